@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // timezone database, for VMs' scaling schedules, which isn't in the image
 
 	"github.com/tychoish/fun/srv"
 	"go.uber.org/zap"
@@ -23,6 +25,15 @@ import (
 // all of the juicy bits are defined in pkg/plugin/
 
 func main() {
+	// validate-config [path] checks the config without starting the scheduler
+	if len(os.Args) >= 2 && os.Args[1] == util.ValidateConfigCommand {
+		path := plugin.DefaultConfigPath
+		if len(os.Args) >= 3 {
+			path = os.Args[2]
+		}
+		os.Exit(util.WriteConfigCheckReport(os.Stdout, path, plugin.CheckConfig(path)))
+	}
+
 	logConfig := zap.NewProductionConfig()
 	logConfig.Sampling = nil // Disable sampling, which the production config enables by default.
 	logger := zap.Must(logConfig.Build()).Named("autoscale-scheduler")
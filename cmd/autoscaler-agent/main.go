@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // timezone database, for .scaling.timeOfDay and VMs' scaling schedules, which isn't in the image
 
 	"github.com/tychoish/fun/srv"
 	"go.uber.org/zap"
@@ -20,6 +22,16 @@ import (
 )
 
 func main() {
+	// validate-config [path] checks the config without starting the agent. The path defaults to
+	// $CONFIG_PATH, as usual.
+	if len(os.Args) >= 2 && os.Args[1] == util.ValidateConfigCommand {
+		path := os.Getenv("CONFIG_PATH")
+		if len(os.Args) >= 3 {
+			path = os.Args[2]
+		}
+		os.Exit(util.WriteConfigCheckReport(os.Stdout, path, agent.CheckConfig(path)))
+	}
+
 	logConfig := zap.NewProductionConfig()
 	logConfig.Sampling = nil                 // Disable sampling, which the production config enables by default.
 	logConfig.Level.SetLevel(zap.DebugLevel) // Allow debug logs
@@ -0,0 +1,97 @@
+package main
+
+// billing-exporter runs the autoscaler-agent's billing collector on its own, either for a single node
+// (as a DaemonSet), or for VMs across the whole cluster (as a Deployment or StatefulSet).
+//
+// It's configured with the following environment variables:
+//
+//   - CONFIG_PATH (required): the path to the billing-exporter's JSON config
+//   - K8S_NODE_NAME: the node to collect billing for. Required if the config sets .perNode.
+//   - BILLING_SHARD: the shard to collect billing for, if the config sets .sharding. Defaults to
+//     the ordinal suffix of the hostname, as for a StatefulSet's pods.
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"k8s.io/client-go/kubernetes"
+	scheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/agent"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func main() {
+	logConfig := zap.NewProductionConfig()
+	logConfig.Sampling = nil // Disable sampling, which the production config enables by default.
+	logger := zap.Must(logConfig.Build()).Named("billing-exporter")
+	defer logger.Sync() //nolint:errcheck // what are we gonna do, log something about it?
+
+	logger.Info("", zap.Any("buildInfo", util.GetBuildInfo()))
+
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		logger.Panic("Missing CONFIG_PATH environment variable")
+	}
+
+	config, err := agent.ReadBillingCollectorConfig(configPath)
+	if err != nil {
+		logger.Panic("Failed to read config", zap.Error(err))
+	}
+	logger.Info("Got config", zap.Any("config", config))
+
+	var nodeName string
+	var shard int
+	if config.PerNode {
+		nodeName = os.Getenv("K8S_NODE_NAME")
+		if nodeName == "" {
+			logger.Panic("Missing K8S_NODE_NAME environment variable, required for .perNode")
+		}
+	} else {
+		shard, err = agent.BillingShardFromEnv(config.ShardCount())
+		if err != nil {
+			logger.Panic("Failed to get billing shard", zap.Error(err))
+		}
+	}
+
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		logger.Panic("Failed to get in-cluster K8s config", zap.Error(err))
+	}
+	kubeClient, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		logger.Panic("Failed to make K8S client", zap.Error(err))
+	}
+	if err = vmapi.AddToScheme(scheme.Scheme); err != nil {
+		logger.Panic("Failed to add NeonVM scheme", zap.Error(err))
+	}
+
+	vmClient, err := vmclient.NewForConfig(kubeConfig)
+	if err != nil {
+		logger.Panic("Failed to make VM client", zap.Error(err))
+	}
+
+	runner := agent.BillingCollectorRunner{
+		Config:     config,
+		ConfigPath: configPath,
+		NodeName:   nodeName,
+		Shard:      shard,
+		KubeClient: kubeClient,
+		VMClient:   vmClient,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer cancel()
+
+	if err := runner.Run(ctx, logger); err != nil {
+		logger.Panic("Billing collector failed", zap.Error(err))
+	}
+	logger.Info("Billing collector returned without issue. Exiting.")
+}
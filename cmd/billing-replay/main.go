@@ -0,0 +1,272 @@
+package main
+
+// billing-replay re-sends billing events that were archived to S3, for backfills after outages of
+// the HTTP collector.
+//
+// Archived objects are expected to be laid out by date, i.e.
+//
+//	<prefix>/year=YYYY/month=MM/day=DD/<name>.ndjson.gz
+//
+// where each object contains newline-delimited JSON billing events, optionally gzip-compressed.
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const dateFormat = "2006-01-02"
+
+type args struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint string
+
+	from time.Time
+	to   time.Time
+
+	collectorURL   string
+	keySuffix      string
+	batchSize      int
+	requestTimeout time.Duration
+	dryRun         bool
+}
+
+func main() {
+	logConfig := zap.NewProductionConfig()
+	logConfig.Sampling = nil // Disable sampling, which the production config enables by default.
+	logger := zap.Must(logConfig.Build()).Named("billing-replay")
+	defer logger.Sync() //nolint:errcheck // what are we gonna do, log something about it?
+
+	logger.Info("", zap.Any("buildInfo", util.GetBuildInfo()))
+
+	a, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	if err := run(ctx, logger, a); err != nil {
+		logger.Fatal("Replay failed", zap.Error(err))
+	}
+}
+
+func parseArgs() (*args, error) {
+	var a args
+	var from, to string
+
+	flag.StringVar(&a.bucket, "bucket", "", "S3 bucket containing the archived events")
+	flag.StringVar(&a.prefix, "prefix", "", "Prefix within the bucket that the archived events are stored under")
+	flag.StringVar(&a.region, "region", "", "AWS region of the bucket. Defaults to the region from the environment")
+	flag.StringVar(&a.endpoint, "endpoint", "", "Custom S3 endpoint, e.g. for S3-compatible storage")
+	flag.StringVar(&from, "from", "", "First day to replay, as YYYY-MM-DD (UTC)")
+	flag.StringVar(&to, "to", "", "Last day to replay, as YYYY-MM-DD (UTC). Defaults to the value of -from")
+	flag.StringVar(&a.collectorURL, "url", "", "Base URL of the billing collector to send the events to")
+	flag.StringVar(&a.keySuffix, "rewrite-keys", "", "If not empty, suffix appended to each event's idempotency key")
+	flag.IntVar(&a.batchSize, "batch-size", 1000, "Maximum number of events to send in a single request")
+	flag.DurationVar(&a.requestTimeout, "request-timeout", 10*time.Second, "Timeout for each request to the collector")
+	flag.BoolVar(&a.dryRun, "dry-run", false, "Read and count the events, without sending them")
+	flag.Parse()
+
+	if a.bucket == "" {
+		return nil, errors.New("missing required flag -bucket")
+	}
+	if a.collectorURL == "" && !a.dryRun {
+		return nil, errors.New("missing required flag -url")
+	}
+	if a.batchSize <= 0 {
+		return nil, fmt.Errorf("-batch-size must be positive, got %d", a.batchSize)
+	}
+	if from == "" {
+		return nil, errors.New("missing required flag -from")
+	}
+	if to == "" {
+		to = from
+	}
+
+	var err error
+	if a.from, err = time.Parse(dateFormat, from); err != nil {
+		return nil, fmt.Errorf("Error parsing -from: %w", err)
+	}
+	if a.to, err = time.Parse(dateFormat, to); err != nil {
+		return nil, fmt.Errorf("Error parsing -to: %w", err)
+	}
+	if a.to.Before(a.from) {
+		return nil, fmt.Errorf("-to (%s) must not be before -from (%s)", to, from)
+	}
+
+	a.prefix = strings.TrimSuffix(a.prefix, "/")
+
+	return &a, nil
+}
+
+func run(ctx context.Context, logger *zap.Logger, a *args) error {
+	var opts []func(*awsconfig.LoadOptions) error
+	if a.region != "" {
+		opts = append(opts, awsconfig.WithRegion(a.region))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("Error loading AWS config: %w", err)
+	}
+
+	s3Client := s3.NewFromConfig(awsConf, func(o *s3.Options) {
+		if a.endpoint != "" {
+			o.BaseEndpoint = aws.String(a.endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	r := replayer{
+		args:      a,
+		s3:        s3Client,
+		collector: billing.NewClient(a.collectorURL, http.DefaultClient),
+		batch:     make([]*billing.IncrementalEvent, 0, a.batchSize),
+		total:     0,
+	}
+
+	for day := a.from; !day.After(a.to); day = day.AddDate(0, 0, 1) {
+		if err := r.replayDay(ctx, logger, day); err != nil {
+			return fmt.Errorf("Error replaying events for %s: %w", day.Format(dateFormat), err)
+		}
+	}
+
+	if err := r.flush(ctx, logger); err != nil {
+		return err
+	}
+
+	logger.Info("Finished replaying events", zap.Int("total", r.total), zap.Bool("dryRun", a.dryRun))
+	return nil
+}
+
+type replayer struct {
+	args      *args
+	s3        *s3.Client
+	collector billing.Client
+
+	batch []*billing.IncrementalEvent
+	total int
+}
+
+func (r *replayer) replayDay(ctx context.Context, logger *zap.Logger, day time.Time) error {
+	prefix := fmt.Sprintf("year=%04d/month=%02d/day=%02d/", day.Year(), day.Month(), day.Day())
+	if r.args.prefix != "" {
+		prefix = fmt.Sprintf("%s/%s", r.args.prefix, prefix)
+	}
+
+	pages := s3.NewListObjectsV2Paginator(r.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.args.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("Error listing objects under %q: %w", prefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			count, err := r.replayObject(ctx, logger, key)
+			if err != nil {
+				return fmt.Errorf("Error replaying object %q: %w", key, err)
+			}
+			logger.Info("Replayed object", zap.String("key", key), zap.Int("events", count))
+		}
+	}
+
+	return nil
+}
+
+func (r *replayer) replayObject(ctx context.Context, logger *zap.Logger, key string) (int, error) {
+	resp, err := r.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.args.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error getting object: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(key, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return 0, fmt.Errorf("Error creating gzip reader: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	count := 0
+	dec := json.NewDecoder(body)
+	for {
+		var event billing.IncrementalEvent
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return count, fmt.Errorf("Error decoding event #%d: %w", count+1, err)
+		}
+
+		if event.Type != "incremental" {
+			return count, fmt.Errorf("Unexpected type %q for event #%d", event.Type, count+1)
+		}
+		if r.args.keySuffix != "" {
+			event.IdempotencyKey = fmt.Sprintf("%s-%s", event.IdempotencyKey, r.args.keySuffix)
+		}
+
+		count += 1
+		r.batch = append(r.batch, &event)
+		if len(r.batch) >= r.args.batchSize {
+			if err := r.flush(ctx, logger); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// flush sends all events in the current batch to the collector
+func (r *replayer) flush(ctx context.Context, logger *zap.Logger) error {
+	if len(r.batch) == 0 {
+		return nil
+	}
+
+	if !r.args.dryRun {
+		traceID := r.collector.GenerateTraceID()
+
+		reqCtx, cancel := context.WithTimeout(ctx, r.args.requestTimeout)
+		defer cancel()
+
+		if err := billing.Send(reqCtx, r.collector, traceID, r.batch); err != nil {
+			return fmt.Errorf("Error sending batch of %d events (traceID %s): %w", len(r.batch), traceID, err)
+		}
+		logger.Info("Sent batch", zap.Int("count", len(r.batch)), zap.String("traceID", string(traceID)))
+	}
+
+	r.total += len(r.batch)
+	r.batch = r.batch[:0]
+	return nil
+}
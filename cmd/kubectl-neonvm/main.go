@@ -0,0 +1,362 @@
+package main
+
+// kubectl-neonvm is a kubectl plugin for inspecting and controlling the autoscaling of VMs.
+//
+// Installed on the PATH, it's run as 'kubectl neonvm'. Usage:
+//
+//	kubectl neonvm status [-n <namespace>] [<vm>]    show each VM's current and goal compute units
+//	kubectl neonvm decisions [-n <namespace>] <vm>   show the autoscaler-agent's recent decisions
+//	kubectl neonvm pin [-n <namespace>] <vm> <cu>    pin the VM at a number of compute units
+//	kubectl neonvm unpin [-n <namespace>] <vm>       go back to scaling the VM from its metrics
+//	kubectl neonvm migrate [-n <namespace>] <vm>     migrate the VM to another node
+//
+// Status and pinning use the VirtualMachine objects directly. Decisions are fetched from the
+// dump-state server of the autoscaler-agent on the VM's node, through the API server's pod proxy.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/agent"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+type args struct {
+	namespace  string
+	kubeconfig string
+
+	agentNamespace string
+	agentSelector  string
+	agentDumpPort  int
+
+	positional []string
+}
+
+type clients struct {
+	kube kubernetes.Interface
+	vm   vmclient.Interface
+}
+
+var commands = map[string]struct {
+	// nargs gives the allowed numbers of positional arguments
+	nargs []int
+	usage string
+	// run runs the command, writing its output to out
+	run func(ctx context.Context, c *clients, a *args, out io.Writer) error
+}{
+	"status":    {nargs: []int{0, 1}, usage: "[<vm>]", run: runStatus},
+	"decisions": {nargs: []int{1}, usage: "<vm>", run: runDecisions},
+	"pin":       {nargs: []int{2}, usage: "<vm> <cu>", run: runPin},
+	"unpin":     {nargs: []int{1}, usage: "<vm>", run: runUnpin},
+	"migrate":   {nargs: []int{1}, usage: "<vm>", run: runMigrate},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	a, err := parseArgs(name, os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if !containsInt(cmd.nargs, len(a.positional)) {
+		fmt.Fprintf(os.Stderr, "usage: kubectl neonvm %s [flags] %s\n", name, cmd.usage)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	c, err := makeClients(a)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(ctx, c, a, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kubectl neonvm <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range []string{"status", "decisions", "pin", "unpin", "migrate"} {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+}
+
+func parseArgs(command string, argv []string) (*args, error) {
+	var a args
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&a.namespace, "n", "", "Namespace of the VMs. Defaults to the namespace of the current context")
+	flags.StringVar(&a.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file. Defaults to the usual kubectl rules")
+	flags.StringVar(&a.agentNamespace, "agent-namespace", "kube-system", "Namespace of the autoscaler-agent pods")
+	flags.StringVar(&a.agentSelector, "agent-selector", "name=autoscaler-agent", "Label selector for the autoscaler-agent pods")
+	flags.IntVar(&a.agentDumpPort, "agent-dump-port", 10300, "Port of the autoscaler-agent's dump-state server")
+
+	// Allow flags to come after the positional arguments, as they can with kubectl.
+	for len(argv) != 0 {
+		if err := flags.Parse(argv); err != nil {
+			return nil, err
+		}
+		argv = flags.Args()
+		if len(argv) != 0 {
+			a.positional = append(a.positional, argv[0])
+			argv = argv[1:]
+		}
+	}
+
+	return &a, nil
+}
+
+func makeClients(a *args) (*clients, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = a.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{} //nolint:exhaustruct // no overrides
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	if a.namespace == "" {
+		namespace, _, err := loader.Namespace()
+		if err != nil {
+			return nil, fmt.Errorf("Error getting namespace from kubeconfig: %w", err)
+		}
+		a.namespace = namespace
+	}
+
+	kubeConfig, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading kubeconfig: %w", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error making K8s client: %w", err)
+	}
+	vmClient, err := vmclient.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error making VM client: %w", err)
+	}
+
+	return &clients{kube: kubeClient, vm: vmClient}, nil
+}
+
+func runStatus(ctx context.Context, c *clients, a *args, out io.Writer) error {
+	var vms []vmapi.VirtualMachine
+	if len(a.positional) == 1 {
+		vm, err := c.vm.NeonvmV1().VirtualMachines(a.namespace).Get(ctx, a.positional[0], metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		vms = append(vms, *vm)
+	} else {
+		list, err := c.vm.NeonvmV1().VirtualMachines(a.namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		vms = list.Items
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tNODE\tAUTOSCALING\tPINNED\tCURRENT CU\tGOAL CU\tLIMIT\tENDPOINT\tREASON")
+	for _, vm := range vms {
+		current, goal, limit, reason := "-", "-", "-", "-"
+		if statusJSON, ok := vm.Annotations[api.AnnotationAutoscalingStatus]; ok {
+			var status api.AutoscalingStatus
+			if err := json.Unmarshal([]byte(statusJSON), &status); err == nil {
+				current = strconv.FormatFloat(status.CurrentCU, 'g', -1, 64)
+				goal = strconv.FormatUint(uint64(status.GoalCU), 10)
+				limit = orDash(status.Limit)
+				reason = orDash(status.Reason)
+			}
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			vm.Name,
+			orDash(vm.Status.Node),
+			api.HasAutoscalingEnabled(&vm),
+			orDash(vm.Annotations[api.AnnotationManualTarget]),
+			current,
+			goal,
+			limit,
+			orDash(vm.Annotations[api.AnnotationBillingEndpointID]),
+			reason,
+		)
+	}
+	return w.Flush()
+}
+
+func runDecisions(ctx context.Context, c *clients, a *args, out io.Writer) error {
+	vm, err := c.vm.NeonvmV1().VirtualMachines(a.namespace).Get(ctx, a.positional[0], metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if vm.Status.Node == "" {
+		return fmt.Errorf("VM %s/%s is not running on a node", vm.Namespace, vm.Name)
+	}
+
+	pods, err := c.kube.CoreV1().Pods(a.agentNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: a.agentSelector,
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", vm.Status.Node),
+	})
+	if err != nil {
+		return fmt.Errorf("Error listing autoscaler-agent pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no autoscaler-agent pod found on node %s", vm.Status.Node)
+	}
+	agentPod := pods.Items[0].Name
+
+	body, err := c.kube.CoreV1().Pods(a.agentNamespace).
+		ProxyGet("http", agentPod, strconv.Itoa(a.agentDumpPort), "/decisions", nil).
+		DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting decisions from autoscaler-agent pod %s: %w", agentPod, err)
+	}
+	var all []agent.VMDecisions
+	if err := json.Unmarshal(body, &all); err != nil {
+		return fmt.Errorf("Error decoding decisions from autoscaler-agent pod %s: %w", agentPod, err)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tOUTCOME\tPREVIOUS CU\tTARGET CU\tSCHEDULER\tLIMIT\tREASON")
+	for _, d := range all {
+		if d.VM.Namespace != vm.Namespace || d.VM.Name != vm.Name {
+			continue
+		}
+		for _, decision := range d.Decisions {
+			reason := decision.Reason
+			if decision.Error != "" {
+				reason = fmt.Sprintf("%s (error: %s)", reason, decision.Error)
+			}
+			fmt.Fprintf(
+				w, "%s\t%s\t%g\t%g\t%s\t%s\t%s\n",
+				decision.Time.Format(time.RFC3339),
+				decision.Outcome,
+				decision.PreviousCU,
+				decision.TargetCU,
+				decision.SchedulerVerdict,
+				orDash(string(decision.Limit)),
+				reason,
+			)
+		}
+	}
+	return w.Flush()
+}
+
+func runPin(ctx context.Context, c *clients, a *args, out io.Writer) error {
+	cu, err := api.ParseManualTarget(a.positional[1])
+	if err != nil {
+		return fmt.Errorf("invalid compute units %q: %w", a.positional[1], err)
+	}
+	return patchManualTarget(ctx, c, out, a.namespace, a.positional[0], strconv.Itoa(int(cu)))
+}
+
+func runUnpin(ctx context.Context, c *clients, a *args, out io.Writer) error {
+	return patchManualTarget(ctx, c, out, a.namespace, a.positional[0], nil)
+}
+
+// patchManualTarget sets the VM's manual target annotation to the value, removing it if value is
+// nil
+func patchManualTarget(ctx context.Context, c *clients, out io.Writer, namespace, name string, value any) error {
+	// Use a merge patch so that it works whether or not the VM already has any annotations
+	patchPayload, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				api.AnnotationManualTarget: value,
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
+	}
+
+	_, err = c.vm.NeonvmV1().VirtualMachines(namespace).
+		Patch(ctx, name, ktypes.MergePatchType, patchPayload, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	if value == nil {
+		fmt.Fprintf(out, "virtualmachine %s/%s unpinned\n", namespace, name)
+	} else {
+		fmt.Fprintf(out, "virtualmachine %s/%s pinned at %s CU\n", namespace, name, value)
+	}
+	return nil
+}
+
+func runMigrate(ctx context.Context, c *clients, a *args, out io.Writer) error {
+	name := a.positional[0]
+	if _, err := c.vm.NeonvmV1().VirtualMachines(a.namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+		return err
+	}
+
+	vmm := &vmapi.VirtualMachineMigration{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-manual-", name),
+			Namespace:    a.namespace,
+		},
+		Spec: vmapi.VirtualMachineMigrationSpec{
+			VmName: name,
+
+			// NeonVM's VirtualMachineMigrationSpec has a bunch of boolean fields that aren't
+			// pointers, so we use the same values as the scheduler plugin.
+			PreventMigrationToSameHost: true,
+			CompletionTimeout:          3600,
+			Incremental:                true,
+			AutoConverge:               true,
+			MaxBandwidth:               resource.MustParse("1Gi"),
+			AllowPostCopy:              false,
+		},
+	}
+
+	created, err := c.vm.NeonvmV1().VirtualMachineMigrations(a.namespace).Create(ctx, vmm, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "virtualmachinemigration %s/%s created\n", created.Namespace, created.Name)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmfake "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned/fake"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func makeVM(name string, node string, annotations map[string]string) *vmapi.VirtualMachine {
+	vm := new(vmapi.VirtualMachine)
+	vm.Namespace = "default"
+	vm.Name = name
+	vm.Annotations = annotations
+	vm.Status.Node = node
+	return vm
+}
+
+// newVMClient returns a fake VM client with the VMs
+//
+// The generated fake client uses the wrong API group for its object tracker, so the VMs can't be
+// given to NewSimpleClientset, and listing them needs its own reactor.
+func newVMClient(t *testing.T, vms ...*vmapi.VirtualMachine) *vmfake.Clientset {
+	client := vmfake.NewSimpleClientset()
+	list := new(vmapi.VirtualMachineList)
+	for _, vm := range vms {
+		_, err := client.NeonvmV1().VirtualMachines(vm.Namespace).Create(context.Background(), vm, metav1.CreateOptions{})
+		require.NoError(t, err)
+		list.Items = append(list.Items, *vm)
+	}
+	client.PrependReactor("list", "virtualmachines", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, list, nil
+	})
+	return client
+}
+
+func testArgs(positional ...string) *args {
+	a, err := parseArgs("test", nil)
+	if err != nil {
+		panic(err)
+	}
+	a.namespace = "default"
+	a.positional = positional
+	return a
+}
+
+func TestParseArgs(t *testing.T) {
+	// Flags can come before or after the positional arguments, like with kubectl
+	a, err := parseArgs("pin", []string{"-n", "ns", "vm", "--agent-dump-port", "1234", "4"})
+	require.NoError(t, err)
+	assert.Equal(t, "ns", a.namespace)
+	assert.Equal(t, 1234, a.agentDumpPort)
+	assert.Equal(t, []string{"vm", "4"}, a.positional)
+	// ... with the defaults for everything else
+	assert.Equal(t, "kube-system", a.agentNamespace)
+	assert.Equal(t, "name=autoscaler-agent", a.agentSelector)
+
+	_, err = parseArgs("pin", []string{"vm", "--unknown"})
+	assert.Error(t, err)
+
+	// The number of positional arguments is checked against each command
+	assert.True(t, containsInt(commands["status"].nargs, 0))
+	assert.True(t, containsInt(commands["status"].nargs, 1))
+	assert.False(t, containsInt(commands["pin"].nargs, 1))
+}
+
+func TestRunStatus(t *testing.T) {
+	status, err := json.Marshal(api.AutoscalingStatus{
+		GoalCU:    4,
+		GrantedCU: 3,
+		CurrentCU: 2.5,
+		Limit:     "scheduler",
+		Reason:    "cpu usage",
+	})
+	require.NoError(t, err)
+	c := &clients{
+		kube: kfake.NewSimpleClientset(),
+		vm: newVMClient(
+			t,
+			makeVM("vm-a", "node-1", map[string]string{
+				api.AnnotationAutoscalingStatus: string(status),
+				api.AnnotationBillingEndpointID: "ep-a",
+				api.AnnotationManualTarget:      "2",
+			}),
+			makeVM("vm-b", "", nil),
+		),
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, runStatus(context.Background(), c, testArgs(), &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"NAME", "NODE", "AUTOSCALING", "PINNED", "CURRENT", "CU", "GOAL", "CU", "LIMIT", "ENDPOINT", "REASON"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"vm-a", "node-1", "false", "2", "2.5", "4", "scheduler", "ep-a", "cpu", "usage"}, strings.Fields(lines[1]))
+	// Everything that's unknown is shown as "-"
+	assert.Equal(t, []string{"vm-b", "-", "false", "-", "-", "-", "-", "-", "-"}, strings.Fields(lines[2]))
+
+	// A single VM can be selected by name
+	out.Reset()
+	require.NoError(t, runStatus(context.Background(), c, testArgs("vm-b"), &out))
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+	assert.Error(t, runStatus(context.Background(), c, testArgs("missing"), &out))
+}
+
+func TestRunPinAndUnpin(t *testing.T) {
+	vmClient := newVMClient(t, makeVM("vm", "node-1", nil))
+	c := &clients{kube: kfake.NewSimpleClientset(), vm: vmClient}
+	ctx := context.Background()
+
+	getTarget := func() (string, bool) {
+		vm, err := vmClient.NeonvmV1().VirtualMachines("default").Get(ctx, "vm", metav1.GetOptions{})
+		require.NoError(t, err)
+		target, ok := vm.Annotations[api.AnnotationManualTarget]
+		return target, ok
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, runPin(ctx, c, testArgs("vm", "4"), &out))
+	assert.Equal(t, "virtualmachine default/vm pinned at 4 CU\n", out.String())
+	target, ok := getTarget()
+	assert.True(t, ok)
+	assert.Equal(t, "4", target)
+
+	// Invalid targets aren't sent to the API server at all
+	assert.Error(t, runPin(ctx, c, testArgs("vm", "lots"), &out))
+	target, _ = getTarget()
+	assert.Equal(t, "4", target)
+
+	out.Reset()
+	require.NoError(t, runUnpin(ctx, c, testArgs("vm"), &out))
+	assert.Equal(t, "virtualmachine default/vm unpinned\n", out.String())
+	_, ok = getTarget()
+	assert.False(t, ok)
+}
+
+func TestRunMigrate(t *testing.T) {
+	vmClient := newVMClient(t, makeVM("vm", "node-1", nil))
+	var created []*vmapi.VirtualMachineMigration
+	vmClient.PrependReactor("create", "virtualmachinemigrations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		vmm := action.(k8stesting.CreateAction).GetObject().(*vmapi.VirtualMachineMigration)
+		created = append(created, vmm)
+		return false, nil, nil
+	})
+	c := &clients{kube: kfake.NewSimpleClientset(), vm: vmClient}
+	ctx := context.Background()
+
+	require.NoError(t, runMigrate(ctx, c, testArgs("vm"), io.Discard))
+	require.Len(t, created, 1)
+	assert.Equal(t, "default", created[0].Namespace)
+	assert.Equal(t, "vm-manual-", created[0].GenerateName)
+	assert.Equal(t, "vm", created[0].Spec.VmName)
+	assert.True(t, created[0].Spec.PreventMigrationToSameHost)
+
+	// Migrations aren't created for VMs that don't exist
+	assert.Error(t, runMigrate(ctx, c, testArgs("missing"), io.Discard))
+	assert.Len(t, created, 1)
+}
+
+// fakeResponse is a restclient.ResponseWrapper that returns a fixed body
+type fakeResponse struct {
+	body []byte
+}
+
+func (r fakeResponse) DoRaw(context.Context) ([]byte, error) {
+	return r.body, nil
+}
+
+func (r fakeResponse) Stream(context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(r.body)), nil
+}
+
+func TestRunDecisions(t *testing.T) {
+	agentPod := &corev1.Pod{ //nolint:exhaustruct // only the metadata is used
+		ObjectMeta: metav1.ObjectMeta{ //nolint:exhaustruct // only the name and labels are used
+			Namespace: "kube-system",
+			Name:      "autoscaler-agent-1",
+			Labels:    map[string]string{"name": "autoscaler-agent"},
+		},
+	}
+	kubeClient := kfake.NewSimpleClientset(agentPod)
+	var proxied []string
+	kubeClient.PrependProxyReactor("pods", func(action k8stesting.Action) (bool, restclient.ResponseWrapper, error) {
+		get := action.(k8stesting.ProxyGetAction)
+		proxied = append(proxied, get.GetName()+":"+get.GetPort()+get.GetPath())
+		// Decisions for every VM on the node are returned, but only the requested VM's are shown
+		return true, fakeResponse{body: []byte(`[
+			{"vm": {"namespace": "default", "name": "vm"}, "decisions": [
+				{"time": "2024-01-01T12:00:00Z", "outcome": "applied", "previousCU": 1, "targetCU": 2,
+					"reason": "cpu usage", "schedulerVerdict": "approved"},
+				{"time": "2024-01-01T12:01:00Z", "outcome": "failed", "previousCU": 2, "targetCU": 4,
+					"reason": "cpu usage", "limit": "scheduler", "schedulerVerdict": "denied", "error": "no room"}
+			]},
+			{"vm": {"namespace": "default", "name": "other"}, "decisions": [
+				{"time": "2024-01-01T12:00:00Z", "outcome": "applied", "previousCU": 1, "targetCU": 8,
+					"reason": "other VM", "schedulerVerdict": "approved"}
+			]}
+		]`)}, nil
+	})
+	c := &clients{
+		kube: kubeClient,
+		vm:   newVMClient(t, makeVM("vm", "node-1", nil), makeVM("stopped", "", nil)),
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, runDecisions(context.Background(), c, testArgs("vm"), &out))
+	assert.Equal(t, []string{"autoscaler-agent-1:10300/decisions"}, proxied)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"2024-01-01T12:00:00Z", "applied", "1", "2", "approved", "-", "cpu", "usage"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"2024-01-01T12:01:00Z", "failed", "2", "4", "denied", "scheduler", "cpu", "usage", "(error:", "no", "room)"}, strings.Fields(lines[2]))
+
+	// VMs that aren't running on a node don't have any decisions to show
+	err := runDecisions(context.Background(), c, testArgs("stopped"), &out)
+	assert.ErrorContains(t, err, "not running on a node")
+}
@@ -0,0 +1,101 @@
+package main
+
+// scaling-simulator runs scenarios through the autoscaler-agent's scaling state machine and prints
+// the decisions that it makes, so that changes to the scaling logic can be checked against known
+// workloads before they're deployed.
+//
+// Usage:
+//
+//	scaling-simulator [-json] [-skip-plugin] <scenario.yaml>...
+//
+// See pkg/agent/core/simulate for the format of scenarios.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core/simulate"
+)
+
+type args struct {
+	json       bool
+	skipPlugin bool
+	files      []string
+}
+
+func main() {
+	a, err := parseArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, file := range a.files {
+		if err := run(a, file); err != nil {
+			log.Fatalf("Error running scenario %q: %s", file, err)
+		}
+	}
+}
+
+func parseArgs() (*args, error) {
+	var a args
+
+	flag.BoolVar(&a.json, "json", false, "Output the decisions as newline-delimited JSON, one line per scenario")
+	flag.BoolVar(&a.skipPlugin, "skip-plugin", false, "Omit requests to the scheduler plugin from the output")
+	flag.Parse()
+
+	a.files = flag.Args()
+	if len(a.files) == 0 {
+		return nil, errors.New("expected at least one scenario file")
+	}
+
+	return &a, nil
+}
+
+func run(a *args, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	scenario, err := simulate.ParseScenario(data)
+	if err != nil {
+		return err
+	}
+
+	result, err := simulate.Run(scenario)
+	if err != nil {
+		return fmt.Errorf("Error running simulation: %w", err)
+	}
+
+	if a.skipPlugin {
+		var decisions []simulate.Decision
+		for _, d := range result.Decisions {
+			if d.Action != simulate.ActionPlugin {
+				decisions = append(decisions, d)
+			}
+		}
+		result.Decisions = decisions
+	}
+
+	if a.json {
+		output := struct {
+			Scenario string `json:"scenario"`
+			*simulate.Result
+		}{
+			Scenario: file,
+			Result:   result,
+		}
+		return json.NewEncoder(os.Stdout).Encode(output)
+	}
+
+	fmt.Printf("%s:\n", file)
+	for _, d := range result.Decisions {
+		fmt.Printf("  %s\n", d)
+	}
+	fmt.Printf("  final: %v vCPU, %v\n\n", result.Final.VCPU, result.Final.Mem)
+	return nil
+}
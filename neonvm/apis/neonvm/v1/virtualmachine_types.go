@@ -20,8 +20,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -49,6 +53,21 @@ const VirtualMachineUsageAnnotation string = "vm.neon.tech/usage"
 // The value of this annotation is always a JSON-encoded VirtualMachineResources object.
 const VirtualMachineResourcesAnnotation string = "vm.neon.tech/resources"
 
+// VirtualMachineTopologyAnnotation is the annotation added to each runner Pod of a VM with
+// .spec.topology, mirroring it so that the scheduler can place the pod.
+//
+// The value of this annotation is always a JSON-encoded VirtualMachineTopology object.
+const VirtualMachineTopologyAnnotation string = "vm.neon.tech/topology"
+
+// VirtualMachineDeletionUnlockedAnnotation is the annotation that must be set to "true" on a
+// VirtualMachine with .spec.deletionProtection before it can be deleted.
+const VirtualMachineDeletionUnlockedAnnotation string = "vm.neon.tech/deletion-unlocked"
+
+// AutoscalingBoundsAnnotation is the annotation on a VirtualMachine that overrides the bounds that
+// the autoscaler-agent scales it within. It's the same as api.AnnotationAutoscalingBounds, which
+// can't be imported here.
+const AutoscalingBoundsAnnotation string = "autoscaling.neon.tech/bounds"
+
 // VirtualMachineUsage provides information about a VM's current usage. This is the type of the
 // JSON-encoded data in the VirtualMachineUsageAnnotation attached to each runner pod.
 type VirtualMachineUsage struct {
@@ -61,6 +80,8 @@ type VirtualMachineResources struct {
 	CPUs           CPUs              `json:"cpus"`
 	MemorySlots    MemorySlots       `json:"memorySlots"`
 	MemorySlotSize resource.Quantity `json:"memorySlotSize"`
+	// PinnedCPUs is the number of host CPUs set aside for the VM's pinned vCPUs, if they are
+	PinnedCPUs uint32 `json:"pinnedCPUs,omitempty"`
 }
 
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
@@ -89,6 +110,36 @@ type VirtualMachineSpec struct {
 	// +optional
 	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds"`
 
+	// GuestTerminationGracePeriodSeconds, if set, is how long the runner waits for the guest to
+	// shut down cleanly after requesting it, before stopping QEMU. It must be less than
+	// TerminationGracePeriodSeconds.
+	//
+	// The guest is first asked to run the VM's shutdown hook (e.g., for postgres to finish a fast
+	// shutdown), and only powered off once that's done.
+	//
+	// If not set, the runner waits for the guest until the pod is killed.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	GuestTerminationGracePeriodSeconds *int64 `json:"guestTerminationGracePeriodSeconds,omitempty"`
+
+	// DeletionProtection, if true, rejects deletion of the VirtualMachine unless it has the
+	// "vm.neon.tech/deletion-unlocked" annotation set to "true".
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+
+	// Paused, if true, stops the guest's vCPUs while keeping its memory, so that an idle VM can be
+	// kept warm without using CPU. Setting it back to false resumes the VM where it left off.
+	//
+	// While paused, the VM's "Paused" status condition is true, and changes to its CPUs or memory
+	// are not applied until it's resumed.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// Topology, if provided, gives where the scheduler should place the VM, relative to
+	// availability zones and other VMs. It also applies to the target of any migration.
+	// +optional
+	Topology *VirtualMachineTopology `json:"topology,omitempty"`
+
 	NodeSelector       map[string]string           `json:"nodeSelector,omitempty"`
 	Affinity           *corev1.Affinity            `json:"affinity,omitempty"`
 	Tolerations        []corev1.Toleration         `json:"tolerations,omitempty"`
@@ -104,6 +155,12 @@ type VirtualMachineSpec struct {
 
 	Guest Guest `json:"guest"`
 
+	// Flavor, if set, gives the name of a VirtualMachineFlavor to take defaults from. Fields that
+	// are not set in this VirtualMachine are filled in from the flavor when the runner pod is
+	// created.
+	// +optional
+	Flavor string `json:"flavor,omitempty"`
+
 	// Running init containers is costly, so InitScript field should be preferred over ExtraInitContainers
 	ExtraInitContainers []corev1.Container `json:"extraInitContainers,omitempty"`
 
@@ -115,10 +172,28 @@ type VirtualMachineSpec struct {
 	// +optional
 	Disks []Disk `json:"disks,omitempty"`
 
+	// SnapshotStorage, if provided, gives the volume that VirtualMachineSnapshots of this VM are
+	// written to, and that disks with .emptyDisk.fromSnapshot are restored from.
+	// +optional
+	SnapshotStorage *SnapshotStorage `json:"snapshotStorage,omitempty"`
+
+	// CloudInit, if provided, attaches a cloud-init drive to the VM, for images that are
+	// configured by cloud-init when they boot.
+	// +optional
+	CloudInit *CloudInit `json:"cloudInit,omitempty"`
+
 	// Extra network interface attached to network provided by Mutlus CNI.
 	// +optional
 	ExtraNetwork *ExtraNetwork `json:"extraNetwork,omitempty"`
 
+	// AdditionalNetworks gives further network interfaces for the VM, each attached to a network
+	// provided by Multus CNI - e.g. a separate network for replication traffic.
+	//
+	// The addresses assigned to the runner pod's interfaces are moved into the VM. The bytes sent
+	// and received on each network are reported separately by the runner.
+	// +optional
+	AdditionalNetworks []AdditionalNetwork `json:"additionalNetworks,omitempty"`
+
 	// +optional
 	ServiceLinks *bool `json:"service_links,omitempty"`
 
@@ -143,6 +218,7 @@ func (spec *VirtualMachineSpec) Resources() VirtualMachineResources {
 		CPUs:           spec.Guest.CPUs,
 		MemorySlots:    spec.Guest.MemorySlots,
 		MemorySlotSize: spec.Guest.MemorySlotSize,
+		PinnedCPUs:     spec.Guest.PinnedCPUs(),
 	}
 }
 
@@ -169,6 +245,20 @@ type Guest struct {
 	MemorySlotSize resource.Quantity `json:"memorySlotSize"`
 	// +optional
 	MemorySlots MemorySlots `json:"memorySlots"`
+	// MemoryProvider gives how memory is hotplugged into the VM. If not set, DIMMSlots is used.
+	// +optional
+	MemoryProvider MemoryProvider `json:"memoryProvider,omitempty"`
+	// CPUPlacement controls which host CPUs the VM's vCPUs run on. If not set, the vCPUs share the
+	// host CPUs with other pods.
+	//
+	// Cannot be updated.
+	// +optional
+	CPUPlacement *CPUPlacement `json:"cpuPlacement,omitempty"`
+	// GPUs gives the host GPUs passed through to the VM, if any. VMs with GPUs can't be migrated.
+	//
+	// Cannot be updated.
+	// +optional
+	GPUs *GPUs `json:"gpus,omitempty"`
 	// +optional
 	RootDisk RootDisk `json:"rootDisk"`
 	// Docker image Entrypoint array replacement.
@@ -270,6 +360,69 @@ type CPUs struct {
 	Max *MilliCPU `json:"max,omitempty"`
 	// +optional
 	Use *MilliCPU `json:"use,omitempty"`
+	// MaxTopology gives the number of vCPUs in the topology that the VM is booted with, which is the
+	// most that can ever be plugged into it. If provided, .max may be changed after the VM is
+	// created, as long as it still fits within this.
+	//
+	// Defaults to .max, rounded up. Cannot be updated.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MaxTopology *int32 `json:"maxTopology,omitempty"`
+}
+
+// CPUPlacement gives how the VM's vCPUs are placed on the host CPUs
+type CPUPlacement struct {
+	// Pinned gives the VM whole host CPUs for its own use, each running one vCPU.
+	//
+	// The runner container gets a whole number of CPUs - .spec.guest.cpus.maxTopology, or else
+	// .spec.guest.cpus.max rounded up - with requests equal to limits, so that the kubelet's static
+	// CPU manager policy gives it exclusive CPUs. The kubelet must be configured with --cpu-manager-policy=static for this to have any
+	// effect, and .spec.podResources must give the runner's memory.
+	// +optional
+	Pinned bool `json:"pinned,omitempty"`
+
+	// SingleNUMANode keeps the vCPUs and the VM's memory on one host NUMA node. Requires Pinned.
+	//
+	// The kubelet's topology manager should be configured with the single-numa-node policy, so
+	// that the CPUs given to the runner are all on one node. Otherwise, only the CPUs on the node
+	// with the most of them are used.
+	// +optional
+	SingleNUMANode bool `json:"singleNUMANode,omitempty"`
+}
+
+// GPUs gives the host GPUs that are passed through to the VM with VFIO
+//
+// The GPUs are given to the runner pod as an extended resource, by a device plugin that binds them
+// to the vfio-pci driver and passes their PCI addresses in the PCI_RESOURCE_<resource name>
+// environment variable (like KubeVirt's device plugins do).
+type GPUs struct {
+	// ResourceName is the name of the extended resource that the device plugin provides the GPUs
+	// as, e.g. "nvidia.com/GA102GL_A10".
+	ResourceName corev1.ResourceName `json:"resourceName"`
+	// Count is the number of GPUs to pass through
+	// +kubebuilder:validation:Minimum=1
+	Count int32 `json:"count"`
+}
+
+// PCIAddressEnvVar returns the name of the environment variable in the runner container that the
+// device plugin sets to the comma-separated PCI addresses of the GPUs
+func (g *GPUs) PCIAddressEnvVar() string {
+	name := strings.ToUpper(string(g.ResourceName))
+	name = strings.ReplaceAll(name, "/", "_")
+	name = strings.ReplaceAll(name, ".", "_")
+	return fmt.Sprintf("PCI_RESOURCE_%s", name)
+}
+
+// PinnedCPUs returns the number of host CPUs set aside for the VM's pinned vCPUs, or zero if the
+// vCPUs aren't pinned
+func (g *Guest) PinnedCPUs() uint32 {
+	if g.CPUPlacement == nil || !g.CPUPlacement.Pinned {
+		return 0
+	}
+	if g.CPUs.MaxTopology != nil {
+		return uint32(*g.CPUs.MaxTopology)
+	}
+	return g.CPUs.Max.RoundedUp()
 }
 
 // MilliCPU is a special type to represent vCPUs * 1000
@@ -340,26 +493,58 @@ func (m MilliCPU) Format(state fmt.State, verb rune) {
 	}
 }
 
+// MemoryProvider is the mechanism used to hotplug memory into a VM
+//
+// +kubebuilder:validation:Enum=DIMMSlots;VirtioMem
+type MemoryProvider string
+
+const (
+	// MemoryProviderDIMMSlots plugs each memory slot as a separate DIMM. This works with any
+	// guest kernel, but there can be at most MaxDIMMSlots slots, and a slot can only be unplugged
+	// once the guest has freed all of it, so large downscales may only partially succeed.
+	MemoryProviderDIMMSlots MemoryProvider = "DIMMSlots"
+	// MemoryProviderVirtioMem resizes a single virtio-mem device, which the guest plugs and
+	// unplugs in small blocks. This allows more and smaller memory slots - down to
+	// VirtioMemBlockSize - but requires a guest kernel with CONFIG_VIRTIO_MEM.
+	MemoryProviderVirtioMem MemoryProvider = "VirtioMem"
+)
+
+// MaxDIMMSlots is the maximum value of .spec.guest.memorySlots.max with the DIMMSlots memory
+// provider
+const MaxDIMMSlots int32 = 128
+
+// VirtioMemBlockSize is the granularity of virtio-mem memory hotplug. With the VirtioMem memory
+// provider, .spec.guest.memorySlotSize must be a multiple of it.
+const VirtioMemBlockSize int64 = 2 << 20 // 2 MiB
+
+// UsesVirtioMem returns whether the VM's memory is hotplugged with virtio-mem, rather than DIMMs
+func (g *Guest) UsesVirtioMem() bool {
+	return g.MemoryProvider == MemoryProviderVirtioMem
+}
+
 type MemorySlots struct {
 	// +kubebuilder:validation:Minimum=1
-	// +kubebuilder:validation:Maximum=128
+	// +kubebuilder:validation:Maximum=1024
 	// +kubebuilder:validation:ExclusiveMaximum=false
 	// +optional
 	// +kubebuilder:default:=1
 	Min *int32 `json:"min"`
 	// +kubebuilder:validation:Minimum=1
-	// +kubebuilder:validation:Maximum=128
+	// +kubebuilder:validation:Maximum=1024
 	// +kubebuilder:validation:ExclusiveMaximum=false
 	// +optional
 	Max *int32 `json:"max,omitempty"`
 	// +kubebuilder:validation:Minimum=1
-	// +kubebuilder:validation:Maximum=128
+	// +kubebuilder:validation:Maximum=1024
 	// +kubebuilder:validation:ExclusiveMaximum=false
 	// +optional
 	Use *int32 `json:"use,omitempty"`
 }
 
 type RootDisk struct {
+	// Image is the image containing the root disk. It is required unless .spec.flavor is set and
+	// the flavor provides an image.
+	// +optional
 	Image string `json:"image"`
 	// +optional
 	Size resource.Quantity `json:"size,omitempty"`
@@ -417,6 +602,48 @@ type Disk struct {
 	MountPath string `json:"mountPath"`
 	// DiskSource represents the location and type of the mounted disk.
 	DiskSource `json:",inline"`
+	// Watch, if provided, makes updates to a configMap or secret disk propagate into the running
+	// VM. Otherwise, its contents are only read when the VM starts.
+	// +optional
+	Watch *DiskWatch `json:"watch,omitempty"`
+}
+
+// SnapshotStorage describes the volume that a VM's disk snapshots are stored on
+type SnapshotStorage struct {
+	// VolumeClaimName is the name of a PersistentVolumeClaim in the VM's namespace. To restore
+	// snapshots into VMs on other nodes, it must support the ReadWriteMany access mode.
+	VolumeClaimName string `json:"volumeClaimName"`
+}
+
+// CloudInitMountPath is the path in the runner pod where the Secret with the VM's cloud-init
+// user-data is mounted, if .spec.cloudInit.userDataSecret is set
+const CloudInitMountPath string = "/vm/cloud-init"
+
+// CloudInitUserDataFile is the name of the file with the user-data, both in CloudInitMountPath and
+// on the cloud-init drive
+const CloudInitUserDataFile string = "user-data"
+
+// CloudInit gives the user-data for a cloud-init drive, in the NoCloud format: an ISO9660 disk
+// labeled "cidata", with the files "user-data" and "meta-data".
+//
+// The meta-data is generated, with .status.cloudInitInstanceID as the instance ID and hostname.
+// It's kept through live migrations, so cloud-init treats the VM as a new instance each time it
+// restarts in a new runner pod, but not when it's migrated.
+type CloudInit struct {
+	// UserData is the user-data, e.g. a #cloud-config document or a shell script
+	// +optional
+	UserData string `json:"userData,omitempty"`
+	// UserDataSecret, if provided, gives the key of a Secret in the VM's namespace to read the
+	// user-data from, instead of UserData
+	// +optional
+	UserDataSecret *corev1.SecretKeySelector `json:"userDataSecret,omitempty"`
+}
+
+type DiskWatch struct {
+	// OnUpdate, if not empty, is a shell command run as root inside the VM after new contents
+	// have been written to the disk's mount path, e.g. to make a server reload its certificates.
+	// +optional
+	OnUpdate string `json:"onUpdate,omitempty"`
 }
 
 type DiskSource struct {
@@ -437,6 +664,13 @@ type EmptyDiskSource struct {
 	Size resource.Quantity `json:"size"`
 	// Discard enables the "discard" mount option for the filesystem
 	Discard bool `json:"discard,omitempty"`
+	// FromSnapshot, if provided, is the name of a VirtualMachineSnapshot in the same namespace
+	// to restore the disk from, instead of starting with an empty filesystem. The snapshot must
+	// include a disk with the same name, and be stored on this VM's .spec.snapshotStorage.
+	//
+	// The restored disk keeps the size it had in the snapshot.
+	// +optional
+	FromSnapshot string `json:"fromSnapshot,omitempty"`
 }
 
 type TmpfsDiskSource struct {
@@ -457,6 +691,79 @@ type ExtraNetwork struct {
 	MultusNetwork string `json:"multusNetwork,omitempty"`
 }
 
+// MaxAdditionalNetworkNameLength is the maximum length of .spec.additionalNetworks[].name, so that
+// the names of the interfaces created for the network fit in the kernel's limit of 15 characters.
+const MaxAdditionalNetworkNameLength = 10
+
+type AdditionalNetwork struct {
+	// Name identifies the network within the VM. It's used to name the network interfaces created
+	// for it, and to report its usage.
+	// +kubebuilder:validation:MaxLength=10
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// Multus Network name specified in network-attachments-definition, as <namespace>/<name>, or
+	// just <name> for a network in the VM's namespace.
+	MultusNetwork string `json:"multusNetwork"`
+}
+
+// PodInterface returns the name of the runner pod's network interface for the network
+func (n *AdditionalNetwork) PodInterface() string {
+	return fmt.Sprintf("nic-%s", n.Name)
+}
+
+// VirtualMachineTopology gives where the scheduler should place a VM, relative to availability
+// zones and other VMs.
+//
+// For example, to keep a replica out of the zones of the other VMs in its group, and preferably in
+// us-east-2a:
+//
+//	topology:
+//	  spreadGroup: ep-example
+//	  requireSpread: true
+//	  preferredZones: [us-east-2a]
+//
+// Zones are only known if the scheduler plugin is configured with the label that nodes'
+// availability zones are in.
+type VirtualMachineTopology struct {
+	// SpreadGroup, if not empty, is shared by the VMs that should be spread across availability
+	// zones, e.g. a primary and its replicas.
+	// +optional
+	SpreadGroup string `json:"spreadGroup,omitempty"`
+	// RequireSpread, if true, forbids placing the VM in a zone that already has another VM from its
+	// spread group. Otherwise, spreading is only preferred.
+	// +optional
+	RequireSpread bool `json:"requireSpread,omitempty"`
+
+	// RequiredZones, if not empty, gives the only availability zones that the VM may be placed in.
+	// +optional
+	RequiredZones []string `json:"requiredZones,omitempty"`
+	// PreferredZones, if not empty, gives the availability zones that the VM should be placed in,
+	// if there's room. They must be a subset of RequiredZones, if that's set.
+	// +optional
+	PreferredZones []string `json:"preferredZones,omitempty"`
+
+	// PreferredArchitectures, if not empty, gives the CPU architectures (as in the
+	// "kubernetes.io/arch" node label) that the VM should be placed on, if there's room. To require
+	// an architecture, use .spec.nodeSelector instead.
+	// +optional
+	PreferredArchitectures []string `json:"preferredArchitectures,omitempty"`
+}
+
+// AllowsZone returns whether the VM may be placed in the zone, according to RequiredZones
+func (t *VirtualMachineTopology) AllowsZone(zone string) bool {
+	return len(t.RequiredZones) == 0 || slices.Contains(t.RequiredZones, zone)
+}
+
+// PrefersZone returns whether the zone is one of the PreferredZones
+func (t *VirtualMachineTopology) PrefersZone(zone string) bool {
+	return slices.Contains(t.PreferredZones, zone)
+}
+
+// PrefersArchitecture returns whether the architecture is one of the PreferredArchitectures
+func (t *VirtualMachineTopology) PrefersArchitecture(arch string) bool {
+	return slices.Contains(t.PreferredArchitectures, arch)
+}
+
 // VirtualMachineStatus defines the observed state of VirtualMachine
 type VirtualMachineStatus struct {
 	// Represents the observations of a VirtualMachine's current state.
@@ -486,14 +793,88 @@ type VirtualMachineStatus struct {
 	ExtraNetMask string `json:"extraNetMask,omitempty"`
 	// +optional
 	Node string `json:"node,omitempty"`
+	// MigratedAt gives the time that the most recent live migration of the VM completed, when Node
+	// was changed to the target node. Usage of the VM is attributed to the source node before this
+	// time, and to the target node after it.
+	// +optional
+	MigratedAt *metav1.Time `json:"migratedAt,omitempty"`
 	// +optional
 	CPUs *MilliCPU `json:"cpus,omitempty"`
 	// +optional
 	MemorySize *resource.Quantity `json:"memorySize,omitempty"`
+	// RootDiskSize gives the current size of the root disk, as seen by QEMU. Increasing
+	// .spec.guest.rootDisk.size grows the disk of a running VM to match.
+	// +optional
+	RootDiskSize *resource.Quantity `json:"rootDiskSize,omitempty"`
 	// +optional
 	SSHSecretName string `json:"sshSecretName,omitempty"`
+	// GuestInfo gives the versions of the software in the guest, as recorded when the VM started.
+	// It is reset whenever the runner pod is recreated.
+	// +optional
+	GuestInfo *GuestInfo `json:"guestInfo,omitempty"`
+	// CloudInitInstanceID is the instance ID on the VM's cloud-init drive, if .spec.cloudInit is
+	// set. It's chosen when the runner pod is created, and kept through live migrations, so that
+	// cloud-init only treats the VM as a new instance when it restarts.
+	// +optional
+	CloudInitInstanceID string `json:"cloudInitInstanceID,omitempty"`
+	// PostgresRestart gives the progress of the most recent coordinated restart of Postgres in the
+	// VM, as requested by the autoscaling.neon.tech/restart-request annotation. It's written by the
+	// autoscaler-agent, and kept when the runner pod is recreated.
+	// +optional
+	PostgresRestart *PostgresRestartStatus `json:"postgresRestart,omitempty"`
+}
+
+// GuestInfo describes the software that a VM's guest is running, so that VMs with outdated images
+// can be found and restarted.
+//
+// All fields are best-effort: they may be empty if the information isn't available, e.g. because
+// the root disk image was built with an older version of vm-builder.
+type GuestInfo struct {
+	// KernelVersion is the release of the guest's Linux kernel, e.g. "6.1.63"
+	// +optional
+	KernelVersion string `json:"kernelVersion,omitempty"`
+	// RootDiskImageID is the ID of the root disk image that the VM was started with, as reported
+	// by the container runtime. This includes the image's digest.
+	// +optional
+	RootDiskImageID string `json:"rootDiskImageID,omitempty"`
+	// VmBuilderVersion is the version of vm-builder that built the root disk image
+	// +optional
+	VmBuilderVersion string `json:"vmBuilderVersion,omitempty"`
+	// Daemons gives the versions of the daemons that vm-builder added to the root disk image, by
+	// name
+	// +optional
+	Daemons map[string]string `json:"daemons,omitempty"`
+}
+
+// PostgresRestartStatus gives the progress of a coordinated restart of Postgres in the VM
+type PostgresRestartStatus struct {
+	// ID is the ID of the restart
+	ID string `json:"id"`
+	// Phase gives the progress of the restart
+	Phase PostgresRestartPhase `json:"phase"`
+	// Message, if not empty, describes the phase, e.g. why the restart is still pending
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Attempts is the number of times that the restart has been attempted
+	Attempts int32 `json:"attempts"`
+	// LastTransitionTime is the time that the status last changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
 }
 
+type PostgresRestartPhase string
+
+const (
+	// PostgresRestartPending means that the restart is waiting to happen, e.g. for the maintenance
+	// window, or to be retried after failing
+	PostgresRestartPending PostgresRestartPhase = "Pending"
+	// PostgresRestartInProgress means that the vm-monitor is currently restarting Postgres
+	PostgresRestartInProgress PostgresRestartPhase = "InProgress"
+	// PostgresRestartSucceeded means that Postgres was restarted
+	PostgresRestartSucceeded PostgresRestartPhase = "Succeeded"
+	// PostgresRestartFailed means that the restart failed, and won't be retried
+	PostgresRestartFailed PostgresRestartPhase = "Failed"
+)
+
 type VmPhase string
 
 const (
@@ -517,6 +898,15 @@ const (
 	VmScaling VmPhase = "Scaling"
 )
 
+// VirtualMachineConditionPaused is the type of the status condition that is true while the VM's
+// vCPUs are stopped because of .spec.paused
+const VirtualMachineConditionPaused string = "Paused"
+
+// IsPaused returns whether the VM's vCPUs are currently stopped because of .spec.paused
+func (vm *VirtualMachine) IsPaused() bool {
+	return meta.IsStatusConditionTrue(vm.Status.Conditions, VirtualMachineConditionPaused)
+}
+
 // IsAlive returns whether the guest in the VM is expected to be running
 func (p VmPhase) IsAlive() bool {
 	switch p {
@@ -556,6 +946,8 @@ func (vm *VirtualMachine) Cleanup() {
 	vm.Status.Node = ""
 	vm.Status.CPUs = nil
 	vm.Status.MemorySize = nil
+	vm.Status.GuestInfo = nil
+	vm.Status.CloudInitInstanceID = ""
 }
 
 func (vm *VirtualMachine) HasRestarted() bool {
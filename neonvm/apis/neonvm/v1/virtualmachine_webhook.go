@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -26,6 +27,8 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -69,7 +72,7 @@ func (r *VirtualMachine) Default() {
 	}
 }
 
-//+kubebuilder:webhook:path=/validate-vm-neon-tech-v1-virtualmachine,mutating=false,failurePolicy=fail,sideEffects=None,groups=vm.neon.tech,resources=virtualmachines,verbs=create;update,versions=v1,name=vvirtualmachine.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-vm-neon-tech-v1-virtualmachine,mutating=false,failurePolicy=fail,sideEffects=None,groups=vm.neon.tech,resources=virtualmachines,verbs=create;update;delete,versions=v1,name=vvirtualmachine.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &VirtualMachine{}
 
@@ -92,6 +95,10 @@ func (r *VirtualMachine) ValidateCreate() error {
 		}
 	}
 
+	if err := r.validateCPUTopology(); err != nil {
+		return err
+	}
+
 	// validate .spec.guest.memorySlots.use and .spec.guest.memorySlots.max
 	if r.Spec.Guest.MemorySlots.Use != nil {
 		if r.Spec.Guest.MemorySlots.Max == nil {
@@ -109,6 +116,23 @@ func (r *VirtualMachine) ValidateCreate() error {
 		}
 	}
 
+	if err := r.validateMemoryProvider(); err != nil {
+		return err
+	}
+
+	if err := r.validateCPUPlacement(); err != nil {
+		return err
+	}
+
+	if r.Spec.Guest.GPUs != nil && r.Spec.Guest.GPUs.ResourceName == "" {
+		return errors.New(".spec.guest.gpus.resourceName must be defined if .spec.guest.gpus is specified")
+	}
+
+	// validate .spec.guest.rootDisk.image
+	if r.Spec.Guest.RootDisk.Image == "" && r.Spec.Flavor == "" {
+		return errors.New(".spec.guest.rootDisk.image must be defined if .spec.flavor is not specified")
+	}
+
 	// validate .spec.disk names
 	reservedDiskNames := []string{
 		"virtualmachineimages",
@@ -120,6 +144,8 @@ func (r *VirtualMachine) ValidateCreate() error {
 		"ssh-privatekey",
 		"ssh-publickey",
 		"ssh-authorized-keys",
+		"snapshots",
+		"cloud-init",
 	}
 	for _, disk := range r.Spec.Disks {
 		if slices.Contains(reservedDiskNames, disk.Name) {
@@ -128,6 +154,23 @@ func (r *VirtualMachine) ValidateCreate() error {
 		if len(disk.Name) > 32 {
 			return fmt.Errorf("disk name '%s' too long, should be less than or equal to 32", disk.Name)
 		}
+		if disk.Watch != nil && disk.ConfigMap == nil && disk.Secret == nil {
+			return fmt.Errorf("disk '%s' has .watch set, but only configMap and secret disks can be watched", disk.Name)
+		}
+		if disk.EmptyDisk != nil && disk.EmptyDisk.FromSnapshot != "" && r.Spec.SnapshotStorage == nil {
+			return fmt.Errorf("disk '%s' has .emptyDisk.fromSnapshot set, but .spec.snapshotStorage is not defined", disk.Name)
+		}
+	}
+
+	// validate .spec.cloudInit
+	if cloudInit := r.Spec.CloudInit; cloudInit != nil {
+		if (cloudInit.UserData == "") == (cloudInit.UserDataSecret == nil) {
+			return errors.New("exactly one of .spec.cloudInit.userData and .spec.cloudInit.userDataSecret must be set")
+		}
+	}
+
+	if err := r.validateAdditionalNetworks(); err != nil {
+		return err
 	}
 
 	// validate .spec.guest.ports[].name
@@ -137,6 +180,14 @@ func (r *VirtualMachine) ValidateCreate() error {
 		}
 	}
 
+	if err := r.validateGuestTerminationGracePeriod(); err != nil {
+		return err
+	}
+
+	if err := r.validateTopology(); err != nil {
+		return err
+	}
+
 	// validate that at most one type of swap is provided:
 	if settings := r.Spec.Guest.Settings; settings != nil {
 		if settings.Swap != nil && settings.SwapInfo != nil {
@@ -157,11 +208,27 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
 		getter    func(*VirtualMachine) any
 	}{
 		{".spec.guest.cpus.min", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Min }},
-		{".spec.guest.cpus.max", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Max }},
+		{".spec.guest.cpus.maxTopology", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.MaxTopology }},
+		{".spec.guest.cpus.max", func(v *VirtualMachine) any {
+			// With a separate maximum topology, the maximum may change, as long as it still fits.
+			// That's checked below.
+			if v.Spec.Guest.CPUs.MaxTopology != nil {
+				return nil
+			}
+			return v.Spec.Guest.CPUs.Max
+		}},
 		{".spec.guest.memorySlots.min", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Min }},
 		{".spec.guest.memorySlots.max", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Max }},
+		{".spec.guest.memoryProvider", func(v *VirtualMachine) any { return v.Spec.Guest.MemoryProvider }},
+		{".spec.guest.cpuPlacement", func(v *VirtualMachine) any { return v.Spec.Guest.CPUPlacement }},
+		{".spec.guest.gpus", func(v *VirtualMachine) any { return v.Spec.Guest.GPUs }},
 		{".spec.guest.ports", func(v *VirtualMachine) any { return v.Spec.Guest.Ports }},
-		{".spec.guest.rootDisk", func(v *VirtualMachine) any { return v.Spec.Guest.RootDisk }},
+		{".spec.guest.rootDisk", func(v *VirtualMachine) any {
+			// The size may increase, to grow the disk. That's checked below.
+			rootDisk := v.Spec.Guest.RootDisk
+			rootDisk.Size = resource.Quantity{}
+			return rootDisk
+		}},
 		{".spec.guest.command", func(v *VirtualMachine) any { return v.Spec.Guest.Command }},
 		{".spec.guest.args", func(v *VirtualMachine) any { return v.Spec.Guest.Args }},
 		{".spec.guest.env", func(v *VirtualMachine) any { return v.Spec.Guest.Env }},
@@ -176,6 +243,9 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
 		}},
 		{".spec.disks", func(v *VirtualMachine) any { return v.Spec.Disks }},
 		{".spec.podResources", func(v *VirtualMachine) any { return v.Spec.PodResources }},
+		{".spec.snapshotStorage", func(v *VirtualMachine) any { return v.Spec.SnapshotStorage }},
+		{".spec.cloudInit", func(v *VirtualMachine) any { return v.Spec.CloudInit }},
+		{".spec.additionalNetworks", func(v *VirtualMachine) any { return v.Spec.AdditionalNetworks }},
 		{".spec.enableAcceleration", func(v *VirtualMachine) any { return v.Spec.EnableAcceleration }},
 		{".spec.enableSSH", func(v *VirtualMachine) any { return v.Spec.EnableSSH }},
 		{".spec.initScript", func(v *VirtualMachine) any { return v.Spec.InitScript }},
@@ -187,6 +257,11 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
 		}
 	}
 
+	// validate .spec.guest.rootDisk.size, which may only increase
+	if r.Spec.Guest.RootDisk.Size.Cmp(before.Spec.Guest.RootDisk.Size) < 0 {
+		return errors.New(".spec.guest.rootDisk.size cannot be decreased")
+	}
+
 	// validate swap changes by comparing the SwapInfo for each.
 	//
 	// If there's an error with the old object, but NOT an error with the new one, we'll allow the
@@ -225,6 +300,10 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
 		}
 	}
 
+	if err := r.validateCPUTopology(); err != nil {
+		return err
+	}
+
 	// validate .spec.guest.memorySlots.use
 	if r.Spec.Guest.MemorySlots.Use != nil {
 		if *r.Spec.Guest.MemorySlots.Use < *r.Spec.Guest.MemorySlots.Min {
@@ -239,11 +318,161 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
 		}
 	}
 
+	if err := r.validateTopology(); err != nil {
+		return err
+	}
+
+	return r.validateGuestTerminationGracePeriod()
+}
+
+// validateCPUTopology checks that the maximum CPUs, including the maximum in the VM's autoscaling
+// bounds, fit within the topology that the VM is booted with, if it's set separately
+func (r *VirtualMachine) validateCPUTopology() error {
+	cpus := r.Spec.Guest.CPUs
+	if cpus.MaxTopology == nil {
+		return nil
+	}
+
+	if *cpus.MaxTopology < 1 {
+		return fmt.Errorf(".spec.guest.cpus.maxTopology (%d) should be at least 1", *cpus.MaxTopology)
+	}
+	if cpus.Max != nil && cpus.Max.RoundedUp() > uint32(*cpus.MaxTopology) {
+		return fmt.Errorf(".spec.guest.cpus.max (%v) should fit within the .spec.guest.cpus.maxTopology (%d)",
+			cpus.Max,
+			*cpus.MaxTopology)
+	}
+
+	// The autoscaler-agent scales the VM up to the maximum in the bounds annotation if there is
+	// one, so that has to fit as well.
+	if boundsJSON, ok := r.Annotations[AutoscalingBoundsAnnotation]; ok {
+		var bounds struct {
+			Max struct {
+				CPU resource.Quantity `json:"cpu"`
+			} `json:"max"`
+		}
+		if err := json.Unmarshal([]byte(boundsJSON), &bounds); err != nil {
+			return fmt.Errorf("annotation %q is not valid JSON: %w", AutoscalingBoundsAnnotation, err)
+		}
+		if maxCPU := MilliCPUFromResourceQuantity(bounds.Max.CPU); maxCPU.RoundedUp() > uint32(*cpus.MaxTopology) {
+			return fmt.Errorf("max CPU in annotation %q (%v) should fit within the .spec.guest.cpus.maxTopology (%d)",
+				AutoscalingBoundsAnnotation,
+				maxCPU,
+				*cpus.MaxTopology)
+		}
+	}
+	return nil
+}
+
+// validateCPUPlacement checks that the VM's pod can be given the CPUs for its pinned vCPUs, if it
+// has them
+func (r *VirtualMachine) validateCPUPlacement() error {
+	placement := r.Spec.Guest.CPUPlacement
+	if placement == nil {
+		return nil
+	}
+
+	if placement.SingleNUMANode && !placement.Pinned {
+		return errors.New(".spec.guest.cpuPlacement.singleNUMANode requires .spec.guest.cpuPlacement.pinned")
+	}
+	if placement.Pinned {
+		// The runner's memory must be set so that its pod has Guaranteed QoS.
+		_, hasRequest := r.Spec.PodResources.Requests[corev1.ResourceMemory]
+		_, hasLimit := r.Spec.PodResources.Limits[corev1.ResourceMemory]
+		if !hasRequest && !hasLimit {
+			return errors.New(".spec.podResources must give the runner's memory if .spec.guest.cpuPlacement.pinned is set")
+		}
+	}
+	return nil
+}
+
+// validateMemoryProvider checks .spec.guest.memorySlots and .spec.guest.memorySlotSize for the
+// memory provider
+func (r *VirtualMachine) validateMemoryProvider() error {
+	if r.Spec.Guest.UsesVirtioMem() {
+		if r.Spec.Guest.MemorySlotSize.Value()%VirtioMemBlockSize != 0 {
+			return fmt.Errorf(".spec.guest.memorySlotSize (%s) must be a multiple of %d bytes with the %s memory provider",
+				r.Spec.Guest.MemorySlotSize.String(),
+				VirtioMemBlockSize,
+				MemoryProviderVirtioMem)
+		}
+	} else if r.Spec.Guest.MemorySlots.Max != nil && *r.Spec.Guest.MemorySlots.Max > MaxDIMMSlots {
+		return fmt.Errorf(".spec.guest.memorySlots.max (%d) must be at most %d with the %s memory provider",
+			*r.Spec.Guest.MemorySlots.Max,
+			MaxDIMMSlots,
+			MemoryProviderDIMMSlots)
+	}
+	return nil
+}
+
+// validateAdditionalNetworks checks that the names of .spec.additionalNetworks can be used for the
+// VM's network interfaces, and to report their usage
+func (r *VirtualMachine) validateAdditionalNetworks() error {
+	seen := make(map[string]struct{})
+	for _, network := range r.Spec.AdditionalNetworks {
+		if network.Name == "" || len(network.Name) > MaxAdditionalNetworkNameLength {
+			return fmt.Errorf(".spec.additionalNetworks[].name '%s' must be between 1 and %d characters", network.Name, MaxAdditionalNetworkNameLength)
+		}
+		// The usage of the pod network is reported as "default"
+		if network.Name == "default" {
+			return errors.New("'default' is reserved for .spec.additionalNetworks[].name")
+		}
+		if _, ok := seen[network.Name]; ok {
+			return fmt.Errorf(".spec.additionalNetworks[].name '%s' is not unique", network.Name)
+		}
+		seen[network.Name] = struct{}{}
+	}
+	return nil
+}
+
+// validateTopology checks .spec.topology, which may be changed at any time. Changes only affect
+// where the VM is placed the next time its pod is scheduled.
+func (r *VirtualMachine) validateTopology() error {
+	topology := r.Spec.Topology
+	if topology == nil {
+		return nil
+	}
+
+	if topology.RequireSpread && topology.SpreadGroup == "" {
+		return errors.New(".spec.topology.spreadGroup must be set if .spec.topology.requireSpread is true")
+	}
+	for i, zone := range topology.RequiredZones {
+		if zone == "" {
+			return fmt.Errorf(".spec.topology.requiredZones[%d] must not be empty", i)
+		}
+	}
+	for i, zone := range topology.PreferredZones {
+		if zone == "" {
+			return fmt.Errorf(".spec.topology.preferredZones[%d] must not be empty", i)
+		}
+		if !topology.AllowsZone(zone) {
+			return fmt.Errorf(".spec.topology.preferredZones[%d] (%s) must be one of .spec.topology.requiredZones", i, zone)
+		}
+	}
+	for i, arch := range topology.PreferredArchitectures {
+		if arch == "" {
+			return fmt.Errorf(".spec.topology.preferredArchitectures[%d] must not be empty", i)
+		}
+	}
+	return nil
+}
+
+// validateGuestTerminationGracePeriod checks that the runner has time to stop QEMU itself after
+// the guest's grace period expires, before the pod is killed
+func (r *VirtualMachine) validateGuestTerminationGracePeriod() error {
+	guestGrace := r.Spec.GuestTerminationGracePeriodSeconds
+	podGrace := r.Spec.TerminationGracePeriodSeconds
+	if guestGrace != nil && podGrace != nil && *guestGrace >= *podGrace {
+		return fmt.Errorf(".spec.guestTerminationGracePeriodSeconds (%d) should be less than .spec.terminationGracePeriodSeconds (%d)",
+			*guestGrace, *podGrace)
+	}
 	return nil
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *VirtualMachine) ValidateDelete() error {
-	// No deletion validation required currently.
+	if r.Spec.DeletionProtection && r.Annotations[VirtualMachineDeletionUnlockedAnnotation] != "true" {
+		return fmt.Errorf("VirtualMachine has .spec.deletionProtection set; annotation %q must be set to \"true\" before deleting it",
+			VirtualMachineDeletionUnlockedAnnotation)
+	}
 	return nil
 }
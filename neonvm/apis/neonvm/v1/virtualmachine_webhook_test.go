@@ -0,0 +1,384 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestValidateDelete(t *testing.T) {
+	cases := []struct {
+		name        string
+		protected   bool
+		annotations map[string]string
+		err         bool
+	}{
+		{name: "unprotected", protected: false, annotations: nil, err: false},
+		{name: "protected", protected: true, annotations: nil, err: true},
+		{
+			name:        "protected-unlocked",
+			protected:   true,
+			annotations: map[string]string{VirtualMachineDeletionUnlockedAnnotation: "true"},
+			err:         false,
+		},
+		{
+			name:        "protected-unlock-not-true",
+			protected:   true,
+			annotations: map[string]string{VirtualMachineDeletionUnlockedAnnotation: "yes"},
+			err:         true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.DeletionProtection = c.protected
+			vm.Annotations = c.annotations
+
+			err := vm.ValidateDelete()
+			if c.err {
+				assert.ErrorContains(t, err, VirtualMachineDeletionUnlockedAnnotation)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateGuestTerminationGracePeriod(t *testing.T) {
+	int64Ptr := func(n int64) *int64 { return &n }
+
+	cases := []struct {
+		name       string
+		guestGrace *int64
+		podGrace   *int64
+		err        bool
+	}{
+		{name: "unset", guestGrace: nil, podGrace: int64Ptr(5), err: false},
+		{name: "less", guestGrace: int64Ptr(4), podGrace: int64Ptr(5), err: false},
+		{name: "zero", guestGrace: int64Ptr(0), podGrace: int64Ptr(5), err: false},
+		{name: "equal", guestGrace: int64Ptr(5), podGrace: int64Ptr(5), err: true},
+		{name: "greater", guestGrace: int64Ptr(10), podGrace: int64Ptr(5), err: true},
+		{name: "no-pod-grace", guestGrace: int64Ptr(10), podGrace: nil, err: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.GuestTerminationGracePeriodSeconds = c.guestGrace
+			vm.Spec.TerminationGracePeriodSeconds = c.podGrace
+
+			err := vm.validateGuestTerminationGracePeriod()
+			if c.err {
+				assert.ErrorContains(t, err, ".spec.guestTerminationGracePeriodSeconds")
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// The same check applies when the VM is updated
+			before := vm.DeepCopy()
+			before.Spec.GuestTerminationGracePeriodSeconds = nil
+			err = vm.ValidateUpdate(before)
+			if c.err {
+				assert.ErrorContains(t, err, ".spec.guestTerminationGracePeriodSeconds")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateCPUTopology(t *testing.T) {
+	int32Ptr := func(n int32) *int32 { return &n }
+	milliCPUPtr := func(m MilliCPU) *MilliCPU { return &m }
+	strPtr := func(s string) *string { return &s }
+
+	cases := []struct {
+		name     string
+		max      *MilliCPU
+		topology *int32
+		bounds   *string
+		err      string
+	}{
+		{name: "no-topology", max: milliCPUPtr(8000), topology: nil, bounds: nil, err: ""},
+		{name: "max-fits", max: milliCPUPtr(3500), topology: int32Ptr(4), bounds: nil, err: ""},
+		{name: "max-too-large", max: milliCPUPtr(4250), topology: int32Ptr(4), bounds: nil, err: ".spec.guest.cpus.max"},
+		{name: "topology-zero", max: nil, topology: int32Ptr(0), bounds: nil, err: "at least 1"},
+		{
+			name:     "bounds-fit",
+			max:      milliCPUPtr(2000),
+			topology: int32Ptr(8),
+			bounds:   strPtr(`{"min":{"cpu":"250m","mem":"1Gi"},"max":{"cpu":"8","mem":"32Gi"}}`),
+			err:      "",
+		},
+		{
+			name:     "bounds-too-large",
+			max:      milliCPUPtr(2000),
+			topology: int32Ptr(8),
+			bounds:   strPtr(`{"min":{"cpu":"250m","mem":"1Gi"},"max":{"cpu":"8500m","mem":"32Gi"}}`),
+			err:      AutoscalingBoundsAnnotation,
+		},
+		{
+			name:     "bounds-invalid",
+			max:      milliCPUPtr(2000),
+			topology: int32Ptr(8),
+			bounds:   strPtr(`{"max":`),
+			err:      "not valid JSON",
+		},
+		{
+			// Without a separate topology, the bounds are only checked by the autoscaler-agent
+			name:     "bounds-without-topology",
+			max:      milliCPUPtr(2000),
+			topology: nil,
+			bounds:   strPtr(`{"max":`),
+			err:      "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.Guest.CPUs.Max = c.max
+			vm.Spec.Guest.CPUs.MaxTopology = c.topology
+			if c.bounds != nil {
+				vm.Annotations = map[string]string{AutoscalingBoundsAnnotation: *c.bounds}
+			}
+
+			err := vm.validateCPUTopology()
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateRootDiskResize(t *testing.T) {
+	cases := []struct {
+		name   string
+		before string
+		after  string
+		image  string
+		err    string
+	}{
+		{name: "unchanged", before: "1Gi", after: "1Gi", image: "", err: ""},
+		{name: "grow", before: "1Gi", after: "2Gi", image: "", err: ""},
+		{name: "grow-from-unset", before: "", after: "2Gi", image: "", err: ""},
+		{name: "shrink", before: "2Gi", after: "1Gi", image: "", err: ".spec.guest.rootDisk.size cannot be decreased"},
+		// The rest of the root disk still can't change
+		{name: "image", before: "1Gi", after: "2Gi", image: "other", err: ".spec.guest.rootDisk"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := new(VirtualMachine)
+			if c.before != "" {
+				before.Spec.Guest.RootDisk.Size = resource.MustParse(c.before)
+			}
+			vm := before.DeepCopy()
+			vm.Spec.Guest.RootDisk.Size = resource.MustParse(c.after)
+			vm.Spec.Guest.RootDisk.Image = c.image
+
+			err := vm.ValidateUpdate(before)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateTopology(t *testing.T) {
+	cases := []struct {
+		name     string
+		topology *VirtualMachineTopology
+		err      string
+	}{
+		{name: "unset", topology: nil, err: ""},
+		{
+			name: "valid",
+			topology: &VirtualMachineTopology{
+				SpreadGroup:            "ep-example",
+				RequireSpread:          true,
+				RequiredZones:          []string{"zone-a", "zone-b"},
+				PreferredZones:         []string{"zone-a"},
+				PreferredArchitectures: []string{"arm64"},
+			},
+			err: "",
+		},
+		{
+			name:     "spread-without-group",
+			topology: &VirtualMachineTopology{RequireSpread: true}, //nolint:exhaustruct // only the spread matters
+			err:      ".spec.topology.spreadGroup",
+		},
+		{
+			name:     "empty-required-zone",
+			topology: &VirtualMachineTopology{RequiredZones: []string{""}}, //nolint:exhaustruct // only the zones matter
+			err:      ".spec.topology.requiredZones[0]",
+		},
+		{
+			name: "preferred-zone-not-required",
+			topology: &VirtualMachineTopology{ //nolint:exhaustruct // only the zones matter
+				RequiredZones:  []string{"zone-a"},
+				PreferredZones: []string{"zone-a", "zone-b"},
+			},
+			err: ".spec.topology.preferredZones[1]",
+		},
+		{
+			name:     "empty-preferred-architecture",
+			topology: &VirtualMachineTopology{PreferredArchitectures: []string{""}}, //nolint:exhaustruct // only the architectures matter
+			err:      ".spec.topology.preferredArchitectures[0]",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.Topology = c.topology
+
+			err := vm.validateTopology()
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// The topology may change, but only to something valid
+			before := vm.DeepCopy()
+			before.Spec.Topology = nil
+			err = vm.ValidateUpdate(before)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateCPUPlacement(t *testing.T) {
+	memory := corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+
+	cases := []struct {
+		name      string
+		placement *CPUPlacement
+		resources corev1.ResourceRequirements
+		err       string
+	}{
+		{
+			name:      "unset",
+			placement: nil,
+			resources: corev1.ResourceRequirements{},
+			err:       "",
+		},
+		{
+			name:      "pinned",
+			placement: &CPUPlacement{Pinned: true, SingleNUMANode: true},
+			resources: corev1.ResourceRequirements{Limits: memory},
+			err:       "",
+		},
+		{
+			name:      "pinned-memory-request",
+			placement: &CPUPlacement{Pinned: true, SingleNUMANode: false},
+			resources: corev1.ResourceRequirements{Requests: memory},
+			err:       "",
+		},
+		{
+			name:      "pinned-without-memory",
+			placement: &CPUPlacement{Pinned: true, SingleNUMANode: false},
+			resources: corev1.ResourceRequirements{},
+			err:       ".spec.podResources",
+		},
+		{
+			name:      "single-numa-node-without-pinned",
+			placement: &CPUPlacement{Pinned: false, SingleNUMANode: true},
+			resources: corev1.ResourceRequirements{Limits: memory},
+			err:       ".spec.guest.cpuPlacement.singleNUMANode",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.Guest.CPUPlacement = c.placement
+			vm.Spec.PodResources = c.resources
+
+			err := vm.validateCPUPlacement()
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPinnedCPUs(t *testing.T) {
+	maxCPU := MilliCPU(2500)
+	maxTopology := int32(4)
+
+	guest := func(placement *CPUPlacement, topology *int32) *Guest {
+		g := new(Guest)
+		g.CPUs.Max = &maxCPU
+		g.CPUs.MaxTopology = topology
+		g.CPUPlacement = placement
+		return g
+	}
+
+	assert.Equal(t, uint32(0), guest(nil, nil).PinnedCPUs())
+	assert.Equal(t, uint32(0), guest(&CPUPlacement{Pinned: false, SingleNUMANode: false}, nil).PinnedCPUs())
+	// Without a larger topology, the maximum vCPUs are rounded up to whole host CPUs
+	assert.Equal(t, uint32(3), guest(&CPUPlacement{Pinned: true, SingleNUMANode: false}, nil).PinnedCPUs())
+	assert.Equal(t, uint32(4), guest(&CPUPlacement{Pinned: true, SingleNUMANode: false}, &maxTopology).PinnedCPUs())
+}
+
+func TestGPUsPCIAddressEnvVar(t *testing.T) {
+	gpus := &GPUs{ResourceName: "nvidia.com/GA102GL_A10", Count: 1}
+	assert.Equal(t, "PCI_RESOURCE_NVIDIA_COM_GA102GL_A10", gpus.PCIAddressEnvVar())
+}
+
+func TestValidateAdditionalNetworks(t *testing.T) {
+	network := func(name string) AdditionalNetwork {
+		return AdditionalNetwork{Name: name, MultusNetwork: "default/" + name}
+	}
+
+	cases := []struct {
+		name     string
+		networks []AdditionalNetwork
+		err      string
+	}{
+		{name: "none", networks: nil, err: ""},
+		{name: "valid", networks: []AdditionalNetwork{network("repl"), network("backup")}, err: ""},
+		{name: "empty", networks: []AdditionalNetwork{network("")}, err: "must be between 1 and 10 characters"},
+		{name: "too-long", networks: []AdditionalNetwork{network("replication")}, err: "must be between 1 and 10 characters"},
+		{name: "reserved", networks: []AdditionalNetwork{network("default")}, err: "'default' is reserved"},
+		{name: "duplicate", networks: []AdditionalNetwork{network("repl"), network("repl")}, err: "is not unique"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := new(VirtualMachine)
+			vm.Spec.AdditionalNetworks = c.networks
+
+			err := vm.validateAdditionalNetworks()
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// The longest allowed name still fits in the kernel's limit for interface names
+	longest := network("abcdefghij")
+	vm := new(VirtualMachine)
+	vm.Spec.AdditionalNetworks = []AdditionalNetwork{longest}
+	assert.NoError(t, vm.validateAdditionalNetworks())
+	assert.Equal(t, "nic-abcdefghij", longest.PodInterface())
+	assert.LessOrEqual(t, len(longest.PodInterface()), 15)
+}
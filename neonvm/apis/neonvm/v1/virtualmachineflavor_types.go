@@ -0,0 +1,156 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FlavorSpecAnnotation is the annotation added to the runner Pod of each VirtualMachine that
+// references a flavor, recording the flavor's spec as of when the pod was created.
+//
+// Migration target pods are built from the recorded spec rather than the flavor's current spec, so
+// that the VM is migrated like-for-like even if the flavor was edited after the VM started.
+//
+// The value of this annotation is always a JSON-encoded VirtualMachineFlavorSpec object.
+const FlavorSpecAnnotation string = "vm.neon.tech/flavor-spec"
+
+// VirtualMachineFlavorSpec defines the spec fragments shared by all VirtualMachines referencing
+// the flavor
+//
+// All fields are optional. When a VirtualMachine references a flavor, any of these fields that
+// the VirtualMachine does not set itself are taken from the flavor when its runner pod is created.
+// So changes to a flavor apply to each VM the next time it is (re)started.
+//
+// Fields that are read from the VirtualMachine before its runner pod exists - by the controller
+// (like .spec.extraNetwork, whose address is allocated first) or by the autoscaler-agent and
+// scheduler (like the memory slot size) - can't be filled in this way.
+type VirtualMachineFlavorSpec struct {
+	// Override for normal neonvm-runner image
+	// +optional
+	RunnerImage *string `json:"runnerImage,omitempty"`
+
+	// +optional
+	KernelImage *string `json:"kernelImage,omitempty"`
+
+	// +optional
+	AppendKernelCmdline *string `json:"appendKernelCmdline,omitempty"`
+
+	// +optional
+	RootDisk *FlavorRootDisk `json:"rootDisk,omitempty"`
+
+	// +optional
+	ComputeUnit *FlavorComputeUnit `json:"computeUnit,omitempty"`
+
+	// AdditionalNetworks is used for VMs that don't set .spec.additionalNetworks
+	// +optional
+	AdditionalNetworks []AdditionalNetwork `json:"additionalNetworks,omitempty"`
+
+	// +optional
+	ServiceLinks *bool `json:"service_links,omitempty"`
+}
+
+type FlavorRootDisk struct {
+	// +optional
+	Image string `json:"image,omitempty"`
+	// +optional
+	Size resource.Quantity `json:"size,omitempty"`
+}
+
+// FlavorComputeUnit gives the class of compute unit for VMs of the flavor: the amount of memory
+// that comes with each CPU, and how that memory is provided.
+type FlavorComputeUnit struct {
+	// MemorySlotSize, if set, is the memory slot size that VMs of the flavor must use.
+	//
+	// Because the autoscaler-agent and scheduler read the slot size from the VirtualMachine itself,
+	// it isn't filled in from the flavor. Instead, a runner pod isn't created for a VM whose
+	// .spec.guest.memorySlotSize is different.
+	// +optional
+	MemorySlotSize *resource.Quantity `json:"memorySlotSize,omitempty"`
+
+	// MemoryProvider is used for VMs that don't set .spec.guest.memoryProvider
+	// +optional
+	MemoryProvider MemoryProvider `json:"memoryProvider,omitempty"`
+}
+
+//+genclient
+//+genclient:nonNamespaced
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster,singular=virtualmachineflavor,shortName=vmf
+
+// VirtualMachineFlavor is the Schema for the virtualmachineflavors API
+type VirtualMachineFlavor struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec VirtualMachineFlavorSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachineFlavorList contains a list of VirtualMachineFlavor
+type VirtualMachineFlavorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineFlavor `json:"items"`
+}
+
+// ApplyTo returns a copy of the VirtualMachine, with any fields not set by the VM filled in from
+// the flavor spec, or an error if the result isn't valid
+func (f *VirtualMachineFlavorSpec) ApplyTo(virtualmachine *VirtualMachine) (*VirtualMachine, error) {
+	vm := virtualmachine.DeepCopy()
+	spec := &vm.Spec
+
+	if spec.RunnerImage == nil && f.RunnerImage != nil {
+		spec.RunnerImage = &[]string{*f.RunnerImage}[0]
+	}
+	if spec.Guest.KernelImage == nil && f.KernelImage != nil {
+		spec.Guest.KernelImage = &[]string{*f.KernelImage}[0]
+	}
+	if spec.Guest.AppendKernelCmdline == nil && f.AppendKernelCmdline != nil {
+		spec.Guest.AppendKernelCmdline = &[]string{*f.AppendKernelCmdline}[0]
+	}
+	if rootDisk := f.RootDisk; rootDisk != nil {
+		if spec.Guest.RootDisk.Image == "" {
+			spec.Guest.RootDisk.Image = rootDisk.Image
+		}
+		if spec.Guest.RootDisk.Size.IsZero() {
+			spec.Guest.RootDisk.Size = rootDisk.Size.DeepCopy()
+		}
+	}
+	if cu := f.ComputeUnit; cu != nil && spec.Guest.MemoryProvider == "" {
+		spec.Guest.MemoryProvider = cu.MemoryProvider
+	}
+	if len(spec.AdditionalNetworks) == 0 && len(f.AdditionalNetworks) != 0 {
+		spec.AdditionalNetworks = append([]AdditionalNetwork{}, f.AdditionalNetworks...)
+	}
+	if spec.ServiceLinks == nil && f.ServiceLinks != nil {
+		spec.ServiceLinks = &[]bool{*f.ServiceLinks}[0]
+	}
+
+	// Fields taken from the flavor haven't been through the webhook, so check them the same way.
+	if spec.Guest.RootDisk.Image == "" {
+		return nil, errors.New("neither VirtualMachine nor flavor set .spec.guest.rootDisk.image")
+	}
+	if cu := f.ComputeUnit; cu != nil && cu.MemorySlotSize != nil && !cu.MemorySlotSize.Equal(spec.Guest.MemorySlotSize) {
+		return nil, fmt.Errorf(
+			".spec.guest.memorySlotSize (%s) must be %s to use the flavor",
+			spec.Guest.MemorySlotSize.String(),
+			cu.MemorySlotSize.String(),
+		)
+	}
+	if err := vm.validateMemoryProvider(); err != nil {
+		return nil, err
+	}
+	if err := vm.validateAdditionalNetworks(); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineFlavor{}, &VirtualMachineFlavorList{}) //nolint:exhaustruct // just being used to provide the types
+}
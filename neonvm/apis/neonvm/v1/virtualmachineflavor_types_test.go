@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestFlavorApplyTo(t *testing.T) {
+	newVM := func(edit func(*VirtualMachine)) *VirtualMachine {
+		vm := new(VirtualMachine)
+		vm.Spec.Flavor = "flavor"
+		vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+		if edit != nil {
+			edit(vm)
+		}
+		return vm
+	}
+	strPtr := func(s string) *string { return &s }
+	slotSize := resource.MustParse("1Gi")
+
+	flavor := &VirtualMachineFlavorSpec{
+		RunnerImage:         strPtr("runner:flavor"),
+		KernelImage:         strPtr("kernel:flavor"),
+		AppendKernelCmdline: nil,
+		RootDisk:            &FlavorRootDisk{Image: "disk:flavor", Size: resource.MustParse("8Gi")},
+		ComputeUnit:         &FlavorComputeUnit{MemorySlotSize: &slotSize, MemoryProvider: MemoryProviderVirtioMem},
+		AdditionalNetworks:  []AdditionalNetwork{{Name: "repl", MultusNetwork: "replication"}},
+		ServiceLinks:        nil,
+	}
+
+	cases := []struct {
+		name     string
+		vm       *VirtualMachine
+		expected func(*VirtualMachine)
+		err      string
+	}{
+		{
+			name: "filled-from-flavor",
+			vm:   newVM(nil),
+			expected: func(vm *VirtualMachine) {
+				vm.Spec.RunnerImage = strPtr("runner:flavor")
+				vm.Spec.Guest.KernelImage = strPtr("kernel:flavor")
+				vm.Spec.Guest.RootDisk.Image = "disk:flavor"
+				vm.Spec.Guest.RootDisk.Size = resource.MustParse("8Gi")
+				vm.Spec.Guest.MemoryProvider = MemoryProviderVirtioMem
+				vm.Spec.AdditionalNetworks = []AdditionalNetwork{{Name: "repl", MultusNetwork: "replication"}}
+			},
+			err: "",
+		},
+		{
+			name: "set-by-vm",
+			vm: newVM(func(vm *VirtualMachine) {
+				vm.Spec.RunnerImage = strPtr("runner:vm")
+				vm.Spec.Guest.RootDisk.Image = "disk:vm"
+				vm.Spec.Guest.MemoryProvider = MemoryProviderDIMMSlots
+				vm.Spec.AdditionalNetworks = []AdditionalNetwork{{Name: "other", MultusNetwork: "other"}}
+			}),
+			expected: func(vm *VirtualMachine) {
+				vm.Spec.Guest.KernelImage = strPtr("kernel:flavor")
+				vm.Spec.Guest.RootDisk.Size = resource.MustParse("8Gi")
+			},
+			err: "",
+		},
+		{
+			name: "wrong-memory-slot-size",
+			vm: newVM(func(vm *VirtualMachine) {
+				vm.Spec.Guest.MemorySlotSize = resource.MustParse("2Gi")
+			}),
+			expected: nil,
+			err:      ".spec.guest.memorySlotSize (2Gi) must be 1Gi to use the flavor",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			applied, err := flavor.ApplyTo(c.vm)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := c.vm.DeepCopy()
+			c.expected(expected)
+			assert.Equal(t, expected, applied)
+		})
+	}
+
+	// The flavor must provide a root disk image if the VM doesn't
+	_, err := (&VirtualMachineFlavorSpec{}).ApplyTo(newVM(nil))
+	assert.ErrorContains(t, err, "rootDisk.image")
+
+	// Fields taken from the flavor are validated like the VM's own
+	virtioMem := &VirtualMachineFlavorSpec{
+		RootDisk:    &FlavorRootDisk{Image: "disk:flavor", Size: resource.Quantity{}},
+		ComputeUnit: &FlavorComputeUnit{MemorySlotSize: nil, MemoryProvider: MemoryProviderVirtioMem},
+	}
+	_, err = virtioMem.ApplyTo(newVM(func(vm *VirtualMachine) {
+		vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Mi")
+	}))
+	assert.ErrorContains(t, err, "must be a multiple of")
+}
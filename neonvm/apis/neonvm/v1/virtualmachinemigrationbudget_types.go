@@ -0,0 +1,73 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VirtualMachineMigrationBudgetSpec defines a group of VirtualMachines and how many of them may
+// be live-migrated at the same time
+//
+// This is similar to a PodDisruptionBudget, but for migrations: for example, a budget selecting
+// both the primary and standby of an endpoint with maxConcurrentMigrations=1 ensures that they are
+// never migrated simultaneously. Migrations that would exceed the budget wait until they no
+// longer would. If a VM is selected by multiple budgets, all of them must allow the migration.
+type VirtualMachineMigrationBudgetSpec struct {
+	// Selector selects the VirtualMachines in the same namespace that the budget applies to. An
+	// empty selector selects all VirtualMachines in the namespace.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// MaxConcurrentMigrations is the maximum number of VirtualMachines selected by the budget that
+	// may be migrating at the same time. Zero means that migrations of the selected VMs are blocked.
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxConcurrentMigrations int32 `json:"maxConcurrentMigrations"`
+}
+
+// VirtualMachineMigrationBudgetStatus records the migrations that the budget has allowed to start
+//
+// Migrations are admitted by updating the status, so concurrent admissions to the same budget
+// conflict with each other, and only one of them succeeds each time.
+type VirtualMachineMigrationBudgetStatus struct {
+	// AdmittedMigrations lists the migrations of selected VMs that the budget allowed to start.
+	// Finished migrations are removed the next time a migration is admitted.
+	// +optional
+	AdmittedMigrations []AdmittedMigration `json:"admittedMigrations,omitempty"`
+}
+
+// AdmittedMigration is a migration that a VirtualMachineMigrationBudget allowed to start
+type AdmittedMigration struct {
+	// Name is the name of the VirtualMachineMigration
+	Name string `json:"name"`
+	// VmName is the name of the VirtualMachine being migrated
+	VmName string `json:"vmName"`
+}
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=virtualmachinemigrationbudget,shortName=vmmb
+//+kubebuilder:printcolumn:name="MaxConcurrent",type=integer,JSONPath=`.spec.maxConcurrentMigrations`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachineMigrationBudget is the Schema for the virtualmachinemigrationbudgets API
+type VirtualMachineMigrationBudget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachineMigrationBudgetSpec   `json:"spec,omitempty"`
+	Status VirtualMachineMigrationBudgetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachineMigrationBudgetList contains a list of VirtualMachineMigrationBudget
+type VirtualMachineMigrationBudgetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineMigrationBudget `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineMigrationBudget{}, &VirtualMachineMigrationBudgetList{}) //nolint:exhaustruct // just being used to provide the types
+}
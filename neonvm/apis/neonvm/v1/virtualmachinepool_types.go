@@ -0,0 +1,99 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VirtualMachinePoolLabel is the label set on each VirtualMachine created for a
+// VirtualMachinePool, equal to the name of the pool. It's removed once the VM is claimed.
+const VirtualMachinePoolLabel string = "vm.neon.tech/pool"
+
+// VirtualMachinePoolClaimedLabel is the label that claims a VirtualMachine from its pool, when set
+// to "true".
+//
+// Usually, VMs are claimed by creating a VirtualMachinePoolClaim, and the pool sets this up. To
+// claim a VM directly instead, pick one with VirtualMachinePoolLabel equal to the pool's name and phase Running,
+// then update it with this label set - and any other labels, annotations, or changes to the spec
+// needed to configure it - using the resourceVersion it was read with, so that two clients can't
+// claim the same VM. The pool then releases the VM, removing its owner reference and
+// VirtualMachinePoolLabel, and creates a new VM to replace it.
+const VirtualMachinePoolClaimedLabel string = "vm.neon.tech/pool-claimed"
+
+// VirtualMachinePoolSpec defines the desired state of VirtualMachinePool
+//
+// A pool keeps a number of pre-booted, unclaimed VirtualMachines running, so that new databases
+// can claim one instead of waiting for a VM to boot. There is typically one pool for each size of
+// VM, given by the template's .spec.guest.cpus and .spec.guest.memorySlots.
+type VirtualMachinePoolSpec struct {
+	// Replicas is the number of unclaimed VirtualMachines that the pool should have
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+
+	// Template describes the VirtualMachines that are created for the pool
+	Template VirtualMachineTemplateSpec `json:"template"`
+}
+
+// VirtualMachineTemplateSpec describes the VirtualMachines created for a VirtualMachinePool
+type VirtualMachineTemplateSpec struct {
+	// Metadata gives the labels and annotations for the VirtualMachines. The name is generated from
+	// the pool's name.
+	// +optional
+	Metadata VirtualMachineTemplateMeta `json:"metadata,omitempty"`
+
+	Spec VirtualMachineSpec `json:"spec"`
+}
+
+// VirtualMachineTemplateMeta is the subset of ObjectMeta that can be set in a
+// VirtualMachineTemplateSpec
+type VirtualMachineTemplateMeta struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VirtualMachinePoolStatus defines the observed state of VirtualMachinePool
+type VirtualMachinePoolStatus struct {
+	// Ready is the number of unclaimed VirtualMachines that are running, and so can be claimed
+	// +optional
+	Ready int32 `json:"ready"`
+	// Pending is the number of unclaimed VirtualMachines that are not yet running
+	// +optional
+	Pending int32 `json:"pending"`
+	// Claimed is the total number of VirtualMachines that have been claimed from the pool
+	// +optional
+	Claimed int64 `json:"claimed"`
+}
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=virtualmachinepool,shortName=vmpool
+//+kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.replicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.ready`
+//+kubebuilder:printcolumn:name="Pending",type=integer,JSONPath=`.status.pending`
+//+kubebuilder:printcolumn:name="Cpus",type=string,JSONPath=`.spec.template.spec.guest.cpus.use`
+//+kubebuilder:printcolumn:name="Memory",type=string,JSONPath=`.spec.template.spec.guest.memorySlots.use`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachinePool is the Schema for the virtualmachinepools API
+type VirtualMachinePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachinePoolSpec   `json:"spec,omitempty"`
+	Status VirtualMachinePoolStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachinePoolList contains a list of VirtualMachinePool
+type VirtualMachinePoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachinePool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachinePool{}, &VirtualMachinePoolList{}) //nolint:exhaustruct // just being used to provide the types
+}
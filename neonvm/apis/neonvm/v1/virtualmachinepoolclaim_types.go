@@ -0,0 +1,76 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VirtualMachinePoolClaimAnnotation is the annotation set on a VirtualMachine that was claimed
+// through a VirtualMachinePoolClaim, equal to the name of the claim.
+const VirtualMachinePoolClaimAnnotation string = "vm.neon.tech/pool-claim"
+
+// VirtualMachinePoolClaimSpec defines the desired state of VirtualMachinePoolClaim
+//
+// A claim requests a pre-booted VirtualMachine from a VirtualMachinePool in the same namespace. The
+// pool binds the claim to one of its running VMs, adds the claim's labels and annotations to it,
+// and releases it from the pool. Each VM is bound to at most one claim, and each claim to at most
+// one VM, even with multiple claims created at the same time.
+type VirtualMachinePoolClaimSpec struct {
+	// PoolName is the name of the VirtualMachinePool to claim a VirtualMachine from
+	PoolName string `json:"poolName"`
+
+	// Metadata gives labels and annotations to add to the claimed VirtualMachine
+	// +optional
+	Metadata VirtualMachineTemplateMeta `json:"metadata,omitempty"`
+}
+
+// VirtualMachinePoolClaimStatus defines the observed state of VirtualMachinePoolClaim
+type VirtualMachinePoolClaimStatus struct {
+	// Phase is Pending until the claim is bound to a VirtualMachine, and then Bound
+	// +optional
+	Phase PoolClaimPhase `json:"phase,omitempty"`
+	// VmName is the name of the VirtualMachine that the claim is bound to
+	// +optional
+	VmName string `json:"vmName,omitempty"`
+}
+
+type PoolClaimPhase string
+
+const (
+	// PoolClaimPending means that the claim hasn't been bound to a VirtualMachine yet, usually
+	// because the pool doesn't have any running VMs.
+	PoolClaimPending PoolClaimPhase = "Pending"
+	// PoolClaimBound means that the claim has been bound to the VirtualMachine in .status.vmName,
+	// which is no longer part of the pool.
+	PoolClaimBound PoolClaimPhase = "Bound"
+)
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=virtualmachinepoolclaim,shortName=vmclaim
+//+kubebuilder:printcolumn:name="Pool",type=string,JSONPath=`.spec.poolName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.status.vmName`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachinePoolClaim is the Schema for the virtualmachinepoolclaims API
+type VirtualMachinePoolClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachinePoolClaimSpec   `json:"spec,omitempty"`
+	Status VirtualMachinePoolClaimStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachinePoolClaimList contains a list of VirtualMachinePoolClaim
+type VirtualMachinePoolClaimList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachinePoolClaim `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachinePoolClaim{}, &VirtualMachinePoolClaimList{}) //nolint:exhaustruct // just being used to provide the types
+}
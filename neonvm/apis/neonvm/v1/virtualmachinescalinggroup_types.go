@@ -0,0 +1,117 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VirtualMachineScalingGroupLabel is the label set on each VirtualMachine created for a
+// VirtualMachineScalingGroup, equal to the name of the group.
+const VirtualMachineScalingGroupLabel string = "vm.neon.tech/scaling-group"
+
+// VirtualMachineScalingGroupReplicasAnnotation is the annotation set on each VirtualMachine in a
+// VirtualMachineScalingGroup, giving the number of replicas in the group that are currently ready.
+// It's kept up-to-date as the group scales, so that it can be included in billing events.
+const VirtualMachineScalingGroupReplicasAnnotation string = "vm.neon.tech/scaling-group-replicas"
+
+// VirtualMachineScalingGroupSpec defines the desired state of VirtualMachineScalingGroup
+//
+// A scaling group runs a number of identical replica VirtualMachines -- e.g. the read replicas of
+// an endpoint -- and scales the number of them horizontally, between .spec.minReplicas and
+// .spec.maxReplicas.
+//
+// Horizontal scaling is coordinated with the autoscaler-agent's vertical scaling of each replica:
+// replicas are only added once the existing ones have been scaled up close to their maximum, and
+// only removed once they've been scaled down close to their minimum. Utilization is the total vCPUs
+// currently in use by the running replicas, as a percentage of the total of their maximum vCPUs.
+type VirtualMachineScalingGroupSpec struct {
+	// MinReplicas is the smallest number of replicas that the group scales down to
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default:=1
+	// +optional
+	MinReplicas int32 `json:"minReplicas"`
+	// MaxReplicas is the largest number of replicas that the group scales up to. It must be at
+	// least MinReplicas.
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// ScaleUpUtilizationPercent gives the utilization at or above which a replica is added
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default:=90
+	// +optional
+	ScaleUpUtilizationPercent int32 `json:"scaleUpUtilizationPercent"`
+	// ScaleDownUtilizationPercent gives the utilization at or below which a replica is removed. It
+	// must be less than ScaleUpUtilizationPercent, with enough of a gap that removing a replica
+	// doesn't immediately cause the rest to be scaled back up.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default:=30
+	// +optional
+	ScaleDownUtilizationPercent int32 `json:"scaleDownUtilizationPercent"`
+	// StabilizationSeconds gives how long the utilization must stay above (or below) the threshold
+	// before a replica is added (or removed), and the minimum time between changes.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default:=300
+	// +optional
+	StabilizationSeconds int32 `json:"stabilizationSeconds"`
+
+	// Template describes the replica VirtualMachines
+	Template VirtualMachineTemplateSpec `json:"template"`
+}
+
+// VirtualMachineScalingGroupStatus defines the observed state of VirtualMachineScalingGroup
+type VirtualMachineScalingGroupStatus struct {
+	// Replicas is the current number of replicas that the group is scaled to
+	// +optional
+	Replicas int32 `json:"replicas"`
+	// Ready is the number of replicas that are running
+	// +optional
+	Ready int32 `json:"ready"`
+	// UtilizationPercent is the utilization of the running replicas, as of the last reconcile
+	// +optional
+	UtilizationPercent int32 `json:"utilizationPercent"`
+	// AboveThresholdSince is the time since which utilization has been continuously at or above
+	// .spec.scaleUpUtilizationPercent, if it is
+	// +optional
+	AboveThresholdSince *metav1.Time `json:"aboveThresholdSince,omitempty"`
+	// BelowThresholdSince is the time since which utilization has been continuously at or below
+	// .spec.scaleDownUtilizationPercent, if it is
+	// +optional
+	BelowThresholdSince *metav1.Time `json:"belowThresholdSince,omitempty"`
+	// LastScaleTime is the last time that the number of replicas was changed
+	// +optional
+	LastScaleTime *metav1.Time `json:"lastScaleTime,omitempty"`
+}
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=virtualmachinescalinggroup,shortName=vmsg
+//+kubebuilder:printcolumn:name="Min",type=integer,JSONPath=`.spec.minReplicas`
+//+kubebuilder:printcolumn:name="Max",type=integer,JSONPath=`.spec.maxReplicas`
+//+kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.status.replicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.ready`
+//+kubebuilder:printcolumn:name="Utilization",type=integer,JSONPath=`.status.utilizationPercent`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachineScalingGroup is the Schema for the virtualmachinescalinggroups API
+type VirtualMachineScalingGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachineScalingGroupSpec   `json:"spec,omitempty"`
+	Status VirtualMachineScalingGroupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachineScalingGroupList contains a list of VirtualMachineScalingGroup
+type VirtualMachineScalingGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineScalingGroup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineScalingGroup{}, &VirtualMachineScalingGroupList{}) //nolint:exhaustruct // just being used to provide the types
+}
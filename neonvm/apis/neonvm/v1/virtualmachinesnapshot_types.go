@@ -0,0 +1,100 @@
+package v1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SnapshotMountPath is the path in the runner pod where the VM's .spec.snapshotStorage volume is
+// mounted
+const SnapshotMountPath string = "/vm/snapshots"
+
+// SnapshotDiskPath returns the path, in the runner pod, of the copy of the disk taken by the
+// snapshot. Names can't contain underscores, so the path is unique for each snapshot and disk.
+func SnapshotDiskPath(snapshotName string, diskName string) string {
+	return fmt.Sprintf("%s/%s_%s.qcow2", SnapshotMountPath, snapshotName, diskName)
+}
+
+// VirtualMachineSnapshotSpec defines the desired state of VirtualMachineSnapshot
+//
+// A snapshot is a point-in-time copy of some of a running VM's emptyDisk disks, written to the
+// VM's .spec.snapshotStorage volume. Other VMs mounting the same volume can then be started with
+// the copy of a disk, by setting the disk's .emptyDisk.fromSnapshot.
+//
+// The copy is crash-consistent: all disks in the snapshot are copied from the same instant, but
+// without flushing anything from the guest first.
+type VirtualMachineSnapshotSpec struct {
+	// VmName is the name of the VirtualMachine, in the same namespace, to take a snapshot of. It
+	// must have .spec.snapshotStorage set.
+	VmName string `json:"vmName"`
+
+	// Disks gives the names of the emptyDisk disks to include in the snapshot. If empty, all of
+	// the VM's emptyDisk disks are included.
+	// +optional
+	Disks []string `json:"disks,omitempty"`
+}
+
+// VirtualMachineSnapshotStatus defines the observed state of VirtualMachineSnapshot
+type VirtualMachineSnapshotStatus struct {
+	// +optional
+	Phase SnapshotPhase `json:"phase,omitempty"`
+	// Disks gives the names of the disks included in the snapshot, once it's started
+	// +optional
+	Disks []string `json:"disks,omitempty"`
+	// PodName is the name of the runner pod that the snapshot is being taken from. If the pod is
+	// replaced before the snapshot finishes, the snapshot fails.
+	// +optional
+	PodName string `json:"podName,omitempty"`
+	// CompletionTime is the time when the snapshot succeeded
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Message gives the reason that the snapshot failed, if it did
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+type SnapshotPhase string
+
+const (
+	// SnapshotPending means that the snapshot hasn't been started yet, e.g. because the VM isn't
+	// running.
+	SnapshotPending SnapshotPhase = "Pending"
+	// SnapshotRunning means that the disks are being copied
+	SnapshotRunning SnapshotPhase = "Running"
+	// SnapshotSucceeded means that all disks have been copied, and the snapshot can be used
+	SnapshotSucceeded SnapshotPhase = "Succeeded"
+	// SnapshotFailed means that the snapshot can't be used. It's not retried.
+	SnapshotFailed SnapshotPhase = "Failed"
+)
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=virtualmachinesnapshot,shortName=vmsnap
+//+kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.spec.vmName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Completed",type=date,JSONPath=`.status.completionTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachineSnapshot is the Schema for the virtualmachinesnapshots API
+type VirtualMachineSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachineSnapshotSpec   `json:"spec,omitempty"`
+	Status VirtualMachineSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachineSnapshotList contains a list of VirtualMachineSnapshot
+type VirtualMachineSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineSnapshot{}, &VirtualMachineSnapshotList{}) //nolint:exhaustruct // just being used to provide the types
+}
@@ -27,6 +27,51 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AdditionalNetwork) DeepCopyInto(out *AdditionalNetwork) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AdditionalNetwork.
+func (in *AdditionalNetwork) DeepCopy() *AdditionalNetwork {
+	if in == nil {
+		return nil
+	}
+	out := new(AdditionalNetwork)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AdmittedMigration) DeepCopyInto(out *AdmittedMigration) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AdmittedMigration.
+func (in *AdmittedMigration) DeepCopy() *AdmittedMigration {
+	if in == nil {
+		return nil
+	}
+	out := new(AdmittedMigration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUPlacement) DeepCopyInto(out *CPUPlacement) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUPlacement.
+func (in *CPUPlacement) DeepCopy() *CPUPlacement {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUPlacement)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CPUs) DeepCopyInto(out *CPUs) {
 	*out = *in
@@ -45,6 +90,11 @@ func (in *CPUs) DeepCopyInto(out *CPUs) {
 		*out = new(MilliCPU)
 		**out = **in
 	}
+	if in.MaxTopology != nil {
+		in, out := &in.MaxTopology, &out.MaxTopology
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUs.
@@ -57,6 +107,26 @@ func (in *CPUs) DeepCopy() *CPUs {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudInit) DeepCopyInto(out *CloudInit) {
+	*out = *in
+	if in.UserDataSecret != nil {
+		in, out := &in.UserDataSecret, &out.UserDataSecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudInit.
+func (in *CloudInit) DeepCopy() *CloudInit {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudInit)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Disk) DeepCopyInto(out *Disk) {
 	*out = *in
@@ -66,6 +136,11 @@ func (in *Disk) DeepCopyInto(out *Disk) {
 		**out = **in
 	}
 	in.DiskSource.DeepCopyInto(&out.DiskSource)
+	if in.Watch != nil {
+		in, out := &in.Watch, &out.Watch
+		*out = new(DiskWatch)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Disk.
@@ -113,6 +188,21 @@ func (in *DiskSource) DeepCopy() *DiskSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiskWatch) DeepCopyInto(out *DiskWatch) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiskWatch.
+func (in *DiskWatch) DeepCopy() *DiskWatch {
+	if in == nil {
+		return nil
+	}
+	out := new(DiskWatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *EmptyDiskSource) DeepCopyInto(out *EmptyDiskSource) {
 	*out = *in
@@ -159,6 +249,57 @@ func (in *ExtraNetwork) DeepCopy() *ExtraNetwork {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FlavorComputeUnit) DeepCopyInto(out *FlavorComputeUnit) {
+	*out = *in
+	if in.MemorySlotSize != nil {
+		in, out := &in.MemorySlotSize, &out.MemorySlotSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FlavorComputeUnit.
+func (in *FlavorComputeUnit) DeepCopy() *FlavorComputeUnit {
+	if in == nil {
+		return nil
+	}
+	out := new(FlavorComputeUnit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FlavorRootDisk) DeepCopyInto(out *FlavorRootDisk) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FlavorRootDisk.
+func (in *FlavorRootDisk) DeepCopy() *FlavorRootDisk {
+	if in == nil {
+		return nil
+	}
+	out := new(FlavorRootDisk)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GPUs) DeepCopyInto(out *GPUs) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GPUs.
+func (in *GPUs) DeepCopy() *GPUs {
+	if in == nil {
+		return nil
+	}
+	out := new(GPUs)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Guest) DeepCopyInto(out *Guest) {
 	*out = *in
@@ -175,6 +316,16 @@ func (in *Guest) DeepCopyInto(out *Guest) {
 	in.CPUs.DeepCopyInto(&out.CPUs)
 	out.MemorySlotSize = in.MemorySlotSize.DeepCopy()
 	in.MemorySlots.DeepCopyInto(&out.MemorySlots)
+	if in.CPUPlacement != nil {
+		in, out := &in.CPUPlacement, &out.CPUPlacement
+		*out = new(CPUPlacement)
+		**out = **in
+	}
+	if in.GPUs != nil {
+		in, out := &in.GPUs, &out.GPUs
+		*out = new(GPUs)
+		**out = **in
+	}
 	in.RootDisk.DeepCopyInto(&out.RootDisk)
 	if in.Command != nil {
 		in, out := &in.Command, &out.Command
@@ -213,6 +364,28 @@ func (in *Guest) DeepCopy() *Guest {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestInfo) DeepCopyInto(out *GuestInfo) {
+	*out = *in
+	if in.Daemons != nil {
+		in, out := &in.Daemons, &out.Daemons
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestInfo.
+func (in *GuestInfo) DeepCopy() *GuestInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GuestSettings) DeepCopyInto(out *GuestSettings) {
 	*out = *in
@@ -430,6 +603,22 @@ func (in *Port) DeepCopy() *Port {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresRestartStatus) DeepCopyInto(out *PostgresRestartStatus) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresRestartStatus.
+func (in *PostgresRestartStatus) DeepCopy() *PostgresRestartStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresRestartStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RootDisk) DeepCopyInto(out *RootDisk) {
 	*out = *in
@@ -451,6 +640,21 @@ func (in *RootDisk) DeepCopy() *RootDisk {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotStorage) DeepCopyInto(out *SnapshotStorage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotStorage.
+func (in *SnapshotStorage) DeepCopy() *SnapshotStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SwapInfo) DeepCopyInto(out *SwapInfo) {
 	*out = *in
@@ -515,6 +719,114 @@ func (in *VirtualMachine) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineFlavor) DeepCopyInto(out *VirtualMachineFlavor) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineFlavor.
+func (in *VirtualMachineFlavor) DeepCopy() *VirtualMachineFlavor {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineFlavor)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineFlavor) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineFlavorList) DeepCopyInto(out *VirtualMachineFlavorList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachineFlavor, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineFlavorList.
+func (in *VirtualMachineFlavorList) DeepCopy() *VirtualMachineFlavorList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineFlavorList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineFlavorList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineFlavorSpec) DeepCopyInto(out *VirtualMachineFlavorSpec) {
+	*out = *in
+	if in.RunnerImage != nil {
+		in, out := &in.RunnerImage, &out.RunnerImage
+		*out = new(string)
+		**out = **in
+	}
+	if in.KernelImage != nil {
+		in, out := &in.KernelImage, &out.KernelImage
+		*out = new(string)
+		**out = **in
+	}
+	if in.AppendKernelCmdline != nil {
+		in, out := &in.AppendKernelCmdline, &out.AppendKernelCmdline
+		*out = new(string)
+		**out = **in
+	}
+	if in.RootDisk != nil {
+		in, out := &in.RootDisk, &out.RootDisk
+		*out = new(FlavorRootDisk)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ComputeUnit != nil {
+		in, out := &in.ComputeUnit, &out.ComputeUnit
+		*out = new(FlavorComputeUnit)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AdditionalNetworks != nil {
+		in, out := &in.AdditionalNetworks, &out.AdditionalNetworks
+		*out = make([]AdditionalNetwork, len(*in))
+		copy(*out, *in)
+	}
+	if in.ServiceLinks != nil {
+		in, out := &in.ServiceLinks, &out.ServiceLinks
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineFlavorSpec.
+func (in *VirtualMachineFlavorSpec) DeepCopy() *VirtualMachineFlavorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineFlavorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineList) DeepCopyInto(out *VirtualMachineList) {
 	*out = *in
@@ -575,31 +887,58 @@ func (in *VirtualMachineMigration) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *VirtualMachineMigrationList) DeepCopyInto(out *VirtualMachineMigrationList) {
+func (in *VirtualMachineMigrationBudget) DeepCopyInto(out *VirtualMachineMigrationBudget) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationBudget.
+func (in *VirtualMachineMigrationBudget) DeepCopy() *VirtualMachineMigrationBudget {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineMigrationBudget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineMigrationBudget) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineMigrationBudgetList) DeepCopyInto(out *VirtualMachineMigrationBudgetList) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ListMeta.DeepCopyInto(&out.ListMeta)
 	if in.Items != nil {
 		in, out := &in.Items, &out.Items
-		*out = make([]VirtualMachineMigration, len(*in))
+		*out = make([]VirtualMachineMigrationBudget, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationList.
-func (in *VirtualMachineMigrationList) DeepCopy() *VirtualMachineMigrationList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationBudgetList.
+func (in *VirtualMachineMigrationBudgetList) DeepCopy() *VirtualMachineMigrationBudgetList {
 	if in == nil {
 		return nil
 	}
-	out := new(VirtualMachineMigrationList)
+	out := new(VirtualMachineMigrationBudgetList)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *VirtualMachineMigrationList) DeepCopyObject() runtime.Object {
+func (in *VirtualMachineMigrationBudgetList) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -607,10 +946,78 @@ func (in *VirtualMachineMigrationList) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *VirtualMachineMigrationSpec) DeepCopyInto(out *VirtualMachineMigrationSpec) {
+func (in *VirtualMachineMigrationBudgetSpec) DeepCopyInto(out *VirtualMachineMigrationBudgetSpec) {
 	*out = *in
-	if in.NodeSelector != nil {
-		in, out := &in.NodeSelector, &out.NodeSelector
+	in.Selector.DeepCopyInto(&out.Selector)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationBudgetSpec.
+func (in *VirtualMachineMigrationBudgetSpec) DeepCopy() *VirtualMachineMigrationBudgetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineMigrationBudgetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineMigrationBudgetStatus) DeepCopyInto(out *VirtualMachineMigrationBudgetStatus) {
+	*out = *in
+	if in.AdmittedMigrations != nil {
+		in, out := &in.AdmittedMigrations, &out.AdmittedMigrations
+		*out = make([]AdmittedMigration, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationBudgetStatus.
+func (in *VirtualMachineMigrationBudgetStatus) DeepCopy() *VirtualMachineMigrationBudgetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineMigrationBudgetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineMigrationList) DeepCopyInto(out *VirtualMachineMigrationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachineMigration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationList.
+func (in *VirtualMachineMigrationList) DeepCopy() *VirtualMachineMigrationList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineMigrationList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineMigrationList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineMigrationSpec) DeepCopyInto(out *VirtualMachineMigrationSpec) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
 		*out = make(map[string]string, len(*in))
 		for key, val := range *in {
 			(*out)[key] = val
@@ -657,6 +1064,186 @@ func (in *VirtualMachineMigrationStatus) DeepCopy() *VirtualMachineMigrationStat
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePool) DeepCopyInto(out *VirtualMachinePool) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePool.
+func (in *VirtualMachinePool) DeepCopy() *VirtualMachinePool {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachinePool) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolClaim) DeepCopyInto(out *VirtualMachinePoolClaim) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	out.Status = in.Status
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolClaim.
+func (in *VirtualMachinePoolClaim) DeepCopy() *VirtualMachinePoolClaim {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolClaim)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachinePoolClaim) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolClaimList) DeepCopyInto(out *VirtualMachinePoolClaimList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachinePoolClaim, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolClaimList.
+func (in *VirtualMachinePoolClaimList) DeepCopy() *VirtualMachinePoolClaimList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolClaimList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachinePoolClaimList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolClaimSpec) DeepCopyInto(out *VirtualMachinePoolClaimSpec) {
+	*out = *in
+	in.Metadata.DeepCopyInto(&out.Metadata)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolClaimSpec.
+func (in *VirtualMachinePoolClaimSpec) DeepCopy() *VirtualMachinePoolClaimSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolClaimSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolClaimStatus) DeepCopyInto(out *VirtualMachinePoolClaimStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolClaimStatus.
+func (in *VirtualMachinePoolClaimStatus) DeepCopy() *VirtualMachinePoolClaimStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolClaimStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolList) DeepCopyInto(out *VirtualMachinePoolList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachinePool, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolList.
+func (in *VirtualMachinePoolList) DeepCopy() *VirtualMachinePoolList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachinePoolList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolSpec) DeepCopyInto(out *VirtualMachinePoolSpec) {
+	*out = *in
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolSpec.
+func (in *VirtualMachinePoolSpec) DeepCopy() *VirtualMachinePoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachinePoolStatus) DeepCopyInto(out *VirtualMachinePoolStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachinePoolStatus.
+func (in *VirtualMachinePoolStatus) DeepCopy() *VirtualMachinePoolStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachinePoolStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineResources) DeepCopyInto(out *VirtualMachineResources) {
 	*out = *in
@@ -675,6 +1262,211 @@ func (in *VirtualMachineResources) DeepCopy() *VirtualMachineResources {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScalingGroup) DeepCopyInto(out *VirtualMachineScalingGroup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScalingGroup.
+func (in *VirtualMachineScalingGroup) DeepCopy() *VirtualMachineScalingGroup {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScalingGroup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineScalingGroup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScalingGroupList) DeepCopyInto(out *VirtualMachineScalingGroupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachineScalingGroup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScalingGroupList.
+func (in *VirtualMachineScalingGroupList) DeepCopy() *VirtualMachineScalingGroupList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScalingGroupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineScalingGroupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScalingGroupSpec) DeepCopyInto(out *VirtualMachineScalingGroupSpec) {
+	*out = *in
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScalingGroupSpec.
+func (in *VirtualMachineScalingGroupSpec) DeepCopy() *VirtualMachineScalingGroupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScalingGroupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScalingGroupStatus) DeepCopyInto(out *VirtualMachineScalingGroupStatus) {
+	*out = *in
+	if in.AboveThresholdSince != nil {
+		in, out := &in.AboveThresholdSince, &out.AboveThresholdSince
+		*out = (*in).DeepCopy()
+	}
+	if in.BelowThresholdSince != nil {
+		in, out := &in.BelowThresholdSince, &out.BelowThresholdSince
+		*out = (*in).DeepCopy()
+	}
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScalingGroupStatus.
+func (in *VirtualMachineScalingGroupStatus) DeepCopy() *VirtualMachineScalingGroupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScalingGroupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshot) DeepCopyInto(out *VirtualMachineSnapshot) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshot.
+func (in *VirtualMachineSnapshot) DeepCopy() *VirtualMachineSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineSnapshot) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotList) DeepCopyInto(out *VirtualMachineSnapshotList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachineSnapshot, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotList.
+func (in *VirtualMachineSnapshotList) DeepCopy() *VirtualMachineSnapshotList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineSnapshotList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotSpec) DeepCopyInto(out *VirtualMachineSnapshotSpec) {
+	*out = *in
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotSpec.
+func (in *VirtualMachineSnapshotSpec) DeepCopy() *VirtualMachineSnapshotSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotStatus) DeepCopyInto(out *VirtualMachineSnapshotStatus) {
+	*out = *in
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotStatus.
+func (in *VirtualMachineSnapshotStatus) DeepCopy() *VirtualMachineSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 	*out = *in
@@ -683,6 +1475,16 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = new(int64)
 		**out = **in
 	}
+	if in.GuestTerminationGracePeriodSeconds != nil {
+		in, out := &in.GuestTerminationGracePeriodSeconds, &out.GuestTerminationGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Topology != nil {
+		in, out := &in.Topology, &out.Topology
+		*out = new(VirtualMachineTopology)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.NodeSelector != nil {
 		in, out := &in.NodeSelector, &out.NodeSelector
 		*out = make(map[string]string, len(*in))
@@ -723,11 +1525,26 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.SnapshotStorage != nil {
+		in, out := &in.SnapshotStorage, &out.SnapshotStorage
+		*out = new(SnapshotStorage)
+		**out = **in
+	}
+	if in.CloudInit != nil {
+		in, out := &in.CloudInit, &out.CloudInit
+		*out = new(CloudInit)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ExtraNetwork != nil {
 		in, out := &in.ExtraNetwork, &out.ExtraNetwork
 		*out = new(ExtraNetwork)
 		**out = **in
 	}
+	if in.AdditionalNetworks != nil {
+		in, out := &in.AdditionalNetworks, &out.AdditionalNetworks
+		*out = make([]AdditionalNetwork, len(*in))
+		copy(*out, *in)
+	}
 	if in.ServiceLinks != nil {
 		in, out := &in.ServiceLinks, &out.ServiceLinks
 		*out = new(bool)
@@ -770,6 +1587,10 @@ func (in *VirtualMachineStatus) DeepCopyInto(out *VirtualMachineStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.MigratedAt != nil {
+		in, out := &in.MigratedAt, &out.MigratedAt
+		*out = (*in).DeepCopy()
+	}
 	if in.CPUs != nil {
 		in, out := &in.CPUs, &out.CPUs
 		*out = new(MilliCPU)
@@ -780,6 +1601,21 @@ func (in *VirtualMachineStatus) DeepCopyInto(out *VirtualMachineStatus) {
 		x := (*in).DeepCopy()
 		*out = &x
 	}
+	if in.RootDiskSize != nil {
+		in, out := &in.RootDiskSize, &out.RootDiskSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.GuestInfo != nil {
+		in, out := &in.GuestInfo, &out.GuestInfo
+		*out = new(GuestInfo)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PostgresRestart != nil {
+		in, out := &in.PostgresRestart, &out.PostgresRestart
+		*out = new(PostgresRestartStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineStatus.
@@ -792,6 +1628,82 @@ func (in *VirtualMachineStatus) DeepCopy() *VirtualMachineStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineTemplateMeta) DeepCopyInto(out *VirtualMachineTemplateMeta) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineTemplateMeta.
+func (in *VirtualMachineTemplateMeta) DeepCopy() *VirtualMachineTemplateMeta {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineTemplateMeta)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineTemplateSpec) DeepCopyInto(out *VirtualMachineTemplateSpec) {
+	*out = *in
+	in.Metadata.DeepCopyInto(&out.Metadata)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineTemplateSpec.
+func (in *VirtualMachineTemplateSpec) DeepCopy() *VirtualMachineTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineTopology) DeepCopyInto(out *VirtualMachineTopology) {
+	*out = *in
+	if in.RequiredZones != nil {
+		in, out := &in.RequiredZones, &out.RequiredZones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PreferredZones != nil {
+		in, out := &in.PreferredZones, &out.PreferredZones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PreferredArchitectures != nil {
+		in, out := &in.PreferredArchitectures, &out.PreferredArchitectures
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineTopology.
+func (in *VirtualMachineTopology) DeepCopy() *VirtualMachineTopology {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineTopology)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineUsage) DeepCopyInto(out *VirtualMachineUsage) {
 	*out = *in
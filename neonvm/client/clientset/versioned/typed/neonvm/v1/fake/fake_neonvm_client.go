@@ -35,10 +35,34 @@ func (c *FakeNeonvmV1) VirtualMachines(namespace string) v1.VirtualMachineInterf
 	return &FakeVirtualMachines{c, namespace}
 }
 
+func (c *FakeNeonvmV1) VirtualMachineFlavors() v1.VirtualMachineFlavorInterface {
+	return &FakeVirtualMachineFlavors{c}
+}
+
 func (c *FakeNeonvmV1) VirtualMachineMigrations(namespace string) v1.VirtualMachineMigrationInterface {
 	return &FakeVirtualMachineMigrations{c, namespace}
 }
 
+func (c *FakeNeonvmV1) VirtualMachineMigrationBudgets(namespace string) v1.VirtualMachineMigrationBudgetInterface {
+	return &FakeVirtualMachineMigrationBudgets{c, namespace}
+}
+
+func (c *FakeNeonvmV1) VirtualMachinePools(namespace string) v1.VirtualMachinePoolInterface {
+	return &FakeVirtualMachinePools{c, namespace}
+}
+
+func (c *FakeNeonvmV1) VirtualMachinePoolClaims(namespace string) v1.VirtualMachinePoolClaimInterface {
+	return &FakeVirtualMachinePoolClaims{c, namespace}
+}
+
+func (c *FakeNeonvmV1) VirtualMachineScalingGroups(namespace string) v1.VirtualMachineScalingGroupInterface {
+	return &FakeVirtualMachineScalingGroups{c, namespace}
+}
+
+func (c *FakeNeonvmV1) VirtualMachineSnapshots(namespace string) v1.VirtualMachineSnapshotInterface {
+	return &FakeVirtualMachineSnapshots{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeNeonvmV1) RESTClient() rest.Interface {
@@ -21,4 +21,16 @@ type IPPoolExpansion interface{}
 
 type VirtualMachineExpansion interface{}
 
+type VirtualMachineFlavorExpansion interface{}
+
 type VirtualMachineMigrationExpansion interface{}
+
+type VirtualMachineMigrationBudgetExpansion interface{}
+
+type VirtualMachinePoolExpansion interface{}
+
+type VirtualMachinePoolClaimExpansion interface{}
+
+type VirtualMachineScalingGroupExpansion interface{}
+
+type VirtualMachineSnapshotExpansion interface{}
@@ -29,7 +29,13 @@ type NeonvmV1Interface interface {
 	RESTClient() rest.Interface
 	IPPoolsGetter
 	VirtualMachinesGetter
+	VirtualMachineFlavorsGetter
 	VirtualMachineMigrationsGetter
+	VirtualMachineMigrationBudgetsGetter
+	VirtualMachinePoolsGetter
+	VirtualMachinePoolClaimsGetter
+	VirtualMachineScalingGroupsGetter
+	VirtualMachineSnapshotsGetter
 }
 
 // NeonvmV1Client is used to interact with features provided by the neonvm group.
@@ -45,10 +51,34 @@ func (c *NeonvmV1Client) VirtualMachines(namespace string) VirtualMachineInterfa
 	return newVirtualMachines(c, namespace)
 }
 
+func (c *NeonvmV1Client) VirtualMachineFlavors() VirtualMachineFlavorInterface {
+	return newVirtualMachineFlavors(c)
+}
+
 func (c *NeonvmV1Client) VirtualMachineMigrations(namespace string) VirtualMachineMigrationInterface {
 	return newVirtualMachineMigrations(c, namespace)
 }
 
+func (c *NeonvmV1Client) VirtualMachineMigrationBudgets(namespace string) VirtualMachineMigrationBudgetInterface {
+	return newVirtualMachineMigrationBudgets(c, namespace)
+}
+
+func (c *NeonvmV1Client) VirtualMachinePools(namespace string) VirtualMachinePoolInterface {
+	return newVirtualMachinePools(c, namespace)
+}
+
+func (c *NeonvmV1Client) VirtualMachinePoolClaims(namespace string) VirtualMachinePoolClaimInterface {
+	return newVirtualMachinePoolClaims(c, namespace)
+}
+
+func (c *NeonvmV1Client) VirtualMachineScalingGroups(namespace string) VirtualMachineScalingGroupInterface {
+	return newVirtualMachineScalingGroups(c, namespace)
+}
+
+func (c *NeonvmV1Client) VirtualMachineSnapshots(namespace string) VirtualMachineSnapshotInterface {
+	return newVirtualMachineSnapshots(c, namespace)
+}
+
 // NewForConfig creates a new NeonvmV1Client for the given config.
 // NewForConfig is equivalent to NewForConfigAndClient(c, httpClient),
 // where httpClient was generated with rest.HTTPClientFor(c).
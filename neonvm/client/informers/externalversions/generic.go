@@ -56,8 +56,20 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().IPPools().Informer()}, nil
 	case v1.SchemeGroupVersion.WithResource("virtualmachines"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachines().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachineflavors"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachineFlavors().Informer()}, nil
 	case v1.SchemeGroupVersion.WithResource("virtualmachinemigrations"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachineMigrations().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachinemigrationbudgets"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachineMigrationBudgets().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachinepools"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachinePools().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachinepoolclaims"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachinePoolClaims().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachinescalinggroups"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachineScalingGroups().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("virtualmachinesnapshots"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Neonvm().V1().VirtualMachineSnapshots().Informer()}, nil
 
 	}
 
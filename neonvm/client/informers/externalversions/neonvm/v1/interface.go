@@ -27,8 +27,20 @@ type Interface interface {
 	IPPools() IPPoolInformer
 	// VirtualMachines returns a VirtualMachineInformer.
 	VirtualMachines() VirtualMachineInformer
+	// VirtualMachineFlavors returns a VirtualMachineFlavorInformer.
+	VirtualMachineFlavors() VirtualMachineFlavorInformer
 	// VirtualMachineMigrations returns a VirtualMachineMigrationInformer.
 	VirtualMachineMigrations() VirtualMachineMigrationInformer
+	// VirtualMachineMigrationBudgets returns a VirtualMachineMigrationBudgetInformer.
+	VirtualMachineMigrationBudgets() VirtualMachineMigrationBudgetInformer
+	// VirtualMachinePools returns a VirtualMachinePoolInformer.
+	VirtualMachinePools() VirtualMachinePoolInformer
+	// VirtualMachinePoolClaims returns a VirtualMachinePoolClaimInformer.
+	VirtualMachinePoolClaims() VirtualMachinePoolClaimInformer
+	// VirtualMachineScalingGroups returns a VirtualMachineScalingGroupInformer.
+	VirtualMachineScalingGroups() VirtualMachineScalingGroupInformer
+	// VirtualMachineSnapshots returns a VirtualMachineSnapshotInformer.
+	VirtualMachineSnapshots() VirtualMachineSnapshotInformer
 }
 
 type version struct {
@@ -52,7 +64,37 @@ func (v *version) VirtualMachines() VirtualMachineInformer {
 	return &virtualMachineInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
 
+// VirtualMachineFlavors returns a VirtualMachineFlavorInformer.
+func (v *version) VirtualMachineFlavors() VirtualMachineFlavorInformer {
+	return &virtualMachineFlavorInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
+
 // VirtualMachineMigrations returns a VirtualMachineMigrationInformer.
 func (v *version) VirtualMachineMigrations() VirtualMachineMigrationInformer {
 	return &virtualMachineMigrationInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// VirtualMachineMigrationBudgets returns a VirtualMachineMigrationBudgetInformer.
+func (v *version) VirtualMachineMigrationBudgets() VirtualMachineMigrationBudgetInformer {
+	return &virtualMachineMigrationBudgetInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// VirtualMachinePools returns a VirtualMachinePoolInformer.
+func (v *version) VirtualMachinePools() VirtualMachinePoolInformer {
+	return &virtualMachinePoolInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// VirtualMachinePoolClaims returns a VirtualMachinePoolClaimInformer.
+func (v *version) VirtualMachinePoolClaims() VirtualMachinePoolClaimInformer {
+	return &virtualMachinePoolClaimInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// VirtualMachineScalingGroups returns a VirtualMachineScalingGroupInformer.
+func (v *version) VirtualMachineScalingGroups() VirtualMachineScalingGroupInformer {
+	return &virtualMachineScalingGroupInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// VirtualMachineSnapshots returns a VirtualMachineSnapshotInformer.
+func (v *version) VirtualMachineSnapshots() VirtualMachineSnapshotInformer {
+	return &virtualMachineSnapshotInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
@@ -33,6 +33,10 @@ type VirtualMachineListerExpansion interface{}
 // VirtualMachineNamespaceLister.
 type VirtualMachineNamespaceListerExpansion interface{}
 
+// VirtualMachineFlavorListerExpansion allows custom methods to be added to
+// VirtualMachineFlavorLister.
+type VirtualMachineFlavorListerExpansion interface{}
+
 // VirtualMachineMigrationListerExpansion allows custom methods to be added to
 // VirtualMachineMigrationLister.
 type VirtualMachineMigrationListerExpansion interface{}
@@ -40,3 +44,43 @@ type VirtualMachineMigrationListerExpansion interface{}
 // VirtualMachineMigrationNamespaceListerExpansion allows custom methods to be added to
 // VirtualMachineMigrationNamespaceLister.
 type VirtualMachineMigrationNamespaceListerExpansion interface{}
+
+// VirtualMachineMigrationBudgetListerExpansion allows custom methods to be added to
+// VirtualMachineMigrationBudgetLister.
+type VirtualMachineMigrationBudgetListerExpansion interface{}
+
+// VirtualMachineMigrationBudgetNamespaceListerExpansion allows custom methods to be added to
+// VirtualMachineMigrationBudgetNamespaceLister.
+type VirtualMachineMigrationBudgetNamespaceListerExpansion interface{}
+
+// VirtualMachinePoolListerExpansion allows custom methods to be added to
+// VirtualMachinePoolLister.
+type VirtualMachinePoolListerExpansion interface{}
+
+// VirtualMachinePoolNamespaceListerExpansion allows custom methods to be added to
+// VirtualMachinePoolNamespaceLister.
+type VirtualMachinePoolNamespaceListerExpansion interface{}
+
+// VirtualMachinePoolClaimListerExpansion allows custom methods to be added to
+// VirtualMachinePoolClaimLister.
+type VirtualMachinePoolClaimListerExpansion interface{}
+
+// VirtualMachinePoolClaimNamespaceListerExpansion allows custom methods to be added to
+// VirtualMachinePoolClaimNamespaceLister.
+type VirtualMachinePoolClaimNamespaceListerExpansion interface{}
+
+// VirtualMachineScalingGroupListerExpansion allows custom methods to be added to
+// VirtualMachineScalingGroupLister.
+type VirtualMachineScalingGroupListerExpansion interface{}
+
+// VirtualMachineScalingGroupNamespaceListerExpansion allows custom methods to be added to
+// VirtualMachineScalingGroupNamespaceLister.
+type VirtualMachineScalingGroupNamespaceListerExpansion interface{}
+
+// VirtualMachineSnapshotListerExpansion allows custom methods to be added to
+// VirtualMachineSnapshotLister.
+type VirtualMachineSnapshotListerExpansion interface{}
+
+// VirtualMachineSnapshotNamespaceListerExpansion allows custom methods to be added to
+// VirtualMachineSnapshotNamespaceLister.
+type VirtualMachineSnapshotNamespaceListerExpansion interface{}
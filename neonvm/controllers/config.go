@@ -1,5 +1,13 @@
 package controllers
 
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
 // ReconcilerConfig stores shared configuration for VirtualMachineReconciler and
 // VirtualMachineMigrationReconciler.
 type ReconcilerConfig struct {
@@ -15,6 +23,13 @@ type ReconcilerConfig struct {
 	// This is defined as a config option so we can do a gradual rollout of this change.
 	UseContainerMgr bool
 
+	// EnforceRunnerMemoryLimit, if true, makes neonvm-runner limit the memory of QEMU's cgroup to
+	// slightly above the VM's maximum memory. Has no effect if UseContainerMgr is true, because
+	// then neonvm-runner doesn't manage the cgroup.
+	//
+	// This field is passed to neonvm-runner as the `-enforce-memory-limit` arg.
+	EnforceRunnerMemoryLimit bool
+
 	MaxConcurrentReconciles int
 
 	// QEMUDiskCacheSettings sets the values of the 'cache.*' settings used for QEMU disks.
@@ -22,6 +37,24 @@ type ReconcilerConfig struct {
 	// This field is passed to neonvm-runner as the `-qemu-disk-cache-settings` arg, and is directly
 	// used in setting up the VM disks via QEMU's `-drive` flag.
 	QEMUDiskCacheSettings string
+
+	// LatestGuestKernelVersion, if not empty, is the guest kernel version that VMs are expected to
+	// be running. VMs with any other version are counted as outdated in the controller's metrics.
+	LatestGuestKernelVersion string
+	// LatestVmBuilderVersion, if not empty, is the version of vm-builder that VMs' root disk images
+	// are expected to be built with. VMs with any other version are counted as outdated in the
+	// controller's metrics.
+	LatestVmBuilderVersion string
+
+	// ComputeUnitCPU and ComputeUnitMemory give the size of a compute unit, which is used to
+	// report the per-node density of VMs in the controller's metrics.
+	ComputeUnitCPU    vmv1.MilliCPU
+	ComputeUnitMemory resource.Quantity
+
+	// VirtioMemResizeTimeout is how long the guest has to finish resizing a VM's virtio-mem device.
+	// If it takes longer, .spec.guest.memorySlots.use is changed to match the memory that the guest
+	// did plug, so that the VM doesn't stay in the Scaling phase. Zero disables the timeout.
+	VirtioMemResizeTimeout time.Duration
 }
 
 func (c *ReconcilerConfig) criEndpointSocketPath() string {
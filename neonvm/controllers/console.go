@@ -0,0 +1,141 @@
+package controllers
+
+// Streaming of the output of VMs' serial consoles, served by the controller so that the kernel and
+// boot logs of a VM can be read without access to its node or the runner pod's network.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// consoleBufferSize is the size of the chunks that console output is forwarded in
+const consoleBufferSize = 4096
+
+// ConsoleHandler returns the handler for GET /console/<namespace>/<name>, which replies with the
+// output of the VM's serial console, similar to 'kubectl logs'.
+//
+// The "follow=true" and "tailBytes" query parameters are passed through to the VM's runner, and
+// behave like 'kubectl logs --follow' and '--limit-bytes', except that tailBytes gives the most
+// recent output rather than the earliest.
+//
+// The console may show secrets passed to the guest, so requests must present the token stored in
+// tokenFile as a bearer token.
+func ConsoleHandler(c client.Client, tokenFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, _ = w.Write([]byte(fmt.Sprintf("request method must be %s", http.MethodGet)))
+			return
+		}
+
+		if code, err := util.CheckBearerToken(r, tokenFile); err != nil {
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/console/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("path must be /console/<namespace>/<name>"))
+			return
+		}
+		name := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+
+		vm := new(vmv1.VirtualMachine)
+		if err := c.Get(r.Context(), name, vm); err != nil {
+			status := http.StatusInternalServerError
+			if apierrors.IsNotFound(err) {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(fmt.Sprintf("failed to get VirtualMachine %s: %s", name, err)))
+			return
+		}
+		if vm.Status.PodName == "" || vm.Status.PodIP == "" {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(fmt.Sprintf("VirtualMachine %s does not have a runner pod", name)))
+			return
+		}
+
+		pod := new(corev1.Pod)
+		if err := c.Get(r.Context(), types.NamespacedName{Namespace: vm.Namespace, Name: vm.Status.PodName}, pod); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("failed to get runner pod %s: %s", vm.Status.PodName, err)))
+			return
+		}
+		runnerVersion, err := getRunnerVersion(pod)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("failed to get runner version of pod %s: %s", pod.Name, err)))
+			return
+		}
+		if !runnerVersion.SupportsConsole() {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(fmt.Sprintf("runner pod %s is too old to stream the console", pod.Name)))
+			return
+		}
+
+		query := url.Values{}
+		for _, param := range []string{"follow", "tailBytes"} {
+			if v := r.URL.Query().Get(param); v != "" {
+				query.Set(param, v)
+			}
+		}
+		runnerURL := fmt.Sprintf("http://%s:%d/console?%s", vm.Status.PodIP, vm.Spec.RunnerPort, query.Encode())
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, runnerURL, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("failed to create request: %s", err)))
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(fmt.Sprintf("failed to get console from runner: %s", err)))
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(fmt.Sprintf("unexpected status from runner: %s", resp.Status)))
+			return
+		}
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusOK)
+
+		// Flush each chunk as it arrives, so that following the console isn't delayed by buffering.
+		flusher, _ := w.(http.Flusher)
+		buf := make([]byte, consoleBufferSize)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+var _ = Describe("VM console", func() {
+	ctx := context.Background()
+
+	// Each test gets its own namespace, because envtest doesn't actually remove namespaces (or
+	// their contents) when they're deleted.
+	var namespace string
+	var tokenFile string
+	var runnerQueries []url.Values
+	var runnerPort int32
+
+	BeforeEach(func() {
+		By("Creating the Namespace to perform the tests")
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "console-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		dir, err := os.MkdirTemp("", "console-test-")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		tokenFile = filepath.Join(dir, "token")
+		Expect(os.WriteFile(tokenFile, []byte("secret\n"), 0o600)).To(Succeed())
+
+		By("Starting the runner's console endpoint")
+		runnerQueries = nil
+		runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Path).To(Equal("/console"))
+			runnerQueries = append(runnerQueries, r.URL.Query())
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte("Linux version 6.1\n"))
+		}))
+		DeferCleanup(runner.Close)
+		runnerURL, err := url.Parse(runner.URL)
+		Expect(err).NotTo(HaveOccurred())
+		_, portStr, err := net.SplitHostPort(runnerURL.Host)
+		Expect(err).NotTo(HaveOccurred())
+		port, err := strconv.Atoi(portStr)
+		Expect(err).NotTo(HaveOccurred())
+		runnerPort = int32(port)
+	})
+
+	AfterEach(func() {
+		By("Deleting the Namespace to perform the tests")
+		_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	})
+
+	// createVM creates the VM "vm", running in the runner pod "vm-runner" with the given version of
+	// the runner protocol
+	createVM := func(runnerVersion api.RunnerProtoVersion) {
+		vm := &vmv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: namespace},
+			Spec:       vmv1.VirtualMachineSpec{RestartPolicy: "Never", RunnerPort: runnerPort},
+		}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		vm.Status.Phase = vmv1.VmRunning
+		vm.Status.PodName = "vm-runner"
+		vm.Status.PodIP = "127.0.0.1"
+		Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "vm-runner",
+				Namespace: namespace,
+				Labels:    map[string]string{vmv1.RunnerPodVersionLabel: strconv.Itoa(int(runnerVersion))},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "neonvm-runner", Image: "runner:test"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+	}
+
+	// get makes a request to the console handler, returning the status code and body
+	get := func(path string, token string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ConsoleHandler(k8sClient, tokenFile).ServeHTTP(w, r)
+		body, err := io.ReadAll(w.Result().Body)
+		Expect(err).NotTo(HaveOccurred())
+		return w.Code, string(body)
+	}
+
+	It("should refuse requests without the token", func() {
+		createVM(api.RunnerProtoV3)
+
+		code, _ := get("/console/"+namespace+"/vm", "")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		code, _ = get("/console/"+namespace+"/vm", "other")
+		Expect(code).To(Equal(http.StatusUnauthorized))
+		Expect(runnerQueries).To(BeEmpty())
+
+		By("Refusing everything if the token can't be read")
+		Expect(os.Remove(tokenFile)).To(Succeed())
+		code, _ = get("/console/"+namespace+"/vm", "secret")
+		Expect(code).To(Equal(http.StatusInternalServerError))
+		Expect(runnerQueries).To(BeEmpty())
+	})
+
+	It("should forward the console from the runner", func() {
+		createVM(api.RunnerProtoV3)
+
+		code, body := get("/console/"+namespace+"/vm?follow=true&tailBytes=100&other=1", "secret")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("Linux version 6.1\n"))
+		// Only the parameters that the runner knows about are passed on
+		Expect(runnerQueries).To(Equal([]url.Values{{"follow": {"true"}, "tailBytes": {"100"}}}))
+	})
+
+	It("should fail for VMs that can't stream their console", func() {
+		By("Requesting the console of a VM that doesn't exist")
+		code, _ := get("/console/"+namespace+"/missing", "secret")
+		Expect(code).To(Equal(http.StatusNotFound))
+
+		By("Requesting an invalid path")
+		code, _ = get("/console/"+namespace, "secret")
+		Expect(code).To(Equal(http.StatusNotFound))
+
+		By("Requesting the console of a VM with an old runner")
+		createVM(api.RunnerProtoV2)
+		code, body := get("/console/"+namespace+"/vm", "secret")
+		Expect(code).To(Equal(http.StatusConflict))
+		Expect(body).To(ContainSubstring("too old"))
+		Expect(runnerQueries).To(BeEmpty())
+	})
+})
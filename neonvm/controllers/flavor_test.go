@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+func TestFlavorResolution(t *testing.T) {
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, vmv1.AddToScheme(scheme))
+
+	flavorWithImage := func(image string) *vmv1.VirtualMachineFlavor {
+		return &vmv1.VirtualMachineFlavor{
+			TypeMeta:   metav1.TypeMeta{},
+			ObjectMeta: metav1.ObjectMeta{Name: "flavor"},
+			Spec: vmv1.VirtualMachineFlavorSpec{
+				RunnerImage:         nil,
+				KernelImage:         nil,
+				AppendKernelCmdline: nil,
+				RootDisk:            &vmv1.FlavorRootDisk{Image: image, Size: resource.Quantity{}},
+				ComputeUnit:         nil,
+				AdditionalNetworks:  nil,
+				ServiceLinks:        nil,
+			},
+		}
+	}
+
+	vm := &vmv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default"},
+	}
+	vm.Spec.Flavor = "flavor"
+	vm.Status.PodName = "vm-source"
+
+	// The source pod is created from the flavor as it was when the VM started
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(flavorWithImage("disk:v1")).Build()
+	flavored, flavorSpec, err := withFlavorApplied(ctx, c, vm)
+	require.NoError(t, err)
+	assert.Equal(t, "disk:v1", flavored.Spec.Guest.RootDisk.Image)
+
+	sourcePod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "vm-source", Namespace: "default"}}
+	require.NoError(t, setFlavorSpecAnnotation(sourcePod, flavorSpec))
+	require.NoError(t, c.Create(ctx, sourcePod))
+
+	// ... and then the flavor is edited
+	var flavor vmv1.VirtualMachineFlavor
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "flavor"}, &flavor))
+	flavor.Spec.RootDisk.Image = "disk:v2"
+	require.NoError(t, c.Update(ctx, &flavor))
+
+	// New pods (e.g. after a restart) use the current flavor
+	flavored, _, err = withFlavorApplied(ctx, c, vm)
+	require.NoError(t, err)
+	assert.Equal(t, "disk:v2", flavored.Spec.Guest.RootDisk.Image)
+
+	// ... but the migration target is built the same way as the source pod, and records the same
+	// flavor spec for the next migration.
+	flavored, targetSpec, err := withSourceFlavorApplied(ctx, c, vm)
+	require.NoError(t, err)
+	assert.Equal(t, "disk:v1", flavored.Spec.Guest.RootDisk.Image)
+	assert.Equal(t, flavorSpec, targetSpec)
+
+	// Source pods without a recorded flavor spec fall back to the current flavor
+	delete(sourcePod.Annotations, vmv1.FlavorSpecAnnotation)
+	require.NoError(t, c.Update(ctx, sourcePod))
+	flavored, _, err = withSourceFlavorApplied(ctx, c, vm)
+	require.NoError(t, err)
+	assert.Equal(t, "disk:v2", flavored.Spec.Guest.RootDisk.Image)
+
+	// VMs without a flavor are used as-is, without looking anything up
+	plain := vm.DeepCopy()
+	plain.Spec.Flavor = ""
+	plain.Status.PodName = "missing"
+	flavored, flavorSpec, err = withSourceFlavorApplied(ctx, c, plain)
+	require.NoError(t, err)
+	assert.Same(t, plain, flavored)
+	assert.Nil(t, flavorSpec)
+}
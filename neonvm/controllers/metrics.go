@@ -10,6 +10,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/util"
 )
 
@@ -19,6 +20,12 @@ type ReconcilerMetrics struct {
 	runnerCreationToVMRunningTime  prometheus.Histogram
 	vmCreationToVMRunningTime      prometheus.Histogram
 	vmRestartCounts                prometheus.Counter
+	guestVersions                  *guestVersionMetrics
+	nodeDensity                    *nodeDensityMetrics
+	poolVMs                        *prometheus.GaugeVec
+	poolClaims                     *prometheus.CounterVec
+	scalingGroupReplicas           *prometheus.GaugeVec
+	scalingGroupUtilization        *prometheus.GaugeVec
 }
 
 func MakeReconcilerMetrics() ReconcilerMetrics {
@@ -62,10 +69,190 @@ func MakeReconcilerMetrics() ReconcilerMetrics {
 				Help: "Total number of VM restarts across the cluster captured by VirtualMachine reconciler",
 			},
 		)),
+		guestVersions: &guestVersionMetrics{
+			versions: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_guest_versions",
+					Help: "Number of VMs running each version of the software in the guest, as recorded in .status.guestInfo",
+				},
+				[]string{"component", "version"},
+			)),
+			outdated: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_guest_outdated",
+					Help: "Number of VMs running a version of the guest kernel or vm-builder other than the configured latest version",
+				},
+				[]string{"component"},
+			)),
+			lock:   sync.Mutex{},
+			byVM:   make(map[client.ObjectKey][]guestComponent),
+			counts: make(map[guestComponent]int),
+		},
+		nodeDensity: &nodeDensityMetrics{
+			vms: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_node_vms",
+					Help: "Number of running VMs on each node",
+				},
+				[]string{"node"},
+			)),
+			reservedCU: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_node_reserved_compute_units",
+					Help: "Total compute units that the VMs on each node may scale up to",
+				},
+				[]string{"node"},
+			)),
+			usedCU: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_node_used_compute_units",
+					Help: "Total compute units currently used by the VMs on each node",
+				},
+				[]string{"node"},
+			)),
+			fragmentation: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_node_memory_slot_fragmentation",
+					Help: "Fraction of the memory slots of the VMs on each node that are not plugged in",
+				},
+				[]string{"node"},
+			)),
+			packingEfficiency: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "vm_node_packing_efficiency",
+					Help: "Ratio of used to reserved compute units of the VMs on each node",
+				},
+				[]string{"node"},
+			)),
+			lock:   sync.Mutex{},
+			byVM:   make(map[client.ObjectKey]vmDensity),
+			byNode: make(map[string]*nodeDensityTotals),
+		},
+		poolVMs: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vm_pool_vms",
+				Help: "Number of unclaimed VMs in each VirtualMachinePool, by whether they're ready to be claimed",
+			},
+			[]string{"namespace", "pool", "state"},
+		)),
+		poolClaims: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_pool_claims_total",
+				Help: "Number of VMs claimed from each VirtualMachinePool",
+			},
+			[]string{"namespace", "pool"},
+		)),
+		scalingGroupReplicas: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vm_scaling_group_replicas",
+				Help: "Number of replica VMs in each VirtualMachineScalingGroup, by whether they're running",
+			},
+			[]string{"namespace", "group", "state"},
+		)),
+		scalingGroupUtilization: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vm_scaling_group_utilization_ratio",
+				Help: "Ratio of the vCPUs in use by the running replicas of each VirtualMachineScalingGroup to their maximum vCPUs",
+			},
+			[]string{"namespace", "group"},
+		)),
 	}
+	// Initialize the outdated counts, so they're reported even if there's no outdated VMs
+	m.guestVersions.outdated.WithLabelValues(guestComponentKernel)
+	m.guestVersions.outdated.WithLabelValues(guestComponentVmBuilder)
 	return m
 }
 
+// guestVersionMetrics tracks the versions of the software that each VM's guest is running, so we
+// can report the version skew across the cluster, and how many VMs need to be restarted to get
+// them up to date.
+type guestVersionMetrics struct {
+	versions *prometheus.GaugeVec
+	outdated *prometheus.GaugeVec
+
+	lock sync.Mutex
+	byVM map[client.ObjectKey][]guestComponent
+	// counts gives the number of VMs with each component, so that we can remove labels from the
+	// versions metric once they're no longer used.
+	counts map[guestComponent]int
+}
+
+const (
+	guestComponentKernel    = "kernel"
+	guestComponentVmBuilder = "vmBuilder"
+)
+
+type guestComponent struct {
+	name     string
+	version  string
+	outdated bool
+}
+
+// guestComponents returns the components from the guest info that are reported in the metrics
+func guestComponents(info *vmv1.GuestInfo, config *ReconcilerConfig) []guestComponent {
+	if info == nil {
+		return nil
+	}
+
+	var components []guestComponent
+	add := func(name, version, latest string) {
+		if version == "" {
+			return
+		}
+		components = append(components, guestComponent{
+			name:     name,
+			version:  version,
+			outdated: latest != "" && version != latest,
+		})
+	}
+
+	add(guestComponentKernel, info.KernelVersion, config.LatestGuestKernelVersion)
+	add(guestComponentVmBuilder, info.VmBuilderVersion, config.LatestVmBuilderVersion)
+	for name, version := range info.Daemons {
+		add(name, version, "")
+	}
+	return components
+}
+
+// update sets the components used by the VM, replacing any that were previously set. If the VM
+// was deleted, components should be nil.
+func (m *guestVersionMetrics) update(key client.ObjectKey, components []guestComponent) {
+	// guestVersions isn't set in tests
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.byVM[key] {
+		m.counts[c] -= 1
+		if m.counts[c] == 0 {
+			delete(m.counts, c)
+			m.versions.DeleteLabelValues(c.name, c.version)
+		} else {
+			m.versions.WithLabelValues(c.name, c.version).Set(float64(m.counts[c]))
+		}
+		if c.outdated {
+			m.outdated.WithLabelValues(c.name).Dec()
+		}
+	}
+
+	for _, c := range components {
+		m.counts[c] += 1
+		m.versions.WithLabelValues(c.name, c.version).Set(float64(m.counts[c]))
+		if c.outdated {
+			m.outdated.WithLabelValues(c.name).Inc()
+		}
+	}
+
+	if len(components) == 0 {
+		delete(m.byVM, key)
+	} else {
+		m.byVM[key] = components
+	}
+}
+
 type wrappedReconciler struct {
 	ControllerName string
 	Reconciler     reconcile.Reconciler
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// staleClient returns the objects from a snapshot for List, like a reconciler whose informer cache
+// hasn't caught up yet
+type staleClient struct {
+	client.Client
+	snapshot client.Client
+}
+
+func (c staleClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.snapshot.List(ctx, list, opts...)
+}
+
+var _ = Describe("VirtualMachineMigrationBudget admission", func() {
+	ctx := context.Background()
+
+	// Each test gets its own namespace, because envtest doesn't actually remove namespaces (or
+	// their contents) when they're deleted.
+	var namespace string
+	var reconciler *VirtualMachineMigrationReconciler
+
+	BeforeEach(func() {
+		By("Creating the Namespace to perform the tests")
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "budget-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		By("Creating the budget, allowing one migration at a time")
+		budget := &vmv1.VirtualMachineMigrationBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: "budget", Namespace: namespace},
+			Spec: vmv1.VirtualMachineMigrationBudgetSpec{
+				Selector:                metav1.LabelSelector{MatchLabels: map[string]string{"endpoint": "ep-1"}},
+				MaxConcurrentMigrations: 1,
+			},
+		}
+		Expect(k8sClient.Create(ctx, budget)).To(Succeed())
+
+		reconciler = &VirtualMachineMigrationReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: nil,
+			Config:   nil,
+		}
+	})
+
+	AfterEach(func() {
+		By("Deleting the Namespace to perform the tests")
+		_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	})
+
+	createVM := func(name string, phase vmv1.VmPhase) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{"endpoint": "ep-1"},
+			},
+			Spec: vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+		}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		vm.Status.Phase = phase
+		Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+		return vm
+	}
+
+	createMigration := func(name string, vmName string) *vmv1.VirtualMachineMigration {
+		m := &vmv1.VirtualMachineMigration{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}
+		m.Spec.VmName = vmName
+		Expect(k8sClient.Create(ctx, m)).To(Succeed())
+		return m
+	}
+
+	getAdmitted := func() []vmv1.AdmittedMigration {
+		var budget vmv1.VirtualMachineMigrationBudget
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "budget"}, &budget)).To(Succeed())
+		return budget.Status.AdmittedMigrations
+	}
+
+	It("should admit one migration at a time, even from a stale cache", func() {
+		vmA := createVM("vm-a", vmv1.VmRunning)
+		vmB := createVM("vm-b", vmv1.VmRunning)
+		migrationA := createMigration("migration-a", "vm-a")
+		migrationB := createMigration("migration-b", "vm-b")
+
+		// A reconcile of the second migration that started at the same time only sees the state
+		// from before the first was admitted.
+		var budget vmv1.VirtualMachineMigrationBudget
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "budget"}, &budget)).To(Succeed())
+		snapshot := fake.NewClientBuilder().WithScheme(k8sClient.Scheme()).WithObjects(
+			vmA.DeepCopy(), vmB.DeepCopy(), migrationA.DeepCopy(), migrationB.DeepCopy(), &budget,
+		).Build()
+		stale := &VirtualMachineMigrationReconciler{
+			Client:   staleClient{Client: k8sClient, snapshot: snapshot},
+			Scheme:   k8sClient.Scheme(),
+			Recorder: nil,
+			Config:   nil,
+		}
+
+		By("Admitting the first migration")
+		blockedBy, err := reconciler.admitMigration(ctx, vmA, migrationA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal(""))
+		Expect(getAdmitted()).To(Equal([]vmv1.AdmittedMigration{{Name: "migration-a", VmName: "vm-a"}}))
+
+		By("Admitting it again, as if the reconcile was retried, without counting it twice")
+		blockedBy, err = reconciler.admitMigration(ctx, vmA, migrationA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal(""))
+
+		By("Admitting the second migration from the stale cache")
+		// It would be allowed, but that can't be recorded because the budget was updated in the
+		// meantime.
+		_, err = stale.admitMigration(ctx, vmB, migrationB)
+		Expect(apierrors.IsConflict(err)).To(BeTrue(), "expected conflict, got %v", err)
+
+		By("Retrying with up-to-date state")
+		blockedBy, err = reconciler.admitMigration(ctx, vmB, migrationB)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal("budget"))
+
+		By("Finishing the first migration, so that the second is admitted in its place")
+		migrationA.Status.Phase = vmv1.VmmSucceeded
+		Expect(k8sClient.Status().Update(ctx, migrationA)).To(Succeed())
+
+		blockedBy, err = reconciler.admitMigration(ctx, vmB, migrationB)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal(""))
+		Expect(getAdmitted()).To(Equal([]vmv1.AdmittedMigration{{Name: "migration-b", VmName: "vm-b"}}))
+	})
+
+	It("should count VMs that are migrating without an admitted migration", func() {
+		// vm-a is migrating without an admitted migration, e.g. because it started before the
+		// budget was created.
+		vmA := createVM("vm-a", vmv1.VmMigrating)
+		vmB := createVM("vm-b", vmv1.VmRunning)
+		migrationB := createMigration("migration-b", "vm-b")
+
+		blockedBy, err := reconciler.admitMigration(ctx, vmB, migrationB)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal("budget"))
+		Expect(getAdmitted()).To(BeEmpty())
+
+		By("Moving the migrating VM out of the budget's selector")
+		vmA.Labels = map[string]string{"endpoint": "ep-2"}
+		Expect(k8sClient.Update(ctx, vmA)).To(Succeed())
+
+		blockedBy, err = reconciler.admitMigration(ctx, vmB, migrationB)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockedBy).To(Equal(""))
+	})
+})
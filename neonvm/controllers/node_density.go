@@ -0,0 +1,200 @@
+package controllers
+
+// Per-node VM density and packing efficiency, computed from the VMs' specs and statuses so that
+// it's available in one place, for both dashboards and the rebalancer.
+
+import (
+	"math"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// NodeDensity summarizes the VMs running on a single node, as served by the controller's debug
+// server at /nodes
+type NodeDensity struct {
+	Node string `json:"node"`
+	VMs  int    `json:"vms"`
+
+	// ReservedCU is the total number of compute units that the node's VMs may scale up to
+	ReservedCU float64 `json:"reservedCU"`
+	// UsedCU is the total number of compute units that the node's VMs are currently using
+	UsedCU float64 `json:"usedCU"`
+
+	// MemorySlotFragmentation is the fraction of the node's VMs' memory slots that are not
+	// currently plugged in
+	MemorySlotFragmentation float64 `json:"memorySlotFragmentation"`
+	// PackingEfficiency is the ratio of UsedCU to ReservedCU, between 0 and 1. Low values mean that
+	// much of what's reserved on the node is idle.
+	PackingEfficiency float64 `json:"packingEfficiency"`
+}
+
+// vmDensity is a single VM's contribution to its node's density
+type vmDensity struct {
+	node         string
+	reservedCU   float64
+	usedCU       float64
+	slotsTotal   int32
+	slotsPlugged int32
+}
+
+// nodeDensityTotals is the sum of vmDensity for all VMs on a node
+type nodeDensityTotals struct {
+	vms          int
+	reservedCU   float64
+	usedCU       float64
+	slotsTotal   int64
+	slotsPlugged int64
+}
+
+func (t *nodeDensityTotals) add(d vmDensity, sign int) {
+	t.vms += sign
+	t.reservedCU += float64(sign) * d.reservedCU
+	t.usedCU += float64(sign) * d.usedCU
+	t.slotsTotal += int64(sign) * int64(d.slotsTotal)
+	t.slotsPlugged += int64(sign) * int64(d.slotsPlugged)
+}
+
+func (t *nodeDensityTotals) summary(node string) NodeDensity {
+	fragmentation := 0.0
+	if t.slotsTotal != 0 {
+		fragmentation = float64(t.slotsTotal-t.slotsPlugged) / float64(t.slotsTotal)
+	}
+	efficiency := 0.0
+	if t.reservedCU != 0 {
+		efficiency = t.usedCU / t.reservedCU
+	}
+
+	return NodeDensity{
+		Node:                    node,
+		VMs:                     t.vms,
+		ReservedCU:              t.reservedCU,
+		UsedCU:                  t.usedCU,
+		MemorySlotFragmentation: fragmentation,
+		PackingEfficiency:       efficiency,
+	}
+}
+
+// nodeDensityMetrics tracks the density of VMs on each node
+type nodeDensityMetrics struct {
+	vms               *prometheus.GaugeVec
+	reservedCU        *prometheus.GaugeVec
+	usedCU            *prometheus.GaugeVec
+	fragmentation     *prometheus.GaugeVec
+	packingEfficiency *prometheus.GaugeVec
+
+	lock   sync.Mutex
+	byVM   map[client.ObjectKey]vmDensity
+	byNode map[string]*nodeDensityTotals
+}
+
+// vmDensityFor returns the VM's contribution to its node's density, or nil if it isn't currently
+// running on a node
+func vmDensityFor(vm *vmv1.VirtualMachine, config *ReconcilerConfig) *vmDensity {
+	if vm.Status.Node == "" || vm.Status.CPUs == nil || vm.Status.MemorySize == nil {
+		return nil
+	}
+
+	slotSize := vm.Spec.Guest.MemorySlotSize.Value()
+	maxCPU := vm.Spec.Guest.CPUs.Max
+	maxSlots := vm.Spec.Guest.MemorySlots.Max
+	if slotSize == 0 || maxCPU == nil || maxSlots == nil {
+		return nil
+	}
+
+	computeUnits := func(cpu vmv1.MilliCPU, memBytes int64) float64 {
+		return math.Max(
+			cpu.AsFloat64()/config.ComputeUnitCPU.AsFloat64(),
+			float64(memBytes)/float64(config.ComputeUnitMemory.Value()),
+		)
+	}
+
+	return &vmDensity{
+		node:         vm.Status.Node,
+		reservedCU:   computeUnits(*maxCPU, int64(*maxSlots)*slotSize),
+		usedCU:       computeUnits(*vm.Status.CPUs, vm.Status.MemorySize.Value()),
+		slotsTotal:   *maxSlots,
+		slotsPlugged: int32(vm.Status.MemorySize.Value() / slotSize),
+	}
+}
+
+// update sets the VM's contribution to its node's density, replacing any that was previously set.
+// If the VM was deleted or isn't running on a node, density should be nil.
+func (m *nodeDensityMetrics) update(key client.ObjectKey, density *vmDensity) {
+	// nodeDensity isn't set in tests
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, hadOld := m.byVM[key]
+	if hadOld && density != nil && old == *density {
+		return
+	}
+
+	if hadOld {
+		delete(m.byVM, key)
+		totals := m.byNode[old.node]
+		totals.add(old, -1)
+		m.refresh(old.node)
+	}
+	if density != nil {
+		m.byVM[key] = *density
+		totals, ok := m.byNode[density.node]
+		if !ok {
+			totals = &nodeDensityTotals{vms: 0, reservedCU: 0, usedCU: 0, slotsTotal: 0, slotsPlugged: 0}
+			m.byNode[density.node] = totals
+		}
+		totals.add(*density, 1)
+		m.refresh(density.node)
+	}
+}
+
+// refresh updates the metrics for the node to match its totals, removing them if there are no
+// longer any VMs on the node.
+//
+// This method expects m.lock to be held.
+func (m *nodeDensityMetrics) refresh(node string) {
+	totals := m.byNode[node]
+	if totals.vms == 0 {
+		delete(m.byNode, node)
+		m.vms.DeleteLabelValues(node)
+		m.reservedCU.DeleteLabelValues(node)
+		m.usedCU.DeleteLabelValues(node)
+		m.fragmentation.DeleteLabelValues(node)
+		m.packingEfficiency.DeleteLabelValues(node)
+		return
+	}
+
+	summary := totals.summary(node)
+	m.vms.WithLabelValues(node).Set(float64(summary.VMs))
+	m.reservedCU.WithLabelValues(node).Set(summary.ReservedCU)
+	m.usedCU.WithLabelValues(node).Set(summary.UsedCU)
+	m.fragmentation.WithLabelValues(node).Set(summary.MemorySlotFragmentation)
+	m.packingEfficiency.WithLabelValues(node).Set(summary.PackingEfficiency)
+}
+
+// NodeDensity returns the current density of VMs on each node, ordered by node name
+func (m ReconcilerMetrics) NodeDensity() []NodeDensity {
+	if m.nodeDensity == nil {
+		return []NodeDensity{}
+	}
+
+	m.nodeDensity.lock.Lock()
+	defer m.nodeDensity.lock.Unlock()
+
+	nodes := make([]NodeDensity, 0, len(m.nodeDensity.byNode))
+	for node, totals := range m.nodeDensity.byNode {
+		nodes = append(nodes, totals.summary(node))
+	}
+	slices.SortFunc(nodes, func(a, b NodeDensity) (less bool) {
+		return a.Node < b.Node
+	})
+	return nodes
+}
@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+var _ = Describe("VirtualMachinePool controller", func() {
+	ctx := context.Background()
+
+	// Each test gets its own namespace, because envtest doesn't actually remove namespaces (or
+	// their contents) when they're deleted.
+	var namespace string
+	var reconciler *VirtualMachinePoolReconciler
+
+	BeforeEach(func() {
+		By("Creating the Namespace to perform the tests")
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "pool-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		reconciler = &VirtualMachinePoolReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: record.NewFakeRecorder(100),
+			Config:   nil,
+			Metrics:  ReconcilerMetrics{},
+		}
+	})
+
+	AfterEach(func() {
+		By("Deleting the Namespace to perform the tests")
+		_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	})
+
+	createPool := func(replicas int32) *vmv1.VirtualMachinePool {
+		pool := &vmv1.VirtualMachinePool{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool", Namespace: namespace},
+			Spec: vmv1.VirtualMachinePoolSpec{
+				Replicas: replicas,
+				Template: vmv1.VirtualMachineTemplateSpec{
+					Metadata: vmv1.VirtualMachineTemplateMeta{
+						Labels:      map[string]string{"size": "small"},
+						Annotations: nil,
+					},
+					Spec: vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pool)).To(Succeed())
+		return pool
+	}
+
+	// createPoolVM creates a VM in the pool, in the given phase. The pool orders VMs by when they
+	// were created, which only has a resolution of one second; with equal timestamps, they're
+	// ordered by name.
+	createPoolVM := func(pool *vmv1.VirtualMachinePool, name string, phase vmv1.VmPhase, extraLabels map[string]string) *vmv1.VirtualMachine {
+		labels := map[string]string{vmv1.VirtualMachinePoolLabel: pool.Name, "size": "small"}
+		for k, v := range extraLabels {
+			labels[k] = v
+		}
+		vm := &vmv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+			Spec:       vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+		}
+		Expect(ctrl.SetControllerReference(pool, vm, k8sClient.Scheme())).To(Succeed())
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		vm.Status.Phase = phase
+		Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+		return vm
+	}
+
+	createClaim := func(name string, status vmv1.VirtualMachinePoolClaimStatus) *vmv1.VirtualMachinePoolClaim {
+		claim := &vmv1.VirtualMachinePoolClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: vmv1.VirtualMachinePoolClaimSpec{
+				PoolName: "pool",
+				Metadata: vmv1.VirtualMachineTemplateMeta{
+					Labels:      map[string]string{"endpoint": name},
+					Annotations: map[string]string{"claimed-by": name},
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, claim)).To(Succeed())
+
+		if status != (vmv1.VirtualMachinePoolClaimStatus{}) {
+			claim.Status = status
+			Expect(k8sClient.Status().Update(ctx, claim)).To(Succeed())
+		}
+		return claim
+	}
+
+	reconcilePool := func(r *VirtualMachinePoolReconciler) error {
+		_, err := r.Reconcile(ctx, ctrl.Request{
+			NamespacedName: client.ObjectKey{Namespace: namespace, Name: "pool"},
+		})
+		return err
+	}
+
+	// listPoolVMs returns the VMs that are still in the pool, by name
+	listPoolVMs := func() map[string]vmv1.VirtualMachine {
+		var vms vmv1.VirtualMachineList
+		Expect(k8sClient.List(
+			ctx,
+			&vms,
+			client.InNamespace(namespace),
+			client.MatchingLabels{vmv1.VirtualMachinePoolLabel: "pool"},
+		)).To(Succeed())
+		byName := make(map[string]vmv1.VirtualMachine)
+		for _, vm := range vms.Items {
+			byName[vm.Name] = vm
+		}
+		return byName
+	}
+
+	getPool := func() *vmv1.VirtualMachinePool {
+		pool := &vmv1.VirtualMachinePool{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "pool"}, pool)).To(Succeed())
+		return pool
+	}
+	getClaim := func(name string) *vmv1.VirtualMachinePoolClaim {
+		claim := &vmv1.VirtualMachinePoolClaim{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, claim)).To(Succeed())
+		return claim
+	}
+	getVM := func(name string) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, vm)).To(Succeed())
+		return vm
+	}
+
+	It("should fill the pool from the template, and replace stopped VMs", func() {
+		pool := createPool(2)
+
+		By("Reconciling the empty pool")
+		Expect(reconcilePool(reconciler)).To(Succeed())
+		vms := listPoolVMs()
+		Expect(vms).To(HaveLen(2))
+		var failed string
+		for name, vm := range vms {
+			vm := vm
+			Expect(vm.Labels["size"]).To(Equal("small"))
+			Expect(metav1.IsControlledBy(&vm, pool)).To(BeTrue())
+			failed = name
+		}
+		Expect(getPool().Status).To(Equal(vmv1.VirtualMachinePoolStatus{Ready: 0, Pending: 2, Claimed: 0}))
+
+		By("Stopping one of the VMs, so that it can't be claimed")
+		vm := vms[failed]
+		vm.Status.Phase = vmv1.VmFailed
+		Expect(k8sClient.Status().Update(ctx, &vm)).To(Succeed())
+
+		Expect(reconcilePool(reconciler)).To(Succeed())
+		vms = listPoolVMs()
+		Expect(vms).To(HaveLen(2))
+		Expect(vms).NotTo(HaveKey(failed))
+	})
+
+	It("should remove VMs that aren't ready first, and then the newest", func() {
+		pool := createPool(1)
+		createPoolVM(pool, "vm-1-ready", vmv1.VmRunning, nil)
+		// Make sure the creation timestamps differ, so that the newest VM is well-defined.
+		time.Sleep(time.Second)
+		createPoolVM(pool, "vm-2-ready", vmv1.VmRunning, nil)
+		createPoolVM(pool, "vm-3-pending", vmv1.VmPending, nil)
+
+		Expect(reconcilePool(reconciler)).To(Succeed())
+		vms := listPoolVMs()
+		Expect(vms).To(HaveLen(1))
+		Expect(vms).To(HaveKey("vm-1-ready"))
+		Expect(getPool().Status).To(Equal(vmv1.VirtualMachinePoolStatus{Ready: 1, Pending: 0, Claimed: 0}))
+	})
+
+	It("should bind claims in order, to the oldest VMs first", func() {
+		pool := createPool(2)
+		createPoolVM(pool, "vm-1", vmv1.VmRunning, nil)
+		createPoolVM(pool, "vm-2", vmv1.VmRunning, nil)
+		createClaim("claim-a", vmv1.VirtualMachinePoolClaimStatus{})
+		createClaim("claim-b", vmv1.VirtualMachinePoolClaimStatus{})
+		createClaim("claim-c", vmv1.VirtualMachinePoolClaimStatus{})
+
+		Expect(reconcilePool(reconciler)).To(Succeed())
+
+		By("Checking that each VM was bound to only one claim, and released with its metadata")
+		for claimName, vmName := range map[string]string{"claim-a": "vm-1", "claim-b": "vm-2"} {
+			Expect(getClaim(claimName).Status).To(Equal(vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimBound, VmName: vmName}))
+
+			vm := getVM(vmName)
+			Expect(vm.OwnerReferences).To(BeEmpty())
+			Expect(vm.Labels).NotTo(HaveKey(vmv1.VirtualMachinePoolLabel))
+			Expect(vm.Labels["endpoint"]).To(Equal(claimName))
+			Expect(vm.Labels["size"]).To(Equal("small"))
+			Expect(vm.Annotations["claimed-by"]).To(Equal(claimName))
+			Expect(vm.Annotations[vmv1.VirtualMachinePoolClaimAnnotation]).To(Equal(claimName))
+		}
+
+		By("Checking that the last claim waits for the replacement VMs to start")
+		Expect(getClaim("claim-c").Status).To(Equal(vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimPending, VmName: ""}))
+		vms := listPoolVMs()
+		Expect(vms).To(HaveLen(2))
+		Expect(getPool().Status).To(Equal(vmv1.VirtualMachinePoolStatus{Ready: 0, Pending: 2, Claimed: 2}))
+
+		for _, vm := range vms {
+			vm := vm
+			vm.Status.Phase = vmv1.VmRunning
+			Expect(k8sClient.Status().Update(ctx, &vm)).To(Succeed())
+		}
+		Expect(reconcilePool(reconciler)).To(Succeed())
+
+		claimC := getClaim("claim-c")
+		Expect(claimC.Status.Phase).To(Equal(vmv1.PoolClaimBound))
+		Expect(vms).To(HaveKey(claimC.Status.VmName))
+		Expect(listPoolVMs()).To(HaveLen(2))
+	})
+
+	It("should finish binding claims after an interrupted reconcile", func() {
+		pool := createPool(1)
+		createPoolVM(pool, "vm-a", vmv1.VmRunning, nil)
+		// vm-b is assigned to claim-b, but was then claimed directly, through the label
+		createPoolVM(pool, "vm-b", vmv1.VmRunning, map[string]string{vmv1.VirtualMachinePoolClaimedLabel: "true"})
+		createPoolVM(pool, "vm-c", vmv1.VmRunning, nil)
+		// claim-a was assigned its VM, but the reconcile stopped before the VM was released
+		createClaim("claim-a", vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimPending, VmName: "vm-a"})
+		createClaim("claim-b", vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimPending, VmName: "vm-b"})
+
+		Expect(reconcilePool(reconciler)).To(Succeed())
+
+		Expect(getClaim("claim-a").Status).To(Equal(vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimBound, VmName: "vm-a"}))
+		// claim-b gets another VM instead
+		Expect(getClaim("claim-b").Status).To(Equal(vmv1.VirtualMachinePoolClaimStatus{Phase: vmv1.PoolClaimBound, VmName: "vm-c"}))
+		Expect(getVM("vm-b").Annotations).NotTo(HaveKey(vmv1.VirtualMachinePoolClaimAnnotation))
+		Expect(getPool().Status.Claimed).To(Equal(int64(3)))
+	})
+
+	It("should not bind a claim twice from a stale cache", func() {
+		pool := createPool(1)
+		vm := createPoolVM(pool, "vm", vmv1.VmRunning, nil)
+		claim := createClaim("claim", vmv1.VirtualMachinePoolClaimStatus{})
+
+		// The snapshot has the same objects, from before the claim was bound
+		snapshot := fake.NewClientBuilder().WithScheme(k8sClient.Scheme()).WithObjects(
+			getPool(), getVM(vm.Name), getClaim(claim.Name),
+		).Build()
+
+		Expect(reconcilePool(reconciler)).To(Succeed())
+		bound := getClaim("claim")
+		Expect(bound.Status.Phase).To(Equal(vmv1.PoolClaimBound))
+
+		By("Reconciling with a client that still sees the claim as unbound")
+		stale := &VirtualMachinePoolReconciler{
+			Client:   staleClient{Client: k8sClient, snapshot: snapshot},
+			Scheme:   k8sClient.Scheme(),
+			Recorder: record.NewFakeRecorder(100),
+			Config:   nil,
+			Metrics:  ReconcilerMetrics{},
+		}
+		err := reconcilePool(stale)
+		Expect(apierrors.IsConflict(err)).To(BeTrue(), "expected conflict, got %v", err)
+
+		Expect(getClaim("claim").Status).To(Equal(bound.Status))
+	})
+})
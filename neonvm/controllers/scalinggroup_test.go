@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+func scalingGroupTestSpec() vmv1.VirtualMachineScalingGroupSpec {
+	return vmv1.VirtualMachineScalingGroupSpec{
+		MinReplicas:                 1,
+		MaxReplicas:                 3,
+		ScaleUpUtilizationPercent:   90,
+		ScaleDownUtilizationPercent: 30,
+		StabilizationSeconds:        60,
+		Template: vmv1.VirtualMachineTemplateSpec{
+			Metadata: vmv1.VirtualMachineTemplateMeta{Labels: nil, Annotations: nil},
+			Spec:     vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+		},
+	}
+}
+
+var _ = Describe("VirtualMachineScalingGroup scaling", func() {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ago := func(seconds int) *metav1.Time {
+		t := metav1.NewTime(now.Add(-time.Duration(seconds) * time.Second))
+		return &t
+	}
+	at := func(t time.Time) *metav1.Time {
+		m := metav1.NewTime(t)
+		return &m
+	}
+
+	type status = vmv1.VirtualMachineScalingGroupStatus
+
+	DescribeTable("scaleReplicas",
+		func(current status, ready int, pending int, desired int32, expected status) {
+			spec := scalingGroupTestSpec()
+			Expect(scaleReplicas(&spec, &current, ready, pending, now)).To(Equal(desired))
+			Expect(current).To(Equal(expected))
+		},
+		Entry("should start a new group at its minimum",
+			status{}, 0, 0, int32(1),
+			status{Replicas: 1, LastScaleTime: at(now)},
+		),
+		Entry("should clamp the replicas to the maximum",
+			status{Replicas: 5, UtilizationPercent: 50}, 5, 0, int32(3),
+			status{Replicas: 3, UtilizationPercent: 50, LastScaleTime: at(now)},
+		),
+		Entry("should record when utilization goes above the threshold",
+			status{Replicas: 1, UtilizationPercent: 95}, 1, 0, int32(1),
+			status{Replicas: 1, UtilizationPercent: 95, AboveThresholdSince: at(now)},
+		),
+		Entry("should not scale up before utilization has been stable",
+			status{Replicas: 1, UtilizationPercent: 95, AboveThresholdSince: ago(30)}, 1, 0, int32(1),
+			status{Replicas: 1, UtilizationPercent: 95, AboveThresholdSince: ago(30)},
+		),
+		Entry("should scale up once utilization has been stable",
+			status{Replicas: 1, UtilizationPercent: 95, AboveThresholdSince: ago(60)}, 1, 0, int32(2),
+			status{Replicas: 2, UtilizationPercent: 95, LastScaleTime: at(now)},
+		),
+		Entry("should not scale up while replicas are pending",
+			status{Replicas: 2, UtilizationPercent: 95, AboveThresholdSince: ago(60)}, 1, 1, int32(2),
+			status{Replicas: 2, UtilizationPercent: 95, AboveThresholdSince: ago(60)},
+		),
+		Entry("should not scale up too soon after the last scaling",
+			status{Replicas: 2, UtilizationPercent: 95, AboveThresholdSince: ago(60), LastScaleTime: ago(30)}, 2, 0, int32(2),
+			status{Replicas: 2, UtilizationPercent: 95, AboveThresholdSince: ago(60), LastScaleTime: ago(30)},
+		),
+		Entry("should not scale up past the maximum",
+			status{Replicas: 3, UtilizationPercent: 95, AboveThresholdSince: ago(600)}, 3, 0, int32(3),
+			status{Replicas: 3, UtilizationPercent: 95, AboveThresholdSince: ago(600)},
+		),
+		Entry("should scale down once utilization has been stable",
+			status{Replicas: 3, UtilizationPercent: 10, BelowThresholdSince: ago(60)}, 3, 0, int32(2),
+			status{Replicas: 2, UtilizationPercent: 10, LastScaleTime: at(now)},
+		),
+		Entry("should not scale down past the minimum",
+			status{Replicas: 1, UtilizationPercent: 10, BelowThresholdSince: ago(600)}, 1, 0, int32(1),
+			status{Replicas: 1, UtilizationPercent: 10, BelowThresholdSince: ago(600)},
+		),
+		Entry("should reset the thresholds when utilization is between them",
+			status{Replicas: 2, UtilizationPercent: 50, AboveThresholdSince: ago(30)}, 2, 0, int32(2),
+			status{Replicas: 2, UtilizationPercent: 50},
+		),
+		Entry("should not cross a threshold without ready replicas",
+			status{Replicas: 2, UtilizationPercent: 0}, 0, 2, int32(2),
+			status{Replicas: 2, UtilizationPercent: 0},
+		),
+	)
+
+	DescribeTable("nextScalingCheck",
+		func(current status, expected time.Duration) {
+			spec := scalingGroupTestSpec()
+			Expect(nextScalingCheck(&spec, &current, now)).To(Equal(expected))
+		},
+		Entry("should not requeue within the thresholds", status{LastScaleTime: ago(10)}, time.Duration(0)),
+		Entry("should requeue when stable above the threshold", status{AboveThresholdSince: ago(20)}, 40*time.Second),
+		Entry("should requeue when stable below the threshold", status{BelowThresholdSince: ago(50)}, 10*time.Second),
+		Entry("should wait for the last scaling to settle", status{AboveThresholdSince: ago(50), LastScaleTime: ago(15)}, 45*time.Second),
+		Entry("should check again soon when overdue", status{BelowThresholdSince: ago(600)}, time.Second),
+	)
+})
+
+var _ = Describe("VirtualMachineScalingGroup controller", func() {
+	ctx := context.Background()
+
+	// Each test gets its own namespace, because envtest doesn't actually remove namespaces (or
+	// their contents) when they're deleted.
+	var namespace string
+	var reconciler *VirtualMachineScalingGroupReconciler
+
+	BeforeEach(func() {
+		By("Creating the Namespace to perform the tests")
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "scalinggroup-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		reconciler = &VirtualMachineScalingGroupReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: record.NewFakeRecorder(100),
+			Config:   nil,
+			Metrics:  ReconcilerMetrics{},
+		}
+	})
+
+	AfterEach(func() {
+		By("Deleting the Namespace to perform the tests")
+		_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	})
+
+	listVMs := func() []vmv1.VirtualMachine {
+		var vms vmv1.VirtualMachineList
+		Expect(k8sClient.List(ctx, &vms, client.InNamespace(namespace))).To(Succeed())
+		return vms.Items
+	}
+
+	It("should keep the replicas annotation on its VMs up-to-date", func() {
+		By("Creating a group with two replicas")
+		group := &vmv1.VirtualMachineScalingGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: "group", Namespace: namespace},
+			Spec:       scalingGroupTestSpec(),
+		}
+		group.Spec.MaxReplicas = 2
+		Expect(k8sClient.Create(ctx, group)).To(Succeed())
+		group.Status.Replicas = 2
+		Expect(k8sClient.Status().Update(ctx, group)).To(Succeed())
+
+		reconcile := func() {
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(group)})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("Reconciling before any replica is ready")
+		reconcile()
+		vms := listVMs()
+		Expect(vms).To(HaveLen(2))
+		for _, vm := range vms {
+			Expect(vm.Annotations).To(HaveKeyWithValue(vmv1.VirtualMachineScalingGroupReplicasAnnotation, "0"))
+		}
+
+		By("Reconciling once one of them is running")
+		// The annotation is patched on both, without changing the rest of the VMs.
+		running := vms[0].DeepCopy()
+		running.Status.Phase = vmv1.VmRunning
+		Expect(k8sClient.Status().Update(ctx, running)).To(Succeed())
+
+		reconcile()
+		for _, vm := range listVMs() {
+			Expect(vm.Annotations).To(HaveKeyWithValue(vmv1.VirtualMachineScalingGroupReplicasAnnotation, "1"))
+			Expect(vm.Labels).To(HaveKeyWithValue(vmv1.VirtualMachineScalingGroupLabel, "group"))
+			if vm.Name == running.Name {
+				Expect(vm.Status.Phase).To(Equal(vmv1.VmRunning))
+			}
+		}
+
+		var updated vmv1.VirtualMachineScalingGroup
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(group), &updated)).To(Succeed())
+		Expect(updated.Status.Replicas).To(Equal(int32(2)))
+		Expect(updated.Status.Ready).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+var _ = Describe("VirtualMachineSnapshot controller", func() {
+	ctx := context.Background()
+
+	// Each test gets its own namespace, because envtest doesn't actually remove namespaces (or
+	// their contents) when they're deleted.
+	var namespace string
+	var recorder *record.FakeRecorder
+	var reconciler *VirtualMachineSnapshotReconciler
+
+	BeforeEach(func() {
+		By("Creating the Namespace to perform the tests")
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "snapshot-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		recorder = record.NewFakeRecorder(100)
+		reconciler = &VirtualMachineSnapshotReconciler{
+			Client:   k8sClient,
+			Scheme:   k8sClient.Scheme(),
+			Recorder: recorder,
+			Config:   nil,
+			Metrics:  ReconcilerMetrics{},
+		}
+	})
+
+	AfterEach(func() {
+		By("Deleting the Namespace to perform the tests")
+		_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+	})
+
+	// createVM creates the VM "vm" with an emptyDisk "pgdata" and a tmpfs disk "config", running in
+	// the runner pod "vm-runner" if the phase is alive
+	createVM := func(phase vmv1.VmPhase, modify func(*vmv1.VirtualMachine)) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: namespace},
+			Spec:       vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+		}
+		vm.Spec.SnapshotStorage = &vmv1.SnapshotStorage{VolumeClaimName: "snapshots"}
+		vm.Spec.Disks = []vmv1.Disk{
+			{Name: "pgdata", MountPath: "/var/db", DiskSource: vmv1.DiskSource{EmptyDisk: &vmv1.EmptyDiskSource{Size: resource.MustParse("1Gi")}}},
+			{Name: "config", MountPath: "/etc/config", DiskSource: vmv1.DiskSource{Tmpfs: &vmv1.TmpfsDiskSource{Size: resource.MustParse("1Mi")}}},
+		}
+		if modify != nil {
+			modify(vm)
+		}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		vm.Status.Phase = phase
+		vm.Status.PodName = "vm-runner"
+		vm.Status.PodIP = "127.0.0.1"
+		Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+		return vm
+	}
+
+	// createSnapshot creates the snapshot "snap" of "vm". If status is not nil, the snapshot is
+	// created as if it had already been reconciled up to that point.
+	createSnapshot := func(disks []string, status *vmv1.VirtualMachineSnapshotStatus) *vmv1.VirtualMachineSnapshot {
+		snapshot := &vmv1.VirtualMachineSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: "snap", Namespace: namespace},
+			Spec:       vmv1.VirtualMachineSnapshotSpec{VmName: "vm", Disks: disks},
+		}
+		if status != nil {
+			snapshot.Finalizers = []string{snapshotFinalizer}
+		}
+		Expect(k8sClient.Create(ctx, snapshot)).To(Succeed())
+		if status != nil {
+			snapshot.Status = *status
+			Expect(k8sClient.Status().Update(ctx, snapshot)).To(Succeed())
+		}
+		return snapshot
+	}
+
+	runningStatus := func(disks ...string) *vmv1.VirtualMachineSnapshotStatus {
+		return &vmv1.VirtualMachineSnapshotStatus{Phase: vmv1.SnapshotRunning, Disks: disks, PodName: "vm-runner"}
+	}
+
+	getSnapshot := func() *vmv1.VirtualMachineSnapshot {
+		snapshot := new(vmv1.VirtualMachineSnapshot)
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "snap"}, snapshot)).To(Succeed())
+		return snapshot
+	}
+
+	reconcile := func() (ctrl.Result, *vmv1.VirtualMachineSnapshot) {
+		key := client.ObjectKey{Namespace: namespace, Name: "snap"}
+		result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		return result, getSnapshot()
+	}
+
+	const startPgdata = `{
+		"execute": "transaction",
+		"arguments": {"actions": [{
+			"type": "drive-backup",
+			"data": {
+				"device": "pgdata",
+				"job-id": "snapshot-snap_pgdata",
+				"target": "/vm/snapshots/snap_pgdata.qcow2",
+				"sync": "full",
+				"format": "qcow2",
+				"auto-dismiss": false
+			}
+		}]}
+	}`
+	const queryJobs = `{"execute": "query-jobs"}`
+	jobs := func(jobs ...QmpJob) string {
+		result, err := json.Marshal(QmpJobs{Return: jobs})
+		Expect(err).NotTo(HaveOccurred())
+		return string(result)
+	}
+
+	Context("Taking snapshots", func() {
+		It("should record the snapshot as running before copying the disks", func() {
+			vm := createVM(vmv1.VmPending, nil)
+			createSnapshot(nil, nil)
+
+			By("Adding the finalizer")
+			_, snapshot := reconcile()
+			Expect(snapshot.Finalizers).To(ConsistOf(snapshotFinalizer))
+			Expect(snapshot.Status.Phase).To(BeEquivalentTo(""))
+
+			By("Marking the new snapshot as pending")
+			_, snapshot = reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotPending))
+
+			By("Waiting for the VM to be running")
+			result, snapshot := reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotPending))
+			Expect(result.RequeueAfter).To(Equal(snapshotPollInterval))
+
+			By("Recording the disks and runner pod, without connecting to QMP yet")
+			vm.Status.Phase = vmv1.VmRunning
+			Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+			result, snapshot = reconcile()
+			Expect(result.Requeue).To(BeTrue())
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotRunning))
+			Expect(snapshot.Status.Disks).To(Equal([]string{"pgdata"}))
+			Expect(snapshot.Status.PodName).To(Equal("vm-runner"))
+		})
+
+		It("should copy the disks and track them until they've finished", func() {
+			vm := createVM(vmv1.VmRunning, nil)
+			createSnapshot(nil, runningStatus("pgdata"))
+			qmp := newQMPMock()
+			defer qmp.done()
+
+			By("Starting the copies, all in the same transaction")
+			qmp.expect(queryJobs, jobs())
+			qmp.expect(startPgdata, `{"return": {}}`)
+			result, err := reconciler.reconcileRunning(ctx, getSnapshot(), vm, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(snapshotPollInterval))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Started")))
+
+			By("Waiting while the copy is running")
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "running", Error: nil}))
+			result, err = reconciler.reconcileRunning(ctx, getSnapshot(), vm, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(snapshotPollInterval))
+			Expect(getSnapshot().Status.Phase).To(Equal(vmv1.SnapshotRunning))
+
+			By("Succeeding once it's finished, and dismissing the job")
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "concluded", Error: nil}))
+			qmp.expect(`{"execute": "job-dismiss", "arguments": {"id": "snapshot-snap_pgdata"}}`, `{"return": {}}`)
+			result, err = reconciler.reconcileRunning(ctx, getSnapshot(), vm, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+			snapshot := getSnapshot()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotSucceeded))
+			Expect(snapshot.Status.CompletionTime).NotTo(BeNil())
+
+			By("Leaving the finished snapshot as-is")
+			_, snapshot = reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotSucceeded))
+		})
+	})
+
+	Context("Failures", func() {
+		It("should fail if copying a disk fails", func() {
+			vm := createVM(vmv1.VmRunning, nil)
+			createSnapshot(nil, runningStatus("pgdata"))
+			qmp := newQMPMock()
+			defer qmp.done()
+
+			message := "No space left on device"
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "concluded", Error: &message}))
+			// The failed job is dismissed too
+			qmp.expect(`{"execute": "job-dismiss", "arguments": {"id": "snapshot-snap_pgdata"}}`, `{"return": {}}`)
+			_, err := reconciler.reconcileRunning(ctx, getSnapshot(), vm, qmp)
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshot := getSnapshot()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal("Failed to copy disks: [disk pgdata: No space left on device]"))
+		})
+
+		It("should fail if some of the copies are missing", func() {
+			vm := createVM(vmv1.VmRunning, nil)
+			createSnapshot(nil, runningStatus("pgdata", "cache"))
+			qmp := newQMPMock()
+			defer qmp.done()
+
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "running", Error: nil}))
+			_, err := reconciler.reconcileRunning(ctx, getSnapshot(), vm, qmp)
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshot := getSnapshot()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal("Failed to copy disks: [disk cache: copy not found]"))
+		})
+
+		It("should fail if the runner pod was replaced", func() {
+			createVM(vmv1.VmRunning, nil)
+			createSnapshot(nil, runningStatus("pgdata"))
+			vm := new(vmv1.VirtualMachine)
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "vm"}, vm)).To(Succeed())
+			vm.Status.PodName = "vm-runner-2"
+			Expect(k8sClient.Status().Update(ctx, vm)).To(Succeed())
+
+			_, snapshot := reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal("VirtualMachine vm stopped while taking snapshot"))
+		})
+
+		It("should fail if the VM has no snapshot storage", func() {
+			createVM(vmv1.VmRunning, func(vm *vmv1.VirtualMachine) { vm.Spec.SnapshotStorage = nil })
+			createSnapshot(nil, &vmv1.VirtualMachineSnapshotStatus{Phase: vmv1.SnapshotPending})
+
+			_, snapshot := reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal("VirtualMachine vm does not have .spec.snapshotStorage"))
+		})
+
+		It("should fail if a disk isn't an emptyDisk", func() {
+			createVM(vmv1.VmRunning, nil)
+			createSnapshot([]string{"config"}, &vmv1.VirtualMachineSnapshotStatus{Phase: vmv1.SnapshotPending})
+
+			_, snapshot := reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal(`VirtualMachine vm has no emptyDisk disk named "config"`))
+		})
+
+		It("should fail if the VM doesn't exist, and not retry", func() {
+			createSnapshot(nil, &vmv1.VirtualMachineSnapshotStatus{Phase: vmv1.SnapshotPending})
+
+			_, snapshot := reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(Equal("VirtualMachine vm not found"))
+
+			By("Creating the VM afterwards")
+			createVM(vmv1.VmRunning, nil)
+			_, snapshot = reconcile()
+			Expect(snapshot.Status.Phase).To(Equal(vmv1.SnapshotFailed))
+		})
+	})
+
+	Context("Deleting snapshots", func() {
+		It("should cancel copies that are still running", func() {
+			snapshot := createSnapshot(nil, runningStatus("pgdata"))
+			qmp := newQMPMock()
+			defer qmp.done()
+
+			By("Cancelling the running job")
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "running", Error: nil}))
+			qmp.expect(`{"execute": "job-cancel", "arguments": {"id": "snapshot-snap_pgdata"}}`, `{"return": {}}`)
+			remaining, err := stopSnapshotJobs(snapshot, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(BeTrue())
+
+			By("Waiting while it's aborting")
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "aborting", Error: nil}))
+			remaining, err = stopSnapshotJobs(snapshot, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(BeTrue())
+
+			By("Dismissing it once it has concluded")
+			message := "Operation cancelled"
+			qmp.expect(queryJobs, jobs(QmpJob{Id: "snapshot-snap_pgdata", Type: "backup", Status: "concluded", Error: &message}))
+			qmp.expect(`{"execute": "job-dismiss", "arguments": {"id": "snapshot-snap_pgdata"}}`, `{"return": {}}`)
+			remaining, err = stopSnapshotJobs(snapshot, qmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(BeFalse())
+		})
+
+		It("should remove the copies of the disks through the runner", func() {
+			var requests []api.SnapshotDelete
+			runner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.URL.Path).To(Equal("/snapshot_delete"))
+				body, err := io.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				var parsed api.SnapshotDelete
+				Expect(json.Unmarshal(body, &parsed)).To(Succeed())
+				requests = append(requests, parsed)
+			}))
+			defer runner.Close()
+			runnerURL, err := url.Parse(runner.URL)
+			Expect(err).NotTo(HaveOccurred())
+			_, portStr, err := net.SplitHostPort(runnerURL.Host)
+			Expect(err).NotTo(HaveOccurred())
+			port, err := strconv.Atoi(portStr)
+			Expect(err).NotTo(HaveOccurred())
+
+			createVM(vmv1.VmRunning, func(vm *vmv1.VirtualMachine) { vm.Spec.RunnerPort = int32(port) })
+			// Succeeded snapshots don't have any block jobs left, so QMP isn't used.
+			snapshot := createSnapshot(nil, &vmv1.VirtualMachineSnapshotStatus{
+				Phase: vmv1.SnapshotSucceeded, Disks: []string{"pgdata"}, PodName: "vm-runner",
+			})
+			Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(snapshot)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requests).To(Equal([]api.SnapshotDelete{{Name: "snap", Disks: []string{"pgdata"}}}))
+
+			err = k8sClient.Get(ctx, client.ObjectKeyFromObject(snapshot), snapshot)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected not found, got %v", err)
+		})
+
+		It("should leave the copies behind if the VM isn't running", func() {
+			createVM(vmv1.VmSucceeded, nil)
+			snapshot := createSnapshot(nil, runningStatus("pgdata"))
+			Expect(k8sClient.Delete(ctx, snapshot)).To(Succeed())
+
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(snapshot)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring("CleanupSkipped")))
+
+			err = k8sClient.Get(ctx, client.ObjectKeyFromObject(snapshot), snapshot)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected not found, got %v", err)
+		})
+	})
+})
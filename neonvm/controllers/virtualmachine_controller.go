@@ -30,6 +30,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	nadapiv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
@@ -68,11 +69,17 @@ const (
 	typeAvailableVirtualMachine = "Available"
 	// typeDegradedVirtualMachine represents the status used when the custom resource is deleted and the finalizer operations are must to occur.
 	typeDegradedVirtualMachine = "Degraded"
+	// typeCPUTopologyExceededVirtualMachine represents the status used when .spec.guest.cpus.use is
+	// more than the vCPUs in the topology that the VM was booted with, so it can't be reached.
+	typeCPUTopologyExceededVirtualMachine = "CPUTopologyExceeded"
+	// typeVirtioMemResizingVirtualMachine represents the status used while the guest is resizing
+	// the VM's virtio-mem device. The transition time is when the current resize started.
+	typeVirtioMemResizingVirtualMachine = "VirtioMemResizing"
 )
 
 const (
 	minSupportedRunnerVersion api.RunnerProtoVersion = api.RunnerProtoV1
-	maxSupportedRunnerVersion api.RunnerProtoVersion = api.RunnerProtoV1
+	maxSupportedRunnerVersion api.RunnerProtoVersion = api.RunnerProtoV3
 )
 
 // VirtualMachineReconciler reconciles a VirtualMachine object
@@ -92,6 +99,7 @@ type VirtualMachineReconciler struct {
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachineflavors,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=core,resources=nodes,verbs=list
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
@@ -121,6 +129,8 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		// Error reading the object - requeue the request.
 		if notfound := client.IgnoreNotFound(err); notfound == nil {
 			log.Info("virtualmachine resource not found. Ignoring since object must be deleted")
+			r.Metrics.guestVersions.update(req.NamespacedName, nil)
+			r.Metrics.nodeDensity.update(req.NamespacedName, nil)
 			return ctrl.Result{}, nil
 		}
 		log.Error(err, "Unable to fetch VirtualMachine")
@@ -163,6 +173,8 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 			}
 		}
 		// Stop reconciliation as the item is being deleted
+		r.Metrics.guestVersions.update(req.NamespacedName, nil)
+		r.Metrics.nodeDensity.update(req.NamespacedName, nil)
 		return ctrl.Result{}, nil
 	}
 
@@ -182,6 +194,9 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		}
 	}
 
+	r.Metrics.guestVersions.update(req.NamespacedName, guestComponents(virtualmachine.Status.GuestInfo, r.Config))
+	r.Metrics.nodeDensity.update(req.NamespacedName, vmDensityFor(&virtualmachine, r.Config))
+
 	return ctrl.Result{RequeueAfter: time.Second}, nil
 }
 
@@ -292,6 +307,44 @@ func (r *VirtualMachineReconciler) updateVMStatusCPU(
 	}
 }
 
+// cpusWithinTopology returns the CPUs that the VM should be scaled to, which is
+// .spec.guest.cpus.use capped at the number of vCPUs in the topology that QEMU was started with.
+//
+// If .spec.guest.cpus.use doesn't fit, the VM's status gets a condition explaining why it won't be
+// reached, which is removed again once it does fit.
+func (r *VirtualMachineReconciler) cpusWithinTopology(
+	virtualmachine *vmv1.VirtualMachine,
+	topologyCPUs uint32,
+) vmv1.MilliCPU {
+	specCPU := *virtualmachine.Spec.Guest.CPUs.Use
+	topologyMax := vmv1.MilliCPU(1000 * topologyCPUs)
+
+	if specCPU <= topologyMax {
+		if meta.FindStatusCondition(virtualmachine.Status.Conditions, typeCPUTopologyExceededVirtualMachine) != nil {
+			meta.SetStatusCondition(&virtualmachine.Status.Conditions,
+				metav1.Condition{Type: typeCPUTopologyExceededVirtualMachine,
+					Status:  metav1.ConditionFalse,
+					Reason:  "Reconciling",
+					Message: fmt.Sprintf(".spec.guest.cpus.use fits within the VM's topology of %d vCPUs", topologyCPUs)})
+		}
+		return specCPU
+	}
+
+	msg := fmt.Sprintf(
+		".spec.guest.cpus.use (%v) is more than the VM's topology of %d vCPUs, which can't change without restarting the VM",
+		specCPU, topologyCPUs,
+	)
+	if !meta.IsStatusConditionTrue(virtualmachine.Status.Conditions, typeCPUTopologyExceededVirtualMachine) {
+		r.Recorder.Event(virtualmachine, "Warning", "CPUTopologyExceeded", msg)
+	}
+	meta.SetStatusCondition(&virtualmachine.Status.Conditions,
+		metav1.Condition{Type: typeCPUTopologyExceededVirtualMachine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Reconciling",
+			Message: msg})
+	return topologyMax
+}
+
 func (r *VirtualMachineReconciler) updateVMStatusMemory(
 	virtualmachine *vmv1.VirtualMachine,
 	qmpMemorySize *resource.Quantity,
@@ -305,6 +358,218 @@ func (r *VirtualMachineReconciler) updateVMStatusMemory(
 	}
 }
 
+// scaleVirtioMem requests the virtio-mem device to be resized to match
+// .spec.guest.memorySlots.use, returning whether the guest has finished plugging or unplugging the
+// memory.
+//
+// Unlike DIMMs, the guest resizes the device gradually, so this is expected to return false for a
+// few reconciles after the size changes.
+func (r *VirtualMachineReconciler) scaleVirtioMem(ctx context.Context, vm *vmv1.VirtualMachine) (bool, error) {
+	mon, err := QmpConnect(QmpAddr(vm))
+	if err != nil {
+		return false, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	return r.resizeVirtioMem(ctx, vm, mon, time.Now())
+}
+
+// resizeVirtioMem implements scaleVirtioMem, with the QMP connection to the VM already made.
+//
+// If the guest doesn't finish resizing the device within the ReconcilerConfig's VirtioMemResizeTimeout,
+// .spec.guest.memorySlots.use is changed to the memory slots that the guest did plug, like when
+// not all DIMMs can be plugged.
+func (r *VirtualMachineReconciler) resizeVirtioMem(
+	ctx context.Context,
+	vm *vmv1.VirtualMachine,
+	mon QMPRunner,
+	now time.Time,
+) (bool, error) {
+	log := log.FromContext(ctx)
+
+	memSlotsMin := *vm.Spec.Guest.MemorySlots.Min
+	slotSize := vm.Spec.Guest.MemorySlotSize.Value()
+	target := slotSize * int64(*vm.Spec.Guest.MemorySlots.Use-memSlotsMin)
+
+	plugged, err := QmpSetVirtioMemSize(mon, target)
+	if err != nil {
+		return false, err
+	}
+
+	if plugged == target {
+		meta.RemoveStatusCondition(&vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+		return true, nil
+	}
+
+	// Track how long the guest has been resizing to this target. If the target changed, the
+	// resize starts over.
+	message := fmt.Sprintf("Resizing virtio-mem device to %d bytes", target)
+	resizing := meta.FindStatusCondition(vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+	if resizing == nil || resizing.Message != message {
+		meta.RemoveStatusCondition(&vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+		meta.SetStatusCondition(&vm.Status.Conditions,
+			metav1.Condition{Type: typeVirtioMemResizingVirtualMachine,
+				Status:             metav1.ConditionTrue,
+				Reason:             "Resizing",
+				Message:            message,
+				LastTransitionTime: metav1.NewTime(now)})
+		log.Info("Waiting for guest to resize virtio-mem device", "plugged", plugged, "target", target)
+		return false, nil
+	}
+
+	elapsed := now.Sub(resizing.LastTransitionTime.Time)
+	if r.Config.VirtioMemResizeTimeout == 0 || elapsed < r.Config.VirtioMemResizeTimeout {
+		log.Info("Waiting for guest to resize virtio-mem device", "plugged", plugged, "target", target, "elapsed", elapsed)
+		return false, nil
+	}
+
+	// The guest is stuck, so settle for what it has plugged so far, in whole slots. When scaling
+	// down, the partially unplugged slot is still in use.
+	pluggedSlots := plugged / slotSize
+	if plugged > target && plugged%slotSize != 0 {
+		pluggedSlots += 1
+	}
+	memorySlotsUse := memSlotsMin + int32(pluggedSlots)
+
+	log.Info("Timed out waiting for guest to resize virtio-mem device, will modify .spec.guest.memorySlots.use instead",
+		"plugged", plugged, "target", target, "elapsed", elapsed)
+	r.Recorder.Event(vm, "Warning", "VirtioMemResizeTimeout",
+		fmt.Sprintf("Guest resized virtio-mem device to %d of %d bytes within %s, setting .spec.guest.memorySlots.use to %d",
+			plugged, target, r.Config.VirtioMemResizeTimeout, memorySlotsUse))
+
+	// firstly re-fetch VM
+	if err := r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, vm); err != nil {
+		log.Error(err, "Unable to re-fetch VirtualMachine")
+		return false, err
+	}
+	memorySlotsUseInSpec := *vm.Spec.Guest.MemorySlots.Use
+	*vm.Spec.Guest.MemorySlots.Use = memorySlotsUse
+	if err := r.tryUpdateVM(ctx, vm); err != nil {
+		log.Error(err, "Failed to update .spec.guest.memorySlots.use",
+			"old value", memorySlotsUseInSpec,
+			"new value", memorySlotsUse)
+		return false, err
+	}
+	meta.RemoveStatusCondition(&vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+	return false, nil
+}
+
+// syncPaused stops or resumes the VM's vCPUs to match .spec.paused, and updates its "Paused"
+// status condition
+func (r *VirtualMachineReconciler) syncPaused(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	mon, err := QmpConnect(QmpAddr(vm))
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	return r.reconcilePaused(ctx, vm, mon)
+}
+
+// reconcilePaused implements syncPaused, with the QMP connection to the VM already made
+func (r *VirtualMachineReconciler) reconcilePaused(ctx context.Context, vm *vmv1.VirtualMachine, mon QMPRunner) error {
+	log := log.FromContext(ctx)
+
+	paused, err := QmpIsPaused(mon)
+	if err != nil {
+		return fmt.Errorf("failed to get run state: %w", err)
+	}
+
+	if paused != vm.Spec.Paused {
+		if vm.Spec.Paused {
+			log.Info("Pausing VirtualMachine")
+		} else {
+			log.Info("Resuming VirtualMachine")
+		}
+		if err := QmpSetPaused(mon, vm.Spec.Paused); err != nil {
+			return fmt.Errorf("failed to set paused to %t: %w", vm.Spec.Paused, err)
+		}
+		paused = vm.Spec.Paused
+		if paused {
+			r.Recorder.Event(vm, "Normal", "Paused", fmt.Sprintf("VirtualMachine %s was paused", vm.Name))
+		} else {
+			r.Recorder.Event(vm, "Normal", "Resumed", fmt.Sprintf("VirtualMachine %s was resumed", vm.Name))
+		}
+	}
+
+	if paused {
+		meta.SetStatusCondition(&vm.Status.Conditions,
+			metav1.Condition{Type: vmv1.VirtualMachineConditionPaused,
+				Status:  metav1.ConditionTrue,
+				Reason:  "Paused",
+				Message: "VirtualMachine vCPUs are stopped because .spec.paused is true"})
+	} else {
+		meta.SetStatusCondition(&vm.Status.Conditions,
+			metav1.Condition{Type: vmv1.VirtualMachineConditionPaused,
+				Status:  metav1.ConditionFalse,
+				Reason:  "Running",
+				Message: "VirtualMachine vCPUs are running"})
+	}
+	return nil
+}
+
+// syncRootDiskSize grows the root disk of the running VM if .spec.guest.rootDisk.size is larger
+// than its current size, and records the current size in .status.rootDiskSize
+//
+// The root disk is never shrunk. The webhook prevents decreasing the size in the spec, but the
+// disk may still be larger than the spec if the image itself was larger.
+func (r *VirtualMachineReconciler) syncRootDiskSize(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	log := log.FromContext(ctx)
+
+	currentSize, err := QmpGetRootDiskSize(QmpAddr(vm))
+	if err != nil {
+		return fmt.Errorf("failed to get root disk size: %w", err)
+	}
+
+	specSize := vm.Spec.Guest.RootDisk.Size
+	if !specSize.IsZero() && specSize.Cmp(*currentSize) > 0 {
+		log.Info("Growing root disk of VirtualMachine", "current", currentSize, "target", specSize.String())
+		if err := QmpResizeRootDisk(vm.Status.PodIP, vm.Spec.QMP, &specSize); err != nil {
+			return fmt.Errorf("failed to resize root disk: %w", err)
+		}
+		r.Recorder.Event(vm, "Normal", "RootDiskResized",
+			fmt.Sprintf("VirtualMachine %s root disk grown from %v to %v", vm.Name, currentSize, specSize.String()))
+		currentSize = resource.NewQuantity(specSize.Value(), resource.BinarySI)
+	}
+
+	vm.Status.RootDiskSize = currentSize
+	return nil
+}
+
+// updateVMStatusGuestInfo sets .status.guestInfo from the runner pod. Failures are logged but
+// otherwise ignored, leaving .status.guestInfo unset so that it's retried on the next reconcile.
+func (r *VirtualMachineReconciler) updateVMStatusGuestInfo(
+	ctx context.Context,
+	vm *vmv1.VirtualMachine,
+	runnerPod *corev1.Pod,
+	runnerVersion api.RunnerProtoVersion,
+) {
+	log := log.FromContext(ctx)
+
+	info := vmv1.GuestInfo{
+		KernelVersion:    "",
+		RootDiskImageID:  "",
+		VmBuilderVersion: "",
+		Daemons:          nil,
+	}
+	if runnerVersion.SupportsGuestInfo() {
+		fromRunner, err := getRunnerGuestInfo(ctx, vm)
+		if err != nil {
+			log.Error(err, "Failed to get guest info from runner", "VirtualMachine", vm.Name)
+			return
+		}
+		info = *fromRunner
+	}
+
+	for _, stat := range runnerPod.Status.InitContainerStatuses {
+		if stat.Name == "init" {
+			info.RootDiskImageID = stat.ImageID
+		}
+	}
+
+	vm.Status.GuestInfo = &info
+}
+
 func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachine *vmv1.VirtualMachine) error {
 	log := log.FromContext(ctx)
 
@@ -325,6 +590,8 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 	// Generate runner pod name
 	if len(virtualmachine.Status.PodName) == 0 {
 		virtualmachine.Status.PodName = names.SimpleNameGenerator.GenerateName(fmt.Sprintf("%s-", virtualmachine.Name))
+		// The new pod is a new instance for cloud-init. Migration targets keep the same ID.
+		virtualmachine.Status.CloudInitInstanceID = virtualmachine.Status.PodName
 		// Update the .Status on API Server to avoid creating multiple pods for a single VM
 		// See https://github.com/neondatabase/autoscaling/issues/794 for the context
 		if err := r.Status().Update(ctx, virtualmachine); err != nil {
@@ -372,6 +639,12 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 		vmRunner := &corev1.Pod{}
 		err := r.Get(ctx, types.NamespacedName{Name: virtualmachine.Status.PodName, Namespace: virtualmachine.Namespace}, vmRunner)
 		if err != nil && apierrors.IsNotFound(err) {
+			// Wait until any snapshots that disks are restored from can be used
+			if err := checkSnapshotsForVirtualMachine(ctx, r.Client, virtualmachine); err != nil {
+				log.Info("Waiting for snapshots before creating runner pod", "reason", err.Error())
+				return nil
+			}
+
 			var sshSecret *corev1.Secret
 			if enableSSH {
 				// Check if the ssh secret already exists, if not create a new one
@@ -401,7 +674,7 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 			}
 
 			// Define a new pod
-			pod, err := r.podForVirtualMachine(virtualmachine, sshSecret)
+			pod, err := r.podForVirtualMachine(ctx, virtualmachine, sshSecret)
 			if err != nil {
 				log.Error(err, "Failed to define new Pod resource for VirtualMachine")
 				return err
@@ -519,8 +792,13 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 				return err
 			}
 
+			// record what the guest is running, once per runner pod
+			if virtualmachine.Status.GuestInfo == nil {
+				r.updateVMStatusGuestInfo(ctx, virtualmachine, vmRunner, runnerVersion)
+			}
+
 			// get CPU details from QEMU
-			cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(virtualmachine))
+			cpuSlotsPlugged, cpuSlotsEmpty, err := QmpGetCpus(QmpAddr(virtualmachine))
 			if err != nil {
 				log.Error(err, "Failed to get CPU details from VirtualMachine", "VirtualMachine", virtualmachine.Name)
 				return err
@@ -546,17 +824,34 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 			// update status by memory sizes used in the VM
 			r.updateVMStatusMemory(virtualmachine, memorySize)
 
+			// grow the root disk, if its size in the spec has been increased
+			if err := r.syncRootDiskSize(ctx, virtualmachine); err != nil {
+				log.Error(err, "Failed to sync root disk size of VirtualMachine", "VirtualMachine", virtualmachine.Name)
+				return err
+			}
+
+			// stop or resume the guest, if requested
+			if err := r.syncPaused(ctx, virtualmachine); err != nil {
+				log.Error(err, "Failed to sync paused state of VirtualMachine", "VirtualMachine", virtualmachine.Name)
+				return err
+			}
+			// the guest can't respond to hotplug while paused, so leave scaling until it's resumed
+			if virtualmachine.Spec.Paused {
+				break
+			}
+
 			// check if need hotplug/unplug CPU or memory
 			// compare guest spec and count of plugged
 
-			specUseCPU := virtualmachine.Spec.Guest.CPUs.Use
-			scaleCgroupCPU := *specUseCPU != cgroupUsage.VCPUs
+			specUseCPU := r.cpusWithinTopology(virtualmachine, uint32(len(cpuSlotsPlugged)+len(cpuSlotsEmpty)))
+			scaleCgroupCPU := specUseCPU != cgroupUsage.VCPUs
 			scaleQemuCPU := specUseCPU.RoundedUp() != pluggedCPU
 			if scaleCgroupCPU || scaleQemuCPU {
 				log.Info("VM goes into scaling mode, CPU count needs to be changed",
 					"CPUs on runner pod cgroup", cgroupUsage.VCPUs,
 					"CPUs on board", pluggedCPU,
-					"CPUs in spec", virtualmachine.Spec.Guest.CPUs.Use)
+					"CPUs in spec", virtualmachine.Spec.Guest.CPUs.Use,
+					"CPUs within topology", specUseCPU)
 				virtualmachine.Status.Phase = vmv1.VmScaling
 			}
 
@@ -665,12 +960,12 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 
 		// do hotplug/unplug CPU
 		// firstly get current state from QEMU
-		cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(virtualmachine))
+		cpuSlotsPlugged, cpuSlotsEmpty, err := QmpGetCpus(QmpAddr(virtualmachine))
 		if err != nil {
 			log.Error(err, "Failed to get CPU details from VirtualMachine", "VirtualMachine", virtualmachine.Name)
 			return err
 		}
-		specCPU := virtualmachine.Spec.Guest.CPUs.Use
+		specCPU := r.cpusWithinTopology(virtualmachine, uint32(len(cpuSlotsPlugged)+len(cpuSlotsEmpty)))
 		pluggedCPU := uint32(len(cpuSlotsPlugged))
 
 		cgroupUsage, err := getRunnerCgroup(ctx, virtualmachine)
@@ -698,13 +993,13 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 			r.Recorder.Event(virtualmachine, "Normal", "ScaleDown",
 				fmt.Sprintf("One CPU was unplugged from VM %s",
 					virtualmachine.Name))
-		} else if *specCPU != cgroupUsage.VCPUs {
-			log.Info("Update runner pod cgroups", "runner", cgroupUsage.VCPUs, "spec", *specCPU)
-			if err := setRunnerCgroup(ctx, virtualmachine, *specCPU); err != nil {
+		} else if specCPU != cgroupUsage.VCPUs {
+			log.Info("Update runner pod cgroups", "runner", cgroupUsage.VCPUs, "spec", specCPU)
+			if err := setRunnerCgroup(ctx, virtualmachine, specCPU); err != nil {
 				return err
 			}
 			reason := "ScaleDown"
-			if *specCPU > cgroupUsage.VCPUs {
+			if specCPU > cgroupUsage.VCPUs {
 				reason = "ScaleUp"
 			}
 			r.Recorder.Event(virtualmachine, "Normal", reason,
@@ -716,32 +1011,40 @@ func (r *VirtualMachineReconciler) doReconcile(ctx context.Context, virtualmachi
 		}
 
 		// do hotplug/unplug Memory
-		memSlotsMin := *virtualmachine.Spec.Guest.MemorySlots.Min
-		targetSlotCount := int(*virtualmachine.Spec.Guest.MemorySlots.Use - memSlotsMin)
-
-		realSlots, err := QmpSetMemorySlots(ctx, virtualmachine, targetSlotCount, r.Recorder)
-		if realSlots < 0 {
-			return err
-		}
-
-		if realSlots != int(targetSlotCount) {
-			log.Info("Couldn't achieve desired memory slot count, will modify .spec.guest.memorySlots.use instead", "details", err)
-			// firstly re-fetch VM
-			if err := r.Get(ctx, types.NamespacedName{Name: virtualmachine.Name, Namespace: virtualmachine.Namespace}, virtualmachine); err != nil {
-				log.Error(err, "Unable to re-fetch VirtualMachine")
+		if virtualmachine.Spec.Guest.UsesVirtioMem() {
+			ramScaled, err = r.scaleVirtioMem(ctx, virtualmachine)
+			if err != nil {
+				log.Error(err, "Failed to resize virtio-mem device", "VirtualMachine", virtualmachine.Name)
 				return err
 			}
-			memorySlotsUseInSpec := *virtualmachine.Spec.Guest.MemorySlots.Use
-			memoryPluggedSlots := memSlotsMin + int32(realSlots)
-			*virtualmachine.Spec.Guest.MemorySlots.Use = memoryPluggedSlots
-			if err := r.tryUpdateVM(ctx, virtualmachine); err != nil {
-				log.Error(err, "Failed to update .spec.guest.memorySlots.use",
-					"old value", memorySlotsUseInSpec,
-					"new value", memoryPluggedSlots)
+		} else {
+			memSlotsMin := *virtualmachine.Spec.Guest.MemorySlots.Min
+			targetSlotCount := int(*virtualmachine.Spec.Guest.MemorySlots.Use - memSlotsMin)
+
+			realSlots, err := QmpSetMemorySlots(ctx, virtualmachine, targetSlotCount, r.Recorder)
+			if realSlots < 0 {
 				return err
 			}
-		} else {
-			ramScaled = true
+
+			if realSlots != int(targetSlotCount) {
+				log.Info("Couldn't achieve desired memory slot count, will modify .spec.guest.memorySlots.use instead", "details", err)
+				// firstly re-fetch VM
+				if err := r.Get(ctx, types.NamespacedName{Name: virtualmachine.Name, Namespace: virtualmachine.Namespace}, virtualmachine); err != nil {
+					log.Error(err, "Unable to re-fetch VirtualMachine")
+					return err
+				}
+				memorySlotsUseInSpec := *virtualmachine.Spec.Guest.MemorySlots.Use
+				memoryPluggedSlots := memSlotsMin + int32(realSlots)
+				*virtualmachine.Spec.Guest.MemorySlots.Use = memoryPluggedSlots
+				if err := r.tryUpdateVM(ctx, virtualmachine); err != nil {
+					log.Error(err, "Failed to update .spec.guest.memorySlots.use",
+						"old value", memorySlotsUseInSpec,
+						"new value", memoryPluggedSlots)
+					return err
+				}
+			} else {
+				ramScaled = true
+			}
 		}
 
 		// set VM phase to running if everything scaled
@@ -965,6 +1268,8 @@ func updatePodMetadataIfNecessary(ctx context.Context, c client.Client, vm *vmv1
 				"k8s.v1.cni.cncf.io/networks":        true,
 				"k8s.v1.cni.cncf.io/network-status":  true,
 				"k8s.v1.cni.cncf.io/networks-status": true,
+				// Set when the pod is created, from the flavor at that time
+				vmv1.FlavorSpecAnnotation: true,
 			},
 		},
 	}
@@ -1079,16 +1384,34 @@ func extractVirtualMachineResourcesJSON(spec vmv1.VirtualMachineSpec) string {
 	return string(resourcesJSON)
 }
 
+func extractVirtualMachineTopologyJSON(spec vmv1.VirtualMachineSpec) string {
+	topologyJSON, err := json.Marshal(spec.Topology)
+	if err != nil {
+		panic(fmt.Errorf("error marshalling JSON: %w", err))
+	}
+
+	return string(topologyJSON)
+}
+
 // podForVirtualMachine returns a VirtualMachine Pod object
 func (r *VirtualMachineReconciler) podForVirtualMachine(
+	ctx context.Context,
 	virtualmachine *vmv1.VirtualMachine,
 	sshSecret *corev1.Secret,
 ) (*corev1.Pod, error) {
-	pod, err := podSpec(virtualmachine, sshSecret, r.Config)
+	vm, flavorSpec, err := withFlavorApplied(ctx, r.Client, virtualmachine)
 	if err != nil {
 		return nil, err
 	}
 
+	pod, err := podSpec(vm, sshSecret, r.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := setFlavorSpecAnnotation(pod, flavorSpec); err != nil {
+		return nil, err
+	}
+
 	// Set the ownerRef for the Pod
 	// More info: https://kubernetes.io/docs/concepts/overview/working-with-objects/owners-dependents/
 	if err := ctrl.SetControllerReference(virtualmachine, pod, r.Scheme); err != nil {
@@ -1098,6 +1421,66 @@ func (r *VirtualMachineReconciler) podForVirtualMachine(
 	return pod, nil
 }
 
+// withFlavorApplied returns the VirtualMachine with any fields it doesn't set filled in from the
+// current spec of its VirtualMachineFlavor, along with that spec. If the VirtualMachine doesn't
+// reference a flavor, it's returned as-is, with a nil spec.
+//
+// The returned object is only used to construct the runner pod; it must not be written back.
+func withFlavorApplied(
+	ctx context.Context,
+	c client.Client,
+	virtualmachine *vmv1.VirtualMachine,
+) (*vmv1.VirtualMachine, *vmv1.VirtualMachineFlavorSpec, error) {
+	if virtualmachine.Spec.Flavor == "" {
+		return virtualmachine, nil, nil
+	}
+
+	var flavor vmv1.VirtualMachineFlavor
+	if err := c.Get(ctx, types.NamespacedName{Name: virtualmachine.Spec.Flavor}, &flavor); err != nil {
+		return nil, nil, fmt.Errorf("Failed to get VirtualMachineFlavor %q: %w", virtualmachine.Spec.Flavor, err)
+	}
+
+	vm, err := flavor.Spec.ApplyTo(virtualmachine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to apply VirtualMachineFlavor %q: %w", flavor.Name, err)
+	}
+	return vm, &flavor.Spec, nil
+}
+
+// setFlavorSpecAnnotation records the flavor spec that the runner pod was built with, if there is
+// one, so that the pod can be reproduced even if the flavor changes
+func setFlavorSpecAnnotation(pod *corev1.Pod, flavorSpec *vmv1.VirtualMachineFlavorSpec) error {
+	if flavorSpec == nil {
+		return nil
+	}
+
+	flavorJSON, err := json.Marshal(flavorSpec)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal flavor spec: %w", err)
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[vmv1.FlavorSpecAnnotation] = string(flavorJSON)
+	return nil
+}
+
+// recordedFlavorSpec returns the flavor spec that the runner pod was built with, or nil if the pod
+// doesn't have one recorded (because the VM doesn't reference a flavor, or the pod was created
+// before flavor specs were recorded).
+func recordedFlavorSpec(pod *corev1.Pod) (*vmv1.VirtualMachineFlavorSpec, error) {
+	flavorJSON, ok := pod.Annotations[vmv1.FlavorSpecAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var flavorSpec vmv1.VirtualMachineFlavorSpec
+	if err := json.Unmarshal([]byte(flavorJSON), &flavorSpec); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal %s annotation on pod %s: %w", vmv1.FlavorSpecAnnotation, pod.Name, err)
+	}
+	return &flavorSpec, nil
+}
+
 func (r *VirtualMachineReconciler) sshSecretForVirtualMachine(virtualmachine *vmv1.VirtualMachine) (*corev1.Secret, error) {
 	secret, err := sshSecretSpec(virtualmachine)
 	if err != nil {
@@ -1167,6 +1550,9 @@ func annotationsForVirtualMachine(virtualmachine *vmv1.VirtualMachine) map[strin
 	a["kubectl.kubernetes.io/default-container"] = "neonvm-runner"
 	a[vmv1.VirtualMachineUsageAnnotation] = extractVirtualMachineUsageJSON(virtualmachine.Spec)
 	a[vmv1.VirtualMachineResourcesAnnotation] = extractVirtualMachineResourcesJSON(virtualmachine.Spec)
+	if virtualmachine.Spec.Topology != nil {
+		a[vmv1.VirtualMachineTopologyAnnotation] = extractVirtualMachineTopologyJSON(virtualmachine.Spec)
+	}
 	return a
 }
 
@@ -1270,6 +1656,35 @@ func getRunnerCgroup(ctx context.Context, vm *vmv1.VirtualMachine) (*api.VCPUCgr
 	return &result, nil
 }
 
+func getRunnerGuestInfo(ctx context.Context, vm *vmv1.VirtualMachine) (*vmv1.GuestInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d/guest_info", vm.Status.PodIP, vm.Spec.RunnerPort)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var result vmv1.GuestInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 // imageForVirtualMachine gets the Operand image which is managed by this controller
 // from the VM_RUNNER_IMAGE environment variable defined in the config/manager/manager.yaml
 func imageForVmRunner() (string, error) {
@@ -1281,8 +1696,61 @@ func imageForVmRunner() (string, error) {
 	return image, nil
 }
 
+// setGuaranteedResources sets the resources of the pod's containers so that the pod has Guaranteed
+// QoS, with runnerCPUs whole CPUs for the runner container.
+//
+// For each container, the CPU and memory limits are set equal to the requests, or the requests to
+// the limits if only those were set. Init containers without either copy the runner's.
+func setGuaranteedResources(pod *corev1.Pod, runnerCPUs uint32) {
+	runner := pod.Spec.Containers[0].Resources.DeepCopy()
+	cpus := *resource.NewQuantity(int64(runnerCPUs), resource.DecimalSI)
+	if runner.Requests == nil {
+		runner.Requests = corev1.ResourceList{}
+	}
+	if runner.Limits == nil {
+		runner.Limits = corev1.ResourceList{}
+	}
+	runner.Requests[corev1.ResourceCPU] = cpus
+	runner.Limits[corev1.ResourceCPU] = cpus
+
+	guarantee := func(r *corev1.ResourceRequirements) {
+		// The maps may be shared with the VM's spec, so don't modify them in place.
+		*r = *r.DeepCopy()
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			request, hasRequest := r.Requests[name]
+			limit, hasLimit := r.Limits[name]
+			switch {
+			case hasRequest:
+				limit = request
+			case hasLimit:
+				request = limit
+			default:
+				request = runner.Requests[name]
+				limit = runner.Requests[name]
+			}
+			if r.Requests == nil {
+				r.Requests = corev1.ResourceList{}
+			}
+			if r.Limits == nil {
+				r.Limits = corev1.ResourceList{}
+			}
+			r.Requests[name] = request
+			r.Limits[name] = limit
+		}
+	}
+
+	guarantee(runner)
+	pod.Spec.Containers[0].Resources = *runner
+	for i := range pod.Spec.Containers[1:] {
+		guarantee(&pod.Spec.Containers[i+1].Resources)
+	}
+	for i := range pod.Spec.InitContainers {
+		guarantee(&pod.Spec.InitContainers[i].Resources)
+	}
+}
+
 func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, config *ReconcilerConfig) (*corev1.Pod, error) {
-	runnerVersion := api.RunnerProtoV1
+	runnerVersion := api.RunnerProtoV3
 	labels := labelsForVirtualMachine(virtualmachine, &runnerVersion)
 	annotations := annotationsForVirtualMachine(virtualmachine)
 	affinity := affinityForVirtualMachine(virtualmachine)
@@ -1335,6 +1803,8 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 						"cp /disk.qcow2 /vm/images/rootdisk.qcow2 && " +
 							/* uid=36(qemu) gid=34(kvm) groups=34(kvm) */
 							"chown 36:34 /vm/images/rootdisk.qcow2 && " +
+							// versions.json is only present in images from newer versions of vm-builder
+							"if [ -f /versions.json ]; then cp /versions.json /vm/images/versions.json; fi && " +
 							"sysctl -w net.ipv4.ip_forward=1",
 					},
 					SecurityContext: &corev1.SecurityContext{
@@ -1373,6 +1843,8 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 						// args that follow.
 						if config.UseContainerMgr {
 							cmd = append(cmd, "-skip-cgroup-management")
+						} else if config.EnforceRunnerMemoryLimit {
+							cmd = append(cmd, "-enforce-memory-limit")
 						}
 						cmd = append(
 							cmd,
@@ -1597,6 +2069,17 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 	if *virtualmachine.Spec.EnableAcceleration {
 		pod.Spec.Containers[0].Resources.Limits["neonvm/kvm"] = resource.MustParse("1")
 	}
+	// The GPUs' device plugin gives the runner their PCI addresses. Extended resources only need a
+	// limit; the request defaults to it.
+	if gpus := virtualmachine.Spec.Guest.GPUs; gpus != nil {
+		pod.Spec.Containers[0].Resources.Limits[gpus.ResourceName] = *resource.NewQuantity(int64(gpus.Count), resource.DecimalSI)
+	}
+
+	// Pinned vCPUs need exclusive host CPUs, which the kubelet's static CPU manager policy only
+	// gives to containers with a whole number of CPUs in pods with Guaranteed QoS.
+	if cpus := virtualmachine.Spec.Guest.PinnedCPUs(); cpus != 0 {
+		setGuaranteedResources(pod, cpus)
+	}
 
 	for _, port := range virtualmachine.Spec.Guest.Ports {
 		cPort := corev1.ContainerPort{
@@ -1683,7 +2166,48 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 		}
 	}
 
-	// use multus network to add extra network interface
+	if storage := virtualmachine.Spec.SnapshotStorage; storage != nil {
+		diskName := "snapshots"
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      diskName,
+			MountPath: vmv1.SnapshotMountPath,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: diskName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: storage.VolumeClaimName,
+				},
+			},
+		})
+	}
+
+	// mount the Secret with the cloud-init user-data, for the runner to put on the cloud-init drive
+	if cloudInit := virtualmachine.Spec.CloudInit; cloudInit != nil && cloudInit.UserDataSecret != nil {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "cloud-init",
+			MountPath: vmv1.CloudInitMountPath,
+			ReadOnly:  true,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "cloud-init",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: cloudInit.UserDataSecret.Name,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  cloudInit.UserDataSecret.Key,
+							Path: vmv1.CloudInitUserDataFile,
+						},
+					},
+					Optional: cloudInit.UserDataSecret.Optional,
+				},
+			},
+		})
+	}
+
+	// use multus network to add extra network interfaces
+	var nadNetworks []string
 	if virtualmachine.Spec.ExtraNetwork != nil && virtualmachine.Spec.ExtraNetwork.Enable {
 		var nadNetwork string
 		if len(virtualmachine.Spec.ExtraNetwork.MultusNetwork) > 0 { // network specified in spec
@@ -1699,7 +2223,13 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 			}
 			nadNetwork = fmt.Sprintf("%s/%s", nadNamespace, nadName)
 		}
-		pod.ObjectMeta.Annotations[nadapiv1.NetworkAttachmentAnnot] = fmt.Sprintf("%s@%s", nadNetwork, virtualmachine.Spec.ExtraNetwork.Interface)
+		nadNetworks = append(nadNetworks, fmt.Sprintf("%s@%s", nadNetwork, virtualmachine.Spec.ExtraNetwork.Interface))
+	}
+	for _, network := range virtualmachine.Spec.AdditionalNetworks {
+		nadNetworks = append(nadNetworks, fmt.Sprintf("%s@%s", network.MultusNetwork, network.PodInterface()))
+	}
+	if len(nadNetworks) != 0 {
+		pod.ObjectMeta.Annotations[nadapiv1.NetworkAttachmentAnnot] = strings.Join(nadNetworks, ",")
 	}
 
 	return pod, nil
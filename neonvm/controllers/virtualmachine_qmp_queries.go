@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -39,6 +40,19 @@ type QmpMemorySize struct {
 	} `json:"return"`
 }
 
+type QmpBlocks struct {
+	Return []QmpBlock `json:"return"`
+}
+
+type QmpBlock struct {
+	Device   string `json:"device"`
+	Inserted *struct {
+		Image struct {
+			VirtualSize int64 `json:"virtual-size"`
+		} `json:"image"`
+	} `json:"inserted,omitempty"`
+}
+
 type QmpCpuSlot struct {
 	Core int32  `json:"core"`
 	QOM  string `json:"qom"`
@@ -60,6 +74,8 @@ type QmpMemoryDevice struct {
 		Slot         int64  `json:"slot"`
 		Node         int64  `json:"node"`
 		Id           string `json:"id"`
+		// RequestedSize is only set for virtio-mem devices
+		RequestedSize int64 `json:"requested-size,omitempty"`
 	} `json:"data"`
 }
 
@@ -76,6 +92,24 @@ type QmpMigrationInfo struct {
 	Return MigrationInfo `json:"return"`
 }
 
+type QmpJobs struct {
+	Return []QmpJob `json:"return"`
+}
+
+type QmpJob struct {
+	Id     string  `json:"id"`
+	Type   string  `json:"type"`
+	Status string  `json:"status"`
+	Error  *string `json:"error,omitempty"`
+}
+
+type QmpStatus struct {
+	Return struct {
+		Running bool   `json:"running"`
+		Status  string `json:"status"`
+	} `json:"return"`
+}
+
 type MigrationInfo struct {
 	Status      string `json:"status"`
 	TotalTimeMs int64  `json:"total-time"`
@@ -274,7 +308,7 @@ func QmpQueryMemoryDevices(ip string, port int32) ([]QmpMemoryDevice, error) {
 	return QmpMonQueryMemoryDevices(mon)
 }
 
-func QmpMonQueryMemoryDevices(mon *qmp.SocketMonitor) ([]QmpMemoryDevice, error) {
+func QmpMonQueryMemoryDevices(mon QMPRunner) ([]QmpMemoryDevice, error) {
 	cmd := []byte(`{"execute": "query-memory-devices"}`)
 	raw, err := mon.Run(cmd)
 	if err != nil {
@@ -670,7 +704,39 @@ func QmpSetMemorySlots(
 	return setter.run()
 }
 
+// QmpSetVirtioMemSize sets the requested size of the VM's virtio-mem device, returning how much
+// memory the guest has currently plugged from it.
+func QmpSetVirtioMemSize(mon QMPRunner, requestedSize int64) (int64, error) {
+	devices, err := QmpMonQueryMemoryDevices(mon)
+	if err != nil {
+		return 0, err
+	}
+	idx := slices.IndexFunc(devices, func(d QmpMemoryDevice) bool { return d.Type == "virtio-mem" })
+	if idx == -1 {
+		return 0, errors.New("virtio-mem device not found")
+	}
+	device := devices[idx]
+
+	if device.Data.RequestedSize != requestedSize {
+		qmpcmd := []byte(fmt.Sprintf(
+			`{"execute": "qom-set", "arguments": {"path": "/machine/peripheral/%s", "property": "requested-size", "value": %d}}`,
+			device.Data.Id, requestedSize,
+		))
+		if _, err := mon.Run(qmpcmd); err != nil {
+			return 0, err
+		}
+	}
+
+	return device.Data.Size, nil
+}
+
 func QmpSyncMemoryToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration) error {
+	// The state of the virtio-mem device, including which blocks are plugged, is migrated along
+	// with the rest of the VM.
+	if vm.Spec.Guest.UsesVirtioMem() {
+		return nil
+	}
+
 	memoryDevices, err := QmpQueryMemoryDevices(QmpAddr(vm))
 	if err != nil {
 		return err
@@ -741,6 +807,51 @@ func QmpGetMemorySize(ip string, port int32) (*resource.Quantity, error) {
 	return resource.NewQuantity(result.Return.BaseMemory+result.Return.PluggedMemory, resource.BinarySI), nil
 }
 
+// rootDiskDevice is the ID of the root disk's drive, as given to QEMU by neonvm-runner
+const rootDiskDevice = "rootdisk"
+
+// QmpGetRootDiskSize returns the current size of the VM's root disk
+func QmpGetRootDiskSize(ip string, port int32) (*resource.Quantity, error) {
+	mon, err := QmpConnect(ip, port)
+	if err != nil {
+		return nil, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	qmpcmd := []byte(`{"execute": "query-block"}`)
+	raw, err := mon.Run(qmpcmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var result QmpBlocks
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	for _, block := range result.Return {
+		if block.Device == rootDiskDevice && block.Inserted != nil {
+			return resource.NewQuantity(block.Inserted.Image.VirtualSize, resource.BinarySI), nil
+		}
+	}
+	return nil, fmt.Errorf("block device %q not found", rootDiskDevice)
+}
+
+// QmpResizeRootDisk grows the VM's root disk to the given size
+//
+// The guest is notified of the new size by virtio, and grows the root filesystem to match.
+func QmpResizeRootDisk(ip string, port int32, size *resource.Quantity) error {
+	mon, err := QmpConnect(ip, port)
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	qmpcmd := []byte(fmt.Sprintf(`{"execute": "block_resize", "arguments": {"device": %q, "size": %d}}`, rootDiskDevice, size.Value()))
+	_, err = mon.Run(qmpcmd)
+	return err
+}
+
 func QmpStartMigration(virtualmachine *vmv1.VirtualMachine, virtualmachinemigration *vmv1.VirtualMachineMigration) error {
 
 	// QMP port
@@ -911,3 +1022,109 @@ func QmpQuit(ip string, port int32) error {
 
 	return nil
 }
+
+// QmpIsPaused returns whether the VM's vCPUs are stopped
+func QmpIsPaused(mon QMPRunner) (bool, error) {
+	qmpcmd := []byte(`{"execute": "query-status"}`)
+	raw, err := mon.Run(qmpcmd)
+	if err != nil {
+		return false, err
+	}
+
+	var result QmpStatus
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	return result.Return.Status == "paused", nil
+}
+
+// QmpSetPaused stops the VM's vCPUs if paused is true, or resumes them otherwise
+func QmpSetPaused(mon QMPRunner, paused bool) error {
+	qmpcmd := []byte(`{"execute": "cont"}`)
+	if paused {
+		qmpcmd = []byte(`{"execute": "stop"}`)
+	}
+	_, err := mon.Run(qmpcmd)
+	return err
+}
+
+// snapshotJobId returns the ID of the QEMU block job copying the disk for the snapshot
+func snapshotJobId(snapshotName string, diskName string) string {
+	return fmt.Sprintf("snapshot-%s_%s", snapshotName, diskName)
+}
+
+// QmpStartSnapshot starts copying the disks to the snapshot's storage, all from the same instant.
+// The copies are made by block jobs, which can be checked with QmpQueryJobs.
+func QmpStartSnapshot(mon QMPRunner, snapshotName string, disks []string) error {
+	type backupData struct {
+		Device      string `json:"device"`
+		JobId       string `json:"job-id"`
+		Target      string `json:"target"`
+		Sync        string `json:"sync"`
+		Format      string `json:"format"`
+		AutoDismiss bool   `json:"auto-dismiss"`
+	}
+	type action struct {
+		Type string     `json:"type"`
+		Data backupData `json:"data"`
+	}
+	var actions []action
+	for _, disk := range disks {
+		actions = append(actions, action{
+			Type: "drive-backup",
+			Data: backupData{
+				Device: disk,
+				JobId:  snapshotJobId(snapshotName, disk),
+				Target: vmv1.SnapshotDiskPath(snapshotName, disk),
+				Sync:   "full",
+				Format: "qcow2",
+				// keep the job around after it finishes, so that we can see whether it failed
+				AutoDismiss: false,
+			},
+		})
+	}
+
+	cmd := map[string]any{
+		"execute":   "transaction",
+		"arguments": map[string]any{"actions": actions},
+	}
+	qmpcmd, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("error marshaling json: %w", err)
+	}
+	_, err = mon.Run(qmpcmd)
+	return err
+}
+
+// QmpQueryJobs returns the block jobs in QEMU, including the ones that have finished but haven't
+// been dismissed
+func QmpQueryJobs(mon QMPRunner) ([]QmpJob, error) {
+	qmpcmd := []byte(`{"execute": "query-jobs"}`)
+	raw, err := mon.Run(qmpcmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var result QmpJobs
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	return result.Return, nil
+}
+
+// QmpDismissJob removes a finished block job from QEMU
+func QmpDismissJob(mon QMPRunner, id string) error {
+	qmpcmd := []byte(fmt.Sprintf(`{"execute": "job-dismiss", "arguments": {"id": %q}}`, id))
+	_, err := mon.Run(qmpcmd)
+	return err
+}
+
+// QmpCancelJob stops a running block job. The job still has to be dismissed with QmpDismissJob
+// once it has concluded.
+func QmpCancelJob(mon QMPRunner, id string) error {
+	qmpcmd := []byte(fmt.Sprintf(`{"execute": "job-cancel", "arguments": {"id": %q}}`, id))
+	_, err := mon.Run(qmpcmd)
+	return err
+}
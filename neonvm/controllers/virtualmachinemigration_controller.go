@@ -21,6 +21,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"slices"
+	"strings"
 	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -33,6 +35,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/storage/names"
@@ -69,6 +72,8 @@ type VirtualMachineMigrationReconciler struct {
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinemigrations,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinemigrations/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinemigrations/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinemigrationbudgets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinemigrationbudgets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;list;watch
@@ -197,12 +202,44 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 		return r.updateMigrationStatus(ctx, migration)
 	}
 
+	// The state of devices passed through to the VM can't be transferred, so VMs with them can't
+	// be migrated.
+	if migration.Status.Phase == "" && vm.Spec.Guest.GPUs != nil {
+		message := fmt.Sprintf("VM (%s) has GPUs passed through, so it can't be migrated", vm.Name)
+		log.Info(message)
+		r.Recorder.Event(migration, "Warning", "Failed", message)
+		meta.SetStatusCondition(&migration.Status.Conditions,
+			metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+				Status:  metav1.ConditionTrue,
+				Reason:  "Reconciling",
+				Message: message})
+		migration.Status.Phase = vmv1.VmmFailed
+		return r.updateMigrationStatus(ctx, migration)
+	}
+
 	switch migration.Status.Phase {
 
 	case "":
 		// need change VM status asap to prevent autoscler change CPU/RAM in VM
 		// but only if VM running
 		if vm.Status.Phase == vmv1.VmRunning {
+			// ... and only if no VirtualMachineMigrationBudget would be exceeded by starting it.
+			blockedBy, err := r.admitMigration(ctx, vm, migration)
+			if apierrors.IsConflict(err) {
+				// Another migration was admitted to the same budget at the same time. Check again,
+				// counting it.
+				log.Info("Conflict while admitting migration to VirtualMachineMigrationBudget, retrying", "error", err.Error())
+				return ctrl.Result{Requeue: true}, nil
+			} else if err != nil {
+				log.Error(err, "Failed to check VirtualMachineMigrationBudgets")
+				return ctrl.Result{}, err
+			} else if blockedBy != "" {
+				message := fmt.Sprintf("Waiting for VirtualMachineMigrationBudget %s to allow migration", blockedBy)
+				log.Info(message)
+				r.Recorder.Event(migration, "Normal", "WaitingForBudget", message)
+				return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+			}
+
 			vm.Status.Phase = vmv1.VmPreMigrating
 			if err := r.Status().Update(ctx, vm); err != nil {
 				log.Error(err, "Failed to update VM status to PreMigrating", "Status", vm.Status.Phase)
@@ -245,7 +282,7 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			}
 
 			// Define a new target pod
-			tpod, err := r.targetPodForVirtualMachine(vm, migration, sshSecret)
+			tpod, err := r.targetPodForVirtualMachine(ctx, vm, migration, sshSecret)
 			if err != nil {
 				log.Error(err, "Failed to generate Target Pod spec")
 				return ctrl.Result{}, err
@@ -435,6 +472,11 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			vm.Status.PodName = migration.Status.TargetPodName
 			vm.Status.PodIP = migration.Status.TargetPodIP
 			vm.Status.Phase = vmv1.VmRunning
+			// Hand the VM off to the target node at the same time, so that the autoscaler-agents
+			// on each node agree on when its usage moved between them.
+			now := metav1.Now()
+			vm.Status.Node = targetRunner.Spec.NodeName
+			vm.Status.MigratedAt = &now
 			// update VM status
 			if err := r.Status().Update(ctx, vm); err != nil {
 				log.Error(err, "Failed to redefine runner pod in VM")
@@ -680,17 +722,213 @@ func (r *VirtualMachineMigrationReconciler) SetupWithManager(mgr ctrl.Manager) (
 	return reconciler, err
 }
 
+// admitMigration checks each VirtualMachineMigrationBudget selecting the VM, and if all of them
+// allow the migration to start, records it as admitted in their statuses. It returns the name of a
+// budget that doesn't allow the migration because other selected VMs are already migrating, or the
+// empty string if the migration was admitted.
+//
+// A VM is counted as migrating while a budget has admitted a migration for it that hasn't finished,
+// while its phase is PreMigrating or Migrating, and while it has a Pending or Running migration, so
+// that migrations started before the budget existed are counted too.
+//
+// Admission is serialized per budget: each status update is made with the resourceVersion that the
+// budget was read with, so if two migrations are admitted to the same budget at once (or the cache
+// was stale), one of the updates fails with a conflict, and that migration is checked again on the
+// next reconcile, this time counting the other one.
+func (r *VirtualMachineMigrationReconciler) admitMigration(
+	ctx context.Context,
+	vm *vmv1.VirtualMachine,
+	migration *vmv1.VirtualMachineMigration,
+) (string, error) {
+	var budgetList vmv1.VirtualMachineMigrationBudgetList
+	if err := r.List(ctx, &budgetList, client.InNamespace(vm.Namespace)); err != nil {
+		return "", fmt.Errorf("Failed to list VirtualMachineMigrationBudgets: %w", err)
+	}
+
+	var budgets []*vmv1.VirtualMachineMigrationBudget
+	var selectors []labels.Selector
+	for i := range budgetList.Items {
+		budget := &budgetList.Items[i]
+		selector, err := metav1.LabelSelectorAsSelector(&budget.Spec.Selector)
+		if err != nil {
+			return "", fmt.Errorf("Invalid selector for VirtualMachineMigrationBudget %s: %w", budget.Name, err)
+		}
+		if selector.Matches(labels.Set(vm.Labels)) {
+			budgets = append(budgets, budget)
+			selectors = append(selectors, selector)
+		}
+	}
+	// Only look up the other migrations if there's a budget that applies to this VM.
+	if len(budgets) == 0 {
+		return "", nil
+	}
+
+	var migrations vmv1.VirtualMachineMigrationList
+	if err := r.List(ctx, &migrations, client.InNamespace(vm.Namespace)); err != nil {
+		return "", fmt.Errorf("Failed to list VirtualMachineMigrations: %w", err)
+	}
+	var vms vmv1.VirtualMachineList
+	if err := r.List(ctx, &vms, client.InNamespace(vm.Namespace)); err != nil {
+		return "", fmt.Errorf("Failed to list VirtualMachines: %w", err)
+	}
+	migrating := migratingVMs(vms.Items, migrations.Items, vm.Name)
+
+	// Check every budget before admitting to any of them, so that a migration doesn't hold a place
+	// in one budget while waiting on another.
+	var toUpdate []*vmv1.VirtualMachineMigrationBudget
+	for i, budget := range budgets {
+		admitted := unfinishedMigrations(budget.Status.AdmittedMigrations, migrations.Items)
+		if slices.ContainsFunc(admitted, func(m vmv1.AdmittedMigration) bool { return m.Name == migration.Name }) {
+			continue
+		}
+		if budgetUsage(admitted, selectors[i], migrating, vm.Name) >= budget.Spec.MaxConcurrentMigrations {
+			return budget.Name, nil
+		}
+
+		budget.Status.AdmittedMigrations = append(admitted, vmv1.AdmittedMigration{
+			Name:   migration.Name,
+			VmName: vm.Name,
+		})
+		toUpdate = append(toUpdate, budget)
+	}
+
+	// Update the budgets in a consistent order, so that if concurrent admissions conflict partway
+	// through, they can't each end up holding a place that the other is waiting for.
+	slices.SortFunc(toUpdate, func(a, b *vmv1.VirtualMachineMigrationBudget) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, budget := range toUpdate {
+		if err := r.Status().Update(ctx, budget); err != nil {
+			return "", fmt.Errorf("Failed to admit migration to VirtualMachineMigrationBudget %s: %w", budget.Name, err)
+		}
+	}
+
+	return "", nil
+}
+
+// migratingVMs returns the labels of the VMs in the namespace that are migrating, other than the
+// VM with the excluded name
+func migratingVMs(
+	vms []vmv1.VirtualMachine,
+	migrations []vmv1.VirtualMachineMigration,
+	exclude string,
+) map[string]labels.Set {
+	withMigration := make(map[string]struct{})
+	for _, m := range migrations {
+		if m.Status.Phase == vmv1.VmmPending || m.Status.Phase == vmv1.VmmRunning {
+			withMigration[m.Spec.VmName] = struct{}{}
+		}
+	}
+
+	migrating := make(map[string]labels.Set)
+	for _, vm := range vms {
+		if vm.Name == exclude {
+			continue
+		}
+		_, ok := withMigration[vm.Name]
+		if ok || vm.Status.Phase == vmv1.VmPreMigrating || vm.Status.Phase == vmv1.VmMigrating {
+			migrating[vm.Name] = labels.Set(vm.Labels)
+		}
+	}
+	return migrating
+}
+
+// unfinishedMigrations returns the admitted migrations that still exist and haven't succeeded or
+// failed
+func unfinishedMigrations(
+	admitted []vmv1.AdmittedMigration,
+	migrations []vmv1.VirtualMachineMigration,
+) []vmv1.AdmittedMigration {
+	phases := make(map[string]vmv1.VmmPhase)
+	for _, m := range migrations {
+		phases[m.Name] = m.Status.Phase
+	}
+
+	var unfinished []vmv1.AdmittedMigration
+	for _, m := range admitted {
+		phase, ok := phases[m.Name]
+		if ok && phase != vmv1.VmmSucceeded && phase != vmv1.VmmFailed {
+			unfinished = append(unfinished, m)
+		}
+	}
+	return unfinished
+}
+
+// budgetUsage returns the number of VMs, other than the VM with the excluded name, that count
+// towards a budget with the admitted migrations and selector
+func budgetUsage(
+	admitted []vmv1.AdmittedMigration,
+	selector labels.Selector,
+	migrating map[string]labels.Set,
+	exclude string,
+) int32 {
+	counted := make(map[string]struct{})
+	for _, m := range admitted {
+		if m.VmName != exclude {
+			counted[m.VmName] = struct{}{}
+		}
+	}
+	for name, vmLabels := range migrating {
+		if selector.Matches(vmLabels) {
+			counted[name] = struct{}{}
+		}
+	}
+	return int32(len(counted))
+}
+
+// withSourceFlavorApplied is like withFlavorApplied, but uses the flavor spec recorded on the VM's
+// current runner pod instead of the flavor's current spec, if there is one
+func withSourceFlavorApplied(
+	ctx context.Context,
+	c client.Client,
+	vm *vmv1.VirtualMachine,
+) (*vmv1.VirtualMachine, *vmv1.VirtualMachineFlavorSpec, error) {
+	if vm.Spec.Flavor == "" {
+		return vm, nil, nil
+	}
+
+	sourcePod := new(corev1.Pod)
+	err := c.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, sourcePod)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get source runner pod %s: %w", vm.Status.PodName, err)
+	}
+	flavorSpec, err := recordedFlavorSpec(sourcePod)
+	if err != nil {
+		return nil, nil, err
+	} else if flavorSpec == nil {
+		// The source pod was created before flavor specs were recorded, so the flavor's current
+		// spec is the best we have.
+		return withFlavorApplied(ctx, c, vm)
+	}
+
+	flavoredVM, err := flavorSpec.ApplyTo(vm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to apply flavor recorded on source runner pod %s: %w", sourcePod.Name, err)
+	}
+	return flavoredVM, flavorSpec, nil
+}
+
 // targetPodForVirtualMachine returns a VirtualMachine Pod object
 func (r *VirtualMachineMigrationReconciler) targetPodForVirtualMachine(
+	ctx context.Context,
 	vm *vmv1.VirtualMachine,
 	migration *vmv1.VirtualMachineMigration,
 	sshSecret *corev1.Secret,
 ) (*corev1.Pod, error) {
+	// Build the target pod from the same flavor spec as the source pod, so that the migration is
+	// like-for-like even if the flavor was edited after the VM started.
+	flavoredVM, flavorSpec, err := withSourceFlavorApplied(ctx, r.Client, vm)
+	if err != nil {
+		return nil, err
+	}
 
-	pod, err := podSpec(vm, sshSecret, r.Config)
+	pod, err := podSpec(flavoredVM, sshSecret, r.Config)
 	if err != nil {
 		return nil, err
 	}
+	if err := setFlavorSpecAnnotation(pod, flavorSpec); err != nil {
+		return nil, err
+	}
 
 	// override pod name
 	pod.Name = migration.Status.TargetPodName
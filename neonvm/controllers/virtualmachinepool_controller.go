@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// VirtualMachinePoolReconciler reconciles a VirtualMachinePool object
+type VirtualMachinePoolReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Config   *ReconcilerConfig
+
+	Metrics ReconcilerMetrics
+}
+
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinepools,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinepools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinepoolclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinepoolclaims/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile keeps .spec.replicas unclaimed VirtualMachines in the pool, binding
+// VirtualMachinePoolClaims to them and releasing the ones that have been claimed.
+//
+// A claim is bound in three steps, so that an interrupted reconcile can pick up where it left off:
+// first the claim's .status.vmName is set, then the VM is updated with the claim's metadata and
+// released from the pool, and then the claim's phase is set to Bound. Each of these is an update
+// with the resourceVersion that the object was read with, so a claim can't be bound to two VMs, or
+// a VM to two claims, even if the cache is stale.
+func (r *VirtualMachinePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	pool := new(vmv1.VirtualMachinePool)
+	if err := r.Get(ctx, req.NamespacedName, pool); err != nil {
+		// ignore error and stop reconcile loop if object not found (already deleted?)
+		if apierrors.IsNotFound(err) {
+			r.deletePoolMetrics(req.Namespace, req.Name)
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to fetch VirtualMachinePool")
+		return ctrl.Result{}, err
+	}
+
+	// The pool's VMs are deleted by garbage collection, through their owner references.
+	if !pool.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	var vmList vmv1.VirtualMachineList
+	if err := r.List(
+		ctx,
+		&vmList,
+		client.InNamespace(pool.Namespace),
+		client.MatchingLabels{vmv1.VirtualMachinePoolLabel: pool.Name},
+	); err != nil {
+		return ctrl.Result{}, fmt.Errorf("Failed to list VirtualMachines for pool: %w", err)
+	}
+
+	var claimList vmv1.VirtualMachinePoolClaimList
+	if err := r.List(ctx, &claimList, client.InNamespace(pool.Namespace)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("Failed to list VirtualMachinePoolClaims: %w", err)
+	}
+
+	// Claims that have been assigned a VM but aren't bound yet, by the VM's name
+	binding := make(map[string]*vmv1.VirtualMachinePoolClaim)
+	var unbound []*vmv1.VirtualMachinePoolClaim
+	for i := range claimList.Items {
+		claim := &claimList.Items[i]
+		if claim.Spec.PoolName != pool.Name || !claim.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if claim.Status.Phase == vmv1.PoolClaimBound {
+			continue
+		} else if claim.Status.VmName != "" {
+			binding[claim.Status.VmName] = claim
+		} else {
+			unbound = append(unbound, claim)
+		}
+	}
+
+	var ready, pending []*vmv1.VirtualMachine
+	var claimed int64
+	for i := range vmList.Items {
+		vm := &vmList.Items[i]
+		if !metav1.IsControlledBy(vm, pool) || !vm.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		if vm.Labels[vmv1.VirtualMachinePoolClaimedLabel] == "true" {
+			if err := r.releaseVM(ctx, pool, vm); err != nil {
+				return ctrl.Result{}, err
+			}
+			log.Info("Released claimed VM from pool", "VirtualMachine", vm.Name)
+			r.Recorder.Eventf(pool, corev1.EventTypeNormal, "Claimed", "VirtualMachine %s was claimed", vm.Name)
+			claimed += 1
+			continue
+		}
+
+		// VMs claimed through the label are released above, even if they were also assigned to a
+		// VirtualMachinePoolClaim, which then gets another VM.
+		if claim, ok := binding[vm.Name]; ok {
+			delete(binding, vm.Name)
+			if err := r.bindClaim(ctx, pool, claim, vm); err != nil {
+				return ctrl.Result{}, err
+			}
+			claimed += 1
+			continue
+		}
+
+		switch vm.Status.Phase {
+		case vmv1.VmRunning:
+			ready = append(ready, vm)
+		case vmv1.VmFailed, vmv1.VmSucceeded:
+			// The VM can't be claimed anymore, so replace it.
+			log.Info("Deleting stopped VM from pool", "VirtualMachine", vm.Name, "phase", vm.Status.Phase)
+			if err := r.Delete(ctx, vm); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to delete stopped VirtualMachine %s: %w", vm.Name, err)
+			}
+		default:
+			pending = append(pending, vm)
+		}
+	}
+
+	// The rest of the claims being bound were assigned VMs that are no longer in the pool: either
+	// because they were already released to the claim, or because they were claimed some other way
+	// in the meantime.
+	for _, claim := range sortedClaims(binding) {
+		var vm vmv1.VirtualMachine
+		err := r.Get(ctx, client.ObjectKey{Namespace: pool.Namespace, Name: claim.Status.VmName}, &vm)
+		if client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, fmt.Errorf("Failed to get VirtualMachine %s for claim %s: %w", claim.Status.VmName, claim.Name, err)
+		}
+
+		if err == nil && vm.Annotations[vmv1.VirtualMachinePoolClaimAnnotation] == claim.Name {
+			if err := r.setClaimStatus(ctx, claim, vmv1.PoolClaimBound, vm.Name); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else {
+			log.Info("VM assigned to claim is no longer available, retrying", "VirtualMachinePoolClaim", claim.Name, "VirtualMachine", claim.Status.VmName)
+			unbound = append(unbound, claim)
+		}
+	}
+
+	// Bind the unbound claims to the ready VMs, oldest first.
+	sort.SliceStable(unbound, func(i, j int) bool {
+		return unbound[i].CreationTimestamp.Before(&unbound[j].CreationTimestamp)
+	})
+	sort.SliceStable(ready, func(i, j int) bool {
+		return ready[i].CreationTimestamp.Before(&ready[j].CreationTimestamp)
+	})
+	for _, claim := range unbound {
+		if len(ready) == 0 {
+			if claim.Status.Phase != vmv1.PoolClaimPending || claim.Status.VmName != "" {
+				if err := r.setClaimStatus(ctx, claim, vmv1.PoolClaimPending, ""); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			continue
+		}
+
+		vm := ready[0]
+		ready = ready[1:]
+		if err := r.setClaimStatus(ctx, claim, vmv1.PoolClaimPending, vm.Name); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.bindClaim(ctx, pool, claim, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		claimed += 1
+	}
+
+	current := len(ready) + len(pending)
+	desired := int(pool.Spec.Replicas)
+
+	if current < desired {
+		for i := current; i < desired; i++ {
+			vm, err := r.vmForPool(pool)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if err := r.Create(ctx, vm); err != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to create VirtualMachine for pool: %w", err)
+			}
+			log.Info("Created VM for pool", "VirtualMachine", vm.Name)
+			pending = append(pending, vm)
+		}
+	} else if current > desired {
+		// Prefer removing VMs that aren't ready yet, and then the newest ones.
+		byNewest := func(vms []*vmv1.VirtualMachine) {
+			sort.SliceStable(vms, func(i, j int) bool {
+				return vms[j].CreationTimestamp.Before(&vms[i].CreationTimestamp)
+			})
+		}
+		byNewest(pending)
+		byNewest(ready)
+		excess := append(append([]*vmv1.VirtualMachine{}, pending...), ready...)[:current-desired]
+		for _, vm := range excess {
+			if err := r.Delete(ctx, vm); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to delete excess VirtualMachine %s: %w", vm.Name, err)
+			}
+			log.Info("Deleted excess VM from pool", "VirtualMachine", vm.Name)
+		}
+		// Recount, now that some were removed.
+		removed := len(excess)
+		if removed <= len(pending) {
+			pending = pending[removed:]
+		} else {
+			ready = ready[removed-len(pending):]
+			pending = nil
+		}
+	}
+
+	pool.Status.Ready = int32(len(ready))
+	pool.Status.Pending = int32(len(pending))
+	pool.Status.Claimed += claimed
+	if err := r.Status().Update(ctx, pool); err != nil {
+		log.Error(err, "Failed to update VirtualMachinePool status")
+		return ctrl.Result{}, err
+	}
+
+	r.updatePoolMetrics(pool, claimed)
+
+	return ctrl.Result{}, nil
+}
+
+// bindClaim gives the claim's metadata to the VM assigned to it, releases the VM from the pool, and
+// marks the claim as bound
+func (r *VirtualMachinePoolReconciler) bindClaim(
+	ctx context.Context,
+	pool *vmv1.VirtualMachinePool,
+	claim *vmv1.VirtualMachinePoolClaim,
+	vm *vmv1.VirtualMachine,
+) error {
+	if vm.Labels == nil {
+		vm.Labels = make(map[string]string)
+	}
+	for k, v := range claim.Spec.Metadata.Labels {
+		vm.Labels[k] = v
+	}
+	if vm.Annotations == nil {
+		vm.Annotations = make(map[string]string)
+	}
+	for k, v := range claim.Spec.Metadata.Annotations {
+		vm.Annotations[k] = v
+	}
+	vm.Annotations[vmv1.VirtualMachinePoolClaimAnnotation] = claim.Name
+
+	if err := r.releaseVM(ctx, pool, vm); err != nil {
+		return err
+	}
+	if err := r.setClaimStatus(ctx, claim, vmv1.PoolClaimBound, vm.Name); err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Info("Bound claim to VM from pool", "VirtualMachinePoolClaim", claim.Name, "VirtualMachine", vm.Name)
+	r.Recorder.Eventf(pool, corev1.EventTypeNormal, "Claimed", "VirtualMachine %s was claimed by %s", vm.Name, claim.Name)
+	return nil
+}
+
+func (r *VirtualMachinePoolReconciler) setClaimStatus(
+	ctx context.Context,
+	claim *vmv1.VirtualMachinePoolClaim,
+	phase vmv1.PoolClaimPhase,
+	vmName string,
+) error {
+	claim.Status.Phase = phase
+	claim.Status.VmName = vmName
+	if err := r.Status().Update(ctx, claim); err != nil {
+		return fmt.Errorf("Failed to update VirtualMachinePoolClaim %s status: %w", claim.Name, err)
+	}
+	return nil
+}
+
+// sortedClaims returns the claims in the map, sorted by name
+func sortedClaims(claims map[string]*vmv1.VirtualMachinePoolClaim) []*vmv1.VirtualMachinePoolClaim {
+	var sorted []*vmv1.VirtualMachinePoolClaim
+	for _, c := range claims {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// releaseVM removes the claimed VM from the pool, so that it's no longer owned or counted by it
+func (r *VirtualMachinePoolReconciler) releaseVM(ctx context.Context, pool *vmv1.VirtualMachinePool, vm *vmv1.VirtualMachine) error {
+	var ownerRefs []metav1.OwnerReference
+	for _, ref := range vm.OwnerReferences {
+		if ref.UID != pool.UID {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	vm.OwnerReferences = ownerRefs
+	delete(vm.Labels, vmv1.VirtualMachinePoolLabel)
+	delete(vm.Labels, vmv1.VirtualMachinePoolClaimedLabel)
+
+	if err := r.Update(ctx, vm); err != nil {
+		return fmt.Errorf("Failed to release claimed VirtualMachine %s: %w", vm.Name, err)
+	}
+	return nil
+}
+
+// vmForPool returns a new VirtualMachine from the pool's template
+func (r *VirtualMachinePoolReconciler) vmForPool(pool *vmv1.VirtualMachinePool) (*vmv1.VirtualMachine, error) {
+	template := pool.Spec.Template.DeepCopy()
+
+	labels := template.Metadata.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[vmv1.VirtualMachinePoolLabel] = pool.Name
+
+	vm := &vmv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-", pool.Name),
+			Namespace:    pool.Namespace,
+			Labels:       labels,
+			Annotations:  template.Metadata.Annotations,
+		},
+		Spec: template.Spec,
+	}
+
+	if err := ctrl.SetControllerReference(pool, vm, r.Scheme); err != nil {
+		return nil, fmt.Errorf("Failed to set owner reference on VirtualMachine for pool: %w", err)
+	}
+	return vm, nil
+}
+
+func (r *VirtualMachinePoolReconciler) updatePoolMetrics(pool *vmv1.VirtualMachinePool, claimed int64) {
+	// metrics aren't set in tests
+	if r.Metrics.poolVMs == nil {
+		return
+	}
+
+	r.Metrics.poolVMs.WithLabelValues(pool.Namespace, pool.Name, "ready").Set(float64(pool.Status.Ready))
+	r.Metrics.poolVMs.WithLabelValues(pool.Namespace, pool.Name, "pending").Set(float64(pool.Status.Pending))
+	r.Metrics.poolClaims.WithLabelValues(pool.Namespace, pool.Name).Add(float64(claimed))
+}
+
+func (r *VirtualMachinePoolReconciler) deletePoolMetrics(namespace, name string) {
+	if r.Metrics.poolVMs == nil {
+		return
+	}
+
+	r.Metrics.poolVMs.DeleteLabelValues(namespace, name, "ready")
+	r.Metrics.poolVMs.DeleteLabelValues(namespace, name, "pending")
+	r.Metrics.poolClaims.DeleteLabelValues(namespace, name)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Note that the VirtualMachines and VirtualMachinePoolClaims will be also watched, so that claims are
+// handled immediately
+func (r *VirtualMachinePoolReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
+	cntrlName := "virtualmachinepool"
+	reconciler := WithMetrics(withCatchPanic(r), r.Metrics, cntrlName)
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&vmv1.VirtualMachinePool{}).
+		Owns(&vmv1.VirtualMachine{}).
+		Watches(
+			&source.Kind{Type: &vmv1.VirtualMachinePoolClaim{}},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				claim := obj.(*vmv1.VirtualMachinePoolClaim)
+				return []reconcile.Request{{
+					NamespacedName: client.ObjectKey{Namespace: claim.Namespace, Name: claim.Spec.PoolName},
+				}}
+			}),
+		).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
+		Named(cntrlName).
+		Complete(reconciler)
+	return reconciler, err
+}
@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// VirtualMachineScalingGroupReconciler reconciles a VirtualMachineScalingGroup object
+type VirtualMachineScalingGroupReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Config   *ReconcilerConfig
+
+	Metrics ReconcilerMetrics
+}
+
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinescalinggroups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinescalinggroups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile scales the group's replicas horizontally based on their utilization, and keeps the
+// number of replica VirtualMachines equal to .status.replicas.
+//
+// The VirtualMachines are watched, so changes to their vCPUs from vertical scaling by the
+// autoscaler-agent trigger a reconcile.
+func (r *VirtualMachineScalingGroupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	group := new(vmv1.VirtualMachineScalingGroup)
+	if err := r.Get(ctx, req.NamespacedName, group); err != nil {
+		// ignore error and stop reconcile loop if object not found (already deleted?)
+		if apierrors.IsNotFound(err) {
+			r.deleteScalingGroupMetrics(req.Namespace, req.Name)
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to fetch VirtualMachineScalingGroup")
+		return ctrl.Result{}, err
+	}
+
+	// The group's VMs are deleted by garbage collection, through their owner references.
+	if !group.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// There's no webhook for scaling groups, so check the relationships between fields here.
+	if group.Spec.MaxReplicas < group.Spec.MinReplicas {
+		r.Recorder.Event(group, corev1.EventTypeWarning, "InvalidSpec", ".spec.maxReplicas must not be less than .spec.minReplicas")
+		return ctrl.Result{}, nil
+	} else if group.Spec.ScaleDownUtilizationPercent >= group.Spec.ScaleUpUtilizationPercent {
+		r.Recorder.Event(group, corev1.EventTypeWarning, "InvalidSpec", ".spec.scaleDownUtilizationPercent must be less than .spec.scaleUpUtilizationPercent")
+		return ctrl.Result{}, nil
+	}
+
+	var vmList vmv1.VirtualMachineList
+	if err := r.List(
+		ctx,
+		&vmList,
+		client.InNamespace(group.Namespace),
+		client.MatchingLabels{vmv1.VirtualMachineScalingGroupLabel: group.Name},
+	); err != nil {
+		return ctrl.Result{}, fmt.Errorf("Failed to list VirtualMachines for scaling group: %w", err)
+	}
+
+	var ready, pending []*vmv1.VirtualMachine
+	for i := range vmList.Items {
+		vm := &vmList.Items[i]
+		if !metav1.IsControlledBy(vm, group) || !vm.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		switch vm.Status.Phase {
+		case vmv1.VmRunning:
+			ready = append(ready, vm)
+		case vmv1.VmFailed, vmv1.VmSucceeded:
+			// The replica isn't serving anymore, so replace it.
+			log.Info("Deleting stopped VM from scaling group", "VirtualMachine", vm.Name, "phase", vm.Status.Phase)
+			if err := r.Delete(ctx, vm); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to delete stopped VirtualMachine %s: %w", vm.Name, err)
+			}
+		default:
+			pending = append(pending, vm)
+		}
+	}
+
+	now := time.Now()
+	group.Status.UtilizationPercent = replicaUtilization(ready)
+	previous := group.Status.Replicas
+	desired := scaleReplicas(&group.Spec, &group.Status, len(ready), len(pending), now)
+	if previous != 0 && desired != previous {
+		log.Info(
+			"Scaling replicas of scaling group",
+			"from", previous, "to", desired, "utilizationPercent", group.Status.UtilizationPercent,
+		)
+		r.Recorder.Eventf(
+			group, corev1.EventTypeNormal, "Scaled",
+			"Scaled from %d to %d replicas, at %d%% utilization", previous, desired, group.Status.UtilizationPercent,
+		)
+	}
+
+	current := len(ready) + len(pending)
+	if current < int(desired) {
+		for i := current; i < int(desired); i++ {
+			vm, err := r.vmForScalingGroup(group, len(ready))
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if err := r.Create(ctx, vm); err != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to create VirtualMachine for scaling group: %w", err)
+			}
+			log.Info("Created VM for scaling group", "VirtualMachine", vm.Name)
+			pending = append(pending, vm)
+		}
+	} else if current > int(desired) {
+		// Prefer removing VMs that aren't ready yet, and then the newest ones.
+		byNewest := func(vms []*vmv1.VirtualMachine) {
+			sort.SliceStable(vms, func(i, j int) bool {
+				return vms[j].CreationTimestamp.Before(&vms[i].CreationTimestamp)
+			})
+		}
+		byNewest(pending)
+		byNewest(ready)
+		excess := append(append([]*vmv1.VirtualMachine{}, pending...), ready...)[:current-int(desired)]
+		for _, vm := range excess {
+			if err := r.Delete(ctx, vm); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("Failed to delete excess VirtualMachine %s: %w", vm.Name, err)
+			}
+			log.Info("Deleted excess VM from scaling group", "VirtualMachine", vm.Name)
+		}
+		// Recount, now that some were removed.
+		removed := len(excess)
+		if removed <= len(pending) {
+			pending = pending[removed:]
+		} else {
+			ready = ready[removed-len(pending):]
+			pending = nil
+		}
+	}
+
+	// Keep the replica count on every VM up-to-date, so that it's included in their billing events.
+	// Only the ready replicas are counted, because pending ones aren't serving anything yet.
+	for _, vm := range append(append([]*vmv1.VirtualMachine{}, ready...), pending...) {
+		if err := r.setReplicasAnnotation(ctx, vm, len(ready)); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, fmt.Errorf("Failed to update replicas annotation on VirtualMachine %s: %w", vm.Name, err)
+		}
+	}
+
+	group.Status.Ready = int32(len(ready))
+	if err := r.Status().Update(ctx, group); err != nil {
+		log.Error(err, "Failed to update VirtualMachineScalingGroup status")
+		return ctrl.Result{}, err
+	}
+
+	r.updateScalingGroupMetrics(group, len(pending))
+
+	return ctrl.Result{RequeueAfter: nextScalingCheck(&group.Spec, &group.Status, now)}, nil
+}
+
+// replicaUtilization returns the vCPUs in use by the replicas, as a percentage of their maximum
+// vCPUs
+func replicaUtilization(ready []*vmv1.VirtualMachine) int32 {
+	var used, max uint64
+	for _, vm := range ready {
+		if vm.Status.CPUs == nil || vm.Spec.Guest.CPUs.Max == nil {
+			continue
+		}
+		used += uint64(*vm.Status.CPUs)
+		max += uint64(*vm.Spec.Guest.CPUs.Max)
+	}
+	if max == 0 {
+		return 0
+	}
+	return int32(used * 100 / max)
+}
+
+// scaleReplicas returns the number of replicas that the group should have, updating the status to
+// match
+//
+// .status.utilizationPercent must already be set for the ready replicas. The number of replicas is
+// only changed by one at a time, and only after utilization has been past the threshold for
+// .spec.stabilizationSeconds, both continuously and since the last change. Replicas aren't added
+// while any are still pending, because they aren't counted in the utilization yet.
+func scaleReplicas(
+	spec *vmv1.VirtualMachineScalingGroupSpec,
+	status *vmv1.VirtualMachineScalingGroupStatus,
+	ready int,
+	pending int,
+	now time.Time,
+) int32 {
+	since := func(current *metav1.Time, past bool) *metav1.Time {
+		if !past || ready == 0 {
+			return nil
+		} else if current != nil {
+			return current
+		}
+		t := metav1.NewTime(now)
+		return &t
+	}
+	status.AboveThresholdSince = since(status.AboveThresholdSince, status.UtilizationPercent >= spec.ScaleUpUtilizationPercent)
+	status.BelowThresholdSince = since(status.BelowThresholdSince, status.UtilizationPercent <= spec.ScaleDownUtilizationPercent)
+
+	stabilization := time.Second * time.Duration(spec.StabilizationSeconds)
+	stable := func(t *metav1.Time) bool {
+		return t != nil && now.Sub(t.Time) >= stabilization
+	}
+
+	desired := status.Replicas
+	if desired < spec.MinReplicas {
+		desired = spec.MinReplicas
+	} else if desired > spec.MaxReplicas {
+		desired = spec.MaxReplicas
+	} else if status.LastScaleTime == nil || stable(status.LastScaleTime) {
+		if stable(status.AboveThresholdSince) && pending == 0 && desired < spec.MaxReplicas {
+			desired += 1
+		} else if stable(status.BelowThresholdSince) && desired > spec.MinReplicas {
+			desired -= 1
+		}
+	}
+
+	if desired != status.Replicas {
+		t := metav1.NewTime(now)
+		status.LastScaleTime = &t
+		// Start over, so that the new number of replicas must also be stable before changing it.
+		status.AboveThresholdSince = nil
+		status.BelowThresholdSince = nil
+		status.Replicas = desired
+	}
+	return desired
+}
+
+// nextScalingCheck returns how long until the group may need to be scaled, without any changes to
+// it or its VMs, or zero if it won't
+func nextScalingCheck(
+	spec *vmv1.VirtualMachineScalingGroupSpec,
+	status *vmv1.VirtualMachineScalingGroupStatus,
+	now time.Time,
+) time.Duration {
+	since := status.AboveThresholdSince
+	if since == nil {
+		since = status.BelowThresholdSince
+	}
+	if since == nil {
+		return 0
+	}
+
+	stabilization := time.Second * time.Duration(spec.StabilizationSeconds)
+	at := since.Add(stabilization)
+	if status.LastScaleTime != nil && status.LastScaleTime.Add(stabilization).After(at) {
+		at = status.LastScaleTime.Add(stabilization)
+	}
+	if wait := at.Sub(now); wait > time.Second {
+		return wait
+	}
+	return time.Second
+}
+
+// setReplicasAnnotation sets the VM's replicas annotation to the number of ready replicas, if it
+// isn't already
+//
+// Only the annotation is patched, so that this doesn't conflict with concurrent changes to the rest
+// of the VM (e.g. vertical scaling by the autoscaler-agent).
+func (r *VirtualMachineScalingGroupReconciler) setReplicasAnnotation(ctx context.Context, vm *vmv1.VirtualMachine, ready int) error {
+	replicas := strconv.Itoa(ready)
+	if vm.Annotations[vmv1.VirtualMachineScalingGroupReplicasAnnotation] == replicas {
+		return nil
+	}
+
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				vmv1.VirtualMachineScalingGroupReplicasAnnotation: replicas,
+			},
+		},
+	}
+	patchData, err := json.Marshal(patch)
+	if err != nil {
+		panic(fmt.Errorf("error marshalling merge patch: %w", err))
+	}
+	return r.Patch(ctx, vm, client.RawPatch(types.MergePatchType, patchData))
+}
+
+// vmForScalingGroup returns a new replica VirtualMachine from the group's template, given the
+// number of replicas that are currently ready
+func (r *VirtualMachineScalingGroupReconciler) vmForScalingGroup(group *vmv1.VirtualMachineScalingGroup, ready int) (*vmv1.VirtualMachine, error) {
+	template := group.Spec.Template.DeepCopy()
+
+	labels := template.Metadata.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[vmv1.VirtualMachineScalingGroupLabel] = group.Name
+
+	annotations := template.Metadata.Annotations
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[vmv1.VirtualMachineScalingGroupReplicasAnnotation] = strconv.Itoa(ready)
+
+	vm := &vmv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-", group.Name),
+			Namespace:    group.Namespace,
+			Labels:       labels,
+			Annotations:  annotations,
+		},
+		Spec: template.Spec,
+	}
+
+	if err := ctrl.SetControllerReference(group, vm, r.Scheme); err != nil {
+		return nil, fmt.Errorf("Failed to set owner reference on VirtualMachine for scaling group: %w", err)
+	}
+	return vm, nil
+}
+
+func (r *VirtualMachineScalingGroupReconciler) updateScalingGroupMetrics(group *vmv1.VirtualMachineScalingGroup, pending int) {
+	// metrics aren't set in tests
+	if r.Metrics.scalingGroupReplicas == nil {
+		return
+	}
+
+	r.Metrics.scalingGroupReplicas.WithLabelValues(group.Namespace, group.Name, "ready").Set(float64(group.Status.Ready))
+	r.Metrics.scalingGroupReplicas.WithLabelValues(group.Namespace, group.Name, "pending").Set(float64(pending))
+	r.Metrics.scalingGroupUtilization.WithLabelValues(group.Namespace, group.Name).Set(float64(group.Status.UtilizationPercent) / 100)
+}
+
+func (r *VirtualMachineScalingGroupReconciler) deleteScalingGroupMetrics(namespace, name string) {
+	if r.Metrics.scalingGroupReplicas == nil {
+		return
+	}
+
+	r.Metrics.scalingGroupReplicas.DeleteLabelValues(namespace, name, "ready")
+	r.Metrics.scalingGroupReplicas.DeleteLabelValues(namespace, name, "pending")
+	r.Metrics.scalingGroupUtilization.DeleteLabelValues(namespace, name)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Note that the VirtualMachines will be also watched, so that changes in utilization are handled
+// immediately
+func (r *VirtualMachineScalingGroupReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
+	cntrlName := "virtualmachinescalinggroup"
+	reconciler := WithMetrics(withCatchPanic(r), r.Metrics, cntrlName)
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&vmv1.VirtualMachineScalingGroup{}).
+		Owns(&vmv1.VirtualMachine{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
+		Named(cntrlName).
+		Complete(reconciler)
+	return reconciler, err
+}
@@ -0,0 +1,426 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// snapshotPollInterval is how often the progress of snapshots is checked, while they're running
+// or waiting for their VM to start
+const snapshotPollInterval = 2 * time.Second
+
+// snapshotFinalizer is set on VirtualMachineSnapshots so that their block jobs and the copies of
+// their disks can be removed when they're deleted
+const snapshotFinalizer = "vm.neon.tech/snapshot-finalizer"
+
+// VirtualMachineSnapshotReconciler reconciles a VirtualMachineSnapshot object
+type VirtualMachineSnapshotReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Config   *ReconcilerConfig
+
+	Metrics ReconcilerMetrics
+}
+
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile starts the snapshot once its VM is running, and then tracks it until the disks have
+// been copied. When the snapshot is deleted, its block jobs are stopped and the copies of the
+// disks are removed.
+//
+// Snapshots are never retried: once a snapshot has succeeded or failed, it's left as-is.
+func (r *VirtualMachineSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	snapshot := new(vmv1.VirtualMachineSnapshot)
+	if err := r.Get(ctx, req.NamespacedName, snapshot); err != nil {
+		// ignore error and stop reconcile loop if object not found (already deleted?)
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to fetch VirtualMachineSnapshot")
+		return ctrl.Result{}, err
+	}
+
+	if !snapshot.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(snapshot, snapshotFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		done, err := r.cleanupSnapshot(ctx, snapshot)
+		if err != nil {
+			log.Error(err, "Failed to clean up VirtualMachineSnapshot")
+			return ctrl.Result{}, err
+		} else if !done {
+			return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+		}
+		controllerutil.RemoveFinalizer(snapshot, snapshotFinalizer)
+		if err := r.Update(ctx, snapshot); err != nil {
+			log.Error(err, "Failed to remove finalizer from VirtualMachineSnapshot")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(snapshot, snapshotFinalizer) {
+		controllerutil.AddFinalizer(snapshot, snapshotFinalizer)
+		if err := r.Update(ctx, snapshot); err != nil {
+			log.Error(err, "Failed to add finalizer to VirtualMachineSnapshot")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	switch snapshot.Status.Phase {
+	case vmv1.SnapshotSucceeded, vmv1.SnapshotFailed:
+		return ctrl.Result{}, nil
+	case "":
+		snapshot.Status.Phase = vmv1.SnapshotPending
+		if err := r.Status().Update(ctx, snapshot); err != nil {
+			log.Error(err, "Failed to update VirtualMachineSnapshot status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	vm := new(vmv1.VirtualMachine)
+	err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.VmName, Namespace: snapshot.Namespace}, vm)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("VirtualMachine %s not found", snapshot.Spec.VmName))
+		}
+		log.Error(err, "Failed to get VirtualMachine", "VmName", snapshot.Spec.VmName)
+		return ctrl.Result{}, err
+	}
+
+	if snapshot.Status.Phase == vmv1.SnapshotPending {
+		if vm.Spec.SnapshotStorage == nil {
+			return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("VirtualMachine %s does not have .spec.snapshotStorage", vm.Name))
+		}
+		disks, err := snapshotDisks(snapshot, vm)
+		if err != nil {
+			return ctrl.Result{}, r.fail(ctx, snapshot, err.Error())
+		}
+
+		// The disks can only be copied while QEMU is running, and not during a migration.
+		if vm.Status.Phase != vmv1.VmRunning && vm.Status.Phase != vmv1.VmScaling {
+			log.Info("Waiting for VirtualMachine to be running before taking snapshot", "VmName", vm.Name, "phase", vm.Status.Phase)
+			return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+		}
+
+		// Record which runner pod the copies are made in before starting them, so that they're
+		// never started twice if updating the status fails. They're started on the next reconcile.
+		snapshot.Status.Phase = vmv1.SnapshotRunning
+		snapshot.Status.Disks = disks
+		snapshot.Status.PodName = vm.Status.PodName
+		if err := r.Status().Update(ctx, snapshot); err != nil {
+			log.Error(err, "Failed to update VirtualMachineSnapshot status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	// The snapshot is running.
+	if vm.Status.PodName != snapshot.Status.PodName || !vm.Status.Phase.IsAlive() {
+		return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("VirtualMachine %s stopped while taking snapshot", vm.Name))
+	}
+
+	mon, err := QmpConnect(QmpAddr(vm))
+	if err != nil {
+		log.Error(err, "Failed to connect to QMP of VirtualMachine", "VmName", vm.Name)
+		return ctrl.Result{}, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	return r.reconcileRunning(ctx, snapshot, vm, mon)
+}
+
+// reconcileRunning starts copying the disks of a running snapshot if that hasn't happened yet,
+// and otherwise checks whether the copies are finished
+func (r *VirtualMachineSnapshotReconciler) reconcileRunning(
+	ctx context.Context,
+	snapshot *vmv1.VirtualMachineSnapshot,
+	vm *vmv1.VirtualMachine,
+	mon QMPRunner,
+) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	jobs, err := QmpQueryJobs(mon)
+	if err != nil {
+		log.Error(err, "Failed to get block jobs from VirtualMachine", "VmName", vm.Name)
+		return ctrl.Result{}, err
+	}
+
+	var finished []string
+	var failures []string
+	var missing []string
+	for _, disk := range snapshot.Status.Disks {
+		id := snapshotJobId(snapshot.Name, disk)
+		idx := slices.IndexFunc(jobs, func(j QmpJob) bool { return j.Id == id })
+		if idx == -1 {
+			missing = append(missing, disk)
+			continue
+		}
+
+		job := jobs[idx]
+		if job.Status != "concluded" {
+			continue
+		}
+		finished = append(finished, id)
+		if job.Error != nil {
+			failures = append(failures, fmt.Sprintf("disk %s: %s", disk, *job.Error))
+		}
+	}
+
+	// Jobs are only dismissed after the outcome is recorded, and the runner pod is the one the
+	// snapshot was started in. So if none of the jobs exist, they haven't been started yet.
+	if len(missing) == len(snapshot.Status.Disks) {
+		log.Info("Starting snapshot", "VmName", vm.Name, "disks", snapshot.Status.Disks)
+		if err := QmpStartSnapshot(mon, snapshot.Name, snapshot.Status.Disks); err != nil {
+			return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("Failed to start copying disks: %s", err))
+		}
+		r.Recorder.Event(snapshot, corev1.EventTypeNormal, "Started",
+			fmt.Sprintf("Started copying disks of VirtualMachine %s", vm.Name))
+		return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+	}
+	for _, disk := range missing {
+		failures = append(failures, fmt.Sprintf("disk %s: copy not found", disk))
+	}
+
+	switch {
+	case len(failures) != 0:
+		err = r.fail(ctx, snapshot, fmt.Sprintf("Failed to copy disks: %v", failures))
+	case len(finished) == len(snapshot.Status.Disks):
+		log.Info("Snapshot succeeded", "VmName", vm.Name)
+		r.Recorder.Event(snapshot, corev1.EventTypeNormal, "Succeeded",
+			fmt.Sprintf("Copied disks of VirtualMachine %s", vm.Name))
+		now := metav1.Now()
+		snapshot.Status.Phase = vmv1.SnapshotSucceeded
+		snapshot.Status.CompletionTime = &now
+		err = r.Status().Update(ctx, snapshot)
+	default:
+		return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Now that the outcome is recorded, we don't need the finished jobs anymore. Any that are
+	// still running after a failure are stopped when the snapshot is deleted.
+	for _, id := range finished {
+		if err := QmpDismissJob(mon, id); err != nil {
+			log.Error(err, "Failed to dismiss finished block job", "VmName", vm.Name, "job", id)
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// cleanupSnapshot stops the snapshot's block jobs and removes the copies of its disks, before the
+// snapshot is deleted. It returns false if it needs to be called again, once the block jobs have
+// stopped.
+//
+// The copies can only be removed through the VM's runner pod, so they're left behind if the VM
+// isn't running.
+func (r *VirtualMachineSnapshotReconciler) cleanupSnapshot(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot) (bool, error) {
+	log := log.FromContext(ctx)
+
+	// Nothing is copied until the snapshot is running.
+	if len(snapshot.Status.Disks) == 0 {
+		return true, nil
+	}
+
+	vm := new(vmv1.VirtualMachine)
+	err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.VmName, Namespace: snapshot.Namespace}, vm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get VirtualMachine %s: %w", snapshot.Spec.VmName, err)
+	}
+	if err != nil || !vm.Status.Phase.IsAlive() || vm.Spec.SnapshotStorage == nil {
+		r.Recorder.Event(snapshot, corev1.EventTypeWarning, "CleanupSkipped",
+			fmt.Sprintf("VirtualMachine %s is not running, so the copies of its disks were not removed", snapshot.Spec.VmName))
+		return true, nil
+	}
+
+	// The block jobs only exist in the runner pod the snapshot was started in, and the ones for
+	// successful snapshots have all been dismissed already.
+	if snapshot.Status.Phase != vmv1.SnapshotSucceeded && vm.Status.PodName == snapshot.Status.PodName {
+		mon, err := QmpConnect(QmpAddr(vm))
+		if err != nil {
+			return false, fmt.Errorf("failed to connect to QMP: %w", err)
+		}
+		defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+		remaining, err := stopSnapshotJobs(snapshot, mon)
+		if err != nil {
+			return false, err
+		} else if remaining {
+			log.Info("Waiting for block jobs of deleted snapshot to stop", "VmName", vm.Name)
+			return false, nil
+		}
+	}
+
+	if err := deleteRunnerSnapshot(ctx, vm, snapshot); err != nil {
+		log.Error(err, "Failed to remove copies of disks for deleted snapshot", "VmName", vm.Name)
+		r.Recorder.Event(snapshot, corev1.EventTypeWarning, "CleanupFailed",
+			fmt.Sprintf("Failed to remove the copies of the disks of VirtualMachine %s: %s", vm.Name, err))
+	}
+	return true, nil
+}
+
+// stopSnapshotJobs cancels the snapshot's block jobs that are still running, and dismisses the
+// ones that have concluded. It returns whether any of the jobs still exist afterwards.
+func stopSnapshotJobs(snapshot *vmv1.VirtualMachineSnapshot, mon QMPRunner) (bool, error) {
+	jobs, err := QmpQueryJobs(mon)
+	if err != nil {
+		return false, fmt.Errorf("failed to get block jobs: %w", err)
+	}
+
+	remaining := false
+	for _, disk := range snapshot.Status.Disks {
+		id := snapshotJobId(snapshot.Name, disk)
+		idx := slices.IndexFunc(jobs, func(j QmpJob) bool { return j.Id == id })
+		if idx == -1 {
+			continue
+		}
+
+		switch jobs[idx].Status {
+		case "concluded":
+			if err := QmpDismissJob(mon, id); err != nil {
+				return false, fmt.Errorf("failed to dismiss block job %s: %w", id, err)
+			}
+		case "aborting":
+			remaining = true
+		default:
+			if err := QmpCancelJob(mon, id); err != nil {
+				return false, fmt.Errorf("failed to cancel block job %s: %w", id, err)
+			}
+			remaining = true
+		}
+	}
+	return remaining, nil
+}
+
+// fail marks the snapshot as failed, with the reason
+func (r *VirtualMachineSnapshotReconciler) fail(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot, message string) error {
+	log.FromContext(ctx).Info("Snapshot failed", "reason", message)
+	r.Recorder.Event(snapshot, corev1.EventTypeWarning, "Failed", message)
+
+	snapshot.Status.Phase = vmv1.SnapshotFailed
+	snapshot.Status.Message = message
+	return r.Status().Update(ctx, snapshot)
+}
+
+// deleteRunnerSnapshot asks the VM's runner pod to remove the copies of the disks taken by the
+// snapshot
+func deleteRunnerSnapshot(ctx context.Context, vm *vmv1.VirtualMachine, snapshot *vmv1.VirtualMachineSnapshot) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d/snapshot_delete", vm.Status.PodIP, vm.Spec.RunnerPort)
+
+	data, err := json.Marshal(api.SnapshotDelete{Name: snapshot.Name, Disks: snapshot.Status.Disks})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// snapshotDisks returns the names of the VM's disks to include in the snapshot
+func snapshotDisks(snapshot *vmv1.VirtualMachineSnapshot, vm *vmv1.VirtualMachine) ([]string, error) {
+	var emptyDisks []string
+	for _, disk := range vm.Spec.Disks {
+		if disk.EmptyDisk != nil {
+			emptyDisks = append(emptyDisks, disk.Name)
+		}
+	}
+
+	if len(snapshot.Spec.Disks) == 0 {
+		if len(emptyDisks) == 0 {
+			return nil, fmt.Errorf("VirtualMachine %s has no emptyDisk disks", vm.Name)
+		}
+		return emptyDisks, nil
+	}
+
+	for _, name := range snapshot.Spec.Disks {
+		if !slices.Contains(emptyDisks, name) {
+			return nil, fmt.Errorf("VirtualMachine %s has no emptyDisk disk named %q", vm.Name, name)
+		}
+	}
+	return snapshot.Spec.Disks, nil
+}
+
+// checkSnapshotsForVirtualMachine returns an error if any of the snapshots that the VM's disks are
+// restored from can't be used yet
+func checkSnapshotsForVirtualMachine(ctx context.Context, c client.Client, vm *vmv1.VirtualMachine) error {
+	for _, disk := range vm.Spec.Disks {
+		if disk.EmptyDisk == nil || disk.EmptyDisk.FromSnapshot == "" {
+			continue
+		}
+
+		snapshot := new(vmv1.VirtualMachineSnapshot)
+		err := c.Get(ctx, types.NamespacedName{Name: disk.EmptyDisk.FromSnapshot, Namespace: vm.Namespace}, snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot %s for disk %s: %w", disk.EmptyDisk.FromSnapshot, disk.Name, err)
+		}
+		if snapshot.Status.Phase != vmv1.SnapshotSucceeded {
+			return fmt.Errorf("snapshot %s for disk %s has phase %q", snapshot.Name, disk.Name, snapshot.Status.Phase)
+		}
+		if !slices.Contains(snapshot.Status.Disks, disk.Name) {
+			return fmt.Errorf("snapshot %s does not include disk %s", snapshot.Name, disk.Name)
+		}
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *VirtualMachineSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
+	cntrlName := "virtualmachinesnapshot"
+	reconciler := WithMetrics(withCatchPanic(r), r.Metrics, cntrlName)
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&vmv1.VirtualMachineSnapshot{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
+		Named(cntrlName).
+		Complete(reconciler)
+	return reconciler, err
+}
@@ -1,10 +1,22 @@
-package controllers_test
+package controllers
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 
-	"github.com/neondatabase/autoscaling/neonvm/controllers"
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 )
 
 type qmpEvent struct {
@@ -50,8 +62,245 @@ var _ = Describe("VM QMP interaction", func() {
 				 "arguments": {"id": "memslot1",
 						"size": 100,
 						"qom-type": "memory-backend-ram"}}`, `{}`)
-			err := controllers.QmpAddMemoryBackend(qmp, 1, 100)
+			err := QmpAddMemoryBackend(qmp, 1, 100)
+			Expect(err).To(Not(HaveOccurred()))
+		})
+	})
+
+	Context("Pausing", func() {
+		ctx := context.Background()
+
+		var recorder *record.FakeRecorder
+		var reconciler *VirtualMachineReconciler
+
+		BeforeEach(func() {
+			recorder = record.NewFakeRecorder(10)
+			reconciler = &VirtualMachineReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+				Config:   nil,
+			}
+		})
+
+		newVM := func(paused bool) *vmv1.VirtualMachine {
+			vm := &vmv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: "default"},
+			}
+			vm.Spec.Paused = paused
+			return vm
+		}
+
+		It("should get the run state", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+
+			qmp.expect(`{"execute": "query-status"}`, `{"return": {"running": false, "status": "paused"}}`)
+			paused, err := QmpIsPaused(qmp)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(paused).To(BeTrue())
+
+			qmp.expect(`{"execute": "query-status"}`, `{"return": {"running": true, "status": "running"}}`)
+			paused, err = QmpIsPaused(qmp)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(paused).To(BeFalse())
+		})
+
+		It("should pause a running VM", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := newVM(true)
+
+			qmp.expect(`{"execute": "query-status"}`, `{"return": {"running": true, "status": "running"}}`)
+			qmp.expect(`{"execute": "stop"}`, `{"return": {}}`)
+			Expect(reconciler.reconcilePaused(ctx, vm, qmp)).To(Succeed())
+
+			cond := meta.FindStatusCondition(vm.Status.Conditions, vmv1.VirtualMachineConditionPaused)
+			Expect(cond).To(Not(BeNil()))
+			Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Paused")))
+		})
+
+		It("should resume a paused VM", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := newVM(false)
+
+			qmp.expect(`{"execute": "query-status"}`, `{"return": {"running": false, "status": "paused"}}`)
+			qmp.expect(`{"execute": "cont"}`, `{"return": {}}`)
+			Expect(reconciler.reconcilePaused(ctx, vm, qmp)).To(Succeed())
+
+			cond := meta.FindStatusCondition(vm.Status.Conditions, vmv1.VirtualMachineConditionPaused)
+			Expect(cond).To(Not(BeNil()))
+			Expect(cond.Status).To(Equal(metav1.ConditionFalse))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Resumed")))
+		})
+
+		It("should only update the condition when the run state already matches", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := newVM(true)
+
+			qmp.expect(`{"execute": "query-status"}`, `{"return": {"running": false, "status": "paused"}}`)
+			Expect(reconciler.reconcilePaused(ctx, vm, qmp)).To(Succeed())
+
+			cond := meta.FindStatusCondition(vm.Status.Conditions, vmv1.VirtualMachineConditionPaused)
+			Expect(cond).To(Not(BeNil()))
+			Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+			Expect(recorder.Events).To(BeEmpty())
+		})
+	})
+
+	Context("Resizing virtio-mem", func() {
+		ctx := context.Background()
+		const gib = int64(1) << 30
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		var namespace string
+		var recorder *record.FakeRecorder
+		var reconciler *VirtualMachineReconciler
+
+		BeforeEach(func() {
+			By("Creating the Namespace to perform the tests")
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "virtio-mem-test-"}}
+			Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+			namespace = ns.Name
+
+			recorder = record.NewFakeRecorder(10)
+			reconciler = &VirtualMachineReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+				Config:   &ReconcilerConfig{VirtioMemResizeTimeout: 5 * time.Minute}, //nolint:exhaustruct // only the timeout is used
+			}
+		})
+
+		AfterEach(func() {
+			By("Deleting the Namespace to perform the tests")
+			_ = k8sClient.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+		})
+
+		// createVM creates a VM with 1GiB memory slots, with one of them not from the virtio-mem
+		// device
+		createVM := func(use int32) *vmv1.VirtualMachine {
+			vm := &vmv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm", Namespace: namespace},
+				Spec:       vmv1.VirtualMachineSpec{RestartPolicy: "Never"},
+			}
+			vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+			vm.Spec.Guest.MemorySlots.Min = &[]int32{1}[0]
+			vm.Spec.Guest.MemorySlots.Max = &[]int32{8}[0]
+			vm.Spec.Guest.MemorySlots.Use = &use
+			Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+			return vm
+		}
+
+		queryDevices := `{"execute": "query-memory-devices"}`
+		devices := func(size, requestedSize int64) string {
+			return fmt.Sprintf(
+				`{"return": [{"type": "virtio-mem", "data": {"id": "vm0", "memdev": "/objects/vmem0", "size": %d, "requested-size": %d}}]}`,
+				size, requestedSize,
+			)
+		}
+		setRequestedSize := func(size int64) string {
+			return fmt.Sprintf(
+				`{"execute": "qom-set", "arguments": {"path": "/machine/peripheral/vm0", "property": "requested-size", "value": %d}}`,
+				size,
+			)
+		}
+
+		It("should finish once the guest has resized the device", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := createVM(4)
+
+			qmp.expect(queryDevices, devices(3*gib, 3*gib))
+			done, err := reconciler.resizeVirtioMem(ctx, vm, qmp, start)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeTrue())
+			Expect(meta.FindStatusCondition(vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)).To(BeNil())
+		})
+
+		It("should settle for the memory the guest plugged, if it takes too long", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := createVM(4)
+
+			By("Requesting the new size")
+			qmp.expect(queryDevices, devices(gib, gib))
+			qmp.expect(setRequestedSize(3*gib), `{"return": {}}`)
+			done, err := reconciler.resizeVirtioMem(ctx, vm, qmp, start)
 			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeFalse())
+			cond := meta.FindStatusCondition(vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+			Expect(cond).To(Not(BeNil()))
+			Expect(cond.LastTransitionTime.Time).To(Equal(start))
+
+			By("Waiting while the guest is still within the timeout")
+			qmp.expect(queryDevices, devices(gib+gib/2, 3*gib))
+			done, err = reconciler.resizeVirtioMem(ctx, vm, qmp, start.Add(4*time.Minute))
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeFalse())
+			Expect(recorder.Events).To(BeEmpty())
+
+			By("Settling for the whole slots that were plugged, after the timeout")
+			qmp.expect(queryDevices, devices(2*gib+gib/2, 3*gib))
+			done, err = reconciler.resizeVirtioMem(ctx, vm, qmp, start.Add(5*time.Minute))
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeFalse())
+			Expect(recorder.Events).To(Receive(ContainSubstring("VirtioMemResizeTimeout")))
+			Expect(meta.FindStatusCondition(vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)).To(BeNil())
+
+			var updated vmv1.VirtualMachine
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(vm), &updated)).To(Succeed())
+			Expect(*updated.Spec.Guest.MemorySlots.Use).To(Equal(int32(3)))
+		})
+
+		It("should keep a partially unplugged slot when scaling down", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := createVM(2)
+			meta.SetStatusCondition(&vm.Status.Conditions, metav1.Condition{
+				Type:               typeVirtioMemResizingVirtualMachine,
+				Status:             metav1.ConditionTrue,
+				Reason:             "Resizing",
+				Message:            fmt.Sprintf("Resizing virtio-mem device to %d bytes", gib),
+				LastTransitionTime: metav1.NewTime(start),
+			})
+
+			qmp.expect(queryDevices, devices(2*gib+gib/2, gib))
+			done, err := reconciler.resizeVirtioMem(ctx, vm, qmp, start.Add(10*time.Minute))
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeFalse())
+
+			var updated vmv1.VirtualMachine
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(vm), &updated)).To(Succeed())
+			Expect(*updated.Spec.Guest.MemorySlots.Use).To(Equal(int32(4)))
+		})
+
+		It("should restart the timeout when the target changes", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			vm := createVM(4)
+			meta.SetStatusCondition(&vm.Status.Conditions, metav1.Condition{
+				Type:               typeVirtioMemResizingVirtualMachine,
+				Status:             metav1.ConditionTrue,
+				Reason:             "Resizing",
+				Message:            fmt.Sprintf("Resizing virtio-mem device to %d bytes", 2*gib),
+				LastTransitionTime: metav1.NewTime(start),
+			})
+
+			now := start.Add(10 * time.Minute)
+			qmp.expect(queryDevices, devices(gib, 2*gib))
+			qmp.expect(setRequestedSize(3*gib), `{"return": {}}`)
+			done, err := reconciler.resizeVirtioMem(ctx, vm, qmp, now)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(done).To(BeFalse())
+			Expect(recorder.Events).To(BeEmpty())
+
+			cond := meta.FindStatusCondition(vm.Status.Conditions, typeVirtioMemResizingVirtualMachine)
+			Expect(cond).To(Not(BeNil()))
+			Expect(cond.LastTransitionTime.Time).To(Equal(now))
 		})
 	})
 })
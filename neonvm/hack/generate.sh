@@ -16,3 +16,11 @@ controller-gen rbac:roleName=manager-role crd webhook paths="./neonvm/..." \
 	output:crd:artifacts:config=neonvm/config/crd/bases \
 	output:rbac:artifacts:config=neonvm/config/rbac \
 	output:webhook:artifacts:config=neonvm/config/webhook
+
+protoc --go_out=. --go_opt=paths=source_relative \
+	--go-grpc_out=. --go-grpc_opt=paths=source_relative \
+	pkg/api/plugin.proto
+
+protoc --go_out=. --go_opt=paths=source_relative \
+	pkg/billing/billingpb/billing.proto \
+	pkg/agent/billing/remotewritepb/remote.proto
@@ -30,10 +30,12 @@ import (
 	"github.com/tychoish/fun/srv"
 	"go.uber.org/zap/zapcore"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -95,7 +97,14 @@ func main() {
 	var probeAddr string
 	var concurrencyLimit int
 	var enableContainerMgr bool
+	var enforceRunnerMemoryLimit bool
 	var qemuDiskCacheSettings string
+	var latestGuestKernelVersion string
+	var latestVmBuilderVersion string
+	var computeUnitCPU string
+	var computeUnitMemory string
+	var virtioMemResizeTimeout time.Duration
+	var consoleTokenFile string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -103,7 +112,14 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&concurrencyLimit, "concurrency-limit", 1, "Maximum number of concurrent reconcile operations")
 	flag.BoolVar(&enableContainerMgr, "enable-container-mgr", false, "Enable crictl-based container-mgr alongside each VM")
+	flag.BoolVar(&enforceRunnerMemoryLimit, "enforce-runner-memory-limit", false, "Limit the memory of neonvm-runner's QEMU cgroup (cgroup v1 or v2) to slightly above the VM's maximum memory")
 	flag.StringVar(&qemuDiskCacheSettings, "qemu-disk-cache-settings", "cache=none", "Set neonvm-runner's QEMU disk cache settings")
+	flag.StringVar(&latestGuestKernelVersion, "latest-guest-kernel-version", "", "If set, VMs running any other guest kernel version are reported as outdated")
+	flag.StringVar(&latestVmBuilderVersion, "latest-vm-builder-version", "", "If set, VMs with root disk images built by any other vm-builder version are reported as outdated")
+	flag.StringVar(&computeUnitCPU, "compute-unit-cpu", "1", "The CPU of a compute unit, used to report the per-node density of VMs")
+	flag.StringVar(&computeUnitMemory, "compute-unit-memory", "4Gi", "The memory of a compute unit, used to report the per-node density of VMs")
+	flag.DurationVar(&virtioMemResizeTimeout, "virtio-mem-resize-timeout", 5*time.Minute, "How long the guest has to resize a VM's virtio-mem device, before the controller settles for the memory it has plugged. Zero disables the timeout")
+	flag.StringVar(&consoleTokenFile, "console-token-file", "", "If set, VMs' serial consoles are served on the debug server, to requests with the bearer token stored in this file")
 	opts := zap.Options{ //nolint:exhaustruct // typical options struct; not all fields needed.
 		Development:     true,
 		StacktraceLevel: zapcore.Level(zapcore.PanicLevel),
@@ -152,13 +168,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	cuCPU, err := resource.ParseQuantity(computeUnitCPU)
+	if err != nil || cuCPU.IsZero() {
+		setupLog.Error(err, "invalid compute unit CPU", "value", computeUnitCPU)
+		os.Exit(1)
+	}
+	cuMemory, err := resource.ParseQuantity(computeUnitMemory)
+	if err != nil || cuMemory.IsZero() {
+		setupLog.Error(err, "invalid compute unit memory", "value", computeUnitMemory)
+		os.Exit(1)
+	}
+
 	reconcilerMetrics := controllers.MakeReconcilerMetrics()
 
 	rc := &controllers.ReconcilerConfig{
-		IsK3s:                   isK3s,
-		UseContainerMgr:         enableContainerMgr,
-		MaxConcurrentReconciles: concurrencyLimit,
-		QEMUDiskCacheSettings:   qemuDiskCacheSettings,
+		IsK3s:                    isK3s,
+		UseContainerMgr:          enableContainerMgr,
+		EnforceRunnerMemoryLimit: enforceRunnerMemoryLimit,
+		MaxConcurrentReconciles:  concurrencyLimit,
+		QEMUDiskCacheSettings:    qemuDiskCacheSettings,
+		LatestGuestKernelVersion: latestGuestKernelVersion,
+		LatestVmBuilderVersion:   latestVmBuilderVersion,
+		ComputeUnitCPU:           vmv1.MilliCPUFromResourceQuantity(cuCPU),
+		ComputeUnitMemory:        cuMemory,
+		VirtioMemResizeTimeout:   virtioMemResizeTimeout,
 	}
 
 	vmReconciler := &controllers.VirtualMachineReconciler{
@@ -194,6 +227,45 @@ func main() {
 		setupLog.Error(err, "unable to create webhook", "webhook", "VirtualMachineMigration")
 		os.Exit(1)
 	}
+
+	poolReconciler := &controllers.VirtualMachinePoolReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("virtualmachinepool-controller"),
+		Config:   rc,
+		Metrics:  reconcilerMetrics,
+	}
+	poolReconcilerMetrics, err := poolReconciler.SetupWithManager(mgr)
+	if err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachinePool")
+		os.Exit(1)
+	}
+
+	scalingGroupReconciler := &controllers.VirtualMachineScalingGroupReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("virtualmachinescalinggroup-controller"),
+		Config:   rc,
+		Metrics:  reconcilerMetrics,
+	}
+	scalingGroupReconcilerMetrics, err := scalingGroupReconciler.SetupWithManager(mgr)
+	if err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachineScalingGroup")
+		os.Exit(1)
+	}
+
+	snapshotReconciler := &controllers.VirtualMachineSnapshotReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("virtualmachinesnapshot-controller"),
+		Config:   rc,
+		Metrics:  reconcilerMetrics,
+	}
+	snapshotReconcilerMetrics, err := snapshotReconciler.SetupWithManager(mgr)
+	if err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachineSnapshot")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -205,7 +277,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	dbgSrv := debugServerFunc(vmReconcilerMetrics, migrationReconcilerMetrics)
+	dbgSrv := debugServerFunc(mgr.GetClient(), consoleTokenFile, reconcilerMetrics, vmReconcilerMetrics, migrationReconcilerMetrics, poolReconcilerMetrics, scalingGroupReconcilerMetrics, snapshotReconcilerMetrics)
 	if err := mgr.Add(dbgSrv); err != nil {
 		setupLog.Error(err, "unable to set up debug server")
 		os.Exit(1)
@@ -239,9 +311,31 @@ func checkIfRunningInK3sCluster(cfg *rest.Config) (bool, error) {
 	return false, nil
 }
 
-func debugServerFunc(reconcilers ...controllers.ReconcilerWithMetrics) manager.RunnableFunc {
+func debugServerFunc(c client.Client, consoleTokenFile string, metrics controllers.ReconcilerMetrics, reconcilers ...controllers.ReconcilerWithMetrics) manager.RunnableFunc {
 	return manager.RunnableFunc(func(ctx context.Context) error {
 		mux := http.NewServeMux()
+		if consoleTokenFile != "" {
+			mux.HandleFunc("/console/", controllers.ConsoleHandler(c, consoleTokenFile))
+		}
+		mux.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				_, _ = w.Write([]byte(fmt.Sprintf("request method must be %s", http.MethodGet)))
+				return
+			}
+
+			responseBody, err := json.Marshal(metrics.NodeDensity())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(fmt.Sprintf("failed to marshal JSON response: %s", err)))
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(responseBody)
+		})
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			defer r.Body.Close()
 
@@ -0,0 +1,213 @@
+// Package cgroup manages memory limits for cgroups, on both cgroup v1 and cgroup v2 ("unified")
+// hierarchies.
+//
+// CPU limits are handled by the runner with containerd's cgroups library. Memory limits are
+// implemented here directly on the cgroup filesystem instead, so that they can be tested against
+// a fake hierarchy in a temporary directory.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the cgroup hierarchy mounted at some mount point
+type Version int
+
+const (
+	V1 Version = iota + 1
+	V2
+)
+
+func (v Version) String() string {
+	switch v {
+	case V1:
+		return "v1"
+	case V2:
+		return "v2"
+	default:
+		return fmt.Sprintf("<unknown cgroup version %d>", int(v))
+	}
+}
+
+// v1Unlimited is the value of cgroup v1 memory limits when there's no limit: the largest int64,
+// rounded down to the page size. Any value this large or larger is treated as unlimited.
+const v1Unlimited uint64 = 9223372036854771712
+
+// DetectVersion returns the version of the cgroup hierarchy mounted at mountPoint, typically
+// "/sys/fs/cgroup"
+//
+// A unified hierarchy has a 'cgroup.controllers' file at its root. For cgroup v1, each controller
+// is mounted separately, so we instead look for the memory controller's directory.
+func DetectVersion(mountPoint string) (Version, error) {
+	if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); err == nil {
+		return V2, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("Error checking for cgroup v2: %w", err)
+	}
+
+	if info, err := os.Stat(filepath.Join(mountPoint, "memory")); err == nil && info.IsDir() {
+		return V1, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("Error checking for cgroup v1: %w", err)
+	}
+
+	return 0, fmt.Errorf("No cgroup hierarchy with the memory controller found at %s", mountPoint)
+}
+
+// MemoryLimits are the memory limits of a cgroup, in bytes. A value of zero means there's no
+// limit.
+type MemoryLimits struct {
+	// High is the soft limit. Above it, the cgroup's processes are throttled and put under heavy
+	// reclaim pressure, but not OOM-killed.
+	//
+	// For cgroup v2, this is 'memory.high'. For cgroup v1, which has no direct equivalent, we use
+	// 'memory.soft_limit_in_bytes', which only applies reclaim pressure when the host is itself
+	// low on memory.
+	High uint64
+	// Max is the hard limit. If the cgroup's usage can't be reclaimed to below it, the OOM killer
+	// is invoked.
+	//
+	// For cgroup v2, this is 'memory.max'. For cgroup v1, it's 'memory.limit_in_bytes'.
+	Max uint64
+}
+
+// Manager sets the memory limits for a single cgroup
+type Manager struct {
+	version Version
+	// dir is the cgroup's directory, including the mount point and (for v1) the controller
+	dir string
+}
+
+// NewManager returns a Manager for the cgroup at path within the hierarchy at mountPoint, creating
+// the cgroup if it doesn't already exist.
+func NewManager(mountPoint string, version Version, path string) (*Manager, error) {
+	var dir string
+	switch version {
+	case V1:
+		dir = filepath.Join(mountPoint, "memory", path)
+	case V2:
+		dir = filepath.Join(mountPoint, path)
+	default:
+		return nil, fmt.Errorf("Unknown cgroup version %v", version)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating cgroup %s: %w", path, err)
+	}
+
+	return &Manager{version: version, dir: dir}, nil
+}
+
+// Version returns the version of the hierarchy that the cgroup is in
+func (m *Manager) Version() Version {
+	return m.version
+}
+
+func (m *Manager) highFile() string {
+	if m.version == V1 {
+		return "memory.soft_limit_in_bytes"
+	}
+	return "memory.high"
+}
+
+func (m *Manager) maxFile() string {
+	if m.version == V1 {
+		return "memory.limit_in_bytes"
+	}
+	return "memory.max"
+}
+
+// SetMemoryLimits sets the cgroup's memory limits
+//
+// If High is greater than Max, it has no effect, so we return an error instead of setting it.
+func (m *Manager) SetMemoryLimits(limits MemoryLimits) error {
+	if limits.High != 0 && limits.Max != 0 && limits.High > limits.Max {
+		return fmt.Errorf("memory high limit %d is greater than max limit %d", limits.High, limits.Max)
+	}
+
+	// To avoid ever having the hard limit temporarily below the soft limit, the order we write
+	// the files in depends on whether the limits are increasing or decreasing.
+	current, err := m.GetMemoryLimits()
+	if err != nil {
+		return err
+	}
+	increasing := limits.Max == 0 || (current.Max != 0 && limits.Max > current.Max)
+
+	writes := []struct {
+		file  string
+		value uint64
+	}{
+		{file: m.highFile(), value: limits.High},
+		{file: m.maxFile(), value: limits.Max},
+	}
+	if increasing {
+		writes[0], writes[1] = writes[1], writes[0]
+	}
+
+	for _, w := range writes {
+		if err := m.write(w.file, w.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMemoryLimits returns the cgroup's current memory limits
+//
+// Limits that haven't been set yet are returned as zero (i.e. unlimited).
+func (m *Manager) GetMemoryLimits() (MemoryLimits, error) {
+	high, err := m.read(m.highFile())
+	if err != nil {
+		return MemoryLimits{}, err
+	}
+	hard, err := m.read(m.maxFile())
+	if err != nil {
+		return MemoryLimits{}, err
+	}
+	return MemoryLimits{High: high, Max: hard}, nil
+}
+
+func (m *Manager) write(file string, value uint64) error {
+	var content string
+	switch {
+	case value != 0:
+		content = strconv.FormatUint(value, 10)
+	case m.version == V1:
+		content = "-1"
+	default:
+		content = "max"
+	}
+
+	if err := os.WriteFile(filepath.Join(m.dir, file), []byte(content), 0o644); err != nil {
+		return fmt.Errorf("Error writing %s: %w", file, err)
+	}
+	return nil
+}
+
+func (m *Manager) read(file string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(m.dir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error reading %s: %w", file, err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if content == "max" || content == "-1" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseUint(content, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing %s: %w", file, err)
+	}
+	if value >= v1Unlimited {
+		return 0, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,122 @@
+package cgroup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/neonvm/pkg/cgroup"
+)
+
+// fakeHierarchy creates a directory that looks like a cgroup mount point of the given version
+func fakeHierarchy(t *testing.T, version cgroup.Version) string {
+	root := t.TempDir()
+	switch version {
+	case cgroup.V1:
+		require.NoError(t, os.Mkdir(filepath.Join(root, "memory"), 0o755))
+		require.NoError(t, os.Mkdir(filepath.Join(root, "cpu"), 0o755))
+	case cgroup.V2:
+		require.NoError(t, os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0o644))
+	}
+	return root
+}
+
+func readFile(t *testing.T, path ...string) string {
+	data, err := os.ReadFile(filepath.Join(path...))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestDetectVersion(t *testing.T) {
+	for _, version := range []cgroup.Version{cgroup.V1, cgroup.V2} {
+		detected, err := cgroup.DetectVersion(fakeHierarchy(t, version))
+		require.NoError(t, err)
+		require.Equal(t, version, detected)
+	}
+
+	_, err := cgroup.DetectVersion(t.TempDir())
+	require.Error(t, err)
+}
+
+func TestMemoryLimits(t *testing.T) {
+	cases := []struct {
+		version  cgroup.Version
+		dir      []string
+		highFile string
+		maxFile  string
+	}{
+		{
+			version:  cgroup.V1,
+			dir:      []string{"memory", "vm"},
+			highFile: "memory.soft_limit_in_bytes",
+			maxFile:  "memory.limit_in_bytes",
+		},
+		{
+			version:  cgroup.V2,
+			dir:      []string{"vm"},
+			highFile: "memory.high",
+			maxFile:  "memory.max",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.version.String(), func(t *testing.T) {
+			root := fakeHierarchy(t, c.version)
+			dir := filepath.Join(append([]string{root}, c.dir...)...)
+
+			manager, err := cgroup.NewManager(root, c.version, "/vm")
+			require.NoError(t, err)
+			require.DirExists(t, dir)
+
+			// Nothing set yet: unlimited
+			limits, err := manager.GetMemoryLimits()
+			require.NoError(t, err)
+			require.Equal(t, cgroup.MemoryLimits{High: 0, Max: 0}, limits)
+
+			set := cgroup.MemoryLimits{High: 3 << 30, Max: 4 << 30}
+			require.NoError(t, manager.SetMemoryLimits(set))
+			require.Equal(t, "3221225472", readFile(t, dir, c.highFile))
+			require.Equal(t, "4294967296", readFile(t, dir, c.maxFile))
+
+			limits, err = manager.GetMemoryLimits()
+			require.NoError(t, err)
+			require.Equal(t, set, limits)
+
+			// Decreasing
+			set = cgroup.MemoryLimits{High: 1 << 30, Max: 2 << 30}
+			require.NoError(t, manager.SetMemoryLimits(set))
+			limits, err = manager.GetMemoryLimits()
+			require.NoError(t, err)
+			require.Equal(t, set, limits)
+
+			// High above max is rejected, and leaves the limits as they were
+			require.Error(t, manager.SetMemoryLimits(cgroup.MemoryLimits{High: 3 << 30, Max: 2 << 30}))
+			limits, err = manager.GetMemoryLimits()
+			require.NoError(t, err)
+			require.Equal(t, set, limits)
+
+			// Removing the limits
+			require.NoError(t, manager.SetMemoryLimits(cgroup.MemoryLimits{High: 0, Max: 0}))
+			limits, err = manager.GetMemoryLimits()
+			require.NoError(t, err)
+			require.Equal(t, cgroup.MemoryLimits{High: 0, Max: 0}, limits)
+		})
+	}
+
+	// The value that the kernel reports for cgroup v1 when there's no limit
+	t.Run("v1 kernel unlimited", func(t *testing.T) {
+		root := fakeHierarchy(t, cgroup.V1)
+		manager, err := cgroup.NewManager(root, cgroup.V1, "/vm")
+		require.NoError(t, err)
+
+		dir := filepath.Join(root, "memory", "vm")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.limit_in_bytes"), []byte("9223372036854771712\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.soft_limit_in_bytes"), []byte("9223372036854771712\n"), 0o644))
+
+		limits, err := manager.GetMemoryLimits()
+		require.NoError(t, err)
+		require.Equal(t, cgroup.MemoryLimits{High: 0, Max: 0}, limits)
+	})
+}
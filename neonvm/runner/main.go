@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -19,6 +20,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -38,11 +40,14 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 
 	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/neonvm/pkg/cgroup"
 	"github.com/neondatabase/autoscaling/pkg/api"
 )
 
@@ -54,9 +59,15 @@ const (
 
 	rootDiskPath                   = "/vm/images/rootdisk.qcow2"
 	runtimeDiskPath                = "/vm/images/runtime.iso"
+	cloudInitDiskPath              = "/vm/images/cloud-init.iso"
 	mountedDiskPath                = "/vm/images"
 	qmpUnixSocketForSigtermHandler = "/vm/qmp-sigterm.sock"
+	qmpUnixSocketForCPUPinning     = "/vm/qmp-cpu-pinning.sock"
 	logSerialSocket                = "/vm/log.sock"
+	consoleLogPath                 = "/vm/console.log"
+	diskUpdatesSocket              = "/vm/disk-updates.sock"
+	guestShutdownSocket            = "/vm/guest-shutdown.sock"
+	guestVersionsPath              = "/vm/images/versions.json"
 	bufferedReaderSize             = 4096
 
 	sshAuthorizedKeysDiskPath   = "/vm/images/ssh-authorized-keys.iso"
@@ -64,13 +75,42 @@ const (
 
 	swapName = "swapdisk"
 
+	// consoleLogMaxSize is the size above which the console log is truncated, checked every
+	// consoleLogCheckInterval. The console output is still written to stdout in full.
+	consoleLogMaxSize       = 8 * 1024 * 1024
+	consoleLogCheckInterval = 10 * time.Second
+	// consoleFollowInterval is how often new output is checked for, while following the console
+	// log. See handleConsole.
+	consoleFollowInterval = 250 * time.Millisecond
+
+	// diskWatchInterval is how often we check for changes to disks with .watch set. Kubelet only
+	// updates configMap and secret volumes about once a minute anyways.
+	diskWatchInterval = 10 * time.Second
+
+	// guestShutdownAckTimeout is how long the guest has to acknowledge a request to stop its
+	// workload, before we assume that its image doesn't support it. See requestGuestShutdown.
+	guestShutdownAckTimeout = 5 * time.Second
+
 	defaultNetworkBridgeName = "br-def"
 	defaultNetworkTapName    = "tap-def"
 	defaultNetworkCIDR       = "169.254.254.252/30"
 
+	// egressAccountingChain is the iptables chain used to count bytes sent by the VM, split by
+	// destination. See handleNetworkUsage.
+	egressAccountingChain = "NEONVM-EGRESS"
+
 	overlayNetworkBridgeName = "br-overlay"
 	overlayNetworkTapName    = "tap-overlay"
 
+	// additionalNetworkBridgePrefix and additionalNetworkTapPrefix give the names of the
+	// interfaces for each of .spec.additionalNetworks, when followed by the network's name.
+	additionalNetworkBridgePrefix = "brn-"
+	additionalNetworkTapPrefix    = "tapn-"
+
+	// defaultNetworkUsageName is the name that the usage of the default (pod) network is reported
+	// under. See handleNetworkUsage.
+	defaultNetworkUsageName = "default"
+
 	// defaultPath is the default path to the resolv.conf that contains information to resolve DNS. See Path().
 	resolveDefaultPath = "/etc/resolv.conf"
 	// alternatePath is a path different from defaultPath, that may be used to resolve DNS. See Path().
@@ -91,6 +131,15 @@ const (
 	//
 	// See also: https://neondb.slack.com/archives/C03TN5G758R/p1693462680623239
 	cpuLimitOvercommitFactor = 4
+
+	// qemuMemoryOverhead is the amount of memory, on top of the VM's maximum memory, that QEMU is
+	// allowed to use before it's throttled, if the QEMU cgroup's memory limit is enforced. The
+	// hard limit is twice this above the VM's maximum memory.
+	qemuMemoryOverhead = 256 << 20 // 256 MiB
+
+	// vcpuPinningInterval is how often the vCPU threads of VMs with pinned vCPUs are checked, so
+	// that hotplugged vCPUs are pinned soon after they're added.
+	vcpuPinningInterval = 5 * time.Second
 )
 
 var (
@@ -214,6 +263,7 @@ func createISO9660runtime(
 	enableSSH bool,
 	swapInfo *vmv1.SwapInfo,
 	shmsize *resource.Quantity,
+	networks []additionalNetwork,
 ) error {
 	writer, err := iso9660.NewWriter()
 	if err != nil {
@@ -281,6 +331,15 @@ func createISO9660runtime(
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount %s $(/neonvm/bin/blkid -L %s) %s`, opts, disk.Name, disk.MountPath))
 				// Note: chmod must be after mount, otherwise it gets overwritten by mount.
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/chmod 0777 %s`, disk.MountPath))
+			case (disk.ConfigMap != nil || disk.Secret != nil) && disk.Watch != nil:
+				// Watched disks are copied into a tmpfs, so that vmdiskupdate can replace their
+				// contents later.
+				isoPath := fmt.Sprintf("/neonvm/disks/%s", disk.Name)
+				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mkdir -p %s`, isoPath))
+				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount -o ro,mode=0644 $(/neonvm/bin/blkid -L %s) %s`, disk.Name, isoPath))
+				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount -t tmpfs -o mode=0755 %s %s`, disk.Name, disk.MountPath))
+				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/cp -a %s/. %s/`, isoPath, disk.MountPath))
+				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/umount %s`, isoPath))
 			case disk.ConfigMap != nil || disk.Secret != nil:
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount -o ro,mode=0644 $(/neonvm/bin/blkid -L %s) %s`, disk.Name, disk.MountPath))
 			case disk.Tmpfs != nil:
@@ -302,6 +361,42 @@ func createISO9660runtime(
 		return err
 	}
 
+	// addresses for additional networks, configured by vminit. The guest's interfaces are found by
+	// their MAC addresses, because their names depend on the order that they're detected in.
+	if len(networks) != 0 {
+		lines := []string{
+			"set -euxo pipefail",
+			`iface_by_mac() { for d in /sys/class/net/*; do [ "$(/neonvm/bin/cat $d/address)" = "$1" ] && /neonvm/bin/basename $d; done; true; }`,
+		}
+		for _, n := range networks {
+			lines = append(lines, fmt.Sprintf(`iface="$(iface_by_mac %s)"`, n.mac.String()))
+			for _, addr := range n.addrs {
+				lines = append(lines, fmt.Sprintf(`/neonvm/bin/ip addr add %s dev "$iface"`, addr.String()))
+			}
+			lines = append(lines, `/neonvm/bin/ip link set up dev "$iface"`)
+		}
+		lines = append(lines, "")
+		err = writer.AddFile(bytes.NewReader([]byte(strings.Join(lines, "\n"))), "networks.sh")
+		if err != nil {
+			return err
+		}
+	}
+
+	// hooks for watched disks, run by vmdiskupdate with the name of the disk that was updated
+	hooks := []string{`case "$1" in`}
+	for _, disk := range disks {
+		if disk.Watch != nil && disk.Watch.OnUpdate != "" {
+			hooks = append(hooks, fmt.Sprintf(`%s) /neonvm/bin/sh -c %s ;;`, disk.Name, shellescape.Quote(disk.Watch.OnUpdate)))
+		}
+	}
+	if len(hooks) > 1 {
+		hooks = append(hooks, "esac", "")
+		err = writer.AddFile(bytes.NewReader([]byte(strings.Join(hooks, "\n"))), "disk-hooks.sh")
+		if err != nil {
+			return err
+		}
+	}
+
 	if swapInfo != nil {
 		lines := []string{
 			`#!/neonvm/bin/sh`,
@@ -353,6 +448,56 @@ func createISO9660runtime(
 	return nil
 }
 
+// createCloudInitISO creates the VM's cloud-init drive, in the NoCloud format
+//
+// The instance ID is the VM's .status.cloudInitInstanceID, which is kept through migrations, so that
+// cloud-init doesn't treat the VM as a new instance afterwards.
+func createCloudInitISO(cloudInit *vmv1.CloudInit, instanceID string, diskPath string) error {
+	userData := []byte(cloudInit.UserData)
+	if secret := cloudInit.UserDataSecret; secret != nil {
+		var err error
+		userData, err = os.ReadFile(fmt.Sprintf("%s/%s", vmv1.CloudInitMountPath, vmv1.CloudInitUserDataFile))
+		// if the Secret is optional and missing, the user-data is just empty
+		missingOk := secret.Optional != nil && *secret.Optional
+		if err != nil && !(missingOk && errors.Is(err, os.ErrNotExist)) {
+			return fmt.Errorf("could not read user-data: %w", err)
+		}
+	}
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, instanceID)
+
+	writer, err := iso9660.NewWriter()
+	if err != nil {
+		return err
+	}
+	defer writer.Cleanup() //nolint:errcheck // Nothing to do with the error, maybe log it ? TODO
+
+	if err := writer.AddFile(bytes.NewReader(userData), vmv1.CloudInitUserDataFile); err != nil {
+		return err
+	}
+	if err := writer.AddFile(bytes.NewReader([]byte(metaData)), "meta-data"); err != nil {
+		return err
+	}
+
+	outputFile, err := os.OpenFile(diskPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	err = outputFile.Chown(36, 34)
+	if err != nil {
+		return err
+	}
+
+	// cloud-init finds the NoCloud drive by its label
+	err = writer.WriteTo(outputFile, "cidata")
+	if err != nil {
+		return err
+	}
+
+	return outputFile.Close()
+}
+
 func calcDirUsage(dirPath string) (int64, error) {
 	stat, err := os.Lstat(dirPath)
 	if err != nil {
@@ -417,6 +562,21 @@ func createSwap(diskPath string, swapInfo vmv1.SwapInfo) error {
 	return nil
 }
 
+// restoreQCOW2 creates the disk at diskPath as a copy of the snapshot at snapshotPath, so that the
+// snapshot itself is never modified
+func restoreQCOW2(snapshotPath string, diskPath string) error {
+	if err := execFg(QEMU_IMG_BIN, "convert", "-q", "-f", "qcow2", "-O", "qcow2", "-o", "cluster_size=2M,lazy_refcounts=on", snapshotPath, diskPath); err != nil {
+		return err
+	}
+
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := execFg("chown", "36:34", diskPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func createQCOW2(diskName string, diskPath string, diskSize *resource.Quantity, contentPath *string) error {
 	ext4blocksMin := int64(64)
 	ext4blockSize := int64(4096)
@@ -595,6 +755,7 @@ type Config struct {
 	kernelPath           string
 	appendKernelCmdline  string
 	skipCgroupManagement bool
+	enforceMemoryLimit   bool
 	diskCacheSettings    string
 }
 
@@ -605,6 +766,7 @@ func newConfig() *Config {
 		kernelPath:           defaultKernelPath,
 		appendKernelCmdline:  "",
 		skipCgroupManagement: false,
+		enforceMemoryLimit:   false,
 		diskCacheSettings:    "cache=none",
 	}
 	flag.StringVar(&cfg.vmSpecDump, "vmspec", cfg.vmSpecDump,
@@ -618,6 +780,9 @@ func newConfig() *Config {
 	flag.BoolVar(&cfg.skipCgroupManagement, "skip-cgroup-management",
 		cfg.skipCgroupManagement,
 		"Don't try to manage CPU (use if running alongside container-mgr)")
+	flag.BoolVar(&cfg.enforceMemoryLimit, "enforce-memory-limit",
+		cfg.enforceMemoryLimit,
+		"Limit the memory of the QEMU cgroup to slightly above the VM's maximum memory (ignored with -skip-cgroup-management)")
 	flag.StringVar(&cfg.diskCacheSettings, "qemu-disk-cache-settings",
 		cfg.diskCacheSettings, "Cache settings to add to -drive args for VM disks")
 	flag.Parse()
@@ -666,7 +831,10 @@ func run(logger *zap.Logger) error {
 	memory := []string{}
 	memory = append(memory, fmt.Sprintf("size=%db", initialMemorySize))
 	if vmSpec.Guest.MemorySlots.Max != nil {
-		memory = append(memory, fmt.Sprintf("slots=%d", *vmSpec.Guest.MemorySlots.Max-*vmSpec.Guest.MemorySlots.Min))
+		// virtio-mem doesn't use DIMM slots; the extra memory is all in one device.
+		if !vmSpec.Guest.UsesVirtioMem() {
+			memory = append(memory, fmt.Sprintf("slots=%d", *vmSpec.Guest.MemorySlots.Max-*vmSpec.Guest.MemorySlots.Min))
+		}
 		memory = append(memory, fmt.Sprintf("maxmem=%db", vmSpec.Guest.MemorySlotSize.Value()*int64(*vmSpec.Guest.MemorySlots.Max)))
 	}
 
@@ -706,6 +874,13 @@ func run(logger *zap.Logger) error {
 		return fmt.Errorf("%s: %w", msg, err)
 	}
 
+	// The addresses of the pod's interfaces for additional networks are needed for both the runtime
+	// disk and the QEMU command, so they're read before either is started.
+	networks, err := prepareAdditionalNetworks(vmSpec.AdditionalNetworks)
+	if err != nil {
+		return logWrap("failed to prepare additional networks", err)
+	}
+
 	eg := &errgroup.Group{}
 	eg.Go(func() error {
 		if err := runInitScript(logger, vmSpec.InitScript); err != nil {
@@ -725,6 +900,7 @@ func run(logger *zap.Logger) error {
 			enableSSH,
 			swapInfo,
 			shmSize,
+			networks,
 		); err != nil {
 			return logWrap("failed to create iso9660 disk", err)
 		}
@@ -742,7 +918,7 @@ func run(logger *zap.Logger) error {
 
 	eg.Go(func() error {
 		var err error
-		qemuCmd, err = buildQEMUCmd(cfg, logger, vmSpec, &vmStatus, cpus, memory, enableSSH, swapInfo)
+		qemuCmd, err = buildQEMUCmd(cfg, logger, vmSpec, &vmStatus, cpus, memory, enableSSH, swapInfo, networks)
 		if err != nil {
 			return logWrap("failed to build QEMU command", err)
 		}
@@ -753,7 +929,9 @@ func run(logger *zap.Logger) error {
 		return err
 	}
 
-	err = runQEMU(cfg, logger, vmSpec, qemuCmd, qemuCPUs)
+	guestInfo := readGuestInfo(logger, cfg.kernelPath)
+
+	err = runQEMU(cfg, logger, vmSpec, qemuCmd, qemuCPUs, guestInfo)
 	if err != nil {
 		return fmt.Errorf("failed to run QEMU: %w", err)
 	}
@@ -791,6 +969,32 @@ func resizeRootDisk(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
 	return nil
 }
 
+// virtioMemArgs returns the QEMU arguments for the virtio-mem device holding all of the guest's
+// memory above .spec.guest.memorySlots.min, or nil if there is no such memory
+//
+// The device starts with the memory given by .spec.guest.memorySlots.use, and is resized by the
+// controller by setting its "requested-size".
+func virtioMemArgs(guest *vmv1.Guest) []string {
+	if guest.MemorySlots.Max == nil || *guest.MemorySlots.Max <= *guest.MemorySlots.Min {
+		return nil
+	}
+
+	slotSize := guest.MemorySlotSize.Value()
+	maxSize := slotSize * int64(*guest.MemorySlots.Max-*guest.MemorySlots.Min)
+	var requestedSize int64
+	if guest.MemorySlots.Use != nil {
+		requestedSize = slotSize * int64(*guest.MemorySlots.Use-*guest.MemorySlots.Min)
+	}
+
+	return []string{
+		"-object", fmt.Sprintf("memory-backend-ram,id=virtiomem0-backend,size=%db", maxSize),
+		"-device", fmt.Sprintf(
+			"virtio-mem-pci,id=virtiomem0,memdev=virtiomem0-backend,block-size=%db,requested-size=%db",
+			vmv1.VirtioMemBlockSize, requestedSize,
+		),
+	}
+}
+
 func buildQEMUCmd(
 	cfg *Config,
 	logger *zap.Logger,
@@ -799,6 +1003,7 @@ func buildQEMUCmd(
 	cpus, memory []string,
 	enableSSH bool,
 	swapInfo *vmv1.SwapInfo,
+	networks []additionalNetwork,
 ) ([]string, error) {
 	// prepare qemu command line
 	qemuCmd := []string{
@@ -810,7 +1015,10 @@ func buildQEMUCmd(
 		"-only-migratable",
 		"-audiodev", "none,id=noaudio",
 		"-serial", "pty",
-		"-serial", "stdio",
+		// The kernel's console. Its output goes to stdout, and is also kept in consoleLogPath, to
+		// be served by handleConsole.
+		"-chardev", fmt.Sprintf("stdio,id=console,logfile=%s,logappend=on", consoleLogPath),
+		"-serial", "chardev:console",
 		"-msg", "timestamp=on",
 		"-qmp", fmt.Sprintf("tcp:0.0.0.0:%d,server,wait=off", vmSpec.QMP),
 		"-qmp", fmt.Sprintf("tcp:0.0.0.0:%d,server,wait=off", vmSpec.QMPManual),
@@ -820,6 +1028,31 @@ func buildQEMUCmd(
 		"-device", "virtserialport,chardev=log,name=tech.neon.log.0",
 	}
 
+	// A separate monitor for pinning vCPUs, so that it doesn't contend with the sigterm handler.
+	if vmSpec.Guest.PinnedCPUs() != 0 {
+		qemuCmd = append(qemuCmd, "-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForCPUPinning))
+	}
+
+	// Only add the port for disk updates if it's needed, so that VMs without watched disks keep
+	// the same set of devices, which must match between the source and target of a migration.
+	if slices.ContainsFunc(vmSpec.Disks, func(d vmv1.Disk) bool { return d.Watch != nil }) {
+		qemuCmd = append(
+			qemuCmd,
+			"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=disk-updates", diskUpdatesSocket),
+			"-device", "virtserialport,chardev=disk-updates,name=tech.neon.disks.0",
+		)
+	}
+
+	// Likewise, the port for asking the guest to stop its workload on termination is only added
+	// if there's a grace period for it.
+	if vmSpec.GuestTerminationGracePeriodSeconds != nil {
+		qemuCmd = append(
+			qemuCmd,
+			"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=guest-shutdown", guestShutdownSocket),
+			"-device", "virtserialport,chardev=guest-shutdown,name=tech.neon.shutdown.0",
+		)
+	}
+
 	// disk details
 	qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=rootdisk,file=%s,if=virtio,media=disk,index=0,%s", rootDiskPath, cfg.diskCacheSettings))
 	qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=runtime,file=%s,if=virtio,media=cdrom,readonly=on,cache=none", runtimeDiskPath))
@@ -844,10 +1077,17 @@ func buildQEMUCmd(
 	for _, disk := range vmSpec.Disks {
 		switch {
 		case disk.EmptyDisk != nil:
-			logger.Info("creating QCOW2 image with empty ext4 filesystem", zap.String("diskName", disk.Name))
 			dPath := fmt.Sprintf("%s/%s.qcow2", mountedDiskPath, disk.Name)
-			if err := createQCOW2(disk.Name, dPath, &disk.EmptyDisk.Size, nil); err != nil {
-				return nil, fmt.Errorf("Failed to create QCOW2 image: %w", err)
+			if snapshot := disk.EmptyDisk.FromSnapshot; snapshot != "" {
+				logger.Info("restoring QCOW2 image from snapshot", zap.String("diskName", disk.Name), zap.String("snapshot", snapshot))
+				if err := restoreQCOW2(vmv1.SnapshotDiskPath(snapshot, disk.Name), dPath); err != nil {
+					return nil, fmt.Errorf("Failed to restore QCOW2 image from snapshot: %w", err)
+				}
+			} else {
+				logger.Info("creating QCOW2 image with empty ext4 filesystem", zap.String("diskName", disk.Name))
+				if err := createQCOW2(disk.Name, dPath, &disk.EmptyDisk.Size, nil); err != nil {
+					return nil, fmt.Errorf("Failed to create QCOW2 image: %w", err)
+				}
 			}
 			discard := ""
 			if disk.EmptyDisk.Discard {
@@ -867,6 +1107,20 @@ func buildQEMUCmd(
 		}
 	}
 
+	if vmSpec.CloudInit != nil {
+		logger.Info("creating cloud-init disk", zap.String("diskPath", cloudInitDiskPath))
+		// VMs whose pods were created by older controllers don't have an instance ID in their
+		// status. Their pod name is the closest we can do.
+		instanceID := vmStatus.CloudInitInstanceID
+		if instanceID == "" {
+			instanceID = vmStatus.PodName
+		}
+		if err := createCloudInitISO(vmSpec.CloudInit, instanceID, cloudInitDiskPath); err != nil {
+			return nil, fmt.Errorf("Failed to create cloud-init disk: %w", err)
+		}
+		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=cloud-init,file=%s,if=virtio,media=cdrom,readonly=on,cache=none", cloudInitDiskPath))
+	}
+
 	// cpu details
 	// NB: EnableAcceleration guaranteed non-nil because the k8s API server sets the default for us.
 	if *vmSpec.EnableAcceleration && checkKVM() {
@@ -880,6 +1134,9 @@ func buildQEMUCmd(
 
 	// memory details
 	qemuCmd = append(qemuCmd, "-m", strings.Join(memory, ","))
+	if vmSpec.Guest.UsesVirtioMem() {
+		qemuCmd = append(qemuCmd, virtioMemArgs(&vmSpec.Guest)...)
+	}
 
 	// default (pod) net details
 	macDefault, err := defaultNetwork(logger, defaultNetworkCIDR, vmSpec.Guest.Ports)
@@ -899,6 +1156,32 @@ func buildQEMUCmd(
 		qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("virtio-net-pci,netdev=overlay,mac=%s", macOverlay.String()))
 	}
 
+	// additional (multus) networks
+	if err := setupAdditionalNetworks(logger, networks); err != nil {
+		return nil, fmt.Errorf("Failed to set up additional networks: %w", err)
+	}
+	for _, n := range networks {
+		qemuCmd = append(qemuCmd, "-netdev", fmt.Sprintf("tap,id=net-%s,ifname=%s,script=no,downscript=no,vhost=on", n.name, n.tap))
+		qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("virtio-net-pci,netdev=net-%s,mac=%s", n.name, n.mac.String()))
+	}
+
+	// GPUs, passed through with VFIO
+	if vmSpec.Guest.GPUs != nil {
+		addresses, err := gpuPCIAddresses(vmSpec.Guest.GPUs)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get GPUs: %w", err)
+		}
+		// VFIO pins all of the guest's memory, so QEMU must be allowed to lock all of it.
+		unlimited := unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+		if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unlimited); err != nil {
+			return nil, fmt.Errorf("Failed to remove locked memory limit for GPUs: %w", err)
+		}
+		for i, addr := range addresses {
+			logger.Info("passing through GPU", zap.String("address", addr))
+			qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("vfio-pci,host=%s,id=gpu%d", addr, i))
+		}
+	}
+
 	// kernel details
 	qemuCmd = append(qemuCmd, "-kernel", cfg.kernelPath)
 	var effectiveKernelCmdline string
@@ -926,6 +1209,7 @@ func runQEMU(
 	vmSpec *vmv1.VirtualMachineSpec,
 	qemuCmd []string,
 	qemuCPUs QemuCPUs,
+	guestInfo vmv1.GuestInfo,
 ) error {
 	selfPodName, ok := os.LookupEnv("K8S_POD_NAME")
 	if !ok {
@@ -933,6 +1217,7 @@ func runQEMU(
 	}
 
 	var cgroupPath string
+	var memoryCgroupVersion cgroup.Version
 
 	if !cfg.skipCgroupManagement {
 		selfCgroupPath, err := getSelfCgroupPath(logger)
@@ -956,28 +1241,74 @@ func runQEMU(
 		if err := setCgroupLimit(logger, qemuCPUs.use, cgroupPath); err != nil {
 			return fmt.Errorf("Failed to set cgroup limit: %w", err)
 		}
+
+		if cfg.enforceMemoryLimit {
+			maxSlots := *vmSpec.Guest.MemorySlots.Min
+			if vmSpec.Guest.MemorySlots.Max != nil {
+				maxSlots = *vmSpec.Guest.MemorySlots.Max
+			}
+			maxMemory := vmSpec.Guest.MemorySlotSize.Value() * int64(maxSlots)
+			memoryCgroupVersion, err = setCgroupMemoryLimit(logger, uint64(maxMemory), cgroupPath)
+			if err != nil {
+				return fmt.Errorf("Failed to set cgroup memory limit: %w", err)
+			}
+		}
+	}
+
+	var placement *cpuPlacement
+	if vmSpec.Guest.PinnedCPUs() != 0 {
+		var err error
+		placement, err = getCPUPlacement(logger, vmSpec.Guest.PinnedCPUs(), vmSpec.Guest.CPUPlacement.SingleNUMANode)
+		if err != nil {
+			return fmt.Errorf("Failed to get CPUs for pinned vCPUs: %w", err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
-	go terminateQemuOnSigterm(ctx, logger, &wg)
+	go terminateQemuOnSigterm(ctx, logger, vmSpec.GuestTerminationGracePeriodSeconds, &wg)
 	if !cfg.skipCgroupManagement {
 		wg.Add(1)
-		go listenForCPUChanges(ctx, logger, vmSpec.RunnerPort, cgroupPath, &wg)
+		go listenForCPUChanges(ctx, logger, vmSpec.RunnerPort, cgroupPath, guestInfo, vmSpec.AdditionalNetworks, &wg)
 	}
 	wg.Add(1)
 	go forwardLogs(ctx, logger, &wg)
+	wg.Add(1)
+	go watchDisks(ctx, logger, vmSpec.Disks, &wg)
+	wg.Add(1)
+	go truncateConsoleLog(ctx, logger, &wg)
+	if placement != nil {
+		wg.Add(1)
+		go pinVCPUs(ctx, logger, placement.cpus, &wg)
+	}
+
+	qemu := append([]string{QEMU_BIN}, qemuCmd...)
+	if placement != nil && placement.numaNode != nil {
+		// Keep all of QEMU's threads and memory on the NUMA node. The vCPU threads are then pinned
+		// to individual CPUs by pinVCPUs.
+		qemu = append([]string{
+			"numactl",
+			fmt.Sprintf("--membind=%d", *placement.numaNode),
+			fmt.Sprintf("--physcpubind=%s", formatCPUList(placement.cpus)),
+		}, qemu...)
+	}
 
 	var bin string
 	var cmd []string
 	if !cfg.skipCgroupManagement {
 		bin = "cgexec"
-		cmd = append([]string{"-g", fmt.Sprintf("cpu:%s", cgroupPath), QEMU_BIN}, qemuCmd...)
+		cmd = []string{"-g", fmt.Sprintf("cpu:%s", cgroupPath)}
+		// With cgroup v1, the memory controller is a separate hierarchy that QEMU must also be
+		// placed into. With v2, there's only the one cgroup.
+		if memoryCgroupVersion == cgroup.V1 {
+			cmd = append(cmd, "-g", fmt.Sprintf("memory:%s", cgroupPath))
+		}
+		cmd = append(cmd, qemu...)
 	} else {
-		bin = QEMU_BIN
-		cmd = qemuCmd
+		bin = qemu[0]
+		cmd = qemu[1:]
 	}
 
 	logger.Info(fmt.Sprintf("calling %s", bin), zap.Strings("args", cmd))
@@ -1025,6 +1356,49 @@ func handleCPUChange(logger *zap.Logger, w http.ResponseWriter, r *http.Request,
 	w.WriteHeader(200)
 }
 
+func handleSnapshotDelete(logger *zap.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("could not read body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+
+	var parsed api.SnapshotDelete
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		logger.Error("could not parse body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+
+	// Object names can't contain slashes, so these can't refer to files outside of the snapshot
+	// storage. Check anyways, because they're used as paths.
+	for _, name := range append([]string{parsed.Name}, parsed.Disks...) {
+		if name == "" || strings.ContainsAny(name, "/_") || name == "." || name == ".." {
+			logger.Error("invalid name in snapshot delete request", zap.String("name", name))
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	logger.Info("removing snapshot", zap.String("snapshot", parsed.Name), zap.Strings("disks", parsed.Disks))
+	for _, disk := range parsed.Disks {
+		path := vmv1.SnapshotDiskPath(parsed.Name, disk)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("could not remove copy of disk", zap.String("path", path), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
 func handleCPUCurrent(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cgroupPath string) {
 	if r.Method != "GET" {
 		logger.Error("unexpected method", zap.String("method", r.Method))
@@ -1050,84 +1424,486 @@ func handleCPUCurrent(logger *zap.Logger, w http.ResponseWriter, r *http.Request
 	w.Write(body) //nolint:errcheck // Not much to do with the error here. TODO: log it?
 }
 
-func listenForCPUChanges(ctx context.Context, logger *zap.Logger, port int32, cgroupPath string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	mux := http.NewServeMux()
-	loggerHandlers := logger.Named("http-handlers")
-	cpuChangeLogger := loggerHandlers.Named("cpu_change")
-	mux.HandleFunc("/cpu_change", func(w http.ResponseWriter, r *http.Request) {
-		handleCPUChange(cpuChangeLogger, w, r, cgroupPath)
-	})
-	cpuCurrentLogger := loggerHandlers.Named("cpu_current")
-	mux.HandleFunc("/cpu_current", func(w http.ResponseWriter, r *http.Request) {
-		handleCPUCurrent(cpuCurrentLogger, w, r, cgroupPath)
-	})
-	server := http.Server{
-		Addr:              fmt.Sprintf("0.0.0.0:%d", port),
-		Handler:           mux,
-		ReadTimeout:       5 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      5 * time.Second,
+func handleGuestInfo(logger *zap.Logger, w http.ResponseWriter, r *http.Request, guestInfo vmv1.GuestInfo) {
+	if r.Method != "GET" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
 	}
-	errChan := make(chan error)
-	go func() {
-		errChan <- server.ListenAndServe()
-	}()
-	select {
-	case err := <-errChan:
-		if errors.Is(err, http.ErrServerClosed) {
-			logger.Info("cpu_change server closed")
-		} else if err != nil {
-			logger.Fatal("cpu_change exited with error", zap.Error(err))
-		}
-	case <-ctx.Done():
-		err := server.Shutdown(context.Background())
-		logger.Info("shut down cpu_change server", zap.Error(err))
+
+	body, err := json.Marshal(guestInfo)
+	if err != nil {
+		logger.Error("could not marshal body", zap.Error(err))
+		w.WriteHeader(500)
+		return
 	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck // Not much to do with the error here. TODO: log it?
 }
 
-func printWithNewline(slice []byte) error {
-	if len(slice) == 0 {
-		return nil
+// handleConsole replies with the output of the VM's serial console, i.e. the kernel's console.
+//
+// With the "tailBytes" query parameter, only that many of the most recent bytes are sent. With
+// "follow=true", the response doesn't end, and new output is streamed as it's written.
+//
+// Only the output since the log was last truncated is available; see truncateConsoleLog.
+func handleConsole(ctx context.Context, logger *zap.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
 	}
 
-	_, err := os.Stdout.Write(slice)
+	query := r.URL.Query()
+	follow := query.Get("follow") == "true"
+	var tailBytes int64 = -1
+	if t := query.Get("tailBytes"); t != "" {
+		var err error
+		tailBytes, err = strconv.ParseInt(t, 10, 64)
+		if err != nil || tailBytes < 0 {
+			logger.Error("could not parse tailBytes", zap.String("tailBytes", t), zap.Error(err))
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	file, err := os.Open(consoleLogPath)
 	if err != nil {
-		return err
+		logger.Error("could not open console log", zap.Error(err))
+		w.WriteHeader(500)
+		return
 	}
+	defer file.Close()
 
-	if slice[len(slice)-1] == '\n' {
-		return nil
+	info, err := file.Stat()
+	if err != nil {
+		logger.Error("could not stat console log", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	offset := int64(0)
+	if tailBytes >= 0 && info.Size() > tailBytes {
+		offset = info.Size() - tailBytes
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		logger.Error("could not seek in console log", zap.Error(err))
+		w.WriteHeader(500)
+		return
 	}
 
-	_, err = os.Stdout.WriteString("\n")
-	return err
-}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 
-func drainLogsReader(reader *bufio.Reader, logger *zap.Logger) error {
-	for {
-		// ReadSlice actually can return no more than bufferedReaderSize bytes
-		slice, err := reader.ReadSlice('\n')
-		// If err != nil, slice might not have \n at the end
-		err2 := printWithNewline(slice)
+	if !follow {
+		_, _ = io.Copy(w, file)
+		return
+	}
 
-		err = errors.Join(err, err2)
+	// The server's write timeout is for ordinary requests; following lasts until the client goes
+	// away.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Error("could not clear write deadline", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	ticker := time.NewTicker(consoleFollowInterval)
+	defer ticker.Stop()
+	for {
+		n, err := io.Copy(w, file)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
-				return nil
-			}
-			if errors.Is(err, io.EOF) {
-				logger.Warn("EOF while reading from log serial")
-			} else {
-				logger.Error("failed to read from log serial", zap.Error(err))
+			// most likely, the client went away
+			return
+		}
+		offset += n
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		// If the log was truncated, start again from the beginning.
+		if info, err := file.Stat(); err == nil && info.Size() < offset {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				logger.Error("could not seek in console log", zap.Error(err))
+				return
 			}
-			return err
+			offset = 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// forwardLogs writes from socket to stdout line by line
-func forwardLogs(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+// truncateConsoleLog periodically empties the console log once it's larger than
+// consoleLogMaxSize, so that it doesn't fill the pod's disk
+//
+// QEMU opens the log for appending, so it continues writing at the start of the file.
+func truncateConsoleLog(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(consoleLogCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(consoleLogPath)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Error("could not stat console log", zap.Error(err))
+			}
+			continue
+		}
+		if info.Size() > consoleLogMaxSize {
+			logger.Info("truncating console log", zap.Int64("size", info.Size()))
+			if err := os.Truncate(consoleLogPath, 0); err != nil {
+				logger.Error("could not truncate console log", zap.Error(err))
+			}
+		}
+	}
+}
+
+// readGuestInfo collects the versions of the software that the guest will run. Anything that can't
+// be determined is logged and left empty, because it's only informational.
+func readGuestInfo(logger *zap.Logger, kernelPath string) vmv1.GuestInfo {
+	info := vmv1.GuestInfo{
+		KernelVersion:    "",
+		RootDiskImageID:  "", // filled in by the controller, from the pod's status
+		VmBuilderVersion: "",
+		Daemons:          nil,
+	}
+
+	kernelVersion, err := readKernelVersion(kernelPath)
+	if err != nil {
+		logger.Warn("Could not read guest kernel version", zap.String("path", kernelPath), zap.Error(err))
+	} else {
+		info.KernelVersion = kernelVersion
+	}
+
+	// versions.json is added to the root disk image by vm-builder, and copied next to the disk by
+	// the init container. Images built by older versions of vm-builder won't have it.
+	data, err := os.ReadFile(guestVersionsPath)
+	if err != nil {
+		logger.Warn("Could not read guest versions file", zap.String("path", guestVersionsPath), zap.Error(err))
+		return info
+	}
+	var versions struct {
+		VmBuilder string            `json:"vmBuilder"`
+		Daemons   map[string]string `json:"daemons"`
+	}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		logger.Warn("Could not parse guest versions file", zap.String("path", guestVersionsPath), zap.Error(err))
+		return info
+	}
+	info.VmBuilderVersion = versions.VmBuilder
+	info.Daemons = versions.Daemons
+
+	logger.Info("Read guest info", zap.Any("guestInfo", info))
+	return info
+}
+
+// readKernelVersion returns the release of the kernel in the bzImage at path, e.g. "6.1.63"
+//
+// The setup header of a bzImage contains a pointer to a human-readable version string, which starts
+// with the release. For more, see:
+// https://www.kernel.org/doc/html/latest/arch/x86/boot.html#the-real-mode-kernel-header
+func readKernelVersion(path string) (string, error) {
+	const (
+		headerMagicOffset   = 0x202
+		versionOffsetOffset = 0x20E
+		versionBaseOffset   = 0x200
+		maxVersionLen       = 256
+	)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, versionOffsetOffset+2)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", fmt.Errorf("could not read setup header: %w", err)
+	}
+	if string(header[headerMagicOffset:headerMagicOffset+4]) != "HdrS" {
+		return "", errors.New("not a bzImage: setup header magic not found")
+	}
+	versionOffset := binary.LittleEndian.Uint16(header[versionOffsetOffset:])
+	if versionOffset == 0 {
+		return "", errors.New("bzImage does not contain a version string")
+	}
+
+	buf := make([]byte, maxVersionLen)
+	n, err := f.ReadAt(buf, int64(versionOffset)+versionBaseOffset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("could not read version string: %w", err)
+	}
+	version, _, _ := bytes.Cut(buf[:n], []byte{0})
+	fields := strings.Fields(string(version))
+	if len(fields) == 0 {
+		return "", errors.New("bzImage has an empty version string")
+	}
+
+	return fields[0], nil
+}
+
+// networkUsageLock serializes changes to the egress accounting chain, so that concurrent requests
+// don't insert duplicate rules
+var networkUsageLock sync.Mutex
+
+// handleNetworkUsage replies with the total bytes sent by the VM, split into traffic to the
+// internal CIDRs given by the "internal" query parameters, and everything else.
+//
+// Counting only starts once a CIDR has been requested, so the caller is expected to use the same
+// set of CIDRs each time, and only look at the difference between successive responses.
+//
+// The reply also includes the bytes sent and received on each of the VM's network interfaces:
+// the default network, and each of .spec.additionalNetworks. Traffic on additional networks is not
+// included in the internal and internet totals.
+//
+// Lastly, it includes the number of connections made to the guest's ports from outside the pod.
+// Unlike the interface counters, this keeps counting while the VM is paused, because QEMU stops
+// reading from the TAP device then.
+func handleNetworkUsage(logger *zap.Logger, w http.ResponseWriter, r *http.Request, networks []vmv1.AdditionalNetwork) {
+	if r.Method != "GET" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+
+	internal := make(map[string]struct{})
+	for _, c := range r.URL.Query()["internal"] {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			logger.Error("could not parse CIDR", zap.String("cidr", c), zap.Error(err))
+			w.WriteHeader(400)
+			return
+		}
+		internal[ipNet.String()] = struct{}{}
+	}
+
+	networkUsageLock.Lock()
+	defer networkUsageLock.Unlock()
+
+	for cidr := range internal {
+		// Check if the rule already exists, and add it before the catch-all rule if not.
+		if err := execFg("iptables", "-C", egressAccountingChain, "-d", cidr, "-j", "RETURN"); err == nil {
+			continue
+		}
+		if err := execFg("iptables", "-I", egressAccountingChain, "1", "-d", cidr, "-j", "RETURN"); err != nil {
+			logger.Error("could not add egress accounting rule", zap.String("cidr", cidr), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	out, err := exec.Command("iptables", "-L", egressAccountingChain, "-v", "-x", "-n").Output()
+	if err != nil {
+		logger.Error("could not list egress accounting rules", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	// Output looks like:
+	//
+	//   Chain NEONVM-EGRESS (1 references)
+	//       pkts      bytes target     prot opt in     out     source               destination
+	//         12     1480 RETURN     all  --  *      *       0.0.0.0/0            10.0.0.0/8
+	//        140    20210 RETURN     all  --  *      *       0.0.0.0/0            0.0.0.0/0
+	var resp api.NetworkUsage
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// skip the two header lines, and anything else that isn't a rule
+		if len(fields) < 9 || fields[0] == "pkts" || fields[0] == "Chain" {
+			continue
+		}
+		sent, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			logger.Error("could not parse egress accounting rule", zap.String("line", line), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+
+		dest := fields[8]
+		if dest == "0.0.0.0/0" {
+			resp.InternetBytes += sent
+		} else if _, ok := internal[dest]; ok {
+			resp.InternalBytes += sent
+		}
+	}
+
+	taps := map[string]string{defaultNetworkUsageName: defaultNetworkTapName}
+	for _, network := range networks {
+		taps[network.Name] = additionalNetworkTapName(network.Name)
+	}
+	resp.Interfaces = make(map[string]api.InterfaceUsage)
+	for name, tap := range taps {
+		link, err := netlink.LinkByName(tap)
+		if err != nil {
+			logger.Error("could not get network interface", zap.String("interface", tap), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		stats := link.Attrs().Statistics
+		if stats == nil {
+			logger.Error("network interface has no statistics", zap.String("interface", tap))
+			w.WriteHeader(500)
+			return
+		}
+		// The TAP interface is on the host side, so what it receives was sent by the VM, and what
+		// it transmits was received by the VM.
+		resp.Interfaces[name] = api.InterfaceUsage{
+			SentBytes:     stats.RxBytes,
+			ReceivedBytes: stats.TxBytes,
+		}
+	}
+
+	// The DNAT rules for the guest's ports are in the nat table, which only sees the first packet
+	// of each connection - so their packet counts are the number of connections.
+	out, err = exec.Command("iptables", "-t", "nat", "-L", "PREROUTING", "-v", "-x", "-n").Output()
+	if err != nil {
+		logger.Error("could not list DNAT rules", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	var connections uint64
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "DNAT" {
+			continue
+		}
+		pkts, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			logger.Error("could not parse DNAT rule", zap.String("line", line), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		connections += pkts
+	}
+	resp.InboundConnections = &connections
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("could not marshal body", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck // Not much to do with the error here. TODO: log it?
+}
+
+func listenForCPUChanges(
+	ctx context.Context,
+	logger *zap.Logger,
+	port int32,
+	cgroupPath string,
+	guestInfo vmv1.GuestInfo,
+	networks []vmv1.AdditionalNetwork,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	mux := http.NewServeMux()
+	loggerHandlers := logger.Named("http-handlers")
+	cpuChangeLogger := loggerHandlers.Named("cpu_change")
+	mux.HandleFunc("/cpu_change", func(w http.ResponseWriter, r *http.Request) {
+		handleCPUChange(cpuChangeLogger, w, r, cgroupPath)
+	})
+	cpuCurrentLogger := loggerHandlers.Named("cpu_current")
+	mux.HandleFunc("/cpu_current", func(w http.ResponseWriter, r *http.Request) {
+		handleCPUCurrent(cpuCurrentLogger, w, r, cgroupPath)
+	})
+	networkUsageLogger := loggerHandlers.Named("network_usage")
+	mux.HandleFunc("/network_usage", func(w http.ResponseWriter, r *http.Request) {
+		handleNetworkUsage(networkUsageLogger, w, r, networks)
+	})
+	guestInfoLogger := loggerHandlers.Named("guest_info")
+	mux.HandleFunc("/guest_info", func(w http.ResponseWriter, r *http.Request) {
+		handleGuestInfo(guestInfoLogger, w, r, guestInfo)
+	})
+	snapshotDeleteLogger := loggerHandlers.Named("snapshot_delete")
+	mux.HandleFunc("/snapshot_delete", func(w http.ResponseWriter, r *http.Request) {
+		handleSnapshotDelete(snapshotDeleteLogger, w, r)
+	})
+	consoleLogger := loggerHandlers.Named("console")
+	mux.HandleFunc("/console", func(w http.ResponseWriter, r *http.Request) {
+		handleConsole(ctx, consoleLogger, w, r)
+	})
+	server := http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%d", port),
+		Handler:           mux,
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+	}
+	errChan := make(chan error)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			logger.Info("cpu_change server closed")
+		} else if err != nil {
+			logger.Fatal("cpu_change exited with error", zap.Error(err))
+		}
+	case <-ctx.Done():
+		err := server.Shutdown(context.Background())
+		logger.Info("shut down cpu_change server", zap.Error(err))
+	}
+}
+
+func printWithNewline(slice []byte) error {
+	if len(slice) == 0 {
+		return nil
+	}
+
+	_, err := os.Stdout.Write(slice)
+	if err != nil {
+		return err
+	}
+
+	if slice[len(slice)-1] == '\n' {
+		return nil
+	}
+
+	_, err = os.Stdout.WriteString("\n")
+	return err
+}
+
+func drainLogsReader(reader *bufio.Reader, logger *zap.Logger) error {
+	for {
+		// ReadSlice actually can return no more than bufferedReaderSize bytes
+		slice, err := reader.ReadSlice('\n')
+		// If err != nil, slice might not have \n at the end
+		err2 := printWithNewline(slice)
+
+		err = errors.Join(err, err2)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				logger.Warn("EOF while reading from log serial")
+			} else {
+				logger.Error("failed to read from log serial", zap.Error(err))
+			}
+			return err
+		}
+	}
+}
+
+// forwardLogs writes from socket to stdout line by line
+func forwardLogs(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	delay := 3 * time.Second
@@ -1195,6 +1971,143 @@ func forwardLogs(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
 	}
 }
 
+// watchDisks periodically checks the contents of configMap and secret disks with .watch set,
+// sending them to the guest whenever they change. In the guest, vmdiskupdate applies the update and
+// runs the disk's hook, if there is one.
+//
+// Changes that happen before this function starts aren't detected until the next change.
+func watchDisks(ctx context.Context, logger *zap.Logger, disks []vmv1.Disk, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	type watchedDisk struct {
+		disk vmv1.Disk
+		dir  string
+		// files is the contents the guest currently has, or nil if we don't know
+		files map[string][]byte
+	}
+
+	var watched []*watchedDisk
+	for _, disk := range disks {
+		if disk.Watch == nil {
+			continue
+		}
+
+		dir := fmt.Sprintf("/vm/mounts%s", disk.MountPath)
+		files, err := readDiskFiles(dir)
+		if err != nil {
+			logger.Error("failed to read contents of watched disk", zap.String("diskName", disk.Name), zap.Error(err))
+		}
+		watched = append(watched, &watchedDisk{disk: disk, dir: dir, files: files})
+	}
+
+	if len(watched) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(diskWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, w := range watched {
+			files, err := readDiskFiles(w.dir)
+			if err != nil {
+				logger.Error("failed to read contents of watched disk", zap.String("diskName", w.disk.Name), zap.Error(err))
+				continue
+			}
+			if reflect.DeepEqual(files, w.files) {
+				continue
+			}
+
+			logger.Info("contents of watched disk changed, sending update to guest", zap.String("diskName", w.disk.Name))
+			if err := sendDiskUpdate(w.disk, files); err != nil {
+				// We'll retry on the next tick, because w.files is unchanged.
+				logger.Error("failed to send disk update to guest", zap.String("diskName", w.disk.Name), zap.Error(err))
+				continue
+			}
+			w.files = files
+		}
+	}
+}
+
+// readDiskFiles returns the contents of all files under dir, keyed by their path relative to it
+//
+// Entries starting with ".." are skipped: kubelet stores each version of a configMap or secret
+// volume in hidden directories like that, with the visible files being symlinks into them.
+func readDiskFiles(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := os.ReadDir(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "..") {
+				continue
+			}
+
+			path := filepath.Join(rel, e.Name())
+			// use os.Stat to follow symlinks
+			info, err := os.Stat(filepath.Join(dir, path))
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if err := walk(path); err != nil {
+					return err
+				}
+				continue
+			}
+
+			content, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil {
+				return err
+			}
+			files[path] = content
+		}
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// sendDiskUpdate writes the new contents of the disk to the guest's disk updates port, in the
+// line-based format expected by vmdiskupdate
+func sendDiskUpdate(disk vmv1.Disk, files map[string][]byte) error {
+	conn, err := net.DialTimeout("unix", diskUpdatesSocket, time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to dial to diskUpdatesSocket: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(diskWatchInterval)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "begin %s %s\n", disk.Name, disk.MountPath)
+	for path, content := range files {
+		// the path goes last, so that it may contain spaces
+		fmt.Fprintf(&buf, "file %s %s\n", base64.StdEncoding.EncodeToString(content), path)
+	}
+	buf.WriteString("end\n")
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write update: %w", err)
+	}
+	return nil
+}
+
 func getSelfCgroupPath(logger *zap.Logger) (string, error) {
 	// There's some fun stuff here. For general information, refer to `man 7 cgroups` - specifically
 	// the section titled "/proc files" - for "/proc/cgroups" and "/proc/pid/cgroup".
@@ -1345,6 +2258,35 @@ func setCgroupLimit(logger *zap.Logger, r vmv1.MilliCPU, cgroupPath string) erro
 	return nil
 }
 
+// setCgroupMemoryLimit sets the memory limits of the QEMU cgroup based on the VM's maximum memory,
+// returning the version of the cgroup hierarchy that the limits were set in
+func setCgroupMemoryLimit(logger *zap.Logger, vmMaxMemory uint64, cgroupPath string) (cgroup.Version, error) {
+	version, err := cgroup.DetectVersion(cgroupMountPoint)
+	if err != nil {
+		return 0, err
+	}
+
+	manager, err := cgroup.NewManager(cgroupMountPoint, version, cgroupPath)
+	if err != nil {
+		return 0, err
+	}
+
+	limits := cgroup.MemoryLimits{
+		High: vmMaxMemory + qemuMemoryOverhead,
+		Max:  vmMaxMemory + 2*qemuMemoryOverhead,
+	}
+	logger.Info(
+		"setting cgroup memory limits",
+		zap.String("version", version.String()),
+		zap.Uint64("high", limits.High),
+		zap.Uint64("max", limits.Max),
+	)
+	if err := manager.SetMemoryLimits(limits); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
 func getCgroupQuota(cgroupPath string) (*vmv1.MilliCPU, error) {
 	isV2 := cgroups.Mode() == cgroups.Unified
 	var path string
@@ -1385,7 +2327,11 @@ func processCPUs(cpus vmv1.CPUs) QemuCPUs {
 	}
 
 	var max *int
-	if cpus.Max != nil {
+	if cpus.MaxTopology != nil {
+		// The topology is declared separately, so that .max can change later.
+		val := int(*cpus.MaxTopology)
+		max = &val
+	} else if cpus.Max != nil {
 		val := int(cpus.Max.RoundedUp())
 		max = &val
 	}
@@ -1396,7 +2342,203 @@ func processCPUs(cpus vmv1.CPUs) QemuCPUs {
 	}
 }
 
-func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+// cpuPlacement gives where the vCPUs of a VM with pinned vCPUs are placed on the host
+type cpuPlacement struct {
+	// cpus are the host CPUs that the vCPUs are pinned to, in order
+	cpus []int
+	// numaNode is the host NUMA node that QEMU is restricted to, if it is
+	numaNode *int
+}
+
+// getCPUPlacement returns the host CPUs to pin the VM's vCPUs to, from the CPUs that the runner is
+// allowed to run on.
+//
+// With the kubelet's static CPU manager policy, the runner container is given pinnedCPUs exclusive
+// CPUs. Otherwise, it's allowed to run on the same CPUs as other pods, so pinning only limits
+// where the vCPUs run.
+func getCPUPlacement(logger *zap.Logger, pinnedCPUs uint32, singleNUMANode bool) (*cpuPlacement, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return nil, err
+	}
+	var allowed []int
+	for _, line := range strings.Split(string(status), "\n") {
+		if list, ok := strings.CutPrefix(line, "Cpus_allowed_list:"); ok {
+			allowed, err = parseCPUList(strings.TrimSpace(list))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse allowed CPUs: %w", err)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("could not determine allowed CPUs")
+	}
+
+	if len(allowed) != int(pinnedCPUs) {
+		logger.Warn(
+			"number of allowed CPUs is not the number of pinned vCPUs, kubelet may not be using the static CPU manager policy",
+			zap.Ints("allowedCPUs", allowed),
+			zap.Uint32("pinnedCPUs", pinnedCPUs),
+		)
+	}
+
+	placement := &cpuPlacement{cpus: allowed, numaNode: nil}
+	if !singleNUMANode {
+		return placement, nil
+	}
+
+	// Pick the NUMA node with the most of the allowed CPUs.
+	nodePaths, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var nodeCPUs []int
+	for _, path := range nodePaths {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, "cpulist"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CPUs of NUMA node %d: %w", node, err)
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CPUs of NUMA node %d: %w", node, err)
+		}
+		var onNode []int
+		for _, cpu := range allowed {
+			if slices.Contains(cpus, cpu) {
+				onNode = append(onNode, cpu)
+			}
+		}
+		if len(onNode) > len(nodeCPUs) {
+			placement.numaNode = &node
+			nodeCPUs = onNode
+		}
+	}
+	if placement.numaNode == nil {
+		logger.Warn("could not find NUMA node of allowed CPUs, not restricting VM to a single NUMA node")
+		return placement, nil
+	}
+
+	if len(nodeCPUs) != len(allowed) {
+		logger.Warn(
+			"allowed CPUs are on multiple NUMA nodes, only using those on one node",
+			zap.Int("numaNode", *placement.numaNode),
+			zap.Ints("nodeCPUs", nodeCPUs),
+		)
+	}
+	placement.cpus = nodeCPUs
+	logger.Info("using CPUs on a single NUMA node", zap.Int("numaNode", *placement.numaNode), zap.Ints("cpus", nodeCPUs))
+	return placement, nil
+}
+
+// parseCPUList parses a list of CPUs in the format used by the kernel, e.g. "0-3,8,10-11"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, err
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+func formatCPUList(cpus []int) string {
+	var parts []string
+	for _, cpu := range cpus {
+		parts = append(parts, strconv.Itoa(cpu))
+	}
+	return strings.Join(parts, ",")
+}
+
+// pinVCPUs periodically pins each of the VM's vCPU threads to one of hostCPUs, so that vCPUs
+// hotplugged after the VM starts are pinned as well
+func pinVCPUs(ctx context.Context, logger *zap.Logger, hostCPUs []int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger = logger.Named("pin-vcpus")
+
+	// thread ID -> host CPU, for the vCPU threads that have already been pinned
+	pinned := make(map[int]int)
+
+	ticker := time.NewTicker(vcpuPinningInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := pinVCPUThreads(logger, hostCPUs, pinned); err != nil {
+			logger.Warn("failed to pin vCPUs", zap.Error(err))
+		}
+	}
+}
+
+func pinVCPUThreads(logger *zap.Logger, hostCPUs []int, pinned map[int]int) error {
+	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForCPUPinning, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := mon.Connect(); err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	raw, err := mon.Run([]byte(`{"execute": "query-cpus-fast"}`))
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Return []struct {
+			CPUIndex int `json:"cpu-index"`
+			ThreadID int `json:"thread-id"`
+		} `json:"return"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	for _, vcpu := range result.Return {
+		hostCPU := hostCPUs[vcpu.CPUIndex%len(hostCPUs)]
+		if cpu, ok := pinned[vcpu.ThreadID]; ok && cpu == hostCPU {
+			continue
+		}
+
+		var set unix.CPUSet
+		set.Set(hostCPU)
+		if err := unix.SchedSetaffinity(vcpu.ThreadID, &set); err != nil {
+			return fmt.Errorf("failed to pin vCPU %d: %w", vcpu.CPUIndex, err)
+		}
+		pinned[vcpu.ThreadID] = hostCPU
+		logger.Info("pinned vCPU", zap.Int("vcpu", vcpu.CPUIndex), zap.Int("threadID", vcpu.ThreadID), zap.Int("hostCPU", hostCPU))
+	}
+	return nil
+}
+
+// terminateQemuOnSigterm requests a clean shutdown of the guest on SIGTERM, by sending it an ACPI
+// power button event.
+//
+// If guestGracePeriodSeconds is not nil, the guest is first asked to stop its workload through
+// vmshutdownagent, so that postgres is shut down cleanly before anything else in the guest, and
+// QEMU is stopped if the guest hasn't shut down within the grace period.
+func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, guestGracePeriodSeconds *int64, wg *sync.WaitGroup) {
 	logger = logger.Named("terminate-qemu-on-sigterm")
 
 	defer wg.Done()
@@ -1410,7 +2552,19 @@ func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, wg *sync.Wa
 		return
 	}
 
-	logger.Info("got signal, sending powerdown command to QEMU")
+	var deadline time.Time
+	if guestGracePeriodSeconds != nil {
+		deadline = time.Now().Add(time.Duration(*guestGracePeriodSeconds) * time.Second)
+
+		logger.Info("got signal, asking guest to shut down its workload")
+		if err := requestGuestShutdown(ctx, deadline); err != nil {
+			logger.Warn("failed to shut down guest workload, falling back to powerdown", zap.Error(err))
+		} else {
+			logger.Info("guest workload shut down")
+		}
+	}
+
+	logger.Info("sending powerdown command to QEMU")
 
 	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForSigtermHandler, 2*time.Second)
 	if err != nil {
@@ -1432,6 +2586,78 @@ func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, wg *sync.Wa
 	}
 
 	logger.Info("system_powerdown command sent to QEMU")
+
+	if guestGracePeriodSeconds == nil {
+		return
+	}
+
+	gracePeriod := time.Duration(*guestGracePeriodSeconds) * time.Second
+	select {
+	case <-ctx.Done():
+		logger.Info("QEMU exited within guest termination grace period")
+		return
+	case <-time.After(time.Until(deadline)):
+	}
+
+	logger.Warn("guest did not shut down within grace period, sending quit command to QEMU", zap.Duration("gracePeriod", gracePeriod))
+	_, err = mon.Run([]byte(`{"execute": "quit"}`))
+	if err != nil {
+		logger.Error("failed to execute quit command", zap.Error(err))
+		return
+	}
+
+	logger.Info("quit command sent to QEMU")
+}
+
+// requestGuestShutdown asks vmshutdownagent in the guest to stop the workload, and waits for it to
+// finish, until the deadline.
+//
+// Images built before vmshutdownagent existed never acknowledge the request, so we only wait
+// guestShutdownAckTimeout for that.
+func requestGuestShutdown(ctx context.Context, deadline time.Time) error {
+	conn, err := net.DialTimeout("unix", guestShutdownSocket, time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to dial to guestShutdownSocket: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock any reads if QEMU exits in the meantime
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+	if _, err := conn.Write([]byte("shutdown\n")); err != nil {
+		return fmt.Errorf("failed to write shutdown request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	expect := func(want string) error {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", want, err)
+		}
+		if got := strings.TrimSpace(line); got != want {
+			return fmt.Errorf("expected %q, got %q", want, got)
+		}
+		return nil
+	}
+
+	ackDeadline := time.Now().Add(guestShutdownAckTimeout)
+	if ackDeadline.Before(deadline) {
+		if err := conn.SetReadDeadline(ackDeadline); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+	}
+	if err := expect("ack"); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	return expect("done")
 }
 
 func calcIPs(cidr string) (net.IP, net.IP, net.IPMask, error) {
@@ -1553,6 +2779,24 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		return nil, err
 	}
 
+	// count outgoing traffic, so that it can be classified by destination for billing.
+	//
+	// The chain ends with a catch-all rule; rules for internal destinations are inserted before it
+	// on demand, by handleNetworkUsage.
+	logger.Info("setup accounting for outgoing traffic")
+	if err := execFg("iptables", "-N", egressAccountingChain); err != nil {
+		logger.Error("could not create egress accounting chain", zap.Error(err))
+		return nil, err
+	}
+	if err := execFg("iptables", "-A", egressAccountingChain, "-j", "RETURN"); err != nil {
+		logger.Error("could not set up catch-all egress accounting rule", zap.Error(err))
+		return nil, err
+	}
+	if err := execFg("iptables", "-A", "FORWARD", "-i", defaultNetworkBridgeName, "-o", "eth0", "-j", egressAccountingChain); err != nil {
+		logger.Error("could not set up jump to egress accounting chain", zap.Error(err))
+		return nil, err
+	}
+
 	// pass incoming traffic to .Guest.Spec.Ports into VM
 	var iptablesArgs []string
 	for _, port := range ports {
@@ -1660,62 +2904,161 @@ func overlayNetwork(iface string) (mac.MAC, error) {
 		return nil, err
 	}
 
+	if err := bridgePodInterface(overlayNetworkBridgeName, overlayNetworkTapName, iface); err != nil {
+		return nil, err
+	}
+
+	return mac, nil
+}
+
+// bridgePodInterface connects the pod's network interface iface to a new TAP interface for the
+// VM, through a new bridge. Any IPv4 addresses are removed from iface, so that they can be used by
+// the VM instead.
+func bridgePodInterface(bridgeName string, tapName string, iface string) error {
 	// create and configure linux bridge
 	bridge := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: overlayNetworkBridgeName,
+			Name: bridgeName,
 			Protinfo: &netlink.Protinfo{
 				Learning: false,
 			},
 		},
 	}
 	if err := netlink.LinkAdd(bridge); err != nil {
-		return nil, err
+		return err
 	}
 	if err := netlink.LinkSetUp(bridge); err != nil {
-		return nil, err
+		return err
 	}
 
 	// create an configure TAP interface
 	tap := &netlink.Tuntap{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: overlayNetworkTapName,
+			Name: tapName,
 		},
 		Mode:  netlink.TUNTAP_MODE_TAP,
 		Flags: netlink.TUNTAP_DEFAULTS,
 	}
 	if err := netlink.LinkAdd(tap); err != nil {
-		return nil, err
+		return err
 	}
 	if err := netlink.LinkSetMaster(tap, bridge); err != nil {
-		return nil, err
+		return err
 	}
 	if err := netlink.LinkSetUp(tap); err != nil {
-		return nil, err
+		return err
 	}
 
-	// add overlay interface to bridge as well
-	overlayLink, err := netlink.LinkByName(iface)
+	// add pod interface to bridge as well
+	podLink, err := netlink.LinkByName(iface)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// firsly delete IP address(es) (it it exist) from overlay interface
-	overlayAddrs, err := netlink.AddrList(overlayLink, netlink.FAMILY_V4)
+	// firsly delete IP address(es) (it it exist) from pod interface
+	podAddrs, err := netlink.AddrList(podLink, netlink.FAMILY_V4)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, a := range overlayAddrs {
+	for _, a := range podAddrs {
 		ip := a.IPNet
 		if ip != nil {
-			if err := netlink.AddrDel(overlayLink, &a); err != nil {
-				return nil, err
+			if err := netlink.AddrDel(podLink, &a); err != nil {
+				return err
 			}
 		}
 	}
-	// and now add overlay link to bridge
-	if err := netlink.LinkSetMaster(overlayLink, bridge); err != nil {
-		return nil, err
+	// and now add pod link to bridge
+	if err := netlink.LinkSetMaster(podLink, bridge); err != nil {
+		return err
 	}
 
-	return mac, nil
+	return nil
+}
+
+// additionalNetwork is one of .spec.additionalNetworks, prepared for the VM
+type additionalNetwork struct {
+	name string
+	// podIface is the runner pod's interface for the network, created by Multus
+	podIface string
+	// tap is the interface that QEMU uses for the VM's interface on the network. Its statistics
+	// are reported by handleNetworkUsage.
+	tap    string
+	bridge string
+	mac    mac.MAC
+	// addrs are the IPv4 addresses that were assigned to podIface, which are moved into the VM
+	addrs []*net.IPNet
+}
+
+func additionalNetworkTapName(name string) string {
+	return fmt.Sprintf("%s%s", additionalNetworkTapPrefix, name)
+}
+
+// prepareAdditionalNetworks generates the MAC address for each of the VM's additional networks,
+// and reads the addresses that the VM should use from the pod's interfaces, before they're bridged
+// by setupAdditionalNetworks.
+func prepareAdditionalNetworks(networks []vmv1.AdditionalNetwork) ([]additionalNetwork, error) {
+	var prepared []additionalNetwork
+	for _, network := range networks {
+		mac, err := mac.GenerateRandMAC()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate random MAC for network %s: %w", network.Name, err)
+		}
+
+		link, err := netlink.LinkByName(network.PodInterface())
+		if err != nil {
+			return nil, fmt.Errorf("could not find interface %s for network %s: %w", network.PodInterface(), network.Name, err)
+		}
+		linkAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("could not list addresses of interface %s: %w", network.PodInterface(), err)
+		}
+		var addrs []*net.IPNet
+		for _, a := range linkAddrs {
+			if a.IPNet != nil {
+				addrs = append(addrs, a.IPNet)
+			}
+		}
+
+		prepared = append(prepared, additionalNetwork{
+			name:     network.Name,
+			podIface: network.PodInterface(),
+			tap:      additionalNetworkTapName(network.Name),
+			bridge:   fmt.Sprintf("%s%s", additionalNetworkBridgePrefix, network.Name),
+			mac:      mac,
+			addrs:    addrs,
+		})
+	}
+	return prepared, nil
+}
+
+// setupAdditionalNetworks bridges the pod's interface for each additional network to the VM
+func setupAdditionalNetworks(logger *zap.Logger, networks []additionalNetwork) error {
+	for _, n := range networks {
+		logger.Info("setup additional network", zap.String("name", n.name), zap.String("interface", n.podIface))
+		if err := bridgePodInterface(n.bridge, n.tap, n.podIface); err != nil {
+			return fmt.Errorf("could not set up network %s: %w", n.name, err)
+		}
+	}
+	return nil
+}
+
+// gpuPCIAddresses returns the PCI addresses of the GPUs that the device plugin gave to the runner
+// container, checking that there's as many as the VM should have
+func gpuPCIAddresses(gpus *vmv1.GPUs) ([]string, error) {
+	envVar := gpus.PCIAddressEnvVar()
+	value, ok := os.LookupEnv(envVar)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("environment variable %s missing", envVar)
+	}
+
+	var addresses []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) != int(gpus.Count) {
+		return nil, fmt.Errorf("expected %d GPUs in %s, got %d: %q", gpus.Count, envVar, len(addresses), value)
+	}
+	return addresses, nil
 }
@@ -13,3 +13,9 @@
 chmod 666 /dev/vport0p1
 mkdir -p /dev/virtio-ports
 ln -s /dev/vport0p1 /dev/virtio-ports/tech.neon.log.0
+
+# serial port for updates to watched disks, only present if the VM has any.
+if [ -e /dev/vport0p2 ]; then
+    chmod 600 /dev/vport0p2
+    ln -s /dev/vport0p2 /dev/virtio-ports/tech.neon.disks.0
+fi
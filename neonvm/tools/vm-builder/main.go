@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -37,6 +38,10 @@ var (
 	scriptVmAcpi string
 	//go:embed files/vmshutdown
 	scriptVmShutdown string
+	//go:embed files/vmdiskupdate
+	scriptVmDiskUpdate string
+	//go:embed files/vmshutdownagent
+	scriptVmShutdownAgent string
 	//go:embed files/vminit
 	scriptVmInit string
 	//go:embed files/udev-init.sh
@@ -49,6 +54,15 @@ var (
 	configChrony string
 	//go:embed files/sshd_config
 	configSshd string
+	//go:embed files/70-rootdisk-resize.rules
+	configUdevRootDiskResize string
+)
+
+// Versions of the daemons that we add to the image. These are also recorded in the image, so that
+// they can be reported in the VM's status.
+const (
+	busyboxVersion = "1.35.0"
+	vectorVersion  = "0.26.0"
 )
 
 var (
@@ -102,12 +116,22 @@ type TemplatesContext struct {
 	Env           []string
 	RootDiskImage string
 
+	BusyboxVersion string
+	VectorVersion  string
+
 	SpecBuild       string
 	SpecMerge       string
 	InittabCommands []inittabCommand
 	ShutdownHook    string
 }
 
+// guestVersions is the format of versions.json, which is added to the final image next to the disk
+// and read by neonvm-runner when the VM starts.
+type guestVersions struct {
+	VmBuilder string            `json:"vmBuilder"`
+	Daemons   map[string]string `json:"daemons"`
+}
+
 type inittabCommand struct {
 	SysvInitAction      string
 	CommandUser         string
@@ -216,6 +240,9 @@ func main() {
 		Env:           imageSpec.Config.Env,
 		RootDiskImage: *srcImage,
 
+		BusyboxVersion: busyboxVersion,
+		VectorVersion:  vectorVersion,
+
 		SpecBuild:       "",  // overridden below if spec != nil
 		SpecMerge:       "",  // overridden below if spec != nil
 		InittabCommands: nil, // overridden below if spec != nil
@@ -272,12 +299,15 @@ func main() {
 		{"Dockerfile", dockerfileVmBuilder},
 		{"vmstart", scriptVmStart},
 		{"vmshutdown", scriptVmShutdown},
+		{"vmdiskupdate", scriptVmDiskUpdate},
+		{"vmshutdownagent", scriptVmShutdownAgent},
 		{"inittab", scriptInitTab},
 		{"vmacpi", scriptVmAcpi},
 		{"vminit", scriptVmInit},
 		{"vector.yaml", configVector},
 		{"chrony.conf", configChrony},
 		{"sshd_config", configSshd},
+		{"70-rootdisk-resize.rules", configUdevRootDiskResize},
 		{"udev-init.sh", scriptUdevInit},
 		{"resize-swap.sh", scriptResizeSwap},
 	}
@@ -288,6 +318,20 @@ func main() {
 		}
 	}
 
+	versions, err := json.Marshal(guestVersions{
+		VmBuilder: Version,
+		Daemons: map[string]string{
+			"busybox": busyboxVersion,
+			"vector":  vectorVersion,
+		},
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := addFileToTar(tw, "versions.json", versions); err != nil {
+		log.Fatalln(err)
+	}
+
 	buildArgs := make(map[string]*string)
 	buildArgs["DISK_SIZE"] = size
 	opt := types.ImageBuildOptions{
@@ -0,0 +1,339 @@
+package agent
+
+// Kubernetes Events for persistent problems, so that they're visible with 'kubectl describe'
+// instead of only in the autoscaler-agent's logs.
+//
+// Each problem is tracked separately. A Warning Event is posted when it crosses the configured
+// threshold, and a Normal Event once it's resolved - so an ongoing problem produces one Event, not
+// one per failure.
+//
+// Events are always posted on the VirtualMachine objects, because that's where users look. Problems
+// that aren't specific to a single VM, like billing pushes failing, are posted on every VM that
+// this autoscaler-agent is responsible for.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// Reasons for the Events that we post
+const (
+	eventReasonScalingRepeatedlyDenied = "ScalingRepeatedlyDenied"
+	eventReasonScalingAllowed          = "ScalingAllowed"
+	eventReasonMetricsUnreachable      = "MetricsUnreachable"
+	eventReasonMetricsReachable        = "MetricsReachable"
+	eventReasonBillingPushFailing      = "BillingPushFailing"
+	eventReasonBillingPushRecovered    = "BillingPushRecovered"
+	eventReasonVMStoreFailing          = "VMStoreFailing"
+	eventReasonVMStoreRecovered        = "VMStoreRecovered"
+	eventReasonHostContention          = "HostContention"
+	eventReasonHostContentionResolved  = "HostContentionResolved"
+)
+
+var _ billing.StatusReporter = (*nodeAnomalies)(nil)
+
+// nodeAnomalies tracks problems that affect the whole node, posting Events on each VM on the node
+type nodeAnomalies struct {
+	config   *AnomalyEventsConfig
+	recorder record.EventRecorder
+	// listVMs returns the VMs that Events are posted on. It must not call into nodeAnomalies.
+	listVMs func() []util.NamespacedName
+
+	mu sync.Mutex
+	// pushFailures gives the number of consecutive failed pushes for each billing client
+	pushFailures map[string]uint
+	// storeFailingPosted is true if we've posted that the VM store is failing, and haven't yet
+	// posted that it recovered
+	storeFailingPosted bool
+}
+
+func newNodeAnomalies(
+	config *AnomalyEventsConfig,
+	recorder record.EventRecorder,
+	listVMs func() []util.NamespacedName,
+) *nodeAnomalies {
+	return &nodeAnomalies{
+		config:             config,
+		recorder:           recorder,
+		listVMs:            listVMs,
+		mu:                 sync.Mutex{},
+		pushFailures:       make(map[string]uint),
+		storeFailingPosted: false,
+	}
+}
+
+// currentVMs returns the VMs that the autoscaler-agent is currently responsible for
+func (s *agentState) currentVMs() []util.NamespacedName {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var vms []util.NamespacedName
+	for _, pod := range s.pods {
+		func() {
+			pod.status.mu.Lock()
+			defer pod.status.mu.Unlock()
+
+			if !pod.status.deleted {
+				vms = append(vms, pod.status.vmInfo.NamespacedName())
+			}
+		}()
+	}
+	return vms
+}
+
+// postOnAllVMs posts the Event on each VM on the node
+//
+// It must be called without holding a.mu, because listing the VMs may need to wait on other locks.
+func (a *nodeAnomalies) postOnAllVMs(eventType, reason, messageFmt string, args ...any) {
+	for _, vm := range a.listVMs() {
+		a.recorder.Eventf(vmObjectReference(vm), eventType, reason, messageFmt, args...)
+	}
+}
+
+// VMStoreFailing implements billing.StatusReporter
+func (a *nodeAnomalies) VMStoreFailing(outage time.Duration) {
+	post := func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if a.storeFailingPosted || outage < time.Second*time.Duration(a.config.VMStoreFailingSeconds) {
+			return false
+		}
+		a.storeFailingPosted = true
+		return true
+	}()
+
+	if post {
+		a.postOnAllVMs(
+			corev1.EventTypeWarning, eventReasonVMStoreFailing,
+			"VM store has been failing for %s; billing events may be incomplete", outage.Round(time.Second),
+		)
+	}
+}
+
+// VMStoreRecovered implements billing.StatusReporter
+func (a *nodeAnomalies) VMStoreRecovered() {
+	post := func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		posted := a.storeFailingPosted
+		a.storeFailingPosted = false
+		return posted
+	}()
+
+	if post {
+		a.postOnAllVMs(corev1.EventTypeNormal, eventReasonVMStoreRecovered, "VM store has recovered")
+	}
+}
+
+// QueueSize implements billing.StatusReporter
+func (a *nodeAnomalies) QueueSize(client string, size int) {
+	// Backlogs are reported by the health server instead
+}
+
+// PushResult implements billing.StatusReporter
+func (a *nodeAnomalies) PushResult(client string, err error) {
+	failures := func() uint {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if err == nil {
+			failures := a.pushFailures[client]
+			delete(a.pushFailures, client)
+			return failures
+		}
+		a.pushFailures[client] += 1
+		return a.pushFailures[client]
+	}()
+
+	if err == nil && failures >= a.config.BillingPushFailuresThreshold {
+		a.postOnAllVMs(
+			corev1.EventTypeNormal, eventReasonBillingPushRecovered,
+			"Pushing billing events to %q succeeded after %d failures", client, failures,
+		)
+	} else if err != nil && failures == a.config.BillingPushFailuresThreshold {
+		a.postOnAllVMs(
+			corev1.EventTypeWarning, eventReasonBillingPushFailing,
+			"Pushing billing events to %q has failed %d times in a row: %s", client, failures, err,
+		)
+	}
+}
+
+// vmAnomalies tracks problems with a single VM, for the Runner
+type vmAnomalies struct {
+	mu sync.Mutex
+	// deniedUpscales gives the number of consecutive upscales that the scheduler plugin denied
+	deniedUpscales uint
+	// metricsFailingSince is the time of the first failed metrics request since the last
+	// successful one, or nil if the last request was successful
+	metricsFailingSince *time.Time
+	// metricsFailingPosted is true if we've posted that metrics are unreachable, and haven't yet
+	// posted that they're reachable again
+	metricsFailingPosted bool
+	// hostContentionPosted is true if we've posted that the VM's CPUs are being stolen by the
+	// host, and haven't yet posted that it's resolved
+	hostContentionPosted bool
+}
+
+func newVMAnomalies() *vmAnomalies {
+	return &vmAnomalies{
+		mu:                   sync.Mutex{},
+		deniedUpscales:       0,
+		metricsFailingSince:  nil,
+		metricsFailingPosted: false,
+		hostContentionPosted: false,
+	}
+}
+
+// metricsFailing returns whether the most recent metrics request for the VM failed
+func (a *vmAnomalies) metricsFailing() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.metricsFailingSince != nil
+}
+
+// anomalyEventsEnabled returns whether Events should be posted for problems with the VM
+func (r *Runner) anomalyEventsEnabled() bool {
+	return r.global.config.AnomalyEvents != nil && r.global.eventRecorder != nil
+}
+
+func (r *Runner) vmObjectReference() *corev1.ObjectReference {
+	return vmObjectReference(r.vmName)
+}
+
+func vmObjectReference(vm util.NamespacedName) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:       "VirtualMachine",
+		APIVersion: vmapi.SchemeGroupVersion.String(),
+		Namespace:  vm.Namespace,
+		Name:       vm.Name,
+	}
+}
+
+// checkRepeatedDenials updates the count of consecutive denied upscales with the decision, posting
+// an Event if the threshold is reached
+func (r *Runner) checkRepeatedDenials(decision executor.Decision) {
+	if !r.anomalyEventsEnabled() {
+		return
+	}
+
+	a := r.anomalies
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	threshold := r.global.config.AnomalyEvents.RepeatedDenialsThreshold
+
+	switch decision.Outcome {
+	case executor.DecisionDenied:
+		a.deniedUpscales += 1
+		if a.deniedUpscales == threshold {
+			r.global.eventRecorder.Eventf(
+				r.vmObjectReference(), corev1.EventTypeWarning, eventReasonScalingRepeatedlyDenied,
+				"Scheduler denied %d upscales in a row, most recently %.2f CU -> %.2f CU (scheduler: %s)",
+				a.deniedUpscales, decision.PreviousCU, decision.TargetCU, decision.SchedulerVerdict,
+			)
+		}
+	case executor.DecisionApplied:
+		if a.deniedUpscales >= threshold {
+			r.global.eventRecorder.Eventf(
+				r.vmObjectReference(), corev1.EventTypeNormal, eventReasonScalingAllowed,
+				"Scaling to %.2f CU succeeded after %d denied upscales", decision.TargetCU, a.deniedUpscales,
+			)
+		}
+		a.deniedUpscales = 0
+	default:
+		// Failed requests don't tell us anything about whether the scheduler would allow it
+	}
+}
+
+// checkMetricsUnreachable updates the state of metrics requests with the result of the latest one,
+// posting an Event if they've been failing for too long, or have recovered
+//
+// The state is updated even if Events aren't enabled, because it's also used for the health
+// server.
+func (r *Runner) checkMetricsUnreachable(err error) {
+	a := r.anomalies
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err == nil {
+		if a.metricsFailingPosted {
+			r.global.eventRecorder.Eventf(
+				r.vmObjectReference(), corev1.EventTypeNormal, eventReasonMetricsReachable,
+				"Metrics are reachable again after %s", time.Since(*a.metricsFailingSince).Round(time.Second),
+			)
+		}
+		a.metricsFailingSince = nil
+		a.metricsFailingPosted = false
+		return
+	}
+
+	now := time.Now()
+	if a.metricsFailingSince == nil {
+		a.metricsFailingSince = &now
+	}
+	if !r.anomalyEventsEnabled() {
+		return
+	}
+
+	threshold := time.Second * time.Duration(r.global.config.AnomalyEvents.MetricsUnreachableSeconds)
+	if outage := now.Sub(*a.metricsFailingSince); !a.metricsFailingPosted && outage >= threshold {
+		a.metricsFailingPosted = true
+		r.global.eventRecorder.Eventf(
+			r.vmObjectReference(), corev1.EventTypeWarning, eventReasonMetricsUnreachable,
+			"Metrics have been unreachable for %s: %s", outage.Round(time.Second), err,
+		)
+	}
+}
+
+// checkHostContention updates whether the VM's CPUs are being stolen by the host with its latest
+// metrics, posting an Event if the steal time has crossed the threshold, or gone back below it
+//
+// Unlike throttling, steal time isn't fixed by scaling up: the host can't keep up with the CPUs
+// that the VM already has. So the Event is there to explain why upscaling isn't helping.
+func (r *Runner) checkHostContention(contention *core.HostContentionMetrics) {
+	if !r.anomalyEventsEnabled() || r.global.config.AnomalyEvents.HostContentionStealFraction == 0 {
+		return
+	} else if contention == nil || contention.StealFraction == nil {
+		return
+	}
+
+	a := r.anomalies
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	threshold := r.global.config.AnomalyEvents.HostContentionStealFraction
+	steal := float64(*contention.StealFraction)
+
+	if steal >= threshold && !a.hostContentionPosted {
+		a.hostContentionPosted = true
+		r.global.metrics.hostContentionEvents.Inc()
+
+		throttled := "unknown"
+		if contention.ThrottledFraction != nil {
+			throttled = fmt.Sprintf("%.1f%%", *contention.ThrottledFraction*100)
+		}
+		r.global.eventRecorder.Eventf(
+			r.vmObjectReference(), corev1.EventTypeWarning, eventReasonHostContention,
+			"CPU steal time is %.1f%% (throttled: %s); the host is oversubscribed, so scaling up won't help",
+			steal*100, throttled,
+		)
+	} else if steal < threshold && a.hostContentionPosted {
+		a.hostContentionPosted = false
+		r.global.eventRecorder.Eventf(
+			r.vmObjectReference(), corev1.EventTypeNormal, eventReasonHostContentionResolved,
+			"CPU steal time is back down to %.1f%%", steal*100,
+		)
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// postedEvent is an Event recorded by eventLog
+type postedEvent struct {
+	object    util.NamespacedName
+	kind      string
+	eventType string
+	reason    string
+	message   string
+}
+
+// eventLog is a record.EventRecorder that keeps the Events, so that tests can check which object
+// each one was posted on
+type eventLog struct {
+	events []postedEvent
+}
+
+func (l *eventLog) Event(object runtime.Object, eventType, reason, message string) {
+	ref := object.(*corev1.ObjectReference)
+	l.events = append(l.events, postedEvent{
+		object:    util.NamespacedName{Namespace: ref.Namespace, Name: ref.Name},
+		kind:      ref.Kind,
+		eventType: eventType,
+		reason:    reason,
+		message:   message,
+	})
+}
+
+func (l *eventLog) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	l.Event(object, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (l *eventLog) AnnotatedEventf(object runtime.Object, _ map[string]string, eventType, reason, messageFmt string, args ...any) {
+	l.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// reasons returns the reason for each Event posted on the VM
+func (l *eventLog) reasons(vm util.NamespacedName) []string {
+	var reasons []string
+	for _, e := range l.events {
+		if e.object == vm {
+			reasons = append(reasons, e.reason)
+		}
+	}
+	return reasons
+}
+
+func TestNodeAnomaliesPostedOnVMs(t *testing.T) {
+	vmA := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+	vmB := util.NamespacedName{Namespace: "other", Name: "vm-b"}
+	vms := []util.NamespacedName{vmA, vmB}
+
+	config := &AnomalyEventsConfig{
+		RepeatedDenialsThreshold:     3,
+		MetricsUnreachableSeconds:    60,
+		BillingPushFailuresThreshold: 2,
+		VMStoreFailingSeconds:        60,
+		HostContentionStealFraction:  0,
+	}
+	log := &eventLog{events: nil}
+	a := newNodeAnomalies(config, log, func() []util.NamespacedName { return vms })
+
+	// Failed pushes are only posted once the threshold is reached, and then only once
+	a.PushResult("http", errors.New("connection refused"))
+	assert.Empty(t, log.events)
+	a.PushResult("http", errors.New("connection refused"))
+	a.PushResult("http", errors.New("connection refused"))
+	a.PushResult("http", nil)
+
+	// Outages of the VM store shorter than the threshold aren't posted
+	a.VMStoreFailing(30 * time.Second)
+	a.VMStoreRecovered()
+	a.VMStoreFailing(90 * time.Second)
+	a.VMStoreFailing(120 * time.Second)
+	a.VMStoreRecovered()
+
+	// Every Event was posted on each VM, and nothing else
+	expected := []string{
+		eventReasonBillingPushFailing,
+		eventReasonBillingPushRecovered,
+		eventReasonVMStoreFailing,
+		eventReasonVMStoreRecovered,
+	}
+	assert.Equal(t, expected, log.reasons(vmA))
+	assert.Equal(t, expected, log.reasons(vmB))
+	assert.Len(t, log.events, 2*len(expected))
+	for _, e := range log.events {
+		assert.Equal(t, "VirtualMachine", e.kind)
+	}
+
+	// VMs that have since been added get later Events too
+	vmC := util.NamespacedName{Namespace: "default", Name: "vm-c"}
+	vms = append(vms, vmC)
+	a.PushResult("s3", errors.New("access denied"))
+	a.PushResult("s3", errors.New("access denied"))
+	assert.Equal(t, []string{eventReasonBillingPushFailing}, log.reasons(vmC))
+}
+
+func TestHostContentionEvents(t *testing.T) {
+	vm := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+	config := &AnomalyEventsConfig{
+		RepeatedDenialsThreshold:     0,
+		MetricsUnreachableSeconds:    0,
+		BillingPushFailuresThreshold: 0,
+		VMStoreFailingSeconds:        0,
+		HostContentionStealFraction:  0.1,
+	}
+	log := &eventLog{events: nil}
+	metrics, _ := makeGlobalMetrics()
+	r := &Runner{ //nolint:exhaustruct // only the fields for posting Events are used
+		global: &agentState{ //nolint:exhaustruct // only the fields for posting Events are used
+			config:        &Config{AnomalyEvents: config}, //nolint:exhaustruct // only the anomaly config is used
+			metrics:       metrics,
+			eventRecorder: log,
+		},
+		vmName:    vm,
+		anomalies: newVMAnomalies(),
+	}
+
+	check := func(steal *float32, throttled *float32) {
+		r.checkHostContention(&core.HostContentionMetrics{StealFraction: steal, ThrottledFraction: throttled})
+	}
+	fraction := func(f float32) *float32 { return &f }
+
+	// Steal time below the threshold, or unknown, isn't posted
+	check(fraction(0.05), fraction(0.5))
+	check(nil, fraction(0.5))
+	r.checkHostContention(nil)
+	assert.Empty(t, log.events)
+
+	// Crossing the threshold posts a Warning, once
+	check(fraction(0.125), fraction(0.05))
+	check(fraction(0.2), fraction(0.05))
+	require.Len(t, log.events, 1)
+	assert.Equal(t, postedEvent{
+		object:    vm,
+		kind:      "VirtualMachine",
+		eventType: corev1.EventTypeWarning,
+		reason:    eventReasonHostContention,
+		message:   "CPU steal time is 12.5% (throttled: 5.0%); the host is oversubscribed, so scaling up won't help",
+	}, log.events[0])
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.hostContentionEvents))
+
+	// Unknown steal time doesn't resolve it, but going back below the threshold does
+	check(nil, nil)
+	check(fraction(0.02), nil)
+	require.Len(t, log.events, 2)
+	assert.Equal(t, postedEvent{
+		object:    vm,
+		kind:      "VirtualMachine",
+		eventType: corev1.EventTypeNormal,
+		reason:    eventReasonHostContentionResolved,
+		message:   "CPU steal time is back down to 2.0%",
+	}, log.events[1])
+	check(fraction(0.01), nil)
+	assert.Len(t, log.events, 2)
+
+	// Each new period of contention is posted, even if throttling isn't known
+	check(fraction(0.3), nil)
+	require.Len(t, log.events, 3)
+	assert.Equal(t, eventReasonHostContention, log.events[2].reason)
+	assert.Contains(t, log.events[2].message, "(throttled: unknown)")
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.hostContentionEvents))
+
+	// A threshold of zero disables the Events
+	config.HostContentionStealFraction = 0
+	check(fraction(0.01), nil)
+	check(fraction(0.9), nil)
+	assert.Len(t, log.events, 3)
+}
@@ -0,0 +1,77 @@
+package billing
+
+// Alternative definitions of when a VM is "active", for the active time metric.
+//
+// By default, a VM is active whenever it's alive. With the "databaseActivity" mode, it's only
+// active if the database inside it has been doing something recently, so that idle databases that
+// are kept running (e.g. because suspension is disabled) aren't counted as active compute.
+
+import (
+	"time"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type ActiveTimeConfig struct {
+	// Mode gives what makes a VM count as active
+	Mode ActiveTimeMode `json:"mode"`
+	// IdleAfterSeconds, with the "databaseActivity" mode, gives how long after the database was
+	// last active that the VM stops counting as active.
+	IdleAfterSeconds uint `json:"idleAfterSeconds,omitempty"`
+}
+
+type ActiveTimeMode string
+
+const (
+	// ActiveTimeVMAlive counts VMs as active whenever they're alive. This is the default.
+	ActiveTimeVMAlive ActiveTimeMode = "vmAlive"
+	// ActiveTimeDatabaseActivity counts VMs as active only while the database inside has active
+	// backends or is committing transactions, or did so within the last IdleAfterSeconds.
+	//
+	// This requires metrics from Postgres inside the VM. VMs that haven't reported any are
+	// counted as active whenever they're alive, so that a missing signal doesn't under-count.
+	ActiveTimeDatabaseActivity ActiveTimeMode = "databaseActivity"
+)
+
+// Valid returns whether m is one of the known active time modes
+func (m ActiveTimeMode) Valid() bool {
+	switch m {
+	case ActiveTimeVMAlive, ActiveTimeDatabaseActivity:
+		return true
+	default:
+		return false
+	}
+}
+
+// DatabaseActivitySource gives the most recent database activity in each VM, from the metrics
+// collected from inside it
+type DatabaseActivitySource interface {
+	// LastDatabaseActivity returns the last time that each VM's database was seen to be active.
+	// VMs that have reported database metrics but were never active have a nil time; VMs that
+	// haven't reported any are not included.
+	LastDatabaseActivity() map[util.NamespacedName]*time.Time
+}
+
+// refreshDatabaseActivity fetches the latest database activity, if it's used to determine active
+// time
+func (s *metricsState) refreshDatabaseActivity() {
+	s.databaseActivity = nil
+	if s.activeTime != nil && s.activeTime.Mode == ActiveTimeDatabaseActivity && s.activitySource != nil {
+		s.databaseActivity = s.activitySource.LastDatabaseActivity()
+	}
+}
+
+// idleSince returns whether the VM's database was idle for the whole time from since until the
+// latest collection, meaning that time shouldn't count as active.
+func (s *metricsState) idleSince(vm *vmapi.VirtualMachine, since time.Time) bool {
+	if s.databaseActivity == nil {
+		return false
+	}
+	lastActive, ok := s.databaseActivity[util.GetNamespacedName(vm)]
+	if !ok {
+		return false
+	}
+	idleAfter := time.Second * time.Duration(s.activeTime.IdleAfterSeconds)
+	return lastActive == nil || lastActive.Add(idleAfter).Before(since)
+}
@@ -0,0 +1,90 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type fakeActivitySource map[util.NamespacedName]*time.Time
+
+func (f fakeActivitySource) LastDatabaseActivity() map[util.NamespacedName]*time.Time {
+	return f
+}
+
+func TestIdleSince(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	vm := func(name string) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.Namespace = "default"
+		vm.Name = name
+		return vm
+	}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.activeTime = &ActiveTimeConfig{Mode: ActiveTimeDatabaseActivity, IdleAfterSeconds: 60}
+	s.activitySource = fakeActivitySource{
+		{Namespace: "default", Name: "recent"}: ago(90 * time.Second),
+		{Namespace: "default", Name: "old"}:    ago(time.Hour),
+		{Namespace: "default", Name: "never"}:  nil,
+	}
+	s.refreshDatabaseActivity()
+
+	since := now.Add(-2 * time.Minute)
+	// Active within IdleAfterSeconds of the start of the slice
+	assert.False(t, s.idleSince(vm("recent"), since))
+	assert.True(t, s.idleSince(vm("old"), since))
+	assert.True(t, s.idleSince(vm("never"), since))
+	// VMs without database metrics are always active
+	assert.False(t, s.idleSince(vm("unknown"), since))
+
+	// ... as are all VMs, without the databaseActivity mode
+	s.activeTime.Mode = ActiveTimeVMAlive
+	s.refreshDatabaseActivity()
+	assert.False(t, s.idleSince(vm("never"), since))
+}
+
+func TestIdleTimeSliceNotActive(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	slice := func(from, to time.Duration, idle bool) metricsTimeSlice {
+		return metricsTimeSlice{
+			metrics: vmMetricsInstant{
+				cpu:               1000,
+				mem:               0,
+				gpus:              0,
+				idle:              idle,
+				egress:            nil,
+				egressUnavailable: false,
+				containerCPU:      nil,
+				burstBaselineCU:   0,
+				usedCPU:           0,
+				usedMem:           0,
+			},
+			startTime: start.Add(from),
+			endTime:   start.Add(to),
+		}
+	}
+
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+
+	var h vmMetricsHistory
+	h.appendSlice(slice(0, 10*time.Second, false), computeUnit)
+	h.appendSlice(slice(10*time.Second, 30*time.Second, true), computeUnit)
+	h.appendSlice(slice(30*time.Second, 35*time.Second, false), computeUnit)
+	h.finalizeCurrentTimeSlice(computeUnit)
+
+	// CPU is still counted while idle, but active time isn't
+	assert.Equal(t, 15*time.Second, h.total.activeTime)
+	assert.InDelta(t, 35.0, h.total.cpu, 1e-9)
+}
@@ -0,0 +1,31 @@
+package billing
+
+// Counting of the scale-ups and scale-downs of each endpoint, sent through the billing pipeline so
+// that scaling activity can be correlated with usage without a separate telemetry path.
+
+import (
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+type ScalingActivityConfig struct {
+	// UpscaleMetricName is the name of the metric for the number of times each endpoint was scaled
+	// up during the window
+	UpscaleMetricName string `json:"upscaleMetricName"`
+	// DownscaleMetricName is the name of the metric for the number of times each endpoint was
+	// scaled down during the window
+	DownscaleMetricName string `json:"downscaleMetricName"`
+}
+
+// addScalingActivity counts the change in the VM's compute units between the two instants as a
+// scale-up or scale-down, if there was one.
+//
+// Changes are only seen at the granularity of collection, so a VM that was scaled up and back down
+// between two collections isn't counted at all.
+func (s *vmMetricsSeconds) addScalingActivity(old, present vmMetricsInstant, computeUnit api.Resources) {
+	oldCU, presentCU := old.computeUnits(computeUnit), present.computeUnits(computeUnit)
+	if presentCU > oldCU {
+		s.upscales += 1
+	} else if presentCU < oldCU {
+		s.downscales += 1
+	}
+}
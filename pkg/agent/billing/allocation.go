@@ -0,0 +1,276 @@
+package billing
+
+// HTTP API serving the resource allocation of each endpoint in the shape of OpenCost's allocation
+// API, so that existing cost dashboards can consume it directly.
+//
+// For more, see: https://www.opencost.io/docs/integrations/api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type AllocationConfig struct {
+	// Port is the port to serve the allocation API on
+	Port uint16 `json:"port"`
+	// RetentionHours gives the number of hours of allocation history to keep, which is the largest
+	// window that can be requested.
+	RetentionHours uint `json:"retentionHours"`
+}
+
+// allocationStore keeps the total allocation of each endpoint, in hourly buckets
+type allocationStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	// clock gives the time that queries are relative to, matching the time of the recorded slices
+	clock util.Clock
+	// buckets maps from the start of each hour to the allocation during that hour
+	buckets map[time.Time]map[allocationKey]*allocationTotals
+}
+
+type allocationKey struct {
+	namespace  string
+	endpointID string
+}
+
+type allocationTotals struct {
+	cpuCoreSeconds float64
+	ramByteSeconds float64
+}
+
+func newAllocationStore(conf *AllocationConfig, clock util.Clock) *allocationStore {
+	return &allocationStore{
+		mu:        sync.Mutex{},
+		retention: time.Hour * time.Duration(conf.RetentionHours),
+		clock:     clock,
+		buckets:   make(map[time.Time]map[allocationKey]*allocationTotals),
+	}
+}
+
+// record adds the allocation over the time slice to the endpoint's totals
+//
+// The whole slice is attributed to the hour it started in. Slices are only as long as the interval
+// between collections, so this is only slightly imprecise.
+func (s *allocationStore) record(key allocationKey, slice metricsTimeSlice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hour := slice.startTime.UTC().Truncate(time.Hour)
+	bucket, ok := s.buckets[hour]
+	if !ok {
+		bucket = make(map[allocationKey]*allocationTotals)
+		s.buckets[hour] = bucket
+	}
+	totals, ok := bucket[key]
+	if !ok {
+		totals = &allocationTotals{cpuCoreSeconds: 0, ramByteSeconds: 0}
+		bucket[key] = totals
+	}
+
+	seconds := slice.Duration().Seconds()
+	totals.cpuCoreSeconds += slice.metrics.cpu.AsFloat64() * seconds
+	totals.ramByteSeconds += slice.metrics.mem.AsFloat64() * seconds
+
+	cutoff := slice.endTime.Add(-s.retention)
+	for h := range s.buckets {
+		if h.Add(time.Hour).Before(cutoff) {
+			delete(s.buckets, h)
+		}
+	}
+}
+
+// openCostAllocation is a single allocation in OpenCost's allocation API
+//
+// We only fill in the fields relating to CPU and memory. Costs are always zero, because we don't
+// know them.
+type openCostAllocation struct {
+	Name       string             `json:"name"`
+	Properties openCostProperties `json:"properties"`
+	Window     openCostWindow     `json:"window"`
+	Start      time.Time          `json:"start"`
+	End        time.Time          `json:"end"`
+	Minutes    float64            `json:"minutes"`
+	CPUCores   float64            `json:"cpuCores"`
+	CPUHours   float64            `json:"cpuCoreHours"`
+	RAMBytes   float64            `json:"ramBytes"`
+	RAMHours   float64            `json:"ramByteHours"`
+	CPUCost    float64            `json:"cpuCost"`
+	RAMCost    float64            `json:"ramCost"`
+	TotalCost  float64            `json:"totalCost"`
+}
+
+type openCostProperties struct {
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type openCostWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type openCostResponse struct {
+	Code    int                             `json:"code"`
+	Data    []map[string]openCostAllocation `json:"data,omitempty"`
+	Message string                          `json:"message,omitempty"`
+}
+
+// Values of the "aggregate" parameter that we support
+const (
+	aggregateNamespace = "namespace"
+	aggregateEndpoint  = "endpoint"
+)
+
+// allocations returns the allocation over the window ending at now, aggregated by the given
+// property
+func (s *allocationStore) allocations(now time.Time, window time.Duration, aggregate string) map[string]openCostAllocation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.UTC().Add(-window).Truncate(time.Hour)
+	end := now.UTC()
+	hours := end.Sub(start).Hours()
+
+	result := make(map[string]openCostAllocation)
+	for h, bucket := range s.buckets {
+		if h.Before(start) {
+			continue
+		}
+		for key, totals := range bucket {
+			name := key.namespace
+			properties := openCostProperties{Namespace: key.namespace, Labels: nil}
+			if aggregate == aggregateEndpoint {
+				name = key.namespace + "/" + key.endpointID
+				properties.Labels = map[string]string{api.AnnotationBillingEndpointID: key.endpointID}
+			}
+
+			a, ok := result[name]
+			if !ok {
+				a = openCostAllocation{
+					Name:       name,
+					Properties: properties,
+					Window:     openCostWindow{Start: start, End: end},
+					Start:      start,
+					End:        end,
+					Minutes:    end.Sub(start).Minutes(),
+					CPUCores:   0,
+					CPUHours:   0,
+					RAMBytes:   0,
+					RAMHours:   0,
+					CPUCost:    0,
+					RAMCost:    0,
+					TotalCost:  0,
+				}
+			}
+			a.CPUHours += totals.cpuCoreSeconds / 3600
+			a.RAMHours += totals.ramByteSeconds / 3600
+			if hours > 0 {
+				a.CPUCores = a.CPUHours / hours
+				a.RAMBytes = a.RAMHours / hours
+			}
+			result[name] = a
+		}
+	}
+
+	return result
+}
+
+// parseAllocationWindow parses the "window" parameter, which may be a duration like "1h" or a
+// number of days like "7d"
+func parseAllocationWindow(window string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, err
+	} else if d <= 0 {
+		return 0, fmt.Errorf("window must be positive")
+	}
+	return d, nil
+}
+
+// startAllocationServer begins serving the allocation API on the port, until the context is
+// canceled
+func startAllocationServer(ctx context.Context, logger *zap.Logger, port uint16, store *allocationStore) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	server := &http.Server{Handler: allocationHandler(logger, store)}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Allocation API server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// allocationHandler returns the handler for the allocation API, serving the allocations from the
+// store
+func allocationHandler(logger *zap.Logger, store *allocationStore) http.Handler {
+	respond := func(w http.ResponseWriter, resp openCostResponse) {
+		body, err := json.Marshal(resp)
+		if err != nil {
+			logger.Panic("Failed to encode allocation response JSON", zap.Error(err))
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(resp.Code)
+		_, _ = w.Write(body)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocation/compute", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respond(w, openCostResponse{Code: http.StatusMethodNotAllowed, Data: nil, Message: "method not allowed"})
+			return
+		}
+
+		query := r.URL.Query()
+		window, err := parseAllocationWindow(query.Get("window"))
+		if err != nil {
+			respond(w, openCostResponse{Code: http.StatusBadRequest, Data: nil, Message: fmt.Sprintf("invalid window: %s", err)})
+			return
+		}
+		aggregate := query.Get("aggregate")
+		if aggregate == "" {
+			aggregate = aggregateNamespace
+		}
+		if aggregate != aggregateNamespace && aggregate != aggregateEndpoint {
+			msg := fmt.Sprintf("unsupported aggregate %q, must be %q or %q", aggregate, aggregateNamespace, aggregateEndpoint)
+			respond(w, openCostResponse{Code: http.StatusBadRequest, Data: nil, Message: msg})
+			return
+		}
+
+		allocations := store.allocations(store.clock.Now(), window, aggregate)
+		respond(w, openCostResponse{Code: http.StatusOK, Data: []map[string]openCostAllocation{allocations}, Message: ""})
+	})
+
+	return mux
+}
@@ -0,0 +1,165 @@
+package billing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestAllocationStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	clock := util.NewFakeClock(now)
+	store := newAllocationStore(&AllocationConfig{Port: 0, RetentionHours: 3}, clock)
+
+	slice := func(start time.Time, cpu vmapi.MilliCPU, mem api.Bytes, seconds int) metricsTimeSlice {
+		return metricsTimeSlice{
+			metrics: vmMetricsInstant{
+				cpu:               cpu,
+				mem:               mem,
+				gpus:              0,
+				idle:              false,
+				egress:            nil,
+				egressUnavailable: false,
+				containerCPU:      nil,
+				burstBaselineCU:   0,
+				usedCPU:           0,
+				usedMem:           0,
+			},
+			startTime: start,
+			endTime:   start.Add(time.Duration(seconds) * time.Second),
+		}
+	}
+	epA := allocationKey{namespace: "ns-1", endpointID: "ep-a"}
+	epB := allocationKey{namespace: "ns-1", endpointID: "ep-b"}
+	epC := allocationKey{namespace: "ns-2", endpointID: "ep-c"}
+
+	// An hour of 2 CPUs and 1GiB for ep-a, split across the previous and current hours
+	store.record(epA, slice(now.Add(-time.Hour), 2000, 1<<30, 1800))
+	store.record(epA, slice(now.Add(-30*time.Minute), 2000, 1<<30, 1800))
+	// Half an hour of 1 CPU for ep-b, in the current hour
+	store.record(epB, slice(now.Add(-30*time.Minute), 1000, 0, 1800))
+	// An hour of 4 CPUs for ep-c, in the previous hour
+	store.record(epC, slice(now.Add(-90*time.Minute), 4000, 0, 3600))
+
+	byNamespace := store.allocations(now, 2*time.Hour, aggregateNamespace)
+	require.Len(t, byNamespace, 2)
+	ns1 := byNamespace["ns-1"]
+	assert.Equal(t, "ns-1", ns1.Properties.Namespace)
+	assert.Nil(t, ns1.Properties.Labels)
+	assert.InDelta(t, 2.5, ns1.CPUHours, 1e-9)
+	assert.InDelta(t, float64(1<<30), ns1.RAMHours, 1e-3)
+	// The window is rounded down to the start of the hour
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), ns1.Start)
+	assert.Equal(t, now, ns1.End)
+	assert.InDelta(t, 150, ns1.Minutes, 1e-9)
+	assert.InDelta(t, 1, ns1.CPUCores, 1e-9) // 2.5 CPU-hours over 2.5 hours
+	assert.InDelta(t, 4, byNamespace["ns-2"].CPUHours, 1e-9)
+
+	byEndpoint := store.allocations(now, 2*time.Hour, aggregateEndpoint)
+	require.Len(t, byEndpoint, 3)
+	assert.InDelta(t, 2, byEndpoint["ns-1/ep-a"].CPUHours, 1e-9)
+	assert.Equal(t, map[string]string{api.AnnotationBillingEndpointID: "ep-b"}, byEndpoint["ns-1/ep-b"].Properties.Labels)
+
+	// Shorter windows only include the hours they overlap
+	recent := store.allocations(now, 10*time.Minute, aggregateEndpoint)
+	require.Len(t, recent, 2)
+	assert.InDelta(t, 1, recent["ns-1/ep-a"].CPUHours, 1e-9)
+	assert.InDelta(t, 0.5, recent["ns-1/ep-b"].CPUHours, 1e-9)
+
+	// Hours older than the retention are dropped as new slices are recorded
+	later := now.Add(4 * time.Hour)
+	store.record(epA, slice(later, 1000, 0, 60))
+	all := store.allocations(later, 24*time.Hour, aggregateEndpoint)
+	require.Len(t, all, 1)
+	assert.InDelta(t, 1.0/60, all["ns-1/ep-a"].CPUHours, 1e-9)
+}
+
+func TestParseAllocationWindow(t *testing.T) {
+	cases := []struct {
+		window   string
+		expected time.Duration
+		err      bool
+	}{
+		{window: "1h", expected: time.Hour, err: false},
+		{window: "90m", expected: 90 * time.Minute, err: false},
+		{window: "7d", expected: 7 * 24 * time.Hour, err: false},
+		{window: "0s", expected: 0, err: true},
+		{window: "-1h", expected: 0, err: true},
+		{window: "xd", expected: 0, err: true},
+		{window: "", expected: 0, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.window, func(t *testing.T) {
+			d, err := parseAllocationWindow(c.window)
+			if c.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, c.expected, d)
+			}
+		})
+	}
+}
+
+func TestAllocationHandler(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	store := newAllocationStore(&AllocationConfig{Port: 0, RetentionHours: 24}, util.NewFakeClock(now))
+	store.record(allocationKey{namespace: "ns", endpointID: "ep"}, metricsTimeSlice{
+		metrics: vmMetricsInstant{
+			cpu:               1000,
+			mem:               0,
+			gpus:              0,
+			idle:              false,
+			egress:            nil,
+			egressUnavailable: false,
+			containerCPU:      nil,
+			burstBaselineCU:   0,
+			usedCPU:           0,
+			usedMem:           0,
+		},
+		startTime: now.Add(-time.Hour),
+		endTime:   now,
+	})
+
+	handler := allocationHandler(zap.NewNop(), store)
+	get := func(method, url string) (int, openCostResponse) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		var resp openCostResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, rec.Code, resp.Code)
+		return rec.Code, resp
+	}
+
+	code, resp := get(http.MethodGet, "/allocation/compute?window=1d")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Data, 1)
+	assert.InDelta(t, 1, resp.Data[0]["ns"].CPUHours, 1e-9)
+
+	code, resp = get(http.MethodGet, "/allocation/compute?window=1d&aggregate=endpoint")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Data, 1)
+	assert.Contains(t, resp.Data[0], "ns/ep")
+
+	code, resp = get(http.MethodGet, "/allocation/compute?window=1d&aggregate=pod")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Message, "unsupported aggregate")
+
+	code, resp = get(http.MethodGet, "/allocation/compute?window=soon")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Message, "invalid window")
+
+	code, _ = get(http.MethodPost, "/allocation/compute?window=1d")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,125 @@
+package billing
+
+// Detection of implausible jumps in per-endpoint usage, compared to the recent history of the same
+// endpoint. Flagged events are still sent; detection is only there to make them easy to find.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type AnomalyDetectionConfig struct {
+	// BaselineWindows is the number of recent accumulation windows that the baseline usage for each
+	// endpoint is averaged over. Endpoints are only checked once their baseline is full.
+	BaselineWindows uint `json:"baselineWindows"`
+	// Threshold is the ratio of usage rate to baseline rate above which an event is flagged, e.g.
+	// 100 for a 100x jump.
+	Threshold float64 `json:"threshold"`
+	// MinValue is the minimum value an event must have to be flagged, so that jumps from zero or
+	// near-zero usage aren't reported.
+	MinValue int `json:"minValue"`
+}
+
+type anomalyDetector struct {
+	conf         *AnomalyDetectionConfig
+	anomalyTotal *prometheus.CounterVec
+
+	baselines map[anomalyKey]*usageBaseline
+	// generation is incremented at the end of each window, so that we can remove the baselines of
+	// endpoints that have gone away
+	generation uint64
+}
+
+type anomalyKey struct {
+	endpointID string
+	metricName string
+}
+
+// usageBaseline stores the rates of usage (value per second) from the most recent windows
+type usageBaseline struct {
+	rates    []float64
+	next     int
+	lastSeen uint64
+}
+
+func newAnomalyDetector(conf *AnomalyDetectionConfig, anomalyTotal *prometheus.CounterVec) *anomalyDetector {
+	return &anomalyDetector{
+		conf:         conf,
+		anomalyTotal: anomalyTotal,
+		baselines:    make(map[anomalyKey]*usageBaseline),
+		generation:   0,
+	}
+}
+
+// check returns whether the event is anomalous compared to the baseline for its endpoint and
+// metric, and then adds it to that baseline.
+func (d *anomalyDetector) check(logger *zap.Logger, event *billing.IncrementalEvent) bool {
+	seconds := event.StopTime.Sub(event.StartTime).Seconds()
+	if seconds <= 0 {
+		return false
+	}
+	rate := float64(event.Value) / seconds
+
+	key := anomalyKey{endpointID: event.EndpointID, metricName: event.MetricName}
+	b, ok := d.baselines[key]
+	if !ok {
+		b = &usageBaseline{
+			rates:    make([]float64, 0, d.conf.BaselineWindows),
+			next:     0,
+			lastSeen: 0,
+		}
+		d.baselines[key] = b
+	}
+
+	anomalous := false
+	if len(b.rates) == int(d.conf.BaselineWindows) && event.Value >= d.conf.MinValue {
+		baseline := b.mean()
+		// A zero baseline with non-trivial usage is as implausible as any other jump.
+		if baseline == 0 || rate/baseline > d.conf.Threshold {
+			anomalous = true
+			d.anomalyTotal.WithLabelValues(event.MetricName).Inc()
+			logger.Warn(
+				"Anomalous billing usage detected",
+				zap.String("EndpointID", event.EndpointID),
+				zap.String("MetricName", event.MetricName),
+				zap.Int("Value", event.Value),
+				zap.Float64("rate", rate),
+				zap.Float64("baselineRate", baseline),
+			)
+		}
+	}
+
+	b.add(rate)
+	b.lastSeen = d.generation
+	return anomalous
+}
+
+// finishWindow removes the baselines of all endpoints that had no events in the window that just
+// finished
+func (d *anomalyDetector) finishWindow() {
+	for key, b := range d.baselines {
+		if b.lastSeen != d.generation {
+			delete(d.baselines, key)
+		}
+	}
+	d.generation += 1
+}
+
+func (b *usageBaseline) add(rate float64) {
+	if len(b.rates) < cap(b.rates) {
+		b.rates = append(b.rates, rate)
+		return
+	}
+	b.rates[b.next] = rate
+	b.next = (b.next + 1) % len(b.rates)
+}
+
+func (b *usageBaseline) mean() float64 {
+	var sum float64
+	for _, r := range b.rates {
+		sum += r
+	}
+	return sum / float64(len(b.rates))
+}
@@ -0,0 +1,152 @@
+package billing
+
+// Backfilling the active time of VMs that were already running when the collector started.
+//
+// Usage is only counted between collections, so after a restart, the time from when the previous
+// collector stopped counting until our first collection is lost. For active time, we can estimate
+// that gap from the VM itself: if it's been running since before the restart, it was active for
+// the whole gap. So on the first collection, each VM's active time is backfilled from the latest
+// of when it was created, when it last became available, and when it was last migrated, limited
+// to the configured maximum and to the time of the restored history snapshot.
+//
+// The snapshot is required: it's replaced whenever usage is enqueued, including by the final flush
+// on shutdown, so its time is when the previous collector last counted usage. Without it, we can't
+// tell how much of the gap was already counted (e.g. during a crash loop, all of it would be counted
+// again on every restart), so nothing is backfilled.
+//
+// Backfilled events are sent separately from the regular batches, with a distinct suffix on their
+// idempotency keys, so that they can be told apart (and discarded, if necessary) downstream.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type StartupBackfillConfig struct {
+	// MaxSeconds gives the longest gap that's backfilled for each VM.
+	//
+	// Backfilling also requires a history snapshot that's restored on startup; the gap never
+	// extends before the time of the snapshot.
+	MaxSeconds uint `json:"maxSeconds"`
+	// IdempotencyKeySuffix is appended to the idempotency key of each backfilled event
+	IdempotencyKeySuffix string `json:"idempotencyKeySuffix"`
+}
+
+// vmConditionAvailable is the type of the condition that neonvm-controller sets on VMs once
+// they're running
+const vmConditionAvailable = "Available"
+
+// runningSince returns the earliest time that the VM is known to have been running on this node
+// continuously until now, or false if it isn't known to be running.
+func runningSince(vm *vmapi.VirtualMachine) (time.Time, bool) {
+	since := vm.CreationTimestamp.Time
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type != vmConditionAvailable {
+			continue
+		} else if cond.Status != metav1.ConditionTrue {
+			return time.Time{}, false
+		}
+		if cond.LastTransitionTime.After(since) {
+			since = cond.LastTransitionTime.Time
+		}
+	}
+	// Usage before the VM was migrated here was counted by the source node.
+	if vm.Status.MigratedAt != nil && vm.Status.MigratedAt.After(since) {
+		since = vm.Status.MigratedAt.Time
+	}
+	return since, !since.IsZero()
+}
+
+// recordBackfillStart records the start of the gap to backfill for the VM, as of the first
+// collection at now, if there is one
+func (s *metricsState) recordBackfillStart(vm *vmapi.VirtualMachine, key metricsKey, now time.Time) {
+	// Without a restored snapshot, we don't know how much of the gap was already counted.
+	if s.backfillNotBefore.IsZero() {
+		return
+	}
+	since, ok := runningSince(vm)
+	if !ok {
+		return
+	}
+
+	start := now.Add(-time.Second * time.Duration(s.startupBackfill.MaxSeconds))
+	if s.backfillNotBefore.After(start) {
+		start = s.backfillNotBefore
+	}
+	if since.After(start) {
+		start = since
+	}
+
+	if !start.Before(now) || s.idleSince(vm, start) {
+		return
+	}
+	s.backfillStarts[key] = start
+}
+
+// enqueueStartupBackfill adds an active time event to the queues for each VM with a gap recorded
+// by the first collection
+func (s *metricsState) enqueueStartupBackfill(
+	logger *zap.Logger,
+	conf *Config,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+	backfilledSeconds prometheus.Counter,
+) {
+	if len(s.backfillStarts) == 0 || s.lastCollectTime == nil {
+		return
+	}
+	end := *s.lastCollectTime
+	now := s.clock.Now()
+
+	batchSize := len(s.backfillStarts)
+	firstSeq, err := s.sequence.Reserve(uint64(batchSize))
+	if err != nil {
+		logger.Error("Failed to persist billing sequence number", zap.Error(err))
+	}
+
+	countInBatch := 0
+	var total time.Duration
+	var batch []billing.AnyEvent
+	for key, start := range s.backfillStarts {
+		gap := end.Sub(start)
+		total += gap
+
+		seq := firstSeq + uint64(countInBatch)
+		countInBatch += 1
+		event := billing.Enrich(now, hostname, seq, countInBatch, batchSize, &billing.IncrementalEvent{
+			MetricName:     conf.ActiveTimeMetricName,
+			Type:           "", // set by billing.Enrich
+			SchemaVersion:  0,  // set by billing.Enrich
+			IdempotencyKey: "", // set by billing.Enrich
+			SequenceNumber: 0,  // set by billing.Enrich
+			EndpointID:     key.endpointID,
+			StartTime:      start,
+			StopTime:       end,
+			Value:          s.roundValue(conf.Rounding, key, conf.ActiveTimeMetricName, gap.Seconds(), false),
+			Anomalous:      false,
+			Partial:        false,
+			Identity:       s.identities[key],
+		})
+		event.IdempotencyKey = fmt.Sprintf("%s-%s", event.IdempotencyKey, s.startupBackfill.IdempotencyKeySuffix)
+		batch = append(batch, logAddedEvent(logger, event))
+	}
+	s.enqueueBatch(queues, batch)
+
+	backfilledSeconds.Add(total.Seconds())
+	s.summary.recordEnqueued(countInBatch)
+	logger.Info(
+		"Backfilled active time for VMs running before startup",
+		zap.Int("vms", countInBatch),
+		zap.Duration("total", total),
+	)
+
+	s.backfillStarts = nil
+}
@@ -0,0 +1,144 @@
+package billing
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestStartupBackfill(t *testing.T) {
+	logger := zap.NewNop()
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	newVM := func(created time.Time, available *metav1.Condition, migratedAt *time.Time) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.CreationTimestamp = metav1.Time{Time: created}
+		if available != nil {
+			vm.Status.Conditions = []metav1.Condition{*available}
+		}
+		if migratedAt != nil {
+			vm.Status.MigratedAt = &metav1.Time{Time: *migratedAt}
+		}
+		return vm
+	}
+	available := func(status metav1.ConditionStatus, at time.Time) *metav1.Condition {
+		return &metav1.Condition{
+			Type:               vmConditionAvailable,
+			Status:             status,
+			ObservedGeneration: 0,
+			LastTransitionTime: metav1.Time{Time: at},
+			Reason:             "",
+			Message:            "",
+		}
+	}
+	migrated := ago(3 * time.Minute)
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.startupBackfill = &StartupBackfillConfig{MaxSeconds: 600, IdempotencyKeySuffix: "backfill"}
+	s.backfillNotBefore = ago(8 * time.Minute) // as if restored from a snapshot
+	s.backfillStarts = make(map[metricsKey]time.Time)
+
+	cases := []struct {
+		name     string
+		vm       *vmapi.VirtualMachine
+		expected *time.Time
+	}{
+		{
+			name:     "created-during-gap",
+			vm:       newVM(ago(time.Minute), nil, nil),
+			expected: func() *time.Time { t := ago(time.Minute); return &t }(),
+		},
+		{
+			name:     "limited-by-snapshot",
+			vm:       newVM(ago(time.Hour), available(metav1.ConditionTrue, ago(time.Hour)), nil),
+			expected: &s.backfillNotBefore,
+		},
+		{
+			name:     "became-available-during-gap",
+			vm:       newVM(ago(time.Hour), available(metav1.ConditionTrue, ago(5*time.Minute)), nil),
+			expected: func() *time.Time { t := ago(5 * time.Minute); return &t }(),
+		},
+		{
+			name:     "migrated-during-gap",
+			vm:       newVM(ago(time.Hour), available(metav1.ConditionTrue, ago(time.Hour)), &migrated),
+			expected: &migrated,
+		},
+		{
+			name:     "not-available",
+			vm:       newVM(ago(time.Hour), available(metav1.ConditionFalse, ago(time.Hour)), nil),
+			expected: nil,
+		},
+		{
+			name:     "created-after-collection",
+			vm:       newVM(now, nil, nil),
+			expected: nil,
+		},
+	}
+
+	for _, c := range cases {
+		key := metricsKey{uid: "", endpointID: c.name}
+		s.recordBackfillStart(c.vm, key, now)
+		start, ok := s.backfillStarts[key]
+		if c.expected == nil {
+			assert.False(t, ok, c.name)
+		} else if assert.True(t, ok, c.name) {
+			assert.Equal(t, *c.expected, start, c.name)
+		}
+	}
+
+	// Without a snapshot, nothing is backfilled, because the previous collector may have already
+	// counted the whole gap.
+	notBefore := s.backfillNotBefore
+	s.backfillNotBefore = time.Time{}
+	key := metricsKey{uid: "", endpointID: "no-snapshot"}
+	s.recordBackfillStart(newVM(ago(time.Hour), available(metav1.ConditionTrue, ago(time.Hour)), nil), key, now)
+	assert.NotContains(t, s.backfillStarts, key)
+	s.backfillNotBefore = notBefore
+
+	// Enqueue the backfilled events
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.lastCollectTime = &now
+	s.clock = util.NewFakeClock(now)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	queue, reader := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, s.clock)
+	backfilled := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_backfilled_seconds", Help: ""})
+
+	conf := new(Config)
+	conf.ActiveTimeMetricName = "active_time"
+	s.enqueueStartupBackfill(logger, conf, "test-host", []eventQueuePusher[billing.AnyEvent]{queue}, backfilled)
+
+	values := make(map[string]int)
+	for _, e := range reader.get(10) {
+		event := e.(*billing.IncrementalEvent)
+		assert.Equal(t, "active_time", event.MetricName)
+		assert.Equal(t, now, event.StopTime)
+		assert.True(t, strings.HasSuffix(event.IdempotencyKey, "-backfill"), event.IdempotencyKey)
+		values[event.EndpointID] = event.Value
+	}
+	assert.Equal(t, map[string]int{
+		"created-during-gap":          60,
+		"limited-by-snapshot":         480,
+		"became-available-during-gap": 300,
+		"migrated-during-gap":         180,
+	}, values)
+	assert.Nil(t, s.backfillStarts)
+
+	// Only on startup
+	s.enqueueStartupBackfill(logger, conf, "test-host", []eventQueuePusher[billing.AnyEvent]{queue}, backfilled)
+	assert.Equal(t, 4, reader.size())
+}
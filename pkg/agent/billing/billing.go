@@ -2,13 +2,17 @@ package billing
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"math"
-	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	"k8s.io/apimachinery/pkg/types"
 
@@ -16,6 +20,7 @@ import (
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/billing"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
 )
 
 type Config struct {
@@ -24,28 +29,325 @@ type Config struct {
 	ActiveTimeMetricName   string        `json:"activeTimeMetricName"`
 	CollectEverySeconds    uint          `json:"collectEverySeconds"`
 	AccumulateEverySeconds uint          `json:"accumulateEverySeconds"`
+
+	// AccumulateEverySecondsByMetric, if not empty, gives longer intervals between the events for
+	// some metrics, keyed by the metric's name. Each must be a multiple of AccumulateEverySeconds.
+	// Metrics that aren't listed are sent every AccumulateEverySeconds. See cadence.go.
+	AccumulateEverySecondsByMetric map[string]uint `json:"accumulateEverySecondsByMetric,omitempty"`
+
+	// SequenceFilePath, if not empty, gives the path of a file used to persist the sequence number
+	// incorporated into each event's idempotency key, so that keys remain unique across restarts
+	// even if the clock jumps backwards.
+	SequenceFilePath string `json:"sequenceFilePath,omitempty"`
+
+	// HistorySnapshot, if provided, enables periodically persisting the usage accumulated since the
+	// last batch, so that it can be restored if the autoscaler-agent is restarted partway through
+	// a window. See HistorySnapshotConfig.
+	HistorySnapshot *HistorySnapshotConfig `json:"historySnapshot,omitempty"`
+
+	// ComputeUnitMetricName, if not empty, enables emitting an additional incremental metric with
+	// the number of compute unit-seconds allocated to each endpoint, using the agent's configured
+	// compute unit.
+	ComputeUnitMetricName string `json:"computeUnitMetricName,omitempty"`
+
+	// GPUMetricName, if not empty, enables emitting an additional incremental metric with the
+	// number of GPU-seconds allocated to each endpoint, from the GPUs passed through to its VM.
+	// Endpoints without GPUs always have zero.
+	GPUMetricName string `json:"gpuMetricName,omitempty"`
+
+	// BurstMetricName, if not empty, enables emitting an additional incremental metric with the
+	// number of compute unit-seconds allocated to each endpoint above its baseline, for VMs with
+	// burst credits (see api.BurstCredits). Endpoints without burst credits always have zero.
+	BurstMetricName string `json:"burstMetricName,omitempty"`
+
+	// Utilization, if provided, enables emitting additional metrics with the resources actually
+	// used by each endpoint, rather than allocated, from the metrics fetched from inside its VM.
+	// See UtilizationConfig.
+	Utilization *UtilizationConfig `json:"utilization,omitempty"`
+
+	// ShutdownFlushTimeoutSeconds, if non-zero, enables a final flush on shutdown: all usage
+	// accumulated since the last batch is turned into events, and we wait up to this long for the
+	// senders to push everything remaining in their queues.
+	ShutdownFlushTimeoutSeconds uint `json:"shutdownFlushTimeoutSeconds,omitempty"`
+
+	// StartupBackfill, if provided, enables backfilling the active time of VMs that were already
+	// running when the collector started, for the gap before the first collection. It's only used
+	// on startup. See StartupBackfillConfig.
+	StartupBackfill *StartupBackfillConfig `json:"startupBackfill,omitempty"`
+
+	// AnomalyDetection, if provided, enables flagging events with implausible jumps in usage
+	AnomalyDetection *AnomalyDetectionConfig `json:"anomalyDetection,omitempty"`
+
+	// Egress, if provided, enables collecting the bytes sent by each VM, emitted as separate
+	// metrics for internal and internet traffic.
+	Egress *EgressConfig `json:"egress,omitempty"`
+
+	// ContainerCPU, if provided, enables collecting the CPU time used by individual cgroups inside
+	// each VM (e.g. a connection pooler sidecar), emitted as a separate metric for each cgroup.
+	ContainerCPU *ContainerCPUConfig `json:"containerCPU,omitempty"`
+
+	// ScalingActivity, if provided, enables emitting the number of times each endpoint was scaled
+	// up and down in each window, as separate metrics.
+	ScalingActivity *ScalingActivityConfig `json:"scalingActivity,omitempty"`
+
+	// Heartbeat, if provided, enables periodically emitting an absolute event for each endpoint
+	// with its current allocation. Endpoints without heartbeats are not running on this node, while
+	// the lack of any events at all means the agent itself has stopped reporting.
+	Heartbeat *HeartbeatConfig `json:"heartbeat,omitempty"`
+
+	// Allocation, if provided, enables serving the allocation of each endpoint over HTTP, in the
+	// shape of OpenCost's allocation API. Changes to this field require a restart.
+	Allocation *AllocationConfig `json:"allocation,omitempty"`
+
+	// StoreFailure, if provided, configures what we do while the VM store is failing, beyond
+	// logging. Without it, no usage is recorded until the store recovers.
+	StoreFailure *StoreFailureConfig `json:"storeFailure,omitempty"`
+
+	// ActiveTime, if provided, changes what makes a VM count as active, for the active time
+	// metric. By default, VMs are active whenever they're alive.
+	ActiveTime *ActiveTimeConfig `json:"activeTime,omitempty"`
+
+	// Reconciliation, if provided, enables periodically checking that the CPU usage sent in events
+	// matches the allocation that was collected, logging and exporting metrics if they diverge.
+	Reconciliation *ReconciliationConfig `json:"reconciliation,omitempty"`
+
+	// RemoteWrite, if provided, pushes running totals of each endpoint's usage to a Prometheus
+	// remote-write endpoint after every batch. Changes require a restart.
+	RemoteWrite *RemoteWriteConfig `json:"remoteWrite,omitempty"`
+
+	// EventMetadata, if provided, enables including metadata about each VM in its events, like its
+	// namespace and name. Only the fields that it lists are included.
+	EventMetadata *EventMetadataConfig `json:"eventMetadata,omitempty"`
+
+	// EndpointFilter, if provided, excludes some endpoints from billing entirely -- e.g. internal
+	// databases that shouldn't appear on customers' invoices. See EndpointFilterConfig.
+	EndpointFilter *EndpointFilterConfig `json:"endpointFilter,omitempty"`
+
+	// Enrichment, if provided, modifies every event just before it's queued to be sent -- e.g. to
+	// rename metrics, or drop the events for some endpoints. See EnrichmentConfig.
+	Enrichment *EnrichmentConfig `json:"enrichment,omitempty"`
+
+	// MaxEventWindowSeconds, if non-zero, limits the time covered by each event. If it's been longer
+	// than this since the last batch (e.g. because collection was stalled), the usage is split
+	// evenly into consecutive windows of at most this long, each sent as a separate batch.
+	MaxEventWindowSeconds uint `json:"maxEventWindowSeconds,omitempty"`
+
+	// LogSummaryEverySeconds gives the interval between info-level summaries of collection and
+	// pushing. The details of each are only logged at debug level.
+	//
+	// If zero, no summaries are logged, and repeated errors are logged every time instead of being
+	// summarized.
+	LogSummaryEverySeconds uint `json:"logSummaryEverySeconds"`
+
+	// Rounding, if provided, gives the increments that the values of each metric are sent in, to
+	// match the terms that usage is billed on.
+	Rounding *RoundingConfig `json:"rounding,omitempty"`
+
+	// Residency, if provided, enables tracking the time that VMs spend at each size, in buckets of
+	// compute units. See ResidencyConfig.
+	Residency *ResidencyConfig `json:"residency,omitempty"`
+
+	// CostEstimate, if provided, enables exporting the estimated cost per hour of each endpoint's
+	// usage, from the price of each metric.
+	CostEstimate *CostEstimateConfig `json:"costEstimate,omitempty"`
+
+	// CheckInvariants, if true, enables checking that the CPU-seconds accumulated for each endpoint
+	// are never negative, and never more than the largest allocation that was observed could have
+	// used. Violations are logged as errors and counted in a metric. Changes require a restart.
+	CheckInvariants bool `json:"checkInvariants,omitempty"`
+
+	// ReloadEverySeconds, if non-zero, makes the autoscaler-agent periodically re-read its config
+	// file and apply any changes to the billing config without restarting.
+	//
+	// Adding or removing clients, and changes to SequenceFilePath or this field, still require a
+	// restart.
+	ReloadEverySeconds uint `json:"reloadEverySeconds,omitempty"`
+}
+
+// MetricNames returns the name of each metric that events may be sent for, keyed by the path of
+// the field that sets it. Metrics for features that aren't enabled are not included.
+func (c *Config) MetricNames() map[string]string {
+	names := map[string]string{
+		".billing.cpuMetricName":        c.CPUMetricName,
+		".billing.activeTimeMetricName": c.ActiveTimeMetricName,
+	}
+	if c.ComputeUnitMetricName != "" {
+		names[".billing.computeUnitMetricName"] = c.ComputeUnitMetricName
+	}
+	if c.GPUMetricName != "" {
+		names[".billing.gpuMetricName"] = c.GPUMetricName
+	}
+	if c.BurstMetricName != "" {
+		names[".billing.burstMetricName"] = c.BurstMetricName
+	}
+	if c.Utilization != nil {
+		names[".billing.utilization.cpuMetricName"] = c.Utilization.CPUMetricName
+		names[".billing.utilization.computeUnitMetricName"] = c.Utilization.ComputeUnitMetricName
+	}
+	if c.Egress != nil {
+		names[".billing.egress.internalMetricName"] = c.Egress.InternalMetricName
+		names[".billing.egress.internetMetricName"] = c.Egress.InternetMetricName
+		for network, metricName := range c.Egress.InterfaceMetricNames {
+			names[fmt.Sprintf(".billing.egress.interfaceMetricNames.%s", network)] = metricName
+		}
+	}
+	if c.ContainerCPU != nil {
+		for cgroup, metricName := range c.ContainerCPU.MetricNames {
+			names[fmt.Sprintf(".billing.containerCPU.metricNames[%q]", cgroup)] = metricName
+		}
+	}
+	if c.ScalingActivity != nil {
+		names[".billing.scalingActivity.upscaleMetricName"] = c.ScalingActivity.UpscaleMetricName
+		names[".billing.scalingActivity.downscaleMetricName"] = c.ScalingActivity.DownscaleMetricName
+	}
+	if c.Heartbeat != nil {
+		names[".billing.heartbeat.metricName"] = c.Heartbeat.MetricName
+	}
+	if c.Residency != nil && c.Residency.Events != nil {
+		names[".billing.residency.events.metricNamePrefix"] = c.Residency.Events.MetricNamePrefix
+	}
+	return names
 }
 
 type ClientsConfig struct {
 	HTTP *HTTPClientConfig `json:"http"`
+	// File, if not nil, writes events to the local filesystem. See FileClientConfig.
+	File *FileClientConfig `json:"file,omitempty"`
+	// NATS, if not nil, publishes events to NATS JetStream. See NATSClientConfig.
+	NATS *NATSClientConfig `json:"nats,omitempty"`
+	// S3, if not nil, uploads events to an S3 bucket. See S3ClientConfig.
+	S3 *S3ClientConfig `json:"s3,omitempty"`
 }
 
 type HTTPClientConfig struct {
 	BaseClientConfig
-	URL string `json:"url"`
+	// URL is where events are pushed to. It must not be set if Shards is.
+	URL string `json:"url,omitempty"`
+	// Shards, if not nil, partitions events across multiple URLs by their endpoint ID, instead of
+	// pushing them all to URL. See ShardsConfig.
+	Shards *ShardsConfig `json:"shards,omitempty"`
 }
 
 type BaseClientConfig struct {
 	PushEverySeconds          uint `json:"pushEverySeconds"`
 	PushRequestTimeoutSeconds uint `json:"pushRequestTimeoutSeconds"`
 	MaxBatchSize              uint `json:"maxBatchSize"`
+	// Queue, if not nil, limits the number of events waiting to be sent. See QueueConfig.
+	Queue *QueueConfig `json:"queue,omitempty"`
+	// Format is the wire format used for pushing events: "json" (the default) or "protobuf". If
+	// the collector doesn't support protobuf, pushes fall back to JSON until the format is changed.
+	//
+	// Events spilled to disk are always pushed as JSON.
+	Format billing.Format `json:"format,omitempty"`
+	// RateLimit, if not nil, limits the rate and concurrency of push requests. See RateLimitConfig.
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty"`
+	// Retry, if not nil, retries failed sends within each push, instead of waiting until the next
+	// one. See RetryConfig.
+	Retry *RetryConfig `json:"retry,omitempty"`
+	// CircuitBreaker, if not nil, stops pushes for a while after repeated failures. While the
+	// circuit is open, a queue with the "blockAccumulation" policy drops its oldest events instead
+	// of delaying batches for the other clients. See CircuitBreakerConfig.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker,omitempty"`
+	// ContentDigest, if true, includes a SHA-256 digest of each batch in the request headers and in
+	// the payload, so that the collector can check that the batch arrived intact. See
+	// billing.MarshalFormatWithDigest.
+	//
+	// Events spilled to disk are pushed with the digest header, but without the digest field.
+	ContentDigest bool `json:"contentDigest,omitempty"`
 }
 
 type metricsState struct {
+	computeUnit  api.Resources
+	sequence     *billing.Sequence
+	anomalies    *anomalyDetector       // nil if anomaly detection is disabled
+	reconciler   *reconciler            // nil if reconciliation is disabled
+	invariants   *invariantChecker      // nil if invariants aren't checked
+	remoteWrite  *remoteWriter          // nil if usage isn't pushed to remote-write
+	residency    *residencyTracker      // nil if residency isn't tracked
+	egress       *EgressConfig          // nil if egress collection is disabled
+	usageSource  UsageSource            // nil if egress collection is disabled
+	containerCPU *ContainerCPUConfig    // nil if container CPU isn't collected
+	activity     *ScalingActivityConfig // nil if scaling activity isn't emitted
+	metadata     *EventMetadataConfig   // nil if events don't include VM metadata
+	enrichment   *eventEnrichment       // nil if events aren't enriched
+	filter       *endpointFilter        // nil if all endpoints are billed
+	activeTime   *ActiveTimeConfig      // nil if VMs are active whenever they're alive
+	summary      *logSummary
+	errors       *util.ErrorAggregator
+
+	storeFailureConf *StoreFailureConfig // nil if there's no special handling for store failures
+	listVMs          VMLister
+	activitySource   DatabaseActivitySource
+	// databaseActivity stores the database activity of each VM, as of the latest collection. It's
+	// only set if active time is based on database activity.
+	databaseActivity map[util.NamespacedName]*time.Time
+	// utilizationConf is nil if utilization isn't emitted
+	utilizationConf   *UtilizationConfig
+	utilizationSource UtilizationSource
+	// utilization stores the utilization of each VM, as of the latest collection. It's only set if
+	// utilization is emitted.
+	utilization  map[util.NamespacedName]VMUtilization
+	storeFailure storeFailureState
+	allocations  *allocationStore // nil if the allocation API is disabled
+	// roundingRemainders stores the usage that's been left over from rounding the values in past
+	// events, to be included in the next event for the same endpoint and metric.
+	roundingRemainders map[roundingKey]float64
+	// deferredUsage stores the usage that's been held back from the events for each endpoint and
+	// metric, until the metric is next due. See cadence.go.
+	deferredUsage map[roundingKey]deferredUsage
+	// metricsLastSent stores the end of the last batch that included each metric with its own
+	// cadence
+	metricsLastSent map[string]time.Time
+	// costs accumulates the estimated cost of each endpoint's usage in the current batch. It's used
+	// whether or not cost estimates are enabled, so that they can be changed by a config reload.
+	costs *costEstimator
+
 	historical      map[metricsKey]vmMetricsHistory
 	present         map[metricsKey]vmMetricsInstant
 	lastCollectTime *time.Time
+	// departed stores the VMs that were in the collection before the latest one, but not the
+	// latest, so that their usage can still be finalized if they were deleted or migrated away.
+	departed map[metricsKey]departedVM
+	// migratedIn stores the recent migrations to this node, by the VM's UID, that we've already
+	// counted the usage from. See migratedInSince.
+	migratedIn map[types.UID]time.Time
+	// identities stores the metadata for each VM's events, from the latest time that it was
+	// collected. It's only populated if metadata is enabled.
+	identities      map[metricsKey]billing.Identity
 	pushWindowStart time.Time
+	lastHeartbeat   time.Time
+	// snapshot is nil if the history isn't persisted. See snapshot.go.
+	snapshot     *HistorySnapshotConfig
+	lastSnapshot time.Time
+	// startupBackfill is nil if active time isn't backfilled on startup. See backfill.go.
+	startupBackfill *StartupBackfillConfig
+	// backfillNotBefore is the earliest time that can be backfilled, because the usage before it
+	// was restored from a snapshot
+	backfillNotBefore time.Time
+	// backfillStarts stores the start of the gap to backfill for each VM in the first collection,
+	// until the backfilled events are enqueued
+	backfillStarts map[metricsKey]time.Time
+
+	tracer   trace.Tracer
+	reporter StatusReporter // nil if the status isn't reported
+	clock    util.Clock
+}
+
+// StatusReporter is notified of the status of collecting and pushing billing events, so that
+// problems can be made visible outside of the autoscaler-agent's logs
+//
+// Its methods may be called concurrently; the status of each client is reported by its sender.
+type StatusReporter interface {
+	// VMStoreFailing is called on each collection while the VM store is failing, with the time
+	// since the failure started
+	VMStoreFailing(outage time.Duration)
+	// VMStoreRecovered is called on the first collection after the VM store stopped failing
+	VMStoreRecovered()
+	// QueueSize is called with the number of events waiting to be pushed with the client, before
+	// each attempt to push them
+	QueueSize(client string, size int)
+	// PushResult is called after each attempt to push events with the client
+	PushResult(client string, err error)
 }
 
 type metricsKey struct {
@@ -69,6 +371,36 @@ func (m *metricsTimeSlice) Duration() time.Duration { return m.endTime.Sub(m.sta
 type vmMetricsInstant struct {
 	// cpu stores the cpu allocation at a particular instant.
 	cpu vmapi.MilliCPU
+	// mem stores the memory allocation at a particular instant.
+	mem api.Bytes
+	// gpus stores the number of GPUs passed through to the VM at a particular instant.
+	gpus uint32
+	// idle is true if the database inside the VM wasn't active, so that the time isn't counted as
+	// active time. It's only set for the metrics of a time slice, and only if active time is based
+	// on database activity.
+	idle bool
+	// egress stores the total bytes sent by the VM up to a particular instant, if known.
+	//
+	// If the VM's network usage couldn't be fetched, this is the last known value instead, so that
+	// the bytes sent in the meantime are counted once it's available again.
+	//
+	// This is always nil for the metrics of a time slice, because it's a counter rather than an
+	// allocation.
+	egress *api.NetworkUsage
+	// egressUnavailable is true if egress is being collected, but the VM's network usage couldn't
+	// be fetched at this instant.
+	egressUnavailable bool
+	// containerCPU stores the total CPU-seconds used by each of the VM's cgroups up to a particular
+	// instant, if known. Like egress, this is the last known value if it couldn't be fetched, and
+	// it's always nil for the metrics of a time slice.
+	containerCPU *containerCPUUsage
+	// burstBaselineCU stores the baseline compute units from the VM's burst credits, or zero if it
+	// doesn't have any.
+	burstBaselineCU uint16
+	// usedCPU and usedMem store the resources in use by the VM at a particular instant, capped at
+	// the allocation. They're zero if utilization isn't emitted, or the VM's usage isn't known.
+	usedCPU vmapi.MilliCPU
+	usedMem api.Bytes
 }
 
 // vmMetricsSeconds is like vmMetrics, but the values cover the allocation over time
@@ -76,102 +408,644 @@ type vmMetricsSeconds struct {
 	// cpu stores the CPU seconds allocated to the VM, roughly equivalent to the integral of CPU
 	// usage over time.
 	cpu float64
+	// computeUnits stores the compute unit-seconds allocated to the VM, where the number of CUs at
+	// any instant is the larger of the CPU and memory allocations, measured in CUs.
+	computeUnits float64
+	// gpu stores the GPU-seconds allocated to the VM
+	gpu float64
+	// burstComputeUnits stores the compute unit-seconds allocated to the VM above the baseline of
+	// its burst credits, if it has any
+	burstComputeUnits float64
+	// usedCPU and usedComputeUnits store the CPU-seconds and compute unit-seconds used by the VM,
+	// if utilization is emitted
+	usedCPU          float64
+	usedComputeUnits float64
 	// activeTime stores the total time that the VM was active
 	activeTime time.Duration
+	// internalEgressBytes and internetEgressBytes store the bytes sent by the VM to internal and
+	// internet destinations, respectively.
+	internalEgressBytes uint64
+	internetEgressBytes uint64
+	// egressUnavailable is true if the VM's network usage was unavailable for any collection
+	// during the time covered, which means that some of the bytes sent may only be counted later.
+	egressUnavailable bool
+	// interfaceEgressBytes stores the bytes sent by the VM on each of its additional networks,
+	// keyed by the network's name. It's nil if there weren't any.
+	interfaceEgressBytes map[string]uint64
+	// containerCPU stores the CPU-seconds used by each of the VM's cgroups, keyed by the cgroup's
+	// path. It's nil if there weren't any.
+	containerCPU map[string]float64
+	// upscales and downscales store the number of times the VM's compute units increased or
+	// decreased, respectively.
+	upscales   uint
+	downscales uint
 }
 
 func RunBillingMetricsCollector(
 	backgroundCtx context.Context,
 	parentLogger *zap.Logger,
 	conf *Config,
+	configUpdates <-chan *Config,
+	computeUnit api.Resources,
 	store VMStoreForNode,
+	deletedVMs <-chan *vmapi.VirtualMachine,
+	migratedVMs <-chan *vmapi.VirtualMachine,
+	listVMs VMLister,
+	activitySource DatabaseActivitySource,
+	utilizationSource UtilizationSource,
 	metrics PromMetrics,
+	tracer trace.Tracer,
+	reporter StatusReporter,
+	clock util.Clock,
 ) {
-	var clients []clientInfo
+	logger := parentLogger.Named("billing")
 
-	if c := conf.Clients.HTTP; c != nil {
-		clients = append(clients, clientInfo{
-			client: billing.NewClient(c.URL, http.DefaultClient),
-			name:   "http",
-			config: c.BaseClientConfig,
-		})
-	}
+	clients := makeClients(logger, conf)
 
-	logger := parentLogger.Named("billing")
+	sequence := billing.NewSequence()
+	if conf.SequenceFilePath != "" {
+		var err error
+		sequence, err = billing.LoadSequence(conf.SequenceFilePath)
+		if err != nil {
+			// Fall back to an in-memory sequence. Keys will still be unique as long as the clock
+			// doesn't go backwards across the restart.
+			logger.Error("Failed to load billing sequence number, starting from zero", zap.Error(err))
+			sequence = billing.NewSequence()
+		}
+	}
 
-	collectTicker := time.NewTicker(time.Second * time.Duration(conf.CollectEverySeconds))
+	collectTicker := clock.NewTicker(time.Second * time.Duration(conf.CollectEverySeconds))
 	defer collectTicker.Stop()
 	// Offset by half a second, so it's a bit more deterministic.
-	time.Sleep(500 * time.Millisecond)
-	accumulateTicker := time.NewTicker(time.Second * time.Duration(conf.AccumulateEverySeconds))
+	clock.Sleep(500 * time.Millisecond)
+	accumulateTicker := clock.NewTicker(time.Second * time.Duration(conf.AccumulateEverySeconds))
 	defer accumulateTicker.Stop()
+	summaryTicker := newSummaryTicker(clock, conf.LogSummaryEverySeconds)
+	defer summaryTicker.Stop()
+
+	var anomalies *anomalyDetector
+	if conf.AnomalyDetection != nil {
+		anomalies = newAnomalyDetector(conf.AnomalyDetection, metrics.anomaliesTotal)
+	}
+
+	// Errors are summarized alongside the regular log summary
+	errs := util.NewErrorAggregator(
+		time.Second*time.Duration(conf.LogSummaryEverySeconds),
+		metrics.collectErrorsTotal,
+		networkUsageErrorKind,
+		containerCPUErrorKind,
+	)
+
+	var allocations *allocationStore
+	if conf.Allocation != nil {
+		allocations = newAllocationStore(conf.Allocation, clock)
+		if err := startAllocationServer(backgroundCtx, logger.Named("allocation"), conf.Allocation.Port, allocations); err != nil {
+			logger.Error("Failed to start allocation API server", zap.Error(err))
+		}
+	}
+
+	var reconciler *reconciler
+	if conf.Reconciliation != nil {
+		reconciler = newReconciler(conf.Reconciliation, metrics)
+	}
+
+	var invariants *invariantChecker
+	if conf.CheckInvariants {
+		invariants = newInvariantChecker(metrics)
+	}
+
+	var residency *residencyTracker
+	if conf.Residency != nil {
+		residency = newResidencyTracker(conf.Residency, metrics, clock.Now())
+	}
+
+	var remoteWrite *remoteWriter
+	if conf.RemoteWrite != nil {
+		remoteWrite = newRemoteWriter(backgroundCtx, logger.Named("remote-write"), conf.RemoteWrite, metrics)
+	}
 
 	state := metricsState{
-		historical:      make(map[metricsKey]vmMetricsHistory),
-		present:         make(map[metricsKey]vmMetricsInstant),
-		lastCollectTime: nil,
-		pushWindowStart: time.Now(),
+		computeUnit:       computeUnit,
+		sequence:          sequence,
+		anomalies:         anomalies,
+		reconciler:        reconciler,
+		invariants:        invariants,
+		remoteWrite:       remoteWrite,
+		residency:         residency,
+		egress:            conf.Egress,
+		usageSource:       newUsageSource(conf.Egress),
+		containerCPU:      conf.ContainerCPU,
+		activity:          conf.ScalingActivity,
+		metadata:          conf.EventMetadata,
+		enrichment:        newEventEnrichment(conf.Enrichment, metrics),
+		filter:            newEndpointFilter(conf.EndpointFilter, metrics),
+		activeTime:        conf.ActiveTime,
+		summary:           newLogSummary(clock),
+		errors:            errs,
+		storeFailureConf:  conf.StoreFailure,
+		listVMs:           listVMs,
+		activitySource:    activitySource,
+		databaseActivity:  nil,
+		utilizationConf:   conf.Utilization,
+		utilizationSource: utilizationSource,
+		utilization:       nil,
+		storeFailure: storeFailureState{
+			failingSince:    nil,
+			lastListAttempt: nil,
+			listed:          nil,
+		},
+		allocations:        allocations,
+		roundingRemainders: make(map[roundingKey]float64),
+		deferredUsage:      make(map[roundingKey]deferredUsage),
+		metricsLastSent:    make(map[string]time.Time),
+		costs:              newCostEstimator(metrics),
+		historical:         make(map[metricsKey]vmMetricsHistory),
+		present:            make(map[metricsKey]vmMetricsInstant),
+		lastCollectTime:    nil,
+		departed:           make(map[metricsKey]departedVM),
+		migratedIn:         make(map[types.UID]time.Time),
+		identities:         make(map[metricsKey]billing.Identity),
+		pushWindowStart:    clock.Now(),
+		lastHeartbeat:      time.Time{},
+		snapshot:           conf.HistorySnapshot,
+		lastSnapshot:       clock.Now(),
+		startupBackfill:    conf.StartupBackfill,
+		backfillNotBefore:  time.Time{},
+		backfillStarts:     make(map[metricsKey]time.Time),
+		tracer:             tracer,
+		reporter:           reporter,
+		clock:              clock,
+	}
+	state.restoreHistorySnapshot(logger, clock.Now())
+	if state.startupBackfill != nil && state.backfillNotBefore.IsZero() {
+		logger.Warn("Skipping startup backfill, because there's no history snapshot to bound it")
 	}
 
-	var queueWriters []eventQueuePusher[*billing.IncrementalEvent]
+	var queueWriters []eventQueuePusher[billing.AnyEvent]
+	var sendersDone sync.WaitGroup
+	var signalSendersDone []util.CondChannelSender
+	senderUpdates := make(map[string]clientUpdates)
 
 	for _, c := range clients {
-		qw, queueReader := newEventQueue[*billing.IncrementalEvent](metrics.queueSizeCurrent.WithLabelValues(c.name))
+		breaker := newCircuitBreaker(c.config.CircuitBreaker, metrics.circuitBreakerOpen.WithLabelValues(c.name))
+		maxSize, onOverflow, evictIf, onReject, spill := makeQueueOverflow(logger.Named(fmt.Sprintf("queue-%s", c.name)), c, breaker, metrics, clock)
+		qw, queueReader := newEventQueue(metrics.queueSizeCurrent.WithLabelValues(c.name), maxSize, onOverflow, evictIf, onReject, clock)
 		queueWriters = append(queueWriters, qw)
+		state.summary.addClient(c.name, qw)
 
 		// Start the sender
 		signalDone, thisThreadFinished := util.NewCondChannelPair()
-		defer signalDone.Send() //nolint:gocritic // this defer-in-loop is intentional.
+		signalSendersDone = append(signalSendersDone, signalDone)
+		updates := make(clientUpdates, 1)
+		senderUpdates[c.name] = updates
 		sender := eventSender{
 			clientInfo:        c,
 			metrics:           metrics,
+			summary:           state.summary,
 			queue:             queueReader,
 			collectorFinished: thisThreadFinished,
+			updates:           updates,
+			tracer:            tracer,
+			reporter:          reporter,
+			spill:             spill,
+			lag:               metrics.pushLag.addClient(c.name, queueReader, spill, clock),
+			breaker:           breaker,
+			format:            &pushFormat{mu: sync.Mutex{}, current: c.config.Format},
+			limiter:           newPushLimiter(c.config.RateLimit),
+			faults:            faults.FromContext(backgroundCtx),
+			clock:             clock,
 			lastSendDuration:  0,
 		}
-		go sender.senderLoop(logger.Named(fmt.Sprintf("send-%s", c.name)))
+		senderLogger := logger.Named(fmt.Sprintf("send-%s", c.name))
+		sendersDone.Add(1)
+		go func() {
+			defer sendersDone.Done()
+			sender.senderLoop(senderLogger)
+		}()
 	}
 
+	// Notify the senders when we're done, so they can push whatever is left in their queues.
+	defer func() {
+		for _, signalDone := range signalSendersDone {
+			signalDone.Send()
+		}
+	}()
+
 	// The rest of this function is to do with collection
 	logger = logger.Named("collect")
 
-	state.collect(logger, store, metrics)
+	state.collect(backgroundCtx, logger, store, metrics)
+	state.enqueueStartupBackfill(logger, conf, billing.GetHostname(), queueWriters, metrics.startupBackfillSecondsTotal)
 
 	for {
 		select {
-		case <-collectTicker.C:
-			logger.Info("Collecting billing state")
-			if store.Stopped() && backgroundCtx.Err() == nil {
-				err := errors.New("VM store stopped but background context is still live")
-				logger.Panic("Validation check failed", zap.Error(err))
+		case <-collectTicker.C():
+			logger.Debug("Collecting billing state")
+			state.collect(backgroundCtx, logger, store, metrics)
+			if conf.Heartbeat != nil {
+				state.maybeEnqueueHeartbeats(logger, conf.Heartbeat, billing.GetHostname(), queueWriters)
 			}
-			state.collect(logger, store, metrics)
-		case <-accumulateTicker.C:
-			logger.Info("Creating billing batch")
-			state.drainEnqueue(logger, conf, billing.GetHostname(), queueWriters)
+			state.maybeEnqueueResidencyEvents(logger, billing.GetHostname(), queueWriters)
+			state.maybeSaveHistorySnapshot(logger, clock.Now())
+		case <-accumulateTicker.C():
+			if anyBlocked(queueWriters) {
+				// Usage keeps accumulating in the meantime, so it'll be included in the next batch
+				// that isn't blocked.
+				logger.Warn("Delaying billing batch, a client's queue is full")
+				metrics.accumulationsBlockedTotal.Inc()
+				continue
+			}
+			logger.Debug("Creating billing batch")
+			state.drainEnqueue(logger, conf, billing.GetHostname(), queueWriters, clock.Now(), false)
+		case vm := <-deletedVMs:
+			state.finalizeDeparted(logger, conf, billing.GetHostname(), queueWriters, vm, clock.Now(), false)
+			metrics.deletionsFinalizedTotal.Inc()
+		case vm := <-migratedVMs:
+			// Only VMs with .status.migratedAt are sent here; see migration.go.
+			state.finalizeDeparted(logger, conf, billing.GetHostname(), queueWriters, vm, vm.Status.MigratedAt.Time, true)
+			metrics.migrationsFinalizedTotal.Inc()
+		case <-summaryTicker.C():
+			state.summary.log(logger)
+			state.errors.Flush(logger)
+		case newConf := <-configUpdates:
+			logger.Info("Applying updated billing config")
+			conf = state.reload(logger, conf, newConf, metrics, senderUpdates, collectTicker, accumulateTicker, summaryTicker)
 		case <-backgroundCtx.Done():
+			if conf.ShutdownFlushTimeoutSeconds != 0 {
+				state.flushOnShutdown(logger, conf, queueWriters, signalSendersDone, &sendersDone)
+			}
 			return
 		}
 	}
 }
 
-func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics PromMetrics) {
-	now := time.Now()
+// makeQueueOverflow returns the size limit and overflow handling for the client's queue, along with
+// the spillStore that events are written to, if there is one
+//
+// A non-nil evictIf means that accumulation is blocked while the queue is full, unless evictIf
+// returns true. Other events that are enqueued in the meantime can't wait, so they're passed to
+// onReject.
+//
+// Every event that's dropped is counted in the queue dropped events metric.
+func makeQueueOverflow(
+	logger *zap.Logger,
+	c clientInfo,
+	breaker *circuitBreaker,
+	metrics PromMetrics,
+	clock util.Clock,
+) (
+	maxSize int,
+	onOverflow func([]billing.AnyEvent),
+	evictIf func() bool,
+	onReject func([]billing.AnyEvent),
+	spill *spillStore,
+) {
+	conf := c.config.Queue
+	if conf == nil {
+		return 0, nil, nil, nil, nil
+	}
 
-	metricsBatch := metrics.forBatch()
-	defer metricsBatch.finish() // This doesn't *really* need to be deferred, but it's up here so we don't forget
+	dropped := func(reason string, count int) {
+		metrics.queueDroppedEventsTotal.WithLabelValues(c.name, reason).Add(float64(count))
+	}
+
+	policy := conf.OverflowPolicy
+	if policy == QueueSpillToDisk {
+		var err error
+		spill, err = newSpillStore(conf.SpillDirectory, c.name, clock)
+		if err != nil {
+			// Blocking accumulation is the only other policy that doesn't lose events.
+			logger.Error("Failed to set up spilling billing events to disk, blocking accumulation instead", zap.Error(err))
+			policy = QueueBlockAccumulation
+		}
+	}
+
+	switch policy {
+	case QueueDropOldest:
+		onOverflow = func(evicted []billing.AnyEvent) {
+			logger.Warn("Billing event queue is full, dropped oldest events", zap.Int("count", len(evicted)))
+			metrics.queueOverflowEventsTotal.WithLabelValues(c.name, string(policy), "dropped").Add(float64(len(evicted)))
+			dropped(queueDroppedFull, len(evicted))
+		}
+	case QueueSpillToDisk:
+		onOverflow = func(evicted []billing.AnyEvent) {
+			if err := spill.write(partitionByShard(evicted, shardCountOf(c.sink)), int(c.config.MaxBatchSize)); err != nil {
+				logger.Error("Failed to spill billing events to disk, dropped them", zap.Int("count", len(evicted)), zap.Error(err))
+				metrics.queueOverflowEventsTotal.WithLabelValues(c.name, string(policy), "dropped").Add(float64(len(evicted)))
+				dropped(queueDroppedSpillFailed, len(evicted))
+				return
+			}
+			logger.Info("Billing event queue is full, spilled oldest events to disk", zap.Int("count", len(evicted)))
+			metrics.queueOverflowEventsTotal.WithLabelValues(c.name, string(policy), "spilled").Add(float64(len(evicted)))
+		}
+	case QueueBlockAccumulation:
+		// Blocking would hold up every other client, so don't block while the circuit is open,
+		// because the events aren't going to be sent any time soon.
+		onOverflow = func(evicted []billing.AnyEvent) {
+			logger.Warn("Billing event queue is full and circuit breaker is open, dropped oldest events", zap.Int("count", len(evicted)))
+			metrics.queueOverflowEventsTotal.WithLabelValues(c.name, string(policy), "skipped_circuit_open").Add(float64(len(evicted)))
+			dropped(queueDroppedCircuitOpen, len(evicted))
+		}
+		evictIf = func() bool { return breaker.isOpen(clock.Now()) }
+		// Usage waits for room in the queue -- including the final usage of departed VMs, and
+		// residency -- so the only events that are rejected are heartbeats, which are regenerated
+		// from the current allocations each time.
+		onReject = func(rejected []billing.AnyEvent) {
+			logger.Warn("Billing event queue is full, dropped new events", zap.Int("count", len(rejected)))
+			metrics.queueOverflowEventsTotal.WithLabelValues(c.name, string(policy), "dropped").Add(float64(len(rejected)))
+			dropped(queueDroppedBlocked, len(rejected))
+		}
+	}
+
+	return int(conf.MaxSize), onOverflow, evictIf, onReject, spill
+}
+
+// Values of the "reason" label on the queue dropped events metric
+const (
+	queueDroppedFull        = "queue_full"
+	queueDroppedSpillFailed = "spill_failed"
+	queueDroppedCircuitOpen = "circuit_open"
+	queueDroppedBlocked     = "blocked"
+)
+
+// reload applies the changes from oldConf to newConf, returning the config that's now in effect
+//
+// Accumulated usage and the contents of the queues are preserved, so no events are lost; the only
+// effect on those is that events already in a queue are sent with the new client.
+func (s *metricsState) reload(
+	logger *zap.Logger,
+	oldConf *Config,
+	newConf *Config,
+	metrics PromMetrics,
+	senderUpdates map[string]clientUpdates,
+	collectTicker util.Ticker,
+	accumulateTicker util.Ticker,
+	summaryTicker util.Ticker,
+) *Config {
+	// Make a copy, so that the values we keep from oldConf don't modify the caller's.
+	conf := *newConf
+
+	if conf.SequenceFilePath != oldConf.SequenceFilePath {
+		logger.Warn(
+			"Ignoring change to billing sequenceFilePath, requires restart",
+			zap.String("current", oldConf.SequenceFilePath),
+			zap.String("new", conf.SequenceFilePath),
+		)
+		conf.SequenceFilePath = oldConf.SequenceFilePath
+	}
+	conf.ReloadEverySeconds = oldConf.ReloadEverySeconds
+	if !reflect.DeepEqual(conf.Allocation, oldConf.Allocation) {
+		logger.Warn("Ignoring change to billing allocation, requires restart")
+		conf.Allocation = oldConf.Allocation
+	}
+	if !reflect.DeepEqual(conf.RemoteWrite, oldConf.RemoteWrite) {
+		logger.Warn("Ignoring change to billing remoteWrite, requires restart")
+		conf.RemoteWrite = oldConf.RemoteWrite
+	}
+	if conf.CheckInvariants != oldConf.CheckInvariants {
+		logger.Warn("Ignoring change to billing checkInvariants, requires restart")
+		conf.CheckInvariants = oldConf.CheckInvariants
+	}
+	if oldMax, newMax := oldConf.StoreFailure.retryBackoffMaxSeconds(), conf.StoreFailure.retryBackoffMaxSeconds(); oldMax != newMax {
+		logger.Warn(
+			"Ignoring change to billing storeFailure.retryBackoffMaxSeconds, requires restart",
+			zap.Uint("current", oldMax),
+			zap.Uint("new", newMax),
+		)
+		if conf.StoreFailure != nil {
+			storeFailure := *conf.StoreFailure
+			storeFailure.RetryBackoffMaxSeconds = oldMax
+			conf.StoreFailure = &storeFailure
+		}
+	}
+
+	if conf.CollectEverySeconds != oldConf.CollectEverySeconds {
+		collectTicker.Reset(time.Second * time.Duration(conf.CollectEverySeconds))
+	}
+	if conf.AccumulateEverySeconds != oldConf.AccumulateEverySeconds {
+		accumulateTicker.Reset(time.Second * time.Duration(conf.AccumulateEverySeconds))
+	}
+	if conf.LogSummaryEverySeconds != oldConf.LogSummaryEverySeconds {
+		resetSummaryTicker(summaryTicker, conf.LogSummaryEverySeconds)
+	}
+
+	if !reflect.DeepEqual(conf.AnomalyDetection, oldConf.AnomalyDetection) {
+		// The baseline doesn't carry over, because the windows may now be different.
+		s.anomalies = nil
+		if conf.AnomalyDetection != nil {
+			s.anomalies = newAnomalyDetector(conf.AnomalyDetection, metrics.anomaliesTotal)
+		}
+	}
+	if !reflect.DeepEqual(conf.Reconciliation, oldConf.Reconciliation) {
+		// Like anomaly detection, the history doesn't carry over.
+		s.reconciler = nil
+		if conf.Reconciliation != nil {
+			s.reconciler = newReconciler(conf.Reconciliation, metrics)
+		}
+	}
+	if !reflect.DeepEqual(conf.Residency, oldConf.Residency) {
+		// The buckets may have changed, so the residency since the last events doesn't carry over.
+		s.residency = nil
+		if conf.Residency != nil {
+			s.residency = newResidencyTracker(conf.Residency, metrics, s.clock.Now())
+		}
+	}
+	if !reflect.DeepEqual(conf.Egress, oldConf.Egress) {
+		s.usageSource = newUsageSource(conf.Egress)
+		s.resetEgressBaselines()
+	}
+	s.egress = conf.Egress
+	s.snapshot = conf.HistorySnapshot
+	s.containerCPU = conf.ContainerCPU
+	s.activity = conf.ScalingActivity
+	s.metadata = conf.EventMetadata
+	s.enrichment = newEventEnrichment(conf.Enrichment, metrics)
+	if !reflect.DeepEqual(conf.EndpointFilter, oldConf.EndpointFilter) {
+		s.filter = newEndpointFilter(conf.EndpointFilter, metrics)
+	}
+	s.activeTime = conf.ActiveTime
+	s.utilizationConf = conf.Utilization
+	s.storeFailureConf = conf.StoreFailure
+
+	if conf.Clients.HTTP != nil && oldConf.Clients.HTTP != nil {
+		// Spilled events are stored by shard, so they'd go to the wrong one if the count changed.
+		if oldCount, newCount := shardCount(oldConf.Clients.HTTP), shardCount(conf.Clients.HTTP); oldCount != newCount {
+			logger.Warn(
+				"Ignoring change to number of billing clients.http shards, requires restart",
+				zap.Int("current", oldCount),
+				zap.Int("new", newCount),
+			)
+			httpConf := *conf.Clients.HTTP
+			httpConf.URL = oldConf.Clients.HTTP.URL
+			httpConf.Shards = oldConf.Clients.HTTP.Shards
+			conf.Clients.HTTP = &httpConf
+		}
+	}
+
+	newClients := makeClients(logger, &conf)
+	for _, c := range newClients {
+		updates, ok := senderUpdates[c.name]
+		if !ok {
+			logger.Warn("Ignoring new billing client, requires restart", zap.String("client", c.name))
+			continue
+		}
+		updates.send(c)
+	}
+	for name := range senderUpdates {
+		if !slices.ContainsFunc(newClients, func(c clientInfo) bool { return c.name == name }) {
+			logger.Warn("Ignoring removal of billing client, requires restart", zap.String("client", name))
+		}
+	}
+	// Keep the existing set of clients, so the config matches the ones that are running.
+	if oldConf.Clients.HTTP == nil {
+		conf.Clients.HTTP = nil
+	} else if conf.Clients.HTTP == nil {
+		conf.Clients.HTTP = oldConf.Clients.HTTP
+	} else if !reflect.DeepEqual(conf.Clients.HTTP.Queue, oldConf.Clients.HTTP.Queue) {
+		logger.Warn("Ignoring change to billing clients.http.queue, requires restart")
+		httpConf := *conf.Clients.HTTP
+		httpConf.Queue = oldConf.Clients.HTTP.Queue
+		conf.Clients.HTTP = &httpConf
+	}
+	if oldConf.Clients.File == nil {
+		conf.Clients.File = nil
+	} else if conf.Clients.File == nil {
+		conf.Clients.File = oldConf.Clients.File
+	} else if !reflect.DeepEqual(*conf.Clients.File, *oldConf.Clients.File) {
+		// The file being written is kept across updates, so only the base config can change.
+		fileConf := *oldConf.Clients.File
+		fileConf.BaseClientConfig = conf.Clients.File.BaseClientConfig
+		fileConf.Queue = oldConf.Clients.File.Queue
+		if !reflect.DeepEqual(fileConf, *conf.Clients.File) {
+			logger.Warn("Ignoring change to billing clients.file path, file limits, or queue, requires restart")
+		}
+		conf.Clients.File = &fileConf
+	}
+	if oldConf.Clients.NATS == nil {
+		conf.Clients.NATS = nil
+	} else if conf.Clients.NATS == nil {
+		conf.Clients.NATS = oldConf.Clients.NATS
+	} else if !reflect.DeepEqual(*conf.Clients.NATS, *oldConf.Clients.NATS) {
+		// Like the file client, the connection is kept across updates.
+		natsConf := *oldConf.Clients.NATS
+		natsConf.BaseClientConfig = conf.Clients.NATS.BaseClientConfig
+		natsConf.Queue = oldConf.Clients.NATS.Queue
+		if !reflect.DeepEqual(natsConf, *conf.Clients.NATS) {
+			logger.Warn("Ignoring change to billing clients.nats connection, subject, or queue, requires restart")
+		}
+		conf.Clients.NATS = &natsConf
+	}
+	if oldConf.Clients.S3 == nil {
+		conf.Clients.S3 = nil
+	} else if conf.Clients.S3 == nil {
+		conf.Clients.S3 = oldConf.Clients.S3
+	} else if !reflect.DeepEqual(conf.Clients.S3.Queue, oldConf.Clients.S3.Queue) {
+		logger.Warn("Ignoring change to billing clients.s3.queue, requires restart")
+		s3Conf := *conf.Clients.S3
+		s3Conf.Queue = oldConf.Clients.S3.Queue
+		conf.Clients.S3 = &s3Conf
+	}
+
+	return &conf
+}
+
+// flushOnShutdown enqueues events for all usage since the last batch and waits for the senders
+// to push them, giving up after conf.ShutdownFlushTimeoutSeconds.
+func (s *metricsState) flushOnShutdown(
+	logger *zap.Logger,
+	conf *Config,
+	queues []eventQueuePusher[billing.AnyEvent],
+	signalSendersDone []util.CondChannelSender,
+	sendersDone *sync.WaitGroup,
+) {
+	timeout := time.Second * time.Duration(conf.ShutdownFlushTimeoutSeconds)
+	logger.Info("Flushing billing events before shutdown", zap.Duration("timeout", timeout))
+
+	// This is the last batch, so any remainders from rounding need to be included.
+	s.drainEnqueue(logger, conf, billing.GetHostname(), queues, s.clock.Now(), true)
+	for _, signalDone := range signalSendersDone {
+		signalDone.Send()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		sendersDone.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		logger.Info("Finished flushing billing events")
+	case <-s.clock.After(timeout):
+		logger.Warn("Timed out waiting for billing events to be flushed", zap.Duration("timeout", timeout))
+	}
+}
+
+func (s *metricsState) collect(ctx context.Context, logger *zap.Logger, store VMStoreForNode, metrics PromMetrics) {
+	ctx, span := s.tracer.Start(ctx, "billing.collect")
+	defer span.End()
+
+	now := s.clock.Now()
+
+	// If the store has stopped while we're still running, it's given up after too many failures.
+	// The autoscaler-agent will exit soon, but until then, treat it the same as if it were failing.
+	storeFailing := store.Failing() || (store.Stopped() && ctx.Err() == nil)
 
-	old := s.present
-	s.present = make(map[metricsKey]vmMetricsInstant)
 	var vmsOnThisNode []*vmapi.VirtualMachine
-	if store.Failing() {
-		logger.Error("VM store is currently stopped. No events will be recorded")
+	if storeFailing {
+		vmsOnThisNode = s.vmsWhileStoreFailing(ctx, logger, now, metrics)
 	} else {
+		s.storeNotFailing(logger, now, metrics)
 		vmsOnThisNode = store.ListIndexed(func(i *VMNodeIndex) []*vmapi.VirtualMachine {
 			return i.List()
 		})
 	}
-	for _, vm := range vmsOnThisNode {
+	span.SetAttributes(attribute.Int("billing.vms", len(vmsOnThisNode)), attribute.Bool("billing.store_failing", storeFailing))
+	if s.filter != nil {
+		vmsOnThisNode = s.filter.apply(vmsOnThisNode)
+	}
+	s.refreshDatabaseActivity()
+	s.refreshUtilization()
+	var endpointVMs []*vmapi.VirtualMachine
+	if s.egress != nil || s.containerCPU != nil {
+		for _, vm := range vmsOnThisNode {
+			if _, isEndpoint := vm.Annotations[api.AnnotationBillingEndpointID]; isEndpoint && vm.Status.Phase.IsAlive() && !vm.IsPaused() {
+				endpointVMs = append(endpointVMs, vm)
+			}
+		}
+	}
+	var usage map[types.UID]VMUsage
+	if s.egress != nil {
+		usage = fetchUsage(ctx, logger, s.egress, s.usageSource, s.errors, metrics.networkUsageRequestDuration, endpointVMs)
+	}
+	var containerCPU map[types.UID]*containerCPUUsage
+	if s.containerCPU != nil {
+		containerCPU = fetchContainerCPU(ctx, logger, s.containerCPU, s.errors, endpointVMs)
+	}
+
+	s.collectVMs(logger, now, vmsOnThisNode, usage, containerCPU, metrics)
+}
+
+// collectVMs records the state of the VMs as of now, adding time slices for the VMs that were also
+// present in the previous collection
+//
+// usage is only used if egress collection is enabled, and containerCPU only if container CPU is
+// collected.
+func (s *metricsState) collectVMs(
+	logger *zap.Logger,
+	now time.Time,
+	vms []*vmapi.VirtualMachine,
+	usage map[types.UID]VMUsage,
+	containerCPU map[types.UID]*containerCPUUsage,
+	metrics PromMetrics,
+) {
+	metricsBatch := metrics.forBatch()
+	defer metricsBatch.finish() // This doesn't *really* need to be deferred, but it's up here so we don't forget
+
+	old := s.present
+	s.present = make(map[metricsKey]vmMetricsInstant)
+
+	for _, vm := range vms {
 		endpointID, isEndpoint := vm.Annotations[api.AnnotationBillingEndpointID]
 		metricsBatch.inc(isEndpointFlag(isEndpoint), autoscalingEnabledFlag(api.HasAutoscalingEnabled(vm)), vm.Status.Phase)
 		if !isEndpoint {
@@ -179,7 +1053,9 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 			continue
 		}
 
-		if !vm.Status.Phase.IsAlive() || vm.Status.CPUs == nil {
+		// Paused VMs aren't using any CPU, so their time is treated the same as when they're not
+		// running.
+		if !vm.Status.Phase.IsAlive() || vm.Status.CPUs == nil || vm.IsPaused() {
 			continue
 		}
 
@@ -187,15 +1063,71 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 			uid:        vm.UID,
 			endpointID: endpointID,
 		}
+		s.recordIdentity(key, vm)
 		presentMetrics := vmMetricsInstant{
-			cpu: *vm.Status.CPUs,
+			cpu:               *vm.Status.CPUs,
+			mem:               0,     // set below, if available
+			gpus:              0,     // set below, if available
+			egress:            nil,   // set below, if available
+			idle:              false, // only used for time slices
+			egressUnavailable: false, // set below, if egress is collected
+			containerCPU:      nil,   // set below, if available
+			burstBaselineCU:   0,     // set below, if the VM has burst credits
+			usedCPU:           0,     // set below, if utilization is emitted
+			usedMem:           0,     // set below, if utilization is emitted
+		}
+		if vm.Status.MemorySize != nil {
+			presentMetrics.mem = api.BytesFromResourceQuantity(*vm.Status.MemorySize)
+		}
+		if vm.Spec.Guest.GPUs != nil {
+			presentMetrics.gpus = uint32(vm.Spec.Guest.GPUs.Count)
+		}
+		// Invalid burst credits are reported by the autoscaler-agent when it scales the VM, so here
+		// they're just treated as if there were none.
+		if credits, err := api.ExtractBurstCredits(vm); err == nil && credits != nil {
+			presentMetrics.burstBaselineCU = credits.BaselineCU
+		}
+		if s.utilization != nil {
+			s.setUtilization(vm, &presentMetrics)
+		}
+		if s.egress != nil {
+			if vmUsage, ok := usage[vm.UID]; ok {
+				presentMetrics.egress = &vmUsage.Network
+			} else {
+				presentMetrics.egressUnavailable = true
+				metrics.networkUsageUnavailableTotal.Inc()
+			}
+		}
+		if s.containerCPU != nil {
+			presentMetrics.containerCPU = containerCPU[vm.UID]
 		}
 		if oldMetrics, ok := old[key]; ok {
+			if presentMetrics.egressUnavailable {
+				// Keep the last known value, so that the bytes sent while it was unavailable are
+				// counted when it's available again, rather than lost.
+				presentMetrics.egress = oldMetrics.egress
+			}
+			if s.containerCPU != nil && presentMetrics.containerCPU == nil {
+				// Likewise for the CPU time used by the VM's cgroups.
+				presentMetrics.containerCPU = oldMetrics.containerCPU
+			}
+
 			// The VM was present from s.lastTime to now. Add a time slice to its metrics history.
 			timeSlice := metricsTimeSlice{
 				metrics: vmMetricsInstant{
 					// strategically under-bill by assigning the minimum to the entire time slice.
-					cpu: util.Min(oldMetrics.cpu, presentMetrics.cpu),
+					cpu:  util.Min(oldMetrics.cpu, presentMetrics.cpu),
+					mem:  util.Min(oldMetrics.mem, presentMetrics.mem),
+					gpus: util.Min(oldMetrics.gpus, presentMetrics.gpus),
+					idle: s.idleSince(vm, *s.lastCollectTime),
+					// egress and container CPU are accounted for separately, below.
+					egress:            nil,
+					egressUnavailable: false,
+					containerCPU:      nil,
+					// likewise, under-bill burst usage with the higher baseline.
+					burstBaselineCU: util.Max(oldMetrics.burstBaselineCU, presentMetrics.burstBaselineCU),
+					usedCPU:         util.Min(oldMetrics.usedCPU, presentMetrics.usedCPU),
+					usedMem:         util.Min(oldMetrics.usedMem, presentMetrics.usedMem),
 				},
 				// note: we know s.lastTime != nil because otherwise old would be empty.
 				startTime: *s.lastCollectTime,
@@ -206,28 +1138,81 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 			if !ok {
 				vmHistory = vmMetricsHistory{
 					lastSlice: nil,
-					total:     vmMetricsSeconds{cpu: 0, activeTime: time.Duration(0)},
+					total: vmMetricsSeconds{
+						cpu:                  0,
+						computeUnits:         0,
+						gpu:                  0,
+						burstComputeUnits:    0,
+						usedCPU:              0,
+						usedComputeUnits:     0,
+						activeTime:           time.Duration(0),
+						internalEgressBytes:  0,
+						internetEgressBytes:  0,
+						egressUnavailable:    false,
+						interfaceEgressBytes: nil,
+						containerCPU:         nil,
+						upscales:             0,
+						downscales:           0,
+					},
 				}
 			}
 			// append the slice, merging with the previous if the resource usage was the same
-			vmHistory.appendSlice(timeSlice)
+			vmHistory.appendSlice(timeSlice, s.computeUnit)
+			if s.allocations != nil {
+				s.allocations.record(allocationKey{namespace: vm.Namespace, endpointID: endpointID}, timeSlice)
+			}
+			if s.residency != nil {
+				s.residency.record(endpointID, timeSlice, s.computeUnit)
+			}
+			s.reconcileSlice(endpointID, timeSlice)
+			if s.invariants != nil {
+				s.invariants.observe(endpointID, util.Max(oldMetrics.cpu, presentMetrics.cpu), *s.lastCollectTime, now)
+			}
+			if oldMetrics.egress != nil && presentMetrics.egress != nil {
+				if vmHistory.total.addEgress(*oldMetrics.egress, *presentMetrics.egress) {
+					logger.Info("VM network usage counters were reset", util.VMNameFields(vm))
+					metrics.networkUsageResetsTotal.Inc()
+				}
+			}
+			if oldMetrics.egressUnavailable || presentMetrics.egressUnavailable {
+				vmHistory.total.egressUnavailable = true
+			}
+			if oldMetrics.containerCPU != nil && presentMetrics.containerCPU != nil {
+				vmHistory.total.addContainerCPU(*oldMetrics.containerCPU, *presentMetrics.containerCPU)
+			}
+			if s.activity != nil {
+				vmHistory.total.addScalingActivity(oldMetrics, presentMetrics, s.computeUnit)
+			}
 			s.historical[key] = vmHistory
+		} else if since, ok := s.migratedInSince(vm, now); ok {
+			// The VM was migrated to this node since it was last collected. Its usage from the
+			// migration onwards wasn't counted by the source node, so we count it here.
+			s.addMigratedInSlice(vm, key, presentMetrics, since, now)
+			if s.invariants != nil {
+				s.invariants.observe(endpointID, presentMetrics.cpu, since, now)
+			}
+		} else if s.lastCollectTime == nil && s.startupBackfill != nil {
+			// First collection since startup: the VM may have been running for a while already.
+			s.recordBackfillStart(vm, key, now)
 		}
 
 		s.present[key] = presentMetrics
 	}
 
+	s.recordDeparted(old, s.lastCollectTime)
+	s.forgetOldMigrations(now)
 	s.lastCollectTime = &now
+	s.summary.recordCollection(len(s.present))
 }
 
-func (h *vmMetricsHistory) appendSlice(timeSlice metricsTimeSlice) {
+func (h *vmMetricsHistory) appendSlice(timeSlice metricsTimeSlice, computeUnit api.Resources) {
 	// Try to extend the existing period of continuous usage
 	if h.lastSlice != nil && h.lastSlice.tryMerge(timeSlice) {
 		return
 	}
 
 	// Something's new. Push previous time slice, start new one:
-	h.finalizeCurrentTimeSlice()
+	h.finalizeCurrentTimeSlice(computeUnit)
 	h.lastSlice = &timeSlice
 }
 
@@ -235,7 +1220,7 @@ func (h *vmMetricsHistory) appendSlice(timeSlice metricsTimeSlice) {
 //
 // This ends up rounding down the total time spent on a given time slice, so it's best to defer
 // calling this function until it's actually needed.
-func (h *vmMetricsHistory) finalizeCurrentTimeSlice() {
+func (h *vmMetricsHistory) finalizeCurrentTimeSlice(computeUnit api.Resources) {
 	if h.lastSlice == nil {
 		return
 	}
@@ -245,18 +1230,66 @@ func (h *vmMetricsHistory) finalizeCurrentTimeSlice() {
 		panic("negative duration")
 	}
 
+	activeTime := duration
+	if h.lastSlice.metrics.idle {
+		activeTime = 0
+	}
+
 	// TODO: This approach is imperfect. Floating-point math is probably *fine*, but really not
 	// something we want to rely on. A "proper" solution is a lot of work, but long-term valuable.
 	metricsSeconds := vmMetricsSeconds{
-		cpu:        duration.Seconds() * h.lastSlice.metrics.cpu.AsFloat64(),
-		activeTime: duration,
+		cpu:               duration.Seconds() * h.lastSlice.metrics.cpu.AsFloat64(),
+		computeUnits:      duration.Seconds() * h.lastSlice.metrics.computeUnits(computeUnit),
+		gpu:               duration.Seconds() * float64(h.lastSlice.metrics.gpus),
+		burstComputeUnits: duration.Seconds() * h.lastSlice.metrics.burstComputeUnits(computeUnit),
+		usedCPU:           duration.Seconds() * h.lastSlice.metrics.usedCPU.AsFloat64(),
+		usedComputeUnits:  duration.Seconds() * h.lastSlice.metrics.usedComputeUnits(computeUnit),
+		activeTime:        activeTime,
+		// egress is not tracked by time slices; see vmMetricsInstant.
+		internalEgressBytes:  0,
+		internetEgressBytes:  0,
+		egressUnavailable:    false,
+		interfaceEgressBytes: nil,
+		containerCPU:         nil,
+		upscales:             0,
+		downscales:           0,
 	}
 	h.total.cpu += metricsSeconds.cpu
+	h.total.computeUnits += metricsSeconds.computeUnits
+	h.total.gpu += metricsSeconds.gpu
+	h.total.burstComputeUnits += metricsSeconds.burstComputeUnits
+	h.total.usedCPU += metricsSeconds.usedCPU
+	h.total.usedComputeUnits += metricsSeconds.usedComputeUnits
 	h.total.activeTime += metricsSeconds.activeTime
 
 	h.lastSlice = nil
 }
 
+// computeUnits returns the number of compute units represented by the allocation, which is the
+// larger of the CPU and memory amounts, each divided by the corresponding amount in one CU.
+//
+// Fractional CUs are preserved, so that VMs with allocations that aren't a multiple of the compute
+// unit are not over-billed.
+func (m vmMetricsInstant) computeUnits(computeUnit api.Resources) float64 {
+	var cpuCUs, memCUs float64
+	if computeUnit.VCPU != 0 {
+		cpuCUs = m.cpu.AsFloat64() / computeUnit.VCPU.AsFloat64()
+	}
+	if computeUnit.Mem != 0 {
+		memCUs = m.mem.AsFloat64() / computeUnit.Mem.AsFloat64()
+	}
+	return math.Max(cpuCUs, memCUs)
+}
+
+// burstComputeUnits returns the number of compute units represented by the allocation that are
+// above the baseline of the VM's burst credits, or zero if it doesn't have any
+func (m vmMetricsInstant) burstComputeUnits(computeUnit api.Resources) float64 {
+	if m.burstBaselineCU == 0 {
+		return 0
+	}
+	return math.Max(0, m.computeUnits(computeUnit)-float64(m.burstBaselineCU))
+}
+
 // tryMerge attempts to merge s and next (assuming that next is after s), returning true only if
 // that merging was successful.
 //
@@ -270,9 +1303,10 @@ func (s *metricsTimeSlice) tryMerge(next metricsTimeSlice) bool {
 }
 
 func logAddedEvent(logger *zap.Logger, event *billing.IncrementalEvent) *billing.IncrementalEvent {
-	logger.Info(
+	logger.Debug(
 		"Adding event to batch",
 		zap.String("IdempotencyKey", event.IdempotencyKey),
+		zap.Uint64("SequenceNumber", event.SequenceNumber),
 		zap.String("EndpointID", event.EndpointID),
 		zap.String("MetricName", event.MetricName),
 		zap.Int("Value", event.Value),
@@ -280,47 +1314,547 @@ func logAddedEvent(logger *zap.Logger, event *billing.IncrementalEvent) *billing
 	return event
 }
 
-// drainEnqueue clears the current history, adding it as events to the queue
-func (s *metricsState) drainEnqueue(logger *zap.Logger, conf *Config, hostname string, queues []eventQueuePusher[*billing.IncrementalEvent]) {
-	now := time.Now()
+// drainEnqueue clears the current history, adding it as events to the queue, with the batch ending
+// at now
+//
+// If settleAll is true, the remainders from rounding for every endpoint are included, rather than
+// being carried over into the next batch, as is any usage that was held back by the metrics'
+// cadences.
+func (s *metricsState) drainEnqueue(
+	logger *zap.Logger,
+	conf *Config,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+	now time.Time,
+	settleAll bool,
+) {
+	_, span := s.tracer.Start(context.Background(), "billing.accumulate", trace.WithAttributes(attribute.Int("billing.endpoints", len(s.historical))))
+	defer span.End()
+
+	// Endpoints with a remainder from rounding (or usage that was held back) that have since left
+	// this node without any more usage still need an event, so that the remainder isn't lost.
+	leftover := maps.Keys(s.roundingRemainders)
+	for rk := range s.deferredUsage {
+		leftover = append(leftover, rk)
+	}
+	for _, rk := range leftover {
+		_, hasHistory := s.historical[rk.metricsKey]
+		_, present := s.present[rk.metricsKey]
+		if !hasHistory && (settleAll || !present) {
+			s.historical[rk.metricsKey] = vmMetricsHistory{
+				lastSlice: nil,
+				total: vmMetricsSeconds{
+					cpu:                  0,
+					computeUnits:         0,
+					gpu:                  0,
+					burstComputeUnits:    0,
+					usedCPU:              0,
+					usedComputeUnits:     0,
+					activeTime:           time.Duration(0),
+					internalEgressBytes:  0,
+					internetEgressBytes:  0,
+					egressUnavailable:    false,
+					interfaceEgressBytes: nil,
+					containerCPU:         nil,
+					upscales:             0,
+					downscales:           0,
+				},
+			}
+		}
+	}
+
+	windows := splitWindow(s.pushWindowStart, now, time.Second*time.Duration(conf.MaxEventWindowSeconds))
+	if len(windows) > 1 {
+		logger.Warn(
+			"Splitting billing usage into multiple windows",
+			zap.Time("start", s.pushWindowStart),
+			zap.Duration("duration", now.Sub(s.pushWindowStart)),
+			zap.Int("windows", len(windows)),
+		)
+	}
+	// The usage is about to be enqueued, so it mustn't be restored from a snapshot anymore. That
+	// includes the usage that was held back, which may be added to the events.
+	s.saveHistorySnapshot(logger, now, now, nil, nil)
+	for i, historical := range splitHistory(s.historical, s.computeUnit, windows) {
+		s.enqueueHistory(logger, conf, hostname, queues, now, windows[i], historical, settleAll)
+
+		if s.anomalies != nil {
+			s.anomalies.finishWindow()
+		}
+	}
+
+	batchDuration := now.Sub(s.pushWindowStart)
+	s.pushWindowStart = now
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	// ... but whatever's still held back isn't in any of the events, so it needs to be restored.
+	if len(s.deferredUsage) != 0 {
+		s.saveHistorySnapshot(logger, now, now, nil, s.deferredUsage)
+	}
+	s.forgetIdentities()
+
+	if s.reconciler != nil {
+		s.reconciler.finishWindow(logger)
+	}
+	if s.invariants != nil {
+		s.invariants.finishBatch()
+	}
+	if s.remoteWrite != nil {
+		s.remoteWrite.push(now, hostname, s.egress != nil)
+	}
+	if s.costs != nil {
+		s.costs.finishBatch(conf.CostEstimate, batchDuration)
+	}
+}
+
+// finalizeDeparted immediately enqueues the usage of a VM that was deleted or migrated away from
+// this node, rather than waiting for the next batch, so that usage for short-lived VMs isn't lost
+// if we're restarted in the meantime.
+//
+// The VM's usage since the last collection is included up to end, assuming that its resources
+// didn't change in that time. For migrated VMs, end is the time of the migration, and any usage
+// that was collected after it is removed, because it's counted by the target node.
+func (s *metricsState) finalizeDeparted(
+	logger *zap.Logger,
+	conf *Config,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+	vm *vmapi.VirtualMachine,
+	end time.Time,
+	migrated bool,
+) {
+	endpointID, isEndpoint := vm.Annotations[api.AnnotationBillingEndpointID]
+	if !isEndpoint {
+		return
+	}
+	key := metricsKey{
+		uid:        vm.UID,
+		endpointID: endpointID,
+	}
+	s.recordIdentity(key, vm)
+
+	now := s.clock.Now()
+
+	// If the VM was already gone from the latest collection, its usage is counted from the one
+	// before.
+	var lastMetrics vmMetricsInstant
+	var lastSeen *time.Time
+	if presentMetrics, ok := s.present[key]; ok && s.lastCollectTime != nil {
+		lastMetrics, lastSeen = presentMetrics, s.lastCollectTime
+	} else if departed, ok := s.departed[key]; ok {
+		lastMetrics, lastSeen = departed.metrics, &departed.lastSeen
+	}
+
+	if history, ok := s.historical[key]; ok && migrated {
+		if history.lastSlice != nil {
+			// The usage that's removed was already recorded for reconciliation. A slice from the
+			// old end back to the new one has a negative duration, which removes it again.
+			before := *history.lastSlice
+			history.clampToMigration(end)
+			s.reconcileSlice(endpointID, metricsTimeSlice{
+				metrics:   before.metrics,
+				startTime: before.endTime,
+				endTime:   history.lastSlice.endTime,
+			})
+		}
+		s.historical[key] = history
+	}
+
+	if lastSeen != nil && end.After(*lastSeen) {
+		timeSlice := metricsTimeSlice{
+			metrics: vmMetricsInstant{
+				cpu:               lastMetrics.cpu,
+				mem:               lastMetrics.mem,
+				gpus:              lastMetrics.gpus,
+				idle:              false,
+				egress:            nil,
+				egressUnavailable: false,
+				containerCPU:      nil,
+				burstBaselineCU:   lastMetrics.burstBaselineCU,
+				usedCPU:           lastMetrics.usedCPU,
+				usedMem:           lastMetrics.usedMem,
+			},
+			startTime: *lastSeen,
+			endTime:   end,
+		}
+
+		vmHistory, ok := s.historical[key]
+		if !ok {
+			vmHistory = vmMetricsHistory{
+				lastSlice: nil,
+				total: vmMetricsSeconds{
+					cpu:                  0,
+					computeUnits:         0,
+					gpu:                  0,
+					burstComputeUnits:    0,
+					usedCPU:              0,
+					usedComputeUnits:     0,
+					activeTime:           time.Duration(0),
+					internalEgressBytes:  0,
+					internetEgressBytes:  0,
+					egressUnavailable:    false,
+					interfaceEgressBytes: nil,
+					containerCPU:         nil,
+					upscales:             0,
+					downscales:           0,
+				},
+			}
+		}
+		vmHistory.appendSlice(timeSlice, s.computeUnit)
+		if s.allocations != nil {
+			s.allocations.record(allocationKey{namespace: vm.Namespace, endpointID: endpointID}, timeSlice)
+		}
+		if s.residency != nil {
+			s.residency.record(endpointID, timeSlice, s.computeUnit)
+		}
+		s.reconcileSlice(endpointID, timeSlice)
+		if s.invariants != nil {
+			s.invariants.observe(endpointID, lastMetrics.cpu, *lastSeen, end)
+		}
+		s.historical[key] = vmHistory
+	}
+	delete(s.present, key)
+	delete(s.departed, key)
+
+	history, ok := s.historical[key]
+	if !ok {
+		delete(s.identities, key)
+		return
+	}
+	if anyBlocked(queues) {
+		// The usage can't be recomputed, so it's kept with the rest until there's room, and sent in
+		// the next batch that isn't blocked.
+		logger.Warn("Delaying billing for departed VM, a client's queue is full", util.VMNameFields(vm), zap.String("endpointID", endpointID))
+		s.saveHistorySnapshot(logger, now, s.pushWindowStart, s.historical, s.deferredUsage)
+		return
+	}
+	delete(s.historical, key)
+	defer delete(s.identities, key)
+	// Everything held back for the VM is added to its events, so it's not in the snapshot either.
+	s.saveHistorySnapshot(logger, now, s.pushWindowStart, s.historical, s.deferredUsageExcept(key))
+
+	if migrated {
+		logger.Info("Finalizing billing for VM migrated away", util.VMNameFields(vm), zap.String("endpointID", endpointID), zap.Time("migratedAt", end))
+	} else {
+		logger.Info("Finalizing billing for deleted VM", util.VMNameFields(vm), zap.String("endpointID", endpointID))
+	}
+	window := eventWindow{start: s.pushWindowStart, end: now, last: true}
+	s.enqueueHistory(logger, conf, hostname, queues, now, window, map[metricsKey]vmMetricsHistory{key: history}, true)
+}
+
+// enqueueHistory adds events for the usage in each history, covering the window
+//
+// Remainders from rounding are carried over for endpoints that are still present, unless settleAll
+// is true. They're never settled before the last window.
+func (s *metricsState) enqueueHistory(
+	logger *zap.Logger,
+	conf *Config,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+	now time.Time,
+	window eventWindow,
+	historical map[metricsKey]vmMetricsHistory,
+	settleAll bool,
+) {
+	eventsPerVM := 2
+	if conf.ComputeUnitMetricName != "" {
+		eventsPerVM += 1
+	}
+	if conf.GPUMetricName != "" {
+		eventsPerVM += 1
+	}
+	if conf.BurstMetricName != "" {
+		eventsPerVM += 1
+	}
+	if conf.Utilization != nil {
+		eventsPerVM += 2
+	}
+	if conf.Egress != nil {
+		eventsPerVM += 2 + len(conf.Egress.InterfaceMetricNames)
+	}
+	if conf.ContainerCPU != nil {
+		eventsPerVM += len(conf.ContainerCPU.MetricNames)
+	}
+	if conf.ScalingActivity != nil {
+		eventsPerVM += 2
+	}
+
+	// Sorted, so that the order of events for each VM is consistent.
+	var interfaceNetworks []string
+	if conf.Egress != nil {
+		for network := range conf.Egress.InterfaceMetricNames {
+			interfaceNetworks = append(interfaceNetworks, network)
+		}
+		slices.Sort(interfaceNetworks)
+	}
+	var cgroups []string
+	if conf.ContainerCPU != nil {
+		for cgroup := range conf.ContainerCPU.MetricNames {
+			cgroups = append(cgroups, cgroup)
+		}
+		slices.Sort(cgroups)
+	}
 
 	countInBatch := 0
-	batchSize := 2 * len(s.historical)
+	batchSize := eventsPerVM * len(historical)
 
-	// Helper function that adds an event to all queues
+	firstSeq, err := s.sequence.Reserve(uint64(batchSize))
+	if err != nil {
+		logger.Error("Failed to persist billing sequence number", zap.Error(err))
+	}
+
+	// With settleAll, nothing is held back, so it's not counted as a batch for the metrics'
+	// cadences.
+	var notDue map[string]struct{}
+	if !settleAll {
+		notDue = s.metricsNotDue(conf, window.start, window.end)
+	}
+
+	// Helper function that enriches the event and adds it to the batch for all queues
+	var batch []billing.AnyEvent
 	enqueue := func(event *billing.IncrementalEvent) {
-		for _, q := range queues {
-			q.enqueue(event)
+		if s.anomalies != nil {
+			event.Anomalous = s.anomalies.check(logger, event)
 		}
+		seq := firstSeq + uint64(countInBatch)
+		countInBatch += 1
+		event = logAddedEvent(logger, billing.Enrich(now, hostname, seq, countInBatch, batchSize, event))
+		if s.reconciler != nil && event.MetricName == conf.CPUMetricName {
+			s.reconciler.recordEmitted(event.EndpointID, event.Value)
+		}
+		batch = append(batch, event)
 	}
 
-	for key, history := range s.historical {
-		history.finalizeCurrentTimeSlice()
+	for key, history := range historical {
+		history.finalizeCurrentTimeSlice(s.computeUnit)
+		if s.invariants != nil {
+			s.invariants.recordBilled(logger, key.endpointID, history.total.cpu)
+		}
+		if s.remoteWrite != nil {
+			s.remoteWrite.record(now, key.endpointID, history.total)
+		}
 
-		countInBatch += 1
-		enqueue(logAddedEvent(logger, billing.Enrich(now, hostname, countInBatch, batchSize, &billing.IncrementalEvent{
+		_, present := s.present[key]
+		settle := window.last && (settleAll || !present)
+		identity := s.identities[key]
+		round := func(metricName string, value float64) int {
+			if s.costs != nil {
+				s.costs.record(conf.CostEstimate, key.endpointID, metricName, value)
+			}
+			return s.roundValue(conf.Rounding, key, metricName, value, settle)
+		}
+		// Helper function that holds back the event if its metric isn't due, and otherwise
+		// enqueues it
+		emit := func(event *billing.IncrementalEvent) {
+			_, hold := notDue[event.MetricName]
+			if !s.deferEvent(key, event, hold && !settle) {
+				enqueue(event)
+			}
+		}
+
+		emit(&billing.IncrementalEvent{
 			MetricName:     conf.CPUMetricName,
 			Type:           "", // set by billing.Enrich
+			SchemaVersion:  0,  // set by billing.Enrich
 			IdempotencyKey: "", // set by billing.Enrich
+			SequenceNumber: 0,  // set by billing.Enrich
 			EndpointID:     key.endpointID,
 			// TODO: maybe we should store start/stop time in the vmMetricsHistory object itself?
 			// That way we can be aligned to collection, rather than pushing.
-			StartTime: s.pushWindowStart,
-			StopTime:  now,
-			Value:     int(math.Round(history.total.cpu)),
-		})))
-		countInBatch += 1
-		enqueue(logAddedEvent(logger, billing.Enrich(now, hostname, countInBatch, batchSize, &billing.IncrementalEvent{
+			StartTime: window.start,
+			StopTime:  window.end,
+			Value:     round(conf.CPUMetricName, history.total.cpu),
+			Anomalous: false, // set by enqueue
+			Partial:   false,
+			Identity:  identity,
+		})
+		emit(&billing.IncrementalEvent{
 			MetricName:     conf.ActiveTimeMetricName,
 			Type:           "", // set by billing.Enrich
+			SchemaVersion:  0,  // set by billing.Enrich
 			IdempotencyKey: "", // set by billing.Enrich
+			SequenceNumber: 0,  // set by billing.Enrich
 			EndpointID:     key.endpointID,
-			StartTime:      s.pushWindowStart,
-			StopTime:       now,
-			Value:          int(math.Round(history.total.activeTime.Seconds())),
-		})))
+			StartTime:      window.start,
+			StopTime:       window.end,
+			Value:          round(conf.ActiveTimeMetricName, history.total.activeTime.Seconds()),
+			Anomalous:      false, // set by enqueue
+			Partial:        false,
+			Identity:       identity,
+		})
+		if conf.ComputeUnitMetricName != "" {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.ComputeUnitMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.ComputeUnitMetricName, history.total.computeUnits),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
+		if conf.GPUMetricName != "" {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.GPUMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.GPUMetricName, history.total.gpu),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
+		if conf.BurstMetricName != "" {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.BurstMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.BurstMetricName, history.total.burstComputeUnits),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
+		if conf.Utilization != nil {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.Utilization.CPUMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.Utilization.CPUMetricName, history.total.usedCPU),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.Utilization.ComputeUnitMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.Utilization.ComputeUnitMetricName, history.total.usedComputeUnits),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
+		if conf.Egress != nil {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.Egress.InternalMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.Egress.InternalMetricName, float64(history.total.internalEgressBytes)),
+				Anomalous:      false, // set by enqueue
+				Partial:        history.total.egressUnavailable,
+				Identity:       identity,
+			})
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.Egress.InternetMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.Egress.InternetMetricName, float64(history.total.internetEgressBytes)),
+				Anomalous:      false, // set by enqueue
+				Partial:        history.total.egressUnavailable,
+				Identity:       identity,
+			})
+			for _, network := range interfaceNetworks {
+				metricName := conf.Egress.InterfaceMetricNames[network]
+				emit(&billing.IncrementalEvent{
+					MetricName:     metricName,
+					Type:           "", // set by billing.Enrich
+					SchemaVersion:  0,  // set by billing.Enrich
+					IdempotencyKey: "", // set by billing.Enrich
+					SequenceNumber: 0,  // set by billing.Enrich
+					EndpointID:     key.endpointID,
+					StartTime:      window.start,
+					StopTime:       window.end,
+					Value:          round(metricName, float64(history.total.interfaceEgressBytes[network])),
+					Anomalous:      false, // set by enqueue
+					Partial:        history.total.egressUnavailable,
+					Identity:       identity,
+				})
+			}
+		}
+		for _, cgroup := range cgroups {
+			metricName := conf.ContainerCPU.MetricNames[cgroup]
+			emit(&billing.IncrementalEvent{
+				MetricName:     metricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(metricName, history.total.containerCPU[cgroup]),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
+		if conf.ScalingActivity != nil {
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.ScalingActivity.UpscaleMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.ScalingActivity.UpscaleMetricName, float64(history.total.upscales)),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+			emit(&billing.IncrementalEvent{
+				MetricName:     conf.ScalingActivity.DownscaleMetricName,
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      window.start,
+				StopTime:       window.end,
+				Value:          round(conf.ScalingActivity.DownscaleMetricName, float64(history.total.downscales)),
+				Anomalous:      false, // set by enqueue
+				Partial:        false,
+				Identity:       identity,
+			})
+		}
 	}
 
-	s.pushWindowStart = now
-	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.enqueueBatch(queues, batch)
+	s.summary.recordEnqueued(countInBatch)
 }
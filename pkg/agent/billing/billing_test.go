@@ -0,0 +1,320 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestFinalizeDeleted(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(start)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.computeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+	s.pushWindowStart = start
+	s.clock = clock
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, clock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	newVM := func(uid types.UID, cpu vmapi.MilliCPU) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = uid
+		vm.Name = string(uid)
+		vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep-" + string(uid)}
+		vm.Status.Phase = vmapi.VmRunning
+		vm.Status.CPUs = &cpu
+		return vm
+	}
+	vmA := newVM("vm-a", 1000)
+	vmB := newVM("vm-b", 2000)
+
+	// cpuEvents returns the value of the CPU event for each endpoint in the queue, emptying it
+	cpuEvents := func() map[string]int {
+		values := make(map[string]int)
+		for _, e := range puller.get(puller.size()) {
+			if e, ok := e.(*billing.IncrementalEvent); ok && e.MetricName == "cpu" {
+				values[e.EndpointID] += e.Value
+			}
+		}
+		puller.drop(puller.size())
+		return values
+	}
+
+	s.collectVMs(logger, clock.Now(), []*vmapi.VirtualMachine{vmA, vmB}, nil, nil, metrics)
+	clock.Advance(30 * time.Second)
+	s.collectVMs(logger, clock.Now(), []*vmapi.VirtualMachine{vmA, vmB}, nil, nil, metrics)
+
+	// When vm-a is deleted, its usage is enqueued immediately, including the time since the last
+	// collection.
+	clock.Advance(15 * time.Second)
+	s.finalizeDeparted(logger, &conf, "host", queues, vmA, clock.Now(), false)
+	assert.Equal(t, map[string]int{"ep-vm-a": 45}, cpuEvents())
+
+	// ... so the next batch only has vm-b
+	clock.Advance(15 * time.Second)
+	s.collectVMs(logger, clock.Now(), []*vmapi.VirtualMachine{vmB}, nil, nil, metrics)
+	s.drainEnqueue(logger, &conf, "host", queues, clock.Now(), false)
+	assert.Equal(t, map[string]int{"ep-vm-b": 120}, cpuEvents())
+
+	// Finalizing a VM that's already been finalized does nothing
+	s.finalizeDeparted(logger, &conf, "host", queues, vmA, clock.Now(), false)
+	assert.Equal(t, 0, puller.size())
+
+	// If the deletion arrives after the VM was already gone from the latest collection, its usage
+	// is counted from the collection before.
+	clock.Advance(30 * time.Second)
+	s.collectVMs(logger, clock.Now(), nil, nil, nil, metrics)
+	clock.Advance(10 * time.Second)
+	s.finalizeDeparted(logger, &conf, "host", queues, vmB, clock.Now(), false)
+	assert.Equal(t, map[string]int{"ep-vm-b": 80}, cpuEvents())
+	assert.Empty(t, s.historical)
+	assert.Empty(t, s.present)
+	assert.Empty(t, s.departed)
+
+	// VMs without an endpoint ID aren't billed at all
+	vmC := newVM("vm-c", 1000)
+	delete(vmC.Annotations, api.AnnotationBillingEndpointID)
+	s.finalizeDeparted(logger, &conf, "host", queues, vmC, clock.Now(), false)
+	require.Equal(t, 0, puller.size())
+}
+
+func TestFinalizeDeletedWhileBlocked(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(start)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.computeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+	s.metadata = &EventMetadataConfig{Fields: []EventMetadataField{EventMetadataVMName}, RegionLabel: ""}
+	s.pushWindowStart = start
+	s.clock = clock
+
+	// A queue that rejects new events while it's full, as with the "block" overflow policy
+	var rejected []billing.AnyEvent
+	onReject := func(events []billing.AnyEvent) { rejected = append(rejected, events...) }
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 2, nil, nil, onReject, clock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	cpu := vmapi.MilliCPU(1000)
+	vm := new(vmapi.VirtualMachine)
+	vm.UID = "vm-a"
+	vm.Name = "vm-a"
+	vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep-vm-a"}
+	vm.Status.Phase = vmapi.VmRunning
+	vm.Status.CPUs = &cpu
+
+	s.collectVMs(logger, clock.Now(), []*vmapi.VirtualMachine{vm}, nil, nil, metrics)
+	clock.Advance(30 * time.Second)
+	s.collectVMs(logger, clock.Now(), []*vmapi.VirtualMachine{vm}, nil, nil, metrics)
+
+	// While the queue is full, the deleted VM's usage is kept rather than enqueued
+	pusher.enqueue(queueTestEvents(2)...)
+	require.True(t, pusher.blocked())
+	clock.Advance(15 * time.Second)
+	s.finalizeDeparted(logger, &conf, "host", queues, vm, clock.Now(), false)
+	assert.Empty(t, rejected)
+	assert.Equal(t, 2, puller.size())
+	assert.Len(t, s.historical, 1)
+	assert.Empty(t, s.present)
+
+	// ... and it's included in the next batch once there's room, with its identity
+	puller.drop(puller.size())
+	clock.Advance(15 * time.Second)
+	s.collectVMs(logger, clock.Now(), nil, nil, nil, metrics)
+	s.drainEnqueue(logger, &conf, "host", queues, clock.Now(), false)
+	values := make(map[string]int)
+	for _, e := range puller.get(puller.size()) {
+		if e, ok := e.(*billing.IncrementalEvent); ok && e.MetricName == "cpu" {
+			values[e.EndpointID] += e.Value
+			assert.Equal(t, "vm-a", e.Identity.VMName)
+		}
+	}
+	assert.Equal(t, map[string]int{"ep-vm-a": 45}, values)
+	assert.Empty(t, rejected)
+	assert.Empty(t, s.historical)
+	assert.Empty(t, s.identities)
+}
+
+func TestGPUSeconds(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+	conf.GPUMetricName = "gpu"
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.pushWindowStart = start
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, util.RealClock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	newVM := func(uid types.UID, gpus *vmapi.GPUs) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = uid
+		vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep-" + string(uid)}
+		vm.Status.Phase = vmapi.VmRunning
+		cpu := vmapi.MilliCPU(1000)
+		vm.Status.CPUs = &cpu
+		vm.Spec.Guest.GPUs = gpus
+		return vm
+	}
+	vms := []*vmapi.VirtualMachine{
+		newVM("vm-gpu", &vmapi.GPUs{ResourceName: "nvidia.com/gpu", Count: 2}),
+		newVM("vm-cpu", nil),
+	}
+
+	s.collectVMs(logger, start, vms, nil, nil, metrics)
+	now := start.Add(90 * time.Second)
+	s.collectVMs(logger, now, vms, nil, nil, metrics)
+	s.drainEnqueue(logger, &conf, "host", queues, now, false)
+
+	values := make(map[string]int)
+	for _, e := range puller.get(puller.size()) {
+		if e, ok := e.(*billing.IncrementalEvent); ok && e.MetricName == "gpu" {
+			values[e.EndpointID] += e.Value
+		}
+	}
+	// Each GPU is billed for the whole time the VM was running, and endpoints without GPUs still
+	// get an event, with zero.
+	assert.Equal(t, map[string]int{"ep-vm-gpu": 180, "ep-vm-cpu": 0}, values)
+}
+
+func TestBurstComputeUnitSeconds(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+	conf.BurstMetricName = "burst"
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.computeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.pushWindowStart = start
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, util.RealClock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	// Every VM has 4 CU, which is 1 CPU
+	newVM := func(uid types.UID, credits string) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = uid
+		vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep-" + string(uid)}
+		if credits != "" {
+			vm.Annotations[api.AnnotationBurstCredits] = credits
+		}
+		vm.Status.Phase = vmapi.VmRunning
+		cpu := vmapi.MilliCPU(1000)
+		vm.Status.CPUs = &cpu
+		return vm
+	}
+	vms := []*vmapi.VirtualMachine{
+		newVM("above", `{"baselineCU": 1, "secondsPerHour": 600}`),
+		newVM("at", `{"baselineCU": 4, "secondsPerHour": 600}`),
+		newVM("none", ""),
+		// Invalid burst credits are treated as if there were none
+		newVM("invalid", `{"baselineCU": 1, "secondsPerHour": 7200}`),
+	}
+
+	batch := func(seconds int) map[string]int {
+		now := start.Add(time.Duration(seconds) * time.Second)
+		s.collectVMs(logger, now, vms, nil, nil, metrics)
+		s.drainEnqueue(logger, &conf, "host", queues, now, false)
+
+		values := make(map[string]int)
+		events := puller.get(puller.size())
+		for _, e := range events {
+			if e, ok := e.(*billing.IncrementalEvent); ok && e.MetricName == "burst" {
+				values[e.EndpointID] += e.Value
+			}
+		}
+		puller.drop(len(events))
+		return values
+	}
+
+	s.collectVMs(logger, start, vms, nil, nil, metrics)
+	// Only the compute units above the baseline are counted, and every endpoint gets an event.
+	assert.Equal(t, map[string]int{"ep-above": 180, "ep-at": 0, "ep-none": 0, "ep-invalid": 0}, batch(60))
+
+	// Once the VM is scaled down to its baseline, there's nothing more to count
+	cpu := vmapi.MilliCPU(250)
+	vms[0].Status.CPUs = &cpu
+	assert.Equal(t, map[string]int{"ep-above": 0, "ep-at": 0, "ep-none": 0, "ep-invalid": 0}, batch(120))
+}
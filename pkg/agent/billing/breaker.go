@@ -0,0 +1,88 @@
+package billing
+
+// Per-client circuit breaker, so that a client whose destination keeps failing stops being retried
+// on every push, and doesn't hold up accumulation for the other clients.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed pushes after which the circuit opens.
+	FailureThreshold uint `json:"failureThreshold"`
+	// OpenSeconds is how long the circuit stays open before another push is attempted. If that
+	// push fails, the circuit opens again straight away.
+	OpenSeconds uint `json:"openSeconds"`
+}
+
+// circuitBreaker tracks consecutive failures for a single client
+//
+// It's shared between the client's sender, which records the result of each push, and the
+// collector, which checks whether the client's queue should shed events instead of blocking.
+type circuitBreaker struct {
+	mu     sync.Mutex
+	config *CircuitBreakerConfig // nil if the circuit never opens
+	// failures is the number of consecutive failed pushes
+	failures uint
+	// openUntil is the time until which the circuit is open. It's zero if the circuit hasn't opened
+	// since the last successful push.
+	openUntil time.Time
+	gauge     prometheus.Gauge
+}
+
+func newCircuitBreaker(config *CircuitBreakerConfig, gauge prometheus.Gauge) *circuitBreaker {
+	gauge.Set(0)
+	return &circuitBreaker{
+		mu:        sync.Mutex{},
+		config:    config,
+		failures:  0,
+		openUntil: time.Time{},
+		gauge:     gauge,
+	}
+}
+
+// isOpen returns whether pushes should be skipped at the given time
+func (b *circuitBreaker) isOpen(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.config != nil && now.Before(b.openUntil)
+}
+
+// recordResult updates the breaker with the result of a push, returning whether the circuit was
+// opened as a result
+func (b *circuitBreaker) recordResult(now time.Time, err error) (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.gauge.Set(0)
+		return false
+	}
+
+	b.failures += 1
+	if b.config == nil || b.failures < b.config.FailureThreshold {
+		return false
+	}
+	b.openUntil = now.Add(time.Second * time.Duration(b.config.OpenSeconds))
+	b.gauge.Set(1)
+	return true
+}
+
+// setConfig replaces the breaker's config, when the client's config is reloaded. The count of
+// consecutive failures is kept.
+func (b *circuitBreaker) setConfig(config *CircuitBreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.config = config
+	if config == nil {
+		b.openUntil = time.Time{}
+		b.gauge.Set(0)
+	}
+}
@@ -0,0 +1,120 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_circuit_breaker_open", Help: ""})
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 2, OpenSeconds: 10}, gauge)
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	failure := errors.New("push failed")
+
+	assert.False(t, breaker.recordResult(start, failure))
+	assert.False(t, breaker.isOpen(start))
+	assert.True(t, breaker.recordResult(start, failure))
+	assert.True(t, breaker.isOpen(start.Add(9*time.Second)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	// After OpenSeconds, one push is allowed. If it fails, the circuit opens again straight away.
+	assert.False(t, breaker.isOpen(start.Add(10*time.Second)))
+	assert.True(t, breaker.recordResult(start.Add(10*time.Second), failure))
+	assert.True(t, breaker.isOpen(start.Add(11*time.Second)))
+
+	// ... and if it succeeds, the circuit closes.
+	assert.False(t, breaker.recordResult(start.Add(20*time.Second), nil))
+	assert.False(t, breaker.isOpen(start.Add(20*time.Second)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(gauge))
+
+	// Without a config, the circuit never opens
+	breaker.setConfig(nil)
+	for i := 0; i < 5; i++ {
+		assert.False(t, breaker.recordResult(start, failure))
+	}
+	assert.False(t, breaker.isOpen(start))
+}
+
+// fakeSink fails the first failures sends with err
+type fakeSink struct {
+	failures int
+	err      error
+	sends    *int
+}
+
+func (f fakeSink) send(eventSender, *zap.Logger, []billing.AnyEvent, int, time.Time) error {
+	*f.sends += 1
+	if *f.sends <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f fakeSink) updated(next sink) sink { return next }
+func (f fakeSink) close(*zap.Logger)      {}
+func (f fakeSink) logField() zap.Field    { return zap.Skip() }
+
+func TestSendWithRetry(t *testing.T) {
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.metrics = NewPromMetrics()
+	sender.config.Retry = &RetryConfig{MaxAttempts: 3, InitialBackoffSeconds: 0, MaxBackoffSeconds: 0}
+	sender.name = "test"
+	clock := util.NewFakeClock(time.Now())
+	sender.clock = clock
+
+	// Retried until it succeeds
+	sends := 0
+	sender.sink = fakeSink{failures: 2, err: errors.New("push failed"), sends: &sends}
+	assert.NoError(t, sender.sendWithRetry(zap.NewNop(), nil, 0, time.Now()))
+	assert.Equal(t, 3, sends)
+
+	// ... but only up to MaxAttempts
+	sends = 0
+	sender.sink = fakeSink{failures: 5, err: errors.New("push failed"), sends: &sends}
+	assert.Error(t, sender.sendWithRetry(zap.NewNop(), nil, 0, time.Now()))
+	assert.Equal(t, 3, sends)
+	assert.Equal(t, 4.0, testutil.ToFloat64(sender.metrics.sendRetriesTotal.WithLabelValues("test")))
+
+	// Errors from marshaling aren't retried
+	sends = 0
+	sender.sink = fakeSink{failures: 5, err: billing.JSONError{Err: errors.New("bad event")}, sends: &sends}
+	assert.Error(t, sender.sendWithRetry(zap.NewNop(), nil, 0, time.Now()))
+	assert.Equal(t, 1, sends)
+
+	// ... and neither are other errors that would happen again
+	sends = 0
+	sender.sink = fakeSink{failures: 5, err: billing.AuthError{StatusCode: http.StatusUnauthorized}, sends: &sends}
+	assert.Error(t, sender.sendWithRetry(zap.NewNop(), nil, 0, time.Now()))
+	assert.Equal(t, 1, sends)
+
+	// Throttling that asks us to wait longer than the maximum backoff is left for the next push
+	sends = 0
+	throttled := billing.ThrottledError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	sender.sink = fakeSink{failures: 5, err: throttled, sends: &sends}
+	assert.Equal(t, throttled, sender.sendWithRetry(zap.NewNop(), nil, 0, time.Now()))
+	assert.Equal(t, 1, sends)
+
+	// Backoff is waited out on the sender's clock
+	sends = 0
+	sender.config.Retry = &RetryConfig{MaxAttempts: 3, InitialBackoffSeconds: 30, MaxBackoffSeconds: 60}
+	sender.sink = fakeSink{failures: 1, err: errors.New("push failed"), sends: &sends}
+	done := make(chan error)
+	go func() { done <- sender.sendWithRetry(zap.NewNop(), nil, 0, clock.Now()) }()
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, sends)
+	clock.Advance(30 * time.Second)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 2, sends)
+}
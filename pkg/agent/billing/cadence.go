@@ -0,0 +1,95 @@
+package billing
+
+// Per-metric emission cadences, so that metrics that don't need much precision (e.g. network
+// egress) can be sent less often than every batch, reducing the number of events.
+//
+// Usage is still collected and accumulated as usual. When a metric isn't due in a batch, the value
+// of each endpoint's event is held back and added to the next event that's sent for the same
+// endpoint and metric, which then covers the whole time since the first one that was held back.
+//
+// Held back usage is sent immediately when the endpoint's VM leaves this node, or on shutdown if
+// shutdownFlushTimeoutSeconds is set. Unlike the remainders from rounding, it's also included in
+// history snapshots, so that it isn't lost if the collector is restarted in the meantime.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// deferredUsage is the usage of an endpoint's metric that's been held back until the metric is next
+// due
+type deferredUsage struct {
+	start   time.Time
+	value   int
+	partial bool
+}
+
+// metricsNotDue returns the metrics whose events should be held back in the batch ending at end,
+// according to conf.AccumulateEverySecondsByMetric, and records that the rest were sent
+func (s *metricsState) metricsNotDue(conf *Config, start time.Time, end time.Time) map[string]struct{} {
+	notDue := make(map[string]struct{})
+	for metricName, everySeconds := range conf.AccumulateEverySecondsByMetric {
+		lastSent, ok := s.metricsLastSent[metricName]
+		if !ok {
+			lastSent = start
+		}
+
+		// Batches aren't exactly AccumulateEverySeconds apart, so allow for some variation, rather
+		// than waiting an extra batch whenever one is a little early.
+		tolerance := time.Second * time.Duration(conf.AccumulateEverySeconds) / 2
+		if end.Sub(lastSent) < time.Second*time.Duration(everySeconds)-tolerance {
+			notDue[metricName] = struct{}{}
+			s.metricsLastSent[metricName] = lastSent
+		} else {
+			s.metricsLastSent[metricName] = end
+		}
+	}
+
+	// Forget the metrics that no longer have their own cadence, so they start from scratch if
+	// they're given one again.
+	for metricName := range s.metricsLastSent {
+		if _, ok := conf.AccumulateEverySecondsByMetric[metricName]; !ok {
+			delete(s.metricsLastSent, metricName)
+		}
+	}
+
+	return notDue
+}
+
+// deferEvent holds back the event's usage if hold is true, returning whether it did. Otherwise, any
+// usage that was held back before is added to the event, which is extended to cover it.
+func (s *metricsState) deferEvent(key metricsKey, event *billing.IncrementalEvent, hold bool) bool {
+	rk := roundingKey{metricsKey: key, metricName: event.MetricName}
+	deferred, ok := s.deferredUsage[rk]
+
+	if hold {
+		if !ok {
+			deferred.start = event.StartTime
+		}
+		deferred.value += event.Value
+		deferred.partial = deferred.partial || event.Partial
+		s.deferredUsage[rk] = deferred
+		return true
+	}
+
+	if ok {
+		event.StartTime = deferred.start
+		event.Value += deferred.value
+		event.Partial = event.Partial || deferred.partial
+		delete(s.deferredUsage, rk)
+	}
+	return false
+}
+
+// deferredUsageExcept returns the usage that's been held back for every VM other than the one with
+// the key
+func (s *metricsState) deferredUsageExcept(key metricsKey) map[roundingKey]deferredUsage {
+	deferred := make(map[roundingKey]deferredUsage)
+	for rk, d := range s.deferredUsage {
+		if rk.metricsKey != key {
+			deferred[rk] = d
+		}
+	}
+	return deferred
+}
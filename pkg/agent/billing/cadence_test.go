@@ -0,0 +1,113 @@
+package billing
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestMetricCadences(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+	conf.AccumulateEverySeconds = 60
+	conf.AccumulateEverySecondsByMetric = map[string]uint{"active": 180}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.pushWindowStart = start
+	s.snapshot = &HistorySnapshotConfig{Path: filepath.Join(t.TempDir(), "history.json"), EverySeconds: 3600, MaxAgeSeconds: 3600}
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, util.RealClock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	vm := new(vmapi.VirtualMachine)
+	vm.UID = "vm"
+	vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep"}
+	vm.Status.Phase = vmapi.VmRunning
+	cpu := vmapi.MilliCPU(1000)
+	vm.Status.CPUs = &cpu
+
+	type event struct {
+		metric string
+		start  time.Time
+		value  int
+	}
+	batch := func(minute int, vms []*vmapi.VirtualMachine, settleAll bool) []event {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		s.collectVMs(logger, now, vms, nil, nil, metrics)
+		s.drainEnqueue(logger, &conf, "host", queues, now, settleAll)
+
+		var events []event
+		for _, e := range puller.get(puller.size()) {
+			e := e.(*billing.IncrementalEvent)
+			events = append(events, event{metric: e.MetricName, start: e.StartTime, value: e.Value})
+		}
+		puller.drop(len(events))
+		return events
+	}
+
+	// restored returns the held back usage that would be restored from the snapshot on restart
+	restored := func() map[roundingKey]deferredUsage {
+		r := new(metricsState)
+		r.snapshot = s.snapshot
+		r.restoreHistorySnapshot(logger, start.Add(10*time.Minute))
+		return r.deferredUsage
+	}
+	activeKey := roundingKey{metricsKey: metricsKey{uid: "vm", endpointID: "ep"}, metricName: "active"}
+
+	s.collectVMs(logger, start, []*vmapi.VirtualMachine{vm}, nil, nil, metrics)
+
+	// Active time is held back for the first two batches...
+	assert.Equal(t, []event{{"cpu", start, 60}}, batch(1, []*vmapi.VirtualMachine{vm}, false))
+	assert.Equal(t, []event{{"cpu", start.Add(time.Minute), 60}}, batch(2, []*vmapi.VirtualMachine{vm}, false))
+	// The held back usage isn't in any event yet, so it's kept across restarts
+	assert.Equal(t, map[roundingKey]deferredUsage{
+		activeKey: {start: start, value: 120, partial: false},
+	}, restored())
+	// ... and then sent, covering all three.
+	assert.Equal(t, []event{
+		{"cpu", start.Add(2 * time.Minute), 60},
+		{"active", start, 180},
+	}, batch(3, []*vmapi.VirtualMachine{vm}, false))
+	assert.Empty(t, restored())
+
+	assert.Equal(t, []event{{"cpu", start.Add(3 * time.Minute), 60}}, batch(4, []*vmapi.VirtualMachine{vm}, false))
+	// When a VM departs, its own held back usage is sent with its events, so only the rest is kept
+	// in the snapshot
+	assert.Empty(t, s.deferredUsageExcept(activeKey.metricsKey))
+	assert.Len(t, s.deferredUsageExcept(metricsKey{uid: "other", endpointID: "ep-other"}), 1)
+	// Held back usage is sent as soon as the VM is gone
+	assert.Equal(t, []event{
+		{"cpu", start.Add(4 * time.Minute), 0},
+		{"active", start.Add(3 * time.Minute), 60},
+	}, batch(5, nil, false))
+	assert.Empty(t, s.deferredUsage)
+}
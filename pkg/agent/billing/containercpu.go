@@ -0,0 +1,169 @@
+package billing
+
+// Collection of the CPU time used by individual cgroups inside each VM, so that processes that are
+// billed separately from the rest of the VM (e.g. a connection pooler sidecar) can have their own
+// metrics.
+//
+// The counters are scraped from vector.dev's cgroups host metrics, exported from inside each VM.
+// Like egress, they're counters rather than allocations, so they're tracked between collections
+// instead of in time slices.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type ContainerCPUConfig struct {
+	// Port is the port of vector.dev's Prometheus exporter in each VM, which must have the cgroups
+	// collector enabled
+	Port uint16 `json:"port"`
+	// MetricNames gives the name of the metric for the CPU-seconds used by each cgroup, keyed by
+	// the cgroup's path as reported by vector.dev -- e.g. "system.slice/pgbouncer.service".
+	//
+	// CPU time used by these cgroups is still included in the VM's regular CPU metric, which is
+	// based on its allocation rather than its usage.
+	MetricNames map[string]string `json:"metricNames"`
+	// RequestTimeoutSeconds gives the timeout for requests to each VM's exporter
+	RequestTimeoutSeconds uint `json:"requestTimeoutSeconds"`
+}
+
+// containerCPUUsage is the total CPU-seconds used by each of a VM's cgroups, keyed by the cgroup's
+// path
+type containerCPUUsage struct {
+	seconds map[string]float64
+}
+
+// vectorCgroupCPUMetric is the name of vector.dev's counter of the CPU time used by each cgroup
+const vectorCgroupCPUMetric = "cgroup_cpu_usage_seconds_total"
+
+// containerCPUErrorKind is the kind of errors from fetching cgroups' CPU usage, for the
+// collectErrorsTotal metric
+const containerCPUErrorKind = "container_cpu"
+
+// fetchContainerCPU requests the CPU-seconds used by each of the configured cgroups in all of the
+// VMs, returning the results that were successful
+//
+// Like fetchUsage, requests are made by a fixed number of workers, each with its own timeout.
+func fetchContainerCPU(
+	ctx context.Context,
+	logger *zap.Logger,
+	conf *ContainerCPUConfig,
+	errs *util.ErrorAggregator,
+	vms []*vmapi.VirtualMachine,
+) map[types.UID]*containerCPUUsage {
+	timeout := time.Second * time.Duration(conf.RequestTimeoutSeconds)
+
+	var mu sync.Mutex
+	results := make(map[types.UID]*containerCPUUsage)
+
+	vmsToFetch := make(chan *vmapi.VirtualMachine, len(vms))
+	for _, vm := range vms {
+		vmsToFetch <- vm
+	}
+	close(vmsToFetch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < util.Min(defaultEgressMaxConcurrentRequests, len(vms)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for vm := range vmsToFetch {
+				usage, err := getContainerCPU(ctx, conf, vm, timeout)
+				if err != nil {
+					err = fmt.Errorf("VM %v: %w", util.GetNamespacedName(vm), err)
+					errs.Report(logger, containerCPUErrorKind, "Failed to get VM container CPU usage", err)
+					continue
+				}
+
+				mu.Lock()
+				results[vm.UID] = usage
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func getContainerCPU(
+	ctx context.Context,
+	conf *ContainerCPUConfig,
+	vm *vmapi.VirtualMachine,
+	timeout time.Duration,
+) (*containerCPUUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d/metrics", vm.Status.PodIP, conf.Port)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error doing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response body: %w", err)
+	}
+
+	return readContainerCPU(core.ParsePromOutput(body), conf), nil
+}
+
+// readContainerCPU extracts the CPU-seconds used by each of the configured cgroups from vector.dev's
+// metrics output
+//
+// Cgroups that aren't in the output (e.g. because the sidecar isn't running) are left out.
+func readContainerCPU(out core.PromOutput, conf *ContainerCPUConfig) *containerCPUUsage {
+	usage := &containerCPUUsage{seconds: make(map[string]float64)}
+	for cgroup := range conf.MetricNames {
+		if seconds, err := out.Sum(vectorCgroupCPUMetric, core.LabelFilter{"cgroup": cgroup}); err == nil {
+			usage.seconds[cgroup] = seconds
+		}
+	}
+	return usage
+}
+
+// addContainerCPU adds the CPU-seconds used by each cgroup between the two instants to the totals
+//
+// Unlike the network counters, each cgroup's counter is reset separately (e.g. when the sidecar
+// restarts), so only the cgroups whose counter decreased are counted from zero. Cgroups that
+// weren't reported before are only counted from the next collection.
+func (s *vmMetricsSeconds) addContainerCPU(old, present containerCPUUsage) {
+	for cgroup, presentSeconds := range present.seconds {
+		oldSeconds, ok := old.seconds[cgroup]
+		if !ok {
+			continue
+		} else if presentSeconds < oldSeconds {
+			oldSeconds = 0
+		}
+
+		if s.containerCPU == nil {
+			s.containerCPU = make(map[string]float64)
+		}
+		s.containerCPU[cgroup] += presentSeconds - oldSeconds
+	}
+}
@@ -0,0 +1,42 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+)
+
+func TestContainerCPU(t *testing.T) {
+	out := core.ParsePromOutput([]byte(`# TYPE cgroup_cpu_usage_seconds_total counter
+cgroup_cpu_usage_seconds_total{cgroup="system.slice/pgbouncer.service",collector="cgroups",host="vm"} 12.5 1700000000000
+cgroup_cpu_usage_seconds_total{cgroup="system.slice/postgres.service",collector="cgroups",host="vm"} 300 1700000000000
+`))
+	conf := &ContainerCPUConfig{
+		Port: 9100,
+		MetricNames: map[string]string{
+			"system.slice/pgbouncer.service": "pooler_cpu_seconds",
+			"system.slice/proxy.service":     "proxy_cpu_seconds",
+		},
+		RequestTimeoutSeconds: 1,
+	}
+
+	// Cgroups that aren't running are left out, and others are ignored
+	usage := readContainerCPU(out, conf)
+	assert.Equal(t, map[string]float64{"system.slice/pgbouncer.service": 12.5}, usage.seconds)
+
+	var total vmMetricsSeconds
+	total.addContainerCPU(
+		containerCPUUsage{seconds: map[string]float64{"pooler": 10, "proxy": 5}},
+		containerCPUUsage{seconds: map[string]float64{"pooler": 12, "proxy": 7, "other": 3}},
+	)
+	assert.Equal(t, map[string]float64{"pooler": 2, "proxy": 2}, total.containerCPU)
+
+	// Each counter is reset separately, and cgroups are only counted once they've been seen before
+	total.addContainerCPU(
+		containerCPUUsage{seconds: map[string]float64{"pooler": 12, "proxy": 7, "other": 3}},
+		containerCPUUsage{seconds: map[string]float64{"pooler": 1, "proxy": 8, "other": 4}},
+	)
+	assert.Equal(t, map[string]float64{"pooler": 3, "proxy": 3, "other": 1}, total.containerCPU)
+}
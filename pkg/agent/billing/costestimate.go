@@ -0,0 +1,89 @@
+package billing
+
+// Estimates of what each endpoint's usage costs, from the same usage that's sent in its events, so
+// that users get feedback on their spending without waiting for an invoice.
+//
+// The estimate for each batch is the cost of the usage in it, at the configured prices, divided by
+// the time the batch covers. It's exported as a gauge of the cost per hour for each endpoint on this
+// node, which is only as accurate as the prices: it doesn't know about discounts or free tiers.
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type CostEstimateConfig struct {
+	// Prices gives the price of one unit of each metric, keyed by metric name. For example, if
+	// compute unit-seconds cost 0.16 per compute unit-hour, the computeUnitMetricName would have a
+	// price of 0.16/3600.
+	//
+	// Metrics without a price don't contribute to the estimate.
+	Prices map[string]float64 `json:"prices"`
+}
+
+// costEstimator accumulates the estimated cost of each endpoint's usage within a batch, and
+// exports the cost per hour once the batch is finished
+type costEstimator struct {
+	gauge *prometheus.GaugeVec
+	// batch stores the estimated cost of each endpoint's usage in the current batch
+	batch map[string]float64
+	// exported stores the endpoints that currently have a value in the gauge
+	exported map[string]struct{}
+}
+
+func newCostEstimator(metrics PromMetrics) *costEstimator {
+	return &costEstimator{
+		gauge:    metrics.estimatedCostPerHour,
+		batch:    make(map[string]float64),
+		exported: make(map[string]struct{}),
+	}
+}
+
+// record adds the cost of the endpoint's usage of the metric to the current batch
+//
+// The value should be the exact usage, before rounding, so that the estimate doesn't jump around
+// as rounding remainders are carried between batches.
+func (c *costEstimator) record(conf *CostEstimateConfig, endpointID string, metricName string, value float64) {
+	if conf == nil {
+		return
+	}
+	price, ok := conf.Prices[metricName]
+	if !ok {
+		return
+	}
+	c.batch[endpointID] += price * value
+}
+
+// finishBatch exports the cost per hour of each endpoint's usage in the batch, which covered the
+// given duration, and starts a new batch
+//
+// Endpoints without any usage in the batch are removed from the gauge.
+func (c *costEstimator) finishBatch(conf *CostEstimateConfig, duration time.Duration) {
+	defer func() {
+		c.batch = make(map[string]float64)
+	}()
+
+	if conf == nil {
+		// Cost estimates may have been disabled by a config reload, in which case we need to clean
+		// up the old values.
+		for endpointID := range c.exported {
+			c.gauge.DeleteLabelValues(endpointID)
+			delete(c.exported, endpointID)
+		}
+		return
+	} else if duration <= 0 {
+		return
+	}
+
+	for endpointID := range c.exported {
+		if _, ok := c.batch[endpointID]; !ok {
+			c.gauge.DeleteLabelValues(endpointID)
+			delete(c.exported, endpointID)
+		}
+	}
+	for endpointID, cost := range c.batch {
+		c.gauge.WithLabelValues(endpointID).Set(cost / duration.Hours())
+		c.exported[endpointID] = struct{}{}
+	}
+}
@@ -0,0 +1,47 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostEstimator(t *testing.T) {
+	metrics := NewPromMetrics()
+	c := newCostEstimator(metrics)
+	conf := &CostEstimateConfig{
+		Prices: map[string]float64{
+			"cpu":    0.5 / 3600, // per CPU-hour
+			"egress": 0.1 / 1e9,  // per GB
+		},
+	}
+
+	costPerHour := func(endpointID string) float64 {
+		return testutil.ToFloat64(metrics.estimatedCostPerHour.WithLabelValues(endpointID))
+	}
+
+	// Half an hour of 2 CPUs and 1GB of egress, across two VMs for the same endpoint. Metrics
+	// without a price are ignored.
+	c.record(conf, "ep-a", "cpu", 1800)
+	c.record(conf, "ep-a", "cpu", 1800)
+	c.record(conf, "ep-a", "egress", 1e9)
+	c.record(conf, "ep-a", "active", 1800)
+	c.record(conf, "ep-b", "cpu", 900)
+	c.finishBatch(conf, 30*time.Minute)
+
+	assert.InDelta(t, 1.2, costPerHour("ep-a"), 1e-9)
+	assert.InDelta(t, 0.25, costPerHour("ep-b"), 1e-9)
+
+	// Endpoints without usage in the next batch are removed
+	c.record(conf, "ep-a", "cpu", 3600)
+	c.finishBatch(conf, time.Hour)
+	assert.InDelta(t, 0.5, costPerHour("ep-a"), 1e-9)
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.estimatedCostPerHour))
+
+	// ... and all of them are removed if estimates are disabled
+	c.record(nil, "ep-a", "cpu", 3600)
+	c.finishBatch(nil, time.Hour)
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.estimatedCostPerHour))
+}
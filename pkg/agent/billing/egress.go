@@ -0,0 +1,244 @@
+package billing
+
+// Collection of the bytes sent by each VM, classified as internal or internet traffic by the
+// VM's runner, based on the destination. The counters come from a UsageSource; see usage.go.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type EgressConfig struct {
+	// InternalCIDRs lists the destinations that traffic is classified as internal for, e.g.
+	// replication to standby nodes in the same cluster. All other traffic is internet egress.
+	//
+	// Only the runner source classifies traffic by destination.
+	InternalCIDRs []string `json:"internalCIDRs"`
+	// InternalMetricName is the name of the metric for bytes sent to internal destinations
+	InternalMetricName string `json:"internalMetricName"`
+	// InternetMetricName is the name of the metric for bytes sent to all other destinations
+	InternetMetricName string `json:"internetMetricName"`
+	// InterfaceMetricNames, if not empty, gives the name of the metric for bytes sent on each of
+	// the VMs' additional networks, keyed by the network's name in .spec.additionalNetworks.
+	//
+	// Traffic on additional networks (e.g. for replication) is never included in the internal or
+	// internet metrics, so networks that aren't listed here are not billed at all.
+	InterfaceMetricNames map[string]string `json:"interfaceMetricNames,omitempty"`
+	// RequestTimeoutSeconds gives the timeout for requests to each VM's runner
+	RequestTimeoutSeconds uint `json:"requestTimeoutSeconds"`
+	// MaxConcurrentRequests, if non-zero, limits the number of requests to VMs' runners that are
+	// in flight at once. Defaults to defaultEgressMaxConcurrentRequests.
+	MaxConcurrentRequests uint `json:"maxConcurrentRequests,omitempty"`
+	// Source, if provided, selects where the counters are fetched from. Defaults to the VMs'
+	// runners. See UsageSourceConfig.
+	Source *UsageSourceConfig `json:"source,omitempty"`
+}
+
+// defaultEgressMaxConcurrentRequests is the limit on concurrent requests for network usage, if
+// it's not set in the config
+const defaultEgressMaxConcurrentRequests = 32
+
+func (c *EgressConfig) maxConcurrentRequests() int {
+	if c.MaxConcurrentRequests == 0 {
+		return defaultEgressMaxConcurrentRequests
+	}
+	return int(c.MaxConcurrentRequests)
+}
+
+// networkUsageErrorKind is the kind of errors from fetching network usage, for the
+// collectErrorsTotal metric
+const networkUsageErrorKind = "network_usage"
+
+// Outcomes of individual requests for network usage, for the networkUsageRequestDuration metric
+const (
+	networkUsageOutcomeSuccess = "success"
+	networkUsageOutcomeTimeout = "timeout"
+	networkUsageOutcomeFailure = "failure"
+)
+
+// resetEgressBaselines forgets the network usage from the last collection, so that egress is
+// counted again from the next collection.
+//
+// This is required whenever the UsageSource is replaced: the new source's counters don't continue
+// from the old one's (e.g. the mock source starts again from zero), so the difference between
+// them isn't bytes that the VMs sent.
+func (s *metricsState) resetEgressBaselines() {
+	for key, m := range s.present {
+		m.egress = nil
+		s.present[key] = m
+	}
+}
+
+// fetchUsage requests the current usage of all of the VMs from the source, returning the results
+// that were successful
+//
+// Requests are made by a fixed number of workers, so that nodes with many VMs don't send a burst
+// of requests all at once. Each request has its own timeout, so the total time is bounded by the
+// number of VMs per worker, multiplied by the timeout.
+//
+// Failures are reported through errs, so that VMs whose runners are consistently unreachable don't
+// flood the logs.
+func fetchUsage(
+	ctx context.Context,
+	logger *zap.Logger,
+	conf *EgressConfig,
+	source UsageSource,
+	errs *util.ErrorAggregator,
+	requestDuration *prometheus.HistogramVec,
+	vms []*vmapi.VirtualMachine,
+) map[types.UID]VMUsage {
+	timeout := time.Second * time.Duration(conf.RequestTimeoutSeconds)
+
+	var mu sync.Mutex
+	results := make(map[types.UID]VMUsage)
+
+	vmsToFetch := make(chan *vmapi.VirtualMachine, len(vms))
+	for _, vm := range vms {
+		vmsToFetch <- vm
+	}
+	close(vmsToFetch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < util.Min(conf.maxConcurrentRequests(), len(vms)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for vm := range vmsToFetch {
+				start := time.Now()
+				usage, err := getUsage(ctx, source, vm, timeout)
+
+				outcome := networkUsageOutcomeSuccess
+				if err != nil {
+					outcome = networkUsageOutcomeFailure
+					if errors.Is(err, context.DeadlineExceeded) {
+						outcome = networkUsageOutcomeTimeout
+					}
+				}
+				requestDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+
+				if err != nil {
+					err = fmt.Errorf("VM %v: %w", util.GetNamespacedName(vm), err)
+					errs.Report(logger, networkUsageErrorKind, "Failed to get VM network usage", err)
+					continue
+				}
+
+				mu.Lock()
+				results[vm.UID] = *usage
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func getUsage(ctx context.Context, source UsageSource, vm *vmapi.VirtualMachine, timeout time.Duration) (*VMUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return source.GetUsage(ctx, vm)
+}
+
+// runnerUsageSource is the UsageSource that fetches network usage from each VM's runner, which
+// classifies the traffic by destination
+type runnerUsageSource struct {
+	// query is the encoded query string for the runner's /network_usage endpoint
+	query string
+}
+
+func newRunnerUsageSource(conf *EgressConfig) *runnerUsageSource {
+	return &runnerUsageSource{query: url.Values{"internal": conf.InternalCIDRs}.Encode()}
+}
+
+func (s *runnerUsageSource) GetUsage(ctx context.Context, vm *vmapi.VirtualMachine) (*VMUsage, error) {
+	url := fmt.Sprintf("http://%s:%d/network_usage?%s", vm.Status.PodIP, vm.Spec.RunnerPort, s.query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error doing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response body: %w", err)
+	}
+
+	var usage api.NetworkUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling response body: %w", err)
+	}
+
+	return &VMUsage{Network: usage, Disk: nil}, nil
+}
+
+// addEgress adds the bytes sent between the two instants to the totals, returning whether the
+// VM's counters were reset in between
+//
+// All of the counters are reset together, when a new runner starts reporting them (e.g. because
+// the runner restarted, or the VM was migrated). So if any of them decreased, all of them are
+// counted from zero, and the bytes sent between old and the reset are not billed.
+func (s *vmMetricsSeconds) addEgress(old, present api.NetworkUsage) (reset bool) {
+	reset = networkUsageReset(old, present)
+	if reset {
+		old = api.NetworkUsage{InternalBytes: 0, InternetBytes: 0, Interfaces: nil, InboundConnections: nil}
+	}
+
+	s.internalEgressBytes += present.InternalBytes - old.InternalBytes
+	s.internetEgressBytes += present.InternetBytes - old.InternetBytes
+
+	for name, presentUsage := range present.Interfaces {
+		oldUsage, ok := old.Interfaces[name]
+		if !ok && !reset {
+			// Interfaces that weren't reported before are only counted from the next collection.
+			continue
+		}
+		if s.interfaceEgressBytes == nil {
+			s.interfaceEgressBytes = make(map[string]uint64)
+		}
+		s.interfaceEgressBytes[name] += presentUsage.SentBytes - oldUsage.SentBytes
+	}
+
+	return reset
+}
+
+// networkUsageReset returns whether any of the counters in present are less than in old, which
+// means that they were reset in between
+func networkUsageReset(old, present api.NetworkUsage) bool {
+	if present.InternalBytes < old.InternalBytes || present.InternetBytes < old.InternetBytes {
+		return true
+	}
+	for name, presentUsage := range present.Interfaces {
+		oldUsage, ok := old.Interfaces[name]
+		if ok && (presentUsage.SentBytes < oldUsage.SentBytes || presentUsage.ReceivedBytes < oldUsage.ReceivedBytes) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,362 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestAddEgress(t *testing.T) {
+	usage := func(internal, internet uint64, interfaces map[string]api.InterfaceUsage) api.NetworkUsage {
+		return api.NetworkUsage{InternalBytes: internal, InternetBytes: internet, Interfaces: interfaces, InboundConnections: nil}
+	}
+	iface := func(sent, received uint64) api.InterfaceUsage {
+		return api.InterfaceUsage{SentBytes: sent, ReceivedBytes: received}
+	}
+
+	cases := []struct {
+		name     string
+		old      api.NetworkUsage
+		present  api.NetworkUsage
+		reset    bool
+		internal uint64
+		internet uint64
+		perIface map[string]uint64
+	}{
+		{
+			name:     "increase",
+			old:      usage(100, 1000, map[string]api.InterfaceUsage{"repl": iface(50, 10)}),
+			present:  usage(150, 1200, map[string]api.InterfaceUsage{"repl": iface(80, 20)}),
+			reset:    false,
+			internal: 50,
+			internet: 200,
+			perIface: map[string]uint64{"repl": 30},
+		},
+		{
+			name:     "no change",
+			old:      usage(100, 1000, nil),
+			present:  usage(100, 1000, nil),
+			reset:    false,
+			internal: 0,
+			internet: 0,
+			perIface: nil,
+		},
+		{
+			name:     "new interface is counted from the next collection",
+			old:      usage(100, 1000, nil),
+			present:  usage(100, 1000, map[string]api.InterfaceUsage{"repl": iface(80, 20)}),
+			reset:    false,
+			internal: 0,
+			internet: 0,
+			perIface: nil,
+		},
+		{
+			// The runner restarted, so all the counters start again from zero
+			name:     "runner restart",
+			old:      usage(100, 1000, map[string]api.InterfaceUsage{"repl": iface(50, 10)}),
+			present:  usage(20, 30, map[string]api.InterfaceUsage{"repl": iface(5, 1)}),
+			reset:    true,
+			internal: 20,
+			internet: 30,
+			perIface: map[string]uint64{"repl": 5},
+		},
+		{
+			// After a migration, the VM's usage comes from the target runner. Its counters started
+			// from zero, but some of them may already be larger than the source runner's were.
+			name:     "migration with partially larger counters",
+			old:      usage(100, 1000, nil),
+			present:  usage(500, 400, nil),
+			reset:    true,
+			internal: 500,
+			internet: 400,
+			perIface: nil,
+		},
+		{
+			// A decrease in received bytes alone still means that all the counters were reset
+			name:     "reset detected from received bytes",
+			old:      usage(100, 1000, map[string]api.InterfaceUsage{"repl": iface(50, 10)}),
+			present:  usage(150, 1200, map[string]api.InterfaceUsage{"repl": iface(80, 5)}),
+			reset:    true,
+			internal: 150,
+			internet: 1200,
+			perIface: map[string]uint64{"repl": 80},
+		},
+		{
+			// Interfaces that first appear with a reset have all their bytes counted
+			name:     "new interface after reset",
+			old:      usage(100, 1000, nil),
+			present:  usage(10, 20, map[string]api.InterfaceUsage{"repl": iface(30, 40)}),
+			reset:    true,
+			internal: 10,
+			internet: 20,
+			perIface: map[string]uint64{"repl": 30},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var total vmMetricsSeconds
+			reset := total.addEgress(c.old, c.present)
+			assert.Equal(t, c.reset, reset)
+			assert.Equal(t, c.internal, total.internalEgressBytes)
+			assert.Equal(t, c.internet, total.internetEgressBytes)
+			assert.Equal(t, c.perIface, total.interfaceEgressBytes)
+		})
+	}
+}
+
+func TestAddEgressAccumulatesAcrossReset(t *testing.T) {
+	// The VM is migrated between the second and third collections. Only the bytes sent by the
+	// target runner before the third collection are counted for that interval.
+	collections := []api.NetworkUsage{
+		{InternalBytes: 0, InternetBytes: 100, Interfaces: nil},
+		{InternalBytes: 0, InternetBytes: 300, Interfaces: nil},
+		{InternalBytes: 0, InternetBytes: 50, Interfaces: nil},
+		{InternalBytes: 0, InternetBytes: 125, Interfaces: nil},
+	}
+
+	var total vmMetricsSeconds
+	var resets int
+	for i := 1; i < len(collections); i++ {
+		if total.addEgress(collections[i-1], collections[i]) {
+			resets += 1
+		}
+	}
+
+	assert.Equal(t, 1, resets)
+	assert.Equal(t, uint64(200+50+75), total.internetEgressBytes)
+	assert.Equal(t, uint64(0), total.internalEgressBytes)
+}
+
+func TestInterfaceEgressEvents(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+	conf.Egress = &EgressConfig{
+		InternalCIDRs:      nil,
+		InternalMetricName: "internal",
+		InternetMetricName: "internet",
+		// "storage" isn't listed, so it isn't billed
+		InterfaceMetricNames:  map[string]string{"repl": "repl_egress", "backup": "backup_egress"},
+		RequestTimeoutSeconds: 1,
+		MaxConcurrentRequests: 0,
+		Source:                nil,
+	}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.egress = conf.Egress
+	s.pushWindowStart = start
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, util.RealClock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	vm := new(vmapi.VirtualMachine)
+	vm.UID = "vm"
+	vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep"}
+	vm.Status.Phase = vmapi.VmRunning
+	cpu := vmapi.MilliCPU(1000)
+	vm.Status.CPUs = &cpu
+
+	usage := func(internal, internet, repl, backup, storage uint64) map[types.UID]VMUsage {
+		return map[types.UID]VMUsage{vm.UID: {
+			Network: api.NetworkUsage{
+				InternalBytes: internal,
+				InternetBytes: internet,
+				Interfaces: map[string]api.InterfaceUsage{
+					"repl":    {SentBytes: repl, ReceivedBytes: 0},
+					"backup":  {SentBytes: backup, ReceivedBytes: 0},
+					"storage": {SentBytes: storage, ReceivedBytes: 0},
+				},
+				InboundConnections: nil,
+			},
+			Disk: nil,
+		}}
+	}
+
+	type event struct {
+		metric string
+		value  int
+	}
+
+	s.collectVMs(logger, start, []*vmapi.VirtualMachine{vm}, usage(0, 0, 0, 0, 0), nil, metrics)
+	now := start.Add(time.Minute)
+	s.collectVMs(logger, now, []*vmapi.VirtualMachine{vm}, usage(10, 20, 300, 4000, 50000), nil, metrics)
+	s.drainEnqueue(logger, &conf, "host", queues, now, false)
+
+	var events []event
+	for _, e := range puller.get(puller.size()) {
+		e := e.(*billing.IncrementalEvent)
+		events = append(events, event{metric: e.MetricName, value: e.Value})
+	}
+
+	// Each additional network's egress is billed separately from the internal and internet
+	// egress, with the networks in a consistent order.
+	assert.Equal(t, []event{
+		{"cpu", 60},
+		{"active", 60},
+		{"internal", 10},
+		{"internet", 20},
+		{"backup_egress", 4000},
+		{"repl_egress", 300},
+	}, events)
+}
+
+func TestResetEgressBaselines(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.egress = &EgressConfig{
+		InternalCIDRs:         nil,
+		InternalMetricName:    "internal",
+		InternetMetricName:    "internet",
+		InterfaceMetricNames:  nil,
+		RequestTimeoutSeconds: 1,
+		MaxConcurrentRequests: 0,
+		Source:                nil,
+	}
+	s.pushWindowStart = start
+
+	vm := new(vmapi.VirtualMachine)
+	vm.UID = "vm"
+	vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep"}
+	vm.Status.Phase = vmapi.VmRunning
+	cpu := vmapi.MilliCPU(1000)
+	vm.Status.CPUs = &cpu
+
+	collect := func(minutes int, internal, internet uint64) {
+		usage := map[types.UID]VMUsage{vm.UID: {
+			Network: api.NetworkUsage{InternalBytes: internal, InternetBytes: internet, Interfaces: nil, InboundConnections: nil},
+			Disk:    nil,
+		}}
+		now := start.Add(time.Duration(minutes) * time.Minute)
+		s.collectVMs(logger, now, []*vmapi.VirtualMachine{vm}, usage, nil, metrics)
+	}
+
+	collect(0, 1000, 2000)
+	collect(1, 1100, 2200)
+
+	// The usage source is replaced, and the new one's counters have nothing to do with the old
+	// one's. Only the bytes sent after the first collection from the new source are counted.
+	s.resetEgressBaselines()
+	collect(2, 50000, 90000)
+	collect(3, 50010, 90020)
+
+	total := s.historical[metricsKey{uid: vm.UID, endpointID: "ep"}].total
+	assert.Equal(t, uint64(100+10), total.internalEgressBytes)
+	assert.Equal(t, uint64(200+20), total.internetEgressBytes)
+	assert.False(t, total.egressUnavailable)
+	// ... and the switch isn't mistaken for the counters being reset
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.networkUsageResetsTotal))
+}
+
+// blockingUsageSource is a UsageSource that records how many requests are in flight at once, and
+// never replies for VMs named "stuck"
+type blockingUsageSource struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (s *blockingUsageSource) GetUsage(ctx context.Context, vm *vmapi.VirtualMachine) (*VMUsage, error) {
+	s.mu.Lock()
+	s.inFlight += 1
+	s.maxInFlight = util.Max(s.maxInFlight, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight -= 1
+		s.mu.Unlock()
+	}()
+
+	switch vm.Name {
+	case "stuck":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case "broken":
+		return nil, errors.New("connection refused")
+	default:
+		// Give the other workers a chance to start their requests
+		time.Sleep(10 * time.Millisecond)
+		return &VMUsage{Network: api.NetworkUsage{InternalBytes: 1, InternetBytes: 2, Interfaces: nil, InboundConnections: nil}, Disk: nil}, nil
+	}
+}
+
+func TestFetchUsage(t *testing.T) {
+	metrics := NewPromMetrics()
+	errs := util.NewErrorAggregator(time.Minute, metrics.collectErrorsTotal, networkUsageErrorKind)
+	conf := &EgressConfig{
+		InternalCIDRs:         nil,
+		InternalMetricName:    "internal",
+		InternetMetricName:    "internet",
+		InterfaceMetricNames:  nil,
+		RequestTimeoutSeconds: 1,
+		MaxConcurrentRequests: 3,
+		Source:                nil,
+	}
+
+	var vms []*vmapi.VirtualMachine
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "stuck", "broken"} {
+		vm := new(vmapi.VirtualMachine)
+		vm.Name = name
+		vm.UID = types.UID(name)
+		vms = append(vms, vm)
+	}
+
+	source := new(blockingUsageSource)
+	results := fetchUsage(context.Background(), zap.NewNop(), conf, source, errs, metrics.networkUsageRequestDuration, vms)
+
+	// Only the successful requests have results
+	assert.Len(t, results, 8)
+	assert.NotContains(t, results, types.UID("stuck"))
+	assert.NotContains(t, results, types.UID("broken"))
+	assert.Equal(t, uint64(2), results["a"].Network.InternetBytes)
+
+	assert.Equal(t, 3, source.maxInFlight)
+	// Each outcome was observed
+	assert.Equal(t, 3, testutil.CollectAndCount(metrics.networkUsageRequestDuration))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.collectErrorsTotal.WithLabelValues(networkUsageErrorKind)))
+}
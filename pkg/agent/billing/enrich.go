@@ -0,0 +1,169 @@
+package billing
+
+// Enrichment of billing events just before they're queued, so that deployments can adjust what's
+// sent without patching the code that produces the events.
+//
+// Simple changes -- renaming metrics, filling in the region, dropping endpoints -- are configured
+// with EnrichmentConfig. Anything else can be done by a Go function registered with
+// RegisterEventEnricher (e.g. from an init function in a fork's own package), which is then enabled
+// by name in the config.
+//
+// Enrichment is applied after everything else, so the rest of billing (e.g. rounding, anomaly
+// detection, and reconciliation) always sees the original events.
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type EnrichmentConfig struct {
+	// MetricNames renames metrics: events for each metric in the keys are sent with the value as
+	// their metric name instead.
+	MetricNames map[string]string `json:"metricNames,omitempty"`
+	// Region, if not empty, is set as the region of every event that doesn't already have one.
+	Region string `json:"region,omitempty"`
+	// DropEndpoints gives regular expressions for endpoint IDs whose events are dropped instead of
+	// sent. Each must match the whole endpoint ID.
+	DropEndpoints []string `json:"dropEndpoints,omitempty"`
+	// Hooks gives the names of the enrichers registered with RegisterEventEnricher to apply to each
+	// event, in order, after the rest of the enrichment.
+	Hooks []string `json:"hooks,omitempty"`
+}
+
+// EventEnricher modifies a billing event before it's queued, returning false if the event should be
+// dropped instead
+//
+// The event is either a *billing.IncrementalEvent or a *billing.AbsoluteEvent. Its idempotency key
+// has already been set, and shouldn't be changed.
+type EventEnricher func(event billing.AnyEvent) (keep bool)
+
+var (
+	eventEnrichersMu sync.Mutex
+	eventEnrichers   = make(map[string]EventEnricher)
+)
+
+// RegisterEventEnricher makes the enricher available to enable by name in EnrichmentConfig.Hooks
+//
+// It panics if an enricher with the same name is already registered.
+func RegisterEventEnricher(name string, enricher EventEnricher) {
+	eventEnrichersMu.Lock()
+	defer eventEnrichersMu.Unlock()
+
+	if _, ok := eventEnrichers[name]; ok {
+		panic(fmt.Errorf("billing event enricher %q is already registered", name))
+	}
+	eventEnrichers[name] = enricher
+}
+
+// EventEnricherRegistered returns whether an enricher with the name was registered with
+// RegisterEventEnricher
+func EventEnricherRegistered(name string) bool {
+	eventEnrichersMu.Lock()
+	defer eventEnrichersMu.Unlock()
+
+	_, ok := eventEnrichers[name]
+	return ok
+}
+
+// eventEnrichment applies an EnrichmentConfig
+type eventEnrichment struct {
+	conf          *EnrichmentConfig
+	dropEndpoints []*regexp.Regexp
+	hooks         []EventEnricher
+
+	droppedTotal *prometheus.CounterVec
+}
+
+// newEventEnrichment returns the enrichment for the config, or nil if there is none
+//
+// The config must have already been validated.
+func newEventEnrichment(conf *EnrichmentConfig, metrics PromMetrics) *eventEnrichment {
+	if conf == nil {
+		return nil
+	}
+
+	var dropEndpoints []*regexp.Regexp
+	for _, pattern := range conf.DropEndpoints {
+		dropEndpoints = append(dropEndpoints, regexp.MustCompile(fmt.Sprintf("^(?:%s)$", pattern)))
+	}
+
+	eventEnrichersMu.Lock()
+	defer eventEnrichersMu.Unlock()
+
+	var hooks []EventEnricher
+	for _, name := range conf.Hooks {
+		hooks = append(hooks, eventEnrichers[name])
+	}
+
+	return &eventEnrichment{
+		conf:          conf,
+		dropEndpoints: dropEndpoints,
+		hooks:         hooks,
+		droppedTotal:  metrics.enrichmentDroppedTotal,
+	}
+}
+
+// apply modifies the event according to the config, returning false if it should be dropped
+func (e *eventEnrichment) apply(event billing.AnyEvent) (keep bool) {
+	endpointID := billing.EndpointIDOf(event)
+	for _, re := range e.dropEndpoints {
+		if endpointID != "" && re.MatchString(endpointID) {
+			e.droppedTotal.WithLabelValues("dropEndpoints").Inc()
+			return false
+		}
+	}
+
+	var metricName *string
+	var identity *billing.Identity
+	switch ev := event.(type) {
+	case *billing.IncrementalEvent:
+		metricName, identity = &ev.MetricName, &ev.Identity
+	case *billing.AbsoluteEvent:
+		metricName, identity = &ev.MetricName, &ev.Identity
+	default:
+		panic(fmt.Errorf("unexpected billing event type %T", event))
+	}
+
+	if name, ok := e.conf.MetricNames[*metricName]; ok {
+		*metricName = name
+	}
+	if e.conf.Region != "" && identity.Region == "" {
+		identity.Region = e.conf.Region
+	}
+
+	for i, hook := range e.hooks {
+		if !hook(event) {
+			e.droppedTotal.WithLabelValues(e.conf.Hooks[i]).Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// enqueueBatch adds the events to all of the queues, after applying the configured enrichment,
+// except for the ones that the enrichment dropped
+//
+// Each queue's size limit is applied to the batch as a whole, so a full queue either takes all of
+// the events or none of them. See eventQueueInternals.onReject.
+func (s *metricsState) enqueueBatch(queues []eventQueuePusher[billing.AnyEvent], events []billing.AnyEvent) {
+	if s.enrichment != nil {
+		kept := make([]billing.AnyEvent, 0, len(events))
+		for _, e := range events {
+			if s.enrichment.apply(e) {
+				kept = append(kept, e)
+			}
+		}
+		events = kept
+	}
+	if len(events) == 0 {
+		return
+	}
+	for _, q := range queues {
+		q.enqueue(events...)
+	}
+}
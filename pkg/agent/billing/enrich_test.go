@@ -0,0 +1,70 @@
+package billing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+func TestEventEnrichment(t *testing.T) {
+	RegisterEventEnricher("test-drop-zero", func(event billing.AnyEvent) bool {
+		e, ok := event.(*billing.IncrementalEvent)
+		return !ok || e.Value != 0
+	})
+	// Enrichers are registered globally, so remove it again for the next run of the test
+	t.Cleanup(func() {
+		eventEnrichersMu.Lock()
+		defer eventEnrichersMu.Unlock()
+		delete(eventEnrichers, "test-drop-zero")
+	})
+	assert.True(t, EventEnricherRegistered("test-drop-zero"))
+	assert.False(t, EventEnricherRegistered("test-unknown"))
+
+	metrics := NewPromMetrics()
+	e := newEventEnrichment(&EnrichmentConfig{
+		MetricNames:   map[string]string{"cpu_seconds": "effective_compute_seconds"},
+		Region:        "us-east-2",
+		DropEndpoints: []string{"ep-internal-.*"},
+		Hooks:         []string{"test-drop-zero"},
+	}, metrics)
+
+	event := func(endpointID string, value int) *billing.IncrementalEvent {
+		return &billing.IncrementalEvent{ //nolint:exhaustruct // only some fields are relevant
+			MetricName: "cpu_seconds",
+			EndpointID: endpointID,
+			Value:      value,
+		}
+	}
+
+	ev := event("ep-foo", 10)
+	assert.True(t, e.apply(ev))
+	assert.Equal(t, "effective_compute_seconds", ev.MetricName)
+	assert.Equal(t, "us-east-2", ev.Region)
+
+	// The region isn't overwritten if the event already has one
+	abs := &billing.AbsoluteEvent{ //nolint:exhaustruct // only some fields are relevant
+		MetricName: "heartbeat",
+		EndpointID: "ep-foo",
+		Identity:   billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "eu-west-1", Architecture: "", Replicas: 0},
+	}
+	assert.True(t, e.apply(abs))
+	assert.Equal(t, "heartbeat", abs.MetricName)
+	assert.Equal(t, "eu-west-1", abs.Region)
+
+	// Patterns must match the whole endpoint ID
+	assert.False(t, e.apply(event("ep-internal-1", 10)))
+	assert.True(t, e.apply(event("ep-foo-internal-1", 10)))
+	assert.False(t, e.apply(event("ep-foo", 0)))
+
+	expected := `
+# HELP autoscaling_agent_billing_enrichment_dropped_events_total Total billing events dropped by enrichment instead of being sent, by the config field or hook that dropped them
+# TYPE autoscaling_agent_billing_enrichment_dropped_events_total counter
+autoscaling_agent_billing_enrichment_dropped_events_total{source="dropEndpoints"} 1
+autoscaling_agent_billing_enrichment_dropped_events_total{source="test-drop-zero"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(metrics.enrichmentDroppedTotal, strings.NewReader(expected)))
+}
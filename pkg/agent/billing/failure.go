@@ -0,0 +1,166 @@
+package billing
+
+// Deciding what to do with events that failed to send, from the kind of error.
+//
+// - Errors that may be transient (timeouts, 5xx responses, throttling) are retried according to
+//   the client's retry policy, leaving the events in the queue if they keep failing.
+// - If the batch was too large for the collector, it's split in half, and each half is sent
+//   separately.
+// - If the events themselves were rejected (they couldn't be marshaled, or the collector responded
+//   with 400 Bad Request or 422 Unprocessable Content), sending them again won't help. The batch is
+//   split until the rejected events are isolated, and those are dropped, so that they don't hold up
+//   the rest of the queue.
+// - If our credentials were rejected, or the collector responded with any other 4xx (e.g. 404 from
+//   a wrong URL), the events may well be fine, but nothing will be accepted until the config or the
+//   collector is fixed. They're kept in the queue, and the failure is raised as an alert.
+//
+// Splitting stops after maxSplitDepth halvings. If the rejected events haven't been isolated by
+// then, the collector is probably rejecting everything, so the events are kept as if the failure
+// was raised as an alert, instead of sending every event on its own just to drop them all.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// failureAction is what the sender does with events that failed to send
+type failureAction string
+
+const (
+	failureRetry failureAction = "retry"
+	failureSplit failureAction = "split"
+	failureDrop  failureAction = "drop"
+	failureAlert failureAction = "alert"
+)
+
+// maxSplitDepth is the number of times that a batch may be halved to isolate rejected events. It's
+// enough to isolate single events in batches of up to 1024.
+const maxSplitDepth = 10
+
+// Values of the "reason" label on the dropped events metric
+const (
+	dropReasonTooLarge = "too-large"
+	dropReasonRejected = "rejected"
+)
+
+// classifyFailure returns what should be done with the events, given the error from sending them
+func classifyFailure(err error) failureAction {
+	var tooLarge billing.PayloadTooLargeError
+	var auth billing.AuthError
+	switch {
+	case errors.As(err, &tooLarge):
+		return failureSplit
+	case errors.As(err, &auth):
+		return failureAlert
+	case billing.IsRetryable(err):
+		return failureRetry
+	case isEventRejection(err):
+		return failureDrop
+	default:
+		return failureAlert
+	}
+}
+
+// isEventRejection returns whether the error shows that the events themselves can never be
+// accepted, rather than a problem with the collector or our config
+func isEventRejection(err error) bool {
+	var jsonErr billing.JSONError
+	var statusErr billing.UnexpectedStatusCodeError
+	switch {
+	case errors.As(err, &jsonErr):
+		return true
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusUnprocessableEntity
+	default:
+		return false
+	}
+}
+
+// sendChunk sends the events, splitting them into smaller batches if the collector can't accept
+// them all at once, and dropping any that it will never accept
+//
+// depth is the number of times that the events have already been split from the original chunk.
+//
+// It returns the number of events from the start of the chunk that were handled -- i.e., either
+// sent or dropped -- before any error.
+func (s eventSender) sendChunk(
+	logger *zap.Logger,
+	events []billing.AnyEvent,
+	depth int,
+	total int,
+	startTime time.Time,
+) (int, error) {
+	err := s.sendWithRetry(logger, events, total, startTime)
+	if err == nil {
+		return len(events), nil
+	}
+
+	action := classifyFailure(err)
+	switch action {
+	case failureSplit, failureDrop:
+		if len(events) > 1 && depth >= maxSplitDepth {
+			logger.Error(
+				"Billing collector rejected every batch of events after splitting, keeping them until it's fixed",
+				zap.Int("count", len(events)),
+				zap.Int("depth", depth),
+				zap.Error(err),
+			)
+			s.metrics.sendRejectionsTotal.WithLabelValues(s.clientInfo.name).Inc()
+			return 0, err
+		} else if len(events) > 1 {
+			half := len(events) / 2
+			logger.Warn(
+				"Splitting batch of billing events after it was rejected",
+				zap.Int("count", len(events)),
+				zap.String("action", string(action)),
+				zap.Error(err),
+			)
+			s.metrics.sendSplitsTotal.WithLabelValues(s.clientInfo.name).Inc()
+
+			sent, err := s.sendChunk(logger, events[:half], depth+1, total, startTime)
+			if err != nil {
+				return sent, err
+			}
+			rest, err := s.sendChunk(logger, events[half:], depth+1, total+sent, startTime)
+			return sent + rest, err
+		}
+
+		reason := dropReasonRejected
+		if action == failureSplit {
+			reason = dropReasonTooLarge
+		}
+		logger.Error(
+			"Dropping billing event that the collector will never accept",
+			zap.Any("event", events[0]),
+			zap.String("reason", reason),
+			zap.Error(err),
+		)
+		s.metrics.sendDroppedEventsTotal.WithLabelValues(s.clientInfo.name, reason).Add(float64(len(events)))
+		return len(events), nil
+	case failureAlert:
+		var auth billing.AuthError
+		if errors.As(err, &auth) {
+			logger.Error(
+				"Billing collector rejected our credentials, keeping events until the config is fixed",
+				zap.Int("count", len(events)),
+				zap.Error(err),
+			)
+			s.metrics.sendAuthFailuresTotal.WithLabelValues(s.clientInfo.name).Inc()
+		} else {
+			logger.Error(
+				"Billing collector rejected events for an unknown reason, keeping them until it's fixed",
+				zap.Int("count", len(events)),
+				zap.Error(err),
+			)
+			s.metrics.sendRejectionsTotal.WithLabelValues(s.clientInfo.name).Inc()
+		}
+		return 0, err
+	default:
+		return 0, err
+	}
+}
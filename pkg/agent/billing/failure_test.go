@@ -0,0 +1,139 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// rejectingSink rejects batches that are larger than maxBatch, and any batch that includes an event
+// for a rejected endpoint, recording the endpoints of the batches it accepts
+type rejectingSink struct {
+	maxBatch int
+	rejected map[string]bool
+	accepted *[]string
+}
+
+func (r rejectingSink) send(_ eventSender, _ *zap.Logger, events []billing.AnyEvent, _ int, _ time.Time) error {
+	if len(events) > r.maxBatch {
+		return billing.PayloadTooLargeError{StatusCode: http.StatusRequestEntityTooLarge}
+	}
+	for _, e := range events {
+		if r.rejected[e.(*billing.IncrementalEvent).EndpointID] {
+			return billing.UnexpectedStatusCodeError{StatusCode: http.StatusBadRequest}
+		}
+	}
+	for _, e := range events {
+		*r.accepted = append(*r.accepted, e.(*billing.IncrementalEvent).EndpointID)
+	}
+	return nil
+}
+
+func (r rejectingSink) updated(next sink) sink { return next }
+func (r rejectingSink) close(*zap.Logger)      {}
+func (r rejectingSink) logField() zap.Field    { return zap.Skip() }
+
+func TestClassifyFailure(t *testing.T) {
+	assert.Equal(t, failureRetry, classifyFailure(billing.RequestError{Err: errors.New("timeout")}))
+	assert.Equal(t, failureRetry, classifyFailure(billing.ThrottledError{StatusCode: http.StatusTooManyRequests, RetryAfter: 0}))
+	assert.Equal(t, failureRetry, classifyFailure(billing.UnexpectedStatusCodeError{StatusCode: http.StatusBadGateway}))
+	assert.Equal(t, failureSplit, classifyFailure(billing.PayloadTooLargeError{StatusCode: http.StatusRequestEntityTooLarge}))
+	assert.Equal(t, failureAlert, classifyFailure(billing.AuthError{StatusCode: http.StatusForbidden}))
+	assert.Equal(t, failureDrop, classifyFailure(billing.UnexpectedStatusCodeError{StatusCode: http.StatusBadRequest}))
+	assert.Equal(t, failureDrop, classifyFailure(billing.UnexpectedStatusCodeError{StatusCode: http.StatusUnprocessableEntity}))
+	assert.Equal(t, failureDrop, classifyFailure(billing.JSONError{Err: errors.New("bad event")}))
+	// Other 4xx responses don't show that anything's wrong with the events, e.g. a wrong URL
+	assert.Equal(t, failureAlert, classifyFailure(billing.UnexpectedStatusCodeError{StatusCode: http.StatusNotFound}))
+	assert.Equal(t, failureAlert, classifyFailure(billing.UnexpectedStatusCodeError{StatusCode: http.StatusMethodNotAllowed}))
+}
+
+func TestSendChunkSplitsAndDrops(t *testing.T) {
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.metrics = NewPromMetrics()
+	sender.name = "test"
+	sender.clock = util.NewFakeClock(time.Now())
+
+	var events []billing.AnyEvent
+	for _, ep := range []string{"ep-1", "ep-2", "ep-bad", "ep-3", "ep-4"} {
+		events = append(events, &billing.IncrementalEvent{
+			MetricName:     "effective_compute_seconds",
+			Type:           "",
+			SchemaVersion:  0,
+			IdempotencyKey: "",
+			SequenceNumber: 0,
+			EndpointID:     ep,
+			StartTime:      time.Time{},
+			StopTime:       time.Time{},
+			Value:          1,
+			Anomalous:      false,
+			Partial:        false,
+			Identity:       billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0},
+		})
+	}
+
+	var accepted []string
+	sender.sink = rejectingSink{maxBatch: 2, rejected: map[string]bool{"ep-bad": true}, accepted: &accepted}
+
+	handled, err := sender.sendChunk(zap.NewNop(), events, 0, 0, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, len(events), handled)
+	// Everything except the rejected event was sent, in order
+	assert.Equal(t, []string{"ep-1", "ep-2", "ep-3", "ep-4"}, accepted)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendDroppedEventsTotal.WithLabelValues("test", dropReasonRejected)))
+
+	// Events aren't dropped when our credentials are rejected
+	sends := 0
+	sender.sink = fakeSink{failures: 1, err: billing.AuthError{StatusCode: http.StatusUnauthorized}, sends: &sends}
+	handled, err = sender.sendChunk(zap.NewNop(), events, 0, 0, time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, 0, handled)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendAuthFailuresTotal.WithLabelValues("test")))
+
+	// ... nor when the collector rejects them for any other reason, without splitting them
+	sends = 0
+	sender.sink = fakeSink{failures: 1, err: billing.UnexpectedStatusCodeError{StatusCode: http.StatusNotFound}, sends: &sends}
+	handled, err = sender.sendChunk(zap.NewNop(), events, 0, 0, time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, 0, handled)
+	assert.Equal(t, 1, sends)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendRejectionsTotal.WithLabelValues("test")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendDroppedEventsTotal.WithLabelValues("test", dropReasonRejected)))
+}
+
+func TestSendChunkSplitDepth(t *testing.T) {
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.metrics = NewPromMetrics()
+	sender.name = "test"
+	sender.clock = util.NewFakeClock(time.Now())
+
+	events := make([]billing.AnyEvent, 1<<(maxSplitDepth+1))
+	for i := range events {
+		//nolint:exhaustruct // only the endpoint matters here
+		events[i] = &billing.IncrementalEvent{MetricName: "cpu", EndpointID: fmt.Sprintf("ep-%d", i), Value: 1}
+	}
+
+	// If the collector rejects everything, splitting stops before the events are sent one at a
+	// time, and they're kept.
+	sends := 0
+	sender.sink = fakeSink{failures: len(events) * 2, err: billing.UnexpectedStatusCodeError{StatusCode: http.StatusBadRequest}, sends: &sends}
+	handled, err := sender.sendChunk(zap.NewNop(), events, 0, 0, time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, 0, handled)
+	// Only the first batch at each depth is sent, because the first failure at the deepest level
+	// stops the rest.
+	assert.Equal(t, maxSplitDepth+1, sends)
+	assert.Equal(t, 0.0, testutil.ToFloat64(sender.metrics.sendDroppedEventsTotal.WithLabelValues("test", dropReasonRejected)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendRejectionsTotal.WithLabelValues("test")))
+}
@@ -0,0 +1,93 @@
+package billing
+
+// Writing billing events to the local filesystem instead of pushing them, for air-gapped clusters
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type FileClientConfig struct {
+	BaseClientConfig
+	// Path is the directory that events are written under, partitioned by date. See
+	// billing.FileClient for the layout.
+	Path string `json:"path"`
+	// MaxFileBytes is the uncompressed size, in bytes, at which a file is completed and a new one is
+	// started.
+	MaxFileBytes uint `json:"maxFileBytes"`
+	// MaxFileAgeSeconds is the age at which a file is completed and a new one is started, even if
+	// it hasn't reached MaxFileBytes.
+	MaxFileAgeSeconds uint `json:"maxFileAgeSeconds"`
+}
+
+func newFileClient(c *FileClientConfig) *billing.FileClient {
+	return billing.NewFileClient(c.Path, int64(c.MaxFileBytes), time.Second*time.Duration(c.MaxFileAgeSeconds))
+}
+
+// fileSink writes events to the local filesystem
+type fileSink struct {
+	file *billing.FileClient
+}
+
+// send writes the events to the current file, logging and recording metrics about the result in
+// the same way as push
+func (f fileSink) send(s eventSender, logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error {
+	writeStart := time.Now()
+	err := f.file.Write(writeStart, events)
+	writeDuration := time.Since(writeStart)
+	if s.reporter != nil {
+		s.reporter.PushResult(s.clientInfo.name, err)
+	}
+
+	response := responseClass(err)
+	s.metrics.sendBatchSize.WithLabelValues(s.clientInfo.name).Observe(float64(len(events)))
+	s.metrics.sendRequestsTotal.WithLabelValues(s.clientInfo.name, response).Inc()
+	s.metrics.sendRequestDuration.WithLabelValues(s.clientInfo.name, response).Observe(writeDuration.Seconds())
+
+	if err != nil {
+		logger.Error(
+			"Failed to write billing events",
+			zap.Int("count", len(events)),
+			zap.String("dir", f.file.Dir),
+			zap.Int("total", total),
+			zap.Duration("totalTime", s.clock.Since(startTime)),
+			zap.Error(err),
+		)
+		s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErrorClass(err)).Inc()
+		return err
+	}
+
+	logger.Debug(
+		"Successfully wrote some billing events",
+		zap.Int("count", len(events)),
+		zap.String("dir", f.file.Dir),
+		zap.Int("total", total+len(events)),
+		zap.Duration("totalTime", s.clock.Since(startTime)),
+	)
+	return nil
+}
+
+// updated keeps the current sink, so that the file that's open continues to be written to
+func (f fileSink) updated(sink) sink {
+	return f
+}
+
+// onPushInterval rotates the current file if it's too old, even if there are no new events
+func (f fileSink) onPushInterval(logger *zap.Logger, now time.Time) {
+	if err := f.file.RotateIfExpired(now); err != nil {
+		logger.Error("Failed to rotate billing events file", zap.String("dir", f.file.Dir), zap.Error(err))
+	}
+}
+
+func (f fileSink) close(logger *zap.Logger) {
+	if err := f.file.Close(); err != nil {
+		logger.Error("Failed to complete billing events file", zap.String("dir", f.file.Dir), zap.Error(err))
+	}
+}
+
+func (f fileSink) logField() zap.Field {
+	return zap.String("dir", f.file.Dir)
+}
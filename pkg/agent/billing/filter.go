@@ -0,0 +1,120 @@
+package billing
+
+// Filtering of the endpoints that are billed, so that internal or system databases can be kept out
+// of customers' usage.
+//
+// Excluded VMs are removed as soon as they're listed on each collection, so none of their usage is
+// collected or sent. They're counted by the autoscaling_agent_billing_vms_excluded metric.
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+type EndpointFilterConfig struct {
+	// Allow, if not empty, gives regular expressions for the endpoint IDs that are billed.
+	// Endpoints whose ID doesn't match any of them are excluded. Each must match the whole ID.
+	Allow []string `json:"allow,omitempty"`
+	// Deny gives regular expressions for endpoint IDs that are excluded, even if they're allowed.
+	// Each must match the whole ID.
+	Deny []string `json:"deny,omitempty"`
+	// Selector, if not nil, excludes the VMs whose labels don't match it. To exclude VMs with a
+	// particular label, use an expression with the "DoesNotExist" or "NotIn" operator.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// endpointFilter applies an EndpointFilterConfig
+type endpointFilter struct {
+	allow    []*regexp.Regexp
+	deny     []*regexp.Regexp
+	selector labels.Selector // nil if there's no selector
+
+	excludedCurrent *prometheus.GaugeVec
+}
+
+// newEndpointFilter returns the filter for the config, or nil if there is none
+//
+// The config must have already been validated.
+func newEndpointFilter(conf *EndpointFilterConfig, metrics PromMetrics) *endpointFilter {
+	// Reset the metric, so that the exclusions from a filter that's been removed don't stick around.
+	metrics.vmsExcludedCurrent.Reset()
+	if conf == nil {
+		return nil
+	}
+
+	compile := func(patterns []string) []*regexp.Regexp {
+		var res []*regexp.Regexp
+		for _, pattern := range patterns {
+			res = append(res, regexp.MustCompile(fmt.Sprintf("^(?:%s)$", pattern)))
+		}
+		return res
+	}
+
+	var selector labels.Selector
+	if conf.Selector != nil {
+		// The selector was already checked when the config was read.
+		selector, _ = metav1.LabelSelectorAsSelector(conf.Selector)
+	}
+
+	return &endpointFilter{
+		allow:           compile(conf.Allow),
+		deny:            compile(conf.Deny),
+		selector:        selector,
+		excludedCurrent: metrics.vmsExcludedCurrent,
+	}
+}
+
+// exclusion returns why the VM is excluded from billing, or "" if it isn't
+//
+// VMs that aren't endpoints are never excluded, because they aren't billed anyways.
+func (f *endpointFilter) exclusion(vm *vmapi.VirtualMachine) string {
+	endpointID, isEndpoint := vm.Annotations[api.AnnotationBillingEndpointID]
+	if !isEndpoint {
+		return ""
+	}
+
+	matchesAny := func(res []*regexp.Regexp) bool {
+		for _, re := range res {
+			if re.MatchString(endpointID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(f.allow) != 0 && !matchesAny(f.allow) {
+		return "allow"
+	} else if matchesAny(f.deny) {
+		return "deny"
+	} else if f.selector != nil && !f.selector.Matches(labels.Set(vm.Labels)) {
+		return "selector"
+	}
+	return ""
+}
+
+// apply returns the VMs that aren't excluded, updating the metric with the number that were
+func (f *endpointFilter) apply(vms []*vmapi.VirtualMachine) []*vmapi.VirtualMachine {
+	excluded := map[string]int{"allow": 0, "deny": 0, "selector": 0}
+
+	var included []*vmapi.VirtualMachine
+	for _, vm := range vms {
+		if reason := f.exclusion(vm); reason != "" {
+			excluded[reason] += 1
+			continue
+		}
+		included = append(included, vm)
+	}
+
+	for reason, count := range excluded {
+		f.excludedCurrent.WithLabelValues(reason).Set(float64(count))
+	}
+	return included
+}
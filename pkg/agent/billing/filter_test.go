@@ -0,0 +1,58 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestEndpointFilter(t *testing.T) {
+	makeVM := func(name string, endpointID string, labels map[string]string) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.Name = name
+		vm.Labels = labels
+		if endpointID != "" {
+			vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: endpointID}
+		}
+		return vm
+	}
+	names := func(vms []*vmapi.VirtualMachine) []string {
+		var result []string
+		for _, vm := range vms {
+			result = append(result, vm.Name)
+		}
+		return result
+	}
+
+	metrics := NewPromMetrics()
+	f := newEndpointFilter(&EndpointFilterConfig{
+		Allow: []string{"ep-.*"},
+		Deny:  []string{"ep-system-.*"},
+		Selector: &metav1.LabelSelector{ //nolint:exhaustruct // MatchLabels isn't needed
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "example.com/internal", Operator: metav1.LabelSelectorOpDoesNotExist, Values: nil},
+			},
+		},
+	}, metrics)
+
+	vms := []*vmapi.VirtualMachine{
+		makeVM("billed", "ep-foo", nil),
+		makeVM("not-endpoint", "", map[string]string{"example.com/internal": "true"}),
+		makeVM("not-allowed", "other-foo", nil),
+		makeVM("denied", "ep-system-1", nil),
+		makeVM("internal", "ep-bar", map[string]string{"example.com/internal": "true"}),
+		// Patterns must match the whole endpoint ID
+		makeVM("suffix", "xep-foo", nil),
+	}
+	assert.Equal(t, []string{"billed", "not-endpoint"}, names(f.apply(vms)))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.vmsExcludedCurrent.WithLabelValues("allow")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.vmsExcludedCurrent.WithLabelValues("deny")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.vmsExcludedCurrent.WithLabelValues("selector")))
+}
@@ -0,0 +1,74 @@
+package billing
+
+// Periodic "heartbeat" events with the current allocation of each endpoint, so that the absence of
+// usage events can be told apart from the absence of reporting.
+
+import (
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type HeartbeatConfig struct {
+	// MetricName is the name of the absolute metric giving each endpoint's current allocation, in
+	// thousandths of a compute unit.
+	MetricName string `json:"metricName"`
+	// EverySeconds gives the minimum interval between heartbeats. Heartbeats are sent alongside
+	// collection, so the actual interval is rounded up to a multiple of collectEverySeconds.
+	EverySeconds uint `json:"everySeconds"`
+}
+
+// maybeEnqueueHeartbeats adds a heartbeat event to the queues for each endpoint that was present in
+// the most recent collection, if it's been long enough since the last time.
+func (s *metricsState) maybeEnqueueHeartbeats(
+	logger *zap.Logger,
+	conf *HeartbeatConfig,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+) {
+	now := s.clock.Now()
+	if now.Sub(s.lastHeartbeat) < time.Second*time.Duration(conf.EverySeconds) {
+		return
+	}
+	s.lastHeartbeat = now
+
+	batchSize := len(s.present)
+	firstSeq, err := s.sequence.Reserve(uint64(batchSize))
+	if err != nil {
+		logger.Error("Failed to persist billing sequence number", zap.Error(err))
+	}
+
+	countInBatch := 0
+	var batch []billing.AnyEvent
+	for key, m := range s.present {
+		seq := firstSeq + uint64(countInBatch)
+		countInBatch += 1
+		event := billing.Enrich(now, hostname, seq, countInBatch, batchSize, &billing.AbsoluteEvent{
+			MetricName:     conf.MetricName,
+			Type:           "", // set by billing.Enrich
+			SchemaVersion:  0,  // set by billing.Enrich
+			IdempotencyKey: "", // set by billing.Enrich
+			SequenceNumber: 0,  // set by billing.Enrich
+			TenantID:       "",
+			TimelineID:     "",
+			EndpointID:     key.endpointID,
+			Time:           now,
+			Value:          int(math.Round(m.computeUnits(s.computeUnit) * 1000)),
+			Identity:       s.identities[key],
+		})
+		logger.Debug(
+			"Adding heartbeat event to batch",
+			zap.String("IdempotencyKey", event.IdempotencyKey),
+			zap.Uint64("SequenceNumber", event.SequenceNumber),
+			zap.String("EndpointID", event.EndpointID),
+			zap.Int("Value", event.Value),
+		)
+		batch = append(batch, event)
+	}
+
+	s.enqueueBatch(queues, batch)
+	s.summary.recordEnqueued(countInBatch)
+}
@@ -7,12 +7,14 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
 
 type VMStoreForNode = watch.IndexedStore[vmapi.VirtualMachine, *VMNodeIndex]
 
-// VMNodeIndex is a watch.Index that stores all of the VMs for a particular node
+// VMNodeIndex is a watch.Index that stores all of the VMs for a particular node, or, when the
+// billing collector is running centrally, for one shard of the whole cluster (see NewVMShardIndex)
 //
 // We have to implement this ourselves because K8s does not (as of 2023-04-04) support field
 // selectors on CRDs, so we can't have the API server filter out VMs for us.
@@ -22,18 +24,36 @@ type VMStoreForNode = watch.IndexedStore[vmapi.VirtualMachine, *VMNodeIndex]
 // https://github.com/kubernetes/kubernetes/issues/53459#issuecomment-1146200268
 type VMNodeIndex struct {
 	forNode map[types.UID]*vmapi.VirtualMachine
-	node    string
+	// includes returns whether the VM belongs in the index
+	includes func(*vmapi.VirtualMachine) bool
 }
 
 func NewVMNodeIndex(node string) *VMNodeIndex {
 	return &VMNodeIndex{
-		forNode: make(map[types.UID]*vmapi.VirtualMachine),
-		node:    node,
+		forNode:  make(map[types.UID]*vmapi.VirtualMachine),
+		includes: func(vm *vmapi.VirtualMachine) bool { return vm.Status.Node == node },
 	}
 }
 
+// NewVMShardIndex returns a VMNodeIndex for the VMs on every node whose endpoint IDs are in the
+// shard, out of count shards. VMs without an endpoint ID are all in the first shard.
+//
+// Endpoints are assigned to shards the same way as with ShardsConfig, so a centralized collector
+// for each shard can push to the matching shard of a sharded billing endpoint.
+func NewVMShardIndex(shard int, count int) *VMNodeIndex {
+	return &VMNodeIndex{
+		forNode:  make(map[types.UID]*vmapi.VirtualMachine),
+		includes: func(vm *vmapi.VirtualMachine) bool { return VMInShard(vm, shard, count) },
+	}
+}
+
+// VMInShard returns whether the VM is in the shard, out of count shards, as for NewVMShardIndex
+func VMInShard(vm *vmapi.VirtualMachine, shard int, count int) bool {
+	return shardOf(vm.Annotations[api.AnnotationBillingEndpointID], count) == shard
+}
+
 func (i *VMNodeIndex) Add(vm *vmapi.VirtualMachine) {
-	if vm.Status.Node == i.node {
+	if i.includes(vm) {
 		i.forNode[vm.UID] = vm
 	}
 }
@@ -0,0 +1,45 @@
+package billing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestVMShardIndex(t *testing.T) {
+	const count = 4
+
+	var vms []*vmapi.VirtualMachine
+	for i := 0; i < 20; i++ {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = types.UID(fmt.Sprintf("vm-%d", i))
+		vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: fmt.Sprintf("ep-%d", i)}
+		vms = append(vms, vm)
+	}
+	noEndpoint := new(vmapi.VirtualMachine)
+	noEndpoint.UID = "no-endpoint"
+	vms = append(vms, noEndpoint)
+
+	// Every VM is in exactly one shard, matching the shard its events are sent to
+	total := 0
+	for shard := 0; shard < count; shard++ {
+		index := NewVMShardIndex(shard, count)
+		for _, vm := range vms {
+			index.Add(vm)
+		}
+		for _, vm := range index.List() {
+			assert.Equal(t, shard, shardOf(vm.Annotations[api.AnnotationBillingEndpointID], count))
+		}
+		total += len(index.List())
+	}
+	assert.Equal(t, len(vms), total)
+
+	// VMs without an endpoint ID are in the first shard
+	assert.True(t, VMInShard(noEndpoint, 0, count))
+}
@@ -0,0 +1,90 @@
+package billing
+
+// Optional self-check of the accumulation of usage, asserting that the CPU-seconds accumulated for
+// each endpoint are never negative, and never more than its allocation could have used.
+//
+// Each time slice is strategically under-billed with the smaller of the allocations observed at
+// either end, so the usage must be between zero and the integral of the *larger* one. That bound is
+// integrated separately, directly from what was observed at each collection, so that bugs in
+// merging, splitting, clamping, or finalizing time slices are caught.
+//
+// Unlike reconciliation, this is checked before rounding, so there's no tolerance beyond
+// floating-point error.
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	invariantNonNegative   = "non_negative"
+	invariantMaxAllocation = "max_allocation"
+)
+
+// invariantEpsilon is the difference, in CPU-seconds, that's allowed for floating-point error when
+// comparing the accumulated usage with the bound, in addition to invariantRelativeEpsilon of it
+const (
+	invariantEpsilon         = 1e-6
+	invariantRelativeEpsilon = 1e-9
+)
+
+type invariantChecker struct {
+	violationsTotal *prometheus.CounterVec
+
+	// bounds stores the most CPU-seconds that each endpoint could have used since the last batch
+	bounds map[string]float64
+	// accumulated stores the CPU-seconds accumulated for each endpoint since the last batch
+	accumulated map[string]float64
+}
+
+func newInvariantChecker(metrics PromMetrics) *invariantChecker {
+	return &invariantChecker{
+		violationsTotal: metrics.invariantViolationsTotal,
+		bounds:          make(map[string]float64),
+		accumulated:     make(map[string]float64),
+	}
+}
+
+// observe adds the largest CPU allocation observed for the endpoint over the time from start to end
+func (c *invariantChecker) observe(endpointID string, maxCPU vmapi.MilliCPU, start, end time.Time) {
+	if end.After(start) {
+		c.bounds[endpointID] += maxCPU.AsFloat64() * end.Sub(start).Seconds()
+	}
+}
+
+// recordBilled adds CPU-seconds accumulated for the endpoint, before rounding, and checks that the
+// invariants still hold
+func (c *invariantChecker) recordBilled(logger *zap.Logger, endpointID string, cpuSeconds float64) {
+	c.accumulated[endpointID] += cpuSeconds
+	accumulated := c.accumulated[endpointID]
+	bound := c.bounds[endpointID]
+
+	violated := func(invariant string, msg string) {
+		logger.Error(
+			msg,
+			zap.String("invariant", invariant),
+			zap.String("endpointID", endpointID),
+			zap.Float64("cpuSeconds", cpuSeconds),
+			zap.Float64("accumulatedCPUSeconds", accumulated),
+			zap.Float64("maxCPUSeconds", bound),
+		)
+		c.violationsTotal.WithLabelValues(invariant).Inc()
+	}
+
+	if cpuSeconds < -invariantEpsilon || accumulated < -invariantEpsilon {
+		violated(invariantNonNegative, "Accumulated billing CPU usage is negative")
+	}
+	if accumulated > bound*(1+invariantRelativeEpsilon)+invariantEpsilon {
+		violated(invariantMaxAllocation, "Accumulated billing CPU usage is more than the largest allocation observed")
+	}
+}
+
+// finishBatch resets the totals once all the usage since the last batch has been accumulated
+func (c *invariantChecker) finishBatch() {
+	c.bounds = make(map[string]float64)
+	c.accumulated = make(map[string]float64)
+}
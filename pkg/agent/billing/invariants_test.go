@@ -0,0 +1,207 @@
+package billing
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestInvariantChecker(t *testing.T) {
+	metrics := NewPromMetrics()
+	c := newInvariantChecker(metrics)
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	violations := func(invariant string) float64 {
+		return testutil.ToFloat64(metrics.invariantViolationsTotal.WithLabelValues(invariant))
+	}
+
+	// 2 CPUs for a minute, then 1 CPU for a minute
+	c.observe("ep-a", 2000, start, start.Add(time.Minute))
+	c.observe("ep-a", 1000, start.Add(time.Minute), start.Add(2*time.Minute))
+	// Backwards time is ignored, rather than reducing the bound
+	c.observe("ep-a", 1000, start.Add(time.Minute), start)
+
+	c.recordBilled(logger, "ep-a", 120)
+	c.recordBilled(logger, "ep-a", 60)
+	assert.Equal(t, 0.0, violations(invariantMaxAllocation))
+	c.recordBilled(logger, "ep-a", 1)
+	assert.Equal(t, 1.0, violations(invariantMaxAllocation))
+
+	// Usage for endpoints that were never observed is always too much
+	c.recordBilled(logger, "ep-b", 1)
+	assert.Equal(t, 2.0, violations(invariantMaxAllocation))
+
+	c.recordBilled(logger, "ep-c", -1)
+	assert.Equal(t, 1.0, violations(invariantNonNegative))
+
+	// Each batch starts from zero
+	c.finishBatch()
+	c.observe("ep-a", 1000, start, start.Add(time.Minute))
+	c.recordBilled(logger, "ep-a", 60)
+	assert.Equal(t, 2.0, violations(invariantMaxAllocation))
+	assert.Equal(t, 1.0, violations(invariantNonNegative))
+}
+
+// TestAccumulationInvariants runs random sequences of collections, batches, deletions, and
+// migrations, and checks that the invariants always hold
+func TestAccumulationInvariants(t *testing.T) {
+	const (
+		runs         = 200
+		stepsPerRun  = 100
+		endpoints    = 3
+		maxVMs       = 5
+		maxCPUMillis = 8000
+	)
+
+	for run := 0; run < runs; run++ {
+		seed := int64(run)
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			metrics := NewPromMetrics()
+			logger := zap.NewNop()
+			start := time.Now()
+
+			var conf Config
+			conf.CPUMetricName = "cpu"
+			conf.ActiveTimeMetricName = "active"
+			conf.MaxEventWindowSeconds = uint(rng.Intn(2)) * 300
+
+			s := new(metricsState)
+			s.tracer = trace.NewNoopTracerProvider().Tracer("")
+			s.sequence = billing.NewSequence()
+			s.invariants = newInvariantChecker(metrics)
+			s.summary = newLogSummary(util.RealClock)
+			s.roundingRemainders = make(map[roundingKey]float64)
+			s.historical = make(map[metricsKey]vmMetricsHistory)
+			s.present = make(map[metricsKey]vmMetricsInstant)
+			s.departed = make(map[metricsKey]departedVM)
+			s.migratedIn = make(map[types.UID]time.Time)
+			s.identities = make(map[metricsKey]billing.Identity)
+			s.pushWindowStart = start
+			clock := util.NewFakeClock(start)
+			s.clock = clock
+
+			now := start
+			nextUID := 0
+			var vms []*vmapi.VirtualMachine
+			newVM := func() *vmapi.VirtualMachine {
+				vm := new(vmapi.VirtualMachine)
+				vm.Namespace = "default"
+				vm.Name = fmt.Sprintf("vm-%d", nextUID)
+				vm.UID = types.UID(vm.Name)
+				nextUID++
+				vm.Annotations = map[string]string{
+					api.AnnotationBillingEndpointID: fmt.Sprintf("ep-%d", rng.Intn(endpoints)),
+				}
+				vm.Status.Phase = vmapi.VmRunning
+				cpu := vmapi.MilliCPU(1 + rng.Intn(maxCPUMillis))
+				vm.Status.CPUs = &cpu
+				return vm
+			}
+			removeVM := func() *vmapi.VirtualMachine {
+				i := rng.Intn(len(vms))
+				vm := vms[i]
+				vms = append(vms[:i], vms[i+1:]...)
+				return vm
+			}
+
+			for step := 0; step < stepsPerRun; step++ {
+				elapsed := time.Duration(1+rng.Intn(120_000)) * time.Millisecond
+				now = now.Add(elapsed)
+				clock.Advance(elapsed)
+
+				switch op := rng.Intn(8); {
+				case op == 0 && len(vms) < maxVMs:
+					vms = append(vms, newVM())
+				case op == 1 && len(vms) < maxVMs:
+					// Migrated to this node at some point since the last few collections
+					vm := newVM()
+					at := metav1.NewTime(now.Add(-time.Duration(rng.Intn(180_000)) * time.Millisecond))
+					vm.Status.MigratedAt = &at
+					vms = append(vms, vm)
+				case op == 2 && len(vms) != 0:
+					// Scaled. The VM objects are shared with the state, so copy before changing.
+					i := rng.Intn(len(vms))
+					vm := vms[i].DeepCopy()
+					cpu := vmapi.MilliCPU(1 + rng.Intn(maxCPUMillis))
+					vm.Status.CPUs = &cpu
+					vms[i] = vm
+				case op == 3 && len(vms) != 0:
+					// Deleted, possibly some time before we found out about it
+					end := now.Add(-time.Duration(rng.Intn(60_000)) * time.Millisecond)
+					s.finalizeDeparted(logger, &conf, "host", nil, removeVM(), end, false)
+				case op == 4 && len(vms) != 0:
+					// Migrated away, possibly before the latest collection
+					vm := removeVM()
+					at := metav1.NewTime(now.Add(-time.Duration(rng.Intn(180_000)) * time.Millisecond))
+					vm.Status.MigratedAt = &at
+					s.finalizeDeparted(logger, &conf, "host", nil, vm, at.Time, true)
+				case op == 5:
+					s.drainEnqueue(logger, &conf, "host", nil, now, false)
+				default:
+					s.collectVMs(logger, now, vms, nil, nil, metrics)
+				}
+			}
+			s.drainEnqueue(logger, &conf, "host", nil, now, true)
+
+			for _, invariant := range []string{invariantNonNegative, invariantMaxAllocation} {
+				assert.Equal(
+					t, 0.0, testutil.ToFloat64(metrics.invariantViolationsTotal.WithLabelValues(invariant)),
+					"violations of %s invariant", invariant,
+				)
+			}
+		})
+	}
+}
+
+// TestAccumulationInvariantsTight checks that the bound isn't trivially loose: with a constant
+// allocation, all of it is billed.
+func TestAccumulationInvariantsTight(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Now()
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.invariants = newInvariantChecker(metrics)
+	s.summary = newLogSummary(util.RealClock)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+
+	vm := new(vmapi.VirtualMachine)
+	vm.UID = "vm"
+	vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep"}
+	vm.Status.Phase = vmapi.VmRunning
+	cpu := vmapi.MilliCPU(1500)
+	vm.Status.CPUs = &cpu
+	vms := []*vmapi.VirtualMachine{vm}
+
+	for i := 0; i <= 10; i++ {
+		s.collectVMs(logger, start.Add(time.Duration(i)*time.Minute), vms, nil, nil, metrics)
+	}
+	for key, history := range s.historical {
+		history.finalizeCurrentTimeSlice(s.computeUnit)
+		s.invariants.recordBilled(logger, key.endpointID, history.total.cpu)
+	}
+
+	assert.InDelta(t, 900.0, s.invariants.bounds["ep"], 1e-9)
+	assert.InDelta(t, 900.0, s.invariants.accumulated["ep"], 1e-9)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.invariantViolationsTotal.WithLabelValues(invariantMaxAllocation)))
+}
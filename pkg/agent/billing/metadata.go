@@ -0,0 +1,91 @@
+package billing
+
+// Optional metadata about each VM that's included in its billing events, so that usage can be
+// joined to infrastructure downstream without a separate lookup.
+//
+// The metadata is taken from the VM each time it's collected, so events for a VM that was
+// migrated during the window have the metadata from the latest collection.
+//
+// The architecture is that of the node the collector is running on, which is only the VM's node if
+// billing is collected per node. The number of replicas is from the annotation that's kept
+// up-to-date on each VM in a VirtualMachineScalingGroup.
+
+import (
+	"runtime"
+	"strconv"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type EventMetadataConfig struct {
+	// Fields is the allowlist of metadata fields that are included in events
+	Fields []EventMetadataField `json:"fields"`
+	// RegionLabel is the label on each VM that gives its region, required if Fields includes
+	// "region". VMs without the label have no region.
+	RegionLabel string `json:"regionLabel,omitempty"`
+}
+
+type EventMetadataField string
+
+const (
+	EventMetadataNamespace    EventMetadataField = "namespace"
+	EventMetadataVMName       EventMetadataField = "vmName"
+	EventMetadataNodeName     EventMetadataField = "nodeName"
+	EventMetadataRegion       EventMetadataField = "region"
+	EventMetadataArchitecture EventMetadataField = "architecture"
+	EventMetadataReplicas     EventMetadataField = "replicas"
+)
+
+// Valid returns whether f is one of the known metadata fields
+func (f EventMetadataField) Valid() bool {
+	switch f {
+	case EventMetadataNamespace, EventMetadataVMName, EventMetadataNodeName, EventMetadataRegion, EventMetadataArchitecture, EventMetadataReplicas:
+		return true
+	default:
+		return false
+	}
+}
+
+// identityOf returns the metadata for the VM that's enabled by the config
+func (c *EventMetadataConfig) identityOf(vm *vmapi.VirtualMachine) billing.Identity {
+	var id billing.Identity
+	for _, f := range c.Fields {
+		switch f {
+		case EventMetadataNamespace:
+			id.Namespace = vm.Namespace
+		case EventMetadataVMName:
+			id.VMName = vm.Name
+		case EventMetadataNodeName:
+			id.NodeName = vm.Status.Node
+		case EventMetadataRegion:
+			id.Region = vm.Labels[c.RegionLabel]
+		case EventMetadataArchitecture:
+			id.Architecture = runtime.GOARCH
+		case EventMetadataReplicas:
+			// VMs that aren't in a scaling group don't have the annotation, and so have no replicas.
+			id.Replicas, _ = strconv.Atoi(vm.Annotations[vmapi.VirtualMachineScalingGroupReplicasAnnotation])
+		}
+	}
+	return id
+}
+
+// recordIdentity stores the VM's metadata for its events, if metadata is enabled
+func (s *metricsState) recordIdentity(key metricsKey, vm *vmapi.VirtualMachine) {
+	if s.metadata != nil {
+		s.identities[key] = s.metadata.identityOf(vm)
+	}
+}
+
+// forgetIdentities removes the metadata for VMs that are no longer on this node, and have no usage
+// left to be sent
+func (s *metricsState) forgetIdentities() {
+	for key := range s.identities {
+		_, present := s.present[key]
+		_, departed := s.departed[key]
+		_, hasHistory := s.historical[key]
+		if !present && !departed && !hasHistory {
+			delete(s.identities, key)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package billing
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+func TestIdentityOf(t *testing.T) {
+	vm := new(vmapi.VirtualMachine)
+	vm.Namespace = "default"
+	vm.Name = "compute-foo"
+	vm.Labels = map[string]string{"example.com/region": "us-east-2"}
+	vm.Annotations = map[string]string{vmapi.VirtualMachineScalingGroupReplicasAnnotation: "3"}
+	vm.Status.Node = "node-1"
+
+	conf := EventMetadataConfig{
+		Fields:      []EventMetadataField{EventMetadataVMName, EventMetadataRegion},
+		RegionLabel: "example.com/region",
+	}
+	assert.Equal(t, billing.Identity{Namespace: "", VMName: "compute-foo", NodeName: "", Region: "us-east-2", Architecture: "", Replicas: 0}, conf.identityOf(vm))
+
+	conf.Fields = []EventMetadataField{EventMetadataNamespace, EventMetadataNodeName}
+	assert.Equal(t, billing.Identity{Namespace: "default", VMName: "", NodeName: "node-1", Region: "", Architecture: "", Replicas: 0}, conf.identityOf(vm))
+
+	// VMs without the label have no region
+	conf = EventMetadataConfig{Fields: []EventMetadataField{EventMetadataRegion}, RegionLabel: "example.com/other"}
+	assert.Equal(t, billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0}, conf.identityOf(vm))
+
+	// The architecture is the collector's own
+	conf = EventMetadataConfig{Fields: []EventMetadataField{EventMetadataArchitecture}, RegionLabel: ""}
+	assert.Equal(t, billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: runtime.GOARCH, Replicas: 0}, conf.identityOf(vm))
+
+	// The number of replicas is only set for VMs in a scaling group
+	conf = EventMetadataConfig{Fields: []EventMetadataField{EventMetadataReplicas}, RegionLabel: ""}
+	assert.Equal(t, billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 3}, conf.identityOf(vm))
+	vm.Annotations = nil
+	assert.Equal(t, billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0}, conf.identityOf(vm))
+}
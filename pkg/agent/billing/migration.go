@@ -0,0 +1,142 @@
+package billing
+
+// Attribution of usage across live migrations, so that each VM's usage is counted exactly once
+// between the source and target nodes.
+//
+// When a migration completes, the VM's .status.node is changed to the target node at the same time
+// that .status.migratedAt is set. The source node's autoscaler-agent counts the VM's usage up to
+// that time, and the target node's from that time onwards, regardless of when each of them sees
+// the change.
+
+import (
+	"time"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// migrationHandoffMaxDelay is the longest that we expect it to take for a completed migration to
+// be seen by the target node's collection. Migrations that completed longer ago than this aren't
+// counted from their completion, because we may have counted the usage in the meantime.
+const migrationHandoffMaxDelay = 2 * time.Minute
+
+// departedVM records the most recent collection of a VM that's no longer on this node, in case we
+// find out afterwards that it was deleted or migrated away.
+type departedVM struct {
+	metrics  vmMetricsInstant
+	lastSeen time.Time
+}
+
+// migratedInSince returns the time that the VM was migrated to this node, if its usage on this
+// node should be counted from then, rather than from the next collection.
+//
+// This is only the case the first time that each migration is seen.
+func (s *metricsState) migratedInSince(vm *vmapi.VirtualMachine, now time.Time) (time.Time, bool) {
+	if vm.Status.MigratedAt == nil {
+		return time.Time{}, false
+	}
+	at := vm.Status.MigratedAt.Time
+	if at.Before(now.Add(-migrationHandoffMaxDelay)) || !at.Before(now) {
+		return time.Time{}, false
+	}
+	if seen, ok := s.migratedIn[vm.UID]; ok && seen.Equal(at) {
+		return time.Time{}, false
+	}
+
+	s.migratedIn[vm.UID] = at
+	return at, true
+}
+
+// forgetOldMigrations removes the migrations that are too old to be counted by migratedInSince, so
+// that we don't need to remember them anymore.
+func (s *metricsState) forgetOldMigrations(now time.Time) {
+	for uid, at := range s.migratedIn {
+		if at.Before(now.Add(-migrationHandoffMaxDelay)) {
+			delete(s.migratedIn, uid)
+		}
+	}
+}
+
+// recordDeparted updates s.departed with the VMs that were present in old but not in the latest
+// collection
+func (s *metricsState) recordDeparted(old map[metricsKey]vmMetricsInstant, lastSeen *time.Time) {
+	s.departed = make(map[metricsKey]departedVM)
+	if lastSeen == nil {
+		return
+	}
+	for key, metrics := range old {
+		if _, ok := s.present[key]; !ok {
+			s.departed[key] = departedVM{metrics: metrics, lastSeen: *lastSeen}
+		}
+	}
+}
+
+// clampToMigration removes the part of the VM's usage that was recorded after it was migrated away
+// from this node, which happens if we collected it before seeing that it was migrated.
+//
+// Only usage that hasn't been added to the total yet can be removed.
+func (h *vmMetricsHistory) clampToMigration(migratedAt time.Time) {
+	if h.lastSlice == nil || !h.lastSlice.endTime.After(migratedAt) {
+		return
+	}
+	if h.lastSlice.startTime.After(migratedAt) {
+		h.lastSlice.endTime = h.lastSlice.startTime
+	} else {
+		h.lastSlice.endTime = migratedAt
+	}
+}
+
+// addMigratedInSlice records the VM's usage from when it was migrated to this node until now
+func (s *metricsState) addMigratedInSlice(
+	vm *vmapi.VirtualMachine,
+	key metricsKey,
+	presentMetrics vmMetricsInstant,
+	migratedAt time.Time,
+	now time.Time,
+) {
+	timeSlice := metricsTimeSlice{
+		metrics: vmMetricsInstant{
+			cpu:  presentMetrics.cpu,
+			mem:  presentMetrics.mem,
+			gpus: presentMetrics.gpus,
+			idle: s.idleSince(vm, migratedAt),
+			// The target runner's network usage is only counted from the next collection.
+			egress:            nil,
+			egressUnavailable: false,
+			containerCPU:      nil,
+			burstBaselineCU:   presentMetrics.burstBaselineCU,
+			usedCPU:           presentMetrics.usedCPU,
+			usedMem:           presentMetrics.usedMem,
+		},
+		startTime: migratedAt,
+		endTime:   now,
+	}
+
+	vmHistory, ok := s.historical[key]
+	if !ok {
+		vmHistory = vmMetricsHistory{
+			lastSlice: nil,
+			total: vmMetricsSeconds{
+				cpu:                  0,
+				computeUnits:         0,
+				gpu:                  0,
+				burstComputeUnits:    0,
+				usedCPU:              0,
+				usedComputeUnits:     0,
+				activeTime:           time.Duration(0),
+				internalEgressBytes:  0,
+				internetEgressBytes:  0,
+				egressUnavailable:    false,
+				interfaceEgressBytes: nil,
+				containerCPU:         nil,
+				upscales:             0,
+				downscales:           0,
+			},
+		}
+	}
+	vmHistory.appendSlice(timeSlice, s.computeUnit)
+	if s.allocations != nil {
+		s.allocations.record(allocationKey{namespace: vm.Namespace, endpointID: key.endpointID}, timeSlice)
+	}
+	s.reconcileSlice(key.endpointID, timeSlice)
+	s.historical[key] = vmHistory
+}
@@ -0,0 +1,122 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+func TestMigratedInSince(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	migratedVM := func(uid types.UID, at *time.Time) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = uid
+		if at != nil {
+			vm.Status.MigratedAt = &metav1.Time{Time: *at}
+		}
+		return vm
+	}
+	ago := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.migratedIn = make(map[types.UID]time.Time)
+
+	// Never migrated
+	_, ok := s.migratedInSince(migratedVM("a", nil), now)
+	assert.False(t, ok)
+
+	// Migrated too long ago to know whether the usage was already counted
+	_, ok = s.migratedInSince(migratedVM("b", ago(time.Hour)), now)
+	assert.False(t, ok)
+
+	// Recently migrated: counted from the migration, but only once
+	since, ok := s.migratedInSince(migratedVM("c", ago(10*time.Second)), now)
+	assert.True(t, ok)
+	assert.Equal(t, *ago(10 * time.Second), since)
+	_, ok = s.migratedInSince(migratedVM("c", ago(10*time.Second)), now.Add(5*time.Second))
+	assert.False(t, ok)
+
+	// ... until it's migrated again
+	since, ok = s.migratedInSince(migratedVM("c", ago(time.Second)), now)
+	assert.True(t, ok)
+	assert.Equal(t, *ago(time.Second), since)
+
+	// Old migrations are forgotten
+	s.forgetOldMigrations(now.Add(migrationHandoffMaxDelay))
+	assert.Empty(t, s.migratedIn)
+}
+
+func TestClampToMigration(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	slice := func(from, to time.Duration) *metricsTimeSlice {
+		return &metricsTimeSlice{
+			metrics: vmMetricsInstant{
+				cpu:               1000,
+				mem:               0,
+				gpus:              0,
+				idle:              false,
+				egress:            nil,
+				egressUnavailable: false,
+				containerCPU:      nil,
+				burstBaselineCU:   0,
+				usedCPU:           0,
+				usedMem:           0,
+			},
+			startTime: start.Add(from),
+			endTime:   start.Add(to),
+		}
+	}
+
+	cases := []struct {
+		name       string
+		slice      *metricsTimeSlice
+		migratedAt time.Duration
+		expected   *metricsTimeSlice
+	}{
+		{
+			name:       "no usage",
+			slice:      nil,
+			migratedAt: 10 * time.Second,
+			expected:   nil,
+		},
+		{
+			name:       "usage ends before migration",
+			slice:      slice(0, 5*time.Second),
+			migratedAt: 10 * time.Second,
+			expected:   slice(0, 5*time.Second),
+		},
+		{
+			name:       "usage continues after migration",
+			slice:      slice(0, 15*time.Second),
+			migratedAt: 10 * time.Second,
+			expected:   slice(0, 10*time.Second),
+		},
+		{
+			name:       "usage entirely after migration",
+			slice:      slice(12*time.Second, 15*time.Second),
+			migratedAt: 10 * time.Second,
+			expected:   slice(12*time.Second, 12*time.Second),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var h vmMetricsHistory
+			h.lastSlice = c.slice
+			h.clampToMigration(start.Add(c.migratedAt))
+			assert.Equal(t, c.expected, h.lastSlice)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package billing
+
+// Publishing billing events to NATS JetStream instead of pushing them over HTTP
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type NATSClientConfig struct {
+	BaseClientConfig
+	// URL is the NATS server to connect to, or a comma-separated list of servers.
+	URL string `json:"url"`
+	// SubjectTemplate is the subject that each event is published to. It may contain
+	// "{endpoint_id}" and "{metric}", which are replaced with the event's endpoint ID and metric
+	// name, e.g. "billing.{metric}.{endpoint_id}".
+	//
+	// There must be a JetStream stream capturing the subjects. Its duplicate window determines how
+	// long events published more than once are deduplicated for.
+	SubjectTemplate string `json:"subjectTemplate"`
+	// CredentialsFile, if not empty, is the path of a NATS credentials file used to authenticate.
+	CredentialsFile string `json:"credentialsFile,omitempty"`
+	// ReconnectWaitSeconds is the time to wait between attempts to reconnect to the server, after
+	// the connection is lost.
+	ReconnectWaitSeconds uint `json:"reconnectWaitSeconds"`
+}
+
+func newNATSClient(logger *zap.Logger, c *NATSClientConfig) *billing.NATSClient {
+	opts := []nats.Option{
+		nats.Name(fmt.Sprintf("autoscaler-agent-billing-%s", billing.GetHostname())),
+		nats.Timeout(time.Second * time.Duration(c.PushRequestTimeoutSeconds)),
+		// Keep trying to reconnect forever. Events stay in the queue while we're disconnected.
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second * time.Duration(c.ReconnectWaitSeconds)),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("Disconnected from NATS", zap.Error(err))
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Info("Reconnected to NATS", zap.String("url", conn.ConnectedUrl()))
+		}),
+	}
+	if c.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(c.CredentialsFile))
+	}
+
+	return billing.NewNATSClient(c.URL, c.SubjectTemplate, opts...)
+}
+
+// natsSink publishes events to NATS JetStream
+type natsSink struct {
+	client *billing.NATSClient
+}
+
+// send publishes the events, logging and recording metrics about the result in the same way as
+// push
+func (n natsSink) send(s eventSender, logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error {
+	s.waitForRateLimit(logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(s.config.PushRequestTimeoutSeconds))
+	defer cancel()
+
+	reqStart := time.Now()
+	duplicates, err := n.client.Publish(ctx, events)
+	reqDuration := time.Since(reqStart)
+	if s.reporter != nil {
+		s.reporter.PushResult(s.clientInfo.name, err)
+	}
+
+	response := responseClass(err)
+	s.metrics.sendBatchSize.WithLabelValues(s.clientInfo.name).Observe(float64(len(events)))
+	s.metrics.sendRequestsTotal.WithLabelValues(s.clientInfo.name, response).Inc()
+	s.metrics.sendRequestDuration.WithLabelValues(s.clientInfo.name, response).Observe(reqDuration.Seconds())
+	s.metrics.sendDuplicatesTotal.WithLabelValues(s.clientInfo.name).Add(float64(duplicates))
+
+	if err != nil {
+		logger.Error(
+			"Failed to publish billing events",
+			zap.Int("count", len(events)),
+			zap.Duration("after", reqDuration),
+			zap.String("url", n.client.URL),
+			zap.Int("total", total),
+			zap.Duration("totalTime", s.clock.Since(startTime)),
+			zap.Error(err),
+		)
+		s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErrorClass(err)).Inc()
+		return err
+	}
+
+	logger.Debug(
+		"Successfully published some billing events",
+		zap.Int("count", len(events)),
+		zap.Int("duplicates", duplicates),
+		zap.Duration("after", reqDuration),
+		zap.String("url", n.client.URL),
+		zap.Int("total", total+len(events)),
+		zap.Duration("totalTime", s.clock.Since(startTime)),
+	)
+	return nil
+}
+
+// updated keeps the current sink, so that the existing connection continues to be used
+func (n natsSink) updated(sink) sink {
+	return n
+}
+
+func (n natsSink) close(*zap.Logger) {
+	n.client.Close()
+}
+
+func (n natsSink) logField() zap.Field {
+	return zap.String("url", n.client.URL)
+}
@@ -16,6 +16,61 @@ type PromMetrics struct {
 	queueSizeCurrent  *prometheus.GaugeVec
 	lastSendDuration  *prometheus.GaugeVec
 	sendErrorsTotal   *prometheus.CounterVec
+
+	sendRequestsTotal   *prometheus.CounterVec
+	sendRequestDuration *prometheus.HistogramVec
+	sendBatchSize       *prometheus.HistogramVec
+	sendPayloadBytes    *prometheus.HistogramVec
+	sendRateLimitWait   *prometheus.HistogramVec
+	sendDuplicatesTotal *prometheus.CounterVec
+
+	sendAcknowledgedTotal *prometheus.CounterVec
+	sendRetriesTotal      *prometheus.CounterVec
+
+	sendSplitsTotal        *prometheus.CounterVec
+	sendDroppedEventsTotal *prometheus.CounterVec
+	sendAuthFailuresTotal  *prometheus.CounterVec
+	sendRejectionsTotal    *prometheus.CounterVec
+
+	circuitBreakerOpen       *prometheus.GaugeVec
+	circuitBreakerSkipsTotal *prometheus.CounterVec
+
+	anomaliesTotal     *prometheus.CounterVec
+	collectErrorsTotal *prometheus.CounterVec
+
+	networkUsageRequestDuration  *prometheus.HistogramVec
+	networkUsageUnavailableTotal prometheus.Counter
+	networkUsageResetsTotal      prometheus.Counter
+
+	storeOutageSeconds prometheus.Gauge
+	fallbackListsTotal *prometheus.CounterVec
+
+	deletionsFinalizedTotal  prometheus.Counter
+	migrationsFinalizedTotal prometheus.Counter
+
+	startupBackfillSecondsTotal prometheus.Counter
+
+	queueOverflowEventsTotal   *prometheus.CounterVec
+	queueDroppedEventsTotal    *prometheus.CounterVec
+	accumulationsBlockedTotal  prometheus.Counter
+	spillQuarantinedFilesTotal *prometheus.CounterVec
+
+	allocatedCPUSecondsTotal       prometheus.Counter
+	reconciliationMaxDrift         prometheus.Gauge
+	reconciliationDivergencesTotal prometheus.Counter
+
+	invariantViolationsTotal *prometheus.CounterVec
+
+	remoteWriteRequestsTotal *prometheus.CounterVec
+
+	estimatedCostPerHour *prometheus.GaugeVec
+
+	residencySecondsTotal *prometheus.CounterVec
+
+	enrichmentDroppedTotal *prometheus.CounterVec
+	vmsExcludedCurrent     *prometheus.GaugeVec
+
+	pushLag *pushLagCollector
 }
 
 func NewPromMetrics() PromMetrics {
@@ -55,6 +110,261 @@ func NewPromMetrics() PromMetrics {
 			},
 			[]string{"client", "cause"},
 		),
+		sendRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_requests_total",
+				Help: "Total requests made to send billing events, by the class of response",
+			},
+			[]string{"client", "response"},
+		),
+		sendRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_billing_send_request_duration_seconds",
+				Help:    "Duration, in seconds, of individual requests to send billing events",
+				Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+			},
+			[]string{"client", "response"},
+		),
+		sendBatchSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_billing_send_batch_size",
+				Help:    "Number of billing events included in each request",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 8), // 1 to 16384
+			},
+			[]string{"client"},
+		),
+		sendPayloadBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_billing_send_payload_bytes",
+				Help:    "Size, in bytes, of the body of each request to send billing events",
+				Buckets: prometheus.ExponentialBuckets(256, 4, 8), // 256B to 4MiB
+			},
+			[]string{"client"},
+		),
+		sendRateLimitWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_billing_send_rate_limit_wait_seconds",
+				Help:    "Time that billing push requests were delayed by the client-side rate limit",
+				Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60},
+			},
+			[]string{"client"},
+		),
+		sendDuplicatesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_duplicates_total",
+				Help: "Total number of sent billing events that the destination reported as duplicates of ones it already had",
+			},
+			[]string{"client"},
+		),
+		sendAcknowledgedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_acknowledged_total",
+				Help: "Total number of pushed batches of billing events that the collector acknowledged with an ID",
+			},
+			[]string{"client"},
+		),
+		sendRetriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_retries_total",
+				Help: "Total number of times that sending a batch of billing events was retried after an error",
+			},
+			[]string{"client"},
+		),
+		sendSplitsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_splits_total",
+				Help: "Total number of times that a batch of billing events was split in half after the collector rejected it",
+			},
+			[]string{"client"},
+		),
+		sendDroppedEventsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_dropped_events_total",
+				Help: "Total billing events dropped because the collector would never accept them, by the reason",
+			},
+			[]string{"client", "reason"},
+		),
+		sendAuthFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_auth_failures_total",
+				Help: "Total pushes of billing events that failed because the collector rejected our credentials",
+			},
+			[]string{"client"},
+		),
+		sendRejectionsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_send_rejections_total",
+				Help: "Total pushes of billing events that the collector rejected for a reason other than the events themselves, which are kept",
+			},
+			[]string{"client"},
+		),
+		circuitBreakerOpen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_circuit_breaker_open",
+				Help: "Whether the billing client's circuit breaker is currently open (1) or closed (0)",
+			},
+			[]string{"client"},
+		),
+		circuitBreakerSkipsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_circuit_breaker_skips_total",
+				Help: "Total number of pushes of billing events skipped because the client's circuit breaker was open",
+			},
+			[]string{"client"},
+		),
+		anomaliesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_anomalous_events_total",
+				Help: "Total billing events flagged as implausible jumps compared to the endpoint's recent usage",
+			},
+			[]string{"metric"},
+		),
+		collectErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_collect_errors_total",
+				Help: "Total non-fatal errors while collecting billing metrics, by kind",
+			},
+			[]string{"kind"},
+		),
+		networkUsageRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_billing_network_usage_request_duration_seconds",
+				Help:    "Duration, in seconds, of individual requests for VMs' network usage, by outcome (success, timeout, or failure)",
+				Buckets: prometheus.ExponentialBuckets(0.005, 2, 12), // 5ms to ~10s
+			},
+			[]string{"outcome"},
+		),
+		networkUsageUnavailableTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_network_usage_unavailable_total",
+				Help: "Total times that a VM's network usage was unavailable during collection, deferring its egress to a later collection",
+			},
+		),
+		networkUsageResetsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_network_usage_resets_total",
+				Help: "Total times that a VM's network usage counters were found to have been reset, e.g. because its runner restarted",
+			},
+		),
+		storeOutageSeconds: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_vm_store_outage_seconds",
+				Help: "Duration, in seconds, that the VM store has been continuously failing, as seen by billing collection (zero if it isn't failing)",
+			},
+		),
+		fallbackListsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_fallback_vm_lists_total",
+				Help: "Total direct lists of VMs made by billing collection while the VM store was failing, by outcome",
+			},
+			[]string{"outcome"},
+		),
+		deletionsFinalizedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_vm_deletions_finalized_total",
+				Help: "Total VM deletions for which billing usage was finalized immediately, rather than with the next batch",
+			},
+		),
+		migrationsFinalizedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_vm_migrations_finalized_total",
+				Help: "Total VMs migrated away from this node for which billing usage was finalized up to the time of the migration",
+			},
+		),
+		startupBackfillSecondsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_startup_backfill_seconds_total",
+				Help: "Total active time backfilled on startup for VMs that were already running, in seconds",
+			},
+		),
+		queueOverflowEventsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_queue_overflow_events_total",
+				Help: "Total billing events evicted from a full client queue, by the overflow policy and whether it succeeded",
+			},
+			[]string{"client", "policy", "outcome"},
+		),
+		queueDroppedEventsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_queue_dropped_events_total",
+				Help: "Total billing events dropped because of a client's queue limit, by the reason they couldn't be kept",
+			},
+			[]string{"client", "reason"},
+		),
+		accumulationsBlockedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_accumulations_blocked_total",
+				Help: "Total times that creating a billing batch was delayed because a client queue was full",
+			},
+		),
+		spillQuarantinedFilesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_spill_quarantined_files_total",
+				Help: "Total files of spilled billing events that were moved aside because they couldn't be sent",
+			},
+			[]string{"client"},
+		),
+		allocatedCPUSecondsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_allocated_cpu_seconds_total",
+				Help: "Total CPU-seconds allocated to endpoints on this node, as collected for billing reconciliation",
+			},
+		),
+		reconciliationMaxDrift: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_reconciliation_max_drift_ratio",
+				Help: "Largest relative difference between any endpoint's emitted CPU usage and its collected allocation, over the most recent reconciliation windows",
+			},
+		),
+		reconciliationDivergencesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_reconciliation_divergences_total",
+				Help: "Total times that an endpoint's emitted CPU usage diverged from its collected allocation by more than the tolerance",
+			},
+		),
+		invariantViolationsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_invariant_violations_total",
+				Help: "Total times that the CPU usage accumulated for an endpoint broke an invariant, by invariant",
+			},
+			[]string{"invariant"},
+		),
+		remoteWriteRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_remote_write_requests_total",
+				Help: "Total requests to push usage summaries to the Prometheus remote-write endpoint, by outcome",
+			},
+			[]string{"outcome"},
+		),
+		estimatedCostPerHour: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_estimated_cost_per_hour",
+				Help: "Estimated cost per hour of each endpoint's usage in the most recent billing batch, at the configured prices",
+			},
+			[]string{"endpoint_id"},
+		),
+		residencySecondsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_compute_unit_residency_seconds_total",
+				Help: "Total time that VMs on this node have spent with a size in each bucket of compute units, by the bucket's upper bound",
+			},
+			[]string{"compute_units_le"},
+		),
+		enrichmentDroppedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_enrichment_dropped_events_total",
+				Help: "Total billing events dropped by enrichment instead of being sent, by the config field or hook that dropped them",
+			},
+			[]string{"source"},
+		),
+		vmsExcludedCurrent: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_vms_excluded",
+				Help: "Number of endpoint VMs excluded from billing by the endpoint filter in the latest collection, by the part of the filter that excluded them",
+			},
+			[]string{"reason"},
+		),
+		pushLag: newPushLagCollector(),
 	}
 }
 
@@ -64,6 +374,44 @@ func (m PromMetrics) MustRegister(reg *prometheus.Registry) {
 	reg.MustRegister(m.queueSizeCurrent)
 	reg.MustRegister(m.lastSendDuration)
 	reg.MustRegister(m.sendErrorsTotal)
+	reg.MustRegister(m.sendRequestsTotal)
+	reg.MustRegister(m.sendRequestDuration)
+	reg.MustRegister(m.sendBatchSize)
+	reg.MustRegister(m.sendPayloadBytes)
+	reg.MustRegister(m.sendRateLimitWait)
+	reg.MustRegister(m.sendDuplicatesTotal)
+	reg.MustRegister(m.sendAcknowledgedTotal)
+	reg.MustRegister(m.sendRetriesTotal)
+	reg.MustRegister(m.sendSplitsTotal)
+	reg.MustRegister(m.sendDroppedEventsTotal)
+	reg.MustRegister(m.sendAuthFailuresTotal)
+	reg.MustRegister(m.sendRejectionsTotal)
+	reg.MustRegister(m.circuitBreakerOpen)
+	reg.MustRegister(m.circuitBreakerSkipsTotal)
+	reg.MustRegister(m.anomaliesTotal)
+	reg.MustRegister(m.collectErrorsTotal)
+	reg.MustRegister(m.networkUsageRequestDuration)
+	reg.MustRegister(m.networkUsageUnavailableTotal)
+	reg.MustRegister(m.networkUsageResetsTotal)
+	reg.MustRegister(m.storeOutageSeconds)
+	reg.MustRegister(m.fallbackListsTotal)
+	reg.MustRegister(m.deletionsFinalizedTotal)
+	reg.MustRegister(m.migrationsFinalizedTotal)
+	reg.MustRegister(m.startupBackfillSecondsTotal)
+	reg.MustRegister(m.queueOverflowEventsTotal)
+	reg.MustRegister(m.queueDroppedEventsTotal)
+	reg.MustRegister(m.accumulationsBlockedTotal)
+	reg.MustRegister(m.spillQuarantinedFilesTotal)
+	reg.MustRegister(m.allocatedCPUSecondsTotal)
+	reg.MustRegister(m.reconciliationMaxDrift)
+	reg.MustRegister(m.reconciliationDivergencesTotal)
+	reg.MustRegister(m.invariantViolationsTotal)
+	reg.MustRegister(m.remoteWriteRequestsTotal)
+	reg.MustRegister(m.estimatedCostPerHour)
+	reg.MustRegister(m.residencySecondsTotal)
+	reg.MustRegister(m.enrichmentDroppedTotal)
+	reg.MustRegister(m.vmsExcludedCurrent)
+	reg.MustRegister(m.pushLag)
 }
 
 type batchMetrics struct {
@@ -0,0 +1,125 @@
+package billing
+
+// Metrics for how far behind each client is with pushing events, so that a client that's stopped
+// making progress can be alerted on before its queue overflows.
+//
+// The values are calculated when the metrics are scraped, rather than set by the sender, so that
+// they keep increasing even if the sender is stuck (e.g. retrying a push that never succeeds).
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// pushLagCollector is a prometheus.Collector for the lag of every client
+type pushLagCollector struct {
+	mu      sync.Mutex
+	clients map[string]*clientPushLag
+
+	lastPushAge     *prometheus.Desc
+	oldestUnsentAge *prometheus.Desc
+}
+
+// clientPushLag tracks the lag of a single client
+type clientPushLag struct {
+	mu sync.Mutex
+	// lastSuccess is the last time that the client was caught up: when a push succeeded, or there
+	// was nothing to push
+	lastSuccess time.Time
+
+	queue eventQueuePuller[billing.AnyEvent]
+	spill *spillStore // nil if events aren't spilled to disk
+	clock util.Clock
+}
+
+func newPushLagCollector() *pushLagCollector {
+	return &pushLagCollector{
+		mu:      sync.Mutex{},
+		clients: make(map[string]*clientPushLag),
+		lastPushAge: prometheus.NewDesc(
+			"autoscaling_agent_billing_last_successful_push_age_seconds",
+			"Time, in seconds, since the billing client last pushed events successfully (or had nothing to push)",
+			[]string{"client"},
+			nil,
+		),
+		oldestUnsentAge: prometheus.NewDesc(
+			"autoscaling_agent_billing_oldest_unsent_event_age_seconds",
+			"Time, in seconds, since the oldest event that the billing client hasn't sent yet was queued (or spilled to disk), or zero if there are none",
+			[]string{"client"},
+			nil,
+		),
+	}
+}
+
+// addClient starts reporting the lag of the client with the given queue, returning the tracker for
+// its sender to record successful pushes with
+func (c *pushLagCollector) addClient(
+	name string,
+	queue eventQueuePuller[billing.AnyEvent],
+	spill *spillStore,
+	clock util.Clock,
+) *clientPushLag {
+	lag := &clientPushLag{
+		mu:          sync.Mutex{},
+		lastSuccess: clock.Now(),
+		queue:       queue,
+		spill:       spill,
+		clock:       clock,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clients[name] = lag
+	return lag
+}
+
+// recordSuccess records that the client is caught up, as of now
+func (l *clientPushLag) recordSuccess(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSuccess = now
+}
+
+// oldestUnsent returns when the oldest unsent event was queued, or false if there are none
+//
+// Spilled events are older than everything in the queue, so if there are any, the time that the
+// first of them was spilled is used instead.
+func (l *clientPushLag) oldestUnsent() (time.Time, bool) {
+	if l.spill != nil {
+		// If the spill directory can't be read, the sender will report it; fall back to the queue.
+		if payloads, _, err := l.spill.list(); err == nil && len(payloads) != 0 {
+			return payloads[0].written, true
+		}
+	}
+	return l.queue.oldest()
+}
+
+func (c *pushLagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastPushAge
+	ch <- c.oldestUnsentAge
+}
+
+func (c *pushLagCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, lag := range c.clients {
+		now := lag.clock.Now()
+		lag.mu.Lock()
+		lastSuccess := lag.lastSuccess
+		lag.mu.Unlock()
+
+		var oldestAge time.Duration
+		if oldest, ok := lag.oldestUnsent(); ok {
+			oldestAge = now.Sub(oldest)
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.lastPushAge, prometheus.GaugeValue, now.Sub(lastSuccess).Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(c.oldestUnsentAge, prometheus.GaugeValue, oldestAge.Seconds(), name)
+	}
+}
@@ -0,0 +1,59 @@
+package billing
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestPushLagCollector(t *testing.T) {
+	clock := util.NewFakeClock(time.Now())
+
+	c := newPushLagCollector()
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[billing.AnyEvent](gauge, 0, nil, nil, nil, clock)
+	lag := c.addClient("http", puller, nil, clock)
+
+	expect := func(lastPushAge, oldestUnsentAge string) {
+		t.Helper()
+		expected := `
+# HELP autoscaling_agent_billing_last_successful_push_age_seconds Time, in seconds, since the billing client last pushed events successfully (or had nothing to push)
+# TYPE autoscaling_agent_billing_last_successful_push_age_seconds gauge
+autoscaling_agent_billing_last_successful_push_age_seconds{client="http"} ` + lastPushAge + `
+# HELP autoscaling_agent_billing_oldest_unsent_event_age_seconds Time, in seconds, since the oldest event that the billing client hasn't sent yet was queued (or spilled to disk), or zero if there are none
+# TYPE autoscaling_agent_billing_oldest_unsent_event_age_seconds gauge
+autoscaling_agent_billing_oldest_unsent_event_age_seconds{client="http"} ` + oldestUnsentAge + `
+`
+		assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	}
+
+	clock.Advance(30 * time.Second)
+	expect("30", "0")
+
+	pusher.enqueue(&billing.IncrementalEvent{}) //nolint:exhaustruct // only the enqueue time matters
+	lag.recordSuccess(clock.Now())
+	clock.Advance(90 * time.Second)
+	expect("90", "90")
+
+	puller.drop(1)
+	lag.recordSuccess(clock.Now())
+	expect("0", "0")
+
+	// Spilled events are timed by the same clock as the queue, so the lag doesn't depend on the
+	// wall clock.
+	spill, err := newSpillStore(t.TempDir(), "http", clock)
+	require.NoError(t, err)
+	lag.spill = spill
+	require.NoError(t, spill.write([][]billing.AnyEvent{{&billing.IncrementalEvent{}}}, 0)) //nolint:exhaustruct // only the spill time matters
+	clock.Advance(45 * time.Second)
+	expect("45", "45")
+}
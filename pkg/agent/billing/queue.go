@@ -8,6 +8,7 @@ package billing
 
 import (
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/slices"
@@ -15,11 +16,69 @@ import (
 	"github.com/neondatabase/autoscaling/pkg/util"
 )
 
+// QueueConfig limits the size of a client's queue of events that haven't been sent yet, so that
+// memory usage doesn't grow without bound while the client's endpoint is unreachable.
+//
+// Changes to the queue config require a restart.
+type QueueConfig struct {
+	// MaxSize is the maximum number of events in the client's queue
+	MaxSize uint `json:"maxSize"`
+	// OverflowPolicy gives what happens when the queue is full
+	OverflowPolicy QueueOverflowPolicy `json:"overflowPolicy"`
+	// SpillDirectory is the directory that events are written to with the "spillToDisk" policy. A
+	// subdirectory is used for each client.
+	SpillDirectory string `json:"spillDirectory,omitempty"`
+}
+
+type QueueOverflowPolicy string
+
+const (
+	// QueueBlockAccumulation makes new events wait until there's room in the queue. Usage keeps
+	// being collected in the meantime -- including the final usage of deleted VMs -- and is sent
+	// once the queue has room. Heartbeats, which are regenerated each time, are dropped while the
+	// queue is full.
+	//
+	// If the client has a circuit breaker, the oldest events are dropped instead while it's open.
+	QueueBlockAccumulation QueueOverflowPolicy = "blockAccumulation"
+	// QueueDropOldest drops the oldest events in the queue to make room for new ones
+	QueueDropOldest QueueOverflowPolicy = "dropOldest"
+	// QueueSpillToDisk moves the oldest events in the queue to disk, to be sent before the rest of
+	// the queue
+	QueueSpillToDisk QueueOverflowPolicy = "spillToDisk"
+)
+
+// Valid returns whether p is one of the known overflow policies
+func (p QueueOverflowPolicy) Valid() bool {
+	switch p {
+	case QueueBlockAccumulation, QueueDropOldest, QueueSpillToDisk:
+		return true
+	default:
+		return false
+	}
+}
+
 // this is generic just so there's less typing - "billing.IncrementalEvent" is long!
 type eventQueueInternals[E any] struct {
-	mu        sync.Mutex
-	items     []E
+	mu    sync.Mutex
+	items []E
+	// enqueuedAt gives the time that each item in items was enqueued, for the age of the oldest one
+	enqueuedAt []time.Time
+	// inFlight is the number of items at the front of the queue that were returned by get() and
+	// haven't been dropped yet. They can't be evicted, because the puller may still be using them.
+	inFlight int
+	// maxSize, if non-zero, is the size that the queue is limited to. If onOverflow is not nil, the
+	// oldest items are evicted and passed to it, to bring the queue back down to maxSize.
+	maxSize    int
+	onOverflow func(evicted []E)
+	// evictIf, if not nil, is checked before evicting items. While it returns false, the queue
+	// doesn't evict, and new items wait for room in the same way as if onOverflow were nil.
+	evictIf func() bool
+	// onReject, if not nil, enforces maxSize while the queue isn't evicting: items enqueued while
+	// the queue is full are passed to it instead of being added. Items enqueued while there's room
+	// are always added, so a single enqueue can still take the queue past maxSize.
+	onReject  func(rejected []E)
 	sizeGauge prometheus.Gauge
+	clock     util.Clock
 }
 
 type eventQueuePuller[E any] struct {
@@ -30,11 +89,28 @@ type eventQueuePusher[E any] struct {
 	internals *eventQueueInternals[E]
 }
 
-func newEventQueue[E any](sizeGauge prometheus.Gauge) (eventQueuePusher[E], eventQueuePuller[E]) {
+// newEventQueue creates a new queue, optionally limited to maxSize items. If onOverflow is nil,
+// or evictIf is not nil and returns false, the limit is only used by full() and, if onReject is not
+// nil, to reject new items while the queue is full.
+func newEventQueue[E any](
+	sizeGauge prometheus.Gauge,
+	maxSize int,
+	onOverflow func(evicted []E),
+	evictIf func() bool,
+	onReject func(rejected []E),
+	clock util.Clock,
+) (eventQueuePusher[E], eventQueuePuller[E]) {
 	internals := &eventQueueInternals[E]{
-		mu:        sync.Mutex{},
-		items:     nil,
-		sizeGauge: sizeGauge,
+		mu:         sync.Mutex{},
+		items:      nil,
+		enqueuedAt: nil,
+		inFlight:   0,
+		maxSize:    maxSize,
+		onOverflow: onOverflow,
+		evictIf:    evictIf,
+		onReject:   onReject,
+		sizeGauge:  sizeGauge,
+		clock:      clock,
 	}
 	return eventQueuePusher[E]{internals}, eventQueuePuller[E]{internals}
 }
@@ -45,11 +121,92 @@ func (qi *eventQueueInternals[E]) updateGauge() {
 }
 
 func (q eventQueuePusher[E]) enqueue(events ...E) {
+	var rejected []E
+	evicted := func() []E {
+		q.internals.mu.Lock()
+		defer q.internals.mu.Unlock()
+
+		// The limit applies to every item that's enqueued, whatever its kind, so that nothing can
+		// grow the queue without bound while it isn't evicting.
+		if q.internals.isBlocked() {
+			rejected = events
+			return nil
+		}
+
+		q.internals.items = append(q.internals.items, events...)
+		now := q.internals.clock.Now()
+		for range events {
+			q.internals.enqueuedAt = append(q.internals.enqueuedAt, now)
+		}
+		defer q.internals.updateGauge()
+
+		// Items in flight can't be evicted, so they don't count towards the limit. This may leave
+		// the queue above maxSize until they're dropped, but that's bounded by the puller's batch
+		// size.
+		excess := len(q.internals.items) - q.internals.inFlight - q.internals.maxSize
+		if q.internals.maxSize == 0 || !q.internals.evicts() || excess <= 0 {
+			return nil
+		}
+		// Evict the oldest items that aren't in flight.
+		start := q.internals.inFlight
+		end := start + excess
+		evicted := slices.Clone(q.internals.items[start:end])
+		q.internals.items = slices.Delete(q.internals.items, start, end)
+		q.internals.enqueuedAt = slices.Delete(q.internals.enqueuedAt, start, end)
+		return evicted
+	}()
+
+	if len(evicted) != 0 {
+		q.internals.onOverflow(evicted)
+	}
+	if len(rejected) != 0 {
+		q.internals.onReject(rejected)
+	}
+}
+
+// NB: must hold mu
+func (qi *eventQueueInternals[E]) evicts() bool {
+	return qi.onOverflow != nil && (qi.evictIf == nil || qi.evictIf())
+}
+
+// full returns whether the queue is limited in size, and has reached the limit
+func (q eventQueuePusher[E]) full() bool {
 	q.internals.mu.Lock()
 	defer q.internals.mu.Unlock()
 
-	q.internals.items = append(q.internals.items, events...)
-	q.internals.updateGauge()
+	return q.internals.isFull()
+}
+
+// blocked returns whether the queue is full and rejecting new items, because it isn't evicting.
+// Callers that can wait for room, like accumulation, should check this before enqueueing.
+func (q eventQueuePusher[E]) blocked() bool {
+	q.internals.mu.Lock()
+	defer q.internals.mu.Unlock()
+
+	return q.internals.isBlocked()
+}
+
+// anyBlocked returns whether any of the queues is blocked, in which case events that can't be
+// regenerated should be held until there's room in all of them.
+func anyBlocked[E any](queues []eventQueuePusher[E]) bool {
+	return slices.ContainsFunc(queues, eventQueuePusher[E].blocked)
+}
+
+// NB: must hold mu
+func (qi *eventQueueInternals[E]) isBlocked() bool {
+	return qi.onReject != nil && qi.isFull() && !qi.evicts()
+}
+
+// NB: must hold mu
+func (qi *eventQueueInternals[E]) isFull() bool {
+	return qi.maxSize != 0 && len(qi.items)-qi.inFlight >= qi.maxSize
+}
+
+func (q eventQueuePusher[E]) size() int {
+	q.internals.mu.Lock()
+	defer q.internals.mu.Unlock()
+
+	return len(q.internals.items)
 }
 
 func (q eventQueuePuller[E]) size() int {
@@ -59,14 +216,26 @@ func (q eventQueuePuller[E]) size() int {
 	return len(q.internals.items)
 }
 
+// oldest returns when the oldest item in the queue was enqueued, or false if the queue is empty
+func (q eventQueuePuller[E]) oldest() (time.Time, bool) {
+	q.internals.mu.Lock()
+	defer q.internals.mu.Unlock()
+
+	if len(q.internals.enqueuedAt) == 0 {
+		return time.Time{}, false
+	}
+	return q.internals.enqueuedAt[0], true
+}
+
 func (q eventQueuePuller[E]) get(limit int) []E {
 	q.internals.mu.Lock()
 	defer q.internals.mu.Unlock()
 
 	count := util.Min(limit, len(q.internals.items))
+	q.internals.inFlight = count
 	// NOTE: this kind of access escaping the mutex is only sound because this access is only
 	// granted to the puller, and there's only one puller, and it isn't sound to use the output of a
-	// previous get() after calling drop().
+	// previous get() after calling drop(). The pusher never evicts items that are in flight.
 	return q.internals.items[:count]
 }
 
@@ -75,5 +244,7 @@ func (q eventQueuePuller[E]) drop(count int) {
 	defer q.internals.mu.Unlock()
 
 	q.internals.items = slices.Replace(q.internals.items, 0, count)
+	q.internals.enqueuedAt = slices.Replace(q.internals.enqueuedAt, 0, count)
+	q.internals.inFlight = 0
 	q.internals.updateGauge()
 }
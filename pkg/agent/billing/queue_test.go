@@ -0,0 +1,271 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestEventQueueOverflow(t *testing.T) {
+	var evicted []int
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[int](gauge, 3, func(e []int) { evicted = append(evicted, e...) }, nil, nil, util.RealClock)
+
+	pusher.enqueue(1, 2, 3)
+	assert.True(t, pusher.full())
+	assert.Empty(t, evicted)
+
+	// The oldest events are evicted to make room
+	pusher.enqueue(4)
+	assert.Equal(t, []int{1}, evicted)
+	assert.Equal(t, []int{2, 3, 4}, puller.get(3))
+
+	// ... but not the ones that are being sent, which don't count towards the limit
+	evicted = nil
+	pusher.enqueue(5, 6, 7)
+	assert.Empty(t, evicted)
+	pusher.enqueue(8)
+	assert.Equal(t, []int{5}, evicted)
+	assert.Equal(t, 6, pusher.size())
+
+	puller.drop(3)
+	assert.Equal(t, []int{6, 7, 8}, puller.get(5))
+}
+
+func TestEventQueueBlocking(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[int](gauge, 2, nil, nil, nil, util.RealClock)
+
+	// Without an overflow handler, the queue can grow past its limit; it's only reported as full.
+	pusher.enqueue(1, 2, 3)
+	assert.True(t, pusher.full())
+	assert.Equal(t, 3, pusher.size())
+
+	puller.drop(2)
+	assert.False(t, pusher.full())
+}
+
+func TestEventQueueEvictIf(t *testing.T) {
+	var evicted []int
+	evict := false
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, _ := newEventQueue[int](gauge, 2, func(e []int) { evicted = append(evicted, e...) }, func() bool { return evict }, nil, util.RealClock)
+
+	// While evictIf returns false, the queue grows past its limit, like a blocking queue
+	pusher.enqueue(1, 2, 3)
+	assert.Empty(t, evicted)
+	assert.Equal(t, 3, pusher.size())
+
+	evict = true
+	pusher.enqueue(4)
+	assert.Equal(t, []int{1, 2}, evicted)
+	assert.Equal(t, 2, pusher.size())
+}
+
+func TestEventQueueReject(t *testing.T) {
+	var evicted, rejected []int
+	evict := false
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+	pusher, puller := newEventQueue[int](
+		gauge,
+		2,
+		func(e []int) { evicted = append(evicted, e...) },
+		func() bool { return evict },
+		func(e []int) { rejected = append(rejected, e...) },
+		util.RealClock,
+	)
+
+	// Items are added while there's room, even if that takes the queue past its limit ...
+	pusher.enqueue(1)
+	pusher.enqueue(2, 3)
+	assert.Equal(t, 3, pusher.size())
+	assert.Empty(t, rejected)
+
+	// ... but once it's full, new items are rejected instead of added.
+	pusher.enqueue(4, 5)
+	assert.Equal(t, []int{4, 5}, rejected)
+	assert.Equal(t, 3, pusher.size())
+
+	// Items in flight don't count towards the limit
+	assert.Equal(t, []int{1, 2}, puller.get(2))
+	pusher.enqueue(6)
+	assert.Equal(t, []int{4, 5}, rejected)
+	puller.drop(2)
+	assert.Equal(t, []int{3, 6}, puller.get(5))
+
+	// While evicting, the oldest items are evicted instead of rejecting new ones
+	puller.drop(0)
+	evict = true
+	pusher.enqueue(7)
+	assert.Equal(t, []int{3}, evicted)
+	assert.Equal(t, []int{4, 5}, rejected)
+}
+
+func TestQueueOverflowBlockAccumulation(t *testing.T) {
+	metrics := NewPromMetrics()
+	clock := util.NewFakeClock(time.Now())
+	breakerGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_circuit_breaker_open", Help: ""})
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 10}, breakerGauge)
+
+	var client clientInfo
+	client.name = "test"
+	client.config.Queue = &QueueConfig{MaxSize: 2, OverflowPolicy: QueueBlockAccumulation, SpillDirectory: ""}
+	maxSize, onOverflow, evictIf, onReject, spill := makeQueueOverflow(zap.NewNop(), client, breaker, metrics, clock)
+	assert.Nil(t, spill)
+	pusher, _ := newEventQueue[billing.AnyEvent](newTestQueueGauge(), maxSize, onOverflow, evictIf, onReject, clock)
+
+	droppedEvents := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.queueDroppedEventsTotal.WithLabelValues("test", reason))
+	}
+
+	// Events that arrive while the queue is full are dropped, and counted
+	pusher.enqueue(queueTestEvents(2)...)
+	pusher.enqueue(queueTestEvents(3)...)
+	assert.Equal(t, 2, pusher.size())
+	assert.Equal(t, 3.0, droppedEvents(queueDroppedBlocked))
+
+	// ... and while the circuit breaker is open, the oldest events are dropped instead.
+	breaker.recordResult(clock.Now(), errors.New("push failed"))
+	pusher.enqueue(queueTestEvents(1)...)
+	assert.Equal(t, 2, pusher.size())
+	assert.Equal(t, 1.0, droppedEvents(queueDroppedCircuitOpen))
+	assert.Equal(t, 3.0, droppedEvents(queueDroppedBlocked))
+}
+
+func newTestQueueGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_size", Help: ""})
+}
+
+func queueTestEvents(count int) []billing.AnyEvent {
+	var events []billing.AnyEvent
+	for i := 0; i < count; i++ {
+		events = append(events, new(billing.IncrementalEvent))
+	}
+	return events
+}
+
+func TestQueueLimitMixedEvents(t *testing.T) {
+	metrics := NewPromMetrics()
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(start)
+
+	var conf Config
+	conf.CPUMetricName = "cpu"
+	conf.ActiveTimeMetricName = "active"
+	conf.AccumulateEverySeconds = 60
+	heartbeats := &HeartbeatConfig{MetricName: "heartbeat", EverySeconds: 60}
+	residencyConf := &ResidencyConfig{
+		MinComputeUnits: 0.25,
+		Factor:          2,
+		Buckets:         1,
+		Events:          &ResidencyEventsConfig{MetricNamePrefix: "residency", EverySeconds: 60},
+	}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.sequence = billing.NewSequence()
+	s.summary = newLogSummary(util.RealClock)
+	s.roundingRemainders = make(map[roundingKey]float64)
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	s.metricsLastSent = make(map[string]time.Time)
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	s.present = make(map[metricsKey]vmMetricsInstant)
+	s.departed = make(map[metricsKey]departedVM)
+	s.migratedIn = make(map[types.UID]time.Time)
+	s.identities = make(map[metricsKey]billing.Identity)
+	s.computeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+	s.residency = newResidencyTracker(residencyConf, metrics, start)
+	s.pushWindowStart = start
+	s.clock = clock
+
+	breakerGauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_circuit_breaker_open", Help: ""})
+	breaker := newCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 1, OpenSeconds: 10}, breakerGauge)
+	var client clientInfo
+	client.name = "test"
+	client.config.Queue = &QueueConfig{MaxSize: 5, OverflowPolicy: QueueBlockAccumulation, SpillDirectory: ""}
+	maxSize, onOverflow, evictIf, onReject, _ := makeQueueOverflow(logger, client, breaker, metrics, clock)
+	pusher, puller := newEventQueue[billing.AnyEvent](newTestQueueGauge(), maxSize, onOverflow, evictIf, onReject, clock)
+	queues := []eventQueuePusher[billing.AnyEvent]{pusher}
+
+	var vms []*vmapi.VirtualMachine
+	for _, uid := range []types.UID{"vm-a", "vm-b"} {
+		vm := new(vmapi.VirtualMachine)
+		vm.UID = uid
+		vm.Annotations = map[string]string{api.AnnotationBillingEndpointID: "ep-" + string(uid)}
+		vm.Status.Phase = vmapi.VmRunning
+		cpu := vmapi.MilliCPU(1000)
+		vm.Status.CPUs = &cpu
+		vms = append(vms, vm)
+	}
+	s.collectVMs(logger, start, vms, nil, nil, metrics)
+
+	blockedEvents := func() float64 {
+		return testutil.ToFloat64(metrics.queueDroppedEventsTotal.WithLabelValues("test", queueDroppedBlocked))
+	}
+	kinds := func() []string {
+		var names []string
+		for _, e := range puller.get(puller.size()) {
+			switch e := e.(type) {
+			case *billing.IncrementalEvent:
+				names = append(names, e.MetricName)
+			case *billing.AbsoluteEvent:
+				names = append(names, e.MetricName)
+			}
+		}
+		return names
+	}
+
+	// Usage, then heartbeats: the queue wasn't full before the heartbeats, so they're all added,
+	// taking the queue past the limit.
+	clock.Advance(time.Minute)
+	s.collectVMs(logger, clock.Now(), vms, nil, nil, metrics)
+	s.drainEnqueue(logger, &conf, "host", queues, clock.Now(), false)
+	assert.Equal(t, 4, pusher.size())
+	assert.False(t, pusher.blocked())
+	s.maybeEnqueueHeartbeats(logger, heartbeats, "host", queues)
+	assert.Equal(t, 6, pusher.size())
+	assert.True(t, pusher.blocked())
+
+	// Once the queue is full, every kind of event is held to the same limit: residency waits for
+	// room, and heartbeats are dropped, because they're regenerated next time.
+	s.maybeEnqueueResidencyEvents(logger, "host", queues)
+	assert.Equal(t, 0.0, blockedEvents())
+	clock.Advance(time.Minute)
+	s.maybeEnqueueHeartbeats(logger, heartbeats, "host", queues)
+	assert.Equal(t, 2.0, blockedEvents())
+	assert.Equal(t, 6, pusher.size())
+	assert.ElementsMatch(t, []string{"cpu", "cpu", "active", "active", "heartbeat", "heartbeat"}, kinds())
+
+	// After the queue is drained, events are accepted again, and the residency that was held back
+	// is included.
+	puller.drop(6)
+	assert.False(t, pusher.blocked())
+	clock.Advance(time.Minute)
+	s.collectVMs(logger, clock.Now(), vms, nil, nil, metrics)
+	s.maybeEnqueueResidencyEvents(logger, "host", queues)
+	residency := make(map[string]int)
+	for _, e := range puller.get(puller.size()) {
+		if e, ok := e.(*billing.AbsoluteEvent); ok {
+			residency[e.EndpointID+" "+e.MetricName] = e.Value
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"ep-vm-a residency_le_0.25": 0, "ep-vm-a residency_le_inf": 180,
+		"ep-vm-b residency_le_0.25": 0, "ep-vm-b residency_le_inf": 180,
+	}, residency)
+	assert.Equal(t, 2.0, blockedEvents())
+}
@@ -0,0 +1,82 @@
+package billing
+
+// Client-side rate limiting of pushes, so that when many agents recover from a collector outage at
+// the same time, they don't all push their backlog at once.
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type RateLimitConfig struct {
+	// RequestsPerSecond is the maximum sustained rate of push requests from each client. If zero,
+	// the rate isn't limited.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	// Burst is the maximum number of requests that may be made at once while staying under
+	// RequestsPerSecond. Defaults to 1.
+	Burst uint `json:"burst,omitempty"`
+	// MaxInFlight is the maximum number of concurrent push requests from each client. Requests are
+	// only made concurrently to different shards, so values above 1 have no effect unless Shards
+	// is set. Defaults to 1.
+	MaxInFlight uint `json:"maxInFlight,omitempty"`
+	// StartupJitterSeconds, if non-zero, delays the first push by a random duration of up to this
+	// many seconds, to spread out pushes from agents that were all started at the same time.
+	StartupJitterSeconds uint `json:"startupJitterSeconds,omitempty"`
+}
+
+// newPushLimiter returns the limiter for the request rate, or nil if it's not limited
+func newPushLimiter(c *RateLimitConfig) *rate.Limiter {
+	if c == nil || c.RequestsPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(c.RequestsPerSecond), int(max(c.Burst, 1)))
+}
+
+// sameRateLimit returns whether the two configs are equivalent, so the limiter can be kept
+func sameRateLimit(a, b *RateLimitConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// maxInFlight returns the maximum number of concurrent requests allowed by the config
+func maxInFlight(c *RateLimitConfig) int {
+	if c == nil {
+		return 1
+	}
+	return int(max(c.MaxInFlight, 1))
+}
+
+// startupJitter returns a random delay before the first push, or zero if there's no delay
+func startupJitter(c *RateLimitConfig) time.Duration {
+	if c == nil || c.StartupJitterSeconds == 0 {
+		return 0
+	}
+	return util.NewTimeRange(time.Millisecond, 0, int(c.StartupJitterSeconds)*1000).Random()
+}
+
+// waitForRateLimit blocks until the next push request is allowed by the rate limit
+func (s eventSender) waitForRateLimit(logger *zap.Logger) {
+	if s.limiter == nil {
+		return
+	}
+
+	// Reserve the request as of the sender's clock and wait on the clock, rather than using the
+	// limiter's own timing, so that the wait follows the clock. The burst is at least 1, so the
+	// reservation is always possible.
+	now := s.clock.Now()
+	waited := s.limiter.ReserveN(now, 1).DelayFrom(now)
+	if waited > 0 {
+		<-s.clock.After(waited)
+	}
+
+	s.metrics.sendRateLimitWait.WithLabelValues(s.clientInfo.name).Observe(waited.Seconds())
+	if waited >= time.Second {
+		logger.Info("Push was delayed by the rate limit", zap.Duration("delay", waited))
+	}
+}
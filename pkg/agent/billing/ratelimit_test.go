@@ -0,0 +1,88 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestPushShardsMaxInFlight(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxSeen, requests := 0, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight += 1
+		requests += 1
+		maxSeen = max(maxSeen, inFlight)
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		inFlight -= 1
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	const shards = 4
+	var clients []billing.Client
+	for i := 0; i < shards; i++ {
+		clients = append(clients, billing.NewClient(server.URL, server.Client()))
+	}
+	var events []billing.AnyEvent
+	for i := 0; i < 20; i++ {
+		e := new(billing.IncrementalEvent)
+		e.EndpointID = fmt.Sprintf("ep-%d", i)
+		events = append(events, e)
+	}
+
+	rateLimit := &RateLimitConfig{RequestsPerSecond: 0, Burst: 0, MaxInFlight: 2, StartupJitterSeconds: 0}
+	var config BaseClientConfig
+	config.PushRequestTimeoutSeconds = 5
+	config.RateLimit = rateLimit
+
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.clientInfo = clientInfo{sink: httpSink{clients: clients}, name: "test", config: config}
+	sender.metrics = NewPromMetrics()
+	sender.format = &pushFormat{mu: sync.Mutex{}, current: billing.FormatJSON}
+	sender.limiter = newPushLimiter(rateLimit)
+	sender.clock = util.RealClock
+
+	err := sender.pushShards(zap.NewNop(), clients, events, 0, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, shards, requests)
+	assert.Equal(t, 2, maxSeen)
+}
+
+func TestPushLimiter(t *testing.T) {
+	assert.Nil(t, newPushLimiter(nil))
+	assert.Nil(t, newPushLimiter(&RateLimitConfig{RequestsPerSecond: 0, Burst: 5, MaxInFlight: 0, StartupJitterSeconds: 0}))
+
+	limiter := newPushLimiter(&RateLimitConfig{RequestsPerSecond: 10, Burst: 0, MaxInFlight: 0, StartupJitterSeconds: 0})
+	assert.Equal(t, 1, limiter.Burst())
+	assert.True(t, limiter.Allow())
+	assert.False(t, limiter.Allow())
+
+	assert.Equal(t, 1, maxInFlight(nil))
+	assert.True(t, sameRateLimit(nil, nil))
+	assert.False(t, sameRateLimit(nil, &RateLimitConfig{RequestsPerSecond: 0, Burst: 0, MaxInFlight: 0, StartupJitterSeconds: 0}))
+
+	jitterConf := &RateLimitConfig{RequestsPerSecond: 0, Burst: 0, MaxInFlight: 0, StartupJitterSeconds: 2}
+	for i := 0; i < 100; i++ {
+		jitter := startupJitter(jitterConf)
+		assert.GreaterOrEqual(t, jitter, time.Duration(0))
+		assert.Less(t, jitter, 2*time.Second)
+	}
+	assert.Zero(t, startupJitter(nil))
+}
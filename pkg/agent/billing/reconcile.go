@@ -0,0 +1,145 @@
+package billing
+
+// Self-check that the usage sent in billing events matches the allocation that was collected, so
+// that bugs anywhere between collection and sending (windows, rounding, finalization, ...) are
+// caught automatically.
+//
+// The allocation is integrated separately at each collection, from the same time slices that make
+// up the events, and is also exported as a Prometheus counter. At the end of each batch, the sum of
+// the CPU events sent for each endpoint over the last few batches is compared with its integral
+// over the same batches.
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type ReconciliationConfig struct {
+	// Windows is the number of recent accumulation windows that the totals are compared over. Usage
+	// carried between windows (e.g. remainders from rounding) only makes a difference at the edges,
+	// so more windows make false positives less likely.
+	Windows uint `json:"windows"`
+	// Tolerance is the largest relative difference between the totals that's not reported, e.g.
+	// 0.01 for 1%.
+	Tolerance float64 `json:"tolerance"`
+}
+
+// reconciliationMinDiff is the smallest absolute difference, in CPU-seconds, that's reported, so
+// that rounding each event's value to an integer doesn't cause drift for endpoints with very little
+// usage.
+const reconciliationMinDiff = 2.0
+
+type reconciler struct {
+	conf    *ReconciliationConfig
+	metrics reconcilerMetrics
+
+	// current stores the totals for each endpoint in the window that's in progress
+	current map[string]*reconciledTotals
+	// windows stores the totals from the most recent finished windows, oldest first
+	windows []map[string]reconciledTotals
+}
+
+type reconcilerMetrics struct {
+	allocatedCPUSeconds prometheus.Counter
+	maxDrift            prometheus.Gauge
+	divergencesTotal    prometheus.Counter
+}
+
+type reconciledTotals struct {
+	// allocated is the CPU-seconds allocated to the endpoint, from collection
+	allocated float64
+	// emitted is the sum of the values of the CPU events sent for the endpoint
+	emitted float64
+}
+
+func newReconciler(conf *ReconciliationConfig, metrics PromMetrics) *reconciler {
+	return &reconciler{
+		conf: conf,
+		metrics: reconcilerMetrics{
+			allocatedCPUSeconds: metrics.allocatedCPUSecondsTotal,
+			maxDrift:            metrics.reconciliationMaxDrift,
+			divergencesTotal:    metrics.reconciliationDivergencesTotal,
+		},
+		current: make(map[string]*reconciledTotals),
+		windows: nil,
+	}
+}
+
+func (r *reconciler) totals(endpointID string) *reconciledTotals {
+	t, ok := r.current[endpointID]
+	if !ok {
+		t = &reconciledTotals{allocated: 0, emitted: 0}
+		r.current[endpointID] = t
+	}
+	return t
+}
+
+// recordAllocation adds the CPU allocated to the endpoint over the time slice. Allocation that's
+// later found not to belong to this node (e.g. after a migration) is removed with a negative value.
+func (r *reconciler) recordAllocation(endpointID string, cpuSeconds float64) {
+	r.totals(endpointID).allocated += cpuSeconds
+	r.metrics.allocatedCPUSeconds.Add(math.Max(cpuSeconds, 0))
+}
+
+// recordEmitted adds the value of a CPU event sent for the endpoint
+func (r *reconciler) recordEmitted(endpointID string, value int) {
+	r.totals(endpointID).emitted += float64(value)
+}
+
+// finishWindow ends the current window, and compares the totals over the most recent windows
+func (r *reconciler) finishWindow(logger *zap.Logger) {
+	finished := make(map[string]reconciledTotals, len(r.current))
+	for endpointID, t := range r.current {
+		finished[endpointID] = *t
+	}
+	r.current = make(map[string]*reconciledTotals)
+
+	r.windows = append(r.windows, finished)
+	if len(r.windows) > int(r.conf.Windows) {
+		r.windows = r.windows[len(r.windows)-int(r.conf.Windows):]
+	}
+	if len(r.windows) < int(r.conf.Windows) {
+		return // not enough history yet
+	}
+
+	sums := make(map[string]reconciledTotals)
+	for _, w := range r.windows {
+		for endpointID, t := range w {
+			sum := sums[endpointID]
+			sum.allocated += t.allocated
+			sum.emitted += t.emitted
+			sums[endpointID] = sum
+		}
+	}
+
+	maxDrift := 0.0
+	for endpointID, sum := range sums {
+		diff := math.Abs(sum.emitted - sum.allocated)
+		if diff < reconciliationMinDiff {
+			continue
+		}
+		drift := diff / math.Max(sum.allocated, reconciliationMinDiff)
+		maxDrift = math.Max(maxDrift, drift)
+		if drift > r.conf.Tolerance {
+			logger.Warn(
+				"Billing events diverge from collected allocation",
+				zap.String("endpointID", endpointID),
+				zap.Float64("allocatedCPUSeconds", sum.allocated),
+				zap.Float64("emittedCPUSeconds", sum.emitted),
+				zap.Float64("drift", drift),
+				zap.Int("windows", len(r.windows)),
+			)
+			r.metrics.divergencesTotal.Inc()
+		}
+	}
+	r.metrics.maxDrift.Set(maxDrift)
+}
+
+// reconcileSlice records the CPU allocated over the time slice, if reconciliation is enabled
+func (s *metricsState) reconcileSlice(endpointID string, slice metricsTimeSlice) {
+	if s.reconciler != nil {
+		s.reconciler.recordAllocation(endpointID, slice.metrics.cpu.AsFloat64()*slice.Duration().Seconds())
+	}
+}
@@ -0,0 +1,47 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestReconciler(t *testing.T) {
+	metrics := NewPromMetrics()
+	r := newReconciler(&ReconciliationConfig{Windows: 2, Tolerance: 0.05}, metrics)
+	logger := zap.NewNop()
+
+	// Rounding in one window is made up for in the next
+	r.recordAllocation("ep-a", 100.4)
+	r.recordEmitted("ep-a", 100)
+	r.recordAllocation("ep-b", 50)
+	r.recordEmitted("ep-b", 50)
+	r.finishWindow(logger)
+	// Not enough windows yet
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.reconciliationMaxDrift))
+
+	r.recordAllocation("ep-a", 99.6)
+	r.recordEmitted("ep-a", 100)
+	r.recordAllocation("ep-b", 50)
+	r.recordEmitted("ep-b", 60)
+	r.finishWindow(logger)
+
+	assert.InDelta(t, 0.1, testutil.ToFloat64(metrics.reconciliationMaxDrift), 1e-9)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.reconciliationDivergencesTotal))
+	assert.Equal(t, 300.0, testutil.ToFloat64(metrics.allocatedCPUSecondsTotal))
+
+	// Removed allocation isn't counted twice, and old windows are dropped
+	r.recordAllocation("ep-b", 60)
+	r.recordAllocation("ep-b", -10)
+	r.recordEmitted("ep-b", 50)
+	r.finishWindow(logger)
+	assert.InDelta(t, 0.1, testutil.ToFloat64(metrics.reconciliationMaxDrift), 1e-9)
+
+	r.recordAllocation("ep-b", 50)
+	r.recordEmitted("ep-b", 50)
+	r.finishWindow(logger)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.reconciliationMaxDrift))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.reconciliationDivergencesTotal))
+}
@@ -0,0 +1,243 @@
+package billing
+
+// Exporting coarse usage summaries to a Prometheus remote-write endpoint, for users who want usage
+// data in their own monitoring without consuming billing events.
+//
+// The usage in each batch is added to running totals for each endpoint, which are pushed as
+// counters once per accumulation. Because the samples are cumulative, a failed push loses nothing:
+// the next one includes the same usage. Only the latest set of samples is kept while a push is in
+// progress.
+//
+// The WriteRequest is encoded with our own copy of the parts of the protocol that we use, in
+// remotewritepb, so that we don't need to depend on Prometheus itself.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/billing/remotewritepb"
+)
+
+type RemoteWriteConfig struct {
+	// URL is the Prometheus remote-write endpoint that samples are pushed to
+	URL string `json:"url"`
+	// PushRequestTimeoutSeconds is the timeout for each push to URL
+	PushRequestTimeoutSeconds uint `json:"pushRequestTimeoutSeconds"`
+	// Labels, if not empty, are added to every series, e.g. to identify the cluster. They can't
+	// include the labels set by the autoscaler-agent; see RemoteWriteReservedLabels.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RemoteWriteReservedLabels are the labels set on each series pushed to the remote-write endpoint
+var RemoteWriteReservedLabels = []string{"__name__", "endpoint_id", "node"}
+
+// Names of the series pushed to the remote-write endpoint
+const (
+	remoteWriteCPUMetric            = "autoscaling_billing_cpu_seconds_total"
+	remoteWriteActiveTimeMetric     = "autoscaling_billing_active_seconds_total"
+	remoteWriteInternalEgressMetric = "autoscaling_billing_internal_egress_bytes_total"
+	remoteWriteInternetEgressMetric = "autoscaling_billing_internet_egress_bytes_total"
+)
+
+// remoteWriteStaleAfter is how long an endpoint's totals are kept without any new usage, before
+// they're no longer pushed
+const remoteWriteStaleAfter = time.Hour
+
+type remoteWriter struct {
+	conf    *RemoteWriteConfig
+	client  *http.Client
+	metrics PromMetrics
+	// totals stores the usage of each endpoint since the autoscaler-agent started, by endpoint ID
+	totals map[string]*remoteWriteTotals
+	// pending holds the latest payload that hasn't been pushed yet. It has a buffer size of one.
+	pending chan []byte
+}
+
+type remoteWriteTotals struct {
+	cpuSeconds          float64
+	activeSeconds       float64
+	internalEgressBytes uint64
+	internetEgressBytes uint64
+	lastUpdated         time.Time
+}
+
+// newRemoteWriter creates the remoteWriter and starts pushing in the background, until ctx is
+// canceled
+func newRemoteWriter(ctx context.Context, logger *zap.Logger, conf *RemoteWriteConfig, metrics PromMetrics) *remoteWriter {
+	w := &remoteWriter{
+		conf: conf,
+		client: &http.Client{
+			Timeout: time.Second * time.Duration(conf.PushRequestTimeoutSeconds),
+		},
+		metrics: metrics,
+		totals:  make(map[string]*remoteWriteTotals),
+		pending: make(chan []byte, 1),
+	}
+	go w.run(ctx, logger)
+	return w
+}
+
+// record adds the usage from a batch to the endpoint's totals
+func (w *remoteWriter) record(now time.Time, endpointID string, usage vmMetricsSeconds) {
+	t, ok := w.totals[endpointID]
+	if !ok {
+		t = new(remoteWriteTotals)
+		w.totals[endpointID] = t
+	}
+	t.cpuSeconds += usage.cpu
+	t.activeSeconds += usage.activeTime.Seconds()
+	t.internalEgressBytes += usage.internalEgressBytes
+	t.internetEgressBytes += usage.internetEgressBytes
+	t.lastUpdated = now
+}
+
+// push queues the current totals to be pushed, replacing any that haven't been pushed yet
+func (w *remoteWriter) push(now time.Time, hostname string, egress bool) {
+	for endpointID, t := range w.totals {
+		if now.Sub(t.lastUpdated) > remoteWriteStaleAfter {
+			delete(w.totals, endpointID)
+		}
+	}
+
+	// Sorted, so that the order of series is consistent.
+	endpointIDs := make([]string, 0, len(w.totals))
+	for endpointID := range w.totals {
+		endpointIDs = append(endpointIDs, endpointID)
+	}
+	slices.Sort(endpointIDs)
+
+	var series []remoteWriteSeries
+	for _, endpointID := range endpointIDs {
+		t := w.totals[endpointID]
+		add := func(name string, value float64) {
+			series = append(series, remoteWriteSeries{
+				labels: w.labels(name, endpointID, hostname),
+				value:  value,
+			})
+		}
+		add(remoteWriteCPUMetric, t.cpuSeconds)
+		add(remoteWriteActiveTimeMetric, t.activeSeconds)
+		if egress {
+			add(remoteWriteInternalEgressMetric, float64(t.internalEgressBytes))
+			add(remoteWriteInternetEgressMetric, float64(t.internetEgressBytes))
+		}
+	}
+	if len(series) == 0 {
+		return
+	}
+
+	encoded, err := marshalWriteRequest(now, series)
+	if err != nil {
+		// Only invalid UTF-8 in the labels can cause this. The samples are cumulative, so nothing
+		// is lost if the labels are fixed later.
+		w.metrics.remoteWriteRequestsTotal.WithLabelValues("error").Inc()
+		return
+	}
+	payload := snappy.Encode(nil, encoded)
+	for {
+		select {
+		case w.pending <- payload:
+			return
+		default:
+			// discard the stale payload, if it hasn't been pushed yet
+			select {
+			case <-w.pending:
+			default:
+			}
+		}
+	}
+}
+
+// labels returns the sorted labels for a series
+func (w *remoteWriter) labels(name, endpointID, hostname string) []remoteWriteLabel {
+	labels := []remoteWriteLabel{
+		{name: "__name__", value: name},
+		{name: "endpoint_id", value: endpointID},
+		{name: "node", value: hostname},
+	}
+	for n, v := range w.conf.Labels {
+		labels = append(labels, remoteWriteLabel{name: n, value: v})
+	}
+	slices.SortFunc(labels, func(a, b remoteWriteLabel) (less bool) {
+		return a.name < b.name
+	})
+	return labels
+}
+
+func (w *remoteWriter) run(ctx context.Context, logger *zap.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-w.pending:
+			start := time.Now()
+			err := w.send(ctx, payload)
+			duration := time.Since(start)
+			if err != nil {
+				logger.Warn("Failed to push usage to remote-write endpoint", zap.Duration("after", duration), zap.Error(err))
+				w.metrics.remoteWriteRequestsTotal.WithLabelValues("error").Inc()
+				continue
+			}
+			logger.Debug("Pushed usage to remote-write endpoint", zap.Int("bytes", len(payload)), zap.Duration("after", duration))
+			w.metrics.remoteWriteRequestsTotal.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+func (w *remoteWriter) send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-encoding", "snappy")
+	req.Header.Set("content-type", "application/x-protobuf")
+	req.Header.Set("x-prometheus-remote-write-version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type remoteWriteSeries struct {
+	labels []remoteWriteLabel
+	value  float64
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// marshalWriteRequest produces the protobuf encoding of a remote-write WriteRequest, with a single
+// sample at now for each series
+func marshalWriteRequest(now time.Time, series []remoteWriteSeries) ([]byte, error) {
+	req := &remotewritepb.WriteRequest{Timeseries: make([]*remotewritepb.TimeSeries, 0, len(series))}
+	for _, s := range series {
+		ts := &remotewritepb.TimeSeries{
+			Labels:  make([]*remotewritepb.Label, 0, len(s.labels)),
+			Samples: []*remotewritepb.Sample{{Value: s.value, Timestamp: now.UnixMilli()}},
+		}
+		for _, l := range s.labels {
+			ts.Labels = append(ts.Labels, &remotewritepb.Label{Name: l.name, Value: l.value})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	return proto.Marshal(req)
+}
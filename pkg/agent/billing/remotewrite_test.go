@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/billing/remotewritepb"
+)
+
+// decodedSeries is a series from a WriteRequest, with its labels flattened into a map
+type decodedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest is the inverse of marshalWriteRequest, failing the test on anything unexpected
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	var req remotewritepb.WriteRequest
+	require.NoError(t, proto.Unmarshal(b, &req))
+
+	var series []decodedSeries
+	for _, ts := range req.Timeseries {
+		s := decodedSeries{labels: make(map[string]string), value: 0, timestamp: 0}
+		for _, l := range ts.Labels {
+			s.labels[l.Name] = l.Value
+		}
+		require.Len(t, ts.Samples, 1)
+		s.value = ts.Samples[0].Value
+		s.timestamp = ts.Samples[0].Timestamp
+		series = append(series, s)
+	}
+	return series
+}
+
+func TestRemoteWrite(t *testing.T) {
+	requests := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("content-encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("content-type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests <- body
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := &RemoteWriteConfig{URL: server.URL, PushRequestTimeoutSeconds: 5, Labels: map[string]string{"cluster": "c1"}}
+	w := newRemoteWriter(ctx, zap.NewNop(), conf, NewPromMetrics())
+
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	usage := vmMetricsSeconds{
+		cpu:                  30,
+		computeUnits:         0,
+		gpu:                  0,
+		burstComputeUnits:    0,
+		usedCPU:              0,
+		usedComputeUnits:     0,
+		activeTime:           time.Minute,
+		internalEgressBytes:  100,
+		internetEgressBytes:  200,
+		egressUnavailable:    false,
+		interfaceEgressBytes: nil,
+		containerCPU:         nil,
+		upscales:             0,
+		downscales:           0,
+	}
+	// Totals are cumulative across batches
+	w.record(now, "ep-a", usage)
+	w.record(now, "ep-a", usage)
+	w.push(now, "node-1", false)
+
+	var body []byte
+	select {
+	case body = <-requests:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for push")
+	}
+	payload, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	series := decodeWriteRequest(t, payload)
+	require.Len(t, series, 2)
+	assert.Equal(t, map[string]string{
+		"__name__":    remoteWriteCPUMetric,
+		"cluster":     "c1",
+		"endpoint_id": "ep-a",
+		"node":        "node-1",
+	}, series[0].labels)
+	assert.Equal(t, 60.0, series[0].value)
+	assert.Equal(t, now.UnixMilli(), series[0].timestamp)
+	assert.Equal(t, remoteWriteActiveTimeMetric, series[1].labels["__name__"])
+	assert.Equal(t, 120.0, series[1].value)
+
+	// Endpoints without new usage are eventually forgotten
+	w.push(now.Add(remoteWriteStaleAfter+time.Second), "node-1", false)
+	assert.Empty(t, w.totals)
+}
@@ -0,0 +1,187 @@
+package billing
+
+// Tracking how long VMs spend at each size, so that capacity planning can see the distribution of
+// compute units rather than just the totals in the usage events.
+//
+// Sizes are grouped into exponentially sized buckets of compute units. The time in each bucket is
+// counted in a metric for the whole node, and optionally sent per endpoint as absolute events.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type ResidencyConfig struct {
+	// MinComputeUnits gives the upper bound of the smallest bucket, in compute units
+	MinComputeUnits float64 `json:"minComputeUnits"`
+	// Factor gives the ratio between the upper bounds of consecutive buckets. It must be > 1.
+	Factor float64 `json:"factor"`
+	// Buckets gives the number of buckets with an upper bound. Sizes above the largest bound are
+	// counted in an extra, unbounded bucket.
+	Buckets uint `json:"buckets"`
+	// Events, if provided, enables periodically emitting each endpoint's residency as absolute
+	// events. See ResidencyEventsConfig.
+	Events *ResidencyEventsConfig `json:"events,omitempty"`
+}
+
+// ResidencyEventsConfig configures the absolute events with the residency of each endpoint
+//
+// Each event gives the number of seconds that the endpoint's VM spent in one of the buckets since
+// the previous events. There's one event for every bucket, with the metric name MetricNamePrefix
+// followed by "_le_" and the bucket's upper bound -- e.g. "cu_residency_seconds_le_0.5", or
+// "cu_residency_seconds_le_inf" for the unbounded bucket.
+type ResidencyEventsConfig struct {
+	// MetricNamePrefix gives the start of the metric name of every event
+	MetricNamePrefix string `json:"metricNamePrefix"`
+	// EverySeconds gives the minimum interval between events. Like heartbeats, events are sent
+	// alongside collection, so the actual interval is rounded up to a multiple of
+	// collectEverySeconds.
+	EverySeconds uint `json:"everySeconds"`
+}
+
+// bounds returns the upper bound of each bucket, excluding the unbounded one
+func (c *ResidencyConfig) bounds() []float64 {
+	bounds := make([]float64, c.Buckets)
+	for i := range bounds {
+		bounds[i] = c.MinComputeUnits * math.Pow(c.Factor, float64(i))
+	}
+	return bounds
+}
+
+// residencyTracker accumulates the time each VM spends in each bucket
+type residencyTracker struct {
+	conf   *ResidencyConfig
+	bounds []float64
+	// labels gives the value of the metric's label, and the suffix of the event's metric name, for
+	// each bucket, including the unbounded one
+	labels []string
+	// seconds stores the time spent in each bucket by each endpoint, since the last events. It's
+	// only populated if events are enabled.
+	seconds map[string][]float64
+	counter *prometheus.CounterVec
+	// lastEvents gives the time that events were last sent
+	lastEvents time.Time
+}
+
+func newResidencyTracker(conf *ResidencyConfig, metrics PromMetrics, now time.Time) *residencyTracker {
+	bounds := conf.bounds()
+	labels := make([]string, 0, len(bounds)+1)
+	for _, b := range bounds {
+		labels = append(labels, strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	labels = append(labels, "inf")
+
+	return &residencyTracker{
+		conf:       conf,
+		bounds:     bounds,
+		labels:     labels,
+		seconds:    make(map[string][]float64),
+		counter:    metrics.residencySecondsTotal,
+		lastEvents: now,
+	}
+}
+
+// bucket returns the index of the bucket that the number of compute units falls into
+func (r *residencyTracker) bucket(computeUnits float64) int {
+	for i, b := range r.bounds {
+		if computeUnits <= b {
+			return i
+		}
+	}
+	return len(r.bounds)
+}
+
+// record adds the duration of the time slice to the bucket for the size of the endpoint's VM
+// during it
+func (r *residencyTracker) record(endpointID string, timeSlice metricsTimeSlice, computeUnit api.Resources) {
+	seconds := timeSlice.Duration().Seconds()
+	if seconds <= 0 {
+		return
+	}
+	i := r.bucket(timeSlice.metrics.computeUnits(computeUnit))
+
+	r.counter.WithLabelValues(r.labels[i]).Add(seconds)
+	if r.conf.Events != nil {
+		buckets, ok := r.seconds[endpointID]
+		if !ok {
+			buckets = make([]float64, len(r.labels))
+			r.seconds[endpointID] = buckets
+		}
+		buckets[i] += seconds
+	}
+}
+
+// maybeEnqueueResidencyEvents adds the residency events for each endpoint that's had any since the
+// last time, if it's been long enough.
+func (s *metricsState) maybeEnqueueResidencyEvents(
+	logger *zap.Logger,
+	hostname string,
+	queues []eventQueuePusher[billing.AnyEvent],
+) {
+	r := s.residency
+	if r == nil || r.conf.Events == nil {
+		return
+	}
+	conf := r.conf.Events
+
+	now := s.clock.Now()
+	if now.Sub(r.lastEvents) < time.Second*time.Duration(conf.EverySeconds) {
+		return
+	}
+	// The seconds since the last events would be lost if they were rejected, so they keep
+	// accumulating until there's room.
+	if anyBlocked(queues) {
+		return
+	}
+	r.lastEvents = now
+
+	batchSize := len(r.seconds) * len(r.labels)
+	firstSeq, err := s.sequence.Reserve(uint64(batchSize))
+	if err != nil {
+		logger.Error("Failed to persist billing sequence number", zap.Error(err))
+	}
+
+	countInBatch := 0
+	var batch []billing.AnyEvent
+	for endpointID, buckets := range r.seconds {
+		for i, seconds := range buckets {
+			seq := firstSeq + uint64(countInBatch)
+			countInBatch += 1
+			event := billing.Enrich(now, hostname, seq, countInBatch, batchSize, &billing.AbsoluteEvent{
+				MetricName:     fmt.Sprintf("%s_le_%s", conf.MetricNamePrefix, r.labels[i]),
+				Type:           "", // set by billing.Enrich
+				SchemaVersion:  0,  // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				SequenceNumber: 0,  // set by billing.Enrich
+				TenantID:       "",
+				TimelineID:     "",
+				EndpointID:     endpointID,
+				Time:           now,
+				Value:          int(math.Round(seconds)),
+				// Endpoints may have had more than one VM since the last events.
+				Identity: billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0},
+			})
+			logger.Debug(
+				"Adding residency event to batch",
+				zap.String("IdempotencyKey", event.IdempotencyKey),
+				zap.Uint64("SequenceNumber", event.SequenceNumber),
+				zap.String("EndpointID", event.EndpointID),
+				zap.String("MetricName", event.MetricName),
+				zap.Int("Value", event.Value),
+			)
+			batch = append(batch, event)
+		}
+	}
+	r.seconds = make(map[string][]float64)
+
+	s.enqueueBatch(queues, batch)
+	s.summary.recordEnqueued(countInBatch)
+}
@@ -0,0 +1,67 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestResidencyTracker(t *testing.T) {
+	metrics := NewPromMetrics()
+	conf := &ResidencyConfig{
+		MinComputeUnits: 0.25,
+		Factor:          2,
+		Buckets:         4,
+		Events: &ResidencyEventsConfig{
+			MetricNamePrefix: "cu_residency_seconds",
+			EverySeconds:     60,
+		},
+	}
+	r := newResidencyTracker(conf, metrics, time.Now())
+	assert.Equal(t, []string{"0.25", "0.5", "1", "2", "inf"}, r.labels)
+
+	for cu, want := range map[float64]int{0.1: 0, 0.25: 0, 0.3: 1, 1: 2, 1.5: 3, 2: 3, 2.5: 4, 100: 4} {
+		assert.Equal(t, want, r.bucket(cu), "bucket for %v CU", cu)
+	}
+
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+	start := time.Now()
+	slice := func(cpu vmapi.MilliCPU, mem api.Bytes, seconds int) metricsTimeSlice {
+		return metricsTimeSlice{
+			metrics: vmMetricsInstant{
+				cpu:               cpu,
+				mem:               mem,
+				gpus:              0,
+				idle:              false,
+				egress:            nil,
+				egressUnavailable: false,
+				containerCPU:      nil,
+				burstBaselineCU:   0,
+				usedCPU:           0,
+				usedMem:           0,
+			},
+			startTime: start,
+			endTime:   start.Add(time.Duration(seconds) * time.Second),
+		}
+	}
+
+	// 1 CU for 30s, then 2 CU (by memory) for 60s
+	r.record("ep-a", slice(250, 1<<30, 30), computeUnit)
+	r.record("ep-a", slice(250, 2<<30, 60), computeUnit)
+	r.record("ep-b", slice(2000, 1<<30, 10), computeUnit)
+
+	seconds := func(label string) float64 {
+		return testutil.ToFloat64(metrics.residencySecondsTotal.WithLabelValues(label))
+	}
+	assert.Equal(t, 30.0, seconds("1"))
+	assert.Equal(t, 60.0, seconds("2"))
+	assert.Equal(t, 10.0, seconds("inf"))
+
+	assert.Equal(t, []float64{0, 0, 30, 60, 0}, r.seconds["ep-a"])
+	assert.Equal(t, []float64{0, 0, 0, 0, 10}, r.seconds["ep-b"])
+}
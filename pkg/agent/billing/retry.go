@@ -0,0 +1,68 @@
+package billing
+
+// Retrying failed sends within a single push, before leaving the events in the queue until the
+// next one.
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of times that each batch is sent during a push, including
+	// the first attempt.
+	MaxAttempts uint `json:"maxAttempts"`
+	// InitialBackoffSeconds is the time to wait before the first retry. It doubles after each
+	// retry, up to MaxBackoffSeconds.
+	InitialBackoffSeconds uint `json:"initialBackoffSeconds"`
+	// MaxBackoffSeconds is the maximum time to wait between retries.
+	MaxBackoffSeconds uint `json:"maxBackoffSeconds"`
+}
+
+// sendWithRetry sends the events to the sink, retrying according to the client's retry policy
+//
+// Only errors that may be transient are retried; see failure.go. If the collector asks us to wait
+// longer than MaxBackoffSeconds, the events are left for the next push instead.
+func (s eventSender) sendWithRetry(logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error {
+	r := s.config.Retry
+	if r == nil {
+		return s.sink.send(s, logger, events, total, startTime)
+	}
+
+	backoff := time.Second * time.Duration(r.InitialBackoffSeconds)
+	maxBackoff := time.Second * time.Duration(r.MaxBackoffSeconds)
+	for attempt := uint(1); ; attempt++ {
+		err := s.sink.send(s, logger, events, total, startTime)
+		if err == nil || classifyFailure(err) != failureRetry || attempt >= r.MaxAttempts {
+			return err
+		}
+
+		wait := backoff
+		var throttled billing.ThrottledError
+		if errors.As(err, &throttled) && throttled.RetryAfter > wait {
+			if throttled.RetryAfter > maxBackoff {
+				logger.Warn(
+					"Billing collector asked us to wait longer than the maximum backoff, leaving events for the next push",
+					zap.Int("count", len(events)),
+					zap.Duration("retryAfter", throttled.RetryAfter),
+				)
+				return err
+			}
+			wait = throttled.RetryAfter
+		}
+
+		logger.Info(
+			"Retrying send of billing events",
+			zap.Int("count", len(events)),
+			zap.Uint("attempt", attempt+1),
+			zap.Duration("backoff", wait),
+		)
+		s.metrics.sendRetriesTotal.WithLabelValues(s.clientInfo.name).Inc()
+		s.clock.Sleep(wait)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
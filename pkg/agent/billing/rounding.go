@@ -0,0 +1,115 @@
+package billing
+
+// Rounding of the values in incremental events to the increments that usage is billed in, e.g. so
+// that active time is always sent in whole minutes.
+
+import (
+	"math"
+)
+
+// RoundingConfig gives the increments that the value of each metric is sent in, keyed by metric
+// name.
+//
+// Values are sent as whole multiples of the increment, and the remainder is carried over into the
+// next event for the same endpoint and metric, so that no usage is lost or invented along the way.
+// The remainder is only rounded, according to the policy's Mode, when the endpoint's VM leaves this
+// node, or on shutdown if shutdownFlushTimeoutSeconds is set. Remainders are kept in memory, so at
+// most one increment per endpoint and metric may be lost if the autoscaler-agent restarts without
+// flushing.
+type RoundingConfig struct {
+	// Default gives the rounding policy for each metric, for endpoints without an override
+	Default map[string]RoundingPolicy `json:"default,omitempty"`
+	// Endpoints gives the per-endpoint overrides of Default, keyed by endpoint ID and then metric
+	// name. Metrics that aren't overridden use Default.
+	Endpoints map[string]map[string]RoundingPolicy `json:"endpoints,omitempty"`
+}
+
+type RoundingPolicy struct {
+	// Increment gives the smallest amount of the metric that's billed, in the metric's units. For
+	// example, an increment of 60 for active time means that it's billed in whole minutes, and 360
+	// for compute unit-seconds means that it's billed in 0.1 CU-hour steps.
+	Increment uint `json:"increment"`
+	// Mode gives how the remaining usage is rounded, once there's no more to carry it over to.
+	// Defaults to RoundNearest.
+	Mode RoundingMode `json:"mode,omitempty"`
+}
+
+type RoundingMode string
+
+const (
+	RoundNearest RoundingMode = "nearest"
+	RoundUp      RoundingMode = "up"
+	RoundDown    RoundingMode = "down"
+)
+
+// Valid returns whether m is one of the known rounding modes, or empty
+func (m RoundingMode) Valid() bool {
+	switch m {
+	case "", RoundNearest, RoundUp, RoundDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// roundingEpsilon makes rounding tolerant to floating-point error, so that e.g. 120.0000001
+// seconds rounded up to whole minutes is still two minutes.
+const roundingEpsilon = 1e-9
+
+func (m RoundingMode) round(x float64) float64 {
+	switch m {
+	case RoundUp:
+		return math.Ceil(x - roundingEpsilon)
+	case RoundDown:
+		return math.Floor(x + roundingEpsilon)
+	default:
+		return math.Round(x)
+	}
+}
+
+// policy returns the rounding policy for the endpoint's metric, or nil if its values are sent as-is
+func (c *RoundingConfig) policy(endpointID string, metricName string) *RoundingPolicy {
+	if c == nil {
+		return nil
+	}
+	if p, ok := c.Endpoints[endpointID][metricName]; ok {
+		return &p
+	}
+	if p, ok := c.Default[metricName]; ok {
+		return &p
+	}
+	return nil
+}
+
+type roundingKey struct {
+	metricsKey
+	metricName string
+}
+
+// roundValue returns the value to send for the endpoint's metric, carrying any remainder over to
+// the next call for the same metric.
+//
+// If settle is true, there will be no next call, so the remainder is rounded according to the
+// policy's mode instead of being carried over.
+func (s *metricsState) roundValue(conf *RoundingConfig, key metricsKey, metricName string, value float64, settle bool) int {
+	rk := roundingKey{metricsKey: key, metricName: metricName}
+	total := value + s.roundingRemainders[rk]
+
+	policy := conf.policy(key.endpointID, metricName)
+	if policy == nil {
+		// The policy may have been removed by a config reload, in which case we just need to
+		// include what was left over.
+		delete(s.roundingRemainders, rk)
+		return int(math.Round(total))
+	}
+
+	increment := float64(policy.Increment)
+	if settle {
+		delete(s.roundingRemainders, rk)
+		return int(policy.Mode.round(total/increment) * increment)
+	}
+
+	rounded := math.Floor(total/increment+roundingEpsilon) * increment
+	s.roundingRemainders[rk] = total - rounded
+	return int(rounded)
+}
@@ -0,0 +1,156 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundingMode(t *testing.T) {
+	cases := []struct {
+		mode     RoundingMode
+		x        float64
+		expected float64
+	}{
+		{mode: "", x: 1.4, expected: 1},
+		{mode: "", x: 1.5, expected: 2},
+		{mode: RoundNearest, x: 2.49, expected: 2},
+		{mode: RoundUp, x: 1.01, expected: 2},
+		{mode: RoundUp, x: 2, expected: 2},
+		// Floating-point error doesn't round up an extra increment...
+		{mode: RoundUp, x: 2.0000000001, expected: 2},
+		{mode: RoundDown, x: 1.99, expected: 1},
+		// ... or down by one
+		{mode: RoundDown, x: 1.9999999999, expected: 2},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.mode.round(c.x), "mode %q, x = %v", c.mode, c.x)
+	}
+
+	assert.True(t, RoundingMode("").Valid())
+	assert.True(t, RoundUp.Valid())
+	assert.False(t, RoundingMode("sideways").Valid())
+}
+
+func TestRoundingPolicy(t *testing.T) {
+	conf := &RoundingConfig{
+		Default: map[string]RoundingPolicy{
+			"active": {Increment: 60, Mode: RoundUp},
+		},
+		Endpoints: map[string]map[string]RoundingPolicy{
+			"ep-a": {"active": {Increment: 3600, Mode: RoundDown}},
+		},
+	}
+
+	assert.Equal(t, &RoundingPolicy{Increment: 3600, Mode: RoundDown}, conf.policy("ep-a", "active"))
+	assert.Equal(t, &RoundingPolicy{Increment: 60, Mode: RoundUp}, conf.policy("ep-b", "active"))
+	assert.Nil(t, conf.policy("ep-a", "cpu"))
+	assert.Nil(t, (*RoundingConfig)(nil).policy("ep-a", "active"))
+}
+
+func TestRoundValue(t *testing.T) {
+	type call struct {
+		value    float64
+		settle   bool
+		expected int
+	}
+
+	cases := []struct {
+		name  string
+		mode  RoundingMode
+		calls []call
+	}{
+		{
+			name: "carries-remainders",
+			mode: RoundNearest,
+			calls: []call{
+				{value: 50, settle: false, expected: 0},
+				{value: 50, settle: false, expected: 60},   // 100 total, 40 carried
+				{value: 30, settle: false, expected: 60},   // 70 total, 10 carried
+				{value: 119, settle: false, expected: 120}, // 129 total, 9 carried
+			},
+		},
+		{
+			name: "settle-nearest",
+			mode: RoundNearest,
+			calls: []call{
+				{value: 100, settle: false, expected: 60},
+				{value: 0, settle: true, expected: 60}, // 40 left over, rounded to nearest
+				// Nothing carried after settling
+				{value: 20, settle: true, expected: 0},
+			},
+		},
+		{
+			name: "settle-up",
+			mode: RoundUp,
+			calls: []call{
+				{value: 70, settle: false, expected: 60},
+				{value: 0, settle: true, expected: 60}, // 10 left over, rounded up
+			},
+		},
+		{
+			name: "settle-down",
+			mode: RoundDown,
+			calls: []call{
+				{value: 110, settle: false, expected: 60},
+				{value: 5, settle: true, expected: 0}, // 55 left over, rounded down
+			},
+		},
+		{
+			name: "exact-multiples",
+			mode: RoundUp,
+			calls: []call{
+				{value: 60.0000000001, settle: false, expected: 60},
+				{value: 59.9999999999, settle: true, expected: 60},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &RoundingConfig{
+				Default:   map[string]RoundingPolicy{"active": {Increment: 60, Mode: c.mode}},
+				Endpoints: nil,
+			}
+			s := &metricsState{roundingRemainders: make(map[roundingKey]float64)} //nolint:exhaustruct // only the remainders are used
+			key := metricsKey{uid: "vm", endpointID: "ep"}
+
+			sent := 0.0
+			total := 0.0
+			for i, call := range c.calls {
+				got := s.roundValue(conf, key, "active", call.value, call.settle)
+				assert.Equal(t, call.expected, got, "call %d", i)
+				sent += float64(got)
+				total += call.value
+			}
+
+			// Whatever hasn't been sent is still carried over
+			remainder := s.roundingRemainders[roundingKey{metricsKey: key, metricName: "active"}]
+			if c.calls[len(c.calls)-1].settle {
+				assert.Zero(t, remainder)
+			} else {
+				assert.InDelta(t, total-sent, remainder, 1e-6)
+			}
+		})
+	}
+}
+
+func TestRoundValuePolicyRemoved(t *testing.T) {
+	conf := &RoundingConfig{
+		Default:   map[string]RoundingPolicy{"active": {Increment: 60, Mode: RoundNearest}},
+		Endpoints: nil,
+	}
+	s := &metricsState{roundingRemainders: make(map[roundingKey]float64)} //nolint:exhaustruct // only the remainders are used
+	key := metricsKey{uid: "vm", endpointID: "ep"}
+
+	assert.Equal(t, 0, s.roundValue(conf, key, "active", 45, false))
+
+	// Once the policy is removed by a reload, the remainder is included in the next value, which
+	// is sent as-is
+	assert.Equal(t, 55, s.roundValue(nil, key, "active", 10, false))
+	assert.Empty(t, s.roundingRemainders)
+
+	// Metrics without a policy are rounded to whole numbers
+	assert.Equal(t, 3, s.roundValue(conf, key, "cpu", 2.6, false))
+}
@@ -0,0 +1,96 @@
+package billing
+
+// Uploading billing events to S3 instead of pushing them to a collector
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
+)
+
+type S3ClientConfig struct {
+	BaseClientConfig
+	billing.S3ClientConfig
+}
+
+// s3Sink uploads events to S3
+type s3Sink struct {
+	client *billing.S3Client
+}
+
+// send uploads the events as a single object, logging and recording metrics about the result in
+// the same way as push
+func (u s3Sink) send(s eventSender, logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error {
+	s.waitForRateLimit(logger)
+
+	logger.Debug("Uploading billing events", zap.Int("count", len(events)), u.logField())
+
+	spanCtx, span := s.tracer.Start(
+		context.Background(), "billing.upload",
+		trace.WithAttributes(
+			attribute.String("billing.client", s.clientInfo.name),
+			attribute.Int("billing.events", len(events)),
+		),
+	)
+
+	reqStart := time.Now()
+	err := func() error {
+		reqCtx, cancel := context.WithTimeout(spanCtx, time.Second*time.Duration(s.config.PushRequestTimeoutSeconds))
+		defer cancel()
+
+		return u.client.Upload(reqCtx, reqStart, events)
+	}()
+	reqDuration := time.Since(reqStart)
+	tracing.RecordError(span, err)
+	span.End()
+	if s.reporter != nil {
+		s.reporter.PushResult(s.clientInfo.name, err)
+	}
+
+	response := responseClass(err)
+	s.metrics.sendBatchSize.WithLabelValues(s.clientInfo.name).Observe(float64(len(events)))
+	s.metrics.sendRequestsTotal.WithLabelValues(s.clientInfo.name, response).Inc()
+	s.metrics.sendRequestDuration.WithLabelValues(s.clientInfo.name, response).Observe(reqDuration.Seconds())
+
+	if err != nil {
+		logger.Error(
+			"Failed to upload billing events",
+			zap.Int("count", len(events)),
+			zap.Duration("after", reqDuration),
+			u.logField(),
+			zap.Int("total", total),
+			zap.Duration("totalTime", s.clock.Since(startTime)),
+			zap.Error(err),
+		)
+		s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErrorClass(err)).Inc()
+		return err
+	}
+
+	logger.Debug(
+		"Successfully uploaded some billing events",
+		zap.Int("count", len(events)),
+		zap.Duration("after", reqDuration),
+		u.logField(),
+		zap.Int("total", total+len(events)),
+		zap.Duration("totalTime", s.clock.Since(startTime)),
+	)
+	return nil
+}
+
+// updated switches to the new sink, because the S3 client doesn't hold any state that needs to be
+// kept
+func (u s3Sink) updated(next sink) sink {
+	return next
+}
+
+func (u s3Sink) close(*zap.Logger) {}
+
+func (u s3Sink) logField() zap.Field {
+	return zap.String("bucket", u.client.Config.Bucket)
+}
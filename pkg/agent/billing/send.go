@@ -4,27 +4,71 @@ package billing
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"reflect"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 
 	"github.com/neondatabase/autoscaling/pkg/billing"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 type clientInfo struct {
-	client billing.Client
+	// sink is where the client's events are sent. See sinkKinds.
+	sink   sink
 	name   string
 	config BaseClientConfig
 }
 
+// clientUpdates passes new versions of a client to its sender, when the config is reloaded
+//
+// It must have a buffer size of one, so that only the latest update is kept.
+type clientUpdates chan clientInfo
+
+// send replaces any pending update with c, without blocking
+func (u clientUpdates) send(c clientInfo) {
+	for {
+		select {
+		case u <- c:
+			return
+		default:
+			// discard the stale update, if the sender hasn't received it yet
+			select {
+			case <-u:
+			default:
+			}
+		}
+	}
+}
+
 type eventSender struct {
 	clientInfo
 
 	metrics           PromMetrics
-	queue             eventQueuePuller[*billing.IncrementalEvent]
+	summary           *logSummary
+	queue             eventQueuePuller[billing.AnyEvent]
 	collectorFinished util.CondChannelReceiver
+	updates           clientUpdates
+	tracer            trace.Tracer
+	reporter          StatusReporter // nil if the status isn't reported
+	spill             *spillStore    // nil if events aren't spilled to disk
+	lag               *clientPushLag
+	breaker           *circuitBreaker
+	// format is the wire format currently used for pushes. It starts as config.Format, and falls
+	// back to JSON if the collector doesn't support it.
+	format  *pushFormat
+	limiter *rate.Limiter    // nil if the request rate isn't limited
+	faults  *faults.Injector // nil if fault injection isn't enabled
+	clock   util.Clock
 
 	// lastSendDuration tracks the "real" last full duration of (eventSender).sendAllCurrentEvents().
 	//
@@ -49,8 +93,41 @@ type eventSender struct {
 	lastSendDuration time.Duration
 }
 
+// pushFormat is the wire format currently used for pushes, shared between concurrent requests
+type pushFormat struct {
+	mu      sync.Mutex
+	current billing.Format
+}
+
+func (f *pushFormat) get() billing.Format {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+func (f *pushFormat) set(format billing.Format) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.current = format
+}
+
 func (s eventSender) senderLoop(logger *zap.Logger) {
-	ticker := time.NewTicker(time.Second * time.Duration(s.config.PushEverySeconds))
+	// Spread out the first push from each agent, so that agents that all started at the same time
+	// (e.g. during a rollout) don't stay in lockstep.
+	if jitter := startupJitter(s.config.RateLimit); jitter != 0 {
+		logger.Info("Delaying first push", zap.Duration("delay", jitter))
+		select {
+		case <-s.collectorFinished.Recv():
+			logger.Info("Received notification that collector finished")
+			s.sendAllCurrentEvents(logger, true)
+			s.sink.close(logger)
+			logger.Info("Ending events sender loop")
+			return
+		case <-s.clock.After(jitter):
+		}
+	}
+
+	ticker := s.clock.NewTicker(time.Second * time.Duration(s.config.PushEverySeconds))
 	defer ticker.Stop()
 
 	for {
@@ -60,31 +137,79 @@ func (s eventSender) senderLoop(logger *zap.Logger) {
 		case <-s.collectorFinished.Recv():
 			logger.Info("Received notification that collector finished")
 			final = true
-		case <-ticker.C:
+		case c := <-s.updates:
+			logger.Info("Updating client config", c.sink.logField(), zap.Any("config", c.config))
+			if c.config.PushEverySeconds != s.config.PushEverySeconds {
+				ticker.Reset(time.Second * time.Duration(c.config.PushEverySeconds))
+			}
+			if c.config.Format != s.config.Format {
+				s.format.set(c.config.Format)
+			}
+			if !sameRateLimit(c.config.RateLimit, s.config.RateLimit) {
+				s.limiter = newPushLimiter(c.config.RateLimit)
+			}
+			if !reflect.DeepEqual(c.config.CircuitBreaker, s.config.CircuitBreaker) {
+				s.breaker.setConfig(c.config.CircuitBreaker)
+			}
+			c.sink = s.sink.updated(c.sink)
+			s.clientInfo = c
+			continue
+		case <-ticker.C():
 		}
 
-		s.sendAllCurrentEvents(logger)
+		s.sendAllCurrentEvents(logger, final)
 
 		if final {
+			s.sink.close(logger)
 			logger.Info("Ending events sender loop")
 			return
 		}
 	}
 }
 
-func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
-	logger.Info("Pushing all available events")
+// sendAllCurrentEvents sends everything in the queue, stopping at the first error
+//
+// While the client's circuit breaker is open, nothing is sent, unless this is the final push.
+func (s eventSender) sendAllCurrentEvents(logger *zap.Logger, final bool) {
+	logger.Debug("Pushing all available events")
+	if s.reporter != nil {
+		s.reporter.QueueSize(s.clientInfo.name, s.queue.size())
+	}
+
+	total := 0
+	startTime := s.clock.Now()
+
+	if p, ok := s.sink.(periodicSink); ok {
+		p.onPushInterval(logger, startTime)
+	}
+
+	if !final && s.breaker.isOpen(startTime) {
+		logger.Debug("Skipping push, circuit breaker is open", zap.Int("queueSize", s.queue.size()))
+		s.metrics.circuitBreakerSkipsTotal.WithLabelValues(s.clientInfo.name).Inc()
+		return
+	}
+
+	// Spilled events are older than everything in the queue, so they're sent first.
+	if s.spill != nil {
+		sent, err := s.sendSpilled(logger)
+		total += sent
+		if err != nil {
+			s.recordFailure(logger, err)
+			s.summary.recordPush(s.clientInfo.name, total, err)
+			s.lastSendDuration = 0
+			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(0.0) // use 0 as a flag that something went wrong; there's no valid time here.
+			return
+		}
+	}
 
-	if s.queue.size() == 0 {
-		logger.Info("No billing events to push")
+	if total == 0 && s.queue.size() == 0 {
+		logger.Debug("No billing events to push")
+		s.lag.recordSuccess(s.clock.Now())
 		s.lastSendDuration = 0
 		s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(1e-6) // small value, to indicate that nothing happened
 		return
 	}
 
-	total := 0
-	startTime := time.Now()
-
 	// while there's still events in the queue, send them
 	//
 	// If events are being added to the queue faster than we can send them, this loop will not
@@ -94,17 +219,22 @@ func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
 	// long).
 	for {
 		if size := s.queue.size(); size != 0 {
-			logger.Info("Current queue size is non-zero", zap.Int("queueSize", size))
+			logger.Debug("Current queue size is non-zero", zap.Int("queueSize", size))
 		}
 
 		chunk := s.queue.get(int(s.config.MaxBatchSize))
 		count := len(chunk)
 		if count == 0 {
-			totalTime := time.Since(startTime)
+			if total != 0 {
+				s.breaker.recordResult(s.clock.Now(), nil)
+			}
+			s.lag.recordSuccess(s.clock.Now())
+			totalTime := s.clock.Since(startTime)
 			s.lastSendDuration = totalTime
 			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(totalTime.Seconds())
+			s.summary.recordPush(s.clientInfo.name, total, nil)
 
-			logger.Info(
+			logger.Debug(
 				"All available events have been sent",
 				zap.Int("total", total),
 				zap.Duration("totalTime", totalTime),
@@ -112,72 +242,365 @@ func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
 			return
 		}
 
-		traceID := s.client.GenerateTraceID()
+		handled, err := s.sendChunk(logger, chunk, 0, total, startTime)
+		// Some of the chunk may have been sent (or dropped) before an error, if it was split.
+		s.queue.drop(handled)
+		total += handled
+		if err != nil {
+			// Something went wrong and we're going to abandon attempting to push any further
+			// events.
+			s.recordFailure(logger, err)
+			s.summary.recordPush(s.clientInfo.name, total, err)
 
-		logger.Info(
-			"Pushing billing events",
-			zap.Int("count", count),
-			zap.String("traceID", string(traceID)),
-			zap.String("url", s.client.URL),
+			s.lastSendDuration = 0
+			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(0.0) // use 0 as a flag that something went wrong; there's no valid time here.
+			return
+		}
+
+		s.lag.recordSuccess(s.clock.Now())
+		currentTotalTime := s.clock.Since(startTime)
+
+		if currentTotalTime > s.lastSendDuration {
+			s.lastSendDuration = currentTotalTime
+			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(currentTotalTime.Seconds())
+		}
+	}
+}
+
+// recordFailure records a failed push with the client's circuit breaker
+func (s eventSender) recordFailure(logger *zap.Logger, err error) {
+	if s.breaker.recordResult(s.clock.Now(), err) {
+		logger.Warn(
+			"Too many consecutive failed pushes, opening circuit breaker",
+			zap.Uint("failureThreshold", s.config.CircuitBreaker.FailureThreshold),
+			zap.Uint("openSeconds", s.config.CircuitBreaker.OpenSeconds),
 		)
+	}
+}
+
+// pushShards pushes the events to their shards, with up to RateLimit.MaxInFlight requests at once,
+// returning the first error
+func (s eventSender) pushShards(
+	logger *zap.Logger,
+	clients []billing.Client,
+	chunk []billing.AnyEvent,
+	total int,
+	startTime time.Time,
+) error {
+	shards := partitionByShard(chunk, len(clients))
 
-		reqStart := time.Now()
-		err := func() error {
-			reqCtx, cancel := context.WithTimeout(context.TODO(), time.Second*time.Duration(s.config.PushRequestTimeoutSeconds))
-			defer cancel()
+	inFlight := make(chan struct{}, maxInFlight(s.config.RateLimit))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for shard, events := range shards {
+		if len(events) == 0 {
+			continue
+		}
 
-			return billing.Send(reqCtx, s.client, traceID, chunk)
-		}()
-		reqDuration := time.Since(reqStart)
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(shard int, events []billing.AnyEvent) {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			errs[shard] = s.pushEvents(logger, clients[shard], events, total, startTime)
+		}(shard, events)
+	}
+	wg.Wait()
 
+	for _, err := range errs {
 		if err != nil {
-			// Something went wrong and we're going to abandon attempting to push any further
-			// events.
-			logger.Error(
-				"Failed to push billing events",
-				zap.Int("count", count),
-				zap.Duration("after", reqDuration),
-				zap.String("traceID", string(traceID)),
-				zap.String("url", s.client.URL),
-				zap.Int("total", total),
-				zap.Duration("totalTime", time.Since(startTime)),
-				zap.Error(err),
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSpilled pushes all of the events that were spilled to disk, returning the number that were
+// sent, and the first error
+//
+// Each shard makes progress separately: once a push to one shard fails, the rest of its payloads are
+// left for next time, so that they're still sent in order, but the other shards carry on.
+func (s eventSender) sendSpilled(logger *zap.Logger) (int, error) {
+	// Only HTTP clients spill events to disk; see the validation in pkg/agent/config.go.
+	clients := s.sink.(httpSink).clients
+
+	payloads, bad, err := s.spill.list()
+	if err != nil {
+		logger.Error("Failed to list spilled billing events", zap.Error(err))
+		return 0, err
+	}
+	for _, path := range bad {
+		s.quarantineSpilled(logger, path, errors.New("Bad spilled payload file name"))
+	}
+
+	total := 0
+	startTime := s.clock.Now()
+	failed := make([]bool, len(clients))
+	var firstErr error
+	fail := func(shard int, err error) {
+		failed[shard] = true
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for len(payloads) != 0 {
+		p := payloads[0]
+		payloads = payloads[1:]
+
+		if len(clients) == 1 {
+			p.shard = 0
+		} else if p.shards != len(clients) {
+			// The payload was spilled with a different number of shards (or by an older version
+			// that didn't record it), so its events may belong to other shards now.
+			logger.Info(
+				"Resharding spilled billing events",
+				zap.String("path", p.path),
+				zap.Int("spilledShards", p.shards),
+				zap.Int("shards", len(clients)),
 			)
+			resharded, err := s.spill.reshard(p, len(clients))
+			if err != nil {
+				var parseErr spillParseError
+				if errors.As(err, &parseErr) {
+					s.quarantineSpilled(logger, p.path, err)
+					continue
+				}
+				// We don't know which shards the events are for, so none of them can go ahead.
+				logger.Error("Failed to reshard spilled billing events", zap.String("path", p.path), zap.Error(err))
+				return total, err
+			}
+			payloads = append(resharded, payloads...)
+			continue
+		}
 
-			var rootErr string
-			//nolint:errorlint // The type switch (instead of errors.As) is ok; billing.Send() guarantees the error types.
-			switch e := err.(type) {
-			case billing.JSONError:
-				rootErr = "JSON marshaling"
-			case billing.UnexpectedStatusCodeError:
-				rootErr = fmt.Sprintf("HTTP code %d", e.StatusCode)
-			default:
-				rootErr = util.RootError(err).Error()
+		if failed[p.shard] {
+			continue
+		}
+		path := p.path
+		readPayload := func() ([]byte, error) { return os.ReadFile(path) }
+		if err := s.push(logger, clients[p.shard], billing.FormatJSON, readPayload, p.count, total, startTime); err != nil {
+			// Spilled payloads can't be split to isolate the events that the collector rejected, so
+			// if it rejected the events themselves, the file is moved aside rather than deleted, so
+			// that it doesn't hold up the rest without losing any events that were fine.
+			if classifyFailure(err) != failureDrop {
+				fail(p.shard, err)
+				continue
 			}
-			s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErr).Inc()
+			s.quarantineSpilled(logger, p.path, err)
+			continue
+		}
 
-			s.lastSendDuration = 0
-			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(0.0) // use 0 as a flag that something went wrong; there's no valid time here.
-			return
+		if err := os.Remove(p.path); err != nil {
+			// If we can't remove the file, the events would be sent again. They're deduplicated by
+			// their idempotency keys, but we'd keep sending them, so stop here for this shard.
+			logger.Error("Failed to remove spilled billing events", zap.String("path", p.path), zap.Error(err))
+			fail(p.shard, err)
+			continue
 		}
+		total += p.count
+	}
 
-		s.queue.drop(count) // mark len(chunk) as successfully processed
-		total += len(chunk)
-		currentTotalTime := time.Since(startTime)
+	if total != 0 {
+		logger.Info("Pushed spilled billing events", zap.Int("total", total), zap.Duration("totalTime", s.clock.Since(startTime)))
+	}
+	return total, firstErr
+}
+
+// quarantineSpilled moves aside a spilled file that can never be sent, so that it doesn't hold up
+// the rest
+func (s eventSender) quarantineSpilled(logger *zap.Logger, path string, reason error) {
+	logger.Error("Quarantining spilled billing events that can't be sent", zap.String("path", path), zap.Error(reason))
+	s.metrics.spillQuarantinedFilesTotal.WithLabelValues(s.clientInfo.name).Inc()
+	if err := s.spill.quarantine(path); err != nil {
+		logger.Error("Failed to quarantine spilled billing events", zap.String("path", path), zap.Error(err))
+	}
+}
+
+// pushEvents sends the events in the current format, falling back to JSON if the collector doesn't
+// support it
+func (s eventSender) pushEvents(
+	logger *zap.Logger,
+	client billing.Client,
+	events []billing.AnyEvent,
+	total int,
+	startTime time.Time,
+) error {
+	format := s.format.get()
+	marshal := func() ([]byte, error) { return s.marshal(format, events) }
+	err := s.push(logger, client, format, marshal, len(events), total, startTime)
+	if format != billing.FormatProtobuf || !billing.IsUnsupportedFormat(err) {
+		return err
+	}
+
+	logger.Warn(
+		"Billing collector doesn't support the configured format, falling back to JSON",
+		zap.String("format", string(format)),
+		zap.String("url", client.URL),
+	)
+	s.format.set(billing.FormatJSON)
+	marshal = func() ([]byte, error) { return s.marshal(billing.FormatJSON, events) }
+	return s.push(logger, client, billing.FormatJSON, marshal, len(events), total, startTime)
+}
 
-		logger.Info(
-			"Successfully pushed some billing events",
+// marshal produces the request body for the events, including the batch digest if it's enabled
+func (s eventSender) marshal(format billing.Format, events []billing.AnyEvent) ([]byte, error) {
+	if s.config.ContentDigest {
+		return billing.MarshalFormatWithDigest(format, events)
+	}
+	return billing.MarshalFormat(format, events)
+}
+
+// push sends a single payload of count events, logging and recording metrics about the result
+//
+// total and startTime are only used for logging, and give the progress of the current set of
+// pushes.
+func (s eventSender) push(
+	logger *zap.Logger,
+	client billing.Client,
+	format billing.Format,
+	getPayload func() ([]byte, error),
+	count int,
+	total int,
+	startTime time.Time,
+) error {
+	s.waitForRateLimit(logger)
+
+	traceID := client.GenerateTraceID()
+
+	logger.Debug(
+		"Pushing billing events",
+		zap.Int("count", count),
+		zap.String("traceID", string(traceID)),
+		zap.String("url", client.URL),
+	)
+
+	spanCtx, span := s.tracer.Start(
+		context.Background(), "billing.push",
+		trace.WithAttributes(
+			attribute.String("billing.client", s.clientInfo.name),
+			attribute.String("billing.trace_id", string(traceID)),
+			attribute.Int("billing.events", count),
+		),
+	)
+
+	// The request itself is timed with the real clock, because that's about the collector's
+	// latency rather than ours.
+	reqStart := time.Now()
+	var ackID billing.AckID
+	err := func() error {
+		payload, err := getPayload()
+		if err != nil {
+			return err
+		}
+
+		s.metrics.sendBatchSize.WithLabelValues(s.clientInfo.name).Observe(float64(count))
+		s.metrics.sendPayloadBytes.WithLabelValues(s.clientInfo.name).Observe(float64(len(payload)))
+
+		reqCtx, cancel := context.WithTimeout(spanCtx, time.Second*time.Duration(s.config.PushRequestTimeoutSeconds))
+		defer cancel()
+
+		if err := s.faults.Inject(reqCtx, faults.TargetBilling, ""); err != nil {
+			// SendPayload only returns unwrapped errors of specific types, so match that.
+			return billing.RequestError{Err: err}
+		}
+
+		ackID, err = billing.SendPayload(reqCtx, client, traceID, format, payload)
+		return err
+	}()
+	reqDuration := time.Since(reqStart)
+	tracing.RecordError(span, err)
+	span.End()
+	if s.reporter != nil {
+		s.reporter.PushResult(s.clientInfo.name, err)
+	}
+
+	response := responseClass(err)
+	s.metrics.sendRequestsTotal.WithLabelValues(s.clientInfo.name, response).Inc()
+	s.metrics.sendRequestDuration.WithLabelValues(s.clientInfo.name, response).Observe(reqDuration.Seconds())
+
+	if err != nil {
+		logger.Error(
+			"Failed to push billing events",
 			zap.Int("count", count),
 			zap.Duration("after", reqDuration),
 			zap.String("traceID", string(traceID)),
-			zap.String("url", s.client.URL),
+			zap.String("url", client.URL),
 			zap.Int("total", total),
-			zap.Duration("totalTime", currentTotalTime),
+			zap.Duration("totalTime", s.clock.Since(startTime)),
+			zap.Error(err),
 		)
+		s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErrorClass(err)).Inc()
+		return err
+	}
 
-		if currentTotalTime > s.lastSendDuration {
-			s.lastSendDuration = currentTotalTime
-			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(currentTotalTime.Seconds())
+	fields := []zap.Field{
+		zap.Int("count", count),
+		zap.Duration("after", reqDuration),
+		zap.String("traceID", string(traceID)),
+		zap.String("url", client.URL),
+		zap.Int("total", total+count),
+		zap.Duration("totalTime", s.clock.Since(startTime)),
+	}
+	if ackID != "" {
+		// Log every acknowledged batch, so that it can be matched up with the collector's records.
+		s.metrics.sendAcknowledgedTotal.WithLabelValues(s.clientInfo.name).Inc()
+		logger.Info("Billing collector acknowledged batch", append(fields, zap.String("ackID", string(ackID)))...)
+	} else {
+		logger.Debug("Successfully pushed some billing events", fields...)
+	}
+	return nil
+}
+
+// rootErrorClass returns a description of the root cause of the error from sending events, for use
+// as a metric label
+func rootErrorClass(err error) string {
+	//nolint:errorlint // The type switch (instead of errors.As) is ok; billing.Send() guarantees the error types.
+	switch err.(type) {
+	case billing.JSONError:
+		return "JSON marshaling"
+	default:
+		if code, ok := statusCode(err); ok {
+			return fmt.Sprintf("HTTP code %d", code)
 		}
+		return util.RootError(err).Error()
+	}
+}
+
+// responseClass returns a low-cardinality description of the result of sending events, for use as
+// a metric label
+func responseClass(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	//nolint:errorlint // errors from Marshal and SendPayload are never wrapped, so a type switch is fine here
+	switch err.(type) {
+	case billing.JSONError:
+		return "json_error"
+	default:
+		if code, ok := statusCode(err); ok {
+			return fmt.Sprintf("http_%dxx", code/100)
+		}
+		return "request_error"
+	}
+}
+
+// statusCode returns the HTTP status code of the collector's response, if the error came from one
+func statusCode(err error) (int, bool) {
+	//nolint:errorlint // errors from SendPayload are never wrapped
+	switch e := err.(type) {
+	case billing.UnexpectedStatusCodeError:
+		return e.StatusCode, true
+	case billing.ThrottledError:
+		return e.StatusCode, true
+	case billing.AuthError:
+		return e.StatusCode, true
+	case billing.PayloadTooLargeError:
+		return e.StatusCode, true
+	default:
+		return 0, false
 	}
 }
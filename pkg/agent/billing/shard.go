@@ -0,0 +1,102 @@
+package billing
+
+// Partitioning of events across multiple URLs by their endpoint ID, for pushing to a collector
+// that's sharded by endpoint.
+//
+// Each endpoint's events always go to the same shard, as long as the number of shards doesn't
+// change. Events without an endpoint ID all go to the first shard.
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// ShardsConfig gives the URLs that a client's events are partitioned across, by a hash of their
+// endpoint ID. Exactly one of URLs or URLTemplate must be set.
+//
+// Changes to the number of shards require a restart. Changes to the URLs themselves don't. Events
+// that were spilled to disk before a restart that reduced the number of shards may be sent to the
+// wrong shard.
+type ShardsConfig struct {
+	// URLs is the list of shards' URLs, in order
+	URLs []string `json:"urls,omitempty"`
+	// URLTemplate is the URL of each shard, with "{shard}" replaced by its index, from zero to
+	// Count-1.
+	URLTemplate string `json:"urlTemplate,omitempty"`
+	// Count is the number of shards, if URLTemplate is set
+	Count uint `json:"count,omitempty"`
+}
+
+// ShardURLTemplateVar is replaced in ShardsConfig.URLTemplate with the index of each shard
+const ShardURLTemplateVar = "{shard}"
+
+// shardCount returns the number of shards that the client's events are partitioned across, which
+// is one if it isn't sharded
+func shardCount(c *HTTPClientConfig) int {
+	if c.Shards == nil {
+		return 1
+	} else if len(c.Shards.URLs) != 0 {
+		return len(c.Shards.URLs)
+	}
+	return int(c.Shards.Count)
+}
+
+// urls returns the URL of each shard
+func (c *ShardsConfig) urls() []string {
+	if len(c.URLs) != 0 {
+		return c.URLs
+	}
+	urls := make([]string, c.Count)
+	for i := range urls {
+		urls[i] = strings.ReplaceAll(c.URLTemplate, ShardURLTemplateVar, strconv.Itoa(i))
+	}
+	return urls
+}
+
+// makeShardClients returns the clients for the config's URL, or for each of its shards if it's
+// sharded
+func makeShardClients(c *HTTPClientConfig) []billing.Client {
+	urls := []string{c.URL}
+	if c.Shards != nil {
+		urls = c.Shards.urls()
+	}
+
+	var clients []billing.Client
+	for _, url := range urls {
+		client := billing.NewClient(url, http.DefaultClient)
+		if c.ContentDigest {
+			client = client.WithContentDigest()
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// shardOf returns the shard that events for the endpoint are sent to, out of count shards
+func shardOf(endpointID string, count int) int {
+	if count <= 1 || endpointID == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(endpointID))
+	return int(h.Sum32() % uint32(count))
+}
+
+// partitionByShard splits the events into count groups by shardOf, preserving their order within
+// each group
+func partitionByShard(events []billing.AnyEvent, count int) [][]billing.AnyEvent {
+	if count <= 1 {
+		return [][]billing.AnyEvent{events}
+	}
+
+	groups := make([][]billing.AnyEvent, count)
+	for _, e := range events {
+		shard := shardOf(billing.EndpointIDOf(e), count)
+		groups[shard] = append(groups[shard], e)
+	}
+	return groups
+}
@@ -0,0 +1,62 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+func TestShardURLs(t *testing.T) {
+	conf := ShardsConfig{URLs: nil, URLTemplate: "http://collector-{shard}.billing:8080", Count: 3}
+	assert.Equal(t, []string{
+		"http://collector-0.billing:8080",
+		"http://collector-1.billing:8080",
+		"http://collector-2.billing:8080",
+	}, conf.urls())
+	assert.Equal(t, 3, shardCount(&HTTPClientConfig{
+		BaseClientConfig: BaseClientConfig{PushEverySeconds: 0, PushRequestTimeoutSeconds: 0, MaxBatchSize: 0, Queue: nil},
+		URL:              "",
+		Shards:           &conf,
+	}))
+}
+
+func TestPartitionByShard(t *testing.T) {
+	event := func(endpointID string, value int) billing.AnyEvent {
+		e := new(billing.IncrementalEvent)
+		e.EndpointID = endpointID
+		e.Value = value
+		return e
+	}
+
+	var events []billing.AnyEvent
+	for i := 0; i < 100; i++ {
+		events = append(events, event([]string{"ep-a", "ep-b", "ep-c", "ep-d"}[i%4], i))
+	}
+	events = append(events, new(billing.AbsoluteEvent))
+
+	groups := partitionByShard(events, 3)
+	assert.Len(t, groups, 3)
+
+	total := 0
+	for shard, group := range groups {
+		total += len(group)
+		lastValue := -1
+		for _, e := range group {
+			// Each endpoint's events all go to the same shard, in their original order
+			assert.Equal(t, shard, shardOf(billing.EndpointIDOf(e), 3))
+			if ie, ok := e.(*billing.IncrementalEvent); ok {
+				assert.Greater(t, ie.Value, lastValue)
+				lastValue = ie.Value
+			}
+		}
+	}
+	assert.Equal(t, len(events), total)
+
+	// Events without an endpoint go to the first shard
+	assert.Contains(t, groups[0], events[len(events)-1])
+
+	// Without sharding, there's only one group
+	assert.Equal(t, [][]billing.AnyEvent{events}, partitionByShard(events, 1))
+}
@@ -0,0 +1,132 @@
+package billing
+
+// Sinks are the destinations that billing events are sent to.
+//
+// Each kind of sink is registered in sinkKinds. Every configured sink gets its own queue and
+// sender, with its own retry policy and circuit breaker, so that one failing sink doesn't hold up
+// delivery to the others.
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// sink sends batches of events to a single destination
+type sink interface {
+	// send sends the events, returning an error if they weren't all accepted. It may be called
+	// again with the same events after an error.
+	//
+	// total and startTime are only used for logging, and give the progress of the current set of
+	// sends.
+	send(s eventSender, logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error
+	// updated returns the sink to use once the client's config is updated to one with next. Sinks
+	// that hold state, like an open file or connection, keep using it until restart.
+	updated(next sink) sink
+	// close releases anything held by the sink, once there's nothing left to send
+	close(logger *zap.Logger)
+	// logField describes the sink's destination, for logging
+	logField() zap.Field
+}
+
+// periodicSink is implemented by sinks that need to do something on every push interval, even if
+// there are no events to send
+type periodicSink interface {
+	sink
+	onPushInterval(logger *zap.Logger, now time.Time)
+}
+
+// sinkKind is an entry in the registry of sinks
+type sinkKind struct {
+	name string
+	// make returns the sink and its base config, or nil if this kind of sink isn't configured
+	make func(logger *zap.Logger, c *ClientsConfig) (sink, *BaseClientConfig)
+}
+
+// sinkKinds is the registry of every kind of sink, in the order they're set up
+var sinkKinds = []sinkKind{
+	{
+		name: "http",
+		make: func(_ *zap.Logger, c *ClientsConfig) (sink, *BaseClientConfig) {
+			if c.HTTP == nil {
+				return nil, nil
+			}
+			return httpSink{clients: makeShardClients(c.HTTP)}, &c.HTTP.BaseClientConfig
+		},
+	},
+	{
+		name: "file",
+		make: func(_ *zap.Logger, c *ClientsConfig) (sink, *BaseClientConfig) {
+			if c.File == nil {
+				return nil, nil
+			}
+			return fileSink{file: newFileClient(c.File)}, &c.File.BaseClientConfig
+		},
+	},
+	{
+		name: "nats",
+		make: func(logger *zap.Logger, c *ClientsConfig) (sink, *BaseClientConfig) {
+			if c.NATS == nil {
+				return nil, nil
+			}
+			return natsSink{client: newNATSClient(logger.Named("nats"), c.NATS)}, &c.NATS.BaseClientConfig
+		},
+	},
+	{
+		name: "s3",
+		make: func(_ *zap.Logger, c *ClientsConfig) (sink, *BaseClientConfig) {
+			if c.S3 == nil {
+				return nil, nil
+			}
+			return s3Sink{client: billing.NewS3Client(c.S3.S3ClientConfig)}, &c.S3.BaseClientConfig
+		},
+	},
+}
+
+// makeClients returns a client for each sink that's configured
+func makeClients(logger *zap.Logger, conf *Config) []clientInfo {
+	var clients []clientInfo
+	for _, kind := range sinkKinds {
+		if s, base := kind.make(logger, &conf.Clients); s != nil {
+			clients = append(clients, clientInfo{sink: s, name: kind.name, config: *base})
+		}
+	}
+	return clients
+}
+
+// httpSink pushes events to the billing collector over HTTP, partitioned across its shards
+type httpSink struct {
+	// clients are the shards that events are partitioned across by endpoint ID. If the client
+	// isn't sharded, there's only one.
+	clients []billing.Client
+}
+
+func (h httpSink) send(s eventSender, logger *zap.Logger, events []billing.AnyEvent, total int, startTime time.Time) error {
+	// If any shard fails, the whole chunk is retried. Events that were already pushed to the other
+	// shards are deduplicated by their idempotency keys.
+	return s.pushShards(logger, h.clients, events, total, startTime)
+}
+
+func (h httpSink) updated(next sink) sink {
+	return next
+}
+
+func (h httpSink) close(*zap.Logger) {}
+
+func (h httpSink) logField() zap.Field {
+	var urls []string
+	for _, client := range h.clients {
+		urls = append(urls, client.URL)
+	}
+	return zap.Strings("urls", urls)
+}
+
+// shardCountOf returns the number of shards that the sink partitions events across
+func shardCountOf(s sink) int {
+	if h, ok := s.(httpSink); ok {
+		return len(h.clients)
+	}
+	return 1
+}
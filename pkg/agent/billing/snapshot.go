@@ -0,0 +1,265 @@
+package billing
+
+// Persisting the usage accumulated since the last batch, so that it isn't lost if the collector is
+// restarted partway through a window.
+//
+// Snapshots are written to a file periodically, and restored on startup. Restored usage is sent in
+// the first batch after the restart, in a window that starts where the last batch before the
+// restart ended. Usage between the last snapshot and the restart isn't known, so it isn't billed.
+//
+// Usage that's been held back by a per-metric cadence (see cadence.go) is included as well, because
+// it may have been collected long before the current window.
+//
+// To make sure that usage is never sent twice, the snapshot is replaced before any of the usage in
+// it is enqueued. If the collector is restarted before the events are pushed, the usage is lost,
+// rather than being sent again with different idempotency keys.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type HistorySnapshotConfig struct {
+	// Path gives the file that snapshots are written to. It should be on a volume that persists
+	// across restarts, e.g. a hostPath.
+	Path string `json:"path"`
+	// EverySeconds gives the minimum interval between periodic snapshots. Snapshots are taken
+	// alongside collection, so the actual interval is rounded up to a multiple of
+	// collectEverySeconds.
+	EverySeconds uint `json:"everySeconds"`
+	// MaxAgeSeconds gives the maximum age of a snapshot that's restored on startup. Older snapshots
+	// are discarded, so that usage isn't sent long after the fact.
+	MaxAgeSeconds uint `json:"maxAgeSeconds"`
+}
+
+// historySnapshot is the format of the snapshot file
+type historySnapshot struct {
+	// Time is when the snapshot was taken
+	Time time.Time `json:"time"`
+	// WindowStart is the start of the window that the usage was accumulated in
+	WindowStart time.Time           `json:"windowStart"`
+	VMs         []historySnapshotVM `json:"vms"`
+	// Deferred is the usage that's been held back from past batches, which isn't included in VMs
+	Deferred []historySnapshotDeferred `json:"deferred,omitempty"`
+}
+
+// historySnapshotVM is the usage of a single VM in a historySnapshot. See vmMetricsSeconds for the
+// meaning of each field.
+type historySnapshotVM struct {
+	UID                  types.UID          `json:"uid"`
+	EndpointID           string             `json:"endpointID"`
+	CPU                  float64            `json:"cpu"`
+	ComputeUnits         float64            `json:"computeUnits"`
+	GPU                  float64            `json:"gpu"`
+	BurstComputeUnits    float64            `json:"burstComputeUnits,omitempty"`
+	UsedCPU              float64            `json:"usedCPU,omitempty"`
+	UsedComputeUnits     float64            `json:"usedComputeUnits,omitempty"`
+	ActiveTime           time.Duration      `json:"activeTime"`
+	InternalEgressBytes  uint64             `json:"internalEgressBytes"`
+	InternetEgressBytes  uint64             `json:"internetEgressBytes"`
+	EgressUnavailable    bool               `json:"egressUnavailable"`
+	InterfaceEgressBytes map[string]uint64  `json:"interfaceEgressBytes,omitempty"`
+	ContainerCPU         map[string]float64 `json:"containerCPU,omitempty"`
+	Upscales             uint               `json:"upscales"`
+	Downscales           uint               `json:"downscales"`
+}
+
+// historySnapshotDeferred is the held back usage of a single endpoint's metric in a
+// historySnapshot. See deferredUsage for the meaning of each field.
+type historySnapshotDeferred struct {
+	UID        types.UID `json:"uid"`
+	EndpointID string    `json:"endpointID"`
+	MetricName string    `json:"metricName"`
+	Start      time.Time `json:"start"`
+	Value      int       `json:"value"`
+	Partial    bool      `json:"partial"`
+}
+
+// maybeSaveHistorySnapshot writes a snapshot of the current usage, if snapshots are enabled and
+// it's been long enough since the last one
+func (s *metricsState) maybeSaveHistorySnapshot(logger *zap.Logger, now time.Time) {
+	if s.snapshot == nil || now.Sub(s.lastSnapshot) < time.Second*time.Duration(s.snapshot.EverySeconds) {
+		return
+	}
+	s.saveHistorySnapshot(logger, now, s.pushWindowStart, s.historical, s.deferredUsage)
+}
+
+// saveHistorySnapshot writes a snapshot of the usage in historical, accumulated since windowStart,
+// and the usage held back in deferred, if snapshots are enabled
+func (s *metricsState) saveHistorySnapshot(
+	logger *zap.Logger,
+	now time.Time,
+	windowStart time.Time,
+	historical map[metricsKey]vmMetricsHistory,
+	deferred map[roundingKey]deferredUsage,
+) {
+	if s.snapshot == nil {
+		return
+	}
+	s.lastSnapshot = now
+
+	snapshot := historySnapshot{
+		Time:        now,
+		WindowStart: windowStart,
+		VMs:         make([]historySnapshotVM, 0, len(historical)),
+	}
+	for key, history := range historical {
+		// history is a copy, so this doesn't affect the usage that's still being accumulated.
+		history.finalizeCurrentTimeSlice(s.computeUnit)
+		t := history.total
+		snapshot.VMs = append(snapshot.VMs, historySnapshotVM{
+			UID:                  key.uid,
+			EndpointID:           key.endpointID,
+			CPU:                  t.cpu,
+			ComputeUnits:         t.computeUnits,
+			GPU:                  t.gpu,
+			BurstComputeUnits:    t.burstComputeUnits,
+			UsedCPU:              t.usedCPU,
+			UsedComputeUnits:     t.usedComputeUnits,
+			ActiveTime:           t.activeTime,
+			InternalEgressBytes:  t.internalEgressBytes,
+			InternetEgressBytes:  t.internetEgressBytes,
+			EgressUnavailable:    t.egressUnavailable,
+			InterfaceEgressBytes: t.interfaceEgressBytes,
+			ContainerCPU:         t.containerCPU,
+			Upscales:             t.upscales,
+			Downscales:           t.downscales,
+		})
+	}
+	for rk, d := range deferred {
+		snapshot.Deferred = append(snapshot.Deferred, historySnapshotDeferred{
+			UID:        rk.uid,
+			EndpointID: rk.endpointID,
+			MetricName: rk.metricName,
+			Start:      d.start,
+			Value:      d.value,
+			Partial:    d.partial,
+		})
+	}
+
+	if err := writeHistorySnapshot(s.snapshot.Path, &snapshot); err != nil {
+		logger.Error("Failed to write billing history snapshot", zap.String("path", s.snapshot.Path), zap.Error(err))
+	}
+}
+
+// restoreHistorySnapshot replaces the current usage with the usage from the snapshot file, if
+// snapshots are enabled and there's a recent enough snapshot
+func (s *metricsState) restoreHistorySnapshot(logger *zap.Logger, now time.Time) {
+	if s.snapshot == nil {
+		return
+	}
+
+	snapshot, err := readHistorySnapshot(s.snapshot.Path)
+	if err != nil {
+		logger.Error("Failed to read billing history snapshot", zap.String("path", s.snapshot.Path), zap.Error(err))
+		return
+	} else if snapshot == nil {
+		return
+	}
+
+	if age := now.Sub(snapshot.Time); age > time.Second*time.Duration(s.snapshot.MaxAgeSeconds) {
+		logger.Warn(
+			"Discarding billing history snapshot that's too old",
+			zap.Time("time", snapshot.Time),
+			zap.Duration("age", age),
+			zap.Int("vms", len(snapshot.VMs)),
+		)
+		return
+	} else if snapshot.WindowStart.After(now) {
+		logger.Warn("Discarding billing history snapshot from the future", zap.Time("windowStart", snapshot.WindowStart))
+		return
+	}
+
+	s.historical = make(map[metricsKey]vmMetricsHistory)
+	for _, vm := range snapshot.VMs {
+		key := metricsKey{uid: vm.UID, endpointID: vm.EndpointID}
+		s.historical[key] = vmMetricsHistory{
+			lastSlice: nil,
+			total: vmMetricsSeconds{
+				cpu:                  vm.CPU,
+				computeUnits:         vm.ComputeUnits,
+				gpu:                  vm.GPU,
+				burstComputeUnits:    vm.BurstComputeUnits,
+				usedCPU:              vm.UsedCPU,
+				usedComputeUnits:     vm.UsedComputeUnits,
+				activeTime:           vm.ActiveTime,
+				internalEgressBytes:  vm.InternalEgressBytes,
+				internetEgressBytes:  vm.InternetEgressBytes,
+				egressUnavailable:    vm.EgressUnavailable,
+				interfaceEgressBytes: vm.InterfaceEgressBytes,
+				containerCPU:         vm.ContainerCPU,
+				upscales:             vm.Upscales,
+				downscales:           vm.Downscales,
+			},
+		}
+	}
+	s.deferredUsage = make(map[roundingKey]deferredUsage)
+	for _, d := range snapshot.Deferred {
+		rk := roundingKey{metricsKey: metricsKey{uid: d.UID, endpointID: d.EndpointID}, metricName: d.MetricName}
+		s.deferredUsage[rk] = deferredUsage{start: d.Start, value: d.Value, partial: d.Partial}
+	}
+	s.pushWindowStart = snapshot.WindowStart
+	s.lastSnapshot = now
+	s.backfillNotBefore = snapshot.Time
+
+	logger.Info(
+		"Restored billing history snapshot",
+		zap.Time("time", snapshot.Time),
+		zap.Time("windowStart", snapshot.WindowStart),
+		zap.Int("vms", len(snapshot.VMs)),
+		zap.Int("deferred", len(snapshot.Deferred)),
+	)
+}
+
+// readHistorySnapshot returns the snapshot in the file at path, or nil if the file doesn't exist
+func readHistorySnapshot(path string) (*historySnapshot, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading file: %w", err)
+	}
+
+	var snapshot historySnapshot
+	if err := json.Unmarshal(contents, &snapshot); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+func writeHistorySnapshot(path string, snapshot *historySnapshot) error {
+	contents, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("Error marshaling snapshot: %w", err)
+	}
+
+	// Write to a temporary file and then rename, so that we never leave a partially-written file
+	// behind if we're interrupted.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // no-op after a successful rename
+
+	if _, err := tmp.Write(contents); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("Error writing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error replacing file: %w", err)
+	}
+	return nil
+}
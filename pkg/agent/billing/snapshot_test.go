@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func TestHistorySnapshot(t *testing.T) {
+	logger := zap.NewNop()
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	conf := &HistorySnapshotConfig{
+		Path:          filepath.Join(t.TempDir(), "history.json"),
+		EverySeconds:  60,
+		MaxAgeSeconds: 600,
+	}
+
+	key := metricsKey{uid: "vm-uid", endpointID: "ep-a"}
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.snapshot = conf
+	s.pushWindowStart = start
+	s.historical = map[metricsKey]vmMetricsHistory{
+		key: {
+			// The current slice is included in the snapshot, but left as-is
+			lastSlice: &metricsTimeSlice{
+				metrics: vmMetricsInstant{
+					cpu:               2000,
+					mem:               0,
+					gpus:              0,
+					idle:              false,
+					egress:            nil,
+					egressUnavailable: false,
+					containerCPU:      nil,
+					burstBaselineCU:   0,
+					usedCPU:           0,
+					usedMem:           0,
+				},
+				startTime: start.Add(30 * time.Second),
+				endTime:   start.Add(60 * time.Second),
+			},
+			total: vmMetricsSeconds{
+				cpu:                  30,
+				computeUnits:         0,
+				gpu:                  0,
+				burstComputeUnits:    0,
+				usedCPU:              0,
+				usedComputeUnits:     0,
+				activeTime:           30 * time.Second,
+				internalEgressBytes:  0,
+				internetEgressBytes:  1000,
+				egressUnavailable:    false,
+				interfaceEgressBytes: nil,
+				containerCPU:         map[string]float64{"pooler": 1.5},
+				upscales:             1,
+				downscales:           0,
+			},
+		},
+	}
+
+	// Not long enough since the last snapshot
+	s.lastSnapshot = start
+	s.maybeSaveHistorySnapshot(logger, start.Add(30*time.Second))
+	snapshot, err := readHistorySnapshot(conf.Path)
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	s.maybeSaveHistorySnapshot(logger, start.Add(time.Minute))
+	assert.NotNil(t, s.historical[key].lastSlice)
+
+	restored := new(metricsState)
+	restored.snapshot = conf
+	restored.restoreHistorySnapshot(logger, start.Add(2*time.Minute))
+	assert.Equal(t, start, restored.pushWindowStart)
+	assert.Equal(t, vmMetricsSeconds{
+		cpu:                  90,
+		computeUnits:         0,
+		gpu:                  0,
+		burstComputeUnits:    0,
+		usedCPU:              0,
+		usedComputeUnits:     0,
+		activeTime:           time.Minute,
+		internalEgressBytes:  0,
+		internetEgressBytes:  1000,
+		egressUnavailable:    false,
+		interfaceEgressBytes: nil,
+		containerCPU:         map[string]float64{"pooler": 1.5},
+		upscales:             1,
+		downscales:           0,
+	}, restored.historical[key].total)
+
+	// Snapshots that are too old are discarded
+	restored = new(metricsState)
+	restored.snapshot = conf
+	restored.restoreHistorySnapshot(logger, start.Add(time.Hour))
+	assert.Empty(t, restored.historical)
+
+	// Once the usage is enqueued, it's no longer restored
+	s.saveHistorySnapshot(logger, start.Add(2*time.Minute), start.Add(2*time.Minute), nil, nil)
+	restored = new(metricsState)
+	restored.snapshot = conf
+	restored.restoreHistorySnapshot(logger, start.Add(3*time.Minute))
+	assert.Equal(t, start.Add(2*time.Minute), restored.pushWindowStart)
+	assert.Empty(t, restored.historical)
+}
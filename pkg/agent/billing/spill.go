@@ -0,0 +1,255 @@
+package billing
+
+// Spilling of events that overflowed a client's queue to disk, so that they're sent once the
+// client's endpoint is reachable again, rather than being held in memory or dropped.
+//
+// Events are written as the payloads that are sent, so that they can be sent again as-is, without
+// needing to be parsed. Spilled events are kept across restarts, and sent before anything in the
+// queue, because they're older.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// spillExt is the extension of spilled payloads. Files are written with a temporary name first,
+// so that partially written payloads are never sent.
+const spillExt = ".json"
+
+// spillStore is the directory that a client's events are spilled to
+type spillStore struct {
+	dir  string
+	next uint64
+	// clock gives the time that payloads are written, which orders them and is used for the push
+	// lag of spilled events
+	clock util.Clock
+}
+
+func newSpillStore(dir string, client string, clock util.Clock) (*spillStore, error) {
+	dir = filepath.Join(dir, client)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating spill directory: %w", err)
+	}
+	return &spillStore{dir: dir, next: 0, clock: clock}, nil
+}
+
+// write stores the events for each shard on disk, in payloads of at most batchSize events
+func (s *spillStore) write(shards [][]billing.AnyEvent, batchSize int) error {
+	for shard, events := range shards {
+		for len(events) != 0 {
+			count := len(events)
+			if batchSize != 0 && count > batchSize {
+				count = batchSize
+			}
+
+			payload, err := billing.Marshal(events[:count])
+			if err != nil {
+				return err
+			}
+
+			p := spilledPayload{
+				path:    "", // set by writePayload
+				seq:     s.next,
+				shard:   shard,
+				shards:  len(shards),
+				count:   count,
+				written: s.clock.Now(),
+			}
+			s.next += 1
+			if _, err := s.writePayload(p, payload); err != nil {
+				return err
+			}
+
+			events = events[count:]
+		}
+	}
+	return nil
+}
+
+// writePayload stores the payload on disk with the name for p, returning p with its path
+func (s *spillStore) writePayload(p spilledPayload, payload []byte) (spilledPayload, error) {
+	// Names sort in the order they were written. The shard, number of shards, and count are
+	// included so that the payload doesn't need to be parsed to find them.
+	name := fmt.Sprintf("%020d-%08d-%d-%d-%d", p.written.UnixNano(), p.seq, p.shard, p.shards, p.count)
+	p.path = filepath.Join(s.dir, name+spillExt)
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, payload, 0o644); err != nil {
+		return p, fmt.Errorf("Error writing spilled events: %w", err)
+	}
+	if err := os.Rename(tmpPath, p.path); err != nil {
+		return p, fmt.Errorf("Error renaming spilled events: %w", err)
+	}
+	return p, nil
+}
+
+// spilledPayload is a single payload of events that was spilled to disk
+type spilledPayload struct {
+	path string
+	seq  uint64
+	// shard is the index of the shard that the events were partitioned into, out of shards. If the
+	// number of shards isn't known, because the payload was spilled by an older version, shards is
+	// zero.
+	shard  int
+	shards int
+	count  int
+	// written is when the payload was spilled
+	written time.Time
+}
+
+// list returns all of the spilled payloads, oldest first, along with the paths of any files that
+// don't have a valid name, and so can't be sent
+func (s *spillStore) list() (payloads []spilledPayload, bad []string, _ error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading spill directory: %w", err)
+	}
+
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), spillExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		p, ok := parseSpillName(name)
+		if !ok {
+			bad = append(bad, path)
+			continue
+		}
+		p.path = path
+		payloads = append(payloads, p)
+	}
+	// ReadDir sorts by name, which is the order that the payloads were written.
+	return payloads, bad, nil
+}
+
+// parseSpillName returns the payload with the name (without the extension), or false if it isn't
+// a valid name. Names from older versions are accepted, which were one of:
+//
+//   - "<written>-<seq>-<count>", from before sharding
+//   - "<written>-<seq>-<shard>-<count>", from before the number of shards was included
+func parseSpillName(name string) (spilledPayload, bool) {
+	parts := strings.Split(name, "-")
+	var shardPart, shardsPart, countPart string
+	switch len(parts) {
+	case 3:
+		shardPart, shardsPart, countPart = "0", "0", parts[2]
+	case 4:
+		shardPart, shardsPart, countPart = parts[2], "0", parts[3]
+	case 5:
+		shardPart, shardsPart, countPart = parts[2], parts[3], parts[4]
+	default:
+		return spilledPayload{}, false
+	}
+
+	written, writtenErr := strconv.ParseInt(parts[0], 10, 64)
+	seq, seqErr := strconv.ParseUint(parts[1], 10, 64)
+	shard, shardErr := strconv.Atoi(shardPart)
+	shards, shardsErr := strconv.Atoi(shardsPart)
+	count, countErr := strconv.Atoi(countPart)
+	if writtenErr != nil || seqErr != nil || shardErr != nil || shardsErr != nil || countErr != nil ||
+		shard < 0 || shards < 0 || (shards != 0 && shard >= shards) || count < 0 {
+		return spilledPayload{}, false
+	}
+	return spilledPayload{
+		path:    "",
+		seq:     seq,
+		shard:   shard,
+		shards:  shards,
+		count:   count,
+		written: time.Unix(0, written),
+	}, true
+}
+
+// quarantineExt is added to the names of spilled files that can't be sent, so that they're kept
+// for inspection without being listed again
+const quarantineExt = ".quarantined"
+
+// quarantine moves the file aside, so that it's no longer sent
+func (s *spillStore) quarantine(path string) error {
+	if err := os.Rename(path, path+quarantineExt); err != nil {
+		return fmt.Errorf("Error quarantining spilled events: %w", err)
+	}
+	return nil
+}
+
+// reshard splits the payload into one for each of the current shards that its events belong to,
+// returning the new payloads in place of the old one, which is removed
+//
+// The new payloads have the same position in the order as the one they replace, so that the events
+// for each shard are still sent in the order they were spilled.
+func (s *spillStore) reshard(p spilledPayload, shards int) ([]spilledPayload, error) {
+	contents, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading spilled events: %w", err)
+	}
+	var body struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(contents, &body); err != nil {
+		return nil, spillParseError{Err: err}
+	}
+
+	groups := make([][]json.RawMessage, shards)
+	for _, raw := range body.Events {
+		var e struct {
+			EndpointID string `json:"endpoint_id"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, spillParseError{Err: err}
+		}
+		shard := shardOf(e.EndpointID, shards)
+		groups[shard] = append(groups[shard], raw)
+	}
+
+	var payloads []spilledPayload
+	for shard, events := range groups {
+		if len(events) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(struct {
+			Events []json.RawMessage `json:"events"`
+		}{Events: events})
+		if err != nil {
+			return nil, err
+		}
+		written, err := s.writePayload(spilledPayload{
+			path:    "", // set by writePayload
+			seq:     p.seq,
+			shard:   shard,
+			shards:  shards,
+			count:   len(events),
+			written: p.written,
+		}, payload)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, written)
+	}
+
+	if err := os.Remove(p.path); err != nil {
+		return nil, fmt.Errorf("Error removing resharded spilled events: %w", err)
+	}
+	return payloads, nil
+}
+
+// spillParseError is returned by reshard if the spilled payload can't be parsed, so it'll never be
+// possible to send it
+type spillParseError struct {
+	Err error
+}
+
+func (e spillParseError) Error() string {
+	return fmt.Sprintf("Error parsing spilled events: %s", e.Err)
+}
+
+func (e spillParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,196 @@
+package billing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestParseSpillName(t *testing.T) {
+	written := time.Unix(0, 1700000000000000000)
+	cases := []struct {
+		name     string
+		expected spilledPayload
+	}{
+		// The current format
+		{"01700000000000000000-00000003-1-2-10", spilledPayload{path: "", seq: 3, shard: 1, shards: 2, count: 10, written: written}},
+		// Before the number of shards was included
+		{"01700000000000000000-00000003-1-10", spilledPayload{path: "", seq: 3, shard: 1, shards: 0, count: 10, written: written}},
+		// Before sharding
+		{"01700000000000000000-00000003-10", spilledPayload{path: "", seq: 3, shard: 0, shards: 0, count: 10, written: written}},
+	}
+	for _, c := range cases {
+		p, ok := parseSpillName(c.name)
+		assert.True(t, ok, c.name)
+		assert.Equal(t, c.expected, p, c.name)
+	}
+
+	for _, name := range []string{
+		"",
+		"garbage",
+		"01700000000000000000-00000003",
+		"01700000000000000000-00000003-x-10",
+		"01700000000000000000-00000003-2-2-10",
+		"01700000000000000000-00000003-0-1-2-10",
+	} {
+		_, ok := parseSpillName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestSendSpilled(t *testing.T) {
+	// Find endpoints for each of the two shards
+	var endpoints [2][]string
+	for i := 0; len(endpoints[0]) < 2 || len(endpoints[1]) < 2; i++ {
+		ep := fmt.Sprintf("ep-%d", i)
+		shard := shardOf(ep, 2)
+		endpoints[shard] = append(endpoints[shard], ep)
+	}
+	event := func(endpointID string) billing.AnyEvent {
+		//nolint:exhaustruct // only the endpoint matters here
+		return &billing.IncrementalEvent{MetricName: "cpu", EndpointID: endpointID, Value: 1}
+	}
+
+	// The first shard accepts everything, and the second fails every request
+	var mu sync.Mutex
+	var received [2][]string
+	var requests [2]int
+	var servers [2]*httptest.Server
+	for shard := range servers {
+		servers[shard] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Events []struct {
+					EndpointID string `json:"endpoint_id"`
+				} `json:"events"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			requests[shard] += 1
+			if shard == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			for _, e := range body.Events {
+				received[shard] = append(received[shard], e.EndpointID)
+			}
+		}))
+		defer servers[shard].Close()
+	}
+
+	spill, err := newSpillStore(t.TempDir(), "test", util.RealClock)
+	require.NoError(t, err)
+
+	// A payload from before sharding, with events for both shards
+	old, err := billing.Marshal([]billing.AnyEvent{event(endpoints[0][0]), event(endpoints[1][0])})
+	require.NoError(t, err)
+	oldName := fmt.Sprintf("%020d-%08d-%d%s", time.Now().UnixNano(), 0, 2, spillExt)
+	require.NoError(t, os.WriteFile(filepath.Join(spill.dir, oldName), old, 0o644))
+	// ... then a payload for each shard, and a file that can't be parsed.
+	require.NoError(t, spill.write(partitionByShard([]billing.AnyEvent{
+		event(endpoints[0][1]), event(endpoints[1][1]),
+	}, 2), 0))
+	require.NoError(t, os.WriteFile(filepath.Join(spill.dir, "garbage"+spillExt), []byte("{}"), 0o644))
+
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.metrics = NewPromMetrics()
+	sender.name = "test"
+	sender.clock = util.NewFakeClock(time.Now())
+	sender.config.PushRequestTimeoutSeconds = 5
+	sender.spill = spill
+	sender.sink = httpSink{clients: []billing.Client{
+		billing.NewClient(servers[0].URL, http.DefaultClient),
+		billing.NewClient(servers[1].URL, http.DefaultClient),
+	}}
+
+	// The first shard gets all of its events, in order, even though the second one fails. The
+	// second shard isn't sent anything more after its first failure, so that its events stay in
+	// order.
+	sent, err := sender.sendSpilled(zap.NewNop())
+	assert.Error(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []string{endpoints[0][0], endpoints[0][1]}, received[0])
+	assert.Equal(t, 1, requests[1])
+
+	// The file that couldn't be parsed is moved aside, and what's left is the second shard's
+	// events, routed by the current number of shards.
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.spillQuarantinedFilesTotal.WithLabelValues("test")))
+	assert.FileExists(t, filepath.Join(spill.dir, "garbage"+spillExt+quarantineExt))
+	payloads, bad, err := spill.list()
+	require.NoError(t, err)
+	assert.Empty(t, bad)
+	var left []string
+	for _, p := range payloads {
+		assert.Equal(t, 1, p.shard)
+		assert.Equal(t, 2, p.shards)
+		contents, err := os.ReadFile(p.path)
+		require.NoError(t, err)
+		var body struct {
+			Events []struct {
+				EndpointID string `json:"endpoint_id"`
+			} `json:"events"`
+		}
+		require.NoError(t, json.Unmarshal(contents, &body))
+		for _, e := range body.Events {
+			left = append(left, e.EndpointID)
+		}
+	}
+	// The resharded payload is still first, because it's the oldest.
+	assert.Equal(t, []string{endpoints[1][0], endpoints[1][1]}, left)
+}
+
+func TestSendSpilledRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	spill, err := newSpillStore(t.TempDir(), "test", util.RealClock)
+	require.NoError(t, err)
+	//nolint:exhaustruct // only the endpoint matters here
+	events := []billing.AnyEvent{&billing.IncrementalEvent{MetricName: "cpu", EndpointID: "ep-1", Value: 1}}
+	require.NoError(t, spill.write(partitionByShard(events, 1), 0))
+	payloads, _, err := spill.list()
+	require.NoError(t, err)
+	require.Len(t, payloads, 1)
+
+	var sender eventSender
+	sender.tracer = trace.NewNoopTracerProvider().Tracer("")
+	sender.metrics = NewPromMetrics()
+	sender.name = "test"
+	sender.clock = util.NewFakeClock(time.Now())
+	sender.config.PushRequestTimeoutSeconds = 5
+	sender.spill = spill
+	sender.sink = httpSink{clients: []billing.Client{billing.NewClient(server.URL, http.DefaultClient)}}
+
+	// A spilled payload can't be split to find out which of its events were rejected, so the whole
+	// file is moved aside rather than deleted, and it doesn't hold up the rest.
+	sent, err := sender.sendSpilled(zap.NewNop())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.FileExists(t, payloads[0].path+quarantineExt)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.spillQuarantinedFilesTotal.WithLabelValues("test")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(sender.metrics.sendDroppedEventsTotal.WithLabelValues("test", dropReasonRejected)))
+	left, _, err := spill.list()
+	require.NoError(t, err)
+	assert.Empty(t, left)
+}
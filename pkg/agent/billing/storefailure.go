@@ -0,0 +1,158 @@
+package billing
+
+// Handling for when the VM store is failing, so that an outage of the watch on VMs doesn't silently
+// stop all billing.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+)
+
+type StoreFailureConfig struct {
+	// RetryBackoffMaxSeconds, if non-zero, makes the VM watch back off exponentially while it keeps
+	// failing to re-list or re-watch, up to this maximum delay between retries.
+	//
+	// The VM watch is shared with the rest of the autoscaler-agent, so changes to this field require
+	// a restart.
+	RetryBackoffMaxSeconds uint `json:"retryBackoffMaxSeconds,omitempty"`
+	// FallbackListEverySeconds, if non-zero, enables listing the VMs directly from the API server
+	// while the VM store is failing, at most once per this interval. Between lists, collection uses
+	// the VMs from the latest one.
+	FallbackListEverySeconds uint `json:"fallbackListEverySeconds,omitempty"`
+	// FallbackListTimeoutSeconds gives the timeout for each direct list of VMs. It must be set if
+	// FallbackListEverySeconds is.
+	FallbackListTimeoutSeconds uint `json:"fallbackListTimeoutSeconds,omitempty"`
+}
+
+func (c *StoreFailureConfig) retryBackoffMaxSeconds() uint {
+	if c == nil {
+		return 0
+	}
+	return c.RetryBackoffMaxSeconds
+}
+
+// VMLister lists the VMs on this node directly from the API server, bypassing the VM store
+type VMLister func(ctx context.Context) ([]*vmapi.VirtualMachine, error)
+
+// NewVMLister returns a VMLister that uses the client to list the VMs on the node
+func NewVMLister(client vmclient.Interface, node string) VMLister {
+	return newIndexLister(client, func() *VMNodeIndex { return NewVMNodeIndex(node) })
+}
+
+// NewVMShardLister is like NewVMLister, but lists the VMs in the shard across the whole cluster,
+// for use with NewVMShardIndex
+func NewVMShardLister(client vmclient.Interface, shard int, count int) VMLister {
+	return newIndexLister(client, func() *VMNodeIndex { return NewVMShardIndex(shard, count) })
+}
+
+func newIndexLister(client vmclient.Interface, newIndex func() *VMNodeIndex) VMLister {
+	return func(ctx context.Context) ([]*vmapi.VirtualMachine, error) {
+		list, err := client.NeonvmV1().VirtualMachines(corev1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing VMs: %w", err)
+		}
+
+		// As with the VM store, we can't have the API server filter by node for us.
+		index := newIndex()
+		for i := range list.Items {
+			index.Add(&list.Items[i])
+		}
+		return index.List(), nil
+	}
+}
+
+// storeFailureState tracks an ongoing failure of the VM store
+type storeFailureState struct {
+	// failingSince is the time of the first collection that found the store failing, or nil if it
+	// isn't currently failing
+	failingSince *time.Time
+	// lastListAttempt is the time of the latest attempt to list VMs directly, during this failure
+	lastListAttempt *time.Time
+	// listed is the result of the latest direct list of VMs, or nil if it failed
+	listed []*vmapi.VirtualMachine
+}
+
+// vmsWhileStoreFailing records that the VM store is failing, returning the VMs to collect from in
+// the meantime, if they can be listed directly.
+func (s *metricsState) vmsWhileStoreFailing(
+	ctx context.Context,
+	logger *zap.Logger,
+	now time.Time,
+	metrics PromMetrics,
+) []*vmapi.VirtualMachine {
+	f := &s.storeFailure
+	if f.failingSince == nil {
+		f.failingSince = &now
+	}
+	outage := now.Sub(*f.failingSince)
+	metrics.storeOutageSeconds.Set(outage.Seconds())
+	if s.reporter != nil {
+		s.reporter.VMStoreFailing(outage)
+	}
+
+	conf := s.storeFailureConf
+	if conf == nil || conf.FallbackListEverySeconds == 0 {
+		logger.Error("VM store is currently stopped. No events will be recorded", zap.Duration("outage", outage))
+		return nil
+	}
+
+	if f.lastListAttempt == nil || now.Sub(*f.lastListAttempt) >= time.Second*time.Duration(conf.FallbackListEverySeconds) {
+		f.lastListAttempt = &now
+
+		listCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(conf.FallbackListTimeoutSeconds))
+		defer cancel()
+
+		vms, err := s.listVMs(listCtx)
+		if err != nil {
+			metrics.fallbackListsTotal.WithLabelValues("failure").Inc()
+			f.listed = nil
+			logger.Error(
+				"VM store is currently stopped and listing VMs directly failed. No events will be recorded",
+				zap.Duration("outage", outage),
+				zap.Error(err),
+			)
+			return nil
+		}
+		metrics.fallbackListsTotal.WithLabelValues("success").Inc()
+		f.listed = vms
+	}
+
+	if f.listed == nil {
+		logger.Error("VM store is currently stopped and listing VMs directly failed. No events will be recorded", zap.Duration("outage", outage))
+		return nil
+	}
+
+	logger.Warn(
+		"VM store is currently stopped. Using VMs listed directly from the API server",
+		zap.Duration("outage", outage),
+		zap.Time("listedAt", *f.lastListAttempt),
+		zap.Int("count", len(f.listed)),
+	)
+	return f.listed
+}
+
+// storeNotFailing records that the VM store is working, ending any failure that was ongoing
+func (s *metricsState) storeNotFailing(logger *zap.Logger, now time.Time, metrics PromMetrics) {
+	if s.storeFailure.failingSince != nil {
+		logger.Info("VM store has recovered", zap.Duration("outage", now.Sub(*s.storeFailure.failingSince)))
+		if s.reporter != nil {
+			s.reporter.VMStoreRecovered()
+		}
+	}
+
+	s.storeFailure = storeFailureState{
+		failingSince:    nil,
+		lastListAttempt: nil,
+		listed:          nil,
+	}
+	metrics.storeOutageSeconds.Set(0)
+}
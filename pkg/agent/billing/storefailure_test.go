@@ -0,0 +1,122 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+type fakeStatusReporter struct {
+	outages   []time.Duration
+	recovered int
+}
+
+func (r *fakeStatusReporter) VMStoreFailing(outage time.Duration) {
+	r.outages = append(r.outages, outage)
+}
+
+func (r *fakeStatusReporter) VMStoreRecovered() {
+	r.recovered += 1
+}
+
+func (r *fakeStatusReporter) QueueSize(string, int)    {}
+func (r *fakeStatusReporter) PushResult(string, error) {}
+
+func TestVMsWhileStoreFailing(t *testing.T) {
+	logger := zap.NewNop()
+	ctx := context.Background()
+	metrics := NewPromMetrics()
+	reporter := &fakeStatusReporter{outages: nil, recovered: 0}
+
+	vm := new(vmapi.VirtualMachine)
+	vm.Name = "vm"
+	var listErr error
+	lists := 0
+
+	s := &metricsState{ //nolint:exhaustruct // only the fields used for store failures
+		storeFailureConf: &StoreFailureConfig{
+			RetryBackoffMaxSeconds:     0,
+			FallbackListEverySeconds:   60,
+			FallbackListTimeoutSeconds: 5,
+		},
+		listVMs: func(ctx context.Context) ([]*vmapi.VirtualMachine, error) {
+			lists += 1
+			if listErr != nil {
+				return nil, listErr
+			}
+			return []*vmapi.VirtualMachine{vm}, nil
+		},
+		reporter: reporter,
+	}
+	fallbackLists := func(result string) float64 {
+		return testutil.ToFloat64(metrics.fallbackListsTotal.WithLabelValues(result))
+	}
+
+	start := time.Unix(1000, 0)
+
+	// The first collection with the store failing lists the VMs directly
+	vms := s.vmsWhileStoreFailing(ctx, logger, start, metrics)
+	assert.Equal(t, []*vmapi.VirtualMachine{vm}, vms)
+	assert.Equal(t, 1, lists)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.storeOutageSeconds))
+
+	// Collections within FallbackListEverySeconds reuse the latest list, while the outage grows
+	vms = s.vmsWhileStoreFailing(ctx, logger, start.Add(30*time.Second), metrics)
+	assert.Equal(t, []*vmapi.VirtualMachine{vm}, vms)
+	assert.Equal(t, 1, lists)
+	assert.Equal(t, float64(30), testutil.ToFloat64(metrics.storeOutageSeconds))
+
+	// Once the interval has passed, the VMs are listed again. If that fails, nothing is collected
+	// until the next successful list.
+	listErr = errors.New("list failed")
+	vms = s.vmsWhileStoreFailing(ctx, logger, start.Add(60*time.Second), metrics)
+	assert.Nil(t, vms)
+	vms = s.vmsWhileStoreFailing(ctx, logger, start.Add(90*time.Second), metrics)
+	assert.Nil(t, vms)
+	assert.Equal(t, 2, lists)
+	assert.Equal(t, float64(1), fallbackLists("success"))
+	assert.Equal(t, float64(1), fallbackLists("failure"))
+
+	listErr = nil
+	vms = s.vmsWhileStoreFailing(ctx, logger, start.Add(120*time.Second), metrics)
+	assert.Equal(t, []*vmapi.VirtualMachine{vm}, vms)
+	assert.Equal(t, 3, lists)
+
+	assert.Equal(t, []time.Duration{0, 30 * time.Second, 60 * time.Second, 90 * time.Second, 120 * time.Second}, reporter.outages)
+	assert.Equal(t, 0, reporter.recovered)
+
+	// Recovery ends the outage, and the next failure starts a new one
+	s.storeNotFailing(logger, start.Add(150*time.Second), metrics)
+	assert.Equal(t, 1, reporter.recovered)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.storeOutageSeconds))
+	s.storeNotFailing(logger, start.Add(180*time.Second), metrics)
+	assert.Equal(t, 1, reporter.recovered)
+
+	vms = s.vmsWhileStoreFailing(ctx, logger, start.Add(200*time.Second), metrics)
+	assert.Equal(t, []*vmapi.VirtualMachine{vm}, vms)
+	assert.Equal(t, 4, lists)
+	assert.Equal(t, time.Duration(0), reporter.outages[len(reporter.outages)-1])
+}
+
+func TestVMsWhileStoreFailingWithoutFallback(t *testing.T) {
+	metrics := NewPromMetrics()
+	s := &metricsState{ //nolint:exhaustruct // only the fields used for store failures
+		storeFailureConf: nil,
+		listVMs: func(ctx context.Context) ([]*vmapi.VirtualMachine, error) {
+			t.Fatal("VMs should not be listed without a fallback configured")
+			return nil, nil
+		},
+	}
+
+	start := time.Unix(1000, 0)
+	assert.Nil(t, s.vmsWhileStoreFailing(context.Background(), zap.NewNop(), start, metrics))
+	assert.Nil(t, s.vmsWhileStoreFailing(context.Background(), zap.NewNop(), start.Add(time.Minute), metrics))
+	assert.Equal(t, float64(60), testutil.ToFloat64(metrics.storeOutageSeconds))
+}
@@ -0,0 +1,152 @@
+package billing
+
+// Periodic summary of the collector and senders, logged at info level in place of the details of
+// each collection, event, and push (which are logged at debug level).
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type logSummary struct {
+	mu sync.Mutex
+
+	// collections is the number of times the collector has run since the last summary
+	collections int
+	// vmsCollected is the number of endpoint VMs found by the most recent collection
+	vmsCollected int
+	// eventsEnqueued is the number of events added to the queues since the last summary
+	eventsEnqueued int
+
+	clients map[string]*clientSummary
+
+	clock util.Clock
+}
+
+type clientSummary struct {
+	queue eventQueuePusher[billing.AnyEvent]
+
+	// eventsSent is the number of events successfully pushed since the last summary
+	eventsSent int
+	// lastPush and lastPushResult describe the most recent attempt to push events, if any
+	lastPush       *time.Time
+	lastPushResult string
+}
+
+// clientSummaryLog is the form of clientSummary that's included in the log line
+type clientSummaryLog struct {
+	QueueSize      int        `json:"queueSize"`
+	EventsSent     int        `json:"eventsSent"`
+	LastPush       *time.Time `json:"lastPush"`
+	LastPushResult string     `json:"lastPushResult"`
+}
+
+// newSummaryTicker returns the ticker for logging the summary every interval of the seconds, which
+// is stopped if the seconds are zero, because the summary is disabled.
+func newSummaryTicker(clock util.Clock, seconds uint) util.Ticker {
+	// A ticker can't be created without a positive interval, so a disabled one is stopped straight
+	// away instead.
+	ticker := clock.NewTicker(time.Second * time.Duration(util.Max(seconds, 1)))
+	if seconds == 0 {
+		ticker.Stop()
+	}
+	return ticker
+}
+
+// resetSummaryTicker changes the interval of a ticker from newSummaryTicker, stopping it if the
+// seconds are zero, or starting it again if they aren't.
+func resetSummaryTicker(ticker util.Ticker, seconds uint) {
+	if seconds == 0 {
+		ticker.Stop()
+	} else {
+		ticker.Reset(time.Second * time.Duration(seconds))
+	}
+}
+
+func newLogSummary(clock util.Clock) *logSummary {
+	return &logSummary{
+		mu:             sync.Mutex{},
+		collections:    0,
+		vmsCollected:   0,
+		eventsEnqueued: 0,
+		clients:        make(map[string]*clientSummary),
+		clock:          clock,
+	}
+}
+
+func (s *logSummary) addClient(name string, queue eventQueuePusher[billing.AnyEvent]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[name] = &clientSummary{
+		queue:          queue,
+		eventsSent:     0,
+		lastPush:       nil,
+		lastPushResult: "",
+	}
+}
+
+func (s *logSummary) recordCollection(vms int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collections += 1
+	s.vmsCollected = vms
+}
+
+func (s *logSummary) recordEnqueued(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.eventsEnqueued += count
+}
+
+// recordPush updates the summary for the client after an attempt to push all events in its queue,
+// where sent is the number of events that were successfully pushed before err, if any.
+func (s *logSummary) recordPush(client string, sent int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[client]
+	if !ok {
+		return
+	}
+
+	now := s.clock.Now()
+	c.eventsSent += sent
+	c.lastPush = &now
+	c.lastPushResult = responseClass(err)
+}
+
+// log emits the summary and resets the counters that are relative to the previous summary
+func (s *logSummary) log(logger *zap.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make(map[string]clientSummaryLog)
+	for name, c := range s.clients {
+		clients[name] = clientSummaryLog{
+			QueueSize:      c.queue.size(),
+			EventsSent:     c.eventsSent,
+			LastPush:       c.lastPush,
+			LastPushResult: c.lastPushResult,
+		}
+		c.eventsSent = 0
+	}
+
+	logger.Info(
+		"Billing summary",
+		zap.Int("collections", s.collections),
+		zap.Int("vmsCollected", s.vmsCollected),
+		zap.Int("eventsEnqueued", s.eventsEnqueued),
+		zap.Any("clients", clients),
+	)
+
+	s.collections = 0
+	s.eventsEnqueued = 0
+}
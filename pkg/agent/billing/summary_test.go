@@ -0,0 +1,46 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestSummaryTicker(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC))
+	ticked := func(ticker util.Ticker) bool {
+		select {
+		case <-ticker.C():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// With an interval of zero, the summary is disabled, so the ticker never fires
+	ticker := newSummaryTicker(clock, 0)
+	clock.Advance(time.Hour)
+	assert.False(t, ticked(ticker))
+
+	// ... until it's enabled on reload
+	resetSummaryTicker(ticker, 60)
+	clock.Advance(59 * time.Second)
+	assert.False(t, ticked(ticker))
+	clock.Advance(time.Second)
+	assert.True(t, ticked(ticker))
+
+	// ... and then disabled again
+	resetSummaryTicker(ticker, 0)
+	clock.Advance(time.Hour)
+	assert.False(t, ticked(ticker))
+
+	// Otherwise, it fires every interval
+	ticker = newSummaryTicker(clock, 30)
+	clock.Advance(30 * time.Second)
+	assert.True(t, ticked(ticker))
+	clock.Advance(30 * time.Second)
+	assert.True(t, ticked(ticker))
+}
@@ -0,0 +1,238 @@
+package billing
+
+// Sources of the counters of each VM's usage that aren't part of its allocation, like the bytes it's
+// sent over the network.
+//
+// By default, the counters come from each VM's runner, which is the only source that can classify
+// network traffic by its destination. Runners that don't provide them (e.g. in forks with their own
+// runner) can use the vector.dev exporter inside the VM instead, and the mock source generates them
+// at fixed rates, for testing billing without any real traffic.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// UsageSource provides the current usage counters of VMs
+//
+// Each counter only increases, except when it's reset, e.g. when the VM restarts or is migrated.
+// A decrease in any of the network counters is treated as all of them being reset.
+type UsageSource interface {
+	// GetUsage returns the VM's current counters. The context has the timeout for the request.
+	GetUsage(ctx context.Context, vm *vmapi.VirtualMachine) (*VMUsage, error)
+}
+
+// VMUsage is the usage counters of a VM, from a UsageSource
+type VMUsage struct {
+	Network api.NetworkUsage
+	// Disk is nil if the source doesn't provide disk usage. It's not billed yet.
+	Disk *DiskUsage
+}
+
+// DiskUsage is the total bytes read from and written to a VM's disks
+type DiskUsage struct {
+	ReadBytes    uint64
+	WrittenBytes uint64
+}
+
+type UsageSourceKind string
+
+const (
+	// UsageSourceRunner fetches network usage from each VM's runner. It's the default.
+	UsageSourceRunner UsageSourceKind = "runner"
+	// UsageSourceVector scrapes network and disk usage from vector.dev's host metrics, exported
+	// from inside each VM. See VectorUsageConfig.
+	UsageSourceVector UsageSourceKind = "vector"
+	// UsageSourceMock generates usage at fixed rates. See MockUsageConfig.
+	UsageSourceMock UsageSourceKind = "mock"
+)
+
+// Valid returns whether k is one of the known kinds of usage source, or empty
+func (k UsageSourceKind) Valid() bool {
+	switch k {
+	case "", UsageSourceRunner, UsageSourceVector, UsageSourceMock:
+		return true
+	default:
+		return false
+	}
+}
+
+type UsageSourceConfig struct {
+	// Kind selects the source. Defaults to UsageSourceRunner.
+	Kind UsageSourceKind `json:"kind"`
+	// Vector must be provided if and only if Kind is UsageSourceVector
+	Vector *VectorUsageConfig `json:"vector,omitempty"`
+	// Mock must be provided if and only if Kind is UsageSourceMock
+	Mock *MockUsageConfig `json:"mock,omitempty"`
+}
+
+type VectorUsageConfig struct {
+	// Port is the port of vector.dev's Prometheus exporter in each VM
+	Port uint16 `json:"port"`
+	// NetworkDevices lists the network interfaces in the VM whose transmitted bytes are counted.
+	//
+	// vector.dev can't tell where traffic was sent, so all of it is counted as internet egress,
+	// and EgressConfig.InternalCIDRs has no effect.
+	NetworkDevices []string `json:"networkDevices"`
+	// DiskDevices, if not empty, lists the disk devices in the VM whose reads and writes are
+	// counted. Otherwise, all devices are.
+	DiskDevices []string `json:"diskDevices,omitempty"`
+}
+
+// Names of vector.dev's host metrics that are used by the vector usage source
+const (
+	vectorNetworkTransmitMetric = "host_network_transmit_bytes_total"
+	vectorDiskReadMetric        = "host_disk_read_bytes_total"
+	vectorDiskWrittenMetric     = "host_disk_written_bytes_total"
+)
+
+type MockUsageConfig struct {
+	// InternalBytesPerSecond is the rate that each VM's internal network counter increases at
+	InternalBytesPerSecond uint64 `json:"internalBytesPerSecond"`
+	// InternetBytesPerSecond is the rate that each VM's internet network counter increases at
+	InternetBytesPerSecond uint64 `json:"internetBytesPerSecond"`
+	// DiskReadBytesPerSecond is the rate that each VM's disk read counter increases at
+	DiskReadBytesPerSecond uint64 `json:"diskReadBytesPerSecond,omitempty"`
+	// DiskWrittenBytesPerSecond is the rate that each VM's disk write counter increases at
+	DiskWrittenBytesPerSecond uint64 `json:"diskWrittenBytesPerSecond,omitempty"`
+}
+
+// newUsageSource returns the UsageSource selected by the config, or nil if egress collection is
+// disabled
+func newUsageSource(conf *EgressConfig) UsageSource {
+	if conf == nil {
+		return nil
+	}
+	if conf.Source == nil {
+		return newRunnerUsageSource(conf)
+	}
+
+	switch conf.Source.Kind {
+	case "", UsageSourceRunner:
+		return newRunnerUsageSource(conf)
+	case UsageSourceVector:
+		return &vectorUsageSource{conf: conf.Source.Vector}
+	case UsageSourceMock:
+		return newMockUsageSource(conf.Source.Mock, time.Now)
+	default:
+		panic(fmt.Errorf("unknown usage source kind %q", conf.Source.Kind))
+	}
+}
+
+// vectorUsageSource is the UsageSource that scrapes vector.dev's host metrics from inside each VM
+type vectorUsageSource struct {
+	conf *VectorUsageConfig
+}
+
+func (s *vectorUsageSource) GetUsage(ctx context.Context, vm *vmapi.VirtualMachine) (*VMUsage, error) {
+	url := fmt.Sprintf("http://%s:%d/metrics", vm.Status.PodIP, s.conf.Port)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error doing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response body: %w", err)
+	}
+
+	return readVectorUsage(core.ParsePromOutput(body), s.conf)
+}
+
+// readVectorUsage extracts the usage counters from vector.dev's metrics output
+func readVectorUsage(out core.PromOutput, conf *VectorUsageConfig) (*VMUsage, error) {
+	var internetBytes float64
+	for _, device := range conf.NetworkDevices {
+		sent, err := out.Sum(vectorNetworkTransmitMetric, core.LabelFilter{"device": device})
+		if err != nil {
+			return nil, err
+		}
+		internetBytes += sent
+	}
+
+	sumDisks := func(name string) (float64, error) {
+		if len(conf.DiskDevices) == 0 {
+			return out.Sum(name, nil)
+		}
+		var total float64
+		for _, device := range conf.DiskDevices {
+			v, err := out.Sum(name, core.LabelFilter{"device": device})
+			if err != nil {
+				return 0, err
+			}
+			total += v
+		}
+		return total, nil
+	}
+	read, err := sumDisks(vectorDiskReadMetric)
+	if err != nil {
+		return nil, err
+	}
+	written, err := sumDisks(vectorDiskWrittenMetric)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VMUsage{
+		Network: api.NetworkUsage{
+			InternalBytes:      0,
+			InternetBytes:      uint64(internetBytes),
+			Interfaces:         nil,
+			InboundConnections: nil,
+		},
+		Disk: &DiskUsage{
+			ReadBytes:    uint64(read),
+			WrittenBytes: uint64(written),
+		},
+	}, nil
+}
+
+// mockUsageSource is the UsageSource that generates usage at fixed rates, with every VM's counters
+// starting from when the source was created
+//
+// Usage is only billed from the first collection of each VM, so VMs that appear later aren't billed
+// for the time before they existed.
+type mockUsageSource struct {
+	conf  *MockUsageConfig
+	now   func() time.Time
+	start time.Time
+}
+
+func newMockUsageSource(conf *MockUsageConfig, now func() time.Time) *mockUsageSource {
+	return &mockUsageSource{conf: conf, now: now, start: now()}
+}
+
+func (s *mockUsageSource) GetUsage(ctx context.Context, vm *vmapi.VirtualMachine) (*VMUsage, error) {
+	seconds := uint64(s.now().Sub(s.start).Seconds())
+
+	return &VMUsage{
+		Network: api.NetworkUsage{
+			InternalBytes:      seconds * s.conf.InternalBytesPerSecond,
+			InternetBytes:      seconds * s.conf.InternetBytesPerSecond,
+			Interfaces:         nil,
+			InboundConnections: nil,
+		},
+		Disk: &DiskUsage{
+			ReadBytes:    seconds * s.conf.DiskReadBytesPerSecond,
+			WrittenBytes: seconds * s.conf.DiskWrittenBytesPerSecond,
+		},
+	}, nil
+}
@@ -0,0 +1,58 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestReadVectorUsage(t *testing.T) {
+	out := core.ParsePromOutput([]byte(`# TYPE host_network_transmit_bytes_total counter
+host_network_transmit_bytes_total{collector="network",device="eth0",host="vm"} 1000 1700000000000
+host_network_transmit_bytes_total{collector="network",device="lo",host="vm"} 50000 1700000000000
+host_network_transmit_bytes_total{collector="network",device="eth1",host="vm"} 200 1700000000000
+# TYPE host_disk_read_bytes_total counter
+host_disk_read_bytes_total{collector="disk",device="vda",host="vm"} 4096 1700000000000
+host_disk_read_bytes_total{collector="disk",device="vdb",host="vm"} 1024 1700000000000
+# TYPE host_disk_written_bytes_total counter
+host_disk_written_bytes_total{collector="disk",device="vda",host="vm"} 8192 1700000000000
+host_disk_written_bytes_total{collector="disk",device="vdb",host="vm"} 512 1700000000000
+`))
+
+	// Loopback traffic is excluded by not listing it; all disks are included by default
+	usage, err := readVectorUsage(out, &VectorUsageConfig{Port: 9100, NetworkDevices: []string{"eth0", "eth1"}, DiskDevices: nil})
+	require.NoError(t, err)
+	assert.Equal(t, api.NetworkUsage{InternalBytes: 0, InternetBytes: 1200, Interfaces: nil, InboundConnections: nil}, usage.Network)
+	assert.Equal(t, &DiskUsage{ReadBytes: 5120, WrittenBytes: 8704}, usage.Disk)
+
+	usage, err = readVectorUsage(out, &VectorUsageConfig{Port: 9100, NetworkDevices: []string{"eth0"}, DiskDevices: []string{"vdb"}})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000), usage.Network.InternetBytes)
+	assert.Equal(t, &DiskUsage{ReadBytes: 1024, WrittenBytes: 512}, usage.Disk)
+
+	// Missing devices are an error, rather than counting as zero, which would look like a reset
+	_, err = readVectorUsage(out, &VectorUsageConfig{Port: 9100, NetworkDevices: []string{"eth2"}, DiskDevices: nil})
+	assert.Error(t, err)
+}
+
+func TestMockUsageSource(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	source := newMockUsageSource(&MockUsageConfig{
+		InternalBytesPerSecond:    10,
+		InternetBytesPerSecond:    100,
+		DiskReadBytesPerSecond:    1,
+		DiskWrittenBytesPerSecond: 2,
+	}, func() time.Time { return now })
+
+	now = now.Add(time.Minute)
+	usage, err := source.GetUsage(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, api.NetworkUsage{InternalBytes: 600, InternetBytes: 6000, Interfaces: nil, InboundConnections: nil}, usage.Network)
+	assert.Equal(t, &DiskUsage{ReadBytes: 60, WrittenBytes: 120}, usage.Disk)
+}
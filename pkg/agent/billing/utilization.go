@@ -0,0 +1,79 @@
+package billing
+
+// Billing by actual utilization, rather than allocation, for comparing the two from the same
+// pipeline.
+//
+// The utilization of each VM comes from the metrics that its Runner fetches from inside the VM, and
+// is emitted under separate metric names, in the same units as the corresponding allocation-based
+// metrics. Utilization is capped at the allocation, so it's never billed as more than the VM was
+// given. VMs whose metrics haven't been fetched yet are counted as not using anything, so that
+// utilization is under-counted rather than over-counted.
+//
+// The standalone billing collector doesn't fetch metrics from inside VMs, so with it, every VM's
+// utilization is zero.
+
+import (
+	"math"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type UtilizationConfig struct {
+	// CPUMetricName is the name of the metric for the CPU-seconds used by each endpoint, like
+	// CPUMetricName but from the VM's load average instead of its allocation
+	CPUMetricName string `json:"cpuMetricName"`
+	// ComputeUnitMetricName is the name of the metric for the compute unit-seconds used by each
+	// endpoint, like ComputeUnitMetricName but from the VM's load average and memory usage
+	// instead of its allocation
+	ComputeUnitMetricName string `json:"computeUnitMetricName"`
+}
+
+// VMUtilization gives the resources used by a VM at a particular instant
+type VMUtilization struct {
+	// CPU is the number of vCPUs in use, from the VM's 1-minute load average
+	CPU float64
+	// Mem is the memory in use
+	Mem api.Bytes
+}
+
+// UtilizationSource gives the latest utilization of each VM, from the metrics collected from
+// inside it
+type UtilizationSource interface {
+	// LatestUtilization returns the utilization of each VM, from its most recent metrics. VMs
+	// that haven't reported any metrics are not included.
+	LatestUtilization() map[util.NamespacedName]VMUtilization
+}
+
+// refreshUtilization fetches the latest utilization, if it's emitted
+func (s *metricsState) refreshUtilization() {
+	s.utilization = nil
+	if s.utilizationConf != nil && s.utilizationSource != nil {
+		s.utilization = s.utilizationSource.LatestUtilization()
+	}
+}
+
+// setUtilization records the VM's latest utilization in the metrics, capped at the allocation
+func (s *metricsState) setUtilization(vm *vmapi.VirtualMachine, m *vmMetricsInstant) {
+	used, ok := s.utilization[util.GetNamespacedName(vm)]
+	if !ok {
+		return
+	}
+	cpu := math.Max(0, math.Min(used.CPU, m.cpu.AsFloat64()))
+	m.usedCPU = vmapi.MilliCPU(math.Round(cpu * 1000))
+	m.usedMem = util.Min(used.Mem, m.mem)
+}
+
+// usedComputeUnits returns the number of compute units represented by the utilization, in the same
+// way as computeUnits does for the allocation
+func (m vmMetricsInstant) usedComputeUnits(computeUnit api.Resources) float64 {
+	var cpuCUs, memCUs float64
+	if computeUnit.VCPU != 0 {
+		cpuCUs = m.usedCPU.AsFloat64() / computeUnit.VCPU.AsFloat64()
+	}
+	if computeUnit.Mem != 0 {
+		memCUs = m.usedMem.AsFloat64() / computeUnit.Mem.AsFloat64()
+	}
+	return math.Max(cpuCUs, memCUs)
+}
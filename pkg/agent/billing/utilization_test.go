@@ -0,0 +1,86 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type fakeUtilizationSource map[util.NamespacedName]VMUtilization
+
+func (f fakeUtilizationSource) LatestUtilization() map[util.NamespacedName]VMUtilization {
+	return f
+}
+
+func TestUtilization(t *testing.T) {
+	vm := func(name string) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.Namespace = "default"
+		vm.Name = name
+		return vm
+	}
+	allocated := func() vmMetricsInstant {
+		return vmMetricsInstant{
+			cpu:               2000,
+			mem:               4 << 30,
+			gpus:              0,
+			idle:              false,
+			egress:            nil,
+			egressUnavailable: false,
+			containerCPU:      nil,
+			burstBaselineCU:   0,
+			usedCPU:           0,
+			usedMem:           0,
+		}
+	}
+
+	s := new(metricsState)
+	s.tracer = trace.NewNoopTracerProvider().Tracer("")
+	s.utilizationSource = fakeUtilizationSource{
+		{Namespace: "default", Name: "busy"}: {CPU: 3.5, Mem: 1 << 30},
+		{Namespace: "default", Name: "idle"}: {CPU: 0.25, Mem: 3 << 29},
+	}
+
+	// Nothing is fetched unless utilization is emitted
+	s.refreshUtilization()
+	assert.Nil(t, s.utilization)
+
+	s.utilizationConf = &UtilizationConfig{CPUMetricName: "cpu_used", ComputeUnitMetricName: "cu_used"}
+	s.refreshUtilization()
+
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+
+	// CPU usage is capped at the allocation
+	busy := allocated()
+	s.setUtilization(vm("busy"), &busy)
+	assert.Equal(t, vmapi.MilliCPU(2000), busy.usedCPU)
+	assert.Equal(t, api.Bytes(1<<30), busy.usedMem)
+	assert.InDelta(t, 8, busy.usedComputeUnits(computeUnit), 1e-9)
+
+	// Memory can be the larger of the two
+	idle := allocated()
+	s.setUtilization(vm("idle"), &idle)
+	assert.Equal(t, vmapi.MilliCPU(250), idle.usedCPU)
+	assert.InDelta(t, 1.5, idle.usedComputeUnits(computeUnit), 1e-9)
+
+	// VMs without metrics aren't counted as using anything
+	unknown := allocated()
+	s.setUtilization(vm("unknown"), &unknown)
+	assert.Zero(t, unknown.usedComputeUnits(computeUnit))
+
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var h vmMetricsHistory
+	h.appendSlice(metricsTimeSlice{metrics: idle, startTime: start, endTime: start.Add(10 * time.Second)}, computeUnit)
+	h.finalizeCurrentTimeSlice(computeUnit)
+
+	// Allocation is still counted separately
+	assert.InDelta(t, 20, h.total.cpu, 1e-9)
+	assert.InDelta(t, 2.5, h.total.usedCPU, 1e-9)
+	assert.InDelta(t, 15, h.total.usedComputeUnits, 1e-9)
+}
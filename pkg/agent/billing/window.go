@@ -0,0 +1,144 @@
+package billing
+
+// Splitting of the usage accumulated for a batch into multiple windows, so that a long gap between
+// batches (e.g. because collection was stalled) doesn't produce events covering hours at once.
+//
+// We only have the total usage for each VM over the whole batch, so it's assumed to be spread
+// evenly across it.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// eventWindow is the time covered by a set of events
+type eventWindow struct {
+	start time.Time
+	end   time.Time
+	// last is true if this is the final window of the batch
+	last bool
+}
+
+// splitWindow returns consecutive windows from start to end, each at most maxDuration long
+//
+// If maxDuration is zero, there's only ever one window.
+func splitWindow(start, end time.Time, maxDuration time.Duration) []eventWindow {
+	if maxDuration <= 0 || end.Sub(start) <= maxDuration {
+		return []eventWindow{{start: start, end: end, last: true}}
+	}
+
+	var windows []eventWindow
+	for windowStart := start; windowStart.Before(end); windowStart = windowStart.Add(maxDuration) {
+		windowEnd := windowStart.Add(maxDuration)
+		if !windowEnd.Before(end) {
+			windowEnd = end
+		}
+		windows = append(windows, eventWindow{start: windowStart, end: windowEnd, last: windowEnd.Equal(end)})
+	}
+	return windows
+}
+
+// splitHistory divides the usage in each history across the windows, in proportion to their
+// durations
+func splitHistory(
+	historical map[metricsKey]vmMetricsHistory,
+	computeUnit api.Resources,
+	windows []eventWindow,
+) []map[metricsKey]vmMetricsHistory {
+	if len(windows) == 1 {
+		return []map[metricsKey]vmMetricsHistory{historical}
+	}
+
+	total := windows[len(windows)-1].end.Sub(windows[0].start)
+	fractions := make([]float64, len(windows))
+	for i, w := range windows {
+		fractions[i] = w.end.Sub(w.start).Seconds() / total.Seconds()
+	}
+
+	split := make([]map[metricsKey]vmMetricsHistory, len(windows))
+	for i := range split {
+		split[i] = make(map[metricsKey]vmMetricsHistory)
+	}
+	for key, history := range historical {
+		history.finalizeCurrentTimeSlice(computeUnit)
+		for i, part := range history.total.split(fractions) {
+			split[i][key] = vmMetricsHistory{lastSlice: nil, total: part}
+		}
+	}
+	return split
+}
+
+// split divides the usage into parts with the given fractions, which must add up to one
+//
+// Counts that can't be divided are rounded down in each part, except for the last, which has
+// whatever is left over. This means that the parts always add up to exactly the original.
+func (s vmMetricsSeconds) split(fractions []float64) []vmMetricsSeconds {
+	remaining := s
+	if s.interfaceEgressBytes != nil {
+		remaining.interfaceEgressBytes = make(map[string]uint64)
+		for name, bytes := range s.interfaceEgressBytes {
+			remaining.interfaceEgressBytes[name] = bytes
+		}
+	}
+	if s.containerCPU != nil {
+		remaining.containerCPU = make(map[string]float64)
+		for cgroup, seconds := range s.containerCPU {
+			remaining.containerCPU[cgroup] = seconds
+		}
+	}
+
+	parts := make([]vmMetricsSeconds, 0, len(fractions))
+	for i, f := range fractions {
+		if i == len(fractions)-1 {
+			parts = append(parts, remaining)
+			break
+		}
+
+		part := vmMetricsSeconds{
+			cpu:                  s.cpu * f,
+			computeUnits:         s.computeUnits * f,
+			gpu:                  s.gpu * f,
+			burstComputeUnits:    s.burstComputeUnits * f,
+			usedCPU:              s.usedCPU * f,
+			usedComputeUnits:     s.usedComputeUnits * f,
+			activeTime:           time.Duration(float64(s.activeTime) * f),
+			internalEgressBytes:  uint64(float64(s.internalEgressBytes) * f),
+			internetEgressBytes:  uint64(float64(s.internetEgressBytes) * f),
+			egressUnavailable:    s.egressUnavailable,
+			interfaceEgressBytes: nil, // set below, if there are any
+			containerCPU:         nil, // set below, if there are any
+			upscales:             uint(float64(s.upscales) * f),
+			downscales:           uint(float64(s.downscales) * f),
+		}
+		for name, bytes := range s.interfaceEgressBytes {
+			if part.interfaceEgressBytes == nil {
+				part.interfaceEgressBytes = make(map[string]uint64)
+			}
+			part.interfaceEgressBytes[name] = uint64(float64(bytes) * f)
+			remaining.interfaceEgressBytes[name] -= part.interfaceEgressBytes[name]
+		}
+		for cgroup, seconds := range s.containerCPU {
+			if part.containerCPU == nil {
+				part.containerCPU = make(map[string]float64)
+			}
+			part.containerCPU[cgroup] = seconds * f
+			remaining.containerCPU[cgroup] -= part.containerCPU[cgroup]
+		}
+
+		remaining.cpu -= part.cpu
+		remaining.computeUnits -= part.computeUnits
+		remaining.gpu -= part.gpu
+		remaining.burstComputeUnits -= part.burstComputeUnits
+		remaining.usedCPU -= part.usedCPU
+		remaining.usedComputeUnits -= part.usedComputeUnits
+		remaining.activeTime -= part.activeTime
+		remaining.internalEgressBytes -= part.internalEgressBytes
+		remaining.internetEgressBytes -= part.internetEgressBytes
+		remaining.upscales -= part.upscales
+		remaining.downscales -= part.downscales
+
+		parts = append(parts, part)
+	}
+	return parts
+}
@@ -0,0 +1,98 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitWindow(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// Windows shorter than the maximum aren't split
+	assert.Equal(t,
+		[]eventWindow{{start: start, end: at(time.Minute), last: true}},
+		splitWindow(start, at(time.Minute), time.Hour),
+	)
+	// ... and neither is anything, if there's no maximum
+	assert.Equal(t,
+		[]eventWindow{{start: start, end: at(5 * time.Hour), last: true}},
+		splitWindow(start, at(5*time.Hour), 0),
+	)
+
+	// Longer windows are split, with the last one covering what's left over
+	assert.Equal(t,
+		[]eventWindow{
+			{start: start, end: at(time.Hour), last: false},
+			{start: at(time.Hour), end: at(2 * time.Hour), last: false},
+			{start: at(2 * time.Hour), end: at(150 * time.Minute), last: true},
+		},
+		splitWindow(start, at(150*time.Minute), time.Hour),
+	)
+}
+
+func TestSplitMetricsSeconds(t *testing.T) {
+	total := vmMetricsSeconds{
+		cpu:                  100,
+		computeUnits:         50,
+		gpu:                  10,
+		burstComputeUnits:    20,
+		usedCPU:              30,
+		usedComputeUnits:     15,
+		activeTime:           100 * time.Second,
+		internalEgressBytes:  1001,
+		internetEgressBytes:  7,
+		egressUnavailable:    true,
+		interfaceEgressBytes: map[string]uint64{"repl": 99},
+		containerCPU:         nil,
+		upscales:             3,
+		downscales:           1,
+	}
+
+	parts := total.split([]float64{0.4, 0.4, 0.2})
+	assert.Equal(t, 3, len(parts))
+
+	assert.InDelta(t, 40, parts[0].cpu, 1e-9)
+	assert.InDelta(t, 20, parts[2].cpu, 1e-9)
+	assert.Equal(t, 40*time.Second, parts[0].activeTime)
+	assert.Equal(t, uint64(400), parts[0].internalEgressBytes)
+	assert.Equal(t, uint64(201), parts[2].internalEgressBytes)
+	assert.Equal(t, uint(1), parts[0].upscales)
+
+	// Nothing is lost or duplicated by splitting
+	var sum vmMetricsSeconds
+	for _, p := range parts {
+		assert.True(t, p.egressUnavailable)
+		sum.cpu += p.cpu
+		sum.computeUnits += p.computeUnits
+		sum.gpu += p.gpu
+		sum.burstComputeUnits += p.burstComputeUnits
+		sum.usedCPU += p.usedCPU
+		sum.usedComputeUnits += p.usedComputeUnits
+		sum.activeTime += p.activeTime
+		sum.internalEgressBytes += p.internalEgressBytes
+		sum.internetEgressBytes += p.internetEgressBytes
+		sum.upscales += p.upscales
+		sum.downscales += p.downscales
+		if sum.interfaceEgressBytes == nil {
+			sum.interfaceEgressBytes = make(map[string]uint64)
+		}
+		sum.interfaceEgressBytes["repl"] += p.interfaceEgressBytes["repl"]
+	}
+	sum.egressUnavailable = true
+	assert.InDelta(t, total.cpu, sum.cpu, 1e-9)
+	assert.InDelta(t, total.computeUnits, sum.computeUnits, 1e-9)
+	assert.InDelta(t, total.gpu, sum.gpu, 1e-9)
+	assert.InDelta(t, total.burstComputeUnits, sum.burstComputeUnits, 1e-9)
+	assert.InDelta(t, total.usedCPU, sum.usedCPU, 1e-9)
+	assert.InDelta(t, total.usedComputeUnits, sum.usedComputeUnits, 1e-9)
+	sum.cpu, sum.computeUnits, sum.gpu = total.cpu, total.computeUnits, total.gpu
+	sum.burstComputeUnits = total.burstComputeUnits
+	sum.usedCPU, sum.usedComputeUnits = total.usedCPU, total.usedComputeUnits
+	assert.Equal(t, total, sum)
+
+	// The original isn't modified
+	assert.Equal(t, uint64(99), total.interfaceEgressBytes["repl"])
+}
@@ -0,0 +1,400 @@
+package agent
+
+// Standalone billing collector, run by the billing-exporter, separately from the autoscaler-agents
+//
+// Normally, each autoscaler-agent collects billing for the VMs on its own node. The billing-exporter
+// runs the same collect/accumulate/push pipeline on its own, so that billing can be restarted,
+// scaled, and given permissions independently of autoscaling. It has two modes:
+//
+//  1. Per node (.perNode), as a DaemonSet: each billing-exporter collects billing for the VMs on its
+//     node, exactly like the autoscaler-agent does.
+//  2. Centralized: a single deployment collects billing for the VMs on every node, from a
+//     cluster-wide watch on VMs. The VMs can be split by endpoint ID into a number of shards, each
+//     collected by a separate replica (e.g. of a StatefulSet).
+//
+// In either mode, leader election optionally allows running standbys, without two replicas ever
+// pushing billing events for the same node or shard at once.
+//
+// When using the billing-exporter, the autoscaler-agents' own billing should have no clients
+// configured, so that usage isn't counted twice.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tychoish/fun/erc"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+// BillingCollectorConfig is the config for the billing-exporter
+type BillingCollectorConfig struct {
+	// Billing is the same as the autoscaler-agent's .billing, and may be reloaded the same way
+	Billing billing.Config `json:"billing"`
+	// ComputeUnit is the same as the autoscaler-agent's .scaling.computeUnit. It's used for the
+	// compute unit based billing metrics.
+	ComputeUnit api.Resources `json:"computeUnit"`
+	// ComputeUnitsByArch is the same as the autoscaler-agent's .scaling.computeUnitsByArch. It can
+	// only be used with PerNode, because centralized collection may include nodes with different
+	// architectures.
+	ComputeUnitsByArch api.ComputeUnitsByArch `json:"computeUnitsByArch,omitempty"`
+	// PerNode, if true, collects billing only for the VMs on the node that the billing-exporter is
+	// running on, given by the K8S_NODE_NAME environment variable. Otherwise, billing is collected
+	// for VMs on every node.
+	PerNode bool `json:"perNode,omitempty"`
+	// Sharding, if not nil, splits the VMs between multiple collectors by endpoint ID. It cannot be
+	// used with PerNode.
+	Sharding *BillingShardingConfig `json:"sharding"`
+	// LeaderElection, if not nil, enables running multiple collectors for each node or shard, with
+	// only the leader acting at any time. The Lease is named "<prefix>-billing-<node>" with
+	// PerNode, or "<prefix>-billing-<shard>" otherwise.
+	LeaderElection *LeaderElectionConfig `json:"leaderElection"`
+	// VMWatch, if not nil, configures how the watch on VirtualMachine objects recovers from
+	// problems
+	VMWatch *VMWatchConfig `json:"vmWatch"`
+	// Tracing, if not nil, enables exporting OpenTelemetry traces of billing collection and sending
+	Tracing *tracing.Config `json:"tracing"`
+	// MetricsPort is the port to serve the collector's prometheus metrics on
+	MetricsPort uint16 `json:"metricsPort"`
+	// FaultInjection, if not nil, enables injecting delays and errors into billing pushes, for
+	// testing. It must not be used in production.
+	FaultInjection *faults.Config `json:"faultInjection,omitempty"`
+}
+
+// BillingShardingConfig configures how VMs are split between centralized billing collectors
+type BillingShardingConfig struct {
+	// Count gives the number of shards. Each VM is assigned to a shard by its endpoint ID, the same
+	// way as with .billing.clients.http.shards, and VMs without an endpoint ID are all in the
+	// first shard.
+	Count uint `json:"count"`
+}
+
+// ReadBillingCollectorConfig reads and validates the billing-exporter's config
+func ReadBillingCollectorConfig(path string) (*BillingCollectorConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening config file %q: %w", path, err)
+	}
+
+	defer file.Close()
+	var config BillingCollectorConfig
+	jsonDecoder := json.NewDecoder(file)
+	jsonDecoder.DisallowUnknownFields()
+	if err = jsonDecoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Error decoding JSON config in %q: %w", path, err)
+	}
+
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
+	}
+
+	return &config, nil
+}
+
+func (c *BillingCollectorConfig) validate() error {
+	ec := &erc.Collector{}
+
+	const (
+		emptyTmpl = "field %q cannot be empty"
+		zeroTmpl  = "field %q cannot be zero"
+	)
+
+	validateBillingConfig(ec, &c.Billing)
+	erc.Whenf(ec, c.ComputeUnit.VCPU == 0, zeroTmpl, ".computeUnit.vCPUs")
+	erc.Whenf(ec, c.ComputeUnit.Mem == 0, zeroTmpl, ".computeUnit.mem")
+	if err := c.ComputeUnitsByArch.Validate(".computeUnitsByArch"); err != nil {
+		ec.Add(err)
+	}
+	erc.Whenf(ec, len(c.ComputeUnitsByArch) != 0 && !c.PerNode, "field %q requires %q", ".computeUnitsByArch", ".perNode")
+	erc.Whenf(
+		ec, c.Billing.EventMetadata != nil && slices.Contains(c.Billing.EventMetadata.Fields, billing.EventMetadataArchitecture) && !c.PerNode,
+		"field %q cannot include %q without %q", ".billing.eventMetadata.fields", billing.EventMetadataArchitecture, ".perNode",
+	)
+	erc.Whenf(ec, c.Sharding != nil && c.Sharding.Count == 0, zeroTmpl, ".sharding.count")
+	erc.Whenf(ec, c.Sharding != nil && c.PerNode, "fields %q and %q cannot both be set", ".sharding", ".perNode")
+	if l := c.LeaderElection; l != nil {
+		erc.Whenf(ec, l.LeaseNamespace == "", emptyTmpl, ".leaderElection.leaseNamespace")
+		erc.Whenf(ec, l.LeaseNamePrefix == "", emptyTmpl, ".leaderElection.leaseNamePrefix")
+		erc.Whenf(ec, l.LeaseDurationSeconds == 0, zeroTmpl, ".leaderElection.leaseDurationSeconds")
+		erc.Whenf(ec, l.RenewDeadlineSeconds == 0, zeroTmpl, ".leaderElection.renewDeadlineSeconds")
+		erc.Whenf(ec, l.RenewDeadlineSeconds >= l.LeaseDurationSeconds, "field %q must be less than %q", ".leaderElection.renewDeadlineSeconds", ".leaderElection.leaseDurationSeconds")
+		erc.Whenf(ec, l.RetryPeriodSeconds == 0, zeroTmpl, ".leaderElection.retryPeriodSeconds")
+		erc.Whenf(ec, l.MetricsPort == 0, zeroTmpl, ".leaderElection.metricsPort")
+		erc.Whenf(ec, l.MetricsPort == c.MetricsPort, "fields %q and %q must be different", ".leaderElection.metricsPort", ".metricsPort")
+	}
+	if t := c.Tracing; t != nil {
+		erc.Whenf(ec, t.Endpoint == "", emptyTmpl, ".tracing.endpoint")
+		erc.Whenf(ec, t.SampleFraction < 0 || t.SampleFraction > 1, "field %q must be between 0 and 1", ".tracing.sampleFraction")
+		erc.Whenf(ec, t.ExportIntervalSeconds == 0, zeroTmpl, ".tracing.exportIntervalSeconds")
+		erc.Whenf(ec, t.MaxQueueSize == 0, zeroTmpl, ".tracing.maxQueueSize")
+	}
+	erc.Whenf(ec, c.MetricsPort == 0, zeroTmpl, ".metricsPort")
+	erc.Whenf(ec, c.FaultInjection != nil && c.FaultInjection.ScenarioPath == "", emptyTmpl, ".faultInjection.scenarioPath")
+
+	return ec.Resolve()
+}
+
+// ShardCount returns the number of shards, which is 1 if sharding is disabled
+func (c *BillingCollectorConfig) ShardCount() int {
+	if c.Sharding == nil {
+		return 1
+	}
+	return int(c.Sharding.Count)
+}
+
+// BillingShardFromEnv returns the shard that this collector is responsible for, out of count.
+//
+// The shard is given by the BILLING_SHARD environment variable if it's set, and otherwise by the
+// ordinal suffix of the hostname, as for a StatefulSet's pods (e.g. "billing-collector-2").
+func BillingShardFromEnv(count int) (int, error) {
+	var source, value string
+	if v, ok := os.LookupEnv("BILLING_SHARD"); ok {
+		source, value = "BILLING_SHARD", v
+	} else if count <= 1 {
+		return 0, nil
+	} else {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, fmt.Errorf("Error getting hostname: %w", err)
+		}
+		source, value = "hostname ordinal", hostname[strings.LastIndex(hostname, "-")+1:]
+	}
+
+	shard, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q: %w", source, value, err)
+	}
+	if shard < 0 || shard >= count {
+		return 0, fmt.Errorf("%s %d out of range for %d shards", source, shard, count)
+	}
+	return shard, nil
+}
+
+// BillingCollectorRunner runs the billing collector for a single node or shard
+type BillingCollectorRunner struct {
+	Config     *BillingCollectorConfig
+	ConfigPath string
+	// NodeName is the node to collect billing for, if Config.PerNode is true
+	NodeName string
+	// Shard is the shard to collect billing for, if Config.PerNode is false
+	Shard      int
+	KubeClient *kubernetes.Clientset
+	VMClient   *vmclient.Clientset
+}
+
+func (r BillingCollectorRunner) Run(ctx context.Context, logger *zap.Logger) error {
+	var scope string
+	if r.Config.PerNode {
+		scope = r.NodeName
+		logger = logger.With(zap.String("node", r.NodeName))
+	} else {
+		scope = strconv.Itoa(r.Shard)
+		logger = logger.With(zap.Int("shard", r.Shard))
+	}
+
+	if conf := r.Config.LeaderElection; conf != nil {
+		leaseName := fmt.Sprintf("%s-billing-%s", conf.LeaseNamePrefix, scope)
+		return runWithLeaderElection(ctx, logger, r.KubeClient, conf, leaseName, r.run)
+	}
+	return r.run(ctx, logger)
+}
+
+// includes returns whether the VM is one that this collector is responsible for
+func (r BillingCollectorRunner) includes(vm *vmapi.VirtualMachine) bool {
+	if r.Config.PerNode {
+		return vm.Status.Node == r.NodeName
+	}
+	return billing.VMInShard(vm, r.Shard, r.Config.ShardCount())
+}
+
+func (r BillingCollectorRunner) run(ctx context.Context, logger *zap.Logger) error {
+	// ComputeUnitsByArch is only allowed with PerNode, so there's a single node to check.
+	computeUnit := r.Config.ComputeUnit
+	if r.Config.PerNode {
+		var err error
+		computeUnit, err = nodeComputeUnit(ctx, r.KubeClient, r.NodeName, r.Config.ComputeUnitsByArch, r.Config.ComputeUnit)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// As in the autoscaler-agent, deleted VMs are passed directly to billing so that their final
+	// usage can be sent without waiting for the next batch, and likewise for VMs that were migrated
+	// away from the node, with .perNode. Without it, VMs are never migrated away from the
+	// collector, because it watches every node.
+	billingDeletions := make(chan *vmapi.VirtualMachine, 64)
+	pushBillingDeletion := func(vm *vmapi.VirtualMachine) {
+		select {
+		case billingDeletions <- vm:
+		default:
+			logger.Warn("Billing deletions channel is full, VM usage will be sent with the next batch", util.VMNameFields(vm))
+		}
+	}
+	billingMigrations := make(chan *vmapi.VirtualMachine, 64)
+	pushBillingMigration := func(vm *vmapi.VirtualMachine) {
+		select {
+		case billingMigrations <- vm:
+		default:
+			logger.Warn("Billing migrations channel is full, VM usage up to the migration may not be sent", util.VMNameFields(vm))
+		}
+	}
+
+	promReg := prometheus.NewRegistry()
+	watchMetrics := watch.NewMetrics("autoscaling_billing_exporter_watchers")
+	watchMetrics.MustRegister(promReg)
+	metrics := billing.NewPromMetrics()
+	metrics.MustRegister(promReg)
+
+	logger.Info("Starting VM watcher")
+	vmWatchStore, err := r.startVMWatcher(ctx, logger, watchMetrics, pushBillingDeletion, pushBillingMigration)
+	if err != nil {
+		return fmt.Errorf("Error starting VM watcher: %w", err)
+	}
+	defer vmWatchStore.Stop()
+	logger.Info("VM watcher started")
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-vmWatchStore.Done():
+			if ctx.Err() == nil {
+				logger.Error("VM watch stopped while still running, shutting down")
+				cancel(errVMWatchStopped)
+			}
+		}
+	}()
+
+	if err := util.StartPrometheusMetricsServer(ctx, logger.Named("prometheus"), r.Config.MetricsPort, promReg); err != nil {
+		return fmt.Errorf("Error starting prometheus metrics server: %w", err)
+	}
+
+	tracerProvider, err := tracing.NewTracerProvider(ctx, r.Config.Tracing, "billing-exporter")
+	if err != nil {
+		return fmt.Errorf("Error setting up tracing: %w", err)
+	}
+	if r.Config.Tracing != nil {
+		logger.Info("Starting trace exporter")
+		go tracing.Run(ctx, logger.Named("tracing"), tracerProvider)
+	}
+	tracer := tracerProvider.Tracer("github.com/neondatabase/autoscaling/pkg/agent/billing")
+
+	var store billing.VMStoreForNode
+	var listVMs billing.VMLister
+	if r.Config.PerNode {
+		store = watch.NewIndexedStore(vmWatchStore, billing.NewVMNodeIndex(r.NodeName))
+		listVMs = billing.NewVMLister(r.VMClient, r.NodeName)
+	} else {
+		count := r.Config.ShardCount()
+		store = watch.NewIndexedStore(vmWatchStore, billing.NewVMShardIndex(r.Shard, count))
+		listVMs = billing.NewVMShardLister(r.VMClient, r.Shard, count)
+	}
+
+	readBillingConfig := func(path string) (*billing.Config, error) {
+		config, err := ReadBillingCollectorConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		return &config.Billing, nil
+	}
+	billingUpdates := watchBillingConfig(ctx, logger.Named("billing-reload"), r.ConfigPath, r.Config.Billing, readBillingConfig)
+
+	if conf := r.Config.FaultInjection; conf != nil {
+		scenario, err := faults.ReadScenario(conf.ScenarioPath)
+		if err != nil {
+			return err
+		}
+		logger.Warn("Fault injection is enabled", zap.Any("scenario", scenario))
+		ctx = faults.WithInjector(ctx, faults.NewInjector(scenario))
+	}
+
+	logger.Info("Starting billing metrics collector")
+	billing.RunBillingMetricsCollector(ctx, logger, &r.Config.Billing, billingUpdates, computeUnit, store, billingDeletions, billingMigrations, listVMs, nil, nil, metrics, tracer, nil, util.RealClock)
+
+	if cause := context.Cause(ctx); errors.Is(cause, errVMWatchStopped) {
+		return cause
+	}
+	return nil
+}
+
+// startVMWatcher starts the watch on VMs for the billing collector. As in the autoscaler-agent, it
+// watches VMs across the whole cluster, even with .perNode.
+func (r BillingCollectorRunner) startVMWatcher(
+	ctx context.Context,
+	parentLogger *zap.Logger,
+	metrics watch.Metrics,
+	submitBillingDeletion func(*vmapi.VirtualMachine),
+	submitBillingMigration func(*vmapi.VirtualMachine),
+) (*watch.Store[vmapi.VirtualMachine], error) {
+	logger := parentLogger.Named("vm-watch")
+	config := r.Config
+
+	var retryBackoffMax time.Duration
+	if sf := config.Billing.StoreFailure; sf != nil {
+		retryBackoffMax = time.Second * time.Duration(sf.RetryBackoffMaxSeconds)
+	}
+	var maxFailures int
+	var resyncPeriod time.Duration
+	if w := config.VMWatch; w != nil {
+		maxFailures = int(w.MaxConsecutiveFailures)
+		resyncPeriod = time.Second * time.Duration(w.ResyncEverySeconds)
+	}
+
+	return watch.Watch(
+		ctx,
+		logger.Named("watch"),
+		r.VMClient.NeonvmV1().VirtualMachines(corev1.NamespaceAll),
+		watch.Config{
+			ObjectNameLogField: "virtualmachine",
+			Metrics: watch.MetricsConfig{
+				Metrics:  metrics,
+				Instance: "VirtualMachines",
+			},
+			RetryRelistAfter:       util.NewTimeRange(time.Millisecond, 500, 1000),
+			RetryWatchAfter:        util.NewTimeRange(time.Millisecond, 500, 1000),
+			RetryBackoffMax:        retryBackoffMax,
+			MaxConsecutiveFailures: maxFailures,
+			ResyncPeriod:           resyncPeriod,
+		},
+		watch.Accessors[*vmapi.VirtualMachineList, vmapi.VirtualMachine]{
+			Items: func(list *vmapi.VirtualMachineList) []vmapi.VirtualMachine { return list.Items },
+		},
+		watch.InitModeDefer,
+		metav1.ListOptions{},
+		watch.HandlerFuncs[*vmapi.VirtualMachine]{
+			AddFunc: nil,
+			UpdateFunc: func(oldVM, newVM *vmapi.VirtualMachine) {
+				if config.PerNode && oldVM.Status.Node == r.NodeName && newVM.Status.Node != r.NodeName && newVM.Status.MigratedAt != nil {
+					submitBillingMigration(newVM)
+				}
+			},
+			DeleteFunc: func(vm *vmapi.VirtualMachine, mayBeStale bool) {
+				if r.includes(vm) {
+					submitBillingDeletion(vm)
+				}
+			},
+		},
+	)
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestBillingShardFromEnv(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		count    int
+		expected int
+		err      string
+	}{
+		{name: "first", value: "0", count: 3, expected: 0, err: ""},
+		{name: "last", value: "2", count: 3, expected: 2, err: ""},
+		{name: "sharding disabled", value: "0", count: 1, expected: 0, err: ""},
+		{name: "leading zero", value: "01", count: 3, expected: 1, err: ""},
+		{name: "equal to count", value: "3", count: 3, expected: 0, err: "BILLING_SHARD 3 out of range for 3 shards"},
+		{name: "above count", value: "10", count: 3, expected: 0, err: "BILLING_SHARD 10 out of range for 3 shards"},
+		{name: "negative", value: "-1", count: 3, expected: 0, err: "BILLING_SHARD -1 out of range for 3 shards"},
+		{name: "set while sharding disabled", value: "1", count: 1, expected: 0, err: "BILLING_SHARD 1 out of range for 1 shards"},
+		{name: "empty", value: "", count: 3, expected: 0, err: `Invalid BILLING_SHARD ""`},
+		{name: "not a number", value: "billing-collector-1", count: 3, expected: 0, err: `Invalid BILLING_SHARD "billing-collector-1"`},
+		{name: "whitespace", value: " 1", count: 3, expected: 0, err: `Invalid BILLING_SHARD " 1"`},
+		{name: "fractional", value: "1.0", count: 3, expected: 0, err: `Invalid BILLING_SHARD "1.0"`},
+		{name: "overflow", value: "99999999999999999999", count: 3, expected: 0, err: `Invalid BILLING_SHARD "99999999999999999999"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("BILLING_SHARD", c.value)
+			shard, err := BillingShardFromEnv(c.count)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, shard)
+		})
+	}
+
+	// Without BILLING_SHARD, the hostname isn't needed if sharding is disabled
+	t.Setenv("BILLING_SHARD", "")
+	require.NoError(t, os.Unsetenv("BILLING_SHARD"))
+	shard, err := BillingShardFromEnv(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shard)
+}
+
+func TestBillingCollectorConfigValidateSharding(t *testing.T) {
+	valid := func() *BillingCollectorConfig {
+		c := new(BillingCollectorConfig)
+		c.Billing.ActiveTimeMetricName = "active_time"
+		c.Billing.CPUMetricName = "cpu"
+		c.Billing.CollectEverySeconds = 5
+		c.Billing.AccumulateEverySeconds = 60
+		c.Billing.LogSummaryEverySeconds = 60
+		c.ComputeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+		c.MetricsPort = 9100
+		return c
+	}
+
+	cases := []struct {
+		name     string
+		sharding *BillingShardingConfig
+		perNode  bool
+		err      string
+	}{
+		{name: "disabled", sharding: nil, perNode: false, err: ""},
+		{name: "per node", sharding: nil, perNode: true, err: ""},
+		{name: "one shard", sharding: &BillingShardingConfig{Count: 1}, perNode: false, err: ""},
+		{name: "many shards", sharding: &BillingShardingConfig{Count: 16}, perNode: false, err: ""},
+		{name: "zero shards", sharding: &BillingShardingConfig{Count: 0}, perNode: false, err: `field ".sharding.count" cannot be zero`},
+		{name: "with per node", sharding: &BillingShardingConfig{Count: 2}, perNode: true, err: `fields ".sharding" and ".perNode" cannot both be set`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := valid()
+			conf.Sharding = c.sharding
+			conf.PerNode = c.perNode
+			err := conf.validate()
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	// The log summary may be disabled
+	conf := valid()
+	conf.Billing.LogSummaryEverySeconds = 0
+	assert.NoError(t, conf.validate())
+
+	conf = valid()
+	assert.Equal(t, 1, conf.ShardCount())
+	conf.Sharding = &BillingShardingConfig{Count: 4}
+	assert.Equal(t, 4, conf.ShardCount())
+}
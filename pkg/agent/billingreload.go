@@ -0,0 +1,80 @@
+package agent
+
+// Periodic re-reading of the config file, so that the billing config can be changed without
+// restarting the autoscaler-agent.
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+)
+
+// watchBillingConfig re-reads the config file at path every conf.ReloadEverySeconds, sending the
+// billing config on the returned channel whenever it changes. read returns the billing config from
+// the file at the path, so that the same reloading works for both the autoscaler-agent's config and
+// the standalone billing collector's.
+//
+// If reloading is disabled, the returned channel is nil, so receiving from it blocks forever.
+// Invalid configs are logged and otherwise ignored.
+func watchBillingConfig(
+	ctx context.Context,
+	logger *zap.Logger,
+	path string,
+	conf billing.Config,
+	read func(path string) (*billing.Config, error),
+) <-chan *billing.Config {
+	if conf.ReloadEverySeconds == 0 {
+		return nil
+	}
+
+	updates := make(chan *billing.Config)
+
+	go func() {
+		ticker := time.NewTicker(time.Second * time.Duration(conf.ReloadEverySeconds))
+		defer ticker.Stop()
+
+		current := conf
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			newConfig, err := read(path)
+			if err != nil {
+				logger.Error("Failed to reload config, keeping current billing config", zap.Error(err))
+				continue
+			}
+
+			if reflect.DeepEqual(*newConfig, current) {
+				continue
+			}
+
+			logger.Info("Billing config changed", zap.Any("config", newConfig))
+			current = *newConfig
+
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- newConfig:
+			}
+		}
+	}()
+
+	return updates
+}
+
+// readAgentBillingConfig returns the billing config from the autoscaler-agent's config file
+func readAgentBillingConfig(path string) (*billing.Config, error) {
+	config, err := ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &config.Billing, nil
+}
@@ -1,14 +1,30 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/tychoish/fun/erc"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/agent/core/simulate"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 type Config struct {
@@ -21,6 +37,36 @@ type Config struct {
 	NeonVM    NeonVMConfig     `json:"neonvm"`
 	Billing   billing.Config   `json:"billing"`
 	DumpState *DumpStateConfig `json:"dumpState"`
+	// Decisions, if not nil, enables keeping a record of recent scaling decisions for each VM
+	Decisions *DecisionsConfig `json:"decisions"`
+	// AnomalyEvents, if not nil, enables posting Kubernetes Events for persistent problems, so
+	// that they're visible with 'kubectl describe' and not only in the logs
+	AnomalyEvents *AnomalyEventsConfig `json:"anomalyEvents"`
+	// StateAPI, if not nil, enables serving a summary of the state of every VM on the node, for
+	// use by the console backend
+	StateAPI *StateAPIConfig `json:"stateAPI"`
+	// Webhook, if not nil, enables sending a notification to a webhook for each completed upscale
+	// or downscale, and each denied upscale
+	Webhook *WebhookConfig `json:"webhook"`
+	// Disk, if not nil, enables growing VMs' root disks as they fill up
+	Disk *DiskConfig `json:"disk"`
+	// StatusAnnotation, if not nil, enables writing a summary of each VM's scaling to the
+	// api.AnnotationAutoscalingStatus annotation
+	StatusAnnotation *StatusAnnotationConfig `json:"statusAnnotation"`
+	// Health, if not nil, enables serving /healthz and /readyz for Kubernetes probes
+	Health *HealthConfig `json:"health"`
+	// VMWatch, if not nil, configures how the watch on VirtualMachine objects recovers from
+	// problems
+	VMWatch *VMWatchConfig `json:"vmWatch"`
+	// Tracing, if not nil, enables exporting OpenTelemetry traces of metrics collection, scaling
+	// decisions, and the requests made to act on them
+	Tracing *tracing.Config `json:"tracing"`
+	// LeaderElection, if not nil, enables running multiple autoscaler-agents for each node, with
+	// only the leader acting at any time
+	LeaderElection *LeaderElectionConfig `json:"leaderElection"`
+	// FaultInjection, if not nil, enables injecting delays and errors into requests made by the
+	// autoscaler-agent, for testing. It must not be used in production.
+	FaultInjection *faults.Config `json:"faultInjection,omitempty"`
 }
 
 type RateThresholdConfig struct {
@@ -48,6 +94,10 @@ type MonitorConfig struct {
 	// MaxHealthCheckSequentialFailuresSeconds gives the duration, in seconds, after which we
 	// should restart the connection to the vm-monitor if health checks aren't succeeding.
 	MaxHealthCheckSequentialFailuresSeconds uint `json:"maxHealthCheckSequentialFailuresSeconds"`
+	// ResumeTimeoutSeconds, if non-zero, enables resuming the session with vm-monitors that support
+	// it when the connection drops, so that requests in flight aren't lost. It gives how long to
+	// keep trying to reconnect before starting a new session from scratch.
+	ResumeTimeoutSeconds uint `json:"resumeTimeoutSeconds,omitempty"`
 	// MaxFailedRequestRate defines the maximum rate of failed monitor requests, above which
 	// a VM is considered stuck.
 	MaxFailedRequestRate RateThresholdConfig `json:"maxFailedRequestRate"`
@@ -61,6 +111,44 @@ type MonitorConfig struct {
 	// RequestedUpscaleValidSeconds gives the duration, in seconds, that requested upscaling should
 	// be respected for, before allowing re-downscaling.
 	RequestedUpscaleValidSeconds uint `json:"requestedUpscaleValidSeconds"`
+
+	// FileCache, if provided, enables resizing the VM's local file cache whenever its memory
+	// changes. This requires that the vm-monitor supports the file cache resize capability; if it
+	// doesn't, nothing is sent.
+	FileCache *FileCacheConfig `json:"fileCache,omitempty"`
+
+	// Restart, if provided, enables restarting Postgres in VMs with the api.AnnotationRestartRequest
+	// annotation. This requires that the vm-monitor supports the postgres restart capability; until
+	// it does, the restart stays pending.
+	Restart *RestartConfig `json:"restart,omitempty"`
+}
+
+// RestartConfig configures coordinated restarts of Postgres, which are carried out by the
+// vm-monitor during each VM's maintenance window
+type RestartConfig struct {
+	// CheckEverySeconds gives the interval, in seconds, at which each VM is checked for a requested
+	// restart
+	CheckEverySeconds uint `json:"checkEverySeconds"`
+	// DrainTimeoutSeconds gives how long, in seconds, the vm-monitor should wait for existing
+	// connections to close before shutting Postgres down
+	DrainTimeoutSeconds uint `json:"drainTimeoutSeconds"`
+	// TimeoutSeconds gives how long, in seconds, to wait for the vm-monitor to finish restarting
+	// Postgres. It must be longer than DrainTimeoutSeconds.
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// MaxAttempts gives the number of times that a restart is attempted before it's marked as
+	// failed
+	MaxAttempts uint `json:"maxAttempts"`
+}
+
+// FileCacheConfig configures how the local file cache and related Postgres settings are sized when
+// the VM's memory changes
+type FileCacheConfig struct {
+	// MemoryFraction gives the size of the file cache, as a fraction of the VM's memory
+	MemoryFraction float64 `json:"memoryFraction"`
+	// Settings maps the names of memory-sized Postgres settings to their size as a fraction of the
+	// VM's memory. They're set with ALTER SYSTEM and a configuration reload, so settings that
+	// require a restart (like shared_buffers) won't take effect until Postgres is restarted.
+	Settings map[string]float64 `json:"settings,omitempty"`
 }
 
 // DumpStateConfig configures the endpoint to dump all internal state
@@ -70,6 +158,127 @@ type DumpStateConfig struct {
 	// TimeoutSeconds gives the maximum duration, in seconds, that we allow for a request to dump
 	// internal state.
 	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// RedactFields gives the names of JSON fields to redact from the per-VM dumps served at /vm,
+	// in addition to the ones that are always redacted (like the pod's IP).
+	RedactFields []string `json:"redactFields,omitempty"`
+}
+
+// DecisionsConfig configures the record of scaling decisions kept for each VM
+//
+// Each decision includes the metrics it was based on, the previous and target resources, the
+// reason for the target, and the scheduler plugin's verdict. The most recent decisions are served
+// at /decisions by the dump-state server, if it's enabled.
+type DecisionsConfig struct {
+	// HistorySize gives the number of decisions to keep for each VM. Older decisions are discarded.
+	HistorySize uint `json:"historySize"`
+	// KubernetesEvents, if true, additionally records each decision as an Event on the VM object
+	KubernetesEvents bool `json:"kubernetesEvents"`
+}
+
+// AnomalyEventsConfig gives the thresholds above which problems are posted as Kubernetes Events
+//
+// Events are posted on the VirtualMachine objects. Problems with billing affect every VM on the
+// node, so they're posted on each VM that the autoscaler-agent is responsible for.
+//
+// A Warning Event is posted once each time a threshold is crossed, and a Normal Event when the
+// problem has gone away.
+type AnomalyEventsConfig struct {
+	// RepeatedDenialsThreshold gives the number of consecutive upscales for a VM that the scheduler
+	// plugin must deny before an Event is posted
+	RepeatedDenialsThreshold uint `json:"repeatedDenialsThreshold"`
+	// MetricsUnreachableSeconds gives how long requests for a VM's metrics must have been failing
+	// before an Event is posted
+	MetricsUnreachableSeconds uint `json:"metricsUnreachableSeconds"`
+	// BillingPushFailuresThreshold gives the number of consecutive failed pushes of billing events
+	// to any single client before an Event is posted
+	BillingPushFailuresThreshold uint `json:"billingPushFailuresThreshold"`
+	// VMStoreFailingSeconds gives how long the VM store used for billing must have been failing
+	// before an Event is posted
+	VMStoreFailingSeconds uint `json:"vmStoreFailingSeconds"`
+	// HostContentionStealFraction, if not zero, gives the average fraction of time that a VM's
+	// CPUs must be stolen by the host before an Event is posted saying that the host is
+	// oversubscribed. Requires the VM's host metrics to include steal time.
+	HostContentionStealFraction float64 `json:"hostContentionStealFraction,omitempty"`
+}
+
+// StateAPIConfig configures the API serving the state of each VM at /state/vms
+type StateAPIConfig struct {
+	// Port is the port to serve on
+	Port uint16 `json:"port"`
+	// BearerTokenFile gives the path of a file with the token that requests must present in their
+	// Authorization header. It's required, because the API exposes every VM on the node.
+	BearerTokenFile string `json:"bearerTokenFile"`
+	// MaxPageSize gives the maximum number of VMs returned in a single response, which is also the
+	// default if the request doesn't set a limit.
+	MaxPageSize uint `json:"maxPageSize"`
+}
+
+// WebhookConfig configures the webhook that scaling notifications are sent to
+//
+// Each notification is sent as a JSON-encoded WebhookNotification in the body of a POST request.
+type WebhookConfig struct {
+	// URL is the URL to send notifications to
+	URL string `json:"url"`
+	// SecretFile, if not empty, gives the path of a file with the key used to sign each
+	// notification with HMAC-SHA256. The signature is sent in the X-Autoscaling-Signature header.
+	SecretFile string `json:"secretFile,omitempty"`
+	// TimeoutSeconds gives the timeout, in seconds, for each request to the webhook
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// MaxRetries gives the number of times that a failed request is retried before the
+	// notification is dropped
+	MaxRetries uint `json:"maxRetries"`
+	// RetryWaitSeconds gives the duration, in seconds, to wait before the first retry. The wait is
+	// doubled for each subsequent retry.
+	RetryWaitSeconds uint `json:"retryWaitSeconds"`
+	// QueueSize gives the maximum number of notifications waiting to be sent. Notifications beyond
+	// this are dropped.
+	QueueSize uint `json:"queueSize"`
+}
+
+// VMWatchConfig configures how the watch on VirtualMachine objects recovers from problems
+//
+// The watch always retries failed re-lists and re-watches (with backoff given by
+// .billing.storeFailure.retryBackoffMaxSeconds). These settings add periodic resyncs, and a limit
+// after which the autoscaler-agent gives up and exits, so that it's restarted.
+type VMWatchConfig struct {
+	// ResyncEverySeconds, if non-zero, gives the interval, in seconds, at which all VMs are
+	// re-listed, to recover from any events that were missed
+	ResyncEverySeconds uint `json:"resyncEverySeconds,omitempty"`
+	// MaxConsecutiveFailures, if non-zero, gives the number of consecutive failed re-lists or
+	// re-watches after which the autoscaler-agent exits
+	MaxConsecutiveFailures uint `json:"maxConsecutiveFailures,omitempty"`
+}
+
+// StatusAnnotationConfig configures writing each VM's autoscaling status to an annotation
+type StatusAnnotationConfig struct {
+	// UpdateEverySeconds gives the interval, in seconds, at which the status is checked. The VM is
+	// only patched when the status has changed.
+	UpdateEverySeconds uint `json:"updateEverySeconds"`
+}
+
+// DiskConfig configures growing VMs' root disks as they fill up
+//
+// When the root filesystem's usage crosses UsageThreshold, the VM's .spec.guest.rootDisk.size is
+// increased, and the NeonVM controller grows the disk while the VM is running. Disks are never
+// shrunk.
+type DiskConfig struct {
+	// CheckEverySeconds gives the interval, in seconds, at which each VM's disk usage is checked
+	CheckEverySeconds uint `json:"checkEverySeconds"`
+	// UsageThreshold gives the fraction of the root filesystem that must be used before the disk
+	// is grown. It must be between 0 and 1.
+	UsageThreshold float64 `json:"usageThreshold"`
+	// GrowthFraction gives the fraction of its current size that the disk is grown by each time
+	GrowthFraction float64 `json:"growthFraction"`
+	// MinGrowth gives the smallest amount that the disk is grown by each time
+	MinGrowth api.Bytes `json:"minGrowth"`
+	// MaxSize gives the size that disks are never grown beyond
+	MaxSize api.Bytes `json:"maxSize"`
+	// MinIntervalSeconds gives the minimum duration, in seconds, between growing the same VM's
+	// disk, so that the filesystem has time to grow before we check it again.
+	MinIntervalSeconds uint `json:"minIntervalSeconds"`
+	// FilesystemLabels, if not empty, selects the series of vector.dev's filesystem metrics for the
+	// root filesystem. Defaults to core.DefaultFilesystemLabels.
+	FilesystemLabels core.LabelFilter `json:"filesystemLabels,omitempty"`
 }
 
 // ScalingConfig defines the scheduling we use for scaling up and down
@@ -77,9 +286,161 @@ type ScalingConfig struct {
 	// ComputeUnit is the desired ratio between CPU and memory that the autoscaler-agent should
 	// uphold when making changes to a VM
 	ComputeUnit api.Resources `json:"computeUnit"`
+	// ComputeUnitsByArch gives the compute unit to use instead of ComputeUnit on nodes with each
+	// CPU architecture (as in the "kubernetes.io/arch" node label), for clusters where the ratio
+	// between CPU and memory differs between e.g. amd64 and arm64 nodes.
+	//
+	// The autoscaler-agent only handles the VMs on its own node, so the compute unit for the node's
+	// architecture replaces ComputeUnit on startup.
+	ComputeUnitsByArch api.ComputeUnitsByArch `json:"computeUnitsByArch,omitempty"`
 	// DefaultConfig gives the default scaling config, to be used if there is no configuration
 	// supplied with the "autoscaling.neon.tech/config" annotation.
 	DefaultConfig api.ScalingConfig `json:"defaultConfig"`
+	// Policy, if not empty, gives the name of the scaling policy used to determine how many compute
+	// units each VM should have. Policies other than the default must be registered with
+	// core.RegisterScalingPolicy in a custom build of the autoscaler-agent.
+	//
+	// Policies other than the default are checked on startup with simulate.CheckPolicy, and the
+	// autoscaler-agent refuses to start if the policy fails.
+	Policy string `json:"policy,omitempty"`
+	// WeightedGoal, if not empty, replaces the scaling policy with one that uses the weighted
+	// average of the goals from each term's metric, instead of the largest. It can't be used
+	// together with Policy. Changes require a restart.
+	//
+	// Terms with the "gauge" metric are read from the VM's scraped metrics; they aren't available
+	// for VMs that push metrics over OTLP.
+	WeightedGoal []core.WeightedGoalTerm `json:"weightedGoal,omitempty"`
+	// GoalExpression, if not empty, replaces the scaling policy with a scaling expression that
+	// calculates the goal compute units from each VM's metrics -- e.g.,
+	// "max(load1 / (0.9 * cu_cpus), mem_used / (0.75 * cu_mem))". See core.ExpressionVariables
+	// for the variables that are available. It can't be used together with Policy or
+	// WeightedGoal. Changes require a restart.
+	GoalExpression string `json:"goalExpression,omitempty"`
+	// MaxConcurrentOperationsPerNamespace, if non-zero, limits the number of scheduler plugin and
+	// NeonVM requests that may be in flight at the same time for VMs in any single namespace.
+	MaxConcurrentOperationsPerNamespace uint `json:"maxConcurrentOperationsPerNamespace"`
+	// EmergencyUpscale, if provided, enables immediately upscaling VMs that are about to run out
+	// of memory, without waiting for the regular scaling logic to catch up.
+	EmergencyUpscale *EmergencyUpscaleConfig `json:"emergencyUpscale,omitempty"`
+	// NodePressure, if provided, enables taking memory pressure on the node into account when
+	// scaling each VM.
+	NodePressure *NodePressureConfig `json:"nodePressure,omitempty"`
+	// Prediction, if provided, enables upscaling VMs pre-emptively when the trend in their recent
+	// metrics shows that they'll soon need more resources.
+	Prediction *PredictionConfig `json:"prediction,omitempty"`
+	// Burst, if provided, enables immediately upscaling VMs by the maximum step when their load or
+	// connections spike, bypassing the scaling policy and stabilization.
+	Burst *BurstConfig `json:"burst,omitempty"`
+	// TimeOfDay, if provided, varies how far VMs may be downscaled at a time depending on the time
+	// of day, by modifying the scaling policy.
+	TimeOfDay *TimeOfDayConfig `json:"timeOfDay,omitempty"`
+	// Profiles gives named scaling settings that replace DefaultConfig for the VMs they select. If
+	// more than one profile selects a VM, the first is used. Changes require a restart.
+	Profiles []ScalingProfile `json:"profiles,omitempty"`
+	// ReloadEverySeconds, if non-zero, makes the autoscaler-agent periodically re-read its config
+	// file and apply changes without restarting. This covers DefaultConfig, EmergencyUpscale,
+	// Prediction, Burst, TimeOfDay, most of NodePressure, and the request and retry intervals for
+	// the scheduler, vm-monitor, and NeonVM. Changes to anything else still require a restart.
+	ReloadEverySeconds uint `json:"reloadEverySeconds,omitempty"`
+}
+
+// EmergencyUpscaleConfig defines the triggers and limits for emergency upscaling
+type EmergencyUpscaleConfig struct {
+	// IncreaseCU is the number of compute units to add to the VM's current resources
+	IncreaseCU uint16 `json:"increaseCU"`
+	// MinIntervalSeconds gives the minimum duration, in seconds, between emergency upscales for
+	// the same VM.
+	MinIntervalSeconds uint `json:"minIntervalSeconds"`
+	// ValidSeconds gives the duration, in seconds, that emergency upscaling should be respected
+	// for, before allowing re-downscaling.
+	ValidSeconds uint `json:"validSeconds"`
+
+	// OnMonitorUpscaleRequest, if true, treats every upscale request from the vm-monitor as an
+	// emergency. The vm-monitor only sends these when the VM is close to running out of memory.
+	OnMonitorUpscaleRequest bool `json:"onMonitorUpscaleRequest"`
+	// MemoryStalledFractionThreshold, if non-zero, triggers emergency upscaling when the fraction
+	// of time that the VM was fully stalled on memory (from PSI) between metrics requests is at
+	// least this value.
+	MemoryStalledFractionThreshold float64 `json:"memoryStalledFractionThreshold"`
+}
+
+// NodePressureConfig defines how memory pressure on the node is detected, and how scaling changes
+// while the node is under pressure
+type NodePressureConfig struct {
+	// MemoryPressureThreshold gives the percentage of time, averaged over 10 seconds, that tasks on
+	// the node can be stalled on memory (the "some avg10" value from PSI) before the node is
+	// considered to be under pressure.
+	MemoryPressureThreshold float64 `json:"memoryPressureThreshold"`
+	// CheckEverySeconds gives the interval between checks of the node's memory pressure
+	CheckEverySeconds uint `json:"checkEverySeconds"`
+	// RetryDeniedDownscaleSeconds replaces .monitor.retryDeniedDownscaleSeconds while the node is
+	// under pressure, so that idle VMs are asked to downscale more often.
+	RetryDeniedDownscaleSeconds uint `json:"retryDeniedDownscaleSeconds"`
+	// MaxUpscaleCU gives the maximum number of compute units that a VM may be upscaled by, based
+	// on its metrics, while the node is under pressure. Upscaling requested by the vm-monitor is
+	// not limited.
+	MaxUpscaleCU uint16 `json:"maxUpscaleCU"`
+	// PriorityDelaySeconds, if non-zero, delays how long VMs with a positive priority wait before
+	// responding to pressure on the node, by this many seconds per unit of priority. This way,
+	// resources are reclaimed from lower-priority VMs first, and higher-priority VMs are only
+	// affected if the pressure persists.
+	PriorityDelaySeconds uint `json:"priorityDelaySeconds,omitempty"`
+}
+
+// PredictionConfig defines how the trend in each VM's metrics is projected forward
+type PredictionConfig struct {
+	// WindowSeconds gives the duration, in seconds, of recent metrics that the trend is fit to
+	WindowSeconds uint `json:"windowSeconds"`
+	// HorizonSeconds gives how far ahead, in seconds, the trend is projected. If the projected
+	// metrics would require more compute units, the VM is upscaled to that amount immediately.
+	HorizonSeconds uint `json:"horizonSeconds"`
+	// MinSamples gives the minimum number of metrics within the window required to make a
+	// prediction. Must be at least 2.
+	MinSamples uint `json:"minSamples"`
+}
+
+// BurstConfig defines the triggers and limits for burst upscaling
+//
+// A burst upscale raises the VM by its scaling config's maxScaleStepCU, or to its maximum if that
+// isn't set. It's rate limited separately from emergency upscaling.
+type BurstConfig struct {
+	// LoadPerCPUThreshold, if non-zero, triggers burst upscaling when the VM's 1-minute load
+	// average per vCPU is at least this value.
+	LoadPerCPUThreshold float64 `json:"loadPerCPUThreshold,omitempty"`
+	// ActiveBackendsPerCUThreshold, if non-zero, triggers burst upscaling when the number of
+	// active Postgres backends per compute unit is at least this value. This requires Postgres
+	// metrics to be enabled.
+	ActiveBackendsPerCUThreshold float64 `json:"activeBackendsPerCUThreshold,omitempty"`
+	// MinIntervalSeconds gives the minimum duration, in seconds, between burst upscales for the
+	// same VM.
+	MinIntervalSeconds uint `json:"minIntervalSeconds"`
+	// ValidSeconds gives the duration, in seconds, that burst upscaling should be respected for,
+	// before allowing re-downscaling.
+	ValidSeconds uint `json:"validSeconds"`
+}
+
+// TimeOfDayConfig defines the times of day when downscaling is modified
+type TimeOfDayConfig struct {
+	// Timezone gives the IANA name of the timezone that the periods are in, e.g.
+	// "America/New_York".
+	Timezone string `json:"timezone"`
+	// Periods gives the times of day when downscaling is modified. If the current time is in
+	// multiple periods, the first one is used. Outside of all periods, downscaling is unchanged.
+	Periods []TimeOfDayPeriodConfig `json:"periods"`
+}
+
+// TimeOfDayPeriodConfig defines a single period within each day, with how aggressively VMs may be
+// downscaled during it
+type TimeOfDayPeriodConfig struct {
+	// Start gives the time of day, formatted like "09:00", at which the period begins
+	Start string `json:"start"`
+	// End gives the time of day, formatted like "17:30", at which the period ends. If End is before
+	// Start, the period continues past midnight.
+	End string `json:"end"`
+	// DownscaleFraction gives the fraction of the difference between a VM's current compute units
+	// and the scaling policy's goal that the VM may be downscaled by. With 1, downscaling is
+	// unchanged; with 0, there's no downscaling at all.
+	DownscaleFraction float64 `json:"downscaleFraction"`
 }
 
 // MetricsConfig defines a few parameters for metrics requests to the VM
@@ -89,10 +450,90 @@ type MetricsConfig struct {
 	// LoadMetricPrefix is the prefix at the beginning of the load metrics that we use. For
 	// node_exporter, this is "node_", and for vector it's "host_"
 	LoadMetricPrefix string `json:"loadMetricPrefix"`
+	// HostMetricLabels optionally gives the labels to select the series of each host metric to use,
+	// for when vector.dev exports more than one (e.g., with different "host" or "device" labels).
+	HostMetricLabels core.HostMetricLabels `json:"hostMetricLabels"`
 	// RequestTimeoutSeconds gives the timeout duration, in seconds, for metrics requests
 	RequestTimeoutSeconds uint `json:"requestTimeoutSeconds"`
 	// SecondsBetweenRequests sets the number of seconds to wait between metrics requests
 	SecondsBetweenRequests uint `json:"secondsBetweenRequests"`
+	// Postgres, if provided, enables also fetching metrics from postgres_exporter in the VM, for
+	// use with the Postgres-based targets in api.ScalingConfig
+	Postgres *PostgresMetricsConfig `json:"postgres,omitempty"`
+	// LFC, if not nil, enables collecting metrics about Postgres' local file cache, for use by
+	// VMs with lfcToMemoryRatio in their scaling config.
+	LFC *LFCMetricsConfig `json:"lfc,omitempty"`
+	// OTLP, if not nil, enables receiving metrics pushed over OTLP/gRPC by VMs with the
+	// metrics-transport annotation set to "otlp".
+	OTLP *OTLPMetricsConfig `json:"otlp,omitempty"`
+	// TLS, if not nil, makes metrics requests to VMs use HTTPS, optionally with authentication.
+	// This applies to all of the endpoints that metrics are fetched from.
+	TLS *MetricsTLSConfig `json:"tls,omitempty"`
+	// Targets optionally gives additional endpoints in the VM to fetch metrics from, alongside the
+	// one on Port. The outputs from all of them are merged before reading the host metrics, and a
+	// target that fails doesn't prevent using the rest.
+	Targets []MetricsTargetConfig `json:"targets,omitempty"`
+}
+
+type MetricsTargetConfig struct {
+	// Name identifies the target in logs
+	Name string `json:"name"`
+	// Port is the port that the target serves metrics on in the VM
+	Port uint16 `json:"port"`
+	// Path is the HTTP path of the target's metrics. Defaults to "/metrics".
+	Path string `json:"path,omitempty"`
+	// RenameMetrics optionally maps from the names of metrics served by the target to the names
+	// they're merged as -- e.g., so that one target's "node_load1" can be used as "host_load1".
+	//
+	// Where more than one target has the same metric, the value from Port is preferred, and after
+	// that the earliest target in the list.
+	RenameMetrics map[string]string `json:"renameMetrics,omitempty"`
+}
+
+// scrapeTargets returns all of the endpoints in the VM to fetch metrics from, in order of
+// preference
+func (c *MetricsConfig) scrapeTargets() []MetricsTargetConfig {
+	primary := MetricsTargetConfig{
+		Name:          "default",
+		Port:          c.Port,
+		Path:          "",
+		RenameMetrics: nil,
+	}
+	return append([]MetricsTargetConfig{primary}, c.Targets...)
+}
+
+type MetricsTLSConfig struct {
+	// CAFile, if not empty, gives the path of a PEM bundle with the CAs to trust for the VMs'
+	// certificates. Otherwise, the system's CAs are used.
+	CAFile string `json:"caFile,omitempty"`
+	// ServerName, if not empty, is the name to verify the VMs' certificates against, instead of
+	// their pod IPs.
+	ServerName string `json:"serverName,omitempty"`
+	// ClientCertFile and ClientKeyFile optionally give the paths of the certificate and key that
+	// the autoscaler-agent presents to VMs, for mTLS. Either both or neither must be set.
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+	// BearerTokenFile, if not empty, gives the path of a file with a token to send in the
+	// Authorization header of each request.
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+}
+
+type PostgresMetricsConfig struct {
+	// Port is the port that postgres_exporter serves metrics on in the VM
+	Port uint16 `json:"port"`
+}
+
+type LFCMetricsConfig struct {
+	// Port is the port that sql_exporter serves the LFC metrics on in the VM
+	Port uint16 `json:"port"`
+}
+
+type OTLPMetricsConfig struct {
+	// Port is the port that the autoscaler-agent listens on for OTLP/gRPC metrics exports
+	Port uint16 `json:"port"`
+	// MaxAgeSeconds gives the maximum age, in seconds, of pushed metrics that may still be used.
+	// Older metrics are treated as if the VM hadn't sent any.
+	MaxAgeSeconds uint `json:"maxAgeSeconds"`
 }
 
 // SchedulerConfig defines a few parameters for scheduler requests
@@ -116,6 +557,11 @@ type SchedulerConfig struct {
 	RetryDeniedUpscaleSeconds uint `json:"retryDeniedUpscaleSeconds"`
 	// RequestPort defines the port to access the scheduler's ✨special✨ API with
 	RequestPort uint16 `json:"requestPort"`
+	// Transport gives how requests are sent to the scheduler: "http" (the default), or "grpc".
+	Transport SchedulerTransport `json:"transport,omitempty"`
+	// GRPC gives the settings for requests to the scheduler over gRPC. It's required if Transport
+	// is "grpc".
+	GRPC *SchedulerGRPCConfig `json:"grpc,omitempty"`
 	// MaxFailedRequestRate defines the maximum rate of failed scheduler requests, above which
 	// a VM is considered stuck.
 	MaxFailedRequestRate RateThresholdConfig `json:"maxFailedRequestRate"`
@@ -132,9 +578,92 @@ type NeonVMConfig struct {
 	// MaxFailedRequestRate defines the maximum rate of failed NeonVM requests, above which
 	// a VM is considered stuck.
 	MaxFailedRequestRate RateThresholdConfig `json:"maxFailedRequestRate"`
+
+	// PatchQueue, if not nil, sends all VM patches through a single queue for the node, which
+	// combines repeated patches to the same VM and limits the rate of requests to the API server
+	PatchQueue *PatchQueueConfig `json:"patchQueue"`
+}
+
+// PatchQueueConfig configures the queue that VM patches are sent through
+//
+// While a patch is waiting in the queue, a newer patch of the same kind for the same VM (e.g.
+// another change to its resources) replaces it, so that only the latest is sent.
+type PatchQueueConfig struct {
+	// QueueSize gives the maximum number of patches waiting to be sent. Once the queue is full, new
+	// patches fail immediately, unless they replace one that's already waiting.
+	QueueSize uint `json:"queueSize"`
+	// Workers gives the number of patch requests that may be in progress at once
+	Workers uint `json:"workers"`
+	// RequestsPerSecond gives the maximum sustained rate of patch requests
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst gives the number of patch requests that may be made at once, above RequestsPerSecond
+	Burst uint `json:"burst"`
+	// ThrottledWaitSeconds gives the duration, in seconds, that the queue pauses for after the API
+	// server responds with 429 Too Many Requests, if the response doesn't say how long to wait.
+	ThrottledWaitSeconds uint `json:"throttledWaitSeconds"`
 }
 
 func ReadConfig(path string) (*Config, error) {
+	config, err := decodeConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
+	}
+
+	return config, nil
+}
+
+// nodeComputeUnit returns the compute unit for VMs on the node: the one in byArch for the node's
+// "kubernetes.io/arch" label, if there is one, or def otherwise.
+//
+// The node's label is used instead of the architecture we're running as, because the two don't
+// have to match (e.g. with emulation).
+func nodeComputeUnit(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	nodeName string,
+	byArch api.ComputeUnitsByArch,
+	def api.Resources,
+) (api.Resources, error) {
+	if len(byArch) == 0 {
+		return def, nil
+	}
+
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return api.Resources{}, fmt.Errorf("Error getting node %q: %w", nodeName, err)
+	}
+	return byArch.Get(node.Labels[corev1.LabelArchStable], def), nil
+}
+
+// CheckConfig reads the config at path and returns every problem with it, instead of just the
+// first. This includes the scaling policy guard rail checks that are otherwise done on startup.
+func CheckConfig(path string) []error {
+	config, err := decodeConfig(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	// Unwind returns the most recent error first, so reverse it to match the order of validate().
+	errs := erc.Unwind(config.validate())
+	for i, j := 0, len(errs)-1; i < j; i, j = i+1, j-1 {
+		errs[i], errs[j] = errs[j], errs[i]
+	}
+	if len(errs) != 0 {
+		// The guard rail checks assume the rest of the config is valid.
+		return errs
+	}
+
+	if err := config.Scaling.checkPolicy(); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func decodeConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("Error opening config file %q: %w", path, err)
@@ -148,13 +677,20 @@ func ReadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("Error decoding JSON config in %q: %w", path, err)
 	}
 
-	if err = config.validate(); err != nil {
-		return nil, fmt.Errorf("Invalid config: %w", err)
-	}
-
 	return &config, nil
 }
 
+// checkPolicy runs custom scaling policies against a set of canned scenarios, so that an unsafe
+// policy is caught before it affects any VMs.
+func (c *ScalingConfig) checkPolicy() error {
+	if name := c.Policy; name != "" && name != core.DefaultScalingPolicyName {
+		if err := simulate.CheckPolicy(name, c.ComputeUnit, c.DefaultConfig); err != nil {
+			return fmt.Errorf("Scaling policy %q failed guard rail checks: %w", name, err)
+		}
+	}
+	return nil
+}
+
 func (c *Config) validate() error {
 	ec := &erc.Collector{}
 
@@ -163,25 +699,120 @@ func (c *Config) validate() error {
 		zeroTmpl  = "field %q cannot be zero"
 	)
 
-	erc.Whenf(ec, c.Billing.ActiveTimeMetricName == "", emptyTmpl, ".billing.activeTimeMetricName")
-	erc.Whenf(ec, c.Billing.CPUMetricName == "", emptyTmpl, ".billing.cpuMetricName")
-	erc.Whenf(ec, c.Billing.CollectEverySeconds == 0, zeroTmpl, ".billing.collectEverySeconds")
-	erc.Whenf(ec, c.Billing.AccumulateEverySeconds == 0, zeroTmpl, ".billing.accumulateEverySeconds")
-	erc.Whenf(ec, c.Billing.Clients.HTTP != nil && c.Billing.Clients.HTTP.PushEverySeconds == 0, zeroTmpl, ".billing.clients.http.pushEverySeconds")
-	erc.Whenf(ec, c.Billing.Clients.HTTP != nil && c.Billing.Clients.HTTP.PushRequestTimeoutSeconds == 0, zeroTmpl, ".billing.clients.http.pushRequestTimeoutSeconds")
-	erc.Whenf(ec, c.Billing.Clients.HTTP != nil && c.Billing.Clients.HTTP.MaxBatchSize == 0, zeroTmpl, ".billing.clients.http.maxBatchSize")
-	erc.Whenf(ec, c.Billing.Clients.HTTP != nil && c.Billing.Clients.HTTP.URL == "", emptyTmpl, ".billing.clients.http.url")
+	validateBillingConfig(ec, &c.Billing)
 	erc.Whenf(ec, c.DumpState != nil && c.DumpState.Port == 0, zeroTmpl, ".dumpState.port")
 	erc.Whenf(ec, c.DumpState != nil && c.DumpState.TimeoutSeconds == 0, zeroTmpl, ".dumpState.timeoutSeconds")
+	erc.Whenf(ec, c.Decisions != nil && c.Decisions.HistorySize == 0, zeroTmpl, ".decisions.historySize")
+	if a := c.AnomalyEvents; a != nil {
+		erc.Whenf(ec, a.RepeatedDenialsThreshold == 0, zeroTmpl, ".anomalyEvents.repeatedDenialsThreshold")
+		erc.Whenf(ec, a.MetricsUnreachableSeconds == 0, zeroTmpl, ".anomalyEvents.metricsUnreachableSeconds")
+		erc.Whenf(ec, a.BillingPushFailuresThreshold == 0, zeroTmpl, ".anomalyEvents.billingPushFailuresThreshold")
+		erc.Whenf(ec, a.VMStoreFailingSeconds == 0, zeroTmpl, ".anomalyEvents.vmStoreFailingSeconds")
+		erc.Whenf(ec, a.HostContentionStealFraction < 0 || a.HostContentionStealFraction > 1, "field %q must be between 0 and 1", ".anomalyEvents.hostContentionStealFraction")
+	}
+	if h := c.Health; h != nil {
+		erc.Whenf(ec, h.Port == 0, zeroTmpl, ".health.port")
+		erc.Whenf(ec, h.TimeoutSeconds == 0, zeroTmpl, ".health.timeoutSeconds")
+		erc.Whenf(ec, h.MaxFailingMetricsFraction < 0 || h.MaxFailingMetricsFraction > 1, "field %q must be between 0 and 1", ".health.maxFailingMetricsFraction")
+	}
+	erc.Whenf(ec, c.StateAPI != nil && c.StateAPI.Port == 0, zeroTmpl, ".stateAPI.port")
+	erc.Whenf(ec, c.StateAPI != nil && c.StateAPI.MaxPageSize == 0, zeroTmpl, ".stateAPI.maxPageSize")
+	erc.Whenf(ec, c.StateAPI != nil && c.StateAPI.BearerTokenFile == "", emptyTmpl, ".stateAPI.bearerTokenFile")
+	erc.Whenf(ec, c.Webhook != nil && c.Webhook.URL == "", emptyTmpl, ".webhook.url")
+	erc.Whenf(ec, c.Webhook != nil && c.Webhook.TimeoutSeconds == 0, zeroTmpl, ".webhook.timeoutSeconds")
+	erc.Whenf(ec, c.Webhook != nil && c.Webhook.MaxRetries != 0 && c.Webhook.RetryWaitSeconds == 0, zeroTmpl, ".webhook.retryWaitSeconds")
+	erc.Whenf(ec, c.Webhook != nil && c.Webhook.QueueSize == 0, zeroTmpl, ".webhook.queueSize")
+	if c.StatusAnnotation != nil {
+		erc.Whenf(ec, c.StatusAnnotation.UpdateEverySeconds == 0, zeroTmpl, ".statusAnnotation.updateEverySeconds")
+	}
+	if c.Disk != nil {
+		erc.Whenf(ec, c.Disk.CheckEverySeconds == 0, zeroTmpl, ".disk.checkEverySeconds")
+		erc.Whenf(ec, c.Disk.UsageThreshold <= 0 || c.Disk.UsageThreshold >= 1, "field %q must be between 0 and 1", ".disk.usageThreshold")
+		erc.Whenf(ec, c.Disk.GrowthFraction < 0, "field %q cannot be negative", ".disk.growthFraction")
+		erc.Whenf(ec, c.Disk.GrowthFraction == 0 && c.Disk.MinGrowth == 0, "fields %q and %q cannot both be zero", ".disk.growthFraction", ".disk.minGrowth")
+		erc.Whenf(ec, c.Disk.MaxSize == 0, zeroTmpl, ".disk.maxSize")
+	}
+	if t := c.Tracing; t != nil {
+		erc.Whenf(ec, t.Endpoint == "", emptyTmpl, ".tracing.endpoint")
+		erc.Whenf(ec, t.SampleFraction < 0 || t.SampleFraction > 1, "field %q must be between 0 and 1", ".tracing.sampleFraction")
+		erc.Whenf(ec, t.ExportIntervalSeconds == 0, zeroTmpl, ".tracing.exportIntervalSeconds")
+		erc.Whenf(ec, t.MaxQueueSize == 0, zeroTmpl, ".tracing.maxQueueSize")
+	}
+	erc.Whenf(ec, c.FaultInjection != nil && c.FaultInjection.ScenarioPath == "", emptyTmpl, ".faultInjection.scenarioPath")
+	if l := c.LeaderElection; l != nil {
+		erc.Whenf(ec, l.LeaseNamespace == "", emptyTmpl, ".leaderElection.leaseNamespace")
+		erc.Whenf(ec, l.LeaseNamePrefix == "", emptyTmpl, ".leaderElection.leaseNamePrefix")
+		erc.Whenf(ec, l.LeaseDurationSeconds == 0, zeroTmpl, ".leaderElection.leaseDurationSeconds")
+		erc.Whenf(ec, l.RenewDeadlineSeconds == 0, zeroTmpl, ".leaderElection.renewDeadlineSeconds")
+		erc.Whenf(ec, l.RenewDeadlineSeconds >= l.LeaseDurationSeconds, "field %q must be less than %q", ".leaderElection.renewDeadlineSeconds", ".leaderElection.leaseDurationSeconds")
+		erc.Whenf(ec, l.RetryPeriodSeconds == 0, zeroTmpl, ".leaderElection.retryPeriodSeconds")
+		erc.Whenf(ec, l.MetricsPort == 0, zeroTmpl, ".leaderElection.metricsPort")
+	}
 	erc.Whenf(ec, c.Metrics.Port == 0, zeroTmpl, ".metrics.port")
 	erc.Whenf(ec, c.Metrics.LoadMetricPrefix == "", emptyTmpl, ".metrics.loadMetricPrefix")
 	erc.Whenf(ec, c.Metrics.RequestTimeoutSeconds == 0, zeroTmpl, ".metrics.requestTimeoutSeconds")
 	erc.Whenf(ec, c.Metrics.SecondsBetweenRequests == 0, zeroTmpl, ".metrics.secondsBetweenRequests")
+	if t := c.Metrics.TLS; t != nil {
+		erc.Whenf(ec, t.ClientCertFile != "" && t.ClientKeyFile == "", emptyTmpl, ".metrics.tls.clientKeyFile")
+		erc.Whenf(ec, t.ClientKeyFile != "" && t.ClientCertFile == "", emptyTmpl, ".metrics.tls.clientCertFile")
+	}
+	for i, t := range c.Metrics.Targets {
+		erc.Whenf(ec, t.Name == "", emptyTmpl, fmt.Sprintf(".metrics.targets[%d].name", i))
+		erc.Whenf(ec, t.Port == 0, zeroTmpl, fmt.Sprintf(".metrics.targets[%d].port", i))
+		erc.Whenf(ec, t.Path != "" && !strings.HasPrefix(t.Path, "/"), "field %q must start with '/'", fmt.Sprintf(".metrics.targets[%d].path", i))
+	}
+	erc.Whenf(ec, c.Metrics.Postgres != nil && c.Metrics.Postgres.Port == 0, zeroTmpl, ".metrics.postgres.port")
+	erc.Whenf(ec, c.Metrics.LFC != nil && c.Metrics.LFC.Port == 0, zeroTmpl, ".metrics.lfc.port")
+	erc.Whenf(ec, c.Metrics.OTLP != nil && c.Metrics.OTLP.Port == 0, zeroTmpl, ".metrics.otlp.port")
+	erc.Whenf(ec, c.Metrics.OTLP != nil && c.Metrics.OTLP.MaxAgeSeconds == 0, zeroTmpl, ".metrics.otlp.maxAgeSeconds")
 	erc.Whenf(ec, c.Scaling.ComputeUnit.VCPU == 0, zeroTmpl, ".scaling.computeUnit.vCPUs")
 	erc.Whenf(ec, c.Scaling.ComputeUnit.Mem == 0, zeroTmpl, ".scaling.computeUnit.mem")
+	if err := c.Scaling.ComputeUnitsByArch.Validate(".scaling.computeUnitsByArch"); err != nil {
+		ec.Add(err)
+	}
+	erc.Whenf(ec, c.Scaling.EmergencyUpscale != nil && c.Scaling.EmergencyUpscale.IncreaseCU == 0, zeroTmpl, ".scaling.emergencyUpscale.increaseCU")
+	erc.Whenf(ec, c.Scaling.EmergencyUpscale != nil && c.Scaling.EmergencyUpscale.MinIntervalSeconds == 0, zeroTmpl, ".scaling.emergencyUpscale.minIntervalSeconds")
+	erc.Whenf(ec, c.Scaling.EmergencyUpscale != nil && c.Scaling.EmergencyUpscale.ValidSeconds == 0, zeroTmpl, ".scaling.emergencyUpscale.validSeconds")
+	erc.Whenf(ec, c.Scaling.NodePressure != nil && c.Scaling.NodePressure.MemoryPressureThreshold <= 0, "field %q must be greater than 0", ".scaling.nodePressure.memoryPressureThreshold")
+	erc.Whenf(ec, c.Scaling.NodePressure != nil && c.Scaling.NodePressure.CheckEverySeconds == 0, zeroTmpl, ".scaling.nodePressure.checkEverySeconds")
+	erc.Whenf(ec, c.Scaling.NodePressure != nil && c.Scaling.NodePressure.RetryDeniedDownscaleSeconds == 0, zeroTmpl, ".scaling.nodePressure.retryDeniedDownscaleSeconds")
+	erc.Whenf(ec, c.Scaling.Prediction != nil && c.Scaling.Prediction.WindowSeconds == 0, zeroTmpl, ".scaling.prediction.windowSeconds")
+	erc.Whenf(ec, c.Scaling.Prediction != nil && c.Scaling.Prediction.HorizonSeconds == 0, zeroTmpl, ".scaling.prediction.horizonSeconds")
+	erc.Whenf(ec, c.Scaling.Prediction != nil && c.Scaling.Prediction.MinSamples < 2, "field %q must be at least 2", ".scaling.prediction.minSamples")
+	if b := c.Scaling.Burst; b != nil {
+		erc.Whenf(ec, b.LoadPerCPUThreshold < 0, "field %q must not be negative", ".scaling.burst.loadPerCPUThreshold")
+		erc.Whenf(ec, b.ActiveBackendsPerCUThreshold < 0, "field %q must not be negative", ".scaling.burst.activeBackendsPerCUThreshold")
+		erc.Whenf(
+			ec, b.LoadPerCPUThreshold == 0 && b.ActiveBackendsPerCUThreshold == 0,
+			"fields %q and %q cannot both be zero", ".scaling.burst.loadPerCPUThreshold", ".scaling.burst.activeBackendsPerCUThreshold",
+		)
+		erc.Whenf(ec, b.ActiveBackendsPerCUThreshold != 0 && c.Metrics.Postgres == nil, "field %q requires %q to be set", ".scaling.burst.activeBackendsPerCUThreshold", ".metrics.postgres")
+		erc.Whenf(ec, b.MinIntervalSeconds == 0, zeroTmpl, ".scaling.burst.minIntervalSeconds")
+		erc.Whenf(ec, b.ValidSeconds == 0, zeroTmpl, ".scaling.burst.validSeconds")
+	}
+	if t := c.Scaling.TimeOfDay; t != nil {
+		if _, err := time.LoadLocation(t.Timezone); err != nil {
+			ec.Add(fmt.Errorf("field %q is not a valid timezone: %w", ".scaling.timeOfDay.timezone", err))
+		}
+		erc.Whenf(ec, len(t.Periods) == 0, emptyTmpl, ".scaling.timeOfDay.periods")
+		for i, p := range t.Periods {
+			_, startErr := util.ParseTimeOfDay(p.Start)
+			erc.Whenf(ec, startErr != nil, "field %q must be a time formatted like \"09:00\"", fmt.Sprintf(".scaling.timeOfDay.periods[%d].start", i))
+			_, endErr := util.ParseTimeOfDay(p.End)
+			erc.Whenf(ec, endErr != nil, "field %q must be a time formatted like \"09:00\"", fmt.Sprintf(".scaling.timeOfDay.periods[%d].end", i))
+			erc.Whenf(ec, p.DownscaleFraction < 0 || p.DownscaleFraction > 1, "field %q must be between 0 and 1", fmt.Sprintf(".scaling.timeOfDay.periods[%d].downscaleFraction", i))
+		}
+	}
 	erc.Whenf(ec, c.NeonVM.RequestTimeoutSeconds == 0, zeroTmpl, ".scaling.requestTimeoutSeconds")
 	erc.Whenf(ec, c.NeonVM.RetryFailedRequestSeconds == 0, zeroTmpl, ".scaling.retryFailedRequestSeconds")
 	erc.Whenf(ec, c.NeonVM.MaxFailedRequestRate.IntervalSeconds == 0, zeroTmpl, ".neonvm.maxFailedRequestRate.intervalSeconds")
+	if q := c.NeonVM.PatchQueue; q != nil {
+		erc.Whenf(ec, q.QueueSize == 0, zeroTmpl, ".neonvm.patchQueue.queueSize")
+		erc.Whenf(ec, q.Workers == 0, zeroTmpl, ".neonvm.patchQueue.workers")
+		erc.Whenf(ec, q.RequestsPerSecond <= 0, "field %q must be greater than zero", ".neonvm.patchQueue.requestsPerSecond")
+		erc.Whenf(ec, q.Burst == 0, zeroTmpl, ".neonvm.patchQueue.burst")
+		erc.Whenf(ec, q.ThrottledWaitSeconds == 0, zeroTmpl, ".neonvm.patchQueue.throttledWaitSeconds")
+	}
 	erc.Whenf(ec, c.Monitor.ResponseTimeoutSeconds == 0, zeroTmpl, ".monitor.responseTimeoutSeconds")
 	erc.Whenf(ec, c.Monitor.ConnectionTimeoutSeconds == 0, zeroTmpl, ".monitor.connectionTimeoutSeconds")
 	erc.Whenf(ec, c.Monitor.ConnectionRetryMinWaitSeconds == 0, zeroTmpl, ".monitor.connectionRetryMinWaitSeconds")
@@ -193,15 +824,387 @@ func (c *Config) validate() error {
 	erc.Whenf(ec, c.Monitor.RetryDeniedDownscaleSeconds == 0, zeroTmpl, ".monitor.retryDeniedDownscaleSeconds")
 	erc.Whenf(ec, c.Monitor.RequestedUpscaleValidSeconds == 0, zeroTmpl, ".monitor.requestedUpscaleValidSeconds")
 	erc.Whenf(ec, c.Monitor.MaxFailedRequestRate.IntervalSeconds == 0, zeroTmpl, ".monitor.maxFailedRequestRate.intervalSeconds")
+	if rc := c.Monitor.Restart; rc != nil {
+		erc.Whenf(ec, rc.CheckEverySeconds == 0, zeroTmpl, ".monitor.restart.checkEverySeconds")
+		erc.Whenf(ec, rc.TimeoutSeconds <= rc.DrainTimeoutSeconds, "field %q must be greater than %q", ".monitor.restart.timeoutSeconds", ".monitor.restart.drainTimeoutSeconds")
+		erc.Whenf(ec, rc.MaxAttempts == 0, zeroTmpl, ".monitor.restart.maxAttempts")
+	}
+	if fc := c.Monitor.FileCache; fc != nil {
+		erc.Whenf(ec, fc.MemoryFraction <= 0 || fc.MemoryFraction >= 1, "field %q must be between 0 and 1, exclusive", ".monitor.fileCache.memoryFraction")
+		for name, fraction := range fc.Settings {
+			erc.Whenf(ec, fraction <= 0 || fraction >= 1, "field %q must be between 0 and 1, exclusive", fmt.Sprintf(".monitor.fileCache.settings[%q]", name))
+		}
+	}
 	// add all errors if there are any: https://github.com/neondatabase/autoscaling/pull/195#discussion_r1170893494
 	ec.Add(c.Scaling.DefaultConfig.Validate())
+	profileNames := make(map[string]struct{})
+	for i, p := range c.Scaling.Profiles {
+		path := fmt.Sprintf(".scaling.profiles[%d]", i)
+		erc.Whenf(ec, p.Name == "", emptyTmpl, path+".name")
+		_, duplicate := profileNames[p.Name]
+		erc.Whenf(ec, duplicate, "field %q has duplicate profile name %q", path+".name", p.Name)
+		profileNames[p.Name] = struct{}{}
+		if p.Selector != nil {
+			_, err := metav1.LabelSelectorAsSelector(p.Selector)
+			erc.Whenf(ec, err != nil, "field %q is not a valid label selector: %s", path+".selector", err)
+		}
+		if err := p.Config.Validate(); err != nil {
+			ec.Add(fmt.Errorf("field %q is invalid: %w", path+".config", err))
+		}
+		erc.Whenf(ec, p.MinCU != nil && *p.MinCU == 0, zeroTmpl, path+".minCU")
+		erc.Whenf(ec, p.MaxCU != nil && *p.MaxCU == 0, zeroTmpl, path+".maxCU")
+		erc.Whenf(ec, p.MinCU != nil && p.MaxCU != nil && *p.MinCU > *p.MaxCU, "field %q cannot be greater than %q", path+".minCU", path+".maxCU")
+	}
+	if c.Scaling.Policy != "" {
+		_, ok := core.LookupScalingPolicy(c.Scaling.Policy)
+		erc.Whenf(ec, !ok, "field %q refers to unknown scaling policy %q", ".scaling.policy", c.Scaling.Policy)
+	}
+	if len(c.Scaling.WeightedGoal) != 0 {
+		erc.Whenf(
+			ec, c.Scaling.Policy != "" && c.Scaling.Policy != core.DefaultScalingPolicyName,
+			"field %q cannot be used with %q", ".scaling.weightedGoal", ".scaling.policy",
+		)
+		if err := core.ValidateWeightedGoal(c.Scaling.WeightedGoal); err != nil {
+			ec.Add(fmt.Errorf("field %q is invalid: %w", ".scaling.weightedGoal", err))
+		}
+	}
+	if c.Scaling.GoalExpression != "" {
+		erc.Whenf(
+			ec, c.Scaling.Policy != "" && c.Scaling.Policy != core.DefaultScalingPolicyName,
+			"field %q cannot be used with %q", ".scaling.goalExpression", ".scaling.policy",
+		)
+		erc.Whenf(ec, len(c.Scaling.WeightedGoal) != 0, "field %q cannot be used with %q", ".scaling.goalExpression", ".scaling.weightedGoal")
+		if _, err := core.ParseExpression(c.Scaling.GoalExpression); err != nil {
+			ec.Add(fmt.Errorf("field %q is invalid: %w", ".scaling.goalExpression", err))
+		}
+	}
 	erc.Whenf(ec, c.Scheduler.RequestPort == 0, zeroTmpl, ".scheduler.requestPort")
 	erc.Whenf(ec, c.Scheduler.RequestTimeoutSeconds == 0, zeroTmpl, ".scheduler.requestTimeoutSeconds")
 	erc.Whenf(ec, c.Scheduler.RequestAtLeastEverySeconds == 0, zeroTmpl, ".scheduler.requestAtLeastEverySeconds")
 	erc.Whenf(ec, c.Scheduler.RetryFailedRequestSeconds == 0, zeroTmpl, ".scheduler.retryFailedRequestSeconds")
 	erc.Whenf(ec, c.Scheduler.RetryDeniedUpscaleSeconds == 0, zeroTmpl, ".scheduler.retryDeniedUpscaleSeconds")
 	erc.Whenf(ec, c.Scheduler.SchedulerName == "", emptyTmpl, ".scheduler.schedulerName")
+	switch c.Scheduler.Transport {
+	case "", SchedulerTransportHTTP:
+	case SchedulerTransportGRPC:
+		erc.Whenf(ec, c.Scheduler.GRPC == nil, "field %q is required if .scheduler.transport is \"grpc\"", ".scheduler.grpc")
+	default:
+		ec.Add(fmt.Errorf("field %q has unknown value %q", ".scheduler.transport", c.Scheduler.Transport))
+	}
+	if c.Scheduler.GRPC != nil {
+		erc.Whenf(ec, c.Scheduler.GRPC.Port == 0, zeroTmpl, ".scheduler.grpc.port")
+		erc.Whenf(ec, c.Scheduler.GRPC.KeepaliveSeconds == 0, zeroTmpl, ".scheduler.grpc.keepaliveSeconds")
+	}
 	erc.Whenf(ec, c.Scheduler.MaxFailedRequestRate.IntervalSeconds == 0, zeroTmpl, ".monitor.maxFailedRequestRate.intervalSeconds")
 
 	return ec.Resolve()
 }
+
+// validateBillingConfig checks the billing config, adding any problems to ec. It's shared with
+// BillingCollectorConfig, so paths are given as if it were the autoscaler-agent's config.
+func validateBillingConfig(ec *erc.Collector, b *billing.Config) {
+	const (
+		emptyTmpl = "field %q cannot be empty"
+		zeroTmpl  = "field %q cannot be zero"
+	)
+
+	erc.Whenf(ec, b.ActiveTimeMetricName == "", emptyTmpl, ".billing.activeTimeMetricName")
+	erc.Whenf(ec, b.CPUMetricName == "", emptyTmpl, ".billing.cpuMetricName")
+	erc.Whenf(ec, b.CollectEverySeconds == 0, zeroTmpl, ".billing.collectEverySeconds")
+	erc.Whenf(ec, b.AccumulateEverySeconds == 0, zeroTmpl, ".billing.accumulateEverySeconds")
+	byMetric := maps.Keys(b.AccumulateEverySecondsByMetric)
+	slices.Sort(byMetric)
+	for _, metricName := range byMetric {
+		path := fmt.Sprintf(".billing.accumulateEverySecondsByMetric[%q]", metricName)
+		everySeconds := b.AccumulateEverySecondsByMetric[metricName]
+		erc.Whenf(ec, everySeconds == 0, zeroTmpl, path)
+		erc.Whenf(
+			ec, b.AccumulateEverySeconds != 0 && everySeconds%b.AccumulateEverySeconds != 0,
+			"field %q must be a multiple of %q", path, ".billing.accumulateEverySeconds",
+		)
+	}
+	erc.Whenf(
+		ec, b.MaxEventWindowSeconds != 0 && b.MaxEventWindowSeconds < b.AccumulateEverySeconds,
+		"field %q cannot be less than %q", ".billing.maxEventWindowSeconds", ".billing.accumulateEverySeconds",
+	)
+	erc.Whenf(ec, b.Clients.HTTP != nil && b.Clients.HTTP.PushEverySeconds == 0, zeroTmpl, ".billing.clients.http.pushEverySeconds")
+	erc.Whenf(ec, b.Clients.HTTP != nil && b.Clients.HTTP.PushRequestTimeoutSeconds == 0, zeroTmpl, ".billing.clients.http.pushRequestTimeoutSeconds")
+	erc.Whenf(ec, b.Clients.HTTP != nil && b.Clients.HTTP.MaxBatchSize == 0, zeroTmpl, ".billing.clients.http.maxBatchSize")
+	erc.Whenf(ec, b.Clients.HTTP != nil && b.Clients.HTTP.Shards == nil && b.Clients.HTTP.URL == "", emptyTmpl, ".billing.clients.http.url")
+	if b.Clients.HTTP != nil && b.Clients.HTTP.Shards != nil {
+		s := b.Clients.HTTP.Shards
+		erc.Whenf(ec, b.Clients.HTTP.URL != "", "field %q cannot be set with %q", ".billing.clients.http.url", ".billing.clients.http.shards")
+		erc.Whenf(
+			ec, (len(s.URLs) == 0) == (s.URLTemplate == ""),
+			"exactly one of fields %q or %q must be set", ".billing.clients.http.shards.urls", ".billing.clients.http.shards.urlTemplate",
+		)
+		for i, url := range s.URLs {
+			erc.Whenf(ec, url == "", emptyTmpl, fmt.Sprintf(".billing.clients.http.shards.urls[%d]", i))
+		}
+		if s.URLTemplate != "" {
+			erc.Whenf(ec, s.Count == 0, zeroTmpl, ".billing.clients.http.shards.count")
+			erc.Whenf(
+				ec, !strings.Contains(s.URLTemplate, billing.ShardURLTemplateVar),
+				"field %q must contain %q", ".billing.clients.http.shards.urlTemplate", billing.ShardURLTemplateVar,
+			)
+		} else {
+			erc.Whenf(ec, s.Count != 0, "field %q can only be set with %q", ".billing.clients.http.shards.count", ".billing.clients.http.shards.urlTemplate")
+		}
+	}
+	if b.Clients.HTTP != nil {
+		f := b.Clients.HTTP.Format
+		erc.Whenf(ec, !f.Valid(), "field %q has unknown format %q", ".billing.clients.http.format", f)
+	}
+	if b.Clients.HTTP != nil && b.Clients.HTTP.Queue != nil {
+		q := b.Clients.HTTP.Queue
+		erc.Whenf(ec, q.MaxSize == 0, zeroTmpl, ".billing.clients.http.queue.maxSize")
+		erc.Whenf(ec, !q.OverflowPolicy.Valid(), "field %q has unknown overflow policy %q", ".billing.clients.http.queue.overflowPolicy", q.OverflowPolicy)
+		erc.Whenf(ec, q.OverflowPolicy == billing.QueueSpillToDisk && q.SpillDirectory == "", emptyTmpl, ".billing.clients.http.queue.spillDirectory")
+	}
+	if b.Clients.HTTP != nil && b.Clients.HTTP.RateLimit != nil {
+		r := b.Clients.HTTP.RateLimit
+		erc.Whenf(ec, !(r.RequestsPerSecond >= 0), "field %q cannot be negative", ".billing.clients.http.rateLimit.requestsPerSecond")
+		erc.Whenf(ec, r.Burst != 0 && r.RequestsPerSecond == 0, "field %q can only be set with %q", ".billing.clients.http.rateLimit.burst", ".billing.clients.http.rateLimit.requestsPerSecond")
+	}
+	if f := b.Clients.File; f != nil {
+		erc.Whenf(ec, f.PushEverySeconds == 0, zeroTmpl, ".billing.clients.file.pushEverySeconds")
+		erc.Whenf(ec, f.MaxBatchSize == 0, zeroTmpl, ".billing.clients.file.maxBatchSize")
+		erc.Whenf(ec, f.Path == "", emptyTmpl, ".billing.clients.file.path")
+		erc.Whenf(ec, f.MaxFileBytes == 0, zeroTmpl, ".billing.clients.file.maxFileBytes")
+		erc.Whenf(ec, f.MaxFileAgeSeconds == 0, zeroTmpl, ".billing.clients.file.maxFileAgeSeconds")
+		erc.Whenf(ec, f.Format != "" && f.Format != "json", "field %q must be %q if set", ".billing.clients.file.format", "json")
+		erc.Whenf(ec, f.ContentDigest, "field %q is not supported for %q", ".billing.clients.file.contentDigest", ".billing.clients.file")
+		if q := f.Queue; q != nil {
+			erc.Whenf(ec, q.MaxSize == 0, zeroTmpl, ".billing.clients.file.queue.maxSize")
+			erc.Whenf(ec, !q.OverflowPolicy.Valid(), "field %q has unknown overflow policy %q", ".billing.clients.file.queue.overflowPolicy", q.OverflowPolicy)
+			erc.Whenf(ec, q.OverflowPolicy == billing.QueueSpillToDisk, "field %q cannot be %q", ".billing.clients.file.queue.overflowPolicy", billing.QueueSpillToDisk)
+		}
+	}
+	if n := b.Clients.NATS; n != nil {
+		erc.Whenf(ec, n.PushEverySeconds == 0, zeroTmpl, ".billing.clients.nats.pushEverySeconds")
+		erc.Whenf(ec, n.PushRequestTimeoutSeconds == 0, zeroTmpl, ".billing.clients.nats.pushRequestTimeoutSeconds")
+		erc.Whenf(ec, n.MaxBatchSize == 0, zeroTmpl, ".billing.clients.nats.maxBatchSize")
+		erc.Whenf(ec, n.URL == "", emptyTmpl, ".billing.clients.nats.url")
+		erc.Whenf(ec, n.SubjectTemplate == "", emptyTmpl, ".billing.clients.nats.subjectTemplate")
+		erc.Whenf(ec, n.ReconnectWaitSeconds == 0, zeroTmpl, ".billing.clients.nats.reconnectWaitSeconds")
+		erc.Whenf(ec, n.Format != "" && n.Format != "json", "field %q must be %q if set", ".billing.clients.nats.format", "json")
+		erc.Whenf(ec, n.ContentDigest, "field %q is not supported for %q", ".billing.clients.nats.contentDigest", ".billing.clients.nats")
+		if q := n.Queue; q != nil {
+			erc.Whenf(ec, q.MaxSize == 0, zeroTmpl, ".billing.clients.nats.queue.maxSize")
+			erc.Whenf(ec, !q.OverflowPolicy.Valid(), "field %q has unknown overflow policy %q", ".billing.clients.nats.queue.overflowPolicy", q.OverflowPolicy)
+			erc.Whenf(ec, q.OverflowPolicy == billing.QueueSpillToDisk, "field %q cannot be %q", ".billing.clients.nats.queue.overflowPolicy", billing.QueueSpillToDisk)
+		}
+	}
+	if s := b.Clients.S3; s != nil {
+		erc.Whenf(ec, s.PushEverySeconds == 0, zeroTmpl, ".billing.clients.s3.pushEverySeconds")
+		erc.Whenf(ec, s.PushRequestTimeoutSeconds == 0, zeroTmpl, ".billing.clients.s3.pushRequestTimeoutSeconds")
+		erc.Whenf(ec, s.MaxBatchSize == 0, zeroTmpl, ".billing.clients.s3.maxBatchSize")
+		erc.Whenf(ec, s.Format != "" && s.Format != "json", "field %q must be %q if set", ".billing.clients.s3.format", "json")
+		for _, err := range s.S3ClientConfig.Validate(".billing.clients.s3") {
+			ec.Add(err)
+		}
+		if q := s.Queue; q != nil {
+			erc.Whenf(ec, q.MaxSize == 0, zeroTmpl, ".billing.clients.s3.queue.maxSize")
+			erc.Whenf(ec, !q.OverflowPolicy.Valid(), "field %q has unknown overflow policy %q", ".billing.clients.s3.queue.overflowPolicy", q.OverflowPolicy)
+			erc.Whenf(ec, q.OverflowPolicy == billing.QueueSpillToDisk, "field %q cannot be %q", ".billing.clients.s3.queue.overflowPolicy", billing.QueueSpillToDisk)
+		}
+		if r := s.RateLimit; r != nil {
+			erc.Whenf(ec, !(r.RequestsPerSecond >= 0), "field %q cannot be negative", ".billing.clients.s3.rateLimit.requestsPerSecond")
+			erc.Whenf(ec, r.Burst != 0 && r.RequestsPerSecond == 0, "field %q can only be set with %q", ".billing.clients.s3.rateLimit.burst", ".billing.clients.s3.rateLimit.requestsPerSecond")
+		}
+	}
+	type clientBase struct {
+		path string
+		base *billing.BaseClientConfig
+	}
+	var clientBases []clientBase
+	if b.Clients.HTTP != nil {
+		clientBases = append(clientBases, clientBase{path: ".billing.clients.http", base: &b.Clients.HTTP.BaseClientConfig})
+	}
+	if b.Clients.File != nil {
+		clientBases = append(clientBases, clientBase{path: ".billing.clients.file", base: &b.Clients.File.BaseClientConfig})
+	}
+	if b.Clients.NATS != nil {
+		clientBases = append(clientBases, clientBase{path: ".billing.clients.nats", base: &b.Clients.NATS.BaseClientConfig})
+	}
+	if b.Clients.S3 != nil {
+		clientBases = append(clientBases, clientBase{path: ".billing.clients.s3", base: &b.Clients.S3.BaseClientConfig})
+	}
+	for _, cb := range clientBases {
+		if r := cb.base.Retry; r != nil {
+			erc.Whenf(ec, r.MaxAttempts == 0, zeroTmpl, cb.path+".retry.maxAttempts")
+			erc.Whenf(
+				ec, r.MaxBackoffSeconds < r.InitialBackoffSeconds,
+				"field %q cannot be less than %q", cb.path+".retry.maxBackoffSeconds", cb.path+".retry.initialBackoffSeconds",
+			)
+		}
+		if b := cb.base.CircuitBreaker; b != nil {
+			erc.Whenf(ec, b.FailureThreshold == 0, zeroTmpl, cb.path+".circuitBreaker.failureThreshold")
+			erc.Whenf(ec, b.OpenSeconds == 0, zeroTmpl, cb.path+".circuitBreaker.openSeconds")
+		}
+	}
+	erc.Whenf(ec, b.AnomalyDetection != nil && b.AnomalyDetection.BaselineWindows == 0, zeroTmpl, ".billing.anomalyDetection.baselineWindows")
+	erc.Whenf(ec, b.AnomalyDetection != nil && b.AnomalyDetection.Threshold <= 1, "field %q must be greater than 1", ".billing.anomalyDetection.threshold")
+	if a := b.ScalingActivity; a != nil {
+		erc.Whenf(ec, a.UpscaleMetricName == "", emptyTmpl, ".billing.scalingActivity.upscaleMetricName")
+		erc.Whenf(ec, a.DownscaleMetricName == "", emptyTmpl, ".billing.scalingActivity.downscaleMetricName")
+	}
+	if u := b.Utilization; u != nil {
+		erc.Whenf(ec, u.CPUMetricName == "", emptyTmpl, ".billing.utilization.cpuMetricName")
+		erc.Whenf(ec, u.ComputeUnitMetricName == "", emptyTmpl, ".billing.utilization.computeUnitMetricName")
+	}
+	if e := b.Egress; e != nil {
+		erc.Whenf(ec, e.InternalMetricName == "", emptyTmpl, ".billing.egress.internalMetricName")
+		erc.Whenf(ec, e.InternetMetricName == "", emptyTmpl, ".billing.egress.internetMetricName")
+		erc.Whenf(ec, e.RequestTimeoutSeconds == 0, zeroTmpl, ".billing.egress.requestTimeoutSeconds")
+		for network, metricName := range e.InterfaceMetricNames {
+			erc.Whenf(ec, metricName == "", emptyTmpl, fmt.Sprintf(".billing.egress.interfaceMetricNames.%s", network))
+		}
+		for i, cidr := range e.InternalCIDRs {
+			_, _, err := net.ParseCIDR(cidr)
+			erc.Whenf(ec, err != nil, "field %q is not a valid CIDR: %s", fmt.Sprintf(".billing.egress.internalCIDRs[%d]", i), err)
+		}
+		if src := e.Source; src != nil {
+			erc.Whenf(ec, !src.Kind.Valid(), "field %q has unknown value %q", ".billing.egress.source.kind", src.Kind)
+			isVector := src.Kind == billing.UsageSourceVector
+			isMock := src.Kind == billing.UsageSourceMock
+			erc.Whenf(ec, isVector && src.Vector == nil, "field %q must be provided when %q is %q", ".billing.egress.source.vector", ".billing.egress.source.kind", src.Kind)
+			erc.Whenf(ec, !isVector && src.Vector != nil, "field %q must not be provided when %q is not %q", ".billing.egress.source.vector", ".billing.egress.source.kind", billing.UsageSourceVector)
+			erc.Whenf(ec, isMock && src.Mock == nil, "field %q must be provided when %q is %q", ".billing.egress.source.mock", ".billing.egress.source.kind", src.Kind)
+			erc.Whenf(ec, !isMock && src.Mock != nil, "field %q must not be provided when %q is not %q", ".billing.egress.source.mock", ".billing.egress.source.kind", billing.UsageSourceMock)
+			if v := src.Vector; v != nil {
+				erc.Whenf(ec, v.Port == 0, zeroTmpl, ".billing.egress.source.vector.port")
+				erc.Whenf(ec, len(v.NetworkDevices) == 0, emptyTmpl, ".billing.egress.source.vector.networkDevices")
+			}
+		}
+	}
+	if h := b.HistorySnapshot; h != nil {
+		erc.Whenf(ec, h.Path == "", emptyTmpl, ".billing.historySnapshot.path")
+		erc.Whenf(ec, h.EverySeconds == 0, zeroTmpl, ".billing.historySnapshot.everySeconds")
+		erc.Whenf(ec, h.MaxAgeSeconds == 0, zeroTmpl, ".billing.historySnapshot.maxAgeSeconds")
+	}
+	if f := b.EndpointFilter; f != nil {
+		for i, pattern := range f.Allow {
+			_, err := regexp.Compile(pattern)
+			erc.Whenf(ec, err != nil, "field %q has invalid regular expression: %s", fmt.Sprintf(".billing.endpointFilter.allow[%d]", i), err)
+		}
+		for i, pattern := range f.Deny {
+			_, err := regexp.Compile(pattern)
+			erc.Whenf(ec, err != nil, "field %q has invalid regular expression: %s", fmt.Sprintf(".billing.endpointFilter.deny[%d]", i), err)
+		}
+		if f.Selector != nil {
+			_, err := metav1.LabelSelectorAsSelector(f.Selector)
+			erc.Whenf(ec, err != nil, "field %q is not a valid label selector: %s", ".billing.endpointFilter.selector", err)
+		}
+	}
+	if e := b.Enrichment; e != nil {
+		for i, pattern := range e.DropEndpoints {
+			_, err := regexp.Compile(pattern)
+			erc.Whenf(ec, err != nil, "field %q has invalid regular expression: %s", fmt.Sprintf(".billing.enrichment.dropEndpoints[%d]", i), err)
+		}
+		renamed := maps.Keys(e.MetricNames)
+		slices.Sort(renamed)
+		for _, from := range renamed {
+			erc.Whenf(ec, e.MetricNames[from] == "", emptyTmpl, fmt.Sprintf(".billing.enrichment.metricNames[%q]", from))
+		}
+		for i, name := range e.Hooks {
+			erc.Whenf(ec, !billing.EventEnricherRegistered(name), "field %q has unregistered hook %q", fmt.Sprintf(".billing.enrichment.hooks[%d]", i), name)
+		}
+	}
+	if c := b.ContainerCPU; c != nil {
+		erc.Whenf(ec, c.Port == 0, zeroTmpl, ".billing.containerCPU.port")
+		erc.Whenf(ec, len(c.MetricNames) == 0, emptyTmpl, ".billing.containerCPU.metricNames")
+		erc.Whenf(ec, c.RequestTimeoutSeconds == 0, zeroTmpl, ".billing.containerCPU.requestTimeoutSeconds")
+		for cgroup, metricName := range c.MetricNames {
+			erc.Whenf(ec, cgroup == "", "field %q cannot have an empty cgroup", ".billing.containerCPU.metricNames")
+			erc.Whenf(ec, metricName == "", emptyTmpl, fmt.Sprintf(".billing.containerCPU.metricNames[%q]", cgroup))
+		}
+	}
+	if sb := b.StartupBackfill; sb != nil {
+		erc.Whenf(ec, sb.MaxSeconds == 0, zeroTmpl, ".billing.startupBackfill.maxSeconds")
+		erc.Whenf(ec, sb.IdempotencyKeySuffix == "", emptyTmpl, ".billing.startupBackfill.idempotencyKeySuffix")
+	}
+	erc.Whenf(ec, b.Heartbeat != nil && b.Heartbeat.MetricName == "", emptyTmpl, ".billing.heartbeat.metricName")
+	erc.Whenf(ec, b.Heartbeat != nil && b.Heartbeat.EverySeconds == 0, zeroTmpl, ".billing.heartbeat.everySeconds")
+	if r := b.Residency; r != nil {
+		erc.Whenf(ec, !(r.MinComputeUnits > 0), "field %q must be greater than zero", ".billing.residency.minComputeUnits")
+		erc.Whenf(ec, !(r.Factor > 1), "field %q must be greater than 1", ".billing.residency.factor")
+		erc.Whenf(ec, r.Buckets == 0, zeroTmpl, ".billing.residency.buckets")
+		erc.Whenf(ec, r.Buckets > 64, "field %q must be at most 64", ".billing.residency.buckets")
+		if e := r.Events; e != nil {
+			erc.Whenf(ec, e.MetricNamePrefix == "", emptyTmpl, ".billing.residency.events.metricNamePrefix")
+			erc.Whenf(ec, e.EverySeconds == 0, zeroTmpl, ".billing.residency.events.everySeconds")
+		}
+	}
+	if a := b.Allocation; a != nil {
+		erc.Whenf(ec, a.Port == 0, zeroTmpl, ".billing.allocation.port")
+		erc.Whenf(ec, a.RetentionHours == 0, zeroTmpl, ".billing.allocation.retentionHours")
+	}
+	if r := b.Reconciliation; r != nil {
+		erc.Whenf(ec, r.Windows == 0, zeroTmpl, ".billing.reconciliation.windows")
+		erc.Whenf(ec, r.Tolerance <= 0, "field %q must be greater than zero", ".billing.reconciliation.tolerance")
+	}
+	if w := b.RemoteWrite; w != nil {
+		erc.Whenf(ec, w.URL == "", emptyTmpl, ".billing.remoteWrite.url")
+		erc.Whenf(ec, w.PushRequestTimeoutSeconds == 0, zeroTmpl, ".billing.remoteWrite.pushRequestTimeoutSeconds")
+		for name := range w.Labels {
+			erc.Whenf(
+				ec, name == "" || slices.Contains(billing.RemoteWriteReservedLabels, name),
+				"field %q cannot contain label %q", ".billing.remoteWrite.labels", name,
+			)
+		}
+	}
+	if a := b.ActiveTime; a != nil {
+		erc.Whenf(ec, !a.Mode.Valid(), "field %q has unknown mode %q", ".billing.activeTime.mode", a.Mode)
+		erc.Whenf(ec, a.Mode == billing.ActiveTimeDatabaseActivity && a.IdleAfterSeconds == 0, zeroTmpl, ".billing.activeTime.idleAfterSeconds")
+	}
+	if m := b.EventMetadata; m != nil {
+		for i, f := range m.Fields {
+			erc.Whenf(ec, !f.Valid(), "field %q has unknown metadata field %q", fmt.Sprintf(".billing.eventMetadata.fields[%d]", i), f)
+		}
+		erc.Whenf(
+			ec, slices.Contains(m.Fields, billing.EventMetadataRegion) && m.RegionLabel == "",
+			emptyTmpl, ".billing.eventMetadata.regionLabel",
+		)
+	}
+	if sf := b.StoreFailure; sf != nil && sf.FallbackListEverySeconds != 0 {
+		erc.Whenf(ec, sf.FallbackListTimeoutSeconds == 0, zeroTmpl, ".billing.storeFailure.fallbackListTimeoutSeconds")
+	}
+	// Each metric must have a distinct name, otherwise their events would be indistinguishable.
+	metricNames := b.MetricNames()
+	metricPaths := maps.Keys(metricNames)
+	slices.Sort(metricPaths)
+	metricsByName := make(map[string]string)
+	for _, path := range metricPaths {
+		name := metricNames[path]
+		if other, ok := metricsByName[name]; ok && name != "" {
+			ec.Add(fmt.Errorf("fields %q and %q cannot have the same metric name %q", other, path, name))
+		} else {
+			metricsByName[name] = path
+		}
+	}
+	if r := b.Rounding; r != nil {
+		validatePolicy := func(path string, metric string, p billing.RoundingPolicy) {
+			_, ok := metricsByName[metric]
+			erc.Whenf(ec, !ok || metric == "", "field %q is for unknown metric %q", path, metric)
+			erc.Whenf(ec, p.Increment == 0, zeroTmpl, path+".increment")
+			erc.Whenf(ec, !p.Mode.Valid(), "field %q has unknown rounding mode %q", path+".mode", p.Mode)
+		}
+		for metric, p := range r.Default {
+			validatePolicy(fmt.Sprintf(".billing.rounding.default[%q]", metric), metric, p)
+		}
+		for endpoint, policies := range r.Endpoints {
+			for metric, p := range policies {
+				validatePolicy(fmt.Sprintf(".billing.rounding.endpoints[%q][%q]", endpoint, metric), metric, p)
+			}
+		}
+	}
+	if c := b.CostEstimate; c != nil {
+		for metric, price := range c.Prices {
+			path := fmt.Sprintf(".billing.costEstimate.prices[%q]", metric)
+			_, ok := metricsByName[metric]
+			erc.Whenf(ec, !ok || metric == "", "field %q is for unknown metric %q", path, metric)
+			erc.Whenf(ec, !(price >= 0), "field %q cannot be negative", path)
+		}
+	}
+}
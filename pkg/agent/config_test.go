@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestNodeComputeUnit(t *testing.T) {
+	node := func(name string, arch string) *corev1.Node {
+		return &corev1.Node{ //nolint:exhaustruct // only the labels are used
+			ObjectMeta: metav1.ObjectMeta{ //nolint:exhaustruct // only the name and labels are used
+				Name:   name,
+				Labels: map[string]string{corev1.LabelArchStable: arch},
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(node("amd64-node", "amd64"), node("arm64-node", "arm64"))
+	ctx := context.Background()
+
+	def := api.Resources{VCPU: 250, Mem: 1 << 30}
+	arm := api.Resources{VCPU: 250, Mem: 2 << 30}
+	byArch := api.ComputeUnitsByArch{"arm64": arm}
+
+	// The compute unit follows the node's architecture, whatever the agent's own is
+	cu, err := nodeComputeUnit(ctx, client, "arm64-node", byArch, def)
+	require.NoError(t, err)
+	assert.Equal(t, arm, cu)
+	cu, err = nodeComputeUnit(ctx, client, "amd64-node", byArch, def)
+	require.NoError(t, err)
+	assert.Equal(t, def, cu)
+
+	// The node is only needed if there are compute units by architecture
+	cu, err = nodeComputeUnit(ctx, client, "missing", nil, def)
+	require.NoError(t, err)
+	assert.Equal(t, def, cu)
+	_, err = nodeComputeUnit(ctx, client, "missing", byArch, def)
+	assert.Error(t, err)
+}
@@ -14,6 +14,8 @@ type ActionSet struct {
 	NeonVMRequest    *ActionNeonVMRequest    `json:"neonvmRequest,omitempty"`
 	MonitorDownscale *ActionMonitorDownscale `json:"monitorDownscale,omitempty"`
 	MonitorUpscale   *ActionMonitorUpscale   `json:"monitorUpscale,omitempty"`
+	Suspend          *ActionSuspend          `json:"suspend,omitempty"`
+	Resume           *ActionResume           `json:"resume,omitempty"`
 }
 
 type ActionWait struct {
@@ -41,6 +43,23 @@ type ActionMonitorUpscale struct {
 	Target  api.Resources `json:"target"`
 }
 
+// ActionSuspend asks for the VM to be suspended by setting .spec.paused, after it's been idle for
+// long enough
+type ActionSuspend struct {
+	// Resources gives the resources that the VM is using, which it keeps while suspended
+	Resources api.Resources `json:"resources"`
+	// IdleSince gives the time since which the VM has been idle
+	IdleSince time.Time `json:"idleSince"`
+}
+
+// ActionResume asks for the suspended VM to be resumed by clearing .spec.paused, because
+// connections to it have arrived
+type ActionResume struct {
+	// Resources gives the resources that the VM kept while suspended, which it's using again once
+	// resumed
+	Resources api.Resources `json:"resources"`
+}
+
 func addObjectPtr[T zapcore.ObjectMarshaler](enc zapcore.ObjectEncoder, key string, value *T) error {
 	if value != nil {
 		return enc.AddObject(key, *value)
@@ -56,6 +75,8 @@ func (s ActionSet) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	_ = addObjectPtr(enc, "neonvmRequest", s.NeonVMRequest)
 	_ = addObjectPtr(enc, "monitorDownscale", s.MonitorDownscale)
 	_ = addObjectPtr(enc, "monitorUpscale", s.MonitorUpscale)
+	_ = addObjectPtr(enc, "suspend", s.Suspend)
+	_ = addObjectPtr(enc, "resume", s.Resume)
 	return nil
 }
 
@@ -93,3 +114,16 @@ func (a ActionMonitorUpscale) MarshalLogObject(enc zapcore.ObjectEncoder) error
 	_ = enc.AddObject("target", a.Target)
 	return nil
 }
+
+// MarshalLogObject implements zapcore.ObjectMarshaler, so that ActionSuspend can be used with zap.Object
+func (a ActionSuspend) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	_ = enc.AddObject("resources", a.Resources)
+	enc.AddTime("idleSince", a.IdleSince)
+	return nil
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler, so that ActionResume can be used with zap.Object
+func (a ActionResume) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	_ = enc.AddObject("resources", a.Resources)
+	return nil
+}
@@ -0,0 +1,90 @@
+package core
+
+// Burst upscaling, which immediately upscales a VM by the largest step it's allowed when its load or
+// connections spike, rather than waiting for the scaling policy and stabilization to catch up.
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BurstConfig defines the thresholds and limits for burst upscaling
+type BurstConfig struct {
+	// LoadPerCPUThreshold, if non-zero, triggers a burst upscale when the 1-minute load average
+	// per vCPU the VM is currently using is at least this value.
+	LoadPerCPUThreshold float64
+	// ConnectionsPerCUThreshold, if non-zero, triggers a burst upscale when the number of active
+	// Postgres backends per compute unit the VM is currently using is at least this value.
+	ConnectionsPerCUThreshold float64
+	// MinInterval gives the minimum time between burst upscales for the VM. It's separate from
+	// Config.EmergencyUpscaleMinInterval.
+	MinInterval time.Duration
+	// ValidPeriod gives the duration for which the resources from a burst upscale must be
+	// respected, before allowing downscaling.
+	ValidPeriod time.Duration
+}
+
+// BurstUpscale checks the most recent metrics against Config.Burst's thresholds, and if either is
+// exceeded, immediately raises the desired resources by the scaling config's MaxScaleStepCU above
+// what the VM is currently using -- or to the VM's maximum, if there's no limit on the step.
+//
+// Burst upscales are rate limited by Config.Burst.MinInterval. Returns the reason for the upscale,
+// and whether it was triggered.
+func (s *State) BurstUpscale(now time.Time) (reason string, ok bool) {
+	conf := s.internal.Config.Burst
+	metrics := s.internal.Metrics
+	if conf == nil || metrics == nil {
+		return "", false
+	}
+
+	using := s.internal.VM.Using()
+	if t := conf.LoadPerCPUThreshold; t != 0 && using.VCPU != 0 {
+		if loadPerCPU := float64(metrics.LoadAverage1Min) / using.VCPU.AsFloat64(); loadPerCPU >= t {
+			reason = fmt.Sprintf("load average per CPU %.2f is at least %.2f", loadPerCPU, t)
+		}
+	}
+	if t := conf.ConnectionsPerCUThreshold; reason == "" && t != 0 && metrics.Postgres != nil {
+		cu := s.internal.requiredCUForResources(s.internal.Config.ComputeUnit, using)
+		if cu != 0 {
+			if perCU := float64(metrics.Postgres.ActiveBackends) / float64(cu); perCU >= t {
+				reason = fmt.Sprintf("active backends per CU %.1f is at least %.1f", perCU, t)
+			}
+		}
+	}
+	if reason == "" {
+		return "", false
+	}
+
+	if b := s.internal.Burst; b != nil && now.Sub(b.At) < conf.MinInterval {
+		// Not a warning: a sustained burst is expected to keep exceeding the thresholds.
+		s.internal.info("Ignoring burst upscale, because the previous one was too recent", zap.String("reason", reason))
+		return "", false
+	}
+
+	target := s.internal.VM.Max()
+	if step := s.internal.scalingConfig().MaxScaleStepCU; step != nil {
+		target = using.Add(s.internal.Config.ComputeUnit.Mul(uint16(*step))).Min(target)
+	}
+	if !target.HasFieldGreaterThan(using) {
+		s.internal.info("Ignoring burst upscale, because the VM is already at its maximum", zap.String("reason", reason))
+		return "", false
+	}
+
+	s.internal.Burst = &emergencyUpscale{
+		At:     now,
+		Reason: reason,
+		Target: target.Max(using),
+	}
+	s.internal.info("Burst upscale triggered", zap.String("reason", reason), zap.Object("target", target))
+	return reason, true
+}
+
+func (s *state) timeUntilBurstUpscaleExpired(now time.Time) time.Duration {
+	if s.Burst != nil && s.Config.Burst != nil {
+		return s.Burst.At.Add(s.Config.Burst.ValidPeriod).Sub(now)
+	} else {
+		return 0
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+// Burst credits, which limit how long a VM may spend above a baseline number of compute units in
+// any hour. They're set per VM, with the api.AnnotationBurstCredits annotation.
+//
+// The time above the baseline is tracked from the resources that the VM is using, as of each call
+// to NextActions and each successful NeonVM request. Once the VM has used all of its credits in the
+// trailing hour, the goal from its metrics is capped at the baseline -- without waiting for
+// downscale stabilization -- until enough of that time has aged out of the hour. Like the limit
+// from node memory pressure, upscaling that's requested by the vm-monitor, or from an emergency or
+// burst upscale, is not limited.
+
+import (
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// burstCreditsWindow is the period over which the VM's time above its baseline is limited
+const burstCreditsWindow = time.Hour
+
+// burstCreditsState records the time that the VM recently spent above its baseline
+type burstCreditsState struct {
+	// LastObserved is the last time that the VM's resources were accounted for
+	LastObserved time.Time
+	// WasAbove is true if the VM was above its baseline at LastObserved
+	WasAbove bool
+	// Spent gives the periods within the window that the VM was above its baseline, oldest first
+	Spent []burstPeriod
+}
+
+type burstPeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (s *burstCreditsState) deepCopy() *burstCreditsState {
+	if s == nil {
+		return nil
+	}
+	return &burstCreditsState{
+		LastObserved: s.LastObserved,
+		WasAbove:     s.WasAbove,
+		Spent:        slices.Clone(s.Spent),
+	}
+}
+
+// updateBurstCredits accounts for the time since the VM's resources were last observed, if it has
+// burst credits
+func (s *state) updateBurstCredits(now time.Time) {
+	conf := s.VM.Config.BurstCredits
+	if conf == nil {
+		s.BurstCredits = nil
+		return
+	}
+
+	above := s.requiredCUForResources(s.Config.ComputeUnit, s.VM.Using()) > uint32(conf.BaselineCU)
+	if s.BurstCredits == nil {
+		s.BurstCredits = &burstCreditsState{LastObserved: now, WasAbove: above, Spent: nil}
+		return
+	}
+
+	b := s.BurstCredits
+	if b.WasAbove && now.After(b.LastObserved) {
+		if n := len(b.Spent); n != 0 && b.Spent[n-1].End.Equal(b.LastObserved) {
+			b.Spent[n-1].End = now
+		} else {
+			b.Spent = append(b.Spent, burstPeriod{Start: b.LastObserved, End: now})
+		}
+	}
+
+	// Forget the time that's aged out of the window.
+	windowStart := now.Add(-burstCreditsWindow)
+	for len(b.Spent) != 0 && !b.Spent[0].End.After(windowStart) {
+		b.Spent = slices.Delete(b.Spent, 0, 1)
+	}
+	if len(b.Spent) != 0 && b.Spent[0].Start.Before(windowStart) {
+		b.Spent[0].Start = windowStart
+	}
+
+	if now.After(b.LastObserved) {
+		b.LastObserved = now
+	}
+	b.WasAbove = above
+}
+
+// burstCreditsRemaining returns how much longer the VM may spend above its baseline, as of the
+// last call to updateBurstCredits
+//
+// The VM must have burst credits.
+func (s *state) burstCreditsRemaining() time.Duration {
+	remaining := time.Second * time.Duration(s.VM.Config.BurstCredits.SecondsPerHour)
+	for _, p := range s.BurstCredits.Spent {
+		remaining -= p.End.Sub(p.Start)
+	}
+	return remaining
+}
+
+// burstCreditsExhausted returns whether the VM has used all of its burst credits, as of the last
+// call to updateBurstCredits
+func (s *state) burstCreditsExhausted() bool {
+	return s.BurstCredits != nil && s.burstCreditsRemaining() <= 0
+}
+
+// timeUntilBurstCreditsChange returns how long until the VM either runs out of burst credits (if
+// it's currently above its baseline) or gets some back (if it's run out), or zero if neither will
+// happen on its own
+func (s *state) timeUntilBurstCreditsChange(now time.Time) time.Duration {
+	if s.BurstCredits == nil {
+		return 0
+	}
+
+	if remaining := s.burstCreditsRemaining(); remaining > 0 {
+		if s.BurstCredits.WasAbove {
+			return remaining
+		}
+		return 0
+	} else if len(s.BurstCredits.Spent) == 0 {
+		// No credits at all, so there's nothing to get back.
+		return 0
+	}
+
+	// Credits come back as the oldest time above the baseline ages out of the window. Wait a little
+	// longer than that, so there's something to use once they do.
+	agesOutAt := s.BurstCredits.Spent[0].Start.Add(burstCreditsWindow)
+	return util.Max(agesOutAt.Sub(now), 0) + time.Second
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"time"
 
+	"golang.org/x/exp/slices"
+
 	"github.com/neondatabase/autoscaling/pkg/api"
 )
 
@@ -33,13 +35,19 @@ func (d StateDump) MarshalJSON() ([]byte, error) {
 func (s *State) Dump() StateDump {
 	return StateDump{
 		internal: state{
-			Debug:   s.internal.Debug,
-			Config:  s.internal.Config,
-			VM:      s.internal.VM,
-			Plugin:  s.internal.Plugin.deepCopy(),
-			Monitor: s.internal.Monitor.deepCopy(),
-			NeonVM:  s.internal.NeonVM.deepCopy(),
-			Metrics: shallowCopy[Metrics](s.internal.Metrics),
+			Debug:                   s.internal.Debug,
+			Config:                  s.internal.Config,
+			VM:                      s.internal.VM,
+			Plugin:                  s.internal.Plugin.deepCopy(),
+			Monitor:                 s.internal.Monitor.deepCopy(),
+			NeonVM:                  s.internal.NeonVM.deepCopy(),
+			Emergency:               shallowCopy[emergencyUpscale](s.internal.Emergency),
+			Burst:                   shallowCopy[emergencyUpscale](s.internal.Burst),
+			BurstCredits:            s.internal.BurstCredits.deepCopy(),
+			NodeUnderMemoryPressure: s.internal.NodeUnderMemoryPressure,
+			ScaleToZero:             s.internal.ScaleToZero.deepCopy(),
+			Metrics:                 shallowCopy[Metrics](s.internal.Metrics),
+			MetricsHistory:          slices.Clone(s.internal.MetricsHistory),
 		},
 	}
 }
@@ -61,6 +69,7 @@ func (s *monitorState) deepCopy() monitorState {
 		Approved:           shallowCopy[api.Resources](s.Approved),
 		DownscaleFailureAt: shallowCopy[time.Time](s.DownscaleFailureAt),
 		UpscaleFailureAt:   shallowCopy[time.Time](s.UpscaleFailureAt),
+		MemoryPressure:     shallowCopy[monitorMemoryPressure](s.MemoryPressure),
 	}
 }
 
@@ -71,3 +80,13 @@ func (s *neonvmState) deepCopy() neonvmState {
 		RequestFailedAt:  shallowCopy[time.Time](s.RequestFailedAt),
 	}
 }
+
+func (s *scaleToZeroState) deepCopy() scaleToZeroState {
+	return scaleToZeroState{
+		IdleSince:       shallowCopy[time.Time](s.IdleSince),
+		OngoingRequest:  s.OngoingRequest,
+		ResumeRequested: s.ResumeRequested,
+		RequestFailedAt: shallowCopy[time.Time](s.RequestFailedAt),
+		ConfirmPaused:   shallowCopy[bool](s.ConfirmPaused),
+	}
+}
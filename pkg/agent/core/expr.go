@@ -0,0 +1,372 @@
+package core
+
+// Scaling expressions: a small language for calculating the goal compute units from a VM's
+// metrics, so that the calculation can be tuned for new workloads in the autoscaler-agent's config
+// instead of in the code.
+//
+// An expression is made of numbers, the variables in ExpressionVariables, the operators + - * /
+// with the usual precedence, unary minus, parentheses, and the functions min, max, ceil, and floor.
+// For example, this is roughly equivalent to the default policy's load average and memory goals:
+//
+//	max(load1 / (0.9 * cu_cpus), mem_used / (0.75 * cu_mem))
+//
+// Expressions are parsed and checked when the config is read, so the only errors left when they're
+// evaluated are from metrics that aren't available, or division by zero.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ExpressionVariables describes each of the variables that can be used in a scaling expression
+var ExpressionVariables = map[string]string{
+	"load1":           "1-minute load average",
+	"mem_used":        "memory usage in bytes",
+	"cpus":            "number of vCPUs the VM currently has",
+	"mem_total":       "bytes of memory the VM currently has",
+	"cu":              "number of compute units the VM currently has, rounded up",
+	"cu_cpus":         "number of vCPUs in each compute unit",
+	"cu_mem":          "bytes of memory in each compute unit",
+	"active_backends": "number of active Postgres backends; requires Postgres metrics",
+	"tps":             "Postgres transactions per second; requires Postgres metrics",
+	"lfc_working_set": "estimated size in bytes of the LFC working set; requires LFC metrics",
+}
+
+// expressionFuncs gives the functions that can be used in a scaling expression, with the minimum
+// and maximum number of arguments they take (-1 for no maximum)
+var expressionFuncs = map[string]struct {
+	minArgs, maxArgs int
+	eval             func(args []float64) float64
+}{
+	"min": {1, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, a := range args[1:] {
+			result = math.Min(result, a)
+		}
+		return result
+	}},
+	"max": {1, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, a := range args[1:] {
+			result = math.Max(result, a)
+		}
+		return result
+	}},
+	"ceil":  {1, 1, func(args []float64) float64 { return math.Ceil(args[0]) }},
+	"floor": {1, 1, func(args []float64) float64 { return math.Floor(args[0]) }},
+}
+
+// Expression is a parsed scaling expression
+type Expression struct {
+	src  string
+	root exprNode
+}
+
+// ParseExpression parses and checks the scaling expression, returning error if it isn't valid
+func ParseExpression(src string) (*Expression, error) {
+	p := &exprParser{src: src, pos: 0}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	return &Expression{src: src, root: root}, nil
+}
+
+func (e *Expression) String() string {
+	return e.src
+}
+
+// Eval calculates the value of the expression with the variables, returning error if it uses a
+// variable that's missing or divides by zero
+func (e *Expression) Eval(vars map[string]float64) (float64, error) {
+	return e.root.eval(vars)
+}
+
+type exprNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type exprNumber float64
+
+func (n exprNumber) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type exprVariable string
+
+func (v exprVariable) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(v)]
+	if !ok {
+		return 0, fmt.Errorf("variable %q is not available", string(v))
+	}
+	return value, nil
+}
+
+type exprNegate struct {
+	x exprNode
+}
+
+func (n exprNegate) eval(vars map[string]float64) (float64, error) {
+	x, err := n.x.eval(vars)
+	return -x, err
+}
+
+type exprBinary struct {
+	op   byte
+	l, r exprNode
+}
+
+func (b exprBinary) eval(vars map[string]float64) (float64, error) {
+	l, err := b.l.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.r.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	default:
+		panic(fmt.Errorf("unknown operator %q", b.op))
+	}
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (c exprCall) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(c.args))
+	for i, a := range c.args {
+		var err error
+		if args[i], err = a.eval(vars); err != nil {
+			return 0, err
+		}
+	}
+	return expressionFuncs[c.name].eval(args), nil
+}
+
+// exprParser is a recursive descent parser for scaling expressions
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos += 1
+	}
+}
+
+// consume skips over the next character if it's one of chars, returning it if so
+func (p *exprParser) consume(chars string) (byte, bool) {
+	p.skipSpace()
+	if p.pos < len(p.src) && strings.IndexByte(chars, p.src[p.pos]) != -1 {
+		p.pos += 1
+		return p.src[p.pos-1], true
+	}
+	return 0, false
+}
+
+// parseSum parses operands separated by + or -
+func (p *exprParser) parseSum() (exprNode, error) {
+	node, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.consume("+-")
+		if !ok {
+			return node, nil
+		}
+		r, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		node = exprBinary{op: op, l: node, r: r}
+	}
+}
+
+// parseProduct parses operands separated by * or /
+func (p *exprParser) parseProduct() (exprNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.consume("*/")
+		if !ok {
+			return node, nil
+		}
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		node = exprBinary{op: op, l: node, r: r}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.consume("-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNegate{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a number, variable, function call, or parenthesized expression
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	if _, ok := p.consume("("); ok {
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.consume(")"); !ok {
+			return nil, p.errorf("expected ')'")
+		}
+		return node, nil
+	}
+
+	start := p.pos
+	c := rune(p.src[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.src) && (unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+			p.pos += 1
+		}
+		text := p.src[start:p.pos]
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return exprNumber(value), nil
+	case unicode.IsLetter(c) || c == '_':
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos])) || p.src[p.pos] == '_') {
+			p.pos += 1
+		}
+		name := p.src[start:p.pos]
+		if _, ok := p.consume("("); ok {
+			return p.parseCall(start, name)
+		}
+		if _, ok := ExpressionVariables[name]; !ok {
+			p.pos = start
+			return nil, p.errorf("unknown variable %q", name)
+		}
+		return exprVariable(name), nil
+	default:
+		return nil, p.errorf("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+}
+
+// parseCall parses the arguments of a call to the function with the name, after the opening
+// parenthesis
+func (p *exprParser) parseCall(start int, name string) (exprNode, error) {
+	fn, ok := expressionFuncs[name]
+	if !ok {
+		p.pos = start
+		return nil, p.errorf("unknown function %q", name)
+	}
+
+	var args []exprNode
+	if _, ok := p.consume(")"); !ok {
+		for {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.consume(")"); ok {
+				break
+			} else if _, ok := p.consume(","); !ok {
+				return nil, p.errorf("expected ',' or ')'")
+			}
+		}
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs != -1 && len(args) > fn.maxArgs) {
+		p.pos = start
+		return nil, p.errorf("wrong number of arguments to %s(): %d", name, len(args))
+	}
+	return exprCall{name: name, args: args}, nil
+}
+
+// ExpressionScalingPolicy is a ScalingPolicy that uses a scaling expression to calculate the goal
+// compute units, rounded to the nearest whole number
+//
+// If the expression can't be evaluated (e.g. because it uses Postgres metrics that couldn't be
+// fetched), the goal is unchanged from the VM's current size.
+type ExpressionScalingPolicy struct {
+	Expression *Expression
+}
+
+func (p ExpressionScalingPolicy) GoalCU(input ScalingPolicyInput) (uint32, string) {
+	value, err := p.Expression.Eval(expressionVariables(input))
+	if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		err = fmt.Errorf("result is %v", value)
+	}
+	if err != nil {
+		return usingCU(input), fmt.Sprintf("scaling expression failed: %s", err)
+	}
+
+	goalCU := uint32(math.Round(math.Min(math.Max(value, 0), math.MaxUint32)))
+	return goalCU, "scaling expression"
+}
+
+// expressionVariables returns the values of the variables available to scaling expressions, leaving
+// out any whose metrics are missing
+func expressionVariables(input ScalingPolicyInput) map[string]float64 {
+	m := input.Metrics
+	using := input.VM.Using()
+
+	vars := map[string]float64{
+		"load1":     float64(m.LoadAverage1Min),
+		"mem_used":  float64(m.MemoryUsageBytes),
+		"cpus":      using.VCPU.AsFloat64(),
+		"mem_total": using.Mem.AsFloat64(),
+		"cu":        float64(usingCU(input)),
+		"cu_cpus":   input.ComputeUnit.VCPU.AsFloat64(),
+		"cu_mem":    input.ComputeUnit.Mem.AsFloat64(),
+	}
+	if m.Postgres != nil {
+		vars["active_backends"] = float64(m.Postgres.ActiveBackends)
+		vars["tps"] = float64(m.Postgres.TransactionsPerSecond)
+	}
+	if m.LFC != nil {
+		vars["lfc_working_set"] = float64(m.LFC.WorkingSetSizeBytes)
+	}
+	return vars
+}
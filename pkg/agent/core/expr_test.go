@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	helpers "github.com/neondatabase/autoscaling/pkg/agent/core/testhelpers"
+)
+
+func TestParseExpression(t *testing.T) {
+	vars := map[string]float64{"load1": 2, "cu": 3}
+
+	cases := []struct {
+		src      string
+		expected float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"-load1 + -(-1)", -1},
+		{"max(load1, cu, 1.5)", 3},
+		{"min(load1 / 0.5, cu)", 3},
+		{"ceil(load1 / 0.75) + floor(0.9)", 3},
+		{"  max ( load1 ,cu )  ", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.src, func(t *testing.T) {
+			expr, err := core.ParseExpression(c.src)
+			require.NoError(t, err)
+			value, err := expr.Eval(vars)
+			require.NoError(t, err)
+			assert.InDelta(t, c.expected, value, 1e-9)
+		})
+	}
+
+	invalid := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"load2",
+		"sqrt(load1)",
+		"max()",
+		"ceil(1, 2)",
+		"max(1 2)",
+		"1..2",
+		"load1 % 2",
+	}
+	for _, src := range invalid {
+		t.Run("Invalid/"+src, func(t *testing.T) {
+			_, err := core.ParseExpression(src)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	expr, err := core.ParseExpression("active_backends / 10")
+	require.NoError(t, err)
+	_, err = expr.Eval(map[string]float64{"load1": 1})
+	assert.ErrorContains(t, err, `variable "active_backends" is not available`)
+
+	expr, err = core.ParseExpression("load1 / (cu - 3)")
+	require.NoError(t, err)
+	_, err = expr.Eval(map[string]float64{"load1": 1, "cu": 3})
+	assert.ErrorContains(t, err, "division by zero")
+}
+
+func TestExpressionScalingPolicy(t *testing.T) {
+	metrics := func(load float32, memCU float32, pg *core.PostgresMetrics) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          memCU * float32(DefaultComputeUnit.Mem),
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  pg,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+	goal := func(src string, m core.Metrics) (uint32, string) {
+		expr, err := core.ParseExpression(src)
+		require.NoError(t, err)
+		return core.ExpressionScalingPolicy{Expression: expr}.GoalCU(core.ScalingPolicyInput{
+			Metrics:     m,
+			History:     nil,
+			VM:          helpers.CreateVmInfo(DefaultInitialStateConfig.VM, helpers.WithCurrentCU(2)),
+			Config:      DefaultInitialStateConfig.Core.DefaultScalingConfig,
+			ComputeUnit: DefaultComputeUnit,
+			Now:         time.Now(),
+		})
+	}
+	const defaultLike = "max(load1 / (0.9 * cu_cpus), mem_used / (0.75 * cu_mem))"
+
+	// load 0.9 on 0.25 vCPU per CU -> 4 CU; memory 1.5 CU / 0.75 -> 2 CU
+	cu, reason := goal(defaultLike, metrics(0.9, 1.5, nil))
+	assert.Equal(t, uint32(4), cu)
+	assert.Equal(t, "scaling expression", reason)
+
+	// The VM's current size is available too
+	cu, _ = goal("cu + 1", metrics(0, 0, nil))
+	assert.Equal(t, uint32(3), cu)
+
+	// Negative results are treated as zero
+	cu, _ = goal("-cu", metrics(0, 0, nil))
+	assert.Equal(t, uint32(0), cu)
+
+	// With missing metrics, the VM stays at its current size
+	cu, reason = goal("active_backends / 10", metrics(0, 0, nil))
+	assert.Equal(t, uint32(2), cu)
+	assert.Equal(t, `scaling expression failed: variable "active_backends" is not available`, reason)
+
+	cu, _ = goal("active_backends / 10", metrics(0, 0, &core.PostgresMetrics{ActiveBackends: 45, TransactionsPerSecond: 0, BufferCacheHitRatio: nil}))
+	assert.Equal(t, uint32(5), cu)
+}
@@ -3,9 +3,8 @@ package core
 // Definition of the Metrics type, plus reading it from vector.dev's prometheus format host metrics
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
+	"math"
+	"time"
 
 	"github.com/neondatabase/autoscaling/pkg/api"
 )
@@ -13,8 +12,174 @@ import (
 type Metrics struct {
 	LoadAverage1Min  float32
 	MemoryUsageBytes float32
+
+	// MemoryStalledSecondsTotal, if not nil, gives the total time that all non-idle tasks in the
+	// VM were stalled on memory (i.e. "full" memory pressure, from PSI).
+	//
+	// It's not used by State, but is included so that consumers can detect memory pressure from
+	// the rate of increase.
+	MemoryStalledSecondsTotal *float32
+	// MemoryWaitingSecondsTotal, if not nil, gives the total time that at least one task in the VM
+	// was stalled on memory (i.e. "some" memory pressure, from PSI).
+	MemoryWaitingSecondsTotal *float32
+
+	// MemoryPressure, if not nil, gives the memory pressure in the VM since the previous metrics,
+	// calculated from the PSI counters with (Metrics).MemoryPressureSince().
+	MemoryPressure *MemoryPressureMetrics
+
+	// CPU, if not nil, gives the CPU steal and throttling counters from the VM. Like the PSI
+	// counters, they're only useful in comparison with the previous metrics.
+	CPU *CPUCounters
+	// HostContention, if not nil, gives how much the VM's CPUs were held back by the host since
+	// the previous metrics, calculated from the CPU counters with (CPUCounters).Since().
+	HostContention *HostContentionMetrics
+
+	// Postgres, if not nil, gives the metrics from Postgres inside the VM, which may be used as
+	// additional scaling targets.
+	Postgres *PostgresMetrics
+
+	// LFC, if not nil, gives the metrics from Postgres' local file cache, which may be used to
+	// scale memory based on the size of the working set.
+	LFC *LFCMetrics
+
+	// Gauges gives the values of any other gauges read from the VM's metrics, by name, for use
+	// with WeightedScalingPolicy. Gauges that weren't in the output are missing.
+	Gauges map[string]float64
+}
+
+// MemoryPressureMetrics give the fraction of time that tasks in the VM were stalled on memory, from
+// PSI, over the period between two sets of Metrics
+//
+// Load average and memory usage both lag behind when the VM starts swapping, so memory pressure can
+// be used to upscale sooner.
+type MemoryPressureMetrics struct {
+	// Some is the fraction of time that at least one task was stalled on memory
+	Some float32
+	// Full is the fraction of time that all non-idle tasks were stalled on memory at once
+	Full float32
+}
+
+// MemoryPressureSince calculates the MemoryPressureMetrics over the period from prev to m, which
+// took elapsed time.
+//
+// It returns nil if either is missing the PSI counters (e.g. because the kernel doesn't support
+// it), or if the counters decreased (e.g. because the VM restarted).
+func (m Metrics) MemoryPressureSince(prev Metrics, elapsed time.Duration) *MemoryPressureMetrics {
+	if m.MemoryWaitingSecondsTotal == nil || m.MemoryStalledSecondsTotal == nil ||
+		prev.MemoryWaitingSecondsTotal == nil || prev.MemoryStalledSecondsTotal == nil || elapsed <= 0 {
+		return nil
+	}
+
+	waiting := *m.MemoryWaitingSecondsTotal - *prev.MemoryWaitingSecondsTotal
+	stalled := *m.MemoryStalledSecondsTotal - *prev.MemoryStalledSecondsTotal
+	if waiting < 0 || stalled < 0 {
+		return nil
+	}
+
+	seconds := float32(elapsed.Seconds())
+	return &MemoryPressureMetrics{
+		// The counters are sampled at slightly different times from the elapsed duration, so
+		// clamp to a valid fraction.
+		Some: min(waiting/seconds, 1),
+		Full: min(stalled/seconds, 1),
+	}
+}
+
+// CPUCounters stores the CPU steal and cgroup throttling values read from the VM's host metrics at
+// a single point in time
+type CPUCounters struct {
+	// StealSecondsTotal, if not nil, gives the total time, summed across all CPUs, that the VM's
+	// vCPUs were runnable but the host was running something else.
+	StealSecondsTotal *float64
+	// CPUs gives the number of CPUs that StealSecondsTotal was summed across
+	CPUs int
+	// ThrottledSecondsTotal, if not nil, gives the total time that tasks in the VM's cgroup were
+	// throttled by its CPU quota.
+	ThrottledSecondsTotal *float64
+}
+
+// HostContentionMetrics give the fraction of time that the VM's CPUs were held back, either by the
+// host or by the cgroup's CPU quota, over the period between two sets of CPUCounters
+//
+// High steal time means that the host is oversubscribed, so giving the VM more CPUs won't help
+// until it's migrated or the host's load goes down. Throttling on its own is expected when the VM
+// is at its limit, and is resolved by scaling up.
+type HostContentionMetrics struct {
+	// StealFraction, if not nil, is the average fraction of time that each CPU was stolen by the
+	// host.
+	StealFraction *float32
+	// ThrottledFraction, if not nil, is the fraction of time that the VM's cgroup was throttled.
+	ThrottledFraction *float32
+}
+
+// Since calculates the HostContentionMetrics over the period from prev to c, which took elapsed
+// time.
+//
+// Each fraction is nil if either set of counters is missing it, or if the counter decreased (e.g.
+// because the VM restarted).
+func (c CPUCounters) Since(prev CPUCounters, elapsed time.Duration) HostContentionMetrics {
+	fraction := func(cur, prev *float64, count int) *float32 {
+		if cur == nil || prev == nil || *cur < *prev || count <= 0 || elapsed <= 0 {
+			return nil
+		}
+		// Clamp to a valid fraction, because the counters are sampled at slightly different
+		// times from the elapsed duration.
+		f := float32(min((*cur-*prev)/elapsed.Seconds()/float64(count), 1))
+		return &f
+	}
+
+	var steal *float32
+	if c.CPUs == prev.CPUs {
+		steal = fraction(c.StealSecondsTotal, prev.StealSecondsTotal, c.CPUs)
+	}
+
+	return HostContentionMetrics{
+		StealFraction:     steal,
+		ThrottledFraction: fraction(c.ThrottledSecondsTotal, prev.ThrottledSecondsTotal, 1),
+	}
 }
 
+// PostgresMetrics are the metrics from Postgres that can be used to make scaling decisions
+//
+// These are calculated from a pair of PostgresCounters with (PostgresCounters).Since().
+type PostgresMetrics struct {
+	ActiveBackends        float32
+	TransactionsPerSecond float32
+	// BufferCacheHitRatio gives the fraction of block reads that were served from the buffer
+	// cache, or nil if there weren't any reads.
+	BufferCacheHitRatio *float32
+}
+
+// PostgresCounters stores the values read from postgres_exporter at a single point in time
+type PostgresCounters struct {
+	ActiveBackends    float32
+	TransactionsTotal float64
+	BlocksHitTotal    float64
+	BlocksReadTotal   float64
+}
+
+// LFCMetrics are the metrics from Postgres' local file cache (LFC) that can be used to make scaling
+// decisions
+//
+// These are calculated from a pair of LFCCounters with (LFCCounters).Since().
+type LFCMetrics struct {
+	// HitRatio gives the fraction of LFC lookups that were hits, or nil if there weren't any
+	// lookups.
+	HitRatio *float32
+	// WorkingSetSizeBytes is the estimated size of the pages recently accessed through the LFC
+	WorkingSetSizeBytes float32
+}
+
+// LFCCounters stores the LFC values read from sql_exporter at a single point in time
+type LFCCounters struct {
+	HitsTotal           float64
+	MissesTotal         float64
+	WorkingSetSizeBytes float32
+}
+
+// lfcPageSize is the size of the pages counted by lfc_approximate_working_set_size
+const lfcPageSize = 8192
+
 func (m Metrics) ToAPI() api.Metrics {
 	return api.Metrics{
 		LoadAverage1Min:  m.LoadAverage1Min,
@@ -23,59 +188,258 @@ func (m Metrics) ToAPI() api.Metrics {
 	}
 }
 
+// HostMetricLabels optionally selects which series of vector.dev's host metrics are used, for when
+// there are multiple (e.g., with different "host" or "device" labels). Of the series that match a
+// filter (all of them, if it's empty), the first is used - except for the CPU counters, which are
+// summed.
+type HostMetricLabels struct {
+	Load1           LabelFilter `json:"load1,omitempty"`
+	MemoryAvailable LabelFilter `json:"memoryAvailable,omitempty"`
+	MemoryTotal     LabelFilter `json:"memoryTotal,omitempty"`
+	MemoryStalled   LabelFilter `json:"memoryStalled,omitempty"`
+	MemoryWaiting   LabelFilter `json:"memoryWaiting,omitempty"`
+	// CPUSteal is added to the filter for the steal time of each CPU, which already selects
+	// mode="steal". Every matching series is used, summed across CPUs.
+	CPUSteal LabelFilter `json:"cpuSteal,omitempty"`
+	// CPUThrottled selects the cgroups whose throttled time is summed.
+	CPUThrottled LabelFilter `json:"cpuThrottled,omitempty"`
+}
+
 // ReadMetrics generates Metrics from vector.dev's host metrics output, or returns error on failure
 //
 // This function could be more efficient, but realistically it doesn't matter. The size of the
 // output from node_exporter/vector is so small anyways.
-func ReadMetrics(nodeExporterOutput []byte, loadPrefix string) (m Metrics, err error) {
-	lines := strings.Split(string(nodeExporterOutput), "\n")
-
-	getField := func(linePrefix, dontMatch string) (float32, error) {
-		var line string
-		for _, l := range lines {
-			if strings.HasPrefix(l, linePrefix) && (len(dontMatch) == 0 || !strings.HasPrefix(l, dontMatch)) {
-				line = l
-				break
-			}
-		}
-		if line == "" {
-			return 0, fmt.Errorf("No line in metrics output starting with %q", linePrefix)
-		}
+func ReadMetrics(nodeExporterOutput []byte, loadPrefix string, labels HostMetricLabels) (Metrics, error) {
+	return ReadMetricsFromOutput(ParsePromOutput(nodeExporterOutput), loadPrefix, labels)
+}
 
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			return 0, fmt.Errorf(
-				"Expected >= 2 fields in metrics output for %q. Got %v",
-				linePrefix, len(fields),
-			)
+// ReadMetricsFromOutput is like ReadMetrics, but for output that's already been parsed (e.g.,
+// because it was merged from multiple endpoints).
+func ReadMetricsFromOutput(out PromOutput, loadPrefix string, labels HostMetricLabels) (Metrics, error) {
+	load1, err := out.First(loadPrefix+"load1", labels.Load1)
+	if err != nil {
+		return Metrics{}, err
+	}
+
+	availableMem, err := out.First(loadPrefix+"memory_available_bytes", labels.MemoryAvailable)
+	if err != nil {
+		return Metrics{}, err
+	}
+	totalMem, err := out.First(loadPrefix+"memory_total_bytes", labels.MemoryTotal)
+	if err != nil {
+		return Metrics{}, err
+	}
+
+	// PSI isn't available on all kernels, so it's fine if it's missing.
+	var stalledPtr, waitingPtr *float32
+	if stalled, err := out.First(loadPrefix+"pressure_memory_stalled_seconds_total", labels.MemoryStalled); err == nil {
+		stalled32 := float32(stalled)
+		stalledPtr = &stalled32
+	}
+	if waiting, err := out.First(loadPrefix+"pressure_memory_waiting_seconds_total", labels.MemoryWaiting); err == nil {
+		waiting32 := float32(waiting)
+		waitingPtr = &waiting32
+	}
+
+	m := MetricsFromHostValues(float32(load1), float32(availableMem), float32(totalMem), stalledPtr, waitingPtr)
+	m.CPU, err = ReadCPUCounters(out, loadPrefix, labels)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return m, nil
+}
+
+// ReadCPUCounters generates CPUCounters from vector.dev's host metrics output, or returns nil if
+// neither the steal time nor the cgroup throttling is included.
+func ReadCPUCounters(out PromOutput, loadPrefix string, labels HostMetricLabels) (*CPUCounters, error) {
+	stealFilter := LabelFilter{"mode": "steal"}
+	for k, v := range labels.CPUSteal {
+		stealFilter[k] = v
+	}
+	// Steal time is only reported by some hypervisors, and throttling only if there's a cgroup
+	// with a CPU quota, so it's fine if either is missing.
+	samples, err := out.samples(loadPrefix+"cpu_seconds_total", stealFilter)
+	if err != nil {
+		return nil, err
+	}
+	c := CPUCounters{StealSecondsTotal: nil, CPUs: len(samples), ThrottledSecondsTotal: nil}
+	if len(samples) != 0 {
+		var steal float64
+		for _, s := range samples {
+			steal += s.value
 		}
+		c.StealSecondsTotal = &steal
+	}
+	if throttled, err := out.Sum(loadPrefix+"cgroup_cpu_throttled_seconds_total", labels.CPUThrottled); err == nil {
+		c.ThrottledSecondsTotal = &throttled
+	}
+
+	if c.StealSecondsTotal == nil && c.ThrottledSecondsTotal == nil {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// MetricsFromHostValues creates Metrics from the individual values of vector.dev's host metrics,
+// for when they're received some way other than through ReadMetrics.
+func MetricsFromHostValues(load1, availableMem, totalMem float32, memStalledSecondsTotal, memWaitingSecondsTotal *float32) Metrics {
+	return Metrics{
+		LoadAverage1Min: load1,
+		// Add an extra 100 MiB to account for kernel memory usage
+		MemoryUsageBytes:          totalMem - availableMem + 100*(1<<20),
+		MemoryStalledSecondsTotal: memStalledSecondsTotal,
+		MemoryWaitingSecondsTotal: memWaitingSecondsTotal,
+		MemoryPressure:            nil, // calculated from the previous metrics
+		CPU:                       nil, // read separately, with ReadCPUCounters
+		HostContention:            nil, // calculated from the previous metrics
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	}
+}
+
+// ReadGauges returns the value of each of the named gauges, summed across all of its series, leaving
+// out any that aren't in the output
+func ReadGauges(out PromOutput, names []string) map[string]float64 {
+	if len(names) == 0 {
+		return nil
+	}
 
-		v, err := strconv.ParseFloat(fields[1], 32)
-		if err != nil {
-			return 0, fmt.Errorf(
-				"Error parsing %q as float for line starting with %q: %w",
-				fields[1], linePrefix, err,
-			)
+	gauges := make(map[string]float64)
+	for _, name := range names {
+		if value, err := out.Sum(name, nil); err == nil {
+			gauges[name] = value
 		}
-		return float32(v), nil
 	}
+	return gauges
+}
+
+// DiskUsage gives the usage of a filesystem in the VM, from vector.dev's host metrics
+type DiskUsage struct {
+	UsedBytes  float64
+	TotalBytes float64
+}
+
+// UsedFraction returns the fraction of the filesystem that's in use
+func (u DiskUsage) UsedFraction() float64 {
+	if u.TotalBytes == 0 {
+		return 0
+	}
+	return u.UsedBytes / u.TotalBytes
+}
+
+// DefaultFilesystemLabels selects the root filesystem from vector.dev's host metrics
+var DefaultFilesystemLabels = LabelFilter{"mountpoint": "/"}
+
+// ReadDiskUsage generates DiskUsage from vector.dev's host metrics output, for the filesystem
+// selected by labels
+func ReadDiskUsage(out PromOutput, loadPrefix string, labels LabelFilter) (DiskUsage, error) {
+	used, err := out.First(loadPrefix+"filesystem_used_bytes", labels)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	total, err := out.First(loadPrefix+"filesystem_total_bytes", labels)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+
+	return DiskUsage{UsedBytes: used, TotalBytes: total}, nil
+}
+
+// ReadPostgresCounters generates PostgresCounters from postgres_exporter's output, summing the
+// values across all databases.
+func ReadPostgresCounters(postgresExporterOutput []byte) (c PostgresCounters, err error) {
+	out := ParsePromOutput(postgresExporterOutput)
+
+	activeBackends, err := out.Sum("pg_stat_activity_count", LabelFilter{"state": "active"})
+	if err != nil {
+		return
+	}
+	c.ActiveBackends = float32(activeBackends)
 
-	m.LoadAverage1Min, err = getField(loadPrefix+"load1", loadPrefix+"load15")
+	commits, err := out.Sum("pg_stat_database_xact_commit", nil)
 	if err != nil {
 		return
 	}
+	rollbacks, err := out.Sum("pg_stat_database_xact_rollback", nil)
+	if err != nil {
+		return
+	}
+	c.TransactionsTotal = commits + rollbacks
 
-	availableMem, err := getField(loadPrefix+"memory_available_bytes", "")
+	c.BlocksHitTotal, err = out.Sum("pg_stat_database_blks_hit", nil)
 	if err != nil {
 		return
 	}
-	totalMem, err := getField(loadPrefix+"memory_total_bytes", "")
+	c.BlocksReadTotal, err = out.Sum("pg_stat_database_blks_read", nil)
 	if err != nil {
 		return
 	}
 
-	// Add an extra 100 MiB to account for kernel memory usage
-	m.MemoryUsageBytes = totalMem - availableMem + 100*(1<<20)
+	return
+}
+
+// Since calculates the PostgresMetrics over the period from prev to c, which took elapsed time.
+//
+// If a counter decreased (e.g. because Postgres restarted), its rate is treated as zero.
+func (c PostgresCounters) Since(prev PostgresCounters, elapsed time.Duration) PostgresMetrics {
+	delta := func(cur, prev float64) float64 {
+		return math.Max(0, cur-prev)
+	}
+
+	tps := float32(CounterRate(c.TransactionsTotal, prev.TransactionsTotal, elapsed))
+
+	var hitRatio *float32
+	hits := delta(c.BlocksHitTotal, prev.BlocksHitTotal)
+	reads := delta(c.BlocksReadTotal, prev.BlocksReadTotal)
+	if hits+reads > 0 {
+		ratio := float32(hits / (hits + reads))
+		hitRatio = &ratio
+	}
+
+	return PostgresMetrics{
+		ActiveBackends:        c.ActiveBackends,
+		TransactionsPerSecond: tps,
+		BufferCacheHitRatio:   hitRatio,
+	}
+}
+
+// ReadLFCCounters generates LFCCounters from sql_exporter's output
+func ReadLFCCounters(sqlExporterOutput []byte) (c LFCCounters, err error) {
+	out := ParsePromOutput(sqlExporterOutput)
+
+	c.HitsTotal, err = out.Sum("lfc_hits", nil)
+	if err != nil {
+		return
+	}
+	c.MissesTotal, err = out.Sum("lfc_misses", nil)
+	if err != nil {
+		return
+	}
+	pages, err := out.Sum("lfc_approximate_working_set_size", nil)
+	if err != nil {
+		return
+	}
+	c.WorkingSetSizeBytes = float32(pages * lfcPageSize)
 
 	return
 }
+
+// Since calculates the LFCMetrics over the period from prev to c.
+//
+// If a counter decreased (e.g. because Postgres restarted), the hit ratio is calculated as if there
+// were no lookups.
+func (c LFCCounters) Since(prev LFCCounters) LFCMetrics {
+	var hitRatio *float32
+	hits := c.HitsTotal - prev.HitsTotal
+	misses := c.MissesTotal - prev.MissesTotal
+	if hits >= 0 && misses >= 0 && hits+misses > 0 {
+		ratio := float32(hits / (hits + misses))
+		hitRatio = &ratio
+	}
+
+	return LFCMetrics{
+		HitRatio:            hitRatio,
+		WorkingSetSizeBytes: c.WorkingSetSizeBytes,
+	}
+}
@@ -0,0 +1,36 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+)
+
+func TestReadDiskUsage(t *testing.T) {
+	out := core.ParsePromOutput([]byte(`# TYPE host_filesystem_used_bytes gauge
+host_filesystem_used_bytes{device="/dev/vda",filesystem="ext4",mountpoint="/"} 750
+host_filesystem_used_bytes{device="tmpfs",filesystem="tmpfs",mountpoint="/dev/shm"} 10
+# TYPE host_filesystem_total_bytes gauge
+host_filesystem_total_bytes{device="/dev/vda",filesystem="ext4",mountpoint="/"} 1000
+host_filesystem_total_bytes{device="tmpfs",filesystem="tmpfs",mountpoint="/dev/shm"} 100
+`))
+
+	usage, err := core.ReadDiskUsage(out, "host_", core.DefaultFilesystemLabels)
+	require.NoError(t, err)
+	assert.Equal(t, core.DiskUsage{UsedBytes: 750, TotalBytes: 1000}, usage)
+	assert.Equal(t, 0.75, usage.UsedFraction())
+
+	usage, err = core.ReadDiskUsage(out, "host_", core.LabelFilter{"mountpoint": "/dev/shm"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, usage.UsedFraction())
+
+	_, err = core.ReadDiskUsage(out, "host_", core.LabelFilter{"mountpoint": "/data"})
+	assert.Error(t, err)
+	_, err = core.ReadDiskUsage(out, "other_", core.DefaultFilesystemLabels)
+	assert.Error(t, err)
+
+	assert.Equal(t, 0.0, core.DiskUsage{UsedBytes: 0, TotalBytes: 0}.UsedFraction())
+}
@@ -0,0 +1,220 @@
+package core
+
+// Definition of the ScalingPolicy interface, the registry of available policies, and the default
+// policy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// ScalingPolicy determines the number of compute units that a VM should have, based on its
+// metrics
+//
+// The result is only the starting point: it's still bounded by the VM's minimum and maximum, and
+// may be overridden by requested upscaling, previously denied downscaling, etc.
+type ScalingPolicy interface {
+	// GoalCU returns the number of compute units the VM should have, along with a short
+	// human-readable reason for the result.
+	GoalCU(input ScalingPolicyInput) (cu uint32, reason string)
+}
+
+// ScalingPolicyInput provides the information available to a ScalingPolicy
+type ScalingPolicyInput struct {
+	// Metrics are the most recent metrics from the VM
+	Metrics Metrics
+	// History gives the metrics from the VM before Metrics, oldest first. It contains at most
+	// MetricsHistorySize entries.
+	History []Metrics
+	VM      api.VmInfo
+	// Config is the scaling config for the VM, either from the VM itself or the default.
+	Config      api.ScalingConfig
+	ComputeUnit api.Resources
+	// Now is the time that the goal is being calculated at
+	Now time.Time
+}
+
+// MetricsHistorySize is the maximum number of previous metrics given to a ScalingPolicy
+const MetricsHistorySize = 12
+
+// DefaultScalingPolicyName is the name of the ScalingPolicy used when none is specified
+const DefaultScalingPolicyName = "default"
+
+var scalingPolicies = struct {
+	mu       sync.Mutex
+	policies map[string]ScalingPolicy
+}{
+	mu: sync.Mutex{},
+	policies: map[string]ScalingPolicy{
+		DefaultScalingPolicyName: DefaultScalingPolicy{},
+	},
+}
+
+// RegisterScalingPolicy makes the policy available for selection by name in the
+// autoscaler-agent's config. It's intended to be called from init() in packages that provide
+// alternative policies.
+//
+// Panics if a policy with the same name is already registered.
+func RegisterScalingPolicy(name string, policy ScalingPolicy) {
+	scalingPolicies.mu.Lock()
+	defer scalingPolicies.mu.Unlock()
+
+	if _, ok := scalingPolicies.policies[name]; ok {
+		panic(fmt.Errorf("scaling policy %q is already registered", name))
+	}
+	scalingPolicies.policies[name] = policy
+}
+
+// LookupScalingPolicy returns the policy registered with the name, if there is one
+func LookupScalingPolicy(name string) (_ ScalingPolicy, ok bool) {
+	scalingPolicies.mu.Lock()
+	defer scalingPolicies.mu.Unlock()
+
+	policy, ok := scalingPolicies.policies[name]
+	return policy, ok
+}
+
+// DefaultScalingPolicy is the ScalingPolicy used by default, which scales based on load average,
+// memory usage, and any configured Postgres or LFC targets.
+type DefaultScalingPolicy struct{}
+
+func (DefaultScalingPolicy) GoalCU(input ScalingPolicyInput) (uint32, string) {
+	m := input.Metrics
+
+	// For CPU:
+	// Goal compute unit is at the point where (CPUs) × (LoadAverageFractionTarget) == (load
+	// average),
+	// which we can get by dividing LA by LAFT, and then dividing by the number of CPUs per CU
+	goalCPUs := float64(m.LoadAverage1Min) / input.Config.LoadAverageFractionTarget
+	cpuGoalCU := uint32(math.Round(goalCPUs / input.ComputeUnit.VCPU.AsFloat64()))
+
+	// For Mem:
+	// Goal compute unit is at the point where (Mem) * (MemoryUsageFractionTarget) == (Mem Usage)
+	// We can get the desired memory allocation in bytes by dividing MU by MUFT, and then convert
+	// that to CUs
+	//
+	// NOTE: use uint64 for calculations on bytes as uint32 can overflow
+	memGoalBytes := api.Bytes(math.Round(float64(m.MemoryUsageBytes) / input.Config.MemoryUsageFractionTarget))
+	memGoalCU := uint32(memGoalBytes / input.ComputeUnit.Mem)
+
+	goalCU, reason := cpuGoalCU, "load average"
+	if memGoalCU > goalCU {
+		goalCU, reason = memGoalCU, "memory usage"
+	}
+
+	// For Postgres, each configured target is a simple number of units per CU.
+	if pg := m.Postgres; pg != nil {
+		if perCU := input.Config.ActiveBackendsPerCU; perCU != nil {
+			if cu := uint32(math.Round(float64(pg.ActiveBackends) / *perCU)); cu > goalCU {
+				goalCU, reason = cu, "active backends"
+			}
+		}
+		if perCU := input.Config.TransactionsPerSecondPerCU; perCU != nil {
+			if cu := uint32(math.Round(float64(pg.TransactionsPerSecond) / *perCU)); cu > goalCU {
+				goalCU, reason = cu, "transaction rate"
+			}
+		}
+	}
+
+	// For the LFC, we want enough memory that the working set fits in the portion of it that's
+	// available to the LFC. Round up, so that we scale as soon as the working set stops fitting.
+	if lfc := m.LFC; lfc != nil && input.Config.LFCToMemoryRatio != nil {
+		goalBytes := float64(lfc.WorkingSetSizeBytes) / *input.Config.LFCToMemoryRatio
+		if cu := uint32(math.Ceil(goalBytes / input.ComputeUnit.Mem.AsFloat64())); cu > goalCU {
+			goalCU, reason = cu, "LFC working set size"
+		}
+	}
+
+	// For memory pressure, the VM doesn't have enough memory right now, whatever the usage says, so
+	// we want at least one more CU than it currently has.
+	if p := m.MemoryPressure; p != nil {
+		some, full := input.Config.MemoryPressureSomeThreshold, input.Config.MemoryPressureFullThreshold
+		if (some != nil && float64(p.Some) >= *some) || (full != nil && float64(p.Full) >= *full) {
+			if cu := usingCU(input) + 1; cu > goalCU {
+				goalCU, reason = cu, "memory pressure"
+			}
+		}
+	}
+
+	return goalCU, reason
+}
+
+// usingCU returns the number of compute units that the VM is currently using, rounded up, so that a
+// VM that's between sizes is treated as the larger one.
+func usingCU(input ScalingPolicyInput) uint32 {
+	using := input.VM.Using()
+	return util.Max(
+		uint32((using.VCPU+input.ComputeUnit.VCPU-1)/input.ComputeUnit.VCPU),
+		uint32((using.Mem+input.ComputeUnit.Mem-1)/input.ComputeUnit.Mem),
+	)
+}
+
+// TimeOfDayPolicy is a ScalingPolicy that modifies another, limiting how far VMs are downscaled
+// at a time depending on the time of day. For example, it can make downscaling conservative during
+// business hours, while leaving it as aggressive as the underlying policy overnight.
+type TimeOfDayPolicy struct {
+	// Policy is the underlying policy. Its goal is used as-is, unless it would downscale the VM
+	// during one of the periods.
+	Policy ScalingPolicy
+	// Location gives the timezone that the periods are in
+	Location *time.Location
+	// Periods gives the times of day when downscaling is modified. If the current time is in
+	// multiple periods, the first one is used.
+	Periods []TimeOfDayPeriod
+}
+
+// TimeOfDayPeriod is a single period of time within each day, with its downscaling modifier
+type TimeOfDayPeriod struct {
+	// Start gives the time since midnight at which the period begins
+	Start time.Duration
+	// End gives the time since midnight at which the period ends. If End is before Start, then the
+	// period continues past midnight.
+	End time.Duration
+	// DownscaleFraction gives the fraction of the difference between the VM's current compute
+	// units and the underlying policy's goal that the VM may be downscaled by. With 1, downscaling
+	// is unchanged; with 0, there's no downscaling at all.
+	DownscaleFraction float64
+}
+
+// contains returns whether the time of day, as an offset since midnight, is within the period
+func (p TimeOfDayPeriod) contains(timeOfDay time.Duration) bool {
+	if p.Start <= p.End {
+		return p.Start <= timeOfDay && timeOfDay < p.End
+	} else {
+		return p.Start <= timeOfDay || timeOfDay < p.End
+	}
+}
+
+func (p TimeOfDayPolicy) GoalCU(input ScalingPolicyInput) (uint32, string) {
+	goalCU, reason := p.Policy.GoalCU(input)
+
+	// Round the current resources up to the nearest compute unit, so that a VM that's between
+	// sizes still downscales to a whole number of compute units.
+	currentCU := usingCU(input)
+	if goalCU >= currentCU {
+		return goalCU, reason
+	}
+
+	local := input.Now.In(p.Location)
+	timeOfDay := util.TimeOfDay(local)
+
+	for _, period := range p.Periods {
+		if !period.contains(timeOfDay) {
+			continue
+		}
+
+		decrease := uint32(math.Floor(float64(currentCU-goalCU) * period.DownscaleFraction))
+		if limitedCU := currentCU - decrease; limitedCU != goalCU {
+			goalCU = limitedCU
+			reason = fmt.Sprintf("%s (downscaling limited by time of day)", reason)
+		}
+		break
+	}
+
+	return goalCU, reason
+}
@@ -0,0 +1,100 @@
+package core
+
+// Predictive scaling, which fits a linear trend to the VM's recent metrics and projects it forward,
+// so that we can start upscaling before the load actually arrives.
+
+import (
+	"time"
+)
+
+// PredictionConfig defines how the trend in a VM's metrics is used to upscale pre-emptively
+type PredictionConfig struct {
+	// Window gives the duration of recent metrics that the trend is fit to
+	Window time.Duration
+	// Horizon gives how far ahead the trend is projected. If the projected metrics would require
+	// more compute units than the current ones, the VM is upscaled to that amount now.
+	Horizon time.Duration
+	// MinSamples gives the minimum number of metrics within Window required to make a prediction.
+	// Must be at least 2.
+	MinSamples int
+}
+
+// metricsSample is a single set of metrics, along with the time it was received
+type metricsSample struct {
+	At      time.Time
+	Metrics Metrics
+}
+
+// addPredictionSample records the metrics for use in prediction, removing any samples that are no
+// longer within the window
+func (s *state) addPredictionSample(now time.Time, metrics Metrics) {
+	conf := s.Config.Prediction
+	if conf == nil {
+		return
+	}
+
+	s.PredictionSamples = append(s.PredictionSamples, metricsSample{At: now, Metrics: metrics})
+
+	cutoff := now.Add(-conf.Window)
+	firstKept := 0
+	for firstKept < len(s.PredictionSamples) && s.PredictionSamples[firstKept].At.Before(cutoff) {
+		firstKept += 1
+	}
+	s.PredictionSamples = s.PredictionSamples[firstKept:]
+}
+
+// predictedMetrics returns the most recent metrics with load average and memory usage replaced by
+// their values projected Horizon into the future, if there are enough samples to make a
+// prediction.
+//
+// Only increasing trends are projected. A decreasing trend leaves the value as-is, so that
+// prediction never causes downscaling.
+func (s *state) predictedMetrics() (_ Metrics, ok bool) {
+	conf := s.Config.Prediction
+	if conf == nil || len(s.PredictionSamples) < conf.MinSamples || len(s.PredictionSamples) < 2 {
+		return Metrics{}, false
+	}
+
+	latest := s.PredictionSamples[len(s.PredictionSamples)-1]
+
+	project := func(get func(Metrics) float32) float32 {
+		slope := linearSlope(s.PredictionSamples, latest.At, get)
+		current := get(latest.Metrics)
+		if slope <= 0 {
+			return current
+		}
+		return current + float32(slope*conf.Horizon.Seconds())
+	}
+
+	predicted := latest.Metrics
+	predicted.LoadAverage1Min = project(func(m Metrics) float32 { return m.LoadAverage1Min })
+	predicted.MemoryUsageBytes = project(func(m Metrics) float32 { return m.MemoryUsageBytes })
+	return predicted, true
+}
+
+// linearSlope returns the slope, per second, of the least-squares line through the values from the
+// samples
+func linearSlope(samples []metricsSample, origin time.Time, get func(Metrics) float32) float64 {
+	n := float64(len(samples))
+
+	var sumX, sumY float64
+	for _, sample := range samples {
+		sumX += sample.At.Sub(origin).Seconds()
+		sumY += float64(get(sample.Metrics))
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var covariance, variance float64
+	for _, sample := range samples {
+		dx := sample.At.Sub(origin).Seconds() - meanX
+		dy := float64(get(sample.Metrics)) - meanY
+		covariance += dx * dy
+		variance += dx * dx
+	}
+
+	// If all the samples were at the same time, there's no trend we can fit.
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
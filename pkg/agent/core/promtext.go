@@ -0,0 +1,271 @@
+package core
+
+// Helpers for extracting values from prometheus text-format output, as served by the various
+// exporters inside the VM.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PromOutput is prometheus text-format output, split up so that values can be extracted from it
+type PromOutput struct {
+	lines []string
+}
+
+// LabelFilter selects the series of a metric whose labels have all of the given values. A nil or
+// empty LabelFilter selects every series.
+type LabelFilter map[string]string
+
+// Matches returns whether the labels have all of the values in the filter
+func (f LabelFilter) Matches(labels map[string]string) bool {
+	for k, v := range f {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// promSample is a single line of prometheus output
+type promSample struct {
+	labels map[string]string
+	value  float64
+}
+
+func ParsePromOutput(body []byte) PromOutput {
+	return PromOutput{lines: strings.Split(string(body), "\n")}
+}
+
+// MergePromOutputs combines the outputs into one. Where more than one has the same series, First
+// uses the value from the earliest output.
+func MergePromOutputs(outputs ...PromOutput) PromOutput {
+	var lines []string
+	for _, o := range outputs {
+		lines = append(lines, o.lines...)
+	}
+	return PromOutput{lines: lines}
+}
+
+// Rename returns a copy of the output with the metrics renamed according to names, which maps from
+// old to new names. Metrics not in names are unchanged.
+//
+// Only exact names are renamed, so for a histogram, each of its "_bucket", "_sum", and "_count"
+// series must be given separately.
+func (o PromOutput) Rename(names map[string]string) PromOutput {
+	lines := make([]string, 0, len(o.lines))
+	for _, l := range o.lines {
+		end := strings.IndexAny(l, "{ ")
+		if strings.HasPrefix(l, "#") || end == -1 {
+			lines = append(lines, l)
+			continue
+		}
+		if newName, ok := names[l[:end]]; ok {
+			l = newName + l[end:]
+		}
+		lines = append(lines, l)
+	}
+	return PromOutput{lines: lines}
+}
+
+// samples returns all of the samples for the metric with the name, whose labels match the filter
+func (o PromOutput) samples(name string, filter LabelFilter) ([]promSample, error) {
+	var samples []promSample
+	for _, l := range o.lines {
+		if !strings.HasPrefix(l, name+"{") && !strings.HasPrefix(l, name+" ") {
+			continue
+		}
+
+		rest := strings.TrimPrefix(l, name)
+		labels := make(map[string]string)
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			labels, rest, err = parseLabels(rest)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing labels in metrics output for %q: %w", name, err)
+			}
+		}
+		if !filter.Matches(labels) {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) < 1 {
+			return nil, fmt.Errorf("Missing value in metrics output for %q", name)
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %q as float for metric %q: %w", fields[0], name, err)
+		}
+		samples = append(samples, promSample{labels: labels, value: v})
+	}
+	return samples, nil
+}
+
+// Sum returns the sum of the values of all series for the metric with the name that match the
+// filter, or error if there weren't any.
+//
+// This works for both gauges and counters. For the rate of a counter, see CounterRate.
+func (o PromOutput) Sum(name string, filter LabelFilter) (float64, error) {
+	samples, err := o.samples(name, filter)
+	if err != nil {
+		return 0, err
+	} else if len(samples) == 0 {
+		return 0, fmt.Errorf("No lines in metrics output for %q", name)
+	}
+
+	var sum float64
+	for _, s := range samples {
+		sum += s.value
+	}
+	return sum, nil
+}
+
+// First returns the value of the first series for the metric with the name that matches the
+// filter, or error if there weren't any.
+func (o PromOutput) First(name string, filter LabelFilter) (float64, error) {
+	samples, err := o.samples(name, filter)
+	if err != nil {
+		return 0, err
+	} else if len(samples) == 0 && len(filter) != 0 {
+		return 0, fmt.Errorf("No lines in metrics output for %q with labels %v", name, filter)
+	} else if len(samples) == 0 {
+		return 0, fmt.Errorf("No lines in metrics output for %q", name)
+	}
+	return samples[0].value, nil
+}
+
+// HistogramQuantile estimates the q-quantile (0 <= q <= 1) of the histogram with the name, from
+// the "_bucket" series that match the filter. Series that differ only in labels other than "le"
+// are added together.
+//
+// This uses the same linear interpolation within buckets as prometheus' histogram_quantile(). If
+// the histogram has no observations, the result is NaN.
+func (o PromOutput) HistogramQuantile(name string, q float64, filter LabelFilter) (float64, error) {
+	if q < 0 || q > 1 {
+		return 0, fmt.Errorf("Quantile %v is not between 0 and 1", q)
+	}
+
+	samples, err := o.samples(name+"_bucket", filter)
+	if err != nil {
+		return 0, err
+	}
+
+	counts := make(map[float64]float64)
+	for _, s := range samples {
+		le, ok := s.labels["le"]
+		if !ok {
+			return 0, fmt.Errorf("Missing \"le\" label on bucket for histogram %q", name)
+		}
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing bucket bound %q for histogram %q: %w", le, name, err)
+		}
+		counts[upperBound] += s.value
+	}
+	if _, ok := counts[math.Inf(1)]; !ok {
+		return 0, fmt.Errorf("No +Inf bucket in metrics output for histogram %q", name)
+	}
+
+	bounds := make([]float64, 0, len(counts))
+	for b := range counts {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	total := counts[math.Inf(1)]
+	if total == 0 {
+		return math.NaN(), nil
+	}
+	rank := q * total
+
+	var prevBound, prevCount float64
+	for i, b := range bounds {
+		count := counts[b]
+		if count < rank {
+			prevBound, prevCount = b, count
+			continue
+		}
+
+		if math.IsInf(b, 1) {
+			// Can't interpolate into the +Inf bucket, so the best estimate is the largest finite
+			// upper bound.
+			if i == 0 {
+				return math.NaN(), nil
+			}
+			return prevBound, nil
+		} else if i == 0 && b <= 0 {
+			// The lowest bucket has no lower bound to interpolate from
+			return b, nil
+		}
+
+		if count == prevCount {
+			return b, nil
+		}
+		return prevBound + (b-prevBound)*(rank-prevCount)/(count-prevCount), nil
+	}
+
+	// unreachable: the +Inf bucket always has count >= rank
+	panic("rank greater than histogram count")
+}
+
+// CounterRate returns the per-second rate of increase of a counter from prev to cur, over the
+// elapsed time
+//
+// If the counter decreased (e.g. because the process exporting it restarted), the rate is treated
+// as zero.
+func CounterRate(cur, prev float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return math.Max(0, cur-prev) / elapsed.Seconds()
+}
+
+// parseLabels parses the labels at the start of s, which must begin with '{', returning the rest of
+// the string after the closing '}'
+func parseLabels(s string) (_ map[string]string, rest string, _ error) {
+	labels := make(map[string]string)
+	s = strings.TrimPrefix(s, "{")
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			return nil, "", fmt.Errorf("Expected '=' after label name in %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " ")
+
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("Expected quoted value for label %q", key)
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return nil, "", fmt.Errorf("Unterminated value for label %q", key)
+		}
+		labels[key] = value.String()
+		s = s[i+1:]
+	}
+}
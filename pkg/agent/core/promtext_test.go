@@ -0,0 +1,236 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+)
+
+const examplePromOutput = `# HELP pg_stat_activity_count number of connections in this state
+# TYPE pg_stat_activity_count gauge
+pg_stat_activity_count{datname="postgres",state="active"} 3
+pg_stat_activity_count{datname="postgres",state="idle"} 5
+pg_stat_activity_count{datname="other",state="active"} 1
+pg_stat_activity_count_extra 100
+# TYPE query_duration_seconds histogram
+query_duration_seconds_bucket{db="a",le="0.1"} 2
+query_duration_seconds_bucket{db="a",le="0.5"} 6
+query_duration_seconds_bucket{db="a",le="1"} 8
+query_duration_seconds_bucket{db="a",le="+Inf"} 10
+query_duration_seconds_bucket{db="b",le="0.1"} 8
+query_duration_seconds_bucket{db="b",le="0.5"} 10
+query_duration_seconds_bucket{db="b",le="1"} 10
+query_duration_seconds_bucket{db="b",le="+Inf"} 10
+query_duration_seconds_sum{db="a"} 12.5
+query_duration_seconds_count{db="a"} 10
+weird_labels{msg="a \"quoted\", spaced } value",other="x"} 7
+`
+
+func TestPromOutputSum(t *testing.T) {
+	out := core.ParsePromOutput([]byte(examplePromOutput))
+
+	sum, err := out.Sum("pg_stat_activity_count", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 9.0, sum)
+
+	sum, err = out.Sum("pg_stat_activity_count", core.LabelFilter{"state": "active"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, sum)
+
+	sum, err = out.Sum("weird_labels", core.LabelFilter{"msg": `a "quoted", spaced } value`})
+	assert.NoError(t, err)
+	assert.Equal(t, 7.0, sum)
+
+	_, err = out.Sum("pg_stat_activity_count", core.LabelFilter{"state": "nonexistent"})
+	assert.Error(t, err)
+}
+
+func TestPromOutputHistogramQuantile(t *testing.T) {
+	out := core.ParsePromOutput([]byte(examplePromOutput))
+
+	cases := []struct {
+		name     string
+		q        float64
+		filter   core.LabelFilter
+		expected float64
+	}{
+		// rank 5 of 10: in the (0.1, 0.5] bucket, 3/4 of the way through
+		{"median-a", 0.5, core.LabelFilter{"db": "a"}, 0.4},
+		// rank 9 of 10: in the +Inf bucket, so use the highest finite bound
+		{"p90-a", 0.9, core.LabelFilter{"db": "a"}, 1},
+		// rank 4 of 10: in the [0, 0.1] bucket, half of the way through
+		{"p40-b", 0.4, core.LabelFilter{"db": "b"}, 0.05},
+		// rank 10 of 20, combined: exactly the top of the [0, 0.1] bucket
+		{"median-all", 0.5, nil, 0.1},
+	}
+
+	for _, c := range cases {
+		got, err := out.HistogramQuantile("query_duration_seconds", c.q, c.filter)
+		assert.NoError(t, err, c.name)
+		assert.InDelta(t, c.expected, got, 1e-9, c.name)
+	}
+
+	_, err := out.HistogramQuantile("query_duration_seconds", 1.5, nil)
+	assert.Error(t, err)
+
+	// no buckets at all, so no +Inf bucket
+	_, err = out.HistogramQuantile("query_duration_seconds", 0.5, core.LabelFilter{"db": "c"})
+	assert.Error(t, err)
+}
+
+func TestCounterRate(t *testing.T) {
+	assert.Equal(t, 5.0, core.CounterRate(150, 100, 10*time.Second))
+	// counter reset
+	assert.Equal(t, 0.0, core.CounterRate(10, 100, 10*time.Second))
+	assert.Equal(t, 0.0, core.CounterRate(150, 100, 0))
+	assert.Equal(t, 0.5, core.CounterRate(101, 100, 2*time.Second))
+}
+
+func TestReadMetricsWithLabels(t *testing.T) {
+	output := []byte(`host_load1{collector="loadavg",host="a"} 0.5
+host_load15{collector="loadavg",host="a"} 2
+host_memory_available_bytes{collector="memory",host="other"} 1
+host_memory_available_bytes{collector="memory",host="a"} 1073741824
+host_memory_total_bytes{collector="memory",host="a"} 4294967296
+`)
+
+	labels := core.HostMetricLabels{
+		Load1:           nil,
+		MemoryAvailable: core.LabelFilter{"host": "a"},
+		MemoryTotal:     nil,
+		MemoryStalled:   nil,
+		MemoryWaiting:   nil,
+		CPUSteal:        nil,
+		CPUThrottled:    nil,
+	}
+	m, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(0.5), m.LoadAverage1Min)
+	assert.Equal(t, float32(3*(1<<30)+100*(1<<20)), m.MemoryUsageBytes)
+	assert.Nil(t, m.MemoryStalledSecondsTotal)
+
+	labels.MemoryTotal = core.LabelFilter{"host": "b"}
+	_, err = core.ReadMetrics(output, "host_", labels)
+	assert.Error(t, err)
+}
+
+func TestMergeAndRenamePromOutputs(t *testing.T) {
+	node := core.ParsePromOutput([]byte(`# TYPE node_load1 gauge
+node_load1 0.25
+node_memory_available_bytes 1073741824
+`))
+	vector := core.ParsePromOutput([]byte(`host_load1 0.5
+host_memory_total_bytes 4294967296
+`))
+
+	renamed := node.Rename(map[string]string{
+		"node_load1":                  "host_load1",
+		"node_memory_available_bytes": "host_memory_available_bytes",
+	})
+	merged := core.MergePromOutputs(vector, renamed)
+
+	// host_load1 is in both, so the first output takes precedence
+	labels := core.HostMetricLabels{
+		Load1:           nil,
+		MemoryAvailable: nil,
+		MemoryTotal:     nil,
+		MemoryStalled:   nil,
+		MemoryWaiting:   nil,
+		CPUSteal:        nil,
+		CPUThrottled:    nil,
+	}
+	m, err := core.ReadMetricsFromOutput(merged, "host_", labels)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(0.5), m.LoadAverage1Min)
+	assert.Equal(t, float32(3*(1<<30)+100*(1<<20)), m.MemoryUsageBytes)
+
+	// the original isn't modified
+	_, err = node.Sum("host_load1", nil)
+	assert.Error(t, err)
+}
+
+func TestMemoryPressureSince(t *testing.T) {
+	output := []byte(`host_load1 0.5
+host_memory_available_bytes 1073741824
+host_memory_total_bytes 4294967296
+host_pressure_memory_waiting_seconds_total 12
+host_pressure_memory_stalled_seconds_total 3
+`)
+	labels := core.HostMetricLabels{Load1: nil, MemoryAvailable: nil, MemoryTotal: nil, MemoryStalled: nil, MemoryWaiting: nil, CPUSteal: nil, CPUThrottled: nil}
+	prev, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+
+	output = []byte(`host_load1 0.5
+host_memory_available_bytes 1073741824
+host_memory_total_bytes 4294967296
+host_pressure_memory_waiting_seconds_total 14.5
+host_pressure_memory_stalled_seconds_total 3.5
+`)
+	cur, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+
+	pressure := cur.MemoryPressureSince(prev, 5*time.Second)
+	if assert.NotNil(t, pressure) {
+		assert.InDelta(t, 0.5, pressure.Some, 1e-6)
+		assert.InDelta(t, 0.1, pressure.Full, 1e-6)
+	}
+
+	// If the counters went backwards, e.g. because the VM restarted, there's no result
+	assert.Nil(t, prev.MemoryPressureSince(cur, 5*time.Second))
+
+	// ... and likewise if PSI isn't available
+	cur.MemoryWaitingSecondsTotal = nil
+	assert.Nil(t, cur.MemoryPressureSince(prev, 5*time.Second))
+}
+
+func TestHostContentionSince(t *testing.T) {
+	output := []byte(`host_load1 0.5
+host_memory_available_bytes 1073741824
+host_memory_total_bytes 4294967296
+host_cpu_seconds_total{cpu="0",mode="idle"} 100
+host_cpu_seconds_total{cpu="0",mode="steal"} 10
+host_cpu_seconds_total{cpu="1",mode="steal"} 20
+host_cgroup_cpu_throttled_seconds_total{cgroup="neon-postgres"} 4
+`)
+	labels := core.HostMetricLabels{Load1: nil, MemoryAvailable: nil, MemoryTotal: nil, MemoryStalled: nil, MemoryWaiting: nil, CPUSteal: nil, CPUThrottled: nil}
+	prev, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+	if assert.NotNil(t, prev.CPU) {
+		assert.Equal(t, 2, prev.CPU.CPUs)
+	}
+
+	output = []byte(`host_load1 0.5
+host_memory_available_bytes 1073741824
+host_memory_total_bytes 4294967296
+host_cpu_seconds_total{cpu="0",mode="idle"} 105
+host_cpu_seconds_total{cpu="0",mode="steal"} 12
+host_cpu_seconds_total{cpu="1",mode="steal"} 23
+host_cgroup_cpu_throttled_seconds_total{cgroup="neon-postgres"} 4.5
+`)
+	cur, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+
+	// 5 seconds of steal across 2 CPUs over 5 seconds is half of each CPU
+	contention := cur.CPU.Since(*prev.CPU, 5*time.Second)
+	if assert.NotNil(t, contention.StealFraction) && assert.NotNil(t, contention.ThrottledFraction) {
+		assert.InDelta(t, 0.5, *contention.StealFraction, 1e-6)
+		assert.InDelta(t, 0.1, *contention.ThrottledFraction, 1e-6)
+	}
+
+	// If the counters went backwards, e.g. because the VM restarted, there's no result
+	contention = prev.CPU.Since(*cur.CPU, 5*time.Second)
+	assert.Nil(t, contention.StealFraction)
+	assert.Nil(t, contention.ThrottledFraction)
+
+	// ... and if the VM doesn't report either, there are no counters at all
+	output = []byte(`host_load1 0.5
+host_memory_available_bytes 1073741824
+host_memory_total_bytes 4294967296
+`)
+	m, err := core.ReadMetrics(output, "host_", labels)
+	assert.NoError(t, err)
+	assert.Nil(t, m.CPU)
+}
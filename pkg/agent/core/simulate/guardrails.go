@@ -0,0 +1,181 @@
+package simulate
+
+// Guard rails for custom scaling policies: a fixed set of scenarios that every policy is run
+// through, checking that the resulting decisions are safe.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tychoish/fun/erc"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// Bounds of the VM in the guard rail scenarios. The minimum is above one so that scaling too far
+// down is noticed.
+const (
+	guardRailMinCU = 2
+	guardRailMaxCU = 8
+)
+
+// guardRailMetricsInterval is the time between metrics in the guard rail scenarios, except where
+// they're deliberately missing. It matches the default for the autoscaler-agent's
+// .metrics.secondsBetweenRequests.
+const guardRailMetricsInterval = 5 * time.Second
+
+// guardRailScenario is a scenario that policies are checked against, alongside the number of times
+// that scaling is allowed to change direction during it
+type guardRailScenario struct {
+	name                string
+	timeline            []Event
+	duration            time.Duration
+	maxDirectionChanges int
+}
+
+// guardRailScenarios returns the scenarios that policies are checked against, with metrics that
+// are scaled to the compute unit and scaling config so that each scenario asks for roughly the
+// same number of compute units regardless of them.
+func guardRailScenarios(computeUnit api.Resources, config api.ScalingConfig) []guardRailScenario {
+	// metricsForCU returns metrics that, with the default policy, would produce the given number of
+	// compute units. Memory usage is kept small, so that load average is what matters.
+	metricsForCU := func(cu float64) *EventMetrics {
+		return &EventMetrics{
+			LoadAverage1Min: float32(cu * computeUnit.VCPU.AsFloat64() * config.LoadAverageFractionTarget),
+			MemoryUsage:     0,
+		}
+	}
+	// steady returns metrics at every interval from start up to (but not including) end, as they
+	// would normally arrive.
+	steady := func(start, end time.Duration, cu float64) []Event {
+		var events []Event
+		for d := start; d < end; d += guardRailMetricsInterval {
+			events = append(events, Event{
+				At:                    Duration(d),
+				Metrics:               metricsForCU(cu),
+				MonitorUpscaleRequest: false,
+				Plugin:                nil,
+				Monitor:               nil,
+			})
+		}
+		return events
+	}
+	concat := func(parts ...[]Event) []Event {
+		var events []Event
+		for _, p := range parts {
+			events = append(events, p...)
+		}
+		return events
+	}
+
+	return []guardRailScenario{
+		{
+			name:                "idle",
+			timeline:            steady(0, 10*time.Minute, 0),
+			duration:            10 * time.Minute,
+			maxDirectionChanges: 0,
+		},
+		{
+			// A brief spike well beyond the maximum, followed by going back to idle
+			name: "spike",
+			timeline: concat(
+				steady(0, time.Minute, 0),
+				steady(time.Minute, 3*time.Minute, 4*guardRailMaxCU),
+				steady(3*time.Minute, 10*time.Minute, 0),
+			),
+			duration:            10 * time.Minute,
+			maxDirectionChanges: 1,
+		},
+		{
+			// Load that increases gradually and then stays high
+			name: "sustained load",
+			timeline: concat(
+				steady(0, time.Minute, guardRailMinCU),
+				steady(time.Minute, 2*time.Minute, 4),
+				steady(2*time.Minute, 30*time.Minute, 6),
+			),
+			duration:            30 * time.Minute,
+			maxDirectionChanges: 0,
+		},
+		{
+			// Metrics that stop arriving for a while under load, then briefly come back, then stop
+			// again and come back much lower. The policy keeps being asked for a goal during the
+			// gaps, with the same metrics each time.
+			name: "metric gaps",
+			timeline: concat(
+				steady(0, 2*time.Minute, 5),
+				steady(5*time.Minute, 6*time.Minute, 5),
+				steady(15*time.Minute, 20*time.Minute, 0),
+			),
+			duration:            20 * time.Minute,
+			maxDirectionChanges: 1,
+		},
+	}
+}
+
+// CheckPolicy runs the registered scaling policy through a fixed set of scenarios (idle, a spike,
+// sustained load, and gaps in metrics), returning an error if it ever scales the VM outside its
+// bounds or changes direction more than expected.
+func CheckPolicy(policyName string, computeUnit api.Resources, config api.ScalingConfig) error {
+	ec := &erc.Collector{}
+
+	minResources := computeUnit.Mul(guardRailMinCU)
+	maxResources := computeUnit.Mul(guardRailMaxCU)
+
+	for _, gs := range guardRailScenarios(computeUnit, config) {
+		scenario := &Scenario{
+			ComputeUnit:    computeUnit,
+			MemorySlotSize: computeUnit.Mem,
+			VM: ScenarioVM{
+				MinCU:     guardRailMinCU,
+				MaxCU:     guardRailMaxCU,
+				InitialCU: guardRailMinCU,
+			},
+			Scaling:       config,
+			ScalingPolicy: policyName,
+			Start:         nil,
+			Duration:      Duration(gs.duration),
+			Timeline:      gs.timeline,
+		}
+		if err := scenario.Validate(); err != nil {
+			ec.Add(fmt.Errorf("scenario %q: %w", gs.name, err))
+			continue
+		}
+
+		result, err := Run(scenario)
+		if err != nil {
+			ec.Add(fmt.Errorf("scenario %q: %w", gs.name, err))
+			continue
+		}
+
+		directionChanges := 0
+		var lastIncrease *bool
+		for _, d := range result.Decisions {
+			if d.Action != ActionNeonVM {
+				continue
+			}
+
+			erc.Whenf(
+				ec, d.Target.HasFieldLessThan(minResources),
+				"scenario %q: scaled below the minimum at %s, to %s", gs.name, time.Duration(d.At), formatResources(d.Target),
+			)
+			erc.Whenf(
+				ec, d.Target.HasFieldGreaterThan(maxResources),
+				"scenario %q: scaled above the maximum at %s, to %s", gs.name, time.Duration(d.At), formatResources(d.Target),
+			)
+
+			increase := d.Target.HasFieldGreaterThan(d.Current)
+			if lastIncrease != nil && *lastIncrease != increase {
+				directionChanges += 1
+			}
+			lastIncrease = &increase
+		}
+
+		erc.Whenf(
+			ec, directionChanges > gs.maxDirectionChanges,
+			"scenario %q: scaling changed direction %d times, expected at most %d", gs.name, directionChanges, gs.maxDirectionChanges,
+		)
+	}
+
+	return ec.Resolve()
+}
@@ -0,0 +1,47 @@
+package simulate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestGuardRailScenarioMetrics(t *testing.T) {
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+	config := api.ScalingConfig{ //nolint:exhaustruct // only the targets are used
+		LoadAverageFractionTarget: 0.9,
+		MemoryUsageFractionTarget: 0.75,
+	}
+
+	for _, gs := range guardRailScenarios(computeUnit, config) {
+		t.Run(gs.name, func(t *testing.T) {
+			require.NotEmpty(t, gs.timeline)
+			assert.Equal(t, Duration(0), gs.timeline[0].At, "metrics should be available from the start")
+
+			// Find the gaps between metrics longer than the usual interval
+			var gaps []time.Duration
+			for i := 1; i < len(gs.timeline); i++ {
+				prev, cur := gs.timeline[i-1], gs.timeline[i]
+				require.NotNil(t, cur.Metrics)
+				require.Less(t, prev.At, cur.At, "events must be ordered")
+				if d := time.Duration(cur.At - prev.At); d > guardRailMetricsInterval {
+					gaps = append(gaps, d)
+				}
+			}
+
+			if gs.name == "metric gaps" {
+				// Each gap covers many missed metrics, with some arriving between them
+				assert.Len(t, gaps, 2)
+				for _, d := range gaps {
+					assert.GreaterOrEqual(t, d, 10*guardRailMetricsInterval)
+				}
+			} else {
+				assert.Empty(t, gaps)
+			}
+		})
+	}
+}
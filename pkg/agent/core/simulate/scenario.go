@@ -0,0 +1,257 @@
+package simulate
+
+// Definition of scenarios, which give the VM and a timeline of what happens to it
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tychoish/fun/erc"
+	"sigs.k8s.io/yaml"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// Scenario describes a VM and the events that happen to it, which can be run through the scaling
+// state machine with Run.
+type Scenario struct {
+	// ComputeUnit gives the ratio between CPU and memory, as in the autoscaler-agent config
+	ComputeUnit api.Resources `json:"computeUnit"`
+	// MemorySlotSize gives the size of the VM's memory slots. ComputeUnit.Mem must be a multiple
+	// of it.
+	MemorySlotSize api.Bytes `json:"memorySlotSize"`
+
+	VM ScenarioVM `json:"vm"`
+
+	// Scaling gives the scaling config for the VM, as in the autoscaler-agent's defaultConfig
+	Scaling api.ScalingConfig `json:"scaling"`
+	// ScalingPolicy, if not empty, gives the name of the registered ScalingPolicy to use instead
+	// of the default.
+	ScalingPolicy string `json:"scalingPolicy,omitempty"`
+
+	// Start, if provided, gives the time that the scenario starts at. Defaults to midnight UTC on
+	// 2000-01-01, which is a Saturday.
+	Start *time.Time `json:"start,omitempty"`
+	// Duration gives how long the scenario runs for
+	Duration Duration `json:"duration"`
+
+	// Timeline gives the events in the scenario, ordered by their time
+	Timeline []Event `json:"timeline"`
+}
+
+// ScenarioVM gives the VM's bounds, in compute units
+type ScenarioVM struct {
+	MinCU     uint16 `json:"minCU"`
+	MaxCU     uint16 `json:"maxCU"`
+	InitialCU uint16 `json:"initialCU"`
+}
+
+// Event is something that happens during a scenario. Any number of the fields may be set.
+type Event struct {
+	// At gives the time of the event, relative to the start of the scenario
+	At Duration `json:"at"`
+
+	// Metrics, if not nil, gives the new metrics from the VM
+	Metrics *EventMetrics `json:"metrics,omitempty"`
+	// MonitorUpscaleRequest, if true, has the vm-monitor request more CPU and memory
+	MonitorUpscaleRequest bool `json:"monitorUpscaleRequest,omitempty"`
+
+	// Plugin, if not nil, changes how the scheduler plugin responds to all later requests
+	Plugin *PluginBehavior `json:"plugin,omitempty"`
+	// Monitor, if not nil, changes how the vm-monitor responds to all later requests
+	Monitor *MonitorBehavior `json:"monitor,omitempty"`
+}
+
+// EventMetrics are the subset of core.Metrics that can be given in a scenario
+type EventMetrics struct {
+	LoadAverage1Min float32   `json:"loadAverage1Min"`
+	MemoryUsage     api.Bytes `json:"memoryUsage"`
+}
+
+// PluginBehavior gives how the simulated scheduler plugin responds to requests
+//
+// By default, all requests are permitted.
+type PluginBehavior struct {
+	// MaxPermitCU, if not nil, gives the most that the plugin will permit the VM to have, as if
+	// there was no more room on the node. Decreases are always permitted.
+	MaxPermitCU *uint16 `json:"maxPermitCU,omitempty"`
+	// Fail, if true, makes requests to the plugin fail
+	Fail bool `json:"fail,omitempty"`
+}
+
+// MonitorBehavior gives how the simulated vm-monitor responds to requests
+//
+// By default, all requests are allowed.
+type MonitorBehavior struct {
+	// DenyDownscale, if true, makes the vm-monitor deny requests to downscale
+	DenyDownscale bool `json:"denyDownscale,omitempty"`
+}
+
+// Duration is a time.Duration that's represented in YAML and JSON as a string like "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultStart is the time that scenarios start at, if not given
+var defaultStart = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ParseScenario parses and validates a scenario from its YAML (or JSON) representation
+func ParseScenario(data []byte) (*Scenario, error) {
+	var s Scenario
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return nil, fmt.Errorf("Error parsing scenario: %w", err)
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid scenario: %w", err)
+	}
+
+	return &s, nil
+}
+
+func (s *Scenario) Validate() error {
+	ec := &erc.Collector{}
+
+	const (
+		zeroTmpl = "field %q cannot be zero"
+	)
+
+	erc.Whenf(ec, s.ComputeUnit.VCPU == 0, zeroTmpl, ".computeUnit.vCPUs")
+	erc.Whenf(ec, s.ComputeUnit.Mem == 0, zeroTmpl, ".computeUnit.mem")
+	erc.Whenf(ec, s.MemorySlotSize == 0, zeroTmpl, ".memorySlotSize")
+	erc.Whenf(
+		ec, s.MemorySlotSize != 0 && s.ComputeUnit.Mem%s.MemorySlotSize != 0,
+		"%s must be a multiple of %s", ".computeUnit.mem", ".memorySlotSize",
+	)
+
+	erc.Whenf(ec, s.VM.MinCU == 0, zeroTmpl, ".vm.minCU")
+	erc.Whenf(ec, s.VM.MaxCU < s.VM.MinCU, "%s must not be less than %s", ".vm.maxCU", ".vm.minCU")
+	erc.Whenf(
+		ec, s.VM.InitialCU < s.VM.MinCU || s.VM.InitialCU > s.VM.MaxCU,
+		"%s must be between %s and %s", ".vm.initialCU", ".vm.minCU", ".vm.maxCU",
+	)
+
+	if err := s.Scaling.Validate(); err != nil {
+		ec.Add(fmt.Errorf("%s: %w", ".scaling", err))
+	}
+	if s.ScalingPolicy != "" {
+		_, ok := core.LookupScalingPolicy(s.ScalingPolicy)
+		erc.Whenf(ec, !ok, "%s gives unknown scaling policy %q", ".scalingPolicy", s.ScalingPolicy)
+	}
+
+	erc.Whenf(ec, s.Duration <= 0, "%s must be positive", ".duration")
+	for i, e := range s.Timeline {
+		erc.Whenf(ec, e.At < 0, "%s must not be negative", fmt.Sprintf(".timeline[%d].at", i))
+		erc.Whenf(ec, e.At > s.Duration, "%s must not be after %s", fmt.Sprintf(".timeline[%d].at", i), ".duration")
+		erc.Whenf(
+			ec, i > 0 && e.At < s.Timeline[i-1].At,
+			"%s must not be before the previous event", fmt.Sprintf(".timeline[%d].at", i),
+		)
+	}
+
+	// heads-up! some functions elsewhere depend on the concrete return type of this function.
+	return ec.Resolve()
+}
+
+// start returns the time that the scenario starts at
+func (s *Scenario) start() time.Time {
+	if s.Start != nil {
+		return *s.Start
+	}
+	return defaultStart
+}
+
+// vmInfo returns the initial state of the VM
+func (s *Scenario) vmInfo() api.VmInfo {
+	slotsPerCU := uint16(s.ComputeUnit.Mem / s.MemorySlotSize)
+
+	return api.VmInfo{
+		Name:      "simulated",
+		Namespace: "simulated",
+		Cpu: api.VmCpuInfo{
+			Min:    s.ComputeUnit.VCPU * vmapi.MilliCPU(s.VM.MinCU),
+			Use:    s.ComputeUnit.VCPU * vmapi.MilliCPU(s.VM.InitialCU),
+			Max:    s.ComputeUnit.VCPU * vmapi.MilliCPU(s.VM.MaxCU),
+			Pinned: 0,
+		},
+		Mem: api.VmMemInfo{
+			SlotSize: s.MemorySlotSize,
+			Min:      slotsPerCU * s.VM.MinCU,
+			Use:      slotsPerCU * s.VM.InitialCU,
+			Max:      slotsPerCU * s.VM.MaxCU,
+		},
+		Config: api.VmConfig{
+			AutoMigrationEnabled: false,
+			AlwaysMigrate:        false,
+			ScalingEnabled:       true,
+			ScalingConfig:        &s.Scaling,
+			MetricsTransport:     api.MetricsTransportPull,
+			Schedule:             nil,
+			Overrides:            nil,
+			ManualTargetCU:       nil,
+			Priority:             0,
+			Topology:             nil,
+			BurstCredits:         nil,
+		},
+		Paused:     false,
+		RunnerPort: 0,
+	}
+}
+
+// coreConfig returns the configuration for the scaling state machine
+//
+// Timings are the same as the autoscaler-agent's default config.
+func (s *Scenario) coreConfig() core.Config {
+	var policy core.ScalingPolicy
+	if s.ScalingPolicy != "" {
+		var ok bool
+		if policy, ok = core.LookupScalingPolicy(s.ScalingPolicy); !ok {
+			panic(errors.New("scaling policy should have been checked in Validate"))
+		}
+	}
+
+	return core.Config{
+		ComputeUnit:                         s.ComputeUnit,
+		DefaultScalingConfig:                s.Scaling,
+		NeonVMRetryWait:                     5 * time.Second,
+		PluginRequestTick:                   5 * time.Second,
+		PluginRetryWait:                     3 * time.Second,
+		PluginDeniedRetryWait:               2 * time.Second,
+		MonitorDeniedDownscaleCooldown:      5 * time.Second,
+		MonitorRequestedUpscaleValidPeriod:  10 * time.Second,
+		MonitorRetryWait:                    3 * time.Second,
+		EmergencyUpscaleCU:                  0,
+		EmergencyUpscaleMinInterval:         0,
+		EmergencyUpscaleValidPeriod:         0,
+		NodePressureDeniedDownscaleCooldown: 0,
+		NodePressureMaxUpscaleCU:            0,
+		Prediction:                          nil,
+		Burst:                               nil,
+		ScalingPolicy:                       policy,
+		Log: core.LogConfig{
+			Info: nil,
+			Warn: nil,
+		},
+	}
+}
@@ -0,0 +1,226 @@
+// Package simulate drives the scaling state machine in pkg/agent/core through a Scenario, without
+// any of the components it normally talks to, so that changes to the scaling logic can be checked
+// against recorded or hand-written timelines.
+//
+// The scheduler plugin, NeonVM, and the vm-monitor are all simulated as responding immediately.
+package simulate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// Kinds of action that may appear in a Decision
+const (
+	ActionPlugin           = "plugin"
+	ActionNeonVM           = "neonvm"
+	ActionMonitorDownscale = "monitorDownscale"
+	ActionMonitorUpscale   = "monitorUpscale"
+)
+
+// Decision is a single action taken by the state machine, along with its result
+type Decision struct {
+	// At gives the time of the action, relative to the start of the scenario
+	At Duration `json:"at"`
+	// Action gives the kind of action, e.g. ActionNeonVM
+	Action  string        `json:"action"`
+	Current api.Resources `json:"current"`
+	Target  api.Resources `json:"target"`
+	// Outcome gives a short description of the simulated response
+	Outcome string `json:"outcome"`
+}
+
+// Result is the outcome of running a Scenario
+type Result struct {
+	Decisions []Decision `json:"decisions"`
+	// Final gives the resources that the VM has at the end of the scenario
+	Final api.Resources `json:"final"`
+}
+
+// maxStepsPerInstant limits how many times we'll ask the state machine for new actions without
+// time moving forward, so that a bug in it results in an error rather than looping forever.
+const maxStepsPerInstant = 100
+
+// simulation is the state of a running Scenario
+type simulation struct {
+	scenario *Scenario
+	state    *core.State
+	start    time.Time
+
+	// using gives the resources that the simulated VM currently has
+	using   api.Resources
+	plugin  PluginBehavior
+	monitor MonitorBehavior
+
+	result Result
+}
+
+// Run runs the scenario through the scaling state machine, returning the decisions it made
+//
+// The scenario must have been validated.
+func Run(scenario *Scenario) (*Result, error) {
+	vm := scenario.vmInfo()
+
+	sim := &simulation{
+		scenario: scenario,
+		state:    core.NewState(vm, scenario.coreConfig()),
+		start:    scenario.start(),
+		using:    vm.Using(),
+		plugin:   PluginBehavior{MaxPermitCU: nil, Fail: false},
+		monitor:  MonitorBehavior{DenyDownscale: false},
+		result: Result{
+			Decisions: nil,
+			Final:     api.Resources{VCPU: 0, Mem: 0},
+		},
+	}
+	sim.state.Monitor().Active(true)
+
+	now := sim.start
+	end := sim.start.Add(time.Duration(scenario.Duration))
+	nextEvent := 0
+	stepsAtInstant := 0
+
+	for {
+		for nextEvent < len(scenario.Timeline) && !sim.eventTime(nextEvent).After(now) {
+			sim.applyEvent(now, scenario.Timeline[nextEvent])
+			nextEvent += 1
+		}
+
+		actions := sim.state.NextActions(now)
+		tookAction, err := sim.execute(now, actions)
+		if err != nil {
+			return nil, err
+		}
+
+		if tookAction {
+			// Something changed, so there may be more to do before any time passes.
+			stepsAtInstant += 1
+			if stepsAtInstant > maxStepsPerInstant {
+				return nil, fmt.Errorf("State machine took more than %d actions at %s without waiting", maxStepsPerInstant, now.Sub(sim.start))
+			}
+			continue
+		}
+		stepsAtInstant = 0
+
+		if !now.Before(end) {
+			break
+		}
+
+		next := end
+		if actions.Wait != nil && actions.Wait.Duration > 0 && now.Add(actions.Wait.Duration).Before(next) {
+			next = now.Add(actions.Wait.Duration)
+		}
+		if nextEvent < len(scenario.Timeline) && sim.eventTime(nextEvent).Before(next) {
+			next = sim.eventTime(nextEvent)
+		}
+		now = next
+	}
+
+	sim.result.Final = sim.using
+	return &sim.result, nil
+}
+
+func (sim *simulation) eventTime(i int) time.Time {
+	return sim.start.Add(time.Duration(sim.scenario.Timeline[i].At))
+}
+
+func (sim *simulation) applyEvent(now time.Time, event Event) {
+	if event.Plugin != nil {
+		sim.plugin = *event.Plugin
+	}
+	if event.Monitor != nil {
+		sim.monitor = *event.Monitor
+	}
+	if m := event.Metrics; m != nil {
+		sim.state.UpdateMetrics(now, core.Metrics{
+			LoadAverage1Min:           m.LoadAverage1Min,
+			MemoryUsageBytes:          float32(m.MemoryUsage),
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		})
+	}
+	if event.MonitorUpscaleRequest {
+		sim.state.Monitor().UpscaleRequested(now, api.MoreResources{Cpu: true, Memory: true})
+	}
+}
+
+// execute performs the actions and immediately reports their results back to the state machine,
+// returning whether there were any actions (other than waiting)
+func (sim *simulation) execute(now time.Time, actions core.ActionSet) (bool, error) {
+	tookAction := false
+	record := func(action string, current, target api.Resources, outcome string) {
+		tookAction = true
+		sim.result.Decisions = append(sim.result.Decisions, Decision{
+			At:      Duration(now.Sub(sim.start)),
+			Action:  action,
+			Current: current,
+			Target:  target,
+			Outcome: outcome,
+		})
+	}
+
+	if a := actions.PluginRequest; a != nil {
+		sim.state.Plugin().StartingRequest(now, a.Target)
+		if sim.plugin.Fail {
+			sim.state.Plugin().RequestFailed(now)
+			record(ActionPlugin, sim.using, a.Target, "failed")
+		} else {
+			permit := a.Target
+			if sim.plugin.MaxPermitCU != nil {
+				permit = permit.Min(sim.scenario.ComputeUnit.Mul(*sim.plugin.MaxPermitCU)).Max(sim.using)
+			}
+			resp := api.PluginResponse{Permit: permit, Migrate: nil, DeniedReason: ""}
+			if err := sim.state.Plugin().RequestSuccessful(now, resp); err != nil {
+				return false, fmt.Errorf("Error handling plugin response at %s: %w", now.Sub(sim.start), err)
+			}
+			record(ActionPlugin, sim.using, a.Target, fmt.Sprintf("permitted %s", formatResources(permit)))
+		}
+	}
+
+	if a := actions.MonitorDownscale; a != nil {
+		sim.state.Monitor().StartingDownscaleRequest(now, a.Target)
+		if sim.monitor.DenyDownscale {
+			sim.state.Monitor().DownscaleRequestDenied(now)
+			record(ActionMonitorDownscale, a.Current, a.Target, "denied")
+		} else {
+			sim.state.Monitor().DownscaleRequestAllowed(now)
+			record(ActionMonitorDownscale, a.Current, a.Target, "allowed")
+		}
+	}
+
+	if a := actions.NeonVMRequest; a != nil {
+		sim.state.NeonVM().StartingRequest(now, a.Target)
+		sim.state.NeonVM().RequestSuccessful(now)
+		sim.using = a.Target
+		record(ActionNeonVM, a.Current, a.Target, "ok")
+	}
+
+	if a := actions.MonitorUpscale; a != nil {
+		sim.state.Monitor().StartingUpscaleRequest(now, a.Target)
+		sim.state.Monitor().UpscaleRequestSuccessful(now)
+		record(ActionMonitorUpscale, a.Current, a.Target, "ok")
+	}
+
+	return tookAction, nil
+}
+
+func formatResources(r api.Resources) string {
+	return fmt.Sprintf("%v vCPU, %v", r.VCPU, r.Mem)
+}
+
+// String returns a single-line description of the decision
+func (d Decision) String() string {
+	return fmt.Sprintf(
+		"%8s  %-16s  %s -> %s: %s",
+		time.Duration(d.At), d.Action, formatResources(d.Current), formatResources(d.Target), d.Outcome,
+	)
+}
@@ -0,0 +1,132 @@
+package simulate_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/agent/core/simulate"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func resForCU(cu uint16) api.Resources {
+	return api.Resources{VCPU: 250, Mem: 1 << 30}.Mul(cu)
+}
+
+func loadScenario(t *testing.T, path string) *simulate.Scenario {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenario, err := simulate.ParseScenario(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scenario
+}
+
+type neonvmRequest struct {
+	at     time.Duration
+	target api.Resources
+}
+
+// neonvmRequests returns the times and targets of all the NeonVM requests in the result
+func neonvmRequests(result *simulate.Result) []neonvmRequest {
+	var requests []neonvmRequest
+	for _, d := range result.Decisions {
+		if d.Action == simulate.ActionNeonVM {
+			requests = append(requests, neonvmRequest{at: time.Duration(d.At), target: d.Target})
+		}
+	}
+	return requests
+}
+
+func TestUpscaleDownscale(t *testing.T) {
+	scenario := loadScenario(t, "testdata/upscale-downscale.yaml")
+
+	result, err := simulate.Run(scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upscaling happens all at once, but downscaling is one CU at a time
+	assert.Equal(t, []neonvmRequest{
+		{at: time.Minute, target: resForCU(4)},
+		{at: 5 * time.Minute, target: resForCU(3)},
+		{at: 5 * time.Minute, target: resForCU(2)},
+		{at: 5 * time.Minute, target: resForCU(1)},
+	}, neonvmRequests(result))
+	assert.Equal(t, resForCU(1), result.Final)
+}
+
+func TestPluginLimitsUpscale(t *testing.T) {
+	scenario := loadScenario(t, "testdata/upscale-downscale.yaml")
+	maxPermit := uint16(2)
+	scenario.Timeline[0].Plugin = &simulate.PluginBehavior{MaxPermitCU: &maxPermit, Fail: false}
+	scenario.Timeline = scenario.Timeline[:2]
+
+	result, err := simulate.Run(scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []neonvmRequest{
+		{at: time.Minute, target: resForCU(2)},
+	}, neonvmRequests(result))
+	assert.Equal(t, resForCU(2), result.Final)
+}
+
+func TestInvalidScenario(t *testing.T) {
+	_, err := simulate.ParseScenario([]byte(`
+computeUnit:
+  vCPUs: 250m
+  mem: 1Gi
+memorySlotSize: 1Gi
+vm:
+  minCU: 2
+  maxCU: 1
+  initialCU: 1
+scaling:
+  loadAverageFractionTarget: 0.5
+  memoryUsageFractionTarget: 0.5
+duration: 10m
+`))
+	assert.Error(t, err)
+}
+
+// flappingPolicy alternates between the VM's minimum and maximum every minute
+type flappingPolicy struct{}
+
+func (flappingPolicy) GoalCU(input core.ScalingPolicyInput) (uint32, string) {
+	if input.Now.Minute()%2 == 0 {
+		return 0, "even minute"
+	}
+	return 1000, "odd minute"
+}
+
+func TestCheckPolicy(t *testing.T) {
+	computeUnit := resForCU(1)
+	config := api.ScalingConfig{
+		LoadAverageFractionTarget:     0.9,
+		MemoryUsageFractionTarget:     0.75,
+		ActiveBackendsPerCU:           nil,
+		TransactionsPerSecondPerCU:    nil,
+		MinBufferCacheHitRatio:        nil,
+		LFCToMemoryRatio:              nil,
+		MemoryPressureSomeThreshold:   nil,
+		MemoryPressureFullThreshold:   nil,
+		ScaleDownStabilizationSeconds: nil,
+		ScaleUpCooldownSeconds:        nil,
+		MaxScaleStepCU:                nil,
+		DownscaleBatchWindowSeconds:   nil,
+		ScaleToZero:                   nil,
+	}
+
+	assert.NoError(t, simulate.CheckPolicy(core.DefaultScalingPolicyName, computeUnit, config))
+
+	core.RegisterScalingPolicy("test-flapping", flappingPolicy{})
+	assert.Error(t, simulate.CheckPolicy("test-flapping", computeUnit, config))
+}
@@ -23,11 +23,11 @@ package core
 import (
 	"errors"
 	"fmt"
-	"math"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
@@ -39,7 +39,8 @@ type Config struct {
 	// autoscaler-agent config.
 	ComputeUnit api.Resources
 
-	// DefaultScalingConfig is just copied from the global autoscaler-agent config.
+	// DefaultScalingConfig is just copied from the global autoscaler-agent config, and updated by
+	// UpdateDefaultScalingConfig or UpdateConfig if that's reloaded.
 	// If the VM's ScalingConfig is nil, we use this field instead.
 	DefaultScalingConfig api.ScalingConfig
 
@@ -68,6 +69,39 @@ type Config struct {
 	// MonitorRetryWait gives the amount of time to wait to retry after a *failed* request.
 	MonitorRetryWait time.Duration
 
+	// EmergencyUpscaleCU gives the number of compute units to add to the VM when
+	// (*State).EmergencyUpscale() is called. If zero, emergency upscaling is disabled.
+	EmergencyUpscaleCU uint16
+
+	// EmergencyUpscaleMinInterval gives the minimum time between emergency upscales, so that a
+	// persistent trigger can't repeatedly bypass the regular scaling logic.
+	EmergencyUpscaleMinInterval time.Duration
+
+	// EmergencyUpscaleValidPeriod gives the duration for which the resources from an emergency
+	// upscale must be respected, before allowing downscaling.
+	EmergencyUpscaleValidPeriod time.Duration
+
+	// NodePressureDeniedDownscaleCooldown, if non-zero, replaces MonitorDeniedDownscaleCooldown
+	// while the node is under memory pressure, so that idle VMs are asked to downscale more often.
+	NodePressureDeniedDownscaleCooldown time.Duration
+
+	// NodePressureMaxUpscaleCU gives the maximum number of compute units above the VM's current
+	// resources that the ScalingPolicy's goal may raise it to while the node is under memory
+	// pressure. Upscaling requested by the vm-monitor and emergency upscaling are not limited.
+	NodePressureMaxUpscaleCU uint16
+
+	// Prediction, if not nil, enables upscaling pre-emptively based on the trend in the VM's recent
+	// metrics.
+	Prediction *PredictionConfig
+
+	// Burst, if not nil, enables immediately upscaling by the maximum step when the VM's load or
+	// connections spike, with (*State).BurstUpscale().
+	Burst *BurstConfig
+
+	// ScalingPolicy determines the goal compute units from the VM's metrics. If nil,
+	// DefaultScalingPolicy is used.
+	ScalingPolicy ScalingPolicy `json:"-"`
+
 	// Log provides an outlet for (*State).NextActions() to give informative messages or warnings
 	// about conditions that are impeding its ability to execute.
 	Log LogConfig `json:"-"`
@@ -112,7 +146,41 @@ type state struct {
 	// NeonVM records all state relevant to the NeonVM k8s API
 	NeonVM neonvmState
 
+	// Emergency, if not nil, stores the most recent emergency upscale
+	Emergency *emergencyUpscale
+
+	// Burst, if not nil, stores the most recent burst upscale
+	Burst *emergencyUpscale
+
+	// BurstCredits, if not nil, records the time that the VM recently spent above its baseline, if
+	// it has burst credits
+	BurstCredits *burstCreditsState
+
+	// NodeUnderMemoryPressure is true if the node that the VM is on is currently under memory
+	// pressure, as set by (*State).NodeMemoryPressure().
+	NodeUnderMemoryPressure bool
+
+	// DownscaleJustifiedSince, if not nil, gives the time since which the metrics have continuously
+	// called for less than the VM is currently using. Only used for the scaling config's
+	// ScaleDownStabilizationSeconds.
+	DownscaleJustifiedSince *time.Time
+
+	// DownscaleBatch, if not nil, stores the downscaling that's currently allowed, but held to
+	// combine it with any further downscaling. Only used for the scaling config's
+	// DownscaleBatchWindowSeconds.
+	DownscaleBatch *downscaleBatch
+
+	// ScaleToZero records the VM's progress towards being suspended. Only used for the scaling
+	// config's ScaleToZero.
+	ScaleToZero scaleToZeroState
+
 	Metrics *Metrics
+	// MetricsHistory stores the metrics received before Metrics, oldest first, for use by the
+	// ScalingPolicy.
+	MetricsHistory []Metrics
+	// PredictionSamples stores the metrics received within Config.Prediction's window, oldest
+	// first, if prediction is enabled.
+	PredictionSamples []metricsSample
 }
 
 type pluginState struct {
@@ -154,6 +222,10 @@ type monitorState struct {
 	// UpscaleFailureAt, if not nil, stores the time at which an upscale request most recently
 	// failed
 	UpscaleFailureAt *time.Time
+
+	// MemoryPressure, if not nil, means that the vm-monitor has signaled that the VM is at risk of
+	// running out of memory, so its memory must not be reduced.
+	MemoryPressure *monitorMemoryPressure
 }
 
 func (ms *monitorState) active() bool {
@@ -182,6 +254,31 @@ type deniedDownscale struct {
 	At        time.Time
 	Current   api.Resources
 	Requested api.Resources
+	// Reason is the vm-monitor's explanation for deferring the downscale, if it gave one
+	Reason string
+	// RetryAfter, if non-zero, is how long the vm-monitor asked us to wait before retrying, which
+	// is used instead of the configured cooldown.
+	RetryAfter time.Duration
+}
+
+type monitorMemoryPressure struct {
+	Since time.Time
+	// Reason is the vm-monitor's explanation for why the VM is at risk, if it gave one
+	Reason string
+}
+
+type downscaleBatch struct {
+	// Start gives the time that the batch started
+	Start time.Time
+	// From gives the resources that the VM was using when the batch started. Once they change, the
+	// batch has been applied.
+	From api.Resources
+}
+
+type emergencyUpscale struct {
+	At     time.Time
+	Reason string
+	Target api.Resources
 }
 
 type neonvmState struct {
@@ -189,12 +286,36 @@ type neonvmState struct {
 	// OngoingRequested, if not nil, gives the resources requested
 	OngoingRequested *api.Resources
 	RequestFailedAt  *time.Time
+	// LastUpscaleAt, if not nil, gives the time of the most recent successful request that
+	// increased the VM's resources
+	LastUpscaleAt *time.Time
 }
 
 func (ns *neonvmState) ongoingRequest() bool {
 	return ns.OngoingRequested != nil
 }
 
+// scaleToZeroState tracks the VM through suspension: it's idle once IdleSince is set, suspending
+// while OngoingRequest is true, and suspended while VM.Paused is true - until connections to it
+// arrive, setting ResumeRequested, and it's resumed by clearing .spec.paused again.
+type scaleToZeroState struct {
+	// IdleSince, if not nil, gives the time since which the metrics have continuously shown the VM
+	// as idle
+	IdleSince *time.Time
+	// OngoingRequest is true iff there's currently an ongoing request to suspend or resume the VM
+	OngoingRequest bool
+	// ResumeRequested is true if connections to the VM have arrived since it was suspended, as set
+	// by (*State).InboundTraffic(), so it should be resumed.
+	ResumeRequested bool
+	// RequestFailedAt, if not nil, gives the time of the most recent failed request to suspend or
+	// resume the VM
+	RequestFailedAt *time.Time
+	// ConfirmPaused, if not nil, gives the value of .spec.paused that our most recent request set,
+	// which we haven't yet seen in the VirtualMachine object - so any updates to the VM with a
+	// different value are stale.
+	ConfirmPaused *bool
+}
+
 func NewState(vm api.VmInfo, config Config) *State {
 	return &State{
 		internal: state{
@@ -214,13 +335,30 @@ func NewState(vm api.VmInfo, config Config) *State {
 				Approved:           nil,
 				DownscaleFailureAt: nil,
 				UpscaleFailureAt:   nil,
+				MemoryPressure:     nil,
 			},
 			NeonVM: neonvmState{
 				LastSuccess:      nil,
 				OngoingRequested: nil,
 				RequestFailedAt:  nil,
+				LastUpscaleAt:    nil,
+			},
+			Emergency:               nil,
+			Burst:                   nil,
+			BurstCredits:            nil,
+			NodeUnderMemoryPressure: false,
+			DownscaleJustifiedSince: nil,
+			DownscaleBatch:          nil,
+			ScaleToZero: scaleToZeroState{
+				IdleSince:       nil,
+				OngoingRequest:  false,
+				ResumeRequested: false,
+				RequestFailedAt: nil,
+				ConfirmPaused:   nil,
 			},
-			Metrics: nil,
+			Metrics:           nil,
+			MetricsHistory:    nil,
+			PredictionSamples: nil,
 		},
 	}
 }
@@ -244,13 +382,63 @@ func (s *state) warnf(msg string, args ...any) {
 // NextActions is used to implement the state machine. It's a pure function that *just* indicates
 // what the executor should do.
 func (s *State) NextActions(now time.Time) ActionSet {
+	actions, _ := s.internal.nextActions(now)
+	return actions
+}
+
+// Explanation describes the inputs to and outcome of the calculation of the VM's desired resources,
+// as produced alongside an ActionSet by NextActionsExplained.
+type Explanation struct {
+	// Desired gives the resources that the VM should have, before accounting for what the
+	// scheduler plugin has permitted
+	Desired api.Resources
+	// Reason is a human-readable description of how Desired was chosen
+	Reason string
+	// Metrics, if not nil, gives the most recent metrics from the VM
+	Metrics *Metrics
+	// GoalCU gives the number of compute units that the VM should have, before it's bounded by the
+	// VM's minimum and maximum, or held back by anything else
+	GoalCU uint32
+	// Granted gives the resources that the scheduler plugin has approved for the VM
+	Granted api.Resources
+	// Limit, if not empty, gives what's currently stopping the VM from getting to GoalCU
+	Limit LimitingFactor
+}
+
+// LimitingFactor describes what's stopping a VM from being scaled to its goal
+type LimitingFactor string
+
+const (
+	// LimitBounds means that the goal is outside of the VM's minimum or maximum
+	LimitBounds LimitingFactor = "bounds"
+	// LimitScheduler means that the scheduler plugin hasn't approved upscaling to the goal
+	LimitScheduler LimitingFactor = "scheduler"
+	// LimitMonitor means that the vm-monitor denied downscaling to the goal
+	LimitMonitor LimitingFactor = "monitor"
+	// LimitCooldown means that downscaling is held for stabilization, or because the VM was
+	// upscaled too recently
+	LimitCooldown LimitingFactor = "cooldown"
+	// LimitMemoryPressure means that the vm-monitor has vetoed downscaling memory, because the VM
+	// is at risk of running out of it
+	LimitMemoryPressure LimitingFactor = "memory-pressure"
+	// LimitBurstCredits means that the VM has used up its burst credits, so it's held at its
+	// baseline
+	LimitBurstCredits LimitingFactor = "burst-credits"
+	// LimitSuspended means that the VM is suspended (or being suspended), so it won't be scaled
+	// until it's resumed
+	LimitSuspended LimitingFactor = "suspended"
+)
+
+// NextActionsExplained is like NextActions, but additionally returns an Explanation of why the
+// actions were chosen.
+func (s *State) NextActionsExplained(now time.Time) (ActionSet, Explanation) {
 	return s.internal.nextActions(now)
 }
 
-func (s *state) nextActions(now time.Time) ActionSet {
+func (s *state) nextActions(now time.Time) (ActionSet, Explanation) {
 	var actions ActionSet
 
-	desiredResources, calcDesiredResourcesWait := s.desiredResourcesFromMetricsOrRequestedUpscaling(now)
+	desiredResources, explanation, calcDesiredResourcesWait := s.desiredResourcesFromMetricsOrRequestedUpscaling(now)
 	if calcDesiredResourcesWait == nil {
 		// our handling later on is easier if we can assume it's non-nil
 		calcDesiredResourcesWait = func(ActionSet) *time.Duration { return nil }
@@ -272,8 +460,14 @@ func (s *state) nextActions(now time.Time) ActionSet {
 		pluginRequested = &actions.PluginRequest.Target
 		pluginRequestedPhase = "planned"
 	}
+
+	// While the VM is suspended, its vCPUs are stopped, so there's no point in scaling it or asking
+	// the vm-monitor about it until it's resumed.
+	suspended := s.suspended()
 	var neonvmRequiredWait *time.Duration
-	actions.NeonVMRequest, neonvmRequiredWait = s.calculateNeonVMAction(now, desiredResources, pluginRequested, pluginRequestedPhase)
+	if !suspended {
+		actions.NeonVMRequest, neonvmRequiredWait = s.calculateNeonVMAction(now, desiredResources, pluginRequested, pluginRequestedPhase)
+	}
 
 	// ----
 	// Requests to vm-monitor (upscaling)
@@ -282,13 +476,24 @@ func (s *state) nextActions(now time.Time) ActionSet {
 	// forego notifying the vm-monitor of increased resources because we were busy asking if it
 	// could downscale.
 	var monitorUpscaleRequiredWait *time.Duration
-	actions.MonitorUpscale, monitorUpscaleRequiredWait = s.calculateMonitorUpscaleAction(now, desiredResources)
+	if !suspended {
+		actions.MonitorUpscale, monitorUpscaleRequiredWait = s.calculateMonitorUpscaleAction(now, desiredResources)
+	}
 
 	// ----
 	// Requests to vm-monitor (downscaling)
 	plannedUpscale := actions.MonitorUpscale != nil
 	var monitorDownscaleRequiredWait *time.Duration
-	actions.MonitorDownscale, monitorDownscaleRequiredWait = s.calculateMonitorDownscaleAction(now, desiredResources, plannedUpscale)
+	if !suspended {
+		actions.MonitorDownscale, monitorDownscaleRequiredWait = s.calculateMonitorDownscaleAction(now, desiredResources, plannedUpscale)
+	}
+
+	// ----
+	// Requests to NeonVM (suspending and resuming)
+	var suspendRequiredWait *time.Duration
+	actions.Suspend, suspendRequiredWait = s.calculateSuspendAction(now, actions)
+	var resumeRequiredWait *time.Duration
+	actions.Resume, resumeRequiredWait = s.calculateResumeAction(now)
 
 	// --- and that's all the request types! ---
 
@@ -303,6 +508,8 @@ func (s *state) nextActions(now time.Time) ActionSet {
 		neonvmRequiredWait,
 		monitorUpscaleRequiredWait,
 		monitorDownscaleRequiredWait,
+		suspendRequiredWait,
+		resumeRequiredWait,
 	}
 	for _, w := range requiredWaits {
 		if w != nil {
@@ -315,7 +522,18 @@ func (s *state) nextActions(now time.Time) ActionSet {
 		actions.Wait = &ActionWait{Duration: requiredWait}
 	}
 
-	return actions
+	// If we want more than the scheduler plugin has approved, and we aren't about to ask for it (or
+	// already asking), then it was denied.
+	if desiredResources.HasFieldGreaterThan(s.pluginApprovedUpperBound()) && !s.Plugin.OngoingRequest && actions.PluginRequest == nil {
+		explanation.Limit = LimitScheduler
+	}
+	if suspended && desiredResources != s.VM.Using() {
+		explanation.Limit = LimitSuspended
+	}
+	explanation.Granted = s.pluginApprovedUpperBound()
+	explanation.Metrics = shallowCopy[Metrics](s.Metrics)
+
+	return actions, explanation
 }
 
 func (s *state) calculatePluginAction(
@@ -341,6 +559,16 @@ func (s *state) calculatePluginAction(
 		currentResources = currentResources.Max(*s.NeonVM.OngoingRequested)
 	}
 
+	if s.VM.Paused {
+		// While the VM is suspended, it isn't using any CPU, so we only keep its memory.
+		currentResources.VCPU = 0
+		requestResources = currentResources
+	} else if s.Plugin.Permit != nil && s.Plugin.Permit.VCPU == 0 {
+		// The VM was just resumed, so it's already using its CPU again. The plugin reserves that
+		// regardless of what's available, so we ask for just that first, and then anything more.
+		requestResources = currentResources
+	}
+
 	// We want to make a request to the scheduler plugin if:
 	//  1. it's been long enough since the previous request (so we're obligated by PluginRequestTick); or
 	//  2.a. we want to request resources / inform it of downscale;
@@ -362,7 +590,16 @@ func (s *state) calculatePluginAction(
 		timeUntilRetryBackoffExpires = s.Plugin.LastRequest.At.Add(s.Config.PluginDeniedRetryWait).Sub(now)
 	}
 
-	waitingOnRetryBackoff := timeUntilRetryBackoffExpires > 0
+	// An emergency or burst upscale that we haven't yet asked the plugin for isn't held back by
+	// earlier denied requests.
+	unrequestedEmergency := (s.timeUntilEmergencyUpscaleExpired(now) > 0 &&
+		s.Plugin.LastRequest != nil &&
+		s.Plugin.LastRequest.At.Before(s.Emergency.At)) ||
+		(s.timeUntilBurstUpscaleExpired(now) > 0 &&
+			s.Plugin.LastRequest != nil &&
+			s.Plugin.LastRequest.At.Before(s.Burst.At))
+
+	waitingOnRetryBackoff := timeUntilRetryBackoffExpires > 0 && !unrequestedEmergency
 
 	// changing the resources we're requesting from the plugin
 	wantToRequestNewResources := s.Plugin.LastRequest != nil && s.Plugin.Permit != nil &&
@@ -632,20 +869,35 @@ func (s *state) calculateMonitorDownscaleAction(
 	}, nil
 }
 
+func (s *state) scalingPolicy() ScalingPolicy {
+	if s.Config.ScalingPolicy != nil {
+		return s.Config.ScalingPolicy
+	} else {
+		return DefaultScalingPolicy{}
+	}
+}
+
 func (s *state) scalingConfig() api.ScalingConfig {
+	config := s.Config.DefaultScalingConfig
 	if s.VM.Config.ScalingConfig != nil {
-		return *s.VM.Config.ScalingConfig
-	} else {
-		return s.Config.DefaultScalingConfig
+		config = *s.VM.Config.ScalingConfig
 	}
+	if s.VM.Config.Overrides != nil {
+		config = s.VM.Config.Overrides.Apply(config)
+	}
+	return config
 }
 
 // public version, for testing.
 func (s *State) DesiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (api.Resources, func(ActionSet) *time.Duration) {
-	return s.internal.desiredResourcesFromMetricsOrRequestedUpscaling(now)
+	result, _, wait := s.internal.desiredResourcesFromMetricsOrRequestedUpscaling(now)
+	return result, wait
 }
 
-func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (api.Resources, func(ActionSet) *time.Duration) {
+// desiredResourcesFromMetricsOrRequestedUpscaling returns the resources that the VM should have,
+// along with an Explanation of them. The Explanation doesn't include the metrics, or whether the
+// scheduler plugin is limiting the VM; those are added by the caller.
+func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (api.Resources, Explanation, func(ActionSet) *time.Duration) {
 	// There's some annoying edge cases that this function has to be able to handle properly. For
 	// the sake of completeness, they are:
 	//
@@ -659,38 +911,98 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 	// ---
 	//
 	// Broadly, the implementation works like this:
-	// For CPU:
-	// Based on load average, calculate the "goal" number of CPUs (and therefore compute units)
-	//
-	// For Memory:
-	// Based on memory usage, calculate the VM's desired memory allocation and extrapolate a
-	// goal number of CUs from that.
-	//
-	// 1. Take the maximum of these two goal CUs to create a unified goal CU
+	// 1. Get a goal number of CUs from the ScalingPolicy (by default: the maximum of the goals from
+	//    load average and memory usage; see DefaultScalingPolicy)
 	// 2. Cap the goal CU by min/max, etc
 	// 3. that's it!
 
+	// A manual target pins the VM, so none of the metric-driven adjustments below apply - only
+	// the VM's bounds and any downscaling denied by the vm-monitor, so that we don't take memory
+	// that's in use.
+	pinned := s.VM.Config.ManualTargetCU != nil
+
 	var goalCU uint32
-	if s.Metrics != nil {
-		// For CPU:
-		// Goal compute unit is at the point where (CPUs) × (LoadAverageFractionTarget) == (load
-		// average),
-		// which we can get by dividing LA by LAFT, and then dividing by the number of CPUs per CU
-		goalCPUs := float64(s.Metrics.LoadAverage1Min) / s.scalingConfig().LoadAverageFractionTarget
-		cpuGoalCU := uint32(math.Round(goalCPUs / s.Config.ComputeUnit.VCPU.AsFloat64()))
-
-		// For Mem:
-		// Goal compute unit is at the point where (Mem) * (MemoryUsageFractionTarget) == (Mem Usage)
-		// We can get the desired memory allocation in bytes by dividing MU by MUFT, and then convert
-		// that to CUs
-		//
-		// NOTE: use uint64 for calculations on bytes as uint32 can overflow
-		memGoalBytes := api.Bytes(math.Round(float64(s.Metrics.MemoryUsageBytes) / s.scalingConfig().MemoryUsageFractionTarget))
-		memGoalCU := uint32(memGoalBytes / s.Config.ComputeUnit.Mem)
-
-		goalCU = util.Max(cpuGoalCU, memGoalCU)
+	reason := "no metrics"
+	if pinned {
+		goalCU = uint32(*s.VM.Config.ManualTargetCU)
+		reason = fmt.Sprintf("pinned at %d CU by manual target", goalCU)
+	} else if s.Metrics != nil {
+		goalCU, reason = s.scalingPolicy().GoalCU(ScalingPolicyInput{
+			Metrics:     *s.Metrics,
+			History:     s.MetricsHistory,
+			VM:          s.VM,
+			Config:      s.scalingConfig(),
+			ComputeUnit: s.Config.ComputeUnit,
+			Now:         now,
+		})
+
+		// If the metrics are trending upwards, scale for where they're going to be, rather than
+		// where they are now.
+		if predicted, ok := s.predictedMetrics(); ok {
+			predictedCU, predictedReason := s.scalingPolicy().GoalCU(ScalingPolicyInput{
+				Metrics:     predicted,
+				History:     s.MetricsHistory,
+				VM:          s.VM,
+				Config:      s.scalingConfig(),
+				ComputeUnit: s.Config.ComputeUnit,
+				Now:         now,
+			})
+			if predictedCU > goalCU {
+				goalCU = predictedCU
+				reason = fmt.Sprintf("predicted %s in %s", predictedReason, s.Config.Prediction.Horizon)
+			}
+		}
+	}
+
+	// While the node is under memory pressure, limit how far the metrics alone can push the VM up,
+	// so that scaling on the node doesn't make the pressure worse.
+	if s.NodeUnderMemoryPressure && !pinned {
+		maxCU := s.requiredCUForResources(s.Config.ComputeUnit, s.VM.Using()) + uint32(s.Config.NodePressureMaxUpscaleCU)
+		if goalCU > maxCU {
+			goalCU = maxCU
+			reason = fmt.Sprintf("%s (limited by node memory pressure)", reason)
+		}
 	}
 
+	// Limit how far the metrics can move the VM at once, so that a single noisy sample doesn't
+	// cause a large change. Without metrics, the goal already keeps the VM as-is.
+	if maxStep := s.scalingConfig().MaxScaleStepCU; maxStep != nil && s.Metrics != nil && !pinned {
+		currentCU := s.requiredCUForResources(s.Config.ComputeUnit, s.VM.Using())
+		if goalCU > currentCU+*maxStep {
+			goalCU = currentCU + *maxStep
+			reason = fmt.Sprintf("%s (limited by max scale step)", reason)
+		} else if currentCU > *maxStep && goalCU < currentCU-*maxStep {
+			goalCU = currentCU - *maxStep
+			reason = fmt.Sprintf("%s (limited by max scale step)", reason)
+		}
+	}
+
+	// Layer the VM's schedule on top of the goal from the metrics. Like the limit from node memory
+	// pressure, a scheduled maximum doesn't restrict upscaling requested by the vm-monitor.
+	if schedule := s.VM.Config.Schedule; schedule != nil && !pinned {
+		if w := schedule.ActiveWindow(now); w != nil {
+			if w.MinCU != nil && goalCU < uint32(*w.MinCU) {
+				goalCU = uint32(*w.MinCU)
+				reason = "scheduled minimum"
+			}
+			if w.MaxCU != nil && goalCU > uint32(*w.MaxCU) {
+				goalCU = uint32(*w.MaxCU)
+				reason = fmt.Sprintf("%s (limited by scheduled maximum)", reason)
+			}
+		}
+	}
+
+	// Once the VM has used up its burst credits, the metrics can't keep it above its baseline.
+	s.updateBurstCredits(now)
+	burstCreditsExhausted := s.burstCreditsExhausted() && !pinned
+	var burstCreditsAffectedResult bool
+	if baseline := s.VM.Config.BurstCredits; burstCreditsExhausted && goalCU > uint32(baseline.BaselineCU) {
+		goalCU = uint32(baseline.BaselineCU)
+		reason = fmt.Sprintf("%s (limited by burst credits)", reason)
+		burstCreditsAffectedResult = true
+	}
+	timeUntilBurstCreditsChange := s.timeUntilBurstCreditsChange(now)
+
 	// Copy the initial value of the goal CU so that we can accurately track whether either
 	// requested upscaling or denied downscaling affected the outcome.
 	// Otherwise as written, it'd be possible to update goalCU from requested upscaling and
@@ -701,7 +1013,7 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 
 	// Update goalCU based on any explicitly requested upscaling
 	timeUntilRequestedUpscalingExpired := s.timeUntilRequestedUpscalingExpired(now)
-	requestedUpscalingInEffect := timeUntilRequestedUpscalingExpired > 0
+	requestedUpscalingInEffect := timeUntilRequestedUpscalingExpired > 0 && !pinned
 	if requestedUpscalingInEffect {
 		reqCU := s.requiredCUForRequestedUpscaling(s.Config.ComputeUnit, *s.Monitor.RequestedUpscale)
 		if reqCU > initialGoalCU {
@@ -709,6 +1021,7 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 			// maximum goal CU we *could* have, this won't actually have an effect.
 			requestedUpscalingAffectedResult = true
 			goalCU = util.Max(goalCU, reqCU)
+			reason = fmt.Sprintf("%s (raised by vm-monitor upscale request)", reason)
 		}
 	}
 
@@ -722,6 +1035,7 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 		if reqCU > initialGoalCU {
 			deniedDownscaleAffectedResult = true
 			goalCU = util.Max(goalCU, reqCU)
+			reason = fmt.Sprintf("%s (raised by vm-monitor denied downscale)", reason)
 		}
 	}
 
@@ -739,6 +1053,13 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 	// bound goalResources by the minimum and maximum resource amounts for the VM
 	result := goalResources.Min(s.VM.Max()).Max(s.VM.Min())
 
+	var limit LimitingFactor
+	if result != goalResources {
+		limit = LimitBounds
+	} else if burstCreditsAffectedResult {
+		limit = LimitBurstCredits
+	}
+
 	// ... but if we aren't allowed to downscale, then we *must* make sure that the VM's usage value
 	// won't decrease to the previously denied amount, even if it's greater than the maximum.
 	//
@@ -757,9 +1078,104 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 		preMaxResult := result
 		result = result.Max(s.minRequiredResourcesForDeniedDownscale(s.Config.ComputeUnit, *s.Monitor.DeniedDownscale))
 		if result != preMaxResult {
+			if !deniedDownscaleAffectedResult {
+				reason = fmt.Sprintf("%s (raised by vm-monitor denied downscale)", reason)
+			}
 			deniedDownscaleAffectedResult = true
 		}
 	}
+	if deniedDownscaleAffectedResult {
+		limit = LimitMonitor
+	}
+
+	// While the vm-monitor says that the VM is at risk of running out of memory, it has a hard veto
+	// on reducing memory. Unlike a denied downscale, this doesn't expire on its own, and CPU can
+	// still be reduced. Like the other holds below, it only keeps memory within the VM's maximum.
+	if mp := s.Monitor.MemoryPressure; mp != nil {
+		if floor := util.Min(s.VM.Using().Mem, s.VM.Max().Mem); result.Mem < floor {
+			result.Mem = floor
+			vetoReason := "vm-monitor memory pressure"
+			if mp.Reason != "" {
+				vetoReason = fmt.Sprintf("%s: %s", vetoReason, mp.Reason)
+			}
+			reason = fmt.Sprintf("%s (memory downscale vetoed by %s)", reason, vetoReason)
+			limit = LimitMemoryPressure
+		}
+	}
+
+	// If the buffer cache hit ratio is too low, then downscaling would likely make it worse, so
+	// we hold off on it. Upscaling is still up to the metrics.
+	if minRatio := s.scalingConfig().MinBufferCacheHitRatio; minRatio != nil && s.Metrics != nil && s.Metrics.Postgres != nil && !pinned {
+		if ratio := s.Metrics.Postgres.BufferCacheHitRatio; ratio != nil && float64(*ratio) < *minRatio {
+			preMaxResult := result
+			result = result.Max(s.VM.Using().Min(s.VM.Max()))
+			if result != preMaxResult {
+				reason = fmt.Sprintf("%s (downscale held by low buffer cache hit ratio)", reason)
+			}
+		}
+	}
+
+	// Hold off on downscaling until it's been called for long enough, and it's been long enough
+	// since the last upscaling, so that small fluctuations in the metrics don't make the VM flap
+	// between sizes. As above, we only hold on to resources within the VM's maximum, so that
+	// required downscaling from a bounds change isn't delayed. Nor is downscaling once the VM's
+	// burst credits are used up.
+	var stabilizationAffectedResult bool
+	timeUntilDownscaleStabilized := s.timeUntilDownscaleStabilized(now, result)
+	if timeUntilDownscaleStabilized > 0 && !pinned && !burstCreditsExhausted {
+		preMaxResult := result
+		result = result.Max(s.VM.Using().Min(s.VM.Max()))
+		stabilizationAffectedResult = result != preMaxResult
+		if stabilizationAffectedResult {
+			reason = fmt.Sprintf("%s (downscale held for stabilization)", reason)
+			limit = LimitCooldown
+		}
+	}
+
+	// Once downscaling is allowed, hold it a little longer if configured, so that successive small
+	// steps down are combined into one. The window restarts only after the VM has been downscaled
+	// (or downscaling is no longer called for), so there's at most one downscale per window.
+	var batchingAffectedResult bool
+	var timeUntilDownscaleBatched time.Duration
+	if !stabilizationAffectedResult && !pinned && !burstCreditsExhausted {
+		timeUntilDownscaleBatched = s.timeUntilDownscaleBatched(now, result)
+		if timeUntilDownscaleBatched > 0 {
+			preMaxResult := result
+			result = result.Max(s.VM.Using().Min(s.VM.Max()))
+			batchingAffectedResult = result != preMaxResult
+			if batchingAffectedResult {
+				reason = fmt.Sprintf("%s (downscale held for batching)", reason)
+				limit = LimitCooldown
+			}
+		}
+	}
+
+	// Emergency upscaling overrides everything else, but it's still bounded by the maximum, in
+	// case that's changed since.
+	var emergencyAffectedResult bool
+	timeUntilEmergencyUpscaleExpired := s.timeUntilEmergencyUpscaleExpired(now)
+	if timeUntilEmergencyUpscaleExpired > 0 && !pinned {
+		preMaxResult := result
+		result = result.Max(s.Emergency.Target.Min(s.VM.Max()))
+		emergencyAffectedResult = result != preMaxResult
+		if emergencyAffectedResult {
+			reason = fmt.Sprintf("emergency upscale: %s", s.Emergency.Reason)
+			limit = ""
+		}
+	}
+
+	// Likewise for burst upscaling, which also bypasses stabilization.
+	var burstAffectedResult bool
+	timeUntilBurstUpscaleExpired := s.timeUntilBurstUpscaleExpired(now)
+	if timeUntilBurstUpscaleExpired > 0 && !pinned {
+		preMaxResult := result
+		result = result.Max(s.Burst.Target.Min(s.VM.Max()))
+		burstAffectedResult = result != preMaxResult
+		if burstAffectedResult {
+			reason = fmt.Sprintf("burst upscale: %s", s.Burst.Reason)
+			limit = ""
+		}
+	}
 
 	// Check that the result is sound.
 	//
@@ -787,6 +1203,28 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 			waitTime = util.Min(waitTime, timeUntilRequestedUpscalingExpired)
 			waiting = true
 		}
+		if emergencyAffectedResult {
+			waitTime = util.Min(waitTime, timeUntilEmergencyUpscaleExpired)
+			waiting = true
+		}
+		if burstAffectedResult {
+			waitTime = util.Min(waitTime, timeUntilBurstUpscaleExpired)
+			waiting = true
+		}
+		if stabilizationAffectedResult {
+			waitTime = util.Min(waitTime, timeUntilDownscaleStabilized)
+			waiting = true
+		}
+		if batchingAffectedResult {
+			waitTime = util.Min(waitTime, timeUntilDownscaleBatched)
+			waiting = true
+		}
+		// Either the VM is above its baseline and will run out of burst credits, or it's been held
+		// at its baseline and will get some back.
+		if timeUntilBurstCreditsChange > 0 && (burstCreditsAffectedResult || !burstCreditsExhausted) {
+			waitTime = util.Min(waitTime, timeUntilBurstCreditsChange)
+			waiting = true
+		}
 
 		if waiting {
 			return &waitTime
@@ -795,9 +1233,21 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 		}
 	}
 
-	s.info("Calculated desired resources", zap.Object("current", s.VM.Using()), zap.Object("target", result))
+	s.info("Calculated desired resources", zap.Object("current", s.VM.Using()), zap.Object("target", result), zap.String("reason", reason))
+
+	if s.Metrics == nil && goalCU == 0 {
+		goalCU = s.requiredCUForResources(s.Config.ComputeUnit, s.VM.Using())
+	}
+	explanation := Explanation{
+		Desired: result,
+		Reason:  reason,
+		Metrics: nil, // set by the caller
+		GoalCU:  goalCU,
+		Granted: api.Resources{VCPU: 0, Mem: 0}, // set by the caller
+		Limit:   limit,
+	}
 
-	return result, calculateWaitTime
+	return result, explanation, calculateWaitTime
 }
 
 func (s *state) timeUntilRequestedUpscalingExpired(now time.Time) time.Duration {
@@ -808,6 +1258,133 @@ func (s *state) timeUntilRequestedUpscalingExpired(now time.Time) time.Duration
 	}
 }
 
+func (s *state) timeUntilEmergencyUpscaleExpired(now time.Time) time.Duration {
+	if s.Emergency != nil {
+		return s.Emergency.At.Add(s.Config.EmergencyUpscaleValidPeriod).Sub(now)
+	} else {
+		return 0
+	}
+}
+
+// timeUntilDownscaleStabilized updates whether downscaling is currently justified, given the
+// desired resources, and returns the remaining time before that downscaling is allowed under the
+// scaling config's stabilization settings.
+func (s *state) timeUntilDownscaleStabilized(now time.Time, desired api.Resources) time.Duration {
+	if !desired.HasFieldLessThan(s.VM.Using().Min(s.VM.Max())) {
+		s.DownscaleJustifiedSince = nil
+		return 0
+	} else if s.DownscaleJustifiedSince == nil {
+		s.DownscaleJustifiedSince = &now
+	}
+
+	conf := s.scalingConfig()
+	var remaining time.Duration
+	if secs := conf.ScaleDownStabilizationSeconds; secs != nil {
+		stableAt := s.DownscaleJustifiedSince.Add(time.Second * time.Duration(*secs))
+		remaining = util.Max(remaining, stableAt.Sub(now))
+	}
+	if secs := conf.ScaleUpCooldownSeconds; secs != nil && s.NeonVM.LastUpscaleAt != nil {
+		cooledDownAt := s.NeonVM.LastUpscaleAt.Add(time.Second * time.Duration(*secs))
+		remaining = util.Max(remaining, cooledDownAt.Sub(now))
+	}
+	return remaining
+}
+
+// timeUntilDownscaleBatched updates whether downscaling is currently being batched, given the
+// desired resources, and returns the remaining time before the batch of downscaling is applied.
+func (s *state) timeUntilDownscaleBatched(now time.Time, desired api.Resources) time.Duration {
+	secs := s.scalingConfig().DownscaleBatchWindowSeconds
+	if secs == nil || !desired.HasFieldLessThan(s.VM.Using().Min(s.VM.Max())) {
+		s.DownscaleBatch = nil
+		return 0
+	} else if s.DownscaleBatch == nil || s.DownscaleBatch.From != s.VM.Using() {
+		// Either this is the first downscaling, or the previous batch was applied and there's more
+		// downscaling to do. Either way, start a new batch.
+		s.DownscaleBatch = &downscaleBatch{Start: now, From: s.VM.Using()}
+	}
+
+	return s.DownscaleBatch.Start.Add(time.Second * time.Duration(*secs)).Sub(now)
+}
+
+// suspended returns whether the VM is suspended, or about to be
+func (s *state) suspended() bool {
+	return s.VM.Paused || s.ScaleToZero.OngoingRequest
+}
+
+// updateIdle updates whether the VM has been continuously idle, given its latest metrics, for the
+// scaling config's ScaleToZero.
+func (s *state) updateIdle(now time.Time, metrics Metrics) {
+	conf := s.scalingConfig().ScaleToZero
+	idle := conf != nil && float64(metrics.LoadAverage1Min) <= conf.MaxLoadAverage &&
+		(metrics.Postgres == nil || (metrics.Postgres.ActiveBackends == 0 && metrics.Postgres.TransactionsPerSecond == 0))
+
+	if !idle {
+		s.ScaleToZero.IdleSince = nil
+	} else if s.ScaleToZero.IdleSince == nil {
+		s.ScaleToZero.IdleSince = &now
+	}
+}
+
+func (s *state) calculateSuspendAction(
+	now time.Time,
+	actions ActionSet,
+) (*ActionSuspend, *time.Duration) {
+	conf := s.scalingConfig().ScaleToZero
+	// A manual target pins the VM at that size, so it isn't suspended either.
+	if conf == nil || s.ScaleToZero.IdleSince == nil || s.suspended() || s.VM.Config.ManualTargetCU != nil {
+		return nil, nil
+	}
+
+	idleFor := time.Second * time.Duration(conf.IdleSeconds)
+	if remaining := s.ScaleToZero.IdleSince.Add(idleFor).Sub(now); remaining > 0 {
+		return nil, &remaining
+	}
+
+	// Let any other requests finish first, so that the VM is suspended at the size it's meant to
+	// be, and the scheduler plugin knows about it. We'll be woken up once they're done.
+	otherRequests := s.Plugin.OngoingRequest || s.NeonVM.ongoingRequest() || s.Monitor.OngoingRequest != nil ||
+		actions.PluginRequest != nil || actions.NeonVMRequest != nil ||
+		actions.MonitorUpscale != nil || actions.MonitorDownscale != nil
+	if otherRequests {
+		return nil, nil
+	}
+
+	if s.ScaleToZero.RequestFailedAt != nil {
+		timeUntilFailureBackoffExpires := s.ScaleToZero.RequestFailedAt.Add(s.Config.NeonVMRetryWait).Sub(now)
+		if timeUntilFailureBackoffExpires > 0 {
+			s.warn("Wanted to suspend the VM, but recent request failed too recently")
+			return nil, &timeUntilFailureBackoffExpires
+		}
+	}
+
+	return &ActionSuspend{
+		Resources: s.VM.Using(),
+		IdleSince: *s.ScaleToZero.IdleSince,
+	}, nil
+}
+
+func (s *state) calculateResumeAction(now time.Time) (*ActionResume, *time.Duration) {
+	if !s.VM.Paused || !s.ScaleToZero.ResumeRequested || s.ScaleToZero.OngoingRequest {
+		return nil, nil
+	}
+
+	// Unlike suspending, there's no need to wait for other requests: while the VM is suspended,
+	// nothing else is sent to NeonVM or the vm-monitor, and the scheduler plugin can only be told
+	// about the VM's CPU once it's resumed.
+
+	if s.ScaleToZero.RequestFailedAt != nil {
+		timeUntilFailureBackoffExpires := s.ScaleToZero.RequestFailedAt.Add(s.Config.NeonVMRetryWait).Sub(now)
+		if timeUntilFailureBackoffExpires > 0 {
+			s.warn("Wanted to resume the VM, but recent request failed too recently")
+			return nil, &timeUntilFailureBackoffExpires
+		}
+	}
+
+	return &ActionResume{
+		Resources: s.VM.Using(),
+	}, nil
+}
+
 // NB: we could just use s.plugin.computeUnit or s.monitor.requestedUpscale from inside the
 // function, but those are sometimes nil. This way, it's clear that it's the caller's responsibility
 // to ensure that the values are non-nil.
@@ -830,12 +1407,29 @@ func (s *state) requiredCUForRequestedUpscaling(computeUnit api.Resources, reque
 
 func (s *state) timeUntilDeniedDownscaleExpired(now time.Time) time.Duration {
 	if s.Monitor.DeniedDownscale != nil {
-		return s.Monitor.DeniedDownscale.At.Add(s.Config.MonitorDeniedDownscaleCooldown).Sub(now)
+		cooldown := s.Config.MonitorDeniedDownscaleCooldown
+		if s.Monitor.DeniedDownscale.RetryAfter != 0 {
+			// The vm-monitor knows better than we do when it'll be able to downscale.
+			cooldown = s.Monitor.DeniedDownscale.RetryAfter
+		} else if s.NodeUnderMemoryPressure && s.Config.NodePressureDeniedDownscaleCooldown != 0 {
+			cooldown = s.Config.NodePressureDeniedDownscaleCooldown
+		}
+		return s.Monitor.DeniedDownscale.At.Add(cooldown).Sub(now)
 	} else {
 		return 0
 	}
 }
 
+// requiredCUForResources returns the minimum number of compute units that is at least the
+// resources
+func (s *state) requiredCUForResources(computeUnit, resources api.Resources) uint32 {
+	// note: ceil(x / M) == floor((x + M - 1) / M)
+	fromCPU := uint32((resources.VCPU + computeUnit.VCPU - 1) / computeUnit.VCPU)
+	fromMem := uint32((resources.Mem + computeUnit.Mem - 1) / computeUnit.Mem)
+
+	return util.Max(fromCPU, fromMem)
+}
+
 // NB: like requiredCUForRequestedUpscaling, we make the caller provide the values so that it's
 // more clear that it's the caller's responsibility to ensure the values are non-nil.
 func (s *state) requiredCUForDeniedDownscale(computeUnit, deniedResources api.Resources) uint32 {
@@ -908,7 +1502,9 @@ func (s *state) monitorApprovedLowerBound() api.Resources {
 
 func (s *state) pluginApprovedUpperBound() api.Resources {
 	if s.Plugin.Permit != nil {
-		return *s.Plugin.Permit
+		// The permit only has less than the VM is using if it's from while the VM was suspended,
+		// and the VM has since been resumed.
+		return s.Plugin.Permit.Max(s.VM.Using())
 	} else {
 		return s.VM.Using()
 	}
@@ -934,11 +1530,94 @@ func (s *State) UpdatedVM(vm api.VmInfo) {
 	// - https://github.com/neondatabase/autoscaling/pull/371#issuecomment-1752110131
 	// - https://github.com/neondatabase/autoscaling/issues/462
 	vm.SetUsing(s.internal.VM.Using())
+
+	stz := &s.internal.ScaleToZero
+	if stz.ConfirmPaused != nil {
+		if vm.Paused == *stz.ConfirmPaused {
+			stz.ConfirmPaused = nil
+		} else {
+			// Like above: this is from before our request to suspend or resume the VM.
+			vm.Paused = *stz.ConfirmPaused
+		}
+	}
+	if s.internal.VM.Paused && !vm.Paused {
+		// The VM was resumed by something else. Its metrics from before it was suspended are
+		// stale, so wait for new ones before counting it as idle again.
+		stz.IdleSince = nil
+		stz.ResumeRequested = false
+	}
+
 	s.internal.VM = vm
 }
 
-func (s *State) UpdateMetrics(metrics Metrics) {
+func (s *State) UpdateMetrics(now time.Time, metrics Metrics) {
+	if prev := s.internal.Metrics; prev != nil {
+		s.internal.MetricsHistory = append(s.internal.MetricsHistory, *prev)
+		if len(s.internal.MetricsHistory) > MetricsHistorySize {
+			s.internal.MetricsHistory = slices.Delete(s.internal.MetricsHistory, 0, 1)
+		}
+	}
 	s.internal.Metrics = &metrics
+	s.internal.addPredictionSample(now, metrics)
+	s.internal.updateIdle(now, metrics)
+}
+
+// EmergencyUpscale immediately raises the desired resources by Config.EmergencyUpscaleCU compute
+// units above what the VM is currently using, without waiting for the metrics to catch up.
+//
+// Emergency upscales are rate limited by Config.EmergencyUpscaleMinInterval. Returns whether the
+// upscale was accepted.
+func (s *State) EmergencyUpscale(now time.Time, reason string) bool {
+	if s.internal.Config.EmergencyUpscaleCU == 0 {
+		return false
+	}
+
+	if e := s.internal.Emergency; e != nil && now.Sub(e.At) < s.internal.Config.EmergencyUpscaleMinInterval {
+		s.internal.warnf("Ignoring emergency upscale (%s), because the previous one was too recent", reason)
+		return false
+	}
+
+	using := s.internal.VM.Using()
+	target := using.Add(s.internal.Config.ComputeUnit.Mul(s.internal.Config.EmergencyUpscaleCU)).Min(s.internal.VM.Max())
+	if !target.HasFieldGreaterThan(using) {
+		s.internal.warnf("Ignoring emergency upscale (%s), because the VM is already at its maximum", reason)
+		return false
+	}
+
+	s.internal.Emergency = &emergencyUpscale{
+		At:     now,
+		Reason: reason,
+		Target: target.Max(using),
+	}
+	s.internal.info("Emergency upscale triggered", zap.String("reason", reason), zap.Object("target", target))
+	return true
+}
+
+// UpdateDefaultScalingConfig replaces the scaling config used for VMs that don't have their own,
+// after the global autoscaler-agent config was reloaded.
+func (s *State) UpdateDefaultScalingConfig(config api.ScalingConfig) {
+	s.internal.Config.DefaultScalingConfig = config
+}
+
+// UpdateConfig replaces the Config, after the global autoscaler-agent config was reloaded. The
+// existing Log is kept.
+func (s *State) UpdateConfig(config Config) {
+	config.Log = s.internal.Config.Log
+	s.internal.Config = config
+}
+
+// NodeMemoryPressure sets whether the node the VM is on is under memory pressure, which limits
+// upscaling and makes downscaling more aggressive.
+func (s *State) NodeMemoryPressure(underPressure bool) {
+	s.internal.NodeUnderMemoryPressure = underPressure
+}
+
+// InboundTraffic records that connections to the VM have arrived while it's suspended (or being
+// suspended), so that it's resumed. It has no effect otherwise.
+func (s *State) InboundTraffic() {
+	if s.internal.suspended() {
+		s.internal.ScaleToZero.ResumeRequested = true
+	}
 }
 
 // PluginHandle provides write access to the scheduler plugin pieces of an UpdateState
@@ -971,7 +1650,11 @@ func (h PluginHandle) RequestSuccessful(now time.Time, resp api.PluginResponse)
 		}
 	}()
 
-	if err := resp.Permit.ValidateNonZero(); err != nil {
+	// The request was made while the VM was suspended, so it didn't ask for any CPU. The VM may
+	// have been resumed since, in which case we'll ask for the CPU again.
+	suspendedRequest := h.s.Plugin.LastRequest.Resources.VCPU == 0
+
+	if err := resp.Permit.ValidateNonZero(); err != nil && !(suspendedRequest && resp.Permit.Mem != 0) {
 		return fmt.Errorf("Invalid permit: %w", err)
 	}
 
@@ -984,7 +1667,11 @@ func (h PluginHandle) RequestSuccessful(now time.Time, resp api.PluginResponse)
 	}
 
 	// Errors from resp in connection with the prior request AND the VM state
-	if vmUsing := h.s.VM.Using(); resp.Permit.HasFieldLessThan(vmUsing) {
+	vmUsing := h.s.VM.Using()
+	if suspendedRequest {
+		vmUsing.VCPU = 0
+	}
+	if resp.Permit.HasFieldLessThan(vmUsing) {
 		return fmt.Errorf("Permit has resources less than VM (%+v vs %+v)", resp.Permit, vmUsing)
 	}
 
@@ -1014,6 +1701,7 @@ func (h MonitorHandle) Reset() {
 		Approved:           nil,
 		DownscaleFailureAt: nil,
 		UpscaleFailureAt:   nil,
+		MemoryPressure:     nil,
 	}
 }
 
@@ -1068,9 +1756,26 @@ func (h MonitorHandle) DownscaleRequestAllowed(now time.Time) {
 // Downscale request was successful but the monitor denied our request.
 func (h MonitorHandle) DownscaleRequestDenied(now time.Time) {
 	h.s.Monitor.DeniedDownscale = &deniedDownscale{
-		At:        now,
-		Current:   *h.s.Monitor.Approved,
-		Requested: h.s.Monitor.OngoingRequest.Requested,
+		At:         now,
+		Current:    *h.s.Monitor.Approved,
+		Requested:  h.s.Monitor.OngoingRequest.Requested,
+		Reason:     "",
+		RetryAfter: 0,
+	}
+	h.s.Monitor.OngoingRequest = nil
+}
+
+// Downscale request was successful but the monitor vetoed it for now (e.g. because it would impact
+// active queries), asking us to wait for retryAfter before trying again.
+//
+// If retryAfter is zero, this is equivalent to DownscaleRequestDenied.
+func (h MonitorHandle) DownscaleRequestDeferred(now time.Time, reason string, retryAfter time.Duration) {
+	h.s.Monitor.DeniedDownscale = &deniedDownscale{
+		At:         now,
+		Current:    *h.s.Monitor.Approved,
+		Requested:  h.s.Monitor.OngoingRequest.Requested,
+		Reason:     reason,
+		RetryAfter: retryAfter,
 	}
 	h.s.Monitor.OngoingRequest = nil
 }
@@ -1080,6 +1785,25 @@ func (h MonitorHandle) DownscaleRequestFailed(now time.Time) {
 	h.s.Monitor.DownscaleFailureAt = &now
 }
 
+// MemoryPressure records the vm-monitor's signal of whether the VM is at risk of running out of
+// memory. While it is, the VM's memory won't be reduced, regardless of the metrics or its bounds.
+//
+// Returns whether this started a veto on downscaling memory, i.e. the VM wasn't already at risk.
+func (h MonitorHandle) MemoryPressure(now time.Time, atRisk bool, reason string) (started bool) {
+	if !atRisk {
+		h.s.Monitor.MemoryPressure = nil
+		return false
+	}
+
+	started = h.s.Monitor.MemoryPressure == nil
+	since := now
+	if !started {
+		since = h.s.Monitor.MemoryPressure.Since
+	}
+	h.s.Monitor.MemoryPressure = &monitorMemoryPressure{Since: since, Reason: reason}
+	return started
+}
+
 type NeonVMHandle struct {
 	s *state
 }
@@ -1104,7 +1828,12 @@ func (h NeonVMHandle) RequestSuccessful(now time.Time) {
 	// just because the request completed. It takes longer for the reconcile cycle(s) to make the
 	// necessary changes.
 	// See the comments in (*State).UpdatedVM() for more info.
+	if resources.HasFieldGreaterThan(h.s.VM.Using()) {
+		h.s.NeonVM.LastUpscaleAt = &now
+	}
 	h.s.VM.SetUsing(resources)
+	// Start counting the time above the VM's baseline from the change, not the next NextActions.
+	h.s.updateBurstCredits(now)
 
 	h.s.NeonVM.OngoingRequested = nil
 }
@@ -1113,3 +1842,51 @@ func (h NeonVMHandle) RequestFailed(now time.Time) {
 	h.s.NeonVM.OngoingRequested = nil
 	h.s.NeonVM.RequestFailedAt = &now
 }
+
+func (h NeonVMHandle) StartingSuspend(now time.Time) {
+	h.s.ScaleToZero.OngoingRequest = true
+}
+
+func (h NeonVMHandle) SuspendSuccessful(now time.Time) {
+	if !h.s.ScaleToZero.OngoingRequest {
+		panic("received NeonVM().SuspendSuccessful() update without ongoing request")
+	}
+
+	// Like with RequestSuccessful, we trust that the VM has been updated. The VM won't be seen as
+	// resumed until we've seen that it was suspended, so stale updates can't undo this.
+	paused := true
+	h.s.VM.Paused = paused
+	h.s.ScaleToZero.ConfirmPaused = &paused
+	h.s.ScaleToZero.OngoingRequest = false
+}
+
+func (h NeonVMHandle) SuspendFailed(now time.Time) {
+	h.s.ScaleToZero.OngoingRequest = false
+	h.s.ScaleToZero.RequestFailedAt = &now
+	// The VM is still running, so any connections that arrived in the meantime were served.
+	h.s.ScaleToZero.ResumeRequested = false
+}
+
+func (h NeonVMHandle) StartingResume(now time.Time) {
+	h.s.ScaleToZero.OngoingRequest = true
+}
+
+func (h NeonVMHandle) ResumeSuccessful(now time.Time) {
+	if !h.s.ScaleToZero.OngoingRequest {
+		panic("received NeonVM().ResumeSuccessful() update without ongoing request")
+	}
+
+	// Same as SuspendSuccessful. The metrics from before the VM was suspended are stale, so it
+	// isn't idle until new ones say so.
+	paused := false
+	h.s.VM.Paused = paused
+	h.s.ScaleToZero.ConfirmPaused = &paused
+	h.s.ScaleToZero.OngoingRequest = false
+	h.s.ScaleToZero.ResumeRequested = false
+	h.s.ScaleToZero.IdleSince = nil
+}
+
+func (h NeonVMHandle) ResumeFailed(now time.Time) {
+	h.s.ScaleToZero.OngoingRequest = false
+	h.s.ScaleToZero.RequestFailedAt = &now
+}
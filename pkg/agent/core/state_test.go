@@ -2,6 +2,7 @@ package core_test
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,8 +34,16 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 		{
 			name: "BasicScaleup",
 			metrics: core.Metrics{
-				LoadAverage1Min:  0.30,
-				MemoryUsageBytes: 0.0,
+				LoadAverage1Min:           0.30,
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres:                  nil,
+				LFC:                       nil,
+				Gauges:                    nil,
 			},
 			vmUsing:           api.Resources{VCPU: 250, Mem: 1 * slotSize},
 			schedulerApproved: api.Resources{VCPU: 250, Mem: 1 * slotSize},
@@ -47,8 +56,16 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 		{
 			name: "MismatchedApprovedNoScaledown",
 			metrics: core.Metrics{
-				LoadAverage1Min:  0.0, // ordinarily would like to scale down
-				MemoryUsageBytes: 0.0,
+				LoadAverage1Min:           0.0, // ordinarily would like to scale down
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres:                  nil,
+				LFC:                       nil,
+				Gauges:                    nil,
 			},
 			vmUsing:           api.Resources{VCPU: 250, Mem: 2 * slotSize},
 			schedulerApproved: api.Resources{VCPU: 250, Mem: 2 * slotSize},
@@ -63,8 +80,16 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 			// ref https://github.com/neondatabase/autoscaling/issues/512
 			name: "MismatchedApprovedNoScaledownButVMAtMaximum",
 			metrics: core.Metrics{
-				LoadAverage1Min:  0.0, // ordinarily would like to scale down
-				MemoryUsageBytes: 0.0,
+				LoadAverage1Min:           0.0, // ordinarily would like to scale down
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres:                  nil,
+				LFC:                       nil,
+				Gauges:                    nil,
 			},
 			vmUsing:           api.Resources{VCPU: 1000, Mem: 5 * slotSize}, // note: mem greater than maximum. It can happen when scaling bounds change
 			schedulerApproved: api.Resources{VCPU: 1000, Mem: 5 * slotSize}, // unused
@@ -76,6 +101,108 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 				"Can't decrease desired resources to within VM maximum because of vm-monitor previously denied downscale request",
 			},
 		},
+		{
+			name: "PostgresActiveBackendsScaleup",
+			metrics: core.Metrics{
+				LoadAverage1Min:           0.0,
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres: &core.PostgresMetrics{
+					ActiveBackends:        25, // with 10 per CU, want 3 CU
+					TransactionsPerSecond: 0,
+					BufferCacheHitRatio:   nil,
+				},
+				LFC:    nil,
+				Gauges: nil,
+			},
+			vmUsing:           api.Resources{VCPU: 250, Mem: 1 * slotSize},
+			schedulerApproved: api.Resources{VCPU: 250, Mem: 1 * slotSize},
+			requestedUpscale:  api.MoreResources{Cpu: false, Memory: false},
+			deniedDownscale:   nil,
+
+			expected: api.Resources{VCPU: 750, Mem: 3 * slotSize},
+			warnings: nil,
+		},
+		{
+			name: "PostgresLowCacheHitRatioNoScaledown",
+			metrics: core.Metrics{
+				LoadAverage1Min:           0.0, // ordinarily would like to scale down
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres: &core.PostgresMetrics{
+					ActiveBackends:        0,
+					TransactionsPerSecond: 0,
+					BufferCacheHitRatio:   ptr[float32](0.5),
+				},
+				LFC:    nil,
+				Gauges: nil,
+			},
+			vmUsing:           api.Resources{VCPU: 500, Mem: 2 * slotSize},
+			schedulerApproved: api.Resources{VCPU: 500, Mem: 2 * slotSize},
+			requestedUpscale:  api.MoreResources{Cpu: false, Memory: false},
+			deniedDownscale:   nil,
+
+			expected: api.Resources{VCPU: 500, Mem: 2 * slotSize},
+			warnings: nil,
+		},
+		{
+			name: "LFCWorkingSetScaleup",
+			metrics: core.Metrics{
+				LoadAverage1Min:           0.0,
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure:            nil,
+				CPU:                       nil,
+				HostContention:            nil,
+				Postgres:                  nil,
+				LFC: &core.LFCMetrics{
+					HitRatio:            ptr[float32](0.8),
+					WorkingSetSizeBytes: float32(1.6 * float64(slotSize)), // with ratio 0.75, want 2.13 GiB -> 3 CU
+				},
+				Gauges: nil,
+			},
+			vmUsing:           api.Resources{VCPU: 250, Mem: 1 * slotSize},
+			schedulerApproved: api.Resources{VCPU: 250, Mem: 1 * slotSize},
+			requestedUpscale:  api.MoreResources{Cpu: false, Memory: false},
+			deniedDownscale:   nil,
+
+			expected: api.Resources{VCPU: 750, Mem: 3 * slotSize},
+			warnings: nil,
+		},
+		{
+			name: "MemoryPressureScaleup",
+			metrics: core.Metrics{
+				LoadAverage1Min:           0.0, // ordinarily would like to scale down
+				MemoryUsageBytes:          0.0,
+				MemoryStalledSecondsTotal: nil,
+				MemoryWaitingSecondsTotal: nil,
+				MemoryPressure: &core.MemoryPressureMetrics{
+					Some: 0.3, // with threshold 0.2, want 1 more CU than current
+					Full: 0,
+				},
+				CPU:            nil,
+				HostContention: nil,
+				Postgres:       nil,
+				LFC:            nil,
+				Gauges:         nil,
+			},
+			vmUsing:           api.Resources{VCPU: 500, Mem: 2 * slotSize},
+			schedulerApproved: api.Resources{VCPU: 500, Mem: 2 * slotSize},
+			requestedUpscale:  api.MoreResources{Cpu: false, Memory: false},
+			deniedDownscale:   nil,
+
+			expected: api.Resources{VCPU: 750, Mem: 3 * slotSize},
+			warnings: nil,
+		},
 	}
 
 	for _, c := range cases {
@@ -86,9 +213,10 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 				Name:      "test",
 				Namespace: "test",
 				Cpu: api.VmCpuInfo{
-					Min: 250,
-					Use: c.vmUsing.VCPU,
-					Max: 1000,
+					Min:    250,
+					Use:    c.vmUsing.VCPU,
+					Max:    1000,
+					Pinned: 0,
 				},
 				Mem: api.VmMemInfo{
 					SlotSize: slotSize,
@@ -102,22 +230,50 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 					AlwaysMigrate:        false,
 					ScalingEnabled:       true,
 					ScalingConfig:        nil,
+					MetricsTransport:     api.MetricsTransportPull,
+					Schedule:             nil,
+					Overrides:            nil,
+					ManualTargetCU:       nil,
+					Priority:             0,
+					Topology:             nil,
+					BurstCredits:         nil,
 				},
+				Paused:     false,
+				RunnerPort: 0,
 			},
 			core.Config{
 				ComputeUnit: api.Resources{VCPU: 250, Mem: 1 * slotSize},
 				DefaultScalingConfig: api.ScalingConfig{
-					LoadAverageFractionTarget: 0.5,
-					MemoryUsageFractionTarget: 0.5,
+					LoadAverageFractionTarget:     0.5,
+					MemoryUsageFractionTarget:     0.5,
+					ActiveBackendsPerCU:           ptr(10.0),
+					TransactionsPerSecondPerCU:    nil,
+					MinBufferCacheHitRatio:        ptr(0.9),
+					LFCToMemoryRatio:              ptr(0.75),
+					MemoryPressureSomeThreshold:   ptr(0.2),
+					MemoryPressureFullThreshold:   nil,
+					ScaleDownStabilizationSeconds: nil,
+					ScaleUpCooldownSeconds:        nil,
+					MaxScaleStepCU:                nil,
+					DownscaleBatchWindowSeconds:   nil,
+					ScaleToZero:                   nil,
 				},
 				// these don't really matter, because we're not using (*State).NextActions()
-				NeonVMRetryWait:                    time.Second,
-				PluginRequestTick:                  time.Second,
-				PluginRetryWait:                    time.Second,
-				PluginDeniedRetryWait:              time.Second,
-				MonitorDeniedDownscaleCooldown:     time.Second,
-				MonitorRequestedUpscaleValidPeriod: time.Second,
-				MonitorRetryWait:                   time.Second,
+				NeonVMRetryWait:                     time.Second,
+				PluginRequestTick:                   time.Second,
+				PluginRetryWait:                     time.Second,
+				PluginDeniedRetryWait:               time.Second,
+				MonitorDeniedDownscaleCooldown:      time.Second,
+				MonitorRequestedUpscaleValidPeriod:  time.Second,
+				MonitorRetryWait:                    time.Second,
+				EmergencyUpscaleCU:                  0,
+				EmergencyUpscaleMinInterval:         time.Second,
+				EmergencyUpscaleValidPeriod:         time.Second,
+				NodePressureDeniedDownscaleCooldown: 0,
+				NodePressureMaxUpscaleCU:            0,
+				Prediction:                          nil,
+				Burst:                               nil,
+				ScalingPolicy:                       nil,
 				Log: core.LogConfig{
 					Info: nil,
 					Warn: func(msg string, fields ...zap.Field) {
@@ -129,15 +285,16 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 
 		t.Run(c.name, func(t *testing.T) {
 			// set the metrics
-			state.UpdateMetrics(c.metrics)
+			state.UpdateMetrics(time.Now(), c.metrics)
 
 			now := time.Now()
 
 			// set lastApproved by simulating a scheduler request/response
 			state.Plugin().StartingRequest(now, c.schedulerApproved)
 			err := state.Plugin().RequestSuccessful(now, api.PluginResponse{
-				Permit:  c.schedulerApproved,
-				Migrate: nil,
+				Permit:       c.schedulerApproved,
+				Migrate:      nil,
+				DeniedReason: "",
 			})
 			if err != nil {
 				t.Errorf("state.Plugin().RequestSuccessful() failed: %s", err)
@@ -177,16 +334,35 @@ var DefaultInitialStateConfig = helpers.InitialStateConfig{
 	Core: core.Config{
 		ComputeUnit: DefaultComputeUnit,
 		DefaultScalingConfig: api.ScalingConfig{
-			LoadAverageFractionTarget: 0.5,
-			MemoryUsageFractionTarget: 0.5,
+			LoadAverageFractionTarget:     0.5,
+			MemoryUsageFractionTarget:     0.5,
+			ActiveBackendsPerCU:           nil,
+			TransactionsPerSecondPerCU:    nil,
+			MinBufferCacheHitRatio:        nil,
+			LFCToMemoryRatio:              nil,
+			MemoryPressureSomeThreshold:   nil,
+			MemoryPressureFullThreshold:   nil,
+			ScaleDownStabilizationSeconds: nil,
+			ScaleUpCooldownSeconds:        nil,
+			MaxScaleStepCU:                nil,
+			DownscaleBatchWindowSeconds:   nil,
+			ScaleToZero:                   nil,
 		},
-		NeonVMRetryWait:                    5 * time.Second,
-		PluginRequestTick:                  5 * time.Second,
-		PluginRetryWait:                    3 * time.Second,
-		PluginDeniedRetryWait:              2 * time.Second,
-		MonitorDeniedDownscaleCooldown:     5 * time.Second,
-		MonitorRequestedUpscaleValidPeriod: 10 * time.Second,
-		MonitorRetryWait:                   3 * time.Second,
+		NeonVMRetryWait:                     5 * time.Second,
+		PluginRequestTick:                   5 * time.Second,
+		PluginRetryWait:                     3 * time.Second,
+		PluginDeniedRetryWait:               2 * time.Second,
+		MonitorDeniedDownscaleCooldown:      5 * time.Second,
+		MonitorRequestedUpscaleValidPeriod:  10 * time.Second,
+		MonitorRetryWait:                    3 * time.Second,
+		EmergencyUpscaleCU:                  0, // disabled by default
+		EmergencyUpscaleMinInterval:         10 * time.Second,
+		EmergencyUpscaleValidPeriod:         10 * time.Second,
+		NodePressureDeniedDownscaleCooldown: 0,
+		NodePressureMaxUpscaleCU:            0,
+		Prediction:                          nil,
+		Burst:                               nil,
+		ScalingPolicy:                       nil,
 		Log: core.LogConfig{
 			Info: nil,
 			Warn: nil,
@@ -217,8 +393,9 @@ func doInitialPluginRequest(
 	a.Do(state.Plugin().StartingRequest, clock.Now(), resources)
 	clock.Inc(requestTime)
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resources,
-		Migrate: nil,
+		Permit:       resources,
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 }
 
@@ -261,10 +438,18 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 	// Set metrics
 	clockTick().AssertEquals(duration("0.2s"))
 	lastMetrics := core.Metrics{
-		LoadAverage1Min:  0.3,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.3,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, lastMetrics)
+	a.Do(state.UpdateMetrics, clock.Now(), lastMetrics)
 	// double-check that we agree about the desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -284,8 +469,9 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 	// should have nothing more to do; waiting on plugin request to come back
 	a.Call(nextActions).Equals(core.ActionSet{})
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(2),
-		Migrate: nil,
+		Permit:       resForCU(2),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	// Scheduler approval is done, now we should be making the request to NeonVM
@@ -337,10 +523,18 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 
 	// Set metrics back so that desired resources should now be zero
 	lastMetrics = core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, lastMetrics)
+	a.Do(state.UpdateMetrics, clock.Now(), lastMetrics)
 	// double-check that we agree about the new desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(1))
@@ -391,8 +585,9 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 	// should have nothing more to do; waiting on plugin request to come back
 	a.Call(nextActions).Equals(core.ActionSet{})
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(1),
-		Migrate: nil,
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	// Finally, check there's no leftover actions:
@@ -414,12 +609,20 @@ func TestPeriodicPluginRequest(t *testing.T) {
 	state.Monitor().Active(true)
 
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
 	resources := DefaultComputeUnit
 
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 
 	base := duration("0s")
 	clock.Elapsed().AssertEquals(base)
@@ -453,8 +656,9 @@ func TestPeriodicPluginRequest(t *testing.T) {
 			clock.Inc(reqDuration)
 			a.Call(state.NextActions, clock.Now()).Equals(core.ActionSet{})
 			a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-				Permit:  resources,
-				Migrate: nil,
+				Permit:       resources,
+				Migrate:      nil,
+				DeniedReason: "",
 			})
 			clock.Inc(clockTick - reqDuration)
 		}
@@ -495,10 +699,18 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 	// Set metrics
 	clockTick()
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 	// double-check that we agree about the desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(1))
@@ -608,8 +820,9 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 	})
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(3),
-		Migrate: nil,
+		Permit:       resForCU(3),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// ... And *now* there's nothing left to do but wait until downscale wait expires:
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -651,8 +864,9 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 	})
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(3),
-		Migrate: nil,
+		Permit:       resForCU(3),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	a.Call(nextActions).Equals(core.ActionSet{
 		Wait: &core.ActionWait{Duration: duration("0.9s")}, // yep, still waiting on retrying vm-monitor downscaling
@@ -717,8 +931,9 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 	})
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(1),
-		Migrate: nil,
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// And now there's truly nothing left to do. Back to waiting on plugin request tick :)
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -726,6 +941,74 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 	})
 }
 
+// Checks that when the vm-monitor defers downscaling with a retry-after, we retry after that
+// duration instead of the configured cooldown
+func TestDeferredDownscaleRetryAfter(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithMinMaxCU(1, 8),
+		helpers.WithCurrentCU(6), // NOTE: Start at 6 CU, so we're trying to scale down immediately.
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.PluginRequestTick = duration("7s")
+			c.MonitorDeniedDownscaleCooldown = duration("4s")
+		}),
+	)
+
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	state.Monitor().Active(true)
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(6))
+
+	clock.Inc(duration("0.1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+	clock.Elapsed()
+
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("6.8s")},
+		MonitorDownscale: &core.ActionMonitorDownscale{
+			Current: resForCU(6),
+			Target:  resForCU(5),
+		},
+	})
+	a.Do(state.Monitor().StartingDownscaleRequest, clock.Now(), resForCU(5))
+	clock.Inc(duration("0.1s"))
+	a.Do(state.Monitor().DownscaleRequestDeferred, clock.Now(), "long-running transaction", duration("2s"))
+
+	// Waiting for the vm-monitor's retry-after, not the 4s cooldown:
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("2s")},
+	})
+
+	clock.Inc(duration("2s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.7s")},
+		MonitorDownscale: &core.ActionMonitorDownscale{
+			Current: resForCU(6),
+			Target:  resForCU(5),
+		},
+	})
+}
+
 // Checks that we scale up in a timely manner when the vm-monitor requests it, and don't request
 // downscaling until the time expires.
 func TestRequestedUpscale(t *testing.T) {
@@ -755,10 +1038,18 @@ func TestRequestedUpscale(t *testing.T) {
 	// Set metrics
 	clockTick()
 	lastMetrics := core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, lastMetrics)
+	a.Do(state.UpdateMetrics, clock.Now(), lastMetrics)
 
 	// Check we're not supposed to do anything
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -782,8 +1073,9 @@ func TestRequestedUpscale(t *testing.T) {
 		Wait: &core.ActionWait{Duration: duration("5.9s")}, // same waiting for requested upscale expiring
 	})
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(2),
-		Migrate: nil,
+		Permit:       resForCU(2),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	// After approval from the scheduler plugin, now need to make NeonVM request:
@@ -833,8 +1125,9 @@ func TestRequestedUpscale(t *testing.T) {
 		Wait: &core.ActionWait{Duration: duration("0.9s")}, // waiting for requested upscale expiring
 	})
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(2),
-		Migrate: nil,
+		Permit:       resForCU(2),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	// Still should just be waiting on vm-monitor upscale expiring
@@ -851,6 +1144,1184 @@ func TestRequestedUpscale(t *testing.T) {
 	})
 }
 
+// Checks that emergency upscaling skips waiting on the metrics, is rate limited, and expires after
+// the configured period
+func TestEmergencyUpscale(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	clockTick := func() {
+		clock.Inc(100 * time.Millisecond)
+	}
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.EmergencyUpscaleCU = 2
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	state.Monitor().Active(true)
+
+	// Send initial scheduler request:
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	// Set metrics
+	clockTick()
+	lastMetrics := core.Metrics{
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	}
+	a.Do(state.UpdateMetrics, clock.Now(), lastMetrics)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+
+	// Trigger the emergency upscale. The second one should be rejected, because it's too soon.
+	a.Call(state.EmergencyUpscale, clock.Now(), "test").Equals(true)
+	a.WithWarnings("Ignoring emergency upscale (test), because the previous one was too recent").
+		Call(state.EmergencyUpscale, clock.Now(), "test").
+		Equals(false)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+
+	// Go through the usual upscaling flow:
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("10s")}, // if nothing else happens, emergency upscale expires.
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(resForCU(1)),
+			Target:     resForCU(3),
+			Metrics:    ptr(lastMetrics.ToAPI()),
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(3))
+	clockTick()
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:       resForCU(3),
+		Migrate:      nil,
+		DeniedReason: "",
+	})
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.9s")}, // plugin tick wait is earlier than emergency upscale expiration
+		NeonVMRequest: &core.ActionNeonVMRequest{
+			Current: resForCU(1),
+			Target:  resForCU(3),
+		},
+	})
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(3))
+	clockTick()
+	a.Do(state.NeonVM().RequestSuccessful, clock.Now())
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.8s")}, // still waiting on plugin tick
+		MonitorUpscale: &core.ActionMonitorUpscale{
+			Current: resForCU(1),
+			Target:  resForCU(3),
+		},
+	})
+	a.Do(state.Monitor().StartingUpscaleRequest, clock.Now(), resForCU(3))
+	clockTick()
+	a.Do(state.Monitor().UpscaleRequestSuccessful, clock.Now())
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.7s")},
+	})
+
+	// Still too soon for another one:
+	a.WithWarnings("Ignoring emergency upscale (test), because the previous one was too recent").
+		Call(state.EmergencyUpscale, clock.Now(), "test").
+		Equals(false)
+
+	// Once the valid period expires, we go back to what the metrics say:
+	clock.Inc(duration("9.6s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+	clockTick()
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+
+	// ... and now we're allowed to trigger it again, up to the VM's max of 4 CU:
+	a.Call(state.EmergencyUpscale, clock.Now(), "test").Equals(true)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+}
+
+func TestBurstUpscale(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.Burst = &core.BurstConfig{
+				LoadPerCPUThreshold:       0,
+				ConnectionsPerCUThreshold: 10,
+				MinInterval:               10 * time.Second,
+				ValidPeriod:               5 * time.Second,
+			}
+		}),
+	)
+
+	metricsWithBackends := func(backends float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           0.0,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres: &core.PostgresMetrics{
+				ActiveBackends:        backends,
+				TransactionsPerSecond: 0,
+				BufferCacheHitRatio:   nil,
+			},
+			LFC:    nil,
+			Gauges: nil,
+		}
+	}
+
+	// Below the threshold, nothing happens:
+	a.Do(state.UpdateMetrics, clock.Now(), metricsWithBackends(5))
+	a.Call(state.BurstUpscale, clock.Now()).Equals("", false)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+
+	// Above it, we go straight to the VM's maximum, because there's no limit on the step size.
+	// The scaling policy doesn't use the number of backends, so this is only from the burst.
+	a.Do(state.UpdateMetrics, clock.Now(), metricsWithBackends(20))
+	a.Call(state.BurstUpscale, clock.Now()).Equals("active backends per CU 20.0 is at least 10.0", true)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// Rate limited separately from the valid period:
+	clock.Inc(duration("6s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+	a.Call(state.BurstUpscale, clock.Now()).Equals("", false)
+
+	// Once it's been long enough, a burst is limited to the max step size.
+	clock.Inc(duration("4s"))
+	config := DefaultInitialStateConfig.Core.DefaultScalingConfig
+	config.MaxScaleStepCU = ptr[uint32](2)
+	a.Do(state.UpdateDefaultScalingConfig, config)
+	a.Call(state.BurstUpscale, clock.Now()).Equals("active backends per CU 20.0 is at least 10.0", true)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+}
+
+type fixedScalingPolicy struct {
+	cu      uint32
+	history *[]core.Metrics
+}
+
+func (p fixedScalingPolicy) GoalCU(input core.ScalingPolicyInput) (uint32, string) {
+	*p.history = input.History
+	return p.cu, "fixed"
+}
+
+// Checks that a custom ScalingPolicy is used in place of the default, and that it's given the
+// history of previous metrics
+func TestCustomScalingPolicy(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	var history []core.Metrics
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.ScalingPolicy = fixedScalingPolicy{cu: 3, history: &history}
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	// With the default policy, this load would be 1 CU
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+	a.Call(func() []core.Metrics { return history }).Equals([]core.Metrics(nil))
+
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.2))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+	a.Call(func() []core.Metrics { return history }).Equals([]core.Metrics{metrics(0.1), metrics(0.2)})
+}
+
+// Checks that TimeOfDayPolicy limits downscaling during its periods, in the configured timezone
+func TestTimeOfDayScalingPolicy(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithCurrentCU(4),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.ScalingPolicy = core.TimeOfDayPolicy{
+				Policy:   core.DefaultScalingPolicy{},
+				Location: time.FixedZone("UTC-5", -5*60*60),
+				Periods: []core.TimeOfDayPeriod{
+					// 18:00 to 06:00, continuing past midnight
+					{Start: duration("18h"), End: duration("6h"), DownscaleFraction: 0.5},
+				},
+			}
+		}),
+	)
+
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+
+	// The clock starts at midnight UTC, which is 19:00 locally. So we can only downscale by half of
+	// the difference between the current 4 CU and the goal of 0 CU.
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// 12:00 UTC is 07:00 locally, outside of the period
+	clock.Inc(duration("12h"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that the VM's schedule is layered on top of the goal from the metrics
+func TestScheduledBounds(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithSchedule(api.ScalingSchedule{
+			Timezone: "", // UTC
+			Windows: []api.ScheduleWindow{
+				// The clock starts at midnight on a Saturday, so this is in effect from the start
+				{Days: []string{"fri"}, Start: "20:00", End: "02:00", MinCU: ptr[uint16](3), MaxCU: nil},
+				{Days: nil, Start: "06:00", End: "12:00", MinCU: nil, MaxCU: ptr[uint16](2)},
+			},
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+
+	// Outside of any window, it's just the metrics
+	clock.Inc(duration("2h"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(1.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	clock.Inc(duration("4h"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+}
+
+// Checks that a manual target pins the VM regardless of its metrics, and that automatic scaling
+// resumes once it's removed
+func TestManualTarget(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithManualTarget(3),
+	)
+	state.Monitor().Active(true)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	// Pinned at 3 CU, even without metrics
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+
+	// ... and regardless of the metrics, or requests from the vm-monitor
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(1.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+	a.Do(state.Monitor().UpscaleRequested, clock.Now(), api.MoreResources{Cpu: true, Memory: true})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+
+	// The target is still limited by the VM's bounds
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(
+		DefaultInitialStateConfig.VM,
+		helpers.WithManualTarget(8),
+	))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// Once the target is removed, we go back to using the metrics
+	clock.Inc(duration("1m"))
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that a VM is suspended once it's been idle for long enough, that it gives up its CPU and
+// isn't scaled while suspended, and that it asks for its CPU back once it's resumed
+func TestScaleToZero(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+	suspendedRes := api.Resources{VCPU: 0, Mem: resForCU(1).Mem}
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.PluginRequestTick = duration("1m")
+			c.DefaultScalingConfig.ScaleToZero = &api.ScaleToZeroConfig{
+				IdleSeconds:    10,
+				MaxLoadAverage: 0.05,
+			}
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	// Once the VM is idle, we wait for the idle window to pass...
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("10s")},
+	})
+
+	// ... which is restarted if it stops being idle, even without needing more CPU.
+	clock.Inc(duration("4s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	clock.Inc(duration("0.1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	idleSince := clock.Now()
+	clock.Inc(duration("9.9s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("0.1s")},
+	})
+
+	// Then, the VM is suspended
+	clock.Inc(duration("0.1s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:    &core.ActionWait{Duration: duration("45.8s")}, // plugin request tick
+		Suspend: &core.ActionSuspend{Resources: resForCU(1), IdleSince: idleSince},
+	})
+	a.Do(state.NeonVM().StartingSuspend, clock.Now())
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().SuspendSuccessful, clock.Now())
+
+	// ... and gives up its CPU, but not its memory
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(resForCU(1)),
+			Target:     suspendedRes,
+			Metrics:    ptr(metrics(0.0).ToAPI()),
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), suspendedRes)
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:       suspendedRes,
+		Migrate:      nil,
+		DeniedReason: "",
+	})
+
+	// While it's suspended, it isn't scaled, whatever the metrics say
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(1.0))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("59s")},
+	})
+	_, explanation := state.NextActionsExplained(clock.Now())
+	if explanation.Limit != core.LimitSuspended {
+		t.Errorf("expected limit %q, got %q", core.LimitSuspended, explanation.Limit)
+	}
+
+	// Updates to the VM from before it was suspended don't resume it
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("59s")},
+	})
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM, helpers.WithPaused()))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("59s")},
+	})
+
+	// Once it's resumed, it first asks for the CPU it's already using again...
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM))
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(suspendedRes),
+			Target:     resForCU(1),
+			Metrics:    ptr(metrics(1.0).ToAPI()),
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(1))
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
+	})
+
+	// ... and is then scaled as normal
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(resForCU(1)),
+			Target:     resForCU(4),
+			Metrics:    ptr(metrics(1.0).ToAPI()),
+		},
+	})
+}
+
+// Checks that a suspended VM is resumed once connections to it arrive, retrying if that fails, and
+// that updates to the VM from before it was resumed don't count it as suspended again
+func TestScaleToZeroResume(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+	suspendedRes := api.Resources{VCPU: 0, Mem: resForCU(1).Mem}
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.PluginRequestTick = duration("1m")
+			c.DefaultScalingConfig.ScaleToZero = &api.ScaleToZeroConfig{
+				IdleSeconds:    10,
+				MaxLoadAverage: 0.05,
+			}
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	metrics := core.Metrics{
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	}
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	// Connections while the VM is running don't do anything
+	a.Do(state.InboundTraffic)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
+	idleSince := clock.Now()
+	clock.Inc(duration("10s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:    &core.ActionWait{Duration: duration("49.9s")}, // plugin request tick
+		Suspend: &core.ActionSuspend{Resources: resForCU(1), IdleSince: idleSince},
+	})
+	a.Do(state.NeonVM().StartingSuspend, clock.Now())
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().SuspendSuccessful, clock.Now())
+	a.Do(state.Plugin().StartingRequest, clock.Now(), suspendedRes)
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:       suspendedRes,
+		Migrate:      nil,
+		DeniedReason: "",
+	})
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("1m")},
+	})
+
+	// Once connections arrive, the VM is resumed
+	clock.Inc(duration("1s"))
+	a.Do(state.InboundTraffic)
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:   &core.ActionWait{Duration: duration("59s")},
+		Resume: &core.ActionResume{Resources: resForCU(1)},
+	})
+	a.Do(state.NeonVM().StartingResume, clock.Now())
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("59s")},
+	})
+
+	// If that fails, it's retried after Config.NeonVMRetryWait
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().ResumeFailed, clock.Now())
+	a.
+		WithWarnings("Wanted to resume the VM, but recent request failed too recently").
+		Call(nextActions).
+		Equals(core.ActionSet{
+			Wait: &core.ActionWait{Duration: duration("5s")},
+		})
+	clock.Inc(duration("5s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:   &core.ActionWait{Duration: duration("53.9s")},
+		Resume: &core.ActionResume{Resources: resForCU(1)},
+	})
+	a.Do(state.NeonVM().StartingResume, clock.Now())
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().ResumeSuccessful, clock.Now())
+
+	// Once resumed, it asks for its CPU back. Updates to the VM from before it was resumed don't
+	// change that.
+	resumedActions := core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(suspendedRes),
+			Target:     resForCU(1),
+			Metrics:    ptr(metrics.ToAPI()),
+		},
+	}
+	a.Call(nextActions).Equals(resumedActions)
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM, helpers.WithPaused()))
+	a.Call(nextActions).Equals(resumedActions)
+	a.Do(state.UpdatedVM, helpers.CreateVmInfo(DefaultInitialStateConfig.VM))
+	a.Call(nextActions).Equals(resumedActions)
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(1))
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
+	})
+
+	// The metrics from before it was suspended don't count, so it isn't suspended again until it's
+	// been idle for long enough since being resumed
+	clock.Inc(duration("1s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("59s")},
+	})
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("10s")},
+	})
+}
+
+// Checks that connections arriving while the VM is being suspended resume it once that's done, but
+// not if suspending it failed, because then the VM served them
+func TestScaleToZeroTrafficWhileSuspending(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.PluginRequestTick = duration("1m")
+			c.DefaultScalingConfig.ScaleToZero = &api.ScaleToZeroConfig{
+				IdleSeconds:    10,
+				MaxLoadAverage: 0.05,
+			}
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	metrics := core.Metrics{
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	}
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
+	idleSince := clock.Now()
+	clock.Inc(duration("10s"))
+	suspend := &core.ActionSuspend{Resources: resForCU(1), IdleSince: idleSince}
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:    &core.ActionWait{Duration: duration("49.9s")},
+		Suspend: suspend,
+	})
+
+	// The first attempt fails, with connections arriving in the meantime, so there's nothing to
+	// resume
+	a.Do(state.NeonVM().StartingSuspend, clock.Now())
+	a.Do(state.InboundTraffic)
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().SuspendFailed, clock.Now())
+	a.
+		WithWarnings("Wanted to suspend the VM, but recent request failed too recently").
+		Call(nextActions).
+		Equals(core.ActionSet{
+			Wait: &core.ActionWait{Duration: duration("5s")},
+		})
+
+	// The second succeeds, with connections arriving while it's ongoing, so it's then resumed
+	clock.Inc(duration("5s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait:    &core.ActionWait{Duration: duration("44.8s")},
+		Suspend: suspend,
+	})
+	a.Do(state.NeonVM().StartingSuspend, clock.Now())
+	a.Do(state.InboundTraffic)
+	clock.Inc(duration("0.1s"))
+	a.Do(state.NeonVM().SuspendSuccessful, clock.Now())
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: ptr(resForCU(1)),
+			Target:     api.Resources{VCPU: 0, Mem: resForCU(1).Mem},
+			Metrics:    ptr(metrics.ToAPI()),
+		},
+		Resume: &core.ActionResume{Resources: resForCU(1)},
+	})
+}
+
+// Checks that a VM with burst credits is held at its baseline once it's spent too long above it in
+// the last hour, and that it can go back above once enough of that time has passed
+func TestBurstCredits(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithBurstCredits(api.BurstCredits{BaselineCU: 2, SecondsPerHour: 60}),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			// Stabilization doesn't delay the downscaling when the credits run out.
+			c.DefaultScalingConfig.ScaleDownStabilizationSeconds = ptr[uint32](300)
+		}),
+	)
+	state.Monitor().Active(true)
+
+	metrics := core.Metrics{
+		LoadAverage1Min:           1.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	}
+
+	// Upscale above the baseline, to the VM's maximum of 4 CU
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(4))
+	a.Do(state.NeonVM().RequestSuccessful, clock.Now())
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// Part of the way through the credits, nothing changes
+	clock.Inc(duration("30s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// ... but once they're used up, the VM goes back to its baseline
+	clock.Inc(duration("30s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	_, explanation := state.NextActionsExplained(clock.Now())
+	if !strings.HasSuffix(explanation.Reason, "(limited by burst credits)") {
+		t.Errorf("expected reason to mention burst credits, got %q", explanation.Reason)
+	}
+	if explanation.Limit != core.LimitBurstCredits {
+		t.Errorf("expected limit %q, got %q", core.LimitBurstCredits, explanation.Limit)
+	}
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(2))
+	a.Do(state.NeonVM().RequestSuccessful, clock.Now())
+
+	// It stays there until the time above the baseline starts to age out of the hour
+	clock.Inc(duration("59m"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("10s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+}
+
+// Checks that the max scale step limits how far the metrics move the VM at once, and that it can be
+// set by the VM's overrides
+func TestMaxScaleStep(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithMinMaxCU(1, 8),
+		helpers.WithCurrentCU(4),
+		helpers.WithOverrides(api.ScalingOverrides{
+			MetricsIntervalSeconds:    nil,
+			MaxScaleStepCU:            ptr[uint32](2),
+			LoadAverageFractionTarget: nil,
+			MemoryUsageFractionTarget: nil,
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	// Without metrics, we stay where we are
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// Would like 8 CU, but only allowed to go up by 2
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(1.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(6))
+
+	// Would like 0 CU, but only allowed to go down by 2
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// Within the step, the metrics are used as-is
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.625))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(5))
+}
+
+// Checks that upscaling from metrics is limited while the node is under memory pressure
+func TestNodeMemoryPressure(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.NodePressureMaxUpscaleCU = 1
+		}),
+	)
+
+	state.Monitor().Active(true)
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	clock.Inc(duration("0.1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           1.0, // would like 8 CU, capped to 4 by the VM's maximum
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	a.Do(state.NodeMemoryPressure, true)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	a.Do(state.NodeMemoryPressure, false)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+}
+
+// Checks that memory pressure signaled by the vm-monitor vetoes downscaling memory, but not CPU,
+// until it subsides
+func TestMonitorMemoryPressureVeto(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithCurrentCU(4),
+	)
+	state.Monitor().Active(true)
+
+	a.Call(state.Monitor().MemoryPressure, clock.Now(), true, "memory.high throttled").Equals(true)
+	// Signals while already at risk don't start a new veto
+	a.Call(state.Monitor().MemoryPressure, clock.Now(), true, "memory.high throttled").Equals(false)
+
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           0.0, // would like 0 CU, raised to 1 by the VM's minimum
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(api.Resources{
+		VCPU: resForCU(1).VCPU,
+		Mem:  resForCU(4).Mem,
+	})
+	_, explanation := state.NextActionsExplained(clock.Now())
+	if !strings.HasSuffix(explanation.Reason, "(memory downscale vetoed by vm-monitor memory pressure: memory.high throttled)") {
+		t.Errorf("expected reason to mention the veto, got %q", explanation.Reason)
+	}
+	if explanation.Limit != core.LimitMemoryPressure {
+		t.Errorf("expected limit %q, got %q", core.LimitMemoryPressure, explanation.Limit)
+	}
+
+	// The veto lasts until the vm-monitor says that the VM is no longer at risk
+	clock.Inc(duration("1h"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(api.Resources{
+		VCPU: resForCU(1).VCPU,
+		Mem:  resForCU(4).Mem,
+	})
+	a.Call(state.Monitor().MemoryPressure, clock.Now(), false, "").Equals(false)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that a reloaded default scaling config takes effect for VMs without their own
+func TestUpdateDefaultScalingConfig(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+	)
+
+	state.Monitor().Active(true)
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	clock.Inc(duration("0.1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           0.25, // 0.5 vCPU at the default target of 0.5, so 2 CU
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	config := DefaultInitialStateConfig.Core.DefaultScalingConfig
+	config.LoadAverageFractionTarget = 1.0
+	a.Do(state.UpdateDefaultScalingConfig, config)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that the rest of a reloaded config also takes effect, keeping the existing Log
+func TestUpdateConfig(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	state.Monitor().Active(true)
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	clock.Inc(duration("0.1s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.8s")},
+	})
+
+	config := DefaultInitialStateConfig.Core
+	config.PluginRequestTick = duration("2s")
+	config.DefaultScalingConfig.LoadAverageFractionTarget = 1.0
+	config.Log = core.LogConfig{Info: nil, Warn: nil}
+	a.Do(state.UpdateConfig, config)
+
+	// The next request is due sooner, with the new tick
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("1.8s")},
+	})
+
+	// ... and the new default scaling config is used
+	a.Do(state.UpdateMetrics, clock.Now(), core.Metrics{
+		LoadAverage1Min:           0.25, // 0.25 vCPU at the new target of 1.0, so 1 CU
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
+	})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that an upwards trend in the metrics causes upscaling before the load arrives, and that
+// prediction stops once the samples fall out of the window
+func TestPredictiveScaling(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.Prediction = &core.PredictionConfig{
+				Window:     duration("10s"),
+				Horizon:    duration("5s"),
+				MinSamples: 3,
+			}
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.2))
+	// Not enough samples yet, so just 0.2 load average -> 1.6 CU, rounded to 2
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.3))
+	// Increasing by 0.1 per second, so in 5s the load average will be 0.8 -> 6.4 CU, capped to 4
+	// by the VM's maximum. Without prediction, it'd only be 2.4 CU.
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// A decreasing trend is not projected
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.2))
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+
+	// Once the earlier samples are outside the window, only the latest one is left
+	clock.Inc(duration("20s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+// Checks that downscaling waits until it's been continuously justified for the stabilization
+// period, and until the cooldown after upscaling has passed
+func TestScaleDownStabilization(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.DefaultScalingConfig.ScaleDownStabilizationSeconds = ptr[uint32](5)
+			c.DefaultScalingConfig.ScaleUpCooldownSeconds = ptr[uint32](10)
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	// Upscale to 2 CU
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(2))
+	a.Do(state.NeonVM().RequestSuccessful, clock.Now())
+
+	// Load drops immediately, but we're still within the cooldown after upscaling
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	// ... and the explanation should say why
+	_, explanation := state.NextActionsExplained(clock.Now())
+	if !strings.HasSuffix(explanation.Reason, "(downscale held for stabilization)") {
+		t.Errorf("expected reason to mention stabilization, got %q", explanation.Reason)
+	}
+	if explanation.Limit != core.LimitCooldown {
+		t.Errorf("expected limit %q, got %q", core.LimitCooldown, explanation.Limit)
+	}
+	if explanation.GoalCU != 0 {
+		t.Errorf("expected goal of 0 CU, got %d", explanation.GoalCU)
+	}
+
+	// Load is back up partway through, which resets the stabilization period
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	// The cooldown is over now, but downscaling has only been justified for 4s
+	clock.Inc(duration("4s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// ... and once it's been justified for 5s, we can downscale
+	clock.Inc(duration("1s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
+func TestDownscaleBatching(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.DefaultScalingConfig.DownscaleBatchWindowSeconds = ptr[uint32](5)
+		}),
+	)
+
+	metrics := func(load float32) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          0.0,
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  nil,
+			LFC:                       nil,
+			Gauges:                    nil,
+		}
+	}
+
+	// Upscale to 2 CU. Upscaling is never batched.
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(2))
+	a.Do(state.NeonVM().RequestSuccessful, clock.Now())
+
+	// Load drops, but the downscaling is held until the end of the batch window
+	clock.Inc(duration("1s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	_, explanation := state.NextActionsExplained(clock.Now())
+	if !strings.HasSuffix(explanation.Reason, "(downscale held for batching)") {
+		t.Errorf("expected reason to mention batching, got %q", explanation.Reason)
+	}
+	if explanation.Limit != core.LimitCooldown {
+		t.Errorf("expected limit %q, got %q", core.LimitCooldown, explanation.Limit)
+	}
+
+	// Changes in the desired size within the window don't restart it
+	clock.Inc(duration("2s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("2s"))
+	a.Do(state.UpdateMetrics, clock.Now(), metrics(0.0))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// ... and once the window is over, everything is downscaled at once
+	clock.Inc(duration("1s"))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+}
+
 // Checks that if we get new metrics partway through downscaling, then we pivot back to upscaling
 // without further requests in furtherance of downscaling.
 //
@@ -875,12 +2346,28 @@ func TestDownscalePivotBack(t *testing.T) {
 	}
 
 	initialMetrics := core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
 	newMetrics := core.Metrics{
-		LoadAverage1Min:  0.3,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.3,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
 
 	steps := []struct {
@@ -975,8 +2462,9 @@ func TestDownscalePivotBack(t *testing.T) {
 				*pluginWait = duration("4.9s") // reset because we just made a request
 				t.Log(" > finish plugin downscale")
 				a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-					Permit:  resForCU(1),
-					Migrate: nil,
+					Permit:       resForCU(1),
+					Migrate:      nil,
+					DeniedReason: "",
 				})
 			},
 			post: func(pluginWait *time.Duration) {
@@ -993,8 +2481,9 @@ func TestDownscalePivotBack(t *testing.T) {
 				*pluginWait = duration("4.9s") // reset because we just made a request
 				t.Log(" > finish plugin upscale")
 				a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-					Permit:  resForCU(2),
-					Migrate: nil,
+					Permit:       resForCU(2),
+					Migrate:      nil,
+					DeniedReason: "",
 				})
 			},
 		},
@@ -1019,7 +2508,7 @@ func TestDownscalePivotBack(t *testing.T) {
 		clockTick().AssertEquals(duration("0.2s"))
 		pluginWait := duration("4.8s")
 
-		a.Do(state.UpdateMetrics, initialMetrics)
+		a.Do(state.UpdateMetrics, clock.Now(), initialMetrics)
 		// double-check that we agree about the desired resources
 		a.Call(getDesiredResources, state, clock.Now()).
 			Equals(resForCU(1))
@@ -1030,7 +2519,7 @@ func TestDownscalePivotBack(t *testing.T) {
 				// at the midpoint, start backtracking by setting the metrics
 				midRequest = func() {
 					t.Log(" > > updating metrics mid-request")
-					a.Do(state.UpdateMetrics, newMetrics)
+					a.Do(state.UpdateMetrics, clock.Now(), newMetrics)
 					a.Call(getDesiredResources, state, clock.Now()).
 						Equals(resForCU(2))
 				}
@@ -1074,10 +2563,18 @@ func TestBoundsChangeRequiresDownsale(t *testing.T) {
 
 	// Set metrics so the desired resources are still 2 CU
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.3,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.3,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 	// Check that we agree about desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -1130,8 +2627,9 @@ func TestBoundsChangeRequiresDownsale(t *testing.T) {
 	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(1))
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(1),
-		Migrate: nil,
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// And then, we shouldn't need to do anything else:
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1168,10 +2666,18 @@ func TestBoundsChangeRequiresUpscale(t *testing.T) {
 
 	// Set metrics so the desired resources are still 2 CU
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.3,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.3,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 	// Check that we agree about desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -1200,8 +2706,9 @@ func TestBoundsChangeRequiresUpscale(t *testing.T) {
 	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(3))
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(3),
-		Migrate: nil,
+		Permit:       resForCU(3),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// Do NeonVM request for the upscaling
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1263,10 +2770,18 @@ func TestFailedRequestRetry(t *testing.T) {
 	// Set metrics so that we should be trying to upscale
 	clockTick()
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.3,
-		MemoryUsageBytes: 0.0,
+		LoadAverage1Min:           0.3,
+		MemoryUsageBytes:          0.0,
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 
 	// We should be asking the scheduler for upscaling
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1298,8 +2813,9 @@ func TestFailedRequestRetry(t *testing.T) {
 	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(2))
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(2),
-		Migrate: nil,
+		Permit:       resForCU(2),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	// Now, after plugin request is successful, we should be making a request to NeonVM.
@@ -1382,8 +2898,9 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(3))
 	clockTick()
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(3),
-		Migrate: nil,
+		Permit:       resForCU(3),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 
 	clockTick()
@@ -1405,10 +2922,18 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 	clockTick()
 	// the actual metrics we got in the actual logs
 	metrics := core.Metrics{
-		LoadAverage1Min:  0.0,
-		MemoryUsageBytes: 150589570, // 143.6 MiB
+		LoadAverage1Min:           0.0,
+		MemoryUsageBytes:          150589570, // 143.6 MiB
+		MemoryStalledSecondsTotal: nil,
+		MemoryWaitingSecondsTotal: nil,
+		MemoryPressure:            nil,
+		CPU:                       nil,
+		HostContention:            nil,
+		Postgres:                  nil,
+		LFC:                       nil,
+		Gauges:                    nil,
 	}
-	a.Do(state.UpdateMetrics, metrics)
+	a.Do(state.UpdateMetrics, clock.Now(), metrics)
 
 	// nothing to do yet, until the existing vm-monitor request finishes
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1475,8 +3000,9 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 	clockTick()
 
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(2),
-		Migrate: nil,
+		Permit:       resForCU(2),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// Still waiting for NeonVM request to complete
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1500,8 +3026,9 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 	clockTick()
 
 	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
-		Permit:  resForCU(1),
-		Migrate: nil,
+		Permit:       resForCU(1),
+		Migrate:      nil,
+		DeniedReason: "",
 	})
 	// Nothing left to do
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -70,9 +70,10 @@ func CreateVmInfo(config InitialVmInfoConfig, opts ...VmInfoOpt) api.VmInfo {
 		Name:      "test",
 		Namespace: "test",
 		Cpu: api.VmCpuInfo{
-			Min: vmapi.MilliCPU(config.MinCU) * config.ComputeUnit.VCPU,
-			Use: vmapi.MilliCPU(config.MinCU) * config.ComputeUnit.VCPU,
-			Max: vmapi.MilliCPU(config.MaxCU) * config.ComputeUnit.VCPU,
+			Min:    vmapi.MilliCPU(config.MinCU) * config.ComputeUnit.VCPU,
+			Use:    vmapi.MilliCPU(config.MinCU) * config.ComputeUnit.VCPU,
+			Max:    vmapi.MilliCPU(config.MaxCU) * config.ComputeUnit.VCPU,
+			Pinned: 0,
 		},
 		Mem: api.VmMemInfo{
 			SlotSize: config.MemorySlotSize,
@@ -85,7 +86,16 @@ func CreateVmInfo(config InitialVmInfoConfig, opts ...VmInfoOpt) api.VmInfo {
 			AlwaysMigrate:        false,
 			ScalingConfig:        nil,
 			ScalingEnabled:       true,
+			MetricsTransport:     api.MetricsTransportPull,
+			Schedule:             nil,
+			Overrides:            nil,
+			ManualTargetCU:       nil,
+			Priority:             0,
+			Topology:             nil,
+			BurstCredits:         nil,
 		},
+		Paused:     false,
+		RunnerPort: 0,
 	}
 
 	for _, o := range opts {
@@ -158,3 +168,33 @@ func WithCurrentCU(cu uint16) VmInfoOpt {
 		vm.SetUsing(c.ComputeUnit.Mul(cu))
 	})
 }
+
+func WithSchedule(schedule api.ScalingSchedule) VmInfoOpt {
+	return vmInfoModifier(func(c InitialVmInfoConfig, vm *api.VmInfo) {
+		vm.Config.Schedule = &schedule
+	})
+}
+
+func WithOverrides(overrides api.ScalingOverrides) VmInfoOpt {
+	return vmInfoModifier(func(c InitialVmInfoConfig, vm *api.VmInfo) {
+		vm.Config.Overrides = &overrides
+	})
+}
+
+func WithBurstCredits(credits api.BurstCredits) VmInfoOpt {
+	return vmInfoModifier(func(c InitialVmInfoConfig, vm *api.VmInfo) {
+		vm.Config.BurstCredits = &credits
+	})
+}
+
+func WithManualTarget(cu uint16) VmInfoOpt {
+	return vmInfoModifier(func(c InitialVmInfoConfig, vm *api.VmInfo) {
+		vm.Config.ManualTargetCU = &cu
+	})
+}
+
+func WithPaused() VmInfoOpt {
+	return vmInfoModifier(func(c InitialVmInfoConfig, vm *api.VmInfo) {
+		vm.Paused = true
+	})
+}
@@ -0,0 +1,156 @@
+package core
+
+// A ScalingPolicy that combines the goals from several metrics as a weighted average, instead of
+// taking the largest like DefaultScalingPolicy does.
+//
+// Each term gives a goal number of compute units from a single metric and its target. The result is
+// the average of those goals, weighted by each term's weight, so that e.g. memory usage can count
+// for more than load average without either being able to force scaling on its own.
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tychoish/fun/erc"
+)
+
+// Metrics that a WeightedGoalTerm can use
+const (
+	// WeightedMetricLoad is the 1-minute load average. Its target is the fraction of each CU's
+	// CPUs, like api.ScalingConfig.LoadAverageFractionTarget.
+	WeightedMetricLoad = "load1"
+	// WeightedMetricMemory is the memory usage. Its target is the fraction of each CU's memory,
+	// like api.ScalingConfig.MemoryUsageFractionTarget.
+	WeightedMetricMemory = "memory"
+	// WeightedMetricConnections is the number of active Postgres backends. Its target is the number
+	// of active backends per CU. Requires Postgres metrics.
+	WeightedMetricConnections = "connections"
+	// WeightedMetricGauge is a gauge from the VM's metrics, named by WeightedGoalTerm.Gauge. Its
+	// target is the value of the gauge per CU.
+	WeightedMetricGauge = "gauge"
+)
+
+// WeightedGoalTerm is a single metric in a WeightedScalingPolicy
+type WeightedGoalTerm struct {
+	// Metric is one of the WeightedMetric* constants
+	Metric string `json:"metric"`
+	// Gauge is the name of the gauge in the VM's metrics, if Metric is WeightedMetricGauge
+	Gauge string `json:"gauge,omitempty"`
+	// Target gives the value of the metric that each compute unit should handle. Its meaning
+	// depends on Metric.
+	Target float64 `json:"target"`
+	// Weight gives how much the goal from this term counts for, relative to the others
+	Weight float64 `json:"weight"`
+}
+
+// ValidateWeightedGoal checks that the terms of a WeightedScalingPolicy are usable
+func ValidateWeightedGoal(terms []WeightedGoalTerm) error {
+	ec := &erc.Collector{}
+
+	erc.Whenf(ec, len(terms) == 0, "at least one term is required")
+	for i, t := range terms {
+		path := fmt.Sprintf("[%d]", i)
+		switch t.Metric {
+		case WeightedMetricLoad, WeightedMetricMemory, WeightedMetricConnections:
+			erc.Whenf(ec, t.Gauge != "", "%s can only be set if %s is %q", path+".gauge", path+".metric", WeightedMetricGauge)
+		case WeightedMetricGauge:
+			erc.Whenf(ec, t.Gauge == "", "%s must be set if %s is %q", path+".gauge", path+".metric", WeightedMetricGauge)
+		default:
+			ec.Add(fmt.Errorf("%s has unknown metric %q", path+".metric", t.Metric))
+		}
+		// NaN and infinities can't be decoded from JSON, so we only need to check the sign.
+		erc.Whenf(ec, t.Target <= 0, "%s must be set to value > 0", path+".target")
+		erc.Whenf(ec, t.Metric == WeightedMetricMemory && t.Target >= 1, "%s must be set to value < 1", path+".target")
+		erc.Whenf(ec, t.Weight <= 0, "%s must be set to value > 0", path+".weight")
+	}
+
+	return ec.Resolve()
+}
+
+// WeightedScalingPolicy is a ScalingPolicy that uses the weighted average of the goals from each
+// of its terms
+//
+// Terms whose metric isn't available (e.g. because Postgres metrics couldn't be fetched) are left
+// out, and the weights of the rest are used as-is. If none are available, the goal is unchanged
+// from the VM's current size.
+type WeightedScalingPolicy struct {
+	// Terms must be valid according to ValidateWeightedGoal
+	Terms []WeightedGoalTerm
+}
+
+func (p WeightedScalingPolicy) GoalCU(input ScalingPolicyInput) (uint32, string) {
+	var weightedSum, totalWeight float64
+	var largest string
+	var largestContribution float64
+
+	for _, t := range p.Terms {
+		cu, ok := t.goalCU(input)
+		if !ok || math.IsNaN(cu) || math.IsInf(cu, 0) {
+			continue
+		}
+		// A negative gauge would otherwise count against the other terms, so treat it as not
+		// needing any compute units.
+		cu = max(cu, 0)
+
+		weightedSum += cu * t.Weight
+		totalWeight += t.Weight
+
+		if contribution := cu * t.Weight; largest == "" || contribution > largestContribution {
+			largest, largestContribution = t.name(), contribution
+		}
+	}
+
+	if totalWeight == 0 {
+		return usingCU(input), "weighted goal (no metrics available)"
+	}
+
+	goalCU := uint32(math.Round(weightedSum / totalWeight))
+	return goalCU, fmt.Sprintf("weighted goal (mostly %s)", largest)
+}
+
+// GaugeNames returns the names of the gauges used by the terms, which must be read into
+// Metrics.Gauges
+func (p WeightedScalingPolicy) GaugeNames() []string {
+	var names []string
+	for _, t := range p.Terms {
+		if t.Metric == WeightedMetricGauge {
+			names = append(names, t.Gauge)
+		}
+	}
+	return names
+}
+
+// goalCU returns the fractional number of compute units that the term alone would want, or false if
+// its metric isn't available
+func (t WeightedGoalTerm) goalCU(input ScalingPolicyInput) (_ float64, ok bool) {
+	m := input.Metrics
+
+	switch t.Metric {
+	case WeightedMetricLoad:
+		return float64(m.LoadAverage1Min) / t.Target / input.ComputeUnit.VCPU.AsFloat64(), true
+	case WeightedMetricMemory:
+		return float64(m.MemoryUsageBytes) / t.Target / input.ComputeUnit.Mem.AsFloat64(), true
+	case WeightedMetricConnections:
+		if m.Postgres == nil {
+			return 0, false
+		}
+		return float64(m.Postgres.ActiveBackends) / t.Target, true
+	case WeightedMetricGauge:
+		value, ok := m.Gauges[t.Gauge]
+		if !ok {
+			return 0, false
+		}
+		return value / t.Target, true
+	default:
+		// already checked by ValidateWeightedGoal
+		return 0, false
+	}
+}
+
+// name returns the name of the term's metric, for the reason given with the goal
+func (t WeightedGoalTerm) name() string {
+	if t.Metric == WeightedMetricGauge {
+		return t.Gauge
+	}
+	return t.Metric
+}
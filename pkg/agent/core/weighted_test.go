@@ -0,0 +1,144 @@
+package core_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	helpers "github.com/neondatabase/autoscaling/pkg/agent/core/testhelpers"
+)
+
+func TestValidateWeightedGoal(t *testing.T) {
+	term := func(metric, gauge string, target, weight float64) core.WeightedGoalTerm {
+		return core.WeightedGoalTerm{Metric: metric, Gauge: gauge, Target: target, Weight: weight}
+	}
+
+	cases := []struct {
+		name  string
+		terms []core.WeightedGoalTerm
+		valid bool
+	}{
+		{"Valid", []core.WeightedGoalTerm{
+			term(core.WeightedMetricLoad, "", 0.9, 1),
+			term(core.WeightedMetricMemory, "", 0.75, 2),
+			term(core.WeightedMetricConnections, "", 20, 0.5),
+			term(core.WeightedMetricGauge, "queue_depth", 100, 1),
+		}, true},
+		{"Empty", nil, false},
+		{"UnknownMetric", []core.WeightedGoalTerm{term("disk", "", 1, 1)}, false},
+		{"MissingGauge", []core.WeightedGoalTerm{term(core.WeightedMetricGauge, "", 1, 1)}, false},
+		{"GaugeWithoutGaugeMetric", []core.WeightedGoalTerm{term(core.WeightedMetricLoad, "queue_depth", 1, 1)}, false},
+		{"ZeroTarget", []core.WeightedGoalTerm{term(core.WeightedMetricLoad, "", 0, 1)}, false},
+		{"MemoryTargetTooLarge", []core.WeightedGoalTerm{term(core.WeightedMetricMemory, "", 1, 1)}, false},
+		{"ZeroWeight", []core.WeightedGoalTerm{term(core.WeightedMetricLoad, "", 0.9, 0)}, false},
+		{"NegativeWeight", []core.WeightedGoalTerm{term(core.WeightedMetricLoad, "", 0.9, -1)}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := core.ValidateWeightedGoal(c.terms)
+			if c.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestWeightedScalingPolicy(t *testing.T) {
+	metrics := func(load float32, memCU float32, pg *core.PostgresMetrics, gauges map[string]float64) core.Metrics {
+		return core.Metrics{
+			LoadAverage1Min:           load,
+			MemoryUsageBytes:          memCU * float32(DefaultComputeUnit.Mem),
+			MemoryStalledSecondsTotal: nil,
+			MemoryWaitingSecondsTotal: nil,
+			MemoryPressure:            nil,
+			CPU:                       nil,
+			HostContention:            nil,
+			Postgres:                  pg,
+			LFC:                       nil,
+			Gauges:                    gauges,
+		}
+	}
+	input := func(m core.Metrics) core.ScalingPolicyInput {
+		return core.ScalingPolicyInput{
+			Metrics:     m,
+			History:     nil,
+			VM:          helpers.CreateVmInfo(DefaultInitialStateConfig.VM, helpers.WithCurrentCU(2)),
+			Config:      DefaultInitialStateConfig.Core.DefaultScalingConfig,
+			ComputeUnit: DefaultComputeUnit,
+			Now:         time.Now(),
+		}
+	}
+
+	policy := core.WeightedScalingPolicy{Terms: []core.WeightedGoalTerm{
+		// load of 0.5 per CU (0.25 vCPU, with a target of 2) -> load / 0.5
+		{Metric: core.WeightedMetricLoad, Gauge: "", Target: 2, Weight: 1},
+		// memory usage of half of each CU -> (usage in CU) * 2
+		{Metric: core.WeightedMetricMemory, Gauge: "", Target: 0.5, Weight: 3},
+		{Metric: core.WeightedMetricConnections, Gauge: "", Target: 10, Weight: 1},
+		{Metric: core.WeightedMetricGauge, Gauge: "queue_depth", Target: 100, Weight: 1},
+	}}
+
+	pg := &core.PostgresMetrics{ActiveBackends: 60, TransactionsPerSecond: 0, BufferCacheHitRatio: nil}
+
+	cases := []struct {
+		name     string
+		metrics  core.Metrics
+		expected uint32
+		reason   string
+	}{
+		{
+			// load -> 2 CU, memory -> 6 CU, connections -> 6 CU, gauge -> 2 CU
+			// (2*1 + 6*3 + 6*1 + 2*1) / 6 = 4.67
+			name:     "AllTerms",
+			metrics:  metrics(1, 3, pg, map[string]float64{"queue_depth": 200}),
+			expected: 5,
+			reason:   "weighted goal (mostly memory)",
+		},
+		{
+			// Without Postgres metrics or the gauge, only load and memory are used:
+			// (2*1 + 6*3) / 4 = 5
+			name:     "MissingTerms",
+			metrics:  metrics(1, 3, nil, nil),
+			expected: 5,
+			reason:   "weighted goal (mostly memory)",
+		},
+		{
+			// A negative gauge doesn't reduce the goal by more than if it were zero:
+			// (4*1 + 0*3 + 0*1 + 0*1) / 6 = 0.67
+			name:     "NegativeGauge",
+			metrics:  metrics(2, 0, &core.PostgresMetrics{ActiveBackends: 0, TransactionsPerSecond: 0, BufferCacheHitRatio: nil}, map[string]float64{"queue_depth": -500}),
+			expected: 1,
+			reason:   "weighted goal (mostly load1)",
+		},
+		{
+			// NaN values are ignored, as if the gauge were missing: (4*1 + 0*3) / 4 = 1
+			name:     "NaNGauge",
+			metrics:  metrics(2, 0, nil, map[string]float64{"queue_depth": math.NaN()}),
+			expected: 1,
+			reason:   "weighted goal (mostly load1)",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cu, reason := policy.GoalCU(input(c.metrics))
+			assert.Equal(t, c.expected, cu)
+			assert.Equal(t, c.reason, reason)
+		})
+	}
+
+	// If none of the metrics are available, the VM stays at its current size
+	gaugeOnly := core.WeightedScalingPolicy{Terms: []core.WeightedGoalTerm{
+		{Metric: core.WeightedMetricGauge, Gauge: "queue_depth", Target: 100, Weight: 1},
+	}}
+	cu, reason := gaugeOnly.GoalCU(input(metrics(1, 1, nil, nil)))
+	assert.Equal(t, uint32(2), cu)
+	assert.Equal(t, "weighted goal (no metrics available)", reason)
+	assert.Equal(t, []string{"queue_depth"}, gaugeOnly.GaugeNames())
+}
@@ -0,0 +1,53 @@
+package agent
+
+// Tracking of the activity of the database inside each VM, from the metrics that the Runner
+// fetches, so that billing can count idle databases as inactive. See billing/activetime.go.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+var _ billing.DatabaseActivitySource = (*agentState)(nil)
+
+// recordDatabaseActivity updates the VM's database activity from its latest metrics
+//
+// The database is active if it has any active backends, or committed any transactions since the
+// previous metrics.
+func (s *lockedPodStatus) recordDatabaseActivity(metrics core.Metrics) {
+	if metrics.Postgres == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.databaseMetricsSeen = true
+	if metrics.Postgres.ActiveBackends > 0 || metrics.Postgres.TransactionsPerSecond > 0 {
+		now := time.Now()
+		s.lastDatabaseActivityAt = &now
+	}
+}
+
+// LastDatabaseActivity implements billing.DatabaseActivitySource
+func (s *agentState) LastDatabaseActivity() map[util.NamespacedName]*time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	activity := make(map[util.NamespacedName]*time.Time)
+	for _, pod := range s.pods {
+		func() {
+			pod.status.mu.Lock()
+			defer pod.status.mu.Unlock()
+
+			if pod.status.databaseMetricsSeen {
+				// ok to share the pointer, because it's replaced instead of updated
+				activity[pod.status.vmInfo.NamespacedName()] = pod.status.lastDatabaseActivityAt
+			}
+		}()
+	}
+	return activity
+}
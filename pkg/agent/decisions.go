@@ -0,0 +1,148 @@
+package agent
+
+// Recording of scaling decisions, so that it's possible to later find out why a VM was (or wasn't)
+// resized.
+//
+// Each VM's recent decisions are kept in a bounded in-memory history, which is preserved across
+// Runner restarts and served by the dump-state server. If enabled, each decision is also recorded
+// as a Kubernetes Event on the VM.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
+)
+
+// decisionHistory is a fixed-size ring buffer of the most recent decisions for a VM
+type decisionHistory struct {
+	mu sync.Mutex
+	// decisions has a length equal to the number of decisions stored, and capacity equal to the
+	// maximum.
+	decisions []executor.Decision
+	// next gives the index in decisions that the next decision will be stored at, once it's full
+	next int
+}
+
+func newDecisionHistory(size uint) *decisionHistory {
+	return &decisionHistory{
+		mu:        sync.Mutex{},
+		decisions: make([]executor.Decision, 0, size),
+		next:      0,
+	}
+}
+
+func (h *decisionHistory) add(decision executor.Decision) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.decisions) < cap(h.decisions) {
+		h.decisions = append(h.decisions, decision)
+		return
+	}
+
+	h.decisions[h.next] = decision
+	h.next = (h.next + 1) % len(h.decisions)
+}
+
+// list returns a copy of the stored decisions, oldest first
+func (h *decisionHistory) list() []executor.Decision {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]executor.Decision, 0, len(h.decisions))
+	list = append(list, h.decisions[h.next:]...)
+	list = append(list, h.decisions[:h.next]...)
+	return list
+}
+
+// VMDecisions is the list of recent decisions for a single VM, as served by the dump-state server
+type VMDecisions struct {
+	VM        util.NamespacedName `json:"vm"`
+	Pod       util.NamespacedName `json:"pod"`
+	Decisions []executor.Decision `json:"decisions"`
+}
+
+// makeEventRecorder returns a record.EventRecorder that sends Events from the autoscaler-agent on
+// the given node
+func makeEventRecorder(kubeClient *kubernetes.Clientset, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: kubeClient.CoreV1().Events(""),
+	})
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+		Component: "autoscaler-agent",
+		Host:      nodeName,
+	})
+}
+
+// recordDecision stores the decision in the VM's history and, if enabled, records it as an Event
+// on the VM and sends it to the webhook.
+func (r *Runner) recordDecision(decision executor.Decision) {
+	_, span := r.global.tracer.Start(
+		r.traceContext(context.Background()), "agent.scaling.decision",
+		trace.WithAttributes(r.vmTraceAttributes()...),
+		trace.WithAttributes(
+			attribute.String("outcome", string(decision.Outcome)),
+			attribute.String("reason", decision.Reason),
+			attribute.String("scheduler.verdict", string(decision.SchedulerVerdict)),
+			attribute.Float64("previous.cu", decision.PreviousCU),
+			attribute.Float64("target.cu", decision.TargetCU),
+		),
+	)
+	if decision.Error != "" {
+		tracing.RecordError(span, errors.New(decision.Error))
+	}
+	span.End()
+
+	if r.decisions != nil {
+		r.decisions.add(decision)
+	}
+
+	if r.global.webhook != nil {
+		r.status.mu.Lock()
+		endpointID := r.status.endpointID
+		r.status.mu.Unlock()
+
+		if notification := makeWebhookNotification(r.vmName, endpointID, decision); notification != nil {
+			r.global.webhook.enqueue(*notification)
+		}
+	}
+
+	r.checkRepeatedDenials(decision)
+
+	if c := r.global.config.Decisions; c == nil || !c.KubernetesEvents {
+		return
+	}
+	recorder := r.global.eventRecorder
+	ref := r.vmObjectReference()
+
+	eventType := corev1.EventTypeNormal
+	if decision.Outcome != executor.DecisionApplied {
+		eventType = corev1.EventTypeWarning
+	}
+
+	message := fmt.Sprintf(
+		"%.2f CU -> %.2f CU: %s (scheduler: %s)",
+		decision.PreviousCU, decision.TargetCU, decision.Reason, decision.SchedulerVerdict,
+	)
+	if decision.Error != "" {
+		message = fmt.Sprintf("%s: %s", message, decision.Error)
+	}
+
+	recorder.Event(ref, eventType, fmt.Sprintf("Scaling%s", decision.Outcome), message)
+}
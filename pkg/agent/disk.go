@@ -0,0 +1,184 @@
+package agent
+
+// Growing VMs' root disks as they fill up
+//
+// NeonVM root disks live in the runner pod's ephemeral storage, so there are no
+// PersistentVolumeClaims to expand. Instead, we increase the VM's .spec.guest.rootDisk.size, and
+// the NeonVM controller grows the disk of the running VM to match. Inside the VM, a udev rule then
+// grows the filesystem.
+//
+// Usage is read from the same host metrics that are used for scaling CPU and memory. Disks are only
+// ever grown, never shrunk.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/patch"
+)
+
+// Values of the "outcome" label on the disk resizes metric
+const (
+	diskResizeOutcomeOK      = "ok"
+	diskResizeOutcomeAtMax   = "at-max"
+	diskResizeOutcomeFailed  = "failed"
+	diskResizeOutcomeGrowing = "growing"
+)
+
+// diskSizeAlignment is the granularity that new disk sizes are rounded up to
+const diskSizeAlignment = api.Bytes(1 << 20) // 1 MiB
+
+// diskResizeLoop periodically checks the usage of the VM's root filesystem, growing the disk if it's
+// above the configured threshold.
+func (r *Runner) diskResizeLoop(ctx context.Context, logger *zap.Logger) {
+	config := r.global.config.Disk
+
+	ticker := time.NewTicker(time.Second * time.Duration(config.CheckEverySeconds))
+	defer ticker.Stop()
+
+	var lastResize time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		minInterval := time.Second * time.Duration(config.MinIntervalSeconds)
+		if !lastResize.IsZero() && time.Since(lastResize) < minInterval {
+			continue
+		}
+
+		resized, err := r.checkDiskUsage(ctx, logger)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			logger.Error("Failed to check root disk usage", zap.Error(err))
+			continue
+		}
+		if resized {
+			lastResize = time.Now()
+		}
+	}
+}
+
+// checkDiskUsage makes a single check of the VM's root filesystem usage, growing the disk if it's
+// needed. It returns whether the disk was grown.
+func (r *Runner) checkDiskUsage(ctx context.Context, logger *zap.Logger) (resized bool, _ error) {
+	config := r.global.config.Disk
+	metricsConfig := &r.global.config.Metrics
+
+	timeout := time.Second * time.Duration(metricsConfig.RequestTimeoutSeconds)
+	body, err := r.fetchVMMetrics(ctx, logger, timeout, metricsConfig.Port, "/metrics")
+	if err != nil {
+		return false, err
+	}
+
+	filesystemLabels := config.FilesystemLabels
+	if len(filesystemLabels) == 0 {
+		filesystemLabels = core.DefaultFilesystemLabels
+	}
+	usage, err := core.ReadDiskUsage(core.ParsePromOutput(body), metricsConfig.LoadMetricPrefix, filesystemLabels)
+	if err != nil {
+		return false, fmt.Errorf("Error reading disk usage from prometheus output: %w", err)
+	}
+
+	if usage.UsedFraction() < config.UsageThreshold {
+		return false, nil
+	}
+
+	timeout = time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	vm, err := r.global.vmClient.NeonvmV1().VirtualMachines(r.vmName.Namespace).
+		Get(requestCtx, r.vmName.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("Error getting VM: %w", err)
+	}
+
+	// The spec gives the size that's been requested, which may not have been applied yet. If it
+	// hasn't, wait for that to happen before asking for more.
+	var current api.Bytes
+	if !vm.Spec.Guest.RootDisk.Size.IsZero() {
+		current = api.Bytes(vm.Spec.Guest.RootDisk.Size.Value())
+	} else if vm.Status.RootDiskSize != nil {
+		current = api.Bytes(vm.Status.RootDiskSize.Value())
+	} else {
+		current = api.Bytes(usage.TotalBytes)
+	}
+	if vm.Status.RootDiskSize != nil && api.Bytes(vm.Status.RootDiskSize.Value()) < current {
+		r.global.metrics.diskResizes.WithLabelValues(diskResizeOutcomeGrowing).Inc()
+		logger.Info("Root disk is above usage threshold, but a previous resize is still in progress")
+		return false, nil
+	}
+
+	target := nextDiskSize(current, config)
+	if target <= current {
+		r.global.metrics.diskResizes.WithLabelValues(diskResizeOutcomeAtMax).Inc()
+		logger.Warn(
+			"Root disk is above usage threshold, but already at the maximum size",
+			zap.Float64("usedFraction", usage.UsedFraction()),
+			zap.Any("size", current),
+		)
+		return false, nil
+	}
+
+	logger.Info(
+		"Growing root disk",
+		zap.Float64("usedFraction", usage.UsedFraction()),
+		zap.Any("current", current),
+		zap.Any("target", target),
+	)
+
+	patches := []patch.Operation{{
+		// Only apply the patch if the VM hasn't changed since we read it, so that we don't race
+		// with anything else changing the size.
+		Op:    patch.OpTest,
+		Path:  "/metadata/resourceVersion",
+		Value: vm.ResourceVersion,
+	}, {
+		Op:    patch.OpAdd,
+		Path:  "/spec/guest/rootDisk/size",
+		Value: target.ToResourceQuantity(),
+	}}
+	patchPayload, err := json.Marshal(patches)
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
+	}
+
+	err = r.patchVM(ctx, vmPatchDisk, ktypes.JSONPatchType, patchPayload)
+	if err != nil {
+		r.global.metrics.diskResizes.WithLabelValues(diskResizeOutcomeFailed).Inc()
+		return false, fmt.Errorf("Error patching VM root disk size: %w", err)
+	}
+
+	r.global.metrics.diskResizes.WithLabelValues(diskResizeOutcomeOK).Inc()
+	r.global.metrics.diskResizeBytes.Add((target - current).AsFloat64())
+	return true, nil
+}
+
+// nextDiskSize returns the size that a disk with the given size should be grown to, which is equal
+// to the current size if it can't be grown any further
+func nextDiskSize(current api.Bytes, config *DiskConfig) api.Bytes {
+	growth := util.Max(api.Bytes(math.Ceil(current.AsFloat64()*config.GrowthFraction)), config.MinGrowth)
+
+	target := current + growth
+	if rem := target % diskSizeAlignment; rem != 0 {
+		target += diskSizeAlignment - rem
+	}
+
+	return util.Max(current, util.Min(target, config.MaxSize))
+}
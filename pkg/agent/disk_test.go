@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestNextDiskSize(t *testing.T) {
+	const (
+		MiB = api.Bytes(1 << 20)
+		GiB = api.Bytes(1 << 30)
+	)
+
+	config := &DiskConfig{ //nolint:exhaustruct // only the sizing fields are used
+		GrowthFraction: 0.25,
+		MinGrowth:      GiB,
+		MaxSize:        20 * GiB,
+	}
+
+	cases := []struct {
+		name     string
+		current  api.Bytes
+		expected api.Bytes
+	}{
+		// 25% of 2 GiB is less than the minimum growth
+		{name: "min-growth", current: 2 * GiB, expected: 3 * GiB},
+		{name: "fraction", current: 8 * GiB, expected: 10 * GiB},
+		// 10 GiB + 1 byte, grown by 25%, is rounded up to the next MiB
+		{name: "aligned", current: 10*GiB + 1, expected: 12*GiB + 513*MiB},
+		{name: "capped", current: 18 * GiB, expected: 20 * GiB},
+		{name: "at-max", current: 20 * GiB, expected: 20 * GiB},
+		// Disks that are already too big are never shrunk
+		{name: "above-max", current: 30 * GiB, expected: 30 * GiB},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, nextDiskSize(c.current, config))
+		})
+	}
+}
@@ -22,7 +22,7 @@ import (
 
 const (
 	MinMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_0
-	MaxMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_0
+	MaxMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_1
 )
 
 // This struct represents the result of a dispatcher.Call. Because the SignalSender
@@ -31,16 +31,20 @@ const (
 // is readable. For example, the caller of dispatcher.call(HealthCheck { .. })
 // should only read the healthcheck field.
 type MonitorResult struct {
-	Result       *api.DownscaleResult
-	Confirmation *api.UpscaleConfirmation
-	HealthCheck  *api.HealthCheck
+	Result          *api.DownscaleResult
+	Confirmation    *api.UpscaleConfirmation
+	HealthCheck     *api.HealthCheck
+	FileCacheResult *api.FileCacheResizeResult
+	RestartResult   *api.PostgresRestartResult
 }
 
 // The Dispatcher is the main object managing the websocket connection to the
 // monitor. For more information on the protocol, see pkg/api/types.go
 type Dispatcher struct {
-	// The underlying connection we are managing
+	// The underlying connection we are managing. It's only replaced when resuming the session.
 	conn *websocket.Conn
+	// addr is the address of the vm-monitor, for reconnecting when resuming the session
+	addr string
 
 	// When someone sends a message, the dispatcher will attach a transaction id
 	// to it so that it knows when a response is back. When it receives a message
@@ -49,9 +53,15 @@ type Dispatcher struct {
 	waiters map[uint64]util.SignalSender[waiterResult]
 
 	// lock guards mutating the waiters, exitError, and (closing) exitSignal field.
-	// conn and lastTransactionID are all thread safe.
-	// runner, exit, and protoVersion are never modified.
+	// lastTransactionID is thread safe.
+	// runner, exit, addr, protoVersion, capabilities, and session are never modified.
 	lock sync.Mutex
+	// writeLock is held while sending each message, so that messages are written in the order of
+	// their sequence numbers, and while replacing conn. It may be acquired while holding lock, but
+	// not the other way around.
+	writeLock sync.Mutex
+	// connLock guards conn. No other locks may be acquired while holding it.
+	connLock sync.Mutex
 
 	// The runner that this dispatcher is part of
 	runner *Runner
@@ -70,6 +80,13 @@ type Dispatcher struct {
 	lastTransactionID atomic.Uint64
 
 	protoVersion api.MonitorProtoVersion
+	// capabilities are the optional features supported by both us and the vm-monitor. Always zero
+	// if protoVersion is less than v1.1.
+	capabilities api.MonitorCapabilities
+
+	// session tracks what's needed to resume the session after the connection drops. It's nil if
+	// the session can't be resumed, i.e. if capabilities doesn't have api.MonitorCapResume.
+	session *monitorSession
 }
 
 type waiterResult struct {
@@ -85,6 +102,7 @@ func NewDispatcher(
 	addr string,
 	runner *Runner,
 	sendUpscaleRequested func(request api.MoreResources, withLock func()),
+	sendMemoryPressure func(signal api.MemoryPressureSignal),
 ) (_finalDispatcher *Dispatcher, _ error) {
 	// Create a new root-level context for this Dispatcher so that we can cancel if need be
 	ctx, cancelRootContext := context.WithCancel(ctx)
@@ -95,22 +113,49 @@ func NewDispatcher(
 		}
 	}()
 
+	// MonitorHandshake is a superset of the VersionRange expected by v1.0 vm-monitors, so it's ok
+	// to send it unconditionally.
+	handshake := api.MonitorHandshake{
+		Min:          MinMonitorProtocolVersion,
+		Max:          MaxMonitorProtocolVersion,
+		Capabilities: api.AllMonitorCapabilities,
+		Resume:       nil,
+	}
+	if runner.global.config.Monitor.ResumeTimeoutSeconds == 0 {
+		handshake.Capabilities &^= api.MonitorCapResume
+	}
+
 	connectTimeout := time.Second * time.Duration(runner.global.config.Monitor.ConnectionTimeoutSeconds)
-	conn, protoVersion, err := connectToMonitor(ctx, logger, addr, connectTimeout)
+	conn, resp, capabilities, err := connectToMonitor(ctx, logger, addr, connectTimeout, handshake)
 	if err != nil {
 		return nil, err
 	}
 
+	var session *monitorSession
+	if capabilities.Has(api.MonitorCapResume) {
+		if resp.SessionID != "" {
+			session = newMonitorSession(resp.SessionID)
+		} else {
+			logger.Warn("vm-monitor agreed to resume capability without a session ID, disabling it")
+			capabilities &^= api.MonitorCapResume
+		}
+	}
+
 	disp := &Dispatcher{
 		conn:              conn,
+		addr:              addr,
 		waiters:           make(map[uint64]util.SignalSender[waiterResult]),
 		runner:            runner,
 		lock:              sync.Mutex{},
+		writeLock:         sync.Mutex{},
+		connLock:          sync.Mutex{},
 		exit:              nil, // set below
 		exitError:         nil,
 		exitSignal:        make(chan struct{}),
 		lastTransactionID: atomic.Uint64{}, // Note: initialized to 0, so it's even, as required.
-		protoVersion:      *protoVersion,
+		protoVersion:      resp.Version,
+		capabilities:      capabilities,
+		session:           session,
 	}
 	disp.exit = func(status websocket.StatusCode, err error, transformErr func(error) error) {
 		disp.lock.Lock()
@@ -143,7 +188,7 @@ func NewDispatcher(
 		//
 		// This *potentially* runs us into race issues, but those are probably less bad to deal
 		// with, tbh.
-		go disp.conn.Close(status, closeReason)
+		go disp.currentConn().Close(status, closeReason)
 	}
 
 	go func() {
@@ -153,7 +198,7 @@ func NewDispatcher(
 
 	msgHandlerLogger := logger.Named("message-handler")
 	runner.spawnBackgroundWorker(ctx, msgHandlerLogger, "vm-monitor message handler", func(c context.Context, l *zap.Logger) {
-		disp.run(c, l, sendUpscaleRequested)
+		disp.run(c, l, sendUpscaleRequested, sendMemoryPressure)
 	})
 	runner.spawnBackgroundWorker(ctx, logger.Named("health-checks"), "vm-monitor health checks", func(ctx context.Context, logger *zap.Logger) {
 		timeout := time.Second * time.Duration(runner.global.config.Monitor.ResponseTimeoutSeconds)
@@ -204,7 +249,8 @@ func connectToMonitor(
 	logger *zap.Logger,
 	addr string,
 	timeout time.Duration,
-) (_ *websocket.Conn, _ *api.MonitorProtoVersion, finalErr error) {
+	handshake api.MonitorHandshake,
+) (_ *websocket.Conn, _ *api.MonitorProtocolResponse, _ api.MonitorCapabilities, finalErr error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
@@ -214,7 +260,7 @@ func connectToMonitor(
 	// Doing so causes memory bugs.
 	c, _, err := websocket.Dial(ctx, addr, nil) //nolint:bodyclose // see comment above
 	if err != nil {
-		return nil, nil, fmt.Errorf("error establishing websocket connection to %s: %w", addr, err)
+		return nil, nil, 0, fmt.Errorf("error establishing websocket connection to %s: %w", addr, err)
 	}
 
 	// If we return early, make sure we close the websocket
@@ -228,16 +274,17 @@ func connectToMonitor(
 		}
 	}()
 
-	versionRange := api.VersionRange[api.MonitorProtoVersion]{
-		Min: MinMonitorProtocolVersion,
-		Max: MaxMonitorProtocolVersion,
-	}
-	logger.Info("Sending protocol version range", zap.Any("range", versionRange))
+	logger.Info(
+		"Sending protocol version range",
+		zap.Any("range", handshake.Range()),
+		zap.Stringer("capabilities", handshake.Capabilities),
+		zap.Any("resume", handshake.Resume),
+	)
 
 	// Figure out protocol version
-	err = wsjson.Write(ctx, c, versionRange)
+	err = wsjson.Write(ctx, c, handshake)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error sending protocol range to monitor: %w", err)
+		return nil, nil, 0, fmt.Errorf("error sending protocol range to monitor: %w", err)
 	}
 
 	logger.Info("Reading monitor version response")
@@ -246,18 +293,35 @@ func connectToMonitor(
 	if err != nil {
 		logger.Error("Failed to read monitor response", zap.Error(err))
 		failureReason = websocket.StatusProtocolError
-		return nil, nil, fmt.Errorf("Error reading vm-monitor response during protocol handshake: %w", err)
+		return nil, nil, 0, fmt.Errorf("Error reading vm-monitor response during protocol handshake: %w", err)
 	}
 
 	logger.Info("Got monitor version response", zap.Any("response", resp))
 	if resp.Error != nil {
 		logger.Error("Got error response from vm-monitor", zap.Any("response", resp), zap.String("error", *resp.Error))
 		failureReason = websocket.StatusProtocolError
-		return nil, nil, fmt.Errorf("Monitor returned error during protocol handshake: %q", *resp.Error)
+		return nil, nil, 0, fmt.Errorf("Monitor returned error during protocol handshake: %q", *resp.Error)
+	}
+
+	// Capabilities are only exchanged from v1.1 onwards. Before that, a vm-monitor that happened to
+	// send them shouldn't enable anything.
+	var capabilities api.MonitorCapabilities
+	if resp.Version.HasCapabilities() {
+		capabilities = handshake.Capabilities & resp.Capabilities
 	}
 
-	logger.Info("negotiated protocol version with monitor", zap.Any("response", resp), zap.String("version", resp.Version.String()))
-	return c, &resp.Version, nil
+	logger.Info(
+		"negotiated protocol version with monitor",
+		zap.Any("response", resp),
+		zap.String("version", resp.Version.String()),
+		zap.Stringer("capabilities", capabilities),
+	)
+	return c, &resp, capabilities, nil
+}
+
+// Capabilities returns the optional features that were negotiated with the vm-monitor
+func (disp *Dispatcher) Capabilities() api.MonitorCapabilities {
+	return disp.capabilities
 }
 
 // ExitSignal returns a channel that is closed when the Dispatcher is no longer running
@@ -294,16 +358,46 @@ func (disp *Dispatcher) lenWaiters() int {
 // Send a message down the connection. Only call this method with types that
 // SerializeMonitorMessage can handle.
 func (disp *Dispatcher) send(ctx context.Context, logger *zap.Logger, id uint64, message any) error {
-	data, err := api.SerializeMonitorMessage(message, id)
+	return disp.sendMessage(ctx, logger, id, message, false)
+}
+
+// sendMessage implements send, additionally keeping requests that expect a response so that they can
+// be sent again if the session is resumed before they're responded to. Other messages are kept
+// until the vm-monitor acknowledges them.
+func (disp *Dispatcher) sendMessage(
+	ctx context.Context,
+	logger *zap.Logger,
+	id uint64,
+	message any,
+	isRequest bool,
+) error {
+	disp.writeLock.Lock()
+	defer disp.writeLock.Unlock()
+
+	var data []byte
+	var err error
+	if disp.session != nil {
+		data, err = disp.session.serialize(message, id, isRequest)
+	} else {
+		data, err = api.SerializeMonitorMessage(message, id)
+	}
 	if err != nil {
 		return fmt.Errorf("error serializing message: %w", err)
 	}
+
 	// wsjson.Write serializes whatever is passed in, and go serializes []byte
 	// by base64 encoding it, so use RawMessage to avoid serializing to []byte
 	// (done by SerializeMonitorMessage), and then base64 encoding again
 	raw := json.RawMessage(data)
 	logger.Info("sending message to monitor", zap.ByteString("message", raw))
-	return wsjson.Write(ctx, disp.conn, &raw)
+	return wsjson.Write(ctx, disp.currentConn(), &raw)
+}
+
+// currentConn returns the connection that messages are currently read from and written to
+func (disp *Dispatcher) currentConn() *websocket.Conn {
+	disp.connLock.Lock()
+	defer disp.connLock.Unlock()
+	return disp.conn
 }
 
 // registerWaiter registers a util.SignalSender to get notified when a
@@ -318,7 +412,18 @@ func (disp *Dispatcher) registerWaiter(id uint64, sender util.SignalSender[waite
 func (disp *Dispatcher) unregisterWaiter(id uint64) {
 	disp.lock.Lock()
 	defer disp.lock.Unlock()
+	disp.deleteWaiter(id)
+}
+
+// deleteWaiter deletes the waiter for the id, along with the request that it's waiting on, if it
+// would be sent again on resuming the session.
+//
+// disp.lock must be held.
+func (disp *Dispatcher) deleteWaiter(id uint64) {
 	delete(disp.waiters, id)
+	if disp.session != nil {
+		disp.session.answered(id)
+	}
 }
 
 // Make a request to the monitor and wait for a response. The value passed as message must be a
@@ -343,8 +448,12 @@ func (disp *Dispatcher) Call(
 	// register the waiter *before* sending, so that we avoid a potential race where we'd get a
 	// reply to the message before being ready to receive it.
 	disp.registerWaiter(id, sender)
-	err := disp.send(ctx, logger, id, message)
-	if err != nil {
+	err := disp.sendMessage(ctx, logger, id, message, true)
+	if err != nil && disp.willResend(id) {
+		// The connection probably dropped. The request will be sent again if the session is
+		// resumed, so keep waiting for the response.
+		logger.Warn("failed to send message, waiting to send it again after resuming", zap.Any("message", message), zap.Error(err))
+	} else if err != nil {
 		logger.Error("failed to send message", zap.Any("message", message), zap.Error(err))
 		disp.unregisterWaiter(id)
 		status = "[error: failed to send]"
@@ -387,8 +496,11 @@ func extractField[T any](data map[string]interface{}, key string) (*T, error) {
 
 type messageHandlerFuncs struct {
 	handleUpscaleRequest      func(api.UpscaleRequest)
+	handleMemoryPressure      func(api.MemoryPressureSignal)
 	handleUpscaleConfirmation func(api.UpscaleConfirmation, uint64) error
 	handleDownscaleResult     func(api.DownscaleResult, uint64) error
+	handleFileCacheResult     func(api.FileCacheResizeResult, uint64) error
+	handleRestartResult       func(api.PostgresRestartResult, uint64) error
 	handleMonitorError        func(api.InternalError, uint64) error
 	handleHealthCheck         func(api.HealthCheck, uint64) error
 }
@@ -410,8 +522,8 @@ func (disp *Dispatcher) HandleMessage(
 	// []byte, it would base64 encode it as part of deserialization. json.RawMessage
 	// avoids this, and we manually deserialize later
 	var message json.RawMessage
-	if err := wsjson.Read(ctx, disp.conn, &message); err != nil {
-		return fmt.Errorf("Error receiving message: %w", err)
+	if err := wsjson.Read(ctx, disp.currentConn(), &message); err != nil {
+		return &receiveError{err: err}
 	}
 	logger.Info("(pre-decoding): received a message", zap.ByteString("message", message))
 
@@ -433,6 +545,18 @@ func (disp *Dispatcher) HandleMessage(
 	}
 	id := uint64(*f)
 
+	// With a resumable session, messages may be replayed by the vm-monitor after resuming, so we
+	// must ignore any that we've already seen.
+	if seq, ok := unstructured["seq"].(float64); ok && !disp.markReceived(uint64(seq)) {
+		logger.Info("Ignoring message that was already received", zap.Uint64("seq", uint64(seq)))
+		return nil
+	}
+	// The vm-monitor may also acknowledge the messages it's received from us, so that we don't
+	// need to keep them to send again.
+	if ack, ok := unstructured["ack"].(float64); ok {
+		disp.markAcked(uint64(ack))
+	}
+
 	var rootErr error
 
 	// now that we have the waiter's ID, make sure that if there's some failure past this point, we
@@ -459,7 +583,7 @@ func (disp *Dispatcher) HandleMessage(
 		defer disp.lock.Unlock()
 		if sender, ok := disp.waiters[id]; ok {
 			sender.Send(waiterResult{err: err, res: nil})
-			delete(disp.waiters, id)
+			disp.deleteWaiter(id)
 		} else if rootErr != nil {
 			// we had some error while handling the message with this ID, and there wasn't a
 			// corresponding waiter. We should make note of this in the metrics:
@@ -495,6 +619,13 @@ func (disp *Dispatcher) HandleMessage(
 		}
 		handlers.handleUpscaleRequest(req)
 		return nil
+	case "MemoryPressureSignal":
+		var signal api.MemoryPressureSignal
+		if err := unmarshal(&signal); err != nil {
+			return err
+		}
+		handlers.handleMemoryPressure(signal)
+		return nil
 	case "UpscaleConfirmation":
 		var confirmation api.UpscaleConfirmation
 		if err := unmarshal(&confirmation); err != nil {
@@ -507,6 +638,18 @@ func (disp *Dispatcher) HandleMessage(
 			return err
 		}
 		return handlers.handleDownscaleResult(res, id)
+	case "FileCacheResizeResult":
+		var res api.FileCacheResizeResult
+		if err := unmarshal(&res); err != nil {
+			return err
+		}
+		return handlers.handleFileCacheResult(res, id)
+	case "PostgresRestartResult":
+		var res api.PostgresRestartResult
+		if err := unmarshal(&res); err != nil {
+			return err
+		}
+		return handlers.handleRestartResult(res, id)
 	case "InternalError":
 		var monitorErr api.InternalError
 		if err := unmarshal(&monitorErr); err != nil {
@@ -538,7 +681,12 @@ func (disp *Dispatcher) HandleMessage(
 }
 
 // Long running function that orchestrates all requests/responses.
-func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequester func(_ api.MoreResources, withLock func())) {
+func (disp *Dispatcher) run(
+	ctx context.Context,
+	logger *zap.Logger,
+	upscaleRequester func(_ api.MoreResources, withLock func()),
+	memoryPressureSignaled func(api.MemoryPressureSignal),
+) {
 	logger.Info("Starting message handler")
 
 	// Utility for logging + returning an error when we get a message with an
@@ -568,6 +716,15 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			logger.Info("Updating requested upscale", zap.Any("requested", resourceReq))
 		})
 	}
+	// Like upscale requests, memory pressure signals don't expect a response. They're sent whenever
+	// the VM's risk of running out of memory changes.
+	handleMemoryPressure := func(signal api.MemoryPressureSignal) {
+		defer func() {
+			disp.runner.global.metrics.monitorRequestsInbound.WithLabelValues("MemoryPressureSignal", "ok").Inc()
+		}()
+
+		memoryPressureSignaled(signal)
+	}
 	handleUpscaleConfirmation := func(_ api.UpscaleConfirmation, id uint64) error {
 		disp.lock.Lock()
 		defer disp.lock.Unlock()
@@ -578,13 +735,15 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					Confirmation: &api.UpscaleConfirmation{},
-					Result:       nil,
-					HealthCheck:  nil,
+					Confirmation:    &api.UpscaleConfirmation{},
+					Result:          nil,
+					HealthCheck:     nil,
+					FileCacheResult: nil,
+					RestartResult:   nil,
 				},
 			})
 			// Don't forget to delete the waiter
-			delete(disp.waiters, id)
+			disp.deleteWaiter(id)
 			return nil
 		} else {
 			return handleUnkownMessage("UpscaleConfirmation", id)
@@ -600,18 +759,68 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					Result:       &res,
-					Confirmation: nil,
-					HealthCheck:  nil,
+					Result:          &res,
+					Confirmation:    nil,
+					HealthCheck:     nil,
+					FileCacheResult: nil,
+					RestartResult:   nil,
 				},
 			})
 			// Don't forget to delete the waiter
-			delete(disp.waiters, id)
+			disp.deleteWaiter(id)
 			return nil
 		} else {
 			return handleUnkownMessage("DownscaleResult", id)
 		}
 	}
+	handleFileCacheResult := func(res api.FileCacheResizeResult, id uint64) error {
+		disp.lock.Lock()
+		defer disp.lock.Unlock()
+
+		sender, ok := disp.waiters[id]
+		if ok {
+			logger.Info("vm-monitor returned file cache resize result", zap.Uint64("id", id), zap.Any("result", res))
+			sender.Send(waiterResult{
+				err: nil,
+				res: &MonitorResult{
+					FileCacheResult: &res,
+					Result:          nil,
+					Confirmation:    nil,
+					HealthCheck:     nil,
+					RestartResult:   nil,
+				},
+			})
+			// Don't forget to delete the waiter
+			disp.deleteWaiter(id)
+			return nil
+		} else {
+			return handleUnkownMessage("FileCacheResizeResult", id)
+		}
+	}
+	handleRestartResult := func(res api.PostgresRestartResult, id uint64) error {
+		disp.lock.Lock()
+		defer disp.lock.Unlock()
+
+		sender, ok := disp.waiters[id]
+		if ok {
+			logger.Info("vm-monitor returned postgres restart result", zap.Uint64("id", id), zap.Any("result", res))
+			sender.Send(waiterResult{
+				err: nil,
+				res: &MonitorResult{
+					RestartResult:   &res,
+					Result:          nil,
+					Confirmation:    nil,
+					HealthCheck:     nil,
+					FileCacheResult: nil,
+				},
+			})
+			// Don't forget to delete the waiter
+			disp.deleteWaiter(id)
+			return nil
+		} else {
+			return handleUnkownMessage("PostgresRestartResult", id)
+		}
+	}
 	handleMonitorError := func(err api.InternalError, id uint64) error {
 		disp.lock.Lock()
 		defer disp.lock.Unlock()
@@ -629,7 +838,7 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 				res: nil,
 			})
 			// Don't forget to delete the waiter
-			delete(disp.waiters, id)
+			disp.deleteWaiter(id)
 			return nil
 		} else {
 			return handleUnkownMessage("MonitorError", id)
@@ -646,13 +855,15 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					HealthCheck:  &api.HealthCheck{},
-					Result:       nil,
-					Confirmation: nil,
+					HealthCheck:     &api.HealthCheck{},
+					Result:          nil,
+					Confirmation:    nil,
+					FileCacheResult: nil,
+					RestartResult:   nil,
 				},
 			})
 			// Don't forget to delete the waiter
-			delete(disp.waiters, id)
+			disp.deleteWaiter(id)
 			return nil
 		} else {
 			return handleUnkownMessage("HealthCheck", id)
@@ -661,8 +872,11 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 
 	handlers := messageHandlerFuncs{
 		handleUpscaleRequest:      handleUpscaleRequest,
+		handleMemoryPressure:      handleMemoryPressure,
 		handleUpscaleConfirmation: handleUpscaleConfirmation,
 		handleDownscaleResult:     handleDownscaleResult,
+		handleFileCacheResult:     handleFileCacheResult,
+		handleRestartResult:       handleRestartResult,
 		handleMonitorError:        handleMonitorError,
 		handleHealthCheck:         handleHealthCheck,
 	}
@@ -676,7 +890,12 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 				// runner exited, we should expect to fail to read off the connection,
 				// which is closed by the server exit.
 				logger.Warn("Error handling message", zap.Error(err))
+			} else if resumed, resumeErr := disp.tryResume(ctx, logger, err); resumed {
+				continue
 			} else {
+				if resumeErr != nil {
+					err = fmt.Errorf("%w (failed to resume session: %w)", err, resumeErr)
+				}
 				logger.Error("Error handling message, shutting down connection", zap.Error(err))
 				err = fmt.Errorf("Error handling message: %w", err)
 				// note: in theory we *could* be more descriptive with these statuses, but the only
@@ -4,6 +4,7 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -15,6 +16,7 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
 	"github.com/neondatabase/autoscaling/pkg/util"
 )
 
@@ -55,6 +57,21 @@ func (s *agentState) StartDumpStateServer(shutdownCtx context.Context, logger *z
 
 			return state, 200, nil
 		})
+		util.AddHandler(logger, mux, "/decisions", http.MethodGet, "<empty>", func(ctx context.Context, logger *zap.Logger, body *struct{}) (*[]VMDecisions, int, error) {
+			timeout := time.Duration(config.TimeoutSeconds) * time.Second
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			decisions, err := s.DumpDecisions(ctx)
+			if err != nil {
+				return nil, 500, fmt.Errorf("error while getting decisions: %w", err)
+			}
+
+			return &decisions, 200, nil
+		})
+		mux.HandleFunc("/vm", func(w http.ResponseWriter, r *http.Request) {
+			s.serveVMDump(w, r, logger, config)
+		})
 		// note: we don't shut down this server. It should be possible to continue fetching the
 		// internal state after shutdown has started.
 		server := &http.Server{Handler: mux}
@@ -121,3 +138,177 @@ func (s *agentState) DumpState(ctx context.Context, stopped bool) (*StateDump, e
 
 	return &state, nil
 }
+
+// DumpDecisions returns the recent scaling decisions for every VM, if recording decisions is
+// enabled
+func (s *agentState) DumpDecisions(ctx context.Context) ([]VMDecisions, error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	list := []VMDecisions{}
+	for _, pod := range s.pods {
+		if pod.decisions == nil {
+			continue
+		}
+		list = append(list, VMDecisions{
+			VM:        pod.runner.vmName,
+			Pod:       pod.podName,
+			Decisions: pod.decisions.list(),
+		})
+	}
+
+	// Sort by VM, so that we produce a deterministic ordering
+	slices.SortFunc(list, func(a, b VMDecisions) (less bool) {
+		if a.VM.Namespace != b.VM.Namespace {
+			return a.VM.Namespace < b.VM.Namespace
+		}
+		return a.VM.Name < b.VM.Name
+	})
+
+	return list, nil
+}
+
+// alwaysRedactedFields are the JSON fields that are always redacted from the per-VM dumps, because
+// they aren't needed to investigate scaling and identify things outside of it.
+var alwaysRedactedFields = []string{"podIP", "endpointID"}
+
+// VMStateDump is a snapshot of everything about a single VM's scaling, served at /vm by the
+// dump-state server, for capturing when investigating a VM that's stuck
+type VMStateDump struct {
+	VM    util.NamespacedName `json:"vm"`
+	Pod   util.NamespacedName `json:"pod"`
+	PodIP string              `json:"podIP"`
+
+	Status podStatusDump `json:"status"`
+	// Executor, if not nil, gives the state of the VM's core state machine, and the actions it
+	// most recently recommended. It's nil if the runner hasn't fully started yet.
+	Executor *executor.DebugDump `json:"executor"`
+	// Decisions gives the VM's recent scaling decisions, if recording decisions is enabled
+	Decisions []executor.Decision `json:"decisions,omitempty"`
+}
+
+// serveVMDump handles requests for the snapshot of a single VM, given by the "namespace" and
+// "name" query parameters
+func (s *agentState) serveVMDump(w http.ResponseWriter, r *http.Request, logger *zap.Logger, config *DumpStateConfig) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = w.Write([]byte("request method must be " + http.MethodGet))
+		return
+	}
+
+	vmName := util.NamespacedName{
+		Namespace: r.URL.Query().Get("namespace"),
+		Name:      r.URL.Query().Get("name"),
+	}
+	if vmName.Namespace == "" || vmName.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("missing 'namespace' or 'name' query parameter"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	dump, err := s.DumpVM(ctx, vmName)
+	if err != nil {
+		logger.Error("Failed to dump VM state", zap.Object("virtualmachine", vmName), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprintf("error while getting state: %s", err)))
+		return
+	} else if dump == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("VM %v is not on this node", vmName)))
+		return
+	}
+
+	redactFields := make(map[string]struct{})
+	for _, field := range append(slices.Clone(alwaysRedactedFields), config.RedactFields...) {
+		redactFields[field] = struct{}{}
+	}
+	body, err := redactJSON(dump, redactFields)
+	if err != nil {
+		logger.Error("Failed to redact VM state", zap.Object("virtualmachine", vmName), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("error while redacting state"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// DumpVM returns a snapshot of the VM's scaling state, or nil if the VM has no pod on this node
+func (s *agentState) DumpVM(ctx context.Context, vmName util.NamespacedName) (*VMStateDump, error) {
+	pod, err := func() (*podState, error) {
+		if err := s.lock.TryLock(ctx); err != nil {
+			return nil, err
+		}
+		defer s.lock.Unlock()
+
+		for _, pod := range s.pods {
+			if pod.runner.vmName == vmName {
+				return pod, nil
+			}
+		}
+		return nil, nil
+	}()
+	if err != nil || pod == nil {
+		return nil, err
+	}
+
+	executorDump, err := pod.runner.debugDump(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading runner state: %w", err)
+	}
+
+	var decisions []executor.Decision
+	if pod.decisions != nil {
+		decisions = pod.decisions.list()
+	}
+
+	return &VMStateDump{
+		VM:        vmName,
+		Pod:       pod.podName,
+		PodIP:     pod.runner.podIP,
+		Status:    pod.status.dump(),
+		Executor:  executorDump,
+		Decisions: decisions,
+	}, nil
+}
+
+// redactJSON returns the JSON encoding of value, with the values of any fields in redactFields
+// replaced, wherever they occur
+func redactJSON(value any, redactFields map[string]struct{}) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(encoded, &generic); err != nil {
+		return nil, err
+	}
+
+	var redact func(v any)
+	redact = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, field := range v {
+				if _, ok := redactFields[key]; ok && field != nil {
+					v[key] = "<redacted>"
+				} else {
+					redact(field)
+				}
+			}
+		case []any:
+			for _, elem := range v {
+				redact(elem)
+			}
+		}
+	}
+	redact(generic)
+
+	return json.Marshal(generic)
+}
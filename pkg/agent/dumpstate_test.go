@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestRedactJSON(t *testing.T) {
+	type inner struct {
+		Secret string `json:"secret"`
+		Public string `json:"public"`
+	}
+	value := struct {
+		Secret  string   `json:"secret"`
+		Public  string   `json:"public"`
+		Nested  inner    `json:"nested"`
+		List    []inner  `json:"list"`
+		Missing *string  `json:"missing"`
+		Strings []string `json:"strings"`
+	}{
+		Secret:  "top-level",
+		Public:  "visible",
+		Nested:  inner{Secret: "in-nested", Public: "visible"},
+		List:    []inner{{Secret: "in-list", Public: "visible"}},
+		Missing: nil,
+		Strings: []string{"secret"},
+	}
+
+	body, err := redactJSON(value, map[string]struct{}{"secret": {}, "missing": {}})
+	require.NoError(t, err)
+	// Fields are redacted wherever they occur, but null fields are left as-is, and only the keys
+	// are matched, not values.
+	assert.JSONEq(t, `{
+		"secret": "<redacted>",
+		"public": "visible",
+		"nested": {"secret": "<redacted>", "public": "visible"},
+		"list": [{"secret": "<redacted>", "public": "visible"}],
+		"missing": null,
+		"strings": ["secret"]
+	}`, string(body))
+	for _, secret := range []string{"top-level", "in-nested", "in-list"} {
+		assert.NotContains(t, string(body), `"`+secret+`"`)
+	}
+
+	// Nothing is redacted without any fields
+	body, err = redactJSON(value, nil)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"top-level"`)
+}
+
+func TestServeVMDumpRedacts(t *testing.T) {
+	vmName := util.NamespacedName{Namespace: "default", Name: "vm"}
+	decisions := newDecisionHistory(10)
+	//nolint:exhaustruct // only the reason is checked
+	decisions.add(executor.Decision{Outcome: "applied", Reason: "secret reason"})
+
+	status := new(lockedPodStatus)
+	status.endpointID = "ep-secret"
+	status.failedMonitorRequestCounter = util.NewRecentCounter(time.Minute)
+	status.failedNeonVMRequestCounter = util.NewRecentCounter(time.Minute)
+	status.failedSchedulerRequestCounter = util.NewRecentCounter(time.Minute)
+
+	s := &agentState{ //nolint:exhaustruct // only the fields for dumping VMs are used
+		lock: util.NewChanMutex(),
+		pods: map[util.NamespacedName]*podState{
+			{Namespace: "default", Name: "pod"}: { //nolint:exhaustruct // the runner isn't started
+				podName: util.NamespacedName{Namespace: "default", Name: "pod"},
+				runner: &Runner{ //nolint:exhaustruct // only the fields for dumping are used
+					vmName: vmName,
+					podIP:  "10.1.2.3",
+					lock:   util.NewChanMutex(),
+				},
+				status:    status,
+				decisions: decisions,
+			},
+		},
+	}
+
+	get := func(config *DumpStateConfig, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.serveVMDump(rec, httptest.NewRequest(http.MethodGet, "/vm?"+query, nil), zap.NewNop(), config)
+		return rec
+	}
+
+	// The pod's IP and the endpoint ID are always redacted
+	rec := get(&DumpStateConfig{Port: 0, TimeoutSeconds: 5, RedactFields: nil}, "namespace=default&name=vm")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "10.1.2.3")
+	assert.NotContains(t, rec.Body.String(), "ep-secret")
+	var dump map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &dump))
+	assert.Equal(t, "<redacted>", dump["podIP"])
+	assert.Equal(t, map[string]any{"namespace": "default", "name": "vm"}, dump["vm"])
+	assert.Contains(t, rec.Body.String(), "secret reason")
+
+	// ... and the configured fields are redacted as well, even inside the decisions
+	rec = get(&DumpStateConfig{Port: 0, TimeoutSeconds: 5, RedactFields: []string{"reason"}}, "namespace=default&name=vm")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "10.1.2.3")
+	assert.NotContains(t, rec.Body.String(), "ep-secret")
+	assert.NotContains(t, rec.Body.String(), "secret reason")
+	// The configured fields don't replace the ones that are always redacted
+	assert.Equal(t, 3, strings.Count(rec.Body.String(), "redacted"))
+
+	// Errors don't leak anything either
+	config := &DumpStateConfig{Port: 0, TimeoutSeconds: 5, RedactFields: nil}
+	assert.Equal(t, http.StatusNotFound, get(config, "namespace=default&name=other").Code)
+	assert.Equal(t, http.StatusBadRequest, get(config, "namespace=default").Code)
+}
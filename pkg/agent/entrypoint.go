@@ -2,17 +2,22 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/tychoish/fun/pubsub"
 	"go.uber.org/zap"
 
 	"k8s.io/client-go/kubernetes"
 
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
 	"github.com/neondatabase/autoscaling/pkg/agent/billing"
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
 
@@ -24,6 +29,29 @@ type MainRunner struct {
 }
 
 func (r MainRunner) Run(logger *zap.Logger, ctx context.Context) error {
+	if conf := r.Config.LeaderElection; conf != nil {
+		return r.runWithLeaderElection(ctx, logger, conf, r.run)
+	}
+	return r.run(ctx, logger)
+}
+
+// errVMWatchStopped is the cause of canceling the main context when the VM watch gives up
+var errVMWatchStopped = errors.New("VM watch stopped after too many consecutive failures")
+
+func (r MainRunner) run(ctx context.Context, logger *zap.Logger) error {
+	computeUnit, err := nodeComputeUnit(ctx, r.KubeClient, r.EnvArgs.K8sNodeName, r.Config.Scaling.ComputeUnitsByArch, r.Config.Scaling.ComputeUnit)
+	if err != nil {
+		return err
+	}
+	r.Config.Scaling.ComputeUnit = computeUnit
+
+	if err := r.Config.Scaling.checkPolicy(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	vmEventQueue := pubsub.NewUnlimitedQueue[vmEvent]()
 	defer vmEventQueue.Close()
 	pushToQueue := func(ev vmEvent) {
@@ -32,35 +60,124 @@ func (r MainRunner) Run(logger *zap.Logger, ctx context.Context) error {
 		}
 	}
 
+	// Deleted VMs are passed directly to billing, so that their final usage can be sent without
+	// waiting for the next batch. If billing is falling behind, the usage is instead included in the
+	// next batch as normal.
+	billingDeletions := make(chan *vmapi.VirtualMachine, 64)
+	pushBillingDeletion := func(vm *vmapi.VirtualMachine) {
+		select {
+		case billingDeletions <- vm:
+		default:
+			logger.Warn("Billing deletions channel is full, VM usage will be sent with the next batch", util.VMNameFields(vm))
+		}
+	}
+	// Likewise for VMs that were migrated away from this node, so that their usage up to the
+	// migration is counted here. If billing is falling behind, that usage may be lost.
+	billingMigrations := make(chan *vmapi.VirtualMachine, 64)
+	pushBillingMigration := func(vm *vmapi.VirtualMachine) {
+		select {
+		case billingMigrations <- vm:
+		default:
+			logger.Warn("Billing migrations channel is full, VM usage up to the migration may not be sent", util.VMNameFields(vm))
+		}
+	}
+
 	watchMetrics := watch.NewMetrics("autoscaling_agent_watchers")
 
 	perVMMetrics, vmPromReg := makePerVMMetrics()
 
 	logger.Info("Starting VM watcher")
-	vmWatchStore, err := startVMWatcher(ctx, logger, r.Config, r.VMClient, watchMetrics, perVMMetrics, r.EnvArgs.K8sNodeName, pushToQueue)
+	vmWatchStore, err := startVMWatcher(ctx, logger, r.Config, r.VMClient, watchMetrics, perVMMetrics, r.EnvArgs.K8sNodeName, pushToQueue, pushBillingDeletion, pushBillingMigration)
 	if err != nil {
 		return fmt.Errorf("Error starting VM watcher: %w", err)
 	}
 	defer vmWatchStore.Stop()
 	logger.Info("VM watcher started")
 
+	// If the VM watch gives up, shut everything down cleanly (including flushing billing) and exit
+	// with an error, so that we're restarted with a fresh watch.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-vmWatchStore.Done():
+			if ctx.Err() == nil {
+				logger.Error("VM watch stopped while still running, shutting down")
+				cancel(errVMWatchStopped)
+			}
+		}
+	}()
+
 	schedTracker, err := schedwatch.StartSchedulerWatcher(ctx, logger, r.KubeClient, watchMetrics, r.Config.Scheduler.SchedulerName)
 	if err != nil {
 		return fmt.Errorf("Starting scheduler watch server: %w", err)
 	}
 	defer schedTracker.Stop()
 
-	globalState, globalPromReg := r.newAgentState(logger, r.EnvArgs.K8sPodIP, schedTracker)
+	globalState, globalPromReg, err := r.newAgentState(logger, r.EnvArgs.K8sPodIP, vmWatchStore, schedTracker, perVMMetrics)
+	if err != nil {
+		return err
+	}
 	watchMetrics.MustRegister(globalPromReg)
 
+	if conf := r.Config.Scaling.NodePressure; conf != nil {
+		logger.Info("Starting node memory pressure checks")
+		go globalState.nodePressure.run(ctx, logger.Named("node-pressure"), conf, globalState.metrics.nodeMemoryPressure)
+	}
+
+	reloadEvery := time.Second * time.Duration(r.Config.Scaling.ReloadEverySeconds)
+	go globalState.liveConfig.watch(ctx, logger.Named("config-reload"), r.EnvArgs.ConfigPath, reloadEvery, globalState.metrics.scalingConfigGeneration)
+
+	if globalState.otlp != nil {
+		logger.Info("Starting OTLP metrics receiver")
+		if err := globalState.otlp.start(ctx, logger.Named("otlp"), r.Config.Metrics.OTLP.Port); err != nil {
+			return fmt.Errorf("Error starting OTLP metrics receiver: %w", err)
+		}
+	}
+
+	if r.Config.Tracing != nil {
+		logger.Info("Starting trace exporter")
+		go tracing.Run(ctx, logger.Named("tracing"), globalState.tracerProvider)
+	}
+
+	if globalState.webhook != nil {
+		logger.Info("Starting webhook notification sender")
+		globalState.webhook.start(ctx)
+	}
+
+	if globalState.patchQueue != nil {
+		logger.Info("Starting VM patch queue")
+		globalState.patchQueue.start(ctx, logger.Named("patch-queue"))
+	}
+
 	logger.Info("Starting billing metrics collector")
 	storeForNode := watch.NewIndexedStore(vmWatchStore, billing.NewVMNodeIndex(r.EnvArgs.K8sNodeName))
+	listVMs := billing.NewVMLister(r.VMClient, r.EnvArgs.K8sNodeName)
 
 	metrics := billing.NewPromMetrics()
 	metrics.MustRegister(globalPromReg)
 
+	billingUpdates := watchBillingConfig(ctx, logger.Named("billing-reload"), r.EnvArgs.ConfigPath, r.Config.Billing, readAgentBillingConfig)
+
 	// TODO: catch panics here, bubble those into a clean-ish shutdown.
-	go billing.RunBillingMetricsCollector(ctx, logger, &r.Config.Billing, storeForNode, metrics)
+	billingDone := make(chan struct{})
+	var billingReporters billingStatusReporters
+	if globalState.nodeAnomalies != nil {
+		billingReporters = append(billingReporters, globalState.nodeAnomalies)
+	}
+	if globalState.billingHealth != nil {
+		billingReporters = append(billingReporters, globalState.billingHealth)
+	}
+	var billingStatus billing.StatusReporter
+	if len(billingReporters) != 0 {
+		billingStatus = billingReporters
+	}
+	go func() {
+		defer close(billingDone)
+		// Billing is isolated from the rest of the autoscaler-agent, so fault injection is passed
+		// through the context.
+		billingCtx := faults.WithInjector(ctx, globalState.faults)
+		billing.RunBillingMetricsCollector(billingCtx, logger, &r.Config.Billing, billingUpdates, r.Config.Scaling.ComputeUnit, storeForNode, billingDeletions, billingMigrations, listVMs, globalState, globalState, metrics, globalState.tracer, billingStatus, util.RealClock)
+	}()
 
 	promLogger := logger.Named("prometheus")
 	if err := util.StartPrometheusMetricsServer(ctx, promLogger.Named("global"), 9100, globalPromReg); err != nil {
@@ -77,12 +194,33 @@ func (r MainRunner) Run(logger *zap.Logger, ctx context.Context) error {
 		}
 	}
 
+	if r.Config.StateAPI != nil {
+		logger.Info("Starting state API server")
+		if err := globalState.StartStateAPIServer(ctx, logger.Named("state-api"), r.Config.StateAPI); err != nil {
+			return fmt.Errorf("Error starting state API server: %w", err)
+		}
+	}
+
+	if r.Config.Health != nil {
+		logger.Info("Starting health server")
+		if err := globalState.StartHealthServer(ctx, logger.Named("health"), r.Config.Health, vmWatchStore); err != nil {
+			return fmt.Errorf("Error starting health server: %w", err)
+		}
+	}
+
 	logger.Info("Entering main loop")
 	for {
 		event, err := vmEventQueue.Wait(ctx)
 		if err != nil {
 			if ctx.Err() != nil {
 				// treat context canceled as a "normal" exit (because it is)
+				//
+				// The billing collector may still be flushing its remaining events, which is
+				// bounded by its configured timeout.
+				<-billingDone
+				if cause := context.Cause(ctx); errors.Is(cause, errVMWatchStopped) {
+					return cause
+				}
 				return nil
 			}
 
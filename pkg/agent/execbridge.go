@@ -8,11 +8,14 @@ package agent
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/neondatabase/autoscaling/pkg/agent/executor"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 var (
@@ -41,15 +44,38 @@ func (iface *execPluginInterface) Request(
 	target api.Resources,
 	metrics *api.Metrics,
 ) (*api.PluginResponse, error) {
+	release, err := iface.runner.global.nsLimiter.acquire(ctx, logger, iface.runner.podName.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error waiting for namespace concurrency limit: %w", err)
+	}
+	defer release()
+
 	if lastPermit != nil {
 		iface.runner.recordResourceChange(*lastPermit, target, iface.runner.global.metrics.schedulerRequestedChange)
 	}
 
+	ctx, span := iface.runner.global.tracer.Start(
+		iface.runner.traceContext(ctx), "agent.scheduler.request",
+		trace.WithAttributes(iface.runner.vmTraceAttributes()...),
+		trace.WithAttributes(resourcesTraceAttributes("target", target)...),
+	)
+	defer span.End()
+
 	resp, err := iface.runner.DoSchedulerRequest(ctx, logger, target, lastPermit, metrics)
+	tracing.RecordError(span, err)
 
 	if err == nil && lastPermit != nil {
 		iface.runner.recordResourceChange(*lastPermit, resp.Permit, iface.runner.global.metrics.schedulerApprovedChange)
 	}
+	if err == nil && resp.DeniedReason != "" {
+		logger.Warn(
+			"Scheduler denied part of requested increase",
+			zap.String("reason", string(resp.DeniedReason)),
+			zap.Object("requested", target),
+			zap.Object("permit", resp.Permit),
+		)
+		iface.runner.global.metrics.schedulerDenials.WithLabelValues(string(resp.DeniedReason)).Inc()
+	}
 
 	successful := func() bool {
 		if err != nil { // request is failed
@@ -87,10 +113,24 @@ func makeNeonVMInterface(r *Runner) *execNeonVMInterface {
 
 // Request implements executor.NeonVMInterface
 func (iface *execNeonVMInterface) Request(ctx context.Context, logger *zap.Logger, current, target api.Resources) error {
+	release, err := iface.runner.global.nsLimiter.acquire(ctx, logger, iface.runner.podName.Namespace)
+	if err != nil {
+		return fmt.Errorf("Error waiting for namespace concurrency limit: %w", err)
+	}
+	defer release()
+
 	iface.runner.recordResourceChange(current, target, iface.runner.global.metrics.neonvmRequestedChange)
 
-	err := iface.runner.doNeonVMRequest(ctx, target)
+	ctx, span := iface.runner.global.tracer.Start(
+		iface.runner.traceContext(ctx), "agent.neonvm.patch",
+		trace.WithAttributes(iface.runner.vmTraceAttributes()...),
+		trace.WithAttributes(resourcesTraceAttributes("target", target)...),
+	)
+	defer span.End()
+
+	err = iface.runner.doNeonVMRequest(ctx, target)
 	if err != nil {
+		tracing.RecordError(span, err)
 		iface.runner.status.update(iface.runner.global, func(ps podStatus) podStatus {
 			ps.failedNeonVMRequestCounter.Inc()
 			return ps
@@ -98,6 +138,17 @@ func (iface *execNeonVMInterface) Request(ctx context.Context, logger *zap.Logge
 		return fmt.Errorf("Error making VM patch request: %w", err)
 	}
 
+	iface.runner.status.update(iface.runner.global, func(ps podStatus) podStatus {
+		now := time.Now()
+		if target.HasFieldGreaterThan(current) {
+			ps.lastUpscaleAt = &now
+		}
+		if target.HasFieldLessThan(current) {
+			ps.lastDownscaleAt = &now
+		}
+		return ps
+	})
+
 	return nil
 }
 
@@ -171,6 +222,10 @@ func (h *execMonitorHandle) Downscale(
 
 	if err == nil && result.Ok {
 		h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorApprovedChange)
+		// Shrink the file cache before the VM's memory is actually removed
+		if target.Mem != current.Mem {
+			doMonitorFileCacheResize(ctx, logger, h.monitor.dispatcher, target.Mem)
+		}
 	} else {
 		h.runner.status.update(h.runner.global, func(ps podStatus) podStatus {
 			ps.failedMonitorRequestCounter.Inc()
@@ -194,6 +249,9 @@ func (h *execMonitorHandle) Upscale(ctx context.Context, logger *zap.Logger, cur
 
 	if err == nil {
 		h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorApprovedChange)
+		if target.Mem != current.Mem {
+			doMonitorFileCacheResize(ctx, logger, h.monitor.dispatcher, target.Mem)
+		}
 	} else {
 		h.runner.status.update(h.runner.global, func(ps podStatus) podStatus {
 			ps.failedMonitorRequestCounter.Inc()
@@ -203,3 +261,43 @@ func (h *execMonitorHandle) Upscale(ctx context.Context, logger *zap.Logger, cur
 
 	return err
 }
+
+// Suspend implements executor.NeonVMInterface
+func (iface *execNeonVMInterface) Suspend(ctx context.Context, logger *zap.Logger) error {
+	return iface.setPaused(ctx, logger, true)
+}
+
+// Resume implements executor.NeonVMInterface
+func (iface *execNeonVMInterface) Resume(ctx context.Context, logger *zap.Logger) error {
+	return iface.setPaused(ctx, logger, false)
+}
+
+func (iface *execNeonVMInterface) setPaused(ctx context.Context, logger *zap.Logger, paused bool) error {
+	verb := "suspend"
+	if !paused {
+		verb = "resume"
+	}
+
+	release, err := iface.runner.global.nsLimiter.acquire(ctx, logger, iface.runner.podName.Namespace)
+	if err != nil {
+		return fmt.Errorf("Error waiting for namespace concurrency limit: %w", err)
+	}
+	defer release()
+
+	ctx, span := iface.runner.global.tracer.Start(
+		iface.runner.traceContext(ctx), "agent.neonvm."+verb,
+		trace.WithAttributes(iface.runner.vmTraceAttributes()...),
+	)
+	defer span.End()
+
+	if err := iface.runner.doNeonVMSetPaused(ctx, paused); err != nil {
+		tracing.RecordError(span, err)
+		iface.runner.status.update(iface.runner.global, func(ps podStatus) podStatus {
+			ps.failedNeonVMRequestCounter.Inc()
+			return ps
+		})
+		return fmt.Errorf("Error making VM %s patch request: %w", verb, err)
+	}
+
+	return nil
+}
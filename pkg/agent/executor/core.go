@@ -30,7 +30,17 @@ type Config struct {
 	// In practice, this value is set to a callback that increments a metric.
 	OnNextActions func()
 
+	// OnDecision, if not nil, is called each time a change to the VM's resources is made or fails,
+	// or a request to the scheduler plugin for more resources is denied or fails.
+	//
+	// It is called without holding the ExecutorCore's lock.
+	OnDecision func(Decision)
+
 	Core core.Config
+
+	// Clock gives the current time passed to the core.State, and the timers used to wait for
+	// it. In practice, this is util.RealClock.
+	Clock util.Clock
 }
 
 type ExecutorCore struct {
@@ -44,7 +54,17 @@ type ExecutorCore struct {
 	lastActionsID timedActionsID
 	onNextActions func()
 
+	computeUnit api.Resources
+	onDecision  func(Decision)
+	// schedulerVerdict gives the result of the most recent request to the scheduler plugin, for
+	// inclusion in Decisions. It is guarded by mu.
+	schedulerVerdict SchedulerVerdict
+	// explanation, if not nil, gives the explanation from the most recently calculated actions,
+	// including the desired resources. It is guarded by mu.
+	explanation *core.Explanation
+
 	updates *util.Broadcaster
+	clock   util.Clock
 }
 
 type ClientSet struct {
@@ -61,7 +81,14 @@ func NewExecutorCore(stateLogger *zap.Logger, vm api.VmInfo, config Config) *Exe
 		actions:       nil, // (*ExecutorCore).getActions() checks if this is nil
 		lastActionsID: -1,
 		onNextActions: config.OnNextActions,
-		updates:       util.NewBroadcaster(),
+
+		computeUnit:      config.Core.ComputeUnit,
+		onDecision:       config.OnDecision,
+		schedulerVerdict: SchedulerNotAsked,
+		explanation:      nil,
+
+		updates: util.NewBroadcaster(),
+		clock:   config.Clock,
 	}
 }
 
@@ -88,6 +115,10 @@ type timedActions struct {
 	// id is exclusively used by (*ExecutorCore).updateIfActionsUnchanged().
 	id      timedActionsID
 	actions core.ActionSet
+	// explanation gives the reasoning behind the actions, for use in Decisions
+	explanation core.Explanation
+	// calculatedAt gives the time that the actions were calculated, which any wait is relative to
+	calculatedAt time.Time
 }
 
 type timedActionsID int64
@@ -101,11 +132,14 @@ func (c *ExecutorCore) getActions() timedActions {
 		id := c.lastActionsID + 1
 		c.onNextActions()
 
-		// NOTE: Even though we cache the actions generated using time.Now(), it's *generally* ok.
-		now := time.Now()
+		// NOTE: Even though we cache the actions generated using the current time, it's *generally*
+		// ok.
+		now := c.clock.Now()
 		c.stateLogger.Debug("Recalculating ActionSet", zap.Time("now", now), zap.Any("state", c.core.Dump()))
-		c.actions = &timedActions{id: id, actions: c.core.NextActions(now)}
+		actions, explanation := c.core.NextActionsExplained(now)
+		c.actions = &timedActions{id: id, actions: actions, explanation: explanation, calculatedAt: now}
 		c.lastActionsID = id
+		c.explanation = &explanation
 		c.stateLogger.Debug("New ActionSet", zap.Time("now", now), zap.Any("actions", c.actions.actions))
 	}
 
@@ -139,6 +173,15 @@ func (c *ExecutorCore) updateIfActionsUnchanged(actions timedActions, with func(
 	return true
 }
 
+// recordDecision calls the OnDecision callback, if there is one.
+//
+// This method MUST NOT be called while holding c.mu.
+func (c *ExecutorCore) recordDecision(decision Decision) {
+	if c.onDecision != nil {
+		c.onDecision(decision)
+	}
+}
+
 // may change in the future
 type StateDump = core.StateDump
 
@@ -149,6 +192,76 @@ func (c *ExecutorCore) StateDump() StateDump {
 	return c.core.Dump()
 }
 
+// DebugDump is a snapshot of the ExecutorCore, for investigating why a VM isn't being scaled as
+// expected
+type DebugDump struct {
+	State StateDump `json:"state"`
+	// Actions, if not nil, gives the actions most recently recommended by the state machine,
+	// including how long the executors are waiting before the next recalculation. It's nil if the
+	// actions need to be recalculated.
+	Actions *core.ActionSet `json:"actions"`
+	// ActionsCalculatedAt gives the time that Actions were calculated, which any wait in them is
+	// relative to
+	ActionsCalculatedAt *time.Time `json:"actionsCalculatedAt"`
+	// Explanation, if not nil, gives the reasoning behind the most recently calculated actions
+	Explanation      *core.Explanation `json:"explanation"`
+	SchedulerVerdict SchedulerVerdict  `json:"schedulerVerdict"`
+}
+
+// DebugDump copies and returns the current state inside the executor, along with the most
+// recently calculated actions
+func (c *ExecutorCore) DebugDump() DebugDump {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dump := DebugDump{
+		State:               c.core.Dump(),
+		Actions:             nil,
+		ActionsCalculatedAt: nil,
+		Explanation:         shallowCopy(c.explanation),
+		SchedulerVerdict:    c.schedulerVerdict,
+	}
+	if c.actions != nil {
+		dump.Actions = shallowCopy(&c.actions.actions)
+		dump.ActionsCalculatedAt = shallowCopy(&c.actions.calculatedAt)
+	}
+	return dump
+}
+
+func shallowCopy[T any](ptr *T) *T {
+	if ptr == nil {
+		return nil
+	}
+	x := *ptr
+	return &x
+}
+
+// Goal returns the resources that the VM is currently being scaled towards, or nil if they haven't
+// been calculated yet
+func (c *ExecutorCore) Goal() *api.Resources {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.explanation == nil {
+		return nil
+	}
+	goal := c.explanation.Desired
+	return &goal
+}
+
+// Explanation returns the explanation of the most recently calculated actions, or nil if they
+// haven't been calculated yet
+func (c *ExecutorCore) Explanation() *core.Explanation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.explanation == nil {
+		return nil
+	}
+	explanation := *c.explanation
+	return &explanation
+}
+
 // Updater returns a handle on the object used for making external changes to the ExecutorCore,
 // beyond what's provided by the various client (ish) interfaces
 func (c *ExecutorCore) Updater() ExecutorCoreUpdater {
@@ -162,10 +275,17 @@ type ExecutorCoreUpdater struct {
 
 // UpdateMetrics calls (*core.State).UpdateMetrics() on the inner core.State and runs withLock while
 // holding the lock.
-func (c ExecutorCoreUpdater) UpdateMetrics(metrics core.Metrics, withLock func()) {
+//
+// If the metrics trigger a burst upscale with (*core.State).BurstUpscale(), onBurst is also called
+// while holding the lock, with the reason for it.
+func (c ExecutorCoreUpdater) UpdateMetrics(metrics core.Metrics, withLock func(), onBurst func(reason string)) {
 	c.core.update(func(state *core.State) {
-		state.UpdateMetrics(metrics)
+		now := c.core.clock.Now()
+		state.UpdateMetrics(now, metrics)
 		withLock()
+		if reason, ok := state.BurstUpscale(now); ok {
+			onBurst(reason)
+		}
 	})
 }
 
@@ -191,7 +311,62 @@ func (c ExecutorCoreUpdater) ResetMonitor(withLock func()) {
 // runs withLock while holding the lock.
 func (c ExecutorCoreUpdater) UpscaleRequested(resources api.MoreResources, withLock func()) {
 	c.core.update(func(state *core.State) {
-		state.Monitor().UpscaleRequested(time.Now(), resources)
+		state.Monitor().UpscaleRequested(c.core.clock.Now(), resources)
+		withLock()
+	})
+}
+
+// EmergencyUpscale calls (*core.State).EmergencyUpscale(...) on the inner core.State and runs
+// withLock while holding the lock, if the upscale was accepted.
+func (c ExecutorCoreUpdater) EmergencyUpscale(reason string, withLock func()) {
+	c.core.update(func(state *core.State) {
+		if state.EmergencyUpscale(c.core.clock.Now(), reason) {
+			withLock()
+		}
+	})
+}
+
+// MemoryPressure calls (*core.State).Monitor().MemoryPressure(...) on the inner core.State and
+// runs withLock while holding the lock, with whether this started a veto on downscaling memory.
+func (c ExecutorCoreUpdater) MemoryPressure(signal api.MemoryPressureSignal, withLock func(started bool)) {
+	c.core.update(func(state *core.State) {
+		started := state.Monitor().MemoryPressure(c.core.clock.Now(), signal.AtRisk, signal.Reason)
+		withLock(started)
+	})
+}
+
+// NodeMemoryPressure calls (*core.State).NodeMemoryPressure(...) on the inner core.State and runs
+// withLock while holding the lock.
+func (c ExecutorCoreUpdater) NodeMemoryPressure(underPressure bool, withLock func()) {
+	c.core.update(func(state *core.State) {
+		state.NodeMemoryPressure(underPressure)
+		withLock()
+	})
+}
+
+// InboundTraffic calls (*core.State).InboundTraffic() on the inner core.State and runs withLock
+// while holding the lock.
+func (c ExecutorCoreUpdater) InboundTraffic(withLock func()) {
+	c.core.update(func(state *core.State) {
+		state.InboundTraffic()
+		withLock()
+	})
+}
+
+// UpdateDefaultScalingConfig calls (*core.State).UpdateDefaultScalingConfig(...) on the inner
+// core.State and runs withLock while holding the lock.
+func (c ExecutorCoreUpdater) UpdateDefaultScalingConfig(config api.ScalingConfig, withLock func()) {
+	c.core.update(func(state *core.State) {
+		state.UpdateDefaultScalingConfig(config)
+		withLock()
+	})
+}
+
+// UpdateConfig calls (*core.State).UpdateConfig(...) on the inner core.State and runs withLock while
+// holding the lock.
+func (c ExecutorCoreUpdater) UpdateConfig(config core.Config, withLock func()) {
+	c.core.update(func(state *core.State) {
+		state.UpdateConfig(config)
 		withLock()
 	})
 }
@@ -0,0 +1,108 @@
+package executor
+
+// Records of the scaling decisions carried out by the executors, for auditing why a VM was (or
+// wasn't) resized.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// DecisionOutcome is the result of acting on a scaling decision
+type DecisionOutcome string
+
+const (
+	// DecisionApplied means that the VM's resources were changed
+	DecisionApplied DecisionOutcome = "Applied"
+	// DecisionDenied means that the scheduler plugin didn't permit all of the requested increase
+	DecisionDenied DecisionOutcome = "Denied"
+	// DecisionFailed means that the request to change the VM's resources, or to get permission
+	// from the scheduler plugin, failed
+	DecisionFailed DecisionOutcome = "Failed"
+)
+
+// SchedulerVerdict is the scheduler plugin's response to the most recent request for resources
+type SchedulerVerdict string
+
+const (
+	// SchedulerNotAsked means that there hasn't been a request to the scheduler plugin yet
+	SchedulerNotAsked SchedulerVerdict = "NotAsked"
+	// SchedulerApproved means that the scheduler plugin permitted everything that was requested
+	SchedulerApproved SchedulerVerdict = "Approved"
+	// SchedulerPartiallyApproved means that the scheduler plugin permitted some of the requested
+	// increase, but not all of it
+	SchedulerPartiallyApproved SchedulerVerdict = "PartiallyApproved"
+	// SchedulerDenied means that the scheduler plugin permitted none of the requested increase
+	SchedulerDenied SchedulerVerdict = "Denied"
+	// SchedulerFailed means that the request to the scheduler plugin failed
+	SchedulerFailed SchedulerVerdict = "Failed"
+)
+
+// Decision is a structured record of a change to the VM's resources, or a denied or failed attempt
+// at one
+type Decision struct {
+	Time    time.Time       `json:"time"`
+	Outcome DecisionOutcome `json:"outcome"`
+
+	// Metrics, if not nil, gives the metrics that the decision was based on
+	Metrics *core.Metrics `json:"metrics"`
+
+	Previous   api.Resources `json:"previous"`
+	Target     api.Resources `json:"target"`
+	PreviousCU float64       `json:"previousCU"`
+	TargetCU   float64       `json:"targetCU"`
+
+	// Reason is a human-readable description of how the target was chosen
+	Reason string `json:"reason"`
+	// Limit, if not empty, gives what prevented the target from following the metrics -- e.g.
+	// "memory-pressure" if the vm-monitor vetoed downscaling memory
+	Limit core.LimitingFactor `json:"limit,omitempty"`
+	// SchedulerVerdict gives the scheduler plugin's response to the most recent request
+	SchedulerVerdict SchedulerVerdict `json:"schedulerVerdict"`
+	// Error, if not empty, gives the error that caused the decision to fail
+	Error string `json:"error,omitempty"`
+}
+
+// makeDecision creates a Decision from the explanation that produced the action
+func makeDecision(
+	at time.Time,
+	outcome DecisionOutcome,
+	computeUnit api.Resources,
+	explanation core.Explanation,
+	previous api.Resources,
+	target api.Resources,
+	verdict SchedulerVerdict,
+	err error,
+) Decision {
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+
+	return Decision{
+		Time:             at,
+		Outcome:          outcome,
+		Metrics:          explanation.Metrics,
+		Previous:         previous,
+		Target:           target,
+		PreviousCU:       previous.ComputeUnits(computeUnit),
+		TargetCU:         target.ComputeUnits(computeUnit),
+		Reason:           explanation.Reason,
+		Limit:            explanation.Limit,
+		SchedulerVerdict: verdict,
+		Error:            errMsg,
+	}
+}
+
+// schedulerVerdict returns the verdict for a successful request to the scheduler plugin
+func schedulerVerdict(lastPermit *api.Resources, target, permit api.Resources) SchedulerVerdict {
+	if permit == target {
+		return SchedulerApproved
+	} else if lastPermit != nil && *lastPermit != permit {
+		return SchedulerPartiallyApproved
+	} else {
+		return SchedulerDenied
+	}
+}
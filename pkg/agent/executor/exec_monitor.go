@@ -56,7 +56,7 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
 			logger.Info("Starting vm-monitor downscale request", zap.Object("action", action))
-			startTime = time.Now()
+			startTime = c.clock.Now()
 			monitorIface = c.clients.Monitor.GetHandle()
 			state.Monitor().StartingDownscaleRequest(startTime, action.Target)
 
@@ -70,7 +70,7 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 		}
 
 		result, err := monitorIface.Downscale(ctx, ifaceLogger, action.Current, action.Target)
-		endTime := time.Now()
+		endTime := c.clock.Now()
 
 		c.update(func(state *core.State) {
 			unchanged := generationUnchanged(monitorIface)
@@ -96,7 +96,15 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 
 			logFields = append(logFields, zap.Any("response", result))
 
-			if !result.Ok {
+			if !result.Ok && result.RetryAfterSeconds != 0 {
+				logger.Warn("vm-monitor deferred downscale", logFields...)
+				if unchanged {
+					retryAfter := time.Second * time.Duration(result.RetryAfterSeconds)
+					state.Monitor().DownscaleRequestDeferred(endTime, result.Status, retryAfter)
+				} else {
+					warnSkipBecauseChanged()
+				}
+			} else if !result.Ok {
 				logger.Warn("vm-monitor denied downscale", logFields...)
 				if unchanged {
 					state.Monitor().DownscaleRequestDenied(endTime)
@@ -146,7 +154,7 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
 			logger.Info("Starting vm-monitor upscale request", zap.Object("action", action))
-			startTime = time.Now()
+			startTime = c.clock.Now()
 			monitorIface = c.clients.Monitor.GetHandle()
 			state.Monitor().StartingUpscaleRequest(startTime, action.Target)
 
@@ -160,7 +168,7 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 		}
 
 		err := monitorIface.Upscale(ctx, ifaceLogger, action.Current, action.Target)
-		endTime := time.Now()
+		endTime := c.clock.Now()
 
 		c.update(func(state *core.State) {
 			unchanged := generationUnchanged(monitorIface)
@@ -13,6 +13,10 @@ import (
 
 type NeonVMInterface interface {
 	Request(_ context.Context, _ *zap.Logger, current, target api.Resources) error
+	// Suspend sets the VM's .spec.paused, for ScaleToZeroConfig
+	Suspend(_ context.Context, _ *zap.Logger) error
+	// Resume clears the VM's .spec.paused, undoing Suspend
+	Resume(_ context.Context, _ *zap.Logger) error
 }
 
 func (c *ExecutorCoreWithClients) DoNeonVMRequests(ctx context.Context, logger *zap.Logger) {
@@ -40,17 +44,19 @@ func (c *ExecutorCoreWithClients) DoNeonVMRequests(ctx context.Context, logger *
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
 			logger.Info("Starting NeonVM request", zap.Object("action", action))
-			startTime = time.Now()
+			startTime = c.clock.Now()
 			state.NeonVM().StartingRequest(startTime, action.Target)
 		}); !updated {
 			continue // state has changed, retry.
 		}
 
 		err := c.clients.NeonVM.Request(ctx, ifaceLogger, action.Current, action.Target)
-		endTime := time.Now()
+		endTime := c.clock.Now()
 		logFields := []zap.Field{zap.Object("action", action), zap.Duration("duration", endTime.Sub(startTime))}
 
+		var verdict SchedulerVerdict
 		c.update(func(state *core.State) {
+			verdict = c.schedulerVerdict
 			if err != nil {
 				logger.Error("NeonVM request failed", append(logFields, zap.Error(err))...)
 				state.NeonVM().RequestFailed(endTime)
@@ -59,5 +65,107 @@ func (c *ExecutorCoreWithClients) DoNeonVMRequests(ctx context.Context, logger *
 				state.NeonVM().RequestSuccessful(endTime)
 			}
 		})
+
+		outcome := DecisionApplied
+		if err != nil {
+			outcome = DecisionFailed
+		}
+		c.recordDecision(makeDecision(
+			endTime, outcome, c.computeUnit, last.explanation, action.Current, action.Target, verdict, err,
+		))
+	}
+}
+
+func (c *ExecutorCoreWithClients) DoNeonVMSuspends(ctx context.Context, logger *zap.Logger) {
+	var (
+		updates     util.BroadcastReceiver = c.updates.NewReceiver()
+		ifaceLogger *zap.Logger            = logger.Named("client")
+	)
+
+	for {
+		// Wait until the state's changed, or we're done.
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates.Wait():
+			updates.Awake()
+		}
+
+		last := c.getActions()
+		if last.actions.Suspend == nil {
+			continue // nothing to do; wait until the state changes.
+		}
+
+		var startTime time.Time
+		action := *last.actions.Suspend
+
+		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
+			logger.Info("Starting NeonVM suspend request", zap.Object("action", action))
+			startTime = c.clock.Now()
+			state.NeonVM().StartingSuspend(startTime)
+		}); !updated {
+			continue // state has changed, retry.
+		}
+
+		err := c.clients.NeonVM.Suspend(ctx, ifaceLogger)
+		endTime := c.clock.Now()
+		logFields := []zap.Field{zap.Object("action", action), zap.Duration("duration", endTime.Sub(startTime))}
+
+		c.update(func(state *core.State) {
+			if err != nil {
+				logger.Error("NeonVM suspend request failed", append(logFields, zap.Error(err))...)
+				state.NeonVM().SuspendFailed(endTime)
+			} else /* err == nil */ {
+				logger.Info("NeonVM suspend request successful", logFields...)
+				state.NeonVM().SuspendSuccessful(endTime)
+			}
+		})
+	}
+}
+
+func (c *ExecutorCoreWithClients) DoNeonVMResumes(ctx context.Context, logger *zap.Logger) {
+	var (
+		updates     util.BroadcastReceiver = c.updates.NewReceiver()
+		ifaceLogger *zap.Logger            = logger.Named("client")
+	)
+
+	for {
+		// Wait until the state's changed, or we're done.
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates.Wait():
+			updates.Awake()
+		}
+
+		last := c.getActions()
+		if last.actions.Resume == nil {
+			continue // nothing to do; wait until the state changes.
+		}
+
+		var startTime time.Time
+		action := *last.actions.Resume
+
+		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
+			logger.Info("Starting NeonVM resume request", zap.Object("action", action))
+			startTime = c.clock.Now()
+			state.NeonVM().StartingResume(startTime)
+		}); !updated {
+			continue // state has changed, retry.
+		}
+
+		err := c.clients.NeonVM.Resume(ctx, ifaceLogger)
+		endTime := c.clock.Now()
+		logFields := []zap.Field{zap.Object("action", action), zap.Duration("duration", endTime.Sub(startTime))}
+
+		c.update(func(state *core.State) {
+			if err != nil {
+				logger.Error("NeonVM resume request failed", append(logFields, zap.Error(err))...)
+				state.NeonVM().ResumeFailed(endTime)
+			} else /* err == nil */ {
+				logger.Info("NeonVM resume request successful", logFields...)
+				state.NeonVM().ResumeSuccessful(endTime)
+			}
+		})
 	}
 }
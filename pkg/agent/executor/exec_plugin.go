@@ -40,15 +40,16 @@ func (c *ExecutorCoreWithClients) DoPluginRequests(ctx context.Context, logger *
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
 			logger.Info("Starting plugin request", zap.Object("action", action))
-			startTime = time.Now()
+			startTime = c.clock.Now()
 			state.Plugin().StartingRequest(startTime, action.Target)
 		}); !updated {
 			continue // state has changed, retry.
 		}
 
 		resp, err := c.clients.Plugin.Request(ctx, ifaceLogger, action.LastPermit, action.Target, action.Metrics)
-		endTime := time.Now()
+		endTime := c.clock.Now()
 
+		var verdict SchedulerVerdict
 		c.update(func(state *core.State) {
 			logFields := []zap.Field{
 				zap.Object("action", action),
@@ -58,13 +59,32 @@ func (c *ExecutorCoreWithClients) DoPluginRequests(ctx context.Context, logger *
 			if err != nil {
 				logger.Error("Plugin request failed", append(logFields, zap.Error(err))...)
 				state.Plugin().RequestFailed(endTime)
+				verdict = SchedulerFailed
 			} else {
 				logFields = append(logFields, zap.Any("response", resp))
 				logger.Info("Plugin request successful", logFields...)
 				if err := state.Plugin().RequestSuccessful(endTime, *resp); err != nil {
 					logger.Error("Plugin response validation failed", append(logFields, zap.Error(err))...)
 				}
+				verdict = schedulerVerdict(action.LastPermit, action.Target, resp.Permit)
 			}
+			c.schedulerVerdict = verdict
 		})
+
+		// Successful changes are recorded when NeonVM is updated, but if the scheduler didn't
+		// allow the VM to increase, the change won't happen at all.
+		var previous api.Resources
+		if action.LastPermit != nil {
+			previous = *action.LastPermit
+		}
+		if err != nil {
+			c.recordDecision(makeDecision(
+				endTime, DecisionFailed, c.computeUnit, last.explanation, previous, action.Target, verdict, err,
+			))
+		} else if verdict != SchedulerApproved && action.Target.HasFieldGreaterThan(resp.Permit) {
+			c.recordDecision(makeDecision(
+				endTime, DecisionDenied, c.computeUnit, last.explanation, previous, action.Target, verdict, nil,
+			))
+		}
 	}
 }
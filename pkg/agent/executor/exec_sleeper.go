@@ -2,7 +2,6 @@ package executor
 
 import (
 	"context"
-	"time"
 
 	"go.uber.org/zap"
 
@@ -14,7 +13,7 @@ func (c *ExecutorCore) DoSleeper(ctx context.Context, logger *zap.Logger) {
 
 	// preallocate the timer. We clear it at the top of the loop; the 0 duration is just because we
 	// need *some* value, so it might as well be zero.
-	timer := time.NewTimer(0)
+	timer := c.clock.NewTimer(0)
 	defer timer.Stop()
 
 	for {
@@ -22,7 +21,7 @@ func (c *ExecutorCore) DoSleeper(ctx context.Context, logger *zap.Logger) {
 		if !timer.Stop() {
 			// Clear timer.C only if we haven't already read from it
 			select {
-			case <-timer.C:
+			case <-timer.C():
 			default:
 			}
 		}
@@ -51,7 +50,7 @@ func (c *ExecutorCore) DoSleeper(ctx context.Context, logger *zap.Logger) {
 		case <-updates.Wait():
 			// Don't consume the event here. Rely on the event to remain at the top of the loop
 			continue
-		case <-timer.C:
+		case <-timer.C():
 			select {
 			// If there's also an update, then let that take preference:
 			case <-updates.Wait():
@@ -11,15 +11,21 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
 
 // agentState is the global state for the autoscaler agent
@@ -40,28 +46,144 @@ type agentState struct {
 	vmClient     *vmclient.Clientset
 	schedTracker *schedwatch.SchedulerTracker
 	metrics      GlobalMetrics
+	// vmMetrics are the per-VM metrics, which include the gauges for each VM's autoscaling
+	vmMetrics    PerVMMetrics
+	nsLimiter    *namespaceLimiter
+	nodePressure *nodeMemoryPressure
+	// vmStore gives the VMs from the VM watch, so that Runners can check their VM without
+	// requests to the API server
+	vmStore watch.IndexedStore[vmapi.VirtualMachine, *watch.NameIndex[vmapi.VirtualMachine]]
+	// liveConfig stores the config currently in effect, which differs from config if the
+	// reloadable settings have been changed by reloading it
+	liveConfig *configStore
+	// eventRecorder, if not nil, is used to record scaling decisions and persistent problems as
+	// Events
+	eventRecorder record.EventRecorder
+	// nodeAnomalies, if not nil, posts Events for persistent problems with billing
+	nodeAnomalies *nodeAnomalies
+	// billingHealth, if not nil, tracks the status of billing for the health server
+	billingHealth *billingHealth
+	// webhook, if not nil, is used to send notifications of scaling decisions to a webhook
+	webhook *webhookSender
+	// patchQueue, if not nil, is used to send all VM patches
+	patchQueue *vmPatchQueue
+	// otlp is the receiver for metrics pushed by VMs, or nil if it's not enabled
+	otlp *otlpReceiver
+	// metricsClient is used to fetch metrics from VMs
+	metricsClient *metricsClient
+	// schedulerGRPC is the connection to the scheduler, or nil if requests aren't sent over gRPC
+	schedulerGRPC *schedulerGRPCConn
+	// tracerProvider exports the spans created by tracer. It's a no-op if tracing isn't enabled.
+	tracerProvider trace.TracerProvider
+	// tracer creates spans for each Runner's operations
+	tracer trace.Tracer
+	// faults injects faults into requests made by each Runner. It's nil if fault injection isn't
+	// enabled, which is safe to use.
+	faults *faults.Injector
 }
 
 func (r MainRunner) newAgentState(
 	baseLogger *zap.Logger,
 	podIP string,
+	vmStore *watch.Store[vmapi.VirtualMachine],
 	schedTracker *schedwatch.SchedulerTracker,
-) (*agentState, *prometheus.Registry) {
+	vmMetrics PerVMMetrics,
+) (*agentState, *prometheus.Registry, error) {
+	metricsClient, err := newMetricsClient(r.Config.Metrics.TLS)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating metrics client: %w", err)
+	}
+
 	metrics, promReg := makeGlobalMetrics()
 
-	state := &agentState{
-		lock:         util.NewChanMutex(),
-		pods:         make(map[util.NamespacedName]*podState),
-		baseLogger:   baseLogger,
-		config:       r.Config,
-		kubeClient:   r.KubeClient,
-		vmClient:     r.VMClient,
-		podIP:        podIP,
-		schedTracker: schedTracker,
-		metrics:      metrics,
+	var otlp *otlpReceiver
+	if r.Config.Metrics.OTLP != nil {
+		otlp = newOTLPReceiver(&r.Config.Metrics)
+	}
+
+	var eventRecorder record.EventRecorder
+	if (r.Config.Decisions != nil && r.Config.Decisions.KubernetesEvents) || r.Config.AnomalyEvents != nil {
+		eventRecorder = makeEventRecorder(r.KubeClient, r.EnvArgs.K8sNodeName)
+	}
+
+	var billingHealth *billingHealth
+	if r.Config.Health != nil {
+		billingHealth = newBillingHealth()
+	}
+
+	// The list of VMs that node-wide problems are posted on comes from the state itself, which
+	// doesn't exist yet.
+	var state *agentState
+
+	var anomalies *nodeAnomalies
+	if r.Config.AnomalyEvents != nil {
+		anomalies = newNodeAnomalies(r.Config.AnomalyEvents, eventRecorder, func() []util.NamespacedName {
+			return state.currentVMs()
+		})
+	}
+
+	var webhook *webhookSender
+	if r.Config.Webhook != nil {
+		webhook = newWebhookSender(baseLogger.Named("webhook"), r.Config.Webhook, metrics.webhookNotifications)
+	}
+
+	var patchQueue *vmPatchQueue
+	if r.Config.NeonVM.PatchQueue != nil {
+		patchQueue = newVMPatchQueue(&r.Config.NeonVM, r.VMClient, metrics)
+	}
+
+	var injector *faults.Injector
+	if r.Config.FaultInjection != nil {
+		scenario, err := faults.ReadScenario(r.Config.FaultInjection.ScenarioPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		baseLogger.Warn("Fault injection is enabled", zap.Any("scenario", scenario))
+		injector = faults.NewInjector(scenario)
+	}
+
+	tracerProvider, err := tracing.NewTracerProvider(context.Background(), r.Config.Tracing, "autoscaler-agent")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error setting up tracing: %w", err)
 	}
 
-	return state, promReg
+	var schedulerGRPC *schedulerGRPCConn
+	if r.Config.Scheduler.Transport == SchedulerTransportGRPC {
+		schedulerGRPC = newSchedulerGRPCConn(
+			r.Config.Scheduler.GRPC,
+			time.Second*time.Duration(r.Config.Scheduler.RequestTimeoutSeconds),
+		)
+	}
+
+	state = &agentState{
+		lock:           util.NewChanMutex(),
+		pods:           make(map[util.NamespacedName]*podState),
+		baseLogger:     baseLogger,
+		config:         r.Config,
+		kubeClient:     r.KubeClient,
+		vmClient:       r.VMClient,
+		vmStore:        watch.NewIndexedStore(vmStore, watch.NewNameIndex[vmapi.VirtualMachine]()),
+		podIP:          podIP,
+		schedTracker:   schedTracker,
+		metrics:        metrics,
+		vmMetrics:      vmMetrics,
+		nsLimiter:      newNamespaceLimiter(r.Config.Scaling.MaxConcurrentOperationsPerNamespace, metrics.namespaceLimitWaiting),
+		nodePressure:   newNodeMemoryPressure(),
+		liveConfig:     newConfigStore(r.Config),
+		eventRecorder:  eventRecorder,
+		nodeAnomalies:  anomalies,
+		billingHealth:  billingHealth,
+		webhook:        webhook,
+		patchQueue:     patchQueue,
+		otlp:           otlp,
+		metricsClient:  metricsClient,
+		schedulerGRPC:  schedulerGRPC,
+		tracerProvider: tracerProvider,
+		tracer:         tracerProvider.Tracer("github.com/neondatabase/autoscaling/pkg/agent"),
+		faults:         injector,
+	}
+
+	return state, promReg, nil
 }
 
 func vmIsOurResponsibility(vm *vmapi.VirtualMachine, config *Config, nodeName string) bool {
@@ -121,6 +243,7 @@ func (s *agentState) handleEvent(ctx context.Context, logger *zap.Logger, event
 			now := time.Now()
 			stat.vmInfo = event.vmInfo
 			stat.endpointID = event.endpointID
+			stat.labels = event.labels
 			stat.endpointAssignedAt = &now
 			state.vmInfoUpdated.Send()
 
@@ -151,8 +274,17 @@ func (s *agentState) handleVMEventAdded(
 			vmInfo:             event.vmInfo,
 			endpointID:         event.endpointID,
 			endpointAssignedAt: &now,
-			state:              "", // Explicitly set state to empty so that the initial state update does no decrement
-			stateUpdatedAt:     now,
+			labels:             event.labels,
+			lastUpscaleAt:      nil,
+			lastDownscaleAt:    nil,
+
+			databaseMetricsSeen:    false,
+			lastDatabaseActivityAt: nil,
+
+			utilization: nil,
+
+			state:          "", // Explicitly set state to empty so that the initial state update does no decrement
+			stateUpdatedAt: now,
 
 			startTime:                     now,
 			lastSuccessfulMonitorComm:     nil,
@@ -165,8 +297,14 @@ func (s *agentState) handleVMEventAdded(
 	// Empty update to trigger updating metrics and state.
 	status.update(s, func(s podStatus) podStatus { return s })
 
+	var decisions *decisionHistory
+	if s.config.Decisions != nil {
+		decisions = newDecisionHistory(s.config.Decisions.HistorySize)
+	}
+
 	runner := s.newRunner(event.vmInfo, podName, event.podIP)
 	runner.status = status
+	runner.decisions = decisions
 
 	txVMUpdate, rxVMUpdate := util.NewCondChannelPair()
 
@@ -175,6 +313,7 @@ func (s *agentState) handleVMEventAdded(
 		stop:          cancelRunnerContext,
 		runner:        runner,
 		status:        status,
+		decisions:     decisions,
 		vmInfoUpdated: txVMUpdate,
 	}
 	s.metrics.runnerStarts.Inc()
@@ -318,6 +457,7 @@ func (s *agentState) TriggerRestartIfNecessary(runnerCtx context.Context, logger
 			restartCount := len(status.previousEndStates) + 1
 			runner := s.newRunner(status.vmInfo, podName, podIP)
 			runner.status = pod.status
+			runner.decisions = pod.decisions
 
 			txVMUpdate, rxVMUpdate := util.NewCondChannelPair()
 			// note: pod is *podState, so we don't need to re-assign to the map.
@@ -343,12 +483,14 @@ func (s *agentState) loggerForRunner(restartCount int, vmName, podName util.Name
 	)
 }
 
-// NB: caller must set Runner.status after creation
+// NB: caller must set Runner.status and Runner.decisions after creation
 func (s *agentState) newRunner(vmInfo api.VmInfo, podName util.NamespacedName, podIP string) *Runner {
 	return &Runner{
 		global: s,
 		status: nil, // set by caller
 
+		decisions: nil, // set by caller
+
 		shutdown:    nil, // set by (*Runner).Run
 		vmName:      vmInfo.NamespacedName(),
 		podName:     podName,
@@ -357,8 +499,13 @@ func (s *agentState) newRunner(vmInfo api.VmInfo, podName util.NamespacedName, p
 		lock:        util.NewChanMutex(),
 
 		executorStateDump: nil, // set by (*Runner).Run
+		executorDebugDump: nil, // set by (*Runner).Run
+		executorGoal:      nil, // set by (*Runner).Run
+
+		monitor:   nil,
+		anomalies: newVMAnomalies(),
 
-		monitor: nil,
+		lastMetricsSpan: atomic.Pointer[trace.SpanContext]{},
 
 		backgroundWorkerCount: atomic.Int64{},
 		backgroundPanic:       make(chan error),
@@ -371,6 +518,9 @@ type podState struct {
 	stop   context.CancelFunc
 	runner *Runner
 	status *lockedPodStatus
+	// decisions, if not nil, stores the recent scaling decisions for the VM. It's shared by each
+	// Runner for the pod, so that it persists across restarts.
+	decisions *decisionHistory
 
 	vmInfoUpdated util.CondChannelSender
 }
@@ -430,6 +580,24 @@ type podStatus struct {
 	// NB: this value, once non-nil, is never changed.
 	endpointAssignedAt *time.Time
 
+	// labels stores the latest labels on the VM object, as given by the global VM watcher
+	labels map[string]string
+
+	// lastUpscaleAt and lastDownscaleAt, if not nil, give the time of the most recent successful
+	// NeonVM request that increased or decreased the VM's resources, respectively
+	lastUpscaleAt   *time.Time
+	lastDownscaleAt *time.Time
+
+	// databaseMetricsSeen is true once any metrics from Postgres inside the VM have been received.
+	// lastDatabaseActivityAt, if not nil, gives the most recent time that they showed the database
+	// to be active. See dbactivity.go.
+	databaseMetricsSeen    bool
+	lastDatabaseActivityAt *time.Time
+
+	// utilization, if not nil, gives the resources used by the VM, from its most recent metrics.
+	// See utilization.go.
+	utilization *billing.VMUtilization
+
 	state          runnerMetricState
 	stateUpdatedAt time.Time
 }
@@ -450,6 +618,9 @@ type podStatusDump struct {
 	EndpointID         string     `json:"endpointID"`
 	EndpointAssignedAt *time.Time `json:"endpointAssignedAt"`
 
+	LastUpscaleAt   *time.Time `json:"lastUpscaleAt"`
+	LastDownscaleAt *time.Time `json:"lastDownscaleAt"`
+
 	State          runnerMetricState `json:"state"`
 	StateUpdatedAt time.Time         `json:"stateUpdatedAt"`
 }
@@ -515,6 +686,8 @@ func (s *lockedPodStatus) update(global *agentState, with func(podStatus) podSta
 		global.metrics.runnersCount.WithLabelValues(newIsEndpoint, string(newStatus.state)).Inc()
 	}
 
+	global.vmMetrics.updateVMUsageMetrics(global.config.Scaling.ComputeUnit, s.podStatus, newStatus)
+
 	s.podStatus = newStatus
 }
 
@@ -608,6 +781,10 @@ func (s *lockedPodStatus) dump() podStatusDump {
 		EndpointAssignedAt: s.endpointAssignedAt, // ok to share the pointer, because it's not updated
 		StartTime:          s.startTime,
 
+		// ok to share the pointers, because they're replaced instead of updated
+		LastUpscaleAt:   s.lastUpscaleAt,
+		LastDownscaleAt: s.lastDownscaleAt,
+
 		State:          s.state,
 		StateUpdatedAt: s.stateUpdatedAt,
 
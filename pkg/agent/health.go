@@ -0,0 +1,362 @@
+package agent
+
+// Liveness and readiness endpoints, reporting the status of each of the autoscaler-agent's
+// subsystems
+//
+// Both endpoints serve the same JSON report. They only differ in when they fail: /healthz fails only
+// if restarting the autoscaler-agent might help (i.e. the global state is locked up, or the VM watch
+// has stopped), while /readyz fails if any of the autoscaler-agent's own subsystems is failing.
+//
+// Readiness deliberately ignores the subsystems that depend on something outside the pod (metrics
+// from VMs, the scheduler, and billing), because the pod can't fix those, and failing readiness for
+// them would only make it flap. Their status is still in the report, and is also exported as the
+// autoscaling_agent_subsystem_health metric, so they can be alerted on.
+//
+// Subsystems that are "degraded" never cause either to fail, but are visible in the report - so
+// that, for example, a billing backlog can be told apart from the agent being totally broken.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+// HealthConfig configures the server for liveness and readiness probes
+type HealthConfig struct {
+	// Port is the port to serve /healthz and /readyz on
+	Port uint16 `json:"port"`
+	// TimeoutSeconds gives the maximum time to spend getting the status of the subsystems. If the
+	// global state can't be locked in that time, the autoscaler-agent is reported as not live.
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// MaxFailingMetricsFraction gives the fraction of VMs with failing metrics requests above which
+	// the metrics subsystem is reported as degraded. If every VM is failing, it's reported as
+	// failing instead.
+	MaxFailingMetricsFraction float64 `json:"maxFailingMetricsFraction"`
+	// MaxBillingQueueSize gives the number of billing events waiting to be pushed with any single
+	// client above which the billing subsystem is reported as degraded
+	MaxBillingQueueSize uint `json:"maxBillingQueueSize"`
+}
+
+// HealthStatus is the status of a single subsystem, or of the autoscaler-agent as a whole
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded"
+	HealthFailing  HealthStatus = "failing"
+)
+
+// Names of the subsystems in the HealthReport
+const (
+	healthSubsystemState     = "state"
+	healthSubsystemVMStore   = "vmStore"
+	healthSubsystemMetrics   = "metrics"
+	healthSubsystemBilling   = "billing"
+	healthSubsystemScheduler = "scheduler"
+)
+
+// localSubsystems are the subsystems that only depend on the autoscaler-agent itself, and so are the
+// only ones that can make it not ready
+var localSubsystems = []string{healthSubsystemState, healthSubsystemVMStore}
+
+// SubsystemHealth is the status of a single subsystem
+type SubsystemHealth struct {
+	Status HealthStatus `json:"status"`
+	// Message, if not empty, describes why the subsystem isn't ok
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is the response to requests to /healthz and /readyz
+type HealthReport struct {
+	// Status is the worst status of any subsystem
+	Status HealthStatus `json:"status"`
+	// Live is false if restarting the autoscaler-agent might fix a failing subsystem
+	Live bool `json:"live"`
+	// Ready is false if one of the autoscaler-agent's own subsystems is failing. Failing
+	// dependencies (like the scheduler) are not included.
+	Ready      bool                       `json:"ready"`
+	Subsystems map[string]SubsystemHealth `json:"subsystems"`
+}
+
+func healthOK() SubsystemHealth {
+	return SubsystemHealth{Status: HealthOK, Message: ""}
+}
+
+func healthDegraded(format string, args ...any) SubsystemHealth {
+	return SubsystemHealth{Status: HealthDegraded, Message: fmt.Sprintf(format, args...)}
+}
+
+func healthFailing(format string, args ...any) SubsystemHealth {
+	return SubsystemHealth{Status: HealthFailing, Message: fmt.Sprintf(format, args...)}
+}
+
+var _ billing.StatusReporter = (*billingHealth)(nil)
+
+// billingHealth tracks the status of billing, as reported by the billing collector
+type billingHealth struct {
+	mu      sync.Mutex
+	clients map[string]billingClientHealth
+}
+
+type billingClientHealth struct {
+	queueSize int
+	lastErr   error
+}
+
+func newBillingHealth() *billingHealth {
+	return &billingHealth{
+		mu:      sync.Mutex{},
+		clients: make(map[string]billingClientHealth),
+	}
+}
+
+// VMStoreFailing implements billing.StatusReporter
+func (h *billingHealth) VMStoreFailing(time.Duration) {
+	// The VM store is reported separately, as its own subsystem
+}
+
+// VMStoreRecovered implements billing.StatusReporter
+func (h *billingHealth) VMStoreRecovered() {}
+
+// QueueSize implements billing.StatusReporter
+func (h *billingHealth) QueueSize(client string, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.clients[client]
+	c.queueSize = size
+	h.clients[client] = c
+}
+
+// PushResult implements billing.StatusReporter
+func (h *billingHealth) PushResult(client string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.clients[client]
+	c.lastErr = err
+	h.clients[client] = c
+}
+
+func (h *billingHealth) health(config *HealthConfig) SubsystemHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var problems []string
+	for name, c := range h.clients {
+		if c.lastErr != nil {
+			problems = append(problems, fmt.Sprintf("last push to %q failed: %s", name, c.lastErr))
+		}
+		if uint(c.queueSize) > config.MaxBillingQueueSize {
+			problems = append(problems, fmt.Sprintf("%d events waiting to be pushed to %q", c.queueSize, name))
+		}
+	}
+	if len(problems) != 0 {
+		slices.Sort(problems)
+		return healthDegraded("%s", strings.Join(problems, "; "))
+	}
+	return healthOK()
+}
+
+// billingStatusReporters sends the status of billing to each of the reporters
+type billingStatusReporters []billing.StatusReporter
+
+var _ billing.StatusReporter = billingStatusReporters(nil)
+
+func (rs billingStatusReporters) VMStoreFailing(outage time.Duration) {
+	for _, r := range rs {
+		r.VMStoreFailing(outage)
+	}
+}
+
+func (rs billingStatusReporters) VMStoreRecovered() {
+	for _, r := range rs {
+		r.VMStoreRecovered()
+	}
+}
+
+func (rs billingStatusReporters) QueueSize(client string, size int) {
+	for _, r := range rs {
+		r.QueueSize(client, size)
+	}
+}
+
+func (rs billingStatusReporters) PushResult(client string, err error) {
+	for _, r := range rs {
+		r.PushResult(client, err)
+	}
+}
+
+// healthReport gathers the status of each subsystem
+func (s *agentState) healthReport(ctx context.Context, vmStore *watch.Store[vmapi.VirtualMachine]) HealthReport {
+	subsystems := make(map[string]SubsystemHealth)
+	live := true
+
+	switch {
+	case vmStore.Stopped():
+		subsystems[healthSubsystemVMStore] = healthFailing("VM watch has stopped")
+		live = false
+	case vmStore.Failing():
+		// The watch is retrying, and may still recover on its own. If it doesn't, it gives up and
+		// stops (when .vmWatch.maxConsecutiveFailures is set).
+		subsystems[healthSubsystemVMStore] = healthDegraded(
+			"VM watch is failing to re-list or re-watch (%d consecutive failures)",
+			vmStore.ConsecutiveFailures(),
+		)
+	default:
+		subsystems[healthSubsystemVMStore] = healthOK()
+	}
+
+	if s.billingHealth != nil {
+		subsystems[healthSubsystemBilling] = s.billingHealth.health(s.config.Health)
+	}
+
+	var runners, metricsFailing, schedulerFailing int
+	err := func() error {
+		if err := s.lock.TryLock(ctx); err != nil {
+			return err
+		}
+		defer s.lock.Unlock()
+
+		for _, pod := range s.pods {
+			pod.status.mu.Lock()
+			status := pod.status.podStatus
+			pod.status.mu.Unlock()
+
+			if status.deleted || pod.runner == nil {
+				continue
+			}
+			runners += 1
+			if pod.runner.anomalies.metricsFailing() {
+				metricsFailing += 1
+			}
+			if status.failedSchedulerRequestCounter.Get() > s.config.Scheduler.MaxFailedRequestRate.Threshold {
+				schedulerFailing += 1
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		subsystems[healthSubsystemState] = healthFailing("could not lock global state: %s", err)
+		subsystems[healthSubsystemMetrics] = healthDegraded("unknown, because the global state could not be locked")
+		live = false
+	} else {
+		subsystems[healthSubsystemState] = healthOK()
+
+		switch {
+		case runners != 0 && metricsFailing == runners:
+			subsystems[healthSubsystemMetrics] = healthFailing("metrics requests are failing for all %d VMs", runners)
+		case runners != 0 && float64(metricsFailing)/float64(runners) > s.config.Health.MaxFailingMetricsFraction:
+			subsystems[healthSubsystemMetrics] = healthDegraded("metrics requests are failing for %d of %d VMs", metricsFailing, runners)
+		default:
+			subsystems[healthSubsystemMetrics] = healthOK()
+		}
+	}
+
+	switch {
+	case s.schedTracker.Get() == nil:
+		subsystems[healthSubsystemScheduler] = healthFailing("no scheduler is currently running")
+	case schedulerFailing != 0:
+		subsystems[healthSubsystemScheduler] = healthDegraded("scheduler requests are failing for %d of %d VMs", schedulerFailing, runners)
+	default:
+		subsystems[healthSubsystemScheduler] = healthOK()
+	}
+
+	recordSubsystemHealth(s.metrics.subsystemHealth, subsystems)
+
+	return makeHealthReport(subsystems, live)
+}
+
+// recordSubsystemHealth sets the gauge for each subsystem's status to 1, and its other statuses to 0
+func recordSubsystemHealth(gauge *prometheus.GaugeVec, subsystems map[string]SubsystemHealth) {
+	for name, h := range subsystems {
+		for _, status := range []HealthStatus{HealthOK, HealthDegraded, HealthFailing} {
+			value := 0.0
+			if h.Status == status {
+				value = 1.0
+			}
+			gauge.WithLabelValues(name, string(status)).Set(value)
+		}
+	}
+}
+
+// makeHealthReport summarizes the status of the subsystems
+func makeHealthReport(subsystems map[string]SubsystemHealth, live bool) HealthReport {
+	status := HealthOK
+	ready := true
+	for name, h := range subsystems {
+		if h.Status == HealthFailing || (h.Status == HealthDegraded && status == HealthOK) {
+			status = h.Status
+		}
+		if h.Status == HealthFailing && slices.Contains(localSubsystems, name) {
+			ready = false
+		}
+	}
+
+	return HealthReport{Status: status, Live: live, Ready: ready, Subsystems: subsystems}
+}
+
+func (s *agentState) StartHealthServer(
+	ctx context.Context,
+	logger *zap.Logger,
+	config *HealthConfig,
+	vmStore *watch.Store[vmapi.VirtualMachine],
+) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	handler := func(check func(HealthReport) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(config.TimeoutSeconds))
+			defer cancel()
+
+			report := s.healthReport(ctx, vmStore)
+			body, err := json.Marshal(report)
+			if err != nil {
+				logger.Panic("Failed to encode health report JSON", zap.Error(err))
+			}
+
+			code := http.StatusOK
+			if !check(report) {
+				code = http.StatusServiceUnavailable
+				logger.Warn("Responding to health check with failure", zap.String("path", r.URL.Path), zap.Any("report", report))
+			}
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(code)
+			_, _ = w.Write(body)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handler(func(r HealthReport) bool { return r.Live }))
+	mux.HandleFunc("/readyz", handler(func(r HealthReport) bool { return r.Ready }))
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Health server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthReportReadiness(t *testing.T) {
+	cases := []struct {
+		name           string
+		subsystems     map[string]SubsystemHealth
+		expectedStatus HealthStatus
+		expectedReady  bool
+	}{
+		{
+			name: "all-ok",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:   healthOK(),
+				healthSubsystemVMStore: healthOK(),
+				healthSubsystemMetrics: healthOK(),
+			},
+			expectedStatus: HealthOK,
+			expectedReady:  true,
+		},
+		{
+			name: "scheduler-failing",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:     healthOK(),
+				healthSubsystemVMStore:   healthOK(),
+				healthSubsystemScheduler: healthFailing("no scheduler is currently running"),
+			},
+			expectedStatus: HealthFailing,
+			expectedReady:  true,
+		},
+		{
+			name: "metrics-failing-billing-degraded",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:   healthOK(),
+				healthSubsystemVMStore: healthOK(),
+				healthSubsystemMetrics: healthFailing("metrics requests are failing for all 3 VMs"),
+				healthSubsystemBilling: healthDegraded("last push to \"http\" failed"),
+			},
+			expectedStatus: HealthFailing,
+			expectedReady:  true,
+		},
+		{
+			name: "vm-store-degraded",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:   healthOK(),
+				healthSubsystemVMStore: healthDegraded("VM watch is failing"),
+			},
+			expectedStatus: HealthDegraded,
+			expectedReady:  true,
+		},
+		{
+			name: "vm-store-stopped",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:   healthOK(),
+				healthSubsystemVMStore: healthFailing("VM watch has stopped"),
+			},
+			expectedStatus: HealthFailing,
+			expectedReady:  false,
+		},
+		{
+			name: "state-locked",
+			subsystems: map[string]SubsystemHealth{
+				healthSubsystemState:   healthFailing("could not lock global state"),
+				healthSubsystemVMStore: healthOK(),
+			},
+			expectedStatus: HealthFailing,
+			expectedReady:  false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report := makeHealthReport(c.subsystems, true)
+			assert.Equal(t, c.expectedStatus, report.Status)
+			assert.Equal(t, c.expectedReady, report.Ready)
+		})
+	}
+}
+
+func TestRecordSubsystemHealth(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "test_subsystem_health"}, //nolint:exhaustruct // only the name matters
+		[]string{"subsystem", "status"},
+	)
+
+	recordSubsystemHealth(gauge, map[string]SubsystemHealth{
+		healthSubsystemScheduler: healthFailing("no scheduler is currently running"),
+	})
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauge.WithLabelValues(healthSubsystemScheduler, string(HealthFailing))))
+	assert.Equal(t, 0.0, testutil.ToFloat64(gauge.WithLabelValues(healthSubsystemScheduler, string(HealthOK))))
+
+	// Recovering moves the 1 to the new status
+	recordSubsystemHealth(gauge, map[string]SubsystemHealth{
+		healthSubsystemScheduler: healthOK(),
+	})
+	assert.Equal(t, 0.0, testutil.ToFloat64(gauge.WithLabelValues(healthSubsystemScheduler, string(HealthFailing))))
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauge.WithLabelValues(healthSubsystemScheduler, string(HealthOK))))
+}
@@ -0,0 +1,231 @@
+package agent
+
+// Optional leader election, so that more than one autoscaler-agent can run for each node with only
+// one of them acting at a time.
+//
+// Everything the autoscaler-agent does for its node is a singleton: only one agent may make
+// scaling decisions for a VM, or push billing events for it. So the leader runs the entire main
+// loop, and the other replicas wait on the node's Lease until it's released or expires.
+//
+// When leadership is lost, the main loop is stopped the same way as on shutdown - including
+// flushing the in-memory billing state, if configured - and then Run returns an error, so that the
+// process restarts as a standby with clean state.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// LeaderElectionConfig configures leader election between the autoscaler-agents for each node
+type LeaderElectionConfig struct {
+	// LeaseNamespace is the namespace of the Leases used for the election
+	LeaseNamespace string `json:"leaseNamespace"`
+	// LeaseNamePrefix is combined with the node name to give the name of the node's Lease, like
+	// "<prefix>-<node name>"
+	LeaseNamePrefix string `json:"leaseNamePrefix"`
+	// LeaseDurationSeconds gives how long standbys wait after the last renewal before taking over
+	LeaseDurationSeconds uint `json:"leaseDurationSeconds"`
+	// RenewDeadlineSeconds gives how long the leader keeps trying to renew the Lease before giving
+	// up leadership. It must be less than LeaseDurationSeconds.
+	RenewDeadlineSeconds uint `json:"renewDeadlineSeconds"`
+	// RetryPeriodSeconds gives the time between attempts to acquire or renew the Lease
+	RetryPeriodSeconds uint `json:"retryPeriodSeconds"`
+	// MetricsPort is the port to serve the leader election metrics on. They're served separately
+	// from the rest, because the other metrics servers only run while leading.
+	MetricsPort uint16 `json:"metricsPort"`
+}
+
+type leaderElectionMetrics struct {
+	leader      prometheus.Gauge
+	transitions *prometheus.CounterVec
+}
+
+func makeLeaderElectionMetrics() (leaderElectionMetrics, *prometheus.Registry) {
+	reg := prometheus.NewRegistry()
+
+	metrics := leaderElectionMetrics{
+		leader: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_leader",
+				Help: "Whether this autoscaler-agent is currently the leader for its node (1) or not (0)",
+			},
+		)),
+		transitions: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_leadership_transitions_total",
+				Help: "Number of times this autoscaler-agent acquired or lost leadership for its node",
+			},
+			[]string{"transition"},
+		)),
+	}
+
+	return metrics, reg
+}
+
+// runWithLeaderElection calls run only while this autoscaler-agent is the leader for its node
+func (r MainRunner) runWithLeaderElection(
+	ctx context.Context,
+	logger *zap.Logger,
+	conf *LeaderElectionConfig,
+	run func(context.Context, *zap.Logger) error,
+) error {
+	leaseName := fmt.Sprintf("%s-%s", conf.LeaseNamePrefix, r.EnvArgs.K8sNodeName)
+	return runWithLeaderElection(ctx, logger, r.KubeClient, conf, leaseName, run)
+}
+
+// runWithLeaderElection calls run only while holding the named Lease
+func runWithLeaderElection(
+	ctx context.Context,
+	logger *zap.Logger,
+	kubeClient kubernetes.Interface,
+	conf *LeaderElectionConfig,
+	leaseName string,
+	run func(context.Context, *zap.Logger) error,
+) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Error getting hostname for leader election identity: %w", err)
+	}
+
+	return runAsLeader(ctx, logger, kubeClient, conf, leaseName, identity, run)
+}
+
+// runAsLeader calls run only while holding the named Lease as identity
+func runAsLeader(
+	ctx context.Context,
+	logger *zap.Logger,
+	kubeClient kubernetes.Interface,
+	conf *LeaderElectionConfig,
+	leaseName string,
+	identity string,
+	run func(context.Context, *zap.Logger) error,
+) error {
+	runLogger := logger
+	logger = logger.Named("leader-election")
+
+	metrics, promReg := makeLeaderElectionMetrics()
+	if err := util.StartPrometheusMetricsServer(ctx, logger.Named("prometheus"), conf.MetricsPort, promReg); err != nil {
+		return fmt.Errorf("Error starting prometheus metrics server: %w", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: conf.LeaseNamespace,
+			Name:      leaseName,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	// The elector is given its own context, so that on shutdown we can finish running - and
+	// flushing billing events - before the Lease is released.
+	electorCtx, cancelElector := context.WithCancel(context.Background())
+	defer cancelElector()
+
+	var runErr error
+	runDone := make(chan struct{})
+	var started atomic.Bool
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   time.Second * time.Duration(conf.LeaseDurationSeconds),
+		RenewDeadline:   time.Second * time.Duration(conf.RenewDeadlineSeconds),
+		RetryPeriod:     time.Second * time.Duration(conf.RetryPeriodSeconds),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leadingCtx context.Context) {
+				defer close(runDone)
+
+				started.Store(true)
+				logger.Info("Acquired leadership")
+				metrics.leader.Set(1)
+				metrics.transitions.WithLabelValues("acquired").Inc()
+
+				// Stop when either the autoscaler-agent is shutting down or leadership is lost.
+				runCtx, cancel := context.WithCancel(leadingCtx)
+				defer cancel()
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-runCtx.Done():
+					}
+				}()
+
+				runErr = run(runCtx, runLogger)
+			},
+			OnStoppedLeading: func() {
+				metrics.leader.Set(0)
+				if started.Load() {
+					logger.Warn("Lost leadership")
+					metrics.transitions.WithLabelValues("lost").Inc()
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logger.Info("Current leader is another autoscaler-agent", zap.String("leader", leader))
+				}
+			},
+		},
+		Name: "autoscaler-agent",
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating leader elector: %w", err)
+	}
+
+	// Stop trying to acquire leadership on shutdown, if we don't already have it. If we do, the
+	// elector is stopped once run has finished.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-runDone:
+			return
+		}
+		if !started.Load() {
+			cancelElector()
+		}
+	}()
+
+	logger.Info("Waiting to acquire leadership", zap.String("identity", identity))
+	electorDone := make(chan struct{})
+	go func() {
+		defer close(electorDone)
+		elector.Run(electorCtx)
+	}()
+
+	select {
+	case <-runDone:
+	case <-electorCtx.Done():
+		// Shut down before ever becoming leader.
+		<-electorDone
+		return nil
+	}
+
+	// Release the Lease now that we've finished, so that a standby can take over immediately. The
+	// elector releases it as it stops, so wait for that before returning (and possibly exiting).
+	cancelElector()
+	<-electorDone
+
+	if ctx.Err() != nil {
+		return runErr
+	} else if runErr != nil {
+		return runErr
+	}
+	return errors.New("lost leadership")
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testLeaseName = "autoscaler-agent-node"
+
+func testLeaderElectionConfig() *LeaderElectionConfig {
+	return &LeaderElectionConfig{
+		LeaseNamespace:       "kube-system",
+		LeaseNamePrefix:      "autoscaler-agent",
+		LeaseDurationSeconds: 3,
+		RenewDeadlineSeconds: 2,
+		RetryPeriodSeconds:   1,
+		MetricsPort:          0,
+	}
+}
+
+// startElection calls runAsLeader in the background, with a run function that signals on
+// started and then waits until its context is canceled
+func startElection(
+	ctx context.Context,
+	client kubernetes.Interface,
+	identity string,
+	started chan<- string,
+) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		err := runAsLeader(
+			ctx, zap.NewNop(), client, testLeaderElectionConfig(), testLeaseName, identity,
+			func(ctx context.Context, _ *zap.Logger) error {
+				started <- identity
+				<-ctx.Done()
+				return nil
+			},
+		)
+		done <- err
+	}()
+	return done
+}
+
+func leaseHolder(t *testing.T, client kubernetes.Interface) string {
+	lease, err := client.CoordinationV1().Leases("kube-system").Get(context.Background(), testLeaseName, metav1.GetOptions{})
+	require.NoError(t, err)
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestLeaderElectionShutdown(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan string, 1)
+	done := startElection(ctx, client, "agent-a", started)
+
+	select {
+	case id := <-started:
+		assert.Equal(t, "agent-a", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting to acquire leadership")
+	}
+	assert.Equal(t, "agent-a", leaseHolder(t, client))
+
+	// Shutting down while leading returns run's error - which is nil - rather than "lost
+	// leadership", and releases the Lease
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+	assert.Equal(t, "", leaseHolder(t, client))
+}
+
+func TestLeaderElectionStandbyTakesOver(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	started := make(chan string, 2)
+	doneA := startElection(ctxA, client, "agent-a", started)
+	select {
+	case id := <-started:
+		require.Equal(t, "agent-a", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the first agent to acquire leadership")
+	}
+
+	// The standby doesn't run while the first agent is leading
+	doneB := startElection(ctxB, client, "agent-b", started)
+	select {
+	case id := <-started:
+		t.Fatalf("%s started running while agent-a was leading", id)
+	case <-time.After(2 * time.Second):
+	}
+
+	// ... but takes over once the leader shuts down and releases the Lease
+	cancelA()
+	<-doneA
+	select {
+	case id := <-started:
+		assert.Equal(t, "agent-b", id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the standby to take over")
+	}
+
+	cancelB()
+	assert.NoError(t, <-doneB)
+}
+
+func TestLeaderElectionShutdownWhileStandby(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	started := make(chan string, 2)
+	_ = startElection(ctxA, client, "agent-a", started)
+	<-started
+
+	// A standby that shuts down without ever leading returns without error, and never runs
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneB := startElection(ctxB, client, "agent-b", started)
+	time.Sleep(time.Second)
+	cancelB()
+
+	select {
+	case err := <-doneB:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the standby to shut down")
+	}
+	assert.Empty(t, started)
+	assert.Equal(t, "agent-a", leaseHolder(t, client))
+}
+
+func TestLeaderElectionLostLeadership(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runCanceled atomic.Bool
+	started := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- runAsLeader(
+			ctx, zap.NewNop(), client, testLeaderElectionConfig(), testLeaseName, "agent-a",
+			func(ctx context.Context, _ *zap.Logger) error {
+				started <- "agent-a"
+				<-ctx.Done()
+				runCanceled.Store(true)
+				return nil
+			},
+		)
+	}()
+	<-started
+
+	// Another agent takes the Lease out from under the leader, so it can't renew it
+	leases := client.CoordinationV1().Leases("kube-system")
+	lease, err := leases.Get(context.Background(), testLeaseName, metav1.GetOptions{})
+	require.NoError(t, err)
+	other := "agent-b"
+	lease.Spec.HolderIdentity = &other
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(context.Background(), lease, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// Losing leadership stops run and returns an error, so that the process restarts as a standby
+	select {
+	case err := <-done:
+		assert.True(t, runCanceled.Load())
+		assert.EqualError(t, err, "lost leadership")
+	case <-time.After(20 * time.Second):
+		t.Fatal("timed out waiting for leadership to be lost")
+	}
+}
@@ -0,0 +1,92 @@
+package agent
+
+// HTTP client for fetching metrics from VMs, optionally over HTTPS with authentication, so that
+// the metrics can't be spoofed by anything else on the pod network.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// metricsClient makes requests to the metrics endpoints in VMs
+type metricsClient struct {
+	client *http.Client
+	scheme string
+	// bearerTokenFile, if not empty, is the path of the file with the token to send with each
+	// request
+	bearerTokenFile string
+}
+
+func newMetricsClient(conf *MetricsTLSConfig) (*metricsClient, error) {
+	if conf == nil {
+		return &metricsClient{
+			client:          http.DefaultClient,
+			scheme:          "http",
+			bearerTokenFile: "",
+		}, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: conf.ServerName,
+	}
+
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificates in CA bundle %q", conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &metricsClient{
+		client:          &http.Client{Transport: transport},
+		scheme:          "https",
+		bearerTokenFile: conf.BearerTokenFile,
+	}, nil
+}
+
+// url returns the URL of the metrics endpoint with the port and path at the host
+func (c *metricsClient) url(host string, port uint16, path string) string {
+	return fmt.Sprintf("%s://%s:%d%s", c.scheme, host, port, path)
+}
+
+// get makes a GET request to the URL, adding the bearer token if there is one
+func (c *metricsClient) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, bytes.NewReader(nil))
+	if err != nil {
+		panic(fmt.Errorf("Error constructing metrics request to %q: %w", url, err))
+	}
+
+	if c.bearerTokenFile != "" {
+		token, err := util.ReadSecretFile(c.bearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return c.client.Do(req)
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splitServerAddr returns the host and port that the test server is listening on
+func splitServerAddr(t *testing.T, server *httptest.Server) (string, uint16) {
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	require.NoError(t, err)
+	return host, uint16(port)
+}
+
+func TestMetricsClientPlain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	client, err := newMetricsClient(nil)
+	require.NoError(t, err)
+
+	host, port := splitServerAddr(t, server)
+	url := client.url(host, port, "/metrics")
+	assert.Equal(t, server.URL+"/metrics", url)
+
+	resp, err := client.get(context.Background(), url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "/metrics", string(body))
+}
+
+func TestMetricsClientTLS(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Headers: nil, Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first\n"), 0o600))
+
+	host, port := splitServerAddr(t, server)
+	ctx := context.Background()
+
+	client, err := newMetricsClient(&MetricsTLSConfig{
+		CAFile:          caFile,
+		ServerName:      "example.com", // the name in httptest's certificate
+		ClientCertFile:  "",
+		ClientKeyFile:   "",
+		BearerTokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+
+	url := client.url(host, port, "/metrics")
+	assert.Equal(t, server.URL+"/metrics", url)
+
+	resp, err := client.get(ctx, url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "Bearer first", gotAuth)
+
+	// The token is re-read for each request
+	require.NoError(t, os.WriteFile(tokenFile, []byte("second"), 0o600))
+	resp, err = client.get(ctx, url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "Bearer second", gotAuth)
+
+	// ... and an empty token fails the request instead of sending it without one
+	require.NoError(t, os.WriteFile(tokenFile, []byte("  \n"), 0o600))
+	_, err = client.get(ctx, url)
+	assert.ErrorContains(t, err, "empty")
+
+	// Without the CA, the server's certificate isn't trusted
+	untrusted, err := newMetricsClient(&MetricsTLSConfig{
+		CAFile:          "",
+		ServerName:      "example.com",
+		ClientCertFile:  "",
+		ClientKeyFile:   "",
+		BearerTokenFile: "",
+	})
+	require.NoError(t, err)
+	_, err = untrusted.get(ctx, url)
+	assert.Error(t, err)
+}
+
+func TestNewMetricsClientErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not-pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+
+	cases := []struct {
+		name string
+		conf MetricsTLSConfig
+		err  string
+	}{
+		{
+			name: "missing-ca",
+			conf: MetricsTLSConfig{CAFile: filepath.Join(dir, "missing"), ServerName: "", ClientCertFile: "", ClientKeyFile: "", BearerTokenFile: ""},
+			err:  "Error reading CA bundle",
+		},
+		{
+			name: "invalid-ca",
+			conf: MetricsTLSConfig{CAFile: notPEM, ServerName: "", ClientCertFile: "", ClientKeyFile: "", BearerTokenFile: ""},
+			err:  "No valid certificates",
+		},
+		{
+			name: "invalid-client-cert",
+			conf: MetricsTLSConfig{CAFile: "", ServerName: "", ClientCertFile: notPEM, ClientKeyFile: notPEM, BearerTokenFile: ""},
+			err:  "Error loading client certificate",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := c.conf
+			_, err := newMetricsClient(&conf)
+			assert.ErrorContains(t, err, c.err)
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package agent
+
+// Resuming sessions with the vm-monitor after the connection drops, so that requests in flight
+// aren't lost and the runner doesn't need to restart its vm-monitor state. See api.MonitorResume
+// for the protocol.
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// monitorSession is the state of a session with the vm-monitor that can be resumed
+type monitorSession struct {
+	id string
+
+	// lock guards the rest of the fields. No other locks may be acquired while holding it.
+	lock sync.Mutex
+
+	// lastSentSeq is the sequence number of the latest message we sent
+	lastSentSeq uint64
+	// lastReceivedSeq is the sequence number of the latest message we received
+	lastReceivedSeq uint64
+	// unanswered stores the requests that haven't been responded to yet, by transaction id, so
+	// they can be sent again after resuming
+	unanswered map[uint64]sequencedMessage
+	// unacked stores the other messages that we sent (i.e. our responses to the vm-monitor's
+	// messages), in order, until the vm-monitor acknowledges receiving them. The vm-monitor doesn't
+	// send its messages again once we've responded, so these must be sent again after resuming too.
+	unacked []sequencedMessage
+}
+
+// maxUnackedMessages is the most responses that a monitorSession keeps for the vm-monitor to
+// acknowledge. If there's more, the oldest are dropped, so that a vm-monitor that never sends
+// acknowledgements can't grow the session without bound.
+const maxUnackedMessages = 64
+
+type sequencedMessage struct {
+	seq  uint64
+	data []byte
+}
+
+func newMonitorSession(id string) *monitorSession {
+	return &monitorSession{
+		id:              id,
+		lock:            sync.Mutex{},
+		lastSentSeq:     0,
+		lastReceivedSeq: 0,
+		unanswered:      make(map[uint64]sequencedMessage),
+		unacked:         nil,
+	}
+}
+
+// serialize serializes the message with the next sequence number, keeping it to send again after
+// resuming: requests until they're responded to, and everything else until it's acknowledged.
+//
+// The caller must hold the Dispatcher's writeLock, so that messages are sent in order.
+func (s *monitorSession) serialize(message any, id uint64, isRequest bool) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq := s.lastSentSeq + 1
+	data, err := api.SerializeSequencedMonitorMessage(message, id, seq, s.lastReceivedSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lastSentSeq = seq
+	msg := sequencedMessage{seq: seq, data: data}
+	if isRequest {
+		s.unanswered[id] = msg
+	} else {
+		s.unacked = append(s.unacked, msg)
+		if len(s.unacked) > maxUnackedMessages {
+			s.unacked = s.unacked[len(s.unacked)-maxUnackedMessages:]
+		}
+	}
+	return data, nil
+}
+
+// answered forgets the request with the transaction id, so it isn't sent again after resuming
+func (s *monitorSession) answered(id uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.unanswered, id)
+}
+
+// acked forgets the responses up to and including the sequence number, which the vm-monitor has
+// received
+func (s *monitorSession) acked(seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.forgetAcked(seq)
+}
+
+// forgetAcked implements acked. s.lock must be held.
+func (s *monitorSession) forgetAcked(seq uint64) {
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].seq <= seq {
+		i += 1
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// receive records receiving the message with the sequence number, returning false if it was
+// already received
+func (s *monitorSession) receive(seq uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if seq <= s.lastReceivedSeq {
+		return false
+	}
+	s.lastReceivedSeq = seq
+	return true
+}
+
+// resumeRequest returns the request to resume the session
+func (s *monitorSession) resumeRequest() *api.MonitorResume {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &api.MonitorResume{
+		SessionID:       s.id,
+		LastReceivedSeq: s.lastReceivedSeq,
+	}
+}
+
+// toResend returns the unanswered requests and unacknowledged responses that the vm-monitor didn't
+// receive, in the order they were originally sent
+func (s *monitorSession) toResend(monitorLastReceivedSeq uint64) []sequencedMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Everything up to monitorLastReceivedSeq has been received, so it doesn't need to be kept.
+	s.forgetAcked(monitorLastReceivedSeq)
+
+	resend := append([]sequencedMessage{}, s.unacked...)
+	for _, msg := range s.unanswered {
+		if msg.seq > monitorLastReceivedSeq {
+			resend = append(resend, msg)
+		}
+	}
+	slices.SortFunc(resend, func(x, y sequencedMessage) int {
+		return cmp.Compare(x.seq, y.seq)
+	})
+	return resend
+}
+
+// receiveError is returned by HandleMessage when reading from the connection failed, which is the
+// only kind of failure that resuming the session can fix
+type receiveError struct {
+	err error
+}
+
+func (e *receiveError) Error() string {
+	return fmt.Sprintf("Error receiving message: %s", e.err)
+}
+
+func (e *receiveError) Unwrap() error {
+	return e.err
+}
+
+// markReceived records receiving the message with the sequence number, returning false if it was
+// already received
+func (disp *Dispatcher) markReceived(seq uint64) bool {
+	if disp.session == nil {
+		return true
+	}
+	return disp.session.receive(seq)
+}
+
+// markAcked records that the vm-monitor has received our messages up to and including the
+// sequence number
+func (disp *Dispatcher) markAcked(seq uint64) {
+	if disp.session != nil {
+		disp.session.acked(seq)
+	}
+}
+
+// willResend returns whether the request with the transaction id will be sent again if the session
+// is resumed
+func (disp *Dispatcher) willResend(id uint64) bool {
+	if disp.session == nil {
+		return false
+	}
+
+	disp.session.lock.Lock()
+	defer disp.session.lock.Unlock()
+	_, ok := disp.session.unanswered[id]
+	return ok
+}
+
+// tryResume resumes the session if the error from HandleMessage means the connection dropped,
+// returning whether it was resumed. The returned error is only non-nil if resuming was attempted
+// and failed.
+func (disp *Dispatcher) tryResume(ctx context.Context, logger *zap.Logger, err error) (ok bool, _ error) {
+	var recvErr *receiveError
+	if disp.session == nil || !errors.As(err, &recvErr) {
+		return false, nil
+	}
+
+	logger.Warn("Connection to vm-monitor dropped, trying to resume session", zap.Error(err))
+	outcome := "failed"
+	defer func() {
+		disp.runner.global.metrics.monitorResumes.WithLabelValues(outcome).Inc()
+	}()
+
+	resumeErr := disp.resume(ctx, logger)
+	if resumeErr != nil {
+		if errors.Is(resumeErr, errNotResumed) {
+			outcome = "not_resumed"
+		}
+		logger.Error("Failed to resume session with vm-monitor", zap.Error(resumeErr))
+		return false, resumeErr
+	}
+
+	outcome = "ok"
+	logger.Info("Resumed session with vm-monitor")
+	return true, nil
+}
+
+// errNotResumed is returned by resume if the vm-monitor was reachable but couldn't resume the
+// session, e.g. because it restarted
+var errNotResumed = errors.New("vm-monitor did not resume the session")
+
+// resume reconnects to the vm-monitor and resumes the session, retrying until the configured
+// timeout, and then sends again all the requests the vm-monitor didn't receive.
+func (disp *Dispatcher) resume(ctx context.Context, logger *zap.Logger) error {
+	config := disp.runner.global.config.Monitor
+	connectTimeout := time.Second * time.Duration(config.ConnectionTimeoutSeconds)
+	retryWait := time.Second * time.Duration(config.ConnectionRetryMinWaitSeconds)
+	resumeTimeout := time.Second * time.Duration(config.ResumeTimeoutSeconds)
+
+	ctx, cancel := context.WithTimeout(ctx, resumeTimeout)
+	defer cancel()
+
+	for {
+		handshake := api.MonitorHandshake{
+			Min:          disp.protoVersion,
+			Max:          disp.protoVersion,
+			Capabilities: disp.capabilities,
+			Resume:       disp.session.resumeRequest(),
+		}
+
+		conn, resp, _, err := connectToMonitor(ctx, logger, disp.addr, connectTimeout, handshake)
+		if err == nil {
+			if !resp.Resumed || resp.Version != disp.protoVersion {
+				conn.Close(websocket.StatusNormalClosure, "session not resumed")
+				return errNotResumed
+			}
+			return disp.adoptResumedConn(ctx, logger, conn, resp.LastReceivedSeq)
+		}
+
+		logger.Warn("Failed to reconnect to vm-monitor", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s: %w", resumeTimeout, err)
+		case <-time.After(retryWait):
+		}
+	}
+}
+
+// adoptResumedConn switches to the connection for the resumed session, sending again the requests
+// and responses that the vm-monitor hasn't received, in their original order.
+func (disp *Dispatcher) adoptResumedConn(
+	ctx context.Context,
+	logger *zap.Logger,
+	conn *websocket.Conn,
+	monitorLastReceivedSeq uint64,
+) error {
+	disp.writeLock.Lock()
+	defer disp.writeLock.Unlock()
+
+	// exit closes the current connection after closing exitSignal, so checking while holding
+	// connLock guarantees that the new connection is closed either here or by exit.
+	disp.connLock.Lock()
+	exited := disp.Exited()
+	oldConn := disp.conn
+	if !exited {
+		disp.conn = conn
+	}
+	disp.connLock.Unlock()
+
+	if exited {
+		conn.Close(websocket.StatusNormalClosure, "dispatcher exited")
+		return errors.New("dispatcher exited while resuming")
+	}
+
+	// Closing can take a while, and the connection is already broken anyways.
+	go oldConn.Close(websocket.StatusGoingAway, "resumed on new connection")
+
+	for _, msg := range disp.session.toResend(monitorLastReceivedSeq) {
+		raw := json.RawMessage(msg.data)
+		logger.Info("resending message to monitor", zap.ByteString("message", raw))
+		if err := wsjson.Write(ctx, conn, &raw); err != nil {
+			return fmt.Errorf("error resending message: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// sequencedFields are the fields of a serialized message that are used for resuming the session
+type sequencedFields struct {
+	Type string `json:"type"`
+	Id   uint64 `json:"id"`
+	Seq  uint64 `json:"seq"`
+	Ack  uint64 `json:"ack"`
+}
+
+func decodeSequenced(t *testing.T, data []byte) sequencedFields {
+	var fields sequencedFields
+	require.NoError(t, json.Unmarshal(data, &fields))
+	return fields
+}
+
+func TestMonitorSessionSerialize(t *testing.T) {
+	s := newMonitorSession("session")
+	downscale := api.DownscaleRequest{Target: api.Allocation{Cpu: 0.25, Mem: 1 << 30}}
+
+	data, err := s.serialize(downscale, 1, true)
+	require.NoError(t, err)
+	assert.Equal(t, sequencedFields{Type: "DownscaleRequest", Id: 1, Seq: 1, Ack: 0}, decodeSequenced(t, data))
+
+	// Each message takes the next sequence number, and acknowledges the latest one received
+	assert.True(t, s.receive(1))
+	data, err = s.serialize(api.HealthCheck{}, 2, false)
+	require.NoError(t, err)
+	assert.Equal(t, sequencedFields{Type: "HealthCheck", Id: 2, Seq: 2, Ack: 1}, decodeSequenced(t, data))
+
+	// Only requests are kept to send again
+	assert.Len(t, s.unanswered, 1)
+	assert.Equal(t, uint64(1), s.unanswered[1].seq)
+
+	// Messages that fail to serialize don't use up a sequence number
+	_, err = s.serialize("not a message", 3, true)
+	assert.Error(t, err)
+	data, err = s.serialize(downscale, 4, true)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), decodeSequenced(t, data).Seq)
+	assert.Len(t, s.unanswered, 2)
+
+	s.answered(1)
+	s.answered(4)
+	assert.Empty(t, s.unanswered)
+}
+
+func TestMonitorSessionReceive(t *testing.T) {
+	s := newMonitorSession("session")
+
+	assert.True(t, s.receive(1))
+	assert.True(t, s.receive(2))
+
+	// Messages replayed after resuming that were already received are suppressed
+	assert.False(t, s.receive(1))
+	assert.False(t, s.receive(2))
+	assert.Equal(t, uint64(2), s.resumeRequest().LastReceivedSeq)
+
+	// Gaps are accepted, and the skipped sequence numbers count as received after that
+	assert.True(t, s.receive(5))
+	assert.False(t, s.receive(4))
+	assert.True(t, s.receive(6))
+	assert.Equal(t, &api.MonitorResume{SessionID: "session", LastReceivedSeq: 6}, s.resumeRequest())
+}
+
+func TestMonitorSessionToResend(t *testing.T) {
+	s := newMonitorSession("session")
+	downscale := api.DownscaleRequest{Target: api.Allocation{Cpu: 0.25, Mem: 1 << 30}}
+
+	// Requests 1, 3, 4, and 5 are sent, with a response to the vm-monitor in between
+	for _, m := range []struct {
+		id        uint64
+		isRequest bool
+	}{{1, true}, {2, false}, {3, true}, {4, true}, {5, true}} {
+		_, err := s.serialize(downscale, m.id, m.isRequest)
+		require.NoError(t, err)
+	}
+	s.answered(5)
+
+	// After reconnecting, the requests and responses that the vm-monitor didn't receive are
+	// resent, in order
+	assert.Equal(t, []uint64{1, 2, 3, 4}, resentSeqs(t, s.toResend(0)))
+	assert.Equal(t, []uint64{3, 4}, resentSeqs(t, s.toResend(2)))
+	assert.Equal(t, []uint64{4}, resentSeqs(t, s.toResend(3)))
+	assert.Empty(t, s.toResend(5))
+
+	// ... and answered requests are never resent. Neither is the response, because resuming
+	// showed that the vm-monitor received it.
+	s.answered(3)
+	assert.Equal(t, []uint64{1, 4}, resentSeqs(t, s.toResend(0)))
+}
+
+func TestMonitorSessionAcked(t *testing.T) {
+	s := newMonitorSession("session")
+	invalid := api.InvalidMessage{Error: "unknown message"}
+
+	for id := uint64(1); id <= 4; id++ {
+		_, err := s.serialize(invalid, id, false)
+		require.NoError(t, err)
+	}
+
+	// Responses are kept until the vm-monitor acknowledges them
+	s.acked(2)
+	assert.Equal(t, []uint64{3, 4}, resentSeqs(t, s.toResend(0)))
+	s.acked(4)
+	assert.Empty(t, s.toResend(0))
+
+	// Only the most recent are kept, if the vm-monitor never acknowledges them
+	for id := uint64(5); id < 5+2*maxUnackedMessages; id++ {
+		_, err := s.serialize(invalid, id, false)
+		require.NoError(t, err)
+	}
+	resent := resentSeqs(t, s.toResend(0))
+	require.Len(t, resent, maxUnackedMessages)
+	assert.Equal(t, uint64(5+maxUnackedMessages), resent[0])
+	assert.Equal(t, uint64(4+2*maxUnackedMessages), resent[len(resent)-1])
+}
+
+// resentSeqs returns the sequence numbers of the messages, checking that each message is exactly
+// the original
+func resentSeqs(t *testing.T, msgs []sequencedMessage) []uint64 {
+	var seqs []uint64
+	for _, m := range msgs {
+		seqs = append(seqs, m.seq)
+		assert.Equal(t, m.seq, decodeSequenced(t, m.data).Seq)
+	}
+	return seqs
+}
@@ -0,0 +1,120 @@
+package agent
+
+// Tracking of memory pressure on the node as a whole, so that each VM's scaling can take the health
+// of the node into account.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// hostMemoryPressurePath is the file with the PSI for memory on the whole host. Unlike the
+// cgroup-specific files, it isn't affected by the autoscaler-agent's container.
+const hostMemoryPressurePath = "/proc/pressure/memory"
+
+// nodeMemoryPressure stores whether the node is currently under memory pressure, notifying
+// runners when that changes
+type nodeMemoryPressure struct {
+	mu            sync.Mutex
+	underPressure bool
+	// since gives when underPressure last changed
+	since time.Time
+
+	changed *util.Broadcaster
+}
+
+func newNodeMemoryPressure() *nodeMemoryPressure {
+	return &nodeMemoryPressure{
+		mu:            sync.Mutex{},
+		underPressure: false,
+		since:         time.Now(),
+		changed:       util.NewBroadcaster(),
+	}
+}
+
+// get returns whether the node is currently under memory pressure, and since when that's been the
+// case
+func (p *nodeMemoryPressure) get() (underPressure bool, since time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.underPressure, p.since
+}
+
+func (p *nodeMemoryPressure) set(underPressure bool) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.underPressure == underPressure {
+		return false
+	}
+	p.underPressure = underPressure
+	p.since = time.Now()
+	p.changed.Broadcast()
+	return true
+}
+
+// run periodically checks the host's memory PSI until the context is canceled
+func (p *nodeMemoryPressure) run(ctx context.Context, logger *zap.Logger, conf *NodePressureConfig, gauge prometheus.Gauge) {
+	ticker := time.NewTicker(time.Second * time.Duration(conf.CheckEverySeconds))
+	defer ticker.Stop()
+
+	for {
+		avg10, err := readMemoryPressureAvg10(hostMemoryPressurePath)
+		if err != nil {
+			logger.Error("Failed to read node memory pressure", zap.Error(err))
+		} else {
+			gauge.Set(avg10)
+			if p.set(avg10 >= conf.MemoryPressureThreshold) {
+				logger.Info(
+					"Node memory pressure changed",
+					zap.Bool("underPressure", avg10 >= conf.MemoryPressureThreshold),
+					zap.Float64("avg10", avg10),
+				)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readMemoryPressureAvg10 returns the "some avg10" value from the PSI file at path: the percentage
+// of time over the last 10 seconds that at least one task was stalled on memory.
+func readMemoryPressureAvg10(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading file: %w", err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if value, ok := strings.CutPrefix(f, "avg10="); ok {
+				avg10, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return 0, fmt.Errorf("Error parsing avg10 value %q: %w", value, err)
+				}
+				return avg10, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("No \"some avg10\" value in %s", path)
+}
@@ -0,0 +1,99 @@
+package agent
+
+// Per-namespace limits on the number of concurrent scaling operations, so that a burst of activity
+// from VMs in one namespace can't crowd out everything else on the node.
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// namespaceLimiter restricts the number of in-flight operations for each namespace.
+//
+// A limit of zero means there is no limit.
+type namespaceLimiter struct {
+	limit   uint
+	waiting prometheus.Gauge
+
+	mu         sync.Mutex
+	namespaces map[string]*namespaceSlots
+}
+
+type namespaceSlots struct {
+	sem chan struct{}
+	// users is the number of operations holding or waiting for a slot, so that we can remove the
+	// entry once there's nothing left
+	users uint
+}
+
+func newNamespaceLimiter(limit uint, waiting prometheus.Gauge) *namespaceLimiter {
+	return &namespaceLimiter{
+		limit:      limit,
+		waiting:    waiting,
+		mu:         sync.Mutex{},
+		namespaces: make(map[string]*namespaceSlots),
+	}
+}
+
+// acquire waits until an operation in the namespace is allowed to proceed, returning a function
+// that must be called once the operation has finished.
+//
+// An error is returned only if the context is cancelled before a slot becomes available.
+func (l *namespaceLimiter) acquire(ctx context.Context, logger *zap.Logger, namespace string) (release func(), _ error) {
+	if l.limit == 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	slots, ok := l.namespaces[namespace]
+	if !ok {
+		slots = &namespaceSlots{
+			sem:   make(chan struct{}, l.limit),
+			users: 0,
+		}
+		l.namespaces[namespace] = slots
+	}
+	slots.users += 1
+	l.mu.Unlock()
+
+	release = func() {
+		<-slots.sem
+		l.done(namespace, slots)
+	}
+
+	// fast path: no need to wait.
+	select {
+	case slots.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	logger.Info(
+		"Waiting for other operations in the namespace to finish",
+		zap.String("namespace", namespace),
+		zap.Uint("limit", l.limit),
+	)
+	l.waiting.Inc()
+	defer l.waiting.Dec()
+
+	select {
+	case slots.sem <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		l.done(namespace, slots)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *namespaceLimiter) done(namespace string, slots *namespaceSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots.users -= 1
+	if slots.users == 0 {
+		delete(l.namespaces, namespace)
+	}
+}
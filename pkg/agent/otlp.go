@@ -0,0 +1,284 @@
+package agent
+
+// Receiver for metrics that VMs push over OTLP/gRPC, as an alternative to fetching them from
+// vector.dev in the VM.
+//
+// VMs opt in with the api.AnnotationMetricsTransport annotation. Exported metrics are matched to
+// their VM by the address they were sent from, which is the VM's pod IP.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+)
+
+// otlpReceiver stores the latest metrics pushed by each VM
+type otlpReceiver struct {
+	mu sync.Mutex
+	// latest maps from the pod IP of each VM to the last metrics it sent
+	latest map[string]otlpEntry
+
+	loadPrefix string
+	labels     core.HostMetricLabels
+	maxAge     time.Duration
+}
+
+type otlpEntry struct {
+	metrics    core.Metrics
+	receivedAt time.Time
+}
+
+func newOTLPReceiver(conf *MetricsConfig) *otlpReceiver {
+	return &otlpReceiver{
+		mu:         sync.Mutex{},
+		latest:     make(map[string]otlpEntry),
+		loadPrefix: conf.LoadMetricPrefix,
+		labels:     conf.HostMetricLabels,
+		maxAge:     time.Second * time.Duration(conf.OTLP.MaxAgeSeconds),
+	}
+}
+
+// get returns the most recent metrics pushed from the pod IP, if there were any within the
+// configured maximum age
+func (r *otlpReceiver) get(podIP string) (_ core.Metrics, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.latest[podIP]
+	if !ok || time.Since(entry.receivedAt) > r.maxAge {
+		return core.Metrics{}, false
+	}
+	return entry.metrics, true
+}
+
+func (r *otlpReceiver) set(podIP string, metrics core.Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.latest[podIP] = otlpEntry{metrics: metrics, receivedAt: now}
+
+	// Remove entries for VMs that have stopped sending metrics (e.g., because they were deleted),
+	// so that the map doesn't grow forever.
+	for ip, entry := range r.latest {
+		if now.Sub(entry.receivedAt) > r.maxAge {
+			delete(r.latest, ip)
+		}
+	}
+}
+
+// start begins serving OTLP metrics exports on the port, until the context is canceled
+func (r *otlpReceiver) start(ctx context.Context, logger *zap.Logger, port uint16) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(&otlpMetricsServiceDesc, otlpMetricsService{receiver: r, logger: logger})
+
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("OTLP metrics server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+type otlpMetricsServer interface {
+	export(ctx context.Context, data *metricspb.MetricsData) error
+}
+
+// otlpMetricsServiceDesc describes OTLP's MetricsService, as would be generated from its protobuf
+// definition.
+//
+// We can't use go.opentelemetry.io/proto/otlp/collector/metrics/v1, because it also requires
+// grpc-gateway. Instead, we rely on ExportMetricsServiceRequest having the same encoding as
+// MetricsData, and always respond with an ExportMetricsServiceResponse that has no fields set,
+// which has the same encoding as emptypb.Empty.
+var otlpMetricsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+	HandlerType: (*otlpMetricsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				data := new(metricspb.MetricsData)
+				if err := dec(data); err != nil {
+					return nil, err
+				}
+				if err := srv.(otlpMetricsServer).export(ctx, data); err != nil {
+					return nil, err
+				}
+				return new(emptypb.Empty), nil
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "opentelemetry/proto/collector/metrics/v1/metrics_service.proto",
+}
+
+type otlpMetricsService struct {
+	receiver *otlpReceiver
+	logger   *zap.Logger
+}
+
+func (s otlpMetricsService) export(ctx context.Context, data *metricspb.MetricsData) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Internal, "could not determine the address of the client")
+	}
+	podIP, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not parse client address %q: %s", p.Addr, err)
+	}
+
+	metrics, err := otlpToMetrics(data, s.receiver.loadPrefix, s.receiver.labels)
+	if err != nil {
+		s.logger.Warn("Rejected invalid OTLP metrics", zap.String("podIP", podIP), zap.Error(err))
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	s.receiver.set(podIP, metrics)
+	return nil
+}
+
+// otlpToMetrics converts the gauges and sums in the OTLP data into core.Metrics, expecting the same
+// metric names as we'd get from vector.dev's prometheus output.
+//
+// Data points are selected by comparing the labels against their string attributes. Where more than
+// one matches, the same one is used as with the prometheus output: the first for each of the host
+// values, and the sum for the CPU counters - see core.ReadMetricsFromOutput.
+func otlpToMetrics(data *metricspb.MetricsData, loadPrefix string, labels core.HostMetricLabels) (core.Metrics, error) {
+	type point struct {
+		attrs map[string]string
+		value float64
+	}
+
+	points := make(map[string][]point)
+	for _, rm := range data.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				var dataPoints []*metricspb.NumberDataPoint
+				switch {
+				case m.GetGauge() != nil:
+					dataPoints = m.GetGauge().GetDataPoints()
+				case m.GetSum() != nil:
+					dataPoints = m.GetSum().GetDataPoints()
+				default:
+					// other metric types aren't used yet
+					continue
+				}
+
+				for _, p := range dataPoints {
+					attrs := make(map[string]string)
+					for _, kv := range p.GetAttributes() {
+						attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+					}
+
+					var value float64
+					switch v := p.GetValue().(type) {
+					case *metricspb.NumberDataPoint_AsDouble:
+						value = v.AsDouble
+					case *metricspb.NumberDataPoint_AsInt:
+						value = float64(v.AsInt)
+					default:
+						continue
+					}
+					points[m.GetName()] = append(points[m.GetName()], point{attrs: attrs, value: value})
+				}
+			}
+		}
+	}
+
+	first := func(name string, filter core.LabelFilter) (float32, error) {
+		for _, p := range points[name] {
+			if filter.Matches(p.attrs) {
+				return float32(p.value), nil
+			}
+		}
+		return 0, fmt.Errorf("Missing metric %q", name)
+	}
+	sum := func(name string, filter core.LabelFilter) (float64, error) {
+		var total float64
+		found := false
+		for _, p := range points[name] {
+			if filter.Matches(p.attrs) {
+				total += p.value
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Missing metric %q", name)
+		}
+		return total, nil
+	}
+
+	load1, err := first(loadPrefix+"load1", labels.Load1)
+	if err != nil {
+		return core.Metrics{}, err
+	}
+	availableMem, err := first(loadPrefix+"memory_available_bytes", labels.MemoryAvailable)
+	if err != nil {
+		return core.Metrics{}, err
+	}
+	totalMem, err := first(loadPrefix+"memory_total_bytes", labels.MemoryTotal)
+	if err != nil {
+		return core.Metrics{}, err
+	}
+
+	// PSI isn't available on all kernels, so it's fine if it's missing.
+	var stalledPtr, waitingPtr *float32
+	if stalled, err := first(loadPrefix+"pressure_memory_stalled_seconds_total", labels.MemoryStalled); err == nil {
+		stalledPtr = &stalled
+	}
+	if waiting, err := first(loadPrefix+"pressure_memory_waiting_seconds_total", labels.MemoryWaiting); err == nil {
+		waitingPtr = &waiting
+	}
+
+	m := core.MetricsFromHostValues(load1, availableMem, totalMem, stalledPtr, waitingPtr)
+
+	// As with ReadCPUCounters, steal time is summed across every CPU, and either may be missing.
+	stealFilter := core.LabelFilter{"mode": "steal"}
+	for k, v := range labels.CPUSteal {
+		stealFilter[k] = v
+	}
+	cpu := core.CPUCounters{StealSecondsTotal: nil, CPUs: 0, ThrottledSecondsTotal: nil}
+	var steal float64
+	for _, p := range points[loadPrefix+"cpu_seconds_total"] {
+		if stealFilter.Matches(p.attrs) {
+			steal += p.value
+			cpu.CPUs += 1
+		}
+	}
+	if cpu.CPUs != 0 {
+		cpu.StealSecondsTotal = &steal
+	}
+	if throttled, err := sum(loadPrefix+"cgroup_cpu_throttled_seconds_total", labels.CPUThrottled); err == nil {
+		cpu.ThrottledSecondsTotal = &throttled
+	}
+	if cpu.StealSecondsTotal != nil || cpu.ThrottledSecondsTotal != nil {
+		m.CPU = &cpu
+	}
+
+	return m, nil
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+)
+
+// Checks that OTLP data is read the same way as the equivalent prometheus output, including when
+// more than one series matches
+func TestOTLPMatchesPrometheus(t *testing.T) {
+	type series struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}
+	allSeries := []series{
+		{name: "host_load1", labels: map[string]string{"host": "a"}, value: 0.5},
+		{name: "host_load1", labels: map[string]string{"host": "b"}, value: 1.5},
+		{name: "host_memory_available_bytes", labels: nil, value: 1 << 30},
+		{name: "host_memory_total_bytes", labels: nil, value: 4 << 30},
+		{name: "host_memory_total_bytes", labels: nil, value: 8 << 30},
+		{name: "host_pressure_memory_stalled_seconds_total", labels: nil, value: 3},
+		{name: "host_cpu_seconds_total", labels: map[string]string{"cpu": "0", "mode": "steal"}, value: 2},
+		{name: "host_cpu_seconds_total", labels: map[string]string{"cpu": "1", "mode": "steal"}, value: 4},
+		{name: "host_cpu_seconds_total", labels: map[string]string{"cpu": "0", "mode": "idle"}, value: 100},
+		{name: "host_cgroup_cpu_throttled_seconds_total", labels: map[string]string{"cgroup": "a"}, value: 1.25},
+		{name: "host_cgroup_cpu_throttled_seconds_total", labels: map[string]string{"cgroup": "b"}, value: 2.5},
+	}
+
+	var prom strings.Builder
+	var metrics []*metricspb.Metric
+	for _, s := range allSeries {
+		var labels []string
+		var attrs []*commonpb.KeyValue
+		for k, v := range s.labels {
+			labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+			attrs = append(attrs, &commonpb.KeyValue{ //nolint:exhaustruct // other fields are unexported
+				Key:   k,
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}, //nolint:exhaustruct // other fields are unexported
+			})
+		}
+		if len(labels) != 0 {
+			fmt.Fprintf(&prom, "%s{%s} %v\n", s.name, strings.Join(labels, ","), s.value)
+		} else {
+			fmt.Fprintf(&prom, "%s %v\n", s.name, s.value)
+		}
+
+		metrics = append(metrics, &metricspb.Metric{ //nolint:exhaustruct // other fields are unexported
+			Name: s.name,
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{ //nolint:exhaustruct // other fields are unexported
+				DataPoints: []*metricspb.NumberDataPoint{{ //nolint:exhaustruct // other fields are unexported
+					Attributes: attrs,
+					Value:      &metricspb.NumberDataPoint_AsDouble{AsDouble: s.value},
+				}},
+			}},
+		})
+	}
+	data := &metricspb.MetricsData{ //nolint:exhaustruct // other fields are unexported
+		ResourceMetrics: []*metricspb.ResourceMetrics{{ //nolint:exhaustruct // other fields are unexported
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}}, //nolint:exhaustruct // other fields are unexported
+		}},
+	}
+
+	for _, labels := range []core.HostMetricLabels{
+		{}, //nolint:exhaustruct // no filters
+		{Load1: core.LabelFilter{"host": "b"}, CPUThrottled: core.LabelFilter{"cgroup": "a"}}, //nolint:exhaustruct // other series aren't filtered
+	} {
+		expected, err := core.ReadMetrics([]byte(prom.String()), "host_", labels)
+		require.NoError(t, err)
+		actual, err := otlpToMetrics(data, "host_", labels)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	// The first matching series is used for the host values, and the sum for the CPU counters
+	m, err := otlpToMetrics(data, "host_", core.HostMetricLabels{}) //nolint:exhaustruct // no filters
+	require.NoError(t, err)
+	assert.Equal(t, float32(0.5), m.LoadAverage1Min)
+	require.NotNil(t, m.CPU)
+	assert.Equal(t, 2, m.CPU.CPUs)
+	assert.Equal(t, 6.0, *m.CPU.StealSecondsTotal)
+	assert.Equal(t, 3.75, *m.CPU.ThrottledSecondsTotal)
+}
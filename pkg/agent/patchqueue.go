@@ -0,0 +1,349 @@
+package agent
+
+// Queueing VM patches, so that nodes with many VMs don't overwhelm the API server
+//
+// Without the queue, each Runner patches its VM as soon as it needs to. That's fine most of the
+// time, but when many VMs change at once (e.g. during a config rollout), the burst of requests can
+// get the autoscaler-agent throttled by the API server.
+//
+// With the queue, patches are sent by a fixed number of workers, at a limited rate. Each patch has a
+// kind, and while a patch is waiting, a newer patch of the same kind for the same VM replaces it
+// so that only the latest is sent; whoever submitted the older patch gets the result of the newer
+// one. Patches of the same kind must therefore always set the same fields.
+//
+// If the API server responds with 429 Too Many Requests, the whole queue pauses for as long as the
+// response asks (or ThrottledWaitSeconds), and the patch is retried.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
+)
+
+// Kinds of VM patch. Patches of the same kind for the same VM replace each other in the queue.
+const (
+	vmPatchResources = "resources"
+	vmPatchDisk      = "disk"
+	vmPatchStatus    = "status"
+	vmPatchRestart   = "restart"
+	vmPatchPaused    = "paused"
+)
+
+// Values of the "outcome" label on the patch duration metric
+const (
+	vmPatchOutcomeOK        = "ok"
+	vmPatchOutcomeFailed    = "failed"
+	vmPatchOutcomeThrottled = "throttled"
+)
+
+var errPatchQueueFull = errors.New("VM patch queue is full")
+
+type vmPatchKey struct {
+	vm   util.NamespacedName
+	kind string
+}
+
+type queuedVMPatch struct {
+	patchType ktypes.PatchType
+	payload   []byte
+	// subresources gives the subresource of the VM to patch (e.g. "status"), if any
+	subresources []string
+	queuedAt     time.Time
+	// done receives the result of the patch, once for each submission that it covers. Each channel
+	// has a capacity of 1, so sending never blocks, even if the submitter has stopped waiting.
+	done []chan error
+}
+
+// vmPatchQueue sends VM patches from a fixed number of background workers
+type vmPatchQueue struct {
+	config  *PatchQueueConfig
+	timeout time.Duration
+	client  vmclient.Interface
+	limiter *rate.Limiter
+	metrics GlobalMetrics
+
+	// mu guards pending, order, and pausedUntil
+	mu      sync.Mutex
+	pending map[vmPatchKey]*queuedVMPatch
+	order   []vmPatchKey
+	// pausedUntil, if in the future, gives when the queue may resume after being throttled
+	pausedUntil time.Time
+
+	// signal has a value whenever there may be patches in the queue that no worker has picked up
+	signal chan struct{}
+}
+
+func newVMPatchQueue(config *NeonVMConfig, client vmclient.Interface, metrics GlobalMetrics) *vmPatchQueue {
+	return &vmPatchQueue{
+		config:      config.PatchQueue,
+		timeout:     time.Second * time.Duration(config.RequestTimeoutSeconds),
+		client:      client,
+		limiter:     rate.NewLimiter(rate.Limit(config.PatchQueue.RequestsPerSecond), int(config.PatchQueue.Burst)),
+		metrics:     metrics,
+		mu:          sync.Mutex{},
+		pending:     make(map[vmPatchKey]*queuedVMPatch),
+		order:       nil,
+		pausedUntil: time.Time{},
+		signal:      make(chan struct{}, 1),
+	}
+}
+
+// start begins sending queued patches in the background, until the context is canceled
+func (q *vmPatchQueue) start(ctx context.Context, logger *zap.Logger) {
+	for i := uint(0); i < q.config.Workers; i++ {
+		go q.worker(ctx, logger)
+	}
+}
+
+// patch adds the patch to the queue, and waits until it (or a newer patch of the same kind for the
+// same VM) has been sent, returning the result.
+//
+// Like a patch made directly, waiting is limited to the NeonVM request timeout, so that a queue
+// that's paused after being throttled can't block the caller indefinitely. If the context is
+// canceled or the timeout is reached, patch returns early, but the patch may still be sent.
+func (q *vmPatchQueue) patch(
+	ctx context.Context,
+	vm util.NamespacedName,
+	kind string,
+	patchType ktypes.PatchType,
+	payload []byte,
+	subresources ...string,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	err := q.enqueue(vmPatchKey{vm: vm, kind: kind}, &queuedVMPatch{
+		patchType:    patchType,
+		payload:      payload,
+		subresources: subresources,
+		queuedAt:     time.Now(),
+		done:         []chan error{done},
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// enqueue adds the patch to the back of the queue, or replaces the patch already waiting with the
+// same key
+func (q *vmPatchQueue) enqueue(key vmPatchKey, p *queuedVMPatch) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if existing, ok := q.pending[key]; ok {
+		// Keep the existing patch's place in the queue, so repeated patches can't starve it.
+		existing.patchType = p.patchType
+		existing.payload = p.payload
+		existing.subresources = p.subresources
+		existing.done = append(existing.done, p.done...)
+		q.metrics.patchQueueCoalesced.Inc()
+		return nil
+	}
+
+	if uint(len(q.order)) >= q.config.QueueSize {
+		return errPatchQueueFull
+	}
+
+	q.pending[key] = p
+	q.order = append(q.order, key)
+	q.updateDepth()
+	q.notify()
+	return nil
+}
+
+// requeue puts a patch that was throttled back at the front of the queue, merging it with any newer
+// patch with the same key that was submitted in the meantime
+func (q *vmPatchQueue) requeue(key vmPatchKey, p *queuedVMPatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if newer, ok := q.pending[key]; ok {
+		newer.done = append(newer.done, p.done...)
+		newer.queuedAt = p.queuedAt
+		return
+	}
+
+	q.pending[key] = p
+	q.order = append([]vmPatchKey{key}, q.order...)
+	q.updateDepth()
+	q.notify()
+}
+
+// pop removes the patch at the front of the queue, returning false if there isn't one
+func (q *vmPatchQueue) pop() (vmPatchKey, *queuedVMPatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return vmPatchKey{}, nil, false
+	}
+
+	key := q.order[0]
+	q.order = q.order[1:]
+	p := q.pending[key]
+	delete(q.pending, key)
+	q.updateDepth()
+
+	// Wake up another worker if there's more to do
+	if len(q.order) != 0 {
+		q.notify()
+	}
+	return key, p, true
+}
+
+// notify wakes up a worker, if one isn't already due to wake up. It must be called with q.mu held.
+func (q *vmPatchQueue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// updateDepth sets the queue depth metric. It must be called with q.mu held.
+func (q *vmPatchQueue) updateDepth() {
+	q.metrics.patchQueueDepth.Set(float64(len(q.order)))
+}
+
+func (q *vmPatchQueue) worker(ctx context.Context, logger *zap.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.signal:
+		}
+
+		for {
+			// Wait out any pause before taking the next patch, so that patches stay in the queue
+			// (where newer ones can replace them) while it's paused.
+			if err := q.waitUntilResumed(ctx); err != nil {
+				return
+			}
+			key, p, ok := q.pop()
+			if !ok {
+				break
+			}
+			q.send(ctx, logger, key, p)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// send makes the request for the patch, once the rate limit allows it, and reports the result to
+// everyone waiting on it. If the request was throttled, the patch is requeued instead.
+func (q *vmPatchQueue) send(ctx context.Context, logger *zap.Logger, key vmPatchKey, p *queuedVMPatch) {
+	if err := q.limiter.Wait(ctx); err != nil {
+		finishVMPatch(p, err)
+		return
+	}
+	q.metrics.patchQueueWait.Observe(time.Since(p.queuedAt).Seconds())
+
+	start := time.Now()
+	requestCtx, cancel := context.WithTimeout(ctx, q.timeout)
+	defer cancel()
+	_, err := q.client.NeonvmV1().VirtualMachines(key.vm.Namespace).
+		Patch(requestCtx, key.vm.Name, p.patchType, p.payload, metav1.PatchOptions{}, p.subresources...)
+	duration := time.Since(start)
+
+	if apierrors.IsTooManyRequests(err) {
+		q.metrics.patchQueueThrottled.Inc()
+		q.metrics.patchDuration.WithLabelValues(key.kind, vmPatchOutcomeThrottled).Observe(duration.Seconds())
+
+		wait := time.Second * time.Duration(q.config.ThrottledWaitSeconds)
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok && seconds > 0 {
+			wait = time.Second * time.Duration(seconds)
+		}
+		logger.Warn(
+			"VM patch was throttled by the API server, pausing the queue",
+			zap.Object("virtualmachine", key.vm),
+			zap.String("kind", key.kind),
+			zap.Duration("wait", wait),
+		)
+		q.pause(wait)
+		q.requeue(key, p)
+		return
+	}
+
+	outcome := vmPatchOutcomeOK
+	if err != nil {
+		outcome = vmPatchOutcomeFailed
+	}
+	q.metrics.patchDuration.WithLabelValues(key.kind, outcome).Observe(duration.Seconds())
+	finishVMPatch(p, err)
+}
+
+// waitUntilResumed waits until the queue isn't paused
+func (q *vmPatchQueue) waitUntilResumed(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		wait := time.Until(q.pausedUntil)
+		q.mu.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pause stops all workers from sending patches for the duration
+func (q *vmPatchQueue) pause(duration time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if until := time.Now().Add(duration); until.After(q.pausedUntil) {
+		q.pausedUntil = until
+	}
+}
+
+func finishVMPatch(p *queuedVMPatch, err error) {
+	for _, done := range p.done {
+		done <- err
+	}
+}
+
+// patchVM applies the patch to the Runner's VM (or the subresource of it, if given), through the
+// patch queue if it's enabled
+func (r *Runner) patchVM(ctx context.Context, kind string, patchType ktypes.PatchType, payload []byte, subresources ...string) error {
+	if err := r.global.faults.Inject(ctx, faults.TargetNeonVM, fmt.Sprint(r.vmName)); err != nil {
+		return err
+	}
+
+	if r.global.patchQueue != nil {
+		return r.global.patchQueue.patch(ctx, r.vmName, kind, patchType, payload, subresources...)
+	}
+
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := r.global.vmClient.NeonvmV1().VirtualMachines(r.vmName.Namespace).
+		Patch(requestCtx, r.vmName.Name, patchType, payload, metav1.PatchOptions{}, subresources...)
+	return err
+}
@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+
+	vmfake "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned/fake"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// fakePatchServer records the VM patches it receives, responding to each with the next of the
+// configured errors (or success, once they run out)
+type fakePatchServer struct {
+	mu       sync.Mutex
+	payloads []string
+	// subresources gives the subresource patched by each of payloads, or "" for the VM itself
+	subresources []string
+	errs         []error
+}
+
+func (s *fakePatchServer) react(action k8stesting.Action) (bool, runtime.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payloads = append(s.payloads, string(action.(k8stesting.PatchAction).GetPatch()))
+	s.subresources = append(s.subresources, action.GetSubresource())
+	var err error
+	if len(s.errs) != 0 {
+		err, s.errs = s.errs[0], s.errs[1:]
+	}
+	return true, nil, err
+}
+
+func (s *fakePatchServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.payloads...)
+}
+
+func (s *fakePatchServer) receivedSubresources() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.subresources...)
+}
+
+func newTestPatchQueue(queueSize uint, errs ...error) (*vmPatchQueue, *fakePatchServer) {
+	server := &fakePatchServer{mu: sync.Mutex{}, payloads: nil, subresources: nil, errs: errs}
+	client := vmfake.NewSimpleClientset()
+	client.PrependReactor("patch", "virtualmachines", server.react)
+
+	metrics, _ := makeGlobalMetrics()
+	config := &NeonVMConfig{
+		RequestTimeoutSeconds: 5,
+		PatchQueue: &PatchQueueConfig{
+			QueueSize:            queueSize,
+			Workers:              1,
+			RequestsPerSecond:    1000,
+			Burst:                1000,
+			ThrottledWaitSeconds: 1,
+		},
+	}
+	return newVMPatchQueue(config, client, metrics), server
+}
+
+// submit adds the patch to the queue without waiting for it, returning the channel that receives
+// its result
+func submit(t *testing.T, q *vmPatchQueue, vm util.NamespacedName, kind string, payload string) chan error {
+	done := make(chan error, 1)
+	err := q.enqueue(vmPatchKey{vm: vm, kind: kind}, &queuedVMPatch{
+		patchType:    ktypes.MergePatchType,
+		payload:      []byte(payload),
+		subresources: nil,
+		queuedAt:     time.Now(),
+		done:         []chan error{done},
+	})
+	require.NoError(t, err)
+	return done
+}
+
+func waitResult(t *testing.T, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for patch result")
+		return nil
+	}
+}
+
+func TestPatchQueueCoalescing(t *testing.T) {
+	q, server := newTestPatchQueue(10)
+	vmA := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+	vmB := util.NamespacedName{Namespace: "default", Name: "vm-b"}
+
+	// Queue everything before the workers start, so that the newer patches can replace the older
+	// ones while they're waiting.
+	first := submit(t, q, vmA, vmPatchResources, `{"cpu":1}`)
+	other := submit(t, q, vmB, vmPatchResources, `{"cpu":4}`)
+	disk := submit(t, q, vmA, vmPatchDisk, `{"disk":1}`)
+	second := submit(t, q, vmA, vmPatchResources, `{"cpu":2}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx, zap.NewNop())
+
+	for _, done := range []chan error{first, other, disk, second} {
+		assert.NoError(t, waitResult(t, done))
+	}
+	// The replaced patch kept its place at the front of the queue, with the newer payload. Patches
+	// of other kinds, or for other VMs, are sent separately.
+	assert.Equal(t, []string{`{"cpu":2}`, `{"cpu":4}`, `{"disk":1}`}, server.received())
+}
+
+func TestPatchQueueFull(t *testing.T) {
+	q, _ := newTestPatchQueue(1)
+	vmA := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+	vmB := util.NamespacedName{Namespace: "default", Name: "vm-b"}
+
+	submit(t, q, vmA, vmPatchResources, `{"cpu":1}`)
+	// Replacing a waiting patch doesn't need any more room
+	submit(t, q, vmA, vmPatchResources, `{"cpu":2}`)
+
+	err := q.enqueue(vmPatchKey{vm: vmB, kind: vmPatchResources}, &queuedVMPatch{
+		patchType:    ktypes.MergePatchType,
+		payload:      []byte(`{"cpu":3}`),
+		subresources: nil,
+		queuedAt:     time.Now(),
+		done:         []chan error{make(chan error, 1)},
+	})
+	assert.ErrorIs(t, err, errPatchQueueFull)
+}
+
+func TestPatchQueueFailure(t *testing.T) {
+	failure := errors.New("injected failure")
+	q, server := newTestPatchQueue(10, failure)
+	vm := util.NamespacedName{Namespace: "default", Name: "vm"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx, zap.NewNop())
+
+	// Errors other than throttling are returned to the caller, without retrying
+	err := q.patch(ctx, vm, vmPatchResources, ktypes.MergePatchType, []byte(`{"cpu":1}`))
+	assert.ErrorContains(t, err, failure.Error())
+	assert.Len(t, server.received(), 1)
+
+	// ... and don't affect later patches
+	err = q.patch(ctx, vm, vmPatchResources, ktypes.MergePatchType, []byte(`{"cpu":2}`))
+	assert.NoError(t, err)
+	assert.Len(t, server.received(), 2)
+}
+
+func TestPatchQueueThrottled(t *testing.T) {
+	q, server := newTestPatchQueue(10, apierrors.NewTooManyRequests("slow down", 1))
+	vmA := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+	vmB := util.NamespacedName{Namespace: "default", Name: "vm-b"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx, zap.NewNop())
+
+	start := time.Now()
+	first := submit(t, q, vmA, vmPatchResources, `{"cpu":1}`)
+	require.Eventually(t, func() bool { return len(server.received()) == 1 }, time.Second, time.Millisecond)
+
+	// While the queue is paused, nothing is sent. The throttled patch was requeued, so a newer patch
+	// for the same VM replaces it, and it stays ahead of patches for other VMs.
+	second := submit(t, q, vmA, vmPatchResources, `{"cpu":2}`)
+	other := submit(t, q, vmB, vmPatchResources, `{"cpu":4}`)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, server.received(), 1)
+
+	for _, done := range []chan error{first, second, other} {
+		assert.NoError(t, waitResult(t, done))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, []string{`{"cpu":1}`, `{"cpu":2}`, `{"cpu":4}`}, server.received())
+}
+
+func TestPatchQueueTimeout(t *testing.T) {
+	q, server := newTestPatchQueue(10)
+	q.timeout = 50 * time.Millisecond
+	vm := util.NamespacedName{Namespace: "default", Name: "vm"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx, zap.NewNop())
+
+	// Waiting on a paused queue is limited by the request timeout, even if the caller's context
+	// has no deadline.
+	q.pause(time.Hour)
+	err := q.patch(ctx, vm, vmPatchResources, ktypes.MergePatchType, []byte(`{"cpu":1}`))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, server.received())
+}
@@ -0,0 +1,93 @@
+package agent
+
+// Named scaling profiles, selected for each VM by its namespace or labels, so that (for example)
+// production and staging VMs on the same cluster can be scaled with different aggressiveness.
+
+import (
+	"golang.org/x/exp/slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// ScalingProfile is a named set of scaling settings, used instead of the default scaling config for
+// the VMs that it selects
+//
+// VMs with their own scaling config (from the "autoscaling.neon.tech/config" annotation) keep it,
+// but are still subject to the profile's bounds.
+type ScalingProfile struct {
+	// Name identifies the profile in logs
+	Name string `json:"name"`
+	// Namespaces, if not empty, restricts the profile to VMs in one of these namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector, if not nil, restricts the profile to VMs with matching labels
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Config replaces .scaling.defaultConfig for the selected VMs. Scale-down delays are set with
+	// its scaleDownStabilizationSeconds, and batching of downscaling with its
+	// downscaleBatchWindowSeconds.
+	Config api.ScalingConfig `json:"config"`
+	// MinCU, if provided, raises the minimum compute units of the selected VMs to at least this,
+	// within their own bounds
+	MinCU *uint16 `json:"minCU,omitempty"`
+	// MaxCU, if provided, lowers the maximum compute units of the selected VMs to at most this,
+	// within their own bounds
+	MaxCU *uint16 `json:"maxCU,omitempty"`
+}
+
+// matches returns whether the profile selects the VM
+func (p *ScalingProfile) matches(vm *vmapi.VirtualMachine) bool {
+	if len(p.Namespaces) != 0 && !slices.Contains(p.Namespaces, vm.Namespace) {
+		return false
+	}
+	if p.Selector != nil {
+		// The selector was already checked when the config was read.
+		selector, _ := metav1.LabelSelectorAsSelector(p.Selector)
+		if !selector.Matches(labels.Set(vm.Labels)) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyScalingProfile updates info with the first of the profiles that selects the VM, returning
+// the name of the profile, or "" if none did.
+func applyScalingProfile(profiles []ScalingProfile, computeUnit api.Resources, vm *vmapi.VirtualMachine, info *api.VmInfo) string {
+	for i := range profiles {
+		p := &profiles[i]
+		if !p.matches(vm) {
+			continue
+		}
+
+		if info.Config.ScalingConfig == nil {
+			config := p.Config
+			info.Config.ScalingConfig = &config
+		}
+
+		if p.MinCU != nil {
+			lower := computeUnit.Mul(*p.MinCU)
+			info.Cpu.Min = util.Min(util.Max(info.Cpu.Min, lower.VCPU), info.Cpu.Max)
+			info.Mem.Min = util.Max(info.Mem.Min, memSlotsAtMost(lower.Mem, info.Mem.SlotSize, info.Mem.Max))
+		}
+		if p.MaxCU != nil {
+			upper := computeUnit.Mul(*p.MaxCU)
+			info.Cpu.Max = util.Max(util.Min(info.Cpu.Max, upper.VCPU), info.Cpu.Min)
+			info.Mem.Max = util.Max(memSlotsAtMost(upper.Mem, info.Mem.SlotSize, info.Mem.Max), info.Mem.Min)
+		}
+
+		return p.Name
+	}
+
+	return ""
+}
+
+// memSlotsAtMost returns the number of whole memory slots in mem, but no more than limit
+//
+// The limit is applied before converting to uint16, so that large amounts of memory (e.g. a MaxCU
+// of thousands of compute units) don't wrap around to a small number of slots.
+func memSlotsAtMost(mem api.Bytes, slotSize api.Bytes, limit uint16) uint16 {
+	return uint16(util.Min(mem/slotSize, api.Bytes(limit)))
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func testProfileVM(namespace string, labels map[string]string) *vmapi.VirtualMachine {
+	//nolint:exhaustruct // only the metadata is used to select profiles
+	return &vmapi.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "vm",
+			Labels:    labels,
+		},
+	}
+}
+
+// testProfileVMInfo returns a VmInfo with bounds of 1-8 CU, using 1 GiB memory slots
+func testProfileVMInfo() *api.VmInfo {
+	//nolint:exhaustruct // only the bounds and scaling config are used
+	return &api.VmInfo{
+		Cpu: api.VmCpuInfo{Min: 250, Max: 2000, Use: 250, Pinned: 0},
+		Mem: api.VmMemInfo{Min: 1, Max: 8, Use: 1, SlotSize: 1 << 30},
+	}
+}
+
+func cuPtr(cu uint16) *uint16 {
+	return &cu
+}
+
+var testProfileComputeUnit = api.Resources{VCPU: 250, Mem: 1 << 30}
+
+func TestScalingProfileSelection(t *testing.T) {
+	profiles := []ScalingProfile{
+		{
+			Name:       "staging",
+			Namespaces: []string{"staging"},
+			Selector:   nil,
+			Config:     api.ScalingConfig{LoadAverageFractionTarget: 0.95},
+			MinCU:      nil,
+			MaxCU:      nil,
+		},
+		{
+			Name:       "production",
+			Namespaces: nil,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"tier": "production"},
+			},
+			Config: api.ScalingConfig{LoadAverageFractionTarget: 0.5},
+			MinCU:  nil,
+			MaxCU:  nil,
+		},
+	}
+
+	cases := []struct {
+		name       string
+		vm         *vmapi.VirtualMachine
+		expected   string
+		loadTarget float64
+	}{
+		{
+			name:       "namespace",
+			vm:         testProfileVM("staging", nil),
+			expected:   "staging",
+			loadTarget: 0.95,
+		},
+		{
+			name:       "label",
+			vm:         testProfileVM("default", map[string]string{"tier": "production"}),
+			expected:   "production",
+			loadTarget: 0.5,
+		},
+		{
+			name:       "first-match-wins",
+			vm:         testProfileVM("staging", map[string]string{"tier": "production"}),
+			expected:   "staging",
+			loadTarget: 0.95,
+		},
+		{
+			name:       "no-match",
+			vm:         testProfileVM("default", map[string]string{"tier": "development"}),
+			expected:   "",
+			loadTarget: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info := testProfileVMInfo()
+			name := applyScalingProfile(profiles, testProfileComputeUnit, c.vm, info)
+			assert.Equal(t, c.expected, name)
+			if c.expected == "" {
+				assert.Nil(t, info.Config.ScalingConfig)
+			} else {
+				assert.Equal(t, c.loadTarget, info.Config.ScalingConfig.LoadAverageFractionTarget)
+			}
+		})
+	}
+}
+
+func TestScalingProfileKeepsVMConfig(t *testing.T) {
+	profiles := []ScalingProfile{{
+		Name:       "all",
+		Namespaces: nil,
+		Selector:   nil,
+		Config:     api.ScalingConfig{LoadAverageFractionTarget: 0.95},
+		MinCU:      nil,
+		MaxCU:      cuPtr(4),
+	}}
+
+	info := testProfileVMInfo()
+	own := &api.ScalingConfig{LoadAverageFractionTarget: 0.7}
+	info.Config.ScalingConfig = own
+
+	assert.Equal(t, "all", applyScalingProfile(profiles, testProfileComputeUnit, testProfileVM("default", nil), info))
+	// The VM's own config is kept, but the bounds still apply
+	assert.Same(t, own, info.Config.ScalingConfig)
+	assert.Equal(t, uint16(4), info.Mem.Max)
+}
+
+func TestScalingProfileBounds(t *testing.T) {
+	cases := []struct {
+		name        string
+		computeUnit api.Resources
+		minCU       *uint16
+		maxCU       *uint16
+		expectedCPU api.VmCpuInfo
+		expectedMem api.VmMemInfo
+	}{
+		{
+			name:        "within-bounds",
+			computeUnit: testProfileComputeUnit,
+			minCU:       cuPtr(2),
+			maxCU:       cuPtr(4),
+			expectedCPU: api.VmCpuInfo{Min: 500, Max: 1000, Use: 250, Pinned: 0},
+			expectedMem: api.VmMemInfo{Min: 2, Max: 4, Use: 1, SlotSize: 1 << 30},
+		},
+		{
+			name:        "outside-bounds",
+			computeUnit: testProfileComputeUnit,
+			minCU:       cuPtr(16),
+			maxCU:       nil,
+			// The profile can't raise the minimum above the VM's own maximum
+			expectedCPU: api.VmCpuInfo{Min: 2000, Max: 2000, Use: 250, Pinned: 0},
+			expectedMem: api.VmMemInfo{Min: 8, Max: 8, Use: 1, SlotSize: 1 << 30},
+		},
+		{
+			name:        "max-below-min",
+			computeUnit: testProfileComputeUnit,
+			minCU:       nil,
+			maxCU:       cuPtr(0),
+			// ... or lower the maximum below the VM's own minimum
+			expectedCPU: api.VmCpuInfo{Min: 250, Max: 250, Use: 250, Pinned: 0},
+			expectedMem: api.VmMemInfo{Min: 1, Max: 1, Use: 1, SlotSize: 1 << 30},
+		},
+		{
+			// 4096 CU of 16 GiB is 65536 slots, which would wrap around to 0 as a uint16
+			name:        "large-max",
+			computeUnit: api.Resources{VCPU: 250, Mem: 16 << 30},
+			minCU:       cuPtr(4096),
+			maxCU:       cuPtr(4096),
+			expectedCPU: api.VmCpuInfo{Min: 2000, Max: 2000, Use: 250, Pinned: 0},
+			expectedMem: api.VmMemInfo{Min: 8, Max: 8, Use: 1, SlotSize: 1 << 30},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			profiles := []ScalingProfile{{
+				Name:       "bounds",
+				Namespaces: nil,
+				Selector:   nil,
+				Config:     api.ScalingConfig{},
+				MinCU:      c.minCU,
+				MaxCU:      c.maxCU,
+			}}
+
+			info := testProfileVMInfo()
+			applyScalingProfile(profiles, c.computeUnit, testProfileVM("default", nil), info)
+			assert.Equal(t, c.expectedCPU, info.Cpu)
+			assert.Equal(t, c.expectedMem, info.Mem)
+		})
+	}
+}
@@ -11,21 +11,50 @@ type GlobalMetrics struct {
 	schedulerRequests        *prometheus.CounterVec
 	schedulerRequestedChange resourceChangePair
 	schedulerApprovedChange  resourceChangePair
+	schedulerDenials         *prometheus.CounterVec
 
 	monitorRequestsOutbound *prometheus.CounterVec
 	monitorRequestsInbound  *prometheus.CounterVec
+	monitorResumes          *prometheus.CounterVec
+	monitorMemoryVetoes     prometheus.Counter
 	monitorRequestedChange  resourceChangePair
 	monitorApprovedChange   resourceChangePair
 
 	neonvmRequestsOutbound *prometheus.CounterVec
 	neonvmRequestedChange  resourceChangePair
 
+	patchQueueDepth     prometheus.Gauge
+	patchQueueCoalesced prometheus.Counter
+	patchQueueThrottled prometheus.Counter
+	patchQueueWait      prometheus.Histogram
+	patchDuration       *prometheus.HistogramVec
+
 	runnersCount       *prometheus.GaugeVec
 	runnerFatalErrors  prometheus.Counter
 	runnerThreadPanics prometheus.Counter
 	runnerStarts       prometheus.Counter
 	runnerRestarts     prometheus.Counter
 	runnerNextActions  prometheus.Counter
+	runnerErrors       *prometheus.CounterVec
+
+	namespaceLimitWaiting prometheus.Gauge
+
+	nodeMemoryPressure prometheus.Gauge
+
+	hostContentionEvents prometheus.Counter
+
+	burstUpscales prometheus.Counter
+
+	scalingConfigGeneration prometheus.Gauge
+
+	webhookNotifications *prometheus.CounterVec
+
+	diskResizes     *prometheus.CounterVec
+	diskResizeBytes prometheus.Counter
+
+	postgresRestarts *prometheus.CounterVec
+
+	subsystemHealth *prometheus.GaugeVec
 }
 
 type resourceChangePair struct {
@@ -102,6 +131,13 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 				[]string{directionLabel},
 			)),
 		},
+		schedulerDenials: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_scheduler_plugin_denials_total",
+				Help: "Number of responses from the scheduler plugin that denied part of a requested increase, by reason",
+			},
+			[]string{"reason"},
+		)),
 
 		// ---- MONITOR ----
 		monitorRequestsOutbound: util.RegisterMetric(reg, prometheus.NewCounterVec(
@@ -118,6 +154,19 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 			},
 			[]string{"endpoint", "code"},
 		)),
+		monitorResumes: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_monitor_resumes_total",
+				Help: "Number of attempts to resume sessions with vm-monitors after their connection dropped, by outcome",
+			},
+			[]string{"outcome"},
+		)),
+		monitorMemoryVetoes: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_monitor_memory_pressure_vetoes_total",
+				Help: "Number of times vm-monitors signaled memory pressure, vetoing memory downscaling until it subsided",
+			},
+		)),
 		monitorRequestedChange: resourceChangePair{
 			cpu: util.RegisterMetric(reg, prometheus.NewCounterVec(
 				prometheus.CounterOpts{
@@ -177,6 +226,39 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 				[]string{directionLabel},
 			)),
 		},
+		patchQueueDepth: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_vm_patch_queue_depth",
+				Help: "Number of VM patches waiting in the patch queue",
+			},
+		)),
+		patchQueueCoalesced: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_vm_patch_queue_coalesced_total",
+				Help: "Number of VM patches that replaced an older patch still waiting in the queue",
+			},
+		)),
+		patchQueueThrottled: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_vm_patch_queue_throttled_total",
+				Help: "Number of VM patches that were rejected by the API server with 429 Too Many Requests",
+			},
+		)),
+		patchQueueWait: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_vm_patch_queue_wait_seconds",
+				Help:    "Time that VM patches spent waiting in the patch queue",
+				Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+			},
+		)),
+		patchDuration: util.RegisterMetric(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_vm_patch_duration_seconds",
+				Help:    "Duration of VM patch requests sent from the patch queue, by kind of patch and outcome",
+				Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+			},
+			[]string{"kind", "outcome"},
+		)),
 
 		// ---- RUNNER LIFECYCLE ----
 		runnersCount: util.RegisterMetric(reg, prometheus.NewGaugeVec(
@@ -217,6 +299,95 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 				Help: "Number of times (*core.State).NextActions() has been called",
 			},
 		)),
+		runnerErrors: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_runner_errors_total",
+				Help: "Number of non-fatal errors in runners' background loops, by kind",
+			},
+			[]string{"kind"},
+		)),
+
+		// ---- NAMESPACE LIMITS ----
+		namespaceLimitWaiting: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_namespace_limit_waiting_operations",
+				Help: "Number of operations currently waiting on the per-namespace concurrency limit",
+			},
+		)),
+
+		// ---- NODE PRESSURE ----
+		nodeMemoryPressure: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_node_memory_pressure_avg10",
+				Help: "Percentage of time in the last 10 seconds that tasks on the node were stalled on memory",
+			},
+		)),
+
+		// ---- HOST CONTENTION ----
+		hostContentionEvents: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_host_contention_total",
+				Help: "Number of times that a VM's CPU steal time crossed the threshold for the host being oversubscribed",
+			},
+		)),
+
+		// ---- BURST UPSCALING ----
+		burstUpscales: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_burst_upscales_total",
+				Help: "Number of times that a VM's load or connections spiked enough to trigger a burst upscale",
+			},
+		)),
+
+		// ---- CONFIG RELOADING ----
+		scalingConfigGeneration: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_scaling_config_generation",
+				Help: "Generation of the reloadable config in effect, incremented each time it's changed by a reload",
+			},
+		)),
+
+		// ---- WEBHOOK ----
+		webhookNotifications: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_webhook_notifications_total",
+				Help: "Number of scaling notifications for the webhook, by whether they were sent, failed, or dropped",
+			},
+			[]string{"outcome"},
+		)),
+
+		// ---- DISK ----
+		diskResizes: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_disk_resizes_total",
+				Help: "Number of attempts to grow VMs' root disks, by outcome",
+			},
+			[]string{"outcome"},
+		)),
+		diskResizeBytes: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_disk_resize_bytes_total",
+				Help: "Total number of bytes that VMs' root disks have been grown by",
+			},
+		)),
+
+		// ---- RESTARTS ----
+		postgresRestarts: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_postgres_restarts_total",
+				Help: "Number of attempts to restart Postgres in VMs with a requested restart, by outcome",
+			},
+			[]string{"outcome"},
+		)),
+
+		// ---- HEALTH ----
+		subsystemHealth: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_subsystem_health",
+				Help: "Status of each subsystem as of the last health check, 1 for the current status and 0 for the others",
+			},
+			[]string{"subsystem", "status"},
+		)),
 	}
 
 	// Some of of the metrics should have default keys set to zero. Otherwise, these won't be filled
@@ -257,6 +428,16 @@ type PerVMMetrics struct {
 	cpu          *prometheus.GaugeVec
 	memory       *prometheus.GaugeVec
 	restartCount *prometheus.GaugeVec
+	manualTarget *prometheus.GaugeVec
+
+	// Gauges from each VM's Runner. See vmusage.go.
+	currentCU   *prometheus.GaugeVec
+	goalCU      *prometheus.GaugeVec
+	loadAverage *prometheus.GaugeVec
+	memoryUsage *prometheus.GaugeVec
+	lastScaling *prometheus.GaugeVec
+	cpuSteal    *prometheus.GaugeVec
+	cpuThrottle *prometheus.GaugeVec
 }
 
 type vmResourceValueType string
@@ -312,6 +493,103 @@ func makePerVMMetrics() (PerVMMetrics, *prometheus.Registry) {
 				"project_id",   // .metadata.labels["neon/project-id"]
 			},
 		)),
+		manualTarget: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_manual_target_cu",
+				Help: "Number of compute units that the VM is pinned at by a manual target. Absent if automatic scaling is in effect",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		currentCU: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_current_cu",
+				Help: "Number of compute units currently allocated to the VM",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		goalCU: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_goal_cu",
+				Help: "Number of compute units that the VM is being scaled towards, as of its latest metrics",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		loadAverage: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_load_average_1m",
+				Help: "Most recent 1-minute load average fetched from the VM",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		memoryUsage: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_memory_usage_bytes",
+				Help: "Most recent memory usage in bytes fetched from the VM",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		lastScaling: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_last_scaling_timestamp_seconds",
+				Help: "Unix timestamp of the most recent successful upscale (inc) or downscale (dec) of the VM",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+				directionLabel, // inc or dec
+			},
+		)),
+		cpuSteal: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_cpu_steal_fraction",
+				Help: "Average fraction of time that the VM's CPUs were stolen by the host, between its two most recent metrics",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
+		cpuThrottle: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_cpu_throttled_fraction",
+				Help: "Fraction of time that the VM's cgroup was throttled by its CPU quota, between its two most recent metrics",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+				"project_id",   // .metadata.labels["neon/project-id"]
+			},
+		)),
 	}
 
 	return metrics, reg
@@ -0,0 +1,217 @@
+package agent
+
+// Coordinated restarts of Postgres, requested with the api.AnnotationRestartRequest annotation
+//
+// Some Postgres settings (like shared_buffers) only take effect after a restart, so after a large
+// change to a VM's memory, the control plane may ask for Postgres to be restarted. We check for
+// requested restarts that haven't happened yet, and once the VM is in its maintenance window, ask
+// the vm-monitor to restart Postgres. Progress is written to the VM's .status.postgresRestart.
+//
+// The VM is read from the VM watch store rather than fetched from the API server, so checking
+// doesn't add any load to it. The store may lag behind our own writes to the status, so while the
+// Runner is running, the status that it last wrote is used instead of the one in the store.
+//
+// Each attempt is marked as in progress before it's made, so that if the autoscaler-agent restarts
+// in the middle of it, the attempt is still counted. The vm-monitor is expected to ignore requests
+// for a restart that it's already done.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ktypes "k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+// Values of the "outcome" label on the postgres restarts metric
+const (
+	restartOutcomeOK       = "ok"
+	restartOutcomeRetrying = "retrying"
+	restartOutcomeFailed   = "failed"
+)
+
+// restartLoop periodically checks whether the VM has a requested restart that's due, carrying it
+// out if so.
+func (r *Runner) restartLoop(ctx context.Context, logger *zap.Logger, getVmInfo func() api.VmInfo) {
+	config := r.global.config.Monitor.Restart
+
+	ticker := time.NewTicker(time.Second * time.Duration(config.CheckEverySeconds))
+	defer ticker.Stop()
+
+	// written is the restart status that we last wrote, which the VM store may not have yet
+	var written *vmapi.PostgresRestartStatus
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		vm, ok := r.global.vmStore.GetIndexed(func(index *watch.NameIndex[vmapi.VirtualMachine]) (*vmapi.VirtualMachine, bool) {
+			return index.Get(r.vmName.Namespace, r.vmName.Name)
+		})
+		if !ok {
+			// The Runner is stopped when the VM is deleted, so this should only happen briefly.
+			logger.Warn("VM not found in the VM store, skipping check for requested postgres restart")
+			continue
+		}
+
+		var err error
+		written, err = r.checkRestart(ctx, logger, vm, written, getVmInfo)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Failed to check for requested postgres restart", zap.Error(err))
+		}
+	}
+}
+
+// checkRestart makes a single check for a requested restart of the VM, carrying it out if it's due
+//
+// The VM is shared with the VM store, so it must not be modified. written is the restart status
+// that was last written, if any; checkRestart returns the status as it is after the check.
+func (r *Runner) checkRestart(
+	ctx context.Context,
+	logger *zap.Logger,
+	vm *vmapi.VirtualMachine,
+	written *vmapi.PostgresRestartStatus,
+	getVmInfo func() api.VmInfo,
+) (*vmapi.PostgresRestartStatus, error) {
+	config := r.global.config.Monitor.Restart
+
+	restart, err := api.ExtractCoordinatedRestart(vm)
+	if err != nil {
+		return written, err
+	} else if restart == nil {
+		return written, nil
+	}
+
+	// We're the only writer of the status, so what we last wrote is at least as recent as what's
+	// in the store.
+	status := vm.Status.PostgresRestart
+	if written != nil {
+		status = written
+	}
+
+	var attempts int32
+	if status != nil && status.ID == restart.ID {
+		if status.Phase == vmapi.PostgresRestartSucceeded || status.Phase == vmapi.PostgresRestartFailed {
+			return status, nil
+		}
+		attempts = status.Attempts
+	}
+
+	newStatus := func(phase vmapi.PostgresRestartPhase, message string) vmapi.PostgresRestartStatus {
+		return vmapi.PostgresRestartStatus{
+			ID:                 restart.ID,
+			Phase:              phase,
+			Message:            message,
+			Attempts:           attempts,
+			LastTransitionTime: metav1.Now(),
+		}
+	}
+
+	if !restart.InWindow(time.Now()) {
+		return r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartPending, "waiting for maintenance window"))
+	}
+
+	r.lock.Lock()
+	monitor := r.monitor
+	r.lock.Unlock()
+	if monitor == nil || !monitor.dispatcher.Capabilities().Has(api.MonitorCapPostgresRestart) {
+		return r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartPending, "waiting for a vm-monitor that supports restarts"))
+	}
+
+	attempts += 1
+	status, err = r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartInProgress, ""))
+	if err != nil {
+		return status, err
+	}
+
+	// Size the memory-dependent settings for the VM's current memory, so that they match any
+	// resizing that's happened since Postgres was last started.
+	settings := make(map[string]string)
+	if fc := r.global.config.Monitor.FileCache; fc != nil {
+		for name, value := range fileCacheSettings(fc, getVmInfo().Using().Mem) {
+			settings[name] = value
+		}
+	}
+	for name, value := range restart.Settings {
+		settings[name] = value
+	}
+
+	req := api.PostgresRestartRequest{
+		ID:                  restart.ID,
+		Settings:            settings,
+		DrainTimeoutSeconds: config.DrainTimeoutSeconds,
+	}
+	logger.Info("Restarting postgres", zap.Any("request", req), zap.Int32("attempt", attempts))
+
+	callTimeout := time.Second * time.Duration(config.TimeoutSeconds)
+	res, err := monitor.dispatcher.Call(ctx, logger, callTimeout, "PostgresRestartRequest", req)
+
+	var failure string
+	if err != nil {
+		failure = err.Error()
+	} else if res.RestartResult == nil || !res.RestartResult.Ok {
+		failure = "vm-monitor did not restart postgres"
+		if res.RestartResult != nil && res.RestartResult.Status != "" {
+			failure = fmt.Sprintf("%s: %s", failure, res.RestartResult.Status)
+		}
+	}
+
+	if failure == "" {
+		logger.Info("Restarted postgres", zap.String("id", restart.ID), zap.Any("result", res.RestartResult))
+		r.global.metrics.postgresRestarts.WithLabelValues(restartOutcomeOK).Inc()
+		return r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartSucceeded, res.RestartResult.Status))
+	}
+
+	message := fmt.Sprintf("attempt %d of %d failed: %s", attempts, config.MaxAttempts, failure)
+	if uint(attempts) >= config.MaxAttempts {
+		logger.Error("Failed to restart postgres, giving up", zap.String("id", restart.ID), zap.String("error", failure))
+		r.global.metrics.postgresRestarts.WithLabelValues(restartOutcomeFailed).Inc()
+		return r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartFailed, message))
+	}
+
+	logger.Warn("Failed to restart postgres, will retry", zap.String("id", restart.ID), zap.String("error", failure))
+	r.global.metrics.postgresRestarts.WithLabelValues(restartOutcomeRetrying).Inc()
+	return r.setRestartStatus(ctx, status, newStatus(vmapi.PostgresRestartPending, message))
+}
+
+// setRestartStatus writes the status to the VM's .status.postgresRestart, unless it's the same as
+// the previous status (other than the time), returning the status that the VM now has
+func (r *Runner) setRestartStatus(
+	ctx context.Context,
+	prev *vmapi.PostgresRestartStatus,
+	status vmapi.PostgresRestartStatus,
+) (*vmapi.PostgresRestartStatus, error) {
+	if prev != nil && prev.ID == status.ID && prev.Phase == status.Phase &&
+		prev.Message == status.Message && prev.Attempts == status.Attempts {
+		return prev, nil
+	}
+
+	// Use a merge patch so that only the restart status is changed
+	patchPayload, err := json.Marshal(map[string]any{
+		"status": map[string]any{
+			"postgresRestart": status,
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling merge patch: %w", err))
+	}
+
+	if err := r.patchVM(ctx, vmPatchRestart, ktypes.MergePatchType, patchPayload, "status"); err != nil {
+		return prev, fmt.Errorf("Error patching VM postgres restart status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestCheckRestart(t *testing.T) {
+	failure := errors.New("injected failure")
+	// The second patch fails, and the rest succeed
+	queue, server := newTestPatchQueue(10, nil, failure)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue.start(ctx, zap.NewNop())
+
+	r := &Runner{ //nolint:exhaustruct // only the fields for checking restarts are used
+		global: &agentState{ //nolint:exhaustruct // only the fields for checking restarts are used
+			config: &Config{ //nolint:exhaustruct // only the restart config is used
+				Monitor: MonitorConfig{ //nolint:exhaustruct // only the restart config is used
+					Restart: &RestartConfig{
+						CheckEverySeconds:   60,
+						DrainTimeoutSeconds: 10,
+						TimeoutSeconds:      60,
+						MaxAttempts:         3,
+					},
+				},
+			},
+			patchQueue: queue,
+		},
+		vmName: util.NamespacedName{Namespace: "default", Name: "vm"},
+		lock:   util.NewChanMutex(),
+	}
+	getVmInfo := func() api.VmInfo { panic("the VM info isn't needed without a vm-monitor") }
+
+	vmWithRestart := func(restart string, status *vmapi.PostgresRestartStatus) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.Namespace = "default"
+		vm.Name = "vm"
+		if restart != "" {
+			vm.Annotations = map[string]string{api.AnnotationRestartRequest: restart}
+		}
+		vm.Status.PostgresRestart = status
+		return vm
+	}
+	// statusOf returns the restart status set by the patch
+	statusOf := func(payload string) vmapi.PostgresRestartStatus {
+		var patch struct {
+			Status struct {
+				PostgresRestart vmapi.PostgresRestartStatus `json:"postgresRestart"`
+			} `json:"status"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(payload), &patch))
+		return patch.Status.PostgresRestart
+	}
+
+	// Nothing happens without a requested restart
+	written, err := r.checkRestart(ctx, zap.NewNop(), vmWithRestart("", nil), nil, getVmInfo)
+	require.NoError(t, err)
+	assert.Nil(t, written)
+	assert.Empty(t, server.received())
+
+	// Outside the maintenance window, the restart is pending, which is written to the VM's status
+	// rather than the VM itself.
+	otherDay := strings.ToLower(time.Now().Add(48 * time.Hour).Weekday().String()[:3])
+	notToday := func(id string) string {
+		return `{"id": "` + id + `", "window": {"days": ["` + otherDay + `"], "start": "00:00", "end": "23:59"}}`
+	}
+	vm := vmWithRestart(notToday("resize"), nil)
+	written, err = r.checkRestart(ctx, zap.NewNop(), vm, nil, getVmInfo)
+	require.NoError(t, err)
+	require.Len(t, server.received(), 1)
+	assert.Equal(t, []string{"status"}, server.receivedSubresources())
+	status := statusOf(server.received()[0])
+	assert.Equal(t, "resize", status.ID)
+	assert.Equal(t, vmapi.PostgresRestartPending, status.Phase)
+	assert.Equal(t, "waiting for maintenance window", status.Message)
+	assert.Equal(t, int32(0), status.Attempts)
+	require.NotNil(t, written)
+	assert.Equal(t, status.Phase, written.Phase)
+
+	// The status that was last written is used even if the VM store hasn't caught up, so the VM
+	// isn't patched again while nothing's changed.
+	written, err = r.checkRestart(ctx, zap.NewNop(), vm, written, getVmInfo)
+	require.NoError(t, err)
+	assert.Len(t, server.received(), 1)
+	assert.Equal(t, "waiting for maintenance window", written.Message)
+
+	// In the window, the restart waits for a vm-monitor that supports it. The patch fails, so the
+	// previous status is kept, and it's tried again next time.
+	vm = vmWithRestart(`{"id": "resize"}`, nil)
+	failed, err := r.checkRestart(ctx, zap.NewNop(), vm, written, getVmInfo)
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, written, failed)
+	written, err = r.checkRestart(ctx, zap.NewNop(), vm, written, getVmInfo)
+	require.NoError(t, err)
+	require.Len(t, server.received(), 3)
+	assert.Equal(t, "waiting for a vm-monitor that supports restarts", statusOf(server.received()[2]).Message)
+	assert.Equal(t, "waiting for a vm-monitor that supports restarts", written.Message)
+
+	// Restarts that have already finished aren't carried out again, according to the VM store after
+	// the Runner has restarted...
+	//nolint:exhaustruct // the time isn't checked
+	succeeded := &vmapi.PostgresRestartStatus{ID: "resize", Phase: vmapi.PostgresRestartSucceeded, Attempts: 1}
+	written, err = r.checkRestart(ctx, zap.NewNop(), vmWithRestart(`{"id": "resize"}`, succeeded), nil, getVmInfo)
+	require.NoError(t, err)
+	assert.Equal(t, succeeded, written)
+	assert.Len(t, server.received(), 3)
+
+	// ... but a new restart starts over.
+	_, err = r.checkRestart(ctx, zap.NewNop(), vmWithRestart(notToday("resize-again"), succeeded), nil, getVmInfo)
+	require.NoError(t, err)
+	require.Len(t, server.received(), 4)
+	status = statusOf(server.received()[3])
+	assert.Equal(t, "resize-again", status.ID)
+	assert.Equal(t, vmapi.PostgresRestartPending, status.Phase)
+}
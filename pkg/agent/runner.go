@@ -23,12 +23,14 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
 
 	"github.com/neondatabase/autoscaling/pkg/agent/core"
@@ -36,7 +38,9 @@ import (
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/faults"
 	"github.com/neondatabase/autoscaling/pkg/util/patch"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 // PluginProtocolVersion is the current version of the agent<->scheduler plugin in use by this
@@ -44,7 +48,7 @@ import (
 //
 // Currently, each autoscaler-agent supports only one version at a time. In the future, this may
 // change.
-const PluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_0
+const PluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_4
 
 // Runner is per-VM Pod god object responsible for handling everything
 //
@@ -55,6 +59,9 @@ type Runner struct {
 	// status provides the high-level status of the Runner. Reading or updating the status requires
 	// holding podStatus.lock. Updates are typically done handled by the setStatus method.
 	status *lockedPodStatus
+	// decisions, if not nil, stores the recent scaling decisions for the VM. It's shared with the
+	// podState, so that it persists across restarts.
+	decisions *decisionHistory
 
 	// shutdown provides a clean way to trigger all background Runner threads to shut down. shutdown
 	// is set exactly once, by (*Runner).Run
@@ -73,6 +80,12 @@ type Runner struct {
 	// executorStateDump is set by (*Runner).Run and provides a way to get the state of the
 	// "executor"
 	executorStateDump func() executor.StateDump
+	// executorDebugDump is set by (*Runner).Run and provides a way to get a snapshot of the
+	// "executor", including its most recent actions
+	executorDebugDump func() executor.DebugDump
+	// executorGoal is set by (*Runner).Run and provides a way to get the resources that the
+	// "executor" is currently aiming for
+	executorGoal func() *api.Resources
 
 	// monitor, if non nil, stores the current Dispatcher in use for communicating with the
 	// vm-monitor, alongside a generation number.
@@ -81,6 +94,14 @@ type Runner struct {
 	// which means that it may be read when EITHER holding lock OR the executor's lock.
 	monitor *monitorInfo
 
+	// anomalies tracks persistent problems with the VM, for posting them as Events
+	anomalies *vmAnomalies
+
+	// lastMetricsSpan is the span of the most recent successful metrics request, if tracing is
+	// enabled. It's used as the parent of the spans for the requests made to act on the scaling
+	// decision that the metrics led to.
+	lastMetricsSpan atomic.Pointer[trace.SpanContext]
+
 	// backgroundWorkerCount tracks the current number of background workers. It is exclusively
 	// updated by r.spawnBackgroundWorker
 	backgroundWorkerCount atomic.Int64
@@ -132,6 +153,34 @@ func (r *Runner) State(ctx context.Context) (*RunnerState, error) {
 	}, nil
 }
 
+// debugDump returns a snapshot of the Runner's executor, or nil if it hasn't started yet
+func (r *Runner) debugDump(ctx context.Context) (*executor.DebugDump, error) {
+	if err := r.lock.TryLock(ctx); err != nil {
+		return nil, err
+	}
+	defer r.lock.Unlock()
+
+	if r.executorDebugDump == nil /* may be nil if r.Run() hasn't fully started yet */ {
+		return nil, nil
+	}
+	dump := r.executorDebugDump()
+	return &dump, nil
+}
+
+// goal returns the resources that the Runner's executor is currently aiming for, or nil if they
+// aren't known yet
+func (r *Runner) goal(ctx context.Context) (*api.Resources, error) {
+	if err := r.lock.TryLock(ctx); err != nil {
+		return nil, err
+	}
+	defer r.lock.Unlock()
+
+	if r.executorGoal == nil /* may be nil if r.Run() hasn't fully started yet */ {
+		return nil, nil
+	}
+	return r.executorGoal(), nil
+}
+
 func (r *Runner) Spawn(ctx context.Context, logger *zap.Logger, vmInfoUpdated util.CondChannelReceiver) {
 	go func() {
 		// Gracefully handle panics, plus trigger restart
@@ -193,27 +242,26 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 	// tend to become distribted randomly over time.
 	pluginRequestJitter := util.NewTimeRange(time.Millisecond, 0, 100).Random()
 
+	var onDecision func(executor.Decision)
+	if r.decisions != nil || r.global.webhook != nil {
+		onDecision = r.recordDecision
+	}
+
+	// Create the receiver before reading the current value, so we don't miss any changes.
+	configChanged := r.global.liveConfig.changed.NewReceiver()
+	conf, _ := r.global.liveConfig.get()
+
 	coreExecLogger := execLogger.Named("core")
 	executorCore := executor.NewExecutorCore(coreExecLogger, getVmInfo(), executor.Config{
 		OnNextActions: r.global.metrics.runnerNextActions.Inc,
-		Core: core.Config{
-			ComputeUnit:                        r.global.config.Scaling.ComputeUnit,
-			DefaultScalingConfig:               r.global.config.Scaling.DefaultConfig,
-			NeonVMRetryWait:                    time.Second * time.Duration(r.global.config.NeonVM.RetryFailedRequestSeconds),
-			PluginRequestTick:                  time.Second*time.Duration(r.global.config.Scheduler.RequestAtLeastEverySeconds) - pluginRequestJitter,
-			PluginRetryWait:                    time.Second * time.Duration(r.global.config.Scheduler.RetryFailedRequestSeconds),
-			PluginDeniedRetryWait:              time.Second * time.Duration(r.global.config.Scheduler.RetryDeniedUpscaleSeconds),
-			MonitorDeniedDownscaleCooldown:     time.Second * time.Duration(r.global.config.Monitor.RetryDeniedDownscaleSeconds),
-			MonitorRequestedUpscaleValidPeriod: time.Second * time.Duration(r.global.config.Monitor.RequestedUpscaleValidSeconds),
-			MonitorRetryWait:                   time.Second * time.Duration(r.global.config.Monitor.RetryFailedRequestSeconds),
-			Log: core.LogConfig{
-				Info: coreExecLogger.Info,
-				Warn: coreExecLogger.Warn,
-			},
-		},
+		OnDecision:    onDecision,
+		Core:          r.coreConfig(conf, pluginRequestJitter, coreExecLogger),
+		Clock:         util.RealClock,
 	})
 
 	r.executorStateDump = executorCore.StateDump
+	r.executorDebugDump = executorCore.DebugDump
+	r.executorGoal = executorCore.Goal
 
 	monitorGeneration := executor.NewStoredGenerationNumber()
 
@@ -252,9 +300,85 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 	})
 	r.spawnBackgroundWorker(ctx, logger, "get metrics", func(c context.Context, l *zap.Logger) {
 		r.getMetricsLoop(c, l, func(metrics core.Metrics, withLock func()) {
-			ecwc.Updater().UpdateMetrics(metrics, withLock)
+			ecwc.Updater().UpdateMetrics(metrics, withLock, func(reason string) {
+				l.Warn("Burst upscale triggered", zap.String("reason", reason))
+				r.global.metrics.burstUpscales.Inc()
+			})
+			r.status.setVMUsageMetrics(r.global, metrics, executorCore.Goal())
+			r.status.recordDatabaseActivity(metrics)
+			r.status.recordUtilization(metrics)
+		}, func(reason string) {
+			ecwc.Updater().EmergencyUpscale(reason, func() {
+				l.Warn("Emergency upscale triggered", zap.String("reason", reason))
+			})
 		})
 	})
+	r.spawnBackgroundWorker(ctx, logger, "inbound traffic watcher", func(c context.Context, l *zap.Logger) {
+		r.inboundTrafficLoop(c, l, getVmInfo, func() {
+			ecwc.Updater().InboundTraffic(func() {
+				l.Info("Connections to paused VM arrived")
+			})
+		})
+	})
+	if r.global.config.Disk != nil {
+		r.spawnBackgroundWorker(ctx, logger, "disk resizer", r.diskResizeLoop)
+	}
+	if r.global.config.Monitor.Restart != nil {
+		r.spawnBackgroundWorker(ctx, logger.Named("restart"), "postgres restarter", func(c context.Context, l *zap.Logger) {
+			r.restartLoop(c, l, getVmInfo)
+		})
+	}
+	if r.global.config.StatusAnnotation != nil {
+		r.spawnBackgroundWorker(ctx, logger, "status annotation", func(c context.Context, l *zap.Logger) {
+			r.statusAnnotationLoop(c, l, executorCore, getVmInfo)
+		})
+	}
+	if r.global.config.Scaling.NodePressure != nil {
+		r.spawnBackgroundWorker(ctx, logger, "node pressure updater", func(c context.Context, l *zap.Logger) {
+			// Create the receiver before reading the current value, so we don't miss any changes.
+			changed := r.global.nodePressure.changed.NewReceiver()
+			for {
+				underPressure, since := r.global.nodePressure.get()
+
+				// VMs with higher priority wait longer before responding to the pressure, so that
+				// resources are reclaimed from lower-priority VMs first.
+				var delayed <-chan time.Time
+				if underPressure {
+					if remaining := time.Until(since.Add(r.nodePressureDelay())); remaining > 0 {
+						underPressure = false
+						delayed = time.After(remaining)
+					}
+				}
+
+				ecwc.Updater().NodeMemoryPressure(underPressure, func() {
+					l.Info("Updated node memory pressure", zap.Bool("underPressure", underPressure))
+				})
+
+				select {
+				case <-c.Done():
+					return
+				case <-changed.Wait():
+					changed.Awake()
+				case <-delayed:
+				}
+			}
+		})
+	}
+	r.spawnBackgroundWorker(ctx, logger, "config updater", func(c context.Context, l *zap.Logger) {
+		for {
+			select {
+			case <-c.Done():
+				return
+			case <-configChanged.Wait():
+				configChanged.Awake()
+			}
+
+			conf, generation := r.global.liveConfig.get()
+			ecwc.Updater().UpdateConfig(r.coreConfig(conf, pluginRequestJitter, coreExecLogger), func() {
+				l.Info("Updated config", zap.Uint64("generation", generation))
+			})
+		}
+	})
 	r.spawnBackgroundWorker(ctx, logger.Named("vm-monitor"), "vm-monitor reconnection loop", func(c context.Context, l *zap.Logger) {
 		r.connectToMonitorLoop(c, l, monitorGeneration, monitorStateCallbacks{
 			reset: func(withLock func()) {
@@ -262,6 +386,22 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 			},
 			upscaleRequested: func(request api.MoreResources, withLock func()) {
 				ecwc.Updater().UpscaleRequested(request, withLock)
+				conf, _ := r.global.liveConfig.get()
+				if c := conf.Scaling.EmergencyUpscale; c != nil && c.OnMonitorUpscaleRequest {
+					ecwc.Updater().EmergencyUpscale("vm-monitor requested upscale", func() {
+						l.Warn("Emergency upscale triggered by vm-monitor upscale request")
+					})
+				}
+			},
+			memoryPressure: func(signal api.MemoryPressureSignal) {
+				ecwc.Updater().MemoryPressure(signal, func(started bool) {
+					if !signal.AtRisk {
+						l.Info("vm-monitor memory pressure subsided, allowing memory downscaling")
+					} else if started {
+						l.Warn("vm-monitor signaled memory pressure, vetoing memory downscaling", zap.String("reason", signal.Reason))
+						r.global.metrics.monitorMemoryVetoes.Inc()
+					}
+				})
 			},
 			setActive: func(active bool, withLock func()) {
 				ecwc.Updater().MonitorActive(active, withLock)
@@ -271,6 +411,8 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 	r.spawnBackgroundWorker(ctx, execLogger.Named("sleeper"), "executor: sleeper", ecwc.DoSleeper)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("plugin"), "executor: plugin", ecwc.DoPluginRequests)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("neonvm"), "executor: neonvm", ecwc.DoNeonVMRequests)
+	r.spawnBackgroundWorker(ctx, execLogger.Named("neonvm-suspend"), "executor: neonvm suspend", ecwc.DoNeonVMSuspends)
+	r.spawnBackgroundWorker(ctx, execLogger.Named("neonvm-resume"), "executor: neonvm resume", ecwc.DoNeonVMResumes)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("vm-monitor-downscale"), "executor: vm-monitor downscale", ecwc.DoMonitorDownscales)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("vm-monitor-upscale"), "executor: vm-monitor upscale", ecwc.DoMonitorUpscales)
 
@@ -294,6 +436,119 @@ func ignoreLogger(f func(context.Context)) func(context.Context, *zap.Logger) {
 	}
 }
 
+// coreConfig returns the config for the VM's core.State, from the autoscaler-agent's config in
+// effect. It's called again with the new config whenever the config is reloaded.
+func (r *Runner) coreConfig(conf *Config, pluginRequestJitter time.Duration, logger *zap.Logger) core.Config {
+	var emergencyUpscaleCU uint16
+	var emergencyUpscaleMinInterval, emergencyUpscaleValidPeriod time.Duration
+	if c := conf.Scaling.EmergencyUpscale; c != nil {
+		emergencyUpscaleCU = c.IncreaseCU
+		emergencyUpscaleMinInterval = time.Second * time.Duration(c.MinIntervalSeconds)
+		emergencyUpscaleValidPeriod = time.Second * time.Duration(c.ValidSeconds)
+	}
+
+	var nodePressureDeniedDownscaleCooldown time.Duration
+	var nodePressureMaxUpscaleCU uint16
+	if c := conf.Scaling.NodePressure; c != nil {
+		nodePressureDeniedDownscaleCooldown = time.Second * time.Duration(c.RetryDeniedDownscaleSeconds)
+		nodePressureMaxUpscaleCU = c.MaxUpscaleCU
+	}
+
+	var prediction *core.PredictionConfig
+	if c := conf.Scaling.Prediction; c != nil {
+		prediction = &core.PredictionConfig{
+			Window:     time.Second * time.Duration(c.WindowSeconds),
+			Horizon:    time.Second * time.Duration(c.HorizonSeconds),
+			MinSamples: int(c.MinSamples),
+		}
+	}
+
+	var burst *core.BurstConfig
+	if c := conf.Scaling.Burst; c != nil {
+		burst = &core.BurstConfig{
+			LoadPerCPUThreshold:       c.LoadPerCPUThreshold,
+			ConnectionsPerCUThreshold: c.ActiveBackendsPerCUThreshold,
+			MinInterval:               time.Second * time.Duration(c.MinIntervalSeconds),
+			ValidPeriod:               time.Second * time.Duration(c.ValidSeconds),
+		}
+	}
+
+	var scalingPolicy core.ScalingPolicy = core.DefaultScalingPolicy{}
+	if name := conf.Scaling.Policy; name != "" {
+		// The name was already checked when the config was read.
+		scalingPolicy, _ = core.LookupScalingPolicy(name)
+	}
+	if terms := conf.Scaling.WeightedGoal; len(terms) != 0 {
+		// The terms were already checked when the config was read, and can't be used with a
+		// named policy.
+		scalingPolicy = core.WeightedScalingPolicy{Terms: terms}
+	}
+	if src := conf.Scaling.GoalExpression; src != "" {
+		// Likewise, the expression was already checked when the config was read.
+		expr, _ := core.ParseExpression(src)
+		scalingPolicy = core.ExpressionScalingPolicy{Expression: expr}
+	}
+
+	if c := conf.Scaling.TimeOfDay; c != nil {
+		// The timezone and times were already checked when the config was read.
+		location, _ := time.LoadLocation(c.Timezone)
+		var periods []core.TimeOfDayPeriod
+		for _, p := range c.Periods {
+			start, _ := util.ParseTimeOfDay(p.Start)
+			end, _ := util.ParseTimeOfDay(p.End)
+			periods = append(periods, core.TimeOfDayPeriod{
+				Start:             start,
+				End:               end,
+				DownscaleFraction: p.DownscaleFraction,
+			})
+		}
+		scalingPolicy = core.TimeOfDayPolicy{
+			Policy:   scalingPolicy,
+			Location: location,
+			Periods:  periods,
+		}
+	}
+
+	return core.Config{
+		ComputeUnit:                         conf.Scaling.ComputeUnit,
+		DefaultScalingConfig:                conf.Scaling.DefaultConfig,
+		NeonVMRetryWait:                     time.Second * time.Duration(conf.NeonVM.RetryFailedRequestSeconds),
+		PluginRequestTick:                   time.Second*time.Duration(conf.Scheduler.RequestAtLeastEverySeconds) - pluginRequestJitter,
+		PluginRetryWait:                     time.Second * time.Duration(conf.Scheduler.RetryFailedRequestSeconds),
+		PluginDeniedRetryWait:               time.Second * time.Duration(conf.Scheduler.RetryDeniedUpscaleSeconds),
+		MonitorDeniedDownscaleCooldown:      time.Second * time.Duration(conf.Monitor.RetryDeniedDownscaleSeconds),
+		MonitorRequestedUpscaleValidPeriod:  time.Second * time.Duration(conf.Monitor.RequestedUpscaleValidSeconds),
+		MonitorRetryWait:                    time.Second * time.Duration(conf.Monitor.RetryFailedRequestSeconds),
+		EmergencyUpscaleCU:                  emergencyUpscaleCU,
+		EmergencyUpscaleMinInterval:         emergencyUpscaleMinInterval,
+		EmergencyUpscaleValidPeriod:         emergencyUpscaleValidPeriod,
+		NodePressureDeniedDownscaleCooldown: nodePressureDeniedDownscaleCooldown,
+		NodePressureMaxUpscaleCU:            nodePressureMaxUpscaleCU,
+		Prediction:                          prediction,
+		Burst:                               burst,
+		ScalingPolicy:                       scalingPolicy,
+		Log: core.LogConfig{
+			Info: logger.Info,
+			Warn: logger.Warn,
+		},
+	}
+}
+
+// nodePressureDelay returns how long the node must be under memory pressure before this VM responds
+// to it, based on the VM's priority
+func (r *Runner) nodePressureDelay() time.Duration {
+	r.status.mu.Lock()
+	priority := r.status.vmInfo.Config.Priority
+	r.status.mu.Unlock()
+
+	if priority <= 0 {
+		return 0
+	}
+	conf, _ := r.global.liveConfig.get()
+	perPriority := time.Second * time.Duration(conf.Scaling.NodePressure.PriorityDelaySeconds)
+	return time.Duration(priority) * perPriority
+}
+
 // spawnBackgroundWorker is a helper function to appropriately handle panics in the various goroutines
 // spawned by `(Runner) Run`, sending them back on r.backgroundPanic
 //
@@ -343,6 +598,18 @@ func (r *Runner) spawnBackgroundWorker(ctx context.Context, logger *zap.Logger,
 	}()
 }
 
+// metricsErrorSummaryInterval is the interval at which repeated errors from metrics requests are
+// logged, after the first occurrence
+const metricsErrorSummaryInterval = time.Minute
+
+// kinds of errors in getMetricsLoop, for the runnerErrors metric
+const (
+	metricsErrorKind         = "metrics_request"
+	metricsTargetErrorKind   = "metrics_target_request"
+	postgresMetricsErrorKind = "postgres_metrics_request"
+	lfcMetricsErrorKind      = "lfc_metrics_request"
+)
+
 // getMetricsLoop repeatedly attempts to fetch metrics from the VM
 //
 // Every time metrics are successfully fetched, the value is recorded with newMetrics.
@@ -350,11 +617,11 @@ func (r *Runner) getMetricsLoop(
 	ctx context.Context,
 	logger *zap.Logger,
 	newMetrics func(metrics core.Metrics, withLock func()),
+	emergencyUpscale func(reason string),
 ) {
 	timeout := time.Second * time.Duration(r.global.config.Metrics.RequestTimeoutSeconds)
-	waitBetweenDuration := time.Second * time.Duration(r.global.config.Metrics.SecondsBetweenRequests)
 
-	randomStartWait := util.NewTimeRange(time.Second, 0, int(r.global.config.Metrics.SecondsBetweenRequests)).Random()
+	randomStartWait := util.NewTimeRange(time.Millisecond, 0, int(r.metricsInterval().Milliseconds())).Random()
 
 	logger.Info("Sleeping for random delay before making first metrics request", zap.Duration("delay", randomStartWait))
 
@@ -364,28 +631,187 @@ func (r *Runner) getMetricsLoop(
 	case <-time.After(randomStartWait):
 	}
 
+	// The threshold is re-read each time, because it may change if the config is reloaded.
+	stalledThreshold := func() float64 {
+		conf, _ := r.global.liveConfig.get()
+		if c := conf.Scaling.EmergencyUpscale; c != nil {
+			return c.MemoryStalledFractionThreshold
+		}
+		return 0
+	}
+
+	// previous value of metrics.MemoryStalledSecondsTotal, and when we got it
+	var lastStalled *float32
+	var lastStalledAt time.Time
+
+	// previous metrics and when we got them, for calculating the memory pressure from the PSI
+	// counters
+	var lastHost *core.Metrics
+	var lastHostAt time.Time
+
+	// previous Postgres counters, and when we got them. Rates are calculated between consecutive
+	// successful requests.
+	var lastPostgres *core.PostgresCounters
+	var lastPostgresAt time.Time
+
+	// previous LFC counters, for calculating the hit ratio
+	var lastLFC *core.LFCCounters
+
+	// Metrics requests are made often enough that a VM that's unreachable would otherwise flood
+	// the logs.
+	errs := util.NewErrorAggregator(
+		metricsErrorSummaryInterval,
+		r.global.metrics.runnerErrors,
+		metricsErrorKind, metricsTargetErrorKind, postgresMetricsErrorKind, lfcMetricsErrorKind,
+	)
+	defer errs.Flush(logger)
+
 	for {
-		metrics, err := r.doMetricsRequest(ctx, logger, timeout)
+		// While the VM is suspended, its vCPUs are stopped, so it can't respond - and once it's
+		// resumed, the counters from before will be too old to compare against.
+		if r.vmPaused() {
+			lastStalled, lastHost, lastPostgres, lastLFC = nil, nil, nil, nil
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.metricsInterval()):
+			}
+			continue
+		}
+
+		spanCtx, span := r.global.tracer.Start(ctx, "agent.metrics.scrape", trace.WithAttributes(r.vmTraceAttributes()...))
+		metrics, err := r.doMetricsRequest(spanCtx, logger, timeout, errs)
 		if err != nil {
-			logger.Error("Error making metrics request", zap.Error(err))
+			tracing.RecordError(span, err)
+			errs.Report(logger, metricsErrorKind, "Error making metrics request", err)
+			r.checkMetricsUnreachable(err)
 			goto next
 		} else if metrics == nil {
 			goto next
 		}
+		r.checkMetricsUnreachable(nil)
+
+		// Check memory pressure before updating the metrics, so that the emergency upscale isn't
+		// delayed by the regular scaling logic.
+		if threshold := stalledThreshold(); threshold != 0 && metrics.MemoryStalledSecondsTotal != nil {
+			now := time.Now()
+			if lastStalled != nil && *metrics.MemoryStalledSecondsTotal >= *lastStalled {
+				fraction := float64(*metrics.MemoryStalledSecondsTotal-*lastStalled) / now.Sub(lastStalledAt).Seconds()
+				if fraction >= threshold {
+					emergencyUpscale(fmt.Sprintf("memory stalled %.1f%% of the time", fraction*100))
+				}
+			}
+			lastStalled = metrics.MemoryStalledSecondsTotal
+			lastStalledAt = now
+		}
 
+		{
+			now := time.Now()
+			if lastHost != nil {
+				metrics.MemoryPressure = metrics.MemoryPressureSince(*lastHost, now.Sub(lastHostAt))
+				if metrics.CPU != nil && lastHost.CPU != nil {
+					contention := metrics.CPU.Since(*lastHost.CPU, now.Sub(lastHostAt))
+					metrics.HostContention = &contention
+				}
+			}
+			r.checkHostContention(metrics.HostContention)
+			lastHost = metrics
+			lastHostAt = now
+		}
+
+		if r.global.config.Metrics.Postgres != nil {
+			counters, err := r.doPostgresMetricsRequest(ctx, logger, timeout)
+			if err != nil {
+				errs.Report(logger, postgresMetricsErrorKind, "Error making Postgres metrics request", err)
+				lastPostgres = nil
+			} else {
+				now := time.Now()
+				if lastPostgres != nil {
+					pg := counters.Since(*lastPostgres, now.Sub(lastPostgresAt))
+					metrics.Postgres = &pg
+				}
+				lastPostgres = counters
+				lastPostgresAt = now
+			}
+		}
+
+		if r.global.config.Metrics.LFC != nil {
+			counters, err := r.doLFCMetricsRequest(ctx, logger, timeout)
+			if err != nil {
+				errs.Report(logger, lfcMetricsErrorKind, "Error making LFC metrics request", err)
+				lastLFC = nil
+			} else {
+				if lastLFC != nil {
+					lfc := counters.Since(*lastLFC)
+					metrics.LFC = &lfc
+				}
+				lastLFC = counters
+			}
+		}
+
+		if sc := trace.SpanContextFromContext(spanCtx); sc.IsValid() {
+			r.lastMetricsSpan.Store(&sc)
+		}
 		newMetrics(*metrics, func() {
 			logger.Info("Updated metrics", zap.Any("metrics", *metrics))
 		})
 
 	next:
+		span.End()
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(waitBetweenDuration):
+		case <-time.After(r.metricsInterval()):
 		}
 	}
 }
 
+// metricsInterval returns the time to wait between metrics requests, which may be overridden by
+// the VM's annotations
+func (r *Runner) metricsInterval() time.Duration {
+	r.status.mu.Lock()
+	overrides := r.status.vmInfo.Config.Overrides
+	r.status.mu.Unlock()
+
+	if overrides != nil && overrides.MetricsIntervalSeconds != nil {
+		return time.Second * time.Duration(*overrides.MetricsIntervalSeconds)
+	}
+	return time.Second * time.Duration(r.global.config.Metrics.SecondsBetweenRequests)
+}
+
+// vmPaused returns whether the VM is currently suspended with .spec.paused
+func (r *Runner) vmPaused() bool {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+	return r.status.vmInfo.Paused
+}
+
+// traceContext returns a context with the span of the most recent metrics request as the current
+// span, so that spans started from it are part of the same trace as the metrics that caused them.
+func (r *Runner) traceContext(ctx context.Context) context.Context {
+	if sc := r.lastMetricsSpan.Load(); sc != nil {
+		return trace.ContextWithRemoteSpanContext(ctx, *sc)
+	}
+	return ctx
+}
+
+// vmTraceAttributes returns the span attributes identifying the VM
+func (r *Runner) vmTraceAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("vm.namespace", r.vmName.Namespace),
+		attribute.String("vm.name", r.vmName.Name),
+	}
+}
+
+// resourcesTraceAttributes returns the span attributes for the resources, with keys starting with
+// the prefix
+func resourcesTraceAttributes(prefix string, r api.Resources) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Float64(prefix+".vcpu", r.VCPU.AsFloat64()),
+		attribute.Int64(prefix+".mem", int64(r.Mem)),
+	}
+}
+
 type monitorInfo struct {
 	generation executor.GenerationNumber
 	dispatcher *Dispatcher
@@ -394,6 +820,7 @@ type monitorInfo struct {
 type monitorStateCallbacks struct {
 	reset            func(withLock func())
 	upscaleRequested func(request api.MoreResources, withLock func())
+	memoryPressure   func(signal api.MemoryPressureSignal)
 	setActive        func(active bool, withLock func())
 }
 
@@ -478,7 +905,7 @@ func (r *Runner) connectToMonitorLoop(
 		}
 
 		lastStart = time.Now()
-		dispatcher, err := NewDispatcher(ctx, logger, addr, r, callbacks.upscaleRequested)
+		dispatcher, err := NewDispatcher(ctx, logger, addr, r, callbacks.upscaleRequested, callbacks.memoryPressure)
 		if err != nil {
 			logger.Error("Failed to connect to vm-monitor", zap.String("addr", addr), zap.Error(err))
 			continue
@@ -511,25 +938,139 @@ func (r *Runner) connectToMonitorLoop(
 // Lower-level implementation functions //
 //////////////////////////////////////////
 
-// doMetricsRequest makes a single metrics request to the VM
+// doMetricsRequest makes a single metrics request to the VM, or gets the latest metrics it pushed
+// if it uses the OTLP metrics transport
 func (r *Runner) doMetricsRequest(
 	ctx context.Context,
 	logger *zap.Logger,
 	timeout time.Duration,
+	errs *util.ErrorAggregator,
 ) (*core.Metrics, error) {
-	url := fmt.Sprintf("http://%s:%d/metrics", r.podIP, r.global.config.Metrics.Port)
+	r.status.mu.Lock()
+	transport := r.status.vmInfo.Config.MetricsTransport
+	r.status.mu.Unlock()
+
+	if transport == api.MetricsTransportOTLP && r.global.otlp != nil {
+		m, ok := r.global.otlp.get(r.podIP)
+		if !ok {
+			return nil, fmt.Errorf("No recent metrics received over OTLP from %s", r.podIP)
+		}
+		return &m, nil
+	}
 
-	reqCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	// Fetch from all of the targets at once, so that a slow target doesn't delay the others.
+	targets := r.global.config.Metrics.scrapeTargets()
+	outputs := make([]*core.PromOutput, len(targets))
+	targetErrs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t MetricsTargetConfig) {
+			defer wg.Done()
+			path := t.Path
+			if path == "" {
+				path = "/metrics"
+			}
+			body, err := r.fetchVMMetrics(ctx, logger, timeout, t.Port, path)
+			if err != nil {
+				targetErrs[i] = fmt.Errorf("Error fetching metrics from target %q: %w", t.Name, err)
+				return
+			}
+			out := core.ParsePromOutput(body)
+			if t.RenameMetrics != nil {
+				out = out.Rename(t.RenameMetrics)
+			}
+			outputs[i] = &out
+		}(i, t)
+	}
+	wg.Wait()
+
+	var merged []core.PromOutput
+	for i := range targets {
+		if outputs[i] != nil {
+			merged = append(merged, *outputs[i])
+		}
+	}
+	if len(merged) == 0 {
+		return nil, errors.Join(targetErrs...)
+	}
+	// Only some targets failed, so we can still try to use the rest.
+	for _, err := range targetErrs {
+		if err != nil {
+			errs.Report(logger, metricsTargetErrorKind, "Error making metrics request to target", err)
+		}
+	}
+
+	out := core.MergePromOutputs(merged...)
+	m, err := core.ReadMetricsFromOutput(out, r.global.config.Metrics.LoadMetricPrefix, r.global.config.Metrics.HostMetricLabels)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading metrics from prometheus output: %w", err)
+	}
+	// Gauges for the weighted goal are only read from here, not from metrics pushed over OTLP.
+	m.Gauges = core.ReadGauges(out, core.WeightedScalingPolicy{Terms: r.global.config.Scaling.WeightedGoal}.GaugeNames())
+
+	return &m, nil
+}
+
+// doPostgresMetricsRequest makes a single request to postgres_exporter in the VM
+func (r *Runner) doPostgresMetricsRequest(
+	ctx context.Context,
+	logger *zap.Logger,
+	timeout time.Duration,
+) (*core.PostgresCounters, error) {
+	body, err := r.fetchVMMetrics(ctx, logger, timeout, r.global.config.Metrics.Postgres.Port, "/metrics")
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := core.ReadPostgresCounters(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Postgres metrics from prometheus output: %w", err)
+	}
 
-	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, bytes.NewReader(nil))
+	return &c, nil
+}
+
+// doLFCMetricsRequest makes a single request to sql_exporter in the VM for the LFC metrics
+func (r *Runner) doLFCMetricsRequest(
+	ctx context.Context,
+	logger *zap.Logger,
+	timeout time.Duration,
+) (*core.LFCCounters, error) {
+	body, err := r.fetchVMMetrics(ctx, logger, timeout, r.global.config.Metrics.LFC.Port, "/metrics")
 	if err != nil {
-		panic(fmt.Errorf("Error constructing metrics request to %q: %w", url, err))
+		return nil, err
 	}
 
+	c, err := core.ReadLFCCounters(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading LFC metrics from prometheus output: %w", err)
+	}
+
+	return &c, nil
+}
+
+// fetchVMMetrics returns the body of a successful request to the metrics endpoint on the given
+// port and path in the VM
+func (r *Runner) fetchVMMetrics(
+	ctx context.Context,
+	logger *zap.Logger,
+	timeout time.Duration,
+	port uint16,
+	path string,
+) ([]byte, error) {
+	url := r.global.metricsClient.url(r.podIP, port, path)
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	logger.Info("Making metrics request to VM", zap.String("url", url))
 
-	resp, err := http.DefaultClient.Do(req)
+	if err := r.global.faults.Inject(reqCtx, faults.TargetMetrics, fmt.Sprint(r.vmName)); err != nil {
+		return nil, fmt.Errorf("Error making request to %q: %w", url, err)
+	}
+
+	resp, err := r.global.metricsClient.get(reqCtx, url)
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	} else if err != nil {
@@ -546,15 +1087,14 @@ func (r *Runner) doMetricsRequest(
 		return nil, fmt.Errorf("Unsuccessful response status %d: %s", resp.StatusCode, string(body))
 	}
 
-	m, err := core.ReadMetrics(body, r.global.config.Metrics.LoadMetricPrefix)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading metrics from prometheus output: %w", err)
-	}
-
-	return &m, nil
+	return body, nil
 }
 
 func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) error {
+	// Round up, in case the target isn't a multiple of the slot size. VMs using virtio-mem can have
+	// slots much smaller than a compute unit, so the target isn't always a whole number of slots.
+	memSlots := uint32((target.Mem + r.memSlotSize - 1) / r.memSlotSize)
+
 	patches := []patch.Operation{{
 		Op:    patch.OpReplace,
 		Path:  "/spec/guest/cpus/use",
@@ -562,7 +1102,7 @@ func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) erro
 	}, {
 		Op:    patch.OpReplace,
 		Path:  "/spec/guest/memorySlots/use",
-		Value: uint32(target.Mem / r.memSlotSize),
+		Value: memSlots,
 	}}
 
 	patchPayload, err := json.Marshal(patches)
@@ -570,16 +1110,34 @@ func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) erro
 		panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
 	}
 
-	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
-	requestCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
 	// FIXME: We should check the returned VM object here, in case the values are different.
 	//
 	// Also relevant: <https://github.com/neondatabase/autoscaling/issues/23>
-	_, err = r.global.vmClient.NeonvmV1().VirtualMachines(r.vmName.Namespace).
-		Patch(requestCtx, r.vmName.Name, ktypes.JSONPatchType, patchPayload, metav1.PatchOptions{})
+	err = r.patchVM(ctx, vmPatchResources, ktypes.JSONPatchType, patchPayload)
+	if err != nil {
+		r.global.metrics.neonvmRequestsOutbound.WithLabelValues(fmt.Sprintf("[error: %s]", util.RootError(err))).Inc()
+		return err
+	}
 
+	r.global.metrics.neonvmRequestsOutbound.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// doNeonVMSetPaused suspends or resumes the VM by setting .spec.paused. See ScaleToZeroConfig.
+func (r *Runner) doNeonVMSetPaused(ctx context.Context, paused bool) error {
+	// Use "add" rather than "replace", because .spec.paused is omitted while false.
+	patches := []patch.Operation{{
+		Op:    patch.OpAdd,
+		Path:  "/spec/paused",
+		Value: paused,
+	}}
+
+	patchPayload, err := json.Marshal(patches)
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
+	}
+
+	err = r.patchVM(ctx, vmPatchPaused, ktypes.JSONPatchType, patchPayload)
 	if err != nil {
 		r.global.metrics.neonvmRequestsOutbound.WithLabelValues(fmt.Sprintf("[error: %s]", util.RootError(err))).Inc()
 		return err
@@ -658,6 +1216,55 @@ func doMonitorUpscale(
 	return err
 }
 
+// doMonitorFileCacheResize asks the vm-monitor to resize the file cache (and related Postgres
+// settings) to match the VM's new memory, if it's enabled and the vm-monitor supports it.
+//
+// Failures are logged but not returned, because the VM's resources have already changed by the
+// time this is called; a cache that's the wrong size shouldn't block further scaling.
+func doMonitorFileCacheResize(
+	ctx context.Context,
+	logger *zap.Logger,
+	dispatcher *Dispatcher,
+	mem api.Bytes,
+) {
+	r := dispatcher.runner
+	conf := r.global.config.Monitor.FileCache
+	if conf == nil || !dispatcher.Capabilities().Has(api.MonitorCapFileCacheResize) {
+		return
+	}
+
+	req := api.FileCacheResizeRequest{
+		Size:     uint64(float64(mem) * conf.MemoryFraction),
+		Settings: fileCacheSettings(conf, mem),
+	}
+
+	timeout := time.Second * time.Duration(r.global.config.Monitor.ResponseTimeoutSeconds)
+
+	res, err := dispatcher.Call(ctx, logger, timeout, "FileCacheResizeRequest", req)
+	if err != nil {
+		logger.Error("Failed to resize file cache", zap.Any("request", req), zap.Error(err))
+	} else if res.FileCacheResult == nil || !res.FileCacheResult.Ok {
+		logger.Warn("vm-monitor did not resize file cache", zap.Any("request", req), zap.Any("result", res.FileCacheResult))
+	} else {
+		logger.Info("Resized file cache", zap.Any("request", req), zap.Any("result", res.FileCacheResult))
+	}
+}
+
+// fileCacheSettings returns the memory-sized Postgres settings for a VM with the given memory, or
+// nil if there aren't any
+func fileCacheSettings(conf *FileCacheConfig, mem api.Bytes) map[string]string {
+	if len(conf.Settings) == 0 {
+		return nil
+	}
+
+	settings := make(map[string]string)
+	for name, fraction := range conf.Settings {
+		// Postgres' memory settings accept kB as a unit, which is precise enough.
+		settings[name] = fmt.Sprintf("%dkB", uint64(float64(mem)*fraction)/1024)
+	}
+	return settings
+}
+
 // DoSchedulerRequest sends a request to the scheduler and does not validate the response.
 func (r *Runner) DoSchedulerRequest(
 	ctx context.Context,
@@ -666,6 +1273,10 @@ func (r *Runner) DoSchedulerRequest(
 	lastPermit *api.Resources,
 	metrics *api.Metrics,
 ) (_ *api.PluginResponse, err error) {
+	r.status.mu.Lock()
+	priority := r.status.vmInfo.Config.Priority
+	r.status.mu.Unlock()
+
 	reqData := &api.AgentRequest{
 		ProtoVersion: PluginProtocolVersion,
 		Pod:          r.podName,
@@ -673,6 +1284,7 @@ func (r *Runner) DoSchedulerRequest(
 		Resources:    resources,
 		LastPermit:   lastPermit,
 		Metrics:      metrics,
+		Priority:     priority,
 	}
 
 	// make sure we log any error we're returning:
@@ -690,24 +1302,51 @@ func (r *Runner) DoSchedulerRequest(
 		return nil, err
 	}
 
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Info("Sending request to scheduler", zap.Any("request", reqData))
+
+	if err := r.global.faults.Inject(reqCtx, faults.TargetScheduler, fmt.Sprint(r.vmName)); err != nil {
+		return nil, err
+	}
+
+	var respData *api.PluginResponse
+	if r.global.config.Scheduler.Transport == SchedulerTransportGRPC {
+		respData, err = r.doSchedulerRequestGRPC(reqCtx, sched.IP, reqData)
+	} else {
+		respData, err = r.doSchedulerRequestHTTP(reqCtx, sched.IP, reqData)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Received response from scheduler", zap.Any("response", respData))
+
+	return respData, nil
+}
+
+// doSchedulerRequestHTTP sends the request to the scheduler as JSON over HTTP, returning the
+// response if it was successful
+func (r *Runner) doSchedulerRequestHTTP(
+	ctx context.Context,
+	schedulerIP string,
+	reqData *api.AgentRequest,
+) (*api.PluginResponse, error) {
 	reqBody, err := json.Marshal(reqData)
 	if err != nil {
 		return nil, fmt.Errorf("Error encoding request JSON: %w", err)
 	}
 
-	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
-	reqCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	url := fmt.Sprintf("http://%s:%d/", sched.IP, r.global.config.Scheduler.RequestPort)
+	url := fmt.Sprintf("http://%s:%d/", schedulerIP, r.global.config.Scheduler.RequestPort)
 
-	request, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(reqBody))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("Error building request to %q: %w", url, err)
 	}
 	request.Header.Set("content-type", "application/json")
-
-	logger.Info("Sending request to scheduler", zap.Any("request", reqData))
+	tracing.Inject(ctx, request.Header)
 
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
@@ -736,7 +1375,5 @@ func (r *Runner) DoSchedulerRequest(
 		return nil, fmt.Errorf("Bad JSON response: %w", err)
 	}
 
-	logger.Info("Received response from scheduler", zap.Any("response", respData))
-
 	return &respData, nil
 }
@@ -0,0 +1,130 @@
+package agent
+
+// Resuming suspended VMs once connections to them arrive. See api.ScaleToZeroConfig.
+//
+// While the VM is paused, its vCPUs are stopped, so nothing inside it can tell that it's needed.
+// Instead, the VM's runner counts the connections made to the guest's ports, and once that count
+// goes up, we clear .spec.paused again.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const (
+	// inboundTrafficPollInterval is how often the runner of a paused VM is asked for the number of
+	// connections to it. This is most of the delay that a connection to a paused VM sees.
+	inboundTrafficPollInterval = time.Second
+
+	inboundTrafficErrorKind = "inbound_traffic_request"
+)
+
+// inboundTrafficLoop watches for connections to the VM while it's paused, calling inboundTraffic
+// each time there are new ones.
+func (r *Runner) inboundTrafficLoop(
+	ctx context.Context,
+	logger *zap.Logger,
+	getVmInfo func() api.VmInfo,
+	inboundTraffic func(),
+) {
+	timeout := time.Second * time.Duration(r.global.config.Metrics.RequestTimeoutSeconds)
+
+	errs := util.NewErrorAggregator(metricsErrorSummaryInterval, r.global.metrics.runnerErrors, inboundTrafficErrorKind)
+	defer errs.Flush(logger)
+
+	var counter inboundConnectionCounter
+	warnedUnsupported := false
+
+	for {
+		if vm := getVmInfo(); !vm.Paused || vm.RunnerPort == 0 {
+			// Connections made while the VM is running don't matter, so the count is taken again
+			// the next time it's paused.
+			counter.reset()
+		} else {
+			connections, err := r.getInboundConnections(ctx, timeout, vm.RunnerPort)
+			if err != nil {
+				errs.Report(logger, inboundTrafficErrorKind, "Error fetching inbound connections from runner", err)
+			} else if connections == nil {
+				if !warnedUnsupported {
+					logger.Warn("Runner does not report inbound connections, so the VM won't be resumed by the autoscaler-agent")
+					warnedUnsupported = true
+				}
+			} else if counter.update(*connections) {
+				inboundTraffic()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(inboundTrafficPollInterval):
+		}
+	}
+}
+
+// inboundConnectionCounter tracks the number of connections to a paused VM, as reported by its
+// runner, to find when new ones arrive
+type inboundConnectionCounter struct {
+	// last is the most recently reported number of connections, or nil if there isn't one since the
+	// VM was paused
+	last *uint64
+}
+
+// update records the latest number of connections, returning whether there are new connections
+// since the previous update.
+//
+// The first update after a reset only sets the baseline, because connections from before the VM
+// was paused don't count. If the number decreased, the runner was restarted, so the connections
+// since then are unknown and it's also only a new baseline.
+func (c *inboundConnectionCounter) update(connections uint64) (arrived bool) {
+	arrived = c.last != nil && connections > *c.last
+	c.last = &connections
+	return arrived
+}
+
+func (c *inboundConnectionCounter) reset() {
+	c.last = nil
+}
+
+// getInboundConnections fetches the number of connections to the VM from its runner, returning nil
+// if the runner doesn't report it.
+func (r *Runner) getInboundConnections(ctx context.Context, timeout time.Duration, runnerPort int32) (*uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d/network_usage", r.podIP, runnerPort)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		panic(fmt.Errorf("Error constructing network usage request to %q: %w", url, err))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error making request to %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error receiving response body: %w", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unsuccessful response status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var usage api.NetworkUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling response body: %w", err)
+	}
+	return usage.InboundConnections, nil
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInboundConnectionCounter(t *testing.T) {
+	var c inboundConnectionCounter
+
+	// The first count after the VM is paused is only the baseline
+	assert.False(t, c.update(5))
+	assert.False(t, c.update(5))
+	assert.True(t, c.update(6))
+	assert.False(t, c.update(6))
+
+	// A runner restart resets the count, which isn't a new connection...
+	assert.False(t, c.update(0))
+	// ... but anything after that is
+	assert.True(t, c.update(1))
+
+	// Once the VM is running again, connections don't count until it's paused again
+	c.reset()
+	assert.False(t, c.update(10))
+	assert.True(t, c.update(11))
+}
+
+func TestGetInboundConnections(t *testing.T) {
+	body := `{"InternalBytes":0,"InternetBytes":0,"Interfaces":null,"InboundConnections":3}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/network_usage" {
+			w.WriteHeader(404)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(portStr, 10, 32)
+	require.NoError(t, err)
+
+	r := &Runner{podIP: host} //nolint:exhaustruct // only the pod IP is used
+	ctx := context.Background()
+
+	connections, err := r.getInboundConnections(ctx, time.Second, int32(port))
+	require.NoError(t, err)
+	require.NotNil(t, connections)
+	assert.Equal(t, uint64(3), *connections)
+
+	// Older runners don't report the connections at all
+	body = `{"InternalBytes":0,"InternetBytes":0,"Interfaces":null}`
+	connections, err = r.getInboundConnections(ctx, time.Second, int32(port))
+	require.NoError(t, err)
+	assert.Nil(t, connections)
+
+	body = `not json`
+	_, err = r.getInboundConnections(ctx, time.Second, int32(port))
+	assert.Error(t, err)
+}
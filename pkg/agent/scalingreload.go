@@ -0,0 +1,161 @@
+package agent
+
+// Periodic re-reading of the config file, so that the settings for scaling VMs can be changed
+// without restarting the autoscaler-agent.
+//
+// Only the settings listed in (*Config).withReloaded are reloaded - changes to anything else still
+// require a restart. The billing config is reloaded separately; see billingreload.go.
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// configStore stores the config currently in effect, notifying runners when it changes
+type configStore struct {
+	mu     sync.Mutex
+	config *Config
+	// generation is incremented each time the config changes, starting from 1
+	generation uint64
+
+	changed *util.Broadcaster
+}
+
+func newConfigStore(config *Config) *configStore {
+	return &configStore{
+		mu:         sync.Mutex{},
+		config:     config,
+		generation: 1,
+		changed:    util.NewBroadcaster(),
+	}
+}
+
+// get returns the config currently in effect and its generation. The returned config must not be
+// modified.
+func (s *configStore) get() (*Config, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config, s.generation
+}
+
+func (s *configStore) set(config *Config) (generation uint64, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reflect.DeepEqual(s.config, config) {
+		return s.generation, false
+	}
+	s.config = config
+	s.generation += 1
+	s.changed.Broadcast()
+	return s.generation, true
+}
+
+// withReloaded returns a copy of the config with the settings that can be reloaded taken from
+// newConfig. Those are:
+//
+//   - .scaling.defaultConfig
+//   - .scaling.emergencyUpscale, .scaling.prediction, .scaling.burst, and .scaling.timeOfDay
+//   - .scaling.nodePressure's retryDeniedDownscaleSeconds, maxUpscaleCU, and priorityDelaySeconds
+//   - the request and retry intervals in .scheduler, .monitor, and .neonvm
+//
+// Enabling or disabling .scaling.nodePressure requires a restart, so returns an error.
+func (c *Config) withReloaded(newConfig *Config) (*Config, error) {
+	if (c.Scaling.NodePressure == nil) != (newConfig.Scaling.NodePressure == nil) {
+		return nil, errors.New("enabling or disabling .scaling.nodePressure requires a restart")
+	}
+
+	reloaded := *c
+
+	reloaded.Scaling.DefaultConfig = newConfig.Scaling.DefaultConfig
+	reloaded.Scaling.EmergencyUpscale = newConfig.Scaling.EmergencyUpscale
+	reloaded.Scaling.Prediction = newConfig.Scaling.Prediction
+	reloaded.Scaling.Burst = newConfig.Scaling.Burst
+	reloaded.Scaling.TimeOfDay = newConfig.Scaling.TimeOfDay
+	if np := newConfig.Scaling.NodePressure; np != nil {
+		// The rest of the node pressure config is used by the node-wide checks, which are only
+		// started once.
+		nodePressure := *c.Scaling.NodePressure
+		nodePressure.RetryDeniedDownscaleSeconds = np.RetryDeniedDownscaleSeconds
+		nodePressure.MaxUpscaleCU = np.MaxUpscaleCU
+		nodePressure.PriorityDelaySeconds = np.PriorityDelaySeconds
+		reloaded.Scaling.NodePressure = &nodePressure
+	}
+
+	reloaded.Scheduler.RequestAtLeastEverySeconds = newConfig.Scheduler.RequestAtLeastEverySeconds
+	reloaded.Scheduler.RetryFailedRequestSeconds = newConfig.Scheduler.RetryFailedRequestSeconds
+	reloaded.Scheduler.RetryDeniedUpscaleSeconds = newConfig.Scheduler.RetryDeniedUpscaleSeconds
+	reloaded.Monitor.RetryFailedRequestSeconds = newConfig.Monitor.RetryFailedRequestSeconds
+	reloaded.Monitor.RetryDeniedDownscaleSeconds = newConfig.Monitor.RetryDeniedDownscaleSeconds
+	reloaded.Monitor.RequestedUpscaleValidSeconds = newConfig.Monitor.RequestedUpscaleValidSeconds
+	reloaded.NeonVM.RetryFailedRequestSeconds = newConfig.NeonVM.RetryFailedRequestSeconds
+
+	return &reloaded, nil
+}
+
+// watch re-reads the config file at path every reloadEvery until the context is canceled, updating
+// the config in effect whenever any of the reloadable settings change.
+//
+// Configs that are invalid - including custom scaling policies failing the guard rail checks with
+// the new default config - are logged and otherwise ignored.
+func (s *configStore) watch(ctx context.Context, logger *zap.Logger, path string, reloadEvery time.Duration, gauge prometheus.Gauge) {
+	_, generation := s.get()
+	gauge.Set(float64(generation))
+
+	if reloadEvery == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(reloadEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		newConfig, err := ReadConfig(path)
+		if err != nil {
+			logger.Error("Failed to reload config, keeping current config", zap.Error(err))
+			continue
+		}
+
+		current, _ := s.get()
+		// Check the config that would actually be in effect, which only takes the reloadable
+		// settings from the new file.
+		effective, err := current.withReloaded(newConfig)
+		if err == nil {
+			err = effective.validate()
+		}
+		if err == nil {
+			err = effective.Scaling.checkPolicy()
+		}
+		if err != nil {
+			logger.Error("Reloaded config failed checks, keeping current config", zap.Error(err))
+			continue
+		}
+
+		if generation, changed := s.set(effective); changed {
+			logger.Info(
+				"Config changed",
+				zap.Uint64("generation", generation),
+				zap.Any("scaling", effective.Scaling),
+				zap.Any("scheduler", effective.Scheduler),
+				zap.Any("monitor", effective.Monitor),
+				zap.Any("neonvm", effective.NeonVM),
+			)
+			gauge.Set(float64(generation))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func testReloadConfig() *Config {
+	//nolint:exhaustruct // only the fields that withReloaded looks at
+	return &Config{
+		Scaling: ScalingConfig{
+			ComputeUnit: api.Resources{VCPU: 250, Mem: 1 << 30},
+			DefaultConfig: api.ScalingConfig{
+				LoadAverageFractionTarget: 0.9,
+				MemoryUsageFractionTarget: 0.75,
+			},
+			Policy: "default",
+			NodePressure: &NodePressureConfig{
+				MemoryPressureThreshold:     10,
+				CheckEverySeconds:           5,
+				RetryDeniedDownscaleSeconds: 10,
+				MaxUpscaleCU:                1,
+				PriorityDelaySeconds:        0,
+			},
+			ReloadEverySeconds: 30,
+		},
+		Scheduler: SchedulerConfig{
+			RequestTimeoutSeconds:      2,
+			RequestAtLeastEverySeconds: 5,
+			RetryFailedRequestSeconds:  3,
+			RetryDeniedUpscaleSeconds:  2,
+		},
+		Monitor: MonitorConfig{
+			ResponseTimeoutSeconds:       5,
+			RetryFailedRequestSeconds:    3,
+			RetryDeniedDownscaleSeconds:  5,
+			RequestedUpscaleValidSeconds: 10,
+		},
+		NeonVM: NeonVMConfig{
+			RequestTimeoutSeconds:     10,
+			RetryFailedRequestSeconds: 5,
+		},
+	}
+}
+
+func TestConfigWithReloaded(t *testing.T) {
+	current := testReloadConfig()
+
+	newConfig := testReloadConfig()
+	newConfig.Scaling.DefaultConfig.LoadAverageFractionTarget = 0.5
+	newConfig.Scaling.Burst = &BurstConfig{
+		LoadPerCPUThreshold:          2,
+		ActiveBackendsPerCUThreshold: 0,
+		MinIntervalSeconds:           60,
+		ValidSeconds:                 30,
+	}
+	newConfig.Scaling.NodePressure.MaxUpscaleCU = 0
+	newConfig.Scaling.NodePressure.CheckEverySeconds = 1
+	newConfig.Scheduler.RequestAtLeastEverySeconds = 10
+	newConfig.Monitor.RetryDeniedDownscaleSeconds = 20
+	newConfig.NeonVM.RetryFailedRequestSeconds = 1
+	// not reloadable:
+	newConfig.Scaling.ComputeUnit = api.Resources{VCPU: 1000, Mem: 4 << 30}
+	newConfig.Scaling.Policy = "other"
+	newConfig.Scheduler.RequestTimeoutSeconds = 20
+	newConfig.Monitor.ResponseTimeoutSeconds = 50
+
+	reloaded, err := current.withReloaded(newConfig)
+	require.NoError(t, err)
+
+	expected := testReloadConfig()
+	expected.Scaling.DefaultConfig.LoadAverageFractionTarget = 0.5
+	expected.Scaling.Burst = newConfig.Scaling.Burst
+	expected.Scaling.NodePressure.MaxUpscaleCU = 0
+	expected.Scheduler.RequestAtLeastEverySeconds = 10
+	expected.Monitor.RetryDeniedDownscaleSeconds = 20
+	expected.NeonVM.RetryFailedRequestSeconds = 1
+	assert.Equal(t, expected, reloaded)
+
+	// The current config is unchanged
+	assert.Equal(t, testReloadConfig(), current)
+}
+
+func TestConfigWithReloadedNodePressure(t *testing.T) {
+	enabled := testReloadConfig()
+	disabled := testReloadConfig()
+	disabled.Scaling.NodePressure = nil
+
+	_, err := enabled.withReloaded(disabled)
+	assert.Error(t, err)
+	_, err = disabled.withReloaded(enabled)
+	assert.Error(t, err)
+
+	reloaded, err := disabled.withReloaded(disabled)
+	require.NoError(t, err)
+	assert.Nil(t, reloaded.Scaling.NodePressure)
+}
+
+func TestConfigStoreGeneration(t *testing.T) {
+	store := newConfigStore(testReloadConfig())
+	changed := store.changed.NewReceiver()
+
+	_, generation := store.get()
+	assert.Equal(t, uint64(1), generation)
+
+	// Setting an equal config doesn't count as a change
+	generation, ok := store.set(testReloadConfig())
+	assert.False(t, ok)
+	assert.Equal(t, uint64(1), generation)
+	select {
+	case <-changed.Wait():
+		t.Fatal("unexpected notification for unchanged config")
+	default:
+	}
+
+	newConfig := testReloadConfig()
+	newConfig.Monitor.RetryFailedRequestSeconds = 1
+	generation, ok = store.set(newConfig)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), generation)
+	select {
+	case <-changed.Wait():
+	default:
+		t.Fatal("expected notification for changed config")
+	}
+
+	current, generation := store.get()
+	assert.Equal(t, newConfig, current)
+	assert.Equal(t, uint64(2), generation)
+}
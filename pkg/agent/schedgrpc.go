@@ -0,0 +1,215 @@
+package agent
+
+// Requests to the scheduler plugin over gRPC, if enabled with the scheduler's "transport" config.
+//
+// All runners share a single connection to the scheduler, which is replaced when the scheduler
+// changes. Before a connection is used, the protocol version is negotiated with the scheduler, so
+// that a mismatch is reported once, clearly, instead of on every request.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// SchedulerTransport is the method by which the autoscaler-agent sends requests to the scheduler
+// plugin
+type SchedulerTransport string
+
+const (
+	SchedulerTransportHTTP SchedulerTransport = "http"
+	SchedulerTransportGRPC SchedulerTransport = "grpc"
+)
+
+type SchedulerGRPCConfig struct {
+	// Port is the port that the scheduler serves gRPC requests on
+	Port uint16 `json:"port"`
+	// KeepaliveSeconds gives the interval at which idle connections to the scheduler are pinged.
+	// It must be at least the scheduler's own keepalive interval, or the scheduler will close the
+	// connection.
+	KeepaliveSeconds uint `json:"keepaliveSeconds"`
+}
+
+// schedulerGRPCConn is the shared connection to the current scheduler
+type schedulerGRPCConn struct {
+	config *SchedulerGRPCConfig
+	// timeout is the limit on negotiating the protocol version with a new scheduler
+	timeout     time.Duration
+	dialOptions []grpc.DialOption
+
+	mu sync.Mutex
+	// ip is the IP address of the scheduler that conn is connected to, or "" if there's no
+	// connection
+	ip     string
+	conn   *grpc.ClientConn
+	client api.PluginClient
+	// connecting is the latest attempt to connect to a scheduler, while it's in progress
+	connecting *grpcConnectAttempt
+}
+
+// grpcConnectAttempt is an attempt to connect to a scheduler, shared by all of the callers that need
+// it. The result is available once done is closed.
+type grpcConnectAttempt struct {
+	ip   string
+	done chan struct{}
+
+	client api.PluginClient
+	err    error
+}
+
+// newSchedulerGRPCConn creates a new schedulerGRPCConn, with any extra options to use when
+// connecting to the scheduler
+func newSchedulerGRPCConn(config *SchedulerGRPCConfig, timeout time.Duration, opts ...grpc.DialOption) *schedulerGRPCConn {
+	return &schedulerGRPCConn{
+		config:      config,
+		timeout:     timeout,
+		dialOptions: opts,
+		mu:          sync.Mutex{},
+		ip:          "",
+		conn:        nil,
+		client:      api.PluginClient{},
+		connecting:  nil,
+	}
+}
+
+// get returns the client for the scheduler at the IP address, connecting to it and negotiating the
+// protocol version if there isn't already a connection
+//
+// Connecting happens without holding the lock, so that requests to the current scheduler aren't
+// blocked by it. Concurrent calls for the same scheduler share a single attempt.
+func (c *schedulerGRPCConn) get(ctx context.Context, ip string) (api.PluginClient, error) {
+	c.mu.Lock()
+	if c.conn != nil && c.ip == ip {
+		client := c.client
+		c.mu.Unlock()
+		return client, nil
+	}
+
+	attempt := c.connecting
+	if attempt == nil || attempt.ip != ip {
+		attempt = &grpcConnectAttempt{
+			ip:     ip,
+			done:   make(chan struct{}),
+			client: api.PluginClient{},
+			err:    nil,
+		}
+		c.connecting = attempt
+		go c.connect(attempt)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.client, attempt.err
+	case <-ctx.Done():
+		return api.PluginClient{}, ctx.Err()
+	}
+}
+
+// connect runs the attempt, replacing the current connection if it succeeds and the scheduler
+// hasn't changed again in the meantime
+func (c *schedulerGRPCConn) connect(attempt *grpcConnectAttempt) {
+	defer close(attempt.done)
+
+	conn, client, err := c.dial(attempt.ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	latest := c.connecting == attempt
+	if latest {
+		c.connecting = nil
+	}
+
+	if err != nil {
+		attempt.err = err
+		return
+	} else if !latest {
+		// A newer attempt was started for a different scheduler.
+		_ = conn.Close()
+		attempt.err = fmt.Errorf("Scheduler changed while connecting to %s", attempt.ip)
+		return
+	}
+
+	// The scheduler has changed; the old connection won't be used again.
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.ip = attempt.ip
+	c.conn = conn
+	c.client = client
+	attempt.client = client
+}
+
+// dial connects to the scheduler at the IP address, and checks that it supports our protocol
+// version
+func (c *schedulerGRPCConn) dial(ip string) (*grpc.ClientConn, api.PluginClient, error) {
+	addr := fmt.Sprintf("%s:%d", ip, c.config.Port)
+	opts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(c.config.KeepaliveSeconds) * time.Second,
+			Timeout:             time.Duration(c.config.KeepaliveSeconds) * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}, c.dialOptions...)
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, api.PluginClient{}, fmt.Errorf("Error connecting to %s: %w", addr, err)
+	}
+	client := api.NewPluginClient(conn)
+
+	// The negotiation is shared by everyone waiting for the connection, so it isn't tied to any of
+	// their contexts.
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	supported := api.VersionRange[api.PluginProtoVersion]{Min: PluginProtocolVersion, Max: PluginProtocolVersion}
+	version, err := client.Negotiate(ctx, supported)
+	if err != nil {
+		_ = conn.Close()
+		return nil, api.PluginClient{}, fmt.Errorf("Error negotiating protocol version: %w", err)
+	} else if version != PluginProtocolVersion {
+		_ = conn.Close()
+		return nil, api.PluginClient{}, fmt.Errorf(
+			"Scheduler negotiated protocol version %v, but we only support %v", version, PluginProtocolVersion,
+		)
+	}
+
+	return conn, client, nil
+}
+
+// doSchedulerRequestGRPC sends the request to the scheduler over gRPC, returning the response if it
+// was successful
+func (r *Runner) doSchedulerRequestGRPC(
+	ctx context.Context,
+	schedulerIP string,
+	reqData *api.AgentRequest,
+) (*api.PluginResponse, error) {
+	client, err := r.global.schedulerGRPC.get(ctx, schedulerIP)
+	if err != nil {
+		description := fmt.Sprintf("[error doing request: %s]", util.RootError(err))
+		r.global.metrics.schedulerRequests.WithLabelValues(description).Inc()
+		return nil, err
+	}
+
+	resp, err := client.Request(ctx, reqData)
+	if err != nil {
+		// Record the gRPC status code in place of the HTTP status, e.g. "grpc:InvalidArgument"
+		r.global.metrics.schedulerRequests.WithLabelValues("grpc:" + status.Code(err).String()).Inc()
+		return nil, fmt.Errorf("Error doing request: %w", err)
+	}
+
+	r.global.metrics.schedulerRequests.WithLabelValues(strconv.Itoa(200)).Inc()
+	return resp, nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// fakeSchedulerGRPC serves the plugin's gRPC service, blocking negotiation until unblock is closed
+type fakeSchedulerGRPC struct {
+	version      api.PluginProtoVersion
+	negotiations atomic.Int32
+	unblock      chan struct{}
+}
+
+func (s *fakeSchedulerGRPC) Negotiate(ctx context.Context, _ api.VersionRange[api.PluginProtoVersion]) (api.PluginProtoVersion, error) {
+	s.negotiations.Add(1)
+	select {
+	case <-s.unblock:
+		return s.version, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *fakeSchedulerGRPC) Request(_ context.Context, req *api.AgentRequest) (*api.PluginResponse, error) {
+	return &api.PluginResponse{Permit: req.Resources, Migrate: nil, DeniedReason: ""}, nil
+}
+
+// newTestSchedulerGRPCConn returns a schedulerGRPCConn that connects to the fake scheduler for every
+// IP address
+func newTestSchedulerGRPCConn(t *testing.T, scheduler *fakeSchedulerGRPC) *schedulerGRPCConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	api.RegisterPluginServer(server, scheduler)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	config := &SchedulerGRPCConfig{Port: 10299, KeepaliveSeconds: 10}
+	return newSchedulerGRPCConn(config, 5*time.Second, grpc.WithContextDialer(
+		func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		},
+	))
+}
+
+func TestSchedulerGRPCConnShared(t *testing.T) {
+	scheduler := &fakeSchedulerGRPC{version: PluginProtocolVersion, negotiations: atomic.Int32{}, unblock: make(chan struct{})}
+	conn := newTestSchedulerGRPCConn(t, scheduler)
+	ctx := context.Background()
+
+	// Concurrent requests for the same scheduler share the connection, and negotiate once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := conn.get(ctx, "10.0.0.1")
+			if assert.NoError(t, err) {
+				req := new(api.AgentRequest)
+				req.Resources = api.Resources{VCPU: 1000, Mem: 1 << 30}
+				resp, err := client.Request(ctx, req)
+				assert.NoError(t, err)
+				assert.Equal(t, req.Resources, resp.Permit)
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return scheduler.negotiations.Load() == 1 }, time.Second, time.Millisecond)
+	close(scheduler.unblock)
+	wg.Wait()
+	assert.Equal(t, int32(1), scheduler.negotiations.Load())
+
+	_, err := conn.get(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), scheduler.negotiations.Load())
+}
+
+func TestSchedulerGRPCConnNegotiateUnlocked(t *testing.T) {
+	scheduler := &fakeSchedulerGRPC{version: PluginProtocolVersion, negotiations: atomic.Int32{}, unblock: make(chan struct{})}
+	conn := newTestSchedulerGRPCConn(t, scheduler)
+	ctx := context.Background()
+
+	close(scheduler.unblock)
+	_, err := conn.get(ctx, "10.0.0.1")
+	require.NoError(t, err)
+
+	// While negotiating with a new scheduler, the current connection is still available, and
+	// callers stop waiting once their context is done.
+	scheduler.unblock = make(chan struct{})
+	shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = conn.get(shortCtx, "10.0.0.2")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = conn.get(ctx, "10.0.0.1")
+	assert.NoError(t, err)
+
+	// ... and the negotiation continues in the background, for the next caller to use.
+	close(scheduler.unblock)
+	_, err = conn.get(ctx, "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), scheduler.negotiations.Load())
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	assert.Equal(t, "10.0.0.2", conn.ip)
+}
+
+func TestSchedulerGRPCConnVersionMismatch(t *testing.T) {
+	scheduler := &fakeSchedulerGRPC{version: PluginProtocolVersion - 1, negotiations: atomic.Int32{}, unblock: make(chan struct{})}
+	close(scheduler.unblock)
+	conn := newTestSchedulerGRPCConn(t, scheduler)
+
+	_, err := conn.get(context.Background(), "10.0.0.1")
+	assert.ErrorContains(t, err, "Scheduler negotiated protocol version")
+
+	// Failed attempts aren't reused
+	_, err = conn.get(context.Background(), "10.0.0.1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), scheduler.negotiations.Load())
+}
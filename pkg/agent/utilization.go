@@ -0,0 +1,43 @@
+package agent
+
+// Tracking of the resources used by each VM, from the metrics that the Runner fetches, so that
+// billing can emit usage-based metrics alongside allocation-based ones. See billing/utilization.go.
+
+import (
+	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+var _ billing.UtilizationSource = (*agentState)(nil)
+
+// recordUtilization updates the VM's utilization from its latest metrics
+func (s *lockedPodStatus) recordUtilization(metrics core.Metrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.utilization = &billing.VMUtilization{
+		CPU: float64(metrics.LoadAverage1Min),
+		Mem: api.Bytes(metrics.MemoryUsageBytes),
+	}
+}
+
+// LatestUtilization implements billing.UtilizationSource
+func (s *agentState) LatestUtilization() map[util.NamespacedName]billing.VMUtilization {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	utilization := make(map[util.NamespacedName]billing.VMUtilization)
+	for _, pod := range s.pods {
+		func() {
+			pod.status.mu.Lock()
+			defer pod.status.mu.Unlock()
+
+			if pod.status.utilization != nil {
+				utilization[pod.status.vmInfo.NamespacedName()] = *pod.status.utilization
+			}
+		}()
+	}
+	return utilization
+}
@@ -0,0 +1,265 @@
+package agent
+
+// API serving a summary of the state of every VM on the node, for use by the console backend
+//
+// Unlike the dump-state server, which exposes the full internal state for debugging, this API
+// serves a stable, paginated listing that's cheap enough to be polled.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// VMStateList is the response to a request for the state of the VMs on the node
+type VMStateList struct {
+	VMs []VMStateSummary `json:"vms"`
+	// Continue, if not empty, gives the value of the 'continue' parameter to fetch the next page
+	Continue string `json:"continue,omitempty"`
+}
+
+// VMStateSummary is the state of a single VM, as served by the state API
+type VMStateSummary struct {
+	VM         util.NamespacedName `json:"vm"`
+	Pod        util.NamespacedName `json:"pod"`
+	EndpointID string              `json:"endpointID"`
+
+	CurrentCU float64 `json:"currentCU"`
+	// GoalCU gives the number of compute units that the VM is being scaled towards, or nil if it
+	// isn't known yet
+	GoalCU         *float64 `json:"goalCU"`
+	MinCU          float64  `json:"minCU"`
+	MaxCU          float64  `json:"maxCU"`
+	ManualTargetCU *uint16  `json:"manualTargetCU,omitempty"`
+
+	Health          runnerMetricState `json:"health"`
+	HealthUpdatedAt time.Time         `json:"healthUpdatedAt"`
+
+	LastUpscaleAt   *time.Time `json:"lastUpscaleAt"`
+	LastDownscaleAt *time.Time `json:"lastDownscaleAt"`
+}
+
+// vmStateQuery is the parsed query of a request to the state API
+type vmStateQuery struct {
+	limit    uint
+	after    *util.NamespacedName
+	selector labels.Selector
+}
+
+func (s *agentState) StartStateAPIServer(ctx context.Context, logger *zap.Logger, config *StateAPIConfig) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	server := &http.Server{Handler: s.stateAPIHandler(logger, config)}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("State API server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *agentState) stateAPIHandler(logger *zap.Logger, config *StateAPIConfig) http.Handler {
+	respond := func(w http.ResponseWriter, code int, resp any) {
+		body, err := json.Marshal(resp)
+		if err != nil {
+			logger.Panic("Failed to encode state API response JSON", zap.Error(err))
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write(body)
+	}
+	respondErr := func(w http.ResponseWriter, code int, err error) {
+		respond(w, code, struct {
+			Error string `json:"error"`
+		}{Error: err.Error()})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state/vms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondErr(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		if code, err := util.CheckBearerToken(r, config.BearerTokenFile); err != nil {
+			if code == http.StatusInternalServerError {
+				logger.Error("Failed to check state API request authorization", zap.Error(err))
+			}
+			respondErr(w, code, err)
+			return
+		}
+
+		query, err := parseVMStateQuery(r, config.MaxPageSize)
+		if err != nil {
+			respondErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		list, err := s.listVMStates(r.Context(), query)
+		if err != nil {
+			respondErr(w, http.StatusInternalServerError, fmt.Errorf("error while getting state: %w", err))
+			return
+		}
+
+		respond(w, http.StatusOK, list)
+	})
+
+	return mux
+}
+
+func parseVMStateQuery(r *http.Request, maxPageSize uint) (*vmStateQuery, error) {
+	params := r.URL.Query()
+
+	query := vmStateQuery{
+		limit:    maxPageSize,
+		after:    nil,
+		selector: labels.Everything(),
+	}
+
+	if l := params.Get("limit"); l != "" {
+		limit, err := strconv.ParseUint(l, 10, 0)
+		if err != nil || limit == 0 {
+			return nil, fmt.Errorf("invalid limit %q, must be a positive integer", l)
+		}
+		query.limit = util.Min(uint(limit), maxPageSize)
+	}
+
+	if c := params.Get("continue"); c != "" {
+		namespace, name, ok := strings.Cut(c, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid continue %q", c)
+		}
+		query.after = &util.NamespacedName{Namespace: namespace, Name: name}
+	}
+
+	if sel := params.Get("labelSelector"); sel != "" {
+		selector, err := labels.Parse(sel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labelSelector: %w", err)
+		}
+		query.selector = selector
+	}
+
+	return &query, nil
+}
+
+func compareNamespacedName(a, b util.NamespacedName) int {
+	if a.Namespace != b.Namespace {
+		return strings.Compare(a.Namespace, b.Namespace)
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+// listVMStates returns the page of VMs matching the query, ordered by namespace and name
+func (s *agentState) listVMStates(ctx context.Context, query *vmStateQuery) (*VMStateList, error) {
+	type entry struct {
+		vm     util.NamespacedName
+		pod    *podState
+		runner *Runner
+		status podStatus
+	}
+
+	entries, err := func() ([]entry, error) {
+		if err := s.lock.TryLock(ctx); err != nil {
+			return nil, err
+		}
+		defer s.lock.Unlock()
+
+		var entries []entry
+		for _, pod := range s.pods {
+			pod.status.mu.Lock()
+			status := pod.status.podStatus
+			pod.status.mu.Unlock()
+
+			if status.deleted || !query.selector.Matches(labels.Set(status.labels)) {
+				continue
+			}
+			entries = append(entries, entry{
+				vm:     status.vmInfo.NamespacedName(),
+				pod:    pod,
+				runner: pod.runner,
+				status: status,
+			})
+		}
+		return entries, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(entries, func(a, b entry) (less bool) {
+		return compareNamespacedName(a.vm, b.vm) < 0
+	})
+
+	if query.after != nil {
+		start, _ := slices.BinarySearchFunc(entries, *query.after, func(e entry, after util.NamespacedName) int {
+			// Treat an equal name as less, so that we start strictly after it
+			if c := compareNamespacedName(e.vm, after); c != 0 {
+				return c
+			}
+			return -1
+		})
+		entries = entries[start:]
+	}
+
+	list := VMStateList{
+		VMs:      []VMStateSummary{},
+		Continue: "",
+	}
+	if uint(len(entries)) > query.limit {
+		entries = entries[:query.limit]
+		last := entries[len(entries)-1].vm
+		list.Continue = fmt.Sprintf("%s/%s", last.Namespace, last.Name)
+	}
+
+	computeUnit := s.config.Scaling.ComputeUnit
+	for _, e := range entries {
+		var goalCU *float64
+		// Errors here are only from the context expiring while waiting for the Runner's lock. We'd
+		// rather still return what we have, so just leave the goal unknown.
+		if goal, _ := e.runner.goal(ctx); goal != nil {
+			cu := goal.ComputeUnits(computeUnit)
+			goalCU = &cu
+		}
+
+		list.VMs = append(list.VMs, VMStateSummary{
+			VM:              e.vm,
+			Pod:             e.pod.podName,
+			EndpointID:      e.status.endpointID,
+			CurrentCU:       e.status.vmInfo.Using().ComputeUnits(computeUnit),
+			GoalCU:          goalCU,
+			MinCU:           e.status.vmInfo.Min().ComputeUnits(computeUnit),
+			MaxCU:           e.status.vmInfo.Max().ComputeUnits(computeUnit),
+			ManualTargetCU:  e.status.vmInfo.Config.ManualTargetCU,
+			Health:          e.status.state,
+			HealthUpdatedAt: e.status.stateUpdatedAt,
+			LastUpscaleAt:   e.status.lastUpscaleAt,
+			LastDownscaleAt: e.status.lastDownscaleAt,
+		})
+	}
+
+	return &list, nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestParseVMStateQuery(t *testing.T) {
+	parse := func(rawQuery string) (*vmStateQuery, error) {
+		return parseVMStateQuery(httptest.NewRequest(http.MethodGet, "/state/vms?"+rawQuery, nil), 100)
+	}
+
+	query, err := parse("")
+	require.NoError(t, err)
+	assert.Equal(t, uint(100), query.limit)
+	assert.Nil(t, query.after)
+	assert.True(t, query.selector.Empty())
+
+	query, err = parse("limit=10&continue=ns/vm-1&labelSelector=app%3Dcompute")
+	require.NoError(t, err)
+	assert.Equal(t, uint(10), query.limit)
+	assert.Equal(t, &util.NamespacedName{Namespace: "ns", Name: "vm-1"}, query.after)
+	assert.Equal(t, "app=compute", query.selector.String())
+
+	// The limit is capped at the maximum page size
+	query, err = parse("limit=1000")
+	require.NoError(t, err)
+	assert.Equal(t, uint(100), query.limit)
+
+	for _, invalid := range []string{"limit=0", "limit=-1", "limit=x", "continue=no-slash", "labelSelector=a%3D%3D%3Db"} {
+		_, err := parse(invalid)
+		assert.Error(t, err, "query %q", invalid)
+	}
+}
+
+func TestStateAPIAuthorization(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0o600))
+
+	s := &agentState{ //nolint:exhaustruct // only the fields used by the state API
+		lock:   util.NewChanMutex(),
+		pods:   make(map[util.NamespacedName]*podState),
+		config: &Config{}, //nolint:exhaustruct // only the compute unit is used
+	}
+	handler := s.stateAPIHandler(zap.NewNop(), &StateAPIConfig{Port: 0, BearerTokenFile: tokenFile, MaxPageSize: 10})
+
+	get := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/state/vms", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer wrong").Code)
+
+	rec := get("Bearer secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list VMStateList
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Empty(t, list.VMs)
+	assert.Empty(t, list.Continue)
+
+	// Once the token is rotated, the old one isn't accepted
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated"), 0o600))
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer secret").Code)
+	assert.Equal(t, http.StatusOK, get("Bearer rotated").Code)
+}
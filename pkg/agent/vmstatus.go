@@ -0,0 +1,110 @@
+package agent
+
+// Writing each VM's autoscaling status to an annotation
+//
+// The status summarizes the VM's goal, what the scheduler has granted, and what (if anything) is
+// stopping it from reaching its goal, so that users can check why a VM isn't scaling with
+// 'kubectl get' instead of reading the autoscaler-agent's logs.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	ktypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// statusAnnotationLoop periodically updates the VM's status annotation from the most recent
+// explanation of the executor's actions, patching the VM only when the status has changed.
+func (r *Runner) statusAnnotationLoop(
+	ctx context.Context,
+	logger *zap.Logger,
+	executorCore *executor.ExecutorCore,
+	getVmInfo func() api.VmInfo,
+) {
+	config := r.global.config.StatusAnnotation
+
+	ticker := time.NewTicker(time.Second * time.Duration(config.UpdateEverySeconds))
+	defer ticker.Stop()
+
+	var lastStatus string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		explanation := executorCore.Explanation()
+		if explanation == nil {
+			continue
+		}
+
+		status, err := r.updateStatusAnnotation(ctx, explanation, getVmInfo(), lastStatus)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Failed to update VM status annotation", zap.Error(err))
+			continue
+		}
+		lastStatus = status
+	}
+}
+
+// updateStatusAnnotation sets the VM's status annotation from the explanation, unless it's the
+// same as lastStatus, returning the status that the VM now has
+func (r *Runner) updateStatusAnnotation(
+	ctx context.Context,
+	explanation *core.Explanation,
+	vmInfo api.VmInfo,
+	lastStatus string,
+) (string, error) {
+	computeUnit := r.global.config.Scaling.ComputeUnit
+	status := api.AutoscalingStatus{
+		GoalCU:    explanation.GoalCU,
+		GrantedCU: explanation.Granted.ComputeUnits(computeUnit),
+		CurrentCU: vmInfo.Using().ComputeUnits(computeUnit),
+		Limit:     string(explanation.Limit),
+		Reason:    explanation.Reason,
+	}
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling autoscaling status: %w", err))
+	}
+	if string(statusJSON) == lastStatus {
+		return lastStatus, nil
+	}
+
+	if err := r.patchStatusAnnotation(ctx, string(statusJSON)); err != nil {
+		return lastStatus, err
+	}
+	return string(statusJSON), nil
+}
+
+func (r *Runner) patchStatusAnnotation(ctx context.Context, status string) error {
+	// Use a merge patch so that it works whether or not the VM already has any annotations
+	patchPayload, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				api.AnnotationAutoscalingStatus: status,
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling merge patch: %w", err))
+	}
+
+	if err := r.patchVM(ctx, vmPatchStatus, ktypes.MergePatchType, patchPayload); err != nil {
+		return fmt.Errorf("Error patching VM status annotation: %w", err)
+	}
+	return nil
+}
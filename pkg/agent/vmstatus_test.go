@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestUpdateStatusAnnotation(t *testing.T) {
+	failure := errors.New("injected failure")
+	// The first two patches succeed, and the third fails
+	queue, server := newTestPatchQueue(10, nil, nil, failure)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue.start(ctx, zap.NewNop())
+
+	r := &Runner{ //nolint:exhaustruct // only the fields for patching the VM are used
+		global: &agentState{ //nolint:exhaustruct // only the fields for patching the VM are used
+			config: &Config{ //nolint:exhaustruct // only the compute unit is used
+				Scaling: ScalingConfig{ //nolint:exhaustruct // only the compute unit is used
+					ComputeUnit: api.Resources{VCPU: 250, Mem: 1 << 30},
+				},
+			},
+			patchQueue: queue,
+		},
+		vmName: util.NamespacedName{Namespace: "default", Name: "vm"},
+	}
+
+	//nolint:exhaustruct // only the resources in use matter
+	vmInfo := api.VmInfo{
+		Cpu: api.VmCpuInfo{Use: 500},
+		Mem: api.VmMemInfo{Use: 2, SlotSize: 1 << 30},
+	}
+	//nolint:exhaustruct // the metrics aren't part of the status
+	explanation := &core.Explanation{
+		Desired: api.Resources{VCPU: 1000, Mem: 4 << 30},
+		Reason:  "cpu usage",
+		GoalCU:  4,
+		Granted: api.Resources{VCPU: 750, Mem: 3 << 30},
+		Limit:   core.LimitScheduler,
+	}
+
+	// statusOf returns the status annotation set by the patch
+	statusOf := func(payload string) api.AutoscalingStatus {
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(payload), &patch))
+		var status api.AutoscalingStatus
+		require.NoError(t, json.Unmarshal([]byte(patch.Metadata.Annotations[api.AnnotationAutoscalingStatus]), &status))
+		return status
+	}
+
+	// The first update sets the annotation
+	status, err := r.updateStatusAnnotation(ctx, explanation, vmInfo, "")
+	require.NoError(t, err)
+	require.Len(t, server.received(), 1)
+	assert.Equal(t, api.AutoscalingStatus{
+		GoalCU:    4,
+		GrantedCU: 3,
+		CurrentCU: 2,
+		Limit:     "scheduler",
+		Reason:    "cpu usage",
+	}, statusOf(server.received()[0]))
+
+	// ... and the VM isn't patched again while the status stays the same
+	unchanged, err := r.updateStatusAnnotation(ctx, explanation, vmInfo, status)
+	require.NoError(t, err)
+	assert.Equal(t, status, unchanged)
+	assert.Len(t, server.received(), 1)
+
+	// Once the status changes, it's patched again
+	explanation.Granted = api.Resources{VCPU: 1000, Mem: 4 << 30}
+	explanation.Limit = ""
+	changed, err := r.updateStatusAnnotation(ctx, explanation, vmInfo, status)
+	require.NoError(t, err)
+	assert.NotEqual(t, status, changed)
+	require.Len(t, server.received(), 2)
+	assert.Equal(t, api.AutoscalingStatus{
+		GoalCU:    4,
+		GrantedCU: 4,
+		CurrentCU: 2,
+		Limit:     "",
+		Reason:    "cpu usage",
+	}, statusOf(server.received()[1]))
+
+	// If the patch fails, the last status that was set is kept, so the next update tries again
+	vmInfo.Cpu.Use = 1000
+	failed, err := r.updateStatusAnnotation(ctx, explanation, vmInfo, changed)
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, changed, failed)
+	retried, err := r.updateStatusAnnotation(ctx, explanation, vmInfo, failed)
+	require.NoError(t, err)
+	assert.NotEqual(t, changed, retried)
+	received := server.received()
+	require.Len(t, received, 4)
+	assert.Equal(t, received[2], received[3])
+	assert.Equal(t, 4.0, statusOf(received[3]).CurrentCU)
+}
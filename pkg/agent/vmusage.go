@@ -0,0 +1,85 @@
+package agent
+
+// Per-VM gauges for how each VM is being autoscaled, from its Runner's point of view, so that
+// dashboards can show autoscaling behavior without scraping the VMs directly.
+//
+// The gauges are served with the other per-VM metrics. They're set while holding the pod status'
+// lock, so that a VM's gauges can't be set again after they were removed for its deletion.
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/maps"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// vmUsageLabels returns the labels for the VM's gauges
+func (s podStatus) vmUsageLabels() prometheus.Labels {
+	return makePerVMMetricsLabels(s.vmInfo.Namespace, s.vmInfo.Name, s.endpointID, s.labels[projectLabel], "")
+}
+
+// updateVMUsageMetrics updates the gauges that come from the VM's status, replacing the old ones if
+// the VM's labels changed, or removing them all if it was deleted.
+//
+// This method expects the status' lock to be held.
+func (m *PerVMMetrics) updateVMUsageMetrics(computeUnit api.Resources, old, new podStatus) {
+	oldLabels := old.vmUsageLabels()
+	newLabels := new.vmUsageLabels()
+	if new.deleted || !maps.Equal(oldLabels, newLabels) {
+		for _, g := range []*prometheus.GaugeVec{m.currentCU, m.goalCU, m.loadAverage, m.memoryUsage, m.lastScaling, m.cpuSteal, m.cpuThrottle} {
+			g.DeletePartialMatch(oldLabels)
+		}
+	}
+	if new.deleted {
+		return
+	}
+
+	m.currentCU.With(newLabels).Set(new.vmInfo.Using().ComputeUnits(computeUnit))
+	for direction, at := range map[string]*time.Time{
+		directionValueInc: new.lastUpscaleAt,
+		directionValueDec: new.lastDownscaleAt,
+	} {
+		if at != nil {
+			labels := maps.Clone(newLabels)
+			labels[directionLabel] = direction
+			m.lastScaling.With(labels).Set(float64(at.Unix()))
+		}
+	}
+}
+
+// setVMUsageMetrics sets the gauges for the VM's most recent metrics and the resources that it's
+// being scaled towards
+func (s *lockedPodStatus) setVMUsageMetrics(global *agentState, metrics core.Metrics, goal *api.Resources) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleted {
+		return
+	}
+
+	labels := s.vmUsageLabels()
+	global.vmMetrics.loadAverage.With(labels).Set(float64(metrics.LoadAverage1Min))
+	global.vmMetrics.memoryUsage.With(labels).Set(float64(metrics.MemoryUsageBytes))
+	if goal != nil {
+		global.vmMetrics.goalCU.With(labels).Set(goal.ComputeUnits(global.config.Scaling.ComputeUnit))
+	}
+
+	// Contention isn't always available, so remove the gauges instead of leaving stale values.
+	var steal, throttled *float32
+	if c := metrics.HostContention; c != nil {
+		steal, throttled = c.StealFraction, c.ThrottledFraction
+	}
+	for g, v := range map[*prometheus.GaugeVec]*float32{
+		global.vmMetrics.cpuSteal:    steal,
+		global.vmMetrics.cpuThrottle: throttled,
+	} {
+		if v != nil {
+			g.With(labels).Set(float64(*v))
+		} else {
+			g.Delete(labels)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/maps"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestVMUsageMetrics(t *testing.T) {
+	metrics, _ := makePerVMMetrics()
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+
+	conf := new(Config)
+	conf.Scaling.ComputeUnit = computeUnit
+	global := &agentState{config: conf, vmMetrics: metrics} //nolint:exhaustruct // only the metrics are used
+
+	status := func(endpointID string, cpu uint16, upscaleAt *time.Time) podStatus {
+		var s podStatus
+		s.vmInfo.Namespace = "default"
+		s.vmInfo.Name = "vm"
+		s.vmInfo.Cpu.Use = vmapi.MilliCPU(250 * int(cpu))
+		s.vmInfo.Mem.Use = cpu
+		s.vmInfo.Mem.SlotSize = 1 << 30
+		s.endpointID = endpointID
+		s.labels = map[string]string{projectLabel: "proj"}
+		s.lastUpscaleAt = upscaleAt
+		return s
+	}
+	labels := makePerVMMetricsLabels("default", "vm", "ep-1", "proj", "")
+
+	upscaleAt := time.Unix(1700000000, 0)
+	old := status("ep-1", 0, nil)
+	current := status("ep-1", 2, &upscaleAt)
+	metrics.updateVMUsageMetrics(computeUnit, old, current)
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.currentCU.With(labels)))
+	incLabels := maps.Clone(labels)
+	incLabels[directionLabel] = directionValueInc
+	assert.Equal(t, float64(upscaleAt.Unix()), testutil.ToFloat64(metrics.lastScaling.With(incLabels)))
+	// There hasn't been a downscale yet, so there's nothing for it
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.lastScaling))
+
+	locked := &lockedPodStatus{podStatus: current} //nolint:exhaustruct // the mutex is zero-valued
+	steal := float32(0.25)
+	locked.setVMUsageMetrics(global, core.Metrics{ //nolint:exhaustruct // only these are used
+		LoadAverage1Min:  1.5,
+		MemoryUsageBytes: 1024,
+		HostContention:   &core.HostContentionMetrics{StealFraction: &steal, ThrottledFraction: nil},
+	}, &api.Resources{VCPU: 750, Mem: 1 << 30})
+	assert.Equal(t, 1.5, testutil.ToFloat64(metrics.loadAverage.With(labels)))
+	assert.Equal(t, 1024.0, testutil.ToFloat64(metrics.memoryUsage.With(labels)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.goalCU.With(labels)))
+	assert.Equal(t, 0.25, testutil.ToFloat64(metrics.cpuSteal.With(labels)))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.cpuThrottle))
+
+	// Contention that's no longer available is removed rather than left stale
+	locked.setVMUsageMetrics(global, core.Metrics{LoadAverage1Min: 1, MemoryUsageBytes: 1024}, nil) //nolint:exhaustruct // only these are used
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.cpuSteal))
+	// ... while the goal is kept, because it's only updated when there is one.
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.goalCU.With(labels)))
+
+	// When the VM's labels change, its gauges are replaced
+	moved := status("ep-2", 2, &upscaleAt)
+	metrics.updateVMUsageMetrics(computeUnit, current, moved)
+	newLabels := makePerVMMetricsLabels("default", "vm", "ep-2", "proj", "")
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.currentCU))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.currentCU.With(newLabels)))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.loadAverage))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.goalCU))
+
+	// Once the VM is deleted, all its gauges are removed, and can't be set again
+	deleted := moved
+	deleted.deleted = true
+	metrics.updateVMUsageMetrics(computeUnit, moved, deleted)
+	locked.podStatus = deleted
+	locked.setVMUsageMetrics(global, core.Metrics{LoadAverage1Min: 1, MemoryUsageBytes: 1024}, nil) //nolint:exhaustruct // only these are used
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.currentCU))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.lastScaling))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.loadAverage))
+}
@@ -30,6 +30,11 @@ type vmEvent struct {
 	podIP   string
 	// if present, the ID of the endpoint associated with the VM. May be empty.
 	endpointID string
+	// labels are the VM object's labels
+	labels map[string]string
+	// scalingProfile is the name of the scaling profile applied to vmInfo, or empty if there was
+	// none
+	scalingProfile string
 }
 
 const (
@@ -43,6 +48,9 @@ func (ev vmEvent) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("podName", ev.podName)
 	enc.AddString("podIP", ev.podIP)
 	enc.AddString("endpointID", ev.endpointID)
+	if ev.scalingProfile != "" {
+		enc.AddString("scalingProfile", ev.scalingProfile)
+	}
 	if err := enc.AddReflected("vmInfo", ev.vmInfo); err != nil {
 		return err
 	}
@@ -67,9 +75,22 @@ func startVMWatcher(
 	perVMMetrics PerVMMetrics,
 	nodeName string,
 	submitEvent func(vmEvent),
+	submitBillingDeletion func(*vmapi.VirtualMachine),
+	submitBillingMigration func(*vmapi.VirtualMachine),
 ) (*watch.Store[vmapi.VirtualMachine], error) {
 	logger := parentLogger.Named("vm-watch")
 
+	var retryBackoffMax time.Duration
+	if sf := config.Billing.StoreFailure; sf != nil {
+		retryBackoffMax = time.Second * time.Duration(sf.RetryBackoffMaxSeconds)
+	}
+	var maxFailures int
+	var resyncPeriod time.Duration
+	if w := config.VMWatch; w != nil {
+		maxFailures = int(w.MaxConsecutiveFailures)
+		resyncPeriod = time.Second * time.Duration(w.ResyncEverySeconds)
+	}
+
 	return watch.Watch(
 		ctx,
 		logger.Named("watch"),
@@ -83,6 +104,12 @@ func startVMWatcher(
 			// We want to be relatively snappy; don't wait for too long before retrying.
 			RetryRelistAfter: util.NewTimeRange(time.Millisecond, 500, 1000),
 			RetryWatchAfter:  util.NewTimeRange(time.Millisecond, 500, 1000),
+			// ... but optionally back off while the API server is having trouble, so we don't add
+			// to it.
+			RetryBackoffMax: retryBackoffMax,
+			// If it keeps failing, eventually give up so that the autoscaler-agent is restarted.
+			MaxConsecutiveFailures: maxFailures,
+			ResyncPeriod:           resyncPeriod,
 		},
 		watch.Accessors[*vmapi.VirtualMachineList, vmapi.VirtualMachine]{
 			Items: func(list *vmapi.VirtualMachineList) []vmapi.VirtualMachine { return list.Items },
@@ -94,7 +121,7 @@ func startVMWatcher(
 				setVMMetrics(&perVMMetrics, vm, nodeName)
 
 				if vmIsOurResponsibility(vm, config, nodeName) {
-					event, err := makeVMEvent(logger, vm, vmEventAdded)
+					event, err := makeVMEvent(logger, config, vm, vmEventAdded)
 					if err != nil {
 						logger.Error(
 							"Failed to create vmEvent for added VM",
@@ -108,6 +135,10 @@ func startVMWatcher(
 			UpdateFunc: func(oldVM, newVM *vmapi.VirtualMachine) {
 				updateVMMetrics(&perVMMetrics, oldVM, newVM, nodeName)
 
+				if oldVM.Status.Node == nodeName && newVM.Status.Node != nodeName && newVM.Status.MigratedAt != nil {
+					submitBillingMigration(newVM)
+				}
+
 				oldIsOurs := vmIsOurResponsibility(oldVM, config, nodeName)
 				newIsOurs := vmIsOurResponsibility(newVM, config, nodeName)
 				if !oldIsOurs && !newIsOurs {
@@ -128,7 +159,7 @@ func startVMWatcher(
 					eventKind = vmEventUpdated
 				}
 
-				event, err := makeVMEvent(logger, vmForEvent, eventKind)
+				event, err := makeVMEvent(logger, config, vmForEvent, eventKind)
 				if err != nil {
 					logger.Error(
 						"Failed to create vmEvent for updated VM",
@@ -142,8 +173,12 @@ func startVMWatcher(
 			DeleteFunc: func(vm *vmapi.VirtualMachine, maybeStale bool) {
 				deleteVMMetrics(&perVMMetrics, vm, nodeName)
 
+				if vm.Status.Node == nodeName {
+					submitBillingDeletion(vm)
+				}
+
 				if vmIsOurResponsibility(vm, config, nodeName) {
-					event, err := makeVMEvent(logger, vm, vmEventDeleted)
+					event, err := makeVMEvent(logger, config, vm, vmEventDeleted)
 					if err != nil {
 						logger.Error(
 							"Failed to create vmEvent for deleted VM",
@@ -158,23 +193,27 @@ func startVMWatcher(
 	)
 }
 
-func makeVMEvent(logger *zap.Logger, vm *vmapi.VirtualMachine, kind vmEventKind) (vmEvent, error) {
+func makeVMEvent(logger *zap.Logger, config *Config, vm *vmapi.VirtualMachine, kind vmEventKind) (vmEvent, error) {
 	info, err := api.ExtractVmInfo(logger, vm)
 	if err != nil {
 		return vmEvent{}, fmt.Errorf("Error extracting VM info: %w", err)
 	}
 
+	profile := applyScalingProfile(config.Scaling.Profiles, config.Scaling.ComputeUnit, vm, info)
+
 	endpointID := ""
 	if vm.Labels != nil {
 		endpointID = vm.Labels[endpointLabel]
 	}
 
 	return vmEvent{
-		kind:       kind,
-		vmInfo:     *info,
-		podName:    vm.Status.PodName,
-		podIP:      vm.Status.PodIP,
-		endpointID: endpointID,
+		kind:           kind,
+		vmInfo:         *info,
+		podName:        vm.Status.PodName,
+		podIP:          vm.Status.PodIP,
+		endpointID:     endpointID,
+		labels:         vm.Labels,
+		scalingProfile: profile,
 	}, nil
 }
 
@@ -304,6 +343,28 @@ func makeVMRestartMetrics(vm *vmapi.VirtualMachine) []vmMetric {
 	}
 }
 
+// makeVMManualTargetMetrics makes the metric for the VM's manual target, if it has a valid one
+func makeVMManualTargetMetrics(vm *vmapi.VirtualMachine) []vmMetric {
+	target, ok := vm.Annotations[api.AnnotationManualTarget]
+	if !ok {
+		return nil
+	}
+	cu, err := api.ParseManualTarget(target)
+	if err != nil {
+		return nil
+	}
+
+	endpointID := vm.Labels[endpointLabel]
+	projectID := vm.Labels[projectLabel]
+	labels := makePerVMMetricsLabels(vm.Namespace, vm.Name, endpointID, projectID, "")
+	return []vmMetric{
+		{
+			labels: labels,
+			value:  float64(cu),
+		},
+	}
+}
+
 func setVMMetrics(perVMMetrics *PerVMMetrics, vm *vmapi.VirtualMachine, nodeName string) {
 	if vm.Status.Node != nodeName {
 		return
@@ -323,6 +384,11 @@ func setVMMetrics(perVMMetrics *PerVMMetrics, vm *vmapi.VirtualMachine, nodeName
 	for _, m := range restartCountMetrics {
 		perVMMetrics.restartCount.With(m.labels).Set(m.value)
 	}
+
+	manualTargetMetrics := makeVMManualTargetMetrics(vm)
+	for _, m := range manualTargetMetrics {
+		perVMMetrics.manualTarget.With(m.labels).Set(m.value)
+	}
 }
 
 func updateVMMetrics(perVMMetrics *PerVMMetrics, oldVM, newVM *vmapi.VirtualMachine, nodeName string) {
@@ -361,6 +427,10 @@ func updateVMMetrics(perVMMetrics *PerVMMetrics, oldVM, newVM *vmapi.VirtualMach
 	oldRestartCountMetrics := makeVMRestartMetrics(oldVM)
 	newRestartCountMetrics := makeVMRestartMetrics(newVM)
 	updateMetrics(perVMMetrics.restartCount, oldRestartCountMetrics, newRestartCountMetrics)
+
+	oldManualTargetMetrics := makeVMManualTargetMetrics(oldVM)
+	newManualTargetMetrics := makeVMManualTargetMetrics(newVM)
+	updateMetrics(perVMMetrics.manualTarget, oldManualTargetMetrics, newManualTargetMetrics)
 }
 
 func deleteVMMetrics(perVMMetrics *PerVMMetrics, vm *vmapi.VirtualMachine, nodeName string) {
@@ -382,4 +452,9 @@ func deleteVMMetrics(perVMMetrics *PerVMMetrics, vm *vmapi.VirtualMachine, nodeN
 	for _, m := range restartCountMetrics {
 		perVMMetrics.restartCount.Delete(m.labels)
 	}
+
+	manualTargetMetrics := makeVMManualTargetMetrics(vm)
+	for _, m := range manualTargetMetrics {
+		perVMMetrics.manualTarget.Delete(m.labels)
+	}
 }
@@ -0,0 +1,215 @@
+package agent
+
+// Notifications of scaling activity sent to a webhook, so that it can be fed into chat or incident
+// tooling.
+//
+// Each applied or denied scaling decision produces a single notification, which is sent in the
+// background. If the webhook is slow or unavailable, notifications queue up to a fixed limit and
+// are then dropped, so that scaling is never held up by the webhook.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// WebhookSignatureHeader is the header that notifications are signed in, if a secret is configured
+//
+// The value is "sha256=" followed by the hex-encoded HMAC-SHA256 of the request body.
+const WebhookSignatureHeader = "X-Autoscaling-Signature"
+
+// WebhookNotification is the body of each request sent to the webhook
+type WebhookNotification struct {
+	Time time.Time               `json:"time"`
+	Kind WebhookNotificationKind `json:"kind"`
+
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+	EndpointID string `json:"endpointID,omitempty"`
+
+	Previous   api.Resources `json:"previous"`
+	Target     api.Resources `json:"target"`
+	PreviousCU float64       `json:"previousCU"`
+	TargetCU   float64       `json:"targetCU"`
+
+	Reason           string                    `json:"reason"`
+	SchedulerVerdict executor.SchedulerVerdict `json:"schedulerVerdict"`
+}
+
+type WebhookNotificationKind string
+
+const (
+	WebhookUpscale   WebhookNotificationKind = "upscale"
+	WebhookDownscale WebhookNotificationKind = "downscale"
+	WebhookDenied    WebhookNotificationKind = "denied"
+)
+
+// Values of the "outcome" label on the webhook notifications metric
+const (
+	webhookOutcomeSent    = "sent"
+	webhookOutcomeFailed  = "failed"
+	webhookOutcomeDropped = "dropped"
+)
+
+// makeWebhookNotification returns the notification for the decision, or nil if the decision isn't
+// one that we notify about
+func makeWebhookNotification(vm util.NamespacedName, endpointID string, decision executor.Decision) *WebhookNotification {
+	var kind WebhookNotificationKind
+	switch decision.Outcome {
+	case executor.DecisionApplied:
+		if decision.Target.HasFieldGreaterThan(decision.Previous) {
+			kind = WebhookUpscale
+		} else {
+			kind = WebhookDownscale
+		}
+	case executor.DecisionDenied:
+		kind = WebhookDenied
+	default:
+		return nil
+	}
+
+	return &WebhookNotification{
+		Time:             decision.Time,
+		Kind:             kind,
+		Name:             vm.Name,
+		Namespace:        vm.Namespace,
+		EndpointID:       endpointID,
+		Previous:         decision.Previous,
+		Target:           decision.Target,
+		PreviousCU:       decision.PreviousCU,
+		TargetCU:         decision.TargetCU,
+		Reason:           decision.Reason,
+		SchedulerVerdict: decision.SchedulerVerdict,
+	}
+}
+
+// webhookSender sends notifications to the webhook from a single background worker
+type webhookSender struct {
+	logger  *zap.Logger
+	config  *WebhookConfig
+	client  *http.Client
+	queue   chan WebhookNotification
+	metrics *prometheus.CounterVec
+}
+
+func newWebhookSender(logger *zap.Logger, config *WebhookConfig, metrics *prometheus.CounterVec) *webhookSender {
+	return &webhookSender{
+		logger: logger,
+		config: config,
+		client: &http.Client{
+			Timeout: time.Second * time.Duration(config.TimeoutSeconds),
+		},
+		queue:   make(chan WebhookNotification, config.QueueSize),
+		metrics: metrics,
+	}
+}
+
+// enqueue adds the notification to the queue to send, dropping it if the queue is full
+func (w *webhookSender) enqueue(notification WebhookNotification) {
+	select {
+	case w.queue <- notification:
+	default:
+		w.metrics.WithLabelValues(webhookOutcomeDropped).Inc()
+		w.logger.Warn(
+			"Dropping webhook notification because the queue is full",
+			zap.String("kind", string(notification.Kind)),
+			zap.Object("virtualmachine", util.NamespacedName{Namespace: notification.Namespace, Name: notification.Name}),
+		)
+	}
+}
+
+// start begins sending queued notifications in the background, until the context is canceled
+func (w *webhookSender) start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-w.queue:
+				if err := w.send(ctx, notification); err != nil {
+					w.metrics.WithLabelValues(webhookOutcomeFailed).Inc()
+					w.logger.Error(
+						"Failed to send webhook notification",
+						zap.String("kind", string(notification.Kind)),
+						zap.Object("virtualmachine", util.NamespacedName{Namespace: notification.Namespace, Name: notification.Name}),
+						zap.Error(err),
+					)
+				} else {
+					w.metrics.WithLabelValues(webhookOutcomeSent).Inc()
+				}
+			}
+		}
+	}()
+}
+
+// send makes the request for the notification, retrying with exponential backoff if it fails
+func (w *webhookSender) send(ctx context.Context, notification WebhookNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("Error encoding notification: %w", err)
+	}
+
+	wait := time.Second * time.Duration(w.config.RetryWaitSeconds)
+	for attempt := uint(0); ; attempt++ {
+		retryable, err := w.trySend(ctx, body)
+		if err == nil {
+			return nil
+		} else if !retryable || attempt >= w.config.MaxRetries {
+			return err
+		}
+
+		w.logger.Warn("Webhook request failed, retrying", zap.Duration("wait", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// trySend makes a single request to the webhook, returning whether it may succeed if retried
+func (w *webhookSender) trySend(ctx context.Context, body []byte) (retryable bool, _ error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("Error constructing request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.config.SecretFile != "" {
+		secret, err := util.ReadSecretFile(w.config.SecretFile)
+		if err != nil {
+			return false, fmt.Errorf("Error reading webhook secret: %w", err)
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("Error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, fmt.Errorf("Received response status %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestMakeWebhookNotification(t *testing.T) {
+	vm := util.NamespacedName{Namespace: "ns", Name: "vm"}
+	decision := executor.Decision{ //nolint:exhaustruct // only the fields used in notifications
+		Time:     time.Unix(1000, 0),
+		Outcome:  executor.DecisionApplied,
+		Previous: api.Resources{VCPU: 250, Mem: 1 << 30},
+		Target:   api.Resources{VCPU: 500, Mem: 2 << 30},
+		Reason:   "load",
+	}
+
+	n := makeWebhookNotification(vm, "ep", decision)
+	require.NotNil(t, n)
+	assert.Equal(t, WebhookUpscale, n.Kind)
+	assert.Equal(t, "vm", n.Name)
+	assert.Equal(t, "ns", n.Namespace)
+	assert.Equal(t, "ep", n.EndpointID)
+
+	decision.Previous, decision.Target = decision.Target, decision.Previous
+	assert.Equal(t, WebhookDownscale, makeWebhookNotification(vm, "ep", decision).Kind)
+
+	decision.Outcome = executor.DecisionDenied
+	assert.Equal(t, WebhookDenied, makeWebhookNotification(vm, "ep", decision).Kind)
+
+	decision.Outcome = executor.DecisionOutcome("other")
+	assert.Nil(t, makeWebhookNotification(vm, "ep", decision))
+}
+
+func TestWebhookSend(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("key\n"), 0o600))
+
+	statuses := []int{}
+	var bodies [][]byte
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get(WebhookSignatureHeader))
+
+		status := http.StatusOK
+		if len(statuses) != 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	metrics := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_webhook_notifications_total", Help: ""}, []string{"outcome"})
+	sender := newWebhookSender(zap.NewNop(), &WebhookConfig{
+		URL:              server.URL,
+		SecretFile:       secretFile,
+		TimeoutSeconds:   5,
+		MaxRetries:       2,
+		RetryWaitSeconds: 0,
+		QueueSize:        1,
+	}, metrics)
+	notification := WebhookNotification{ //nolint:exhaustruct // not all fields are needed
+		Kind: WebhookUpscale,
+		Name: "vm",
+	}
+	ctx := context.Background()
+
+	// The body is signed with the secret
+	require.NoError(t, sender.send(ctx, notification))
+	require.Len(t, bodies, 1)
+	var got WebhookNotification
+	require.NoError(t, json.Unmarshal(bodies[0], &got))
+	assert.Equal(t, notification, got)
+	mac := hmac.New(sha256.New, []byte("key"))
+	_, _ = mac.Write(bodies[0])
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signatures[0])
+
+	// Server errors are retried, up to MaxRetries
+	bodies = nil
+	statuses = []int{http.StatusInternalServerError, http.StatusTooManyRequests}
+	require.NoError(t, sender.send(ctx, notification))
+	assert.Len(t, bodies, 3)
+
+	bodies = nil
+	statuses = []int{500, 500, 500, 500}
+	assert.Error(t, sender.send(ctx, notification))
+	assert.Len(t, bodies, 3)
+
+	// ... but other failures aren't
+	bodies = nil
+	statuses = []int{http.StatusBadRequest}
+	assert.Error(t, sender.send(ctx, notification))
+	assert.Len(t, bodies, 1)
+
+	// Without a readable secret, nothing is sent
+	bodies = nil
+	statuses = nil
+	require.NoError(t, os.Remove(secretFile))
+	assert.ErrorContains(t, sender.send(ctx, notification), "webhook secret")
+	assert.Empty(t, bodies)
+}
@@ -0,0 +1,51 @@
+package api
+
+// Support for clusters with nodes of more than one CPU architecture (e.g. amd64 and arm64), where
+// the ratio between CPU and memory in a compute unit may be different on each.
+//
+// Architectures are named as in the "kubernetes.io/arch" node label, which matches Go's GOARCH.
+
+import (
+	"fmt"
+
+	"github.com/tychoish/fun/erc"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// ComputeUnitsByArch gives the compute unit to use on nodes with each architecture, instead of the
+// default
+type ComputeUnitsByArch map[string]Resources
+
+// Get returns the compute unit for the architecture, or def if there isn't one specific to it
+func (c ComputeUnitsByArch) Get(arch string, def Resources) Resources {
+	if cu, ok := c[arch]; ok {
+		return cu
+	}
+	return def
+}
+
+// Validate checks that every compute unit is non-zero. Errors are reported with the field name
+// prefixed by path -- e.g. ".scaling.computeUnitsByArch".
+func (c ComputeUnitsByArch) Validate(path string) error {
+	ec := &erc.Collector{}
+	archs := maps.Keys(c)
+	slices.Sort(archs)
+	for _, arch := range archs {
+		cu := c[arch]
+		erc.Whenf(ec, arch == "", "field %q cannot have an empty architecture", path)
+		erc.Whenf(ec, cu.VCPU == 0, "field %q cannot be zero", fmt.Sprintf("%s.%s.vCPUs", path, arch))
+		erc.Whenf(ec, cu.Mem == 0, "field %q cannot be zero", fmt.Sprintf("%s.%s.mem", path, arch))
+	}
+	return ec.Resolve()
+}
+
+// RequiredArchitecture returns the architecture that the VM's node selector requires, or the empty
+// string if it doesn't require one
+func RequiredArchitecture(vm *vmapi.VirtualMachine) string {
+	return vm.Spec.NodeSelector[corev1.LabelArchStable]
+}
@@ -0,0 +1,52 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestComputeUnitsByArch(t *testing.T) {
+	def := api.Resources{VCPU: 250, Mem: 1 << 30}
+	arm := api.Resources{VCPU: 250, Mem: 2 << 30}
+	byArch := api.ComputeUnitsByArch{"arm64": arm}
+
+	assert.Equal(t, arm, byArch.Get("arm64", def))
+	// Architectures without their own compute unit use the default, as does a node without the
+	// architecture label.
+	assert.Equal(t, def, byArch.Get("amd64", def))
+	assert.Equal(t, def, byArch.Get("", def))
+	assert.Equal(t, def, api.ComputeUnitsByArch(nil).Get("arm64", def))
+
+	assert.NoError(t, byArch.Validate(".computeUnitsByArch"))
+	assert.NoError(t, api.ComputeUnitsByArch(nil).Validate(".computeUnitsByArch"))
+
+	err := api.ComputeUnitsByArch{
+		"amd64": {VCPU: 0, Mem: 1 << 30},
+		"arm64": {VCPU: 250, Mem: 0},
+		"":      def,
+	}.Validate(".scaling.computeUnitsByArch")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `".scaling.computeUnitsByArch.amd64.vCPUs"`)
+		assert.Contains(t, err.Error(), `".scaling.computeUnitsByArch.arm64.mem"`)
+		assert.Contains(t, err.Error(), "empty architecture")
+	}
+}
+
+func TestRequiredArchitecture(t *testing.T) {
+	vm := topologyTestVM(nil)
+	assert.Equal(t, "", api.RequiredArchitecture(vm))
+
+	vm.Spec.NodeSelector = map[string]string{corev1.LabelArchStable: "arm64", "other": "label"}
+	assert.Equal(t, "arm64", api.RequiredArchitecture(vm))
+
+	topology := &vmapi.VirtualMachineTopology{PreferredArchitectures: []string{"arm64"}} //nolint:exhaustruct // only the architectures matter
+	assert.True(t, topology.PrefersArchitecture("arm64"))
+	assert.False(t, topology.PrefersArchitecture("amd64"))
+	assert.False(t, new(vmapi.VirtualMachineTopology).PrefersArchitecture("arm64"))
+}
@@ -0,0 +1,60 @@
+package api
+
+// Burst credits, which allow a VM to be scaled above a baseline number of compute units for only a
+// limited time in any hour, so that a plan can include occasional bursts without paying for
+// sustained usage at the burst size.
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tychoish/fun/erc"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BurstCredits gives how long a VM may spend above its baseline compute units. It's set by the
+// AnnotationBurstCredits annotation.
+//
+// For example, to allow the VM to spend up to 10 minutes in any hour above 2 CU:
+//
+//	{"baselineCU": 2, "secondsPerHour": 600}
+//
+// The autoscaler-agent caps the VM at the baseline once it's used up the time, and billing reports
+// the compute units above the baseline separately, if configured to.
+type BurstCredits struct {
+	// BaselineCU is the number of compute units that the VM may be scaled up to without using its
+	// burst credits
+	BaselineCU uint16 `json:"baselineCU"`
+	// SecondsPerHour is the total time, in any hour, that the VM may spend above BaselineCU
+	SecondsPerHour uint32 `json:"secondsPerHour"`
+}
+
+func (c *BurstCredits) Validate() error {
+	ec := &erc.Collector{}
+
+	erc.Whenf(ec, c.BaselineCU == 0, "%s must be set to value > 0", ".baselineCU")
+	erc.Whenf(ec, c.SecondsPerHour > 3600, "%s must be set to value <= 3600", ".secondsPerHour")
+
+	// heads-up! some functions elsewhere depend on the concrete return type of this function.
+	return ec.Resolve()
+}
+
+// ExtractBurstCredits returns the burst credits from the object's AnnotationBurstCredits
+// annotation, or nil if it doesn't have one
+func ExtractBurstCredits(obj metav1.ObjectMetaAccessor) (*BurstCredits, error) {
+	creditsJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationBurstCredits]
+	if !ok {
+		return nil, nil
+	}
+
+	var credits BurstCredits
+	if err := json.Unmarshal([]byte(creditsJSON), &credits); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationBurstCredits, err)
+	}
+
+	if err := credits.Validate(); err != nil {
+		return nil, fmt.Errorf("Bad burst credits in annotation %q: %w", AnnotationBurstCredits, err)
+	}
+	return &credits, nil
+}
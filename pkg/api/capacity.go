@@ -0,0 +1,71 @@
+package api
+
+// Messages for the scheduler plugin's dry-run capacity queries, which answer questions about
+// whether there's room for a change without reserving anything.
+
+import (
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// VMCapacityRequest asks the scheduler plugin whether the VM could be scaled to Target on the node
+// it's currently on. It's sent as the body of a POST request to the plugin's /capacity/vm
+// endpoint.
+//
+// The answer is the same as the plugin would give to an autoscaler-agent request for Target, using
+// the VM's priority.
+type VMCapacityRequest struct {
+	VM     util.NamespacedName `json:"vm"`
+	Target Resources           `json:"target"`
+	// ComputeUnit, if not nil, is the compute unit that increases are rounded down to a multiple
+	// of, as with AgentRequest.ComputeUnit. Otherwise, memory is rounded down to whole memory
+	// slots.
+	ComputeUnit *Resources `json:"computeUnit,omitempty"`
+}
+
+// VMCapacityResponse is the scheduler plugin's answer to a VMCapacityRequest
+type VMCapacityResponse struct {
+	Node string `json:"node"`
+
+	// Fits is true if the node has enough unreserved resources for the VM to be scaled to the
+	// target right now
+	Fits bool `json:"fits"`
+	// AboveWatermark is true if scaling the VM to the target would put the node above its
+	// watermark, which may result in VMs being migrated away from it
+	AboveWatermark bool `json:"aboveWatermark"`
+	// Reason, if not empty, describes why the VM doesn't fit
+	Reason string `json:"reason,omitempty"`
+
+	// Reserved gives the resources currently reserved for the VM
+	Reserved Resources `json:"reserved"`
+	// MaxFit gives the most that the VM could currently be scaled to on the node, given its
+	// priority, but not accounting for the VM's bounds
+	MaxFit Resources `json:"maxFit"`
+}
+
+// NodeCapacityRequest asks the scheduler plugin about the resources of the node. It's sent as the
+// body of a POST request to the plugin's /capacity/node endpoint.
+type NodeCapacityRequest struct {
+	Node string `json:"node"`
+}
+
+// NodeCapacityResponse is the scheduler plugin's answer to a NodeCapacityRequest
+type NodeCapacityResponse struct {
+	Node string                               `json:"node"`
+	CPU  NodeResourceCapacity[vmapi.MilliCPU] `json:"cpu"`
+	Mem  NodeResourceCapacity[Bytes]          `json:"mem"`
+}
+
+// NodeResourceCapacity describes the amount of a single resource on a node
+type NodeResourceCapacity[T any] struct {
+	Total     T `json:"total"`
+	Reserved  T `json:"reserved"`
+	Watermark T `json:"watermark"`
+
+	// Headroom is the amount that's not reserved, and so is available to upscale the VMs already on
+	// the node
+	Headroom T `json:"headroom"`
+	// Placeable is the amount that's available to new pods, which excludes what's kept aside for
+	// upscaling the VMs already on the node
+	Placeable T `json:"placeable"`
+}
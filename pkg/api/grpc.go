@@ -0,0 +1,227 @@
+package api
+
+// gRPC transport for the agent<->scheduler plugin protocol, as an alternative to JSON over HTTP.
+//
+// The service is defined in plugin.proto, with protobuf messages mirroring AgentRequest and
+// PluginResponse field-for-field. Besides the typed encoding, gRPC adds a long-lived connection
+// with keepalives, and an explicit negotiation of the protocol version before any requests are
+// made.
+//
+// The generated code is wrapped by PluginClient and RegisterPluginServer, which convert between the
+// protobuf messages and the types used for HTTP, so that the rest of the code doesn't need to
+// care which transport is in use.
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// PluginServer is the interface implemented by the scheduler plugin to serve the AutoscalerPlugin
+// gRPC service, with the messages already decoded
+type PluginServer interface {
+	// Negotiate returns the latest protocol version in the range that's also supported by the
+	// server
+	Negotiate(context.Context, VersionRange[PluginProtoVersion]) (PluginProtoVersion, error)
+	Request(context.Context, *AgentRequest) (*PluginResponse, error)
+}
+
+// RegisterPluginServer registers the PluginServer as the AutoscalerPlugin service on the gRPC
+// server
+func RegisterPluginServer(s grpc.ServiceRegistrar, srv PluginServer) {
+	RegisterAutoscalerPluginServer(s, pluginServerAdapter{
+		UnimplementedAutoscalerPluginServer: UnimplementedAutoscalerPluginServer{},
+		srv:                                 srv,
+	})
+}
+
+// pluginServerAdapter implements the generated AutoscalerPluginServer for a PluginServer
+type pluginServerAdapter struct {
+	UnimplementedAutoscalerPluginServer
+	srv PluginServer
+}
+
+func (a pluginServerAdapter) Negotiate(ctx context.Context, req *PluginNegotiateRequest) (*PluginNegotiateResponse, error) {
+	supported := VersionRange[PluginProtoVersion]{
+		Min: PluginProtoVersion(req.MinVersion),
+		Max: PluginProtoVersion(req.MaxVersion),
+	}
+	version, err := a.srv.Negotiate(ctx, supported)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginNegotiateResponse{Version: uint32(version)}, nil
+}
+
+func (a pluginServerAdapter) Request(ctx context.Context, req *PluginRequest) (*PluginReply, error) {
+	agentReq, err := agentRequestFromProto(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid request: %s", err)
+	}
+
+	resp, err := a.srv.Request(ctx, agentReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return pluginResponseToProto(resp), nil
+}
+
+// PluginClient makes gRPC requests to the scheduler plugin
+type PluginClient struct {
+	client AutoscalerPluginClient
+}
+
+func NewPluginClient(conn grpc.ClientConnInterface) PluginClient {
+	return PluginClient{client: NewAutoscalerPluginClient(conn)}
+}
+
+// Negotiate returns the latest protocol version in the range that's also supported by the
+// scheduler plugin
+func (c PluginClient) Negotiate(ctx context.Context, supported VersionRange[PluginProtoVersion]) (PluginProtoVersion, error) {
+	resp, err := c.client.Negotiate(ctx, &PluginNegotiateRequest{
+		MinVersion: uint32(supported.Min),
+		MaxVersion: uint32(supported.Max),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return PluginProtoVersion(resp.Version), nil
+}
+
+func (c PluginClient) Request(ctx context.Context, req *AgentRequest) (*PluginResponse, error) {
+	reply, err := c.client.Request(ctx, agentRequestToProto(req))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := pluginResponseFromProto(reply)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Invalid response: %s", err)
+	}
+	return resp, nil
+}
+
+func agentRequestToProto(req *AgentRequest) *PluginRequest {
+	var metrics *PluginMetrics
+	if req.Metrics != nil {
+		metrics = &PluginMetrics{
+			LoadAverage_1Min: req.Metrics.LoadAverage1Min,
+			LoadAverage_5Min: floatToProto(req.Metrics.LoadAverage5Min),
+			MemoryUsageBytes: floatToProto(req.Metrics.MemoryUsageBytes),
+		}
+	}
+
+	return &PluginRequest{
+		ProtoVersion: uint32(req.ProtoVersion),
+		Pod:          &PluginPod{Namespace: req.Pod.Namespace, Name: req.Pod.Name},
+		ComputeUnit:  resourcesToProto(req.ComputeUnit),
+		Resources:    resourcesToProto(req.Resources),
+		LastPermit:   resourcesPtrToProto(req.LastPermit),
+		Metrics:      metrics,
+		Priority:     req.Priority,
+	}
+}
+
+func agentRequestFromProto(req *PluginRequest) (*AgentRequest, error) {
+	if req.Pod == nil {
+		return nil, errors.New("missing field 'pod'")
+	} else if req.ComputeUnit == nil {
+		return nil, errors.New("missing field 'compute_unit'")
+	} else if req.Resources == nil {
+		return nil, errors.New("missing field 'resources'")
+	}
+
+	var metrics *Metrics
+	if req.Metrics != nil {
+		metrics = &Metrics{
+			LoadAverage1Min:  req.Metrics.LoadAverage_1Min,
+			LoadAverage5Min:  floatFromProto(req.Metrics.LoadAverage_5Min),
+			MemoryUsageBytes: floatFromProto(req.Metrics.MemoryUsageBytes),
+		}
+	}
+
+	return &AgentRequest{
+		ProtoVersion: PluginProtoVersion(req.ProtoVersion),
+		Pod:          util.NamespacedName{Namespace: req.Pod.Namespace, Name: req.Pod.Name},
+		ComputeUnit:  resourcesFromProto(req.ComputeUnit),
+		Resources:    resourcesFromProto(req.Resources),
+		LastPermit:   resourcesPtrFromProto(req.LastPermit),
+		Metrics:      metrics,
+		Priority:     req.Priority,
+	}, nil
+}
+
+func pluginResponseToProto(resp *PluginResponse) *PluginReply {
+	var migrate *PluginMigrate
+	if resp.Migrate != nil {
+		migrate = &PluginMigrate{}
+	}
+
+	return &PluginReply{
+		Permit:       resourcesToProto(resp.Permit),
+		Migrate:      migrate,
+		DeniedReason: string(resp.DeniedReason),
+	}
+}
+
+func pluginResponseFromProto(reply *PluginReply) (*PluginResponse, error) {
+	if reply.Permit == nil {
+		return nil, errors.New("missing field 'permit'")
+	}
+
+	var migrate *MigrateResponse
+	if reply.Migrate != nil {
+		migrate = &MigrateResponse{}
+	}
+
+	return &PluginResponse{
+		Permit:       resourcesFromProto(reply.Permit),
+		Migrate:      migrate,
+		DeniedReason: PermitDeniedReason(reply.DeniedReason),
+	}, nil
+}
+
+func resourcesToProto(r Resources) *PluginResources {
+	return &PluginResources{MilliCpu: uint32(r.VCPU), MemBytes: uint64(r.Mem)}
+}
+
+func resourcesFromProto(r *PluginResources) Resources {
+	return Resources{VCPU: vmapi.MilliCPU(r.MilliCpu), Mem: Bytes(r.MemBytes)}
+}
+
+func resourcesPtrToProto(r *Resources) *PluginResources {
+	if r == nil {
+		return nil
+	}
+	return resourcesToProto(*r)
+}
+
+func resourcesPtrFromProto(r *PluginResources) *Resources {
+	if r == nil {
+		return nil
+	}
+	res := resourcesFromProto(r)
+	return &res
+}
+
+func floatToProto(f *float32) *PluginFloat {
+	if f == nil {
+		return nil
+	}
+	return &PluginFloat{Value: *f}
+}
+
+func floatFromProto(f *PluginFloat) *float32 {
+	if f == nil {
+		return nil
+	}
+	v := f.Value
+	return &v
+}
@@ -0,0 +1,156 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type fakePluginServer struct {
+	supported api.VersionRange[api.PluginProtoVersion]
+	requests  []api.AgentRequest
+	// if non-nil, returned instead of a response granting the requested resources
+	resp *api.PluginResponse
+	err  error
+}
+
+func (s *fakePluginServer) Negotiate(_ context.Context, agent api.VersionRange[api.PluginProtoVersion]) (api.PluginProtoVersion, error) {
+	version, ok := s.supported.LatestSharedVersion(agent)
+	if !ok {
+		return 0, status.Error(codes.FailedPrecondition, "no shared version")
+	}
+	return version, nil
+}
+
+func (s *fakePluginServer) Request(_ context.Context, req *api.AgentRequest) (*api.PluginResponse, error) {
+	s.requests = append(s.requests, *req)
+	if s.err != nil {
+		return nil, s.err
+	} else if s.resp != nil {
+		return s.resp, nil
+	}
+	return &api.PluginResponse{
+		Permit:       req.Resources,
+		Migrate:      nil,
+		DeniedReason: "",
+	}, nil
+}
+
+// startPluginServer serves the fake over an in-memory connection, returning a connection to it
+func startPluginServer(t *testing.T, srv *fakePluginServer) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	api.RegisterPluginServer(server, srv)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestPluginGRPCRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srv := &fakePluginServer{
+		supported: api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV3_0, Max: api.PluginProtoV5_2},
+		requests:  nil,
+		resp:      nil,
+		err:       nil,
+	}
+	client := api.NewPluginClient(startPluginServer(t, srv))
+
+	// Negotiation picks the latest shared version
+	version, err := client.Negotiate(ctx, api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV5_0, Max: api.PluginProtoV5_3})
+	require.NoError(t, err)
+	assert.Equal(t, api.PluginProtoV5_2, version)
+
+	_, err = client.Negotiate(ctx, api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV5_3, Max: api.PluginProtoV5_3})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Requests and responses are passed through unchanged
+	req := &api.AgentRequest{
+		ProtoVersion: api.PluginProtoV5_2,
+		Pod:          util.NamespacedName{Namespace: "default", Name: "vm-pod"},
+		ComputeUnit:  api.Resources{VCPU: 250, Mem: 1 << 30},
+		Resources:    api.Resources{VCPU: 1000, Mem: 4 << 30},
+		LastPermit:   &api.Resources{VCPU: 500, Mem: 2 << 30},
+		Metrics:      &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: nil, MemoryUsageBytes: nil},
+		Priority:     3,
+	}
+	resp, err := client.Request(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, []api.AgentRequest{*req}, srv.requests)
+	assert.Equal(t, &api.PluginResponse{Permit: req.Resources, Migrate: nil, DeniedReason: ""}, resp)
+
+	// ... including optional fields that are set, or left at their zero values
+	loadAvg5M, memUsage := float32(0.25), float32(0)
+	oldReq := &api.AgentRequest{
+		ProtoVersion: api.PluginProtoV1_1,
+		Pod:          util.NamespacedName{Namespace: "default", Name: "old-vm-pod"},
+		ComputeUnit:  api.Resources{VCPU: 250, Mem: 1 << 30},
+		Resources:    api.Resources{VCPU: 0, Mem: 0},
+		LastPermit:   nil,
+		Metrics:      &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: &loadAvg5M, MemoryUsageBytes: &memUsage},
+		Priority:     0,
+	}
+	srv.resp = &api.PluginResponse{
+		Permit:       api.Resources{VCPU: 250, Mem: 1 << 30},
+		Migrate:      &api.MigrateResponse{},
+		DeniedReason: api.PermitDeniedTenantBudget,
+	}
+	resp, err = client.Request(ctx, oldReq)
+	require.NoError(t, err)
+	assert.Equal(t, *oldReq, srv.requests[len(srv.requests)-1])
+	assert.Equal(t, srv.resp, resp)
+	srv.resp = nil
+
+	// Status errors from the server are returned as-is
+	srv.err = status.Error(codes.NotFound, "pod not found")
+	_, err = client.Request(ctx, req)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	srv.err = errors.New("plain error")
+	_, err = client.Request(ctx, req)
+	assert.Equal(t, codes.Unknown, status.Code(err))
+}
+
+func TestPluginGRPCMissingFields(t *testing.T) {
+	srv := &fakePluginServer{
+		supported: api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV5_3, Max: api.PluginProtoV5_3},
+		requests:  nil,
+		resp:      nil,
+		err:       nil,
+	}
+	client := api.NewAutoscalerPluginClient(startPluginServer(t, srv))
+
+	// Requests without the pod or resources are rejected before reaching the server
+	_, err := client.Request(context.Background(), &api.PluginRequest{
+		ProtoVersion: uint32(api.PluginProtoV5_3),
+		Pod:          nil,
+		ComputeUnit:  &api.PluginResources{MilliCpu: 250, MemBytes: 1 << 30},
+		Resources:    &api.PluginResources{MilliCpu: 1000, MemBytes: 4 << 30},
+		LastPermit:   nil,
+		Metrics:      nil,
+		Priority:     0,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, srv.requests)
+}
@@ -0,0 +1,831 @@
+// gRPC service for the agent<->scheduler plugin protocol. See grpc.go.
+//
+// Generate the Go code with 'make generate' after changing this file.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.30.0
+// 	protoc        (unknown)
+// source: pkg/api/plugin.proto
+
+package api
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// PluginNegotiateRequest gives the range of protocol versions that the autoscaler-agent supports
+type PluginNegotiateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MinVersion uint32 `protobuf:"varint,1,opt,name=min_version,json=minVersion,proto3" json:"min_version,omitempty"`
+	MaxVersion uint32 `protobuf:"varint,2,opt,name=max_version,json=maxVersion,proto3" json:"max_version,omitempty"`
+}
+
+func (x *PluginNegotiateRequest) Reset() {
+	*x = PluginNegotiateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginNegotiateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginNegotiateRequest) ProtoMessage() {}
+
+func (x *PluginNegotiateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginNegotiateRequest.ProtoReflect.Descriptor instead.
+func (*PluginNegotiateRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PluginNegotiateRequest) GetMinVersion() uint32 {
+	if x != nil {
+		return x.MinVersion
+	}
+	return 0
+}
+
+func (x *PluginNegotiateRequest) GetMaxVersion() uint32 {
+	if x != nil {
+		return x.MaxVersion
+	}
+	return 0
+}
+
+// PluginNegotiateResponse gives the latest protocol version supported by both the autoscaler-agent
+// and the scheduler plugin
+type PluginNegotiateResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+func (x *PluginNegotiateResponse) Reset() {
+	*x = PluginNegotiateResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginNegotiateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginNegotiateResponse) ProtoMessage() {}
+
+func (x *PluginNegotiateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginNegotiateResponse.ProtoReflect.Descriptor instead.
+func (*PluginNegotiateResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PluginNegotiateResponse) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+// PluginRequest is the protobuf encoding of an AgentRequest
+type PluginRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ProtoVersion uint32           `protobuf:"varint,1,opt,name=proto_version,json=protoVersion,proto3" json:"proto_version,omitempty"`
+	Pod          *PluginPod       `protobuf:"bytes,2,opt,name=pod,proto3" json:"pod,omitempty"`
+	ComputeUnit  *PluginResources `protobuf:"bytes,3,opt,name=compute_unit,json=computeUnit,proto3" json:"compute_unit,omitempty"`
+	Resources    *PluginResources `protobuf:"bytes,4,opt,name=resources,proto3" json:"resources,omitempty"`
+	// Unset if the autoscaler-agent hasn't yet received a permit from the scheduler plugin
+	LastPermit *PluginResources `protobuf:"bytes,5,opt,name=last_permit,json=lastPermit,proto3" json:"last_permit,omitempty"`
+	// Unset if the autoscaler-agent doesn't yet have metrics for the VM
+	Metrics  *PluginMetrics `protobuf:"bytes,6,opt,name=metrics,proto3" json:"metrics,omitempty"`
+	Priority int32          `protobuf:"varint,7,opt,name=priority,proto3" json:"priority,omitempty"`
+}
+
+func (x *PluginRequest) Reset() {
+	*x = PluginRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginRequest) ProtoMessage() {}
+
+func (x *PluginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginRequest.ProtoReflect.Descriptor instead.
+func (*PluginRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PluginRequest) GetProtoVersion() uint32 {
+	if x != nil {
+		return x.ProtoVersion
+	}
+	return 0
+}
+
+func (x *PluginRequest) GetPod() *PluginPod {
+	if x != nil {
+		return x.Pod
+	}
+	return nil
+}
+
+func (x *PluginRequest) GetComputeUnit() *PluginResources {
+	if x != nil {
+		return x.ComputeUnit
+	}
+	return nil
+}
+
+func (x *PluginRequest) GetResources() *PluginResources {
+	if x != nil {
+		return x.Resources
+	}
+	return nil
+}
+
+func (x *PluginRequest) GetLastPermit() *PluginResources {
+	if x != nil {
+		return x.LastPermit
+	}
+	return nil
+}
+
+func (x *PluginRequest) GetMetrics() *PluginMetrics {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+func (x *PluginRequest) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+// PluginReply is the protobuf encoding of a PluginResponse
+type PluginReply struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Permit *PluginResources `protobuf:"bytes,1,opt,name=permit,proto3" json:"permit,omitempty"`
+	// Set if the scheduler plugin is migrating the VM away
+	Migrate *PluginMigrate `protobuf:"bytes,2,opt,name=migrate,proto3" json:"migrate,omitempty"`
+	// Empty unless the permit is less than what was requested, for a known reason
+	DeniedReason string `protobuf:"bytes,3,opt,name=denied_reason,json=deniedReason,proto3" json:"denied_reason,omitempty"`
+}
+
+func (x *PluginReply) Reset() {
+	*x = PluginReply{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginReply) ProtoMessage() {}
+
+func (x *PluginReply) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginReply.ProtoReflect.Descriptor instead.
+func (*PluginReply) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PluginReply) GetPermit() *PluginResources {
+	if x != nil {
+		return x.Permit
+	}
+	return nil
+}
+
+func (x *PluginReply) GetMigrate() *PluginMigrate {
+	if x != nil {
+		return x.Migrate
+	}
+	return nil
+}
+
+func (x *PluginReply) GetDeniedReason() string {
+	if x != nil {
+		return x.DeniedReason
+	}
+	return ""
+}
+
+// PluginPod is the protobuf encoding of the NamespacedName of the VM's pod
+type PluginPod struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Namespace string `protobuf:"bytes,1,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Name      string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+}
+
+func (x *PluginPod) Reset() {
+	*x = PluginPod{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginPod) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginPod) ProtoMessage() {}
+
+func (x *PluginPod) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginPod.ProtoReflect.Descriptor instead.
+func (*PluginPod) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PluginPod) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *PluginPod) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+// PluginResources is the protobuf encoding of api.Resources
+type PluginResources struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MilliCpu uint32 `protobuf:"varint,1,opt,name=milli_cpu,json=milliCpu,proto3" json:"milli_cpu,omitempty"`
+	MemBytes uint64 `protobuf:"varint,2,opt,name=mem_bytes,json=memBytes,proto3" json:"mem_bytes,omitempty"`
+}
+
+func (x *PluginResources) Reset() {
+	*x = PluginResources{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginResources) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginResources) ProtoMessage() {}
+
+func (x *PluginResources) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginResources.ProtoReflect.Descriptor instead.
+func (*PluginResources) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PluginResources) GetMilliCpu() uint32 {
+	if x != nil {
+		return x.MilliCpu
+	}
+	return 0
+}
+
+func (x *PluginResources) GetMemBytes() uint64 {
+	if x != nil {
+		return x.MemBytes
+	}
+	return 0
+}
+
+// PluginMetrics is the protobuf encoding of api.Metrics
+type PluginMetrics struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LoadAverage_1Min float32 `protobuf:"fixed32,1,opt,name=load_average_1min,json=loadAverage1min,proto3" json:"load_average_1min,omitempty"`
+	// DEPRECATED. Only set for protocol versions that include extended metrics
+	LoadAverage_5Min *PluginFloat `protobuf:"bytes,2,opt,name=load_average_5min,json=loadAverage5min,proto3" json:"load_average_5min,omitempty"`
+	// DEPRECATED. Only set for protocol versions that include extended metrics
+	MemoryUsageBytes *PluginFloat `protobuf:"bytes,3,opt,name=memory_usage_bytes,json=memoryUsageBytes,proto3" json:"memory_usage_bytes,omitempty"`
+}
+
+func (x *PluginMetrics) Reset() {
+	*x = PluginMetrics{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginMetrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginMetrics) ProtoMessage() {}
+
+func (x *PluginMetrics) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginMetrics.ProtoReflect.Descriptor instead.
+func (*PluginMetrics) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PluginMetrics) GetLoadAverage_1Min() float32 {
+	if x != nil {
+		return x.LoadAverage_1Min
+	}
+	return 0
+}
+
+func (x *PluginMetrics) GetLoadAverage_5Min() *PluginFloat {
+	if x != nil {
+		return x.LoadAverage_5Min
+	}
+	return nil
+}
+
+func (x *PluginMetrics) GetMemoryUsageBytes() *PluginFloat {
+	if x != nil {
+		return x.MemoryUsageBytes
+	}
+	return nil
+}
+
+// PluginFloat wraps a float, so that it can be unset
+type PluginFloat struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Value float32 `protobuf:"fixed32,1,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (x *PluginFloat) Reset() {
+	*x = PluginFloat{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginFloat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginFloat) ProtoMessage() {}
+
+func (x *PluginFloat) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginFloat.ProtoReflect.Descriptor instead.
+func (*PluginFloat) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PluginFloat) GetValue() float32 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+// PluginMigrate is the protobuf encoding of api.MigrateResponse, which has no fields
+type PluginMigrate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *PluginMigrate) Reset() {
+	*x = PluginMigrate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_api_plugin_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PluginMigrate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PluginMigrate) ProtoMessage() {}
+
+func (x *PluginMigrate) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_plugin_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PluginMigrate.ProtoReflect.Descriptor instead.
+func (*PluginMigrate) Descriptor() ([]byte, []int) {
+	return file_pkg_api_plugin_proto_rawDescGZIP(), []int{8}
+}
+
+var File_pkg_api_plugin_proto protoreflect.FileDescriptor
+
+var file_pkg_api_plugin_proto_rawDesc = []byte{
+	0x0a, 0x14, 0x70, 0x6b, 0x67, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c,
+	0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x22, 0x5a, 0x0a, 0x16, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e,
+	0x4e, 0x65, 0x67, 0x6f, 0x74, 0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x69, 0x6e, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a, 0x6d, 0x69, 0x6e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x61, 0x78, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a, 0x6d, 0x61, 0x78, 0x56, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x22, 0x33, 0x0a, 0x17, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4e, 0x65, 0x67, 0x6f,
+	0x74, 0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07,
+	0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0xfb, 0x02, 0x0a, 0x0d, 0x50, 0x6c, 0x75, 0x67,
+	0x69, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x0c, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2b,
+	0x0a, 0x03, 0x70, 0x6f, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x61, 0x75,
+	0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75,
+	0x67, 0x69, 0x6e, 0x50, 0x6f, 0x64, 0x52, 0x03, 0x70, 0x6f, 0x64, 0x12, 0x42, 0x0a, 0x0c, 0x63,
+	0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x5f, 0x75, 0x6e, 0x69, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1f, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63,
+	0x65, 0x73, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x55, 0x6e, 0x69, 0x74, 0x12,
+	0x3d, 0x0a, 0x09, 0x72, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67,
+	0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x73, 0x6f, 0x75, 0x72,
+	0x63, 0x65, 0x73, 0x52, 0x09, 0x72, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x73, 0x12, 0x40,
+	0x0a, 0x0b, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x74, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e,
+	0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x73, 0x52, 0x0a, 0x6c, 0x61, 0x73, 0x74, 0x50, 0x65, 0x72, 0x6d, 0x69, 0x74,
+	0x12, 0x37, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1d, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73,
+	0x52, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x69,
+	0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x70, 0x72, 0x69,
+	0x6f, 0x72, 0x69, 0x74, 0x79, 0x22, 0xa4, 0x01, 0x0a, 0x0b, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e,
+	0x52, 0x65, 0x70, 0x6c, 0x79, 0x12, 0x37, 0x0a, 0x06, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x74, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c,
+	0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x73,
+	0x6f, 0x75, 0x72, 0x63, 0x65, 0x73, 0x52, 0x06, 0x70, 0x65, 0x72, 0x6d, 0x69, 0x74, 0x12, 0x37,
+	0x0a, 0x07, 0x6d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1d, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31,
+	0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65, 0x52, 0x07,
+	0x6d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x64, 0x65, 0x6e, 0x69, 0x65,
+	0x64, 0x5f, 0x72, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c,
+	0x64, 0x65, 0x6e, 0x69, 0x65, 0x64, 0x52, 0x65, 0x61, 0x73, 0x6f, 0x6e, 0x22, 0x3d, 0x0a, 0x09,
+	0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x50, 0x6f, 0x64, 0x12, 0x1c, 0x0a, 0x09, 0x6e, 0x61, 0x6d,
+	0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6e, 0x61,
+	0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x4b, 0x0a, 0x0f, 0x50,
+	0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x73, 0x12, 0x1b,
+	0x0a, 0x09, 0x6d, 0x69, 0x6c, 0x6c, 0x69, 0x5f, 0x63, 0x70, 0x75, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x08, 0x6d, 0x69, 0x6c, 0x6c, 0x69, 0x43, 0x70, 0x75, 0x12, 0x1b, 0x0a, 0x09, 0x6d,
+	0x65, 0x6d, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08,
+	0x6d, 0x65, 0x6d, 0x42, 0x79, 0x74, 0x65, 0x73, 0x22, 0xcf, 0x01, 0x0a, 0x0d, 0x50, 0x6c, 0x75,
+	0x67, 0x69, 0x6e, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x12, 0x2a, 0x0a, 0x11, 0x6c, 0x6f,
+	0x61, 0x64, 0x5f, 0x61, 0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x5f, 0x31, 0x6d, 0x69, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x02, 0x52, 0x0f, 0x6c, 0x6f, 0x61, 0x64, 0x41, 0x76, 0x65, 0x72, 0x61,
+	0x67, 0x65, 0x31, 0x6d, 0x69, 0x6e, 0x12, 0x47, 0x0a, 0x11, 0x6c, 0x6f, 0x61, 0x64, 0x5f, 0x61,
+	0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x5f, 0x35, 0x6d, 0x69, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1b, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e,
+	0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x46, 0x6c, 0x6f, 0x61, 0x74, 0x52, 0x0f,
+	0x6c, 0x6f, 0x61, 0x64, 0x41, 0x76, 0x65, 0x72, 0x61, 0x67, 0x65, 0x35, 0x6d, 0x69, 0x6e, 0x12,
+	0x49, 0x0a, 0x12, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x5f, 0x75, 0x73, 0x61, 0x67, 0x65, 0x5f,
+	0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x61, 0x75,
+	0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75,
+	0x67, 0x69, 0x6e, 0x46, 0x6c, 0x6f, 0x61, 0x74, 0x52, 0x10, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79,
+	0x55, 0x73, 0x61, 0x67, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x22, 0x23, 0x0a, 0x0b, 0x50, 0x6c,
+	0x75, 0x67, 0x69, 0x6e, 0x46, 0x6c, 0x6f, 0x61, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x02, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22,
+	0x0f, 0x0a, 0x0d, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65,
+	0x32, 0xb7, 0x01, 0x0a, 0x10, 0x41, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x65, 0x72, 0x50,
+	0x6c, 0x75, 0x67, 0x69, 0x6e, 0x12, 0x5c, 0x0a, 0x09, 0x4e, 0x65, 0x67, 0x6f, 0x74, 0x69, 0x61,
+	0x74, 0x65, 0x12, 0x26, 0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67,
+	0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4e, 0x65, 0x67, 0x6f, 0x74, 0x69,
+	0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x27, 0x2e, 0x61, 0x75, 0x74,
+	0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67,
+	0x69, 0x6e, 0x4e, 0x65, 0x67, 0x6f, 0x74, 0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x45, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1d,
+	0x2e, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e,
+	0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e,
+	0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50,
+	0x6c, 0x75, 0x67, 0x69, 0x6e, 0x52, 0x65, 0x70, 0x6c, 0x79, 0x42, 0x2d, 0x5a, 0x2b, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6e, 0x65, 0x6f, 0x6e, 0x64, 0x61, 0x74,
+	0x61, 0x62, 0x61, 0x73, 0x65, 0x2f, 0x61, 0x75, 0x74, 0x6f, 0x73, 0x63, 0x61, 0x6c, 0x69, 0x6e,
+	0x67, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x61, 0x70, 0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
+}
+
+var (
+	file_pkg_api_plugin_proto_rawDescOnce sync.Once
+	file_pkg_api_plugin_proto_rawDescData = file_pkg_api_plugin_proto_rawDesc
+)
+
+func file_pkg_api_plugin_proto_rawDescGZIP() []byte {
+	file_pkg_api_plugin_proto_rawDescOnce.Do(func() {
+		file_pkg_api_plugin_proto_rawDescData = protoimpl.X.CompressGZIP(file_pkg_api_plugin_proto_rawDescData)
+	})
+	return file_pkg_api_plugin_proto_rawDescData
+}
+
+var file_pkg_api_plugin_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_pkg_api_plugin_proto_goTypes = []interface{}{
+	(*PluginNegotiateRequest)(nil),  // 0: autoscaling.v1.PluginNegotiateRequest
+	(*PluginNegotiateResponse)(nil), // 1: autoscaling.v1.PluginNegotiateResponse
+	(*PluginRequest)(nil),           // 2: autoscaling.v1.PluginRequest
+	(*PluginReply)(nil),             // 3: autoscaling.v1.PluginReply
+	(*PluginPod)(nil),               // 4: autoscaling.v1.PluginPod
+	(*PluginResources)(nil),         // 5: autoscaling.v1.PluginResources
+	(*PluginMetrics)(nil),           // 6: autoscaling.v1.PluginMetrics
+	(*PluginFloat)(nil),             // 7: autoscaling.v1.PluginFloat
+	(*PluginMigrate)(nil),           // 8: autoscaling.v1.PluginMigrate
+}
+var file_pkg_api_plugin_proto_depIdxs = []int32{
+	4,  // 0: autoscaling.v1.PluginRequest.pod:type_name -> autoscaling.v1.PluginPod
+	5,  // 1: autoscaling.v1.PluginRequest.compute_unit:type_name -> autoscaling.v1.PluginResources
+	5,  // 2: autoscaling.v1.PluginRequest.resources:type_name -> autoscaling.v1.PluginResources
+	5,  // 3: autoscaling.v1.PluginRequest.last_permit:type_name -> autoscaling.v1.PluginResources
+	6,  // 4: autoscaling.v1.PluginRequest.metrics:type_name -> autoscaling.v1.PluginMetrics
+	5,  // 5: autoscaling.v1.PluginReply.permit:type_name -> autoscaling.v1.PluginResources
+	8,  // 6: autoscaling.v1.PluginReply.migrate:type_name -> autoscaling.v1.PluginMigrate
+	7,  // 7: autoscaling.v1.PluginMetrics.load_average_5min:type_name -> autoscaling.v1.PluginFloat
+	7,  // 8: autoscaling.v1.PluginMetrics.memory_usage_bytes:type_name -> autoscaling.v1.PluginFloat
+	0,  // 9: autoscaling.v1.AutoscalerPlugin.Negotiate:input_type -> autoscaling.v1.PluginNegotiateRequest
+	2,  // 10: autoscaling.v1.AutoscalerPlugin.Request:input_type -> autoscaling.v1.PluginRequest
+	1,  // 11: autoscaling.v1.AutoscalerPlugin.Negotiate:output_type -> autoscaling.v1.PluginNegotiateResponse
+	3,  // 12: autoscaling.v1.AutoscalerPlugin.Request:output_type -> autoscaling.v1.PluginReply
+	11, // [11:13] is the sub-list for method output_type
+	9,  // [9:11] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_pkg_api_plugin_proto_init() }
+func file_pkg_api_plugin_proto_init() {
+	if File_pkg_api_plugin_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_pkg_api_plugin_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginNegotiateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginNegotiateResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginReply); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginPod); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginResources); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginMetrics); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginFloat); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_api_plugin_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PluginMigrate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_pkg_api_plugin_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pkg_api_plugin_proto_goTypes,
+		DependencyIndexes: file_pkg_api_plugin_proto_depIdxs,
+		MessageInfos:      file_pkg_api_plugin_proto_msgTypes,
+	}.Build()
+	File_pkg_api_plugin_proto = out.File
+	file_pkg_api_plugin_proto_rawDesc = nil
+	file_pkg_api_plugin_proto_goTypes = nil
+	file_pkg_api_plugin_proto_depIdxs = nil
+}
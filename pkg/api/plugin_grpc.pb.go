@@ -0,0 +1,154 @@
+// gRPC service for the agent<->scheduler plugin protocol. See grpc.go.
+//
+// Generate the Go code with 'make generate' after changing this file.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pkg/api/plugin.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	AutoscalerPlugin_Negotiate_FullMethodName = "/autoscaling.v1.AutoscalerPlugin/Negotiate"
+	AutoscalerPlugin_Request_FullMethodName   = "/autoscaling.v1.AutoscalerPlugin/Request"
+)
+
+// AutoscalerPluginClient is the client API for AutoscalerPlugin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AutoscalerPluginClient interface {
+	// Negotiate is called by the autoscaler-agent when it first connects, before any other requests
+	Negotiate(ctx context.Context, in *PluginNegotiateRequest, opts ...grpc.CallOption) (*PluginNegotiateResponse, error)
+	// Request is the gRPC equivalent of the scheduler plugin's HTTP endpoint
+	Request(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*PluginReply, error)
+}
+
+type autoscalerPluginClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAutoscalerPluginClient(cc grpc.ClientConnInterface) AutoscalerPluginClient {
+	return &autoscalerPluginClient{cc}
+}
+
+func (c *autoscalerPluginClient) Negotiate(ctx context.Context, in *PluginNegotiateRequest, opts ...grpc.CallOption) (*PluginNegotiateResponse, error) {
+	out := new(PluginNegotiateResponse)
+	err := c.cc.Invoke(ctx, AutoscalerPlugin_Negotiate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *autoscalerPluginClient) Request(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*PluginReply, error) {
+	out := new(PluginReply)
+	err := c.cc.Invoke(ctx, AutoscalerPlugin_Request_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AutoscalerPluginServer is the server API for AutoscalerPlugin service.
+// All implementations must embed UnimplementedAutoscalerPluginServer
+// for forward compatibility
+type AutoscalerPluginServer interface {
+	// Negotiate is called by the autoscaler-agent when it first connects, before any other requests
+	Negotiate(context.Context, *PluginNegotiateRequest) (*PluginNegotiateResponse, error)
+	// Request is the gRPC equivalent of the scheduler plugin's HTTP endpoint
+	Request(context.Context, *PluginRequest) (*PluginReply, error)
+	mustEmbedUnimplementedAutoscalerPluginServer()
+}
+
+// UnimplementedAutoscalerPluginServer must be embedded to have forward compatible implementations.
+type UnimplementedAutoscalerPluginServer struct {
+}
+
+func (UnimplementedAutoscalerPluginServer) Negotiate(context.Context, *PluginNegotiateRequest) (*PluginNegotiateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Negotiate not implemented")
+}
+func (UnimplementedAutoscalerPluginServer) Request(context.Context, *PluginRequest) (*PluginReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Request not implemented")
+}
+func (UnimplementedAutoscalerPluginServer) mustEmbedUnimplementedAutoscalerPluginServer() {}
+
+// UnsafeAutoscalerPluginServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AutoscalerPluginServer will
+// result in compilation errors.
+type UnsafeAutoscalerPluginServer interface {
+	mustEmbedUnimplementedAutoscalerPluginServer()
+}
+
+func RegisterAutoscalerPluginServer(s grpc.ServiceRegistrar, srv AutoscalerPluginServer) {
+	s.RegisterService(&AutoscalerPlugin_ServiceDesc, srv)
+}
+
+func _AutoscalerPlugin_Negotiate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PluginNegotiateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AutoscalerPluginServer).Negotiate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AutoscalerPlugin_Negotiate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AutoscalerPluginServer).Negotiate(ctx, req.(*PluginNegotiateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AutoscalerPlugin_Request_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PluginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AutoscalerPluginServer).Request(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AutoscalerPlugin_Request_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AutoscalerPluginServer).Request(ctx, req.(*PluginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AutoscalerPlugin_ServiceDesc is the grpc.ServiceDesc for AutoscalerPlugin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AutoscalerPlugin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "autoscaling.v1.AutoscalerPlugin",
+	HandlerType: (*AutoscalerPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Negotiate",
+			Handler:    _AutoscalerPlugin_Negotiate_Handler,
+		},
+		{
+			MethodName: "Request",
+			Handler:    _AutoscalerPlugin_Request_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/api/plugin.proto",
+}
@@ -0,0 +1,111 @@
+package api
+
+// Coordinated restarts of Postgres inside a VM, carried out by the vm-monitor at the request of the
+// autoscaler-agent, so that settings that only take effect after a restart (like shared_buffers)
+// can follow large changes to the VM's memory.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tychoish/fun/erc"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CoordinatedRestart asks for Postgres in the VM to be restarted, during the VM's maintenance
+// window. It's set by the AnnotationRestartRequest annotation.
+//
+// For example, to restart with a larger shared_buffers between 02:00 and 04:00 UTC:
+//
+//	{"id": "resize-2024-05-01", "settings": {"shared_buffers": "1GB"}, "window": {"start": "02:00", "end": "04:00"}}
+//
+// Each restart is carried out at most once, so to restart again, the ID must be changed. Progress
+// is written by the autoscaler-agent to the VM's .status.postgresRestart.
+type CoordinatedRestart struct {
+	// ID identifies the restart
+	ID string `json:"id"`
+	// Settings maps the names of Postgres settings to the values they should be set to before
+	// restarting. These take priority over the memory-sized settings that the autoscaler-agent is
+	// configured to send with each restart.
+	Settings map[string]string `json:"settings,omitempty"`
+	// Timezone gives the IANA name of the timezone that the window is in. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// Window, if provided, gives the maintenance window that the restart may happen in. Otherwise,
+	// the restart happens as soon as possible.
+	Window *MaintenanceWindow `json:"window,omitempty"`
+
+	// location is the loaded Timezone, cached by Validate
+	location *time.Location
+}
+
+// MaintenanceWindow is a recurring window of time during which disruptive operations may happen
+type MaintenanceWindow struct {
+	// Days gives the days of the week that the window starts on, as their lowercase three-letter
+	// abbreviations (e.g. "mon"). If empty, the window applies every day.
+	Days []string `json:"days,omitempty"`
+	// Start gives the time of day, formatted like "02:00", at which the window begins
+	Start string `json:"start"`
+	// End gives the time of day, formatted like "04:00", at which the window ends. If End is before
+	// Start, the window continues past midnight, into the next day.
+	End string `json:"end"`
+}
+
+func (r *CoordinatedRestart) Validate() error {
+	ec := &erc.Collector{}
+
+	erc.Whenf(ec, r.ID == "", "%s must not be empty", ".id")
+
+	location, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		ec.Add(fmt.Errorf("%s is not a valid timezone: %w", ".timezone", err))
+	} else {
+		r.location = location
+	}
+
+	if w := r.Window; w != nil {
+		validateDailyWindow(ec, ".window", w.Days, w.Start, w.End)
+	}
+
+	// heads-up! some functions elsewhere depend on the concrete return type of this function.
+	return ec.Resolve()
+}
+
+// InWindow returns whether the restart may happen at the given time
+//
+// The restart must have been validated.
+func (r *CoordinatedRestart) InWindow(now time.Time) bool {
+	if r.Window == nil {
+		return true
+	}
+
+	location := r.location
+	if location == nil {
+		var err error
+		if location, err = time.LoadLocation(r.Timezone); err != nil {
+			panic(fmt.Errorf("coordinated restart has invalid timezone %q: %w", r.Timezone, err))
+		}
+	}
+
+	return inDailyWindow(r.Window.Days, r.Window.Start, r.Window.End, now.In(location))
+}
+
+// ExtractCoordinatedRestart returns the restart requested by the object's AnnotationRestartRequest
+// annotation, or nil if it doesn't have one
+func ExtractCoordinatedRestart(obj metav1.ObjectMetaAccessor) (*CoordinatedRestart, error) {
+	restartJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationRestartRequest]
+	if !ok {
+		return nil, nil
+	}
+
+	var restart CoordinatedRestart
+	if err := json.Unmarshal([]byte(restartJSON), &restart); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationRestartRequest, err)
+	}
+
+	if err := restart.Validate(); err != nil {
+		return nil, fmt.Errorf("Bad restart request in annotation %q: %w", AnnotationRestartRequest, err)
+	}
+	return &restart, nil
+}
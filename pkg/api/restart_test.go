@@ -0,0 +1,95 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func restartTestVM(annotations map[string]string) *vmapi.VirtualMachine {
+	vm := new(vmapi.VirtualMachine)
+	vm.Namespace = "default"
+	vm.Name = "vm"
+	vm.Annotations = annotations
+	return vm
+}
+
+func TestExtractCoordinatedRestart(t *testing.T) {
+	restart, err := api.ExtractCoordinatedRestart(restartTestVM(nil))
+	require.NoError(t, err)
+	assert.Nil(t, restart)
+
+	restart, err = api.ExtractCoordinatedRestart(restartTestVM(map[string]string{
+		api.AnnotationRestartRequest: `{"id": "resize", "settings": {"shared_buffers": "1GB"}, "window": {"start": "02:00", "end": "04:00"}}`,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "resize", restart.ID)
+	assert.Equal(t, map[string]string{"shared_buffers": "1GB"}, restart.Settings)
+	assert.Equal(t, &api.MaintenanceWindow{Days: nil, Start: "02:00", End: "04:00"}, restart.Window)
+
+	cases := []struct {
+		name        string
+		annotation  string
+		errContains string
+	}{
+		{"bad-json", `{"id": `, "Error unmarshaling"},
+		{"no-id", `{"settings": {"shared_buffers": "1GB"}}`, ".id must not be empty"},
+		{"bad-timezone", `{"id": "resize", "timezone": "Nowhere/Special"}`, ".timezone is not a valid timezone"},
+		{"bad-day", `{"id": "resize", "window": {"days": ["monday"], "start": "02:00", "end": "04:00"}}`, ".window.days[0] must be a day"},
+		{"bad-time", `{"id": "resize", "window": {"start": "2am", "end": "04:00"}}`, ".window.start must be a time"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := api.ExtractCoordinatedRestart(restartTestVM(map[string]string{
+				api.AnnotationRestartRequest: c.annotation,
+			}))
+			assert.ErrorContains(t, err, c.errContains)
+		})
+	}
+}
+
+func TestCoordinatedRestartInWindow(t *testing.T) {
+	// 2024-05-01 is a Wednesday
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.UTC)
+	}
+	restart := func(timezone string, window *api.MaintenanceWindow) *api.CoordinatedRestart {
+		r := &api.CoordinatedRestart{ID: "resize", Settings: nil, Timezone: timezone, Window: window}
+		require.NoError(t, r.Validate())
+		return r
+	}
+
+	// Without a window, the restart can happen at any time
+	assert.True(t, restart("", nil).InWindow(at(12, 0)))
+
+	// The start of the window is included, and the end isn't
+	daily := restart("", &api.MaintenanceWindow{Days: nil, Start: "02:00", End: "04:00"})
+	assert.False(t, daily.InWindow(at(1, 59)))
+	assert.True(t, daily.InWindow(at(2, 0)))
+	assert.True(t, daily.InWindow(at(3, 59)))
+	assert.False(t, daily.InWindow(at(4, 0)))
+
+	// The window is in the restart's timezone: 02:00 in Tokyo is 17:00 UTC the day before
+	tokyo := restart("Asia/Tokyo", &api.MaintenanceWindow{Days: nil, Start: "02:00", End: "04:00"})
+	assert.False(t, tokyo.InWindow(at(2, 0)))
+	assert.True(t, tokyo.InWindow(at(17, 30)))
+
+	// A window past midnight is counted from the day that it starts on
+	overnight := restart("", &api.MaintenanceWindow{Days: []string{"tue"}, Start: "23:00", End: "01:00"})
+	assert.True(t, overnight.InWindow(at(0, 30)))
+	assert.False(t, overnight.InWindow(at(23, 30)))
+
+	// The timezone is loaded even if the restart wasn't validated
+	unvalidated := &api.CoordinatedRestart{
+		ID:       "resize",
+		Settings: nil,
+		Timezone: "Asia/Tokyo",
+		Window:   &api.MaintenanceWindow{Days: nil, Start: "02:00", End: "04:00"},
+	}
+	assert.True(t, unvalidated.InWindow(at(17, 30)))
+}
@@ -0,0 +1,151 @@
+package api
+
+// Scheduled bounds on a VM's compute units, so that known traffic patterns don't rely on reactive
+// scaling alone.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tychoish/fun/erc"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// ScalingSchedule gives the time windows during which the number of compute units a VM should have
+// is bounded, on top of its metrics. It's set by the AnnotationAutoscalingSchedule annotation.
+//
+// For example, to keep a VM at 4 CU or more during business hours:
+//
+//	{"timezone": "America/New_York", "windows": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "08:00", "end": "20:00", "minCU": 4}]}
+type ScalingSchedule struct {
+	// Timezone gives the IANA name of the timezone that the windows are in. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// Windows gives the time windows in the schedule. If the current time is in multiple windows,
+	// the first one is used.
+	Windows []ScheduleWindow `json:"windows"`
+
+	// location is the loaded Timezone, cached by Validate
+	location *time.Location
+}
+
+// ScheduleWindow is a single window in a ScalingSchedule
+type ScheduleWindow struct {
+	// Days gives the days of the week that the window starts on, as their lowercase three-letter
+	// abbreviations (e.g. "mon"). If empty, the window applies every day.
+	Days []string `json:"days,omitempty"`
+	// Start gives the time of day, formatted like "08:00", at which the window begins
+	Start string `json:"start"`
+	// End gives the time of day, formatted like "20:00", at which the window ends. If End is before
+	// Start, the window continues past midnight, into the next day.
+	End string `json:"end"`
+	// MinCU, if provided, gives the minimum number of compute units during the window
+	MinCU *uint16 `json:"minCU,omitempty"`
+	// MaxCU, if provided, gives the maximum number of compute units during the window
+	MaxCU *uint16 `json:"maxCU,omitempty"`
+}
+
+var weekdayAbbreviations = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (s *ScalingSchedule) Validate() error {
+	ec := &erc.Collector{}
+
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		ec.Add(fmt.Errorf("%s is not a valid timezone: %w", ".timezone", err))
+	} else {
+		s.location = location
+	}
+
+	erc.Whenf(ec, len(s.Windows) == 0, "%s must not be empty", ".windows")
+	for i, w := range s.Windows {
+		validateDailyWindow(ec, fmt.Sprintf(".windows[%d]", i), w.Days, w.Start, w.End)
+		erc.Whenf(ec, w.MinCU == nil && w.MaxCU == nil, "%s must set at least one of minCU or maxCU", fmt.Sprintf(".windows[%d]", i))
+		erc.Whenf(
+			ec, w.MinCU != nil && w.MaxCU != nil && *w.MinCU > *w.MaxCU,
+			"%s must not be greater than maxCU", fmt.Sprintf(".windows[%d].minCU", i),
+		)
+	}
+
+	// heads-up! some functions elsewhere depend on the concrete return type of this function.
+	return ec.Resolve()
+}
+
+// ActiveWindow returns the first window in the schedule that contains the time, or nil if there
+// is none.
+//
+// The schedule must have been validated.
+func (s *ScalingSchedule) ActiveWindow(now time.Time) *ScheduleWindow {
+	location := s.location
+	if location == nil {
+		// The schedule may have been copied through JSON, which doesn't keep the location.
+		var err error
+		if location, err = time.LoadLocation(s.Timezone); err != nil {
+			panic(fmt.Errorf("scaling schedule has invalid timezone %q: %w", s.Timezone, err))
+		}
+	}
+
+	local := now.In(location)
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if inDailyWindow(w.Days, w.Start, w.End, local) {
+			return w
+		}
+	}
+
+	return nil
+}
+
+// validateDailyWindow checks the days and times of a window that's used with inDailyWindow, adding
+// any errors to ec. path is the path of the window, like ".windows[0]".
+func validateDailyWindow(ec *erc.Collector, path string, days []string, start, end string) {
+	for j, day := range days {
+		_, ok := weekdayAbbreviations[day]
+		erc.Whenf(ec, !ok, "%s must be a day like \"mon\"", fmt.Sprintf("%s.days[%d]", path, j))
+	}
+	_, startErr := util.ParseTimeOfDay(start)
+	erc.Whenf(ec, startErr != nil, "%s must be a time formatted like \"08:00\"", path+".start")
+	_, endErr := util.ParseTimeOfDay(end)
+	erc.Whenf(ec, endErr != nil, "%s must be a time formatted like \"08:00\"", path+".end")
+}
+
+// inDailyWindow returns whether the local time is in the window from start until end, starting on
+// any of the days of the week (or every day, if days is empty). If end is before start, the window
+// continues past midnight, into the next day.
+//
+// The days and times must have been checked with validateDailyWindow.
+func inDailyWindow(days []string, start, end string, local time.Time) bool {
+	timeOfDay := util.TimeOfDay(local)
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	startTime, _ := util.ParseTimeOfDay(start)
+	endTime, _ := util.ParseTimeOfDay(end)
+
+	if startTime <= endTime {
+		return startTime <= timeOfDay && timeOfDay < endTime && startsOn(days, today)
+	}
+	// The window continues past midnight, so it might have started yesterday.
+	return (startTime <= timeOfDay && startsOn(days, today)) || (timeOfDay < endTime && startsOn(days, yesterday))
+}
+
+// startsOn returns whether a window with the days of the week starts on the day
+func startsOn(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if weekdayAbbreviations[d] == day {
+			return true
+		}
+	}
+	return false
+}
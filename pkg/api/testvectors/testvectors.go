@@ -0,0 +1,241 @@
+// Package testvectors provides canonical JSON encodings of the messages that the autoscaler-agent
+// exchanges with the scheduler plugin and the vm-monitor, so that changes to the types in pkg/api
+// can't silently break the wire format.
+//
+// The vectors are stored under vectors/, as <protocol>/<version>/<sender>/<message>.json. Once a
+// protocol version is released, its vectors must not be changed: they're kept so that we can check
+// that messages from components still using that version can be parsed.
+package testvectors
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+//go:embed vectors
+var files embed.FS
+
+// Protocol is one of the protocols that the autoscaler-agent uses
+type Protocol string
+
+const (
+	// ProtocolPlugin is the agent<->scheduler plugin protocol
+	ProtocolPlugin Protocol = "plugin"
+	// ProtocolMonitor is the agent<->monitor protocol
+	ProtocolMonitor Protocol = "monitor"
+)
+
+// Sender is the component that sends a message
+type Sender string
+
+const (
+	SenderAgent   Sender = "agent"
+	SenderPlugin  Sender = "plugin"
+	SenderMonitor Sender = "monitor"
+)
+
+// LatestVersions gives, for each protocol, the version whose vectors must exactly match the current
+// encoding of each message.
+var LatestVersions = map[Protocol]string{
+	ProtocolPlugin:  api.PluginProtoV5_4.String(),
+	ProtocolMonitor: api.MonitorProtoVersion(api.MonitorProtoV1_1).String(),
+}
+
+// Vector is the canonical encoding of a single message
+type Vector struct {
+	Protocol Protocol
+	// Version is the protocol version that the message is from, formatted like "v5.1"
+	Version string
+	Sender  Sender
+	// Message is the name of the message's type in pkg/api, e.g. "AgentRequest"
+	Message string
+	// JSON is the encoded message
+	JSON []byte
+}
+
+// Name returns a name that uniquely identifies the vector, e.g. "plugin/v5.1/agent/AgentRequest"
+func (v Vector) Name() string {
+	return path.Join(string(v.Protocol), v.Version, string(v.Sender), v.Message)
+}
+
+// IsLatest returns whether the vector is from the latest version of its protocol
+func (v Vector) IsLatest() bool {
+	return LatestVersions[v.Protocol] == v.Version
+}
+
+// All returns the vectors for every version of every protocol
+func All() ([]Vector, error) {
+	var vectors []Vector
+
+	err := fs.WalkDir(files, "vectors", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(p, "vectors/"), ".json"), "/")
+		if len(parts) != 4 || !strings.HasSuffix(p, ".json") {
+			return fmt.Errorf("Unexpected test vector path %q", p)
+		}
+
+		data, err := files.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("Error reading test vector %q: %w", p, err)
+		}
+
+		vectors = append(vectors, Vector{
+			Protocol: Protocol(parts[0]),
+			Version:  parts[1],
+			Sender:   Sender(parts[2]),
+			Message:  parts[3],
+			JSON:     data,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vectors, nil
+}
+
+// Latest returns the vectors for the latest version of every protocol
+func Latest() ([]Vector, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var latest []Vector
+	for _, v := range all {
+		if v.IsLatest() {
+			latest = append(latest, v)
+		}
+	}
+	return latest, nil
+}
+
+// monitorBundle is the envelope around messages sent by the autoscaler-agent to the vm-monitor,
+// matching api.SerializeMonitorMessage
+type monitorBundle struct {
+	Content json.RawMessage `json:"content"`
+	Type    string          `json:"type"`
+	Id      uint64          `json:"id"`
+}
+
+// newMessage returns a pointer to a new zero value of the message's type
+func (v Vector) newMessage() (any, error) {
+	switch v.Protocol {
+	case ProtocolPlugin:
+		switch v.Message {
+		case "AgentRequest":
+			return new(api.AgentRequest), nil
+		case "PluginResponse":
+			return new(api.PluginResponse), nil
+		}
+	case ProtocolMonitor:
+		switch v.Message {
+		case "VersionRange":
+			return new(api.VersionRange[api.MonitorProtoVersion]), nil
+		case "MonitorHandshake":
+			return new(api.MonitorHandshake), nil
+		case "MonitorProtocolResponse":
+			return new(api.MonitorProtocolResponse), nil
+		case "UpscaleRequest":
+			return new(api.UpscaleRequest), nil
+		case "UpscaleConfirmation":
+			return new(api.UpscaleConfirmation), nil
+		case "DownscaleResult":
+			return new(api.DownscaleResult), nil
+		case "UpscaleNotification":
+			return new(api.UpscaleNotification), nil
+		case "DownscaleRequest":
+			return new(api.DownscaleRequest), nil
+		case "FileCacheResizeRequest":
+			return new(api.FileCacheResizeRequest), nil
+		case "FileCacheResizeResult":
+			return new(api.FileCacheResizeResult), nil
+		case "PostgresRestartRequest":
+			return new(api.PostgresRestartRequest), nil
+		case "PostgresRestartResult":
+			return new(api.PostgresRestartResult), nil
+		case "MemoryPressureSignal":
+			return new(api.MemoryPressureSignal), nil
+		case "InvalidMessage":
+			return new(api.InvalidMessage), nil
+		case "InternalError":
+			return new(api.InternalError), nil
+		case "HealthCheck":
+			return new(api.HealthCheck), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown message %q for protocol %q", v.Message, v.Protocol)
+}
+
+// isNegotiation returns whether the message is part of the agent<->monitor protocol version
+// negotiation, which is sent without any envelope.
+func (v Vector) isNegotiation() bool {
+	return v.Protocol == ProtocolMonitor && (v.Message == "VersionRange" || v.Message == "MonitorHandshake" || v.Message == "MonitorProtocolResponse")
+}
+
+// Decode parses the vector in the same way as its receiver, returning the message (not a pointer
+// to it).
+func (v Vector) Decode() (any, error) {
+	value, err := v.newMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	data := v.JSON
+
+	if v.Protocol == ProtocolMonitor && !v.isNegotiation() {
+		var bundle monitorBundle
+		if err := json.Unmarshal(v.JSON, &bundle); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling message envelope: %w", err)
+		}
+		if bundle.Type != v.Message {
+			return nil, fmt.Errorf("Message has type %q, expected %q", bundle.Type, v.Message)
+		}
+
+		// The agent wraps its messages in an envelope, while the vm-monitor puts the message's
+		// fields alongside the type and id. The agent decodes the entire message, as-is.
+		if v.Sender == SenderAgent {
+			data = bundle.Content
+		}
+	}
+
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling %s: %w", v.Message, err)
+	}
+
+	return reflect.ValueOf(value).Elem().Interface(), nil
+}
+
+// Encode encodes the message in the same way as the vector's sender, for comparison with the
+// vector's JSON.
+//
+// The vm-monitor isn't part of this repository, so this returns an error for messages it sends.
+func (v Vector) Encode(message any) ([]byte, error) {
+	if v.Sender == SenderMonitor {
+		return nil, errors.New("Messages sent by the vm-monitor are not encoded here")
+	}
+
+	if v.Protocol == ProtocolMonitor && !v.isNegotiation() {
+		// Reuse the id from the vector, so the output can be compared.
+		var bundle monitorBundle
+		if err := json.Unmarshal(v.JSON, &bundle); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling message envelope: %w", err)
+		}
+		return api.SerializeMonitorMessage(message, bundle.Id)
+	}
+
+	return json.Marshal(message)
+}
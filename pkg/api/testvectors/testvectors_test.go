@@ -0,0 +1,212 @@
+package testvectors_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/api/testvectors"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// expected gives the value of every message in the latest version of each protocol
+var expected = map[string]any{
+	"plugin/v5.4/agent/AgentRequest": api.AgentRequest{
+		ProtoVersion: api.PluginProtoV5_4,
+		Pod:          util.NamespacedName{Namespace: "default", Name: "compute-quiet-sun-123456"},
+		ComputeUnit:  api.Resources{VCPU: 250, Mem: 1 << 30},
+		// A suspended VM gives up its vCPUs, but keeps its memory
+		Resources:  api.Resources{VCPU: 0, Mem: 1 << 30},
+		LastPermit: &api.Resources{VCPU: 250, Mem: 1 << 30},
+		Metrics: &api.Metrics{
+			LoadAverage1Min:  0,
+			LoadAverage5Min:  nil,
+			MemoryUsageBytes: nil,
+		},
+		Priority: 10,
+	},
+	"plugin/v5.4/plugin/PluginResponse": api.PluginResponse{
+		Permit:       api.Resources{VCPU: 0, Mem: 1 << 30},
+		Migrate:      nil,
+		DeniedReason: "",
+	},
+
+	"monitor/v1.1/agent/MonitorHandshake": api.MonitorHandshake{
+		Min:          api.MonitorProtoV1_0,
+		Max:          api.MonitorProtoV1_1,
+		Capabilities: api.MonitorCapFileCacheResize | api.MonitorCapCgroupV2,
+	},
+	"monitor/v1.1/agent/DownscaleRequest": api.DownscaleRequest{
+		Target: api.Allocation{Cpu: 0.5, Mem: 2 << 30},
+	},
+	"monitor/v1.1/agent/UpscaleNotification": api.UpscaleNotification{
+		Granted: api.Allocation{Cpu: 2, Mem: 8 << 30},
+	},
+	"monitor/v1.1/agent/FileCacheResizeRequest": api.FileCacheResizeRequest{
+		Size:     3 << 30,
+		Settings: map[string]string{"effective_cache_size": "3145728kB"},
+	},
+	"monitor/v1.1/agent/PostgresRestartRequest": api.PostgresRestartRequest{
+		ID:                  "resize-2024-05-01",
+		Settings:            map[string]string{"shared_buffers": "1048576kB"},
+		DrainTimeoutSeconds: 30,
+	},
+	"monitor/v1.1/agent/InvalidMessage": api.InvalidMessage{Error: `unknown message type "Foo"`},
+	"monitor/v1.1/agent/InternalError":  api.InternalError{Error: "failed to apply upscale"},
+	"monitor/v1.1/agent/HealthCheck":    api.HealthCheck{},
+
+	"monitor/v1.1/monitor/MonitorProtocolResponse": api.MonitorProtocolResponse{
+		Version:      api.MonitorProtoV1_1,
+		Capabilities: api.MonitorCapFileCacheResize,
+		Error:        nil,
+	},
+	"monitor/v1.1/monitor/UpscaleRequest":      api.UpscaleRequest{},
+	"monitor/v1.1/monitor/UpscaleConfirmation": api.UpscaleConfirmation{},
+	"monitor/v1.1/monitor/DownscaleResult": api.DownscaleResult{
+		Ok:     true,
+		Status: "downscaled file cache to 1 GiB",
+	},
+	"monitor/v1.1/monitor/FileCacheResizeResult": api.FileCacheResizeResult{
+		Ok:     true,
+		Status: "resized file cache to 3 GiB",
+	},
+	"monitor/v1.1/monitor/PostgresRestartResult": api.PostgresRestartResult{
+		Ok:     true,
+		Status: "restarted postgres in 4.2s",
+	},
+	"monitor/v1.1/monitor/MemoryPressureSignal": api.MemoryPressureSignal{
+		AtRisk: true,
+		Reason: "memory.high throttled for 12s",
+	},
+	"monitor/v1.1/monitor/InvalidMessage": api.InvalidMessage{Error: "unknown variant `Foo`"},
+	"monitor/v1.1/monitor/InternalError":  api.InternalError{Error: "failed to set cgroup memory limit"},
+	"monitor/v1.1/monitor/HealthCheck":    api.HealthCheck{},
+}
+
+// Checks that the latest vectors decode to the expected values, and that the messages we send are
+// encoded exactly as in the vectors
+func TestRoundTrip(t *testing.T) {
+	vectors, err := testvectors.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]struct{})
+	for _, v := range vectors {
+		t.Run(v.Name(), func(t *testing.T) {
+			seen[v.Name()] = struct{}{}
+
+			want, ok := expected[v.Name()]
+			if !ok {
+				t.Fatal("no expected value for test vector")
+			}
+
+			got, err := v.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, got)
+
+			if v.Sender == testvectors.SenderMonitor {
+				return
+			}
+
+			encoded, err := v.Encode(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var canonical bytes.Buffer
+			if err := json.Compact(&canonical, v.JSON); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, canonical.String(), string(encoded))
+		})
+	}
+
+	for name := range expected {
+		if _, ok := seen[name]; !ok {
+			t.Errorf("missing test vector %s", name)
+		}
+	}
+}
+
+// Checks that the vectors from every protocol version, including old ones, can still be parsed
+func TestCompatibility(t *testing.T) {
+	vectors, err := testvectors.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range vectors {
+		t.Run(v.Name(), func(t *testing.T) {
+			got, err := v.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The plugin uses the version in the request to decide how to respond, so it must match
+			// the version the vector is from.
+			if req, ok := got.(api.AgentRequest); ok {
+				assert.Equal(t, v.Version, req.ProtoVersion.String())
+			}
+		})
+	}
+}
+
+// Checks that every vector is named in the expected layout, and that every protocol has vectors for
+// its latest version
+func TestVectorLayout(t *testing.T) {
+	vectors, err := testvectors.All()
+	require.NoError(t, err)
+
+	latest := make(map[testvectors.Protocol]bool)
+	names := make(map[string]struct{})
+	for _, v := range vectors {
+		assert.Contains(t, testvectors.LatestVersions, v.Protocol, "vector %s", v.Name())
+		assert.Contains(t, []testvectors.Sender{testvectors.SenderAgent, testvectors.SenderPlugin, testvectors.SenderMonitor}, v.Sender, "vector %s", v.Name())
+		assert.Regexp(t, `^v\d+\.\d+$`, v.Version, "vector %s", v.Name())
+
+		_, duplicate := names[v.Name()]
+		assert.False(t, duplicate, "duplicate vector %s", v.Name())
+		names[v.Name()] = struct{}{}
+
+		if v.IsLatest() {
+			latest[v.Protocol] = true
+		}
+	}
+
+	for protocol := range testvectors.LatestVersions {
+		assert.True(t, latest[protocol], "no vectors for latest version of protocol %s", protocol)
+	}
+}
+
+// Checks that the envelope around monitor messages is checked when decoding, and that the vm-monitor's
+// messages can't be encoded here
+func TestMonitorEnvelope(t *testing.T) {
+	v := testvectors.Vector{
+		Protocol: testvectors.ProtocolMonitor,
+		Version:  testvectors.LatestVersions[testvectors.ProtocolMonitor],
+		Sender:   testvectors.SenderAgent,
+		Message:  "DownscaleRequest",
+		JSON:     []byte(`{"type":"UpscaleNotification","id":1,"content":{"granted":{"cpu":1,"mem":1}}}`),
+	}
+	_, err := v.Decode()
+	assert.ErrorContains(t, err, `expected "DownscaleRequest"`)
+
+	// The agent's messages are wrapped, with the original id kept when encoding
+	encoded, err := v.Encode(api.DownscaleRequest{Target: api.Allocation{Cpu: 1, Mem: 1}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"DownscaleRequest","id":1,"content":{"target":{"cpu":1,"mem":1}}}`, string(encoded))
+
+	v.Sender = testvectors.SenderMonitor
+	_, err = v.Encode(api.DownscaleResult{Ok: true, Status: ""})
+	assert.Error(t, err)
+
+	v.Message = "NotAMessage"
+	_, err = v.Decode()
+	assert.ErrorContains(t, err, "Unknown message")
+}
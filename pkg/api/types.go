@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"go.uber.org/zap/zapcore"
 
@@ -87,9 +88,44 @@ const (
 	//
 	// * Removed AgentRequest.metrics fields loadAvg5M and memoryUsageBytes
 	//
-	// Currently the latest version.
+	// Last used in release version v0.28.0.
 	PluginProtoV5_0
 
+	// PluginProtoV5_1 represents v5.1 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.0:
+	//
+	// * The scheduler plugin may permit increases for a VM that's currently migrating (instead of
+	//   rejecting any change), reserving the increase on both the source and target nodes.
+	PluginProtoV5_1
+
+	// PluginProtoV5_2 represents v5.2 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.1:
+	//
+	// * Added AgentRequest.priority, which the scheduler plugin uses to decide which VMs may take
+	//   the last of a node's resources.
+	PluginProtoV5_2
+
+	// PluginProtoV5_3 represents v5.3 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.2:
+	//
+	// * Added PluginResponse.deniedReason, which gives the reason that a requested increase was
+	//   not fully permitted, if it was because of a policy rather than lack of node resources.
+	PluginProtoV5_3
+
+	// PluginProtoV5_4 represents v5.4 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.3:
+	//
+	// * The autoscaler-agent may request zero vCPUs while its VM is suspended (see
+	//   ScaleToZeroConfig). Once the VM is resumed, the scheduler plugin reserves the vCPUs that the
+	//   autoscaler-agent asks for back, even if that overcommits the node.
+	//
+	// Currently the latest version.
+	PluginProtoV5_4
+
 	// latestPluginProtoVersion represents the latest version of the agent<->scheduler plugin
 	// protocol
 	//
@@ -119,6 +155,14 @@ func (v PluginProtoVersion) String() string {
 		return "v4.0"
 	case PluginProtoV5_0:
 		return "v5.0"
+	case PluginProtoV5_1:
+		return "v5.1"
+	case PluginProtoV5_2:
+		return "v5.2"
+	case PluginProtoV5_3:
+		return "v5.3"
+	case PluginProtoV5_4:
+		return "v5.4"
 	default:
 		diff := v - latestPluginProtoVersion
 		return fmt.Sprintf("<unknown = %v + %d>", latestPluginProtoVersion, diff)
@@ -174,6 +218,39 @@ func (v PluginProtoVersion) IncludesExtendedMetrics() bool {
 	return v < PluginProtoV5_0
 }
 
+// AllowsIncreaseDuringMigration returns whether this version of the protocol allows the scheduler
+// plugin to permit increases in resources for a VM that's currently migrating.
+//
+// This is true for version v5.1 and greater.
+func (v PluginProtoVersion) AllowsIncreaseDuringMigration() bool {
+	return v >= PluginProtoV5_1
+}
+
+// AgentSendsPriority returns whether this version of the protocol expects the autoscaler-agent to
+// send the VM's priority in its AgentRequest.
+//
+// This is true for version v5.2 and greater.
+func (v PluginProtoVersion) AgentSendsPriority() bool {
+	return v >= PluginProtoV5_2
+}
+
+// PluginSendsDeniedReason returns whether this version of the protocol allows the scheduler plugin
+// to send PluginResponse.DeniedReason.
+//
+// This is true for version v5.3 and greater.
+func (v PluginProtoVersion) PluginSendsDeniedReason() bool {
+	return v >= PluginProtoV5_3
+}
+
+// AllowsSuspendedCPU returns whether this version of the protocol allows the autoscaler-agent to
+// request zero vCPUs for a suspended VM, and requires the scheduler plugin to reserve them again
+// once it's resumed.
+//
+// This is true for version v5.4 and greater.
+func (v PluginProtoVersion) AllowsSuspendedCPU() bool {
+	return v >= PluginProtoV5_4
+}
+
 // AgentRequest is the type of message sent from an autoscaler-agent to the scheduler plugin
 //
 // All AgentRequests expect a PluginResponse.
@@ -195,6 +272,9 @@ type AgentRequest struct {
 	// The requested amount MAY be equal to the current amount, in which case it serves as a
 	// notification that the VM should no longer be contributing to resource pressure.
 	//
+	// While the VM is suspended, the requested vCPUs are zero. This is only allowed in protocol
+	// versions v5.4 and greater.
+	//
 	// TODO: allow passing nil here if nothing's changed (i.e., the request would be the same as the
 	// previous request)
 	Resources Resources `json:"resources"`
@@ -207,6 +287,11 @@ type AgentRequest struct {
 	//
 	// In some protocol versions, this field may be nil.
 	Metrics *Metrics `json:"metrics"`
+	// Priority gives the VM's priority, from AnnotationAutoscalingPriority. When a node is close to
+	// full, the scheduler plugin reserves the remaining resources for VMs with higher priority.
+	//
+	// Only present in protocol versions v5.2 and greater; zero otherwise.
+	Priority int32 `json:"priority,omitempty"`
 }
 
 // Metrics gives the information pulled from vector.dev that the scheduler may use to prioritize
@@ -379,6 +464,17 @@ func (r Resources) Mul(factor uint16) Resources {
 	}
 }
 
+// ComputeUnits returns the number of compute units that r corresponds to, using whichever resource
+// is the larger fraction of a compute unit. If computeUnit has a zero field, this returns zero.
+func (r Resources) ComputeUnits(computeUnit Resources) float64 {
+	if computeUnit.VCPU == 0 || computeUnit.Mem == 0 {
+		return 0
+	}
+	cpu := float64(r.VCPU) / float64(computeUnit.VCPU)
+	mem := float64(r.Mem) / float64(computeUnit.Mem)
+	return util.Max(cpu, mem)
+}
+
 // AbsDiff returns a new Resources with each field F as the absolute value of the difference between
 // r.F and cmp.F
 func (r Resources) AbsDiff(cmp Resources) Resources {
@@ -419,8 +515,24 @@ type PluginResponse struct {
 	// Migrate, if present, notifies the autoscaler-agent that its VM will be migrated away,
 	// alongside whatever other information may be useful.
 	Migrate *MigrateResponse `json:"migrate,omitempty"`
+
+	// DeniedReason, if not empty, gives the reason that the Permit is less than the requested
+	// resources, when it's because of a policy (e.g. a budget) rather than the node being full.
+	//
+	// Only present in protocol versions v5.3 and greater.
+	DeniedReason PermitDeniedReason `json:"deniedReason,omitempty"`
 }
 
+// PermitDeniedReason is the reason that the scheduler plugin did not fully permit a requested
+// increase. See PluginResponse.DeniedReason.
+type PermitDeniedReason string
+
+const (
+	// PermitDeniedTenantBudget means that the increase would have exceeded the total compute units
+	// allowed for all of the VMs belonging to the VM's tenant.
+	PermitDeniedTenantBudget PermitDeniedReason = "tenantBudget"
+)
+
 // MigrateResponse, when provided, is a notification to the autsocaler-agent that it will migrate
 //
 // After receiving a MigrateResponse, the autoscaler-agent MUST NOT change its resource allocation.
@@ -462,24 +574,71 @@ type VCPUChange struct {
 	VCPUs vmapi.MilliCPU
 }
 
+// SnapshotDelete is used by the controller to ask the runner to remove the copies of the disks
+// taken by a VirtualMachineSnapshot
+type SnapshotDelete struct {
+	Name  string
+	Disks []string
+}
+
 // VCPUCgroup is used in runner to reply to controller
 // it represents the vCPU usage as controlled by cgroup
 type VCPUCgroup struct {
 	VCPUs vmapi.MilliCPU
 }
 
+// NetworkUsage is used in runner to reply to the autoscaler-agent
+// it represents the total bytes sent by the VM, split by the class of destination
+type NetworkUsage struct {
+	InternalBytes uint64
+	InternetBytes uint64
+	// Interfaces gives the usage of each of the VM's network interfaces, keyed by "default" for the
+	// pod network, and otherwise by the name in .spec.additionalNetworks.
+	//
+	// Traffic on additional networks isn't included in InternalBytes or InternetBytes. Older
+	// runners don't report this.
+	Interfaces map[string]InterfaceUsage
+	// InboundConnections is the total number of connections made to the guest's ports from outside
+	// the pod, including while the VM is paused. Older runners don't report this.
+	InboundConnections *uint64 `json:",omitempty"`
+}
+
+// InterfaceUsage is the total bytes sent and received by the VM on one of its network interfaces
+type InterfaceUsage struct {
+	SentBytes     uint64
+	ReceivedBytes uint64
+}
+
 // this a similar version type for controller <-> runner communications
 // see PluginProtoVersion comment for details
 type RunnerProtoVersion uint32
 
 const (
 	RunnerProtoV1 RunnerProtoVersion = iota + 1
+
+	// RunnerProtoV2 adds the runner's /guest_info endpoint
+	RunnerProtoV2
+
+	// RunnerProtoV3 adds the runner's /console endpoint
+	RunnerProtoV3
 )
 
 func (v RunnerProtoVersion) SupportsCgroupFractionalCPU() bool {
 	return v >= RunnerProtoV1
 }
 
+// SupportsGuestInfo returns whether this version of the runner can report the versions of the
+// software in the guest, with the /guest_info endpoint
+func (v RunnerProtoVersion) SupportsGuestInfo() bool {
+	return v >= RunnerProtoV2
+}
+
+// SupportsConsole returns whether this version of the runner can stream the output of the VM's
+// serial console, with the /console endpoint
+func (v RunnerProtoVersion) SupportsConsole() bool {
+	return v >= RunnerProtoV3
+}
+
 ////////////////////////////////////
 //   Agent <-> Monitor Messages   //
 ////////////////////////////////////
@@ -511,6 +670,44 @@ type UpscaleConfirmation struct{}
 type DownscaleResult struct {
 	Ok     bool
 	Status string
+	// RetryAfterSeconds, if non-zero when Ok is false, means that the monitor vetoed the downscale
+	// for now (e.g. because of long-running transactions), with Status giving the reason. The
+	// agent will wait this long before retrying, instead of its usual cooldown.
+	//
+	// Added in v1.1, only sent to agents with MonitorCapDownscaleRetryAfter.
+	RetryAfterSeconds uint `json:",omitempty"`
+}
+
+// This type is sent to the agent when the VM is at risk of running out of memory (e.g. because its
+// cgroup keeps hitting memory.high), and again once it no longer is. While the VM is at risk, the
+// agent won't reduce its memory. The agent does not need to respond.
+//
+// Added in v1.1, only sent to agents with MonitorCapMemoryPressure.
+type MemoryPressureSignal struct {
+	// AtRisk is true if the VM is currently at risk of running out of memory
+	AtRisk bool `json:"atRisk"`
+	// Reason, if not empty, describes why the VM is at risk
+	Reason string `json:"reason,omitempty"`
+}
+
+// This type is sent to the agent in response to a FileCacheResizeRequest, once the monitor has
+// resized the file cache and applied the settings, or failed to do so. The agent does not need to
+// respond.
+//
+// Added in v1.1, only for monitors with MonitorCapFileCacheResize.
+type FileCacheResizeResult struct {
+	Ok     bool   `json:"ok"`
+	Status string `json:"status"`
+}
+
+// This type is sent to the agent in response to a PostgresRestartRequest, once the monitor has
+// restarted Postgres and it's accepting connections again, or failed to do so. The agent does not
+// need to respond.
+//
+// Added in v1.1, only for monitors with MonitorCapPostgresRestart.
+type PostgresRestartResult struct {
+	Ok     bool   `json:"ok"`
+	Status string `json:"status"`
 }
 
 // ** Types sent by agent **
@@ -529,6 +726,40 @@ type DownscaleRequest struct {
 	Target Allocation `json:"target"`
 }
 
+// This type is sent to the monitor after the VM's memory has changed, to resize the local file cache
+// to match. Postgres settings given in Settings should be applied with ALTER SYSTEM, followed by a
+// configuration reload. Once that's done (or failed), the monitor should respond with a
+// FileCacheResizeResult.
+//
+// Added in v1.1, only for monitors with MonitorCapFileCacheResize.
+type FileCacheResizeRequest struct {
+	// Size is the new size of the file cache, in bytes
+	Size uint64 `json:"size"`
+	// Settings maps the names of Postgres settings to their new values, like "effective_cache_size"
+	// to "3145728kB"
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// This type is sent to the monitor to restart Postgres, so that settings that only take effect
+// after a restart (like shared_buffers) are applied. Postgres settings given in Settings should be
+// set with ALTER SYSTEM first. The monitor should wait up to DrainTimeoutSeconds for existing
+// connections to close before shutting Postgres down, and respond with a PostgresRestartResult
+// once it's running again (or failed to restart).
+//
+// Added in v1.1, only for monitors with MonitorCapPostgresRestart.
+type PostgresRestartRequest struct {
+	// ID identifies the restart, from the api.CoordinatedRestart that asked for it. If the monitor
+	// receives a request with the ID of a restart that it's already done, it should respond
+	// successfully without restarting again.
+	ID string `json:"id"`
+	// Settings maps the names of Postgres settings to their new values, like "shared_buffers" to
+	// "1048576kB"
+	Settings map[string]string `json:"settings,omitempty"`
+	// DrainTimeoutSeconds gives how long to wait for existing connections to close before a fast
+	// shutdown
+	DrainTimeoutSeconds uint `json:"drainTimeoutSeconds"`
+}
+
 // ** Types shared by agent and monitor **
 
 // This type can be sent by either party whenever they receive a message they
@@ -554,15 +785,28 @@ type HealthCheck struct{}
 // the following types maybe be sent to the monitor, and thus passed in:
 // - DownscaleRequest
 // - UpscaleNotification
+// - FileCacheResizeRequest (as of v1.1)
+// - PostgresRestartRequest (as of v1.1)
 // - InvalidMessage
 // - InternalError
 // - HealthCheck
 func SerializeMonitorMessage(content any, id uint64) ([]byte, error) {
+	return SerializeSequencedMonitorMessage(content, id, 0, 0)
+}
+
+// SerializeSequencedMonitorMessage is like SerializeMonitorMessage, but includes the message's
+// sequence number and the sequence number of the latest message received from the vm-monitor, for
+// sessions with MonitorCapResume. See MonitorResume.
+//
+// If seq is zero, the message is the same as from SerializeMonitorMessage.
+func SerializeSequencedMonitorMessage(content any, id uint64, seq uint64, ack uint64) ([]byte, error) {
 	// The final type that gets sent over the wire
 	type Bundle struct {
 		Content any    `json:"content"`
 		Type    string `json:"type"`
 		Id      uint64 `json:"id"`
+		Seq     uint64 `json:"seq,omitempty"`
+		Ack     uint64 `json:"ack,omitempty"`
 	}
 
 	var typeStr string
@@ -571,6 +815,10 @@ func SerializeMonitorMessage(content any, id uint64) ([]byte, error) {
 		typeStr = "DownscaleRequest"
 	case UpscaleNotification:
 		typeStr = "UpscaleNotification"
+	case FileCacheResizeRequest:
+		typeStr = "FileCacheResizeRequest"
+	case PostgresRestartRequest:
+		typeStr = "PostgresRestartRequest"
 	case InvalidMessage:
 		typeStr = "InvalidMessage"
 	case InternalError:
@@ -581,10 +829,15 @@ func SerializeMonitorMessage(content any, id uint64) ([]byte, error) {
 		return nil, fmt.Errorf("unknown message type \"%s\"", reflect.TypeOf(content))
 	}
 
+	if seq == 0 {
+		ack = 0
+	}
 	return json.Marshal(Bundle{
 		Content: content,
 		Type:    typeStr,
 		Id:      id,
+		Seq:     seq,
+		Ack:     ack,
 	})
 }
 
@@ -599,9 +852,23 @@ type MonitorProtoVersion uint32
 
 const (
 	// MonitorProtoV1_0 represents v1.0 of the agent<->monitor protocol - the initial version.
+	MonitorProtoV1_0 = iota + 1
+
+	// MonitorProtoV1_1 represents v1.1 of the agent<->monitor protocol.
+	//
+	// Changes from v1.0:
+	//
+	// * The autoscaler-agent sends a MonitorHandshake instead of a VersionRange, and both it and
+	//   the MonitorProtocolResponse carry MonitorCapabilities. This is backwards-compatible with
+	//   v1.0 monitors, because MonitorHandshake only adds a field to VersionRange.
+	// * Adds FileCacheResizeRequest and FileCacheResizeResult, if the monitor has
+	//   MonitorCapFileCacheResize.
+	// * Adds DownscaleResult.RetryAfterSeconds, if the agent has MonitorCapDownscaleRetryAfter.
+	// * Adds PostgresRestartRequest and PostgresRestartResult, if the monitor has
+	//   MonitorCapPostgresRestart.
 	//
 	// Currently the latest version.
-	MonitorProtoV1_0 = iota + 1
+	MonitorProtoV1_1
 
 	// latestMonitorProtoVersion represents the latest version of the agent<->Monitor protocol
 	//
@@ -619,18 +886,145 @@ func (v MonitorProtoVersion) String() string {
 		return "<invalid: zero>"
 	case MonitorProtoV1_0:
 		return "v1.0"
+	case MonitorProtoV1_1:
+		return "v1.1"
 	default:
 		diff := v - latestMonitorProtoVersion
 		return fmt.Sprintf("<unknown = %v + %d>", latestMonitorProtoVersion, diff)
 	}
 }
 
+// HasCapabilities returns whether this version of the protocol exchanges MonitorCapabilities
+// during the handshake
+//
+// This is true for version v1.1 and greater.
+func (v MonitorProtoVersion) HasCapabilities() bool {
+	return v >= MonitorProtoV1_1
+}
+
+// MonitorCapabilities is a set of optional features, as bit flags, that are supported by either
+// side of the agent<->monitor protocol. Features that are supported by both are enabled.
+//
+// Unlike protocol versions, capabilities allow new features to be rolled out without requiring
+// every VM image to be upgraded at the same time as the autoscaler-agent.
+type MonitorCapabilities uint64
+
+const (
+	// MonitorCapFileCacheResize means that the vm-monitor resizes Postgres' local file cache when
+	// the VM is scaled
+	MonitorCapFileCacheResize MonitorCapabilities = 1 << iota
+	// MonitorCapCgroupV2 means that the vm-monitor manages the memory of a cgroup v2 cgroup
+	MonitorCapCgroupV2
+	// MonitorCapDownscaleRetryAfter means that the autoscaler-agent respects the
+	// RetryAfterSeconds of a DownscaleResult
+	MonitorCapDownscaleRetryAfter
+	// MonitorCapResume means that both sides keep the session across dropped connections, so that
+	// requests in flight aren't lost. See MonitorResume.
+	MonitorCapResume
+	// MonitorCapMemoryPressure means that the vm-monitor sends a MemoryPressureSignal when the VM
+	// is at risk of running out of memory, and the autoscaler-agent won't downscale memory until
+	// it's cleared
+	MonitorCapMemoryPressure
+	// MonitorCapPostgresRestart means that the vm-monitor restarts Postgres when it receives a
+	// PostgresRestartRequest
+	MonitorCapPostgresRestart
+
+	// AllMonitorCapabilities is the set of all capabilities known to this version of the
+	// autoscaler-agent
+	AllMonitorCapabilities = MonitorCapFileCacheResize | MonitorCapCgroupV2 | MonitorCapDownscaleRetryAfter |
+		MonitorCapResume | MonitorCapMemoryPressure | MonitorCapPostgresRestart
+)
+
+// Has returns whether all of the capabilities in cmp are in c
+func (c MonitorCapabilities) Has(cmp MonitorCapabilities) bool {
+	return c&cmp == cmp
+}
+
+func (c MonitorCapabilities) String() string {
+	var names []string
+	if c.Has(MonitorCapFileCacheResize) {
+		names = append(names, "file-cache-resize")
+	}
+	if c.Has(MonitorCapCgroupV2) {
+		names = append(names, "cgroup-v2")
+	}
+	if c.Has(MonitorCapDownscaleRetryAfter) {
+		names = append(names, "downscale-retry-after")
+	}
+	if c.Has(MonitorCapResume) {
+		names = append(names, "resume")
+	}
+	if c.Has(MonitorCapMemoryPressure) {
+		names = append(names, "memory-pressure")
+	}
+	if c.Has(MonitorCapPostgresRestart) {
+		names = append(names, "postgres-restart")
+	}
+	if unknown := c &^ AllMonitorCapabilities; unknown != 0 {
+		names = append(names, fmt.Sprintf("<unknown: %#x>", uint64(unknown)))
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+// MonitorHandshake is the first message sent by the autoscaler-agent to the vm-monitor, giving the
+// range of protocol versions that it supports and its capabilities.
+//
+// It's a superset of VersionRange[MonitorProtoVersion], which is what's sent in v1.0.
+type MonitorHandshake struct {
+	Min MonitorProtoVersion `json:"min"`
+	Max MonitorProtoVersion `json:"max"`
+	// Capabilities gives the features that the autoscaler-agent supports. Added in v1.1.
+	Capabilities MonitorCapabilities `json:"capabilities"`
+	// Resume, if not nil, asks the vm-monitor to resume an existing session, after the connection
+	// for it was dropped. Only sent to vm-monitors that agreed to MonitorCapResume for the session.
+	Resume *MonitorResume `json:"resume,omitempty"`
+}
+
+// MonitorResume asks the vm-monitor to resume a session on a new connection
+//
+// With MonitorCapResume, every message in either direction after the handshake has a sequence
+// number ("seq", alongside "id"), starting from 1 for each side of the session. Each side keeps the
+// messages that the other may not have received, so that they can be sent again after resuming:
+// the vm-monitor replays its messages after LastReceivedSeq, and the autoscaler-agent resends its
+// requests that haven't been responded to yet and its other messages (e.g. responses, which the
+// vm-monitor won't ask for again) after the vm-monitor's LastReceivedSeq, with their original ids
+// and sequence numbers. Messages with a sequence number that's already been received are ignored.
+//
+// Messages from the autoscaler-agent also carry the sequence number of the latest message that it
+// received ("ack"), so that the vm-monitor can forget older ones. The vm-monitor may include "ack"
+// in its messages too, so that the autoscaler-agent can forget the messages it doesn't need to
+// send again.
+type MonitorResume struct {
+	// SessionID is the vm-monitor's ID for the session, from MonitorProtocolResponse
+	SessionID string `json:"sessionId"`
+	// LastReceivedSeq is the sequence number of the latest message received from the vm-monitor
+	LastReceivedSeq uint64 `json:"lastReceivedSeq"`
+}
+
+// Range returns the range of protocol versions in the handshake
+func (h MonitorHandshake) Range() VersionRange[MonitorProtoVersion] {
+	return VersionRange[MonitorProtoVersion]{Min: h.Min, Max: h.Max}
+}
+
 // Sent back by the monitor after figuring out what protocol version we should use
 type MonitorProtocolResponse struct {
 	// If `Error` is nil, contains the value of the settled on protocol version.
 	// Otherwise, will be set to 0 (MonitorProtocolVersion's zero value).
 	Version MonitorProtoVersion `json:"version,omitempty"`
 
+	// Capabilities gives the features that the vm-monitor supports. Added in v1.1; always zero for
+	// earlier versions.
+	Capabilities MonitorCapabilities `json:"capabilities,omitempty"`
+
+	// SessionID identifies the session, for resuming it later. Only set with MonitorCapResume.
+	SessionID string `json:"sessionId,omitempty"`
+	// Resumed is true if the vm-monitor resumed the session given by MonitorHandshake.Resume. If it
+	// wasn't resumed (e.g. because the vm-monitor restarted), this is a new session instead.
+	Resumed bool `json:"resumed,omitempty"`
+	// LastReceivedSeq is the sequence number of the latest message that the vm-monitor received
+	// from the autoscaler-agent in the resumed session. Only set if Resumed is true.
+	LastReceivedSeq uint64 `json:"lastReceivedSeq,omitempty"`
+
 	// Will be nil if no error occurred.
 	Error *string `json:"error,omitempty"`
 }
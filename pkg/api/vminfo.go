@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 
 	"github.com/tychoish/fun/erc"
 	"go.uber.org/zap"
@@ -19,12 +20,52 @@ import (
 )
 
 const (
-	LabelEnableAutoMigration      = "autoscaling.neon.tech/auto-migration-enabled"
-	LabelTestingOnlyAlwaysMigrate = "autoscaling.neon.tech/testing-only-always-migrate"
-	LabelEnableAutoscaling        = "autoscaling.neon.tech/enabled"
-	AnnotationAutoscalingBounds   = "autoscaling.neon.tech/bounds"
-	AnnotationAutoscalingConfig   = "autoscaling.neon.tech/config"
-	AnnotationBillingEndpointID   = "autoscaling.neon.tech/billing-endpoint-id"
+	LabelEnableAutoMigration       = "autoscaling.neon.tech/auto-migration-enabled"
+	LabelTestingOnlyAlwaysMigrate  = "autoscaling.neon.tech/testing-only-always-migrate"
+	LabelEnableAutoscaling         = "autoscaling.neon.tech/enabled"
+	AnnotationAutoscalingBounds    = "autoscaling.neon.tech/bounds"
+	AnnotationAutoscalingConfig    = "autoscaling.neon.tech/config"
+	AnnotationAutoscalingSchedule  = "autoscaling.neon.tech/schedule"
+	AnnotationAutoscalingOverrides = "autoscaling.neon.tech/overrides"
+	AnnotationBillingEndpointID    = "autoscaling.neon.tech/billing-endpoint-id"
+	AnnotationMetricsTransport     = "autoscaling.neon.tech/metrics-transport"
+	AnnotationManualTarget         = "autoscaling.neon.tech/manual-target"
+	AnnotationAutoscalingPriority  = "autoscaling.neon.tech/priority"
+	AnnotationAutoscalingStatus    = "autoscaling.neon.tech/status"
+	AnnotationBurstCredits         = "autoscaling.neon.tech/burst-credits"
+	AnnotationRestartRequest       = "autoscaling.neon.tech/restart-request"
+)
+
+// AutoscalingStatus summarizes how a VM is being scaled, so that users can tell why it isn't at the
+// size they expect without reading the autoscaler-agent's logs. If enabled, it's written by the
+// autoscaler-agent to the AnnotationAutoscalingStatus annotation.
+type AutoscalingStatus struct {
+	// GoalCU is the number of compute units that the VM should have, based on its metrics
+	GoalCU uint32 `json:"goalCU"`
+	// GrantedCU is the number of compute units that the scheduler has approved for the VM
+	GrantedCU float64 `json:"grantedCU"`
+	// CurrentCU is the number of compute units that the VM currently has
+	CurrentCU float64 `json:"currentCU"`
+	// Limit, if not empty, gives what's stopping the VM from being scaled to GoalCU: one of
+	// "bounds", "scheduler", "monitor", or "cooldown".
+	Limit string `json:"limit,omitempty"`
+	// Reason is a human-readable description of how the goal was chosen
+	Reason string `json:"reason"`
+}
+
+// MetricsTransport is the method by which the autoscaler-agent gets a VM's metrics, set by the
+// AnnotationMetricsTransport annotation.
+type MetricsTransport string
+
+const (
+	// MetricsTransportPull is the default transport, where the autoscaler-agent periodically fetches
+	// the prometheus metrics from vector.dev in the VM
+	MetricsTransportPull MetricsTransport = "pull"
+	// MetricsTransportOTLP means that the VM pushes its metrics to the autoscaler-agent over
+	// OTLP/gRPC.
+	//
+	// If the autoscaler-agent doesn't have an OTLP receiver enabled, metrics are pulled instead.
+	MetricsTransportOTLP MetricsTransport = "otlp"
 )
 
 func hasTrueLabel(obj metav1.ObjectMetaAccessor, labelName string) bool {
@@ -38,6 +79,30 @@ func HasAutoscalingEnabled(obj metav1.ObjectMetaAccessor) bool {
 	return hasTrueLabel(obj, LabelEnableAutoscaling)
 }
 
+// ParseManualTarget parses the value of the AnnotationManualTarget annotation, which gives the
+// number of compute units to pin the VM at, e.g. "4".
+func ParseManualTarget(value string) (uint16, error) {
+	cu, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("expected a whole number of compute units: %w", err)
+	}
+	if cu == 0 {
+		return 0, errors.New("compute units must be greater than zero")
+	}
+	return uint16(cu), nil
+}
+
+// ParsePriority parses the value of the AnnotationAutoscalingPriority annotation, which gives the
+// VM's priority as a whole number, e.g. "10". Higher values are more important, and the default is
+// zero.
+func ParsePriority(value string) (int32, error) {
+	priority, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("expected a whole number: %w", err)
+	}
+	return int32(priority), nil
+}
+
 // HasAutoMigrationEnabled returns true iff the object has the label that enables "automatic"
 // scheduler-triggered migration, and it's set to "true"
 func HasAutoMigrationEnabled(obj metav1.ObjectMetaAccessor) bool {
@@ -57,12 +122,27 @@ type VmInfo struct {
 	Cpu       VmCpuInfo `json:"cpu"`
 	Mem       VmMemInfo `json:"mem"`
 	Config    VmConfig  `json:"config"`
+
+	// Paused is true if the VM's .spec.paused is set, i.e. it's been suspended. See
+	// ScaleToZeroConfig for more.
+	//
+	// This is always false for a VmInfo extracted from a pod.
+	Paused bool `json:"paused,omitempty"`
+	// RunnerPort is the port of the API served by the VM's runner, which reports the connections
+	// to the VM while it's paused, so that it can be resumed.
+	//
+	// This is always zero for a VmInfo extracted from a pod.
+	RunnerPort int32 `json:"runnerPort,omitempty"`
 }
 
 type VmCpuInfo struct {
 	Min vmapi.MilliCPU `json:"min"`
 	Max vmapi.MilliCPU `json:"max"`
 	Use vmapi.MilliCPU `json:"use"`
+
+	// Pinned, if not zero, is the number of whole host CPUs that the VM's pinned vCPUs have to
+	// themselves, regardless of how many are in use
+	Pinned uint32 `json:"pinned,omitempty"`
 }
 
 func NewVmCpuInfo(cpus vmapi.CPUs) (*VmCpuInfo, error) {
@@ -76,9 +156,10 @@ func NewVmCpuInfo(cpus vmapi.CPUs) (*VmCpuInfo, error) {
 		return nil, errors.New("expected non-nil field Use")
 	}
 	return &VmCpuInfo{
-		Min: *cpus.Min,
-		Max: *cpus.Max,
-		Use: *cpus.Use,
+		Min:    *cpus.Min,
+		Max:    *cpus.Max,
+		Use:    *cpus.Use,
+		Pinned: 0,
 	}, nil
 }
 
@@ -129,6 +210,28 @@ type VmConfig struct {
 	AlwaysMigrate  bool           `json:"alwaysMigrate"`
 	ScalingEnabled bool           `json:"scalingEnabled"`
 	ScalingConfig  *ScalingConfig `json:"scalingConfig,omitempty"`
+	// MetricsTransport gives how the autoscaler-agent should get metrics from the VM. It's always
+	// non-empty when produced by ExtractVmInfo.
+	MetricsTransport MetricsTransport `json:"metricsTransport,omitempty"`
+	// Schedule, if not nil, gives the time windows during which the VM's compute units are bounded,
+	// on top of its metrics.
+	Schedule *ScalingSchedule `json:"schedule,omitempty"`
+	// Overrides, if not nil, replaces individual parts of the autoscaler-agent's configuration for
+	// just this VM.
+	Overrides *ScalingOverrides `json:"overrides,omitempty"`
+	// ManualTargetCU, if not nil, pins the VM at this number of compute units (within its bounds),
+	// instead of scaling it based on its metrics. Set by the AnnotationManualTarget annotation.
+	ManualTargetCU *uint16 `json:"manualTargetCU,omitempty"`
+	// Priority gives how important the VM is relative to others, for deciding which VMs resources
+	// are reclaimed from first when a node is close to full. Higher values are more important; the
+	// default is zero. Set by the AnnotationAutoscalingPriority annotation.
+	Priority int32 `json:"priority,omitempty"`
+	// Topology, if not nil, gives where the scheduler plugin should place the VM, relative to
+	// availability zones and other VMs. Set by the VM's .spec.topology.
+	Topology *vmapi.VirtualMachineTopology `json:"topology,omitempty"`
+	// BurstCredits, if not nil, limits how long the VM may spend above a baseline number of compute
+	// units in any hour. Set by the AnnotationBurstCredits annotation.
+	BurstCredits *BurstCredits `json:"burstCredits,omitempty"`
 }
 
 // Using returns the Resources that this VmInfo says the VM is using
@@ -167,7 +270,14 @@ func (vm VmInfo) NamespacedName() util.NamespacedName {
 
 func ExtractVmInfo(logger *zap.Logger, vm *vmapi.VirtualMachine) (*VmInfo, error) {
 	logger = logger.With(util.VMNameFields(vm))
-	return extractVmInfoGeneric(logger, vm.Name, vm, vm.Spec.Resources())
+	info, err := extractVmInfoGeneric(logger, vm.Name, vm, vm.Spec.Resources())
+	if err != nil {
+		return nil, err
+	}
+	info.Paused = vm.Spec.Paused
+	info.RunnerPort = vm.Spec.RunnerPort
+	info.Config.Topology = vm.Spec.Topology
+	return info, nil
 }
 
 func ExtractVmInfoFromPod(logger *zap.Logger, pod *corev1.Pod) (*VmInfo, error) {
@@ -181,7 +291,20 @@ func ExtractVmInfoFromPod(logger *zap.Logger, pod *corev1.Pod) (*VmInfo, error)
 	}
 
 	vmName := pod.Labels[vmapi.VirtualMachineNameLabel]
-	return extractVmInfoGeneric(logger, vmName, pod, resources)
+	info, err := extractVmInfoGeneric(logger, vmName, pod, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	if topologyJSON, ok := pod.Annotations[vmapi.VirtualMachineTopologyAnnotation]; ok {
+		var topology vmapi.VirtualMachineTopology
+		if err := json.Unmarshal([]byte(topologyJSON), &topology); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling %q: %w",
+				vmapi.VirtualMachineTopologyAnnotation, err)
+		}
+		info.Config.Topology = &topology
+	}
+	return info, nil
 }
 
 func extractVmInfoGeneric(
@@ -194,6 +317,7 @@ func extractVmInfoGeneric(
 	if err != nil {
 		return nil, fmt.Errorf("Error extracting CPU info: %w", err)
 	}
+	cpuInfo.Pinned = resources.PinnedCPUs
 
 	memInfo, err := NewVmMemInfo(resources.MemorySlots, resources.MemorySlotSize)
 	if err != nil {
@@ -214,7 +338,16 @@ func extractVmInfoGeneric(
 			AlwaysMigrate:        alwaysMigrate,
 			ScalingEnabled:       scalingEnabled,
 			ScalingConfig:        nil, // set below, maybe
+			MetricsTransport:     MetricsTransportPull,
+			Schedule:             nil, // set below, maybe
+			Overrides:            nil, // set below, maybe
+			ManualTargetCU:       nil, // set below, maybe
+			Priority:             0,   // set below, maybe
+			Topology:             nil, // set by the caller, maybe
+			BurstCredits:         nil, // set below, maybe
 		},
+		Paused:     false, // set by the caller, maybe
+		RunnerPort: 0,     // set by the caller, maybe
 	}
 
 	if boundsJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationAutoscalingBounds]; ok {
@@ -241,6 +374,61 @@ func extractVmInfoGeneric(
 		info.Config.ScalingConfig = &config
 	}
 
+	if scheduleJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationAutoscalingSchedule]; ok {
+		var schedule ScalingSchedule
+		if err := json.Unmarshal([]byte(scheduleJSON), &schedule); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationAutoscalingSchedule, err)
+		}
+
+		if err := schedule.Validate(); err != nil {
+			return nil, fmt.Errorf("Bad scaling schedule in annotation %q: %w", AnnotationAutoscalingSchedule, err)
+		}
+		info.Config.Schedule = &schedule
+	}
+
+	if overridesJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationAutoscalingOverrides]; ok {
+		var overrides ScalingOverrides
+		if err := json.Unmarshal([]byte(overridesJSON), &overrides); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationAutoscalingOverrides, err)
+		}
+
+		if err := overrides.Validate(); err != nil {
+			return nil, fmt.Errorf("Bad scaling overrides in annotation %q: %w", AnnotationAutoscalingOverrides, err)
+		}
+		info.Config.Overrides = &overrides
+	}
+
+	if target, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationManualTarget]; ok {
+		cu, err := ParseManualTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("Bad manual target in annotation %q: %w", AnnotationManualTarget, err)
+		}
+		info.Config.ManualTargetCU = &cu
+	}
+
+	if priority, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationAutoscalingPriority]; ok {
+		p, err := ParsePriority(priority)
+		if err != nil {
+			return nil, fmt.Errorf("Bad priority in annotation %q: %w", AnnotationAutoscalingPriority, err)
+		}
+		info.Config.Priority = p
+	}
+
+	burstCredits, err := ExtractBurstCredits(obj)
+	if err != nil {
+		return nil, err
+	}
+	info.Config.BurstCredits = burstCredits
+
+	if transport, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationMetricsTransport]; ok {
+		switch t := MetricsTransport(transport); t {
+		case MetricsTransportPull, MetricsTransportOTLP:
+			info.Config.MetricsTransport = t
+		default:
+			return nil, fmt.Errorf("Unknown metrics transport %q in annotation %q", transport, AnnotationMetricsTransport)
+		}
+	}
+
 	min := info.Min()
 	using := info.Using()
 	max := info.Max()
@@ -346,6 +534,87 @@ type ScalingConfig struct {
 	// we would like to be using. For example, with a value of 0.7, on a 4GB VM
 	// we'd like to be using 2.8GB of memory.
 	MemoryUsageFractionTarget float64 `json:"memoryUsageFractionTarget"`
+
+	// ActiveBackendsPerCU, if provided, sets the desired number of active Postgres backends per
+	// compute unit. For example, with a value of 10, we'd want at least 3 CU for 25 active
+	// backends.
+	//
+	// This, and the other Postgres-based fields, only have an effect if the autoscaler-agent is
+	// configured to collect Postgres metrics.
+	ActiveBackendsPerCU *float64 `json:"activeBackendsPerCU,omitempty"`
+
+	// TransactionsPerSecondPerCU, if provided, sets the desired rate of Postgres transactions per
+	// compute unit.
+	TransactionsPerSecondPerCU *float64 `json:"transactionsPerSecondPerCU,omitempty"`
+
+	// MinBufferCacheHitRatio, if provided, prevents downscaling while the fraction of Postgres
+	// block reads served by the buffer cache is below this value, because the working set likely
+	// doesn't fit in memory already.
+	MinBufferCacheHitRatio *float64 `json:"minBufferCacheHitRatio,omitempty"`
+
+	// LFCToMemoryRatio, if provided, enables scaling memory so that the estimated working set of
+	// Postgres' local file cache (LFC) fits in it, given that the LFC may use this fraction of the
+	// VM's memory. For example, with a value of 0.75 and a working set of 3GB, we'd want at least
+	// 4GB of memory.
+	//
+	// This only has an effect if the autoscaler-agent is configured to collect LFC metrics.
+	LFCToMemoryRatio *float64 `json:"lfcToMemoryRatio,omitempty"`
+
+	// MemoryPressureSomeThreshold, if provided, upscales the VM by at least one compute unit when
+	// the fraction of time that some task in the VM was stalled on memory (the "some" value from
+	// PSI) since the previous metrics is at least this value. Load average and memory usage lag
+	// behind when the VM starts swapping, so this catches it sooner.
+	MemoryPressureSomeThreshold *float64 `json:"memoryPressureSomeThreshold,omitempty"`
+
+	// MemoryPressureFullThreshold, if provided, is like MemoryPressureSomeThreshold, but for the
+	// fraction of time that all non-idle tasks were stalled on memory at once (the "full" value).
+	MemoryPressureFullThreshold *float64 `json:"memoryPressureFullThreshold,omitempty"`
+
+	// ScaleDownStabilizationSeconds, if provided, requires that downscaling is continuously
+	// justified by the metrics for this many seconds before it happens, so that brief dips in load
+	// don't cause the VM to flap between sizes.
+	ScaleDownStabilizationSeconds *uint32 `json:"scaleDownStabilizationSeconds,omitempty"`
+
+	// ScaleUpCooldownSeconds, if provided, prevents downscaling for this many seconds after the VM
+	// was last upscaled.
+	ScaleUpCooldownSeconds *uint32 `json:"scaleUpCooldownSeconds,omitempty"`
+
+	// MaxScaleStepCU, if provided, limits how many compute units the metrics can move the VM by at
+	// a time, in either direction. Upscaling requested by the vm-monitor is not limited.
+	MaxScaleStepCU *uint32 `json:"maxScaleStepCU,omitempty"`
+
+	// DownscaleBatchWindowSeconds, if provided, holds downscaling for this many seconds once it's
+	// otherwise allowed, so that the small steps down that happen as load tapers off are combined
+	// into a single change to the VM, instead of each one causing a separate NeonVM update.
+	DownscaleBatchWindowSeconds *uint32 `json:"downscaleBatchWindowSeconds,omitempty"`
+
+	// ScaleToZero, if provided, enables suspending the VM once it's been idle for long enough. See
+	// ScaleToZeroConfig for more.
+	ScaleToZero *ScaleToZeroConfig `json:"scaleToZero,omitempty"`
+}
+
+// ScaleToZeroConfig configures suspending idle VMs, so that they stop using any CPU.
+//
+// The autoscaler-agent suspends the VM by setting its .spec.paused, which stops the guest's vCPUs
+// while keeping its memory. While the VM is suspended, the scheduler plugin is told that it isn't
+// using any CPU, so that other VMs on the node can have it.
+//
+// While the VM is suspended, the autoscaler-agent asks the VM's runner for the number of
+// connections made to the guest's ports, and resumes the VM by clearing .spec.paused once a new
+// one arrives. Anything else may also clear .spec.paused to resume the VM sooner. Because the VM
+// keeps its memory, resuming only takes as long as the NeonVM controller needs to notice. The
+// autoscaler-agent then asks the scheduler plugin for the VM's CPU back, which is reserved even if
+// the node has since been filled up.
+type ScaleToZeroConfig struct {
+	// IdleSeconds sets how long the VM must be continuously idle before it's suspended.
+	IdleSeconds uint32 `json:"idleSeconds"`
+
+	// MaxLoadAverage sets the 1-minute load average at or below which the VM may be considered
+	// idle.
+	//
+	// If the autoscaler-agent is configured to collect Postgres metrics, the VM is additionally
+	// only idle while there are no active backends and no transactions.
+	MaxLoadAverage float64 `json:"maxLoadAverage"`
 }
 
 func (c *ScalingConfig) Validate() error {
@@ -361,6 +630,69 @@ func (c *ScalingConfig) Validate() error {
 	erc.Whenf(ec, c.MemoryUsageFractionTarget < 0.0, "%s must be set to value >= 0", ".memoryUsageFractionTarget")
 	erc.Whenf(ec, c.MemoryUsageFractionTarget >= 1.0, "%s must be set to value < 1 ", ".memoryUsageFractionTarget")
 
+	erc.Whenf(ec, c.ActiveBackendsPerCU != nil && *c.ActiveBackendsPerCU <= 0.0, "%s must be set to value > 0", ".activeBackendsPerCU")
+	erc.Whenf(ec, c.TransactionsPerSecondPerCU != nil && *c.TransactionsPerSecondPerCU <= 0.0, "%s must be set to value > 0", ".transactionsPerSecondPerCU")
+	erc.Whenf(ec, c.MinBufferCacheHitRatio != nil && *c.MinBufferCacheHitRatio < 0.0, "%s must be set to value >= 0", ".minBufferCacheHitRatio")
+	erc.Whenf(ec, c.MinBufferCacheHitRatio != nil && *c.MinBufferCacheHitRatio > 1.0, "%s must be set to value <= 1", ".minBufferCacheHitRatio")
+	erc.Whenf(ec, c.LFCToMemoryRatio != nil && *c.LFCToMemoryRatio <= 0.0, "%s must be set to value > 0", ".lfcToMemoryRatio")
+	erc.Whenf(ec, c.LFCToMemoryRatio != nil && *c.LFCToMemoryRatio > 1.0, "%s must be set to value <= 1", ".lfcToMemoryRatio")
+	erc.Whenf(ec, c.MemoryPressureSomeThreshold != nil && *c.MemoryPressureSomeThreshold <= 0.0, "%s must be set to value > 0", ".memoryPressureSomeThreshold")
+	erc.Whenf(ec, c.MemoryPressureSomeThreshold != nil && *c.MemoryPressureSomeThreshold > 1.0, "%s must be set to value <= 1", ".memoryPressureSomeThreshold")
+	erc.Whenf(ec, c.MemoryPressureFullThreshold != nil && *c.MemoryPressureFullThreshold <= 0.0, "%s must be set to value > 0", ".memoryPressureFullThreshold")
+	erc.Whenf(ec, c.MemoryPressureFullThreshold != nil && *c.MemoryPressureFullThreshold > 1.0, "%s must be set to value <= 1", ".memoryPressureFullThreshold")
+	erc.Whenf(ec, c.MaxScaleStepCU != nil && *c.MaxScaleStepCU == 0, "%s must be set to value > 0", ".maxScaleStepCU")
+	erc.Whenf(ec, c.DownscaleBatchWindowSeconds != nil && *c.DownscaleBatchWindowSeconds == 0, "%s must be set to value > 0", ".downscaleBatchWindowSeconds")
+	if c.ScaleToZero != nil {
+		erc.Whenf(ec, c.ScaleToZero.IdleSeconds == 0, "%s must be set to value > 0", ".scaleToZero.idleSeconds")
+		erc.Whenf(ec, c.ScaleToZero.MaxLoadAverage < 0.0, "%s must be set to value >= 0", ".scaleToZero.maxLoadAverage")
+	}
+
+	// heads-up! some functions elsewhere depend on the concrete return type of this function.
+	return ec.Resolve()
+}
+
+// ScalingOverrides replaces parts of the autoscaler-agent's configuration for a single VM, so that
+// e.g. latency-sensitive databases can have a tighter control loop than batch workloads. It's set
+// by the AnnotationAutoscalingOverrides annotation.
+//
+// Unlike ScalingConfig, every field is optional, and fields that aren't provided keep the value
+// they would otherwise have had.
+type ScalingOverrides struct {
+	// MetricsIntervalSeconds, if provided, replaces the number of seconds between requests for the
+	// VM's metrics.
+	MetricsIntervalSeconds *uint32 `json:"metricsIntervalSeconds,omitempty"`
+	// MaxScaleStepCU, if provided, replaces ScalingConfig.MaxScaleStepCU
+	MaxScaleStepCU *uint32 `json:"maxScaleStepCU,omitempty"`
+	// LoadAverageFractionTarget, if provided, replaces ScalingConfig.LoadAverageFractionTarget
+	LoadAverageFractionTarget *float64 `json:"loadAverageFractionTarget,omitempty"`
+	// MemoryUsageFractionTarget, if provided, replaces ScalingConfig.MemoryUsageFractionTarget
+	MemoryUsageFractionTarget *float64 `json:"memoryUsageFractionTarget,omitempty"`
+}
+
+func (o *ScalingOverrides) Validate() error {
+	ec := &erc.Collector{}
+
+	erc.Whenf(ec, o.MetricsIntervalSeconds != nil && *o.MetricsIntervalSeconds == 0, "%s must be set to value > 0", ".metricsIntervalSeconds")
+	erc.Whenf(ec, o.MaxScaleStepCU != nil && *o.MaxScaleStepCU == 0, "%s must be set to value > 0", ".maxScaleStepCU")
+	erc.Whenf(ec, o.LoadAverageFractionTarget != nil && *o.LoadAverageFractionTarget <= 0.0, "%s must be set to value > 0", ".loadAverageFractionTarget")
+	erc.Whenf(ec, o.LoadAverageFractionTarget != nil && *o.LoadAverageFractionTarget >= 2.0, "%s must be set to value < 2", ".loadAverageFractionTarget")
+	erc.Whenf(ec, o.MemoryUsageFractionTarget != nil && *o.MemoryUsageFractionTarget <= 0.0, "%s must be set to value > 0", ".memoryUsageFractionTarget")
+	erc.Whenf(ec, o.MemoryUsageFractionTarget != nil && *o.MemoryUsageFractionTarget >= 1.0, "%s must be set to value < 1", ".memoryUsageFractionTarget")
+
 	// heads-up! some functions elsewhere depend on the concrete return type of this function.
 	return ec.Resolve()
 }
+
+// Apply returns the ScalingConfig with the overrides applied
+func (o *ScalingOverrides) Apply(config ScalingConfig) ScalingConfig {
+	if o.MaxScaleStepCU != nil {
+		config.MaxScaleStepCU = o.MaxScaleStepCU
+	}
+	if o.LoadAverageFractionTarget != nil {
+		config.LoadAverageFractionTarget = *o.LoadAverageFractionTarget
+	}
+	if o.MemoryUsageFractionTarget != nil {
+		config.MemoryUsageFractionTarget = *o.MemoryUsageFractionTarget
+	}
+	return config
+}
@@ -0,0 +1,96 @@
+package api_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func topologyTestVM(topology *vmapi.VirtualMachineTopology) *vmapi.VirtualMachine {
+	cpu := vmapi.MilliCPU(1000)
+	slots := int32(1)
+
+	vm := new(vmapi.VirtualMachine)
+	vm.Name = "vm"
+	vm.Namespace = "default"
+	vm.Spec.Guest.CPUs = vmapi.CPUs{Min: &cpu, Max: &cpu, Use: &cpu, MaxTopology: nil}
+	vm.Spec.Guest.MemorySlots = vmapi.MemorySlots{Min: &slots, Max: &slots, Use: &slots}
+	vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+	vm.Spec.Topology = topology
+	return vm
+}
+
+func TestExtractVmInfoTopology(t *testing.T) {
+	topology := &vmapi.VirtualMachineTopology{
+		SpreadGroup:            "ep-example",
+		RequireSpread:          true,
+		RequiredZones:          []string{"zone-a", "zone-b"},
+		PreferredZones:         []string{"zone-a"},
+		PreferredArchitectures: []string{"arm64"},
+	}
+	logger := zap.NewNop()
+
+	t.Run("vm", func(t *testing.T) {
+		info, err := api.ExtractVmInfo(logger, topologyTestVM(topology))
+		require.NoError(t, err)
+		assert.Equal(t, topology, info.Config.Topology)
+
+		info, err = api.ExtractVmInfo(logger, topologyTestVM(nil))
+		require.NoError(t, err)
+		assert.Nil(t, info.Config.Topology)
+	})
+
+	t.Run("pod", func(t *testing.T) {
+		vm := topologyTestVM(topology)
+		resourcesJSON, err := json.Marshal(vm.Spec.Resources())
+		require.NoError(t, err)
+		topologyJSON, err := json.Marshal(topology)
+		require.NoError(t, err)
+
+		pod := new(corev1.Pod)
+		pod.Name = "runner"
+		pod.Namespace = vm.Namespace
+		pod.Labels = map[string]string{vmapi.VirtualMachineNameLabel: vm.Name}
+		pod.Annotations = map[string]string{
+			vmapi.VirtualMachineResourcesAnnotation: string(resourcesJSON),
+			vmapi.VirtualMachineTopologyAnnotation:  string(topologyJSON),
+		}
+
+		info, err := api.ExtractVmInfoFromPod(logger, pod)
+		require.NoError(t, err)
+		assert.Equal(t, topology, info.Config.Topology)
+
+		// Pods of VMs without .spec.topology don't have the annotation
+		delete(pod.Annotations, vmapi.VirtualMachineTopologyAnnotation)
+		info, err = api.ExtractVmInfoFromPod(logger, pod)
+		require.NoError(t, err)
+		assert.Nil(t, info.Config.Topology)
+
+		pod.Annotations[vmapi.VirtualMachineTopologyAnnotation] = "not json"
+		_, err = api.ExtractVmInfoFromPod(logger, pod)
+		assert.ErrorContains(t, err, vmapi.VirtualMachineTopologyAnnotation)
+	})
+}
+
+func TestExtractVmInfoPinnedCPUs(t *testing.T) {
+	logger := zap.NewNop()
+
+	vm := topologyTestVM(nil)
+	info, err := api.ExtractVmInfo(logger, vm)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), info.Cpu.Pinned)
+
+	vm.Spec.Guest.CPUPlacement = &vmapi.CPUPlacement{Pinned: true, SingleNUMANode: false}
+	info, err = api.ExtractVmInfo(logger, vm)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), info.Cpu.Pinned)
+}
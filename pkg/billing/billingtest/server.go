@@ -0,0 +1,425 @@
+// Package billingtest provides a fake billing collector, for testing the code that sends billing
+// events against a real HTTP server.
+//
+// The fake collector checks each request against the schema in billing-v1.yaml, records the
+// batches it receives, and can be told to respond slowly or with errors. It only supports JSON, and
+// responds to other formats with 415 Unsupported Media Type, as real collectors may.
+package billingtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// Event is a billing event received by the Server. It has the fields of both AbsoluteEvent and
+// IncrementalEvent, and Type gives which one it is.
+type Event struct {
+	SchemaVersion  uint       `json:"schema_version"`
+	IdempotencyKey string     `json:"idempotency_key"`
+	MetricName     string     `json:"metric"`
+	Type           string     `json:"type"`
+	TenantID       string     `json:"tenant_id,omitempty"`
+	TimelineID     string     `json:"timeline_id,omitempty"`
+	EndpointID     string     `json:"endpoint_id,omitempty"`
+	Time           *time.Time `json:"time,omitempty"`
+	StartTime      *time.Time `json:"start_time,omitempty"`
+	StopTime       *time.Time `json:"stop_time,omitempty"`
+	Value          *int       `json:"value"`
+	Anomalous      bool       `json:"anomalous,omitempty"`
+	Partial        bool       `json:"partial,omitempty"`
+
+	billing.Identity
+}
+
+// Batch is a request received by the Server
+type Batch struct {
+	// ReceivedAt is the time that the request was received
+	ReceivedAt time.Time
+	// TraceID is the value of the request's x-trace-id header
+	TraceID string
+	// StatusCode is the status code of the response
+	StatusCode int
+	// Err is the reason that the request was invalid, or nil if it was valid. Invalid requests are
+	// responded to with 400 Bad Request.
+	Err error
+	// Events are the events in the request. It's empty if the request couldn't be decoded.
+	Events []Event
+}
+
+// Accepted returns whether the batch was accepted, i.e. responded to with 200 OK
+func (b Batch) Accepted() bool {
+	return b.StatusCode == http.StatusOK
+}
+
+// Response sets how the Server responds to a valid request
+type Response struct {
+	// Latency is how long to wait before responding
+	Latency time.Duration
+	// StatusCode is the status code to respond with, or 200 OK if zero. Events in requests that
+	// aren't responded to with 200 OK are not considered to have been accepted.
+	StatusCode int
+	// RetryAfter, if not empty, is the value of the Retry-After header to respond with
+	RetryAfter string
+}
+
+// Server is a fake billing collector, running an HTTP server in the current process
+type Server struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// defaultResponse is used once the scripted responses have run out
+	defaultResponse Response
+	// scripted are the responses to use for the next requests, in order
+	scripted []Response
+	batches  []Batch
+	// accepted gives the first accepted event with each idempotency key
+	accepted map[string]Event
+	// redelivered and conflicting give the idempotency keys that were accepted again, with the
+	// same event or a different one, respectively
+	redelivered map[string]struct{}
+	conflicting map[string]struct{}
+	ackCount    int
+}
+
+// NewServer starts a new Server, which must be closed with Close
+func NewServer() *Server {
+	s := &Server{
+		server:          nil,
+		mu:              sync.Mutex{},
+		defaultResponse: Response{Latency: 0, StatusCode: http.StatusOK, RetryAfter: ""},
+		scripted:        nil,
+		batches:         nil,
+		accepted:        make(map[string]Event),
+		redelivered:     make(map[string]struct{}),
+		conflicting:     make(map[string]struct{}),
+		ackCount:        0,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/usage_events", s.handleUsageEvents)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	})
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// URL returns the base URL of the server, for use with billing.NewClient
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Close shuts down the server, waiting for any requests in progress to finish
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// SetDefaultResponse sets how the server responds to valid requests once all responses given to
+// Respond have been used
+func (s *Server) SetDefaultResponse(r Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultResponse = r
+}
+
+// Respond adds responses to use for the next valid requests, in order, after any given previously
+func (s *Server) Respond(rs ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripted = append(s.scripted, rs...)
+}
+
+// FailNext makes the server respond to the next n valid requests with the status code
+func (s *Server) FailNext(n int, statusCode int) {
+	for i := 0; i < n; i++ {
+		s.Respond(Response{Latency: 0, StatusCode: statusCode, RetryAfter: ""})
+	}
+}
+
+// Batches returns all requests received so far, in the order they were received
+func (s *Server) Batches() []Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Batch(nil), s.batches...)
+}
+
+// AcceptedEvents returns the events from all accepted batches, in the order they were received
+func (s *Server) AcceptedEvents() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []Event
+	for _, b := range s.batches {
+		if b.Accepted() {
+			events = append(events, b.Events...)
+		}
+	}
+	return events
+}
+
+// RedeliveredKeys returns the idempotency keys of events that have been accepted more than once.
+//
+// This is expected when a request is retried after the collector accepted it but the client didn't
+// get the response (e.g. because it timed out), and the collector deduplicates these by the key.
+func (s *Server) RedeliveredKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.redelivered)
+}
+
+// ConflictingKeys returns the idempotency keys that have been accepted for more than one different
+// event. The collector would drop all but the first, so the usage in the others would be lost.
+func (s *Server) ConflictingKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.conflicting)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// AssertValid fails the test if any request received so far was invalid
+func (s *Server) AssertValid(t testing.TB) {
+	t.Helper()
+	for i, b := range s.Batches() {
+		if b.Err != nil {
+			t.Errorf("billing request #%d was invalid: %s", i, b.Err)
+		}
+	}
+}
+
+// AssertUniqueKeys fails the test if any idempotency key has been accepted for more than one
+// different event
+func (s *Server) AssertUniqueKeys(t testing.TB) {
+	t.Helper()
+	if keys := s.ConflictingKeys(); len(keys) != 0 {
+		t.Errorf("idempotency keys %q were used for more than one different billing event", keys)
+	}
+}
+
+func (s *Server) handleUsageEvents(w http.ResponseWriter, r *http.Request) {
+	batch := Batch{
+		ReceivedAt: time.Now(),
+		TraceID:    r.Header.Get("x-trace-id"),
+		StatusCode: 0,
+		Err:        nil,
+		Events:     nil,
+	}
+
+	var response Response
+	s.checkRequest(r, &batch)
+	if batch.StatusCode == 0 {
+		response = s.nextResponse()
+		batch.StatusCode = response.StatusCode
+		if batch.StatusCode == 0 {
+			batch.StatusCode = http.StatusOK
+		}
+	}
+
+	if response.Latency != 0 {
+		select {
+		case <-time.After(response.Latency):
+		case <-r.Context().Done():
+			// The client gave up, but we still record the batch as it would have been handled,
+			// like a real collector that doesn't notice the client going away.
+		}
+	}
+
+	s.mu.Lock()
+	if batch.Accepted() {
+		for _, e := range batch.Events {
+			if first, ok := s.accepted[e.IdempotencyKey]; !ok {
+				s.accepted[e.IdempotencyKey] = e
+			} else if reflect.DeepEqual(first, e) {
+				s.redelivered[e.IdempotencyKey] = struct{}{}
+			} else {
+				s.conflicting[e.IdempotencyKey] = struct{}{}
+			}
+		}
+		s.ackCount++
+		w.Header().Set(billing.AckIDHeader, fmt.Sprintf("ack-%d", s.ackCount))
+	}
+	s.batches = append(s.batches, batch)
+	s.mu.Unlock()
+
+	w.Header().Set("content-type", "application/json")
+	if response.RetryAfter != "" {
+		w.Header().Set("retry-after", response.RetryAfter)
+	}
+	w.WriteHeader(batch.StatusCode)
+	if batch.Err != nil {
+		body, _ := json.Marshal(map[string]string{"error": batch.Err.Error()})
+		_, _ = w.Write(body)
+	} else {
+		_, _ = w.Write([]byte("{}"))
+	}
+}
+
+// checkRequest decodes and validates the request into the batch, setting the batch's status code
+// if the request can't be accepted regardless of the configured responses
+func (s *Server) checkRequest(r *http.Request, batch *Batch) {
+	if r.Method != http.MethodPost {
+		batch.StatusCode = http.StatusMethodNotAllowed
+		batch.Err = fmt.Errorf("unexpected method %s", r.Method)
+		return
+	}
+	if contentType := r.Header.Get("content-type"); contentType != billing.FormatJSON.ContentType() {
+		batch.StatusCode = http.StatusUnsupportedMediaType
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		batch.StatusCode = http.StatusBadRequest
+		batch.Err = fmt.Errorf("error reading body: %w", err)
+		return
+	}
+
+	if digest := r.Header.Get(billing.DigestHeader); digest != "" {
+		sum := sha256.Sum256(body)
+		if expected := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"; digest != expected {
+			batch.StatusCode = http.StatusBadRequest
+			batch.Err = fmt.Errorf("%s header %q doesn't match the body, expected %q", billing.DigestHeader, digest, expected)
+			return
+		}
+	}
+
+	events, err := decodeBatch(body)
+	batch.Events = events
+	if err != nil {
+		batch.StatusCode = http.StatusBadRequest
+		batch.Err = err
+	}
+}
+
+func (s *Server) nextResponse() Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.scripted) == 0 {
+		return s.defaultResponse
+	}
+	r := s.scripted[0]
+	s.scripted = s.scripted[1:]
+	return r
+}
+
+// decodeBatch decodes the body of a request and checks it against the schema, returning the events
+// that could be decoded even if some of them are invalid
+func decodeBatch(body []byte) ([]Event, error) {
+	var payload struct {
+		Events *json.RawMessage `json:"events"`
+		Digest string           `json:"digest"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("error decoding batch: %w", err)
+	}
+	if payload.Events == nil {
+		return nil, errors.New("missing field \"events\"")
+	}
+	if payload.Digest != "" {
+		if expected := billing.BatchDigest(*payload.Events); payload.Digest != expected {
+			return nil, fmt.Errorf("batch digest %q doesn't match the events, expected %q", payload.Digest, expected)
+		}
+	}
+
+	var rawEvents []json.RawMessage
+	if err := json.Unmarshal(*payload.Events, &rawEvents); err != nil {
+		return nil, fmt.Errorf("error decoding events: %w", err)
+	}
+
+	var errs []error
+	keys := make(map[string]struct{})
+	events := make([]Event, 0, len(rawEvents))
+	for i, raw := range rawEvents {
+		var event Event
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&event); err != nil {
+			errs = append(errs, fmt.Errorf("error decoding event #%d: %w", i, err))
+			continue
+		}
+		if err := validateEvent(event); err != nil {
+			errs = append(errs, fmt.Errorf("invalid event #%d: %w", i, err))
+		}
+		if _, ok := keys[event.IdempotencyKey]; ok {
+			errs = append(errs, fmt.Errorf("event #%d has the same idempotency key as an earlier event in the batch: %q", i, event.IdempotencyKey))
+		}
+		keys[event.IdempotencyKey] = struct{}{}
+		events = append(events, event)
+	}
+
+	return events, errors.Join(errs...)
+}
+
+// validateEvent checks the event against the schema for its type
+func validateEvent(e Event) error {
+	var errs []error
+	want := func(ok bool, field string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("missing field %q", field))
+		}
+	}
+	forbid := func(ok bool, field string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("unexpected field %q for %s event", field, e.Type))
+		}
+	}
+
+	want(e.IdempotencyKey != "", "idempotency_key")
+	want(e.MetricName != "", "metric")
+	want(e.Value != nil, "value")
+	if e.SchemaVersion > billing.CurrentSchemaVersion {
+		errs = append(errs, fmt.Errorf("unknown schema version %d", e.SchemaVersion))
+	}
+
+	switch e.Type {
+	case "absolute":
+		want(e.Time != nil, "time")
+		want(e.TenantID != "" || e.EndpointID != "", "tenant_id")
+		forbid(e.StartTime == nil, "start_time")
+		forbid(e.StopTime == nil, "stop_time")
+		forbid(!e.Anomalous, "anomalous")
+		forbid(!e.Partial, "partial")
+	case "incremental":
+		want(e.EndpointID != "", "endpoint_id")
+		want(e.StartTime != nil, "start_time")
+		want(e.StopTime != nil, "stop_time")
+		forbid(e.Time == nil, "time")
+		forbid(e.TenantID == "", "tenant_id")
+		forbid(e.TimelineID == "", "timeline_id")
+		if e.StartTime != nil && e.StopTime != nil && e.StopTime.Before(*e.StartTime) {
+			errs = append(errs, fmt.Errorf("stop_time %s is before start_time %s", e.StopTime, e.StartTime))
+		}
+		if e.Value != nil && *e.Value < 0 {
+			errs = append(errs, fmt.Errorf("negative value %d", *e.Value))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown event type %q", e.Type))
+	}
+
+	return errors.Join(errs...)
+}
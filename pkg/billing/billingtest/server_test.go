@@ -0,0 +1,171 @@
+package billingtest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+	"github.com/neondatabase/autoscaling/pkg/billing/billingtest"
+)
+
+func makeEvents(now time.Time, seq uint64, endpoints ...string) []*billing.IncrementalEvent {
+	var events []*billing.IncrementalEvent
+	for i, ep := range endpoints {
+		events = append(events, billing.Enrich(now, "test-host", seq+uint64(i), i, len(endpoints), &billing.IncrementalEvent{
+			SchemaVersion:  0,
+			IdempotencyKey: "",
+			MetricName:     "effective_compute_seconds",
+			Type:           "",
+			EndpointID:     ep,
+			StartTime:      now.Add(-time.Minute),
+			StopTime:       now,
+			Value:          60,
+			Anomalous:      false,
+			Partial:        false,
+			Identity:       billing.Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0},
+			SequenceNumber: 0,
+		}))
+	}
+	return events
+}
+
+func TestServer(t *testing.T) {
+	server := billingtest.NewServer()
+	defer server.Close()
+
+	client := billing.NewClient(server.URL(), http.DefaultClient).WithContentDigest()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Accepted as normal
+	err := billing.Send(ctx, client, client.GenerateTraceID(), makeEvents(now, 0, "ep-1", "ep-2"))
+	require.NoError(t, err)
+
+	// Simulated failures, followed by a retry that succeeds
+	server.FailNext(2, http.StatusServiceUnavailable)
+	retried := makeEvents(now, 2, "ep-3")
+	for i := 0; i < 2; i++ {
+		err = billing.Send(ctx, client, client.GenerateTraceID(), retried)
+		assert.Equal(t, billing.UnexpectedStatusCodeError{StatusCode: http.StatusServiceUnavailable}, err)
+	}
+	err = billing.Send(ctx, client, client.GenerateTraceID(), retried)
+	require.NoError(t, err)
+
+	// Redelivering the same events is fine
+	err = billing.Send(ctx, client, client.GenerateTraceID(), retried)
+	require.NoError(t, err)
+
+	server.AssertValid(t)
+	server.AssertUniqueKeys(t)
+	assert.Len(t, server.Batches(), 5)
+	assert.Len(t, server.AcceptedEvents(), 4)
+	assert.Equal(t, []string{retried[0].IdempotencyKey}, server.RedeliveredKeys())
+
+	// Reusing a key for a different event is caught
+	conflicting := makeEvents(now, 0, "ep-1", "ep-2")[:1]
+	conflicting[0].Value = 30
+	err = billing.Send(ctx, client, client.GenerateTraceID(), conflicting)
+	require.NoError(t, err)
+	assert.Equal(t, []string{conflicting[0].IdempotencyKey}, server.ConflictingKeys())
+}
+
+func TestServerLatency(t *testing.T) {
+	server := billingtest.NewServer()
+	defer server.Close()
+
+	server.Respond(billingtest.Response{Latency: 200 * time.Millisecond, StatusCode: 0, RetryAfter: ""})
+
+	client := billing.NewClient(server.URL(), &http.Client{Timeout: 50 * time.Millisecond})
+	events := makeEvents(time.Now(), 0, "ep-1")
+	err := billing.Send(context.Background(), client, client.GenerateTraceID(), events)
+	var requestErr billing.RequestError
+	assert.ErrorAs(t, err, &requestErr)
+
+	// The collector still accepted the events, even though the client timed out
+	server.Close()
+	assert.Len(t, server.AcceptedEvents(), 1)
+}
+
+func TestServerErrorClasses(t *testing.T) {
+	server := billingtest.NewServer()
+	defer server.Close()
+
+	server.Respond(
+		billingtest.Response{Latency: 0, StatusCode: http.StatusTooManyRequests, RetryAfter: "30"},
+		billingtest.Response{Latency: 0, StatusCode: http.StatusServiceUnavailable, RetryAfter: "5"},
+		billingtest.Response{Latency: 0, StatusCode: http.StatusServiceUnavailable, RetryAfter: ""},
+		billingtest.Response{Latency: 0, StatusCode: http.StatusUnauthorized, RetryAfter: ""},
+		billingtest.Response{Latency: 0, StatusCode: http.StatusRequestEntityTooLarge, RetryAfter: ""},
+		billingtest.Response{Latency: 0, StatusCode: http.StatusUnprocessableEntity, RetryAfter: ""},
+	)
+
+	client := billing.NewClient(server.URL(), http.DefaultClient)
+	events := makeEvents(time.Now(), 0, "ep-1")
+	send := func() error {
+		return billing.Send(context.Background(), client, client.GenerateTraceID(), events)
+	}
+
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{billing.ThrottledError{StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second}, true},
+		{billing.ThrottledError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 5 * time.Second}, true},
+		{billing.UnexpectedStatusCodeError{StatusCode: http.StatusServiceUnavailable}, true},
+		{billing.AuthError{StatusCode: http.StatusUnauthorized}, false},
+		{billing.PayloadTooLargeError{StatusCode: http.StatusRequestEntityTooLarge}, false},
+		{billing.UnexpectedStatusCodeError{StatusCode: http.StatusUnprocessableEntity}, false},
+	}
+	for _, c := range cases {
+		err := send()
+		assert.Equal(t, c.err, err)
+		assert.Equal(t, c.retryable, billing.IsRetryable(err), "%s", err)
+	}
+
+	require.NoError(t, send())
+	assert.False(t, billing.IsRetryable(billing.JSONError{Err: errors.New("bad event")}))
+	assert.True(t, billing.IsRetryable(errors.New("unknown")))
+}
+
+func TestServerValidation(t *testing.T) {
+	server := billingtest.NewServer()
+	defer server.Close()
+
+	post := func(contentType string, body string) int {
+		resp, err := http.Post(server.URL()+"/usage_events", contentType, strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post(billing.FormatProtobuf.ContentType(), ""))
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{"events": [], "unknown": 1}`))
+	// missing stop_time
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{"events": [{
+		"idempotency_key": "a", "metric": "m", "type": "incremental", "endpoint_id": "ep",
+		"start_time": "2024-01-01T00:00:00Z", "value": 1
+	}]}`))
+	// duplicate keys in the same batch
+	assert.Equal(t, http.StatusBadRequest, post("application/json", `{"events": [
+		{"idempotency_key": "a", "metric": "m", "type": "absolute", "tenant_id": "t", "time": "2024-01-01T00:00:00Z", "value": 1},
+		{"idempotency_key": "a", "metric": "m", "type": "absolute", "tenant_id": "t", "time": "2024-01-01T00:00:00Z", "value": 2}
+	]}`))
+	assert.Equal(t, http.StatusOK, post("application/json", `{"events": [
+		{"idempotency_key": "a", "metric": "m", "type": "absolute", "tenant_id": "t", "time": "2024-01-01T00:00:00Z", "value": 1}
+	]}`))
+
+	batches := server.Batches()
+	require.Len(t, batches, 6)
+	for _, b := range batches[1:5] {
+		assert.Error(t, b.Err)
+	}
+	assert.NoError(t, batches[5].Err)
+}
@@ -4,18 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/lithammer/shortuuid"
+
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 type Client struct {
 	URL   string
 	httpc *http.Client
+	// contentDigest sets whether requests include DigestHeader
+	contentDigest bool
 }
 
 var hostname string
@@ -36,7 +42,14 @@ func GetHostname() string {
 }
 
 func NewClient(url string, c *http.Client) Client {
-	return Client{URL: fmt.Sprintf("%s/usage_events", url), httpc: c}
+	return Client{URL: fmt.Sprintf("%s/usage_events", url), httpc: c, contentDigest: false}
+}
+
+// WithContentDigest returns a copy of the client that includes the digest of each request body in
+// DigestHeader
+func (c Client) WithContentDigest() Client {
+	c.contentDigest = true
+	return c
 }
 
 type TraceID string
@@ -45,10 +58,15 @@ func (c Client) GenerateTraceID() TraceID {
 	return TraceID(shortuuid.New())
 }
 
-// Enrich sets the event's Type and IdempotencyKey fields, so that users of this API don't need to
-// manually set them
-func Enrich[E Event](now time.Time, hostname string, countInBatch, batchSize int, event E) E {
+// Enrich sets the event's Type, SchemaVersion, SequenceNumber, and IdempotencyKey fields, so that
+// users of this API don't need to manually set them
+//
+// The sequence number should be unique for each event generated by this agent (typically from a
+// Sequence), so that idempotency keys remain unique even if the wall clock jumps backwards.
+func Enrich[E Event](now time.Time, hostname string, seq uint64, countInBatch, batchSize int, event E) E {
 	event.setType()
+	*event.getSchemaVersion() = CurrentSchemaVersion
+	*event.getSequenceNumber() = seq
 
 	// RFC3339 with microsecond precision. Possible to get collisions with millis, nanos are extra.
 	// And everything's in UTC, so there's no sense including the offset.
@@ -56,7 +74,7 @@ func Enrich[E Event](now time.Time, hostname string, countInBatch, batchSize int
 
 	key := event.getIdempotencyKey()
 	if *key == "" {
-		*key = fmt.Sprintf("%s-%s-%d/%d", formattedTime, hostname, countInBatch, batchSize)
+		*key = fmt.Sprintf("%s-%s-%d-%d/%d", formattedTime, hostname, seq, countInBatch, batchSize)
 	}
 
 	return event
@@ -64,40 +82,108 @@ func Enrich[E Event](now time.Time, hostname string, countInBatch, batchSize int
 
 // Send attempts to push the events to the remote endpoint.
 //
-// On failure, the error is guaranteed to be one of: JSONError, RequestError, or
-// UnexpectedStatusCodeError.
-func Send[E Event](ctx context.Context, client Client, traceID TraceID, events []E) error {
+// On failure, the error is guaranteed to be one of: JSONError, RequestError, ThrottledError,
+// AuthError, PayloadTooLargeError, or UnexpectedStatusCodeError.
+func Send[E AnyEvent](ctx context.Context, client Client, traceID TraceID, events []E) error {
 	if len(events) == 0 {
 		return nil
 	}
 
+	payload, err := Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	_, err = SendPayload(ctx, client, traceID, FormatJSON, payload)
+	return err
+}
+
+// Marshal produces the request body that Send would use for the events, so that callers can
+// inspect it before calling SendPayload.
+//
+// On failure, the error is guaranteed to be a JSONError.
+func Marshal[E AnyEvent](events []E) ([]byte, error) {
 	payload, err := json.Marshal(struct {
 		Events []E `json:"events"`
 	}{Events: events})
 	if err != nil {
-		return JSONError{Err: err}
+		return nil, JSONError{Err: err}
 	}
 
+	return payload, nil
+}
+
+// SendPayload attempts to push a request body produced by Marshal or MarshalFormat to the remote
+// endpoint. The format gives the content-type of the request.
+//
+// A collector that doesn't support the format is expected to respond with 415 Unsupported Media
+// Type, so that the caller can fall back to JSON; see IsUnsupportedFormat.
+//
+// On success, the returned AckID is the one given by the collector in AckIDHeader, if any.
+//
+// On failure, the error is guaranteed to be one of: RequestError, ThrottledError, AuthError,
+// PayloadTooLargeError, or UnexpectedStatusCodeError.
+func SendPayload(ctx context.Context, client Client, traceID TraceID, format Format, payload []byte) (AckID, error) {
 	r, err := http.NewRequestWithContext(ctx, http.MethodPost, client.URL, bytes.NewReader(payload))
 	if err != nil {
-		return RequestError{Err: err}
+		return "", RequestError{Err: err}
 	}
-	r.Header.Set("content-type", "application/json")
+	r.Header.Set("content-type", format.ContentType())
 	r.Header.Set("x-trace-id", string(traceID))
+	if client.contentDigest {
+		r.Header.Set(DigestHeader, contentDigest(payload))
+	}
+	tracing.Inject(ctx, r.Header)
 
 	resp, err := client.httpc.Do(r)
 	if err != nil {
-		return RequestError{Err: err}
+		return "", RequestError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	// theoretically if wanted/needed, we should use an http handler that
 	// does the retrying, to avoid writing that logic here.
 	if resp.StatusCode != http.StatusOK {
-		return UnexpectedStatusCodeError{StatusCode: resp.StatusCode}
+		return "", statusCodeError(resp, time.Now())
+	}
+
+	return AckID(resp.Header.Get(AckIDHeader)), nil
+}
+
+// statusCodeError returns the error for a response with a status code other than 200 OK
+func statusCodeError(resp *http.Response, now time.Time) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		retryAfter, _ := parseRetryAfter(resp.Header.Get("retry-after"), now)
+		return ThrottledError{StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+	case http.StatusServiceUnavailable:
+		// Only treat unavailability as throttling if the collector says when to come back.
+		// Otherwise, it's more likely to be an outage.
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("retry-after"), now); ok {
+			return ThrottledError{StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+		}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return AuthError{StatusCode: resp.StatusCode}
+	case http.StatusRequestEntityTooLarge:
+		return PayloadTooLargeError{StatusCode: resp.StatusCode}
 	}
 
-	return nil
+	return UnexpectedStatusCodeError{StatusCode: resp.StatusCode}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be either a number of seconds
+// or an HTTP date, returning false if it's missing or invalid
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, at.Sub(now)), true
+	}
+	return 0, false
 }
 
 type JSONError struct {
@@ -112,6 +198,11 @@ func (e JSONError) Unwrap() error {
 	return e.Err
 }
 
+// Retryable returns false, because marshaling the same events would fail again
+func (e JSONError) Retryable() bool {
+	return false
+}
+
 type RequestError struct {
 	Err error
 }
@@ -124,6 +215,11 @@ func (e RequestError) Unwrap() error {
 	return e.Err
 }
 
+// Retryable returns true, because failures to make the request are usually transient
+func (e RequestError) Retryable() bool {
+	return true
+}
+
 type UnexpectedStatusCodeError struct {
 	StatusCode int
 }
@@ -131,3 +227,82 @@ type UnexpectedStatusCodeError struct {
 func (e UnexpectedStatusCodeError) Error() string {
 	return fmt.Sprintf("Unexpected HTTP status code %d", e.StatusCode)
 }
+
+// Retryable returns whether the status code indicates a problem on the collector's side (5xx) or
+// a timeout, rather than a problem with the request itself
+func (e UnexpectedStatusCodeError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout
+}
+
+// ThrottledError is returned when the collector asked us to slow down, with 429 Too Many Requests
+// (or 503 Service Unavailable, with a Retry-After header)
+type ThrottledError struct {
+	StatusCode int
+	// RetryAfter is the time that the collector asked us to wait before retrying, from the
+	// Retry-After header. It's zero if the header was missing or invalid.
+	RetryAfter time.Duration
+}
+
+func (e ThrottledError) Error() string {
+	if e.RetryAfter != 0 {
+		return fmt.Sprintf("Throttled with HTTP status code %d, retry after %s", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("Throttled with HTTP status code %d", e.StatusCode)
+}
+
+// Retryable returns true. Callers should wait for at least RetryAfter first.
+func (e ThrottledError) Retryable() bool {
+	return true
+}
+
+// AuthError is returned when the collector rejected our credentials, with 401 Unauthorized or 403
+// Forbidden
+type AuthError struct {
+	StatusCode int
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("Authentication failed with HTTP status code %d", e.StatusCode)
+}
+
+// Retryable returns false, because the credentials won't fix themselves. The events are still
+// valid though, and can be sent once the configuration is fixed.
+func (e AuthError) Retryable() bool {
+	return false
+}
+
+// PayloadTooLargeError is returned when the collector rejected the request because it was too
+// large, with 413 Content Too Large
+type PayloadTooLargeError struct {
+	StatusCode int
+}
+
+func (e PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("Payload too large, with HTTP status code %d", e.StatusCode)
+}
+
+// Retryable returns false, because the same request would be rejected again. Sending the events in
+// smaller batches may succeed.
+func (e PayloadTooLargeError) Retryable() bool {
+	return false
+}
+
+// IsRetryable returns whether sending the same events again may succeed, given the error from
+// sending them
+//
+// Errors without a Retryable method (e.g. from other kinds of clients) are assumed to be transient.
+func IsRetryable(err error) bool {
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	return true
+}
+
+// IsUnsupportedFormat returns whether the error from SendPayload means that the collector doesn't
+// support the format of the request
+func IsUnsupportedFormat(err error) bool {
+	//nolint:errorlint // SendPayload guarantees that its errors aren't wrapped
+	e, ok := err.(UnexpectedStatusCodeError)
+	return ok && e.StatusCode == http.StatusUnsupportedMediaType
+}
@@ -0,0 +1,71 @@
+package billing
+
+// Digests of event batches, so that the collector can check that each batch arrived intact, and
+// acknowledgement IDs that the collector may return for each batch it accepts.
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const (
+	// DigestHeader is the request header carrying the digest of the entire request body, in the
+	// format from RFC 9530, i.e. "sha-256=:<base64>:"
+	DigestHeader = "content-digest"
+	// AckIDHeader is the response header that the collector may use to return an ID for the batch
+	// it accepted, so that individual batches can be traced through to the collector.
+	AckIDHeader = "x-ack-id"
+)
+
+// AckID is the acknowledgement ID returned by the collector for a batch. It's empty if the
+// collector didn't return one.
+type AckID string
+
+// BatchDigest returns the digest of the encoded events in a batch, as included in the payload by
+// MarshalFormatWithDigest: "sha-256:" followed by the hex-encoded SHA-256 hash.
+func BatchDigest(encodedEvents []byte) string {
+	sum := sha256.Sum256(encodedEvents)
+	return "sha-256:" + hex.EncodeToString(sum[:])
+}
+
+// contentDigest returns the value of DigestHeader for the request body
+func contentDigest(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// MarshalFormatWithDigest is like MarshalFormat, but additionally includes the digest of the events
+// in the payload, so that the collector can check the batch even if it's stored or forwarded
+// without the request headers.
+//
+// For JSON, the digest is in the "digest" field, and is computed over the exact bytes of the
+// "events" array. For protobuf, it's in the EventsBatch's digest field, and is computed over the
+// encoding of the events field (i.e. everything before the digest).
+//
+// On failure, the error is guaranteed to be a JSONError.
+func MarshalFormatWithDigest[E AnyEvent](format Format, events []E) ([]byte, error) {
+	if format == FormatProtobuf {
+		batch := protoBatch(events)
+		encodedEvents, err := marshalProtoBatch(batch)
+		if err != nil {
+			return nil, err
+		}
+		batch.Digest = BatchDigest(encodedEvents)
+		return marshalProtoBatch(batch)
+	}
+
+	encodedEvents, err := json.Marshal(events)
+	if err != nil {
+		return nil, JSONError{Err: err}
+	}
+	payload, err := json.Marshal(struct {
+		Events json.RawMessage `json:"events"`
+		Digest string          `json:"digest"`
+	}{Events: encodedEvents, Digest: BatchDigest(encodedEvents)})
+	if err != nil {
+		return nil, JSONError{Err: err}
+	}
+	return payload, nil
+}
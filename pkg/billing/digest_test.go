@@ -0,0 +1,87 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/neondatabase/autoscaling/pkg/billing/billingpb"
+)
+
+func TestMarshalWithDigest(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	events := []*IncrementalEvent{
+		Enrich(start, "host", 1, 1, 1, &IncrementalEvent{
+			IdempotencyKey: "",
+			MetricName:     "cpu_seconds",
+			Type:           "",
+			EndpointID:     "ep-a",
+			StartTime:      start,
+			StopTime:       start.Add(time.Minute),
+			Value:          60,
+			Anomalous:      false,
+			Partial:        false,
+			SchemaVersion:  0,
+			SequenceNumber: 0,
+			Identity:       Identity{Namespace: "", VMName: "", NodeName: "", Region: "", Architecture: "", Replicas: 0},
+		}),
+	}
+
+	payload, err := MarshalFormatWithDigest(FormatJSON, events)
+	require.NoError(t, err)
+
+	// The digest must be checkable from the exact bytes of the events array in the payload
+	var envelope struct {
+		Events json.RawMessage `json:"events"`
+		Digest string          `json:"digest"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &envelope))
+	assert.Equal(t, BatchDigest(envelope.Events), envelope.Digest)
+
+	// For protobuf, the digest covers everything before it
+	payload, err = MarshalFormatWithDigest(FormatProtobuf, events)
+	require.NoError(t, err)
+	var batch billingpb.EventsBatch
+	require.NoError(t, proto.Unmarshal(payload, &batch))
+	assert.Len(t, batch.Events, len(events))
+	encodedEvents, err := MarshalProtobuf(events)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(payload, encodedEvents))
+	assert.Equal(t, BatchDigest(encodedEvents), batch.Digest)
+}
+
+func TestSendPayloadDigestAndAck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		sum := sha256.Sum256(body)
+		assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", r.Header.Get(DigestHeader))
+
+		w.Header().Set(AckIDHeader, "batch-123")
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, server.Client()).WithContentDigest()
+	ack, err := SendPayload(context.Background(), client, "trace", FormatJSON, []byte(`{"events":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, AckID("batch-123"), ack)
+
+	// Without the digest, the header isn't set
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(DigestHeader))
+	})
+	ack, err = SendPayload(context.Background(), NewClient(server.URL, server.Client()), "trace", FormatJSON, []byte(`{}`))
+	require.NoError(t, err)
+	assert.Empty(t, ack)
+}
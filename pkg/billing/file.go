@@ -0,0 +1,294 @@
+package billing
+
+// Writing billing events to the local filesystem, for clusters without a collector or object
+// storage to push them to.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partialSuffix is added to the name of each file while it's still being written
+const partialSuffix = ".partial"
+
+// FileClient writes billing events as gzipped newline-delimited JSON, in the same date-partitioned
+// layout that cmd/billing-replay reads from S3:
+//
+//	<dir>/year=YYYY/month=MM/day=DD/<name>.ndjson.gz
+//
+// Each file is written with a ".partial" suffix, which is removed when the file is rotated, so that
+// anything reading the directory only sees complete files. Files are rotated once they reach a
+// maximum size or age, and when the date changes.
+//
+// Partial files left behind by an unclean shutdown are completed on the first call to Write.
+type FileClient struct {
+	Dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu        sync.Mutex
+	recovered bool
+	current   *openFile // nil if there's no file currently being written
+}
+
+type openFile struct {
+	path     string // final path of the file, without partialSuffix
+	file     *os.File
+	gz       *gzip.Writer
+	openedAt time.Time
+	bytes    int64 // uncompressed size so far
+}
+
+// NewFileClient returns a FileClient that writes under dir, rotating files once they contain
+// maxBytes of uncompressed events or are maxAge old
+func NewFileClient(dir string, maxBytes int64, maxAge time.Duration) *FileClient {
+	return &FileClient{
+		Dir:       dir,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		mu:        sync.Mutex{},
+		recovered: false,
+		current:   nil,
+	}
+}
+
+// Write appends the events to the current file, opening a new one if necessary, and syncs it to
+// disk before returning.
+//
+// On failure, the error may be a JSONError if the events couldn't be marshaled.
+func (c *FileClient) Write(now time.Time, events []AnyEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return JSONError{Err: err}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.recovered {
+		if err := recoverPartialFiles(c.Dir); err != nil {
+			return fmt.Errorf("Error recovering partial files: %w", err)
+		}
+		c.recovered = true
+	}
+
+	if c.current != nil && c.shouldRotate(now) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	if c.current == nil {
+		f, err := openNewFile(c.Dir, now)
+		if err != nil {
+			return err
+		}
+		c.current = f
+	}
+
+	if _, err := c.current.gz.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Error writing to %s: %w", c.current.file.Name(), err)
+	}
+	c.current.bytes += int64(buf.Len())
+	if err := c.current.gz.Flush(); err != nil {
+		return fmt.Errorf("Error flushing %s: %w", c.current.file.Name(), err)
+	}
+	if err := c.current.file.Sync(); err != nil {
+		return fmt.Errorf("Error syncing %s: %w", c.current.file.Name(), err)
+	}
+
+	if c.current.bytes >= c.maxBytes {
+		return c.rotate()
+	}
+	return nil
+}
+
+// RotateIfExpired completes the current file if it's past its maximum age, so that files are
+// rotated even if no new events are written
+func (c *FileClient) RotateIfExpired(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current == nil || !c.shouldRotate(now) {
+		return nil
+	}
+	return c.rotate()
+}
+
+// Close completes the current file, if there is one
+func (c *FileClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current == nil {
+		return nil
+	}
+	return c.rotate()
+}
+
+func (c *FileClient) shouldRotate(now time.Time) bool {
+	return now.Sub(c.current.openedAt) >= c.maxAge ||
+		c.current.bytes >= c.maxBytes ||
+		datePartition(now) != datePartition(c.current.openedAt)
+}
+
+// rotate completes the current file and renames it to its final path
+//
+// The current file is cleared even on failure, so that the next write starts a new one. The partial
+// file is left to be recovered on the next restart.
+func (c *FileClient) rotate() error {
+	f := c.current
+	c.current = nil
+
+	if err := f.gz.Close(); err != nil {
+		_ = f.file.Close()
+		return fmt.Errorf("Error completing %s: %w", f.file.Name(), err)
+	}
+	if err := f.file.Sync(); err != nil {
+		_ = f.file.Close()
+		return fmt.Errorf("Error syncing %s: %w", f.file.Name(), err)
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("Error closing %s: %w", f.file.Name(), err)
+	}
+	if err := os.Rename(f.file.Name(), f.path); err != nil {
+		return fmt.Errorf("Error renaming completed file: %w", err)
+	}
+	return nil
+}
+
+// datePartition returns the directory, relative to the root, that files opened at the time are
+// written to
+func datePartition(t time.Time) string {
+	t = t.UTC()
+	return filepath.Join(
+		fmt.Sprintf("year=%04d", t.Year()),
+		fmt.Sprintf("month=%02d", t.Month()),
+		fmt.Sprintf("day=%02d", t.Day()),
+	)
+}
+
+func openNewFile(dir string, now time.Time) (*openFile, error) {
+	partitionDir := filepath.Join(dir, datePartition(now))
+	if err := os.MkdirAll(partitionDir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating directory: %w", err)
+	}
+
+	// Include the hostname, so that multiple agents can share a directory.
+	name := fmt.Sprintf("%s-%s.ndjson.gz", now.UTC().Format("20060102T150405.000000Z"), hostname)
+	path := filepath.Join(partitionDir, name)
+
+	file, err := os.OpenFile(path+partialSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file: %w", err)
+	}
+
+	return &openFile{
+		path:     path,
+		file:     file,
+		gz:       gzip.NewWriter(file),
+		openedAt: now,
+		bytes:    0,
+	}, nil
+}
+
+// recoverPartialFiles completes any partial files under dir, which may have been left behind if
+// the process exited without closing them
+//
+// Each batch of events is flushed in full before Write returns, so the partial file only lacks the
+// gzip trailer (and possibly part of a batch that was being written). Everything up to the last
+// complete line is rewritten to the final path.
+func recoverPartialFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == dir {
+				return nil // nothing written yet
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		return recoverPartialFile(path)
+	})
+}
+
+func recoverPartialFile(partialPath string) error {
+	data, err := readTruncatedGzip(partialPath)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %w", partialPath, err)
+	}
+	// Drop any incomplete line at the end
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	finalPath := strings.TrimSuffix(partialPath, partialSuffix)
+	if len(data) == 0 {
+		return os.Remove(partialPath)
+	}
+
+	tmpPath := finalPath + ".recovering"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(file)
+	if _, err := gz.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+	return os.Remove(partialPath)
+}
+
+// readTruncatedGzip returns the decompressed contents of the file, ignoring a missing trailer
+func readTruncatedGzip(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil // empty file; nothing was written
+		}
+		return nil, err
+	}
+
+	data, err := io.ReadAll(gz)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return data, nil
+}
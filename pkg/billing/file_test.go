@@ -0,0 +1,133 @@
+package billing
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readFiles returns the idempotency keys of the events in each complete file under dir, along with
+// the paths of any partial files
+func readFiles(t *testing.T, dir string) (complete map[string][]string, partial []string) {
+	complete = make(map[string][]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		require.NoError(t, err)
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		require.NoError(t, err)
+		if filepath.Ext(path) == partialSuffix {
+			partial = append(partial, rel)
+			return nil
+		}
+
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		require.NoError(t, err)
+		scanner := bufio.NewScanner(gz)
+		keys := []string{}
+		for scanner.Scan() {
+			var event IncrementalEvent
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			keys = append(keys, event.IdempotencyKey)
+		}
+		require.NoError(t, scanner.Err())
+		complete[rel] = keys
+		return nil
+	})
+	require.NoError(t, err)
+	return complete, partial
+}
+
+func fileEvents(keys ...string) []AnyEvent {
+	var events []AnyEvent
+	for _, key := range keys {
+		e := new(IncrementalEvent)
+		e.IdempotencyKey = key
+		events = append(events, e)
+	}
+	return events
+}
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestFileClientRotation(t *testing.T) {
+	dir := t.TempDir()
+	client := NewFileClient(dir, 1<<20, time.Minute)
+
+	start := time.Date(2024, time.March, 31, 23, 59, 40, 0, time.UTC)
+	require.NoError(t, client.Write(start, fileEvents("a", "b")))
+	require.NoError(t, client.Write(start.Add(10*time.Second), fileEvents("c")))
+
+	// Nothing is complete until the file is rotated
+	complete, partial := readFiles(t, dir)
+	assert.Empty(t, complete)
+	assert.Len(t, partial, 1)
+
+	// The date changes, so a new file is started in the next partition
+	require.NoError(t, client.Write(start.Add(30*time.Second), fileEvents("d")))
+	// ... and then rotated because of its age
+	require.NoError(t, client.RotateIfExpired(start.Add(2*time.Minute)))
+
+	complete, partial = readFiles(t, dir)
+	assert.Empty(t, partial)
+	paths := sortedKeys(complete)
+	require.Len(t, paths, 2)
+	assert.Equal(t, "year=2024/month=03/day=31", filepath.Dir(paths[0]))
+	assert.Equal(t, "year=2024/month=04/day=01", filepath.Dir(paths[1]))
+	assert.Equal(t, []string{"a", "b", "c"}, complete[paths[0]])
+	assert.Equal(t, []string{"d"}, complete[paths[1]])
+}
+
+func TestFileClientMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	client := NewFileClient(dir, 1, time.Hour)
+
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, client.Write(now, fileEvents("a")))
+	require.NoError(t, client.Write(now.Add(time.Second), fileEvents("b")))
+	require.NoError(t, client.Close())
+
+	complete, partial := readFiles(t, dir)
+	assert.Empty(t, partial)
+	assert.Len(t, complete, 2)
+}
+
+func TestFileClientRecovery(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	// Simulate an unclean shutdown by never closing the first client
+	crashed := NewFileClient(dir, 1<<20, time.Hour)
+	require.NoError(t, crashed.Write(now, fileEvents("a", "b")))
+
+	client := NewFileClient(dir, 1<<20, time.Hour)
+	require.NoError(t, client.Write(now.Add(time.Second), fileEvents("c")))
+	require.NoError(t, client.Close())
+
+	complete, partial := readFiles(t, dir)
+	assert.Empty(t, partial)
+	var all []string
+	for _, path := range sortedKeys(complete) {
+		all = append(all, complete[path]...)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, all)
+}
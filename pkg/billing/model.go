@@ -23,6 +23,24 @@ type Event interface {
 type eventMethods interface {
 	setType()
 	getIdempotencyKey() *string
+	getSequenceNumber() *uint64
+	getSchemaVersion() *uint
+	getEndpointID() string
+
+	// GetSequenceNumber returns the per-agent sequence number assigned to the event by Enrich
+	GetSequenceNumber() uint64
+}
+
+// AnyEvent is implemented by all of the event types, for when events of different types need to be
+// stored or sent together. It cannot be implemented outside this package.
+type AnyEvent interface {
+	eventMethods
+}
+
+// EndpointIDOf returns the endpoint ID of the event, which may be empty for an AbsoluteEvent that's
+// not about an endpoint
+func EndpointIDOf(e AnyEvent) string {
+	return e.getEndpointID()
 }
 
 var (
@@ -30,14 +48,47 @@ var (
 	_ eventMethods = (*IncrementalEvent)(nil)
 )
 
+// CurrentSchemaVersion is the version of the event schema that's produced by this package. It's
+// incremented whenever fields are added or their meaning changes, so that the collector doesn't need
+// to guess from which fields are present.
+//
+// Version 1 is the first to include the schema version; events without it are from before then.
+// Version 2 added the fields from Identity.
+// Version 3 added Identity.Architecture.
+// Version 4 added Identity.Replicas.
+const CurrentSchemaVersion uint = 4
+
+// Identity gives optional metadata about where the usage in an event came from, so that it can be
+// joined to other infrastructure data without a separate lookup. Fields that aren't known, or
+// aren't enabled, are empty.
+type Identity struct {
+	Namespace    string `json:"namespace,omitempty"`
+	VMName       string `json:"vm_name,omitempty"`
+	NodeName     string `json:"node_name,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	// Replicas is the number of replicas in the VM's scaling group, if it's in one
+	Replicas int `json:"replicas,omitempty"`
+}
+
+// AbsoluteEvent gives the value of a metric at a particular time, either for a tenant and timeline,
+// or for an endpoint.
 type AbsoluteEvent struct {
+	SchemaVersion  uint      `json:"schema_version"`
 	IdempotencyKey string    `json:"idempotency_key"`
 	MetricName     string    `json:"metric"`
 	Type           string    `json:"type"`
-	TenantID       string    `json:"tenant_id"`
-	TimelineID     string    `json:"timeline_id"`
+	TenantID       string    `json:"tenant_id,omitempty"`
+	TimelineID     string    `json:"timeline_id,omitempty"`
+	EndpointID     string    `json:"endpoint_id,omitempty"`
 	Time           time.Time `json:"time"`
 	Value          int       `json:"value"`
+
+	Identity
+
+	// SequenceNumber is the per-agent sequence number assigned to the event by Enrich. It's not
+	// sent to the collector directly, but is incorporated into IdempotencyKey.
+	SequenceNumber uint64 `json:"-"`
 }
 
 // setType implements eventMethods
@@ -50,7 +101,28 @@ func (e *AbsoluteEvent) getIdempotencyKey() *string {
 	return &e.IdempotencyKey
 }
 
+// getSequenceNumber implements eventMethods
+func (e *AbsoluteEvent) getSequenceNumber() *uint64 {
+	return &e.SequenceNumber
+}
+
+// GetSequenceNumber implements eventMethods
+func (e *AbsoluteEvent) GetSequenceNumber() uint64 {
+	return e.SequenceNumber
+}
+
+// getSchemaVersion implements eventMethods
+func (e *AbsoluteEvent) getSchemaVersion() *uint {
+	return &e.SchemaVersion
+}
+
+// getEndpointID implements eventMethods
+func (e *AbsoluteEvent) getEndpointID() string {
+	return e.EndpointID
+}
+
 type IncrementalEvent struct {
+	SchemaVersion  uint      `json:"schema_version"`
 	IdempotencyKey string    `json:"idempotency_key"`
 	MetricName     string    `json:"metric"`
 	Type           string    `json:"type"`
@@ -58,6 +130,20 @@ type IncrementalEvent struct {
 	StartTime      time.Time `json:"start_time"`
 	StopTime       time.Time `json:"stop_time"`
 	Value          int       `json:"value"`
+
+	// Anomalous is set if the value was flagged as an implausible jump compared to recent usage
+	// for the same endpoint. The event is still valid, but may warrant investigation.
+	Anomalous bool `json:"anomalous,omitempty"`
+
+	// Partial is set if some of the usage during the window couldn't be collected in time. That
+	// usage is included in a later event for the same endpoint and metric, once it's available.
+	Partial bool `json:"partial,omitempty"`
+
+	Identity
+
+	// SequenceNumber is the per-agent sequence number assigned to the event by Enrich. It's not
+	// sent to the collector directly, but is incorporated into IdempotencyKey.
+	SequenceNumber uint64 `json:"-"`
 }
 
 // setType implements eventMethods
@@ -69,3 +155,23 @@ func (e *IncrementalEvent) setType() {
 func (e *IncrementalEvent) getIdempotencyKey() *string {
 	return &e.IdempotencyKey
 }
+
+// getSequenceNumber implements eventMethods
+func (e *IncrementalEvent) getSequenceNumber() *uint64 {
+	return &e.SequenceNumber
+}
+
+// GetSequenceNumber implements eventMethods
+func (e *IncrementalEvent) GetSequenceNumber() uint64 {
+	return e.SequenceNumber
+}
+
+// getSchemaVersion implements eventMethods
+func (e *IncrementalEvent) getSchemaVersion() *uint {
+	return &e.SchemaVersion
+}
+
+// getEndpointID implements eventMethods
+func (e *IncrementalEvent) getEndpointID() string {
+	return e.EndpointID
+}
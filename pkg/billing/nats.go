@@ -0,0 +1,153 @@
+package billing
+
+// Publishing billing events to NATS JetStream, as an alternative to pushing them over HTTP
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Variables that may be used in a NATSClient's subject template
+const (
+	SubjectTemplateEndpointID = "{endpoint_id}"
+	SubjectTemplateMetric     = "{metric}"
+)
+
+// NATSClient publishes each billing event as a separate JetStream message, with the event's
+// idempotency key as its Nats-Msg-Id, so that events published more than once (within the
+// stream's duplicate window) are deduplicated by the stream.
+//
+// The connection is made on first use. After that, the NATS client library reconnects
+// automatically, according to the options given to NewNATSClient.
+type NATSClient struct {
+	URL             string
+	subjectTemplate string
+	opts            []nats.Option
+
+	mu   sync.Mutex
+	conn *nats.Conn // nil if not yet connected
+	js   nats.JetStreamContext
+}
+
+// NewNATSClient returns a NATSClient that connects to the NATS servers at url (which may be a
+// comma-separated list) with the options, publishing events to subjects from subjectTemplate
+func NewNATSClient(url string, subjectTemplate string, opts ...nats.Option) *NATSClient {
+	return &NATSClient{
+		URL:             url,
+		subjectTemplate: subjectTemplate,
+		opts:            opts,
+		mu:              sync.Mutex{},
+		conn:            nil,
+		js:              nil,
+	}
+}
+
+// Subject returns the subject that the event is published to
+//
+// Events without an endpoint ID use "none" in its place, because subjects can't have empty tokens.
+func (c *NATSClient) Subject(e AnyEvent) string {
+	endpointID := e.getEndpointID()
+	if endpointID == "" {
+		endpointID = "none"
+	}
+
+	var metric string
+	switch e := e.(type) {
+	case *AbsoluteEvent:
+		metric = e.MetricName
+	case *IncrementalEvent:
+		metric = e.MetricName
+	}
+
+	return strings.NewReplacer(
+		SubjectTemplateEndpointID, endpointID,
+		SubjectTemplateMetric, metric,
+	).Replace(c.subjectTemplate)
+}
+
+// Publish publishes the events and waits for JetStream to acknowledge all of them, returning the
+// number that were deduplicated by the stream.
+//
+// On failure, the error may be a JSONError if the events couldn't be marshaled.
+func (c *NATSClient) Publish(ctx context.Context, events []AnyEvent) (duplicates int, _ error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	js, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	futures := make([]nats.PubAckFuture, 0, len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return 0, JSONError{Err: err}
+		}
+
+		msg := nats.NewMsg(c.Subject(e))
+		msg.Data = data
+		// Equivalent to the nats.MsgId option
+		msg.Header.Set(nats.MsgIdHdr, *e.getIdempotencyKey())
+		f, err := js.PublishMsgAsync(msg)
+		if err != nil {
+			return 0, fmt.Errorf("Error publishing event: %w", err)
+		}
+		futures = append(futures, f)
+	}
+
+	for _, f := range futures {
+		select {
+		case ack := <-f.Ok():
+			if ack.Duplicate {
+				duplicates += 1
+			}
+		case err := <-f.Err():
+			return duplicates, fmt.Errorf("Error publishing event: %w", err)
+		case <-ctx.Done():
+			return duplicates, fmt.Errorf("Error waiting for acknowledgement: %w", ctx.Err())
+		}
+	}
+	return duplicates, nil
+}
+
+// Close closes the connection, if there is one
+func (c *NATSClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.js = nil
+	}
+}
+
+func (c *NATSClient) connect() (nats.JetStreamContext, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.js != nil {
+		return c.js, nil
+	}
+
+	conn, err := nats.Connect(c.URL, c.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to NATS: %w", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error creating JetStream context: %w", err)
+	}
+
+	c.conn = conn
+	c.js = js
+	return js, nil
+}
@@ -0,0 +1,154 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATSSubject(t *testing.T) {
+	client := NewNATSClient("nats://localhost:4222", "billing.{metric}.{endpoint_id}")
+
+	incremental := new(IncrementalEvent)
+	incremental.MetricName = "cpu_seconds"
+	incremental.EndpointID = "ep-a"
+	assert.Equal(t, "billing.cpu_seconds.ep-a", client.Subject(incremental))
+
+	// Events that aren't about an endpoint still need a valid subject
+	absolute := new(AbsoluteEvent)
+	absolute.MetricName = "storage_size"
+	assert.Equal(t, "billing.storage_size.none", client.Subject(absolute))
+}
+
+// fakeJetStream records the messages that are published, acknowledging each one with the result
+// from ack. Any other use of the JetStreamContext panics.
+type fakeJetStream struct {
+	nats.JetStreamContext
+
+	published []*nats.Msg
+	// ack returns the acknowledgement or error for the i'th message, or neither if it's never
+	// acknowledged
+	ack func(i int) (*nats.PubAck, error)
+}
+
+func (f *fakeJetStream) PublishMsgAsync(msg *nats.Msg, _ ...nats.PubOpt) (nats.PubAckFuture, error) {
+	future := fakePubAckFuture{msg: msg, ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	ack, err := f.ack(len(f.published))
+	if ack != nil {
+		future.ok <- ack
+	} else if err != nil {
+		future.err <- err
+	}
+	f.published = append(f.published, msg)
+	return future, nil
+}
+
+type fakePubAckFuture struct {
+	msg *nats.Msg
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func (f fakePubAckFuture) Ok() <-chan *nats.PubAck { return f.ok }
+func (f fakePubAckFuture) Err() <-chan error       { return f.err }
+func (f fakePubAckFuture) Msg() *nats.Msg          { return f.msg }
+
+func TestNATSPublish(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var events []AnyEvent
+	for i, endpointID := range []string{"ep-a", "ep-b", "ep-c"} {
+		//nolint:exhaustruct // other fields are set by Enrich, or irrelevant
+		events = append(events, Enrich(now, "host", uint64(i), i+1, 3, &IncrementalEvent{
+			MetricName: "cpu_seconds",
+			EndpointID: endpointID,
+			StartTime:  now.Add(-time.Minute),
+			StopTime:   now,
+			Value:      i,
+		}))
+	}
+
+	client := NewNATSClient("nats://localhost:4222", "billing.{metric}.{endpoint_id}")
+	js := &fakeJetStream{
+		JetStreamContext: nil,
+		published:        nil,
+		ack: func(i int) (*nats.PubAck, error) {
+			// The second event was already published
+			return &nats.PubAck{Stream: "billing", Sequence: uint64(i), Duplicate: i == 1}, nil
+		},
+	}
+	client.js = js
+
+	duplicates, err := client.Publish(context.Background(), events)
+	require.NoError(t, err)
+	assert.Equal(t, 1, duplicates)
+
+	// Each event is a separate message, deduplicated by its idempotency key
+	require.Len(t, js.published, len(events))
+	for i, msg := range js.published {
+		e := events[i].(*IncrementalEvent)
+		assert.Equal(t, "billing.cpu_seconds."+e.EndpointID, msg.Subject)
+		assert.Equal(t, e.IdempotencyKey, msg.Header.Get(nats.MsgIdHdr))
+		assert.NotEmpty(t, e.IdempotencyKey)
+
+		var decoded IncrementalEvent
+		require.NoError(t, json.Unmarshal(msg.Data, &decoded))
+		assert.Equal(t, e.EndpointID, decoded.EndpointID)
+		assert.Equal(t, e.Value, decoded.Value)
+		assert.Equal(t, "incremental", decoded.Type)
+		assert.True(t, e.StartTime.Equal(decoded.StartTime))
+	}
+
+	// Nothing is published for an empty batch, so it doesn't need a connection.
+	empty := NewNATSClient("nats://localhost:4222", "billing.{metric}.{endpoint_id}")
+	duplicates, err = empty.Publish(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, duplicates)
+}
+
+func TestNATSPublishFailure(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var events []AnyEvent
+	for i := 0; i < 2; i++ {
+		//nolint:exhaustruct // other fields are set by Enrich, or irrelevant
+		events = append(events, Enrich(now, "host", uint64(i), i+1, 2, &AbsoluteEvent{
+			MetricName: "heartbeat",
+			EndpointID: "ep-a",
+			Time:       now,
+			Value:      1,
+		}))
+	}
+
+	client := NewNATSClient("nats://localhost:4222", "billing.{metric}.{endpoint_id}")
+
+	// An error for any of the events fails the whole batch, after counting the duplicates so far
+	client.js = &fakeJetStream{
+		JetStreamContext: nil,
+		published:        nil,
+		ack: func(i int) (*nats.PubAck, error) {
+			if i == 0 {
+				return &nats.PubAck{Stream: "billing", Sequence: 1, Duplicate: true}, nil
+			}
+			return nil, errors.New("no responders")
+		},
+	}
+	duplicates, err := client.Publish(context.Background(), events)
+	assert.ErrorContains(t, err, "no responders")
+	assert.Equal(t, 1, duplicates)
+
+	// If the acknowledgements don't arrive in time, the context's error is returned
+	client.js = &fakeJetStream{
+		JetStreamContext: nil,
+		published:        nil,
+		ack:              func(int) (*nats.PubAck, error) { return nil, nil },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Publish(ctx, events)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
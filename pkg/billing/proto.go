@@ -0,0 +1,127 @@
+package billing
+
+// Protobuf encoding of events, following the schema in billingpb/billing.proto.
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/neondatabase/autoscaling/pkg/billing/billingpb"
+)
+
+// Format is the wire format used for pushing events
+type Format string
+
+const (
+	// FormatJSON is the default format, as described by billing-v1.yaml
+	FormatJSON Format = "json"
+	// FormatProtobuf is the format described by billingpb/billing.proto
+	FormatProtobuf Format = "protobuf"
+)
+
+// Valid returns whether f is one of the known formats. The empty string is valid, and is the same
+// as FormatJSON.
+func (f Format) Valid() bool {
+	switch f {
+	case "", FormatJSON, FormatProtobuf:
+		return true
+	default:
+		return false
+	}
+}
+
+// ContentType returns the value of the content-type header for request bodies in the format
+func (f Format) ContentType() string {
+	if f == FormatProtobuf {
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// MarshalFormat produces the request body for the events in the given format
+//
+// On failure, the error is guaranteed to be a JSONError.
+func MarshalFormat[E AnyEvent](format Format, events []E) ([]byte, error) {
+	if format == FormatProtobuf {
+		return MarshalProtobuf(events)
+	}
+	return Marshal(events)
+}
+
+// MarshalProtobuf produces the protobuf encoding of the events, as an EventsBatch
+//
+// On failure, the error is guaranteed to be a JSONError.
+func MarshalProtobuf[E AnyEvent](events []E) ([]byte, error) {
+	return marshalProtoBatch(protoBatch(events))
+}
+
+// protoBatch returns the EventsBatch message for the events, without a digest
+func protoBatch[E AnyEvent](events []E) *billingpb.EventsBatch {
+	batch := &billingpb.EventsBatch{Events: make([]*billingpb.Event, 0, len(events)), Digest: ""}
+	for _, e := range events {
+		batch.Events = append(batch.Events, protoEvent(e))
+	}
+	return batch
+}
+
+// marshalProtoBatch returns the encoding of the batch
+//
+// Fields are encoded in the order of their field numbers, so the digest is always after the events.
+func marshalProtoBatch(batch *billingpb.EventsBatch) ([]byte, error) {
+	b, err := proto.Marshal(batch)
+	if err != nil {
+		// proto3 requires strings to be valid UTF-8, which JSON doesn't check.
+		return nil, JSONError{Err: err}
+	}
+	return b, nil
+}
+
+func protoEvent(event AnyEvent) *billingpb.Event {
+	//nolint:exhaustruct // fields are set below, depending on the type of event
+	pe := &billingpb.Event{}
+	setIdentity := func(id Identity) {
+		pe.Namespace = id.Namespace
+		pe.VmName = id.VMName
+		pe.NodeName = id.NodeName
+		pe.Region = id.Region
+		pe.Architecture = id.Architecture
+		pe.Replicas = int64(id.Replicas)
+	}
+
+	switch e := event.(type) {
+	case *AbsoluteEvent:
+		pe.SchemaVersion = uint32(e.SchemaVersion)
+		pe.IdempotencyKey = e.IdempotencyKey
+		pe.Metric = e.MetricName
+		pe.Type = e.Type
+		pe.TenantId = e.TenantID
+		pe.TimelineId = e.TimelineID
+		pe.EndpointId = e.EndpointID
+		pe.Time = protoTimestamp(e.Time)
+		pe.Value = int64(e.Value)
+		setIdentity(e.Identity)
+	case *IncrementalEvent:
+		pe.SchemaVersion = uint32(e.SchemaVersion)
+		pe.IdempotencyKey = e.IdempotencyKey
+		pe.Metric = e.MetricName
+		pe.Type = e.Type
+		pe.EndpointId = e.EndpointID
+		pe.StartTime = protoTimestamp(e.StartTime)
+		pe.StopTime = protoTimestamp(e.StopTime)
+		pe.Value = int64(e.Value)
+		pe.Anomalous = e.Anomalous
+		pe.Partial = e.Partial
+		setIdentity(e.Identity)
+	}
+	return pe
+}
+
+// protoTimestamp returns t as a google.protobuf.Timestamp, or nil if it's unset
+func protoTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
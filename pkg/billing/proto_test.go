@@ -0,0 +1,90 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/neondatabase/autoscaling/pkg/billing/billingpb"
+)
+
+func TestMarshalProtobuf(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 500, time.UTC)
+	event := Enrich(start, "host", 7, 1, 1, &IncrementalEvent{
+		SchemaVersion:  0,
+		IdempotencyKey: "",
+		MetricName:     "effective_compute_seconds",
+		Type:           "",
+		EndpointID:     "ep-foo",
+		StartTime:      start,
+		StopTime:       start.Add(time.Minute),
+		Value:          -3,
+		Anomalous:      false,
+		Partial:        true,
+		Identity:       Identity{Namespace: "default", VMName: "compute-foo", NodeName: "", Region: "", Architecture: "", Replicas: 2},
+		SequenceNumber: 0,
+	})
+
+	payload, err := MarshalProtobuf([]*IncrementalEvent{event})
+	require.NoError(t, err)
+	var batch billingpb.EventsBatch
+	require.NoError(t, proto.Unmarshal(payload, &batch))
+	require.Len(t, batch.Events, 1)
+
+	e := batch.Events[0]
+	assert.Equal(t, uint32(CurrentSchemaVersion), e.SchemaVersion)
+	assert.Equal(t, event.IdempotencyKey, e.IdempotencyKey)
+	assert.Equal(t, "effective_compute_seconds", e.Metric)
+	assert.Equal(t, "incremental", e.Type)
+	assert.Equal(t, "ep-foo", e.EndpointId)
+	assert.True(t, e.Partial)
+	assert.False(t, e.Anomalous)
+	assert.Equal(t, int64(-3), e.Value)
+	assert.Equal(t, "default", e.Namespace)
+	assert.Equal(t, "compute-foo", e.VmName)
+	assert.Equal(t, int64(2), e.Replicas)
+	assert.True(t, start.Equal(e.StartTime.AsTime()))
+	assert.True(t, start.Add(time.Minute).Equal(e.StopTime.AsTime()))
+	// Fields that are only for absolute events are unset
+	assert.Nil(t, e.Time)
+	assert.Empty(t, e.TenantId)
+	assert.Empty(t, batch.Digest)
+}
+
+func TestMarshalProtobufAbsolute(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	event := Enrich(now, "host", 7, 1, 1, &AbsoluteEvent{
+		SchemaVersion:  0,
+		IdempotencyKey: "",
+		MetricName:     "heartbeat",
+		Type:           "",
+		TenantID:       "tenant",
+		TimelineID:     "timeline",
+		EndpointID:     "",
+		Time:           now,
+		Value:          4,
+		Identity:       Identity{Namespace: "", VMName: "", NodeName: "node", Region: "us-east-2", Architecture: "arm64", Replicas: 0},
+		SequenceNumber: 0,
+	})
+
+	payload, err := MarshalProtobuf([]*AbsoluteEvent{event})
+	require.NoError(t, err)
+	var batch billingpb.EventsBatch
+	require.NoError(t, proto.Unmarshal(payload, &batch))
+	require.Len(t, batch.Events, 1)
+
+	e := batch.Events[0]
+	assert.Equal(t, "absolute", e.Type)
+	assert.Equal(t, "tenant", e.TenantId)
+	assert.Equal(t, "timeline", e.TimelineId)
+	assert.Equal(t, int64(4), e.Value)
+	assert.True(t, now.Equal(e.Time.AsTime()))
+	assert.Equal(t, "node", e.NodeName)
+	assert.Equal(t, "us-east-2", e.Region)
+	assert.Equal(t, "arm64", e.Architecture)
+	assert.Nil(t, e.StartTime)
+	assert.Nil(t, e.StopTime)
+}
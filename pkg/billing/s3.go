@@ -0,0 +1,211 @@
+package billing
+
+// Pushing billing events to S3, in the date-partitioned layout that cmd/billing-replay reads.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lithammer/shortuuid"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Limits on object tags, from S3
+const (
+	maxObjectTags     = 10
+	maxObjectTagKey   = 128
+	maxObjectTagValue = 256
+)
+
+type S3ClientConfig struct {
+	Bucket string `json:"bucket"`
+	// Region is the AWS region of the bucket. If empty, the region is taken from the environment.
+	Region string `json:"region,omitempty"`
+	// PrefixInBucket, if not empty, is prepended to the key of each object.
+	PrefixInBucket string `json:"prefixInBucket,omitempty"`
+	// Endpoint, if not empty, overrides the S3 endpoint, e.g. for S3-compatible storage.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// SSEKMSKeyARN, if not empty, encrypts each object at rest with the KMS key that has this ARN.
+	// Otherwise, the bucket's default encryption applies.
+	SSEKMSKeyARN string `json:"sseKMSKeyARN,omitempty"`
+	// ACL, if not empty, is the canned ACL applied to each object, e.g.
+	// "bucket-owner-full-control" for a bucket in another account that hasn't disabled ACLs.
+	ACL string `json:"acl,omitempty"`
+	// ExpectedBucketOwner, if not empty, is the ID of the account that must own the bucket. Uploads
+	// fail if the bucket is owned by any other account.
+	ExpectedBucketOwner string `json:"expectedBucketOwner,omitempty"`
+	// Tags, if not empty, are applied to each object, e.g. for cost allocation.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Credentials, if not nil, sets where the AWS credentials come from, instead of the default
+	// credential chain. See S3CredentialsConfig.
+	Credentials *S3CredentialsConfig `json:"credentials,omitempty"`
+}
+
+// Validate checks that the config is valid, returning the problems found. Field names in the errors
+// are prefixed with path, which is the path to the config itself.
+func (c S3ClientConfig) Validate(path string) []error {
+	var errs []error
+	if c.Bucket == "" {
+		errs = append(errs, fmt.Errorf("field %q cannot be empty", path+".bucket"))
+	}
+	if c.ACL != "" && !slices.Contains(s3types.ObjectCannedACL("").Values(), s3types.ObjectCannedACL(c.ACL)) {
+		errs = append(errs, fmt.Errorf("field %q has unknown canned ACL %q", path+".acl", c.ACL))
+	}
+	if len(c.Tags) > maxObjectTags {
+		errs = append(errs, fmt.Errorf("field %q has %d tags, more than the maximum of %d", path+".tags", len(c.Tags), maxObjectTags))
+	}
+	keys := maps.Keys(c.Tags)
+	slices.Sort(keys)
+	for _, k := range keys {
+		if k == "" || len(k) > maxObjectTagKey {
+			errs = append(errs, fmt.Errorf("field %q has tag key %q, which must be between 1 and %d characters", path+".tags", k, maxObjectTagKey))
+		}
+		if len(c.Tags[k]) > maxObjectTagValue {
+			errs = append(errs, fmt.Errorf("field %q has a value for tag %q longer than %d characters", path+".tags", k, maxObjectTagValue))
+		}
+	}
+	if c.Credentials != nil {
+		errs = append(errs, c.Credentials.validate(path+".credentials")...)
+	}
+	return errs
+}
+
+// S3Client writes each batch of billing events as a separate gzipped newline-delimited JSON
+// object, under
+//
+//	<prefix>/year=YYYY/month=MM/day=DD/<hh:mm:ss>Z_<id>.ndjson.gz
+//
+// The AWS client is only created on the first upload, so that a problem with the AWS config is
+// reported (and retried) like any other failure to push events.
+type S3Client struct {
+	Config S3ClientConfig
+
+	mu     sync.Mutex
+	client *s3.Client // nil until the first upload
+}
+
+func NewS3Client(conf S3ClientConfig) *S3Client {
+	return &S3Client{
+		Config: conf,
+		mu:     sync.Mutex{},
+		client: nil,
+	}
+}
+
+// Upload writes the events to a new object.
+//
+// On failure, the error is guaranteed to be one of: JSONError or RequestError.
+func (c *S3Client) Upload(ctx context.Context, now time.Time, events []AnyEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return JSONError{Err: err}
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return JSONError{Err: err}
+	}
+
+	client, err := c.getClient(ctx)
+	if err != nil {
+		return RequestError{Err: err}
+	}
+
+	_, err = client.PutObject(ctx, c.putObjectInput(c.objectKey(now), buf.Bytes()))
+	if err != nil {
+		return RequestError{Err: err}
+	}
+	return nil
+}
+
+func (c *S3Client) putObjectInput(key string, body []byte) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(c.Config.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}
+	if c.Config.SSEKMSKeyARN != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(c.Config.SSEKMSKeyARN)
+	}
+	if c.Config.ACL != "" {
+		input.ACL = s3types.ObjectCannedACL(c.Config.ACL)
+	}
+	if c.Config.ExpectedBucketOwner != "" {
+		input.ExpectedBucketOwner = aws.String(c.Config.ExpectedBucketOwner)
+	}
+	if len(c.Config.Tags) != 0 {
+		tags := url.Values{}
+		for k, v := range c.Config.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	return input
+}
+
+// objectKey returns the key of a new object for events uploaded at the time
+func (c *S3Client) objectKey(now time.Time) string {
+	now = now.UTC()
+	key := fmt.Sprintf(
+		"year=%04d/month=%02d/day=%02d/%s_%s.ndjson.gz",
+		now.Year(), now.Month(), now.Day(), now.Format("15:04:05Z"), shortuuid.New(),
+	)
+	if prefix := strings.TrimSuffix(c.Config.PrefixInBucket, "/"); prefix != "" {
+		key = fmt.Sprintf("%s/%s", prefix, key)
+	}
+	return key
+}
+
+func (c *S3Client) getClient(ctx context.Context) (*s3.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if c.Config.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(c.Config.Region))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS config: %w", err)
+	}
+	if awsConf.Region == "" {
+		return nil, errors.New("AWS region is not set in the config or the environment")
+	}
+	if c.Config.Credentials != nil {
+		awsConf.Credentials = c.Config.Credentials.provider(awsConf)
+	}
+
+	c.client = s3.NewFromConfig(awsConf, func(o *s3.Options) {
+		if c.Config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Config.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return c.client, nil
+}
@@ -0,0 +1,450 @@
+package billing
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestAWSEnv makes the AWS config come only from the environment, with fixed credentials
+func setTestAWSEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+}
+
+type s3Request struct {
+	method string
+	path   string
+	header http.Header
+	events []map[string]any
+}
+
+type stsRequest struct {
+	header http.Header
+	form   url.Values
+}
+
+// stsResponseTmpl is the response to both AssumeRole and AssumeRoleWithWebIdentity, with the name
+// of the action filled in
+const stsResponseTmpl = `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>assumed-key-id</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-session-token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </%[1]sResult>
+  <ResponseMetadata><RequestId>test</RequestId></ResponseMetadata>
+</%[1]sResponse>`
+
+// newTestS3Server returns a server that handles STS requests by returning fixed credentials, and
+// every other request as an S3 PutObject, recording both
+func newTestS3Server(t *testing.T) (*httptest.Server, chan s3Request, chan stsRequest) {
+	requests := make(chan s3Request, 1)
+	stsRequests := make(chan stsRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if !assert.NoError(t, r.ParseForm()) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			stsRequests <- stsRequest{header: r.Header, form: r.PostForm}
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprintf(w, stsResponseTmpl, r.PostForm.Get("Action"))
+			return
+		}
+
+		req := s3Request{method: r.Method, path: r.URL.Path, header: r.Header, events: nil}
+
+		gz, err := gzip.NewReader(r.Body)
+		if assert.NoError(t, err) {
+			scanner := bufio.NewScanner(gz)
+			for scanner.Scan() {
+				var event map[string]any
+				assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+				req.events = append(req.events, event)
+			}
+			assert.NoError(t, scanner.Err())
+		}
+
+		requests <- req
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, stsRequests
+}
+
+func testS3Events(now time.Time) []AnyEvent {
+	return []AnyEvent{
+		Enrich(now, "host", 1, 0, 2, &IncrementalEvent{
+			SchemaVersion:  0,
+			IdempotencyKey: "",
+			MetricName:     "effective_compute_seconds",
+			Type:           "",
+			EndpointID:     "ep-foo",
+			StartTime:      now.Add(-time.Minute),
+			StopTime:       now,
+			Value:          60,
+			Anomalous:      false,
+			Partial:        false,
+			Identity:       Identity{Namespace: "", VMName: "", NodeName: "", Region: ""},
+			SequenceNumber: 0,
+		}),
+		Enrich(now, "host", 2, 1, 2, &IncrementalEvent{
+			SchemaVersion:  0,
+			IdempotencyKey: "",
+			MetricName:     "effective_compute_seconds",
+			Type:           "",
+			EndpointID:     "ep-bar",
+			StartTime:      now.Add(-time.Minute),
+			StopTime:       now,
+			Value:          30,
+			Anomalous:      false,
+			Partial:        false,
+			Identity:       Identity{Namespace: "", VMName: "", NodeName: "", Region: ""},
+			SequenceNumber: 0,
+		}),
+	}
+}
+
+func TestS3ClientUpload(t *testing.T) {
+	setTestAWSEnv(t)
+	server, requests, _ := newTestS3Server(t)
+
+	client := NewS3Client(S3ClientConfig{
+		Bucket:              "billing",
+		Region:              "",
+		PrefixInBucket:      "events/",
+		Endpoint:            server.URL,
+		SSEKMSKeyARN:        "arn:aws:kms:us-east-1:111122223333:key/test",
+		ACL:                 "bucket-owner-full-control",
+		ExpectedBucketOwner: "111122223333",
+		Tags:                map[string]string{"cost-center": "billing&usage", "environment": "prod"},
+		Credentials:         nil,
+	})
+
+	now := time.Date(2024, time.March, 5, 13, 4, 5, 0, time.UTC)
+	require.NoError(t, client.Upload(context.Background(), now, testS3Events(now)))
+
+	req := <-requests
+	assert.Equal(t, http.MethodPut, req.method)
+	assert.Regexp(t, regexp.MustCompile(`^/billing/events/year=2024/month=03/day=05/13:04:05Z_[[:alnum:]]+\.ndjson\.gz$`), req.path)
+	assert.Equal(t, "aws:kms", req.header.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "arn:aws:kms:us-east-1:111122223333:key/test", req.header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	assert.Equal(t, "bucket-owner-full-control", req.header.Get("X-Amz-Acl"))
+	assert.Equal(t, "111122223333", req.header.Get("X-Amz-Expected-Bucket-Owner"))
+
+	tags, err := url.ParseQuery(req.header.Get("X-Amz-Tagging"))
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"cost-center": {"billing&usage"}, "environment": {"prod"}}, tags)
+
+	require.Len(t, req.events, 2)
+	assert.Equal(t, "ep-foo", req.events[0]["endpoint_id"])
+	assert.Equal(t, "ep-bar", req.events[1]["endpoint_id"])
+}
+
+func TestS3ClientUploadDefaults(t *testing.T) {
+	setTestAWSEnv(t)
+	server, requests, _ := newTestS3Server(t)
+
+	client := NewS3Client(S3ClientConfig{
+		Bucket:              "billing",
+		Region:              "",
+		PrefixInBucket:      "",
+		Endpoint:            server.URL,
+		SSEKMSKeyARN:        "",
+		ACL:                 "",
+		ExpectedBucketOwner: "",
+		Tags:                nil,
+		Credentials:         nil,
+	})
+
+	now := time.Date(2024, time.March, 5, 13, 4, 5, 0, time.UTC)
+	require.NoError(t, client.Upload(context.Background(), now, testS3Events(now)))
+
+	// Without any of the options set, the bucket's defaults apply.
+	req := <-requests
+	assert.True(t, strings.HasPrefix(req.path, "/billing/year=2024/month=03/day=05/"), req.path)
+	for _, header := range []string{
+		"X-Amz-Server-Side-Encryption",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+		"X-Amz-Acl",
+		"X-Amz-Expected-Bucket-Owner",
+		"X-Amz-Tagging",
+	} {
+		assert.Empty(t, req.header.Get(header), header)
+	}
+}
+
+func TestS3ClientConfigValidate(t *testing.T) {
+	valid := S3ClientConfig{
+		Bucket:              "billing",
+		Region:              "",
+		PrefixInBucket:      "",
+		Endpoint:            "",
+		SSEKMSKeyARN:        "",
+		ACL:                 "bucket-owner-full-control",
+		ExpectedBucketOwner: "",
+		Tags:                map[string]string{"environment": "prod"},
+		Credentials:         nil,
+	}
+	assert.Empty(t, valid.Validate(".s3"))
+
+	tooManyTags := make(map[string]string)
+	for _, c := range "abcdefghijk" {
+		tooManyTags[string(c)] = ""
+	}
+
+	cases := []struct {
+		name   string
+		modify func(*S3ClientConfig)
+		errs   []string
+	}{
+		{
+			name:   "empty bucket",
+			modify: func(c *S3ClientConfig) { c.Bucket = "" },
+			errs:   []string{`field ".s3.bucket" cannot be empty`},
+		},
+		{
+			name:   "unknown ACL",
+			modify: func(c *S3ClientConfig) { c.ACL = "everyone" },
+			errs:   []string{`field ".s3.acl" has unknown canned ACL "everyone"`},
+		},
+		{
+			name:   "too many tags",
+			modify: func(c *S3ClientConfig) { c.Tags = tooManyTags },
+			errs:   []string{`field ".s3.tags" has 11 tags, more than the maximum of 10`},
+		},
+		{
+			name:   "empty tag key",
+			modify: func(c *S3ClientConfig) { c.Tags = map[string]string{"": "x"} },
+			errs:   []string{`field ".s3.tags" has tag key "", which must be between 1 and 128 characters`},
+		},
+		{
+			name:   "long tag value",
+			modify: func(c *S3ClientConfig) { c.Tags = map[string]string{"k": strings.Repeat("v", 257)} },
+			errs:   []string{`field ".s3.tags" has a value for tag "k" longer than 256 characters`},
+		},
+		{
+			name: "incomplete static credentials",
+			modify: func(c *S3ClientConfig) {
+				c.Credentials = &S3CredentialsConfig{
+					AccessKeyIDFile:     "/secrets/access-key-id",
+					SecretAccessKeyFile: "",
+					SessionTokenFile:    "",
+					WebIdentity:         nil,
+					AssumeRole:          nil,
+				}
+			},
+			errs: []string{`field ".s3.credentials.secretAccessKeyFile" cannot be empty if static credentials are used`},
+		},
+		{
+			name: "static credentials with web identity",
+			modify: func(c *S3ClientConfig) {
+				c.Credentials = &S3CredentialsConfig{
+					AccessKeyIDFile:     "/secrets/access-key-id",
+					SecretAccessKeyFile: "/secrets/secret-access-key",
+					SessionTokenFile:    "",
+					WebIdentity:         &S3WebIdentityConfig{RoleARN: "", TokenFile: "", SessionName: ""},
+					AssumeRole:          nil,
+				}
+			},
+			errs: []string{
+				`field ".s3.credentials.webIdentity" cannot be set with static credentials`,
+				`field ".s3.credentials.webIdentity.roleARN" cannot be empty`,
+				`field ".s3.credentials.webIdentity.tokenFile" cannot be empty`,
+			},
+		},
+		{
+			name: "invalid assume role",
+			modify: func(c *S3ClientConfig) {
+				c.Credentials = &S3CredentialsConfig{
+					AccessKeyIDFile:     "",
+					SecretAccessKeyFile: "",
+					SessionTokenFile:    "",
+					WebIdentity:         nil,
+					AssumeRole:          &S3AssumeRoleConfig{RoleARN: "", ExternalID: "", SessionName: "", DurationSeconds: 60},
+				}
+			},
+			errs: []string{
+				`field ".s3.credentials.assumeRole.roleARN" cannot be empty`,
+				`field ".s3.credentials.assumeRole.durationSeconds" must be at least 900 if set`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := valid
+			c.modify(&conf)
+			var errs []string
+			for _, err := range conf.Validate(".s3") {
+				errs = append(errs, err.Error())
+			}
+			assert.Equal(t, c.errs, errs)
+		})
+	}
+}
+
+// signingKeyID returns the access key ID that the request was signed with
+func signingKeyID(t *testing.T, header http.Header) string {
+	match := regexp.MustCompile(`Credential=([^/]+)/`).FindStringSubmatch(header.Get("Authorization"))
+	require.NotNil(t, match, "request is not signed: %q", header.Get("Authorization"))
+	return match[1]
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func testS3Config(endpoint string, creds *S3CredentialsConfig) S3ClientConfig {
+	return S3ClientConfig{
+		Bucket:              "billing",
+		Region:              "",
+		PrefixInBucket:      "",
+		Endpoint:            endpoint,
+		SSEKMSKeyARN:        "",
+		ACL:                 "",
+		ExpectedBucketOwner: "",
+		Tags:                nil,
+		Credentials:         creds,
+	}
+}
+
+func TestS3ClientStaticCredentials(t *testing.T) {
+	setTestAWSEnv(t)
+	server, requests, _ := newTestS3Server(t)
+
+	dir := t.TempDir()
+	client := NewS3Client(testS3Config(server.URL, &S3CredentialsConfig{
+		AccessKeyIDFile:     writeTestFile(t, dir, "access-key-id", "file-key-id\n"),
+		SecretAccessKeyFile: writeTestFile(t, dir, "secret-access-key", "file-secret\n"),
+		SessionTokenFile:    writeTestFile(t, dir, "session-token", "file-session-token"),
+		WebIdentity:         nil,
+		AssumeRole:          nil,
+	}))
+
+	now := time.Now()
+	require.NoError(t, client.Upload(context.Background(), now, testS3Events(now)))
+
+	// The credentials from the files are used instead of the ones from the environment.
+	req := <-requests
+	assert.Equal(t, "file-key-id", signingKeyID(t, req.header))
+	assert.Equal(t, "file-session-token", req.header.Get("X-Amz-Security-Token"))
+}
+
+func TestFileCredentialsProviderRereads(t *testing.T) {
+	dir := t.TempDir()
+	provider := fileCredentialsProvider{
+		accessKeyIDFile:     writeTestFile(t, dir, "access-key-id", "old-key-id"),
+		secretAccessKeyFile: writeTestFile(t, dir, "secret-access-key", "old-secret"),
+		sessionTokenFile:    "",
+	}
+
+	creds, err := provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "old-key-id", creds.AccessKeyID)
+	assert.Equal(t, "old-secret", creds.SecretAccessKey)
+	assert.Empty(t, creds.SessionToken)
+	assert.True(t, creds.CanExpire)
+
+	// When the Secret is rotated, the next retrieval returns the new credentials.
+	writeTestFile(t, dir, "access-key-id", "new-key-id")
+	writeTestFile(t, dir, "secret-access-key", "new-secret")
+	creds, err = provider.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "new-key-id", creds.AccessKeyID)
+	assert.Equal(t, "new-secret", creds.SecretAccessKey)
+
+	writeTestFile(t, dir, "secret-access-key", "\n")
+	_, err = provider.Retrieve(context.Background())
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestS3ClientAssumeRole(t *testing.T) {
+	setTestAWSEnv(t)
+	server, requests, stsRequests := newTestS3Server(t)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+
+	client := NewS3Client(testS3Config(server.URL, &S3CredentialsConfig{
+		AccessKeyIDFile:     "",
+		SecretAccessKeyFile: "",
+		SessionTokenFile:    "",
+		WebIdentity:         nil,
+		AssumeRole: &S3AssumeRoleConfig{
+			RoleARN:         "arn:aws:iam::111122223333:role/billing-writer",
+			ExternalID:      "test-external-id",
+			SessionName:     "",
+			DurationSeconds: 3600,
+		},
+	}))
+
+	now := time.Now()
+	require.NoError(t, client.Upload(context.Background(), now, testS3Events(now)))
+
+	// The role is assumed with the credentials from the environment...
+	stsReq := <-stsRequests
+	assert.Equal(t, "test-key-id", signingKeyID(t, stsReq.header))
+	assert.Equal(t, "AssumeRole", stsReq.form.Get("Action"))
+	assert.Equal(t, "arn:aws:iam::111122223333:role/billing-writer", stsReq.form.Get("RoleArn"))
+	assert.Equal(t, "test-external-id", stsReq.form.Get("ExternalId"))
+	assert.Equal(t, defaultS3SessionName, stsReq.form.Get("RoleSessionName"))
+	assert.Equal(t, "3600", stsReq.form.Get("DurationSeconds"))
+
+	// ... and the upload uses the role's credentials.
+	req := <-requests
+	assert.Equal(t, "assumed-key-id", signingKeyID(t, req.header))
+	assert.Equal(t, "assumed-session-token", req.header.Get("X-Amz-Security-Token"))
+}
+
+func TestS3ClientWebIdentity(t *testing.T) {
+	setTestAWSEnv(t)
+	server, requests, stsRequests := newTestS3Server(t)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+
+	client := NewS3Client(testS3Config(server.URL, &S3CredentialsConfig{
+		AccessKeyIDFile:     "",
+		SecretAccessKeyFile: "",
+		SessionTokenFile:    "",
+		WebIdentity: &S3WebIdentityConfig{
+			RoleARN:     "arn:aws:iam::111122223333:role/billing-writer",
+			TokenFile:   writeTestFile(t, t.TempDir(), "token", "test-web-identity-token"),
+			SessionName: "test-session",
+		},
+		AssumeRole: nil,
+	}))
+
+	now := time.Now()
+	require.NoError(t, client.Upload(context.Background(), now, testS3Events(now)))
+
+	stsReq := <-stsRequests
+	assert.Equal(t, "AssumeRoleWithWebIdentity", stsReq.form.Get("Action"))
+	assert.Equal(t, "arn:aws:iam::111122223333:role/billing-writer", stsReq.form.Get("RoleArn"))
+	assert.Equal(t, "test-web-identity-token", stsReq.form.Get("WebIdentityToken"))
+	assert.Equal(t, "test-session", stsReq.form.Get("RoleSessionName"))
+
+	req := <-requests
+	assert.Equal(t, "assumed-key-id", signingKeyID(t, req.header))
+}
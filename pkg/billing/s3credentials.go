@@ -0,0 +1,198 @@
+package billing
+
+// Explicit credentials for S3Client, for buckets that the default credential chain can't reach
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// defaultS3SessionName is the role session name used if none is configured, so that the
+	// uploads can be identified in CloudTrail.
+	defaultS3SessionName = "autoscaler-agent-billing"
+	// staticCredentialsRefresh is how often credentials from files are re-read
+	staticCredentialsRefresh = 5 * time.Minute
+	// minAssumeRoleDuration is the shortest session that STS allows
+	minAssumeRoleDuration = 15 * time.Minute
+)
+
+// S3CredentialsConfig sets the AWS credentials that S3Client uses.
+//
+// The base credentials are either static keys read from files (e.g. a mounted Secret), a web
+// identity token (e.g. IRSA), or, if neither is set, the default credential chain. If AssumeRole is
+// set, the base credentials are used to assume that role, e.g. for a bucket in another account.
+type S3CredentialsConfig struct {
+	// AccessKeyIDFile and SecretAccessKeyFile, if set, are paths to files containing static
+	// credentials. The files are re-read every few minutes, so that updates to a mounted Secret
+	// take effect without restarting.
+	AccessKeyIDFile     string `json:"accessKeyIDFile,omitempty"`
+	SecretAccessKeyFile string `json:"secretAccessKeyFile,omitempty"`
+	// SessionTokenFile, if set, is the path to a file containing the session token for temporary
+	// static credentials. It can only be set with AccessKeyIDFile.
+	SessionTokenFile string `json:"sessionTokenFile,omitempty"`
+
+	// WebIdentity, if not nil, gets credentials by exchanging a web identity token for a role. It
+	// cannot be set with static credentials.
+	WebIdentity *S3WebIdentityConfig `json:"webIdentity,omitempty"`
+	// AssumeRole, if not nil, uses the base credentials to assume a role, which is then used for
+	// the uploads.
+	AssumeRole *S3AssumeRoleConfig `json:"assumeRole,omitempty"`
+}
+
+type S3WebIdentityConfig struct {
+	RoleARN string `json:"roleARN"`
+	// TokenFile is the path to a file containing the web identity token, e.g. a projected service
+	// account token. It's re-read whenever new credentials are needed.
+	TokenFile   string `json:"tokenFile"`
+	SessionName string `json:"sessionName,omitempty"`
+}
+
+type S3AssumeRoleConfig struct {
+	RoleARN string `json:"roleARN"`
+	// ExternalID, if not empty, is passed when assuming the role, for roles in another account
+	// that require it.
+	ExternalID  string `json:"externalID,omitempty"`
+	SessionName string `json:"sessionName,omitempty"`
+	// DurationSeconds, if not zero, is the duration of each session. Otherwise, the STS default
+	// applies.
+	DurationSeconds uint `json:"durationSeconds,omitempty"`
+}
+
+// validate checks that the config is valid, returning the problems found. Field names in the errors
+// are prefixed with path, which is the path to the config itself.
+func (c S3CredentialsConfig) validate(path string) []error {
+	var errs []error
+	static := c.AccessKeyIDFile != "" || c.SecretAccessKeyFile != "" || c.SessionTokenFile != ""
+	if static {
+		if c.AccessKeyIDFile == "" {
+			errs = append(errs, fmt.Errorf("field %q cannot be empty if static credentials are used", path+".accessKeyIDFile"))
+		}
+		if c.SecretAccessKeyFile == "" {
+			errs = append(errs, fmt.Errorf("field %q cannot be empty if static credentials are used", path+".secretAccessKeyFile"))
+		}
+	}
+	if w := c.WebIdentity; w != nil {
+		if static {
+			errs = append(errs, fmt.Errorf("field %q cannot be set with static credentials", path+".webIdentity"))
+		}
+		if w.RoleARN == "" {
+			errs = append(errs, fmt.Errorf("field %q cannot be empty", path+".webIdentity.roleARN"))
+		}
+		if w.TokenFile == "" {
+			errs = append(errs, fmt.Errorf("field %q cannot be empty", path+".webIdentity.tokenFile"))
+		}
+	}
+	if a := c.AssumeRole; a != nil {
+		if a.RoleARN == "" {
+			errs = append(errs, fmt.Errorf("field %q cannot be empty", path+".assumeRole.roleARN"))
+		}
+		if a.DurationSeconds != 0 && time.Duration(a.DurationSeconds)*time.Second < minAssumeRoleDuration {
+			errs = append(errs, fmt.Errorf("field %q must be at least %d if set", path+".assumeRole.durationSeconds", int(minAssumeRoleDuration.Seconds())))
+		}
+	}
+	return errs
+}
+
+// provider returns the credentials provider for the config, given the AWS config loaded from the
+// environment
+func (c S3CredentialsConfig) provider(awsConf aws.Config) aws.CredentialsProvider {
+	creds := awsConf.Credentials
+	if c.AccessKeyIDFile != "" {
+		creds = aws.NewCredentialsCache(fileCredentialsProvider{
+			accessKeyIDFile:     c.AccessKeyIDFile,
+			secretAccessKeyFile: c.SecretAccessKeyFile,
+			sessionTokenFile:    c.SessionTokenFile,
+		})
+	} else if w := c.WebIdentity; w != nil {
+		creds = aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+			sts.NewFromConfig(awsConf), w.RoleARN, stscreds.IdentityTokenFile(w.TokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = sessionNameOrDefault(w.SessionName)
+			},
+		))
+	}
+
+	if a := c.AssumeRole; a != nil {
+		baseConf := awsConf.Copy()
+		baseConf.Credentials = creds
+		creds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(
+			sts.NewFromConfig(baseConf), a.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = sessionNameOrDefault(a.SessionName)
+				if a.ExternalID != "" {
+					o.ExternalID = aws.String(a.ExternalID)
+				}
+				if a.DurationSeconds != 0 {
+					o.Duration = time.Second * time.Duration(a.DurationSeconds)
+				}
+			},
+		))
+	}
+
+	return creds
+}
+
+func sessionNameOrDefault(name string) string {
+	if name == "" {
+		return defaultS3SessionName
+	}
+	return name
+}
+
+// fileCredentialsProvider is an aws.CredentialsProvider that reads static credentials from files
+//
+// The credentials are reported as expiring after staticCredentialsRefresh, so that a cache around
+// the provider picks up changes to the files.
+type fileCredentialsProvider struct {
+	accessKeyIDFile     string
+	secretAccessKeyFile string
+	sessionTokenFile    string // may be empty
+}
+
+func (p fileCredentialsProvider) Retrieve(context.Context) (aws.Credentials, error) {
+	accessKeyID, err := readCredentialFile(p.accessKeyIDFile)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	secretAccessKey, err := readCredentialFile(p.secretAccessKeyFile)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	var sessionToken string
+	if p.sessionTokenFile != "" {
+		if sessionToken, err = readCredentialFile(p.sessionTokenFile); err != nil {
+			return aws.Credentials{}, err
+		}
+	}
+
+	return aws.Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Source:          "fileCredentialsProvider",
+		CanExpire:       true,
+		Expires:         time.Now().Add(staticCredentialsRefresh),
+	}, nil
+}
+
+func readCredentialFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading AWS credentials file: %w", err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("AWS credentials file %q is empty", path)
+	}
+	return value, nil
+}
+
+var _ aws.CredentialsProvider = fileCredentialsProvider{}
@@ -0,0 +1,106 @@
+package billing
+
+// Implementation of Sequence, a per-agent source of monotonically increasing numbers used to make
+// idempotency keys unique even if the wall clock jumps around.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sequence provides monotonically increasing sequence numbers, optionally persisted to a file so
+// that the numbers continue to increase across restarts.
+//
+// Numbers are handed out in contiguous blocks with Reserve. When a Sequence is backed by a file,
+// the end of each block is written to the file before the block is returned, so a restart may skip
+// some numbers, but will never reuse them.
+type Sequence struct {
+	mu   sync.Mutex
+	next uint64
+	// path, if not empty, gives the file that the sequence's high water mark is persisted to
+	path string
+}
+
+// NewSequence returns a Sequence that starts from zero and is only stored in memory.
+func NewSequence() *Sequence {
+	return &Sequence{
+		mu:   sync.Mutex{},
+		next: 0,
+		path: "",
+	}
+}
+
+// LoadSequence returns a Sequence that is persisted to the file at path, resuming from the value
+// stored there if the file already exists.
+func LoadSequence(path string) (*Sequence, error) {
+	seq := &Sequence{
+		mu:   sync.Mutex{},
+		next: 0,
+		path: path,
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return seq, nil
+		}
+		return nil, fmt.Errorf("Error reading sequence file %q: %w", path, err)
+	}
+
+	seq.next, err = strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing sequence file %q: %w", path, err)
+	}
+
+	return seq, nil
+}
+
+// Reserve returns the first of count consecutive sequence numbers that have not been returned
+// before.
+//
+// If the Sequence is persisted and writing the new high water mark fails, the reservation is still
+// made (so the numbers remain unique within this process), but the error is returned so that the
+// caller can report it.
+func (s *Sequence) Reserve(count uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := s.next
+	s.next += count
+
+	if s.path == "" {
+		return first, nil
+	}
+
+	return first, s.persist()
+}
+
+// NB: must hold mu
+func (s *Sequence) persist() error {
+	// Write to a temporary file and then rename, so that we never leave a partially-written file
+	// behind if we're interrupted.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary sequence file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // no-op after a successful rename
+
+	if _, err := tmp.WriteString(strconv.FormatUint(s.next, 10)); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("Error writing temporary sequence file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing temporary sequence file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("Error replacing sequence file %q: %w", s.path, err)
+	}
+
+	return nil
+}
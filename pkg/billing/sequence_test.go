@@ -0,0 +1,159 @@
+package billing
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceReserve(t *testing.T) {
+	seq := NewSequence()
+
+	first, err := seq.Reserve(3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), first)
+
+	first, err = seq.Reserve(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), first)
+
+	// Empty reservations don't use up any numbers
+	first, err = seq.Reserve(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), first)
+	first, err = seq.Reserve(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), first)
+}
+
+func TestSequenceReserveConcurrent(t *testing.T) {
+	seq := NewSequence()
+
+	const workers = 8
+	const perWorker = 100
+
+	results := make([][]uint64, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				first, err := seq.Reserve(2)
+				assert.NoError(t, err)
+				results[i] = append(results[i], first)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every block is distinct, and together they cover the numbers exactly
+	seen := make(map[uint64]bool)
+	for _, firsts := range results {
+		for _, first := range firsts {
+			for n := first; n < first+2; n++ {
+				assert.False(t, seen[n], "number %d reserved twice", n)
+				seen[n] = true
+			}
+		}
+	}
+	assert.Len(t, seen, workers*perWorker*2)
+	next, err := seq.Reserve(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(workers*perWorker*2), next)
+}
+
+func TestLoadSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sequence")
+
+	// A missing file starts from zero, without creating the file until something is reserved
+	seq, err := LoadSequence(path)
+	require.NoError(t, err)
+	assert.NoFileExists(t, path)
+
+	first, err := seq.Reserve(5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), first)
+	first, err = seq.Reserve(5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), first)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "10", string(contents))
+
+	// After a restart, the sequence resumes after the last reservation
+	seq, err = LoadSequence(path)
+	require.NoError(t, err)
+	first, err = seq.Reserve(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), first)
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLoadSequenceInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	// Surrounding whitespace is allowed, e.g. from editing the file by hand
+	path := filepath.Join(dir, "whitespace")
+	require.NoError(t, os.WriteFile(path, []byte(" 42\n"), 0o644))
+	seq, err := LoadSequence(path)
+	require.NoError(t, err)
+	first, err := seq.Reserve(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), first)
+
+	for name, contents := range map[string]string{
+		"empty":    "",
+		"negative": "-1",
+		"garbage":  "not a number",
+		"overflow": "18446744073709551616",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+		_, err := LoadSequence(path)
+		assert.ErrorContains(t, err, "Error parsing sequence file", name)
+	}
+
+	// Unreadable files are also an error, rather than silently starting from zero
+	_, err = LoadSequence(dir)
+	assert.ErrorContains(t, err, "Error reading sequence file")
+}
+
+func TestSequencePersistFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing-dir", "sequence")
+	seq, err := LoadSequence(path)
+	require.NoError(t, err)
+
+	// The reservation is still made when persisting fails, so numbers aren't reused
+	first, err := seq.Reserve(3)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(0), first)
+	first, err = seq.Reserve(1)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(3), first)
+}
+
+func TestEnrichSequenceNumber(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	incremental := Enrich(now, "host", 42, 1, 2, new(IncrementalEvent))
+	absolute := Enrich(now, "host", 43, 2, 2, new(AbsoluteEvent))
+
+	events := []AnyEvent{incremental, absolute}
+	assert.Equal(t, uint64(42), events[0].GetSequenceNumber())
+	assert.Equal(t, uint64(43), events[1].GetSequenceNumber())
+
+	// The sequence number keeps the idempotency keys distinct, even at the same time
+	assert.Equal(t, "2024-01-01T00:00:00Z-host-42-1/2", incremental.IdempotencyKey)
+	assert.Equal(t, "2024-01-01T00:00:00Z-host-43-2/2", absolute.IdempotencyKey)
+}
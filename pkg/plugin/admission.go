@@ -0,0 +1,488 @@
+package plugin
+
+// Admission webhooks for VirtualMachines: one that applies namespace-level defaults to new VMs, and
+// one that validates the scaling bounds of VMs against cluster policy.
+//
+// The defaults mean that platform teams don't need to template the same bounds, labels, and
+// annotations into every VM manifest.
+//
+// Without validation, a VM whose bounds the cluster won't honor is only discovered by the
+// autoscaler-agent once the VM is running. With it, creating such a VM -- or changing its bounds to
+// ones that break the policy -- is rejected up front, with a message saying what to change.
+//
+// The webhooks are served over HTTPS, and must be registered for virtualmachines.vm.neon.tech with
+// a MutatingWebhookConfiguration pointing at the path "/mutate-virtualmachine", and a
+// ValidatingWebhookConfiguration pointing at "/validate-virtualmachine". Because mutating webhooks
+// are called first, the defaults are validated along with the rest of the VM.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/patch"
+)
+
+type admissionConfig struct {
+	// Port is the port to serve the webhook on
+	Port uint16 `json:"port"`
+	// CertFile and KeyFile give the paths of the TLS certificate and private key that the webhook
+	// is served with
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// ComputeUnit gives the resources in one compute unit, for converting VMs' bounds into compute
+	// units. It should match the autoscaler-agent's.
+	ComputeUnit api.Resources `json:"computeUnit"`
+	// ComputeUnitsByArch gives the compute unit for VMs that require each CPU architecture in their
+	// node selector, instead of ComputeUnit. It should match the autoscaler-agent's.
+	ComputeUnitsByArch api.ComputeUnitsByArch `json:"computeUnitsByArch,omitempty"`
+
+	// MaxComputeUnits, if not zero, gives the largest maximum that VMs may have, in compute units.
+	MaxComputeUnits float64 `json:"maxComputeUnits,omitempty"`
+	// NamespaceMaxComputeUnits gives the largest maximum that VMs in each namespace may have,
+	// overriding MaxComputeUnits.
+	NamespaceMaxComputeUnits map[string]float64 `json:"namespaceMaxComputeUnits,omitempty"`
+	// AllowedComputeUnits, if not empty, gives the only sizes that VMs' minimum and maximum may
+	// be, in compute units.
+	AllowedComputeUnits []float64 `json:"allowedComputeUnits,omitempty"`
+
+	// NamespaceDefaults gives the defaults applied to new VMs in each namespace. VMs in namespaces
+	// that aren't listed are left as-is.
+	NamespaceDefaults map[string]vmDefaults `json:"namespaceDefaults,omitempty"`
+}
+
+// vmDefaults are applied to new VMs by the mutating webhook. Nothing that's already set on the VM
+// is overwritten.
+type vmDefaults struct {
+	// Bounds, if provided, is set as the VM's scaling bounds annotation, if it doesn't have one
+	Bounds *api.ScalingBounds `json:"bounds,omitempty"`
+	// Labels gives the labels to add to the VM, if it doesn't have them already -- for example, to
+	// select one of the autoscaler-agent's scaling profiles.
+	Labels map[string]string `json:"labels,omitempty"`
+	// EndpointIDLabel, if not empty, gives the label that the VM's billing endpoint ID annotation
+	// is copied from, if the VM has the label but not the annotation.
+	EndpointIDLabel string `json:"endpointIDLabel,omitempty"`
+}
+
+func (d *vmDefaults) validate() (string, error) {
+	// The rest of the bounds can only be validated against each VM's memory slot size.
+	if b := d.Bounds; b != nil {
+		if b.Min.CPU.Sign() <= 0 {
+			return "bounds.min.cpu", errors.New("value must be > 0")
+		} else if b.Min.Mem.Sign() <= 0 {
+			return "bounds.min.mem", errors.New("value must be > 0")
+		} else if b.Max.CPU.Cmp(b.Min.CPU) < 0 {
+			return "bounds.max.cpu", errors.New("value must be >= bounds.min.cpu")
+		} else if b.Max.Mem.Cmp(b.Min.Mem) < 0 {
+			return "bounds.max.mem", errors.New("value must be >= bounds.min.mem")
+		}
+	}
+
+	for key, value := range d.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return fmt.Sprintf("labels[%q]", key), errors.New(strings.Join(errs, "; "))
+		} else if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			return fmt.Sprintf("labels[%q]", key), errors.New(strings.Join(errs, "; "))
+		}
+	}
+
+	if d.EndpointIDLabel != "" {
+		if errs := validation.IsQualifiedName(d.EndpointIDLabel); len(errs) != 0 {
+			return "endpointIDLabel", errors.New(strings.Join(errs, "; "))
+		}
+	}
+
+	return "", nil
+}
+
+func (c *admissionConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	} else if c.CertFile == "" {
+		return "certFile", errors.New("string cannot be empty")
+	} else if c.KeyFile == "" {
+		return "keyFile", errors.New("string cannot be empty")
+	} else if c.ComputeUnit.VCPU == 0 {
+		return "computeUnit.vCPUs", errors.New("value must be > 0")
+	} else if c.ComputeUnit.Mem == 0 {
+		return "computeUnit.mem", errors.New("value must be > 0")
+	} else if c.MaxComputeUnits < 0 || math.IsNaN(c.MaxComputeUnits) {
+		return "maxComputeUnits", errors.New("value must be >= 0")
+	} else if err := c.ComputeUnitsByArch.Validate(".computeUnitsByArch"); err != nil {
+		return "computeUnitsByArch", err
+	}
+
+	for namespace, max := range c.NamespaceMaxComputeUnits {
+		if !(max > 0) {
+			return fmt.Sprintf("namespaceMaxComputeUnits[%q]", namespace), errors.New("value must be > 0")
+		}
+	}
+	for i, size := range c.AllowedComputeUnits {
+		if !(size > 0) {
+			return fmt.Sprintf("allowedComputeUnits[%d]", i), errors.New("value must be > 0")
+		}
+	}
+	for namespace, defaults := range c.NamespaceDefaults {
+		if path, err := defaults.validate(); err != nil {
+			return fmt.Sprintf("namespaceDefaults[%q].%s", namespace, path), err
+		}
+	}
+
+	return "", nil
+}
+
+// computeUnitFor returns the compute unit for the VM, according to the architecture that it
+// requires. VMs that don't require one use the default compute unit.
+func (c *admissionConfig) computeUnitFor(vm *vmapi.VirtualMachine) api.Resources {
+	return c.ComputeUnitsByArch.Get(api.RequiredArchitecture(vm), c.ComputeUnit)
+}
+
+// maxComputeUnits returns the largest maximum allowed for VMs in the namespace, or zero if there
+// is no limit
+func (c *admissionConfig) maxComputeUnits(namespace string) float64 {
+	if max, ok := c.NamespaceMaxComputeUnits[namespace]; ok {
+		return max
+	}
+	return c.MaxComputeUnits
+}
+
+// allowedSize returns whether the number of compute units is one of AllowedComputeUnits, or true
+// if any size is allowed
+func (c *admissionConfig) allowedSize(computeUnits float64) bool {
+	if len(c.AllowedComputeUnits) == 0 {
+		return true
+	}
+	// Compute units are calculated by division, so allow a little bit of imprecision.
+	return slices.ContainsFunc(c.AllowedComputeUnits, func(size float64) bool {
+		return math.Abs(size-computeUnits) < 1e-9
+	})
+}
+
+// startAdmissionServer runs the HTTPS server for the admission webhook
+func (e *AutoscaleEnforcer) startAdmissionServer(ctx context.Context, logger *zap.Logger) error {
+	conf := e.state.conf.Admission
+
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(conf.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	util.AddHandler(
+		logger,
+		mux,
+		"/mutate-virtualmachine",
+		http.MethodPost,
+		"AdmissionReview",
+		func(_ context.Context, logger *zap.Logger, review *admissionv1.AdmissionReview) (*admissionv1.AdmissionReview, int, error) {
+			if review.Request == nil {
+				return nil, 400, errors.New("AdmissionReview is missing request")
+			}
+			resp, err := e.defaultVirtualMachine(logger, conf, review.Request)
+			if err != nil {
+				return nil, 400, err
+			}
+			return resp, 200, nil
+		},
+	)
+	util.AddHandler(
+		logger,
+		mux,
+		"/validate-virtualmachine",
+		http.MethodPost,
+		"AdmissionReview",
+		func(_ context.Context, logger *zap.Logger, review *admissionv1.AdmissionReview) (*admissionv1.AdmissionReview, int, error) {
+			if review.Request == nil {
+				return nil, 400, errors.New("AdmissionReview is missing request")
+			}
+			return e.reviewVirtualMachine(logger, conf, review.Request), 200, nil
+		},
+	)
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.ServeTLS(listener, conf.CertFile, conf.KeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admission webhook server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// reviewVirtualMachine checks the VirtualMachine in the admission request against the policy
+func (e *AutoscaleEnforcer) reviewVirtualMachine(
+	logger *zap.Logger,
+	conf *admissionConfig,
+	req *admissionv1.AdmissionRequest,
+) *admissionv1.AdmissionReview {
+	problems, reason := checkVirtualMachineBounds(logger, e.state.conf, conf, req)
+
+	resp := &admissionv1.AdmissionResponse{ //nolint:exhaustruct // other fields are optional
+		UID:     req.UID,
+		Allowed: len(problems) == 0,
+	}
+	if len(problems) != 0 {
+		e.metrics.admissionRejections.WithLabelValues(reason).Inc()
+		message := fmt.Sprintf(
+			"VirtualMachine %s/%s does not meet the cluster's autoscaling policy: %s",
+			req.Namespace, req.Name, strings.Join(problems, "; "),
+		)
+		logger.Warn("Rejecting VirtualMachine", zap.String("reason", reason), zap.String("message", message))
+		resp.Result = &metav1.Status{ //nolint:exhaustruct // other fields are optional
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: message,
+		}
+	}
+
+	return admissionReviewResponse(resp)
+}
+
+func admissionReviewResponse(resp *admissionv1.AdmissionResponse) *admissionv1.AdmissionReview {
+	return &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionv1.SchemeGroupVersion.String(),
+			Kind:       "AdmissionReview",
+		},
+		Request:  nil,
+		Response: resp,
+	}
+}
+
+// defaultVirtualMachine applies the defaults for the namespace to the new VirtualMachine in the
+// admission request, returning a response with the patch to apply them.
+//
+// Returns error only if the VirtualMachine couldn't be decoded.
+func (e *AutoscaleEnforcer) defaultVirtualMachine(
+	logger *zap.Logger,
+	conf *admissionConfig,
+	req *admissionv1.AdmissionRequest,
+) (*admissionv1.AdmissionReview, error) {
+	resp := &admissionv1.AdmissionResponse{ //nolint:exhaustruct // other fields are optional
+		UID:     req.UID,
+		Allowed: true,
+	}
+
+	defaults, ok := conf.NamespaceDefaults[req.Namespace]
+	if req.Operation != admissionv1.Create || !ok {
+		return admissionReviewResponse(resp), nil
+	}
+
+	var vm vmapi.VirtualMachine
+	if err := json.Unmarshal(req.Object.Raw, &vm); err != nil {
+		return nil, fmt.Errorf("could not decode VirtualMachine: %w", err)
+	}
+
+	patches, applied, skipped := vmDefaultsPatch(logger, &vm, &defaults)
+	for _, name := range applied {
+		e.metrics.admissionDefaultsApplied.WithLabelValues(name, admissionDefaultApplied).Inc()
+	}
+	for _, name := range skipped {
+		e.metrics.admissionDefaultsApplied.WithLabelValues(name, admissionDefaultSkipped).Inc()
+	}
+	if len(patches) != 0 {
+		patchPayload, err := json.Marshal(patches)
+		if err != nil {
+			panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.Patch = patchPayload
+		resp.PatchType = &patchType
+		logger.Info("Applying defaults to VirtualMachine", zap.Strings("defaults", applied))
+	}
+
+	return admissionReviewResponse(resp), nil
+}
+
+// Values of the "outcome" label on the admission defaults metric
+const (
+	admissionDefaultApplied = "applied"
+	admissionDefaultSkipped = "skipped"
+)
+
+// vmDefaultsPatch returns the JSON patch that applies the defaults to the VM, along with the names
+// of the defaults that it applies, and of those that it can't apply because they aren't valid for
+// the VM
+func vmDefaultsPatch(
+	logger *zap.Logger,
+	vm *vmapi.VirtualMachine,
+	defaults *vmDefaults,
+) (_ []patch.Operation, applied []string, skipped []string) {
+	labels := make(map[string]string)
+	for key, value := range defaults.Labels {
+		if _, ok := vm.Labels[key]; !ok {
+			labels[key] = value
+		}
+	}
+	if len(labels) != 0 {
+		applied = append(applied, "labels")
+	}
+
+	annotations := make(map[string]string)
+	if b := defaults.Bounds; b != nil {
+		if _, ok := vm.Annotations[api.AnnotationAutoscalingBounds]; !ok {
+			// The bounds need to be valid for this VM's memory slot size. If they aren't, it's
+			// better to leave the VM without them than to reject it.
+			if err := b.Validate(&vm.Spec.Guest.MemorySlotSize); err != nil {
+				logger.Warn("Not applying default bounds to VirtualMachine", zap.Error(err))
+				skipped = append(skipped, "bounds")
+			} else {
+				boundsJSON, err := json.Marshal(b)
+				if err != nil {
+					panic(fmt.Errorf("Error marshalling scaling bounds: %w", err))
+				}
+				annotations[api.AnnotationAutoscalingBounds] = string(boundsJSON)
+				applied = append(applied, "bounds")
+			}
+		}
+	}
+	if label := defaults.EndpointIDLabel; label != "" {
+		if _, ok := vm.Annotations[api.AnnotationBillingEndpointID]; !ok {
+			if endpointID, ok := vm.Labels[label]; ok && endpointID != "" {
+				annotations[api.AnnotationBillingEndpointID] = endpointID
+				applied = append(applied, "endpointID")
+			}
+		}
+	}
+
+	var patches []patch.Operation
+	patches = append(patches, addEntriesPatch("/metadata/labels", vm.Labels, labels)...)
+	patches = append(patches, addEntriesPatch("/metadata/annotations", vm.Annotations, annotations)...)
+	return patches, applied, skipped
+}
+
+// addEntriesPatch returns the JSON patch that adds the entries to the map at path, given its
+// existing value
+func addEntriesPatch(path string, existing map[string]string, entries map[string]string) []patch.Operation {
+	if len(entries) == 0 {
+		return nil
+	} else if existing == nil {
+		// The map doesn't exist yet, so we have to add it as a whole.
+		return []patch.Operation{{Op: patch.OpAdd, Path: path, From: "", Value: entries}}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var patches []patch.Operation
+	for _, key := range keys {
+		patches = append(patches, patch.Operation{
+			Op:    patch.OpAdd,
+			Path:  fmt.Sprintf("%s/%s", path, patch.PathEscape(key)),
+			From:  "",
+			Value: entries[key],
+		})
+	}
+	return patches
+}
+
+// checkVirtualMachineBounds returns what's wrong with the bounds of the VirtualMachine in the
+// admission request, if anything, along with the reason to record in the metrics.
+//
+// Updates are only checked if they change the VM's bounds, so that VMs created before the policy
+// was tightened can still be scaled, and otherwise updated. If the old VM can't be decoded, the
+// update is always checked.
+func checkVirtualMachineBounds(
+	logger *zap.Logger,
+	pluginConf *Config,
+	conf *admissionConfig,
+	req *admissionv1.AdmissionRequest,
+) (problems []string, reason string) {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return nil, ""
+	} else if pluginConf.ignoredNamespace(req.Namespace) {
+		return nil, ""
+	}
+
+	obj, vm, err := decodeVmInfo(logger, req.Object.Raw)
+	if err != nil {
+		return []string{err.Error()}, "invalid"
+	}
+
+	if req.Operation == admissionv1.Update {
+		_, old, err := decodeVmInfo(logger, req.OldObject.Raw)
+		if err != nil {
+			// Without the old bounds, we can't tell whether they're being changed, so the update is
+			// checked the same as if the VM were new. The old VM was admitted before, so this
+			// should only happen if it predates the current bounds format.
+			logger.Warn("Could not decode old VirtualMachine, checking update in full", zap.Error(err))
+		} else if old.Min() == vm.Min() && old.Max() == vm.Max() {
+			return nil, ""
+		}
+	}
+
+	computeUnit := conf.computeUnitFor(obj)
+	minCU := vm.Min().ComputeUnits(computeUnit)
+	maxCU := vm.Max().ComputeUnits(computeUnit)
+
+	howToChange := fmt.Sprintf(
+		"set in .spec.guest.cpus and .spec.guest.memorySlots, or the %q annotation, where one compute unit is %v vCPU and %v memory",
+		api.AnnotationAutoscalingBounds, computeUnit.VCPU, computeUnit.Mem,
+	)
+
+	if max := conf.maxComputeUnits(req.Namespace); max != 0 && maxCU > max {
+		problems = append(problems, fmt.Sprintf(
+			"maximum of %g compute units is more than the limit of %g for namespace %q -- lower the maximum CPU and memory to at most %g compute units (%s)",
+			maxCU, max, req.Namespace, max, howToChange,
+		))
+		reason = "maxComputeUnits"
+	}
+
+	for _, b := range []struct {
+		name string
+		cu   float64
+	}{{"minimum", minCU}, {"maximum", maxCU}} {
+		if !conf.allowedSize(b.cu) {
+			problems = append(problems, fmt.Sprintf(
+				"%s of %g compute units is not one of the allowed sizes %v -- change the %s CPU and memory to one of them (%s)",
+				b.name, b.cu, conf.AllowedComputeUnits, b.name, howToChange,
+			))
+			if reason == "" {
+				reason = "allowedComputeUnits"
+			}
+		}
+	}
+
+	return problems, reason
+}
+
+// decodeVmInfo decodes the raw VirtualMachine in an admission request, and extracts its VmInfo
+func decodeVmInfo(logger *zap.Logger, raw []byte) (*vmapi.VirtualMachine, *api.VmInfo, error) {
+	var vm vmapi.VirtualMachine
+	if err := json.Unmarshal(raw, &vm); err != nil {
+		return nil, nil, fmt.Errorf("could not decode VirtualMachine: %w", err)
+	}
+
+	info, err := api.ExtractVmInfo(logger, &vm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not determine scaling bounds: %w", err)
+	}
+	return &vm, info, nil
+}
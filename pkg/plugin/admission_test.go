@@ -0,0 +1,365 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/patch"
+)
+
+// admissionTestVM returns the JSON for a VirtualMachine with the given bounds, with 1Gi memory
+// slots
+func admissionTestVM(namespace string, minCPU, maxCPU string, minSlots, maxSlots int) []byte {
+	return []byte(fmt.Sprintf(
+		`{
+			"apiVersion": "vm.neon.tech/v1",
+			"kind": "VirtualMachine",
+			"metadata": {"name": "vm", "namespace": %q},
+			"spec": {"guest": {
+				"cpus": {"min": %q, "max": %q, "use": %q},
+				"memorySlotSize": "1Gi",
+				"memorySlots": {"min": %d, "max": %d, "use": %d}
+			}}
+		}`,
+		namespace, minCPU, maxCPU, minCPU, minSlots, maxSlots, minSlots,
+	))
+}
+
+func admissionTestRequest(op admissionv1.Operation, namespace string, object, oldObject []byte) *admissionv1.AdmissionRequest {
+	req := new(admissionv1.AdmissionRequest)
+	req.Operation = op
+	req.Namespace = namespace
+	req.Name = "vm"
+	req.Object = runtime.RawExtension{Raw: object, Object: nil}
+	req.OldObject = runtime.RawExtension{Raw: oldObject, Object: nil}
+	return req
+}
+
+func TestCheckVirtualMachineBoundsMax(t *testing.T) {
+	pluginConf := new(Config)
+	pluginConf.IgnoreNamespaces = []string{"kube-system"}
+	conf := &admissionConfig{
+		Port:                     10300,
+		CertFile:                 "tls.crt",
+		KeyFile:                  "tls.key",
+		ComputeUnit:              api.Resources{VCPU: 1000, Mem: 4 << 30},
+		ComputeUnitsByArch:       nil,
+		MaxComputeUnits:          4,
+		NamespaceMaxComputeUnits: map[string]float64{"large": 8, "small": 2},
+		AllowedComputeUnits:      nil,
+		NamespaceDefaults:        nil,
+	}
+
+	cases := []struct {
+		name     string
+		req      *admissionv1.AdmissionRequest
+		expected string
+	}{
+		{
+			name:     "within max",
+			req:      admissionTestRequest(admissionv1.Create, "default", admissionTestVM("default", "1", "4", 4, 16), nil),
+			expected: "",
+		},
+		{
+			name:     "over max",
+			req:      admissionTestRequest(admissionv1.Create, "default", admissionTestVM("default", "1", "5", 4, 16), nil),
+			expected: "maxComputeUnits",
+		},
+		{
+			name:     "memory over max",
+			req:      admissionTestRequest(admissionv1.Create, "default", admissionTestVM("default", "1", "4", 4, 20), nil),
+			expected: "maxComputeUnits",
+		},
+		{
+			name:     "namespace max is larger",
+			req:      admissionTestRequest(admissionv1.Create, "large", admissionTestVM("large", "1", "8", 4, 32), nil),
+			expected: "",
+		},
+		{
+			name:     "over namespace max",
+			req:      admissionTestRequest(admissionv1.Create, "large", admissionTestVM("large", "1", "9", 4, 32), nil),
+			expected: "maxComputeUnits",
+		},
+		{
+			name:     "namespace max is smaller",
+			req:      admissionTestRequest(admissionv1.Create, "small", admissionTestVM("small", "1", "4", 4, 16), nil),
+			expected: "maxComputeUnits",
+		},
+		{
+			name:     "ignored namespace",
+			req:      admissionTestRequest(admissionv1.Create, "kube-system", admissionTestVM("kube-system", "1", "16", 4, 64), nil),
+			expected: "",
+		},
+		{
+			name:     "deletion",
+			req:      admissionTestRequest(admissionv1.Delete, "default", nil, admissionTestVM("default", "1", "16", 4, 64)),
+			expected: "",
+		},
+		{
+			name:     "invalid VM",
+			req:      admissionTestRequest(admissionv1.Create, "default", []byte(`{"spec": {"guest": {}}}`), nil),
+			expected: "invalid",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			problems, reason := checkVirtualMachineBounds(zap.NewNop(), pluginConf, conf, c.req)
+			assert.Equal(t, c.expected, reason)
+			if c.expected == "" {
+				assert.Empty(t, problems)
+			} else {
+				assert.Len(t, problems, 1)
+			}
+		})
+	}
+}
+
+func TestCheckVirtualMachineBoundsAllowedSizes(t *testing.T) {
+	pluginConf := new(Config)
+	// One compute unit is 0.75 vCPU and 3Gi, so that a quarter vCPU is a third of a compute unit,
+	// which can't be represented exactly.
+	conf := &admissionConfig{
+		Port:                     10300,
+		CertFile:                 "tls.crt",
+		KeyFile:                  "tls.key",
+		ComputeUnit:              api.Resources{VCPU: 750, Mem: 3 << 30},
+		ComputeUnitsByArch:       nil,
+		MaxComputeUnits:          0,
+		NamespaceMaxComputeUnits: nil,
+		AllowedComputeUnits:      []float64{0.333333333333, 1, 2},
+		NamespaceDefaults:        nil,
+	}
+
+	cases := []struct {
+		name     string
+		vm       []byte
+		expected []string
+	}{
+		{
+			name:     "allowed",
+			vm:       admissionTestVM("default", "250m", "1500m", 1, 6),
+			expected: nil,
+		},
+		{
+			name:     "min not allowed",
+			vm:       admissionTestVM("default", "500m", "1500m", 2, 6),
+			expected: []string{"minimum of 0.6666666666666666 compute units"},
+		},
+		{
+			name:     "max not allowed",
+			vm:       admissionTestVM("default", "250m", "2250m", 1, 9),
+			expected: []string{"maximum of 3 compute units"},
+		},
+		{
+			name:     "neither allowed",
+			vm:       admissionTestVM("default", "500m", "2250m", 2, 9),
+			expected: []string{"minimum of 0.6666666666666666 compute units", "maximum of 3 compute units"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := admissionTestRequest(admissionv1.Create, "default", c.vm, nil)
+			problems, reason := checkVirtualMachineBounds(zap.NewNop(), pluginConf, conf, req)
+			assert.Len(t, problems, len(c.expected))
+			for i := range c.expected {
+				assert.Contains(t, problems[i], c.expected[i])
+			}
+			if len(c.expected) != 0 {
+				assert.Equal(t, "allowedComputeUnits", reason)
+			}
+		})
+	}
+
+	// Sizes within the tolerance are allowed, but nothing larger.
+	assert.True(t, conf.allowedSize(0.7+0.2+0.1))
+	assert.True(t, conf.allowedSize(1.0/3))
+	assert.False(t, conf.allowedSize(1.000001))
+}
+
+func TestCheckVirtualMachineBoundsUpdate(t *testing.T) {
+	pluginConf := new(Config)
+	conf := &admissionConfig{
+		Port:                     10300,
+		CertFile:                 "tls.crt",
+		KeyFile:                  "tls.key",
+		ComputeUnit:              api.Resources{VCPU: 1000, Mem: 4 << 30},
+		ComputeUnitsByArch:       nil,
+		MaxComputeUnits:          4,
+		NamespaceMaxComputeUnits: nil,
+		AllowedComputeUnits:      nil,
+		NamespaceDefaults:        nil,
+	}
+
+	// The VM was created before the limit was lowered to 4 compute units
+	tooLarge := admissionTestVM("default", "1", "8", 4, 32)
+
+	cases := []struct {
+		name      string
+		object    []byte
+		oldObject []byte
+		expected  string
+	}{
+		{
+			name:      "bounds unchanged",
+			object:    tooLarge,
+			oldObject: tooLarge,
+			expected:  "",
+		},
+		{
+			name:      "minimum changed",
+			object:    admissionTestVM("default", "2", "8", 8, 32),
+			oldObject: tooLarge,
+			expected:  "maxComputeUnits",
+		},
+		{
+			name:      "maximum lowered, but still over the limit",
+			object:    admissionTestVM("default", "1", "6", 4, 24),
+			oldObject: tooLarge,
+			expected:  "maxComputeUnits",
+		},
+		{
+			name:      "maximum lowered to the limit",
+			object:    admissionTestVM("default", "1", "4", 4, 16),
+			oldObject: tooLarge,
+			expected:  "",
+		},
+		{
+			name:      "old VM can't be decoded",
+			object:    tooLarge,
+			oldObject: []byte(`{"spec": {"guest": {}}}`),
+			expected:  "maxComputeUnits",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := admissionTestRequest(admissionv1.Update, "default", c.object, c.oldObject)
+			_, reason := checkVirtualMachineBounds(zap.NewNop(), pluginConf, conf, req)
+			assert.Equal(t, c.expected, reason)
+		})
+	}
+}
+
+func TestAddEntriesPatch(t *testing.T) {
+	entries := map[string]string{"b": "2", "example.com/a": "1", "x~y": "3"}
+
+	// Without an existing map, it's added as a whole
+	assert.Equal(t, []patch.Operation{
+		{Op: patch.OpAdd, Path: "/metadata/labels", From: "", Value: entries},
+	}, addEntriesPatch("/metadata/labels", nil, entries))
+
+	// ... otherwise, each entry is added separately, in order, with the keys escaped.
+	assert.Equal(t, []patch.Operation{
+		{Op: patch.OpAdd, Path: "/metadata/labels/b", From: "", Value: "2"},
+		{Op: patch.OpAdd, Path: "/metadata/labels/example.com~1a", From: "", Value: "1"},
+		{Op: patch.OpAdd, Path: "/metadata/labels/x~0y", From: "", Value: "3"},
+	}, addEntriesPatch("/metadata/labels", map[string]string{}, entries))
+
+	// Nothing to add is no patch at all, even without an existing map
+	assert.Empty(t, addEntriesPatch("/metadata/labels", nil, nil))
+	assert.Empty(t, addEntriesPatch("/metadata/labels", map[string]string{"a": "1"}, map[string]string{}))
+}
+
+func TestVMDefaultsPatch(t *testing.T) {
+	bounds := &api.ScalingBounds{
+		Min: api.ResourceBounds{CPU: resource.MustParse("250m"), Mem: resource.MustParse("1Gi")},
+		Max: api.ResourceBounds{CPU: resource.MustParse("2"), Mem: resource.MustParse("8Gi")},
+	}
+	boundsJSON, err := json.Marshal(bounds)
+	require.NoError(t, err)
+
+	defaults := &vmDefaults{
+		Bounds:          bounds,
+		Labels:          map[string]string{"example.com/profile": "small", "team": "storage"},
+		EndpointIDLabel: "example.com/endpoint",
+	}
+
+	newVM := func(labels, annotations map[string]string) *vmapi.VirtualMachine {
+		vm := new(vmapi.VirtualMachine)
+		vm.Name = "vm"
+		vm.Namespace = "default"
+		vm.Labels = labels
+		vm.Annotations = annotations
+		vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+		return vm
+	}
+
+	t.Run("nil maps", func(t *testing.T) {
+		patches, applied, skipped := vmDefaultsPatch(zap.NewNop(), newVM(nil, nil), defaults)
+		assert.Equal(t, []patch.Operation{
+			{
+				Op:    patch.OpAdd,
+				Path:  "/metadata/labels",
+				From:  "",
+				Value: map[string]string{"example.com/profile": "small", "team": "storage"},
+			},
+			{
+				Op:    patch.OpAdd,
+				Path:  "/metadata/annotations",
+				From:  "",
+				Value: map[string]string{api.AnnotationAutoscalingBounds: string(boundsJSON)},
+			},
+		}, patches)
+		assert.Equal(t, []string{"labels", "bounds"}, applied)
+		assert.Empty(t, skipped)
+	})
+
+	t.Run("existing maps", func(t *testing.T) {
+		vm := newVM(
+			map[string]string{"team": "compute", "example.com/endpoint": "ep-1234"},
+			map[string]string{"example.com/other": "value"},
+		)
+		patches, applied, skipped := vmDefaultsPatch(zap.NewNop(), vm, defaults)
+		assert.Equal(t, []patch.Operation{
+			{Op: patch.OpAdd, Path: "/metadata/labels/example.com~1profile", From: "", Value: "small"},
+			{
+				Op:    patch.OpAdd,
+				Path:  "/metadata/annotations/" + patch.PathEscape(api.AnnotationBillingEndpointID),
+				From:  "",
+				Value: "ep-1234",
+			},
+			{
+				Op:    patch.OpAdd,
+				Path:  "/metadata/annotations/" + patch.PathEscape(api.AnnotationAutoscalingBounds),
+				From:  "",
+				Value: string(boundsJSON),
+			},
+		}, patches)
+		assert.Equal(t, []string{"labels", "bounds", "endpointID"}, applied)
+		assert.Empty(t, skipped)
+	})
+
+	t.Run("nothing overwritten", func(t *testing.T) {
+		vm := newVM(
+			map[string]string{"team": "compute", "example.com/profile": "large", "example.com/endpoint": "ep-1234"},
+			map[string]string{api.AnnotationAutoscalingBounds: "{}", api.AnnotationBillingEndpointID: "ep-5678"},
+		)
+		patches, applied, skipped := vmDefaultsPatch(zap.NewNop(), vm, defaults)
+		assert.Empty(t, patches)
+		assert.Empty(t, applied)
+		assert.Empty(t, skipped)
+	})
+
+	t.Run("invalid bounds skipped", func(t *testing.T) {
+		vm := newVM(map[string]string{"team": "storage", "example.com/profile": "small"}, nil)
+		// The default bounds' memory isn't a multiple of the slot size
+		vm.Spec.Guest.MemorySlotSize = resource.MustParse("3Gi")
+		patches, applied, skipped := vmDefaultsPatch(zap.NewNop(), vm, defaults)
+		assert.Empty(t, patches)
+		assert.Empty(t, applied)
+		assert.Equal(t, []string{"bounds"}, skipped)
+	})
+}
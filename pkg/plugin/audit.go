@@ -0,0 +1,289 @@
+package plugin
+
+// Audit of the recent decisions made for autoscaler-agent requests -- which increases were
+// permitted or denied, and why -- so that the "denied" logs on the agent's side can be correlated
+// with the plugin's view of the node at the time.
+//
+// The records are kept in a permitAuditStore, which is selected by the config. Currently the only
+// storage is in memory, bounded per node and per VM.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type permitAuditConfig struct {
+	// Storage gives the kind of storage to keep the audit in. Currently the only option is
+	// "memory".
+	Storage string `json:"storage"`
+	// MaxPerNode gives the number of recent records kept for each node
+	MaxPerNode uint `json:"maxPerNode"`
+	// MaxPerVM gives the number of recent records kept for each VM
+	MaxPerVM uint `json:"maxPerVM"`
+	// RetentionSeconds gives how long records are kept for, so that nodes and VMs that no longer
+	// exist are eventually forgotten
+	RetentionSeconds uint `json:"retentionSeconds"`
+}
+
+// permitAuditStorage gives the constructor for each kind of storage for the audit, by name
+var permitAuditStorage = map[string]func(*permitAuditConfig) permitAuditStore{
+	"memory": newMemoryPermitAuditStore,
+}
+
+func (c *permitAuditConfig) validate() (string, error) {
+	if _, ok := permitAuditStorage[c.Storage]; !ok {
+		return "storage", fmt.Errorf("unknown storage %q", c.Storage)
+	} else if c.MaxPerNode == 0 {
+		return "maxPerNode", errors.New("value must be > 0")
+	} else if c.MaxPerVM == 0 {
+		return "maxPerVM", errors.New("value must be > 0")
+	} else if c.RetentionSeconds == 0 {
+		return "retentionSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// newPermitAuditStore returns the storage for the audit, or nil if it isn't enabled
+func newPermitAuditStore(conf *permitAuditConfig) permitAuditStore {
+	if conf == nil {
+		return nil
+	}
+	return permitAuditStorage[conf.Storage](conf)
+}
+
+// permitAuditStore stores the recent records of the audit
+//
+// Implementations must be safe for concurrent use.
+type permitAuditStore interface {
+	// add stores the record, possibly removing older ones
+	add(record permitAuditRecord)
+	// forNode returns the stored records for the node, oldest first
+	forNode(node string) []permitAuditRecord
+	// forVM returns the stored records for the VM, oldest first
+	forVM(vm util.NamespacedName) []permitAuditRecord
+}
+
+type permitAuditOutcome string
+
+const (
+	// permitAuditPermitted means that the agent was permitted everything that it requested
+	permitAuditPermitted permitAuditOutcome = "permitted"
+	// permitAuditDenied means that the agent was permitted less than it requested
+	permitAuditDenied permitAuditOutcome = "denied"
+	// permitAuditError means that the request failed
+	permitAuditError permitAuditOutcome = "error"
+)
+
+// permitAuditReason gives why a requested increase was not fully permitted
+type permitAuditReason string
+
+const (
+	permitAuditNoReason permitAuditReason = ""
+	// permitAuditTenantBudget means that the increase was limited to fit within the tenant budget
+	permitAuditTenantBudget permitAuditReason = "tenantBudget"
+	// permitAuditMigrating means that the VM is currently migrating, and the increase couldn't be
+	// reserved on both nodes (or increases during migration aren't allowed)
+	permitAuditMigrating permitAuditReason = "migrating"
+	// permitAuditStartingMigration means that the VM is being migrated as a result of the request
+	permitAuditStartingMigration permitAuditReason = "startingMigration"
+	// permitAuditPriorityWatermark means that the VM's priority was below
+	// minPriorityAboveWatermark, so the increase was limited by the node's watermark
+	permitAuditPriorityWatermark permitAuditReason = "priorityWatermark"
+	// permitAuditNodeCapacity means that the node didn't have enough unreserved resources
+	permitAuditNodeCapacity permitAuditReason = "nodeCapacity"
+)
+
+type permitAuditRecord struct {
+	Time time.Time           `json:"time"`
+	Node string              `json:"node"`
+	VM   util.NamespacedName `json:"vm"`
+	Pod  util.NamespacedName `json:"pod"`
+
+	Requested api.Resources `json:"requested"`
+	// Permitted is the permit that was returned, or nil if the request failed
+	Permitted *api.Resources `json:"permitted"`
+	// Reserved is the resources reserved for the VM on the node, after handling the request
+	Reserved api.Resources `json:"reserved"`
+	// NodeReserved is the total resources reserved on the node, after handling the request
+	NodeReserved api.Resources `json:"nodeReserved"`
+
+	Outcome permitAuditOutcome `json:"outcome"`
+	Reason  permitAuditReason  `json:"reason,omitempty"`
+	// Status and Error are set when the request failed
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// permitDenialReason returns why the request wasn't fully permitted, given that it wasn't and it
+// wasn't limited by the tenant budget
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) permitDenialReason(pod *podState, mustMigrate bool, priority int32) permitAuditReason {
+	if pod.vm.currentlyMigrating() {
+		return permitAuditMigrating
+	} else if mustMigrate {
+		return permitAuditStartingMigration
+	} else if e.limitedToWatermark(priority) {
+		return permitAuditPriorityWatermark
+	} else {
+		return permitAuditNodeCapacity
+	}
+}
+
+// auditPermit records the outcome of a request from the pod's autoscaler-agent, in the metrics and,
+// if enabled, the audit
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) auditPermit(
+	pod *podState,
+	requested api.Resources,
+	permitted *api.Resources,
+	reason permitAuditReason,
+	status int,
+	err error,
+) {
+	record := permitAuditRecord{
+		Time:         time.Now(),
+		Node:         pod.node.name,
+		VM:           pod.vm.Name,
+		Pod:          pod.name,
+		Requested:    requested,
+		Permitted:    permitted,
+		Reserved:     api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved},
+		NodeReserved: api.Resources{VCPU: pod.node.cpu.Reserved, Mem: pod.node.mem.Reserved},
+		Outcome:      permitAuditPermitted,
+		Reason:       reason,
+		Status:       0,
+		Error:        "",
+	}
+
+	if err != nil {
+		record.Outcome = permitAuditError
+		record.Status = status
+		record.Error = err.Error()
+	} else if reason != permitAuditNoReason {
+		record.Outcome = permitAuditDenied
+	}
+
+	e.metrics.permitDecisions.
+		WithLabelValues(record.Node, string(record.Outcome), string(record.Reason)).
+		Inc()
+
+	if e.permitAudit != nil {
+		e.permitAudit.add(record)
+	}
+}
+
+type permitAuditNodeRequest struct {
+	Node string `json:"node"`
+}
+
+type permitAuditVMRequest struct {
+	VM util.NamespacedName `json:"vm"`
+}
+
+func (e *AutoscaleEnforcer) addPermitAuditHandlers(logger *zap.Logger, mux *http.ServeMux) {
+	util.AddHandler(
+		logger, mux, "/audit/node", http.MethodPost, "permitAuditNodeRequest",
+		func(_ context.Context, _ *zap.Logger, req *permitAuditNodeRequest) (*[]permitAuditRecord, int, error) {
+			records := e.permitAudit.forNode(req.Node)
+			return &records, 200, nil
+		},
+	)
+	util.AddHandler(
+		logger, mux, "/audit/vm", http.MethodPost, "permitAuditVMRequest",
+		func(_ context.Context, _ *zap.Logger, req *permitAuditVMRequest) (*[]permitAuditRecord, int, error) {
+			records := e.permitAudit.forVM(req.VM)
+			return &records, 200, nil
+		},
+	)
+}
+
+// memoryPermitAuditStore is the permitAuditStore that keeps the records in memory
+type memoryPermitAuditStore struct {
+	mu sync.Mutex
+
+	maxPerNode int
+	maxPerVM   int
+	retention  time.Duration
+
+	nodes       map[string][]permitAuditRecord
+	vms         map[util.NamespacedName][]permitAuditRecord
+	lastCleanup time.Time
+}
+
+func newMemoryPermitAuditStore(conf *permitAuditConfig) permitAuditStore {
+	return &memoryPermitAuditStore{
+		mu:          sync.Mutex{},
+		maxPerNode:  int(conf.MaxPerNode),
+		maxPerVM:    int(conf.MaxPerVM),
+		retention:   time.Duration(conf.RetentionSeconds) * time.Second,
+		nodes:       make(map[string][]permitAuditRecord),
+		vms:         make(map[util.NamespacedName][]permitAuditRecord),
+		lastCleanup: time.Now(),
+	}
+}
+
+func (s *memoryPermitAuditStore) add(record permitAuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[record.Node] = appendBounded(s.nodes[record.Node], record, s.maxPerNode)
+	s.vms[record.VM] = appendBounded(s.vms[record.VM], record, s.maxPerVM)
+
+	// Periodically remove the records that have expired, so that we don't keep the history of
+	// every node and VM that's ever existed.
+	if record.Time.Sub(s.lastCleanup) >= s.retention {
+		cutoff := record.Time.Add(-s.retention)
+		removeExpired(s.nodes, cutoff)
+		removeExpired(s.vms, cutoff)
+		s.lastCleanup = record.Time
+	}
+}
+
+func (s *memoryPermitAuditStore) forNode(node string) []permitAuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.nodes[node])
+}
+
+func (s *memoryPermitAuditStore) forVM(vm util.NamespacedName) []permitAuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.vms[vm])
+}
+
+// appendBounded appends the record, removing the oldest ones if there would be more than limit
+func appendBounded(records []permitAuditRecord, record permitAuditRecord, limit int) []permitAuditRecord {
+	records = append(records, record)
+	if len(records) > limit {
+		records = slices.Delete(records, 0, len(records)-limit)
+	}
+	return records
+}
+
+func removeExpired[K comparable](m map[K][]permitAuditRecord, cutoff time.Time) {
+	for key, records := range m {
+		firstKept, _ := slices.BinarySearchFunc(records, cutoff, func(r permitAuditRecord, t time.Time) int {
+			return r.Time.Compare(t)
+		})
+		if firstKept == len(records) {
+			delete(m, key)
+		} else {
+			m[key] = slices.Delete(records, 0, firstKept)
+		}
+	}
+}
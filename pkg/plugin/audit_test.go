@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func auditTestRecord(at time.Time, node string, vm string) permitAuditRecord {
+	return permitAuditRecord{
+		Time:         at,
+		Node:         node,
+		VM:           util.NamespacedName{Namespace: "default", Name: vm},
+		Pod:          util.NamespacedName{Namespace: "default", Name: vm + "-pod"},
+		Requested:    api.Resources{VCPU: 1000, Mem: 4 << 30},
+		Permitted:    nil,
+		Reserved:     api.Resources{VCPU: 0, Mem: 0},
+		NodeReserved: api.Resources{VCPU: 0, Mem: 0},
+		Outcome:      permitAuditPermitted,
+		Reason:       permitAuditNoReason,
+		Status:       0,
+		Error:        "",
+	}
+}
+
+func auditTimes(records []permitAuditRecord, start time.Time) []int {
+	var seconds []int
+	for _, r := range records {
+		seconds = append(seconds, int(r.Time.Sub(start)/time.Second))
+	}
+	return seconds
+}
+
+func TestMemoryPermitAuditStoreBounds(t *testing.T) {
+	start := time.Now()
+	store := newMemoryPermitAuditStore(&permitAuditConfig{
+		Storage:          "memory",
+		MaxPerNode:       3,
+		MaxPerVM:         2,
+		RetentionSeconds: 3600,
+	})
+	vmA := util.NamespacedName{Namespace: "default", Name: "vm-a"}
+
+	for i := 0; i < 5; i++ {
+		store.add(auditTestRecord(start.Add(time.Duration(i)*time.Second), "node-1", "vm-a"))
+	}
+	store.add(auditTestRecord(start.Add(5*time.Second), "node-1", "vm-b"))
+	store.add(auditTestRecord(start.Add(6*time.Second), "node-2", "vm-a"))
+
+	// Only the most recent records are kept, oldest first, and the per-node and per-VM limits are
+	// applied separately.
+	assert.Equal(t, []int{3, 4, 5}, auditTimes(store.forNode("node-1"), start))
+	assert.Equal(t, []int{6}, auditTimes(store.forNode("node-2"), start))
+	assert.Equal(t, []int{4, 6}, auditTimes(store.forVM(vmA), start))
+	assert.Equal(t, []int{5}, auditTimes(store.forVM(util.NamespacedName{Namespace: "default", Name: "vm-b"}), start))
+	assert.Empty(t, store.forNode("unknown"))
+
+	// The returned records are copies, so changing them doesn't affect the store
+	records := store.forVM(vmA)
+	records[0].Node = "changed"
+	assert.Equal(t, "node-1", store.forVM(vmA)[0].Node)
+}
+
+func TestMemoryPermitAuditStoreExpiry(t *testing.T) {
+	start := time.Now()
+	store := newMemoryPermitAuditStore(&permitAuditConfig{
+		Storage:          "memory",
+		MaxPerNode:       10,
+		MaxPerVM:         10,
+		RetentionSeconds: 60,
+	})
+
+	store.add(auditTestRecord(start, "node-1", "vm-a"))
+	store.add(auditTestRecord(start.Add(30*time.Second), "node-2", "vm-b"))
+	store.add(auditTestRecord(start.Add(50*time.Second), "node-1", "vm-a"))
+
+	// Expired records are only removed once a retention period has passed since the last cleanup
+	store.add(auditTestRecord(start.Add(59*time.Second), "node-1", "vm-a"))
+	assert.Equal(t, []int{0, 50, 59}, auditTimes(store.forNode("node-1"), start))
+
+	// ... and then, everything older than the retention is removed, including nodes and VMs that
+	// have no records left.
+	store.add(auditTestRecord(start.Add(100*time.Second), "node-1", "vm-a"))
+	assert.Equal(t, []int{50, 59, 100}, auditTimes(store.forNode("node-1"), start))
+	assert.Empty(t, store.forNode("node-2"))
+	assert.Empty(t, store.forVM(util.NamespacedName{Namespace: "default", Name: "vm-b"}))
+
+	memStore := store.(*memoryPermitAuditStore)
+	assert.Len(t, memStore.nodes, 1)
+	assert.Len(t, memStore.vms, 1)
+}
+
+func TestRemoveExpired(t *testing.T) {
+	start := time.Now()
+	records := func(seconds ...int) []permitAuditRecord {
+		var rs []permitAuditRecord
+		for _, s := range seconds {
+			rs = append(rs, auditTestRecord(start.Add(time.Duration(s)*time.Second), "node", "vm"))
+		}
+		return rs
+	}
+	m := map[string][]permitAuditRecord{
+		"all-expired": records(0, 1),
+		"some":        records(0, 5, 10),
+		"none":        records(10, 20),
+	}
+
+	// Records exactly at the cutoff are kept
+	removeExpired(m, start.Add(5*time.Second))
+	assert.NotContains(t, m, "all-expired")
+	assert.Equal(t, []int{5, 10}, auditTimes(m["some"], start))
+	assert.Equal(t, []int{10, 20}, auditTimes(m["none"], start))
+}
+
+func TestPermitDenialReason(t *testing.T) {
+	minPriority := int32(10)
+	e := new(AutoscaleEnforcer)
+	e.state.conf = &Config{MinPriorityAboveWatermark: &minPriority} //nolint:exhaustruct // only the watermark is used
+
+	pod := &podState{ //nolint:exhaustruct // only the VM is used
+		vm: &vmPodState{MigrationState: nil}, //nolint:exhaustruct // only the migration is used
+	}
+
+	assert.Equal(t, permitAuditNodeCapacity, e.permitDenialReason(pod, false, 10))
+	assert.Equal(t, permitAuditPriorityWatermark, e.permitDenialReason(pod, false, 9))
+	// Starting a migration takes precedence over the watermark...
+	assert.Equal(t, permitAuditStartingMigration, e.permitDenialReason(pod, true, 9))
+	// ... and being in the middle of one takes precedence over everything.
+	pod.vm.MigrationState = &podMigrationState{Name: util.NamespacedName{Namespace: "default", Name: "vmm"}}
+	assert.Equal(t, permitAuditMigrating, e.permitDenialReason(pod, true, 9))
+
+	// Without a watermark, the priority doesn't matter
+	pod.vm.MigrationState = nil
+	e.state.conf.MinPriorityAboveWatermark = nil
+	assert.Equal(t, permitAuditNodeCapacity, e.permitDenialReason(pod, false, 0))
+}
+
+func TestAuditPermit(t *testing.T) {
+	e := new(AutoscaleEnforcer)
+	e.makePrometheusRegistry()
+	e.permitAudit = newMemoryPermitAuditStore(&permitAuditConfig{
+		Storage:          "memory",
+		MaxPerNode:       10,
+		MaxPerVM:         10,
+		RetentionSeconds: 3600,
+	})
+
+	node := historyTestNode("node-1", 4000, 0, 16<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+	e.state.pods = make(map[util.NamespacedName]*podState)
+	pod := checkpointTestPod(&e.state, node, "pod", 500, 4000, 2<<30, 16<<30)
+	pod.vm = &vmPodState{Name: util.NamespacedName{Namespace: "default", Name: "vm"}} //nolint:exhaustruct // only the name is used
+
+	requested := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	permitted := api.Resources{VCPU: 500, Mem: 2 << 30}
+	e.auditPermit(pod, requested, &requested, permitAuditNoReason, 0, nil)
+	e.auditPermit(pod, requested, &permitted, permitAuditNodeCapacity, 0, nil)
+	e.auditPermit(pod, requested, nil, permitAuditNoReason, http.StatusBadRequest, errors.New("bad request"))
+
+	records := e.permitAudit.forVM(pod.vm.Name)
+	require.Len(t, records, 3)
+	assert.Equal(t, permitAuditPermitted, records[0].Outcome)
+	assert.Equal(t, permitAuditDenied, records[1].Outcome)
+	assert.Equal(t, permitAuditNodeCapacity, records[1].Reason)
+	assert.Equal(t, &permitted, records[1].Permitted)
+	assert.Equal(t, permitAuditError, records[2].Outcome)
+	assert.Equal(t, http.StatusBadRequest, records[2].Status)
+	assert.Equal(t, "bad request", records[2].Error)
+	for _, r := range records {
+		assert.Equal(t, "node-1", r.Node)
+		assert.Equal(t, api.Resources{VCPU: 500, Mem: 2 << 30}, r.Reserved)
+		assert.Equal(t, api.Resources{VCPU: 500, Mem: 2 << 30}, r.NodeReserved)
+	}
+
+	decisions := e.metrics.permitDecisions
+	assert.Equal(t, 1.0, testutil.ToFloat64(decisions.WithLabelValues("node-1", "permitted", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(decisions.WithLabelValues("node-1", "denied", "nodeCapacity")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(decisions.WithLabelValues("node-1", "error", "")))
+}
+
+func TestPermitAuditHandlers(t *testing.T) {
+	start := time.Now()
+	e := new(AutoscaleEnforcer)
+	e.permitAudit = newMemoryPermitAuditStore(&permitAuditConfig{
+		Storage:          "memory",
+		MaxPerNode:       10,
+		MaxPerVM:         10,
+		RetentionSeconds: 3600,
+	})
+	e.permitAudit.add(auditTestRecord(start, "node-1", "vm-a"))
+	e.permitAudit.add(auditTestRecord(start.Add(time.Second), "node-2", "vm-a"))
+
+	mux := http.NewServeMux()
+	e.addPermitAuditHandlers(zap.NewNop(), mux)
+
+	post := func(path string, body string) (int, []permitAuditRecord) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		var records []permitAuditRecord
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &records))
+		}
+		return rec.Code, records
+	}
+
+	status, records := post("/audit/node", `{"node": "node-1"}`)
+	assert.Equal(t, http.StatusOK, status)
+	require.Len(t, records, 1)
+	assert.Equal(t, "vm-a", records[0].VM.Name)
+
+	status, records = post("/audit/vm", `{"vm": {"namespace": "default", "name": "vm-a"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	require.Len(t, records, 2)
+	assert.Equal(t, "node-1", records[0].Node)
+	assert.Equal(t, "node-2", records[1].Node)
+
+	status, _ = post("/audit/node", `not json`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit/node", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
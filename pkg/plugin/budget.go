@@ -0,0 +1,113 @@
+package plugin
+
+// Budgets on the total compute units of each tenant's VMs, across the whole cluster.
+//
+// Each VM's tenant is given by a label on its pod. Increases are only permitted up to the point
+// where the sum of the resources reserved for all of the tenant's VMs reaches its budget; the
+// remainder of the request is denied, with a reason that's passed back to the autoscaler-agent.
+//
+// Budgets are only enforced on increases, so reducing a tenant's budget below its current usage
+// doesn't force any VMs to downscale -- it just prevents them from upscaling until they're within
+// it again.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type tenantBudgetConfig struct {
+	// Label gives the label on VM pods that identifies the tenant the VM belongs to. VMs without
+	// the label aren't subject to any budget.
+	Label string `json:"label"`
+	// Budgets gives the maximum total compute units for all of the VMs belonging to each tenant.
+	// Tenants that aren't listed have no budget.
+	//
+	// Compute units are counted using the compute unit sent by each VM's autoscaler-agent, with
+	// each VM counting as the larger of its CPU and memory in compute units.
+	Budgets map[string]float64 `json:"budgets"`
+}
+
+func (c *tenantBudgetConfig) validate() (string, error) {
+	if c.Label == "" {
+		return "label", errors.New("string cannot be empty")
+	}
+
+	for tenant, budget := range c.Budgets {
+		if budget < 0 || math.IsNaN(budget) {
+			return fmt.Sprintf("budgets[%q]", tenant), errors.New("value must be >= 0")
+		}
+	}
+
+	return "", nil
+}
+
+// podTenant returns the tenant that the pod belongs to, or "" if tenant budgets aren't enabled or
+// the pod doesn't have a tenant
+func podTenant(pod *corev1.Pod, conf *Config) string {
+	if conf.TenantBudgets == nil {
+		return ""
+	}
+	return pod.Labels[conf.TenantBudgets.Label]
+}
+
+// tenantBudgetLimit returns the largest resources that pod may be permitted without exceeding the
+// budget of its VM's tenant, if that's less than the requested resources.
+//
+// The returned limit is never less than the resources currently reserved for the pod, and any
+// increase it allows is a whole number of compute units.
+//
+// The state's lock must be held.
+func (e *AutoscaleEnforcer) tenantBudgetLimit(
+	pod *podState,
+	cu api.Resources,
+	requested api.Resources,
+) (_ api.Resources, budget float64, limited bool) {
+	conf := e.state.conf.TenantBudgets
+	if conf == nil || pod.vm == nil || pod.vm.Tenant == "" {
+		return requested, 0, false
+	}
+	budget, ok := conf.Budgets[pod.vm.Tenant]
+	if !ok {
+		return requested, 0, false
+	}
+
+	current := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+	if !requested.HasFieldGreaterThan(current) {
+		return requested, budget, false
+	}
+
+	// Count each of the tenant's other VMs once. While a VM is migrating, it has a pod on both the
+	// source and target nodes, so we take whichever has more reserved.
+	others := make(map[util.NamespacedName]float64)
+	for _, p := range e.state.pods {
+		if p.vm == nil || p.vm.Tenant != pod.vm.Tenant || p.vm.Name == pod.vm.Name {
+			continue
+		}
+		reserved := api.Resources{VCPU: p.cpu.Reserved, Mem: p.mem.Reserved}.ComputeUnits(cu)
+		others[p.vm.Name] = util.Max(others[p.vm.Name], reserved)
+	}
+	var used float64
+	for _, reserved := range others {
+		used += reserved
+	}
+
+	if used+requested.ComputeUnits(cu) <= budget {
+		return requested, budget, false
+	}
+
+	// Round down to a whole number of compute units, so that the VM can still be given a valid
+	// size. If even the smallest increase doesn't fit, nothing above the current resources is
+	// permitted.
+	allowed := math.Floor(budget - used)
+	if allowed < 0 {
+		allowed = 0
+	}
+	limit := cu.Mul(uint16(util.Min(allowed, math.MaxUint16))).Max(current).Min(requested)
+	return limit, budget, true
+}
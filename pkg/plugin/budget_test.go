@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestTenantBudgetLimit(t *testing.T) {
+	cu := api.Resources{VCPU: 250, Mem: 1 << 30}
+
+	p := new(AutoscaleEnforcer)
+	p.state.conf = &Config{ //nolint:exhaustruct // only the budgets are used
+		TenantBudgets: &tenantBudgetConfig{
+			Label:   "tenant",
+			Budgets: map[string]float64{"a": 8, "b": 5.5},
+		},
+	}
+	p.state.pods = make(map[util.NamespacedName]*podState)
+	node := historyTestNode("node-a", 64000, 0, 256<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+
+	// addPod adds a pod for the VM, with the given number of compute units reserved
+	addPod := func(podName string, vmName string, tenant string, cus uint16) *podState {
+		reserved := cu.Mul(cus)
+		pod := checkpointTestPod(&p.state, node, podName, reserved.VCPU, 16000, reserved.Mem, 64<<30)
+		pod.vm = &vmPodState{ //nolint:exhaustruct // only the name and tenant are used
+			Name:   util.NamespacedName{Namespace: "default", Name: vmName},
+			Tenant: tenant,
+		}
+		return pod
+	}
+	resources := func(cpu vmapi.MilliCPU, mem api.Bytes) api.Resources {
+		return api.Resources{VCPU: cpu, Mem: mem}
+	}
+
+	pod := addPod("pod", "vm", "a", 1)
+	// Tenant "a" has another VM with 2 CU, migrating with 3 CU reserved on the target node, so it
+	// counts as 3 CU
+	addPod("other-source", "other", "a", 2)
+	addPod("other-target", "other", "a", 3)
+	// The pods of other tenants, and the other pod of this VM while it's migrating, don't count
+	addPod("vm-target", "vm", "a", 4)
+	addPod("unrelated", "unrelated", "b", 10)
+
+	// Within the budget: 3 + 5 <= 8
+	limit, budget, limited := p.tenantBudgetLimit(pod, cu, cu.Mul(5))
+	assert.Equal(t, cu.Mul(5), limit)
+	assert.Equal(t, 8.0, budget)
+	assert.False(t, limited)
+
+	// Above the budget: only up to 5 CU
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, cu.Mul(7))
+	assert.Equal(t, cu.Mul(5), limit)
+	assert.True(t, limited)
+
+	// The limit never goes above what was requested for either resource
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, resources(2000, 2<<30))
+	assert.Equal(t, resources(1250, 2<<30), limit)
+	assert.True(t, limited)
+
+	// Decreases aren't limited, even when the tenant is over its budget
+	addPod("big", "big", "a", 10)
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, resources(250, 512<<20))
+	assert.Equal(t, resources(250, 512<<20), limit)
+	assert.False(t, limited)
+
+	// ... and while it's over its budget, increases are limited to the current resources
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, cu.Mul(2))
+	assert.Equal(t, cu.Mul(1), limit)
+	assert.True(t, limited)
+}
+
+func TestTenantBudgetLimitRounding(t *testing.T) {
+	cu := api.Resources{VCPU: 250, Mem: 1 << 30}
+
+	p := new(AutoscaleEnforcer)
+	p.state.conf = &Config{ //nolint:exhaustruct // only the budgets are used
+		TenantBudgets: &tenantBudgetConfig{
+			Label:   "tenant",
+			Budgets: map[string]float64{"a": 5.5},
+		},
+	}
+	p.state.pods = make(map[util.NamespacedName]*podState)
+	node := historyTestNode("node-a", 64000, 0, 256<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+
+	pod := checkpointTestPod(&p.state, node, "pod", 250, 16000, 1<<30, 64<<30)
+	pod.vm = &vmPodState{ //nolint:exhaustruct // only the name and tenant are used
+		Name:   util.NamespacedName{Namespace: "default", Name: "vm"},
+		Tenant: "a",
+	}
+	// The other VM has 1.5 CU, counting memory, which is the larger of the two
+	other := checkpointTestPod(&p.state, node, "other", 250, 16000, 3<<29, 64<<30)
+	other.vm = &vmPodState{ //nolint:exhaustruct // only the name and tenant are used
+		Name:   util.NamespacedName{Namespace: "default", Name: "other"},
+		Tenant: "a",
+	}
+
+	// 4 CU are left, so 5.5 - 1.5 = 4 is allowed exactly
+	limit, _, limited := p.tenantBudgetLimit(pod, cu, cu.Mul(4))
+	assert.Equal(t, cu.Mul(4), limit)
+	assert.False(t, limited)
+
+	// With 2.5 CU used by other VMs, 3 CU are left after rounding down
+	other.mem.Reserved = 5 << 29
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, cu.Mul(4))
+	assert.Equal(t, cu.Mul(3), limit)
+	assert.True(t, limited)
+
+	// If even the current resources don't fit, nothing more is permitted
+	other.mem.Reserved = 6 << 30
+	limit, _, limited = p.tenantBudgetLimit(pod, cu, cu.Mul(4))
+	assert.Equal(t, cu.Mul(1), limit)
+	assert.True(t, limited)
+}
+
+func TestTenantBudgetLimitDisabled(t *testing.T) {
+	cu := api.Resources{VCPU: 250, Mem: 1 << 30}
+	requested := cu.Mul(100)
+
+	p := new(AutoscaleEnforcer)
+	p.state.conf = &Config{TenantBudgets: nil} //nolint:exhaustruct // only the budgets are used
+	p.state.pods = make(map[util.NamespacedName]*podState)
+	node := historyTestNode("node-a", 64000, 0, 256<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+	pod := checkpointTestPod(&p.state, node, "pod", 250, 16000, 1<<30, 64<<30)
+
+	check := func(name string) {
+		limit, budget, limited := p.tenantBudgetLimit(pod, cu, requested)
+		assert.Equal(t, requested, limit, name)
+		assert.Equal(t, 0.0, budget, name)
+		assert.False(t, limited, name)
+	}
+
+	check("budgets disabled")
+
+	p.state.conf.TenantBudgets = &tenantBudgetConfig{Label: "tenant", Budgets: map[string]float64{"a": 1}}
+	check("not a VM")
+
+	pod.vm = &vmPodState{ //nolint:exhaustruct // only the name and tenant are used
+		Name:   util.NamespacedName{Namespace: "default", Name: "vm"},
+		Tenant: "",
+	}
+	check("no tenant")
+
+	pod.vm.Tenant = "b"
+	check("tenant without a budget")
+}
@@ -0,0 +1,125 @@
+package plugin
+
+// Dry-run capacity queries, served alongside the autoscaler-agent requests so that agents and
+// operators can plan scale-ups and migrations before committing to them. Nothing here changes the
+// plugin's state.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func (e *AutoscaleEnforcer) addCapacityHandlers(logger *zap.Logger, mux *http.ServeMux) {
+	util.AddHandler(logger, mux, "/capacity/vm", http.MethodPost, "VMCapacityRequest", e.handleVMCapacityRequest)
+	util.AddHandler(logger, mux, "/capacity/node", http.MethodPost, "NodeCapacityRequest", e.handleNodeCapacityRequest)
+}
+
+func (e *AutoscaleEnforcer) handleVMCapacityRequest(
+	_ context.Context,
+	_ *zap.Logger,
+	req *api.VMCapacityRequest,
+) (*api.VMCapacityResponse, int, error) {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var pod *podState
+	for _, p := range e.state.pods {
+		if p.vm != nil && p.vm.Name == req.VM {
+			pod = p
+			break
+		}
+	}
+	if pod == nil {
+		return nil, 404, fmt.Errorf("VM %v not found", req.VM)
+	}
+
+	node := pod.node
+	reserved := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+
+	// Increases are rounded the same way as for requests from the autoscaler-agent: to multiples of
+	// the compute unit if there is one, or else to whole memory slots.
+	factor := api.Resources{VCPU: 1, Mem: pod.vm.MemSlotSize}
+	if req.ComputeUnit != nil {
+		if err := req.ComputeUnit.ValidateNonZero(); err != nil {
+			return nil, 400, fmt.Errorf("computeUnit fields must be non-zero: %w", err)
+		}
+		if req.ComputeUnit.Mem%pod.vm.MemSlotSize != 0 {
+			return nil, 400, fmt.Errorf(
+				"computeUnit is not divisible by VM memory slot size: %v not divisible by %v",
+				*req.ComputeUnit,
+				pod.vm.MemSlotSize,
+			)
+		}
+		factor = *req.ComputeUnit
+	}
+
+	// Upscales of VMs already on the node may use all of its unreserved resources, including the
+	// headroom that new pods can't be placed into -- unless the VM's priority only allows it to use
+	// what's below the watermark.
+	cpuReservable, memReservable := e.reservableTotals(node, pod.vm.Config.Priority)
+	maxFit := api.Resources{
+		VCPU: pod.cpu.Reserved + maxReservableIncrease(node.cpu.Reserved, cpuReservable, factor.VCPU),
+		Mem:  pod.mem.Reserved + maxReservableIncrease(node.mem.Reserved, memReservable, factor.Mem),
+	}
+	increase := req.Target.SaturatingSub(reserved)
+
+	resp := api.VMCapacityResponse{
+		Node:     node.name,
+		Fits:     !req.Target.HasFieldGreaterThan(maxFit),
+		Reason:   "",
+		Reserved: reserved,
+		MaxFit:   maxFit,
+		AboveWatermark: node.cpu.Reserved+increase.VCPU > node.cpu.Watermark ||
+			node.mem.Reserved+increase.Mem > node.mem.Watermark,
+	}
+
+	if pod.vm.currentlyMigrating() {
+		resp.Fits = false
+		resp.Reason = "VM is currently migrating"
+	} else if !resp.Fits && e.limitedToWatermark(pod.vm.Config.Priority) {
+		resp.Reason = fmt.Sprintf("VM's priority only allows up to %v, below node %s's watermark", maxFit, node.name)
+	} else if !resp.Fits {
+		resp.Reason = fmt.Sprintf("node %s has room for at most %v", node.name, maxFit)
+	}
+
+	return &resp, 200, nil
+}
+
+func (e *AutoscaleEnforcer) handleNodeCapacityRequest(
+	_ context.Context,
+	_ *zap.Logger,
+	req *api.NodeCapacityRequest,
+) (*api.NodeCapacityResponse, int, error) {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	node, ok := e.state.nodes[req.Node]
+	if !ok {
+		return nil, 404, fmt.Errorf("Node %q not found", req.Node)
+	}
+
+	return &api.NodeCapacityResponse{
+		Node: node.name,
+		CPU: api.NodeResourceCapacity[vmapi.MilliCPU]{
+			Total:     node.cpu.Total,
+			Reserved:  node.cpu.Reserved,
+			Watermark: node.cpu.Watermark,
+			Headroom:  node.remainingReservableCPU(),
+			Placeable: node.remainingPlaceableCPU(),
+		},
+		Mem: api.NodeResourceCapacity[api.Bytes]{
+			Total:     node.mem.Total,
+			Reserved:  node.mem.Reserved,
+			Watermark: node.mem.Watermark,
+			Headroom:  node.remainingReservableMem(),
+			Placeable: node.remainingPlaceableMem(),
+		},
+	}, 200, nil
+}
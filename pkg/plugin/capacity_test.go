@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestMaxReservableIncrease(t *testing.T) {
+	assert.Equal(t, uint(6), maxReservableIncrease[uint](2, 10, 3))
+	assert.Equal(t, uint(8), maxReservableIncrease[uint](2, 10, 1))
+	// Reserved may be above the total, e.g. after a config change
+	assert.Equal(t, uint(0), maxReservableIncrease[uint](12, 10, 1))
+}
+
+func TestHandleVMCapacityRequest(t *testing.T) {
+	minPriority := int32(10)
+	p := &AutoscaleEnforcer{} //nolint:exhaustruct // only the state is used
+	p.state.lock = util.NewChanMutex()
+	p.state.conf = &Config{MinPriorityAboveWatermark: &minPriority} //nolint:exhaustruct // only the priority is used
+	p.state.pods = make(map[util.NamespacedName]*podState)
+
+	// 8 CPUs and 32 GiB, with watermarks at 6 CPUs and 24 GiB. 5 CPUs and 20 GiB are reserved in
+	// total, of which the VM has 1 CPU and 4 GiB.
+	node := historyTestNode("node-a", 8000, 4000, 32<<30, 16<<30)
+	node.cpu.Watermark = 6000
+	node.mem.Watermark = 24 << 30
+	node.pods = make(map[util.NamespacedName]*podState)
+	pod := checkpointTestPod(&p.state, node, "pod", 1000, 8000, 4<<30, 32<<30)
+	vmName := util.NamespacedName{Namespace: "default", Name: "vm"}
+	pod.vm = &vmPodState{ //nolint:exhaustruct // only the fields used for capacity matter
+		Name:        vmName,
+		MemSlotSize: 3 << 30,
+		Config:      api.VmConfig{Priority: minPriority}, //nolint:exhaustruct // only the priority matters
+	}
+
+	query := func(target api.Resources, cu *api.Resources) *api.VMCapacityResponse {
+		resp, status, err := p.handleVMCapacityRequest(context.Background(), zap.NewNop(), &api.VMCapacityRequest{
+			VM:          vmName,
+			Target:      target,
+			ComputeUnit: cu,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 200, status)
+		return resp
+	}
+
+	// Memory is rounded down to whole 3 GiB slots: 12 GiB left, so 4 + 12
+	resp := query(api.Resources{VCPU: 2000, Mem: 8 << 30}, nil)
+	assert.True(t, resp.Fits)
+	assert.False(t, resp.AboveWatermark)
+	assert.Equal(t, api.Resources{VCPU: 1000, Mem: 4 << 30}, resp.Reserved)
+	assert.Equal(t, api.Resources{VCPU: 4000, Mem: 16 << 30}, resp.MaxFit)
+
+	// With a compute unit, increases are multiples of it: 3 CPUs and 12 GiB left, so 1 + 2 CPUs
+	resp = query(api.Resources{VCPU: 4000, Mem: 8 << 30}, &api.Resources{VCPU: 2000, Mem: 6 << 30})
+	assert.False(t, resp.Fits)
+	assert.Equal(t, api.Resources{VCPU: 3000, Mem: 16 << 30}, resp.MaxFit)
+	assert.Contains(t, resp.Reason, "node node-a has room")
+
+	// Lower priority VMs are limited to what's left below the watermark: 1 CPU and 4 GiB
+	pod.vm.Config.Priority = minPriority - 1
+	resp = query(api.Resources{VCPU: 3000, Mem: 8 << 30}, nil)
+	assert.False(t, resp.Fits)
+	assert.Equal(t, api.Resources{VCPU: 2000, Mem: 7 << 30}, resp.MaxFit)
+	assert.Contains(t, resp.Reason, "priority")
+	resp = query(api.Resources{VCPU: 2000, Mem: 7 << 30}, nil)
+	assert.True(t, resp.Fits)
+
+	// Compute units must match the VM's slot size
+	_, status, err := p.handleVMCapacityRequest(context.Background(), zap.NewNop(), &api.VMCapacityRequest{
+		VM:          vmName,
+		Target:      api.Resources{VCPU: 1000, Mem: 4 << 30},
+		ComputeUnit: &api.Resources{VCPU: 1000, Mem: 4 << 30},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 400, status)
+
+	// Migrating VMs can't be scaled at all
+	pod.vm.Config.Priority = minPriority
+	pod.vm.MigrationState = &podMigrationState{} //nolint:exhaustruct // only its presence matters
+	resp = query(api.Resources{VCPU: 1000, Mem: 4 << 30}, nil)
+	assert.False(t, resp.Fits)
+	assert.Equal(t, "VM is currently migrating", resp.Reason)
+
+	_, status, err = p.handleVMCapacityRequest(context.Background(), zap.NewNop(), &api.VMCapacityRequest{
+		VM:          util.NamespacedName{Namespace: "default", Name: "other"},
+		Target:      api.Resources{VCPU: 1000, Mem: 4 << 30},
+		ComputeUnit: nil,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 404, status)
+}
+
+func TestHandleNodeCapacityRequest(t *testing.T) {
+	p := &AutoscaleEnforcer{} //nolint:exhaustruct // only the state is used
+	p.state.lock = util.NewChanMutex()
+
+	node := historyTestNode("node-a", 8000, 5000, 32<<30, 20<<30)
+	node.cpu.Watermark = 6000
+	node.cpu.UpscaleHeadroom = 2000
+	node.mem.Watermark = 24 << 30
+	node.mem.UpscaleHeadroom = 8 << 30
+	p.state.nodes = map[string]*nodeState{"node-a": node}
+
+	resp, status, err := p.handleNodeCapacityRequest(context.Background(), zap.NewNop(), &api.NodeCapacityRequest{Node: "node-a"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, &api.NodeCapacityResponse{
+		Node: "node-a",
+		CPU:  api.NodeResourceCapacity[vmapi.MilliCPU]{Total: 8000, Reserved: 5000, Watermark: 6000, Headroom: 3000, Placeable: 1000},
+		Mem:  api.NodeResourceCapacity[api.Bytes]{Total: 32 << 30, Reserved: 20 << 30, Watermark: 24 << 30, Headroom: 12 << 30, Placeable: 4 << 30},
+	}, resp)
+
+	_, status, err = p.handleNodeCapacityRequest(context.Background(), zap.NewNop(), &api.NodeCapacityRequest{Node: "node-b"})
+	assert.Error(t, err)
+	assert.Equal(t, 404, status)
+}
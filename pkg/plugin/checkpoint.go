@@ -0,0 +1,367 @@
+package plugin
+
+// Periodic checkpointing of the plugin's reservations, so that a restarted scheduler can recover
+// the reservations that it can't rebuild from the cluster alone.
+//
+// On startup, the state is first rebuilt from the live pods and VMs as usual. The most recent
+// checkpoint is then reconciled against it: for pods that are still on the same node, reservations
+// that were larger in the checkpoint are restored, so that resources the agents were granted before
+// the restart aren't handed out to new pods. Every difference between the two is counted in the
+// metrics as drift.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/constraints"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type checkpointConfig struct {
+	// File, if not empty, gives the path of a local file to store the checkpoint in. The directory
+	// must already exist.
+	File string `json:"file,omitempty"`
+	// ConfigMap, if provided, stores the checkpoint in a ConfigMap instead of a local file
+	ConfigMap *checkpointConfigMapConfig `json:"configMap,omitempty"`
+
+	// IntervalSeconds gives the time between checkpoints
+	IntervalSeconds uint `json:"intervalSeconds"`
+	// MaxAgeSeconds gives the maximum age of a checkpoint that will be restored on startup. Older
+	// checkpoints are ignored.
+	MaxAgeSeconds uint `json:"maxAgeSeconds"`
+}
+
+type checkpointConfigMapConfig struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (c *checkpointConfig) validate() (string, error) {
+	if c.File == "" && c.ConfigMap == nil {
+		return "", errors.New("one of file or configMap must be provided")
+	} else if c.File != "" && c.ConfigMap != nil {
+		return "", errors.New("only one of file or configMap may be provided")
+	}
+
+	if c.ConfigMap != nil {
+		if c.ConfigMap.Namespace == "" {
+			return "configMap.namespace", errors.New("string cannot be empty")
+		} else if c.ConfigMap.Name == "" {
+			return "configMap.name", errors.New("string cannot be empty")
+		}
+	}
+
+	if c.IntervalSeconds == 0 {
+		return "intervalSeconds", errors.New("value must be > 0")
+	} else if c.MaxAgeSeconds < c.IntervalSeconds {
+		return "maxAgeSeconds", errors.New("value must be >= intervalSeconds")
+	}
+
+	return "", nil
+}
+
+// Values of the "kind" label on the checkpoint drift metric
+const (
+	checkpointDriftPodGone        = "pod-gone"
+	checkpointDriftPodNew         = "pod-new"
+	checkpointDriftNodeChanged    = "node-changed"
+	checkpointDriftReservedRaised = "reserved-raised"
+)
+
+// Values of the "outcome" label on the checkpoint writes metric
+const (
+	checkpointWriteOK     = "ok"
+	checkpointWriteFailed = "failed"
+)
+
+// checkpointDataKey is the key in the ConfigMap that the checkpoint is stored under
+const checkpointDataKey = "checkpoint.json"
+
+type stateCheckpoint struct {
+	Time time.Time       `json:"time"`
+	Pods []podCheckpoint `json:"pods"`
+}
+
+type podCheckpoint struct {
+	Name util.NamespacedName              `json:"name"`
+	Node string                           `json:"node"`
+	CPU  podResourceState[vmapi.MilliCPU] `json:"cpu"`
+	Mem  podResourceState[api.Bytes]      `json:"mem"`
+}
+
+// checkpointStore is where checkpoints are saved to and loaded from
+type checkpointStore interface {
+	// load returns the most recently saved checkpoint, or nil if there isn't one
+	load(ctx context.Context) ([]byte, error)
+	save(ctx context.Context, data []byte) error
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+func (s fileCheckpointStore) load(context.Context) ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s fileCheckpointStore) save(_ context.Context, data []byte) error {
+	// Write to a temporary file and then rename it, so that a crash mid-write can't leave behind
+	// a partial checkpoint.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("Error writing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("Error renaming temporary file: %w", err)
+	}
+	return nil
+}
+
+type configMapCheckpointStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s configMapCheckpointStore) load(ctx context.Context) ([]byte, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[checkpointDataKey]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
+
+func (s configMapCheckpointStore) save(ctx context.Context, data []byte) error {
+	cm := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{ //nolint:exhaustruct // only the name is needed
+			Namespace: s.namespace,
+			Name:      s.name,
+		},
+		Immutable:  nil,
+		Data:       map[string]string{checkpointDataKey: string(data)},
+		BinaryData: nil,
+	}
+
+	_, err := s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// startCheckpointing restores the most recent checkpoint, if there is one, and then starts saving
+// new checkpoints in the background.
+//
+// This method MUST be called after readClusterState, and before any events are handled.
+func (p *AutoscaleEnforcer) startCheckpointing(ctx context.Context, logger *zap.Logger) {
+	conf := p.state.conf.Checkpoint
+
+	var store checkpointStore
+	if conf.ConfigMap != nil {
+		store = configMapCheckpointStore{
+			client:    p.handle.ClientSet(),
+			namespace: conf.ConfigMap.Namespace,
+			name:      conf.ConfigMap.Name,
+		}
+	} else {
+		store = fileCheckpointStore{path: conf.File}
+	}
+
+	// Failing to restore isn't fatal: we're just left with the state rebuilt from the cluster,
+	// which is what we'd have without checkpointing.
+	if err := p.restoreCheckpoint(ctx, logger, store); err != nil {
+		logger.Error("Failed to restore checkpoint", zap.Error(err))
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(conf.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := p.saveCheckpoint(ctx, store); err != nil {
+				p.metrics.checkpointWrites.WithLabelValues(checkpointWriteFailed).Inc()
+				logger.Error("Failed to save checkpoint", zap.Error(err))
+			} else {
+				p.metrics.checkpointWrites.WithLabelValues(checkpointWriteOK).Inc()
+			}
+		}
+	}()
+}
+
+func (p *AutoscaleEnforcer) saveCheckpoint(ctx context.Context, store checkpointStore) error {
+	checkpoint := p.state.checkpoint(time.Now())
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("Error encoding checkpoint: %w", err)
+	}
+
+	if err := store.save(ctx, data); err != nil {
+		return fmt.Errorf("Error saving checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpoint returns the current reservations of all pods
+func (s *pluginState) checkpoint(now time.Time) stateCheckpoint {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pods := make([]podCheckpoint, 0, len(s.pods))
+	for name, pod := range s.pods {
+		pods = append(pods, podCheckpoint{
+			Name: name,
+			Node: pod.node.name,
+			CPU:  pod.cpu,
+			Mem:  pod.mem,
+		})
+	}
+
+	return stateCheckpoint{Time: now, Pods: pods}
+}
+
+// restoreCheckpoint loads the most recent checkpoint and reconciles it against the current state
+func (p *AutoscaleEnforcer) restoreCheckpoint(ctx context.Context, logger *zap.Logger, store checkpointStore) error {
+	data, err := store.load(ctx)
+	if err != nil {
+		return fmt.Errorf("Error loading checkpoint: %w", err)
+	} else if data == nil {
+		logger.Info("No checkpoint to restore")
+		return nil
+	}
+
+	var checkpoint stateCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return fmt.Errorf("Error decoding checkpoint: %w", err)
+	}
+
+	maxAge := time.Duration(p.state.conf.Checkpoint.MaxAgeSeconds) * time.Second
+	if age := time.Since(checkpoint.Time); age > maxAge {
+		logger.Warn("Ignoring checkpoint that is too old", zap.Duration("age", age), zap.Duration("maxAge", maxAge))
+		return nil
+	}
+
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	drift := make(map[string]int)
+	seen := make(map[util.NamespacedName]struct{})
+
+	for _, saved := range checkpoint.Pods {
+		seen[saved.Name] = struct{}{}
+
+		pod, ok := p.state.pods[saved.Name]
+		if !ok {
+			drift[checkpointDriftPodGone] += 1
+			continue
+		} else if pod.node.name != saved.Node {
+			drift[checkpointDriftNodeChanged] += 1
+			continue
+		}
+
+		// Only ever increase reservations: anything we rebuilt from the cluster is known to be in
+		// use, but the checkpoint may include increases that were granted to the autoscaler-agent
+		// and haven't been applied yet.
+		cpuRaised := restoreReservation(&pod.cpu, &pod.node.cpu, saved.CPU)
+		memRaised := restoreReservation(&pod.mem, &pod.node.mem, saved.Mem)
+		if cpuRaised || memRaised {
+			drift[checkpointDriftReservedRaised] += 1
+			logger.Info(
+				"Restored larger reservation from checkpoint",
+				zap.Object("pod", saved.Name),
+				zap.String("node", saved.Node),
+				zap.Object("verdict", verdictSet{
+					cpu: fmt.Sprintf("reserved %v, buffer %v", pod.cpu.Reserved, pod.cpu.Buffer),
+					mem: fmt.Sprintf("reserved %v, buffer %v", pod.mem.Reserved, pod.mem.Buffer),
+				}),
+			)
+		}
+	}
+
+	for name := range p.state.pods {
+		if _, ok := seen[name]; !ok {
+			drift[checkpointDriftPodNew] += 1
+		}
+	}
+
+	for _, node := range p.state.nodes {
+		node.updateMetrics(p.metrics)
+	}
+
+	for kind, count := range drift {
+		p.metrics.checkpointDrift.WithLabelValues(kind).Add(float64(count))
+	}
+
+	logger.Info(
+		"Restored checkpoint",
+		zap.Time("checkpointTime", checkpoint.Time),
+		zap.Int("pods", len(checkpoint.Pods)),
+		zap.Any("drift", drift),
+	)
+	return nil
+}
+
+// restoreReservation raises the pod's reservation to the amount in the checkpoint, if it was
+// larger, returning whether it changed. The extra amount is counted as buffer, because it's not
+// yet known to be in use.
+func restoreReservation[T constraints.Unsigned](
+	pod *podResourceState[T],
+	node *nodeResourceState[T],
+	saved podResourceState[T],
+) (raised bool) {
+	target := util.Min(saved.Reserved, pod.Max)
+	if target <= pod.Reserved {
+		return false
+	}
+
+	diff := target - pod.Reserved
+	pod.Reserved += diff
+	pod.Buffer += diff
+	node.Reserved += diff
+	node.Buffer += diff
+	return true
+}
@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestCheckpointConfigValidate(t *testing.T) {
+	valid := func() *checkpointConfig {
+		return &checkpointConfig{
+			File:            "/var/lib/scheduler/checkpoint.json",
+			ConfigMap:       nil,
+			IntervalSeconds: 10,
+			MaxAgeSeconds:   60,
+		}
+	}
+
+	path, err := valid().validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "", path)
+
+	conf := valid()
+	conf.File = ""
+	_, err = conf.validate()
+	assert.Error(t, err)
+
+	conf = valid()
+	conf.ConfigMap = &checkpointConfigMapConfig{Namespace: "kube-system", Name: "checkpoint"}
+	_, err = conf.validate()
+	assert.Error(t, err)
+
+	conf.File = ""
+	conf.ConfigMap.Name = ""
+	path, _ = conf.validate()
+	assert.Equal(t, "configMap.name", path)
+
+	conf = valid()
+	conf.IntervalSeconds = 0
+	path, _ = conf.validate()
+	assert.Equal(t, "intervalSeconds", path)
+
+	conf = valid()
+	conf.MaxAgeSeconds = 5
+	path, _ = conf.validate()
+	assert.Equal(t, "maxAgeSeconds", path)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir := t.TempDir()
+	store := fileCheckpointStore{path: filepath.Join(dir, "checkpoint.json")}
+	ctx := context.Background()
+
+	data, err := store.load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, data)
+
+	require.NoError(t, store.save(ctx, []byte("first")))
+	require.NoError(t, store.save(ctx, []byte("second")))
+	data, err = store.load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// The temporary files are all cleaned up
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestConfigMapCheckpointStore(t *testing.T) {
+	store := configMapCheckpointStore{
+		client:    fake.NewSimpleClientset(),
+		namespace: "kube-system",
+		name:      "checkpoint",
+	}
+	ctx := context.Background()
+
+	data, err := store.load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, data)
+
+	// The ConfigMap is created on the first save, and updated after that
+	require.NoError(t, store.save(ctx, []byte("first")))
+	require.NoError(t, store.save(ctx, []byte("second")))
+	data, err = store.load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+}
+
+// checkpointTestPod adds a pod to the node with the given reservations, up to the max
+func checkpointTestPod(
+	state *pluginState,
+	node *nodeState,
+	name string,
+	cpu, maxCPU vmapi.MilliCPU,
+	mem, maxMem api.Bytes,
+) *podState {
+	pod := &podState{
+		name: util.NamespacedName{Namespace: "default", Name: name},
+		node: node,
+		cpu:  podResourceState[vmapi.MilliCPU]{Reserved: cpu, Buffer: 0, CapacityPressure: 0, Min: 0, Max: maxCPU},
+		mem:  podResourceState[api.Bytes]{Reserved: mem, Buffer: 0, CapacityPressure: 0, Min: 0, Max: maxMem},
+		gpus: nil,
+		vm:   nil,
+	}
+	node.pods[pod.name] = pod
+	node.cpu.Reserved += cpu
+	node.mem.Reserved += mem
+	state.pods[pod.name] = pod
+	return pod
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	now := time.Now()
+
+	p := &AutoscaleEnforcer{} //nolint:exhaustruct // only the state and metrics are used
+	p.makePrometheusRegistry()
+	p.state.lock = util.NewChanMutex()
+	p.state.conf = &Config{ //nolint:exhaustruct // only the checkpoint config is used
+		Checkpoint: &checkpointConfig{File: "", ConfigMap: nil, IntervalSeconds: 10, MaxAgeSeconds: 60},
+	}
+	p.state.pods = make(map[util.NamespacedName]*podState)
+
+	newNode := func(name string) *nodeState {
+		node := historyTestNode(name, 8000, 0, 32<<30, 0)
+		node.pods = make(map[util.NamespacedName]*podState)
+		return node
+	}
+	nodeA, nodeB := newNode("node-a"), newNode("node-b")
+	p.state.nodes = map[string]*nodeState{"node-a": nodeA, "node-b": nodeB}
+
+	grown := checkpointTestPod(&p.state, nodeA, "grown", 1000, 2000, 4<<30, 8<<30)
+	capped := checkpointTestPod(&p.state, nodeA, "capped", 1000, 2000, 4<<30, 8<<30)
+	shrunk := checkpointTestPod(&p.state, nodeA, "shrunk", 1000, 2000, 4<<30, 8<<30)
+	moved := checkpointTestPod(&p.state, nodeB, "moved", 1000, 2000, 4<<30, 8<<30)
+	checkpointTestPod(&p.state, nodeB, "new", 1000, 2000, 4<<30, 8<<30)
+
+	saved := func(pod *podState, node string, cpu vmapi.MilliCPU, mem api.Bytes) podCheckpoint {
+		return podCheckpoint{
+			Name: pod.name,
+			Node: node,
+			CPU:  podResourceState[vmapi.MilliCPU]{Reserved: cpu, Buffer: 0, CapacityPressure: 0, Min: 0, Max: 0},
+			Mem:  podResourceState[api.Bytes]{Reserved: mem, Buffer: 0, CapacityPressure: 0, Min: 0, Max: 0},
+		}
+	}
+	checkpoint := stateCheckpoint{
+		Time: now.Add(-30 * time.Second),
+		Pods: []podCheckpoint{
+			saved(grown, "node-a", 1500, 6<<30),
+			// Larger than the pod's max, so only raised to the max
+			saved(capped, "node-a", 3000, 4<<30),
+			// Smaller reservations in the checkpoint are never restored
+			saved(shrunk, "node-a", 500, 2<<30),
+			saved(moved, "node-a", 2000, 8<<30),
+			{Name: util.NamespacedName{Namespace: "default", Name: "gone"}, Node: "node-b", CPU: grown.cpu, Mem: grown.mem},
+		},
+	}
+	data, err := json.Marshal(checkpoint)
+	require.NoError(t, err)
+
+	store := fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")}
+	require.NoError(t, store.save(context.Background(), data))
+	require.NoError(t, p.restoreCheckpoint(context.Background(), zap.NewNop(), store))
+
+	assert.Equal(t, podResourceState[vmapi.MilliCPU]{Reserved: 1500, Buffer: 500, CapacityPressure: 0, Min: 0, Max: 2000}, grown.cpu)
+	assert.Equal(t, podResourceState[api.Bytes]{Reserved: 6 << 30, Buffer: 2 << 30, CapacityPressure: 0, Min: 0, Max: 8 << 30}, grown.mem)
+	assert.Equal(t, vmapi.MilliCPU(2000), capped.cpu.Reserved)
+	assert.Equal(t, api.Bytes(4<<30), capped.mem.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(1000), shrunk.cpu.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(1000), moved.cpu.Reserved)
+
+	// The increases are added to the nodes' totals
+	assert.Equal(t, vmapi.MilliCPU(4500), nodeA.cpu.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(1500), nodeA.cpu.Buffer)
+	assert.Equal(t, api.Bytes(14<<30), nodeA.mem.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(2000), nodeB.cpu.Reserved)
+
+	drift := func(kind string) float64 {
+		return testutil.ToFloat64(p.metrics.checkpointDrift.WithLabelValues(kind))
+	}
+	assert.Equal(t, 2.0, drift(checkpointDriftReservedRaised))
+	assert.Equal(t, 1.0, drift(checkpointDriftNodeChanged))
+	assert.Equal(t, 1.0, drift(checkpointDriftPodGone))
+	assert.Equal(t, 1.0, drift(checkpointDriftPodNew))
+
+	// Checkpoints that are too old aren't restored at all
+	checkpoint.Time = now.Add(-2 * time.Minute)
+	checkpoint.Pods = []podCheckpoint{saved(shrunk, "node-a", 2000, 8<<30)}
+	data, err = json.Marshal(checkpoint)
+	require.NoError(t, err)
+	require.NoError(t, store.save(context.Background(), data))
+	require.NoError(t, p.restoreCheckpoint(context.Background(), zap.NewNop(), store))
+	assert.Equal(t, vmapi.MilliCPU(1000), shrunk.cpu.Reserved)
+	assert.Equal(t, 2.0, drift(checkpointDriftReservedRaised))
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	p := &AutoscaleEnforcer{} //nolint:exhaustruct // only the state is used
+	p.state.lock = util.NewChanMutex()
+	p.state.pods = make(map[util.NamespacedName]*podState)
+	node := historyTestNode("node-a", 8000, 0, 32<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+	pod := checkpointTestPod(&p.state, node, "pod", 1000, 2000, 4<<30, 8<<30)
+
+	store := fileCheckpointStore{path: filepath.Join(t.TempDir(), "checkpoint.json")}
+	require.NoError(t, p.saveCheckpoint(context.Background(), store))
+
+	data, err := store.load(context.Background())
+	require.NoError(t, err)
+	var checkpoint stateCheckpoint
+	require.NoError(t, json.Unmarshal(data, &checkpoint))
+	assert.WithinDuration(t, time.Now(), checkpoint.Time, time.Minute)
+	assert.Equal(t, []podCheckpoint{{Name: pod.name, Node: "node-a", CPU: pod.cpu, Mem: pod.mem}}, checkpoint.Pods)
+}
@@ -8,10 +8,13 @@ import (
 
 	"golang.org/x/exp/slices"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 //////////////////
@@ -44,6 +47,17 @@ type Config struct {
 	// re-enable it.
 	DoMigration *bool `json:"doMigration"`
 
+	// AllowIncreaseDuringMigration, if true, allows permitting increases for VMs that are currently
+	// migrating, if the autoscaler-agent's protocol version supports it. The increase is reserved on
+	// both the source and target nodes, so it's only permitted if both have room for it.
+	AllowIncreaseDuringMigration bool `json:"allowIncreaseDuringMigration"`
+
+	// MinPriorityAboveWatermark, if provided, reserves the resources above each node's watermark
+	// for VMs with at least this priority, as sent by the autoscaler-agent. Increases for other VMs
+	// are only permitted up to the watermark, so that when a node is close to full, its remaining
+	// resources go to the most important VMs.
+	MinPriorityAboveWatermark *int32 `json:"minPriorityAboveWatermark,omitempty"`
+
 	// K8sNodeGroupLabel, if provided, gives the label to use when recording k8s node groups in the
 	// metrics (like for autoscaling_plugin_node_{cpu,mem}_resources_current)
 	K8sNodeGroupLabel string `json:"k8sNodeGroupLabel"`
@@ -63,9 +77,54 @@ type Config struct {
 	// evicted, which will allow cluster-autoscaler to trigger scale-up.
 	IgnoreNamespaces []string `json:"ignoreNamespaces"`
 
+	// NamespacePlacementStrategies, if provided, overrides nodeConfig.PlacementStrategy for pods in
+	// each namespace
+	NamespacePlacementStrategies map[string]placementStrategy `json:"namespacePlacementStrategies,omitempty"`
+
+	// GPUResourceNames, if provided, gives the extended resources that GPUs are provided to pods as,
+	// e.g. "nvidia.com/gpu". The number of each on every node is tracked alongside CPU and memory,
+	// and VMs with any of them are never migrated, because GPUs passed through to them can't be.
+	GPUResourceNames []string `json:"gpuResourceNames,omitempty"`
+
 	// DumpState, if provided, enables a server to dump internal state
 	DumpState *dumpStateConfig `json:"dumpState"`
 
+	// CommitmentHistory, if provided, enables recording a rolling history of each node's committed
+	// resources, served over HTTP and optionally uploaded to S3
+	CommitmentHistory *commitmentHistoryConfig `json:"commitmentHistory,omitempty"`
+
+	// Checkpoint, if provided, enables periodically saving the plugin's reservations, so that they
+	// can be recovered after a restart
+	Checkpoint *checkpointConfig `json:"checkpoint,omitempty"`
+
+	// SustainedPressure, if provided, enables migrating VMs away from nodes whose demand has been
+	// too high for too long. It has no effect if migration is disabled.
+	SustainedPressure *sustainedPressureConfig `json:"sustainedPressure,omitempty"`
+
+	// NodeDrain, if provided, enables migrating VMs away from nodes that are cordoned or have one
+	// of the configured taints. It has no effect if migration is disabled.
+	NodeDrain *nodeDrainConfig `json:"nodeDrain,omitempty"`
+
+	// TenantBudgets, if provided, enables limiting the total compute units of all of the VMs
+	// belonging to each tenant, across the whole cluster
+	TenantBudgets *tenantBudgetConfig `json:"tenantBudgets,omitempty"`
+
+	// PermitAudit, if provided, enables keeping a bounded history of the recent permits and denials
+	// for each node and VM, served alongside the autoscaler-agent request handler
+	PermitAudit *permitAuditConfig `json:"permitAudit,omitempty"`
+
+	// GRPC, if provided, enables serving autoscaler-agent requests over gRPC, in addition to HTTP
+	GRPC *grpcConfig `json:"grpc,omitempty"`
+
+	// Admission, if provided, enables serving admission webhooks that apply namespace defaults to
+	// new VirtualMachines, and reject VirtualMachines with scaling bounds that don't meet the
+	// cluster's policy
+	Admission *admissionConfig `json:"admission,omitempty"`
+
+	// Tracing, if provided, enables exporting OpenTelemetry traces of autoscaler-agent requests,
+	// continuing the traces started by the agent
+	Tracing *tracing.Config `json:"tracing,omitempty"`
+
 	// JSONString is the JSON string that was used to generate this config struct
 	JSONString string `json:"-"`
 }
@@ -94,7 +153,31 @@ type nodeConfig struct {
 	// sloping down on either side towards MinUsageScore at 0 and MaxUsageScore at 1.
 	//
 	// This corresponds to xₚ in the desmos link.
+	//
+	// ScorePeak is only used with the "balanced" placement strategy.
 	ScorePeak float64 `json:"scorePeak"`
+
+	// PlacementStrategy selects how nodes are scored by the resources already reserved on them:
+	// "balanced" (the default) uses the curve described above; "binpack" prefers fuller nodes, so
+	// that empty nodes can be scaled down; and "spread" prefers emptier nodes, to minimize
+	// contention between VMs. MinUsageScore and MaxUsageScore still give the score of an empty or
+	// full node, relative to the best one.
+	//
+	// The strategy can be overridden for individual namespaces with
+	// Config.NamespacePlacementStrategies.
+	PlacementStrategy placementStrategy `json:"placementStrategy,omitempty"`
+
+	// UtilizationWeight gives how much each node's observed CPU usage contributes to its score,
+	// from 0 to 1, with the score based on reserved resources (above) making up the rest. Nodes
+	// with less usage get higher scores, so that VMs land on nodes that are genuinely underloaded,
+	// not just those with the most unreserved resources.
+	//
+	// Observed usage is the node's CPU usage from the resource metrics API, so it includes
+	// everything running on the node, and requires metrics-server (or equivalent) in the cluster.
+	// Nodes without recent metrics are scored only by their reserved resources.
+	//
+	// Defaults to zero, which scores nodes only by their reserved resources.
+	UtilizationWeight float64 `json:"utilizationWeight,omitempty"`
 }
 
 // resourceConfig configures the amount of a particular resource we're willing to allocate to VMs,
@@ -108,6 +191,16 @@ type resourceConfig struct {
 	// The word "watermark" was originally used by @zoete as a temporary stand-in term during a
 	// meeting, and so it has intentionally been made permanent to spite the concept of "temporary" 😛
 	Watermark float32 `json:"watermark,omitempty"`
+
+	// UpscaleHeadroomFraction and UpscaleHeadroom reserve part of each node's resources for
+	// increases to the VMs already on it, so that they can still be upscaled when the node is
+	// otherwise full of newly scheduled pods. New pods are only placed on a node if they fit
+	// without using its headroom.
+	//
+	// The headroom is the larger of the fraction of the node's total and the absolute amount. Both
+	// default to zero.
+	UpscaleHeadroomFraction float32            `json:"upscaleHeadroomFraction,omitempty"`
+	UpscaleHeadroom         *resource.Quantity `json:"upscaleHeadroom,omitempty"`
 }
 
 func (c *Config) migrationEnabled() bool {
@@ -132,12 +225,90 @@ func (c *Config) validate() (string, error) {
 		return "eventQueueWorkers", errors.New("value must be > 0")
 	}
 
+	for namespace, strategy := range c.NamespacePlacementStrategies {
+		if err := strategy.validate(); err != nil {
+			return fmt.Sprintf("namespacePlacementStrategies[%q]", namespace), err
+		}
+	}
+
 	if c.DumpState != nil {
 		if path, err := c.DumpState.validate(); err != nil {
 			return fmt.Sprintf("dumpState.%s", path), err
 		}
 	}
 
+	if c.CommitmentHistory != nil {
+		if path, err := c.CommitmentHistory.validate(); err != nil {
+			return fmt.Sprintf("commitmentHistory.%s", path), err
+		}
+	}
+
+	if c.Checkpoint != nil {
+		if path, err := c.Checkpoint.validate(); err != nil {
+			if path == "" {
+				return "checkpoint", err
+			}
+			return fmt.Sprintf("checkpoint.%s", path), err
+		}
+	}
+
+	if c.SustainedPressure != nil {
+		if path, err := c.SustainedPressure.validate(); err != nil {
+			return fmt.Sprintf("sustainedPressure.%s", path), err
+		}
+	}
+
+	if c.NodeDrain != nil {
+		if path, err := c.NodeDrain.validate(); err != nil {
+			return fmt.Sprintf("nodeDrain.%s", path), err
+		}
+	}
+
+	if c.TenantBudgets != nil {
+		if path, err := c.TenantBudgets.validate(); err != nil {
+			return fmt.Sprintf("tenantBudgets.%s", path), err
+		}
+	}
+
+	if c.PermitAudit != nil {
+		if path, err := c.PermitAudit.validate(); err != nil {
+			return fmt.Sprintf("permitAudit.%s", path), err
+		}
+	}
+
+	if c.GRPC != nil {
+		if path, err := c.GRPC.validate(); err != nil {
+			return fmt.Sprintf("grpc.%s", path), err
+		}
+	}
+
+	if c.Admission != nil {
+		if path, err := c.Admission.validate(); err != nil {
+			return fmt.Sprintf("admission.%s", path), err
+		}
+	}
+
+	if t := c.Tracing; t != nil {
+		if t.Endpoint == "" {
+			return "tracing.endpoint", errors.New("string cannot be empty")
+		}
+		if t.SampleFraction < 0 || t.SampleFraction > 1 {
+			return "tracing.sampleFraction", errors.New("value must be between 0 and 1, inclusive")
+		}
+		if t.ExportIntervalSeconds == 0 {
+			return "tracing.exportIntervalSeconds", errors.New("value must be > 0")
+		}
+		if t.MaxQueueSize == 0 {
+			return "tracing.maxQueueSize", errors.New("value must be > 0")
+		}
+	}
+
+	for _, name := range c.GPUResourceNames {
+		if name == "" {
+			return "gpuResourceNames", errors.New("names cannot be empty")
+		}
+	}
+
 	if c.MigrationDeletionRetrySeconds == 0 {
 		return "migrationDeletionRetrySeconds", errors.New("value must be > 0")
 	}
@@ -159,6 +330,10 @@ func (c *nodeConfig) validate() (string, error) {
 		return "maxUsageScore", errors.New("value must be between 0 and 1, inclusive")
 	} else if c.ScorePeak < 0 || c.ScorePeak > 1 {
 		return "scorePeak", errors.New("value must be between 0 and 1, inclusive")
+	} else if c.UtilizationWeight < 0 || c.UtilizationWeight > 1 {
+		return "utilizationWeight", errors.New("value must be between 0 and 1, inclusive")
+	} else if err := c.PlacementStrategy.validate(); err != nil {
+		return "placementStrategy", err
 	}
 
 	return "", nil
@@ -171,6 +346,12 @@ func (c *resourceConfig) validate() (string, error) {
 		return "watermark", errors.New("value must be <= 1")
 	}
 
+	if c.UpscaleHeadroomFraction < 0.0 || c.UpscaleHeadroomFraction >= 1.0 {
+		return "upscaleHeadroomFraction", errors.New("value must be between 0 (inclusive) and 1 (exclusive)")
+	} else if c.UpscaleHeadroom != nil && c.UpscaleHeadroom.Sign() < 0 {
+		return "upscaleHeadroom", errors.New("value must be >= 0")
+	}
+
 	return "", nil
 }
 
@@ -201,6 +382,16 @@ func ReadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
+// CheckConfig reads and validates the config at path, for the 'validate-config' subcommand
+//
+// Validation stops at the first invalid field, so at most one problem is returned.
+func CheckConfig(path string) []error {
+	if _, err := ReadConfig(path); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
 //////////////////////////////////////
 // HELPER METHODS FOR USING CONFIGS //
 //////////////////////////////////////
@@ -210,12 +401,27 @@ func (c *Config) ignoredNamespace(namespace string) bool {
 	return slices.Contains(c.IgnoreNamespaces, namespace)
 }
 
+// gpuResourceNames returns the names of the extended resources that GPUs are provided as
+func (c *Config) gpuResourceNames() []corev1.ResourceName {
+	names := make([]corev1.ResourceName, len(c.GPUResourceNames))
+	for i, name := range c.GPUResourceNames {
+		names[i] = corev1.ResourceName(name)
+	}
+	return names
+}
+
 func (c *nodeConfig) vCpuLimits(total *resource.Quantity) nodeResourceState[vmapi.MilliCPU] {
 	totalMilli := total.MilliValue()
 
+	headroom := int64(c.Cpu.UpscaleHeadroomFraction * float32(totalMilli))
+	if c.Cpu.UpscaleHeadroom != nil {
+		headroom = util.Max(headroom, c.Cpu.UpscaleHeadroom.MilliValue())
+	}
+
 	return nodeResourceState[vmapi.MilliCPU]{
 		Total:                vmapi.MilliCPU(totalMilli),
 		Watermark:            vmapi.MilliCPU(c.Cpu.Watermark * float32(totalMilli)),
+		UpscaleHeadroom:      vmapi.MilliCPU(util.Min(headroom, totalMilli)),
 		Reserved:             0,
 		Buffer:               0,
 		CapacityPressure:     0,
@@ -226,9 +432,15 @@ func (c *nodeConfig) vCpuLimits(total *resource.Quantity) nodeResourceState[vmap
 func (c *nodeConfig) memoryLimits(total *resource.Quantity) nodeResourceState[api.Bytes] {
 	totalBytes := total.Value()
 
+	headroom := int64(c.Memory.UpscaleHeadroomFraction * float32(totalBytes))
+	if c.Memory.UpscaleHeadroom != nil {
+		headroom = util.Max(headroom, c.Memory.UpscaleHeadroom.Value())
+	}
+
 	return nodeResourceState[api.Bytes]{
 		Total:                api.Bytes(totalBytes),
 		Watermark:            api.Bytes(c.Memory.Watermark * float32(totalBytes)),
+		UpscaleHeadroom:      api.Bytes(util.Min(headroom, totalBytes)),
 		Reserved:             0,
 		Buffer:               0,
 		CapacityPressure:     0,
@@ -0,0 +1,226 @@
+package plugin
+
+// Migrating VMs away from nodes that are being drained for maintenance.
+//
+// When a node is cordoned (or has one of the configured taints), the VMs on it will eventually need
+// to be moved off before it can be taken down. Rather than waiting for them to be evicted -- or for
+// an operator to migrate each one by hand -- this periodically checks for such nodes and starts
+// live migrations of their VMs, highest priority first, so that the most important VMs are moved
+// while there's still plenty of time to do so.
+//
+// The number of migrations in progress is limited both per node and across all draining nodes, so
+// that draining many nodes at once doesn't overwhelm the cluster.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type nodeDrainConfig struct {
+	// TaintKeys gives the keys of the taints that mark a node as being drained, in addition to
+	// the node being cordoned (i.e. marked unschedulable).
+	TaintKeys []string `json:"taintKeys"`
+	// CheckIntervalSeconds gives the time between checks for draining nodes
+	CheckIntervalSeconds uint `json:"checkIntervalSeconds"`
+	// MaxConcurrentPerNode gives the maximum number of VMs that will be migrating away from each
+	// draining node at any time
+	MaxConcurrentPerNode uint `json:"maxConcurrentPerNode"`
+	// MaxConcurrent gives the maximum number of VMs that will be migrating away from all draining
+	// nodes at any time
+	MaxConcurrent uint `json:"maxConcurrent"`
+}
+
+func (c *nodeDrainConfig) validate() (string, error) {
+	if c.CheckIntervalSeconds == 0 {
+		return "checkIntervalSeconds", errors.New("value must be > 0")
+	} else if c.MaxConcurrentPerNode == 0 {
+		return "maxConcurrentPerNode", errors.New("value must be > 0")
+	} else if c.MaxConcurrent == 0 {
+		return "maxConcurrent", errors.New("value must be > 0")
+	}
+
+	for i, key := range c.TaintKeys {
+		if key == "" {
+			return "taintKeys", errors.New("keys must not be empty")
+		} else if slices.Contains(c.TaintKeys[:i], key) {
+			return "taintKeys", errors.New("keys must be unique")
+		}
+	}
+
+	return "", nil
+}
+
+// Values of the "outcome" label on the node drain migrations metric
+const (
+	drainMigrationCreated = "created"
+	drainMigrationFailed  = "failed"
+)
+
+// Values of the "limit" label on the drain limited nodes metric
+const (
+	drainLimitNode   = "node"
+	drainLimitGlobal = "global"
+)
+
+// isDraining returns whether the node is cordoned, or has any of the configured taints
+func (c *nodeDrainConfig) isDraining(node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if slices.Contains(c.TaintKeys, taint.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// drainOrder returns the VM pods on the node in the order they should be migrated away when the
+// node is drained -- highest priority first -- along with the number of pods that are currently
+// migrating, and the number that can't be migrated at all.
+func (s *nodeState) drainOrder() (_ []*podState, migrating int, unmovable int) {
+	var pods []*podState
+	for _, pod := range s.pods {
+		if pod.vm == nil {
+			continue
+		} else if pod.vm.currentlyMigrating() {
+			migrating += 1
+		} else if !pod.vm.Config.AutoMigrationEnabled || pod.vm.HasGPUs {
+			unmovable += 1
+		} else {
+			pods = append(pods, pod)
+		}
+	}
+
+	slices.SortFunc(pods, func(a, b *podState) (less bool) {
+		if a.vm.Config.Priority != b.vm.Config.Priority {
+			return a.vm.Config.Priority > b.vm.Config.Priority
+		}
+		return a.vm.isBetterMigrationTarget(b.vm)
+	})
+
+	return pods, migrating, unmovable
+}
+
+func (e *AutoscaleEnforcer) startNodeDrainMigrations(ctx context.Context, logger *zap.Logger) {
+	conf := e.state.conf.NodeDrain
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(conf.CheckIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.checkNodeDrains(ctx, logger)
+			}
+		}
+	}()
+}
+
+// checkNodeDrains starts migrations of the VMs on every draining node, up to the configured limits
+func (e *AutoscaleEnforcer) checkNodeDrains(ctx context.Context, logger *zap.Logger) {
+	conf := e.state.conf.NodeDrain
+
+	var draining []string
+	for _, node := range e.nodeStore.Items() {
+		if conf.isDraining(node) {
+			draining = append(draining, node.Name)
+		}
+	}
+	// Drain nodes in a consistent order, so that each one is finished before moving on to the
+	// next, when the global limit is reached.
+	slices.Sort(draining)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	// Count the migrations in progress across all draining nodes first, so that the global limit
+	// applies regardless of the order they're checked in.
+	var inProgress, pending, unmovable int
+	queues := make(map[string][]*podState)
+	nodeInProgress := make(map[string]int)
+	for _, name := range draining {
+		node, ok := e.state.nodes[name]
+		if !ok {
+			continue
+		}
+		pods, migrating, cantMigrate := node.drainOrder()
+		queues[name] = pods
+		nodeInProgress[name] = migrating
+		inProgress += migrating
+		pending += len(pods)
+		unmovable += cantMigrate
+	}
+
+	e.metrics.drainingNodes.Set(float64(len(draining)))
+	e.metrics.drainPendingVMs.Set(float64(pending))
+	e.metrics.drainUnmovableVMs.Set(float64(unmovable))
+
+	// Count the nodes that still have VMs waiting because of each limit. These are gauges rather
+	// than counters so that they don't grow with every check while a node is waiting.
+	var nodeLimited, globalLimited int
+	defer func() {
+		e.metrics.drainLimitedNodes.WithLabelValues(drainLimitNode).Set(float64(nodeLimited))
+		e.metrics.drainLimitedNodes.WithLabelValues(drainLimitGlobal).Set(float64(globalLimited))
+	}()
+
+	for _, name := range draining {
+		queue := queues[name]
+		if len(queue) == 0 {
+			continue
+		}
+
+		logger := logger.With(zap.String("node", name))
+
+		for _, pod := range queue {
+			// Nodes and pods can be removed while the lock is released to start a migration.
+			node, ok := e.state.nodes[name]
+			if !ok {
+				break
+			} else if _, ok := node.pods[pod.name]; !ok || pod.vm.currentlyMigrating() {
+				continue
+			}
+
+			if uint(nodeInProgress[name]) >= conf.MaxConcurrentPerNode {
+				nodeLimited += 1
+				break
+			} else if uint(inProgress) >= conf.MaxConcurrent {
+				globalLimited += 1
+				if globalLimited == 1 {
+					logger.Info("Node is draining, but too many migrations are already in progress")
+				}
+				break
+			}
+
+			logger := logger.With(
+				zap.Object("pod", pod.name),
+				zap.Object("virtualmachine", pod.vm.Name),
+				zap.Int32("priority", pod.vm.Config.Priority),
+			)
+			logger.Info("Node is draining, migrating VM")
+
+			created, err := e.startMigration(ctx, logger, pod)
+			if err != nil {
+				e.metrics.drainMigrations.WithLabelValues(drainMigrationFailed).Inc()
+				logger.Error("Failed to start migration for draining node", zap.Error(err))
+				continue
+			}
+			if created {
+				e.metrics.drainMigrations.WithLabelValues(drainMigrationCreated).Inc()
+				// The migration won't show up in the pod's state until we see it from the watch,
+				// so count it here instead.
+				nodeInProgress[name] += 1
+				inProgress += 1
+			}
+		}
+	}
+}
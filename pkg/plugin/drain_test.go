@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestNodeDrainIsDraining(t *testing.T) {
+	conf := &nodeDrainConfig{
+		TaintKeys:            []string{"example.com/drain", "example.com/maintenance"},
+		CheckIntervalSeconds: 10,
+		MaxConcurrentPerNode: 1,
+		MaxConcurrent:        1,
+	}
+
+	cases := []struct {
+		name          string
+		unschedulable bool
+		taints        []corev1.Taint
+		expected      bool
+	}{
+		{
+			name:          "schedulable",
+			unschedulable: false,
+			taints:        nil,
+			expected:      false,
+		},
+		{
+			name:          "cordoned",
+			unschedulable: true,
+			taints:        nil,
+			expected:      true,
+		},
+		{
+			name:          "configured taint",
+			unschedulable: false,
+			taints: []corev1.Taint{
+				{Key: "example.com/other", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule},
+			},
+			expected: true,
+		},
+		{
+			name:          "other taints",
+			unschedulable: false,
+			taints: []corev1.Taint{
+				{Key: "example.com/other", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "example.com", Effect: corev1.TaintEffectNoExecute},
+			},
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := &corev1.Node{
+				Spec: corev1.NodeSpec{
+					Unschedulable: c.unschedulable,
+					Taints:        c.taints,
+				},
+			}
+			assert.Equal(t, c.expected, conf.isDraining(node))
+		})
+	}
+
+	// With no taint keys configured, only cordoned nodes are draining
+	noTaints := &nodeDrainConfig{
+		TaintKeys:            nil,
+		CheckIntervalSeconds: 10,
+		MaxConcurrentPerNode: 1,
+		MaxConcurrent:        1,
+	}
+	tainted := &corev1.Node{
+		Spec: corev1.NodeSpec{
+			Taints: []corev1.Taint{{Key: "example.com/drain", Effect: corev1.TaintEffectNoSchedule}},
+		},
+	}
+	assert.False(t, noTaints.isDraining(tainted))
+}
+
+// drainTestPod returns a VM pod with just the fields used by nodeState.drainOrder
+func drainTestPod(name string, priority int32, load float32, migratable bool) *podState {
+	vm := new(vmPodState)
+	vm.Name = util.NamespacedName{Namespace: "default", Name: name}
+	vm.Config.Priority = priority
+	vm.Config.AutoMigrationEnabled = migratable
+	if load >= 0 {
+		vm.Metrics = &api.Metrics{LoadAverage1Min: load, LoadAverage5Min: nil, MemoryUsageBytes: nil}
+	}
+
+	pod := new(podState)
+	pod.name = util.NamespacedName{Namespace: "default", Name: name + "-pod"}
+	pod.vm = vm
+	return pod
+}
+
+func TestNodeDrainOrder(t *testing.T) {
+	node := new(nodeState)
+	node.pods = make(map[util.NamespacedName]*podState)
+	add := func(pod *podState) *podState {
+		node.pods[pod.name] = pod
+		return pod
+	}
+
+	low := add(drainTestPod("low", 0, 0.1, true))
+	highBusy := add(drainTestPod("high-busy", 5, 2.0, true))
+	highIdle := add(drainTestPod("high-idle", 5, 0.5, true))
+	highNoMetrics := add(drainTestPod("high-no-metrics", 5, -1, true))
+	mid := add(drainTestPod("mid", 2, 3.0, true))
+
+	// Pods that are already migrating, or can't be migrated, are counted but not returned
+	add(drainTestPod("disabled", 10, 0.1, false))
+	withGPUs := add(drainTestPod("gpus", 10, 0.1, true))
+	withGPUs.vm.HasGPUs = true
+	migrating := add(drainTestPod("migrating", 10, 0.1, true))
+	migrating.vm.MigrationState = &podMigrationState{
+		Name: util.NamespacedName{Namespace: "default", Name: "schedplugin-migrating"},
+	}
+
+	// Non-VM pods are ignored entirely
+	nonVM := new(podState)
+	nonVM.name = util.NamespacedName{Namespace: "default", Name: "non-vm"}
+	add(nonVM)
+
+	pods, migratingCount, unmovable := node.drainOrder()
+	assert.Equal(t, []*podState{highIdle, highBusy, highNoMetrics, mid, low}, pods)
+	assert.Equal(t, 1, migratingCount)
+	assert.Equal(t, 2, unmovable)
+
+	// An empty node has nothing to do
+	empty := new(nodeState)
+	pods, migratingCount, unmovable = empty.drainOrder()
+	assert.Empty(t, pods)
+	assert.Equal(t, 0, migratingCount)
+	assert.Equal(t, 0, unmovable)
+}
@@ -11,6 +11,8 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 
+	corev1 "k8s.io/api/core/v1"
+
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
@@ -122,8 +124,10 @@ type nodeStateDump struct {
 	Name             string                                     `json:"name"`
 	NodeGroup        string                                     `json:"nodeGroup"`
 	AvailabilityZone string                                     `json:"availabilityZone"`
+	Architecture     string                                     `json:"architecture"`
 	CPU              nodeResourceState[vmapi.MilliCPU]          `json:"cpu"`
 	Mem              nodeResourceState[api.Bytes]               `json:"mem"`
+	GPUs             map[corev1.ResourceName]nodeGPUState       `json:"gpus,omitempty"`
 	Pods             []keyed[util.NamespacedName, podStateDump] `json:"pods"`
 	Mq               []*podNameAndPointer                       `json:"mq"`
 }
@@ -134,6 +138,7 @@ type podStateDump struct {
 	Node pointerString                    `json:"node"`
 	CPU  podResourceState[vmapi.MilliCPU] `json:"cpu"`
 	Mem  podResourceState[api.Bytes]      `json:"mem"`
+	GPUs map[corev1.ResourceName]int64    `json:"gpus,omitempty"`
 	VM   *vmPodState                      `json:"vm"`
 }
 
@@ -202,13 +207,20 @@ func (s *nodeState) dump() nodeStateDump {
 		}
 	}
 
+	gpus := make(map[corev1.ResourceName]nodeGPUState, len(s.gpus))
+	for name, state := range s.gpus {
+		gpus[name] = *state
+	}
+
 	return nodeStateDump{
 		Obj:              makePointerString(s),
 		Name:             s.name,
 		NodeGroup:        s.nodeGroup,
 		AvailabilityZone: s.availabilityZone,
+		Architecture:     s.architecture,
 		CPU:              s.cpu,
 		Mem:              s.mem,
+		GPUs:             gpus,
 		Pods:             pods,
 		Mq:               mq,
 	}
@@ -221,12 +233,21 @@ func (s *podState) dump() podStateDump {
 		vm = &[]vmPodState{s.vm.dump()}[0]
 	}
 
+	var gpus map[corev1.ResourceName]int64
+	if s.gpus != nil {
+		gpus = make(map[corev1.ResourceName]int64, len(s.gpus))
+		for name, count := range s.gpus {
+			gpus[name] = count
+		}
+	}
+
 	return podStateDump{
 		Obj:  makePointerString(s),
 		Name: s.name,
 		Node: makePointerString(s.node),
 		CPU:  s.cpu,
 		Mem:  s.mem,
+		GPUs: gpus,
 		VM:   vm,
 	}
 }
@@ -248,6 +269,9 @@ func (s *vmPodState) dump() vmPodState {
 	return vmPodState{
 		Name:           s.Name,
 		MemSlotSize:    s.MemSlotSize,
+		PinnedCPU:      s.PinnedCPU,
+		HasGPUs:        s.HasGPUs,
+		Tenant:         s.Tenant,
 		Config:         s.Config,
 		Metrics:        metrics,
 		MqIndex:        s.MqIndex,
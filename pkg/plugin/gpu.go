@@ -0,0 +1,125 @@
+package plugin
+
+// Accounting for GPUs passed through to VMs, which are provided to pods as extended resources by a
+// device plugin. GPUs can't be scaled, so unlike CPU and memory, we only need to track how many of
+// them each node has and how many are reserved.
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nodeGPUState describes the state of one kind of GPU on a node
+type nodeGPUState struct {
+	// Total is the number of the GPUs allocatable on the node. This value does not change.
+	Total int64 `json:"total"`
+	// Reserved is the number of the GPUs reserved to pods. It's always exactly equal to the sum of
+	// the node's pods' GPUs of this kind.
+	Reserved int64 `json:"reserved"`
+}
+
+// buildNodeGPUState returns the state of each of the configured GPU resources that the node has
+func buildNodeGPUState(node *corev1.Node, conf *Config) map[corev1.ResourceName]*nodeGPUState {
+	gpus := make(map[corev1.ResourceName]*nodeGPUState)
+	for _, name := range conf.gpuResourceNames() {
+		q, ok := node.Status.Allocatable[name]
+		if !ok {
+			q, ok = node.Status.Capacity[name]
+		}
+		if ok && !q.IsZero() {
+			gpus[name] = &nodeGPUState{Total: q.Value(), Reserved: 0}
+		}
+	}
+	return gpus
+}
+
+// extractPodGPUs returns the number of each of the configured GPU resources that the pod's
+// containers request, or nil if it doesn't have any
+func extractPodGPUs(pod *corev1.Pod, conf *Config) map[corev1.ResourceName]int64 {
+	var gpus map[corev1.ResourceName]int64
+	for _, container := range pod.Spec.Containers {
+		for _, name := range conf.gpuResourceNames() {
+			// Requests for extended resources default to the limits, but that's only set by the
+			// API server, so we may see pods without it.
+			q, ok := container.Resources.Requests[name]
+			if !ok {
+				q, ok = container.Resources.Limits[name]
+			}
+			if !ok || q.IsZero() {
+				continue
+			}
+			if gpus == nil {
+				gpus = make(map[corev1.ResourceName]int64)
+			}
+			gpus[name] += q.Value()
+		}
+	}
+	return gpus
+}
+
+// gpuShortage returns a description of the GPUs that the node doesn't have enough of to add the
+// pod's, given the ones currently in use, or the empty string if it has enough.
+func (s *nodeState) gpuShortage(used, add map[corev1.ResourceName]int64) string {
+	var short []string
+	for name, count := range add {
+		var total int64
+		if state, ok := s.gpus[name]; ok {
+			total = state.Total
+		}
+		if used[name]+count > total {
+			short = append(short, fmt.Sprintf("%s: need %d, %d of %d used", name, count, used[name], total))
+		}
+	}
+	slices.Sort(short)
+	return strings.Join(short, "; ")
+}
+
+// reservedGPUs returns the number of each kind of GPU reserved on the node
+func (s *nodeState) reservedGPUs() map[corev1.ResourceName]int64 {
+	reserved := make(map[corev1.ResourceName]int64)
+	for name, state := range s.gpus {
+		reserved[name] = state.Reserved
+	}
+	return reserved
+}
+
+// reserveGPUs adds the pod's GPUs to the node's reserved GPUs
+func (s *nodeState) reserveGPUs(gpus map[corev1.ResourceName]int64) {
+	for name, count := range gpus {
+		state, ok := s.gpus[name]
+		if !ok {
+			// The pod was placed on the node even though it doesn't have these GPUs. Track them
+			// anyways, so that unreserving them later is consistent.
+			state = &nodeGPUState{Total: 0, Reserved: 0}
+			s.gpus[name] = state
+		}
+		state.Reserved += count
+	}
+}
+
+// unreserveGPUs removes the pod's GPUs from the node's reserved GPUs
+func (s *nodeState) unreserveGPUs(gpus map[corev1.ResourceName]int64) {
+	for name, count := range gpus {
+		if state, ok := s.gpus[name]; ok {
+			state.Reserved -= count
+		}
+	}
+}
+
+func (s *nodeState) updateGPUMetrics(metrics PromMetrics) {
+	for name, state := range s.gpus {
+		metrics.nodeGPUResources.WithLabelValues(s.name, s.nodeGroup, s.availabilityZone, string(name), "Total").Set(float64(state.Total))
+		metrics.nodeGPUResources.WithLabelValues(s.name, s.nodeGroup, s.availabilityZone, string(name), "Reserved").Set(float64(state.Reserved))
+	}
+}
+
+func (s *nodeState) removeGPUMetrics(metrics PromMetrics) {
+	for name := range s.gpus {
+		metrics.nodeGPUResources.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone, string(name), "Total")
+		metrics.nodeGPUResources.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone, string(name), "Reserved")
+	}
+}
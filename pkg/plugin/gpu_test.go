@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const testGPU corev1.ResourceName = "nvidia.com/gpu"
+
+func TestBuildNodeGPUState(t *testing.T) {
+	conf := &Config{GPUResourceNames: []string{string(testGPU), "amd.com/gpu"}} //nolint:exhaustruct // only the GPUs matter
+
+	node := new(corev1.Node)
+	node.Status.Capacity = corev1.ResourceList{
+		testGPU:       resource.MustParse("4"),
+		"amd.com/gpu": resource.MustParse("2"),
+		"example/gpu": resource.MustParse("8"),
+	}
+	// Allocatable is preferred over capacity, and GPUs that aren't allocatable aren't tracked
+	node.Status.Allocatable = corev1.ResourceList{
+		testGPU:       resource.MustParse("3"),
+		"amd.com/gpu": resource.MustParse("0"),
+	}
+
+	assert.Equal(t, map[corev1.ResourceName]*nodeGPUState{
+		testGPU: {Total: 3, Reserved: 0},
+	}, buildNodeGPUState(node, conf))
+
+	// Without allocatable, the capacity is used
+	node.Status.Allocatable = nil
+	assert.Equal(t, map[corev1.ResourceName]*nodeGPUState{
+		testGPU:       {Total: 4, Reserved: 0},
+		"amd.com/gpu": {Total: 2, Reserved: 0},
+	}, buildNodeGPUState(node, conf))
+}
+
+func TestExtractPodGPUs(t *testing.T) {
+	conf := &Config{GPUResourceNames: []string{string(testGPU)}} //nolint:exhaustruct // only the GPUs matter
+
+	container := func(requests, limits corev1.ResourceList) corev1.Container {
+		return corev1.Container{ //nolint:exhaustruct // only the resources matter
+			Resources: corev1.ResourceRequirements{Requests: requests, Limits: limits},
+		}
+	}
+	pod := func(containers ...corev1.Container) *corev1.Pod {
+		p := new(corev1.Pod)
+		p.Spec.Containers = containers
+		return p
+	}
+
+	assert.Nil(t, extractPodGPUs(pod(container(corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}, nil)), conf))
+	// Requests default to the limits, even if the API server hasn't set them yet
+	assert.Equal(t, map[corev1.ResourceName]int64{testGPU: 3}, extractPodGPUs(pod(
+		container(corev1.ResourceList{testGPU: resource.MustParse("1")}, corev1.ResourceList{testGPU: resource.MustParse("1")}),
+		container(nil, corev1.ResourceList{testGPU: resource.MustParse("2")}),
+		// GPUs that aren't configured aren't counted
+		container(nil, corev1.ResourceList{"amd.com/gpu": resource.MustParse("2")}),
+	), conf))
+}
+
+func TestReserveGPUs(t *testing.T) {
+	node := &nodeState{ //nolint:exhaustruct // only the GPUs matter
+		gpus: map[corev1.ResourceName]*nodeGPUState{testGPU: {Total: 4, Reserved: 0}},
+	}
+
+	assert.Equal(t, "", node.gpuShortage(node.reservedGPUs(), map[corev1.ResourceName]int64{testGPU: 4}))
+	node.reserveGPUs(map[corev1.ResourceName]int64{testGPU: 3})
+	assert.Equal(t, map[corev1.ResourceName]int64{testGPU: 3}, node.reservedGPUs())
+
+	// Not enough GPUs of either kind are left
+	assert.Equal(t,
+		"amd.com/gpu: need 1, 0 of 0 used; nvidia.com/gpu: need 2, 3 of 4 used",
+		node.gpuShortage(node.reservedGPUs(), map[corev1.ResourceName]int64{testGPU: 2, "amd.com/gpu": 1}),
+	)
+
+	// GPUs that the node doesn't have are still tracked, so that they're unreserved consistently
+	node.reserveGPUs(map[corev1.ResourceName]int64{"amd.com/gpu": 1})
+	assert.Equal(t, map[corev1.ResourceName]int64{testGPU: 3, "amd.com/gpu": 1}, node.reservedGPUs())
+
+	node.unreserveGPUs(map[corev1.ResourceName]int64{testGPU: 3, "amd.com/gpu": 1})
+	assert.Equal(t, map[corev1.ResourceName]int64{testGPU: 0, "amd.com/gpu": 0}, node.reservedGPUs())
+	assert.Equal(t, "", node.gpuShortage(node.reservedGPUs(), map[corev1.ResourceName]int64{testGPU: 4}))
+}
@@ -0,0 +1,130 @@
+package plugin
+
+// gRPC server for autoscaler-agent requests, served alongside the HTTP server when enabled. See
+// pkg/api/grpc.go and pkg/api/plugin.proto for more.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+type grpcConfig struct {
+	// Port is the port to serve gRPC requests on
+	Port uint16 `json:"port"`
+	// KeepaliveSeconds gives the interval at which the server pings idle connections, and the
+	// minimum interval at which clients may ping the server
+	KeepaliveSeconds uint `json:"keepaliveSeconds"`
+}
+
+func (c *grpcConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	} else if c.KeepaliveSeconds == 0 {
+		return "keepaliveSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// startGRPCServer runs the gRPC server for autoscaler-agent requests, until the context is canceled
+func (e *AutoscaleEnforcer) startGRPCServer(ctx context.Context, logger *zap.Logger) error {
+	conf := e.state.conf.GRPC
+
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(conf.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v: %w", addr, err)
+	}
+
+	keepaliveInterval := time.Duration(conf.KeepaliveSeconds) * time.Second
+	server := grpc.NewServer(
+		grpc.KeepaliveParams(keepalive.ServerParameters{ //nolint:exhaustruct // other fields are optional
+			Time: keepaliveInterval,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             keepaliveInterval,
+			PermitWithoutStream: true,
+		}),
+	)
+	api.RegisterPluginServer(server, pluginGRPCService{e: e, logger: logger})
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+type pluginGRPCService struct {
+	e      *AutoscaleEnforcer
+	logger *zap.Logger
+}
+
+func (s pluginGRPCService) Negotiate(_ context.Context, agentSupported api.VersionRange[api.PluginProtoVersion]) (api.PluginProtoVersion, error) {
+	supported := api.VersionRange[api.PluginProtoVersion]{
+		Min: MinPluginProtocolVersion,
+		Max: MaxPluginProtocolVersion,
+	}
+
+	version, ok := supported.LatestSharedVersion(agentSupported)
+	if !ok {
+		return 0, status.Errorf(
+			codes.FailedPrecondition,
+			"Protocol version mismatch: Need %v but got %v", supported, agentSupported,
+		)
+	}
+	return version, nil
+}
+
+func (s pluginGRPCService) Request(_ context.Context, req *api.AgentRequest) (*api.PluginResponse, error) {
+	logger := s.logger.With(zap.Object("pod", req.Pod))
+	logger.Info("Received autoscaler-agent gRPC request", zap.Any("request", req))
+
+	// Status codes are the same as for HTTP, so that they're counted together in the metrics.
+	resp, statusCode, err := s.e.handleAgentRequest(logger, *req)
+	s.e.metrics.resourceRequests.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+
+	if err != nil {
+		logFunc := logger.Warn
+		if 500 <= statusCode && statusCode < 600 {
+			logFunc = logger.Error
+		}
+		logFunc("Responding to autoscaler-agent gRPC request with error", zap.Int("status", statusCode), zap.Error(err))
+		return nil, status.Error(grpcCodeForStatus(statusCode), err.Error())
+	}
+
+	logger.Info("Responding to autoscaler-agent gRPC request", zap.Any("response", resp))
+	return resp, nil
+}
+
+// grpcCodeForStatus returns the gRPC code corresponding to the HTTP status code returned by
+// handleAgentRequest
+func grpcCodeForStatus(statusCode int) codes.Code {
+	switch {
+	case statusCode == 404:
+		return codes.NotFound
+	case 400 <= statusCode && statusCode < 500:
+		return codes.InvalidArgument
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,369 @@
+package plugin
+
+// Rolling per-node history of committed resources, so that capacity incidents can be analyzed
+// without depending on the retention of an external Prometheus.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type commitmentHistoryConfig struct {
+	// Port is the port to serve the history on
+	Port uint16 `json:"port"`
+	// IntervalSeconds gives the time between samples -- i.e., the resolution of the history
+	IntervalSeconds uint `json:"intervalSeconds"`
+	// WindowSeconds gives how long each sample is kept for
+	WindowSeconds uint `json:"windowSeconds"`
+	// ComputeUnit gives the resources in one compute unit, for recording each node's commitment in
+	// compute units. It should match the autoscaler-agent's.
+	ComputeUnit api.Resources `json:"computeUnit"`
+
+	// S3, if provided, enables periodically uploading new samples to S3
+	S3 *commitmentHistoryS3Config `json:"s3,omitempty"`
+}
+
+type commitmentHistoryS3Config struct {
+	Bucket string `json:"bucket"`
+	// Prefix, if not empty, is prepended to the key of all uploaded objects
+	Prefix string `json:"prefix"`
+	// Region, if not empty, overrides the AWS region from the environment
+	Region string `json:"region"`
+	// Endpoint, if not empty, sets a custom S3 endpoint, e.g. for S3-compatible storage
+	Endpoint string `json:"endpoint"`
+
+	UploadEverySeconds uint `json:"uploadEverySeconds"`
+}
+
+func (c *commitmentHistoryConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	} else if c.IntervalSeconds == 0 {
+		return "intervalSeconds", errors.New("value must be > 0")
+	} else if c.WindowSeconds < c.IntervalSeconds {
+		return "windowSeconds", errors.New("value must be >= intervalSeconds")
+	} else if c.ComputeUnit.VCPU == 0 {
+		return "computeUnit.vCPUs", errors.New("value must be > 0")
+	} else if c.ComputeUnit.Mem == 0 {
+		return "computeUnit.mem", errors.New("value must be > 0")
+	}
+
+	if c.S3 != nil {
+		if c.S3.Bucket == "" {
+			return "s3.bucket", errors.New("string cannot be empty")
+		} else if c.S3.UploadEverySeconds == 0 {
+			return "s3.uploadEverySeconds", errors.New("value must be > 0")
+		}
+	}
+
+	return "", nil
+}
+
+// commitmentHistory stores the recent samples for every node we've seen within the window
+type commitmentHistory struct {
+	mu sync.Mutex
+
+	window      time.Duration
+	computeUnit api.Resources
+	nodes       map[string]*nodeCommitmentHistory
+}
+
+type nodeCommitmentHistory struct {
+	Node             string             `json:"node"`
+	NodeGroup        string             `json:"nodeGroup"`
+	AvailabilityZone string             `json:"availabilityZone"`
+	Samples          []commitmentSample `json:"samples"`
+}
+
+type commitmentSample struct {
+	Time time.Time                          `json:"time"`
+	CPU  resourceCommitment[vmapi.MilliCPU] `json:"cpu"`
+	Mem  resourceCommitment[api.Bytes]      `json:"mem"`
+	// ComputeUnits is the commitment in compute units, with each field the larger of CPU and memory
+	ComputeUnits resourceCommitment[float64] `json:"computeUnits"`
+}
+
+type resourceCommitment[T any] struct {
+	Total    T `json:"total"`
+	Reserved T `json:"reserved"`
+	Buffer   T `json:"buffer"`
+}
+
+func newResourceCommitment[T any](s nodeResourceState[T]) resourceCommitment[T] {
+	return resourceCommitment[T]{
+		Total:    s.Total,
+		Reserved: s.Reserved,
+		Buffer:   s.Buffer,
+	}
+}
+
+// newCommitmentSample returns the sample of the node's commitment at the time
+func newCommitmentSample(node *nodeState, now time.Time, computeUnit api.Resources) commitmentSample {
+	cpu := newResourceCommitment(node.cpu)
+	mem := newResourceCommitment(node.mem)
+	toCU := func(cpu vmapi.MilliCPU, mem api.Bytes) float64 {
+		return api.Resources{VCPU: cpu, Mem: mem}.ComputeUnits(computeUnit)
+	}
+
+	return commitmentSample{
+		Time: now,
+		CPU:  cpu,
+		Mem:  mem,
+		ComputeUnits: resourceCommitment[float64]{
+			Total:    toCU(cpu.Total, mem.Total),
+			Reserved: toCU(cpu.Reserved, mem.Reserved),
+			Buffer:   toCU(cpu.Buffer, mem.Buffer),
+		},
+	}
+}
+
+func (p *AutoscaleEnforcer) startCommitmentHistory(ctx context.Context, logger *zap.Logger) error {
+	conf := p.state.conf.CommitmentHistory
+
+	history := &commitmentHistory{
+		mu:          sync.Mutex{},
+		window:      time.Duration(conf.WindowSeconds) * time.Second,
+		computeUnit: conf.ComputeUnit,
+		nodes:       make(map[string]*nodeCommitmentHistory),
+	}
+
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(conf.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	var uploader *commitmentHistoryUploader
+	if conf.S3 != nil {
+		uploader, err = newCommitmentHistoryUploader(ctx, conf.S3)
+		if err != nil {
+			return fmt.Errorf("Error creating S3 uploader: %w", err)
+		}
+	}
+
+	go func() {
+		mux := http.NewServeMux()
+		util.AddHandler(logger, mux, "/", http.MethodGet, "<empty>", func(_ context.Context, _ *zap.Logger, body *struct{}) (*[]nodeCommitmentHistory, int, error) {
+			nodes := history.since(time.Time{})
+			return &nodes, 200, nil
+		})
+		server := &http.Server{Handler: mux}
+		if err := server.Serve(listener); err != nil {
+			logger.Error("commitment history server exited", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		interval := time.Duration(conf.IntervalSeconds) * time.Second
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				p.state.recordCommitment(history, now)
+			}
+		}
+	}()
+
+	if uploader != nil {
+		go uploader.run(ctx, logger.Named("s3"), history)
+	}
+
+	return nil
+}
+
+// recordCommitment adds a sample for every node currently in the state, and removes samples that
+// have fallen outside the window.
+func (s *pluginState) recordCommitment(history *commitmentHistory, now time.Time) {
+	type nodeSample struct {
+		node   *nodeState
+		sample commitmentSample
+	}
+
+	s.lock.Lock()
+	samples := make([]nodeSample, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		samples = append(samples, nodeSample{
+			node:   n,
+			sample: newCommitmentSample(n, now, history.computeUnit),
+		})
+	}
+	s.lock.Unlock()
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	for _, ns := range samples {
+		h, ok := history.nodes[ns.node.name]
+		if !ok {
+			h = &nodeCommitmentHistory{
+				Node:             ns.node.name,
+				NodeGroup:        ns.node.nodeGroup,
+				AvailabilityZone: ns.node.availabilityZone,
+				Samples:          nil,
+			}
+			history.nodes[ns.node.name] = h
+		}
+		h.Samples = append(h.Samples, ns.sample)
+	}
+
+	// Remove samples outside the window. We keep the history of nodes that were removed until all
+	// of their samples expire, because those are often the most interesting ones.
+	cutoff := now.Add(-history.window)
+	for name, h := range history.nodes {
+		firstKept, _ := slices.BinarySearchFunc(h.Samples, cutoff, func(s commitmentSample, t time.Time) int {
+			return s.Time.Compare(t)
+		})
+		h.Samples = h.Samples[firstKept:]
+		if len(h.Samples) == 0 {
+			delete(history.nodes, name)
+		}
+	}
+}
+
+// since returns a copy of the history of each node, only including samples strictly after the
+// given time
+func (h *commitmentHistory) since(t time.Time) []nodeCommitmentHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nodes := make([]nodeCommitmentHistory, 0, len(h.nodes))
+	for _, n := range h.nodes {
+		idx, found := slices.BinarySearchFunc(n.Samples, t, func(s commitmentSample, t time.Time) int {
+			return s.Time.Compare(t)
+		})
+		if found {
+			idx += 1
+		}
+		if idx == len(n.Samples) {
+			continue
+		}
+
+		nodes = append(nodes, nodeCommitmentHistory{
+			Node:             n.Node,
+			NodeGroup:        n.NodeGroup,
+			AvailabilityZone: n.AvailabilityZone,
+			Samples:          slices.Clone(n.Samples[idx:]),
+		})
+	}
+	slices.SortFunc(nodes, func(x, y nodeCommitmentHistory) (less bool) {
+		return x.Node < y.Node
+	})
+
+	return nodes
+}
+
+type commitmentHistoryUploader struct {
+	conf   *commitmentHistoryS3Config
+	client *s3.Client
+}
+
+func newCommitmentHistoryUploader(ctx context.Context, conf *commitmentHistoryS3Config) (*commitmentHistoryUploader, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if conf.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(conf.Region))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsConf, func(o *s3.Options) {
+		if conf.Endpoint != "" {
+			o.BaseEndpoint = aws.String(conf.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &commitmentHistoryUploader{conf: conf, client: client}, nil
+}
+
+// run periodically uploads all samples that haven't been uploaded yet. Failed uploads are retried
+// on the next tick, so no samples are lost unless they fall outside the window first.
+func (u *commitmentHistoryUploader) run(ctx context.Context, logger *zap.Logger, history *commitmentHistory) {
+	ticker := time.NewTicker(time.Duration(u.conf.UploadEverySeconds) * time.Second)
+	defer ticker.Stop()
+
+	var lastUploaded time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			nodes := history.since(lastUploaded)
+			if len(nodes) == 0 {
+				continue
+			}
+
+			if err := u.upload(ctx, now, nodes); err != nil {
+				logger.Error("Failed to upload commitment history", zap.Error(err))
+				continue
+			}
+
+			for _, n := range nodes {
+				if last := n.Samples[len(n.Samples)-1].Time; last.After(lastUploaded) {
+					lastUploaded = last
+				}
+			}
+			logger.Info("Uploaded commitment history", zap.Int("nodes", len(nodes)))
+		}
+	}
+}
+
+func (u *commitmentHistoryUploader) upload(ctx context.Context, now time.Time, nodes []nodeCommitmentHistory) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	for _, n := range nodes {
+		if err := enc.Encode(n); err != nil {
+			return fmt.Errorf("Error encoding history for node %q: %w", n.Node, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("Error compressing history: %w", err)
+	}
+
+	now = now.UTC()
+	key := fmt.Sprintf(
+		"year=%04d/month=%02d/day=%02d/%s.ndjson.gz",
+		now.Year(), now.Month(), now.Day(), now.Format("15:04:05Z"),
+	)
+	if u.conf.Prefix != "" {
+		key = fmt.Sprintf("%s/%s", u.conf.Prefix, key)
+	}
+
+	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(u.conf.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("Error putting object %q: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// historyTestNode returns a node with just the fields used for the commitment history
+func historyTestNode(name string, totalCPU, reservedCPU vmapi.MilliCPU, totalMem, reservedMem api.Bytes) *nodeState {
+	node := new(nodeState)
+	node.name = name
+	node.nodeGroup = "group"
+	node.availabilityZone = "zone-a"
+	node.cpu.Total = totalCPU
+	node.cpu.Reserved = reservedCPU
+	node.mem.Total = totalMem
+	node.mem.Reserved = reservedMem
+	return node
+}
+
+func TestCommitmentHistoryConfigValidate(t *testing.T) {
+	valid := func() *commitmentHistoryConfig {
+		return &commitmentHistoryConfig{
+			Port:            10301,
+			IntervalSeconds: 60,
+			WindowSeconds:   86400,
+			ComputeUnit:     api.Resources{VCPU: 250, Mem: 1 << 30},
+			S3:              nil,
+		}
+	}
+
+	path, err := valid().validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "", path)
+
+	conf := valid()
+	conf.WindowSeconds = 30
+	path, _ = conf.validate()
+	assert.Equal(t, "windowSeconds", path)
+
+	conf = valid()
+	conf.ComputeUnit.VCPU = 0
+	path, _ = conf.validate()
+	assert.Equal(t, "computeUnit.vCPUs", path)
+
+	conf = valid()
+	conf.ComputeUnit.Mem = 0
+	path, _ = conf.validate()
+	assert.Equal(t, "computeUnit.mem", path)
+}
+
+func TestNewCommitmentSample(t *testing.T) {
+	computeUnit := api.Resources{VCPU: 250, Mem: 1 << 30}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 16 vCPU and 32 GiB, with 2 vCPU (8 CU) and 12 GiB (12 CU) reserved
+	node := historyTestNode("node-1", 16000, 2000, 32<<30, 12<<30)
+	node.cpu.Buffer = 500
+	node.mem.Buffer = 1 << 30
+
+	sample := newCommitmentSample(node, now, computeUnit)
+	assert.Equal(t, commitmentSample{
+		Time: now,
+		CPU:  resourceCommitment[vmapi.MilliCPU]{Total: 16000, Reserved: 2000, Buffer: 500},
+		Mem:  resourceCommitment[api.Bytes]{Total: 32 << 30, Reserved: 12 << 30, Buffer: 1 << 30},
+		// Each field is the larger of CPU and memory in compute units
+		ComputeUnits: resourceCommitment[float64]{Total: 64, Reserved: 12, Buffer: 2},
+	}, sample)
+}
+
+func TestCommitmentHistory(t *testing.T) {
+	computeUnit := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	history := &commitmentHistory{
+		mu:          sync.Mutex{},
+		window:      3 * time.Minute,
+		computeUnit: computeUnit,
+		nodes:       make(map[string]*nodeCommitmentHistory),
+	}
+
+	state := new(pluginState)
+	state.lock = util.NewChanMutex()
+	state.nodes = map[string]*nodeState{
+		"node-1": historyTestNode("node-1", 8000, 2000, 32<<30, 4<<30),
+		"node-2": historyTestNode("node-2", 8000, 0, 32<<30, 0),
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	state.recordCommitment(history, at(0))
+	state.nodes["node-1"].cpu.Reserved = 3000
+	state.recordCommitment(history, at(1))
+	// Removed nodes are kept until all of their samples have expired
+	delete(state.nodes, "node-2")
+	state.recordCommitment(history, at(2))
+
+	nodes := history.since(time.Time{})
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "node-1", nodes[0].Node)
+	assert.Equal(t, "group", nodes[0].NodeGroup)
+	assert.Equal(t, "zone-a", nodes[0].AvailabilityZone)
+	var reserved []float64
+	for _, s := range nodes[0].Samples {
+		reserved = append(reserved, s.ComputeUnits.Reserved)
+	}
+	assert.Equal(t, []float64{2, 3, 3}, reserved)
+	assert.Equal(t, "node-2", nodes[1].Node)
+	assert.Len(t, nodes[1].Samples, 2)
+
+	// Only samples strictly after the time are returned, and nodes without any are omitted.
+	nodes = history.since(at(1))
+	require.Len(t, nodes, 1)
+	require.Len(t, nodes[0].Samples, 1)
+	assert.Equal(t, at(2), nodes[0].Samples[0].Time)
+	assert.Empty(t, history.since(at(2)))
+
+	// The returned samples are copies
+	nodes[0].Samples[0].ComputeUnits.Reserved = 100
+	assert.Equal(t, 3.0, history.since(at(1))[0].Samples[0].ComputeUnits.Reserved)
+
+	// Samples older than the window are removed, along with nodes that have none left.
+	state.recordCommitment(history, at(5))
+	nodes = history.since(time.Time{})
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "node-1", nodes[0].Node)
+	require.Len(t, nodes[0].Samples, 2)
+	assert.Equal(t, at(2), nodes[0].Samples[0].Time)
+	assert.Equal(t, at(5), nodes[0].Samples[1].Time)
+}
@@ -0,0 +1,168 @@
+package plugin
+
+// Observed CPU usage of each node, from the resource metrics API (i.e. metrics-server), for scoring
+// nodes by their utilization. See nodeConfig.UtilizationWeight.
+//
+// The plugin's own view of each node only covers what's reserved on it, which can be very
+// different from what's actually used -- both because VMs don't always use what they have, and
+// because other pods on the node aren't tracked at all.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+const (
+	// nodeMetricsPath is the path of the resource metrics API's list of node metrics
+	nodeMetricsPath = "/apis/metrics.k8s.io/v1beta1/nodes"
+	// nodeUsageRefreshInterval gives the time between fetching the metrics for every node. This
+	// matches metrics-server's default resolution.
+	nodeUsageRefreshInterval = 15 * time.Second
+	// nodeUsageMaxAge gives how old a node's metrics can be before they're no longer used for
+	// scoring, e.g. because metrics-server stopped reporting the node.
+	nodeUsageMaxAge = 2 * time.Minute
+)
+
+// nodeUsage is the observed usage of a node, at a point in time
+type nodeUsage struct {
+	// cpu gives the number of the node's CPUs that were in use
+	cpu float64
+	// at gives the time that the usage was measured at
+	at time.Time
+}
+
+// nodeUsageStore stores the most recent usage of every node
+type nodeUsageStore struct {
+	mu    sync.Mutex
+	nodes map[string]nodeUsage
+}
+
+func newNodeUsageStore() *nodeUsageStore {
+	return &nodeUsageStore{
+		mu:    sync.Mutex{},
+		nodes: make(map[string]nodeUsage),
+	}
+}
+
+// get returns the usage of the node, if it was measured recently enough to be used at time now
+func (s *nodeUsageStore) get(node string, now time.Time) (_ nodeUsage, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage, ok := s.nodes[node]
+	if !ok || now.Sub(usage.at) > nodeUsageMaxAge {
+		return nodeUsage{}, false
+	}
+	return usage, true
+}
+
+// replace sets the usage of every node, forgetting any nodes that aren't included
+func (s *nodeUsageStore) replace(nodes map[string]nodeUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = nodes
+}
+
+// nodeMetricsList is the subset of the resource metrics API's NodeMetricsList that we use
+//
+// The type is copied here, rather than imported from k8s.io/metrics, because only a couple of its
+// fields are needed.
+type nodeMetricsList struct {
+	Items []struct {
+		Metadata  metav1.ObjectMeta   `json:"metadata"`
+		Timestamp metav1.Time         `json:"timestamp"`
+		Usage     corev1.ResourceList `json:"usage"`
+	} `json:"items"`
+}
+
+// parseNodeMetrics returns the CPU usage of each node from the resource metrics API's response
+func parseNodeMetrics(body []byte) (map[string]nodeUsage, error) {
+	var list nodeMetricsList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("Error unmarshaling node metrics: %w", err)
+	}
+
+	nodes := make(map[string]nodeUsage)
+	for _, item := range list.Items {
+		cpu, ok := item.Usage[corev1.ResourceCPU]
+		if !ok {
+			continue
+		}
+		nodes[item.Metadata.Name] = nodeUsage{
+			cpu: cpu.AsApproximateFloat64(),
+			at:  item.Timestamp.Time,
+		}
+	}
+	return nodes, nil
+}
+
+func (e *AutoscaleEnforcer) startNodeUsageRefresh(ctx context.Context, logger *zap.Logger) {
+	go func() {
+		ticker := time.NewTicker(nodeUsageRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := e.refreshNodeUsage(ctx); err != nil && ctx.Err() == nil {
+				// Scoring falls back to only the reserved resources once the existing metrics
+				// are too old, so there's nothing else to do here.
+				logger.Warn("Error fetching node metrics", zap.Error(err))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (e *AutoscaleEnforcer) refreshNodeUsage(ctx context.Context) error {
+	reqCtx, cancel := context.WithTimeout(ctx, nodeUsageRefreshInterval)
+	defer cancel()
+
+	body, err := e.handle.ClientSet().CoreV1().RESTClient().Get().
+		AbsPath(nodeMetricsPath).
+		SetHeader("Accept", "application/json").
+		DoRaw(reqCtx)
+	if err != nil {
+		return fmt.Errorf("Error listing node metrics: %w", err)
+	}
+
+	nodes, err := parseNodeMetrics(body)
+	if err != nil {
+		return err
+	}
+	e.nodeUsage.replace(nodes)
+	return nil
+}
+
+// utilizationScore returns the score of a node with the given CPU usage, out of its total. Nodes
+// that are less used get higher scores.
+//
+// The score is never the minimum, because that's reserved for nodes without room.
+func utilizationScore(usedCPU, totalCPU float64) int64 {
+	scoreLen := framework.MaxNodeScore - framework.MinNodeScore
+
+	usedFraction := 1.0
+	if totalCPU > 0 {
+		usedFraction = math.Min(usedCPU/totalCPU, 1)
+	}
+	return framework.MinNodeScore + 1 + int64(float64(scoreLen-1)*(1-usedFraction))
+}
+
+// blendScores returns the weighted combination of the scores from reserved resources and observed
+// utilization, where weight is the fraction given to utilization
+func blendScores(reservedScore, utilScore int64, weight float64) int64 {
+	return int64(math.Round((1-weight)*float64(reservedScore) + weight*float64(utilScore)))
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+func TestParseNodeMetrics(t *testing.T) {
+	body := `{
+		"kind": "NodeMetricsList",
+		"apiVersion": "metrics.k8s.io/v1beta1",
+		"items": [
+			{
+				"metadata": {"name": "node-a"},
+				"timestamp": "2024-01-01T00:00:00Z",
+				"window": "10s",
+				"usage": {"cpu": "1500m", "memory": "4Gi"}
+			},
+			{
+				"metadata": {"name": "node-b"},
+				"timestamp": "2024-01-01T00:00:05Z",
+				"window": "10s",
+				"usage": {"cpu": "250000000n"}
+			},
+			{
+				"metadata": {"name": "node-c"},
+				"timestamp": "2024-01-01T00:00:05Z",
+				"window": "10s",
+				"usage": {"memory": "1Gi"}
+			}
+		]
+	}`
+
+	nodes, err := parseNodeMetrics([]byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]nodeUsage{
+		"node-a": {cpu: 1.5, at: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"node-b": {cpu: 0.25, at: time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC)},
+	}, normalizeUsageTimes(nodes))
+
+	_, err = parseNodeMetrics([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+// normalizeUsageTimes converts the times to UTC, so that they can be compared with assert.Equal
+func normalizeUsageTimes(nodes map[string]nodeUsage) map[string]nodeUsage {
+	for name, usage := range nodes {
+		usage.at = usage.at.UTC()
+		nodes[name] = usage
+	}
+	return nodes
+}
+
+func TestNodeUsageStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newNodeUsageStore()
+
+	_, ok := store.get("node-a", now)
+	assert.False(t, ok)
+
+	store.replace(map[string]nodeUsage{
+		"node-a": {cpu: 2, at: now},
+		"node-b": {cpu: 3, at: now.Add(-nodeUsageMaxAge - time.Second)},
+	})
+
+	usage, ok := store.get("node-a", now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 2.0, usage.cpu)
+
+	// Metrics that are too old aren't used
+	_, ok = store.get("node-a", now.Add(nodeUsageMaxAge+time.Second))
+	assert.False(t, ok)
+	_, ok = store.get("node-b", now)
+	assert.False(t, ok)
+
+	// Nodes missing from the latest metrics are forgotten
+	store.replace(map[string]nodeUsage{"node-b": {cpu: 1, at: now}})
+	_, ok = store.get("node-a", now)
+	assert.False(t, ok)
+	_, ok = store.get("node-b", now)
+	assert.True(t, ok)
+}
+
+func TestUtilizationScore(t *testing.T) {
+	// Less used nodes score higher, but never at the minimum
+	assert.Equal(t, framework.MaxNodeScore, utilizationScore(0, 8))
+	assert.Equal(t, framework.MinNodeScore+1, utilizationScore(8, 8))
+	assert.Equal(t, framework.MinNodeScore+1, utilizationScore(12, 8))
+	assert.Equal(t, framework.MinNodeScore+1, utilizationScore(1, 0))
+	assert.Greater(t, utilizationScore(2, 8), utilizationScore(6, 8))
+
+	assert.Equal(t, int64(40), blendScores(40, 90, 0))
+	assert.Equal(t, int64(90), blendScores(40, 90, 1))
+	assert.Equal(t, int64(65), blendScores(40, 90, 0.5))
+	assert.Equal(t, int64(53), blendScores(40, 90, 0.25))
+}
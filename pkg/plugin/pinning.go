@@ -0,0 +1,44 @@
+package plugin
+
+// Accounting for VMs with pinned vCPUs, which have whole host CPUs to themselves for as long as
+// they're running, regardless of how many vCPUs are in use.
+
+import (
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// pinnedCPU returns the CPU reserved for the VM's pinned vCPUs, or zero if they aren't pinned
+func pinnedCPU(vm *api.VmInfo) vmapi.MilliCPU {
+	return vmapi.MilliCPU(vm.Cpu.Pinned * 1000)
+}
+
+// reservePinnedCPUs updates the VM info so that all of the host CPUs given to the VM's pinned
+// vCPUs, if it has them, are reserved on the node, as if the VM were always using all of them.
+func reservePinnedCPUs(vm *api.VmInfo) {
+	if cpu := pinnedCPU(vm); cpu != 0 {
+		vm.Cpu.Min = cpu
+		vm.Cpu.Use = cpu
+		vm.Cpu.Max = cpu
+	}
+}
+
+// pinnedCPURequest returns the resources and last permit to handle for a request from the
+// autoscaler-agent, so that the CPU reserved for a VM with pinned vCPUs doesn't change when the
+// agent scales its vCPUs.
+func pinnedCPURequest(
+	vm *vmPodState,
+	reservedCPU vmapi.MilliCPU,
+	resources api.Resources,
+	lastPermit *api.Resources,
+) (api.Resources, *api.Resources) {
+	if vm.PinnedCPU == 0 {
+		return resources, lastPermit
+	}
+
+	resources.VCPU = reservedCPU
+	if lastPermit != nil {
+		lastPermit = &api.Resources{VCPU: reservedCPU, Mem: lastPermit.Mem}
+	}
+	return resources, lastPermit
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestReservePinnedCPUs(t *testing.T) {
+	vmInfo := func(pinned uint32) *api.VmInfo {
+		return &api.VmInfo{ //nolint:exhaustruct // only the CPU matters
+			Cpu: api.VmCpuInfo{Min: 250, Max: 2000, Use: 500, Pinned: pinned},
+		}
+	}
+
+	// VMs without pinned vCPUs are left as-is
+	vm := vmInfo(0)
+	reservePinnedCPUs(vm)
+	assert.Equal(t, vmapi.MilliCPU(0), pinnedCPU(vm))
+	assert.Equal(t, api.VmCpuInfo{Min: 250, Max: 2000, Use: 500, Pinned: 0}, vm.Cpu)
+
+	// ... and the ones with them always use all of their host CPUs.
+	vm = vmInfo(3)
+	reservePinnedCPUs(vm)
+	assert.Equal(t, vmapi.MilliCPU(3000), pinnedCPU(vm))
+	assert.Equal(t, api.VmCpuInfo{Min: 3000, Max: 3000, Use: 3000, Pinned: 3}, vm.Cpu)
+}
+
+func TestPinnedCPURequest(t *testing.T) {
+	requested := api.Resources{VCPU: 500, Mem: 2048}
+	lastPermit := &api.Resources{VCPU: 1000, Mem: 1024}
+
+	// Requests for VMs without pinned vCPUs are unchanged
+	unpinned := &vmPodState{PinnedCPU: 0} //nolint:exhaustruct // only the pinned CPU matters
+	resources, permit := pinnedCPURequest(unpinned, 1000, requested, lastPermit)
+	assert.Equal(t, requested, resources)
+	assert.Equal(t, lastPermit, permit)
+
+	// For VMs with pinned vCPUs, the CPU stays at what's reserved, while memory is still scaled.
+	pinned := &vmPodState{PinnedCPU: 3000} //nolint:exhaustruct // only the pinned CPU matters
+	resources, permit = pinnedCPURequest(pinned, 3000, requested, lastPermit)
+	assert.Equal(t, api.Resources{VCPU: 3000, Mem: 2048}, resources)
+	assert.Equal(t, &api.Resources{VCPU: 3000, Mem: 1024}, permit)
+	// The original last permit isn't modified
+	assert.Equal(t, &api.Resources{VCPU: 1000, Mem: 1024}, lastPermit)
+
+	// ... including when there's no previous permit.
+	resources, permit = pinnedCPURequest(pinned, 3000, requested, nil)
+	assert.Equal(t, api.Resources{VCPU: 3000, Mem: 2048}, resources)
+	assert.Nil(t, permit)
+}
@@ -0,0 +1,71 @@
+package plugin
+
+// Placement strategies, which decide how the resources already reserved on each node affect its
+// score for new pods.
+
+import (
+	"fmt"
+)
+
+// placementStrategy selects how nodes are scored by the resources already reserved on them
+type placementStrategy string
+
+const (
+	// placementBalanced scores nodes highest when they're nodeConfig.ScorePeak full, sloping down
+	// towards MinUsageScore when empty and MaxUsageScore when full. This is the default.
+	placementBalanced placementStrategy = "balanced"
+	// placementBinPack scores nodes higher the fuller they are, packing pods tightly so that as
+	// many nodes as possible are left empty and can be scaled down.
+	placementBinPack placementStrategy = "binpack"
+	// placementSpread scores nodes higher the emptier they are, spreading pods out so that VMs on
+	// the same node contend for resources as little as possible.
+	placementSpread placementStrategy = "spread"
+)
+
+func (s placementStrategy) validate() error {
+	switch s {
+	case "", placementBalanced, placementBinPack, placementSpread:
+		return nil
+	default:
+		return fmt.Errorf("unknown placement strategy %q", s)
+	}
+}
+
+// placementStrategy returns the strategy to use for pods in the namespace
+func (c *Config) placementStrategy(namespace string) placementStrategy {
+	if s, ok := c.NamespacePlacementStrategies[namespace]; ok && s != "" {
+		return s
+	} else if c.NodeConfig.PlacementStrategy != "" {
+		return c.NodeConfig.PlacementStrategy
+	} else {
+		return placementBalanced
+	}
+}
+
+// usageScore returns the score, from 0 to 1, of a node with the given fraction of a resource
+// already reserved, according to the strategy
+//
+// Refer to the comments in nodeConfig for more. Also, see: https://www.desmos.com/calculator/wg8s0yn63s
+func (s placementStrategy) usageScore(conf *nodeConfig, fraction float64) float64 {
+	y0 := conf.MinUsageScore
+	y1 := conf.MaxUsageScore
+
+	switch s {
+	case placementBinPack:
+		// Equivalent to a peak at 1: fuller is always better.
+		return y0 + (1-y0)*fraction
+	case placementSpread:
+		// Equivalent to a peak at 0: emptier is always better.
+		return y1 + (1-y1)*(1-fraction)
+	default:
+		xp := conf.ScorePeak
+
+		score := float64(1) // if fraction == conf.ScorePeak
+		if fraction < xp {
+			score = y0 + (1-y0)/xp*fraction
+		} else if fraction > xp {
+			score = y1 + (1-y1)/(1-xp)*(1-fraction)
+		}
+		return score
+	}
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type placementOutcome struct {
+	emptyNodes int
+	maxFill    float64
+}
+
+// simulatePlacement places each pod on the node with the highest score according to the strategy,
+// the same way the scheduler would with a single resource, and returns the resulting outcome
+func simulatePlacement(
+	t *testing.T,
+	strategy placementStrategy,
+	conf *nodeConfig,
+	nodeSizes []float64,
+	pods []float64,
+) placementOutcome {
+	reserved := make([]float64, len(nodeSizes))
+	for _, pod := range pods {
+		best := -1
+		var bestScore float64
+		for i, size := range nodeSizes {
+			if reserved[i]+pod > size {
+				continue
+			}
+			// Ties go to the first node, like the scheduler's deterministic ordering would.
+			if score := strategy.usageScore(conf, reserved[i]/size); best == -1 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		require.NotEqual(t, -1, best, "no room for pod of size %g", pod)
+		reserved[best] += pod
+	}
+
+	var outcome placementOutcome
+	for i, size := range nodeSizes {
+		if reserved[i] == 0 {
+			outcome.emptyNodes += 1
+		}
+		if fill := reserved[i] / size; fill > outcome.maxFill {
+			outcome.maxFill = fill
+		}
+	}
+	return outcome
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	conf := &nodeConfig{
+		Cpu:               resourceConfig{Watermark: 0.9, UpscaleHeadroomFraction: 0, UpscaleHeadroom: nil},
+		Memory:            resourceConfig{Watermark: 0.9, UpscaleHeadroomFraction: 0, UpscaleHeadroom: nil},
+		MinUsageScore:     0.5,
+		MaxUsageScore:     0.33,
+		ScorePeak:         0.8,
+		PlacementStrategy: "",
+		UtilizationWeight: 0,
+	}
+
+	nodeSizes := []float64{16, 16, 16, 16, 16, 16, 16, 16, 16, 16}
+	var pods []float64
+	for i := 0; i < 30; i += 1 {
+		pods = append(pods, float64(1+i%4))
+	}
+
+	balanced := simulatePlacement(t, placementBalanced, conf, nodeSizes, pods)
+	binpack := simulatePlacement(t, placementBinPack, conf, nodeSizes, pods)
+	spread := simulatePlacement(t, placementSpread, conf, nodeSizes, pods)
+
+	// 73 units of pods fit in 5 nodes when packed tightly; spreading uses every node.
+	assert.Equal(t, 5, binpack.emptyNodes)
+	assert.Equal(t, 0, spread.emptyNodes)
+	assert.GreaterOrEqual(t, binpack.emptyNodes, balanced.emptyNodes)
+	assert.GreaterOrEqual(t, balanced.emptyNodes, spread.emptyNodes)
+
+	assert.LessOrEqual(t, spread.maxFill, balanced.maxFill)
+	assert.LessOrEqual(t, balanced.maxFill, binpack.maxFill)
+	assert.LessOrEqual(t, spread.maxFill, 0.6)
+}
+
+func TestPlacementStrategyOverrides(t *testing.T) {
+	var conf Config
+	assert.Equal(t, placementBalanced, conf.placementStrategy("default"))
+
+	conf.NodeConfig.PlacementStrategy = placementBinPack
+	conf.NamespacePlacementStrategies = map[string]placementStrategy{
+		"latency-sensitive": placementSpread,
+	}
+	assert.Equal(t, placementBinPack, conf.placementStrategy("default"))
+	assert.Equal(t, placementSpread, conf.placementStrategy("latency-sensitive"))
+
+	assert.Error(t, placementStrategy("tetris").validate())
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	corev1 "k8s.io/api/core/v1"
@@ -18,6 +19,7 @@ import (
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
 
@@ -32,6 +34,14 @@ type AutoscaleEnforcer struct {
 	vmClient *vmclient.Clientset
 	state    pluginState
 	metrics  PromMetrics
+	// tracer creates spans for autoscaler-agent requests. It's a no-op if tracing isn't enabled.
+	tracer trace.Tracer
+	// permitAudit stores the recent decisions for autoscaler-agent requests. It's nil if the audit
+	// isn't enabled.
+	permitAudit permitAuditStore
+	// nodeUsage stores the observed CPU usage of each node, from the resource metrics API. It's nil
+	// if scoring doesn't use it.
+	nodeUsage *nodeUsageStore
 
 	// vmStore provides access the current-ish state of VMs in the cluster. If something's missing,
 	// it can be updated with Resync().
@@ -87,6 +97,11 @@ func makeAutoscaleEnforcerPlugin(
 		return nil, fmt.Errorf("Error creating NeonVM client: %w", err)
 	}
 
+	tracerProvider, err := tracing.NewTracerProvider(ctx, config.Tracing, "autoscale-scheduler")
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up tracing: %w", err)
+	}
+
 	p := AutoscaleEnforcer{
 		logger: logger.Named("plugin"),
 
@@ -101,6 +116,10 @@ func makeAutoscaleEnforcerPlugin(
 		metrics:   PromMetrics{},      //nolint:exhaustruct // set by makePrometheusRegistry
 		vmStore:   IndexedVMStore{},   //nolint:exhaustruct // set below
 		nodeStore: IndexedNodeStore{}, //nolint:exhaustruct // set below
+		tracer:    tracerProvider.Tracer("github.com/neondatabase/autoscaling/pkg/plugin"),
+
+		permitAudit: newPermitAuditStore(config.PermitAudit),
+		nodeUsage:   nil, // set below, if enabled
 	}
 
 	if p.state.conf.DumpState != nil {
@@ -205,6 +224,34 @@ func makeAutoscaleEnforcerPlugin(
 		return nil, fmt.Errorf("Error reading cluster state: %w", err)
 	}
 
+	if p.state.conf.Checkpoint != nil {
+		logger.Info("Starting checkpointing")
+		p.startCheckpointing(ctx, logger.Named("checkpoint"))
+	}
+
+	if p.state.conf.SustainedPressure != nil && p.state.conf.migrationEnabled() {
+		logger.Info("Starting sustained pressure migrations")
+		p.startSustainedPressureMigrations(ctx, logger.Named("sustained-pressure"))
+	}
+
+	if p.state.conf.NodeConfig.UtilizationWeight != 0 {
+		logger.Info("Starting node usage refresh")
+		p.nodeUsage = newNodeUsageStore()
+		p.startNodeUsageRefresh(ctx, logger.Named("node-usage"))
+	}
+
+	if p.state.conf.NodeDrain != nil && p.state.conf.migrationEnabled() {
+		logger.Info("Starting node drain migrations")
+		p.startNodeDrainMigrations(ctx, logger.Named("node-drain"))
+	}
+
+	if p.state.conf.CommitmentHistory != nil {
+		logger.Info("Starting commitment history")
+		if err := p.startCommitmentHistory(ctx, logger.Named("commitment-history")); err != nil {
+			return nil, fmt.Errorf("Error starting commitment history: %w", err)
+		}
+	}
+
 	for i := 0; i < config.EventQueueWorkers; i += 1 {
 		// copy the loop variable to avoid it escaping pre Go 1.22
 		go func(ctx context.Context, idx int) {
@@ -224,10 +271,29 @@ func makeAutoscaleEnforcerPlugin(
 		return nil, fmt.Errorf("Error starting prometheus server: %w", err)
 	}
 
+	if p.state.conf.Tracing != nil {
+		logger.Info("Starting trace exporter")
+		go tracing.Run(ctx, logger.Named("tracing"), tracerProvider)
+	}
+
 	if err := p.startPermitHandler(ctx, logger.Named("agent-handler")); err != nil {
 		return nil, fmt.Errorf("permit handler: %w", err)
 	}
 
+	if p.state.conf.GRPC != nil {
+		logger.Info("Starting gRPC server")
+		if err := p.startGRPCServer(ctx, logger.Named("agent-grpc")); err != nil {
+			return nil, fmt.Errorf("Error starting gRPC server: %w", err)
+		}
+	}
+
+	if p.state.conf.Admission != nil {
+		logger.Info("Starting admission webhook server")
+		if err := p.startAdmissionServer(ctx, logger.Named("admission")); err != nil {
+			return nil, fmt.Errorf("Error starting admission webhook server: %w", err)
+		}
+	}
+
 	// Periodically check that we're not deadlocked
 	go func() {
 		defer func() {
@@ -272,6 +338,7 @@ func (e *AutoscaleEnforcer) getVmInfo(logger *zap.Logger, pod *corev1.Pod, actio
 		)
 		return nil, fmt.Errorf("Error extracting VM info: %w", err)
 	}
+	reservePinnedCPUs(vmInfo)
 
 	return vmInfo, nil
 }
@@ -381,6 +448,7 @@ func (e *AutoscaleEnforcer) Filter(
 	} else {
 		podResources = extractPodResources(pod)
 	}
+	podGPUs := extractPodGPUs(pod, e.state.conf)
 
 	// Check that the SchedulerName matches what we're expecting
 	if status := e.checkSchedulerName(logger, pod); status != nil {
@@ -409,6 +477,7 @@ func (e *AutoscaleEnforcer) Filter(
 	//
 	// So we have to actually count up the resource usage of all pods in nodeInfo:
 	var nodeTotal api.Resources
+	nodeGPUs := make(map[corev1.ResourceName]int64)
 
 	// As we process all pods, we should record all the pods that aren't present in both nodeInfo
 	// and e.state's maps, so that we can log any inconsistencies instead of silently using
@@ -426,6 +495,9 @@ func (e *AutoscaleEnforcer) Filter(
 		if podState, ok := e.state.pods[pn]; ok {
 			nodeTotal.VCPU += podState.cpu.Reserved
 			nodeTotal.Mem += podState.mem.Reserved
+			for name, count := range podState.gpus {
+				nodeGPUs[name] += count
+			}
 			delete(missedPods, pn)
 		} else {
 			name := util.GetNamespacedName(podInfo.Pod)
@@ -456,6 +528,9 @@ func (e *AutoscaleEnforcer) Filter(
 			resources := extractPodResources(podInfo.Pod)
 			nodeTotal.VCPU += resources.VCPU
 			nodeTotal.Mem += resources.Mem
+			for name, count := range extractPodGPUs(podInfo.Pod, e.state.conf) {
+				nodeGPUs[name] += count
+			}
 		}
 	}
 
@@ -483,23 +558,37 @@ func (e *AutoscaleEnforcer) Filter(
 
 	allowing := true
 
+	// New pods can't use the node's upscale headroom, which is kept for the pods already there.
 	var cpuCompare string
-	if nodeTotal.VCPU+podResources.VCPU > node.cpu.Total {
+	if nodeTotal.VCPU+podResources.VCPU > node.placeableCPU() {
 		cpuCompare = ">"
 		allowing = false
 	} else {
 		cpuCompare = "<="
 	}
-	cpuMsg := makeMsg("vCPU", cpuCompare, nodeTotal.VCPU, podResources.VCPU, node.cpu.Total)
+	cpuMsg := makeMsg("vCPU", cpuCompare, nodeTotal.VCPU, podResources.VCPU, node.placeableCPU())
 
 	var memCompare string
-	if nodeTotal.Mem+podResources.Mem > node.mem.Total {
+	if nodeTotal.Mem+podResources.Mem > node.placeableMem() {
 		memCompare = ">"
 		allowing = false
 	} else {
 		memCompare = "<="
 	}
-	memMsg := makeMsg("vCPU", memCompare, nodeTotal.Mem, podResources.Mem, node.mem.Total)
+	memMsg := makeMsg("vCPU", memCompare, nodeTotal.Mem, podResources.Mem, node.placeableMem())
+
+	gpuMsg := node.gpuShortage(nodeGPUs, podGPUs)
+	if gpuMsg != "" {
+		allowing = false
+	}
+
+	var topologyMsg string
+	if vmInfo != nil {
+		topologyMsg = e.state.topologyRejection(vmInfo, node)
+		if topologyMsg != "" {
+			allowing = false
+		}
+	}
 
 	var message string
 	var logFunc func(string, ...zap.Field)
@@ -518,9 +607,15 @@ func (e *AutoscaleEnforcer) Filter(
 			cpu: cpuMsg,
 			mem: memMsg,
 		}),
+		zap.String("gpus", gpuMsg),
+		zap.String("topology", topologyMsg),
 	)
 
-	if !allowing {
+	if topologyMsg != "" {
+		return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("VM topology: %s", topologyMsg))
+	} else if gpuMsg != "" {
+		return framework.NewStatus(framework.Unschedulable, fmt.Sprintf("Not enough GPUs for pod: %s", gpuMsg))
+	} else if !allowing {
 		return framework.NewStatus(framework.Unschedulable, "Not enough resources for pod")
 	} else {
 		return nil
@@ -588,18 +683,18 @@ func (e *AutoscaleEnforcer) Score(
 	}
 
 	// Special case: return minimum score if we don't have room
-	noRoom := resources.VCPU > node.remainingReservableCPU() ||
-		resources.Mem > node.remainingReservableMem()
+	noRoom := resources.VCPU > node.remainingPlaceableCPU() ||
+		resources.Mem > node.remainingPlaceableMem()
 	if noRoom {
 		score := framework.MinNodeScore
 		logger.Warn("No room on node, giving minimum score (typically handled by Filter method)", zap.Int64("score", score))
 		return score, nil
 	}
 
-	cpuRemaining := node.remainingReservableCPU()
-	cpuTotal := node.cpu.Total
-	memRemaining := node.remainingReservableMem()
-	memTotal := node.mem.Total
+	cpuRemaining := node.remainingPlaceableCPU()
+	cpuTotal := node.placeableCPU()
+	memRemaining := node.remainingPlaceableMem()
+	memTotal := node.placeableMem()
 
 	cpuFraction := 1 - cpuRemaining.AsFloat64()/cpuTotal.AsFloat64()
 	memFraction := 1 - memRemaining.AsFloat64()/memTotal.AsFloat64()
@@ -607,21 +702,10 @@ func (e *AutoscaleEnforcer) Score(
 	memScale := node.mem.Total.AsFloat64() / e.state.maxTotalReservableMem.AsFloat64()
 
 	nodeConf := e.state.conf.NodeConfig
+	strategy := e.state.conf.placementStrategy(pod.Namespace)
 
-	// Refer to the comments in nodeConfig for more. Also, see: https://www.desmos.com/calculator/wg8s0yn63s
 	calculateScore := func(fraction, scale float64) (float64, int64) {
-		y0 := nodeConf.MinUsageScore
-		y1 := nodeConf.MaxUsageScore
-		xp := nodeConf.ScorePeak
-
-		score := float64(1) // if fraction == nodeConf.ScorePeak
-		if fraction < nodeConf.ScorePeak {
-			score = y0 + (1-y0)/xp*fraction
-		} else if fraction > nodeConf.ScorePeak {
-			score = y1 + (1-y1)/(1-xp)*(1-fraction)
-		}
-
-		score *= scale
+		score := strategy.usageScore(&nodeConf, fraction) * scale
 
 		return score, framework.MinNodeScore + int64(float64(scoreLen)*score)
 	}
@@ -630,9 +714,31 @@ func (e *AutoscaleEnforcer) Score(
 	memFScore, memIScore := calculateScore(memFraction, memScale)
 
 	score := util.Min(cpuIScore, memIScore)
+
+	// Blend in the node's observed usage, if enabled and we have recent metrics for it
+	var utilization string
+	if w := nodeConf.UtilizationWeight; w != 0 {
+		totalCPU := node.cpu.Total.AsFloat64()
+		if usage, ok := e.nodeUsage.get(nodeName, time.Now()); ok {
+			utilScore := utilizationScore(usage.cpu, totalCPU)
+			reservedScore := score
+			score = blendScores(reservedScore, utilScore, w)
+			utilization = fmt.Sprintf(
+				"observed %g of %g CPUs => score %d, weight %g => combined with reserved score %d => %d",
+				usage.cpu, totalCPU, utilScore, w, reservedScore, score,
+			)
+		} else {
+			utilization = "no recent node metrics, using reserved score only"
+		}
+	}
+
+	var topology string
+	score, topology = e.state.applyTopologyPreferences(vmInfo, node, score)
+
 	logger.Info(
 		"Scored pod placement for node",
 		zap.Int64("score", score),
+		zap.String("strategy", string(strategy)),
 		zap.Object("verdict", verdictSet{
 			cpu: fmt.Sprintf(
 				"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
@@ -643,6 +749,8 @@ func (e *AutoscaleEnforcer) Score(
 				memRemaining, memTotal, memFraction, memScale, memFScore, memIScore,
 			),
 		}),
+		zap.String("utilization", utilization),
+		zap.String("topology", topology),
 	)
 
 	return score, nil
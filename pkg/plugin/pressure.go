@@ -0,0 +1,228 @@
+package plugin
+
+// Migrating VMs away from nodes that have been under sustained resource pressure.
+//
+// Normally, migrations are only started while handling requests from the autoscaler-agent, and
+// only when the node's reserved resources are above the watermark. That misses nodes where the VMs'
+// actual usage is high but their reservations aren't -- or where the agents aren't sending
+// requests. This periodically checks each node's demand instead, and starts a migration of the
+// most movable VM if the node has been above the threshold for long enough.
+//
+// Migrations are rate limited both per node and globally, so that a cluster-wide spike in load
+// doesn't start a wave of migrations.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type sustainedPressureConfig struct {
+	// Threshold gives the fraction of a node's resources, from 0 to 1, above which its demand is
+	// considered to be too high.
+	//
+	// Demand is the larger of the node's observed CPU usage (from the load averages sent by
+	// autoscaler-agents) and its reserved memory, each relative to the node's total.
+	Threshold float64 `json:"threshold"`
+	// DurationSeconds gives how long a node's demand must be continuously above the threshold
+	// before a VM is migrated away from it
+	DurationSeconds uint `json:"durationSeconds"`
+	// CheckIntervalSeconds gives the time between checks of every node's demand
+	CheckIntervalSeconds uint `json:"checkIntervalSeconds"`
+
+	// NodeCooldownSeconds gives the minimum time between migrations started from the same node, so
+	// that a migration has time to relieve the pressure before another is started.
+	NodeCooldownSeconds uint `json:"nodeCooldownSeconds"`
+	// MaxPerHour gives the maximum number of migrations that will be started across all nodes
+	// within any hour
+	MaxPerHour uint `json:"maxPerHour"`
+}
+
+func (c *sustainedPressureConfig) validate() (string, error) {
+	if c.Threshold <= 0 || c.Threshold > 1 {
+		return "threshold", errors.New("value must be between 0 (exclusive) and 1 (inclusive)")
+	} else if c.DurationSeconds == 0 {
+		return "durationSeconds", errors.New("value must be > 0")
+	} else if c.CheckIntervalSeconds == 0 {
+		return "checkIntervalSeconds", errors.New("value must be > 0")
+	} else if c.MaxPerHour == 0 {
+		return "maxPerHour", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// Values of the "outcome" label on the sustained pressure migrations metric
+const (
+	pressureMigrationCreated       = "created"
+	pressureMigrationFailed        = "failed"
+	pressureMigrationNoCandidate   = "no-candidate"
+	pressureMigrationNodeLimited   = "node-rate-limited"
+	pressureMigrationGlobalLimited = "global-rate-limited"
+)
+
+// pressureTracker stores the per-node and global state for migrations due to sustained pressure.
+//
+// It's only accessed from the single goroutine running the checks, so has no lock of its own.
+type pressureTracker struct {
+	// since gives the time at which each node's demand was first seen above the threshold, for
+	// the nodes that are still above it
+	since map[string]time.Time
+	// lastMigration gives the time at which a migration was last started from each node
+	lastMigration map[string]time.Time
+	// recent gives the times of the migrations started within the last hour, oldest first
+	recent []time.Time
+}
+
+// demand returns the fraction of the node's resources that are in demand, as described in
+// sustainedPressureConfig.Threshold
+func (s *nodeState) demand() float64 {
+	var cpu, mem float64
+	if s.cpu.Total != 0 {
+		cpu = s.observedCPU() / s.cpu.Total.AsFloat64()
+	}
+	if s.mem.Total != 0 {
+		mem = s.mem.Reserved.AsFloat64() / s.mem.Total.AsFloat64()
+	}
+	return util.Max(cpu, mem)
+}
+
+// mostMovablePod returns the pod on the node that's the best candidate for migration, or nil if
+// there's none that are allowed to migrate
+func (s *nodeState) mostMovablePod() *podState {
+	var best *podState
+	for _, pod := range s.pods {
+		if pod.vm == nil || pod.vm.currentlyMigrating() || !pod.vm.Config.AutoMigrationEnabled || pod.vm.HasGPUs {
+			continue
+		}
+		if best == nil || pod.vm.isBetterMigrationTarget(best.vm) {
+			best = pod
+		}
+	}
+	return best
+}
+
+func (e *AutoscaleEnforcer) startSustainedPressureMigrations(ctx context.Context, logger *zap.Logger) {
+	conf := e.state.conf.SustainedPressure
+
+	tracker := &pressureTracker{
+		since:         make(map[string]time.Time),
+		lastMigration: make(map[string]time.Time),
+		recent:        nil,
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(conf.CheckIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				e.checkSustainedPressure(ctx, logger, tracker, now)
+			}
+		}
+	}()
+}
+
+// checkSustainedPressure updates the tracker with the current demand of every node, starting
+// migrations from the nodes that have been above the threshold for long enough.
+func (e *AutoscaleEnforcer) checkSustainedPressure(
+	ctx context.Context,
+	logger *zap.Logger,
+	tracker *pressureTracker,
+	now time.Time,
+) {
+	conf := e.state.conf.SustainedPressure
+	duration := time.Duration(conf.DurationSeconds) * time.Second
+	cooldown := time.Duration(conf.NodeCooldownSeconds) * time.Second
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	// Forget about migrations that are no longer within the global window
+	for len(tracker.recent) != 0 && now.Sub(tracker.recent[0]) >= time.Hour {
+		tracker.recent = tracker.recent[1:]
+	}
+
+	var pressured []string
+	for name, node := range e.state.nodes {
+		if node.demand() <= conf.Threshold {
+			delete(tracker.since, name)
+			continue
+		}
+		if _, ok := tracker.since[name]; !ok {
+			tracker.since[name] = now
+		}
+		pressured = append(pressured, name)
+	}
+	// Clean up nodes that have been removed
+	for name := range tracker.since {
+		if _, ok := e.state.nodes[name]; !ok {
+			delete(tracker.since, name)
+		}
+	}
+	for name := range tracker.lastMigration {
+		if _, ok := e.state.nodes[name]; !ok {
+			delete(tracker.lastMigration, name)
+		}
+	}
+
+	e.metrics.sustainedPressureNodes.Set(float64(len(pressured)))
+
+	for _, name := range pressured {
+		if now.Sub(tracker.since[name]) < duration {
+			continue
+		}
+
+		// Nodes can be removed while the lock is released to start a migration.
+		node, ok := e.state.nodes[name]
+		if !ok {
+			continue
+		}
+
+		logger := logger.With(
+			zap.String("node", name),
+			zap.Float64("demand", node.demand()),
+			zap.Time("pressureSince", tracker.since[name]),
+		)
+
+		if last, ok := tracker.lastMigration[name]; ok && now.Sub(last) < cooldown {
+			e.metrics.sustainedPressureMigrations.WithLabelValues(pressureMigrationNodeLimited).Inc()
+			continue
+		} else if uint(len(tracker.recent)) >= conf.MaxPerHour {
+			e.metrics.sustainedPressureMigrations.WithLabelValues(pressureMigrationGlobalLimited).Inc()
+			logger.Warn("Node has been under sustained pressure, but too many migrations were started in the last hour")
+			continue
+		}
+
+		pod := node.mostMovablePod()
+		if pod == nil {
+			e.metrics.sustainedPressureMigrations.WithLabelValues(pressureMigrationNoCandidate).Inc()
+			logger.Warn("Node has been under sustained pressure, but there's no VM that can be migrated")
+			continue
+		}
+
+		logger = logger.With(zap.Object("pod", pod.name), zap.Object("virtualmachine", pod.vm.Name))
+		logger.Info("Node has been under sustained pressure, migrating VM")
+
+		created, err := e.startMigration(ctx, logger, pod)
+		if err != nil {
+			e.metrics.sustainedPressureMigrations.WithLabelValues(pressureMigrationFailed).Inc()
+			logger.Error("Failed to start migration for node under sustained pressure", zap.Error(err))
+			continue
+		}
+		if created {
+			e.metrics.sustainedPressureMigrations.WithLabelValues(pressureMigrationCreated).Inc()
+			tracker.lastMigration[name] = now
+			tracker.recent = append(tracker.recent, now)
+			// Give the migration time to take effect before checking the node's demand again.
+			delete(tracker.since, name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"k8s.io/client-go/rest"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestSustainedPressureConfigValidate(t *testing.T) {
+	valid := func() *sustainedPressureConfig {
+		return &sustainedPressureConfig{
+			Threshold:            0.9,
+			DurationSeconds:      300,
+			CheckIntervalSeconds: 30,
+			NodeCooldownSeconds:  600,
+			MaxPerHour:           10,
+		}
+	}
+
+	path, err := valid().validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "", path)
+
+	cases := []struct {
+		path   string
+		modify func(*sustainedPressureConfig)
+	}{
+		{"threshold", func(c *sustainedPressureConfig) { c.Threshold = 0 }},
+		{"threshold", func(c *sustainedPressureConfig) { c.Threshold = 1.5 }},
+		{"durationSeconds", func(c *sustainedPressureConfig) { c.DurationSeconds = 0 }},
+		{"checkIntervalSeconds", func(c *sustainedPressureConfig) { c.CheckIntervalSeconds = 0 }},
+		{"maxPerHour", func(c *sustainedPressureConfig) { c.MaxPerHour = 0 }},
+	}
+	for _, c := range cases {
+		conf := valid()
+		c.modify(conf)
+		path, err := conf.validate()
+		assert.Error(t, err)
+		assert.Equal(t, c.path, path)
+	}
+
+	// The cooldown is optional
+	conf := valid()
+	conf.NodeCooldownSeconds = 0
+	_, err = conf.validate()
+	assert.NoError(t, err)
+}
+
+// pressureTestPod adds a VM pod with the load average to the node
+func pressureTestPod(state *pluginState, node *nodeState, name string, load float32) *podState {
+	pod := checkpointTestPod(state, node, name, 1000, 2000, 4<<30, 8<<30)
+	pod.vm = &vmPodState{ //nolint:exhaustruct // only the fields used for choosing migrations matter
+		Name:    pod.name,
+		Config:  api.VmConfig{AutoMigrationEnabled: true}, //nolint:exhaustruct // only migration matters
+		Metrics: &api.Metrics{LoadAverage1Min: load, LoadAverage5Min: nil, MemoryUsageBytes: nil},
+		MqIndex: -1,
+	}
+	return pod
+}
+
+func TestNodeDemand(t *testing.T) {
+	state := &pluginState{pods: make(map[util.NamespacedName]*podState)} //nolint:exhaustruct // only the pods are used
+	node := historyTestNode("node-a", 8000, 0, 32<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+
+	assert.Equal(t, 0.0, node.demand())
+
+	// Memory is from the reservations: 2 * 4 GiB of 32 GiB
+	pressureTestPod(state, node, "a", 0.5)
+	pressureTestPod(state, node, "b", 1.5)
+	assert.Equal(t, 0.25, node.demand())
+
+	// CPU is from the load averages: 6 of 8 CPUs
+	pressureTestPod(state, node, "c", 4)
+	assert.Equal(t, 0.75, node.demand())
+
+	// Pods without metrics don't count towards CPU
+	checkpointTestPod(state, node, "no-vm", 1000, 1000, 8<<30, 8<<30)
+	assert.Equal(t, 0.75, node.demand())
+	checkpointTestPod(state, node, "more-mem", 1000, 1000, 12<<30, 12<<30)
+	assert.Equal(t, 1.0, node.demand())
+}
+
+func TestMostMovablePod(t *testing.T) {
+	state := &pluginState{pods: make(map[util.NamespacedName]*podState)} //nolint:exhaustruct // only the pods are used
+	node := historyTestNode("node-a", 8000, 0, 32<<30, 0)
+	node.pods = make(map[util.NamespacedName]*podState)
+
+	assert.Nil(t, node.mostMovablePod())
+
+	checkpointTestPod(state, node, "not-a-vm", 1000, 1000, 1<<30, 1<<30)
+	pressureTestPod(state, node, "disabled", 0.1).vm.Config.AutoMigrationEnabled = false
+	pressureTestPod(state, node, "gpus", 0.1).vm.HasGPUs = true
+	pressureTestPod(state, node, "migrating", 0.1).vm.MigrationState = &podMigrationState{} //nolint:exhaustruct // only its presence matters
+	assert.Nil(t, node.mostMovablePod())
+
+	noMetrics := pressureTestPod(state, node, "no-metrics", 0)
+	noMetrics.vm.Metrics = nil
+	assert.Equal(t, noMetrics, node.mostMovablePod())
+
+	// VMs with metrics are preferred, and then the ones with the lowest load
+	pressureTestPod(state, node, "busy", 3)
+	idle := pressureTestPod(state, node, "idle", 0.5)
+	assert.Equal(t, idle, node.mostMovablePod())
+}
+
+// fakeMigrationServer is an API server that only supports getting and creating
+// VirtualMachineMigrations, none of which exist beforehand
+type fakeMigrationServer struct {
+	mu      sync.Mutex
+	created []string
+}
+
+func (s *fakeMigrationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/apis/vm.neon.tech/v1/namespaces/default/virtualmachinemigrations") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	case http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		var vmm vmapi.VirtualMachineMigration
+		if err := json.Unmarshal(body, &vmm); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.created = append(s.created, vmm.Spec.VmName)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeMigrationServer) createdVMs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.created...)
+}
+
+func TestCheckSustainedPressure(t *testing.T) {
+	server := &fakeMigrationServer{mu: sync.Mutex{}, created: nil}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	vmClient, err := vmclient.NewForConfig(&rest.Config{Host: httpServer.URL}) //nolint:exhaustruct // only the host is needed
+	require.NoError(t, err)
+
+	p := &AutoscaleEnforcer{vmClient: vmClient} //nolint:exhaustruct // only the client, state and metrics are used
+	p.makePrometheusRegistry()
+	p.state.lock = util.NewChanMutex()
+	p.state.conf = &Config{ //nolint:exhaustruct // only the sustained pressure config is used
+		SustainedPressure: &sustainedPressureConfig{
+			Threshold:            0.8,
+			DurationSeconds:      300,
+			CheckIntervalSeconds: 30,
+			NodeCooldownSeconds:  600,
+			MaxPerHour:           2,
+		},
+	}
+	p.state.pods = make(map[util.NamespacedName]*podState)
+
+	newNode := func(name string) *nodeState {
+		node := historyTestNode(name, 4000, 0, 32<<30, 0)
+		node.pods = make(map[util.NamespacedName]*podState)
+		p.state.nodes[name] = node
+		return node
+	}
+	p.state.nodes = make(map[string]*nodeState)
+	nodeA, nodeB, nodeC := newNode("node-a"), newNode("node-b"), newNode("node-c")
+
+	// node-a and node-b are each at 90% of their CPU. node-c is fine.
+	pressureTestPod(&p.state, nodeA, "a-busy", 3)
+	pressureTestPod(&p.state, nodeA, "a-idle", 0.6)
+	pressureTestPod(&p.state, nodeB, "b-busy", 3.6)
+	pressureTestPod(&p.state, nodeC, "c", 1)
+
+	tracker := &pressureTracker{
+		since:         make(map[string]time.Time),
+		lastMigration: make(map[string]time.Time),
+		recent:        nil,
+	}
+	outcomes := func(outcome string) float64 {
+		return testutil.ToFloat64(p.metrics.sustainedPressureMigrations.WithLabelValues(outcome))
+	}
+	check := func(now time.Time) {
+		p.checkSustainedPressure(context.Background(), zap.NewNop(), tracker, now)
+	}
+
+	start := time.Now()
+	check(start)
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.metrics.sustainedPressureNodes))
+	assert.Equal(t, map[string]time.Time{"node-a": start, "node-b": start}, tracker.since)
+
+	// Not above the threshold for long enough yet
+	check(start.Add(4 * time.Minute))
+	assert.Empty(t, server.createdVMs())
+
+	// Once it's been long enough, the least loaded VM on each node is migrated
+	at := start.Add(5 * time.Minute)
+	check(at)
+	created := server.createdVMs()
+	assert.ElementsMatch(t, []string{"a-idle", "b-busy"}, created)
+	assert.Equal(t, 2.0, outcomes(pressureMigrationCreated))
+	assert.Equal(t, map[string]time.Time{"node-a": at, "node-b": at}, tracker.lastMigration)
+	assert.Empty(t, tracker.since)
+
+	// The migrations don't take effect in this test, so the nodes are still under pressure. Once
+	// that's been long enough again, the cooldown applies first...
+	check(at.Add(1 * time.Minute))
+	check(at.Add(6 * time.Minute))
+	assert.Equal(t, 2.0, outcomes(pressureMigrationNodeLimited))
+	// ... and then the global limit
+	check(at.Add(10 * time.Minute))
+	assert.Equal(t, 2.0, outcomes(pressureMigrationGlobalLimited))
+	assert.Len(t, server.createdVMs(), 2)
+
+	// A node whose demand drops is no longer tracked
+	nodeB.pods[util.NamespacedName{Namespace: "default", Name: "b-busy"}].vm.Metrics.LoadAverage1Min = 1
+	check(at.Add(11 * time.Minute))
+	assert.NotContains(t, tracker.since, "node-b")
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.metrics.sustainedPressureNodes))
+	assert.Equal(t, 3.0, outcomes(pressureMigrationGlobalLimited))
+
+	// After an hour, migrations are allowed again, but only if there's a VM that can migrate
+	nodeA.pods[util.NamespacedName{Namespace: "default", Name: "a-busy"}].vm.Config.AutoMigrationEnabled = false
+	nodeA.pods[util.NamespacedName{Namespace: "default", Name: "a-idle"}].vm.Config.AutoMigrationEnabled = false
+	check(at.Add(time.Hour))
+	assert.Empty(t, tracker.recent)
+	assert.Equal(t, 1.0, outcomes(pressureMigrationNoCandidate))
+	assert.Len(t, server.createdVMs(), 2)
+
+	// Nodes that are removed are forgotten
+	delete(p.state.nodes, "node-a")
+	check(at.Add(time.Hour + time.Minute))
+	assert.Empty(t, tracker.since)
+	assert.NotContains(t, tracker.lastMigration, "node-a")
+	assert.Contains(t, tracker.lastMigration, "node-b")
+}
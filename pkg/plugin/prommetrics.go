@@ -21,14 +21,33 @@ type PromMetrics struct {
 	validResourceRequests *prometheus.CounterVec
 	nodeCPUResources      *prometheus.GaugeVec
 	nodeMemResources      *prometheus.GaugeVec
+	nodeGPUResources      *prometheus.GaugeVec
 	migrationCreations    prometheus.Counter
 	migrationDeletions    *prometheus.CounterVec
 	migrationCreateFails  prometheus.Counter
 	migrationDeleteFails  *prometheus.CounterVec
+	migrationReplacements *prometheus.CounterVec
 	reserveShouldDeny     *prometheus.CounterVec
 	eventQueueDepth       prometheus.Gauge
 	eventQueueAddsTotal   prometheus.Counter
 	eventQueueLatency     prometheus.Histogram
+	checkpointWrites      *prometheus.CounterVec
+	checkpointDrift       *prometheus.CounterVec
+
+	sustainedPressureNodes      prometheus.Gauge
+	sustainedPressureMigrations *prometheus.CounterVec
+	drainingNodes               prometheus.Gauge
+	drainPendingVMs             prometheus.Gauge
+	drainUnmovableVMs           prometheus.Gauge
+	drainMigrations             *prometheus.CounterVec
+	drainLimitedNodes           *prometheus.GaugeVec
+
+	tenantBudgetDenials *prometheus.CounterVec
+
+	permitDecisions *prometheus.CounterVec
+
+	admissionRejections      *prometheus.CounterVec
+	admissionDefaultsApplied *prometheus.CounterVec
 }
 
 func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
@@ -86,6 +105,13 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"node", "node_group", "availability_zone", "field"},
 		)),
+		nodeGPUResources: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_node_gpu_resources_current",
+				Help: "Current number of each kind of GPU for 'nodeGPUState' fields",
+			},
+			[]string{"node", "node_group", "availability_zone", "resource", "field"},
+		)),
 		migrationCreations: util.RegisterMetric(reg, prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "autoscaling_plugin_migrations_created_total",
@@ -112,6 +138,13 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"phase"},
 		)),
+		migrationReplacements: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_migrations_replaced_total",
+				Help: "Number of finished VirtualMachineMigrations deleted by the plugin to start a new migration for the same VM",
+			},
+			[]string{"phase"},
+		)),
 		reserveShouldDeny: util.RegisterMetric(reg, prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "autoscaling_plugin_reserve_should_deny_total",
@@ -138,6 +171,93 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 				Buckets: prometheus.ExponentialBuckets(10e-9, 10, 12),
 			},
 		)),
+		checkpointWrites: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_checkpoint_writes_total",
+				Help: "Number of attempts to save a checkpoint of the plugin's reservations",
+			},
+			[]string{"outcome"},
+		)),
+		checkpointDrift: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_checkpoint_drift_total",
+				Help: "Number of pods that differed between the restored checkpoint and the state rebuilt from the cluster",
+			},
+			[]string{"kind"},
+		)),
+		sustainedPressureNodes: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_sustained_pressure_nodes",
+				Help: "Number of nodes whose demand is currently above the sustained pressure threshold",
+			},
+		)),
+		sustainedPressureMigrations: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_sustained_pressure_migrations_total",
+				Help: "Number of attempts to migrate a VM away from a node under sustained pressure",
+			},
+			[]string{"outcome"},
+		)),
+		drainingNodes: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_draining_nodes",
+				Help: "Number of nodes that are currently cordoned or tainted for draining",
+			},
+		)),
+		drainPendingVMs: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_drain_pending_vms",
+				Help: "Number of VMs on draining nodes that are yet to be migrated away",
+			},
+		)),
+		drainUnmovableVMs: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_drain_unmovable_vms",
+				Help: "Number of VMs on draining nodes that can't be migrated away automatically",
+			},
+		)),
+		drainMigrations: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_drain_migrations_total",
+				Help: "Number of attempts to migrate a VM away from a draining node",
+			},
+			[]string{"outcome"},
+		)),
+		drainLimitedNodes: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_drain_limited_nodes",
+				Help: "Number of draining nodes with VMs waiting to migrate because of the concurrent migration limits",
+			},
+			[]string{"limit"},
+		)),
+		tenantBudgetDenials: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_tenant_budget_denials_total",
+				Help: "Number of requested increases that were not fully permitted because of the tenant's compute unit budget",
+			},
+			[]string{"tenant"},
+		)),
+		permitDecisions: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_permit_decisions_total",
+				Help: "Number of autoscaler-agent requests for known VMs, by outcome and the reason for any denial",
+			},
+			[]string{"node", "outcome", "reason"},
+		)),
+		admissionRejections: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_admission_rejections_total",
+				Help: "Number of VirtualMachines rejected by the admission webhook, by the policy they didn't meet",
+			},
+			[]string{"reason"},
+		)),
+		admissionDefaultsApplied: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_admission_defaults_applied_total",
+				Help: "Number of new VirtualMachines that the admission webhook applied (or skipped, if invalid for the VM) each kind of namespace default to",
+			},
+			[]string{"default", "outcome"},
+		)),
 	}
 
 	return reg
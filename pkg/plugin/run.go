@@ -11,9 +11,13 @@ import (
 	"time"
 
 	"github.com/tychoish/fun/srv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
 )
 
 const (
@@ -27,7 +31,7 @@ const (
 // If you update either of these values, make sure to also update VERSIONING.md.
 const (
 	MinPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV3_0
-	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_0
+	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_4
 )
 
 // startPermitHandler runs the server for handling each resourceRequest from a pod
@@ -77,8 +81,20 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 			zap.String("client", r.RemoteAddr), zap.Any("request", req),
 		)
 
+		// Continue the agent's trace, if it sent one
+		_, span := e.tracer.Start(
+			tracing.Extract(r.Context(), r.Header), "plugin.agent_request",
+			trace.WithAttributes(
+				attribute.String("pod.namespace", req.Pod.Namespace),
+				attribute.String("pod.name", req.Pod.Name),
+			),
+		)
+		defer span.End()
+
 		resp, statusCode, err := e.handleAgentRequest(logger, req)
 		finalStatus = statusCode
+		span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		tracing.RecordError(span, err)
 
 		if err != nil {
 			logFunc := logger.Warn
@@ -114,6 +130,11 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 		_, _ = w.Write(responseBody)
 	})
 
+	e.addCapacityHandlers(logger.Named("capacity"), mux)
+	if e.permitAudit != nil {
+		e.addPermitAuditHandlers(logger.Named("permit-audit"), mux)
+	}
+
 	orca := srv.GetOrchestrator(ctx)
 
 	logger.Info("Starting resource request server")
@@ -132,7 +153,7 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 func (e *AutoscaleEnforcer) handleAgentRequest(
 	logger *zap.Logger,
 	req api.AgentRequest,
-) (_ *api.PluginResponse, status int, _ error) {
+) (_ *api.PluginResponse, status int, err error) {
 	nodeName := "<none>" // override this later if we have a node name
 	defer func() {
 		hasMetrics := req.Metrics != nil
@@ -212,26 +233,79 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	// Also, now that we know which VM this refers to (and which node it's on), add that to the logger for later.
 	logger = logger.With(zap.Object("virtualmachine", pod.vm.Name), zap.String("node", nodeName))
 
+	// From here on, the request is for a VM that we know about, so record the outcome.
+	var permitted *api.Resources
+	auditReason := permitAuditNoReason
+	defer func() {
+		e.auditPermit(pod, req.Resources, permitted, auditReason, status, err)
+	}()
+
 	mustMigrate := pod.vm.MigrationState == nil &&
 		// Check whether the pod *will* migrate, then update its resources, and THEN start its
 		// migration, using the possibly-changed resources.
 		e.updateMetricsAndCheckMustMigrate(logger, pod.vm, node, req.Metrics)
 
 	supportsFractionalCPU := req.ProtoVersion.SupportsFractionalCPU()
+	allowsIncreaseDuringMigration := req.ProtoVersion.AllowsIncreaseDuringMigration()
+
+	var priority int32
+	if req.ProtoVersion.AgentSendsPriority() {
+		priority = req.Priority
+	}
+
+	resources, lastPermit := pinnedCPURequest(pod.vm, pod.cpu.Reserved, req.Resources, req.LastPermit)
+
+	// If the VM was suspended, its vCPUs were given up, and it's now using them again.
+	resumed := req.ProtoVersion.AllowsSuspendedCPU() && lastPermit != nil &&
+		lastPermit.VCPU == 0 && resources.VCPU != 0 && !pod.vm.currentlyMigrating()
+	if resumed {
+		verdict := makeResourceTransitioner(&node.cpu, &pod.cpu).handleResumed(resources.VCPU)
+		node.updateMetrics(e.metrics)
+		logger.Info("Reserved CPU for resumed pod", zap.String("verdict", verdict))
+		// Otherwise, the last permit would release what we just reserved.
+		lastPermit = &api.Resources{VCPU: resources.VCPU, Mem: lastPermit.Mem}
+	}
+
+	var deniedReason api.PermitDeniedReason
+	if limit, budget, limited := e.tenantBudgetLimit(pod, req.ComputeUnit, resources); limited {
+		logger.Warn(
+			"Limiting requested increase to fit within tenant budget",
+			zap.String("tenant", pod.vm.Tenant),
+			zap.Float64("budgetCU", budget),
+			zap.Object("requested", resources),
+			zap.Object("limit", limit),
+		)
+		e.metrics.tenantBudgetDenials.WithLabelValues(pod.vm.Tenant).Inc()
+		resources = limit
+		auditReason = permitAuditTenantBudget
+		if req.ProtoVersion.PluginSendsDeniedReason() {
+			deniedReason = api.PermitDeniedTenantBudget
+		}
+	}
 
 	permit, status, err := e.handleResources(
 		logger,
 		pod,
 		node,
 		req.ComputeUnit,
-		req.Resources,
-		req.LastPermit,
+		resources,
+		lastPermit,
 		mustMigrate,
 		supportsFractionalCPU,
+		allowsIncreaseDuringMigration,
+		priority,
 	)
 	if err != nil {
 		return nil, status, err
 	}
+	if pod.vm.PinnedCPU != 0 {
+		// The CPU stays reserved, but the agent is only permitted what it asked for.
+		permit.VCPU = req.Resources.VCPU
+	}
+	permitted = &permit
+	if auditReason == permitAuditNoReason && req.Resources.HasFieldGreaterThan(permit) {
+		auditReason = e.permitDenialReason(pod, mustMigrate, priority)
+	}
 
 	var migrateDecision *api.MigrateResponse
 	if mustMigrate {
@@ -250,8 +324,9 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	}
 
 	resp := api.PluginResponse{
-		Permit:  permit,
-		Migrate: migrateDecision,
+		Permit:       permit,
+		Migrate:      migrateDecision,
+		DeniedReason: deniedReason,
 	}
 	return &resp, 200, nil
 }
@@ -265,14 +340,47 @@ func (e *AutoscaleEnforcer) handleResources(
 	lastPermit *api.Resources,
 	startingMigration bool,
 	supportsFractionalCPU bool,
+	allowsIncreaseDuringMigration bool,
+	priority int32,
 ) (api.Resources, int, error) {
 	if !supportsFractionalCPU && req.VCPU%1000 != 0 {
 		err := errors.New("agent requested fractional CPU with protocol version that does not support it")
 		return api.Resources{}, 400, err
 	}
 
+	cpuFactor := cu.VCPU
+	if !supportsFractionalCPU {
+		cpuFactor = 1000
+	}
+	memFactor := cu.Mem
+
 	// Check that we aren't being asked to do something during migration:
 	if pod.vm.currentlyMigrating() {
+		// ... unless it's an increase that we can reserve on both the source and target nodes.
+		if allowsIncreaseDuringMigration && e.state.conf.AllowIncreaseDuringMigration &&
+			req.VCPU >= pod.cpu.Reserved && req.Mem >= pod.mem.Reserved {
+			if target := e.migrationTarget(pod); target != nil {
+				cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+					handleRequestedDuringMigration(makeResourceTransitioner(&target.node.cpu, &target.cpu), req.VCPU, cpuFactor)
+				memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+					handleRequestedDuringMigration(makeResourceTransitioner(&target.node.mem, &target.mem), req.Mem, memFactor)
+
+				node.updateMetrics(e.metrics)
+				target.node.updateMetrics(e.metrics)
+
+				logger.Info(
+					"Handled requested resources from migrating pod",
+					zap.Object("target", target.name),
+					zap.String("targetNode", target.node.name),
+					zap.Object("verdict", verdictSet{
+						cpu: cpuVerdict,
+						mem: memVerdict,
+					}),
+				)
+				return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
+			}
+		}
+
 		// The agent shouldn't have asked for a change after already receiving notice that it's
 		// migrating.
 		if req.VCPU != pod.cpu.Reserved || req.Mem != pod.mem.Reserved {
@@ -296,19 +404,16 @@ func (e *AutoscaleEnforcer) handleResources(
 		)
 	}
 
-	cpuFactor := cu.VCPU
-	if !supportsFractionalCPU {
-		cpuFactor = 1000
-	}
-	memFactor := cu.Mem
+	cpuReservable, memReservable := e.reservableTotals(node, priority)
 
 	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
-		handleRequested(req.VCPU, startingMigration, cpuFactor)
+		handleRequested(req.VCPU, startingMigration, cpuFactor, cpuReservable)
 	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
-		handleRequested(req.Mem, startingMigration, memFactor)
+		handleRequested(req.Mem, startingMigration, memFactor, memReservable)
 
 	logger.Info(
 		"Handled requested resources from pod",
+		zap.Int32("priority", priority),
 		zap.Object("verdict", verdictSet{
 			cpu: cpuVerdict,
 			mem: memVerdict,
@@ -318,6 +423,35 @@ func (e *AutoscaleEnforcer) handleResources(
 	return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
 }
 
+// limitedToWatermark returns whether VMs with the priority can only be given what's left below
+// each node's watermark, leaving the rest for higher-priority VMs. See MinPriorityAboveWatermark.
+func (e *AutoscaleEnforcer) limitedToWatermark(priority int32) bool {
+	minPriority := e.state.conf.MinPriorityAboveWatermark
+	return minPriority != nil && priority < *minPriority
+}
+
+// reservableTotals returns the amounts that the node's reserved CPU and memory may be increased up
+// to for a VM with the priority
+func (e *AutoscaleEnforcer) reservableTotals(node *nodeState, priority int32) (vmapi.MilliCPU, api.Bytes) {
+	if e.limitedToWatermark(priority) {
+		return node.cpu.Watermark, node.mem.Watermark
+	}
+	return node.cpu.Total, node.mem.Total
+}
+
+// migrationTarget returns the pod that's the target of the migration that pod is the source for, if
+// it's been placed on another node
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) migrationTarget(pod *podState) *podState {
+	for _, p := range e.state.pods {
+		if p != pod && p.vm != nil && p.vm.Name == pod.vm.Name && p.node != pod.node {
+			return p
+		}
+	}
+	return nil
+}
+
 func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	logger *zap.Logger,
 	vm *vmPodState,
@@ -340,6 +474,9 @@ func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	if vm.currentlyMigrating() {
 		return false // don't do anything else; it's already migrating.
 	}
+	if vm.HasGPUs {
+		return false // GPUs passed through to the VM can't be migrated with it.
+	}
 
 	node.mq.addOrUpdate(vm)
 
@@ -60,10 +60,16 @@ type nodeState struct {
 	// availabilityZone, if present, gives the availability zone that this node is in.
 	availabilityZone string
 
+	// architecture gives the node's CPU architecture, from the "kubernetes.io/arch" label, or the
+	// empty string if the node doesn't have the label.
+	architecture string
+
 	// cpu tracks the state of vCPU resources -- what's available and how
 	cpu nodeResourceState[vmapi.MilliCPU]
 	// mem tracks the state of bytes of memory -- what's available and how
 	mem nodeResourceState[api.Bytes]
+	// gpus tracks the state of each kind of GPU that the node has. See gpu.go.
+	gpus map[corev1.ResourceName]*nodeGPUState
 
 	// pods tracks all the VM pods assigned to this node
 	//
@@ -84,6 +90,7 @@ func (s *nodeResourceState[T]) fields() []nodeResourceStateField[T] {
 	return []nodeResourceStateField[T]{
 		{"Total", s.Total},
 		{"Watermark", s.Watermark},
+		{"UpscaleHeadroom", s.UpscaleHeadroom},
 		{"Reserved", s.Reserved},
 		{"Buffer", s.Buffer},
 		{"CapacityPressure", s.CapacityPressure},
@@ -91,9 +98,22 @@ func (s *nodeResourceState[T]) fields() []nodeResourceStateField[T] {
 	}
 }
 
+// observedCPU returns the total of the most recent load averages sent for the VMs on the node,
+// which roughly gives the number of its CPUs that are actually in use
+func (s *nodeState) observedCPU() float64 {
+	var total float64
+	for _, pod := range s.pods {
+		if pod.vm != nil && pod.vm.Metrics != nil {
+			total += float64(pod.vm.Metrics.LoadAverage1Min)
+		}
+	}
+	return total
+}
+
 func (s *nodeState) updateMetrics(metrics PromMetrics) {
 	s.cpu.updateMetrics(metrics.nodeCPUResources, s.name, s.nodeGroup, s.availabilityZone, vmapi.MilliCPU.AsFloat64)
 	s.mem.updateMetrics(metrics.nodeMemResources, s.name, s.nodeGroup, s.availabilityZone, api.Bytes.AsFloat64)
+	s.updateGPUMetrics(metrics)
 }
 
 func (s *nodeResourceState[T]) updateMetrics(
@@ -117,6 +137,7 @@ func (s *nodeState) removeMetrics(metrics PromMetrics) {
 			g.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone, f.valueName)
 		}
 	}
+	s.removeGPUMetrics(metrics)
 }
 
 // nodeResourceState describes the state of a resource allocated to a node
@@ -126,6 +147,9 @@ type nodeResourceState[T any] struct {
 	// Watermark is the amount of T reserved to pods above which we attempt to reduce usage via
 	// migration.
 	Watermark T `json:"watermark"`
+	// UpscaleHeadroom is the amount of T that's set aside for increases to the pods already on the
+	// node. New pods are only placed on the node if they fit within (Total - UpscaleHeadroom).
+	UpscaleHeadroom T `json:"upscaleHeadroom"`
 	// Reserved is the current amount of T reserved to pods. It SHOULD be less than or equal to
 	// Total), and we take active measures reduce it once it is above Watermark.
 	//
@@ -173,6 +197,8 @@ type podState struct {
 	cpu podResourceState[vmapi.MilliCPU]
 	// memBytes is the current state of this pod's memory utilization and pressure
 	mem podResourceState[api.Bytes]
+	// gpus gives the number of each kind of GPU that the pod has, or nil if it doesn't have any
+	gpus map[corev1.ResourceName]int64
 
 	// vm stores the extra information associated with VMs
 	vm *vmPodState
@@ -187,6 +213,17 @@ type vmPodState struct {
 	// earlier versions of the agent<->plugin protocol.
 	MemSlotSize api.Bytes
 
+	// PinnedCPU is the CPU reserved for the VM's pinned vCPUs, or zero if they aren't pinned. See
+	// reservePinnedCPUs.
+	PinnedCPU vmapi.MilliCPU
+
+	// HasGPUs is true if the VM has GPUs passed through to it, in which case it can't be migrated
+	HasGPUs bool
+
+	// Tenant is the tenant that the VM belongs to, from its pod's label, or "" if it has none or
+	// tenant budgets aren't enabled. See tenantBudgetConfig.
+	Tenant string
+
 	// Config stores the values of per-VM settings for this VM
 	Config api.VmConfig
 
@@ -260,6 +297,28 @@ func (s *nodeState) remainingReservableMem() api.Bytes {
 	return util.SaturatingSub(s.mem.Total, s.mem.Reserved)
 }
 
+// remainingPlaceableCPU returns the remaining CPU that can be allocated to new pods, which excludes
+// the node's upscale headroom
+func (s *nodeState) remainingPlaceableCPU() vmapi.MilliCPU {
+	return util.SaturatingSub(s.placeableCPU(), s.cpu.Reserved)
+}
+
+// placeableCPU returns the total CPU that new pods can be placed into
+func (s *nodeState) placeableCPU() vmapi.MilliCPU {
+	return util.SaturatingSub(s.cpu.Total, s.cpu.UpscaleHeadroom)
+}
+
+// remainingPlaceableMem returns the remaining number of bytes of memory that can be allocated to
+// new pods, which excludes the node's upscale headroom
+func (s *nodeState) remainingPlaceableMem() api.Bytes {
+	return util.SaturatingSub(s.placeableMem(), s.mem.Reserved)
+}
+
+// placeableMem returns the total bytes of memory that new pods can be placed into
+func (s *nodeState) placeableMem() api.Bytes {
+	return util.SaturatingSub(s.mem.Total, s.mem.UpscaleHeadroom)
+}
+
 // tooMuchPressure is used to signal whether the node should start migrating pods out in order to
 // relieve some of the pressure
 func (s *nodeState) tooMuchPressure(logger *zap.Logger) bool {
@@ -486,8 +545,10 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 		name:             node.Name,
 		nodeGroup:        nodeGroup,
 		availabilityZone: availabilityZone,
+		architecture:     node.Labels[corev1.LabelArchStable],
 		cpu:              cpu,
 		mem:              mem,
+		gpus:             buildNodeGPUState(node, conf),
 		pods:             make(map[util.NamespacedName]*podState),
 		mq:               migrationQueue{},
 	}
@@ -507,6 +568,7 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 			Total:     n.mem.Total,
 			Watermark: n.mem.Watermark,
 		}),
+		zap.Any("gpus", n.gpus),
 	)
 
 	return n, nil
@@ -639,8 +701,12 @@ func (e *AutoscaleEnforcer) reserveResources(
 	} else {
 		add = extractPodResources(pod)
 	}
+	gpus := extractPodGPUs(pod, e.state.conf)
+	gpuShortage := node.gpuShortage(node.reservedGPUs(), gpus)
 
-	shouldDeny := add.VCPU > node.remainingReservableCPU() || add.Mem > node.remainingReservableMem()
+	// New pods can't use the node's upscale headroom, which is kept for the pods already there.
+	shouldDeny := add.VCPU > node.remainingPlaceableCPU() || add.Mem > node.remainingPlaceableMem() ||
+		gpuShortage != ""
 
 	if shouldDeny {
 		e.metrics.IncReserveShouldDeny(pod, node)
@@ -648,26 +714,30 @@ func (e *AutoscaleEnforcer) reserveResources(
 
 	if shouldDeny && allowDeny {
 		cpuShortVerdict := "NOT ENOUGH"
-		if add.VCPU <= node.remainingReservableCPU() {
+		if add.VCPU <= node.remainingPlaceableCPU() {
 			cpuShortVerdict = "OK"
 		}
 		memShortVerdict := "NOT ENOUGH"
-		if add.Mem <= node.remainingReservableMem() {
+		if add.Mem <= node.remainingPlaceableMem() {
 			memShortVerdict = "OK"
 		}
 
 		verdict := verdictSet{
 			cpu: fmt.Sprintf(
-				"need %v, %v of %v used, so %v available (%s)",
-				add.VCPU, node.cpu.Reserved, node.cpu.Total, node.remainingReservableCPU(), cpuShortVerdict,
+				"need %v, %v of %v used (%v kept as headroom), so %v available (%s)",
+				add.VCPU, node.cpu.Reserved, node.cpu.Total, node.cpu.UpscaleHeadroom, node.remainingPlaceableCPU(), cpuShortVerdict,
 			),
 			mem: fmt.Sprintf(
-				"need %v, %v of %v used, so %v available (%s)",
-				add.Mem, node.mem.Reserved, node.mem.Total, node.remainingReservableMem(), memShortVerdict,
+				"need %v, %v of %v used (%v kept as headroom), so %v available (%s)",
+				add.Mem, node.mem.Reserved, node.mem.Total, node.mem.UpscaleHeadroom, node.remainingPlaceableMem(), memShortVerdict,
 			),
 		}
 
-		logger.Error("Can't reserve resources for Pod (not enough available)", zap.Object("verdict", verdict))
+		logger.Error(
+			"Can't reserve resources for Pod (not enough available)",
+			zap.Object("verdict", verdict),
+			zap.String("gpus", gpuShortage),
+		)
 		return false, &verdict, nil
 	}
 
@@ -681,6 +751,9 @@ func (e *AutoscaleEnforcer) reserveResources(
 		vmState = &vmPodState{
 			Name:           vmInfo.NamespacedName(),
 			MemSlotSize:    vmInfo.Mem.SlotSize,
+			PinnedCPU:      pinnedCPU(vmInfo),
+			HasGPUs:        len(gpus) != 0,
+			Tenant:         podTenant(pod, e.state.conf),
 			Config:         vmInfo.Config,
 			Metrics:        nil,
 			MqIndex:        -1,
@@ -724,6 +797,7 @@ func (e *AutoscaleEnforcer) reserveResources(
 		node: node,
 		cpu:  cpuState,
 		mem:  memState,
+		gpus: gpus,
 		vm:   vmState,
 	}
 	newNodeReservedCPU := node.cpu.Reserved + ps.cpu.Reserved
@@ -743,13 +817,14 @@ func (e *AutoscaleEnforcer) reserveResources(
 	if allowDeny {
 		logger.Info("Allowing reserve resources for Pod", zap.Object("verdict", verdict))
 	} else if shouldDeny /* but couldn't */ {
-		logger.Warn("Reserved resources for Pod above totals", zap.Object("verdict", verdict))
+		logger.Warn("Reserved resources for Pod above totals", zap.Object("verdict", verdict), zap.String("gpus", gpuShortage))
 	} else {
 		logger.Info("Reserved resources for Pod", zap.Object("verdict", verdict))
 	}
 
 	node.cpu.Reserved = newNodeReservedCPU
 	node.mem.Reserved = newNodeReservedMem
+	node.reserveGPUs(ps.gpus)
 
 	node.pods[podName] = ps
 	e.state.pods[podName] = ps
@@ -811,6 +886,7 @@ func (e *AutoscaleEnforcer) unreserveResources(
 		handleDeleted(currentlyMigrating)
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleDeleted(currentlyMigrating)
+	ps.node.unreserveGPUs(ps.gpus)
 
 	// Delete our record of the pod
 	delete(e.state.pods, podName)
@@ -947,12 +1023,33 @@ func (e *AutoscaleEnforcer) handlePodEndMigration(logger *zap.Logger, podName, m
 	}
 	logger = logger.With(zap.Object("virtualmachine", ps.vm.Name))
 
+	if !ps.vm.currentlyMigrating() {
+		// The target of a migration is never marked as migrating, so there's nothing to reconcile:
+		// any increases during the migration were already reserved for it.
+		logger.Info(
+			"Recorded end of migration for VM pod",
+			zap.Object("reserved", api.Resources{VCPU: ps.cpu.Reserved, Mem: ps.mem.Reserved}),
+		)
+		return
+	}
+
+	// The pod was the source of the migration, and it's still around (e.g. because the migration
+	// failed). Its reservation will no longer be relieved by the migration, so it shouldn't count
+	// towards the pressure accounted for.
+	cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).handleEndMigration()
+	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).handleEndMigration()
+
 	ps.vm.MigrationState = nil
 
-	//nolint:gocritic // NOTE: not *currently* needed, but this should be kept here as a reminder, in case that changes.
-	// ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics)
 
-	logger.Info("Recorded end of migration for VM pod")
+	logger.Info(
+		"Recorded end of migration for VM pod",
+		zap.Object("verdict", verdictSet{
+			cpu: cpuVerdict,
+			mem: memVerdict,
+		}),
+	)
 }
 
 func (e *AutoscaleEnforcer) handleUpdatedScalingBounds(logger *zap.Logger, vm *api.VmInfo, unqualifiedPodName string) {
@@ -1161,12 +1258,39 @@ func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logg
 	// We technically don't *need* this additional request here (because we can check the return
 	// from the Create request with apierrors.IsAlreadyExists). However: the benefit we get from
 	// this is that the logs are significantly clearer.
-	_, err := e.vmClient.NeonvmV1().
+	existing, err := e.vmClient.NeonvmV1().
 		VirtualMachineMigrations(pod.name.Namespace).
 		Get(ctx, vmmName.Name, metav1.GetOptions{})
 	if err == nil {
-		logger.Warn("VirtualMachineMigration already exists, nothing to do")
-		return false, nil
+		// Migrations always have the same name for the VM, so a leftover from an earlier migration
+		// would block any new ones if we didn't remove it first. Once it's finished, it's safe to
+		// delete.
+		finished := existing.Status.Phase == vmapi.VmmSucceeded || existing.Status.Phase == vmapi.VmmFailed
+		if !finished || existing.DeletionTimestamp != nil {
+			logger.Warn(
+				"VirtualMachineMigration already exists, nothing to do",
+				zap.String("phase", string(existing.Status.Phase)),
+				zap.Bool("deleting", existing.DeletionTimestamp != nil),
+			)
+			return false, nil
+		}
+
+		logger.Info(
+			"Deleting finished VirtualMachineMigration to replace it",
+			zap.String("phase", string(existing.Status.Phase)),
+		)
+		err := e.vmClient.NeonvmV1().
+			VirtualMachineMigrations(pod.name.Namespace).
+			Delete(ctx, vmmName.Name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{UID: &existing.UID},
+			})
+		if err != nil && !apierrors.IsNotFound(err) {
+			e.metrics.migrationDeleteFails.WithLabelValues(string(existing.Status.Phase)).Inc()
+			logger.Error("Failed to delete finished VirtualMachineMigration", zap.Error(err))
+			return false, fmt.Errorf("Error deleting finished migration: %w", err)
+		}
+		e.metrics.migrationDeletions.WithLabelValues(string(existing.Status.Phase)).Inc()
+		e.metrics.migrationReplacements.WithLabelValues(string(existing.Status.Phase)).Inc()
 	} else if !apierrors.IsNotFound(err) {
 		// We're *expecting* to get IsNotFound = true; if err != nil and isn't NotFound, then
 		// there's some unexpected error.
@@ -1211,7 +1335,12 @@ func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logg
 
 	logger.Info("Migration doesn't already exist, creating one for VM", zap.Any("spec", vmm.Spec))
 	_, err = e.vmClient.NeonvmV1().VirtualMachineMigrations(pod.name.Namespace).Create(ctx, vmm, metav1.CreateOptions{})
-	if err != nil {
+	if apierrors.IsAlreadyExists(err) {
+		// The migration we deleted above may still have finalizers to run; we'll try again next
+		// time.
+		logger.Warn("VirtualMachineMigration still exists after deletion, will retry later")
+		return false, nil
+	} else if err != nil {
 		e.metrics.migrationCreateFails.Inc()
 		// log here, while the logger's fields are in scope
 		logger.Error("Unexpected error doing Create request for new migration", zap.Error(err))
@@ -1320,6 +1449,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		if err != nil {
 			return fmt.Errorf("Error extracting VM info for %v: %w", vmName, err)
 		}
+		reservePinnedCPUs(vmInfo)
 
 		ns, err := p.state.getOrFetchNodeState(ctx, logger, p.metrics, p.nodeStore, pod.Spec.NodeName)
 		if err != nil {
@@ -1327,10 +1457,13 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			continue
 		}
 
+		gpus := extractPodGPUs(pod, p.state.conf)
+
 		// Build the pod state, update the node
 		ps := &podState{
 			name: podName,
 			node: ns,
+			gpus: gpus,
 			cpu: podResourceState[vmapi.MilliCPU]{
 				Reserved:         vmInfo.Cpu.Max,
 				Buffer:           vmInfo.Cpu.Max - vmInfo.Cpu.Use,
@@ -1353,6 +1486,9 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 				MigrationState: nil,
 
 				MemSlotSize: vmInfo.Mem.SlotSize,
+				PinnedCPU:   pinnedCPU(vmInfo),
+				HasGPUs:     len(gpus) != 0,
+				Tenant:      podTenant(pod, p.state.conf),
 				Config:      vmInfo.Config,
 			},
 		}
@@ -1376,6 +1512,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		ns.cpu.Buffer += ps.cpu.Buffer
 		ns.mem.Reserved += ps.mem.Reserved
 		ns.mem.Buffer += ps.mem.Buffer
+		ns.reserveGPUs(ps.gpus)
 
 		cpuVerdict := fmt.Sprintf(
 			"pod = %v/%v (node %v -> %v / %v, %v -> %v buffer)",
@@ -1456,6 +1593,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			name: podName,
 			node: ns,
 			vm:   nil,
+			gpus: extractPodGPUs(pod, p.state.conf),
 			cpu: podResourceState[vmapi.MilliCPU]{
 				Reserved:         podRes.VCPU,
 				Buffer:           0,
@@ -1489,6 +1627,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			}),
 		)
 
+		ns.reserveGPUs(ps.gpus)
 		ns.updateMetrics(p.metrics)
 
 		ns.pods[podName] = ps
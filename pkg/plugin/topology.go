@@ -0,0 +1,98 @@
+package plugin
+
+// Placement of VMs according to their .spec.topology (mirrored onto runner pods by the
+// vmapi.VirtualMachineTopologyAnnotation): required and preferred availability zones, preferred CPU
+// architectures, and spreading VMs in the same group across zones.
+//
+// Migration targets are scheduled like any other VM pod, so they're also placed according to the
+// VM's topology.
+
+import (
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// spreadGroupInZone returns the VMs in the spread group that have pods in the availability zone,
+// other than the given VM.
+//
+// This method expects s.lock to be held.
+func (s *pluginState) spreadGroupInZone(group string, zone string, except util.NamespacedName) []util.NamespacedName {
+	var vms []util.NamespacedName
+	for _, pod := range s.pods {
+		if pod.vm == nil || pod.vm.Name == except || pod.node.availabilityZone != zone {
+			continue
+		}
+		if t := pod.vm.Config.Topology; t != nil && t.SpreadGroup == group {
+			vms = append(vms, pod.vm.Name)
+		}
+	}
+	return vms
+}
+
+// topologyRejection returns why the VM can't be placed on the node because of its topology, or the
+// empty string if it can be.
+//
+// This method expects s.lock to be held.
+func (s *pluginState) topologyRejection(vm *api.VmInfo, node *nodeState) string {
+	topology := vm.Config.Topology
+	if topology == nil {
+		return ""
+	}
+
+	if !topology.AllowsZone(node.availabilityZone) {
+		return fmt.Sprintf("node availability zone %q is not one of the VM's required zones", node.availabilityZone)
+	}
+
+	// Nodes without a known zone can't conflict with anything.
+	if topology.RequireSpread && node.availabilityZone != "" {
+		others := s.spreadGroupInZone(topology.SpreadGroup, node.availabilityZone, vm.NamespacedName())
+		if len(others) != 0 {
+			return fmt.Sprintf(
+				"availability zone %q already has VM %v from spread group %q",
+				node.availabilityZone, others[0], topology.SpreadGroup,
+			)
+		}
+	}
+
+	return ""
+}
+
+// applyTopologyPreferences lowers the node's score for each of the VM's topology preferences that
+// it doesn't satisfy, returning the new score and a description of what changed.
+//
+// The score is halved (relative to the minimum) for each unmet preference, and is never lowered to
+// the minimum score, because that's reserved for nodes without room.
+//
+// This method expects s.lock to be held.
+func (s *pluginState) applyTopologyPreferences(vm *api.VmInfo, node *nodeState, score int64) (int64, string) {
+	if vm == nil || vm.Config.Topology == nil {
+		return score, ""
+	}
+	topology := vm.Config.Topology
+
+	var unmet []string
+	if len(topology.PreferredZones) != 0 && !topology.PrefersZone(node.availabilityZone) {
+		unmet = append(unmet, "not in a preferred zone")
+	}
+	if len(topology.PreferredArchitectures) != 0 && !topology.PrefersArchitecture(node.architecture) {
+		unmet = append(unmet, "not a preferred architecture")
+	}
+	if topology.SpreadGroup != "" && !topology.RequireSpread && node.availabilityZone != "" {
+		others := s.spreadGroupInZone(topology.SpreadGroup, node.availabilityZone, vm.NamespacedName())
+		if len(others) != 0 {
+			unmet = append(unmet, fmt.Sprintf("zone has %d other VM(s) from spread group", len(others)))
+		}
+	}
+
+	if len(unmet) == 0 {
+		return score, ""
+	}
+
+	floor := framework.MinNodeScore + 1
+	newScore := util.Max(floor, floor+(score-floor)>>len(unmet))
+	return newScore, fmt.Sprintf("%v => score %d -> %d", unmet, score, newScore)
+}
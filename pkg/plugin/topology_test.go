@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// topologyTestState returns a pluginState with a VM from spread group "group" on node-a, in zone-a
+func topologyTestState() (*pluginState, map[string]*nodeState) {
+	nodes := map[string]*nodeState{
+		"node-a":  {name: "node-a", availabilityZone: "zone-a", architecture: "amd64"}, //nolint:exhaustruct // only the placement matters
+		"node-b":  {name: "node-b", availabilityZone: "zone-b", architecture: "arm64"}, //nolint:exhaustruct // only the placement matters
+		"no-zone": {name: "no-zone", availabilityZone: "", architecture: "amd64"},      //nolint:exhaustruct // only the placement matters
+	}
+
+	existing := util.NamespacedName{Namespace: "default", Name: "primary"}
+	s := &pluginState{ //nolint:exhaustruct // only the pods matter
+		pods: map[util.NamespacedName]*podState{
+			existing: { //nolint:exhaustruct // only the node and VM matter
+				name: existing,
+				node: nodes["node-a"],
+				vm: &vmPodState{ //nolint:exhaustruct // only the name and config matter
+					Name: existing,
+					Config: api.VmConfig{ //nolint:exhaustruct // only the topology matters
+						Topology: &vmapi.VirtualMachineTopology{SpreadGroup: "group"}, //nolint:exhaustruct // only the group matters
+					},
+				},
+			},
+		},
+	}
+	return s, nodes
+}
+
+func topologyTestVM(topology *vmapi.VirtualMachineTopology) *api.VmInfo {
+	return &api.VmInfo{ //nolint:exhaustruct // only the name and topology matter
+		Name:      "replica",
+		Namespace: "default",
+		Config:    api.VmConfig{Topology: topology}, //nolint:exhaustruct // only the topology matters
+	}
+}
+
+func TestTopologyRejection(t *testing.T) {
+	s, nodes := topologyTestState()
+
+	cases := []struct {
+		name     string
+		topology *vmapi.VirtualMachineTopology
+		node     string
+		rejected bool
+	}{
+		{name: "no-topology", topology: nil, node: "node-a", rejected: false},
+		{
+			name:     "required-zone",
+			topology: &vmapi.VirtualMachineTopology{RequiredZones: []string{"zone-b"}}, //nolint:exhaustruct // only the zones matter
+			node:     "node-b",
+			rejected: false,
+		},
+		{
+			name:     "not-required-zone",
+			topology: &vmapi.VirtualMachineTopology{RequiredZones: []string{"zone-b"}}, //nolint:exhaustruct // only the zones matter
+			node:     "node-a",
+			rejected: true,
+		},
+		{
+			name:     "required-spread-conflict",
+			topology: &vmapi.VirtualMachineTopology{SpreadGroup: "group", RequireSpread: true}, //nolint:exhaustruct // only the spread matters
+			node:     "node-a",
+			rejected: true,
+		},
+		{
+			name:     "required-spread-other-zone",
+			topology: &vmapi.VirtualMachineTopology{SpreadGroup: "group", RequireSpread: true}, //nolint:exhaustruct // only the spread matters
+			node:     "node-b",
+			rejected: false,
+		},
+		{
+			name:     "required-spread-unknown-zone",
+			topology: &vmapi.VirtualMachineTopology{SpreadGroup: "group", RequireSpread: true}, //nolint:exhaustruct // only the spread matters
+			node:     "no-zone",
+			rejected: false,
+		},
+		{
+			name:     "required-spread-other-group",
+			topology: &vmapi.VirtualMachineTopology{SpreadGroup: "other", RequireSpread: true}, //nolint:exhaustruct // only the spread matters
+			node:     "node-a",
+			rejected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reason := s.topologyRejection(topologyTestVM(c.topology), nodes[c.node])
+			if c.rejected {
+				assert.NotEmpty(t, reason)
+			} else {
+				assert.Empty(t, reason)
+			}
+		})
+	}
+}
+
+func TestApplyTopologyPreferences(t *testing.T) {
+	s, nodes := topologyTestState()
+
+	cases := []struct {
+		name     string
+		topology *vmapi.VirtualMachineTopology
+		node     string
+		score    int64
+		expected int64
+	}{
+		{name: "no-topology", topology: nil, node: "node-a", score: 81, expected: 81},
+		{
+			name:     "preferred-zone",
+			topology: &vmapi.VirtualMachineTopology{PreferredZones: []string{"zone-a"}}, //nolint:exhaustruct // only the zones matter
+			node:     "node-a",
+			score:    81,
+			expected: 81,
+		},
+		{
+			name:     "not-preferred-zone",
+			topology: &vmapi.VirtualMachineTopology{PreferredZones: []string{"zone-a"}}, //nolint:exhaustruct // only the zones matter
+			node:     "node-b",
+			score:    81,
+			expected: 41,
+		},
+		{
+			name:     "preferred-architecture",
+			topology: &vmapi.VirtualMachineTopology{PreferredArchitectures: []string{"amd64", "arm64"}}, //nolint:exhaustruct // only the architectures matter
+			node:     "node-b",
+			score:    81,
+			expected: 81,
+		},
+		{
+			name:     "not-preferred-architecture",
+			topology: &vmapi.VirtualMachineTopology{PreferredArchitectures: []string{"arm64"}}, //nolint:exhaustruct // only the architectures matter
+			node:     "node-a",
+			score:    81,
+			expected: 41,
+		},
+		{
+			name:     "preferred-spread-conflict",
+			topology: &vmapi.VirtualMachineTopology{SpreadGroup: "group"}, //nolint:exhaustruct // only the spread matters
+			node:     "node-a",
+			score:    81,
+			expected: 41,
+		},
+		{
+			name: "all-unmet",
+			topology: &vmapi.VirtualMachineTopology{ //nolint:exhaustruct // only the preferences matter
+				SpreadGroup:            "group",
+				PreferredZones:         []string{"zone-b"},
+				PreferredArchitectures: []string{"arm64"},
+			},
+			node:     "node-a",
+			score:    81,
+			expected: 11,
+		},
+		{
+			// The score is never lowered to the minimum
+			name:     "floor",
+			topology: &vmapi.VirtualMachineTopology{PreferredZones: []string{"zone-a"}}, //nolint:exhaustruct // only the zones matter
+			node:     "node-b",
+			score:    1,
+			expected: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			score, _ := s.applyTopologyPreferences(topologyTestVM(c.topology), nodes[c.node], c.score)
+			assert.Equal(t, c.expected, score)
+		})
+	}
+}
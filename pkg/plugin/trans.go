@@ -120,17 +120,18 @@ func (r resourceTransitioner[T]) handleLastPermit(lastPermit T) (verdict string)
 // handleRequested updates r.pod and r.node with changes to match the requested resources, within
 // what's possible given the remaining resources.
 //
-// Any permitted increases are required to be a multiple of factor.
+// Any permitted increases are required to be a multiple of factor, and may not take the node's
+// reserved amount above totalReservable, which is normally equal to r.node.Total.
 //
 // A pretty-formatted summary of the outcome is returned as the verdict, for logging.
-func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration bool, factor T) (verdict string) {
+func (r resourceTransitioner[T]) handleRequested(
+	requested T,
+	startingMigration bool,
+	factor T,
+	totalReservable T,
+) (verdict string) {
 	oldState := r.snapshotState()
 
-	totalReservable := r.node.Total
-	// note: it's possible to temporarily have reserved > totalReservable, after loading state or
-	// config change; we have to use SaturatingSub here to account for that.
-	remainingReservable := util.SaturatingSub(totalReservable, oldState.node.Reserved)
-
 	// Note: The correctness of this function depends on the autoscaler-agents and previous
 	// scheduler being well-behaved. This function will fail to prevent overcommitting when:
 	//
@@ -200,9 +201,7 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 		// Please think carefully before changing this.
 
 		increase := requested - r.pod.Reserved
-		// Increases are bounded by what's left in the node, rounded down to the nearest multiple of
-		// the factor.
-		maxIncrease := (remainingReservable / factor) * factor
+		maxIncrease := maxReservableIncrease(oldState.node.Reserved, totalReservable, factor)
 		if increase > maxIncrease /* increases are bound by what's left in the node */ {
 			r.pod.CapacityPressure = increase - maxIncrease
 			// adjust node pressure accordingly. We can have old < new or new > old, so we shouldn't
@@ -254,6 +253,77 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 	return verdict
 }
 
+// maxReservableIncrease returns the largest increase that can be reserved on a node with the
+// reserved amount: what's left below totalReservable, rounded down to the nearest multiple of
+// factor.
+func maxReservableIncrease[T constraints.Unsigned](reserved T, totalReservable T, factor T) T {
+	// note: it's possible to temporarily have reserved > totalReservable, after loading state or
+	// config change; we have to use SaturatingSub here to account for that.
+	return (util.SaturatingSub(totalReservable, reserved) / factor) * factor
+}
+
+// handleRequestedDuringMigration updates r (the migration source) and target (the migration
+// target) to match the requested increase, within what's possible given the remaining resources on
+// *both* nodes.
+//
+// While the migration is ongoing, the increase is double-booked: it's reserved on the source node
+// because the VM is still running there, and on the target node because that's where it will end
+// up. The source node's PressureAccountedFor is also increased to match, because the source pod's
+// reservation is released once the migration completes.
+//
+// NeonVM doesn't apply changes to the VM's resources while it's migrating: the VirtualMachine
+// controller only scales VMs in the Running phase, so the increase is applied on the target once
+// the migration has finished. The target's extra reservation is therefore used, rather than left
+// behind. If the migration fails instead, the target pod is deleted, releasing its reservation with
+// it (see handleDeleted), and the source pod keeps the increase (see handleEndMigration).
+//
+// Requests for less than the current reservation are ignored; the VM can't have been downscaled
+// during the migration.
+//
+// Any permitted increases are required to be a multiple of factor.
+//
+// A pretty-formatted summary of the outcome is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleRequestedDuringMigration(target resourceTransitioner[T], requested T, factor T) (verdict string) {
+	oldState := r.snapshotState()
+	oldTarget := target.snapshotState()
+
+	if requested <= r.pod.Reserved {
+		return fmt.Sprintf("Keeping %d during migration (requested %d)", r.pod.Reserved, requested)
+	}
+
+	remainingSource := util.SaturatingSub(r.node.Total, r.node.Reserved)
+	remainingTarget := util.SaturatingSub(target.node.Total, target.node.Reserved)
+
+	increase := requested - r.pod.Reserved
+	maxIncrease := (util.Min(remainingSource, remainingTarget) / factor) * factor
+	increase = util.Min(increase, maxIncrease)
+
+	r.pod.Reserved += increase
+	r.node.Reserved += increase
+	r.node.PressureAccountedFor += increase
+	target.pod.Reserved += increase
+	target.node.Reserved += increase
+
+	var wanted string
+	if r.pod.Reserved != requested {
+		wanted = fmt.Sprintf(" (wanted %d)", requested)
+	}
+
+	fmtString := "Register %d -> %d%s during migration; " +
+		"source node reserved %d -> %d (of %d, %d -> %d spoken for), " +
+		"target pod reserved %d -> %d, target node reserved %d -> %d (of %d)"
+	verdict = fmt.Sprintf(
+		fmtString,
+		// Register %d -> %d%s during migration
+		oldState.pod.Reserved, r.pod.Reserved, wanted,
+		// source node reserved %d -> %d (of %d, %d -> %d spoken for)
+		oldState.node.Reserved, r.node.Reserved, r.node.Total, oldState.node.PressureAccountedFor, r.node.PressureAccountedFor,
+		// target pod reserved %d -> %d, target node reserved %d -> %d (of %d)
+		oldTarget.pod.Reserved, target.pod.Reserved, oldTarget.node.Reserved, target.node.Reserved, target.node.Total,
+	)
+	return verdict
+}
+
 // handleDeleted updates r.node with changes to match the removal of r.pod
 //
 // A pretty-formatted summary of the changes is returned as the verdict, for logging.
@@ -303,6 +373,33 @@ func (r resourceTransitioner[T]) handleNonAutoscalingUsageChange(newUsage T) (ve
 	return verdict
 }
 
+// handleResumed updates r.pod and r.node to reserve what a VM is using after being resumed from
+// suspension, during which it gave up its reservation.
+//
+// The VM is already using the resources again by the time we hear about it, so they're reserved
+// even if that takes the node above its total.
+//
+// A pretty-formatted summary of the changes is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleResumed(using T) (verdict string) {
+	oldState := r.snapshotState()
+
+	if using <= r.pod.Reserved {
+		return fmt.Sprintf("pod reserved %d already covers resumed usage %d, no changes", r.pod.Reserved, using)
+	}
+
+	r.node.Reserved += using - r.pod.Reserved
+	r.pod.Reserved = using
+
+	verdict = fmt.Sprintf(
+		"pod reserved %d -> %d, node reserved %d -> %d (of %d)",
+		oldState.pod.Reserved, r.pod.Reserved, oldState.node.Reserved, r.node.Reserved, r.node.Total,
+	)
+	if r.node.Reserved > r.node.Total {
+		verdict += fmt.Sprintf(", overcommitted by %d", r.node.Reserved-r.node.Total)
+	}
+	return verdict
+}
+
 // handleAutoscalingDisabled updates r.node with changes to clear any buffer and capacityPressure
 // from r.pod
 //
@@ -374,6 +471,23 @@ func (r resourceTransitioner[T]) handleStartMigration(source bool) (verdict stri
 	return verdict
 }
 
+// handleEndMigration updates r.node to match that r.pod is no longer the source of an ongoing
+// migration, undoing the changes to the node's PressureAccountedFor from handleStartMigration and
+// handleRequestedDuringMigration.
+//
+// A pretty-formatted summary of the changes is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleEndMigration() (verdict string) {
+	oldState := r.snapshotState()
+
+	r.node.PressureAccountedFor = util.SaturatingSub(r.node.PressureAccountedFor, r.pod.Reserved)
+
+	verdict = fmt.Sprintf(
+		"pod reserved %d; node pressureAccountedFor %d -> %d",
+		r.pod.Reserved, oldState.node.PressureAccountedFor, r.node.PressureAccountedFor,
+	)
+	return verdict
+}
+
 func handleUpdatedLimits[T constraints.Unsigned](
 	node *nodeResourceState[T],
 	pod *podResourceState[T],
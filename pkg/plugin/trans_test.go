@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// migrationTestState is the CPU state of both sides of a migration, after it's started
+type migrationTestState struct {
+	sourceNode nodeResourceState[vmapi.MilliCPU]
+	sourcePod  podResourceState[vmapi.MilliCPU]
+	targetNode nodeResourceState[vmapi.MilliCPU]
+	targetPod  podResourceState[vmapi.MilliCPU]
+}
+
+func (s *migrationTestState) source() resourceTransitioner[vmapi.MilliCPU] {
+	return makeResourceTransitioner(&s.sourceNode, &s.sourcePod)
+}
+
+func (s *migrationTestState) target() resourceTransitioner[vmapi.MilliCPU] {
+	return makeResourceTransitioner(&s.targetNode, &s.targetPod)
+}
+
+// newMigrationTestState returns the state for a VM with 1 vCPU, migrating from a node with 2 vCPU
+// free to one with targetFree vCPU free
+func newMigrationTestState(targetFree vmapi.MilliCPU) *migrationTestState {
+	s := new(migrationTestState)
+	s.sourceNode.Total = 8000
+	s.sourceNode.Reserved = 6000
+	s.sourcePod.Reserved = 1000
+	s.sourcePod.Max = 4000
+
+	s.targetNode.Total = 8000
+	s.targetNode.Reserved = 8000 - targetFree
+	s.targetPod.Reserved = 1000
+	s.targetPod.Max = 4000
+
+	// Only the source pod is marked as migrating. The target pod is created as part of the
+	// migration, so it never starts migrating.
+	s.source().handleStartMigration(true)
+	return s
+}
+
+func TestHandleRequestedDuringMigration(t *testing.T) {
+	s := newMigrationTestState(4000)
+	assert.Equal(t, vmapi.MilliCPU(1000), s.sourceNode.PressureAccountedFor)
+
+	// The increase is reserved on both nodes, and the source node expects it to be relieved by the
+	// migration.
+	s.source().handleRequestedDuringMigration(s.target(), 2000, 250)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(7000), s.sourceNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.sourceNode.PressureAccountedFor)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.targetPod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(5000), s.targetNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(0), s.targetNode.PressureAccountedFor)
+
+	// Decreases are ignored
+	s.source().handleRequestedDuringMigration(s.target(), 1000, 250)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.targetPod.Reserved)
+}
+
+func TestHandleRequestedDuringMigrationLimited(t *testing.T) {
+	// The target node has less room than the source node, and the increase is limited to the
+	// multiple of the factor that fits on both.
+	s := newMigrationTestState(1600)
+	s.source().handleRequestedDuringMigration(s.target(), 4000, 250)
+	assert.Equal(t, vmapi.MilliCPU(2500), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(7500), s.sourceNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(2500), s.sourceNode.PressureAccountedFor)
+	assert.Equal(t, vmapi.MilliCPU(2500), s.targetPod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(7900), s.targetNode.Reserved)
+
+	// With no room left for a whole factor on the target node, nothing more is reserved.
+	s.source().handleRequestedDuringMigration(s.target(), 4000, 250)
+	assert.Equal(t, vmapi.MilliCPU(2500), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(2500), s.targetPod.Reserved)
+
+	// The source node limits it in the same way.
+	s = newMigrationTestState(4000)
+	s.source().handleRequestedDuringMigration(s.target(), 4000, 250)
+	assert.Equal(t, vmapi.MilliCPU(3000), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(8000), s.sourceNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(3000), s.targetPod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(6000), s.targetNode.Reserved)
+}
+
+func TestHandleRequestedDuringMigrationRelease(t *testing.T) {
+	// When the migration succeeds, the source pod is deleted, releasing the whole reservation on
+	// the source node, including the increase. The target keeps the increase, because NeonVM
+	// applies it to the target once the migration has finished.
+	s := newMigrationTestState(4000)
+	s.source().handleRequestedDuringMigration(s.target(), 2000, 250)
+	s.source().handleDeleted(true)
+	assert.Equal(t, vmapi.MilliCPU(5000), s.sourceNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(0), s.sourceNode.PressureAccountedFor)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.targetPod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(5000), s.targetNode.Reserved)
+
+	// When the migration fails, the source keeps the increase, but no longer expects it to be
+	// relieved. The target pod is deleted, releasing the increase on the target node.
+	s = newMigrationTestState(4000)
+	s.source().handleRequestedDuringMigration(s.target(), 2000, 250)
+	s.source().handleEndMigration()
+	s.target().handleDeleted(false)
+	assert.Equal(t, vmapi.MilliCPU(2000), s.sourcePod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(7000), s.sourceNode.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(0), s.sourceNode.PressureAccountedFor)
+	assert.Equal(t, vmapi.MilliCPU(3000), s.targetNode.Reserved)
+}
+
+func TestHandleSuspendedAndResumed(t *testing.T) {
+	node := nodeResourceState[vmapi.MilliCPU]{Total: 8000, Reserved: 7000}
+	pod := podResourceState[vmapi.MilliCPU]{Reserved: 1000, Max: 4000}
+	r := makeResourceTransitioner(&node, &pod)
+
+	// While suspended, the VM's CPU is released.
+	r.handleRequested(0, false, 250, node.Total)
+	assert.Equal(t, vmapi.MilliCPU(0), pod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(6000), node.Reserved)
+
+	// ... and taken by another VM in the meantime.
+	node.Reserved = 8000
+
+	// The VM is already using its CPU again once it's resumed, so it's reserved regardless.
+	r.handleResumed(1000)
+	assert.Equal(t, vmapi.MilliCPU(1000), pod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(9000), node.Reserved)
+
+	// Resuming again changes nothing, and neither does the last permit the plugin rewrites to
+	// match.
+	r.handleResumed(1000)
+	r.handleLastPermit(1000)
+	assert.Equal(t, vmapi.MilliCPU(1000), pod.Reserved)
+	assert.Equal(t, vmapi.MilliCPU(9000), node.Reserved)
+
+	// Further increases are still limited by what's left on the node.
+	r.handleRequested(2000, false, 250, node.Total)
+	assert.Equal(t, vmapi.MilliCPU(1000), pod.Reserved)
+}
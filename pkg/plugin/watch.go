@@ -47,6 +47,7 @@ func (e *AutoscaleEnforcer) watchNodeEvents(
 			// FIXME: make these configurable.
 			RetryRelistAfter: util.NewTimeRange(time.Second, 3, 5),
 			RetryWatchAfter:  util.NewTimeRange(time.Second, 3, 5),
+			RetryBackoffMax:  0,
 		},
 		watch.Accessors[*corev1.NodeList, corev1.Node]{
 			Items: func(list *corev1.NodeList) []corev1.Node { return list.Items },
@@ -99,6 +100,7 @@ func (e *AutoscaleEnforcer) watchPodEvents(
 			// FIXME: make these configurable.
 			RetryRelistAfter: util.NewTimeRange(time.Millisecond, 250, 750),
 			RetryWatchAfter:  util.NewTimeRange(time.Millisecond, 250, 750),
+			RetryBackoffMax:  0,
 		},
 		watch.Accessors[*corev1.PodList, corev1.Pod]{
 			Items: func(list *corev1.PodList) []corev1.Pod { return list.Items },
@@ -235,6 +237,7 @@ func (e *AutoscaleEnforcer) watchVMEvents(
 			// FIXME: make these durations configurable.
 			RetryRelistAfter: util.NewTimeRange(time.Millisecond, 250, 750),
 			RetryWatchAfter:  util.NewTimeRange(time.Millisecond, 250, 750),
+			RetryBackoffMax:  0,
 		},
 		watch.Accessors[*vmapi.VirtualMachineList, vmapi.VirtualMachine]{
 			Items: func(list *vmapi.VirtualMachineList) []vmapi.VirtualMachine { return list.Items },
@@ -283,6 +286,8 @@ func (e *AutoscaleEnforcer) watchVMEvents(
 					logger.Error("Failed to extract VM info in update for old VM", util.VMNameFields(oldVM), zap.Error(err))
 					return
 				}
+				reservePinnedCPUs(newInfo)
+				reservePinnedCPUs(oldInfo)
 
 				if newVM.Status.PodName == "" {
 					logger.Info("Skipping update for VM because .status.podName is empty", util.VMNameFields(newVM))
@@ -354,6 +359,7 @@ func (e *AutoscaleEnforcer) watchMigrationEvents(
 			// FIXME: make these durations configurable.
 			RetryRelistAfter: util.NewTimeRange(time.Second, 3, 5),
 			RetryWatchAfter:  util.NewTimeRange(time.Second, 3, 5),
+			RetryBackoffMax:  0,
 		},
 		watch.Accessors[*vmapi.VirtualMachineMigrationList, vmapi.VirtualMachineMigration]{
 			Items: func(list *vmapi.VirtualMachineMigrationList) []vmapi.VirtualMachineMigration { return list.Items },
@@ -0,0 +1,243 @@
+package util
+
+// A swappable source of time, so that code that depends on the current time or on tickers can be
+// tested deterministically, by advancing a FakeClock instead of waiting.
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock gives the current time, and creates tickers and timers based on it
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Ticker is like *time.Ticker, but created by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Timer is like *time.Timer, but created by a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// RealClock is the Clock given by the system time, equivalent to the functions in package time
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{ticker: time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+type realTicker struct{ ticker *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time   { return t.ticker.C }
+func (t realTicker) Reset(d time.Duration) { t.ticker.Reset(d) }
+func (t realTicker) Stop()                 { t.ticker.Stop() }
+
+type realTimer struct{ timer *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.timer.C }
+func (t realTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+func (t realTimer) Stop() bool                 { return t.timer.Stop() }
+
+// FakeClock is a Clock that only moves forward when Advance is called, firing any tickers and
+// timers that are due along the way
+//
+// Like their counterparts in package time, the channels of tickers and timers have a buffer of one
+// element, and ticks are dropped if the receiver hasn't kept up.
+type FakeClock struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	now  time.Time
+
+	// waiters are the active tickers and timers, in no particular order
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+	// period is the interval between ticks for tickers, and zero for timers
+	period time.Duration
+}
+
+// NewFakeClock returns a FakeClock with the time set to start
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{
+		mu:      sync.Mutex{},
+		cond:    nil, // set below
+		now:     start,
+		waiters: nil,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for (*FakeClock).NewTicker")
+	}
+	return fakeTicker{w: c.newWaiter(d, d)}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{w: c.newWaiter(d, 0)}
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.newWaiter(d, 0).c
+}
+
+// Sleep blocks until the clock has been advanced by at least d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) newWaiter(d time.Duration, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &fakeWaiter{
+		clock:    c,
+		c:        make(chan time.Time, 1),
+		deadline: c.now.Add(d),
+		period:   period,
+	}
+	c.scheduleLocked(w)
+	return w
+}
+
+// Advance moves the clock forward by d, firing each ticker and timer that's due, in order of their
+// deadlines
+//
+// Code that's woken by a tick and then calls Now sees the time after the whole advance, so tests
+// that depend on it should advance by one interval at a time.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for _, w := range c.waiters {
+			if !w.deadline.After(target) && (next == nil || w.deadline.Before(next.deadline)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		c.now = next.deadline
+		select {
+		case next.c <- c.now:
+		default:
+		}
+		if next.period != 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			c.removeLocked(next)
+		}
+	}
+	c.now = target
+}
+
+// BlockUntil waits until there are at least n active tickers and timers (including those created
+// by After and Sleep), so that tests can advance the clock only once the code under test is
+// waiting on it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// scheduleLocked adds the waiter, unless it's a timer that's already due, which fires immediately
+func (c *FakeClock) scheduleLocked(w *fakeWaiter) {
+	if w.period == 0 && !w.deadline.After(c.now) {
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		return
+	}
+	c.waiters = append(c.waiters, w)
+	c.cond.Broadcast()
+}
+
+// removeLocked removes the waiter, returning whether it was active
+func (c *FakeClock) removeLocked(w *fakeWaiter) bool {
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.removeLocked(w)
+}
+
+func (w *fakeWaiter) reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	active := w.clock.removeLocked(w)
+	if w.period != 0 {
+		w.period = d
+	}
+	w.deadline = w.clock.now.Add(d)
+	w.clock.scheduleLocked(w)
+	return active
+}
+
+type fakeTicker struct{ w *fakeWaiter }
+
+func (t fakeTicker) C() <-chan time.Time   { return t.w.c }
+func (t fakeTicker) Reset(d time.Duration) { t.w.reset(d) }
+func (t fakeTicker) Stop()                 { t.w.stop() }
+
+type fakeTimer struct{ w *fakeWaiter }
+
+func (t fakeTimer) C() <-chan time.Time        { return t.w.c }
+func (t fakeTimer) Reset(d time.Duration) bool { return t.w.reset(d) }
+func (t fakeTimer) Stop() bool                 { return t.w.stop() }
@@ -0,0 +1,74 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func received(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(start)
+
+	ticker := clock.NewTicker(time.Minute)
+	timer := clock.NewTimer(90 * time.Second)
+
+	clock.Advance(59 * time.Second)
+	_, ok := received(ticker.C())
+	assert.False(t, ok)
+
+	// Ticks carry the time they were due, even if the clock moved past it
+	clock.Advance(2 * time.Second)
+	tick, ok := received(ticker.C())
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Minute), tick)
+	assert.Equal(t, start.Add(61*time.Second), clock.Now())
+
+	clock.Advance(30 * time.Second)
+	fired, ok := received(timer.C())
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(90*time.Second), fired)
+	assert.False(t, timer.Stop())
+
+	// Ticks are dropped if they aren't received, like with time.Ticker
+	clock.Advance(5 * time.Minute)
+	tick, ok = received(ticker.C())
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(2*time.Minute), tick)
+	_, ok = received(ticker.C())
+	assert.False(t, ok)
+
+	// Resetting the ticker restarts it from now, with the new interval
+	ticker.Reset(10 * time.Second)
+	clock.Advance(10 * time.Second)
+	tick, ok = received(ticker.C())
+	assert.True(t, ok)
+	assert.Equal(t, clock.Now(), tick)
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	_, ok = received(ticker.C())
+	assert.False(t, ok)
+
+	// Sleep returns once the clock has been advanced far enough
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Second)
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	<-done
+}
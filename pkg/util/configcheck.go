@@ -0,0 +1,44 @@
+package util
+
+// Shared handling for the 'validate-config' subcommand of the autoscaler-agent and scheduler
+// plugin, so that CI can catch broken configs before they're rolled out.
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ValidateConfigCommand is the name of the subcommand that checks a config file without running
+const ValidateConfigCommand = "validate-config"
+
+// ConfigCheckReport is the JSON output of the 'validate-config' subcommand
+type ConfigCheckReport struct {
+	Path   string   `json:"path"`
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+}
+
+// WriteConfigCheckReport writes the report for the problems found with the config at path,
+// returning the exit code that the process should use: 0 if there were no problems, 1 if there
+// were, or 2 if the report couldn't be written.
+func WriteConfigCheckReport(w io.Writer, path string, errs []error) int {
+	report := ConfigCheckReport{
+		Path:   path,
+		Valid:  len(errs) == 0,
+		Errors: make([]string, 0, len(errs)),
+	}
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return 2
+	}
+
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
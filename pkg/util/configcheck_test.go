@@ -0,0 +1,54 @@
+package util_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestWriteConfigCheckReport(t *testing.T) {
+	cases := []struct {
+		name     string
+		errs     []error
+		code     int
+		expected util.ConfigCheckReport
+	}{
+		{
+			name: "valid",
+			errs: nil,
+			code: 0,
+			expected: util.ConfigCheckReport{
+				Path:   "config.json",
+				Valid:  true,
+				Errors: []string{},
+			},
+		},
+		{
+			name: "invalid",
+			errs: []error{errors.New("first"), errors.New("second")},
+			code: 1,
+			expected: util.ConfigCheckReport{
+				Path:   "config.json",
+				Valid:  false,
+				Errors: []string{"first", "second"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			code := util.WriteConfigCheckReport(&buf, "config.json", c.errs)
+			assert.Equal(t, c.code, code)
+
+			var report util.ConfigCheckReport
+			assert.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+			assert.Equal(t, c.expected, report)
+		})
+	}
+}
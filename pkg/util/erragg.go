@@ -0,0 +1,128 @@
+package util
+
+// Aggregation of repeated errors from hot loops, so that persistent failures don't flood the logs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// OtherErrorKind is the label value used by ErrorAggregator for errors whose kind wasn't provided
+// to NewErrorAggregator
+const OtherErrorKind = "other"
+
+// ErrorAggregator logs errors from hot loops (e.g. repeated requests that are failing), collapsing
+// repeats of the same error into periodic summaries, and counts every error in a prometheus
+// counter.
+//
+// The first occurrence of each error is logged immediately. Further errors with the same kind and
+// root cause (see RootError) are only counted, and then logged as a single summary once the
+// interval has passed, either on the next call to Report or on an explicit call to Flush.
+//
+// ErrorAggregator is safe for concurrent use.
+type ErrorAggregator struct {
+	interval time.Duration
+	// counter is labeled only by the error kind, which is limited to the kinds given to
+	// NewErrorAggregator (plus OtherErrorKind), so that the cardinality is bounded.
+	counter *prometheus.CounterVec
+	kinds   map[string]struct{}
+
+	mu          sync.Mutex
+	windowStart time.Time
+	seen        map[aggregatedErrorKey]*aggregatedError
+}
+
+type aggregatedErrorKey struct {
+	kind  string
+	cause string
+}
+
+type aggregatedError struct {
+	msg     string
+	repeats uint
+	last    error
+}
+
+// NewErrorAggregator creates a new ErrorAggregator that summarizes repeated errors every interval,
+// counting them in the counter.
+//
+// The counter must have exactly one label, which is set to the kind of each error. Kinds that
+// aren't in kinds are counted as OtherErrorKind.
+func NewErrorAggregator(interval time.Duration, counter *prometheus.CounterVec, kinds ...string) *ErrorAggregator {
+	kindSet := make(map[string]struct{})
+	for _, k := range kinds {
+		kindSet[k] = struct{}{}
+		// Initialize the counter, so that it's visible before any errors occur
+		counter.WithLabelValues(k)
+	}
+
+	return &ErrorAggregator{
+		interval:    interval,
+		counter:     counter,
+		kinds:       kindSet,
+		mu:          sync.Mutex{},
+		windowStart: time.Now(),
+		seen:        make(map[aggregatedErrorKey]*aggregatedError),
+	}
+}
+
+// Report records an error of the given kind, logging it with msg unless it's a repeat of a recent
+// error
+func (a *ErrorAggregator) Report(logger *zap.Logger, kind string, msg string, err error) {
+	a.report(time.Now(), logger, kind, msg, err)
+}
+
+// report is separated from its exported version to provide more flexibility around testing.
+func (a *ErrorAggregator) report(now time.Time, logger *zap.Logger, kind string, msg string, err error) {
+	label := kind
+	if _, ok := a.kinds[kind]; !ok {
+		label = OtherErrorKind
+	}
+	a.counter.WithLabelValues(label).Inc()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.windowStart) >= a.interval {
+		a.flush(now, logger)
+	}
+
+	key := aggregatedErrorKey{kind: kind, cause: RootError(err).Error()}
+	if e, ok := a.seen[key]; ok {
+		e.repeats += 1
+		e.last = err
+		return
+	}
+
+	a.seen[key] = &aggregatedError{msg: msg, repeats: 0, last: err}
+	logger.Error(msg, zap.Error(err))
+}
+
+// Flush logs the summaries of all errors repeated since the last flush, and starts a new interval
+func (a *ErrorAggregator) Flush(logger *zap.Logger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.flush(time.Now(), logger)
+}
+
+// NB: must hold mu
+func (a *ErrorAggregator) flush(now time.Time, logger *zap.Logger) {
+	for key, e := range a.seen {
+		if e.repeats != 0 {
+			logger.Error(
+				e.msg+" (repeated)",
+				zap.String("kind", key.kind),
+				zap.Uint("repeats", e.repeats),
+				zap.Duration("period", now.Sub(a.windowStart)),
+				zap.NamedError("lastError", e.last),
+			)
+		}
+	}
+
+	a.seen = make(map[aggregatedErrorKey]*aggregatedError)
+	a.windowStart = now
+}
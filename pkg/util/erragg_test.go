@@ -0,0 +1,59 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestErrorAggregator(t *testing.T) {
+	ts := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	core, logs := observer.New(zap.ErrorLevel)
+	logger := zap.New(core)
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors_total"}, []string{"kind"})
+	agg := NewErrorAggregator(time.Minute, counter, "request")
+	agg.windowStart = ts
+
+	refused := errors.New("connection refused")
+	timeout := errors.New("timed out")
+
+	// The first error is logged, and repeats of it aren't (even with different context)
+	agg.report(ts, logger, "request", "Request failed", fmt.Errorf("Error making request to a: %w", refused))
+	agg.report(ts.Add(time.Second), logger, "request", "Request failed", fmt.Errorf("Error making request to b: %w", refused))
+	agg.report(ts.Add(2*time.Second), logger, "request", "Request failed", fmt.Errorf("Error making request to c: %w", refused))
+	assert.Equal(t, 1, logs.Len())
+
+	// A different root cause is logged separately
+	agg.report(ts.Add(3*time.Second), logger, "request", "Request failed", timeout)
+	assert.Equal(t, 2, logs.Len())
+
+	// Unknown kinds are counted as "other"
+	agg.report(ts.Add(4*time.Second), logger, "unknown", "Something failed", refused)
+	assert.Equal(t, 3, logs.Len())
+
+	assert.Equal(t, 4.0, testutil.ToFloat64(counter.WithLabelValues("request")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues(OtherErrorKind)))
+
+	// After the interval, the next error triggers a summary of the repeats, and is itself logged
+	agg.report(ts.Add(time.Minute), logger, "request", "Request failed", refused)
+	entries := logs.TakeAll()
+	assert.Equal(t, 5, len(entries))
+	summary := entries[3]
+	assert.Equal(t, "Request failed (repeated)", summary.Message)
+	assert.Equal(t, uint64(2), summary.ContextMap()["repeats"])
+	assert.Equal(t, "Error making request to c: connection refused", summary.ContextMap()["lastError"])
+	assert.Equal(t, "Request failed", entries[4].Message)
+
+	// Flushing with no repeats logs nothing
+	agg.Flush(logger)
+	assert.Equal(t, 0, logs.Len())
+}
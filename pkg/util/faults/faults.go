@@ -0,0 +1,222 @@
+// Package faults implements optional fault injection, for testing how the autoscaler-agent handles
+// slow or failing dependencies without needing them to actually misbehave.
+//
+// Faults are described by a scenario file, which gives the faults to inject into each kind of
+// request, and when. For example:
+//
+//	{
+//	  "seed": 42,
+//	  "faults": [
+//	    { "target": "metrics", "vm": "default/example", "probability": 0.5, "error": "connection refused" },
+//	    { "target": "billing", "startAfterSeconds": 60, "durationSeconds": 30, "delayMillis": 5000 }
+//	  ]
+//	}
+//
+// All methods are safe to call on a nil *Injector, which is how fault injection is disabled.
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Target is a kind of request that faults can be injected into
+type Target string
+
+const (
+	// TargetMetrics is requests for metrics from a VM
+	TargetMetrics Target = "metrics"
+	// TargetScheduler is requests to the scheduler plugin
+	TargetScheduler Target = "scheduler"
+	// TargetNeonVM is patches to VirtualMachine objects
+	TargetNeonVM Target = "neonvm"
+	// TargetBilling is pushes of billing events
+	TargetBilling Target = "billing"
+)
+
+func (t Target) valid() bool {
+	switch t {
+	case TargetMetrics, TargetScheduler, TargetNeonVM, TargetBilling:
+		return true
+	default:
+		return false
+	}
+}
+
+// Config enables fault injection
+type Config struct {
+	// ScenarioPath is the path to the scenario file, which is read once on startup
+	ScenarioPath string `json:"scenarioPath"`
+}
+
+// Scenario gives all the faults to inject
+type Scenario struct {
+	// Seed is the seed for deciding whether each fault with a Probability less than 1 is injected,
+	// so that a scenario is repeatable for the same sequence of requests
+	Seed   int64   `json:"seed"`
+	Faults []Fault `json:"faults"`
+}
+
+// Fault is a single fault in a Scenario. Each request may have more than one fault injected into
+// it; their delays are added together, and the first error is returned.
+type Fault struct {
+	// Target is the kind of request to inject the fault into
+	Target Target `json:"target"`
+	// VM, if not empty, limits the fault to requests for the VM with this "namespace/name". It
+	// has no effect for billing, which isn't specific to any VM.
+	VM string `json:"vm,omitempty"`
+	// StartAfterSeconds gives the time after startup that the fault starts being injected
+	StartAfterSeconds uint `json:"startAfterSeconds,omitempty"`
+	// DurationSeconds, if non-zero, gives how long the fault is injected for, after it starts.
+	// Otherwise, it's injected until shutdown.
+	DurationSeconds uint `json:"durationSeconds,omitempty"`
+	// Probability, if non-zero, gives the fraction of requests that the fault is injected into.
+	// Otherwise, it's injected into every request.
+	Probability float64 `json:"probability,omitempty"`
+	// DelayMillis gives how long to delay the request by, in milliseconds
+	DelayMillis uint `json:"delayMillis,omitempty"`
+	// Error, if not empty, makes the request fail with this message, after any delay
+	Error string `json:"error,omitempty"`
+}
+
+// ReadScenario reads and validates the scenario file at the path
+func ReadScenario(path string) (*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening fault injection scenario %q: %w", path, err)
+	}
+	defer file.Close()
+
+	var scenario Scenario
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("Error decoding fault injection scenario %q: %w", path, err)
+	}
+
+	if err := scenario.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid fault injection scenario %q: %w", path, err)
+	}
+	return &scenario, nil
+}
+
+func (s *Scenario) validate() error {
+	var errs []error
+	for i, f := range s.Faults {
+		if !f.Target.valid() {
+			errs = append(errs, fmt.Errorf("unknown target %q for .faults[%d]", f.Target, i))
+		}
+		if f.Probability < 0 || f.Probability > 1 {
+			errs = append(errs, fmt.Errorf("field %q must be between 0 and 1", fmt.Sprintf(".faults[%d].probability", i)))
+		}
+		if f.DelayMillis == 0 && f.Error == "" {
+			errs = append(errs, fmt.Errorf("fields %q and %q cannot both be empty", fmt.Sprintf(".faults[%d].delayMillis", i), fmt.Sprintf(".faults[%d].error", i)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Error is the error returned by Inject for an injected fault
+type Error struct {
+	Target  Target
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("injected %s fault: %s", e.Target, e.Message)
+}
+
+// Injector injects the faults from a Scenario
+type Injector struct {
+	scenario *Scenario
+	start    time.Time
+
+	// mu guards rand, which isn't safe for concurrent use
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewInjector returns an Injector for the scenario, with the time of each fault relative to now
+func NewInjector(scenario *Scenario) *Injector {
+	return &Injector{
+		scenario: scenario,
+		start:    time.Now(),
+		mu:       sync.Mutex{},
+		rand:     rand.New(rand.NewSource(scenario.Seed)),
+	}
+}
+
+// Inject applies any faults for a request of the target kind, waiting for their delay and then
+// returning their error, if any. vm is the "namespace/name" of the VM that the request is for, or
+// empty if it's not for any VM.
+//
+// If the context is canceled during the delay, Inject returns the context's error.
+func (i *Injector) Inject(ctx context.Context, target Target, vm string) error {
+	if i == nil {
+		return nil
+	}
+
+	delay, err := i.faultsFor(target, vm, time.Since(i.start))
+	if delay != 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+// faultsFor returns the total delay and first error of the faults that apply to a request, elapsed
+// time after the Injector was created
+func (i *Injector) faultsFor(target Target, vm string, elapsed time.Duration) (time.Duration, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var delay time.Duration
+	var err error
+	for _, f := range i.scenario.Faults {
+		if f.Target != target || (f.VM != "" && target != TargetBilling && f.VM != vm) {
+			continue
+		}
+
+		start := time.Second * time.Duration(f.StartAfterSeconds)
+		if elapsed < start {
+			continue
+		} else if f.DurationSeconds != 0 && elapsed >= start+time.Second*time.Duration(f.DurationSeconds) {
+			continue
+		}
+
+		if f.Probability != 0 && i.rand.Float64() >= f.Probability {
+			continue
+		}
+
+		delay += time.Millisecond * time.Duration(f.DelayMillis)
+		if err == nil && f.Error != "" {
+			err = &Error{Target: target, Message: f.Error}
+		}
+	}
+	return delay, err
+}
+
+type contextKey struct{}
+
+// WithInjector returns a copy of the context that carries the Injector, for code that's otherwise
+// isolated from the place it's configured
+func WithInjector(ctx context.Context, i *Injector) context.Context {
+	return context.WithValue(ctx, contextKey{}, i)
+}
+
+// FromContext returns the Injector from WithInjector, or nil if there isn't one
+func FromContext(ctx context.Context) *Injector {
+	i, _ := ctx.Value(contextKey{}).(*Injector)
+	return i
+}
@@ -0,0 +1,109 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilInjector(t *testing.T) {
+	var i *Injector
+	require.NoError(t, i.Inject(context.Background(), TargetMetrics, "default/vm"))
+	require.Nil(t, FromContext(context.Background()))
+}
+
+func TestFaultsFor(t *testing.T) {
+	i := NewInjector(&Scenario{
+		Seed: 1,
+		Faults: []Fault{
+			{Target: TargetMetrics, VM: "default/a", StartAfterSeconds: 0, DurationSeconds: 0, Probability: 0, DelayMillis: 0, Error: "refused"},
+			{Target: TargetNeonVM, VM: "", StartAfterSeconds: 10, DurationSeconds: 5, Probability: 0, DelayMillis: 100, Error: ""},
+			{Target: TargetNeonVM, VM: "", StartAfterSeconds: 12, DurationSeconds: 0, Probability: 0, DelayMillis: 50, Error: "conflict"},
+			{Target: TargetBilling, VM: "ignored", StartAfterSeconds: 0, DurationSeconds: 0, Probability: 0, DelayMillis: 0, Error: "unavailable"},
+		},
+	})
+
+	_, err := i.faultsFor(TargetMetrics, "default/a", 0)
+	assert.Equal(t, &Error{Target: TargetMetrics, Message: "refused"}, err)
+	_, err = i.faultsFor(TargetMetrics, "default/b", 0)
+	assert.NoError(t, err)
+	_, err = i.faultsFor(TargetScheduler, "default/a", 0)
+	assert.NoError(t, err)
+
+	// Faults only apply during their window, and their delays add up
+	delay, err := i.faultsFor(TargetNeonVM, "default/a", 9*time.Second)
+	assert.Zero(t, delay)
+	assert.NoError(t, err)
+	delay, err = i.faultsFor(TargetNeonVM, "default/a", 11*time.Second)
+	assert.Equal(t, 100*time.Millisecond, delay)
+	assert.NoError(t, err)
+	delay, err = i.faultsFor(TargetNeonVM, "default/a", 13*time.Second)
+	assert.Equal(t, 150*time.Millisecond, delay)
+	assert.EqualError(t, err, "injected neonvm fault: conflict")
+	delay, _ = i.faultsFor(TargetNeonVM, "default/a", time.Hour)
+	assert.Equal(t, 50*time.Millisecond, delay)
+
+	// Billing faults aren't limited by VM
+	_, err = i.faultsFor(TargetBilling, "", 0)
+	assert.Error(t, err)
+}
+
+func TestProbabilityIsRepeatable(t *testing.T) {
+	run := func() []bool {
+		i := NewInjector(&Scenario{
+			Seed:   42,
+			Faults: []Fault{{Target: TargetScheduler, VM: "", StartAfterSeconds: 0, DurationSeconds: 0, Probability: 0.5, DelayMillis: 0, Error: "timeout"}},
+		})
+		var results []bool
+		for n := 0; n < 100; n++ {
+			_, err := i.faultsFor(TargetScheduler, "", 0)
+			results = append(results, err != nil)
+		}
+		return results
+	}
+
+	first := run()
+	assert.Equal(t, first, run())
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+}
+
+func TestInjectDelay(t *testing.T) {
+	i := NewInjector(&Scenario{
+		Seed:   0,
+		Faults: []Fault{{Target: TargetBilling, VM: "", StartAfterSeconds: 0, DurationSeconds: 0, Probability: 0, DelayMillis: 10_000, Error: ""}},
+	})
+	ctx := WithInjector(context.Background(), i)
+	require.Same(t, i, FromContext(ctx))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := FromContext(ctx).Inject(ctx, TargetBilling, "")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestReadScenario(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+
+	s, err := ReadScenario(write("valid.json", `{"seed": 1, "faults": [{"target": "scheduler", "error": "oops"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []Fault{{Target: TargetScheduler, VM: "", StartAfterSeconds: 0, DurationSeconds: 0, Probability: 0, DelayMillis: 0, Error: "oops"}}, s.Faults)
+
+	_, err = ReadScenario(write("target.json", `{"faults": [{"target": "monitor", "error": "oops"}]}`))
+	assert.ErrorContains(t, err, `unknown target "monitor"`)
+	_, err = ReadScenario(write("empty.json", `{"faults": [{"target": "metrics"}]}`))
+	assert.ErrorContains(t, err, "cannot both be empty")
+	_, err = ReadScenario(write("unknown.json", `{"faults": [], "extra": true}`))
+	assert.Error(t, err)
+}
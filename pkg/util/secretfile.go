@@ -0,0 +1,43 @@
+package util
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile returns the contents of a file with a token or key, without any surrounding
+// whitespace.
+//
+// Secret files are read each time the secret is used, rather than once at startup, so that they can
+// be rotated (e.g. by updating the Secret they're mounted from) without restarting. So, every field
+// in the config that gives the path to one should be passed here on each use.
+func ReadSecretFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading file: %w", err)
+	}
+	secret := strings.TrimSpace(string(contents))
+	if secret == "" {
+		return "", errors.New("File is empty")
+	}
+	return secret, nil
+}
+
+// CheckBearerToken returns an error, with the HTTP status code to respond with, if the request
+// doesn't present the token stored in tokenFile
+func CheckBearerToken(r *http.Request, tokenFile string) (int, error) {
+	expected, err := ReadSecretFile(tokenFile)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Error reading bearer token: %w", err)
+	}
+
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		return http.StatusUnauthorized, errors.New("unauthorized")
+	}
+	return 0, nil
+}
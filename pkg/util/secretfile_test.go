@@ -0,0 +1,77 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret")
+
+	_, err := ReadSecretFile(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("  token\n"), 0o600))
+	secret, err := ReadSecretFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "token", secret)
+
+	// Changes to the file are picked up on the next read
+	require.NoError(t, os.WriteFile(path, []byte("rotated"), 0o600))
+	secret, err = ReadSecretFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", secret)
+
+	require.NoError(t, os.WriteFile(path, []byte("\n\t \n"), 0o600))
+	_, err = ReadSecretFile(path)
+	assert.ErrorContains(t, err, "empty")
+}
+
+func TestCheckBearerToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	request := func(auth string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	cases := []struct {
+		name      string
+		auth      string
+		tokenFile string
+		code      int
+	}{
+		{name: "correct", auth: "Bearer secret", tokenFile: tokenFile, code: 0},
+		{name: "missing", auth: "", tokenFile: tokenFile, code: http.StatusUnauthorized},
+		{name: "wrong", auth: "Bearer other", tokenFile: tokenFile, code: http.StatusUnauthorized},
+		{name: "not-bearer", auth: "Basic secret", tokenFile: tokenFile, code: http.StatusUnauthorized},
+		{name: "prefix", auth: "Bearer secre", tokenFile: tokenFile, code: http.StatusUnauthorized},
+		// If the token can't be read, nothing is allowed
+		{name: "no-token-file", auth: "Bearer secret", tokenFile: filepath.Join(dir, "missing"), code: http.StatusInternalServerError},
+		{name: "token-file-unset", auth: "Bearer ", tokenFile: "", code: http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, err := CheckBearerToken(request(c.auth), c.tokenFile)
+			assert.Equal(t, c.code, code)
+			if c.code == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -33,3 +33,24 @@ func (r TimeRange) Random() time.Duration {
 	count := rand.Intn(r.max-r.min) + r.min
 	return time.Duration(count) * r.units
 }
+
+// TimeOfDayLayout is the format of times of day given by ParseTimeOfDay, e.g. "09:00"
+const TimeOfDayLayout = "15:04"
+
+// ParseTimeOfDay returns the time since midnight given by the string, formatted like
+// TimeOfDayLayout
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse(TimeOfDayLayout, s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// TimeOfDay returns the wall clock time of t as the time since midnight, in t's location
+//
+// On days with a daylight saving transition, this differs from the actual time elapsed since
+// midnight, but matches times of day given by ParseTimeOfDay.
+func TimeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
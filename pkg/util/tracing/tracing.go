@@ -0,0 +1,139 @@
+// Package tracing sets up OpenTelemetry tracing for our components: spans are batched and
+// exported to an OTLP/HTTP collector, and the trace context is propagated between components with
+// W3C trace context headers on HTTP requests.
+//
+// Components create spans with the go.opentelemetry.io/otel/trace API, using the Tracer from the
+// TracerProvider returned by NewTracerProvider. If tracing isn't enabled, that's a no-op provider.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Config configures the export of spans to an OpenTelemetry collector
+type Config struct {
+	// Endpoint is the base URL of the collector's OTLP/HTTP receiver, like
+	// "http://otel-collector:4318". Spans are sent to the /v1/traces path.
+	Endpoint string `json:"endpoint"`
+	// SampleFraction gives the fraction of new traces that are recorded, from 0 to 1. Spans that
+	// continue a trace from another component follow the sampling decision made there.
+	SampleFraction float64 `json:"sampleFraction"`
+	// ExportIntervalSeconds gives how often finished spans are sent to the collector
+	ExportIntervalSeconds uint `json:"exportIntervalSeconds"`
+	// MaxQueueSize gives the maximum number of finished spans waiting to be exported. Spans
+	// finished while the queue is full are dropped.
+	MaxQueueSize uint `json:"maxQueueSize"`
+}
+
+// NewTracerProvider returns a TracerProvider for the service that exports spans as configured, or
+// a no-op TracerProvider if conf is nil.
+//
+// Spans are exported in the background. Run must be called to export any remaining spans on
+// shutdown.
+func NewTracerProvider(ctx context.Context, conf *Config, serviceName string) (trace.TracerProvider, error) {
+	if conf == nil {
+		return trace.NewNoopTracerProvider(), nil
+	}
+
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing endpoint: %w", err)
+	} else if endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("Endpoint %q is not an http:// or https:// URL", conf.Endpoint)
+	}
+
+	opts := []otlphttp.Option{otlphttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlphttp.WithInsecure())
+	}
+	exporter, err := otlp.NewExporter(ctx, otlphttp.NewDriver(opts...))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceNameKey.String(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(
+			exporter,
+			sdktrace.WithBatchTimeout(time.Second*time.Duration(conf.ExportIntervalSeconds)),
+			sdktrace.WithMaxQueueSize(int(conf.MaxQueueSize)),
+		),
+		// Continue the sampling decision from other components, only sampling new traces by the
+		// configured fraction.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleFraction))),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// Run waits until the context is canceled and then shuts down the TracerProvider, exporting any
+// remaining spans. Errors from exporting spans are logged in the meantime.
+//
+// Run returns immediately if the TracerProvider is a no-op.
+func Run(ctx context.Context, logger *zap.Logger, provider trace.TracerProvider) {
+	sdkProvider, ok := provider.(*sdktrace.TracerProvider)
+	if !ok {
+		return
+	}
+
+	otel.SetErrorHandler(errorHandler{logger: logger})
+
+	<-ctx.Done()
+
+	// Use a fresh context for the final export, so that spans from shutting down aren't lost.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sdkProvider.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to export remaining spans", zap.Error(err))
+	}
+}
+
+// errorHandler is an otel.ErrorHandler that logs errors, e.g. from failing to export spans
+type errorHandler struct {
+	logger *zap.Logger
+}
+
+func (h errorHandler) Handle(err error) {
+	h.logger.Error("OpenTelemetry error", zap.Error(err))
+}
+
+// RecordError records the error on the span and marks the span as failed, if err is not nil
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject adds the current span in the context to the headers of an outgoing HTTP request, so that
+// the receiver's spans are part of the same trace
+func Inject(ctx context.Context, header http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Extract returns a context with the span from the headers of an incoming HTTP request as the
+// current (remote) span, so that spans started from it are part of the sender's trace.
+//
+// If the headers don't have a valid span, the context is returned unchanged.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+}
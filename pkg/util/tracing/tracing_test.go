@@ -0,0 +1,83 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/neondatabase/autoscaling/pkg/util/tracing"
+)
+
+func TestDisabledIsNoop(t *testing.T) {
+	provider, err := tracing.NewTracerProvider(context.Background(), nil, "test")
+	require.NoError(t, err)
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "span")
+	require.False(t, span.IsRecording())
+	span.End()
+
+	// The span isn't real, so there's nothing to propagate
+	header := http.Header{}
+	tracing.Inject(ctx, header)
+	require.Empty(t, header)
+
+	// ... and Run has nothing to wait for
+	tracing.Run(context.Background(), nil, provider)
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "otel-collector:4318", "grpc://otel-collector:4317", "http://"} {
+		conf := &tracing.Config{
+			Endpoint:              endpoint,
+			SampleFraction:        1,
+			ExportIntervalSeconds: 1,
+			MaxQueueSize:          10,
+		}
+		_, err := tracing.NewTracerProvider(context.Background(), conf, "test")
+		require.Error(t, err, "endpoint %q", endpoint)
+	}
+}
+
+// spanWithContext is a non-recording span with a fixed SpanContext, standing in for a span started
+// by the SDK
+type spanWithContext struct {
+	trace.Span
+	sc trace.SpanContext
+}
+
+func (s spanWithContext) SpanContext() trace.SpanContext {
+	return s.sc
+}
+
+func TestPropagation(t *testing.T) {
+	traceID, err := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("b7ad6b7169203331")
+	require.NoError(t, err)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		TraceState: trace.TraceState{},
+		Remote:     false,
+	})
+	span := spanWithContext{Span: trace.SpanFromContext(context.Background()), sc: sc}
+
+	header := http.Header{}
+	tracing.Inject(trace.ContextWithSpan(context.Background(), span), header)
+	require.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", header.Get("traceparent"))
+
+	// The receiver's spans continue the trace, with the sender's span as their parent
+	received := trace.RemoteSpanContextFromContext(tracing.Extract(context.Background(), header))
+	require.True(t, received.IsRemote())
+	require.Equal(t, sc.TraceID(), received.TraceID())
+	require.Equal(t, sc.SpanID(), received.SpanID())
+	require.True(t, received.IsSampled())
+
+	// Invalid headers leave the context unchanged
+	header.Set("traceparent", "00-00000000000000000000000000000000-b7ad6b7169203331-01")
+	require.False(t, trace.RemoteSpanContextFromContext(tracing.Extract(context.Background(), header)).IsValid())
+}
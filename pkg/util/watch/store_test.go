@@ -0,0 +1,269 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// errInjected is returned by fakeClient for the calls that it's configured to fail
+var errInjected = errors.New("injected failure")
+
+// fakeClient is a Client for pods, failing the configured number of calls to List and Watch, and
+// returning the current set of pods otherwise
+type fakeClient struct {
+	mu       sync.Mutex
+	pods     []corev1.Pod
+	lists    int
+	watches  int
+	watchers []*watch.FakeWatcher
+
+	listFailures  int
+	watchFailures int
+}
+
+func newFakeClient(pods ...corev1.Pod) *fakeClient {
+	return &fakeClient{
+		mu:            sync.Mutex{},
+		pods:          pods,
+		lists:         0,
+		watches:       0,
+		watchers:      nil,
+		listFailures:  0,
+		watchFailures: 0,
+	}
+}
+
+func (c *fakeClient) List(context.Context, metav1.ListOptions) (*corev1.PodList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lists += 1
+	if c.listFailures > 0 {
+		c.listFailures -= 1
+		return nil, errInjected
+	}
+	return &corev1.PodList{ //nolint:exhaustruct // only the items are used
+		Items: append([]corev1.Pod{}, c.pods...),
+	}, nil
+}
+
+func (c *fakeClient) Watch(context.Context, metav1.ListOptions) (watch.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.watches += 1
+	if c.watchFailures > 0 {
+		c.watchFailures -= 1
+		return nil, errInjected
+	}
+	w := watch.NewFake()
+	c.watchers = append(c.watchers, w)
+	return w, nil
+}
+
+func (c *fakeClient) set(f func(c *fakeClient)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c)
+}
+
+func (c *fakeClient) counts() (lists int, watches int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lists, c.watches
+}
+
+// stopWatcher ends the most recent watch, as if the API server had closed it
+func (c *fakeClient) stopWatcher() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watchers[len(c.watchers)-1].Stop()
+}
+
+func makePod(name string) corev1.Pod {
+	return corev1.Pod{ //nolint:exhaustruct // only the metadata is used
+		ObjectMeta: metav1.ObjectMeta{ //nolint:exhaustruct // only the name and UID are used
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID(name),
+		},
+	}
+}
+
+func startWatch(t *testing.T, ctx context.Context, client *fakeClient, config Config) *Store[corev1.Pod] {
+	config.ObjectNameLogField = "pod"
+	config.Metrics = MetricsConfig{Metrics: NewMetrics("test_watchers"), Instance: t.Name()}
+	store, err := Watch(
+		ctx,
+		zap.NewNop(),
+		client,
+		config,
+		Accessors[*corev1.PodList, corev1.Pod]{
+			Items: func(list *corev1.PodList) []corev1.Pod { return list.Items },
+		},
+		InitModeSync,
+		metav1.ListOptions{}, //nolint:exhaustruct // no options are needed
+		HandlerFuncs[*corev1.Pod]{AddFunc: nil, UpdateFunc: nil, DeleteFunc: nil},
+	)
+	require.NoError(t, err)
+	return store
+}
+
+func waitDone[T any](t *testing.T, store *Store[T]) {
+	select {
+	case <-store.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the store to stop")
+	}
+}
+
+func itemNames(store *Store[corev1.Pod]) []string {
+	var names []string
+	for _, pod := range store.Items() {
+		names = append(names, pod.Name)
+	}
+	return names
+}
+
+func TestMaxConsecutiveFailures(t *testing.T) {
+	retry := util.NewTimeRange(time.Millisecond, 1, 1)
+
+	t.Run("re-watch", func(t *testing.T) {
+		client := newFakeClient(makePod("a"))
+		store := startWatch(t, context.Background(), client, Config{ //nolint:exhaustruct // no relisting
+			RetryWatchAfter:        retry,
+			MaxConsecutiveFailures: 3,
+		})
+
+		client.set(func(c *fakeClient) { c.watchFailures = 100 })
+		client.stopWatcher()
+		waitDone(t, store)
+
+		// Only the re-watches count as failures, so it's the initial watch plus three more
+		_, watches := client.counts()
+		assert.Equal(t, 4, watches)
+		assert.True(t, store.Stopped())
+		assert.True(t, store.Failing())
+		assert.Equal(t, 3, store.ConsecutiveFailures())
+	})
+
+	t.Run("relist", func(t *testing.T) {
+		client := newFakeClient(makePod("a"))
+		store := startWatch(t, context.Background(), client, Config{ //nolint:exhaustruct // no re-watching
+			RetryRelistAfter:       retry,
+			MaxConsecutiveFailures: 2,
+		})
+
+		client.set(func(c *fakeClient) { c.listFailures = 100 })
+		store.Relist()
+		waitDone(t, store)
+
+		lists, _ := client.counts()
+		assert.Equal(t, 3, lists)
+		assert.Equal(t, 2, store.ConsecutiveFailures())
+		// The store keeps the last objects it saw
+		assert.Equal(t, []string{"a"}, itemNames(store))
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		client := newFakeClient()
+		store := startWatch(t, context.Background(), client, Config{ //nolint:exhaustruct // no relisting
+			RetryWatchAfter:        retry,
+			MaxConsecutiveFailures: 3,
+		})
+		defer store.Stop()
+
+		// Two failures in a row, and then success: the count starts again from zero, so the store
+		// keeps going.
+		client.set(func(c *fakeClient) { c.watchFailures = 2 })
+		client.stopWatcher()
+		require.Eventually(t, func() bool {
+			_, watches := client.counts()
+			return watches == 4 && !store.Failing()
+		}, 5*time.Second, time.Millisecond)
+		assert.Equal(t, 0, store.ConsecutiveFailures())
+		assert.False(t, store.Stopped())
+		select {
+		case <-store.Done():
+			t.Fatal("store stopped after recovering")
+		default:
+		}
+	})
+}
+
+func TestResyncPeriod(t *testing.T) {
+	client := newFakeClient(makePod("a"))
+	store := startWatch(t, context.Background(), client, Config{ //nolint:exhaustruct // no retrying
+		ResyncPeriod: 10 * time.Millisecond,
+	})
+	defer store.Stop()
+	assert.Equal(t, []string{"a"}, itemNames(store))
+
+	// Changes that the watch missed are picked up by the next resync, even though the watch itself
+	// never fails.
+	client.set(func(c *fakeClient) { c.pods = []corev1.Pod{makePod("b")} })
+	require.Eventually(t, func() bool {
+		names := itemNames(store)
+		return len(names) == 1 && names[0] == "b"
+	}, 5*time.Second, time.Millisecond)
+
+	lists, watches := client.counts()
+	assert.GreaterOrEqual(t, lists, 2)
+	// Each resync restarts the watch
+	assert.GreaterOrEqual(t, watches, lists)
+	assert.False(t, store.Failing())
+}
+
+func TestStoreDone(t *testing.T) {
+	t.Run("stopped", func(t *testing.T) {
+		client := newFakeClient()
+		store := startWatch(t, context.Background(), client, Config{}) //nolint:exhaustruct // defaults are fine
+
+		select {
+		case <-store.Done():
+			t.Fatal("store stopped before Stop was called")
+		default:
+		}
+		store.Stop()
+		waitDone(t, store)
+		assert.True(t, store.Stopped())
+		// Stopping again doesn't panic from closing the channel twice
+		store.Stop()
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		client := newFakeClient()
+		ctx, cancel := context.WithCancel(context.Background())
+		store := startWatch(t, ctx, client, Config{}) //nolint:exhaustruct // defaults are fine
+
+		cancel()
+		waitDone(t, store)
+		assert.True(t, store.Stopped())
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		client := newFakeClient()
+		store := startWatch(t, context.Background(), client, Config{}) //nolint:exhaustruct // no retrying
+
+		// Without RetryWatchAfter, the first failed re-watch stops the store
+		client.set(func(c *fakeClient) { c.watchFailures = 1 })
+		client.stopWatcher()
+		waitDone(t, store)
+		_, watches := client.counts()
+		assert.Equal(t, 2, watches)
+	})
+}
@@ -49,6 +49,29 @@ type Config struct {
 	// RetryWatchAfter gives a retry interval when a non-initial watch fails. If left nil, then
 	// Watch will not retry.
 	RetryWatchAfter *util.TimeRange
+	// RetryBackoffMax, if non-zero, makes retries back off exponentially while the API server
+	// keeps failing: each consecutive failed re-list or re-watch doubles the delay given by
+	// RetryRelistAfter or RetryWatchAfter, up to this maximum.
+	RetryBackoffMax time.Duration
+	// MaxConsecutiveFailures, if non-zero, gives the number of consecutive failed re-lists or
+	// re-watches after which Watch gives up and stops the store. If zero, Watch retries forever.
+	MaxConsecutiveFailures int
+	// ResyncPeriod, if non-zero, makes Watch periodically re-list, so that the store recovers from
+	// any events that were missed or mishandled without waiting for the watch to fail.
+	ResyncPeriod time.Duration
+}
+
+// retryDelay returns how long to wait before retrying, after the given number of consecutive
+// failures (including the latest)
+func (c Config) retryDelay(base *util.TimeRange, failures int) time.Duration {
+	delay := base.Random()
+	if c.RetryBackoffMax == 0 {
+		return delay
+	}
+	for i := 1; i < failures && delay < c.RetryBackoffMax; i++ {
+		delay *= 2
+	}
+	return util.Min(delay, c.RetryBackoffMax)
 }
 
 // Accessors provides the "glue" functions for Watch to go from a list L (returned by the
@@ -164,8 +187,11 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 		nextIndexID:   0,
 		indexes:       make(map[uint64]Index[T]),
 		stopSignal:    sendStop,
+		stopOnce:      sync.Once{},
+		done:          make(chan struct{}),
 		stopped:       atomic.Bool{},
 		failing:       atomic.Bool{},
+		failures:      atomic.Int64{},
 	}
 
 	items := accessors.Items(initialList)
@@ -212,9 +238,12 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 		}()
 
 		// note: instead of deferring watcher.Stop() directly, wrapping it in an outer function
-		// means that we'll always Stop the most recent watcher.
+		// means that we'll always Stop the most recent watcher. It's nil if the last re-watch
+		// failed.
 		defer func() {
-			watcher.Stop()
+			if watcher != nil {
+				watcher.Stop()
+			}
 		}()
 
 		// explicitly stop on exit so that it's possible to know when the store is stopped
@@ -249,6 +278,14 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 
 		logger.Info("All setup complete, entering event loop")
 
+		// resync is nil if periodic resyncs aren't enabled, which blocks forever in the select below
+		var resync <-chan time.Time
+		if config.ResyncPeriod != 0 {
+			resyncTicker := time.NewTicker(config.ResyncPeriod)
+			defer resyncTicker.Stop()
+			resync = resyncTicker.C
+		}
+
 		for {
 			// this is used exclusively for relisting, but must be defined up here so that our gotos
 			// don't jump over variables.
@@ -264,6 +301,9 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 				case <-store.triggerRelist:
 					config.Metrics.relistRequested()
 					goto relist
+				case <-resync:
+					logger.Info("Periodic resync")
+					goto relist
 				case event, ok := <-watcher.ResultChan():
 					if !ok {
 						logger.Info("Watcher ended gracefully, restarting")
@@ -344,7 +384,7 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 			watcher.Stop()
 
 			logger.Info("Relisting")
-			for first := true; ; first = false {
+			for first, failures := true, 0; ; first = false {
 				func() {
 					store.mutex.Lock()
 					defer store.mutex.Unlock()
@@ -379,12 +419,19 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 						logger.Info("Ending: because relist failed and RetryWatchAfter is nil")
 						return
 					}
-					retryAfter := config.RetryRelistAfter.Random()
-					logger.Info("Retrying relist after delay", zap.Duration("delay", retryAfter))
-
+					failures += 1
 					store.failing.Store(true)
+					store.failures.Store(int64(failures))
 					config.Metrics.failing()
 
+					if config.MaxConsecutiveFailures != 0 && failures >= config.MaxConsecutiveFailures {
+						logger.Error("Ending: because relist failed too many times in a row", zap.Int("failures", failures))
+						return
+					}
+
+					retryAfter := config.retryDelay(config.RetryRelistAfter, failures)
+					logger.Info("Retrying relist after delay", zap.Duration("delay", retryAfter))
+
 					select {
 					case <-time.After(retryAfter):
 						logger.Info("Relist delay reached, retrying", zap.Duration("delay", retryAfter))
@@ -399,6 +446,7 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 				}
 
 				store.failing.Store(false)
+				store.failures.Store(0)
 				config.Metrics.unfailing()
 
 				// err == nil, process relistList
@@ -472,7 +520,7 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 			// It's possible that we attempt to watch with a resource version that's too old, in
 			// which case the API call *does* succeed, but the first event is an error (which we use
 			// to trigger relisting).
-			for {
+			for failures := 0; ; {
 				config.Metrics.startWatch()
 				watcher, err = client.Watch(ctx, watchOpts)
 				config.Metrics.doneWatch(err)
@@ -482,12 +530,19 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 						logger.Info("Ending: because re-watch failed and RetryWatchAfter is nil")
 						return
 					}
-					retryAfter := config.RetryWatchAfter.Random()
-					logger.Info("Retrying re-watch after delay", zap.Duration("delay", retryAfter))
-
+					failures += 1
 					store.failing.Store(true)
+					store.failures.Store(int64(failures))
 					config.Metrics.failing()
 
+					if config.MaxConsecutiveFailures != 0 && failures >= config.MaxConsecutiveFailures {
+						logger.Error("Ending: because re-watch failed too many times in a row", zap.Int("failures", failures))
+						return
+					}
+
+					retryAfter := config.retryDelay(config.RetryWatchAfter, failures)
+					logger.Info("Retrying re-watch after delay", zap.Duration("delay", retryAfter))
+
 					select {
 					case <-time.After(retryAfter):
 						logger.Info("Re-watch delay reached, retrying", zap.Duration("delay", retryAfter))
@@ -503,6 +558,7 @@ func Watch[C Client[L], L metav1.ListMetaAccessor, T any, P Object[T]](
 
 				// err == nil
 				store.failing.Store(false)
+				store.failures.Store(0)
 				config.Metrics.unfailing()
 				break
 			}
@@ -593,8 +649,13 @@ type Store[T any] struct {
 	indexes     map[uint64]Index[T]
 
 	stopSignal util.SignalSender[struct{}]
-	stopped    atomic.Bool
-	failing    atomic.Bool
+	stopOnce   sync.Once
+	// done is closed when the store is stopped
+	done    chan struct{}
+	stopped atomic.Bool
+	failing atomic.Bool
+	// failures gives the number of consecutive failed re-lists or re-watches, while failing
+	failures atomic.Int64
 }
 
 // Relist triggers re-listing the WatchStore, returning a channel that will be closed once the
@@ -620,12 +681,25 @@ func (w *Store[T]) Relist() <-chan struct{} {
 func (w *Store[T]) Stop() {
 	w.stopSignal.Send(struct{}{})
 	w.stopped.Store(true)
+	w.stopOnce.Do(func() { close(w.done) })
+}
+
+// Done returns a channel that's closed once the store has stopped, either because Stop was called,
+// the context passed to Watch was canceled, or Watch gave up after too many failures.
+func (w *Store[T]) Done() <-chan struct{} {
+	return w.done
 }
 
 func (w *Store[T]) Failing() bool {
 	return w.failing.Load()
 }
 
+// ConsecutiveFailures returns the number of consecutive failed re-lists or re-watches, which is
+// zero unless the store is failing
+func (w *Store[T]) ConsecutiveFailures() int {
+	return int(w.failures.Load())
+}
+
 func (w *Store[T]) Stopped() bool {
 	return w.stopped.Load()
 }
@@ -0,0 +1,37 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestRetryDelay(t *testing.T) {
+	base := util.NewTimeRange(time.Second, 2, 2)
+
+	cases := []struct {
+		name     string
+		max      time.Duration
+		failures int
+		expected time.Duration
+	}{
+		{name: "no-backoff", max: 0, failures: 5, expected: 2 * time.Second},
+		{name: "first-failure", max: time.Minute, failures: 1, expected: 2 * time.Second},
+		{name: "second-failure", max: time.Minute, failures: 2, expected: 4 * time.Second},
+		{name: "fourth-failure", max: time.Minute, failures: 4, expected: 16 * time.Second},
+		{name: "capped", max: time.Minute, failures: 10, expected: time.Minute},
+		{name: "max-below-base", max: time.Second, failures: 1, expected: time.Second},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := Config{ //nolint:exhaustruct // only the backoff is used
+				RetryBackoffMax: c.max,
+			}
+			assert.Equal(t, c.expected, config.retryDelay(base, c.failures))
+		})
+	}
+}